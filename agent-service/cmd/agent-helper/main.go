@@ -0,0 +1,126 @@
+// agent-helper runs the commands the unprivileged agent needs root for. It is installed
+// setuid root and executable only by the agent's group:
+//
+//	install -o root -g hysteria2-agent -m 4750 agent-helper /usr/local/libexec/hysteria2-agent/agent-helper
+//
+//	agent-helper <command> [args...]                      run an allowlisted command as root
+//	agent-helper write-file <path> <mode>                 write stdin to an allowlisted file
+//	agent-helper remove-file <path>                       remove an allowlisted file
+//	agent-helper install-service <init> <service> [...]   render and enable one of the agent's services
+//	agent-helper start-service|stop-service|reload-service <service>
+//	                                                      supervise a service without an init system
+//	agent-helper install-cron-job|remove-cron-job <cron.d|crontab> <job>
+//	                                                      manage one of the agent's cron jobs
+//	agent-helper add-repository apt <codename> [<fingerprint>] | rpm
+//	                                                      configure the WARP client repository
+//	agent-helper install-certificate <domain> <cert file> <key file>
+//	                                                      copy a Let's Encrypt certificate and key into
+//	                                                      the agent's certificate directory
+//
+// Every request, allowed or refused, is appended to the audit log.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"hysteria2_microservices/agent-service/internal/privsep"
+)
+
+const (
+	auditLog     = "/var/log/hysteria2-agent/helper-audit.log"
+	exitRefused  = 126
+	exitFailed   = 1
+	exitUsage    = 2
+	trustedPaths = "/usr/sbin:/usr/bin:/sbin:/bin:/usr/local/sbin:/usr/local/bin"
+)
+
+type auditRecord struct {
+	Time    string   `json:"time"`
+	UID     int      `json:"uid"`
+	PPID    int      `json:"ppid"`
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+	Allowed bool     `json:"allowed"`
+	Error   string   `json:"error,omitempty"`
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: agent-helper <command> [args...]")
+		os.Exit(exitUsage)
+	}
+	name, args := os.Args[1], os.Args[2:]
+
+	path, err := privsep.Check(name, args)
+	audit(name, args, err)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "agent-helper: refused: %v\n", err)
+		os.Exit(exitRefused)
+	}
+
+	// Become root in full, so commands that check the real user see root too
+	if err := syscall.Setgid(0); err == nil {
+		err = syscall.Setuid(0)
+	}
+	if err != nil {
+		fail(fmt.Errorf("failed to become root, is the helper setuid root? %w", err))
+	}
+
+	// A clean environment: nothing the agent sets, such as SSL_CERT_FILE or a proxy, reaches
+	// a root command or the helper's own downloads
+	env := []string{"PATH=" + trustedPaths, "LANG=C", "DEBIAN_FRONTEND=noninteractive"}
+	os.Clearenv()
+	for _, kv := range env {
+		key, value, _ := strings.Cut(kv, "=")
+		os.Setenv(key, value)
+	}
+
+	if privsep.Builtin(path) {
+		fail(privsep.Run(path, args, os.Stdin))
+		return
+	}
+	fail(syscall.Exec(path, append([]string{path}, args...), env))
+}
+
+// audit appends the request to the audit log; a request that cannot be audited is refused
+func audit(name string, args []string, checkErr error) {
+	record := auditRecord{
+		Time:    time.Now().UTC().Format(time.RFC3339Nano),
+		UID:     os.Getuid(),
+		PPID:    os.Getppid(),
+		Command: name,
+		Args:    args,
+		Allowed: checkErr == nil,
+	}
+	if checkErr != nil {
+		record.Error = checkErr.Error()
+	}
+	line, _ := json.Marshal(record)
+
+	err := os.MkdirAll(filepath.Dir(auditLog), 0750)
+	if err == nil {
+		var file *os.File
+		if file, err = os.OpenFile(auditLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600); err == nil {
+			_, err = file.Write(append(line, '\n'))
+			file.Close()
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "agent-helper: refused: audit log: %v\n", err)
+		os.Exit(exitRefused)
+	}
+}
+
+func fail(err error) {
+	if err == nil {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "agent-helper: %v\n", err)
+	os.Exit(exitFailed)
+}
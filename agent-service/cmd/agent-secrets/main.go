@@ -0,0 +1,91 @@
+// agent-secrets manages the node key that agent config secrets are sealed to.
+//
+//	agent-secrets keygen [-key file]                 create the node key and print its public key
+//	agent-secrets pubkey [-key file]                 print the public key
+//	agent-secrets seal [-key file | -pubkey key] [value]  seal a value, read from stdin when omitted
+//	agent-secrets open [-key file] [value]           decrypt a sealed value
+//
+// Sealed values can be pasted into agent.yaml in place of the plaintext secret.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"hysteria2_microservices/agent-service/internal/secrets"
+)
+
+const defaultKeyFile = "/etc/hysteria2-agent/node.key"
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	keyFile := flags.String("key", defaultKeyFile, "node private key file")
+	publicKey := flags.String("pubkey", "", "seal to this base64 public key instead of the key file")
+	flags.Parse(os.Args[2:])
+
+	switch os.Args[1] {
+	case "keygen":
+		keyring, err := secrets.GenerateKey(*keyFile)
+		exitOnError(err)
+		fmt.Println(keyring.PublicKey())
+	case "pubkey":
+		keyring, err := secrets.LoadKey(*keyFile)
+		exitOnError(err)
+		fmt.Println(keyring.PublicKey())
+	case "seal":
+		value := argOrStdin(flags)
+		var sealed string
+		var err error
+		if *publicKey != "" {
+			sealed, err = secrets.SealTo(*publicKey, value)
+		} else {
+			var keyring *secrets.Keyring
+			if keyring, err = secrets.LoadKey(*keyFile); err == nil {
+				sealed, err = keyring.Seal(value)
+			}
+		}
+		exitOnError(err)
+		fmt.Println(sealed)
+	case "open":
+		keyring, err := secrets.LoadKey(*keyFile)
+		exitOnError(err)
+		value, err := keyring.Open(argOrStdin(flags))
+		exitOnError(err)
+		fmt.Println(value)
+	default:
+		usage()
+	}
+}
+
+// argOrStdin returns the first argument, or the first line of stdin so secrets stay out
+// of the shell history
+func argOrStdin(flags *flag.FlagSet) string {
+	if flags.NArg() > 0 {
+		return flags.Arg(0)
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		exitOnError(err)
+	}
+	return strings.TrimRight(line, "\r\n")
+}
+
+func exitOnError(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: agent-secrets keygen|pubkey|seal|open [-key file] [-pubkey key] [value]")
+	os.Exit(2)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Faults a script can inject
+const (
+	faultWARPDown    = "warp_down"    // WARP disconnects and refuses to reconnect
+	faultCertFailure = "cert_failure" // certificate issuance and renewal fail
+	faultSlowRPC     = "slow_rpc"     // RPCs are delayed by Delay
+	faultRPCError    = "rpc_error"    // RPCs fail with Unavailable
+	faultOffline     = "offline"      // heartbeats stop and every RPC fails
+)
+
+// duration reads a Go duration string such as "90s" from JSON
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+// fault is one entry of a fault script. It starts After the simulator started and lasts
+// Duration, or until the end without one. Node limits it to the node of that name and RPC
+// to the method of that name, e.g. "UpdateConfig"; Rate makes it hit only that share of
+// the calls.
+type fault struct {
+	Fault    string   `json:"fault"`
+	Node     string   `json:"node,omitempty"`
+	RPC      string   `json:"rpc,omitempty"`
+	After    duration `json:"after,omitempty"`
+	Duration duration `json:"duration,omitempty"`
+	Delay    duration `json:"delay,omitempty"`
+	Rate     float64  `json:"rate,omitempty"`
+}
+
+// faultScript is the faults of every simulated node, timed from start
+type faultScript struct {
+	Faults []fault `json:"faults"`
+
+	start time.Time
+}
+
+// loadFaultScript reads a fault script; an empty path injects no faults
+func loadFaultScript(path string) (*faultScript, error) {
+	script := &faultScript{start: time.Now()}
+	if path == "" {
+		return script, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, script); err != nil {
+		return nil, fmt.Errorf("invalid fault script %s: %w", path, err)
+	}
+	for i, f := range script.Faults {
+		switch f.Fault {
+		case faultWARPDown, faultCertFailure, faultRPCError, faultOffline:
+		case faultSlowRPC:
+			if f.Delay <= 0 {
+				return nil, fmt.Errorf("fault %d: slow_rpc needs a delay", i)
+			}
+		default:
+			return nil, fmt.Errorf("fault %d: unknown fault %q", i, f.Fault)
+		}
+		if f.Rate < 0 || f.Rate > 1 {
+			return nil, fmt.Errorf("fault %d: rate must be between 0 and 1", i)
+		}
+	}
+	return script, nil
+}
+
+// active returns the first fault of kind hitting node now, for the RPC method when not empty
+func (s *faultScript) active(kind, node, method string) *fault {
+	elapsed := time.Since(s.start)
+	for i := range s.Faults {
+		f := &s.Faults[i]
+		if f.Fault != kind || (f.Node != "" && f.Node != node) {
+			continue
+		}
+		if f.RPC != "" && method != "" && f.RPC != method {
+			continue
+		}
+		start := time.Duration(f.After)
+		if elapsed < start || (f.Duration > 0 && elapsed >= start+time.Duration(f.Duration)) {
+			continue
+		}
+		if f.Rate > 0 && rand.Float64() >= f.Rate {
+			continue
+		}
+		return f
+	}
+	return nil
+}
+
+// interceptor applies the offline, slow_rpc and rpc_error faults of a node to its RPCs
+func (s *faultScript) interceptor(node string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		method := info.FullMethod[strings.LastIndex(info.FullMethod, "/")+1:]
+		if s.active(faultOffline, node, method) != nil {
+			return nil, status.Error(codes.Unavailable, "injected fault: node is offline")
+		}
+		if f := s.active(faultSlowRPC, node, method); f != nil {
+			select {
+			case <-time.After(time.Duration(f.Delay)):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		if s.active(faultRPCError, node, method) != nil {
+			return nil, status.Errorf(codes.Unavailable, "injected fault: %s failed", method)
+		}
+		return handler(ctx, req)
+	}
+}
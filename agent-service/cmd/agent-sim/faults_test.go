@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func writeFaultScript(t *testing.T, script string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "faults.json")
+	if err := os.WriteFile(path, []byte(script), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadFaultScript(t *testing.T) {
+	script, err := loadFaultScript(writeFaultScript(t, `{"faults": [
+		{"fault": "warp_down", "node": "sim-1", "after": "30s", "duration": "1m"},
+		{"fault": "slow_rpc", "rpc": "UpdateConfig", "delay": "2s", "rate": 0.5}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(script.Faults) != 2 || time.Duration(script.Faults[0].After) != 30*time.Second || time.Duration(script.Faults[1].Delay) != 2*time.Second {
+		t.Errorf("faults = %+v", script.Faults)
+	}
+
+	if script, err := loadFaultScript(""); err != nil || len(script.Faults) != 0 {
+		t.Errorf("no script = %+v, %v; want no faults", script, err)
+	}
+
+	invalid := map[string]string{
+		"unknown fault":         `{"faults": [{"fault": "disk_full"}]}`,
+		"slow_rpc no delay":     `{"faults": [{"fault": "slow_rpc"}]}`,
+		"rate over one":         `{"faults": [{"fault": "rpc_error", "rate": 1.5}]}`,
+		"duration not a string": `{"faults": [{"fault": "offline", "after": 30}]}`,
+		"bad duration":          `{"faults": [{"fault": "offline", "after": "soon"}]}`,
+	}
+	for name, data := range invalid {
+		t.Run(name, func(t *testing.T) {
+			if _, err := loadFaultScript(writeFaultScript(t, data)); err == nil {
+				t.Error("loadFaultScript succeeded")
+			}
+		})
+	}
+}
+
+func TestFaultScriptActive(t *testing.T) {
+	script := &faultScript{
+		Faults: []fault{
+			{Fault: faultWARPDown, Node: "sim-1"},
+			{Fault: faultRPCError, RPC: "UpdateConfig"},
+			{Fault: faultOffline, After: duration(time.Minute)},
+			{Fault: faultCertFailure, Duration: duration(time.Minute)},
+		},
+		start: time.Now().Add(-2 * time.Minute),
+	}
+	tests := []struct {
+		name         string
+		kind         string
+		node, method string
+		want         bool
+	}{
+		{"on its node", faultWARPDown, "sim-1", "", true},
+		{"on another node", faultWARPDown, "sim-2", "", false},
+		{"on its RPC", faultRPCError, "sim-2", "UpdateConfig", true},
+		{"on another RPC", faultRPCError, "sim-2", "GetStatus", false},
+		{"started", faultOffline, "sim-1", "", true},
+		{"over", faultCertFailure, "sim-1", "", false},
+		{"not scripted", faultSlowRPC, "sim-1", "GetStatus", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := script.active(tt.kind, tt.node, tt.method) != nil; got != tt.want {
+				t.Errorf("active = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFaultScriptInterceptor(t *testing.T) {
+	script := &faultScript{Faults: []fault{{Fault: faultRPCError, Node: "sim-1", RPC: "UpdateConfig"}}, start: time.Now()}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return "ok", nil }
+
+	tests := []struct {
+		node   string
+		method string
+		want   codes.Code
+	}{
+		{"sim-1", "/node_management.NodeManager/UpdateConfig", codes.Unavailable},
+		{"sim-1", "/node_management.NodeManager/GetStatus", codes.OK},
+		{"sim-2", "/node_management.NodeManager/UpdateConfig", codes.OK},
+	}
+	for _, tt := range tests {
+		_, err := script.interceptor(tt.node)(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: tt.method}, handler)
+		if got := status.Code(err); got != tt.want {
+			t.Errorf("%s %s: code %s, want %s", tt.node, tt.method, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+// agent-sim runs simulated agents for testing the orchestrator without VPS nodes.
+//
+//	agent-sim [-nodes n] [-base-port port] [-master addr] [-faults file]
+//
+// Every simulated node serves the NodeManager gRPC API on its own port from base-port up,
+// keeping users, configs, Hysteria2, WARP and certificates in memory, and answers errors
+// with the ErrorCodes of the real agent. With -master the nodes register with the master
+// and send heartbeats like an agent.
+//
+// A fault script injects failures on a schedule, for example:
+//
+//	{"faults": [
+//	  {"fault": "warp_down", "node": "sim-1", "after": "1m", "duration": "2m"},
+//	  {"fault": "cert_failure", "rpc": "IssueCertificate"},
+//	  {"fault": "slow_rpc", "rpc": "UpdateConfig", "delay": "20s", "rate": 0.5},
+//	  {"fault": "rpc_error", "rpc": "AddUser", "rate": 0.1},
+//	  {"fault": "offline", "node": "sim-2", "after": "5m"}
+//	]}
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"hysteria2_microservices/agent-service/internal/handlers"
+	pb "hysteria2_microservices/proto"
+)
+
+func main() {
+	nodes := flag.Int("nodes", 3, "number of simulated nodes")
+	basePort := flag.Int("base-port", 60051, "gRPC port of the first node, the others count up from it")
+	advertiseIP := flag.String("advertise-ip", "127.0.0.1", "IP address the nodes register with")
+	namePrefix := flag.String("name-prefix", "sim", "node names are the prefix and the node number")
+	location := flag.String("location", "Simulated", "location the nodes register with")
+	country := flag.String("country", "ZZ", "country the nodes register with")
+	master := flag.String("master", "", "master gRPC address to register with and send heartbeats to")
+	heartbeat := flag.Duration("heartbeat", 30*time.Second, "heartbeat interval")
+	faultFile := flag.String("faults", "", "JSON fault script")
+	logLevel := flag.String("log-level", "info", "log level")
+	flag.Parse()
+
+	logger := logrus.New()
+	logger.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	if level, err := logrus.ParseLevel(*logLevel); err == nil {
+		logger.SetLevel(level)
+	}
+
+	faults, err := loadFaultScript(*faultFile)
+	if err != nil {
+		logger.Fatalf("Failed to load fault script: %v", err)
+	}
+
+	var masterClient pb.MasterServiceClient
+	if *master != "" {
+		conn, err := grpc.Dial(*master, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			logger.Fatalf("Failed to connect to master server: %v", err)
+		}
+		defer conn.Close()
+		masterClient = pb.NewMasterServiceClient(conn)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	servers := make([]*grpc.Server, 0, *nodes)
+	for i := 1; i <= *nodes; i++ {
+		node := newSimNode(fmt.Sprintf("%s-%d", *namePrefix, i), *basePort+i-1, faults, logger)
+
+		lis, err := net.Listen("tcp", fmt.Sprintf(":%d", node.port))
+		if err != nil {
+			logger.Fatalf("Failed to listen on port %d: %v", node.port, err)
+		}
+		// Faults are injected inside the error interceptor, so they carry ErrorCodes too
+		s := grpc.NewServer(grpc.ChainUnaryInterceptor(handlers.ErrorCodeInterceptor, faults.interceptor(node.name)))
+		pb.RegisterNodeManagerServer(s, node)
+		grpc_health_v1.RegisterHealthServer(s, health.NewServer())
+		servers = append(servers, s)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Serve(lis); err != nil {
+				node.logger.Errorf("gRPC server stopped: %v", err)
+			}
+		}()
+		node.logger.Infof("Serving NodeManager on :%d", node.port)
+
+		if masterClient != nil {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				runAgent(ctx, node, masterClient, *advertiseIP, *location, *country, *heartbeat)
+			}()
+		}
+	}
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+
+	logger.Info("Stopping simulated nodes...")
+	cancel()
+	for _, s := range servers {
+		s.Stop()
+	}
+	wg.Wait()
+}
+
+// runAgent registers the node with the master, retrying until it succeeds, then sends
+// heartbeats until ctx is done. An offline node sends none.
+func runAgent(ctx context.Context, node *simNode, master pb.MasterServiceClient, ip, location, country string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if node.faults.active(faultOffline, node.name, "") == nil {
+			if err := agentTick(ctx, node, master, ip, location, country); err != nil {
+				node.logger.Errorf("Failed to reach master: %v", err)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// agentTick registers the node when it has no ID yet and sends a heartbeat otherwise
+func agentTick(ctx context.Context, node *simNode, master pb.MasterServiceClient, ip, location, country string) error {
+	node.mu.Lock()
+	nodeID := node.nodeID
+	node.mu.Unlock()
+
+	if nodeID == "" {
+		resp, err := master.RegisterNode(ctx, &pb.RegisterNodeRequest{
+			Name:      node.name,
+			Hostname:  node.name,
+			IpAddress: ip,
+			Location:  location,
+			Country:   country,
+			GrpcPort:  int32(node.port),
+			Version:   "1.0.0",
+			Capabilities: map[string]string{
+				"hysteria2":         "true",
+				"admission_control": "true",
+				"cert_inventory":    "true",
+				"cert_upload":       "true",
+				"simulated":         "true",
+			},
+			AuthToken: "dummy-token",
+		})
+		if err != nil {
+			return err
+		}
+		if !resp.Success {
+			return fmt.Errorf("registration failed: %s", resp.Message)
+		}
+
+		node.mu.Lock()
+		node.nodeID = resp.NodeId
+		node.mu.Unlock()
+		node.logger.Infof("Registered with master server, node ID: %s", resp.NodeId)
+		return nil
+	}
+
+	resp, err := master.Heartbeat(ctx, &pb.HeartbeatRequest{
+		NodeId:  nodeID,
+		Status:  "online",
+		Metrics: node.metrics(),
+	})
+	if err != nil {
+		return err
+	}
+	if !resp.Success {
+		node.logger.Warnf("Heartbeat failed: %s", resp.Message)
+	}
+	return nil
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"hysteria2_microservices/agent-service/internal/services"
+	pb "hysteria2_microservices/proto"
+)
+
+// simNode fakes the NodeManager of one agent in memory. It answers the RPCs the orchestrator
+// drives node setup and user provisioning with; the rest are left unimplemented.
+type simNode struct {
+	pb.UnimplementedNodeManagerServer
+
+	name   string
+	port   int
+	faults *faultScript
+	logger *logrus.Entry
+
+	mu                sync.Mutex
+	nodeID            string
+	startedAt         time.Time
+	users             map[string]map[string]string
+	configs           map[string]string // config type -> deployed version
+	hysteriaInstalled bool
+	hysteriaRunning   bool
+	hysteriaConfig    string
+	warpInstalled     bool
+	warpConnected     bool
+	warpConnectedAt   time.Time
+	certificates      map[string]time.Time // domain -> not after
+	capacity          services.CapacityLimits
+}
+
+func newSimNode(name string, port int, faults *faultScript, logger *logrus.Logger) *simNode {
+	return &simNode{
+		name:         name,
+		port:         port,
+		faults:       faults,
+		logger:       logger.WithField("node", name),
+		startedAt:    time.Now(),
+		users:        map[string]map[string]string{},
+		configs:      map[string]string{},
+		certificates: map[string]time.Time{},
+		// A fresh node comes up with Hysteria2 installed by the agent and WARP missing
+		hysteriaInstalled: true,
+	}
+}
+
+// metrics returns the heartbeat metrics, made up around the number of users on the node
+func (n *simNode) metrics() map[string]float64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	users := float64(len(n.users))
+	metrics := map[string]float64{
+		"cpu_usage":                 10 + users*0.5 + rand.Float64()*5,
+		"memory_usage":              30 + users*0.2 + rand.Float64()*2,
+		"uptime":                    time.Since(n.startedAt).Seconds(),
+		"capacity_max_connections":  float64(n.capacity.MaxConnections),
+		"capacity_max_mbps":         float64(n.capacity.MaxMbps),
+		"capacity_connections":      users * 2,
+		"capacity_mbps":             users * 1.5,
+		"capacity_admission_closed": 0,
+	}
+	if n.capacity.MaxConnections > 0 && int(users*2) >= n.capacity.MaxConnections {
+		metrics["capacity_admission_closed"] = 1
+	}
+	return metrics
+}
+
+// warpDown disconnects WARP while a warp_down fault is active and reports whether it is
+func (n *simNode) warpDown() bool {
+	if n.faults.active(faultWARPDown, n.name, "") == nil {
+		return false
+	}
+	if n.warpConnected {
+		n.logger.Warn("Injected fault: WARP disconnected")
+		n.warpConnected = false
+	}
+	return true
+}
+
+func (n *simNode) GetStatus(ctx context.Context, req *pb.StatusRequest) (*pb.StatusResponse, error) {
+	n.mu.Lock()
+	resp := &pb.StatusResponse{
+		Node: &pb.Node{
+			Id:     n.nodeID,
+			Name:   n.name,
+			Status: "online",
+		},
+		ServicesStatus: map[string]string{
+			"hysteria2": serviceState(n.hysteriaInstalled, n.hysteriaRunning),
+			"warp":      serviceState(n.warpInstalled, n.warpConnected && !n.warpDown()),
+		},
+	}
+	n.mu.Unlock()
+
+	resp.SystemMetrics = n.metrics()
+	return resp, nil
+}
+
+func serviceState(installed, running bool) string {
+	switch {
+	case !installed:
+		return "not_installed"
+	case running:
+		return "running"
+	default:
+		return "stopped"
+	}
+}
+
+func (n *simNode) UpdateConfig(ctx context.Context, req *pb.ConfigUpdateRequest) (*pb.ConfigUpdateResponse, error) {
+	if len(req.ConfigData) == 0 {
+		return nil, fmt.Errorf("%s config is empty: %w", req.ConfigType, services.ErrConfigInvalid)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.configs[req.ConfigType] = req.Version
+	n.logger.Infof("Deployed %s config version %s", req.ConfigType, req.Version)
+	return &pb.ConfigUpdateResponse{
+		Success:         true,
+		Message:         "Config deployed",
+		DeployedVersion: req.Version,
+	}, nil
+}
+
+func (n *simNode) ReloadConfig(ctx context.Context, req *pb.ReloadRequest) (*pb.ReloadResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.ServiceName == "hysteria2" && !n.hysteriaInstalled {
+		return nil, fmt.Errorf("failed to reload Hysteria2: %w", services.ErrServerNotInstalled)
+	}
+	return &pb.ReloadResponse{Success: true, Message: "Config reloaded"}, nil
+}
+
+func (n *simNode) AddUser(ctx context.Context, req *pb.AddUserRequest) (*pb.AddUserResponse, error) {
+	if req.UserId == "" {
+		return nil, status.Error(codes.InvalidArgument, "user_id is required")
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.users[req.UserId] = req.UserConfig
+	return &pb.AddUserResponse{Success: true, Message: "User added"}, nil
+}
+
+func (n *simNode) RemoveUser(ctx context.Context, req *pb.RemoveUserRequest) (*pb.RemoveUserResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.users, req.UserId)
+	return &pb.RemoveUserResponse{Success: true, Message: "User removed"}, nil
+}
+
+func (n *simNode) UpdateUser(ctx context.Context, req *pb.UpdateUserRequest) (*pb.UpdateUserResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.users[req.UserId]; !ok {
+		return nil, status.Errorf(codes.NotFound, "user %s is not on the node", req.UserId)
+	}
+	n.users[req.UserId] = req.UserConfig
+	return &pb.UpdateUserResponse{Success: true, Message: "User updated"}, nil
+}
+
+func (n *simNode) GetMetrics(ctx context.Context, req *pb.MetricsRequest) (*pb.MetricsResponse, error) {
+	return &pb.MetricsResponse{
+		Metrics: []*pb.MetricEvent{{Values: n.metrics()}},
+	}, nil
+}
+
+func (n *simNode) RestartServer(ctx context.Context, req *pb.RestartRequest) (*pb.RestartResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	switch req.ServiceName {
+	case "hysteria2", "":
+		if !n.hysteriaInstalled {
+			return &pb.RestartResponse{Success: true, Message: "No server is installed"}, nil
+		}
+		n.hysteriaRunning = true
+		return &pb.RestartResponse{Success: true, Message: "Restarted hysteria2"}, nil
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported service %q", req.ServiceName)
+	}
+}
+
+func (n *simNode) GetLogs(ctx context.Context, req *pb.LogRequest) (*pb.LogResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return &pb.LogResponse{
+		Success: true,
+		Logs: []string{
+			fmt.Sprintf("%s simulated node %s started", n.startedAt.Format(time.RFC3339), n.name),
+			fmt.Sprintf("%s %d user(s) provisioned", time.Now().Format(time.RFC3339), len(n.users)),
+		},
+	}, nil
+}
+
+func (n *simNode) InstallHysteria2(ctx context.Context, req *pb.InstallHysteria2Request) (*pb.InstallHysteria2Response, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.hysteriaInstalled = true
+	return &pb.InstallHysteria2Response{Success: true, Message: "Hysteria2 installed successfully"}, nil
+}
+
+func (n *simNode) ConfigureHysteria2(ctx context.Context, req *pb.ConfigureHysteria2Request) (*pb.ConfigureHysteria2Response, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.hysteriaInstalled {
+		return nil, fmt.Errorf("failed to configure Hysteria2: %w", services.ErrServerNotInstalled)
+	}
+	n.hysteriaConfig = req.ConfigTemplate
+	return &pb.ConfigureHysteria2Response{
+		Success:         true,
+		Message:         "Hysteria2 configured successfully",
+		ConfigPath:      "/etc/hysteria/config.yaml",
+		GeneratedConfig: req.ConfigTemplate,
+	}, nil
+}
+
+func (n *simNode) StartHysteria2(ctx context.Context, req *pb.StartHysteria2Request) (*pb.StartHysteria2Response, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.hysteriaInstalled {
+		return nil, fmt.Errorf("failed to start Hysteria2: %w", services.ErrServerNotInstalled)
+	}
+	n.hysteriaRunning = true
+	return &pb.StartHysteria2Response{Success: true, Message: "Hysteria2 started successfully"}, nil
+}
+
+func (n *simNode) StopHysteria2(ctx context.Context, req *pb.StopHysteria2Request) (*pb.StopHysteria2Response, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.hysteriaRunning = false
+	return &pb.StopHysteria2Response{Success: true, Message: "Hysteria2 stopped successfully"}, nil
+}
+
+func (n *simNode) GetHysteria2Status(ctx context.Context, req *pb.GetHysteria2StatusRequest) (*pb.GetHysteria2StatusResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return &pb.GetHysteria2StatusResponse{
+		Status: map[string]string{
+			"installed": fmt.Sprintf("%t", n.hysteriaInstalled),
+			"running":   fmt.Sprintf("%t", n.hysteriaRunning),
+			"users":     fmt.Sprintf("%d", len(n.users)),
+		},
+	}, nil
+}
+
+func (n *simNode) InstallWARPClient(ctx context.Context, req *pb.InstallWARPClientRequest) (*pb.InstallWARPClientResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.warpInstalled = true
+	return &pb.InstallWARPClientResponse{Success: true, Message: "WARP client installed successfully"}, nil
+}
+
+func (n *simNode) ConnectWARP(ctx context.Context, req *pb.ConnectWARPRequest) (*pb.ConnectWARPResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.warpInstalled {
+		return nil, fmt.Errorf("failed to connect to WARP: %w", services.ErrWARPNotInstalled)
+	}
+	if n.warpDown() {
+		return nil, fmt.Errorf("failed to connect to WARP: %w", services.ErrWARPNotConnected)
+	}
+	if !n.warpConnected {
+		n.warpConnected = true
+		n.warpConnectedAt = time.Now()
+	}
+	return &pb.ConnectWARPResponse{Success: true, Message: "Connected to WARP successfully"}, nil
+}
+
+func (n *simNode) DisconnectWARP(ctx context.Context, req *pb.DisconnectWARPRequest) (*pb.DisconnectWARPResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.warpConnected = false
+	return &pb.DisconnectWARPResponse{Success: true, Message: "Disconnected from WARP successfully"}, nil
+}
+
+func (n *simNode) GetWARPStatus(ctx context.Context, req *pb.GetWARPStatusRequest) (*pb.GetWARPStatusResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	warp := &pb.WARPStatus{
+		Installed: n.warpInstalled,
+		Connected: n.warpConnected && !n.warpDown(),
+		Mode:      "proxy",
+		Health:    "healthy",
+	}
+	if warp.Connected {
+		warp.LastConnected = n.warpConnectedAt.Unix()
+		warp.Uptime = int64(time.Since(n.warpConnectedAt).Seconds())
+	} else if n.warpInstalled {
+		warp.Health = "unhealthy"
+		warp.Error = services.ErrWARPNotConnected.Error()
+	}
+	return &pb.GetWARPStatusResponse{Status: warp}, nil
+}
+
+// IssueCertificate answers like the agent: an ACME failure is a response without success,
+// not an error
+func (n *simNode) IssueCertificate(ctx context.Context, req *pb.IssueCertificateRequest) (*pb.IssueCertificateResponse, error) {
+	domain, err := services.NormalizeSNIDomain(req.Domain)
+	if err != nil {
+		return nil, err
+	}
+	if n.faults.active(faultCertFailure, n.name, "IssueCertificate") != nil {
+		n.logger.Warnf("Injected fault: certificate issuance for %s failed", domain)
+		return &pb.IssueCertificateResponse{
+			Success: false,
+			Message: "Failed to issue certificate: injected fault: ACME order failed",
+		}, nil
+	}
+
+	notAfter := time.Now().Add(90 * 24 * time.Hour)
+	n.mu.Lock()
+	n.certificates[domain] = notAfter
+	n.mu.Unlock()
+	return &pb.IssueCertificateResponse{
+		Success:  true,
+		Message:  fmt.Sprintf("Certificate for %s issued by %s", domain, "Simulated CA"),
+		Issuer:   "Simulated CA",
+		NotAfter: notAfter.Unix(),
+	}, nil
+}
+
+// InstallCertificate keeps the expiry of the uploaded leaf, the chain is not served
+func (n *simNode) InstallCertificate(ctx context.Context, req *pb.InstallCertificateRequest) (*pb.InstallCertificateResponse, error) {
+	domain, err := services.NormalizeSNIDomain(req.Domain)
+	if err != nil {
+		return nil, err
+	}
+	pair, err := tls.X509KeyPair([]byte(req.CertificatePem), []byte(req.PrivateKeyPem))
+	if err != nil {
+		return &pb.InstallCertificateResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to install certificate: certificate and private key do not match: %v", err),
+		}, nil
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+
+	n.mu.Lock()
+	n.certificates[domain] = leaf.NotAfter
+	n.mu.Unlock()
+	return &pb.InstallCertificateResponse{
+		Success:  true,
+		Message:  fmt.Sprintf("Certificate for %s issued by %s installed", domain, leaf.Issuer.CommonName),
+		Issuer:   leaf.Issuer.CommonName,
+		NotAfter: leaf.NotAfter.Unix(),
+	}, nil
+}
+
+func (n *simNode) RenewCertificates(ctx context.Context, req *pb.RenewCertificatesRequest) (*pb.RenewCertificatesResponse, error) {
+	if n.faults.active(faultCertFailure, n.name, "RenewCertificates") != nil {
+		return nil, fmt.Errorf("failed to renew certificates: injected fault: ACME order failed")
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for domain := range n.certificates {
+		n.certificates[domain] = time.Now().Add(90 * 24 * time.Hour)
+	}
+	return &pb.RenewCertificatesResponse{
+		Success: true,
+		Message: fmt.Sprintf("Renewed %d certificate(s)", len(n.certificates)),
+	}, nil
+}
+
+func (n *simNode) ListCertificates(ctx context.Context, req *pb.ListCertificatesRequest) (*pb.ListCertificatesResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	resp := &pb.ListCertificatesResponse{
+		Success:      true,
+		Message:      fmt.Sprintf("%d certificate(s) found", len(n.certificates)),
+		Certificates: make([]*pb.NodeCertificate, 0, len(n.certificates)),
+	}
+	for domain, notAfter := range n.certificates {
+		resp.Certificates = append(resp.Certificates, &pb.NodeCertificate{
+			Domain:    domain,
+			Issuer:    "Simulated CA",
+			NotBefore: notAfter.Add(-90 * 24 * time.Hour).Unix(),
+			NotAfter:  notAfter.Unix(),
+			Source:    "files",
+			DaysLeft:  int32(time.Until(notAfter).Hours() / 24),
+		})
+	}
+	return resp, nil
+}
+
+func (n *simNode) SetNodeCapacity(ctx context.Context, req *pb.SetNodeCapacityRequest) (*pb.SetNodeCapacityResponse, error) {
+	if req.Capacity == nil {
+		return nil, status.Error(codes.InvalidArgument, "capacity is required")
+	}
+	if req.Capacity.MaxConnections < 0 || req.Capacity.MaxMbps < 0 {
+		return nil, status.Error(codes.InvalidArgument, "capacity limits must not be negative")
+	}
+
+	n.mu.Lock()
+	n.capacity = services.CapacityLimits{
+		MaxConnections: int(req.Capacity.MaxConnections),
+		MaxMbps:        int(req.Capacity.MaxMbps),
+	}
+	n.mu.Unlock()
+	return &pb.SetNodeCapacityResponse{
+		Success:  true,
+		Message:  "Capacity limits applied successfully",
+		Capacity: req.Capacity,
+	}, nil
+}
+
+func (n *simNode) GetNodeCapacity(ctx context.Context, req *pb.GetNodeCapacityRequest) (*pb.GetNodeCapacityResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return &pb.GetNodeCapacityResponse{
+		Success: true,
+		Capacity: &pb.NodeCapacity{
+			MaxConnections: int32(n.capacity.MaxConnections),
+			MaxMbps:        int32(n.capacity.MaxMbps),
+		},
+	}, nil
+}
@@ -8,14 +8,21 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
 	"hysteria2_microservices/agent-service/internal/config"
 	"hysteria2_microservices/agent-service/internal/handlers"
+	"hysteria2_microservices/agent-service/internal/privsep"
 	"hysteria2_microservices/agent-service/internal/services"
+	"hysteria2_microservices/agent-service/internal/tunnel"
+	"hysteria2_microservices/pkg/events"
 	pb "hysteria2_microservices/proto"
 )
 
@@ -29,6 +36,19 @@ func main() {
 	// Setup logger
 	logger := setupLogger(cfg.Logging)
 
+	// Warn loudly when built with -tags chaos for fault-injection tests
+	services.LogFaultInjection(logger)
+
+	// Run privileged commands through the setuid helper when not running as root
+	if err := privsep.Enable(cfg.Privilege.Helper); err != nil {
+		logger.Fatalf("Failed to enable privilege separation: %v", err)
+	}
+	if privsep.Enabled() {
+		logger.Infof("Running unprivileged, privileged commands go through %s", cfg.Privilege.Helper)
+	} else if os.Geteuid() != 0 {
+		logger.Warn("Running unprivileged without a privilege helper, firewall and service management will fail")
+	}
+
 	// Initialize services
 	localServices := setupLocalServices(cfg, logger)
 
@@ -52,26 +72,173 @@ func main() {
 	}()
 
 	// Setup gRPC server for master commands
-	grpcServer := setupGRPCServer(localServices, masterClient, logger)
+	healthServer := health.NewServer()
+	grpcServer := setupGRPCServer(localServices, masterClient, healthServer, logger)
 
 	// Start agent
 	agent := handlers.NewAgent(localServices, masterClient, cfg, logger)
 
+	// Keep the errors logged from here on for the local admin API
+	var adminAPI *handlers.AdminAPI
+	if cfg.Admin.Enabled {
+		adminAPI = handlers.NewAdminAPI(localServices, agent, cfg, logger)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	g, gctx := errgroup.WithContext(ctx)
 
+	// Publish heartbeats, traffic and events to the event bus rather than calling the
+	// orchestrator and api-service for each
+	bus := setupEventBus(cfg, logger)
+	if bus != nil {
+		bus.Start(ctx)
+		defer bus.Stop()
+		agent.SetEventBus(bus)
+		localServices.SessionTracker.SetEventBus(bus)
+	}
+
 	// Start agent
 	g.Go(func() error {
 		return agent.Start(gctx)
 	})
 
+	// Serve the local admin API so operators on the node can recover it without the master;
+	// the agent keeps running when it cannot start
+	if adminAPI != nil {
+		go func() {
+			if err := adminAPI.Run(gctx); err != nil {
+				logger.Errorf("Failed to start admin API: %v", err)
+			}
+		}()
+	}
+
 	// Start gRPC server
 	g.Go(func() error {
 		return startGRPCServer(grpcServer, cfg, logger)
 	})
 
+	// Behind NAT the master cannot dial the gRPC server; serve it over a tunnel the agent opens
+	if tunnelClient := setupTunnel(cfg, masterConn, logger); tunnelClient != nil {
+		g.Go(func() error {
+			return tunnelClient.Run(gctx)
+		})
+		g.Go(func() error {
+			if err := grpcServer.Serve(tunnelClient); err != nil {
+				return fmt.Errorf("failed to serve gRPC over the tunnel: %w", err)
+			}
+			return nil
+		})
+	}
+
+	// Close the node to everything but SSH, the orchestrator and the VPN ports before serving
+	if cfg.Firewall.Enabled {
+		if err := localServices.Firewall.EnsureBaseline(); err != nil {
+			logger.Errorf("Failed to apply firewall baseline: %v", err)
+		}
+	}
+
+	// Ban addresses that keep failing Hysteria2, Xray or SSH authentication
+	if cfg.BruteForce.Enabled {
+		if err := localServices.BruteForceGuard.Start(gctx); err != nil {
+			logger.Errorf("Failed to start brute-force guard: %v", err)
+		}
+	}
+
+	// Answer all DNS on the node locally and forward it over DoH so nothing leaks in plaintext
+	if cfg.DNS.Enabled {
+		if err := localServices.DNSResolver.Start(gctx); err != nil {
+			logger.Errorf("Failed to start DNS resolver: %v", err)
+		}
+	}
+
+	// Restore the assigned domain blocklists and keep them downloaded
+	if err := localServices.ContentFilter.Start(gctx); err != nil {
+		logger.Errorf("Failed to start content filter: %v", err)
+	}
+
+	// Restore the assigned routing profiles
+	if err := localServices.RoutingProfiles.Start(gctx); err != nil {
+		logger.Errorf("Failed to start routing profiles: %v", err)
+	}
+
+	// Restore the outbound policy choosing where Hysteria2 traffic leaves the node
+	if err := localServices.OutboundPolicy.Start(gctx); err != nil {
+		logger.Errorf("Failed to start outbound policy: %v", err)
+	}
+
+	// Front Hysteria2 with the obfuscating UDP relay when QUIC obfuscation is enabled
+	if cfg.Hysteria2.QUICObfuscationEnabled {
+		if err := localServices.QUICRelay.Start(gctx); err != nil {
+			logger.Errorf("Failed to start QUIC obfuscation relay: %v", err)
+		}
+	}
+
+	// Behind the port mux the decoy site moves to the default backend so unmatched traffic lands on it
+	if cfg.PortMux.Enabled && cfg.Decoy.ListenAddr == cfg.PortMux.ListenAddr {
+		cfg.Decoy.ListenAddr = cfg.PortMux.DefaultBackend
+	}
+
+	// Serve the decoy website on TCP 443 so probes see an ordinary HTTPS site
+	if cfg.Decoy.Enabled {
+		if err := localServices.DecoyManager.Start(gctx); err != nil {
+			logger.Errorf("Failed to start decoy site: %v", err)
+		}
+	}
+
+	// Share the public TCP port between Xray and the decoy site; Hysteria2 keeps the UDP side
+	if cfg.PortMux.Enabled {
+		if err := localServices.PortMux.Start(gctx); err != nil {
+			logger.Errorf("Failed to start port mux: %v", err)
+		}
+	}
+
+	// Re-read Vault, KMS and other referenced secrets and restart the servers using rotated ones
+	if err := localServices.SecretRotator.Start(gctx); err != nil {
+		logger.Errorf("Failed to start secret rotation: %v", err)
+	}
+
+	// Report the clients online on Hysteria2 for the live session list
+	if err := localServices.SessionTracker.Start(gctx); err != nil {
+		logger.Errorf("Failed to start session tracking: %v", err)
+	}
+
+	// Check the egress addresses against blocklists and streaming services
+	if err := localServices.EgressMonitor.Start(gctx); err != nil {
+		logger.Errorf("Failed to start egress checks: %v", err)
+	}
+
+	// Send the traffic meant for WARP to the backup egress while WARP stays unhealthy
+	if err := localServices.WARPFailover.Start(gctx); err != nil {
+		logger.Errorf("Failed to start WARP failover: %v", err)
+	}
+
+	// Rotate the WARP egress on schedule and when its address gets blocklisted
+	if err := localServices.WARPRotator.Start(gctx); err != nil {
+		logger.Errorf("Failed to start WARP rotation: %v", err)
+	}
+
+	// Watch free space on the partitions the servers need and edits to the deployed configs
+	if err := localServices.Integrity.Start(gctx); err != nil {
+		logger.Errorf("Failed to start integrity checks: %v", err)
+	}
+
+	// Reject new connections once the node is at its connection or bandwidth cap
+	if err := localServices.Admission.Start(gctx); err != nil {
+		logger.Errorf("Failed to start admission control: %v", err)
+	}
+
+	// Queue egress traffic fairly and mark it per traffic class
+	if err := localServices.QoS.Start(gctx); err != nil {
+		logger.Errorf("Failed to start QoS manager: %v", err)
+	}
+
+	// Forward the public ports users requested to their servers
+	if err := localServices.PortForwards.Start(gctx); err != nil {
+		logger.Errorf("Failed to start port forwarder: %v", err)
+	}
+
 	// Wait for interrupt signal or error
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
@@ -84,8 +251,21 @@ func main() {
 	}
 
 	logger.Info("Shutting down agent...")
+	timeout := time.Duration(cfg.Shutdown.Timeout) * time.Second
+	healthServer.Shutdown()
+
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), timeout)
+	defer drainCancel()
+	agent.Drain(drainCtx)
+	if bus != nil {
+		if err := bus.Flush(drainCtx); err != nil {
+			logger.Warnf("Events not published before shutdown: %d", bus.Pending())
+		}
+	}
+
+	stopGRPCServer(grpcServer, timeout, logger)
 	cancel()
-	grpcServer.GracefulStop()
+	agent.Stop()
 	logger.Info("Agent stopped gracefully")
 }
 
@@ -110,14 +290,92 @@ func setupLogger(cfg config.LoggingConfig) *logrus.Logger {
 }
 
 func setupLocalServices(cfg *config.Config, logger *logrus.Logger) *services.LocalServices {
+	hysteriaManager := services.NewHysteriaManager(logger, cfg)
+	xrayManager := services.NewXrayManager(logger, cfg)
+	firewall := services.NewFirewallManager(logger, cfg)
+	networkManager := services.NewNetworkManager(logger, cfg)
+	protocols := services.NewProtocolReconciler(logger, cfg, hysteriaManager, xrayManager)
+	integrity := services.NewIntegrityMonitor(logger, cfg)
+	warpManager := services.NewWARPManager(logger, cfg)
+	egressMonitor := services.NewEgressMonitor(logger, cfg)
+
 	return &services.LocalServices{
 		ConfigManager:    services.NewConfigManager(logger),
 		MetricsCollector: services.NewMetricsCollector(cfg, logger),
 		SystemManager:    services.NewSystemManager(logger),
-		NetworkManager:   services.NewNetworkManager(logger, cfg),
-		HysteriaManager:  services.NewHysteriaManager(logger, cfg),
-		WARPManager:      services.NewWARPManager(logger, cfg),
+		NetworkManager:   networkManager,
+		HysteriaManager:  hysteriaManager,
+		XrayManager:      xrayManager,
+		WARPManager:      warpManager,
+		DecoyManager:     services.NewDecoyManager(logger, cfg, services.NewCertificateManager(logger, cfg)),
+		QUICRelay:        services.NewQUICRelay(logger, cfg),
+		PortMux:          services.NewPortMux(logger, cfg),
+		Protocols:        protocols,
+		DNSResolver:      services.NewDNSResolver(logger, cfg),
+		Firewall:         firewall,
+		BruteForceGuard:  services.NewBruteForceGuard(logger, cfg, firewall),
+		ContentFilter:    services.NewContentFilter(logger, cfg, hysteriaManager, xrayManager),
+		RoutingProfiles:  services.NewRoutingProfileManager(logger, cfg, hysteriaManager, xrayManager),
+		OutboundPolicy:   services.NewOutboundPolicyManager(logger, cfg, hysteriaManager),
+		ProbeRunner:      services.NewProbeRunner(logger, cfg),
+		Speedtest:        services.NewSpeedtestRunner(logger, cfg),
+		EgressMonitor:    egressMonitor,
+		WARPFailover:     services.NewWARPFailover(logger, cfg, services.NewWARPMonitor(logger, cfg, warpManager), hysteriaManager),
+		WARPRotator:      services.NewWARPRotator(logger, cfg, warpManager, hysteriaManager, egressMonitor),
+		Integrity:        integrity,
+		Drift:            services.NewDriftDetector(logger, cfg, integrity, protocols, hysteriaManager, xrayManager, firewall, networkManager),
+		Admission:        services.NewAdmissionController(logger, cfg),
+		QoS:              services.NewQoSManager(logger, cfg),
+		PortForwards:     services.NewPortForwarder(logger, cfg),
+		HysteriaUpdater:  services.NewHysteriaUpdater(logger, cfg, hysteriaManager),
+		XrayUpdater:      services.NewXrayUpdater(logger, cfg, xrayManager),
+		SecretRotator:    services.NewSecretRotator(logger, cfg, hysteriaManager, xrayManager),
+		SessionTracker:   services.NewSessionTracker(logger, cfg),
+		NodeBackup:       services.NewNodeBackup(logger, cfg, hysteriaManager, xrayManager),
+	}
+}
+
+// setupEventBus returns nil when no NATS server is configured
+func setupEventBus(cfg *config.Config, logger *logrus.Logger) *events.Bus {
+	if cfg.Events.URL == "" {
+		return nil
+	}
+	if cfg.Node.ID == "" {
+		logger.Warn("Event bus configured without node.id, publishing to the master instead")
+		return nil
+	}
+	bus, err := events.New(events.Config{
+		Options: events.Options{
+			URL:      cfg.Events.URL,
+			Name:     "agent-" + cfg.Node.ID,
+			Token:    cfg.Events.Token,
+			User:     cfg.Events.User,
+			Password: cfg.Events.Password,
+		},
+		Source: "agent/" + cfg.Node.ID,
+		Outbox: cfg.Events.Outbox,
+		OnError: func(err error) {
+			logger.Warnf("Event bus error: %v", err)
+		},
+	})
+	if err != nil {
+		logger.Fatalf("Failed to set up the event bus: %v", err)
+	}
+	logger.Infof("Publishing heartbeats and events to %s", cfg.Events.URL)
+	return bus
+}
+
+// setupTunnel returns nil unless the reverse tunnel is enabled
+func setupTunnel(cfg *config.Config, masterConn *grpc.ClientConn, logger *logrus.Logger) *tunnel.Client {
+	if !cfg.Tunnel.Enabled {
+		return nil
+	}
+	if masterConn == nil || cfg.Node.ID == "" {
+		logger.Warn("Tunnel enabled without master_server and node.id, not opening it")
+		return nil
 	}
+	logger.Infof("Opening reverse tunnel to %s", cfg.MasterServer)
+	return tunnel.NewClient(handlers.NewTunnelTransport(masterConn, cfg.Node.ID, cfg.Tunnel.Token), logger)
 }
 
 func setupMasterClient(cfg *config.Config, logger *logrus.Logger) (*grpc.ClientConn, error) {
@@ -126,7 +384,15 @@ func setupMasterClient(cfg *config.Config, logger *logrus.Logger) (*grpc.ClientC
 		return nil, nil
 	}
 
-	conn, err := grpc.Dial(cfg.MasterServer, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	// Ping the master while idle so the reverse tunnel notices dropped NAT mappings
+	conn, err := grpc.Dial(cfg.MasterServer,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                30 * time.Second,
+			Timeout:             10 * time.Second,
+			PermitWithoutStream: true,
+		}),
+	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to master server: %w", err)
 	}
@@ -136,15 +402,37 @@ func setupMasterClient(cfg *config.Config, logger *logrus.Logger) (*grpc.ClientC
 	return conn, nil
 }
 
-func setupGRPCServer(localServices *services.LocalServices, masterClient pb.MasterServiceClient, logger *logrus.Logger) *grpc.Server {
-	s := grpc.NewServer()
+func setupGRPCServer(localServices *services.LocalServices, masterClient pb.MasterServiceClient, healthServer *health.Server, logger *logrus.Logger) *grpc.Server {
+	// Report handler errors as statuses with an ErrorCode detail
+	s := grpc.NewServer(grpc.UnaryInterceptor(handlers.ErrorCodeInterceptor))
 
 	// Register node manager service
 	pb.RegisterNodeManagerServer(s, handlers.NewNodeManagerHandler(localServices, logger))
 
+	// Serve grpc_health_v1 so the orchestrator and load balancers can probe the agent
+	grpc_health_v1.RegisterHealthServer(s, healthServer)
+
 	return s
 }
 
+// stopGRPCServer refuses new RPCs and waits for the in-flight ones, cancelling those still
+// running after timeout
+func stopGRPCServer(s *grpc.Server, timeout time.Duration, logger *logrus.Logger) {
+	done := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		logger.Warnf("In-flight gRPC operations did not finish within %s, cancelling them", timeout)
+		s.Stop()
+		<-done
+	}
+}
+
 func startGRPCServer(s *grpc.Server, cfg *config.Config, logger *logrus.Logger) error {
 	addr := fmt.Sprintf(":%d", cfg.Node.GRPCPort)
 	lis, err := net.Listen("tcp", addr)
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// logEntry is an entry of the admin API's errors endpoint
+type logEntry struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Message string    `json:"message"`
+}
+
+func showErrors(ctx context.Context) {
+	var result struct {
+		Entries []logEntry `json:"entries"`
+	}
+	adminRequest(ctx, http.MethodGet, "/errors", &result)
+	if *jsonOut {
+		printJSON(result.Entries)
+		return
+	}
+	if len(result.Entries) == 0 {
+		fmt.Println("No errors logged")
+		return
+	}
+	for _, entry := range result.Entries {
+		fmt.Printf("%s %-7s %s\n", entry.Time.Local().Format(time.DateTime), strings.ToUpper(entry.Level), entry.Message)
+	}
+}
+
+func flushIPTables(ctx context.Context) {
+	var result struct {
+		Removed []string `json:"removed"`
+	}
+	adminRequest(ctx, http.MethodPost, "/iptables/flush", &result)
+	if *jsonOut {
+		printJSON(result)
+		return
+	}
+	if len(result.Removed) == 0 {
+		fmt.Println("No agent chains installed")
+		return
+	}
+	for _, chain := range result.Removed {
+		fmt.Println("removed", chain)
+	}
+}
+
+// adminRequest calls the agent's admin API with the token from the token file and decodes
+// the JSON response into out
+func adminRequest(ctx context.Context, method, path string, out interface{}) {
+	token, err := os.ReadFile(*tokenFile)
+	if err != nil {
+		exitOnError(fmt.Errorf("failed to read the admin token: %w", err))
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "http://"+*adminAddr+path, nil)
+	exitOnError(err)
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+
+	resp, err := http.DefaultClient.Do(req)
+	exitOnError(err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	exitOnError(err)
+
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &apiErr) == nil && apiErr.Error != "" {
+			exitOnError(fmt.Errorf("%s", apiErr.Error))
+		}
+		exitOnError(fmt.Errorf("admin API returned %s", resp.Status))
+	}
+	exitOnError(json.Unmarshal(body, out))
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around a change
+const diffContext = 3
+
+// unifiedDiff compares the config in force with the generated one line by line, in the
+// format of diff -u. It returns an empty string when they are the same.
+func unifiedDiff(path, current, generated string) string {
+	a, b := splitLines(current), splitLines(generated)
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	// Walk the table into a script of kept, removed and added lines
+	type edit struct {
+		op   byte // ' ', '-' or '+'
+		line string
+		i, j int // line numbers in a and b before the edit
+	}
+	var script []edit
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			script = append(script, edit{' ', a[i], i, j})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			script = append(script, edit{'-', a[i], i, j})
+			i++
+		default:
+			script = append(script, edit{'+', b[j], i, j})
+			j++
+		}
+	}
+
+	var out strings.Builder
+	for k := 0; k < len(script); {
+		if script[k].op == ' ' {
+			k++
+			continue
+		}
+		// A hunk runs from diffContext lines before the change to diffContext lines after
+		// the last change closer than twice that
+		start := max(0, k-diffContext)
+		end := k
+		for n := k; n < len(script); n++ {
+			if script[n].op != ' ' {
+				end = n
+			} else if n-end > 2*diffContext {
+				break
+			}
+		}
+		end = min(len(script), end+diffContext+1)
+
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s (in force)\n+++ %s (generated)\n", path, path)
+		}
+		removed, added := 0, 0
+		for _, e := range script[start:end] {
+			if e.op != '+' {
+				removed++
+			}
+			if e.op != '-' {
+				added++
+			}
+		}
+		// An empty side starts at the line before, as in diff -u
+		fromA, fromB := script[start].i+1, script[start].j+1
+		if removed == 0 {
+			fromA--
+		}
+		if added == 0 {
+			fromB--
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", fromA, removed, fromB, added)
+		for _, e := range script[start:end] {
+			fmt.Fprintf(&out, "%c%s\n", e.op, e.line)
+		}
+		k = end
+	}
+	return out.String()
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestUnifiedDiff(t *testing.T) {
+	const header = "--- /etc/hysteria/config.yaml (in force)\n+++ /etc/hysteria/config.yaml (generated)\n"
+	const current = "listen: :443\ntls:\n  cert: /etc/hysteria/cert.pem\n  key: /etc/hysteria/key.pem\nauth:\n  type: http\n  http:\n    url: http://127.0.0.1:8080/auth\nmasquerade:\n  type: proxy\nbandwidth:\n  up: 1 gbps\n  down: 1 gbps\n"
+	tests := []struct {
+		name      string
+		current   string
+		generated string
+		want      string
+	}{
+		{"same", current, current, ""},
+		{
+			"changed line",
+			current,
+			"listen: :8443\n" + current[len("listen: :443\n"):],
+			header + "@@ -1,4 +1,4 @@\n-listen: :443\n+listen: :8443\n tls:\n   cert: /etc/hysteria/cert.pem\n   key: /etc/hysteria/key.pem\n",
+		},
+		{
+			// Changes further apart than twice the context get hunks of their own
+			"two hunks",
+			current,
+			"listen: :8443\n" + current[len("listen: :443\n"):len(current)-len("  down: 1 gbps\n")] + "  down: 500 mbps\n",
+			header + "@@ -1,4 +1,4 @@\n-listen: :443\n+listen: :8443\n tls:\n   cert: /etc/hysteria/cert.pem\n   key: /etc/hysteria/key.pem\n" +
+				"@@ -10,4 +10,4 @@\n   type: proxy\n bandwidth:\n   up: 1 gbps\n-  down: 1 gbps\n+  down: 500 mbps\n",
+		},
+		{
+			"added at the end",
+			current,
+			current + "sniff:\n  enable: true\n",
+			header + "@@ -11,3 +11,5 @@\n bandwidth:\n   up: 1 gbps\n   down: 1 gbps\n+sniff:\n+  enable: true\n",
+		},
+		{"no config in force", "", "listen: :443\n", header + "@@ -0,0 +1,1 @@\n+listen: :443\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := unifiedDiff("/etc/hysteria/config.yaml", tt.current, tt.generated); got != tt.want {
+				t.Errorf("diff:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,371 @@
+// agentctl shows and operates this node's agent, the way warp-cli and xray do for their own
+// state. It talks to the agent's gRPC API on the node and, for the commands meant for
+// recovering a node the orchestrator cannot reach, to its local admin API.
+//
+//	agentctl status                                   agent, Hysteria2, Xray and WARP status
+//	agentctl warp status|connect|disconnect           the WARP client
+//	agentctl cert list [-expiring days] | renew       the node's certificates
+//	agentctl config show|diff [hysteria2|xray] [-template file] [-protocol p]
+//	agentctl users                                    clients online on Xray
+//	agentctl restart [hysteria2|xray]                 restart one or every installed server
+//	agentctl errors                                   last errors and warnings of the agent (admin API)
+//	agentctl iptables flush                           remove the agent's iptables chains (admin API)
+//
+// config show prints the server config in force and config diff compares it with the one
+// the agent would generate now, from -template when given. Global flags go before the
+// command: -grpc addr, -admin addr, -token-file file and -json for machine-readable output.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	pb "hysteria2_microservices/proto"
+)
+
+var (
+	grpcAddr  = flag.String("grpc", "127.0.0.1:50051", "agent gRPC address")
+	adminAddr = flag.String("admin", "127.0.0.1:9190", "agent admin API address")
+	tokenFile = flag.String("token-file", "/etc/hysteria2-agent/admin.token", "admin API token file")
+	jsonOut   = flag.Bool("json", false, "print JSON")
+	timeout   = flag.Duration("timeout", 2*time.Minute, "time allowed for the command")
+)
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	switch args[0] {
+	case "status":
+		showStatus(ctx, dial())
+	case "warp":
+		warp(ctx, dial(), subcommand(args))
+	case "cert":
+		cert(ctx, dial(), subcommand(args), args[min(2, len(args)):])
+	case "config":
+		serverConfig(ctx, dial(), subcommand(args), args[min(2, len(args)):])
+	case "users":
+		users(ctx, dial())
+	case "restart":
+		service := ""
+		if len(args) > 1 {
+			service = args[1]
+		}
+		resp, err := dial().RestartServer(ctx, &pb.RestartRequest{ServiceName: service})
+		exitOnError(err)
+		printResult(resp, resp.Message)
+	case "errors":
+		showErrors(ctx)
+	case "iptables":
+		if subcommand(args) != "flush" {
+			usage()
+		}
+		flushIPTables(ctx)
+	default:
+		usage()
+	}
+}
+
+func dial() pb.NodeManagerClient {
+	conn, err := grpc.Dial(*grpcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	exitOnError(err)
+	return pb.NewNodeManagerClient(conn)
+}
+
+func showStatus(ctx context.Context, client pb.NodeManagerClient) {
+	agent, err := client.GetStatus(ctx, &pb.StatusRequest{})
+	exitOnError(err)
+	hysteria, err := client.GetHysteria2Status(ctx, &pb.GetHysteria2StatusRequest{})
+	exitOnError(err)
+	xray, err := client.GetXrayStatus(ctx, &pb.GetXrayStatusRequest{})
+	exitOnError(err)
+	warp, err := client.GetWARPStatus(ctx, &pb.GetWARPStatusRequest{})
+	exitOnError(err)
+
+	if *jsonOut {
+		printJSON(map[string]interface{}{
+			"agent":     agent.ServicesStatus,
+			"hysteria2": hysteria.Status,
+			"xray":      xray.Status,
+			"warp":      warp.Status,
+		})
+		return
+	}
+
+	printSection("Hysteria2", hysteria.Status)
+	printSection("Xray", xray.Status)
+	if w := warp.Status; w != nil {
+		fmt.Println("WARP")
+		tw := newTable()
+		fmt.Fprintf(tw, "  installed\t%t\n", w.Installed)
+		fmt.Fprintf(tw, "  connected\t%t\n", w.Connected)
+		if w.IpAddress != "" {
+			fmt.Fprintf(tw, "  ip\t%s\n", w.IpAddress)
+		}
+		if w.Health != "" {
+			fmt.Fprintf(tw, "  health\t%s\n", w.Health)
+		}
+		if w.Error != "" {
+			fmt.Fprintf(tw, "  error\t%s\n", w.Error)
+		}
+		tw.Flush()
+	}
+	printSection("Agent", agent.ServicesStatus)
+}
+
+func warp(ctx context.Context, client pb.NodeManagerClient, command string) {
+	switch command {
+	case "status":
+		resp, err := client.GetWARPStatus(ctx, &pb.GetWARPStatusRequest{})
+		exitOnError(err)
+		if *jsonOut || resp.Status == nil {
+			printJSON(resp.Status)
+			return
+		}
+		w := resp.Status
+		tw := newTable()
+		fmt.Fprintf(tw, "installed\t%t\n", w.Installed)
+		fmt.Fprintf(tw, "connected\t%t\n", w.Connected)
+		fmt.Fprintf(tw, "mode\t%s\n", w.Mode)
+		fmt.Fprintf(tw, "proxy port\t%d\n", w.ProxyPort)
+		fmt.Fprintf(tw, "account\t%s\n", w.AccountType)
+		if w.Organization != "" {
+			fmt.Fprintf(tw, "organization\t%s\n", w.Organization)
+		}
+		fmt.Fprintf(tw, "ip\t%s\n", w.IpAddress)
+		fmt.Fprintf(tw, "location\t%s\n", w.Location)
+		fmt.Fprintf(tw, "health\t%s\n", w.Health)
+		if w.Error != "" {
+			fmt.Fprintf(tw, "error\t%s\n", w.Error)
+		}
+		tw.Flush()
+	case "connect":
+		resp, err := client.ConnectWARP(ctx, &pb.ConnectWARPRequest{})
+		exitOnError(err)
+		printResult(resp, resp.Message)
+		exitUnless(resp.Success)
+	case "disconnect":
+		resp, err := client.DisconnectWARP(ctx, &pb.DisconnectWARPRequest{})
+		exitOnError(err)
+		printResult(resp, resp.Message)
+		exitUnless(resp.Success)
+	default:
+		usage()
+	}
+}
+
+func cert(ctx context.Context, client pb.NodeManagerClient, command string, args []string) {
+	switch command {
+	case "list":
+		flags := flag.NewFlagSet("cert list", flag.ExitOnError)
+		expiring := flags.Int("expiring", 0, "only certificates expiring within this many days")
+		flags.Parse(args)
+
+		resp, err := client.ListCertificates(ctx, &pb.ListCertificatesRequest{})
+		exitOnError(err)
+		var certificates []*pb.NodeCertificate
+		for _, c := range resp.Certificates {
+			if *expiring == 0 || int(c.DaysLeft) <= *expiring {
+				certificates = append(certificates, c)
+			}
+		}
+		if *jsonOut {
+			printJSON(certificates)
+			return
+		}
+		tw := newTable()
+		fmt.Fprintln(tw, "DOMAIN\tISSUER\tEXPIRES\tDAYS LEFT\tSOURCE")
+		for _, c := range certificates {
+			issuer := c.Issuer
+			if c.SelfSigned {
+				issuer += " (self-signed)"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n", c.Domain, issuer, time.Unix(c.NotAfter, 0).UTC().Format("2006-01-02"), c.DaysLeft, c.Source)
+		}
+		tw.Flush()
+	case "renew":
+		resp, err := client.RenewCertificates(ctx, &pb.RenewCertificatesRequest{})
+		exitOnError(err)
+		printResult(resp, resp.Message)
+		exitUnless(resp.Success)
+	default:
+		usage()
+	}
+}
+
+func serverConfig(ctx context.Context, client pb.NodeManagerClient, command string, args []string) {
+	kind := "hysteria2"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		kind, args = args[0], args[1:]
+	}
+	flags := flag.NewFlagSet("config "+command, flag.ExitOnError)
+	templateFile := flags.String("template", "", "config template to generate from, the default config when empty")
+	protocol := flags.String("protocol", "", "Xray protocol")
+	flags.Parse(args)
+
+	req := &pb.PreviewServerConfigRequest{Kind: kind, Protocol: *protocol}
+	if *templateFile != "" {
+		data, err := os.ReadFile(*templateFile)
+		exitOnError(err)
+		req.ConfigTemplate = string(data)
+	}
+	resp, err := client.PreviewServerConfig(ctx, req)
+	exitOnError(err)
+
+	switch command {
+	case "show":
+		if *jsonOut {
+			printJSON(map[string]string{"config_path": resp.ConfigPath, "config": resp.CurrentConfig})
+			return
+		}
+		if resp.CurrentConfig == "" {
+			fmt.Fprintf(os.Stderr, "%s has not been configured yet\n", kind)
+			os.Exit(1)
+		}
+		fmt.Print(resp.CurrentConfig)
+	case "diff":
+		diff := unifiedDiff(resp.ConfigPath, resp.CurrentConfig, resp.GeneratedConfig)
+		if *jsonOut {
+			printJSON(map[string]interface{}{"config_path": resp.ConfigPath, "changed": diff != "", "diff": diff})
+			return
+		}
+		if diff == "" {
+			fmt.Println("No changes")
+			return
+		}
+		fmt.Print(diff)
+		// Like diff(1), differences exit with 1
+		os.Exit(1)
+	default:
+		usage()
+	}
+}
+
+func users(ctx context.Context, client pb.NodeManagerClient) {
+	resp, err := client.GetXrayConnections(ctx, &pb.GetXrayConnectionsRequest{})
+	exitOnError(err)
+	if *jsonOut {
+		printJSON(resp.Connections)
+		return
+	}
+	tw := newTable()
+	fmt.Fprintln(tw, "USER\tDEVICE\tEMAIL\tINBOUNDS\tADDRESSES\tUP\tDOWN\tLAST SEEN")
+	for _, c := range resp.Connections {
+		lastSeen := "-"
+		if c.LastSeen > 0 {
+			lastSeen = time.Unix(c.LastSeen, 0).UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", c.UserId, c.DeviceId, c.Email,
+			strings.Join(c.InboundTags, ","), strings.Join(c.Ips, ","), formatBytes(c.Uplink), formatBytes(c.Downlink), lastSeen)
+	}
+	tw.Flush()
+}
+
+// printSection prints a status map sorted by key under a title
+func printSection(title string, values map[string]string) {
+	if len(values) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fmt.Println(title)
+	tw := newTable()
+	for _, key := range keys {
+		fmt.Fprintf(tw, "  %s\t%s\n", key, values[key])
+	}
+	tw.Flush()
+}
+
+// printResult prints a response as JSON with -json and its message otherwise
+func printResult(resp interface{}, message string) {
+	if *jsonOut {
+		printJSON(resp)
+		return
+	}
+	fmt.Println(message)
+}
+
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	exitOnError(enc.Encode(v))
+}
+
+func newTable() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func subcommand(args []string) string {
+	if len(args) < 2 {
+		usage()
+	}
+	return args[1]
+}
+
+func exitUnless(success bool) {
+	if !success {
+		os.Exit(1)
+	}
+}
+
+// exitOnError prints the message of a gRPC status without its code prefix
+func exitOnError(err error) {
+	if err == nil {
+		return
+	}
+	if st, ok := status.FromError(err); ok {
+		fmt.Fprintln(os.Stderr, st.Message())
+	} else {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	os.Exit(1)
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `usage: agentctl [-grpc addr] [-admin addr] [-token-file file] [-json] command
+
+commands:
+  status                                  agent, Hysteria2, Xray and WARP status
+  warp status|connect|disconnect          the WARP client
+  cert list [-expiring days] | renew      the node's certificates
+  config show|diff [hysteria2|xray] [-template file] [-protocol p]
+  users                                   clients online on Xray
+  restart [hysteria2|xray]                restart one or every installed server
+  errors                                  last errors and warnings of the agent
+  iptables flush                          remove the agent's iptables chains`)
+	os.Exit(2)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"google.golang.org/grpc/status"
+	pb "hysteria2_microservices/proto"
+)
+
+// agentLoad drives the master's MasterService like a fleet of agents
+type agentLoad struct {
+	master pb.MasterServiceClient
+	stats  *stats
+	prefix string
+}
+
+// agent registers one simulated node and, until ctx is done, reports a batch of metrics and
+// a heartbeat every interval. The first report is delayed by up to an interval so the agents
+// spread out like a fleet started over time.
+func (a *agentLoad) agent(ctx context.Context, n int, interval time.Duration, batch int) {
+	name := fmt.Sprintf("%s-%d", a.prefix, n)
+
+	var nodeID string
+	for {
+		if nodeID = a.register(ctx, n, name); nodeID != "" {
+			break
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	select {
+	case <-time.After(time.Duration(rand.Int63n(int64(interval)))):
+	case <-ctx.Done():
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		a.reportMetrics(ctx, nodeID, batch)
+		a.heartbeat(ctx, nodeID)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (a *agentLoad) register(ctx context.Context, n int, name string) string {
+	start := time.Now()
+	resp, err := a.master.RegisterNode(ctx, &pb.RegisterNodeRequest{
+		Name:      name,
+		Hostname:  name,
+		IpAddress: fmt.Sprintf("198.18.%d.%d", n/250, n%250+1), // benchmarking range, RFC 2544
+		Location:  "Load test",
+		Country:   "ZZ",
+		GrpcPort:  50051,
+		Version:   "1.0.0",
+		Capabilities: map[string]string{
+			"hysteria2": "true",
+			"simulated": "true",
+		},
+		AuthToken: "dummy-token",
+	})
+	if !a.record(ctx, "grpc_register", start, err) {
+		return ""
+	}
+	if !resp.Success {
+		return ""
+	}
+	return resp.NodeId
+}
+
+func (a *agentLoad) heartbeat(ctx context.Context, nodeID string) {
+	start := time.Now()
+	_, err := a.master.Heartbeat(ctx, &pb.HeartbeatRequest{
+		NodeId:  nodeID,
+		Status:  "online",
+		Metrics: simulatedMetrics(),
+	})
+	a.record(ctx, "grpc_heartbeat", start, err)
+}
+
+// reportMetrics sends batch samples, as an agent does with the samples collected between
+// two reports
+func (a *agentLoad) reportMetrics(ctx context.Context, nodeID string, batch int) {
+	events := make([]*pb.MetricEvent, batch)
+	for i := range events {
+		events[i] = &pb.MetricEvent{
+			Values: simulatedMetrics(),
+			Labels: map[string]string{"source": "loadtest"},
+		}
+	}
+
+	start := time.Now()
+	_, err := a.master.ReportMetrics(ctx, &pb.ReportMetricsRequest{NodeId: nodeID, Metrics: events})
+	a.record(ctx, "grpc_report_metrics", start, err)
+}
+
+// record counts a call and reports whether it succeeded; a call cut short by the end of the
+// run is not counted
+func (a *agentLoad) record(ctx context.Context, operation string, start time.Time, err error) bool {
+	if err != nil && ctx.Err() != nil {
+		return false
+	}
+	failure := ""
+	if err != nil {
+		failure = status.Code(err).String()
+	}
+	a.stats.record(operation, time.Since(start), failure)
+	return err == nil
+}
+
+func simulatedMetrics() map[string]float64 {
+	connections := float64(rand.Intn(500))
+	return map[string]float64{
+		"cpu_usage":            5 + rand.Float64()*60,
+		"memory_usage":         20 + rand.Float64()*50,
+		"network_rx_bytes":     rand.Float64() * 1e9,
+		"network_tx_bytes":     rand.Float64() * 1e9,
+		"capacity_connections": connections,
+		"capacity_mbps":        connections * (0.5 + rand.Float64()),
+	}
+}
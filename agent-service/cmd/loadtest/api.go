@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// credential is an account a virtual user logs in with
+type credential struct {
+	Email    string
+	Password string
+}
+
+// loadCredentials reads "email:password" lines; blank lines and lines starting with # are
+// skipped
+func loadCredentials(path string) ([]credential, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var credentials []credential
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		email, password, ok := strings.Cut(text, ":")
+		if !ok || email == "" {
+			return nil, fmt.Errorf("%s:%d: expected email:password", path, line)
+		}
+		credentials = append(credentials, credential{Email: email, Password: password})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(credentials) == 0 {
+		return nil, fmt.Errorf("%s: no credentials", path)
+	}
+	return credentials, nil
+}
+
+// apiClient calls the API service like a client app
+type apiClient struct {
+	baseURL string
+	http    *http.Client
+	stats   *stats
+}
+
+// virtualUser logs in and fetches its subscription every think time, logging in again after
+// relogin fetches, until ctx is done. Think times are jittered by a fifth so the users do
+// not fall into step.
+func (c *apiClient) virtualUser(ctx context.Context, cred credential, think time.Duration, relogin int) {
+	var token string
+	for fetched := 0; ; fetched++ {
+		if token == "" || (relogin > 0 && fetched%relogin == 0) {
+			token, _ = c.login(ctx, cred)
+		}
+		if token != "" {
+			c.fetchSubscription(ctx, token)
+		}
+
+		jitter := time.Duration(float64(think) * (0.8 + 0.4*rand.Float64()))
+		select {
+		case <-time.After(jitter):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *apiClient) login(ctx context.Context, cred credential) (string, error) {
+	body, _ := json.Marshal(map[string]string{"email": cred.Email, "password": cred.Password})
+
+	var resp struct {
+		Token struct {
+			AccessToken string `json:"access_token"`
+		} `json:"token"`
+	}
+	if err := c.call(ctx, "api_login", http.MethodPost, "/api/v1/auth/login", "", body, &resp); err != nil {
+		return "", err
+	}
+	return resp.Token.AccessToken, nil
+}
+
+func (c *apiClient) fetchSubscription(ctx context.Context, token string) {
+	c.call(ctx, "api_subscription", http.MethodGet, "/api/v1/me/subscription", token, nil, nil)
+}
+
+// call sends a request and records its latency under operation; a call cut short by the end
+// of the run is not recorded
+func (c *apiClient) call(ctx context.Context, operation, method, path, token string, body []byte, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	start := time.Now()
+	resp, err := c.http.Do(req)
+	if err != nil {
+		if ctx.Err() == nil {
+			c.stats.record(operation, time.Since(start), "transport")
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	elapsed := time.Since(start)
+	if err != nil {
+		if ctx.Err() == nil {
+			c.stats.record(operation, elapsed, "transport")
+		}
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		c.stats.record(operation, elapsed, strconv.Itoa(resp.StatusCode))
+		return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	c.stats.record(operation, elapsed, "")
+
+	if out != nil {
+		return json.Unmarshal(data, out)
+	}
+	return nil
+}
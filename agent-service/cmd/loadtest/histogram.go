@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Latencies are counted in buckets growing by histogramGrowth from histogramMin, so
+// percentiles are accurate to a quarter of the value without keeping every sample
+const (
+	histogramMin     = 100 * time.Microsecond
+	histogramGrowth  = 1.25
+	histogramBuckets = 64 // up to about 2.5 hours
+)
+
+// histogram counts the latencies and failures of one operation
+type histogram struct {
+	mu      sync.Mutex
+	buckets [histogramBuckets]int64
+	count   int64
+	errors  int64
+	sum     time.Duration
+	min     time.Duration
+	max     time.Duration
+	codes   map[string]int64 // failures by status
+}
+
+func newHistogram() *histogram {
+	return &histogram{codes: map[string]int64{}}
+}
+
+// record counts a call that took d; a non-empty failure counts it failed with that status
+func (h *histogram) record(d time.Duration, failure string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.count++
+	h.sum += d
+	if h.count == 1 || d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+	h.buckets[bucketOf(d)]++
+	if failure != "" {
+		h.errors++
+		h.codes[failure]++
+	}
+}
+
+func bucketOf(d time.Duration) int {
+	if d <= histogramMin {
+		return 0
+	}
+	i := int(math.Ceil(math.Log(float64(d)/float64(histogramMin)) / math.Log(histogramGrowth)))
+	if i >= histogramBuckets {
+		return histogramBuckets - 1
+	}
+	return i
+}
+
+// bucketBound is the upper bound of bucket i
+func bucketBound(i int) time.Duration {
+	return time.Duration(float64(histogramMin) * math.Pow(histogramGrowth, float64(i)))
+}
+
+// summary is the outcome of one operation
+type summary struct {
+	Operation string           `json:"operation"`
+	Count     int64            `json:"count"`
+	Errors    int64            `json:"errors"`
+	Rate      float64          `json:"rate_per_second"`
+	MeanMs    float64          `json:"mean_ms"`
+	MinMs     float64          `json:"min_ms"`
+	P50Ms     float64          `json:"p50_ms"`
+	P90Ms     float64          `json:"p90_ms"`
+	P99Ms     float64          `json:"p99_ms"`
+	MaxMs     float64          `json:"max_ms"`
+	Failures  map[string]int64 `json:"failures,omitempty"`
+
+	buckets [histogramBuckets]int64
+}
+
+func (h *histogram) summary(operation string, elapsed time.Duration) summary {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := summary{
+		Operation: operation,
+		Count:     h.count,
+		Errors:    h.errors,
+		buckets:   h.buckets,
+	}
+	if h.count == 0 {
+		return s
+	}
+	s.Rate = float64(h.count) / elapsed.Seconds()
+	s.MeanMs = ms(h.sum / time.Duration(h.count))
+	s.MinMs = ms(h.min)
+	s.MaxMs = ms(h.max)
+	s.P50Ms = ms(h.percentile(0.50))
+	s.P90Ms = ms(h.percentile(0.90))
+	s.P99Ms = ms(h.percentile(0.99))
+	if len(h.codes) > 0 {
+		s.Failures = make(map[string]int64, len(h.codes))
+		for code, n := range h.codes {
+			s.Failures[code] = n
+		}
+	}
+	return s
+}
+
+// percentile returns the upper bound of the bucket holding the p-th latency, capped at max
+func (h *histogram) percentile(p float64) time.Duration {
+	rank := int64(math.Ceil(p * float64(h.count)))
+	var seen int64
+	for i, n := range h.buckets {
+		seen += n
+		if seen >= rank {
+			if bound := bucketBound(i); bound < h.max {
+				return bound
+			}
+			return h.max
+		}
+	}
+	return h.max
+}
+
+func ms(d time.Duration) float64 {
+	return math.Round(float64(d)/float64(time.Millisecond)*100) / 100
+}
+
+// printHistogram draws the non-empty latency buckets of s as bars
+func printHistogram(w io.Writer, s summary) {
+	first, last := -1, -1
+	var peak int64
+	for i, n := range s.buckets {
+		if n == 0 {
+			continue
+		}
+		if first < 0 {
+			first = i
+		}
+		last = i
+		if n > peak {
+			peak = n
+		}
+	}
+	if first < 0 {
+		return
+	}
+
+	const width = 40
+	for i := first; i <= last; i++ {
+		n := s.buckets[i]
+		bar := int(math.Round(float64(n) / float64(peak) * width))
+		if n > 0 && bar == 0 {
+			bar = 1
+		}
+		fmt.Fprintf(w, "  <= %10s %8d %s\n", bucketBound(i).Round(10*time.Microsecond), n, strings.Repeat("#", bar))
+	}
+}
+
+// printSummaries writes the table of every operation, followed by their histograms
+func printSummaries(w io.Writer, summaries []summary, elapsed time.Duration) {
+	fmt.Fprintf(w, "Elapsed %s\n\n", elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "%-22s %9s %7s %9s %9s %9s %9s %9s %9s\n",
+		"operation", "count", "errors", "rate/s", "mean ms", "p50 ms", "p90 ms", "p99 ms", "max ms")
+	for _, s := range summaries {
+		fmt.Fprintf(w, "%-22s %9d %7d %9.1f %9.2f %9.2f %9.2f %9.2f %9.2f\n",
+			s.Operation, s.Count, s.Errors, s.Rate, s.MeanMs, s.P50Ms, s.P90Ms, s.P99Ms, s.MaxMs)
+	}
+
+	for _, s := range summaries {
+		if s.Count == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\n%s\n", s.Operation)
+		printHistogram(w, s)
+		if len(s.Failures) > 0 {
+			codes := make([]string, 0, len(s.Failures))
+			for code := range s.Failures {
+				codes = append(codes, code)
+			}
+			sort.Strings(codes)
+			for _, code := range codes {
+				fmt.Fprintf(w, "  failed %s: %d\n", code, s.Failures[code])
+			}
+		}
+	}
+}
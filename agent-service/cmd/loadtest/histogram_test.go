@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogramSummary(t *testing.T) {
+	h := newHistogram()
+	for i := 1; i <= 100; i++ {
+		failure := ""
+		if i%10 == 0 {
+			failure = "500"
+		}
+		h.record(time.Duration(i)*time.Millisecond, failure)
+	}
+
+	s := h.summary("login", 10*time.Second)
+	if s.Count != 100 || s.Errors != 10 || s.Failures["500"] != 10 || s.Rate != 10 {
+		t.Errorf("summary = %+v", s)
+	}
+	if s.MinMs != 1 || s.MaxMs != 100 || s.MeanMs != 50.5 {
+		t.Errorf("min, mean, max = %g, %g, %g; want 1, 50.5, 100", s.MinMs, s.MeanMs, s.MaxMs)
+	}
+	// Percentiles are bucket bounds, at most a quarter over the latency, never over the max
+	for _, p := range []struct {
+		got, want float64
+	}{{s.P50Ms, 50}, {s.P90Ms, 90}, {s.P99Ms, 99}} {
+		if p.got < p.want || p.got > p.want*histogramGrowth {
+			t.Errorf("percentile %g ms, want %g to %g", p.got, p.want, p.want*histogramGrowth)
+		}
+	}
+	if s.P99Ms > s.MaxMs {
+		t.Errorf("p99 %g ms over the max %g ms", s.P99Ms, s.MaxMs)
+	}
+
+	if empty := newHistogram().summary("login", time.Second); empty.Count != 0 || empty.P99Ms != 0 {
+		t.Errorf("empty summary = %+v", empty)
+	}
+}
+
+func TestBucketOf(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want int
+	}{
+		{0, 0},
+		{histogramMin, 0},
+		{histogramMin + 1, 1},
+		{bucketBound(10), 10},
+		{24 * time.Hour, histogramBuckets - 1},
+	}
+	for _, tt := range tests {
+		if got := bucketOf(tt.d); got != tt.want {
+			t.Errorf("bucketOf(%s) = %d, want %d", tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestPrintSummaries(t *testing.T) {
+	h := newHistogram()
+	h.record(time.Millisecond, "")
+	h.record(time.Millisecond, "timeout")
+	h.record(time.Millisecond, "401")
+
+	var out strings.Builder
+	printSummaries(&out, []summary{h.summary("login", time.Second), newHistogram().summary("subscription", time.Second)}, time.Second)
+	got := out.String()
+	for _, want := range []string{"login", "subscription", "########################################", "failed 401: 1\n  failed timeout: 1\n"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output lacks %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestLoadCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials")
+	os.WriteFile(path, []byte("# load test accounts\n\nu1@example.com:secret:with:colons\n  u2@example.com:pw  \n"), 0600)
+	credentials, err := loadCredentials(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(credentials) != 2 || credentials[0].Password != "secret:with:colons" || credentials[1].Email != "u2@example.com" {
+		t.Errorf("credentials = %+v", credentials)
+	}
+
+	for name, data := range map[string]string{"no password": "u1@example.com\n", "no email": ":pw\n", "empty": "# none\n"} {
+		os.WriteFile(path, []byte(data), 0600)
+		if _, err := loadCredentials(path); err == nil {
+			t.Errorf("%s: loadCredentials succeeded", name)
+		}
+	}
+}
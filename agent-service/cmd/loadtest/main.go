@@ -0,0 +1,201 @@
+// loadtest puts the control plane under the load of many users and agents and reports the
+// latency of every call, for capacity planning.
+//
+//	loadtest -api http://api:8080 -credentials users.txt [-users n] [-think 5s]
+//	loadtest -master orchestrator:50052 [-agents n] [-metrics-interval 10s]
+//
+// Virtual users log in to the API service and fetch their subscription; simulated agents
+// register with the master and report metrics and heartbeats over gRPC. Both run together
+// when both addresses are given. The run ends after -duration or on SIGINT and prints a
+// table of latency percentiles with a histogram per call, or JSON with -json.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	pb "hysteria2_microservices/proto"
+)
+
+// stats holds the histograms of every operation
+type stats struct {
+	mu         sync.Mutex
+	histograms map[string]*histogram
+}
+
+func (s *stats) record(operation string, d time.Duration, failure string) {
+	s.mu.Lock()
+	h, ok := s.histograms[operation]
+	if !ok {
+		h = newHistogram()
+		s.histograms[operation] = h
+	}
+	s.mu.Unlock()
+
+	h.record(d, failure)
+}
+
+func (s *stats) summaries(elapsed time.Duration) []summary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	operations := make([]string, 0, len(s.histograms))
+	for operation := range s.histograms {
+		operations = append(operations, operation)
+	}
+	sort.Strings(operations)
+
+	summaries := make([]summary, 0, len(operations))
+	for _, operation := range operations {
+		summaries = append(summaries, s.histograms[operation].summary(operation, elapsed))
+	}
+	return summaries
+}
+
+func main() {
+	apiURL := flag.String("api", "", "API service base URL, e.g. http://localhost:8080")
+	credentialsFile := flag.String("credentials", "", "file of email:password lines the virtual users log in with")
+	users := flag.Int("users", 100, "virtual users; they share the accounts when there are fewer")
+	think := flag.Duration("think", 5*time.Second, "pause between the requests of a virtual user")
+	relogin := flag.Int("relogin", 10, "subscription fetches before a virtual user logs in again, 0 for never")
+	master := flag.String("master", "", "master gRPC address, e.g. localhost:50052")
+	agents := flag.Int("agents", 100, "simulated agents")
+	metricsInterval := flag.Duration("metrics-interval", 10*time.Second, "interval of the metric reports and heartbeats of an agent")
+	batch := flag.Int("batch", 6, "metric samples per report")
+	prefix := flag.String("name-prefix", "loadtest", "node names are the prefix and the agent number")
+	duration := flag.Duration("duration", time.Minute, "length of the run")
+	rampUp := flag.Duration("ramp-up", 10*time.Second, "time over which the users and agents are started")
+	timeout := flag.Duration("timeout", 30*time.Second, "timeout of a call")
+	jsonOutput := flag.Bool("json", false, "print the results as JSON")
+	flag.Parse()
+
+	if *apiURL == "" && *master == "" {
+		fmt.Fprintln(os.Stderr, "loadtest: give -api, -master or both")
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *apiURL != "" && *credentialsFile == "" {
+		exitOnError(fmt.Errorf("-api needs -credentials"))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *rampUp+*duration)
+	defer cancel()
+	go func() {
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+		<-quit
+		cancel()
+	}()
+
+	results := &stats{histograms: map[string]*histogram{}}
+	var workers []func(context.Context)
+
+	if *apiURL != "" {
+		credentials, err := loadCredentials(*credentialsFile)
+		exitOnError(err)
+
+		client := &apiClient{
+			baseURL: *apiURL,
+			http: &http.Client{
+				Timeout:   *timeout,
+				Transport: &http.Transport{MaxIdleConnsPerHost: *users},
+			},
+			stats: results,
+		}
+		for i := 0; i < *users; i++ {
+			cred := credentials[i%len(credentials)]
+			workers = append(workers, func(ctx context.Context) {
+				client.virtualUser(ctx, cred, *think, *relogin)
+			})
+		}
+	}
+
+	if *master != "" {
+		conn, err := grpc.Dial(*master, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		exitOnError(err)
+		defer conn.Close()
+
+		load := &agentLoad{master: timeoutClient{pb.NewMasterServiceClient(conn), *timeout}, stats: results, prefix: *prefix}
+		for i := 1; i <= *agents; i++ {
+			n := i
+			workers = append(workers, func(ctx context.Context) {
+				load.agent(ctx, n, *metricsInterval, *batch)
+			})
+		}
+	}
+
+	// Interleave the users and agents over the ramp-up
+	start := time.Now()
+	var wg sync.WaitGroup
+	step := time.Duration(0)
+	if len(workers) > 1 {
+		step = *rampUp / time.Duration(len(workers)-1)
+	}
+	for i, worker := range workers {
+		wg.Add(1)
+		go func(delay time.Duration, worker func(context.Context)) {
+			defer wg.Done()
+			select {
+			case <-time.After(delay):
+				worker(ctx)
+			case <-ctx.Done():
+			}
+		}(time.Duration(i)*step, worker)
+	}
+	wg.Wait()
+
+	elapsed := time.Since(start)
+	summaries := results.summaries(elapsed)
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		exitOnError(encoder.Encode(map[string]interface{}{
+			"elapsed_seconds": elapsed.Seconds(),
+			"operations":      summaries,
+		}))
+		return
+	}
+	printSummaries(os.Stdout, summaries, elapsed)
+}
+
+// timeoutClient bounds every call of the master client with a timeout
+type timeoutClient struct {
+	pb.MasterServiceClient
+	timeout time.Duration
+}
+
+func (c timeoutClient) RegisterNode(ctx context.Context, req *pb.RegisterNodeRequest, opts ...grpc.CallOption) (*pb.RegisterNodeResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return c.MasterServiceClient.RegisterNode(ctx, req, opts...)
+}
+
+func (c timeoutClient) Heartbeat(ctx context.Context, req *pb.HeartbeatRequest, opts ...grpc.CallOption) (*pb.HeartbeatResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return c.MasterServiceClient.Heartbeat(ctx, req, opts...)
+}
+
+func (c timeoutClient) ReportMetrics(ctx context.Context, req *pb.ReportMetricsRequest, opts ...grpc.CallOption) (*pb.ReportMetricsResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return c.MasterServiceClient.ReportMetrics(ctx, req, opts...)
+}
+
+func exitOnError(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "loadtest:", err)
+		os.Exit(1)
+	}
+}
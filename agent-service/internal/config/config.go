@@ -1,21 +1,55 @@
 package config
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 
 	"github.com/spf13/viper"
+
+	"hysteria2_microservices/agent-service/internal/secrets"
 )
 
 type Config struct {
-	MasterServer string          `mapstructure:"master_server"`
-	Node         NodeConfig      `mapstructure:"node"`
-	Metrics      MetricsConfig   `mapstructure:"metrics"`
-	Logging      LoggingConfig   `mapstructure:"logging"`
-	Network      NetworkConfig   `mapstructure:"network"`
-	Hysteria2    Hysteria2Config `mapstructure:"hysteria2"`
-	Xray         XrayConfig      `mapstructure:"xray"`
+	MasterServer string             `mapstructure:"master_server"`
+	Node         NodeConfig         `mapstructure:"node"`
+	Metrics      MetricsConfig      `mapstructure:"metrics"`
+	Logging      LoggingConfig      `mapstructure:"logging"`
+	Network      NetworkConfig      `mapstructure:"network"`
+	Hysteria2    Hysteria2Config    `mapstructure:"hysteria2"`
+	Xray         XrayConfig         `mapstructure:"xray"`
+	Decoy        DecoyConfig        `mapstructure:"decoy"`
+	PortMux      PortMuxConfig      `mapstructure:"port_mux"`
+	DNS          DNSConfig          `mapstructure:"dns"`
+	Firewall     FirewallConfig     `mapstructure:"firewall"`
+	BruteForce   BruteForceConfig   `mapstructure:"brute_force"`
+	Filter       FilterConfig       `mapstructure:"filter"`
+	Routing      RoutingConfig      `mapstructure:"routing_profiles"`
+	Artifacts    ArtifactsConfig    `mapstructure:"artifacts"`
+	Secrets      SecretsConfig      `mapstructure:"secrets"`
+	Sessions     SessionsConfig     `mapstructure:"sessions"`
+	Egress       EgressConfig       `mapstructure:"egress"`
+	WARPFailover WARPFailoverConfig `mapstructure:"warp_failover"`
+	WARPRotation WARPRotationConfig `mapstructure:"warp_rotation"`
+	Integrity    IntegrityConfig    `mapstructure:"integrity"`
+	Shutdown     ShutdownConfig     `mapstructure:"shutdown"`
+	Capacity     CapacityConfig     `mapstructure:"capacity"`
+	QoS          QoSConfig          `mapstructure:"qos"`
+	PortForward  PortForwardConfig  `mapstructure:"port_forward"`
+	Events       EventsConfig       `mapstructure:"events"`
+	Tunnel       TunnelConfig       `mapstructure:"tunnel"`
+	Admin        AdminConfig        `mapstructure:"admin"`
+	System       SystemConfig       `mapstructure:"system"`
+	Privilege    PrivilegeConfig    `mapstructure:"privilege"`
+	Commands     CommandsConfig     `mapstructure:"commands"`
+
+	// secretRefs maps secret fields configured as provider references to the reference
+	secretRefs map[string]string
+	resolver   *secrets.Resolver
 }
 
 type NodeConfig struct {
@@ -23,11 +57,13 @@ type NodeConfig struct {
 	Name         string            `mapstructure:"name"`
 	Hostname     string            `mapstructure:"hostname"`
 	IPAddress    string            `mapstructure:"ip_address"`
+	IPv6Address  string            `mapstructure:"ipv6_address"` // published as AAAA next to ip_address by DNS load balancing
 	Location     string            `mapstructure:"location"`
 	Country      string            `mapstructure:"country"`
 	GRPCPort     int               `mapstructure:"grpc_port"`
 	Capabilities map[string]string `mapstructure:"capabilities"`
 	Metadata     map[string]string `mapstructure:"metadata"`
+	Protocols    map[string]bool   `mapstructure:"protocols"` // Protocol matrix last applied from the orchestrator
 }
 
 type MetricsConfig struct {
@@ -43,11 +79,13 @@ type LoggingConfig struct {
 type NetworkConfig struct {
 	EnableMasquerading bool   `mapstructure:"enable_masquerading"`
 	DefaultInterface   string `mapstructure:"default_interface"`
+	EnableIPv6         bool   `mapstructure:"enable_ipv6"` // Dual-stack routing, listeners and checks when the host has a global IPv6 address
+	StateFile          string `mapstructure:"state_file"`  // Masquerade and WARP routing rules re-applied on start
 }
 
 type Hysteria2Config struct {
 	EnableBBR          bool   `mapstructure:"enable_bbr"`
-	EnableSystemd      bool   `mapstructure:"enable_systemd"`
+	EnableSystemd      bool   `mapstructure:"enable_systemd"` // run as a service of the host's init system, not only systemd
 	PortHopping        bool   `mapstructure:"port_hopping"`
 	HopInterval        int    `mapstructure:"hop_interval"` // seconds
 	HopStartPort       int    `mapstructure:"hop_start_port"`
@@ -63,12 +101,26 @@ type Hysteria2Config struct {
 	UpMbps             int    `mapstructure:"up_mbps"`
 	DownMbps           int    `mapstructure:"down_mbps"`
 
+	// Version management
+	Version            string `mapstructure:"version"`              // Pinned release such as "v2.6.1", empty for the latest
+	BinaryPath         string `mapstructure:"binary_path"`          // Installed server binary, replaced on upgrade
+	UpgradeHealthCheck int    `mapstructure:"upgrade_health_check"` // Seconds the upgraded server must stay up before the upgrade is kept
+
+	// Draining before a restart: new connections are rejected, then the server restarts once
+	// DrainConnections or fewer are left or DrainTimeout seconds passed. 0 restarts at once.
+	DrainTimeout     int `mapstructure:"drain_timeout"`
+	DrainConnections int `mapstructure:"drain_connections"`
+
 	// Advanced Obfuscation Settings for Russian DPI Bypass
+	ObfuscationPreset          string   `mapstructure:"obfuscation_preset"` // Orchestrator preset the settings below came from
 	AdvancedObfuscationEnabled bool     `mapstructure:"advanced_obfuscation_enabled"`
 	QUICObfuscationEnabled     bool     `mapstructure:"quic_obfuscation_enabled"`
 	QUICScrambleTransform      bool     `mapstructure:"quic_scramble_transform"`
 	QUICPacketPadding          int      `mapstructure:"quic_packet_padding"` // 1200-1500 bytes
 	QUICTimingRandomization    bool     `mapstructure:"quic_timing_randomization"`
+	QUICObfuscationKey         string   `mapstructure:"quic_obfuscation_key"`     // Shared key for the scramble transform
+	QUICRelayUpstreamPort      int      `mapstructure:"quic_relay_upstream_port"` // Loopback port Hysteria2 moves to behind the relay
+	QUICTimingJitterMs         int      `mapstructure:"quic_timing_jitter_ms"`    // Max inter-packet delay
 	TLSFingerprintRotation     bool     `mapstructure:"tls_fingerprint_rotation"`
 	TLSFingerprints            []string `mapstructure:"tls_fingerprints"` // ["chrome", "firefox", "safari"]
 	VLESSRealityEnabled        bool     `mapstructure:"vless_reality_enabled"`
@@ -98,10 +150,323 @@ type Hysteria2Config struct {
 	WARPClientType   string `mapstructure:"warp_client_type"` // "local", "docker"
 	WARPLicenseKey   string `mapstructure:"warp_license_key"`
 	WARPOrganization string `mapstructure:"warp_organization"`
+
+	// Destinations Hysteria2 sends direct while WARP carries the rest: addresses, CIDRs,
+	// domains with their subdomains, geoip:<country> or geosite:<list>
+	WARPBypass []string `mapstructure:"warp_bypass"`
+
+	// OpenPGP fingerprint the Cloudflare package signing key must have; any key served over
+	// TLS by pkg.cloudflareclient.com is trusted when empty
+	WARPRepoKeyFingerprint string `mapstructure:"warp_repo_key_fingerprint"`
+
+	// Cloudflare Zero Trust service token enrolling the client into WARPOrganization
+	WARPTeamsClientID     string `mapstructure:"warp_teams_client_id"`
+	WARPTeamsClientSecret string `mapstructure:"warp_teams_client_secret"`
+
+	// Docker WARP client, used when WARPClientType is "docker"
+	WARPDockerImage   string `mapstructure:"warp_docker_image"` // Image running warp-svc with a SOCKS5 proxy on WARPContainerPort
+	WARPContainerName string `mapstructure:"warp_container_name"`
+	WARPContainerPort int    `mapstructure:"warp_container_port"` // Proxy port inside the container, published on 127.0.0.1:WARPProxyPort
+	WARPDataDir       string `mapstructure:"warp_data_dir"`       // Registration state mounted into the container
+
+	// Masquerade Configuration (served to probes that fail Hysteria2 auth)
+	MasqueradeType          string            `mapstructure:"masquerade_type"`           // "string", "file", "proxy"
+	MasqueradeProxyURL      string            `mapstructure:"masquerade_proxy_url"`      // Upstream for "proxy" mode
+	MasqueradeRewriteHost   bool              `mapstructure:"masquerade_rewrite_host"`   // Rewrite Host header to upstream
+	MasqueradeFileDir       string            `mapstructure:"masquerade_file_dir"`       // Decoy website root for "file" mode
+	MasqueradeStringContent string            `mapstructure:"masquerade_string_content"` // Body for "string" mode
+	MasqueradeStringStatus  int               `mapstructure:"masquerade_string_status"`  // Status code for "string" mode
+	MasqueradeStringHeaders map[string]string `mapstructure:"masquerade_string_headers"` // Headers for "string" mode
+
+	// Certificate mode: "files" serves the certificates the agent issues with certbot or
+	// self-signs, "acme" has Hysteria2 obtain and renew its certificate itself
+	CertMode        string            `mapstructure:"cert_mode"`
+	ACMEDomains     []string          `mapstructure:"acme_domains"`      // Defaults to the SNI domains
+	ACMEEmail       string            `mapstructure:"acme_email"`        // Defaults to sni_email
+	ACMECA          string            `mapstructure:"acme_ca"`           // "letsencrypt" or "zerossl"
+	ACMEChallenge   string            `mapstructure:"acme_challenge"`    // "http", "tls" or "dns"
+	ACMEListenHost  string            `mapstructure:"acme_listen_host"`  // Address the challenge listener binds, empty for all
+	ACMEAltPort     int               `mapstructure:"acme_alt_port"`     // Challenge listener port when 80/443 is forwarded to it
+	ACMEDNSProvider string            `mapstructure:"acme_dns_provider"` // "cloudflare", "duckdns", "gandi", "godaddy", "namedotcom", "vultr"
+	ACMEDNSConfig   map[string]string `mapstructure:"acme_dns_config"`   // Provider credentials, e.g. cloudflare_api_token
+	ACMEDir         string            `mapstructure:"acme_dir"`          // Where Hysteria2 stores its account and certificates
+}
+
+// DecoyConfig controls the decoy website served to non-VPN traffic on TCP 443
+type DecoyConfig struct {
+	Enabled        bool   `mapstructure:"enabled"`
+	ListenAddr     string `mapstructure:"listen_addr"`      // HTTPS listener, e.g. ":443"
+	HTTPListenAddr string `mapstructure:"http_listen_addr"` // Plain HTTP listener redirecting to HTTPS, empty to disable
+	SiteDir        string `mapstructure:"site_dir"`         // Static site root, shared with file masquerade
+	SiteTitle      string `mapstructure:"site_title"`       // Title used when installing the bundled site
+	ServerHeader   string `mapstructure:"server_header"`    // Value of the Server response header
+}
+
+// PortMuxConfig controls the TCP demultiplexer that lets Xray and the decoy site share
+// one public port with Hysteria2. Hysteria2 keeps the UDP side of the port; TCP
+// connections are routed to loopback backends by TLS SNI and ALPN.
+type PortMuxConfig struct {
+	Enabled          bool           `mapstructure:"enabled"`
+	ListenAddr       string         `mapstructure:"listen_addr"`       // Public TCP listener, e.g. ":443"
+	DefaultBackend   string         `mapstructure:"default_backend"`   // Backend for unmatched and non-TLS traffic, usually the decoy site
+	Routes           []PortMuxRoute `mapstructure:"routes"`            // Evaluated in order, first match wins
+	HandshakeTimeout int            `mapstructure:"handshake_timeout"` // seconds to wait for the ClientHello
+}
+
+// PortMuxRoute sends connections matching any SNI and any ALPN to Backend. An empty list matches everything.
+type PortMuxRoute struct {
+	SNI     []string `mapstructure:"sni"`     // Exact names or "*.example.com"
+	ALPN    []string `mapstructure:"alpn"`    // e.g. "h2", "http/1.1"
+	Backend string   `mapstructure:"backend"` // host:port, normally on loopback
+}
+
+// DNSConfig controls the local resolver that answers all DNS on the node and forwards it
+// over DNS-over-HTTPS or DNS-over-TLS, through WARP when it is enabled, so no plaintext
+// DNS leaves the node
+type DNSConfig struct {
+	Enabled           bool      `mapstructure:"enabled"`
+	ListenAddr        string    `mapstructure:"listen_addr"`          // UDP and TCP listener, the target of the port 53 redirect
+	Upstreams         []string  `mapstructure:"upstreams"`            // DoH (https://) or DoT (tls://host[:853][?sni=name]) endpoints in fallback order, addressed by IP so they need no DNS themselves
+	ViaWARP           bool      `mapstructure:"via_warp"`             // Send upstream queries through the WARP SOCKS5 proxy when WARP is enabled
+	Rules             []DNSRule `mapstructure:"rules"`                // Per-domain overrides, first match wins
+	Intercept         bool      `mapstructure:"intercept"`            // Redirect all outgoing port 53 traffic to the resolver
+	Timeout           int       `mapstructure:"timeout"`              // seconds per upstream query
+	CacheSize         int       `mapstructure:"cache_size"`           // answers kept, 0 disables caching
+	CacheTTL          int       `mapstructure:"cache_ttl"`            // seconds
+	LeakCheckServer   string    `mapstructure:"leak_check_server"`    // Public resolver probed to confirm port 53 is intercepted
+	LeakCheckServerV6 string    `mapstructure:"leak_check_server_v6"` // IPv6 resolver probed when the node has IPv6
+	LeakCheckInterval int       `mapstructure:"leak_check_interval"`  // seconds, 0 disables periodic checks
+}
+
+// DNSRule sends queries for Domains and their subdomains to its own upstreams or route.
+// "*" matches every name.
+type DNSRule struct {
+	Domains   []string `mapstructure:"domains" json:"domains"`
+	Upstreams []string `mapstructure:"upstreams" json:"upstreams,omitempty"` // empty uses the default upstreams
+	Route     string   `mapstructure:"route" json:"route,omitempty"`         // "warp", "direct", or empty to follow via_warp
+}
+
+// FirewallConfig controls the default-deny inbound ruleset installed on the node. The
+// baseline always allows SSH, the agent gRPC port from the orchestrator and the VPN
+// ports of the configured services; everything else is dropped.
+type FirewallConfig struct {
+	Enabled           bool     `mapstructure:"enabled"`
+	Backend           string   `mapstructure:"backend"`            // "auto", "nftables" or "ufw"
+	SSHPort           int      `mapstructure:"ssh_port"`           // 0 leaves SSH closed
+	SSHSources        []string `mapstructure:"ssh_sources"`        // CIDRs allowed to reach SSH, empty allows any
+	ManagementSources []string `mapstructure:"management_sources"` // Orchestrator CIDRs for the gRPC port, empty resolves master_server
+	StateDir          string   `mapstructure:"state_dir"`          // Saved rules and the previous ruleset
+}
+
+// BruteForceConfig bans addresses that keep failing Hysteria2, Xray or SSH authentication.
+// Bans are enforced by the firewall, so they need the firewall to be enabled.
+type BruteForceConfig struct {
+	Enabled       bool     `mapstructure:"enabled"`
+	MaxRetries    int      `mapstructure:"max_retries"`     // failures within find_time that trigger a ban
+	FindTime      int      `mapstructure:"find_time"`       // seconds
+	BanTime       int      `mapstructure:"ban_time"`        // seconds
+	Sources       []string `mapstructure:"sources"`         // "hysteria2", "xray", "ssh"
+	Whitelist     []string `mapstructure:"whitelist"`       // IPs or CIDRs that are never banned
+	XrayAccessLog string   `mapstructure:"xray_access_log"` // Xray access log, written while the guard is enabled
+}
+
+// FilterConfig controls the domain blocklists and allowlists pushed by the orchestrator.
+// Lists are compiled into Xray routing rules and a Hysteria2 ACL.
+type FilterConfig struct {
+	StateDir        string `mapstructure:"state_dir"`         // Saved lists and the last downloaded copy of each
+	HysteriaACLPath string `mapstructure:"hysteria_acl_path"` // ACL loaded by Hysteria2 while any list is assigned
+	RefreshInterval int    `mapstructure:"refresh_interval"`  // seconds between downloads for lists without their own interval
+	MaxListSize     int64  `mapstructure:"max_list_size"`     // bytes accepted per downloaded list
+}
+
+// RoutingConfig controls the routing profiles pushed by the orchestrator, which send
+// domains and addresses to other nodes, WARP, the default outbound or nowhere
+type RoutingConfig struct {
+	StateDir string `mapstructure:"state_dir"` // Saved profiles and their compiled Hysteria2 routing
+}
+
+// ArtifactsConfig switches installs and upgrades from GitHub, get.hy2.sh and the Cloudflare
+// package repository to the orchestrator's artifact store, for nodes that cannot reach them
+type ArtifactsConfig struct {
+	Offline bool   `mapstructure:"offline"`
+	URL     string `mapstructure:"url"`   // e.g. "https://orchestrator.example.com:8081/artifacts"
+	Token   string `mapstructure:"token"` // the orchestrator's NODE_AUTH_TOKEN
+}
+
+// SecretsConfig controls encryption of secrets at rest. Secret fields of this config may be
+// sealed to the node key (see the secrets package) and are decrypted on load; generated
+// Hysteria2 and Xray configs are sealed when EncryptGenerated is set. Secret fields and
+// certificate key paths may also reference an env, file, Vault or KMS secret, which is
+// read again every RefreshInterval.
+type SecretsConfig struct {
+	KeyFile          string `mapstructure:"key_file"`          // Node X25519 private key, created on first start
+	EncryptGenerated bool   `mapstructure:"encrypt_generated"` // Seal secrets in generated server configs
+	RuntimeDir       string `mapstructure:"runtime_dir"`       // tmpfs directory for the decrypted copies servers run from
+	RefreshInterval  int    `mapstructure:"refresh_interval"`  // Seconds between reads of referenced secrets, 0 disables rotation
+}
+
+// SessionsConfig reports the clients online on Hysteria2 to the api-service, which keeps
+// the live session list and answers with the clients an operator disconnected. Clients
+// are known by their Hysteria2 auth ID, "<user_id>" or "<user_id>@<device_id>".
+type SessionsConfig struct {
+	Enabled            bool   `mapstructure:"enabled"`
+	APIURL             string `mapstructure:"api_url"`              // e.g. "http://api-service:8080"
+	Token              string `mapstructure:"token"`                // the api-service NODE_AUTH_TOKEN
+	PollInterval       int    `mapstructure:"poll_interval"`        // seconds between reads of the online clients
+	TrafficStatsListen string `mapstructure:"traffic_stats_listen"` // Hysteria2 traffic stats API, kept on loopback
+	TrafficStatsSecret string `mapstructure:"traffic_stats_secret"`
+	ConnectionLog      bool   `mapstructure:"connection_log"` // post finished sessions with the client address to the api-service analytics
+}
+
+// EgressConfig checks the addresses the node's traffic leaves from, directly and through
+// WARP when it is enabled, against DNS blocklists and the services that block datacenter
+// and VPN ranges, so operators can rotate addresses that went bad
+type EgressConfig struct {
+	Enabled  bool     `mapstructure:"enabled"`
+	Interval int      `mapstructure:"interval"`  // seconds between checks
+	Timeout  int      `mapstructure:"timeout"`   // seconds per request or lookup
+	EchoURLs []string `mapstructure:"echo_urls"` // endpoints answering with the caller's address in plain text, tried in order
+	GeoURL   string   `mapstructure:"geo_url"`   // ipinfo.io-style JSON lookup, "{ip}" is replaced by the address; empty skips it
+	DNSBLs   []string `mapstructure:"dnsbls"`    // blocklist zones; Spamhaus refuses queries sent through public resolvers
+	Services []string `mapstructure:"services"`  // "netflix", "youtube", "google"
+}
+
+// WARPFailoverConfig moves the traffic Hysteria2 sends through WARP to a backup egress
+// while the WARP monitor keeps finding WARP unhealthy, and back once it has recovered.
+// Recovering takes more healthy checks than failing over takes unhealthy ones, so a
+// flapping WARP stays failed over.
+type WARPFailoverConfig struct {
+	Enabled      bool   `mapstructure:"enabled"`
+	FailAfter    int    `mapstructure:"fail_after"`    // consecutive unhealthy checks before failing over
+	RecoverAfter int    `mapstructure:"recover_after"` // consecutive healthy checks before switching back
+	Backup       string `mapstructure:"backup"`        // "direct", or a socks5:// or http:// upstream URL
+	StateFile    string `mapstructure:"state_file"`
+}
+
+// WARPRotationConfig reconnects WARP, or replaces its registration to get a new egress
+// address, every Interval seconds and when the egress check finds the WARP address on a
+// blocklist. Hysteria2 is drained first, so fewer connections break with the old path.
+type WARPRotationConfig struct {
+	Enabled     bool   `mapstructure:"enabled"`
+	Mode        string `mapstructure:"mode"`         // "reconnect" or "reregister"
+	Interval    int    `mapstructure:"interval"`     // seconds between scheduled rotations, 0 rotates only on listings
+	OnBlocklist bool   `mapstructure:"on_blocklist"` // rotate when the egress check finds the WARP address listed
+	MinInterval int    `mapstructure:"min_interval"` // seconds at least between two rotations
+	Drain       bool   `mapstructure:"drain"`        // drain Hysteria2 clients before rotating
+	StateFile   string `mapstructure:"state_file"`
+}
+
+// IntegrityConfig watches the free space and inodes of the partitions holding the server
+// configs, certificates and DiskPaths, and the deployed configs: the agent records the hash
+// of every server config and ACL it writes to ManifestFile, and a config that no longer
+// matches was edited outside the agent and is reported as drift
+type IntegrityConfig struct {
+	Enabled         bool     `mapstructure:"enabled"`
+	Interval        int      `mapstructure:"interval"`          // seconds between checks
+	DiskPaths       []string `mapstructure:"disk_paths"`        // further directories whose partition is checked, such as log directories
+	DiskWarnPercent int      `mapstructure:"disk_warn_percent"` // space or inodes in use from which a partition is reported low; 0 disables
+	ManifestFile    string   `mapstructure:"manifest_file"`
+}
+
+// ShutdownConfig controls how the agent stops on SIGTERM. It reports the node going down
+// for maintenance, stops serving gRPC and waits up to Timeout for in-flight operations.
+// Hysteria2 and Xray keep serving clients unless StopServers is set, in which case the
+// agent starts them again on its next start.
+type ShutdownConfig struct {
+	Timeout     int    `mapstructure:"timeout"`      // seconds to wait for in-flight operations
+	StopServers bool   `mapstructure:"stop_servers"` // stop Hysteria2 and Xray with the agent
+	StateFile   string `mapstructure:"state_file"`   // how the agent last stopped, read on start
+}
+
+// CapacityConfig caps what the node admits: once MaxConnections client connections are open,
+// or while traffic on the default interface runs at MaxMbps, new connections to the public
+// ports are rejected and clients fail over to other nodes. Limits set by the orchestrator
+// are saved to StateFile and take precedence over the configured ones. 0 leaves a cap unset.
+type CapacityConfig struct {
+	MaxConnections int    `mapstructure:"max_connections"`
+	MaxMbps        int    `mapstructure:"max_mbps"`       // busier direction of the default interface
+	CheckInterval  int    `mapstructure:"check_interval"` // seconds between measurements
+	StateFile      string `mapstructure:"state_file"`
+}
+
+// QoSConfig sets up queueing on the node's egress interface: a fair-queueing qdisc that keeps
+// bulk transfers from delaying interactive traffic, and DSCP marks per traffic class. A policy
+// set by the orchestrator is saved to StateFile and takes precedence over the configured one.
+// Latency to ProbeTargets is measured every ProbeInterval seconds and around every policy
+// change, to show what the queueing does for it.
+type QoSConfig struct {
+	Enabled       bool     `mapstructure:"enabled"`
+	Qdisc         string   `mapstructure:"qdisc"`          // "fq_codel" or "cake"
+	BandwidthMbps int      `mapstructure:"bandwidth_mbps"` // rate CAKE shapes to, 0 leaves it unshaped
+	Interface     string   `mapstructure:"interface"`      // empty uses network.default_interface
+	ProbeTargets  []string `mapstructure:"probe_targets"`  // host:port reached over TCP
+	ProbeSamples  int      `mapstructure:"probe_samples"`  // handshakes per target in a measurement
+	ProbeInterval int      `mapstructure:"probe_interval"` // seconds, 0 only measures around policy changes
+	StateFile     string   `mapstructure:"state_file"`
+}
+
+// PortForwardConfig lets users expose a service they run elsewhere, e.g. a game server,
+// through the node: a public port between MinPort and MaxPort is DNATed to their target.
+// The forwards the orchestrator set are saved to StateFile and restored on start.
+type PortForwardConfig struct {
+	Enabled   bool   `mapstructure:"enabled"`
+	MinPort   int    `mapstructure:"min_port"`
+	MaxPort   int    `mapstructure:"max_port"`
+	StateFile string `mapstructure:"state_file"`
+}
+
+// EventsConfig publishes heartbeats, traffic samples and audit events to the NATS JetStream
+// event bus instead of calling the orchestrator and api-service for each. Events are held
+// in an outbox of Outbox events while NATS is unreachable. Empty URL disables the bus.
+type EventsConfig struct {
+	URL      string `mapstructure:"url"` // nats:// or tls://
+	Token    string `mapstructure:"token"`
+	User     string `mapstructure:"user"`
+	Password string `mapstructure:"password"`
+	Outbox   int    `mapstructure:"outbox"`
+}
+
+// TunnelConfig opens a reverse tunnel to the master server for nodes behind NAT or a
+// firewall closing the gRPC port: the master reaches the node's gRPC server over
+// connections the agent opens. Needs node.id.
+type TunnelConfig struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Token   string `mapstructure:"token"` // the orchestrator's NODE_AUTH_TOKEN
+}
+
+// AdminConfig serves a small HTTP API on loopback for operators logged in to the node, to
+// check and recover it while the orchestrator cannot reach it. Requests carry the token as
+// a bearer token; without one configured, a random token is written to TokenFile.
+type AdminConfig struct {
+	Enabled      bool   `mapstructure:"enabled"`
+	Listen       string `mapstructure:"listen"` // must be a loopback address
+	Token        string `mapstructure:"token"`
+	TokenFile    string `mapstructure:"token_file"`
+	ErrorLogSize int    `mapstructure:"error_log_size"` // errors and warnings kept for the errors endpoint
+}
+
+// SystemConfig overrides what the agent detects about the host; empty detects it
+type SystemConfig struct {
+	Init           string `mapstructure:"init"`            // systemd, openrc or none, which supervises processes itself
+	PackageManager string `mapstructure:"package_manager"` // apt, dnf, yum or apk
+}
+
+// PrivilegeConfig lets the agent run as an unprivileged user
+type PrivilegeConfig struct {
+	Helper string `mapstructure:"helper"` // setuid helper running allowlisted commands as root; unused when the agent runs as root
+}
+
+// CommandsConfig controls how the agent runs external commands
+type CommandsConfig struct {
+	Timeout    int      `mapstructure:"timeout"`     // seconds per command
+	DryRun     bool     `mapstructure:"dry_run"`     // log commands without running them
+	InheritEnv bool     `mapstructure:"inherit_env"` // pass the agent's environment to commands
+	Env        []string `mapstructure:"env"`         // KEY=value pairs added for every command
 }
 
 type XrayConfig struct {
 	EnableAPI          bool     `mapstructure:"enable_api"`
+	APIListen          string   `mapstructure:"api_listen"` // Handler and stats API, kept on loopback
 	ListenPort         int      `mapstructure:"listen_port"`
 	LogLevel           string   `mapstructure:"log_level"`
 	SupportedProtocols []string `mapstructure:"supported_protocols"` // ["vless", "reality", "vmess", etc.]
@@ -119,9 +484,27 @@ type XrayConfig struct {
 	RealityPublicKey   string   `mapstructure:"reality_public_key"`
 	RealityShortIds    []string `mapstructure:"reality_short_ids"`
 
+	// Trojan specific
+	TrojanPort     int    `mapstructure:"trojan_port"`
+	TrojanPassword string `mapstructure:"trojan_password"`
+
+	// Shadowsocks-2022 specific
+	ShadowsocksPort     int    `mapstructure:"shadowsocks_port"`
+	ShadowsocksMethod   string `mapstructure:"shadowsocks_method"`   // "2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm"
+	ShadowsocksPassword string `mapstructure:"shadowsocks_password"` // base64 server key sized for the method
+
 	// Certificate management
 	CertPath string `mapstructure:"cert_path"`
 	KeyPath  string `mapstructure:"key_path"`
+
+	// Server config written by inbound and user management
+	ConfigPath string `mapstructure:"config_path"`
+
+	// Version management
+	Version            string `mapstructure:"version"`              // Pinned release such as "v25.1.30", empty for the latest
+	BinaryPath         string `mapstructure:"binary_path"`          // Installed server binary, replaced on upgrade
+	AssetDir           string `mapstructure:"asset_dir"`            // geoip.dat and geosite.dat shipped with each release
+	UpgradeHealthCheck int    `mapstructure:"upgrade_health_check"` // Seconds the upgraded server must stay up before the upgrade is kept
 }
 
 func LoadConfig() (*Config, error) {
@@ -149,9 +532,131 @@ func LoadConfig() (*Config, error) {
 		return nil, fmt.Errorf("error unmarshaling config: %w", err)
 	}
 
+	if err := config.openSecrets(); err != nil {
+		return nil, err
+	}
+
 	return &config, nil
 }
 
+// SecretFields returns the config fields holding secrets, which may be sealed on disk
+func (c *Config) SecretFields() map[string]*string {
+	return map[string]*string{
+		"hysteria2.auth_password":            &c.Hysteria2.AuthPassword,
+		"hysteria2.salamander_password":      &c.Hysteria2.SalamanderPassword,
+		"hysteria2.quic_obfuscation_key":     &c.Hysteria2.QUICObfuscationKey,
+		"hysteria2.warp_license_key":         &c.Hysteria2.WARPLicenseKey,
+		"hysteria2.warp_teams_client_secret": &c.Hysteria2.WARPTeamsClientSecret,
+		"xray.reality_private_key":           &c.Xray.RealityPrivateKey,
+		"xray.trojan_password":               &c.Xray.TrojanPassword,
+		"xray.shadowsocks_password":          &c.Xray.ShadowsocksPassword,
+		"artifacts.token":                    &c.Artifacts.Token,
+		"sessions.token":                     &c.Sessions.Token,
+		"sessions.traffic_stats_secret":      &c.Sessions.TrafficStatsSecret,
+		"events.token":                       &c.Events.Token,
+		"events.password":                    &c.Events.Password,
+		"tunnel.token":                       &c.Tunnel.Token,
+		"admin.token":                        &c.Admin.Token,
+	}
+}
+
+// SecretKeyFields returns the certificate private key paths. A key path may reference a
+// secret holding the PEM key instead, which is written to the runtime directory.
+func (c *Config) SecretKeyFields() map[string]*string {
+	return map[string]*string{
+		"hysteria2.sni_key_path": &c.Hysteria2.SNIKeyPath,
+		"xray.key_path":          &c.Xray.KeyPath,
+	}
+}
+
+// openSecrets resolves provider references and decrypts sealed secret fields in place,
+// loading the node key only when some field is sealed
+func (c *Config) openSecrets() error {
+	c.resolver = secrets.NewResolverFromEnv()
+	c.secretRefs = make(map[string]string)
+	for name, field := range c.SecretFields() {
+		if c.resolver.IsReference(*field) {
+			c.secretRefs[name] = *field
+		}
+	}
+	for name, field := range c.SecretKeyFields() {
+		if c.resolver.IsReference(*field) {
+			c.secretRefs[name] = *field
+		}
+	}
+	if _, err := c.RefreshSecrets(context.Background()); err != nil {
+		return err
+	}
+
+	var keyring *secrets.Keyring
+	for name, field := range c.SecretFields() {
+		if !secrets.IsSealed(*field) {
+			continue
+		}
+		if keyring == nil {
+			var err error
+			if keyring, err = secrets.LoadKey(c.Secrets.KeyFile); err != nil {
+				return fmt.Errorf("config has sealed secrets: %w", err)
+			}
+		}
+		value, err := keyring.Open(*field)
+		if err != nil {
+			return fmt.Errorf("error decrypting %s: %w", name, err)
+		}
+		*field = value
+	}
+	return nil
+}
+
+// RefreshSecrets reads the referenced secrets again and returns the fields that changed.
+// A field whose secret cannot be read keeps its previous value.
+func (c *Config) RefreshSecrets(ctx context.Context) ([]string, error) {
+	fields := c.SecretFields()
+	keyFields := c.SecretKeyFields()
+
+	var changed []string
+	var errs []error
+	for name, ref := range c.secretRefs {
+		value, err := c.resolver.Resolve(ctx, ref)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+
+		if field, ok := keyFields[name]; ok {
+			path := filepath.Join(c.Secrets.RuntimeDir, strings.ReplaceAll(name, ".", "-")+".pem")
+			current, _ := os.ReadFile(path)
+			if *field == path && string(current) == value+"\n" {
+				continue
+			}
+			if err := writeKeyFile(path, value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				continue
+			}
+			*field = path
+		} else {
+			if *fields[name] == value {
+				continue
+			}
+			*fields[name] = value
+		}
+		changed = append(changed, name)
+	}
+	return changed, errors.Join(errs...)
+}
+
+// writeKeyFile stores a private key read from a secret store where only root can read it
+func writeKeyFile(path, key string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create runtime directory: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(key+"\n"), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
 func setDefaults() {
 	viper.SetDefault("master_server", "")
 	viper.SetDefault("node.grpc_port", 50051)
@@ -161,6 +666,8 @@ func setDefaults() {
 	viper.SetDefault("logging.format", "text")
 	viper.SetDefault("network.enable_masquerading", false)
 	viper.SetDefault("network.default_interface", "eth0")
+	viper.SetDefault("network.enable_ipv6", true)
+	viper.SetDefault("network.state_file", "/etc/hysteria2-agent/routing.json")
 	viper.SetDefault("hysteria2.enable_bbr", true)
 	viper.SetDefault("hysteria2.enable_systemd", true)
 	viper.SetDefault("hysteria2.port_hopping", false)
@@ -173,6 +680,11 @@ func setDefaults() {
 	viper.SetDefault("hysteria2.auth_type", "password")
 	viper.SetDefault("hysteria2.up_mbps", 100)
 	viper.SetDefault("hysteria2.down_mbps", 100)
+	viper.SetDefault("hysteria2.version", "")
+	viper.SetDefault("hysteria2.binary_path", "/usr/local/bin/hysteria")
+	viper.SetDefault("hysteria2.upgrade_health_check", 15)
+	viper.SetDefault("hysteria2.drain_timeout", 30)
+	viper.SetDefault("hysteria2.drain_connections", 0)
 	viper.SetDefault("hysteria2.sni_enabled", false)
 	viper.SetDefault("hysteria2.sni_domains", []string{})
 	viper.SetDefault("hysteria2.default_sni", "")
@@ -193,6 +705,14 @@ func setDefaults() {
 	viper.SetDefault("hysteria2.warp_client_type", "local")
 	viper.SetDefault("hysteria2.warp_license_key", "")
 	viper.SetDefault("hysteria2.warp_organization", "")
+	viper.SetDefault("hysteria2.warp_bypass", []string{})
+	viper.SetDefault("hysteria2.warp_repo_key_fingerprint", "")
+	viper.SetDefault("hysteria2.warp_teams_client_id", "")
+	viper.SetDefault("hysteria2.warp_teams_client_secret", "")
+	viper.SetDefault("hysteria2.warp_docker_image", "caomingjun/warp:latest")
+	viper.SetDefault("hysteria2.warp_container_name", "hysteria-warp")
+	viper.SetDefault("hysteria2.warp_container_port", 1080)
+	viper.SetDefault("hysteria2.warp_data_dir", "/var/lib/hysteria2-agent/warp")
 
 	// Advanced obfuscation defaults for Russian DPI bypass
 	viper.SetDefault("hysteria2.advanced_obfuscation_enabled", false)
@@ -200,6 +720,9 @@ func setDefaults() {
 	viper.SetDefault("hysteria2.quic_scramble_transform", false)
 	viper.SetDefault("hysteria2.quic_packet_padding", 1300)
 	viper.SetDefault("hysteria2.quic_timing_randomization", false)
+	viper.SetDefault("hysteria2.quic_obfuscation_key", "")
+	viper.SetDefault("hysteria2.quic_relay_upstream_port", 18443)
+	viper.SetDefault("hysteria2.quic_timing_jitter_ms", 15)
 	viper.SetDefault("hysteria2.tls_fingerprint_rotation", false)
 	viper.SetDefault("hysteria2.tls_fingerprints", []string{"chrome"})
 	viper.SetDefault("hysteria2.vless_reality_enabled", false)
@@ -208,15 +731,194 @@ func setDefaults() {
 	viper.SetDefault("hysteria2.traffic_shaping_enabled", false)
 	viper.SetDefault("hysteria2.behavioral_randomization", false)
 
+	// Masquerade defaults
+	viper.SetDefault("hysteria2.masquerade_type", "proxy")
+	viper.SetDefault("hysteria2.masquerade_proxy_url", "https://www.google.com")
+	viper.SetDefault("hysteria2.masquerade_rewrite_host", true)
+	viper.SetDefault("hysteria2.masquerade_file_dir", "/var/www/masquerade")
+	viper.SetDefault("hysteria2.masquerade_string_content", "")
+	viper.SetDefault("hysteria2.masquerade_string_status", 200)
+	viper.SetDefault("hysteria2.masquerade_string_headers", map[string]string{"content-type": "text/html; charset=utf-8"})
+
+	// Certificate mode defaults
+	viper.SetDefault("hysteria2.cert_mode", "files")
+	viper.SetDefault("hysteria2.acme_domains", []string{})
+	viper.SetDefault("hysteria2.acme_email", "")
+	viper.SetDefault("hysteria2.acme_ca", "letsencrypt")
+	viper.SetDefault("hysteria2.acme_challenge", "http")
+	viper.SetDefault("hysteria2.acme_listen_host", "")
+	viper.SetDefault("hysteria2.acme_alt_port", 0)
+	viper.SetDefault("hysteria2.acme_dns_provider", "")
+	viper.SetDefault("hysteria2.acme_dir", "/var/lib/hysteria/acme")
+
+	// Decoy website defaults
+	viper.SetDefault("decoy.enabled", false)
+	viper.SetDefault("decoy.listen_addr", ":443")
+	viper.SetDefault("decoy.http_listen_addr", "") // certbot --standalone needs :80 for http-01
+	viper.SetDefault("decoy.site_dir", "/var/www/masquerade")
+	viper.SetDefault("decoy.site_title", "")
+	viper.SetDefault("decoy.server_header", "nginx")
+
+	// Port mux defaults
+	viper.SetDefault("port_mux.enabled", false)
+	viper.SetDefault("port_mux.listen_addr", ":443")
+	viper.SetDefault("port_mux.default_backend", "127.0.0.1:8444")
+	viper.SetDefault("port_mux.handshake_timeout", 5)
+
+	// DNS resolver defaults
+	viper.SetDefault("dns.enabled", true)
+	viper.SetDefault("dns.listen_addr", "127.0.0.1:53")
+	viper.SetDefault("dns.upstreams", []string{"https://1.1.1.1/dns-query", "https://1.0.0.1/dns-query"})
+	viper.SetDefault("dns.via_warp", true)
+	viper.SetDefault("dns.intercept", true)
+	viper.SetDefault("dns.timeout", 5)
+	viper.SetDefault("dns.cache_size", 4096)
+	viper.SetDefault("dns.cache_ttl", 60)
+	viper.SetDefault("dns.leak_check_server", "8.8.8.8:53")
+	viper.SetDefault("dns.leak_check_server_v6", "[2001:4860:4860::8888]:53")
+	viper.SetDefault("dns.leak_check_interval", 300)
+
+	// Firewall defaults
+	viper.SetDefault("firewall.enabled", false)
+	viper.SetDefault("firewall.backend", "auto")
+	viper.SetDefault("firewall.ssh_port", 22)
+	viper.SetDefault("firewall.ssh_sources", []string{})
+	viper.SetDefault("firewall.management_sources", []string{})
+	viper.SetDefault("firewall.state_dir", "/etc/hysteria2-agent/firewall")
+
+	// Brute-force protection defaults
+	viper.SetDefault("brute_force.enabled", false)
+	viper.SetDefault("brute_force.max_retries", 5)
+	viper.SetDefault("brute_force.find_time", 600)
+	viper.SetDefault("brute_force.ban_time", 3600)
+	viper.SetDefault("brute_force.sources", []string{"hysteria2", "xray", "ssh"})
+	viper.SetDefault("brute_force.whitelist", []string{})
+	viper.SetDefault("brute_force.xray_access_log", "/var/log/xray/access.log")
+
+	// Content filter defaults
+	viper.SetDefault("filter.state_dir", "/etc/hysteria2-agent/filter")
+	viper.SetDefault("filter.hysteria_acl_path", "/etc/hysteria/filter.acl")
+	viper.SetDefault("filter.refresh_interval", 86400)
+	viper.SetDefault("filter.max_list_size", 64<<20)
+
+	// Routing profile defaults
+	viper.SetDefault("routing_profiles.state_dir", "/etc/hysteria2-agent/routing-profiles")
+
+	viper.SetDefault("artifacts.offline", false)
+
+	// Secrets at rest defaults
+	viper.SetDefault("secrets.key_file", "/etc/hysteria2-agent/node.key")
+	viper.SetDefault("secrets.encrypt_generated", false)
+	viper.SetDefault("secrets.runtime_dir", "/run/hysteria2-agent")
+	viper.SetDefault("secrets.refresh_interval", 0)
+
+	// Live session defaults
+	viper.SetDefault("sessions.enabled", false)
+	viper.SetDefault("sessions.poll_interval", 10)
+	viper.SetDefault("sessions.traffic_stats_listen", "127.0.0.1:25413")
+	viper.SetDefault("sessions.connection_log", true)
+
+	// Egress reputation defaults
+	viper.SetDefault("egress.enabled", true)
+	viper.SetDefault("egress.interval", 21600)
+	viper.SetDefault("egress.timeout", 10)
+	viper.SetDefault("egress.echo_urls", []string{"https://api.ipify.org", "https://icanhazip.com", "https://ifconfig.me/ip"})
+	viper.SetDefault("egress.geo_url", "https://ipinfo.io/{ip}/json")
+	viper.SetDefault("egress.dnsbls", []string{"zen.spamhaus.org", "bl.spamcop.net", "b.barracudacentral.org"})
+	viper.SetDefault("egress.services", []string{"netflix", "youtube", "google"})
+
+	// WARP failover defaults
+	viper.SetDefault("warp_failover.enabled", false)
+	viper.SetDefault("warp_failover.fail_after", 3)
+	viper.SetDefault("warp_failover.recover_after", 10)
+	viper.SetDefault("warp_failover.backup", "direct")
+	viper.SetDefault("warp_failover.state_file", "/etc/hysteria2-agent/warp_failover.json")
+
+	// WARP rotation defaults
+	viper.SetDefault("warp_rotation.enabled", false)
+	viper.SetDefault("warp_rotation.mode", "reconnect")
+	viper.SetDefault("warp_rotation.interval", 86400)
+	viper.SetDefault("warp_rotation.on_blocklist", true)
+	viper.SetDefault("warp_rotation.min_interval", 3600)
+	viper.SetDefault("warp_rotation.drain", true)
+	viper.SetDefault("warp_rotation.state_file", "/etc/hysteria2-agent/warp_rotation.json")
+
+	// Integrity monitoring defaults
+	viper.SetDefault("integrity.enabled", true)
+	viper.SetDefault("integrity.interval", 300)
+	viper.SetDefault("integrity.disk_paths", []string{"/var/log"})
+	viper.SetDefault("integrity.disk_warn_percent", 90)
+	viper.SetDefault("integrity.manifest_file", "/etc/hysteria2-agent/integrity.json")
+
+	// Shutdown defaults
+	viper.SetDefault("shutdown.timeout", 30)
+	viper.SetDefault("shutdown.stop_servers", false)
+	viper.SetDefault("shutdown.state_file", "/etc/hysteria2-agent/state.json")
+
+	// Capacity defaults
+	viper.SetDefault("capacity.max_connections", 0)
+	viper.SetDefault("capacity.max_mbps", 0)
+	viper.SetDefault("capacity.check_interval", 10)
+	viper.SetDefault("capacity.state_file", "/etc/hysteria2-agent/capacity.json")
+
+	// QoS defaults
+	viper.SetDefault("qos.enabled", false)
+	viper.SetDefault("qos.qdisc", "fq_codel")
+	viper.SetDefault("qos.bandwidth_mbps", 0)
+	viper.SetDefault("qos.interface", "")
+	viper.SetDefault("qos.probe_targets", []string{"1.1.1.1:443", "8.8.8.8:443"})
+	viper.SetDefault("qos.probe_samples", 10)
+	viper.SetDefault("qos.probe_interval", 300)
+	viper.SetDefault("qos.state_file", "/etc/hysteria2-agent/qos.json")
+
+	// Port forward defaults
+	viper.SetDefault("port_forward.enabled", false)
+	viper.SetDefault("port_forward.min_port", 40000)
+	viper.SetDefault("port_forward.max_port", 49999)
+	viper.SetDefault("port_forward.state_file", "/etc/hysteria2-agent/port_forwards.json")
+
+	// Event bus defaults
+	viper.SetDefault("events.outbox", 10000)
+
+	// Reverse tunnel defaults
+	viper.SetDefault("tunnel.enabled", false)
+
+	// Local admin API defaults
+	viper.SetDefault("admin.enabled", true)
+	viper.SetDefault("admin.listen", "127.0.0.1:9190")
+	viper.SetDefault("admin.token_file", "/etc/hysteria2-agent/admin.token")
+	viper.SetDefault("admin.error_log_size", 100)
+
+	// Host detection is automatic unless overridden
+	viper.SetDefault("system.init", "")
+	viper.SetDefault("system.package_manager", "")
+
+	// Privilege separation defaults
+	viper.SetDefault("privilege.helper", "")
+
+	// External command defaults
+	viper.SetDefault("commands.timeout", 60)
+	viper.SetDefault("commands.dry_run", false)
+	viper.SetDefault("commands.inherit_env", true)
+
 	// Xray defaults
 	viper.SetDefault("xray.enable_api", false)
+	viper.SetDefault("xray.api_listen", "127.0.0.1:10085")
 	viper.SetDefault("xray.listen_port", 443)
 	viper.SetDefault("xray.log_level", "warning")
-	viper.SetDefault("xray.supported_protocols", []string{"vless", "reality"})
+	viper.SetDefault("xray.supported_protocols", []string{"vless", "reality", "trojan", "shadowsocks-2022"})
 	viper.SetDefault("xray.default_protocol", "vless")
 	viper.SetDefault("xray.enable_statistics", false)
 	viper.SetDefault("xray.cert_path", "/etc/xray/cert.pem")
 	viper.SetDefault("xray.key_path", "/etc/xray/key.pem")
+	viper.SetDefault("xray.config_path", "/etc/xray/config.json")
+	viper.SetDefault("xray.version", "")
+	viper.SetDefault("xray.binary_path", "/usr/local/bin/xray")
+	viper.SetDefault("xray.asset_dir", "/usr/local/share/xray")
+	viper.SetDefault("xray.upgrade_health_check", 15)
+	viper.SetDefault("xray.trojan_port", 8443)
+	viper.SetDefault("xray.shadowsocks_port", 8388)
+	viper.SetDefault("xray.shadowsocks_method", "2022-blake3-aes-128-gcm")
 }
 
 func bindEnvVars() {
@@ -225,11 +927,17 @@ func bindEnvVars() {
 	viper.BindEnv("node.name", "NODE_NAME")
 	viper.BindEnv("node.hostname", "NODE_HOSTNAME")
 	viper.BindEnv("node.ip_address", "NODE_IP_ADDRESS")
+	viper.BindEnv("node.ipv6_address", "NODE_IPV6_ADDRESS")
 	viper.BindEnv("node.location", "NODE_LOCATION")
 	viper.BindEnv("node.country", "NODE_COUNTRY")
 	viper.BindEnv("node.grpc_port", "NODE_GRPC_PORT")
 	viper.BindEnv("logging.level", "LOG_LEVEL")
 	viper.BindEnv("logging.format", "LOG_FORMAT")
+	viper.BindEnv("network.enable_ipv6", "ENABLE_IPV6")
+	viper.BindEnv("shutdown.timeout", "SHUTDOWN_TIMEOUT")
+	viper.BindEnv("shutdown.stop_servers", "SHUTDOWN_STOP_SERVERS")
+	viper.BindEnv("hysteria2.drain_timeout", "HYSTERIA2_DRAIN_TIMEOUT")
+	viper.BindEnv("hysteria2.drain_connections", "HYSTERIA2_DRAIN_CONNECTIONS")
 
 	// WARP environment variables
 	viper.BindEnv("hysteria2.warp_enabled", "WARP_ENABLED")
@@ -239,6 +947,149 @@ func bindEnvVars() {
 	viper.BindEnv("hysteria2.warp_client_type", "WARP_CLIENT_TYPE")
 	viper.BindEnv("hysteria2.warp_license_key", "WARP_LICENSE_KEY")
 	viper.BindEnv("hysteria2.warp_organization", "WARP_ORGANIZATION")
+	viper.BindEnv("hysteria2.warp_bypass", "WARP_BYPASS")
+	viper.BindEnv("hysteria2.warp_teams_client_id", "WARP_TEAMS_CLIENT_ID")
+	viper.BindEnv("hysteria2.warp_teams_client_secret", "WARP_TEAMS_CLIENT_SECRET")
+	viper.BindEnv("hysteria2.warp_docker_image", "WARP_DOCKER_IMAGE")
+	viper.BindEnv("hysteria2.warp_repo_key_fingerprint", "WARP_REPO_KEY_FINGERPRINT")
+
+	// Masquerade environment variables
+	viper.BindEnv("hysteria2.masquerade_type", "MASQUERADE_TYPE")
+	viper.BindEnv("hysteria2.masquerade_proxy_url", "MASQUERADE_PROXY_URL")
+	viper.BindEnv("hysteria2.masquerade_rewrite_host", "MASQUERADE_REWRITE_HOST")
+	viper.BindEnv("hysteria2.masquerade_file_dir", "MASQUERADE_FILE_DIR")
+	viper.BindEnv("hysteria2.masquerade_string_content", "MASQUERADE_STRING_CONTENT")
+	viper.BindEnv("hysteria2.masquerade_string_status", "MASQUERADE_STRING_STATUS")
+
+	// Certificate mode environment variables
+	viper.BindEnv("hysteria2.cert_mode", "HYSTERIA2_CERT_MODE")
+	viper.BindEnv("hysteria2.acme_email", "ACME_EMAIL")
+	viper.BindEnv("hysteria2.acme_challenge", "ACME_CHALLENGE")
+
+	// QUIC obfuscation environment variables
+	viper.BindEnv("hysteria2.quic_obfuscation_enabled", "QUIC_OBFUSCATION_ENABLED")
+	viper.BindEnv("hysteria2.quic_obfuscation_key", "QUIC_OBFUSCATION_KEY")
+	viper.BindEnv("hysteria2.quic_relay_upstream_port", "QUIC_RELAY_UPSTREAM_PORT")
+
+	// Decoy website environment variables
+	viper.BindEnv("decoy.enabled", "DECOY_ENABLED")
+	viper.BindEnv("decoy.listen_addr", "DECOY_LISTEN_ADDR")
+	viper.BindEnv("decoy.http_listen_addr", "DECOY_HTTP_LISTEN_ADDR")
+	viper.BindEnv("decoy.site_dir", "DECOY_SITE_DIR")
+	viper.BindEnv("decoy.site_title", "DECOY_SITE_TITLE")
+	viper.BindEnv("decoy.server_header", "DECOY_SERVER_HEADER")
+
+	// Port mux environment variables
+	viper.BindEnv("port_mux.enabled", "PORT_MUX_ENABLED")
+	viper.BindEnv("port_mux.listen_addr", "PORT_MUX_LISTEN_ADDR")
+	viper.BindEnv("port_mux.default_backend", "PORT_MUX_DEFAULT_BACKEND")
+
+	// DNS resolver environment variables
+	viper.BindEnv("dns.enabled", "DNS_ENABLED")
+	viper.BindEnv("dns.listen_addr", "DNS_LISTEN_ADDR")
+	viper.BindEnv("dns.upstreams", "DNS_UPSTREAMS")
+	viper.BindEnv("dns.via_warp", "DNS_VIA_WARP")
+	viper.BindEnv("dns.intercept", "DNS_INTERCEPT")
+
+	// Firewall environment variables
+	viper.BindEnv("firewall.enabled", "FIREWALL_ENABLED")
+	viper.BindEnv("firewall.backend", "FIREWALL_BACKEND")
+	viper.BindEnv("firewall.ssh_port", "FIREWALL_SSH_PORT")
+	viper.BindEnv("firewall.management_sources", "FIREWALL_MANAGEMENT_SOURCES")
+
+	// Brute-force protection environment variables
+	viper.BindEnv("brute_force.enabled", "BRUTE_FORCE_ENABLED")
+	viper.BindEnv("brute_force.max_retries", "BRUTE_FORCE_MAX_RETRIES")
+	viper.BindEnv("brute_force.ban_time", "BRUTE_FORCE_BAN_TIME")
+	viper.BindEnv("brute_force.whitelist", "BRUTE_FORCE_WHITELIST")
+
+	// Content filter environment variables
+	viper.BindEnv("filter.refresh_interval", "FILTER_REFRESH_INTERVAL")
+
+	// Offline install environment variables
+	viper.BindEnv("artifacts.offline", "ARTIFACTS_OFFLINE")
+	viper.BindEnv("artifacts.url", "ARTIFACTS_URL")
+	viper.BindEnv("artifacts.token", "NODE_AUTH_TOKEN")
+
+	// Secrets at rest environment variables
+	viper.BindEnv("secrets.key_file", "SECRETS_KEY_FILE")
+	viper.BindEnv("secrets.encrypt_generated", "SECRETS_ENCRYPT_GENERATED")
+	viper.BindEnv("secrets.refresh_interval", "SECRETS_REFRESH_INTERVAL")
+
+	// Live session environment variables
+	viper.BindEnv("sessions.enabled", "SESSIONS_ENABLED")
+	viper.BindEnv("sessions.api_url", "SESSIONS_API_URL")
+	viper.BindEnv("sessions.token", "NODE_AUTH_TOKEN")
+	viper.BindEnv("sessions.traffic_stats_secret", "SESSIONS_TRAFFIC_STATS_SECRET")
+	viper.BindEnv("sessions.connection_log", "SESSIONS_CONNECTION_LOG")
+
+	// Egress reputation environment variables
+	viper.BindEnv("egress.enabled", "EGRESS_CHECK_ENABLED")
+	viper.BindEnv("egress.interval", "EGRESS_CHECK_INTERVAL")
+	viper.BindEnv("egress.dnsbls", "EGRESS_DNSBLS")
+
+	// WARP failover environment variables
+	viper.BindEnv("warp_failover.enabled", "WARP_FAILOVER_ENABLED")
+	viper.BindEnv("warp_failover.backup", "WARP_FAILOVER_BACKUP")
+
+	// WARP rotation environment variables
+	viper.BindEnv("warp_rotation.enabled", "WARP_ROTATION_ENABLED")
+	viper.BindEnv("warp_rotation.mode", "WARP_ROTATION_MODE")
+	viper.BindEnv("warp_rotation.interval", "WARP_ROTATION_INTERVAL")
+
+	// Integrity monitoring environment variables
+	viper.BindEnv("integrity.enabled", "INTEGRITY_CHECK_ENABLED")
+	viper.BindEnv("integrity.interval", "INTEGRITY_CHECK_INTERVAL")
+	viper.BindEnv("integrity.disk_warn_percent", "INTEGRITY_DISK_WARN_PERCENT")
+
+	// Capacity environment variables
+	viper.BindEnv("capacity.max_connections", "CAPACITY_MAX_CONNECTIONS")
+	viper.BindEnv("capacity.max_mbps", "CAPACITY_MAX_MBPS")
+
+	// QoS environment variables
+	viper.BindEnv("qos.enabled", "QOS_ENABLED")
+	viper.BindEnv("qos.qdisc", "QOS_QDISC")
+	viper.BindEnv("qos.bandwidth_mbps", "QOS_BANDWIDTH_MBPS")
+
+	// Port forward environment variables
+	viper.BindEnv("port_forward.enabled", "PORT_FORWARD_ENABLED")
+	viper.BindEnv("port_forward.min_port", "PORT_FORWARD_MIN_PORT")
+	viper.BindEnv("port_forward.max_port", "PORT_FORWARD_MAX_PORT")
+
+	// Event bus environment variables
+	viper.BindEnv("events.url", "EVENTS_NATS_URL")
+	viper.BindEnv("events.token", "EVENTS_NATS_TOKEN")
+	viper.BindEnv("events.user", "EVENTS_NATS_USER")
+	viper.BindEnv("events.password", "EVENTS_NATS_PASSWORD")
+	viper.BindEnv("events.outbox", "EVENTS_OUTBOX_SIZE")
+
+	// Reverse tunnel environment variables
+	viper.BindEnv("tunnel.enabled", "TUNNEL_ENABLED")
+	viper.BindEnv("tunnel.token", "NODE_AUTH_TOKEN")
+
+	// Local admin API environment variables
+	viper.BindEnv("admin.enabled", "AGENT_ADMIN_ENABLED")
+	viper.BindEnv("admin.listen", "AGENT_ADMIN_LISTEN")
+	viper.BindEnv("admin.token", "AGENT_ADMIN_TOKEN")
+
+	// Host environment variables
+	viper.BindEnv("system.init", "SYSTEM_INIT")
+	viper.BindEnv("system.package_manager", "SYSTEM_PACKAGE_MANAGER")
+
+	// Privilege separation environment variables
+	viper.BindEnv("privilege.helper", "AGENT_PRIVILEGE_HELPER")
+
+	// External command environment variables
+	viper.BindEnv("commands.timeout", "COMMAND_TIMEOUT")
+	viper.BindEnv("commands.dry_run", "COMMAND_DRY_RUN")
+	viper.BindEnv("commands.inherit_env", "COMMAND_INHERIT_ENV")
+
+	// Xray environment variables
+	viper.BindEnv("xray.trojan_port", "XRAY_TROJAN_PORT")
+	viper.BindEnv("xray.trojan_password", "XRAY_TROJAN_PASSWORD")
+	viper.BindEnv("xray.shadowsocks_port", "XRAY_SHADOWSOCKS_PORT")
+	viper.BindEnv("xray.shadowsocks_method", "XRAY_SHADOWSOCKS_METHOD")
+	viper.BindEnv("xray.shadowsocks_password", "XRAY_SHADOWSOCKS_PASSWORD")
 }
 
 func GetEnvString(key, defaultValue string) string {
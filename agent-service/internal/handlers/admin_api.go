@@ -0,0 +1,296 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"hysteria2_microservices/agent-service/internal/config"
+	"hysteria2_microservices/agent-service/internal/services"
+)
+
+// LogEntry is an error or warning the agent logged
+type LogEntry struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Message string    `json:"message"`
+}
+
+// ErrorLog is a logrus hook keeping the last errors and warnings for the admin API
+type ErrorLog struct {
+	mu      sync.Mutex
+	entries []LogEntry
+	size    int
+}
+
+// NewErrorLog creates an ErrorLog keeping size entries
+func NewErrorLog(size int) *ErrorLog {
+	if size < 1 {
+		size = 1
+	}
+	return &ErrorLog{size: size}
+}
+
+// Levels returns the levels the hook keeps
+func (l *ErrorLog) Levels() []logrus.Level {
+	return []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel, logrus.WarnLevel}
+}
+
+// Fire keeps entry, dropping the oldest one when the log is full
+func (l *ErrorLog) Fire(entry *logrus.Entry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.entries) == l.size {
+		l.entries = l.entries[1:]
+	}
+	l.entries = append(l.entries, LogEntry{Time: entry.Time.UTC(), Level: entry.Level.String(), Message: entry.Message})
+	return nil
+}
+
+// Entries returns the kept entries, oldest first
+func (l *ErrorLog) Entries() []LogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]LogEntry{}, l.entries...)
+}
+
+// AdminAPI serves the local admin API: an operator logged in to the node can check it,
+// restart Hysteria2, flush the agent's iptables chains and read the last errors while the
+// orchestrator cannot reach it. It only listens on loopback and every request needs the
+// admin token.
+type AdminAPI struct {
+	localServices *services.LocalServices
+	agent         *Agent
+	config        *config.Config
+	logger        *logrus.Logger
+	errorLog      *ErrorLog
+	startedAt     time.Time
+	token         string
+}
+
+// NewAdminAPI creates the admin API and starts keeping the errors logged from now on
+func NewAdminAPI(localServices *services.LocalServices, agent *Agent, cfg *config.Config, logger *logrus.Logger) *AdminAPI {
+	errorLog := NewErrorLog(cfg.Admin.ErrorLogSize)
+	logger.AddHook(errorLog)
+	return &AdminAPI{
+		localServices: localServices,
+		agent:         agent,
+		config:        cfg,
+		logger:        logger,
+		errorLog:      errorLog,
+		startedAt:     time.Now().UTC(),
+	}
+}
+
+// Run serves the API until ctx is done
+func (api *AdminAPI) Run(ctx context.Context) error {
+	listen := api.config.Admin.Listen
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return fmt.Errorf("invalid admin.listen %q: %w", listen, err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("admin.listen %q is not a loopback address", listen)
+	}
+
+	token, err := api.loadToken()
+	if err != nil {
+		return fmt.Errorf("failed to set up the admin token: %w", err)
+	}
+	api.token = token
+
+	lis, err := net.Listen("tcp", listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", listen, err)
+	}
+	srv := &http.Server{
+		Handler:           api.handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       60 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	api.logger.Infof("Admin API listening on %s", lis.Addr())
+	if err := srv.Serve(lis); err != nil && err != http.ErrServerClosed {
+		return fmt.Errorf("admin API stopped: %w", err)
+	}
+	return nil
+}
+
+// loadToken returns the configured token, or the one in the token file, which is created
+// with a random token readable by root only when missing
+func (api *AdminAPI) loadToken() (string, error) {
+	if api.config.Admin.Token != "" {
+		return api.config.Admin.Token, nil
+	}
+	path := api.config.Admin.TokenFile
+	data, err := os.ReadFile(path)
+	if err == nil && strings.TrimSpace(string(data)) != "" {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return "", err
+	}
+	api.logger.Infof("Admin token written to %s", path)
+	return token, nil
+}
+
+func (api *AdminAPI) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", api.status)
+	mux.HandleFunc("GET /errors", api.recentErrors)
+	mux.HandleFunc("POST /hysteria2/restart", api.restartHysteria)
+	mux.HandleFunc("POST /iptables/flush", api.flushIPTables)
+	return api.authorize(mux)
+}
+
+// authorize rejects requests from other hosts, which a loopback listener only gets through
+// a local proxy, and requests without the token. Refusals are logged without the token.
+func (api *AdminAPI) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() || r.Header.Get("X-Forwarded-For") != "" {
+			api.logger.Warnf("Admin API refused %s %s from %s: not a local request", r.Method, r.URL.Path, r.RemoteAddr)
+			writeAdminError(w, http.StatusForbidden, "admin API only serves local requests")
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(api.token)) != 1 {
+			api.logger.Warnf("Admin API refused %s %s from %s: invalid admin token", r.Method, r.URL.Path, r.RemoteAddr)
+			writeAdminError(w, http.StatusUnauthorized, "invalid admin token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// status reports the agent, the link to the master and the servers
+func (api *AdminAPI) status(w http.ResponseWriter, r *http.Request) {
+	result := map[string]interface{}{
+		"node_id":       api.config.Node.ID,
+		"node_name":     api.config.Node.Name,
+		"agent_started": api.startedAt,
+	}
+
+	master := map[string]interface{}{"server": api.config.MasterServer}
+	last, heartbeatErr := api.agent.LastHeartbeat()
+	if !last.IsZero() {
+		master["last_heartbeat"] = last.UTC()
+	}
+	if heartbeatErr != "" {
+		master["heartbeat_error"] = heartbeatErr
+	}
+	result["master"] = master
+
+	if status, err := api.localServices.HysteriaManager.GetHysteria2Status(); err == nil {
+		result["hysteria2"] = status
+	} else {
+		result["hysteria2"] = map[string]string{"error": err.Error()}
+	}
+	if api.localServices.XrayManager.IsXrayInstalled() {
+		if status, err := api.localServices.XrayManager.GetXrayStatus(); err == nil {
+			result["xray"] = status
+		} else {
+			result["xray"] = map[string]string{"error": err.Error()}
+		}
+	}
+
+	if api.config.Hysteria2.WARPEnabled {
+		warp := map[string]interface{}{}
+		connected, err := api.localServices.WARPManager.IsWARPConnected()
+		warp["connected"] = connected
+		if err != nil {
+			warp["error"] = err.Error()
+		}
+		if state := api.localServices.WARPFailover.State(); state.Enabled {
+			warp["failover"] = state
+		}
+		if state := api.localServices.WARPRotator.State(); state.Enabled {
+			warp["rotation"] = state
+		}
+		result["warp"] = warp
+	}
+
+	if api.config.Firewall.Enabled {
+		missing, err := api.localServices.Firewall.Verify()
+		firewall := map[string]interface{}{"missing": missing}
+		if err != nil {
+			firewall["error"] = err.Error()
+		}
+		result["firewall"] = firewall
+	}
+	if report := api.localServices.EgressMonitor.LastReport(); report != nil {
+		result["egress"] = report
+	}
+
+	writeAdminJSON(w, http.StatusOK, result)
+}
+
+// recentErrors returns the last errors and warnings logged, oldest first
+func (api *AdminAPI) recentErrors(w http.ResponseWriter, r *http.Request) {
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{"entries": api.errorLog.Entries()})
+}
+
+// restartHysteria restarts Hysteria2 with its current config at once, cutting short a drain
+// in progress
+func (api *AdminAPI) restartHysteria(w http.ResponseWriter, r *http.Request) {
+	api.logger.Warn("Hysteria2 restart requested through the admin API")
+	hysteria := api.localServices.HysteriaManager
+	if err := hysteria.ForceRestartHysteria2(hysteria.ConfigPath()); err != nil {
+		writeAdminError(w, http.StatusInternalServerError, fmt.Sprintf("failed to restart Hysteria2: %v", err))
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{"restarted": "hysteria2"})
+}
+
+// flushIPTables removes the agent's iptables chains
+func (api *AdminAPI) flushIPTables(w http.ResponseWriter, r *http.Request) {
+	api.logger.Warn("iptables flush requested through the admin API")
+	removed, err := api.localServices.NetworkManager.FlushAgentRules()
+	if err != nil {
+		writeAdminJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": err.Error(), "removed": removed})
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{"removed": removed})
+}
+
+func writeAdminJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(body)
+}
+
+func writeAdminError(w http.ResponseWriter, code int, message string) {
+	writeAdminJSON(w, code, map[string]string{"error": message})
+}
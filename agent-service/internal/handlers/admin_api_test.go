@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newTestAdminAPI(token string) *AdminAPI {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	errorLog := NewErrorLog(10)
+	logger.AddHook(errorLog)
+	return &AdminAPI{logger: logger, errorLog: errorLog, token: token}
+}
+
+func TestAdminAPIAuthorize(t *testing.T) {
+	const token = "0123456789abcdef"
+	tests := []struct {
+		name          string
+		remoteAddr    string
+		authorization string
+		forwardedFor  string
+		want          int
+	}{
+		{"missing token", "127.0.0.1:40000", "", "", http.StatusUnauthorized},
+		{"wrong token", "127.0.0.1:40000", "Bearer fedcba9876543210", "", http.StatusUnauthorized},
+		{"not a bearer token", "127.0.0.1:40000", token, "", http.StatusUnauthorized},
+		{"other host", "192.0.2.10:40000", "Bearer " + token, "", http.StatusForbidden},
+		{"through a local proxy", "127.0.0.1:40000", "Bearer " + token, "192.0.2.10", http.StatusForbidden},
+		{"IPv6 loopback", "[::1]:40000", "Bearer " + token, "", http.StatusOK},
+		{"authorized", "127.0.0.1:40000", "Bearer " + token, "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newTestAdminAPI(token)
+			req := httptest.NewRequest(http.MethodGet, "/errors", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			if tt.forwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+			rec := httptest.NewRecorder()
+			api.handler().ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+}
+
+func TestAdminAPIErrorsHideToken(t *testing.T) {
+	const token = "0123456789abcdef"
+	api := newTestAdminAPI(token)
+	api.logger.Error("Hysteria2 failed to start")
+
+	// Refused requests are logged, the tokens they carried are not
+	for _, tried := range []string{token, "fedcba9876543210"} {
+		req := httptest.NewRequest(http.MethodGet, "/errors", nil)
+		req.RemoteAddr = "192.0.2.10:40000"
+		req.Header.Set("Authorization", "Bearer "+tried)
+		api.handler().ServeHTTP(httptest.NewRecorder(), req)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/errors", nil)
+	req.RemoteAddr = "127.0.0.1:40000"
+	req.Header.Set("Authorization", "Bearer fedcba9876543210")
+	api.handler().ServeHTTP(httptest.NewRecorder(), req)
+
+	req = httptest.NewRequest(http.MethodGet, "/errors", nil)
+	req.RemoteAddr = "127.0.0.1:40000"
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	api.handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	if body := rec.Body.String(); strings.Contains(body, token) || strings.Contains(body, "fedcba9876543210") {
+		t.Errorf("errors echo a token: %s", body)
+	}
+
+	var got struct {
+		Entries []LogEntry `json:"entries"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Entries) != 4 || got.Entries[0].Message != "Hysteria2 failed to start" || got.Entries[0].Level != "error" {
+		t.Errorf("entries = %+v, want the error and three refusals", got.Entries)
+	}
+}
+
+func TestErrorLogKeepsLatest(t *testing.T) {
+	log := NewErrorLog(2)
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	logger.AddHook(log)
+	logger.Info("not kept")
+	for _, msg := range []string{"first", "second", "third"} {
+		logger.Warn(msg)
+	}
+	entries := log.Entries()
+	if len(entries) != 2 || entries[0].Message != "second" || entries[1].Message != "third" {
+		t.Errorf("entries = %+v, want second and third", entries)
+	}
+}
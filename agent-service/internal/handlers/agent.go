@@ -2,11 +2,21 @@ package handlers
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"hysteria2_microservices/agent-service/internal/config"
+	"hysteria2_microservices/agent-service/internal/secrets"
 	"hysteria2_microservices/agent-service/internal/services"
+	"hysteria2_microservices/pkg/events"
 	pb "hysteria2_microservices/proto"
 )
 
@@ -14,8 +24,16 @@ import (
 type Agent struct {
 	localServices *services.LocalServices
 	masterClient  pb.MasterServiceClient
+	bus           *events.Bus // carries heartbeats and events instead of masterClient when set
 	config        *config.Config
 	logger        *logrus.Logger
+
+	startedAt time.Time
+	draining  atomic.Bool // going down for maintenance, see Drain
+
+	heartbeatMu    sync.Mutex
+	lastHeartbeat  time.Time // last heartbeat the master or event bus accepted
+	heartbeatError string    // error of the last heartbeat, empty when it went through
 }
 
 // NewAgent creates a new Agent
@@ -28,10 +46,30 @@ func NewAgent(localServices *services.LocalServices, masterClient pb.MasterServi
 	}
 }
 
+// SetEventBus publishes heartbeats and events to bus rather than calling the master; set
+// before Start
+func (a *Agent) SetEventBus(bus *events.Bus) {
+	a.bus = bus
+}
+
+// reporting tells whether heartbeats and events have somewhere to go
+func (a *Agent) reporting() bool {
+	return a.masterClient != nil || a.bus != nil
+}
+
 // Start starts the agent
 func (a *Agent) Start(ctx context.Context) error {
 	a.logger.Info("Starting agent...")
 
+	// Report egress health changes; set before the first check, which starts with the agent
+	if a.reporting() {
+		a.localServices.EgressMonitor.SetReporter(a.reportEgressHealth)
+		a.localServices.Integrity.SetReporter(a.reportIntegrity)
+		a.localServices.WARPFailover.SetReporter(a.reportWARPFailover)
+		a.localServices.WARPRotator.SetReporter(a.reportWARPRotation)
+		a.localServices.HysteriaManager.SetReloadReporter(a.reportReload)
+	}
+
 	// Register with master if client available
 	if a.masterClient != nil {
 		if err := a.registerWithMaster(ctx); err != nil {
@@ -39,11 +77,19 @@ func (a *Agent) Start(ctx context.Context) error {
 		}
 	}
 
-	// Start heartbeat if master client available
-	if a.masterClient != nil {
+	// Start the servers a graceful shutdown stopped and flag an unclean one
+	a.recoverState(ctx)
+
+	// Start heartbeat if master client or event bus available
+	if a.reporting() {
 		go a.heartbeatLoop(ctx)
 	}
 
+	// Report bans so the master can show them per node
+	if a.reporting() && a.config.BruteForce.Enabled {
+		a.localServices.BruteForceGuard.SetEventReporter(a.reportBanEvent)
+	}
+
 	// Enable masquerading if configured
 	if a.config.Network.EnableMasquerading {
 		if err := a.localServices.NetworkManager.EnableMasquerading(a.config.Network.DefaultInterface); err != nil {
@@ -53,6 +99,9 @@ func (a *Agent) Start(ctx context.Context) error {
 		}
 	}
 
+	// Re-apply the masquerading and WARP routing lost on reboot and tell the master what was repaired
+	a.reconcileRouting(ctx)
+
 	// Check and enable BBR if configured
 	if a.config.Hysteria2.EnableBBR {
 		if err := a.localServices.SystemManager.CheckAndEnableBBR(); err != nil {
@@ -86,17 +135,56 @@ func (a *Agent) registerWithMaster(ctx context.Context) error {
 		GrpcPort:  int32(a.config.Node.GRPCPort),
 		Version:   "1.0.0",
 		Capabilities: map[string]string{
-			"masquerading":  "true",
-			"network":       "true",
-			"hysteria2":     "true",
-			"xray":          "true",
-			"protocols":     "hysteria2,vless,vless-reality",
-			"vless":         "true",
-			"vless-reality": "true",
+			"masquerading":      "true",
+			"network":           "true",
+			"hysteria2":         "true",
+			"xray":              "true",
+			"protocols":         "hysteria2,vless,vless-reality,trojan,shadowsocks-2022",
+			"vless":             "true",
+			"vless-reality":     "true",
+			"trojan":            "true",
+			"shadowsocks-2022":  "true",
+			"port_mux":          strconv.FormatBool(a.config.PortMux.Enabled),
+			"dns_resolver":      strconv.FormatBool(a.config.DNS.Enabled),
+			"firewall":          strconv.FormatBool(a.config.Firewall.Enabled),
+			"brute_force_guard": strconv.FormatBool(a.config.BruteForce.Enabled),
+			"content_filter":    "true",
+			"routing_profiles":  "true",
+			"probe_runner":      "true",
+			"tls_check":         "true",
+			"speedtest":         "true",
+			"egress_check":      strconv.FormatBool(a.config.Egress.Enabled),
+			"integrity_check":   strconv.FormatBool(a.config.Integrity.Enabled),
+			"warp_failover":     strconv.FormatBool(a.config.WARPFailover.Enabled),
+			"warp_rotation":     strconv.FormatBool(a.config.WARPRotation.Enabled),
+			"drift_check":       "true",
+			"hysteria2_upgrade": "true",
+			"hysteria2_acme":    "true",
+			"cert_inventory":    "true",
+			"cert_upload":       "true",
+			"xray_upgrade":      "true",
+			"offline_install":   strconv.FormatBool(a.config.Artifacts.Offline),
+			"admission_control": "true",
+			"qos":               "true",
+			"port_forward":      strconv.FormatBool(a.config.PortForward.Enabled),
+			"outbound_policy":   "true",
+			"obfuscation":       "true",
+			"fault_injection":   strconv.FormatBool(services.FaultInjectionEnabled()),
+			// Public surface probed by other nodes in censorship resilience tests
+			"hysteria2_port":       strconv.Itoa(a.config.Hysteria2.DefaultListenPort),
+			"tls_ports":            joinPorts(services.PublicTLSPorts(a.config)),
+			"reality_server_names": strings.Join(a.config.Xray.RealityServerNames, ","),
 		},
 		AuthToken: "dummy-token", // TODO: implement proper auth
 		Metadata:  a.config.Node.Metadata,
 	}
+	if a.config.Node.IPv6Address != "" {
+		req.Capabilities["ipv6_address"] = a.config.Node.IPv6Address
+	}
+	// Secrets for this node can be sealed to its public key before they are stored
+	if keyring, err := secrets.LoadKey(a.config.Secrets.KeyFile); err == nil {
+		req.Capabilities["secrets_public_key"] = keyring.PublicKey()
+	}
 
 	resp, err := a.masterClient.RegisterNode(ctx, req)
 	if err != nil {
@@ -120,15 +208,31 @@ func (a *Agent) heartbeatLoop(ctx context.Context) {
 	for {
 		select {
 		case <-ticker.C:
-			if err := a.sendHeartbeat(ctx); err != nil {
+			err := a.sendHeartbeat(ctx)
+			if err != nil {
 				a.logger.Errorf("Failed to send heartbeat: %v", err)
 			}
+			a.heartbeatMu.Lock()
+			if err != nil {
+				a.heartbeatError = err.Error()
+			} else {
+				a.lastHeartbeat, a.heartbeatError = time.Now(), ""
+			}
+			a.heartbeatMu.Unlock()
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
+// LastHeartbeat returns when a heartbeat last went through and the error of the last one,
+// empty when it went through
+func (a *Agent) LastHeartbeat() (time.Time, string) {
+	a.heartbeatMu.Lock()
+	defer a.heartbeatMu.Unlock()
+	return a.lastHeartbeat, a.heartbeatError
+}
+
 func (a *Agent) sendHeartbeat(ctx context.Context) error {
 	// Collect metrics
 	metrics, err := a.localServices.MetricsCollector.Collect()
@@ -144,9 +248,91 @@ func (a *Agent) sendHeartbeat(ctx context.Context) error {
 		}
 	}
 
+	// Report the last DNS leak check so the master can flag leaking nodes
+	if a.config.DNS.Enabled {
+		if check := a.localServices.DNSResolver.LastLeakCheck(); check != nil {
+			metricValues["dns_leak_detected"] = 0
+			if check.Leaking {
+				metricValues["dns_leak_detected"] = 1
+			}
+		}
+	}
+
+	// Report the egress health so the master can flag nodes whose addresses went bad
+	if report := a.localServices.EgressMonitor.LastReport(); report != nil {
+		metricValues["egress_health"] = services.EgressHealthLevel(report.Health)
+		listed := 0
+		for _, path := range report.Paths {
+			for _, listing := range path.Listings {
+				if listing.Listed {
+					listed++
+				}
+			}
+		}
+		metricValues["egress_blocklist_listings"] = float64(listed)
+	}
+
+	// Report whether the backup egress carries WARP's traffic so the master can flag the node
+	if a.config.WARPFailover.Enabled {
+		metricValues["warp_failover_active"] = 0
+		if a.localServices.WARPFailover.State().Active {
+			metricValues["warp_failover_active"] = 1
+		}
+	}
+
+	// Report the fullest partition and drifted configs so the master can flag the node
+	if report := a.localServices.Integrity.LastReport(); report != nil {
+		var used, inodes float64
+		for _, disk := range report.Disks {
+			used = max(used, disk.UsedPercent)
+			inodes = max(inodes, disk.InodesUsedPercent)
+		}
+		metricValues["disk_used_percent"] = used
+		metricValues["disk_inodes_used_percent"] = inodes
+		metricValues["disk_low_partitions"] = float64(len(report.LowDisks()))
+		metricValues["config_drift_files"] = float64(len(report.Drifted()))
+	}
+
+	// Report the capacity in use so the master can place users on nodes with headroom
+	limits := a.localServices.Admission.Limits()
+	metricValues["capacity_max_connections"] = float64(limits.MaxConnections)
+	metricValues["capacity_max_mbps"] = float64(limits.MaxMbps)
+	if utilization := a.localServices.Admission.Utilization(); utilization != nil {
+		metricValues["capacity_connections"] = float64(utilization.Connections)
+		metricValues["capacity_mbps"] = utilization.Mbps
+		// Bytes per second the node sent and received, for the bandwidth graphs
+		metricValues["bandwidth_up"] = utilization.TxBytesPerSec
+		metricValues["bandwidth_down"] = utilization.RxBytesPerSec
+		metricValues["capacity_admission_closed"] = 0
+		if utilization.AdmissionClosed {
+			metricValues["capacity_admission_closed"] = 1
+		}
+	}
+
+	// Report the latency to the QoS probe targets so the effect of queueing can be followed
+	if latency := a.localServices.QoS.Latency(); latency != nil {
+		metricValues["qos_latency_ms"] = latency.MedianMs
+		metricValues["qos_latency_p95_ms"] = latency.P95Ms
+	}
+
+	status := "online"
+	if a.draining.Load() {
+		status = "maintenance"
+	}
+
+	// The orchestrator consumes heartbeats from the bus, catching up after an outage of
+	// either side
+	if a.bus != nil {
+		return a.bus.Publish(events.HeartbeatSubject(a.config.Node.ID), events.TypeHeartbeat, events.Heartbeat{
+			NodeID:  a.config.Node.ID,
+			Status:  status,
+			Metrics: metricValues,
+		})
+	}
+
 	req := &pb.HeartbeatRequest{
 		NodeId:    a.config.Node.ID,
-		Status:    "online",
+		Status:    status,
 		Metrics:   metricValues,
 		Timestamp: nil, // Will be set by protobuf
 	}
@@ -162,3 +348,333 @@ func (a *Agent) sendHeartbeat(ctx context.Context) error {
 
 	return nil
 }
+
+// Drain reports the node going down for maintenance. Heartbeats sent from now on carry the
+// maintenance status, so the orchestrator does not take the node for offline.
+func (a *Agent) Drain(ctx context.Context) {
+	a.draining.Store(true)
+	if !a.reporting() {
+		return
+	}
+
+	if err := a.sendHeartbeat(ctx); err != nil {
+		a.logger.Errorf("Failed to report maintenance status: %v", err)
+	}
+	servers := "running"
+	if a.config.Shutdown.StopServers {
+		servers = "stopped"
+	}
+	a.reportEvent(ctx, "agent_shutdown", "info", "Agent going down for maintenance", map[string]string{
+		"servers": servers,
+	})
+}
+
+// Stop completes a graceful shutdown once gRPC is drained: it waits for a firewall change in
+// progress, stops Hysteria2 and Xray when configured to and records the clean shutdown
+func (a *Agent) Stop() {
+	a.localServices.Firewall.Close()
+
+	state := &services.AgentState{Clean: true, StartedAt: a.startedAt, StoppedAt: time.Now().UTC()}
+	if a.config.Shutdown.StopServers {
+		state.StoppedServers = a.stopServers()
+	} else {
+		a.logger.Info("Leaving Hysteria2 and Xray serving clients")
+	}
+	if err := services.SaveAgentState(a.config.Shutdown.StateFile, state); err != nil {
+		a.logger.Errorf("Failed to save agent state: %v", err)
+	}
+}
+
+// recoverState reads how the agent last stopped and marks this run as not yet cleanly stopped
+func (a *Agent) recoverState(ctx context.Context) {
+	a.startedAt = time.Now().UTC()
+	path := a.config.Shutdown.StateFile
+
+	prev, err := services.LoadAgentState(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		a.logger.Warnf("Ignoring unreadable agent state: %v", err)
+	case !prev.Clean:
+		// The saved firewall rules are installed again on start, repairing a ruleset
+		// the previous run left half-applied
+		a.logger.Warnf("Agent started at %s did not shut down cleanly", prev.StartedAt.Format(time.RFC3339))
+		if a.reporting() {
+			a.reportEvent(ctx, "agent_unclean_restart", "warning", "Agent restarted after an unclean shutdown", map[string]string{
+				"started_at": prev.StartedAt.Format(time.RFC3339),
+			})
+		}
+	default:
+		a.startServers(prev.StoppedServers)
+	}
+
+	if err := services.SaveAgentState(path, &services.AgentState{StartedAt: a.startedAt}); err != nil {
+		a.logger.Errorf("Failed to save agent state: %v", err)
+	}
+}
+
+// reconcileRouting installs the saved routing rules that are missing and reports the check
+func (a *Agent) reconcileRouting(ctx context.Context) {
+	report, err := a.localServices.NetworkManager.Reconcile()
+	if err != nil {
+		a.logger.Errorf("Failed to reconcile routing rules: %v", err)
+		return
+	}
+
+	severity, message := "info", fmt.Sprintf("All %d routing rule set(s) in place", report.Checked)
+	if len(report.Missing) > 0 {
+		severity = "warning"
+		message = fmt.Sprintf("Re-applied %d of %d missing routing rule set(s)", len(report.Repaired), len(report.Missing))
+		a.logger.Warnf("%s: %s", message, strings.Join(report.Missing, ", "))
+	}
+	if len(report.Failed) > 0 {
+		severity = "error"
+		a.logger.Errorf("Failed to re-apply routing rules: %s", strings.Join(report.Failed, "; "))
+	}
+
+	if a.reporting() {
+		a.reportEvent(ctx, "routing_reconciled", severity, message, map[string]string{
+			"checked":  strconv.Itoa(report.Checked),
+			"missing":  strings.Join(report.Missing, ","),
+			"repaired": strings.Join(report.Repaired, ","),
+			"failed":   strings.Join(report.Failed, "; "),
+		})
+	}
+}
+
+// stopServers stops the running servers and returns the ones it stopped
+func (a *Agent) stopServers() []string {
+	var stopped []string
+	if status, err := a.localServices.HysteriaManager.GetHysteria2Status(); err == nil && status["running"] == true {
+		if err := a.localServices.HysteriaManager.StopHysteria2(); err != nil {
+			a.logger.Errorf("Failed to stop Hysteria2: %v", err)
+		} else {
+			stopped = append(stopped, services.ServerHysteria2)
+		}
+	}
+	if status, err := a.localServices.XrayManager.GetXrayStatus(); err == nil && status["running"] == true {
+		if err := a.localServices.XrayManager.StopXray(); err != nil {
+			a.logger.Errorf("Failed to stop Xray: %v", err)
+		} else {
+			stopped = append(stopped, services.ServerXray)
+		}
+	}
+	return stopped
+}
+
+// startServers starts the servers the last shutdown stopped from their saved configs
+func (a *Agent) startServers(names []string) {
+	for _, name := range names {
+		var err error
+		switch name {
+		case services.ServerHysteria2:
+			err = a.localServices.HysteriaManager.StartHysteria2(a.localServices.HysteriaManager.ConfigPath())
+		case services.ServerXray:
+			err = a.localServices.XrayManager.StartXray(a.localServices.XrayManager.ConfigPath())
+		default:
+			continue
+		}
+		if err != nil {
+			a.logger.Errorf("Failed to start %s stopped by the last shutdown: %v", name, err)
+		} else {
+			a.logger.Infof("Started %s stopped by the last shutdown", name)
+		}
+	}
+}
+
+// reportEvent records an event of the node in the audit trail over the bus, or reports it
+// to the master
+func (a *Agent) reportEvent(ctx context.Context, eventType, severity, message string, details map[string]string) {
+	if a.bus != nil {
+		err := a.bus.Publish(events.AuditSubject("agent"), events.TypeAudit, events.AuditEvent{
+			Action:   eventType,
+			Target:   a.config.Node.ID,
+			Severity: severity,
+			Message:  message,
+			Details:  details,
+		})
+		if err != nil {
+			a.logger.Errorf("Failed to publish %s event: %v", eventType, err)
+		}
+		return
+	}
+
+	_, err := a.masterClient.ReportEvent(ctx, &pb.EventReportRequest{
+		NodeId:    a.config.Node.ID,
+		EventType: eventType,
+		Severity:  severity,
+		Message:   message,
+		Details:   details,
+	})
+	if err != nil {
+		a.logger.Errorf("Failed to report %s event: %v", eventType, err)
+	}
+}
+
+func (a *Agent) reportBanEvent(event services.BanEvent) {
+	severity := "warning"
+	message := fmt.Sprintf("Banned %s: %s", event.Ban.IP, event.Ban.Reason)
+	if event.Type == services.BanEventUnbanned {
+		severity = "info"
+		message = fmt.Sprintf("Unbanned %s: %s", event.Ban.IP, event.Ban.Reason)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	a.reportEvent(ctx, event.Type, severity, message, map[string]string{
+		"ip":         event.Ban.IP,
+		"source":     event.Ban.Source,
+		"failures":   strconv.Itoa(event.Ban.Failures),
+		"banned_at":  event.Ban.BannedAt.Format(time.RFC3339),
+		"expires_at": event.Ban.ExpiresAt.Format(time.RFC3339),
+	})
+}
+
+// reportEgressHealth tells the master the node's egress addresses changed health, naming
+// the addresses and what was found
+func (a *Agent) reportEgressHealth(previous, current *services.EgressReport) {
+	severity := "info"
+	switch current.Health {
+	case services.EgressHealthDirty:
+		severity = "error"
+	case services.EgressHealthDegraded, services.EgressHealthUnknown:
+		severity = "warning"
+	}
+	if previous == nil && severity == "info" {
+		return
+	}
+
+	details := map[string]string{"health": current.Health}
+	if previous != nil {
+		details["previous_health"] = previous.Health
+	}
+	var issues []string
+	for _, path := range current.Paths {
+		details[path.Path+"_ip"] = path.IP
+		details[path.Path+"_health"] = path.Health
+		for _, issue := range path.Issues {
+			issues = append(issues, path.Path+": "+issue)
+		}
+		if path.Error != "" {
+			issues = append(issues, path.Path+": "+path.Error)
+		}
+	}
+	details["issues"] = strings.Join(issues, "; ")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	a.reportEvent(ctx, "egress_health_changed", severity, fmt.Sprintf("Egress health is %s", current.Health), details)
+}
+
+// reportIntegrity tells the master which deployed configs were edited outside the agent and
+// which partitions run low, whenever either changes
+func (a *Agent) reportIntegrity(previous, current *services.IntegrityReport) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	drifted := current.Drifted()
+	if previous != nil || len(drifted) > 0 {
+		if previous == nil || !slices.Equal(previous.Drifted(), drifted) {
+			details := map[string]string{"files": strings.Join(drifted, ",")}
+			for _, file := range current.Configs {
+				if file.Status != services.ConfigIntact {
+					details[file.Path] = file.Status
+				}
+			}
+			severity, message := "info", "Deployed configs match what the agent wrote"
+			if len(drifted) > 0 {
+				severity, message = "warning", fmt.Sprintf("%d config(s) changed outside the agent", len(drifted))
+			}
+			a.reportEvent(ctx, "config_drift", severity, message, details)
+		}
+	}
+
+	low := current.LowDisks()
+	if (previous == nil && len(low) == 0) || (previous != nil && slices.Equal(previous.LowDisks(), low)) {
+		return
+	}
+	details := map[string]string{"paths": strings.Join(low, ",")}
+	for _, disk := range current.Disks {
+		if disk.Low {
+			details[disk.Path] = fmt.Sprintf("%.1f%% space, %.1f%% inodes used", disk.UsedPercent, disk.InodesUsedPercent)
+		}
+	}
+	severity, message := "info", "Partitions have space and inodes left"
+	if len(low) > 0 {
+		severity, message = "warning", fmt.Sprintf("%d partition(s) low on space or inodes", len(low))
+	}
+	a.reportEvent(ctx, "disk_space_low", severity, message, details)
+}
+
+// reportWARPFailover tells the master the node moved WARP's traffic to the backup egress or
+// back to WARP
+func (a *Agent) reportWARPFailover(state services.WARPFailoverState) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	details := map[string]string{
+		"active": strconv.FormatBool(state.Active),
+		"backup": state.Backup,
+		"since":  state.Since.Format(time.RFC3339),
+	}
+	if state.Active {
+		details["reason"] = state.Reason
+		a.reportEvent(ctx, "warp_failover", "warning", fmt.Sprintf("WARP unhealthy, traffic moved to %s", state.Backup), details)
+		return
+	}
+	a.reportEvent(ctx, "warp_failover", "info", "WARP recovered, traffic moved back to WARP", details)
+}
+
+// reportWARPRotation tells the master WARP was reconnected or re-registered, and whether
+// it failed to come back
+func (a *Agent) reportWARPRotation(state services.WARPRotationState) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	details := map[string]string{
+		"reason":          state.LastReason,
+		"mode":            state.LastMode,
+		"previous_ip":     state.PreviousIP,
+		"drained_seconds": strconv.Itoa(int(state.Drained)),
+	}
+	if state.LastError != "" {
+		details["error"] = state.LastError
+		a.reportEvent(ctx, "warp_rotated", "error", fmt.Sprintf("WARP rotation (%s) failed", state.LastReason), details)
+		return
+	}
+	a.reportEvent(ctx, "warp_rotated", "info", fmt.Sprintf("WARP rotated (%s)", state.LastReason), details)
+}
+
+// reportReload announces the window in which Hysteria2 rejects new connections before a
+// restart, so clients and the master can move to other nodes, and the restart ending it
+func (a *Agent) reportReload(event services.ReloadEvent) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	details := map[string]string{"connections": strconv.Itoa(event.Connections)}
+	switch event.Type {
+	case services.ReloadEventDrainStarted:
+		details["deadline"] = event.Deadline.UTC().Format(time.RFC3339)
+		a.reportEvent(ctx, event.Type, "info", fmt.Sprintf("Hysteria2 draining, new connections rejected until %s", details["deadline"]), details)
+	case services.ReloadEventRestarted:
+		details["drained_seconds"] = strconv.Itoa(int(event.Drained.Seconds()))
+		if event.Error != "" {
+			details["error"] = event.Error
+			a.reportEvent(ctx, event.Type, "error", "Hysteria2 failed to restart after draining", details)
+			return
+		}
+		a.reportEvent(ctx, event.Type, "info", "Hysteria2 restarted after draining, admitting new connections", details)
+	case services.ReloadEventUndrained:
+		details["drained_seconds"] = strconv.Itoa(int(event.Drained.Seconds()))
+		a.reportEvent(ctx, event.Type, "info", "Hysteria2 admitting new connections again", details)
+	}
+}
+
+func joinPorts(ports []int) string {
+	parts := make([]string, len(ports))
+	for i, port := range ports {
+		parts[i] = strconv.Itoa(port)
+	}
+	return strings.Join(parts, ",")
+}
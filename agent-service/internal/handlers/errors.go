@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"hysteria2_microservices/agent-service/internal/services"
+	pb "hysteria2_microservices/proto"
+)
+
+// errorDomain is the ErrorInfo domain of every ErrorCode
+const errorDomain = "hysteria2.vpn"
+
+// codedError is an error with the ErrorCode and gRPC code it is reported with
+type codedError struct {
+	err      error
+	grpcCode codes.Code
+	code     pb.ErrorCode
+	metadata map[string]string
+}
+
+func (e *codedError) Error() string { return e.err.Error() }
+func (e *codedError) Unwrap() error { return e.err }
+
+// withCode marks err to be reported with code, e.g. for request validation the services
+// cannot tell apart
+func withCode(err error, grpcCode codes.Code, code pb.ErrorCode, metadata map[string]string) error {
+	return &codedError{err: err, grpcCode: grpcCode, code: code, metadata: metadata}
+}
+
+// invalidArgument reports a request the handler rejects
+func invalidArgument(format string, args ...interface{}) error {
+	return withCode(fmt.Errorf(format, args...), codes.InvalidArgument, pb.ErrorCode_ERROR_CODE_INVALID_ARGUMENT, nil)
+}
+
+// errorStatus converts a handler error into a gRPC status carrying an ErrorInfo detail
+// with its ErrorCode. Errors that already are statuses are returned unchanged.
+func errorStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	grpcCode, code, metadata := classifyError(err)
+	st := status.New(grpcCode, err.Error())
+	detailed, detailErr := st.WithDetails(&errdetails.ErrorInfo{
+		Reason:   strings.TrimPrefix(code.String(), "ERROR_CODE_"),
+		Domain:   errorDomain,
+		Metadata: metadata,
+	})
+	if detailErr != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+// classifyError finds the codes of an error from the errors it wraps
+func classifyError(err error) (codes.Code, pb.ErrorCode, map[string]string) {
+	var coded *codedError
+	switch {
+	case errors.As(err, &coded):
+		return coded.grpcCode, coded.code, coded.metadata
+	case errors.Is(err, services.ErrWARPNotInstalled):
+		return codes.FailedPrecondition, pb.ErrorCode_ERROR_CODE_WARP_NOT_INSTALLED, nil
+	case errors.Is(err, services.ErrWARPNotConnected):
+		return codes.Unavailable, pb.ErrorCode_ERROR_CODE_WARP_NOT_CONNECTED, nil
+	case errors.Is(err, services.ErrServerNotInstalled):
+		return codes.FailedPrecondition, pb.ErrorCode_ERROR_CODE_SERVER_NOT_INSTALLED, nil
+	case errors.Is(err, services.ErrConfigInvalid):
+		return codes.InvalidArgument, pb.ErrorCode_ERROR_CODE_CONFIG_INVALID, nil
+	case errors.Is(err, services.ErrInvalidDomain):
+		return codes.InvalidArgument, pb.ErrorCode_ERROR_CODE_INVALID_ARGUMENT, nil
+	case errors.Is(err, services.ErrDomainConflict):
+		return codes.AlreadyExists, pb.ErrorCode_ERROR_CODE_DOMAIN_CONFLICT, nil
+	case errors.Is(err, services.ErrFirewallClosed):
+		return codes.Unavailable, pb.ErrorCode_ERROR_CODE_FIREWALL_UNAVAILABLE, nil
+	case errors.Is(err, services.ErrPortInUse):
+		return codes.AlreadyExists, pb.ErrorCode_ERROR_CODE_PORT_IN_USE, nil
+	case errors.Is(err, services.ErrPortForwardNotFound):
+		return codes.NotFound, pb.ErrorCode_ERROR_CODE_NOT_FOUND, nil
+	case errors.Is(err, services.ErrInvalidOutboundPolicy):
+		return codes.InvalidArgument, pb.ErrorCode_ERROR_CODE_INVALID_ARGUMENT, nil
+	// Servers run as separate processes, so their bind failures only show in their output
+	case errors.Is(err, syscall.EADDRINUSE), strings.Contains(err.Error(), "address already in use"):
+		return codes.FailedPrecondition, pb.ErrorCode_ERROR_CODE_PORT_IN_USE, nil
+	case errors.Is(err, context.DeadlineExceeded):
+		return codes.DeadlineExceeded, pb.ErrorCode_ERROR_CODE_TIMEOUT, nil
+	case errors.Is(err, context.Canceled):
+		return codes.Canceled, pb.ErrorCode_ERROR_CODE_INTERNAL, nil
+	}
+	var exitErr interface{ ExitCode() int }
+	if errors.As(err, &exitErr) {
+		return codes.Internal, pb.ErrorCode_ERROR_CODE_COMMAND_FAILED, nil
+	}
+	return codes.Internal, pb.ErrorCode_ERROR_CODE_INTERNAL, nil
+}
+
+// ErrorCodeInterceptor reports every error a handler returns as a status with its ErrorCode
+func ErrorCodeInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	resp, err := handler(ctx, req)
+	if err != nil {
+		return nil, errorStatus(err)
+	}
+	return resp, nil
+}
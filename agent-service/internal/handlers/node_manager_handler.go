@@ -4,8 +4,14 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"hysteria2_microservices/agent-service/internal/config"
+	"hysteria2_microservices/agent-service/internal/hysteriaconfig"
 	"hysteria2_microservices/agent-service/internal/services"
 	pb "hysteria2_microservices/proto"
 )
@@ -32,10 +38,7 @@ func (h *NodeManagerHandler) EnableMasquerading(ctx context.Context, req *pb.Ena
 	err := h.localServices.NetworkManager.EnableMasquerading(req.InterfaceName)
 	if err != nil {
 		h.logger.Errorf("Failed to enable masquerading: %v", err)
-		return &pb.EnableMasqueradingResponse{
-			Success: false,
-			Message: fmt.Sprintf("Failed to enable masquerading: %v", err),
-		}, nil
+		return nil, fmt.Errorf("failed to enable masquerading: %w", err)
 	}
 
 	return &pb.EnableMasqueradingResponse{
@@ -51,10 +54,7 @@ func (h *NodeManagerHandler) DisableMasquerading(ctx context.Context, req *pb.Di
 	err := h.localServices.NetworkManager.DisableMasquerading(req.InterfaceName)
 	if err != nil {
 		h.logger.Errorf("Failed to disable masquerading: %v", err)
-		return &pb.DisableMasqueradingResponse{
-			Success: false,
-			Message: fmt.Sprintf("Failed to disable masquerading: %v", err),
-		}, nil
+		return nil, fmt.Errorf("failed to disable masquerading: %w", err)
 	}
 
 	return &pb.DisableMasqueradingResponse{
@@ -105,27 +105,56 @@ func (h *NodeManagerHandler) IsMasqueradingEnabled(ctx context.Context, req *pb.
 
 // Other methods (placeholders for now)
 func (h *NodeManagerHandler) UpdateConfig(ctx context.Context, req *pb.ConfigUpdateRequest) (*pb.ConfigUpdateResponse, error) {
-	return &pb.ConfigUpdateResponse{Success: false, Message: "Not implemented"}, nil
+	return nil, status.Error(codes.Unimplemented, "not implemented")
 }
 
 func (h *NodeManagerHandler) ReloadConfig(ctx context.Context, req *pb.ReloadRequest) (*pb.ReloadResponse, error) {
-	return &pb.ReloadResponse{Success: false, Message: "Not implemented"}, nil
+	return nil, status.Error(codes.Unimplemented, "not implemented")
 }
 
+// GetStatus reports the health of the node's egress addresses from the last check, whether
+// WARP is failed over and when it was last rotated
 func (h *NodeManagerHandler) GetStatus(ctx context.Context, req *pb.StatusRequest) (*pb.StatusResponse, error) {
-	return &pb.StatusResponse{}, nil
+	resp := &pb.StatusResponse{ServicesStatus: map[string]string{}}
+	if state := h.localServices.WARPFailover.State(); state.Enabled {
+		resp.ServicesStatus["warp_failover"] = "standby"
+		if state.Active {
+			resp.ServicesStatus["warp_failover"] = "active"
+			resp.ServicesStatus["warp_failover_backup"] = state.Backup
+			resp.ServicesStatus["warp_failover_reason"] = state.Reason
+		}
+		if !state.Since.IsZero() {
+			resp.ServicesStatus["warp_failover_since"] = state.Since.Format(time.RFC3339)
+		}
+	}
+	if state := h.localServices.WARPRotator.State(); state.Enabled && !state.LastAt.IsZero() {
+		resp.ServicesStatus["warp_rotated_at"] = state.LastAt.Format(time.RFC3339)
+		resp.ServicesStatus["warp_rotation_reason"] = state.LastReason
+		if state.LastError != "" {
+			resp.ServicesStatus["warp_rotation_error"] = state.LastError
+		}
+	}
+	if report := h.localServices.EgressMonitor.LastReport(); report != nil {
+		resp.ServicesStatus["egress_health"] = report.Health
+		resp.ServicesStatus["egress_checked_at"] = report.CheckedAt.Format(time.RFC3339)
+		for _, path := range report.Paths {
+			resp.ServicesStatus["egress_"+path.Path+"_ip"] = path.IP
+			resp.ServicesStatus["egress_"+path.Path+"_health"] = path.Health
+		}
+	}
+	return resp, nil
 }
 
 func (h *NodeManagerHandler) AddUser(ctx context.Context, req *pb.AddUserRequest) (*pb.AddUserResponse, error) {
-	return &pb.AddUserResponse{Success: false, Message: "Not implemented"}, nil
+	return nil, status.Error(codes.Unimplemented, "not implemented")
 }
 
 func (h *NodeManagerHandler) RemoveUser(ctx context.Context, req *pb.RemoveUserRequest) (*pb.RemoveUserResponse, error) {
-	return &pb.RemoveUserResponse{Success: false, Message: "Not implemented"}, nil
+	return nil, status.Error(codes.Unimplemented, "not implemented")
 }
 
 func (h *NodeManagerHandler) UpdateUser(ctx context.Context, req *pb.UpdateUserRequest) (*pb.UpdateUserResponse, error) {
-	return &pb.UpdateUserResponse{Success: false, Message: "Not implemented"}, nil
+	return nil, status.Error(codes.Unimplemented, "not implemented")
 }
 
 func (h *NodeManagerHandler) GetMetrics(ctx context.Context, req *pb.MetricsRequest) (*pb.MetricsResponse, error) {
@@ -136,12 +165,52 @@ func (h *NodeManagerHandler) StreamMetrics(req *pb.StreamMetricsRequest, stream
 	return fmt.Errorf("not implemented")
 }
 
+// RestartServer restarts Hysteria2 or Xray, or every installed server when no service is named
 func (h *NodeManagerHandler) RestartServer(ctx context.Context, req *pb.RestartRequest) (*pb.RestartResponse, error) {
-	return &pb.RestartResponse{Success: false, Message: "Not implemented"}, nil
+	h.logger.Infof("RestartServer called: service=%q", req.ServiceName)
+
+	hysteria := h.localServices.HysteriaManager
+	xray := h.localServices.XrayManager
+	var restarted []string
+	switch req.ServiceName {
+	case "hysteria2":
+		if err := hysteria.RestartHysteria2(hysteria.ConfigPath()); err != nil {
+			return nil, fmt.Errorf("failed to restart Hysteria2: %w", err)
+		}
+		restarted = append(restarted, "hysteria2")
+	case "xray":
+		if err := xray.RestartXray(xray.ConfigPath()); err != nil {
+			return nil, fmt.Errorf("failed to restart Xray: %w", err)
+		}
+		restarted = append(restarted, "xray")
+	case "":
+		if hysteria.IsHysteria2Installed() {
+			if err := hysteria.RestartHysteria2(hysteria.ConfigPath()); err != nil {
+				return nil, fmt.Errorf("failed to restart Hysteria2: %w", err)
+			}
+			restarted = append(restarted, "hysteria2")
+		}
+		if xray.IsXrayInstalled() {
+			if err := xray.RestartXray(xray.ConfigPath()); err != nil {
+				return nil, fmt.Errorf("failed to restart Xray: %w", err)
+			}
+			restarted = append(restarted, "xray")
+		}
+	default:
+		return nil, invalidArgument("unsupported service %q", req.ServiceName)
+	}
+
+	if len(restarted) == 0 {
+		return &pb.RestartResponse{Success: true, Message: "No server is installed"}, nil
+	}
+	return &pb.RestartResponse{
+		Success: true,
+		Message: fmt.Sprintf("Restarted %s", strings.Join(restarted, ", ")),
+	}, nil
 }
 
 func (h *NodeManagerHandler) GetLogs(ctx context.Context, req *pb.LogRequest) (*pb.LogResponse, error) {
-	return &pb.LogResponse{Success: false, Logs: []string{"Not implemented"}}, nil
+	return nil, status.Error(codes.Unimplemented, "not implemented")
 }
 
 // Hysteria2 management methods
@@ -153,10 +222,7 @@ func (h *NodeManagerHandler) InstallHysteria2(ctx context.Context, req *pb.Insta
 	err := h.localServices.HysteriaManager.InstallHysteria2()
 	if err != nil {
 		h.logger.Errorf("Failed to install Hysteria2: %v", err)
-		return &pb.InstallHysteria2Response{
-			Success: false,
-			Message: fmt.Sprintf("Failed to install Hysteria2: %v", err),
-		}, nil
+		return nil, fmt.Errorf("failed to install Hysteria2: %w", err)
 	}
 
 	return &pb.InstallHysteria2Response{
@@ -172,21 +238,15 @@ func (h *NodeManagerHandler) ConfigureHysteria2(ctx context.Context, req *pb.Con
 	config, err := h.localServices.HysteriaManager.GenerateConfig(req.ConfigTemplate)
 	if err != nil {
 		h.logger.Errorf("Failed to generate Hysteria2 config: %v", err)
-		return &pb.ConfigureHysteria2Response{
-			Success: false,
-			Message: fmt.Sprintf("Failed to generate config: %v", err),
-		}, nil
+		return nil, fmt.Errorf("failed to generate config: %w", err)
 	}
 
 	// Save config to file
-	configPath := "/etc/hysteria/config.json"
-	err = os.WriteFile(configPath, []byte(config), 0644)
+	configPath := h.localServices.HysteriaManager.ConfigPath()
+	err = h.localServices.HysteriaManager.SaveConfig(configPath, config)
 	if err != nil {
 		h.logger.Errorf("Failed to save config: %v", err)
-		return &pb.ConfigureHysteria2Response{
-			Success: false,
-			Message: fmt.Sprintf("Failed to save config: %v", err),
-		}, nil
+		return nil, fmt.Errorf("failed to save config: %w", err)
 	}
 
 	return &pb.ConfigureHysteria2Response{
@@ -204,10 +264,7 @@ func (h *NodeManagerHandler) StartHysteria2(ctx context.Context, req *pb.StartHy
 	err := h.localServices.HysteriaManager.StartHysteria2(req.ConfigPath)
 	if err != nil {
 		h.logger.Errorf("Failed to start Hysteria2: %v", err)
-		return &pb.StartHysteria2Response{
-			Success: false,
-			Message: fmt.Sprintf("Failed to start Hysteria2: %v", err),
-		}, nil
+		return nil, fmt.Errorf("failed to start Hysteria2: %w", err)
 	}
 
 	return &pb.StartHysteria2Response{
@@ -223,10 +280,7 @@ func (h *NodeManagerHandler) StopHysteria2(ctx context.Context, req *pb.StopHyst
 	err := h.localServices.HysteriaManager.StopHysteria2()
 	if err != nil {
 		h.logger.Errorf("Failed to stop Hysteria2: %v", err)
-		return &pb.StopHysteria2Response{
-			Success: false,
-			Message: fmt.Sprintf("Failed to stop Hysteria2: %v", err),
-		}, nil
+		return nil, fmt.Errorf("failed to stop Hysteria2: %w", err)
 	}
 
 	return &pb.StopHysteria2Response{
@@ -267,10 +321,7 @@ func (h *NodeManagerHandler) EnablePortHopping(ctx context.Context, req *pb.Enab
 	err := h.localServices.HysteriaManager.EnablePortHopping(int(req.StartPort), int(req.EndPort), int(req.Interval))
 	if err != nil {
 		h.logger.Errorf("Failed to enable port hopping: %v", err)
-		return &pb.EnablePortHoppingResponse{
-			Success: false,
-			Message: fmt.Sprintf("Failed to enable port hopping: %v", err),
-		}, nil
+		return nil, fmt.Errorf("failed to enable port hopping: %w", err)
 	}
 
 	return &pb.EnablePortHoppingResponse{
@@ -286,10 +337,7 @@ func (h *NodeManagerHandler) EnableSalamander(ctx context.Context, req *pb.Enabl
 	err := h.localServices.HysteriaManager.EnableSalamander(req.Password)
 	if err != nil {
 		h.logger.Errorf("Failed to enable Salamander: %v", err)
-		return &pb.EnableSalamanderResponse{
-			Success: false,
-			Message: fmt.Sprintf("Failed to enable Salamander: %v", err),
-		}, nil
+		return nil, fmt.Errorf("failed to enable Salamander: %w", err)
 	}
 
 	return &pb.EnableSalamanderResponse{
@@ -298,202 +346,1950 @@ func (h *NodeManagerHandler) EnableSalamander(ctx context.Context, req *pb.Enabl
 	}, nil
 }
 
-// WARP management methods
+// ConfigureMasquerade sets the Hysteria2 masquerade mode and regenerates the server config
+func (h *NodeManagerHandler) ConfigureMasquerade(ctx context.Context, req *pb.ConfigureMasqueradeRequest) (*pb.ConfigureMasqueradeResponse, error) {
+	if req.Masquerade == nil {
+		return nil, invalidArgument("masquerade configuration is required")
+	}
 
-// InstallWARPClient installs Cloudflare WARP client
-func (h *NodeManagerHandler) InstallWARPClient(ctx context.Context, req *pb.InstallWARPClientRequest) (*pb.InstallWARPClientResponse, error) {
-	h.logger.Info("InstallWARPClient called")
+	h.logger.Infof("ConfigureMasquerade called: type=%s", req.Masquerade.Type)
+
+	err := h.localServices.HysteriaManager.ConfigureMasquerade(services.MasqueradeSettings{
+		Type:          req.Masquerade.Type,
+		ProxyURL:      req.Masquerade.ProxyUrl,
+		RewriteHost:   req.Masquerade.RewriteHost,
+		FileDir:       req.Masquerade.FileDir,
+		StringContent: req.Masquerade.StringContent,
+		StringStatus:  int(req.Masquerade.StringStatus),
+		StringHeaders: req.Masquerade.StringHeaders,
+	})
+	if err != nil {
+		h.logger.Errorf("Failed to configure masquerade: %v", err)
+		return nil, fmt.Errorf("failed to configure masquerade: %w", err)
+	}
 
-	err := h.localServices.WARPManager.InstallWARPClient()
+	config, err := h.localServices.HysteriaManager.GenerateConfig("")
 	if err != nil {
-		h.logger.Errorf("Failed to install WARP client: %v", err)
-		return &pb.InstallWARPClientResponse{
-			Success: false,
-			Message: fmt.Sprintf("Failed to install WARP client: %v", err),
-		}, nil
+		h.logger.Errorf("Failed to regenerate Hysteria2 config: %v", err)
+		return nil, fmt.Errorf("failed to regenerate config: %w", err)
 	}
 
-	return &pb.InstallWARPClientResponse{
+	configPath := h.localServices.HysteriaManager.ConfigPath()
+	if err := h.localServices.HysteriaManager.SaveConfig(configPath, config); err != nil {
+		h.logger.Errorf("Failed to save config: %v", err)
+		return nil, fmt.Errorf("failed to save config: %w", err)
+	}
+
+	if err := h.localServices.HysteriaManager.ReloadHysteria2(configPath); err != nil {
+		h.logger.Errorf("Failed to restart Hysteria2: %v", err)
+		return nil, fmt.Errorf("masquerade saved but Hysteria2 restart failed: %w", err)
+	}
+
+	return &pb.ConfigureMasqueradeResponse{
 		Success: true,
-		Message: "WARP client installed successfully",
+		Message: fmt.Sprintf("Masquerade configured in %s mode", req.Masquerade.Type),
 	}, nil
 }
 
-// ConfigureWARP configures WARP settings
-func (h *NodeManagerHandler) ConfigureWARP(ctx context.Context, req *pb.ConfigureWARPRequest) (*pb.ConfigureWARPResponse, error) {
-	h.logger.Infof("ConfigureWARP called with enabled: %v, proxy port: %d", req.Enabled, req.ProxyPort)
+// ConfigureCertificateMode switches the Hysteria2 server between the certificates the agent
+// manages and its own ACME client, then regenerates the config and restarts the server
+func (h *NodeManagerHandler) ConfigureCertificateMode(ctx context.Context, req *pb.ConfigureCertificateModeRequest) (*pb.ConfigureCertificateModeResponse, error) {
+	if req.Mode == nil {
+		return nil, invalidArgument("certificate mode is required")
+	}
 
-	// Build WARP config
-	config := services.WARPConfig{
-		Enabled:      req.Enabled,
-		ProxyPort:    int(req.ProxyPort),
-		AutoConnect:  req.AutoConnect,
-		NotifyOnFail: req.NotifyOnFail,
-		ClientType:   req.ClientType,
-		LicenseKey:   req.LicenseKey,
-		Organization: req.Organization,
-		Mode:         req.Mode,
+	h.logger.Infof("ConfigureCertificateMode called: mode=%s", req.Mode.Mode)
+
+	err := h.localServices.HysteriaManager.ConfigureCertificateMode(certificateModeSettings(req.Mode))
+	if err != nil {
+		h.logger.Errorf("Failed to configure certificate mode: %v", err)
+		return nil, fmt.Errorf("failed to configure certificate mode: %w", err)
 	}
 
-	err := h.localServices.WARPManager.ConfigureWARP(config)
+	config, err := h.localServices.HysteriaManager.GenerateConfig("")
 	if err != nil {
-		h.logger.Errorf("Failed to configure WARP: %v", err)
-		return &pb.ConfigureWARPResponse{
-			Success: false,
-			Message: fmt.Sprintf("Failed to configure WARP: %v", err),
-		}, nil
+		h.logger.Errorf("Failed to regenerate Hysteria2 config: %v", err)
+		return nil, fmt.Errorf("failed to regenerate config: %w", err)
 	}
 
-	return &pb.ConfigureWARPResponse{
+	configPath := h.localServices.HysteriaManager.ConfigPath()
+	if err := h.localServices.HysteriaManager.SaveConfig(configPath, config); err != nil {
+		h.logger.Errorf("Failed to save config: %v", err)
+		return nil, fmt.Errorf("failed to save config: %w", err)
+	}
+
+	if err := h.localServices.HysteriaManager.ReloadHysteria2(configPath); err != nil {
+		h.logger.Errorf("Failed to restart Hysteria2: %v", err)
+		return nil, fmt.Errorf("certificate mode saved but Hysteria2 restart failed: %w", err)
+	}
+
+	return &pb.ConfigureCertificateModeResponse{
 		Success: true,
-		Message: "WARP configured successfully",
+		Message: fmt.Sprintf("Certificate mode set to %s", req.Mode.Mode),
 	}, nil
 }
 
-// ConnectWARP connects to WARP network
-func (h *NodeManagerHandler) ConnectWARP(ctx context.Context, req *pb.ConnectWARPRequest) (*pb.ConnectWARPResponse, error) {
-	h.logger.Info("ConnectWARP called")
-
-	err := h.localServices.WARPManager.ConnectWARP()
+// GetACMEStatus returns the ACME settings and the certificates Hysteria2 has obtained.
+// DNS provider credentials are not returned.
+func (h *NodeManagerHandler) GetACMEStatus(ctx context.Context, req *pb.GetACMEStatusRequest) (*pb.GetACMEStatusResponse, error) {
+	status, err := h.localServices.HysteriaManager.GetACMEStatus()
 	if err != nil {
-		h.logger.Errorf("Failed to connect to WARP: %v", err)
-		return &pb.ConnectWARPResponse{
-			Success: false,
-			Message: fmt.Sprintf("Failed to connect to WARP: %v", err),
-		}, nil
+		h.logger.Errorf("Failed to get ACME status: %v", err)
+		return nil, fmt.Errorf("failed to get ACME status: %w", err)
 	}
 
-	return &pb.ConnectWARPResponse{
+	settings := status.Settings
+	resp := &pb.GetACMEStatusResponse{
 		Success: true,
-		Message: "Connected to WARP successfully",
-	}, nil
+		Mode: &pb.CertificateMode{
+			Mode:        settings.Mode,
+			Domains:     settings.Domains,
+			Email:       settings.Email,
+			Ca:          settings.CA,
+			Challenge:   settings.Challenge,
+			ListenHost:  settings.ListenHost,
+			AltPort:     int32(settings.AltPort),
+			DnsProvider: settings.DNSProvider,
+		},
+		Pending:      status.Pending,
+		ExpiringSoon: status.ExpiringSoon(30),
+	}
+	for _, cert := range status.Certificates {
+		resp.Certificates = append(resp.Certificates, &pb.ACMECertificate{
+			Domain:    cert.Domain,
+			Issuer:    cert.Issuer,
+			Ca:        cert.CA,
+			NotBefore: cert.NotBefore.Unix(),
+			NotAfter:  cert.NotAfter.Unix(),
+			DaysLeft:  int32(time.Until(cert.NotAfter).Hours() / 24),
+		})
+	}
+	if settings.Mode != services.CertificateModeACME {
+		resp.Message = "Hysteria2 serves the certificates managed by the agent"
+	}
+	return resp, nil
 }
 
-// DisconnectWARP disconnects from WARP network
-func (h *NodeManagerHandler) DisconnectWARP(ctx context.Context, req *pb.DisconnectWARPRequest) (*pb.DisconnectWARPResponse, error) {
-	h.logger.Info("DisconnectWARP called")
+func certificateModeSettings(mode *pb.CertificateMode) services.CertificateModeSettings {
+	return services.CertificateModeSettings{
+		Mode:        mode.Mode,
+		Domains:     mode.Domains,
+		Email:       mode.Email,
+		CA:          mode.Ca,
+		Challenge:   mode.Challenge,
+		ListenHost:  mode.ListenHost,
+		AltPort:     int(mode.AltPort),
+		DNSProvider: mode.DnsProvider,
+		DNSConfig:   mode.DnsConfig,
+	}
+}
 
-	err := h.localServices.WARPManager.DisconnectWARP()
+// ApplyObfuscation applies an obfuscation preset's settings: it regenerates the Hysteria2
+// config, moves the QUIC relay and the firewall to match and points the Reality inbound
+// at the preset's targets
+func (h *NodeManagerHandler) ApplyObfuscation(ctx context.Context, req *pb.ApplyObfuscationRequest) (*pb.ApplyObfuscationResponse, error) {
+	if req.Settings == nil {
+		return nil, invalidArgument("obfuscation settings are required")
+	}
+
+	h.logger.Infof("ApplyObfuscation called: preset=%s", req.Preset)
+
+	hysteria := h.localServices.HysteriaManager
+	settings, err := hysteria.ApplyObfuscation(obfuscationSettings(req.Preset, req.Settings))
 	if err != nil {
-		h.logger.Errorf("Failed to disconnect from WARP: %v", err)
-		return &pb.DisconnectWARPResponse{
-			Success: false,
-			Message: fmt.Sprintf("Failed to disconnect from WARP: %v", err),
-		}, nil
+		h.logger.Errorf("Failed to apply obfuscation settings: %v", err)
+		return nil, invalidArgument("invalid obfuscation settings: %v", err)
 	}
 
-	return &pb.DisconnectWARPResponse{
-		Success: true,
-		Message: "Disconnected from WARP successfully",
+	config, err := hysteria.GenerateConfig("")
+	if err != nil {
+		h.logger.Errorf("Failed to regenerate Hysteria2 config: %v", err)
+		return nil, fmt.Errorf("failed to regenerate config: %w", err)
+	}
+
+	configPath := hysteria.ConfigPath()
+	if err := hysteria.SaveConfig(configPath, config); err != nil {
+		h.logger.Errorf("Failed to save config: %v", err)
+		return nil, fmt.Errorf("failed to save config: %w", err)
+	}
+
+	// The relay owns the public port while it runs, so it goes down before Hysteria2 moves
+	// back to it and comes up after Hysteria2 moved to loopback
+	relay := h.localServices.QUICRelay
+	if relay.IsRunning() {
+		relay.Stop()
+	}
+	if err := hysteria.ReloadHysteria2(configPath); err != nil {
+		h.logger.Errorf("Failed to restart Hysteria2: %v", err)
+		return nil, fmt.Errorf("obfuscation settings saved but Hysteria2 restart failed: %w", err)
+	}
+	if settings.QUICObfuscation {
+		if err := relay.Start(context.Background()); err != nil {
+			h.logger.Errorf("Failed to start QUIC obfuscation relay: %v", err)
+			return nil, fmt.Errorf("failed to start QUIC obfuscation relay: %w", err)
+		}
+	}
+
+	// Open the port hopping range
+	if err := h.localServices.Firewall.EnsureBaseline(); err != nil {
+		h.logger.Errorf("Failed to update firewall: %v", err)
+		return nil, fmt.Errorf("failed to update firewall: %w", err)
+	}
+
+	if len(settings.RealityTargets) > 0 {
+		if err := h.localServices.XrayManager.SetRealityTargets(settings.RealityTargets); err != nil {
+			h.logger.Errorf("Failed to set Reality targets: %v", err)
+			return nil, fmt.Errorf("failed to set Reality targets: %w", err)
+		}
+		if err := h.reloadXray(); err != nil {
+			return nil, fmt.Errorf("Reality targets saved but Xray restart failed: %w", err)
+		}
+	}
+
+	message := "Obfuscation turned off"
+	if req.Preset != "" {
+		message = fmt.Sprintf("Obfuscation preset %s applied", req.Preset)
+	}
+	return &pb.ApplyObfuscationResponse{
+		Success:  true,
+		Message:  message,
+		Settings: obfuscationSettingsToProto(settings),
 	}, nil
 }
 
-// GetWARPStatus returns WARP connection status
-func (h *NodeManagerHandler) GetWARPStatus(ctx context.Context, req *pb.GetWARPStatusRequest) (*pb.GetWARPStatusResponse, error) {
-	h.logger.Info("GetWARPStatus called")
+func obfuscationSettings(preset string, settings *pb.ObfuscationSettings) services.ObfuscationSettings {
+	return services.ObfuscationSettings{
+		Preset:             preset,
+		Salamander:         settings.Salamander,
+		SalamanderPassword: settings.SalamanderPassword,
+		PortHopping:        settings.PortHopping,
+		HopStartPort:       int(settings.HopStartPort),
+		HopEndPort:         int(settings.HopEndPort),
+		HopInterval:        int(settings.HopInterval),
+		QUICObfuscation:    settings.QuicObfuscation,
+		PacketPadding:      int(settings.PacketPadding),
+		TimingJitterMs:     int(settings.TimingJitterMs),
+		Fingerprints:       settings.Fingerprints,
+		RealityTargets:     settings.RealityTargets,
+		TrafficShaping:     settings.TrafficShaping,
+	}
+}
 
-	status, err := h.localServices.WARPManager.GetWARPStatus()
+func obfuscationSettingsToProto(settings services.ObfuscationSettings) *pb.ObfuscationSettings {
+	return &pb.ObfuscationSettings{
+		Salamander:         settings.Salamander,
+		SalamanderPassword: settings.SalamanderPassword,
+		PortHopping:        settings.PortHopping,
+		HopStartPort:       int32(settings.HopStartPort),
+		HopEndPort:         int32(settings.HopEndPort),
+		HopInterval:        int32(settings.HopInterval),
+		QuicObfuscation:    settings.QUICObfuscation,
+		PacketPadding:      int32(settings.PacketPadding),
+		TimingJitterMs:     int32(settings.TimingJitterMs),
+		Fingerprints:       settings.Fingerprints,
+		RealityTargets:     settings.RealityTargets,
+		TrafficShaping:     settings.TrafficShaping,
+	}
+}
+
+// UpdateSNIConfig replaces the SNI domains and regenerates the server config. Each domain
+// gets a pre-flight DNS check whose result is returned, not enforced: DNS may be updated
+// after the node is configured.
+func (h *NodeManagerHandler) UpdateSNIConfig(ctx context.Context, req *pb.SNIConfigUpdateRequest) (*pb.UpdateSNIConfigResponse, error) {
+	h.logger.Infof("UpdateSNIConfig called: enabled=%v, domains=%v", req.Enabled, req.Domains)
+
+	hysteria := h.localServices.HysteriaManager
+	var checks []*pb.SNIDomainCheck
+	if req.Enabled {
+		domains, err := services.NormalizeSNIDomains(req.Domains)
+		if err != nil {
+			return nil, err
+		}
+		if err := hysteria.ConfigureSNI(domains, req.DefaultSni); err != nil {
+			h.logger.Errorf("Failed to configure SNI: %v", err)
+			return nil, fmt.Errorf("failed to configure SNI: %w", err)
+		}
+		for _, domain := range domains {
+			check := hysteria.CheckSNIDomainDNS(domain)
+			if !check.ResolvesToNode {
+				h.logger.Warnf("SNI domain %s does not resolve to this node: %s", domain, check.Message)
+			}
+			checks = append(checks, &pb.SNIDomainCheck{
+				Domain:         check.Domain,
+				ResolvesToNode: check.ResolvesToNode,
+				Message:        check.Message,
+			})
+		}
+	} else if err := hysteria.DisableSNI(); err != nil {
+		return nil, fmt.Errorf("failed to disable SNI: %w", err)
+	}
+
+	config, err := hysteria.UpdateServerConfigWithSNI()
 	if err != nil {
-		h.logger.Errorf("Failed to get WARP status: %v", err)
-		return nil, fmt.Errorf("failed to get WARP status: %w", err)
+		h.logger.Errorf("Failed to regenerate Hysteria2 config: %v", err)
+		return nil, fmt.Errorf("failed to regenerate config: %w", err)
 	}
 
-	// Convert to protobuf format
-	pbStatus := &pb.WARPStatus{
-		Installed:      status.Installed,
-		Connected:      status.Connected,
-		Mode:           status.Mode,
-		ProxyPort:      int32(status.ProxyPort),
-		AccountType:    status.AccountType,
-		Organization:   status.Organization,
-		IpAddress:      status.IPAddress,
-		Location:       status.Location,
-		ServerLocation: status.ServerLocation,
-		LastConnected:  status.LastConnected.Unix(),
-		Uptime:         int64(status.Uptime.Seconds()),
-		BytesSent:      status.BytesSent,
-		BytesReceived:  status.BytesReceived,
-		Health:         status.Health,
-		Error:          status.Error,
+	configPath := hysteria.ConfigPath()
+	if err := hysteria.SaveConfig(configPath, config); err != nil {
+		h.logger.Errorf("Failed to save config: %v", err)
+		return nil, fmt.Errorf("failed to save config: %w", err)
 	}
 
-	return &pb.GetWARPStatusResponse{
-		Status: pbStatus,
+	if hysteria.IsHysteria2Installed() {
+		if err := hysteria.ReloadHysteria2(configPath); err != nil {
+			h.logger.Errorf("Failed to restart Hysteria2: %v", err)
+			return nil, fmt.Errorf("SNI configuration saved but Hysteria2 restart failed: %w", err)
+		}
+	}
+
+	return &pb.UpdateSNIConfigResponse{
+		Success:   true,
+		Message:   fmt.Sprintf("SNI configured with %d domain(s)", len(checks)),
+		DnsChecks: checks,
 	}, nil
 }
 
-// EnableWARPProxy enables WARP proxy mode
-func (h *NodeManagerHandler) EnableWARPProxy(ctx context.Context, req *pb.EnableWARPProxyRequest) (*pb.EnableWARPProxyResponse, error) {
-	h.logger.Infof("EnableWARPProxy called on port: %d", req.Port)
+// SetNodeProtocols reconciles running services with the per-node protocol matrix
+func (h *NodeManagerHandler) SetNodeProtocols(ctx context.Context, req *pb.SetNodeProtocolsRequest) (*pb.SetNodeProtocolsResponse, error) {
+	h.logger.Infof("SetNodeProtocols called: %v", req.Protocols)
 
-	err := h.localServices.WARPManager.EnableProxyMode(int(req.Port))
+	results, err := h.localServices.Protocols.Reconcile(req.Protocols)
 	if err != nil {
-		h.logger.Errorf("Failed to enable WARP proxy: %v", err)
-		return &pb.EnableWARPProxyResponse{
-			Success: false,
-			Message: fmt.Sprintf("Failed to enable WARP proxy: %v", err),
+		h.logger.Errorf("Failed to reconcile protocols: %v", err)
+		return &pb.SetNodeProtocolsResponse{
+			Success:   false,
+			Message:   fmt.Sprintf("Failed to reconcile protocols: %v", err),
+			Protocols: h.localServices.Protocols.GetProtocols(),
+			Results:   results,
 		}, nil
 	}
 
-	return &pb.EnableWARPProxyResponse{
-		Success: true,
-		Message: "WARP proxy mode enabled successfully",
+	return &pb.SetNodeProtocolsResponse{
+		Success:   true,
+		Message:   "Protocols reconciled successfully",
+		Protocols: h.localServices.Protocols.GetProtocols(),
+		Results:   results,
 	}, nil
 }
 
-// DisableWARPProxy disables WARP proxy mode
-func (h *NodeManagerHandler) DisableWARPProxy(ctx context.Context, req *pb.DisableWARPProxyRequest) (*pb.DisableWARPProxyResponse, error) {
-	h.logger.Info("DisableWARPProxy called")
+// SetDNSPolicy replaces the resolver's upstreams and per-domain rules
+func (h *NodeManagerHandler) SetDNSPolicy(ctx context.Context, req *pb.SetDNSPolicyRequest) (*pb.SetDNSPolicyResponse, error) {
+	if req.Policy == nil {
+		return nil, invalidArgument("DNS policy is required")
+	}
 
-	err := h.localServices.WARPManager.DisableProxyMode()
+	policy := services.DNSPolicy{
+		Upstreams: req.Policy.Upstreams,
+		ViaWARP:   req.Policy.ViaWarp,
+	}
+	for _, rule := range req.Policy.Rules {
+		policy.Rules = append(policy.Rules, config.DNSRule{
+			Domains:   rule.Domains,
+			Upstreams: rule.Upstreams,
+			Route:     rule.Route,
+		})
+	}
+
+	h.logger.Infof("SetDNSPolicy called: upstreams=%v, via_warp=%v, rules=%d", policy.Upstreams, policy.ViaWARP, len(policy.Rules))
+
+	if err := h.localServices.DNSResolver.SetPolicy(policy); err != nil {
+		h.logger.Errorf("Failed to apply DNS policy: %v", err)
+		return nil, fmt.Errorf("failed to apply DNS policy: %w", err)
+	}
+
+	return &pb.SetDNSPolicyResponse{
+		Success: true,
+		Message: "DNS policy applied successfully",
+	}, nil
+}
+
+// GetFirewallRules returns the node's baseline, additional rules and live ruleset
+func (h *NodeManagerHandler) GetFirewallRules(ctx context.Context, req *pb.GetFirewallRulesRequest) (*pb.GetFirewallRulesResponse, error) {
+	status, err := h.localServices.Firewall.GetRules()
 	if err != nil {
-		h.logger.Errorf("Failed to disable WARP proxy: %v", err)
-		return &pb.DisableWARPProxyResponse{
-			Success: false,
-			Message: fmt.Sprintf("Failed to disable WARP proxy: %v", err),
-		}, nil
+		h.logger.Errorf("Failed to get firewall rules: %v", err)
+		return nil, fmt.Errorf("failed to get firewall rules: %w", err)
 	}
 
-	return &pb.DisableWARPProxyResponse{
+	resp := &pb.GetFirewallRulesResponse{
+		Success:  true,
+		Message:  "Firewall rules retrieved successfully",
+		Enabled:  status.Enabled,
+		Backend:  status.Backend,
+		Baseline: firewallRulesToProto(status.Baseline),
+		Rules:    firewallRulesToProto(status.Rules),
+		Active:   status.Active,
+	}
+	if !status.AppliedAt.IsZero() {
+		resp.AppliedAt = status.AppliedAt.Unix()
+	}
+	return resp, nil
+}
+
+// ApplyFirewallRules installs the baseline plus the requested rules and drops everything else
+func (h *NodeManagerHandler) ApplyFirewallRules(ctx context.Context, req *pb.ApplyFirewallRulesRequest) (*pb.ApplyFirewallRulesResponse, error) {
+	h.logger.Infof("ApplyFirewallRules called: backend=%q, rules=%d", req.Backend, len(req.Rules))
+
+	rules := make([]services.FirewallRule, 0, len(req.Rules))
+	for _, rule := range req.Rules {
+		rules = append(rules, services.FirewallRule{
+			Protocol: rule.Protocol,
+			Ports:    rule.Ports,
+			Sources:  rule.Sources,
+			Comment:  rule.Comment,
+		})
+	}
+
+	if err := h.localServices.Firewall.Apply(req.Backend, rules); err != nil {
+		h.logger.Errorf("Failed to apply firewall rules: %v", err)
+		return nil, fmt.Errorf("failed to apply firewall rules: %w", err)
+	}
+
+	return &pb.ApplyFirewallRulesResponse{
 		Success: true,
-		Message: "WARP proxy mode disabled successfully",
+		Message: "Firewall rules applied successfully",
 	}, nil
 }
 
-// EnableWARPTrafficRouting enables traffic routing through WARP
-func (h *NodeManagerHandler) EnableWARPTrafficRouting(ctx context.Context, req *pb.EnableWARPTrafficRoutingRequest) (*pb.EnableWARPTrafficRoutingResponse, error) {
-	h.logger.Infof("EnableWARPTrafficRouting called for interface: %s", req.InterfaceName)
+// RestoreFirewallRules rolls the firewall back to the ruleset in force before the last apply
+func (h *NodeManagerHandler) RestoreFirewallRules(ctx context.Context, req *pb.RestoreFirewallRulesRequest) (*pb.RestoreFirewallRulesResponse, error) {
+	h.logger.Info("RestoreFirewallRules called")
 
-	err := h.localServices.WARPManager.EnableTrafficRouting(req.InterfaceName)
-	if err != nil {
-		h.logger.Errorf("Failed to enable WARP traffic routing: %v", err)
-		return &pb.EnableWARPTrafficRoutingResponse{
-			Success: false,
-			Message: fmt.Sprintf("Failed to enable WARP traffic routing: %v", err),
-		}, nil
+	if err := h.localServices.Firewall.Restore(); err != nil {
+		h.logger.Errorf("Failed to restore firewall rules: %v", err)
+		return nil, fmt.Errorf("failed to restore firewall rules: %w", err)
 	}
 
-	return &pb.EnableWARPTrafficRoutingResponse{
+	return &pb.RestoreFirewallRulesResponse{
 		Success: true,
-		Message: "WARP traffic routing enabled successfully",
+		Message: "Firewall rules restored successfully",
 	}, nil
 }
 
-// DisableWARPTrafficRouting disables WARP traffic routing
-func (h *NodeManagerHandler) DisableWARPTrafficRouting(ctx context.Context, req *pb.DisableWARPTrafficRoutingRequest) (*pb.DisableWARPTrafficRoutingResponse, error) {
-	h.logger.Info("DisableWARPTrafficRouting called")
+func firewallRulesToProto(rules []services.FirewallRule) []*pb.FirewallRule {
+	result := make([]*pb.FirewallRule, 0, len(rules))
+	for _, rule := range rules {
+		result = append(result, &pb.FirewallRule{
+			Protocol: rule.Protocol,
+			Ports:    rule.Ports,
+			Sources:  rule.Sources,
+			Comment:  rule.Comment,
+		})
+	}
+	return result
+}
 
-	err := h.localServices.WARPManager.DisableTrafficRouting()
-	if err != nil {
-		h.logger.Errorf("Failed to disable WARP traffic routing: %v", err)
-		return &pb.DisableWARPTrafficRoutingResponse{
-			Success: false,
-			Message: fmt.Sprintf("Failed to disable WARP traffic routing: %v", err),
-		}, nil
+// ListBans returns the addresses banned by the brute-force guard
+func (h *NodeManagerHandler) ListBans(ctx context.Context, req *pb.ListBansRequest) (*pb.ListBansResponse, error) {
+	bans := h.localServices.BruteForceGuard.ListBans()
+
+	resp := &pb.ListBansResponse{
+		Success: true,
+		Message: "Bans retrieved successfully",
+		Bans:    make([]*pb.BannedIP, 0, len(bans)),
+	}
+	for _, ban := range bans {
+		resp.Bans = append(resp.Bans, &pb.BannedIP{
+			Ip:        ban.IP,
+			Source:    ban.Source,
+			Reason:    ban.Reason,
+			Failures:  int32(ban.Failures),
+			BannedAt:  ban.BannedAt.Unix(),
+			ExpiresAt: ban.ExpiresAt.Unix(),
+		})
 	}
+	return resp, nil
+}
 
-	return &pb.DisableWARPTrafficRoutingResponse{
+// UnbanIP lifts a brute-force ban before it expires
+func (h *NodeManagerHandler) UnbanIP(ctx context.Context, req *pb.UnbanIPRequest) (*pb.UnbanIPResponse, error) {
+	h.logger.Infof("UnbanIP called: ip=%s", req.Ip)
+
+	if err := h.localServices.BruteForceGuard.Unban(req.Ip); err != nil {
+		h.logger.Errorf("Failed to unban %s: %v", req.Ip, err)
+		return nil, fmt.Errorf("failed to unban %s: %w", req.Ip, err)
+	}
+
+	return &pb.UnbanIPResponse{
 		Success: true,
-		Message: "WARP traffic routing disabled successfully",
+		Message: fmt.Sprintf("%s unbanned successfully", req.Ip),
+	}, nil
+}
+
+// SetContentFilter replaces the domain blocklists and allowlists assigned to the node
+func (h *NodeManagerHandler) SetContentFilter(ctx context.Context, req *pb.SetContentFilterRequest) (*pb.SetContentFilterResponse, error) {
+	h.logger.Infof("SetContentFilter called: lists=%d", len(req.Lists))
+
+	lists := make([]services.FilterList, 0, len(req.Lists))
+	for _, list := range req.Lists {
+		lists = append(lists, services.FilterList{
+			Name:            list.Name,
+			Category:        list.Category,
+			Action:          list.Action,
+			URL:             list.Url,
+			Format:          list.Format,
+			Domains:         list.Domains,
+			Users:           list.Users,
+			RefreshInterval: int(list.RefreshInterval),
+		})
+	}
+
+	if err := h.localServices.ContentFilter.SetLists(lists); err != nil {
+		h.logger.Errorf("Failed to set content filter: %v", err)
+		return nil, fmt.Errorf("failed to set content filter: %w", err)
+	}
+
+	return &pb.SetContentFilterResponse{
+		Success: true,
+		Message: "Content filter applied successfully",
+	}, nil
+}
+
+// GetContentFilter returns the assigned lists with their domain counts and download state
+func (h *NodeManagerHandler) GetContentFilter(ctx context.Context, req *pb.GetContentFilterRequest) (*pb.GetContentFilterResponse, error) {
+	statuses := h.localServices.ContentFilter.GetStatus()
+
+	resp := &pb.GetContentFilterResponse{
+		Success: true,
+		Message: "Content filter retrieved successfully",
+		Lists:   make([]*pb.FilterListStatus, 0, len(statuses)),
+	}
+	for _, status := range statuses {
+		list := &pb.FilterListStatus{
+			Name:    status.Name,
+			Action:  status.Action,
+			Domains: int32(status.Domains),
+			Error:   status.Error,
+		}
+		if !status.FetchedAt.IsZero() {
+			list.FetchedAt = status.FetchedAt.Unix()
+		}
+		resp.Lists = append(resp.Lists, list)
+	}
+	return resp, nil
+}
+
+// SetRoutingProfiles replaces the routing profiles assigned to the node
+func (h *NodeManagerHandler) SetRoutingProfiles(ctx context.Context, req *pb.SetRoutingProfilesRequest) (*pb.SetRoutingProfilesResponse, error) {
+	h.logger.Infof("SetRoutingProfiles called: profiles=%d", len(req.Profiles))
+
+	profiles := make([]services.RoutingProfile, 0, len(req.Profiles))
+	for _, profile := range req.Profiles {
+		rp := services.RoutingProfile{
+			Name:        profile.Name,
+			Description: profile.Description,
+			Users:       profile.Users,
+		}
+		for _, outbound := range profile.Outbounds {
+			rp.Outbounds = append(rp.Outbounds, services.RoutingOutbound{
+				Name:     outbound.Name,
+				Type:     outbound.Type,
+				Address:  outbound.Address,
+				Port:     int(outbound.Port),
+				Username: outbound.Username,
+				Password: outbound.Password,
+				Method:   outbound.Method,
+				SNI:      outbound.Sni,
+			})
+		}
+		for _, rule := range profile.Rules {
+			rp.Rules = append(rp.Rules, services.RoutingRule{
+				Domains:   rule.Domains,
+				IPs:       rule.Ips,
+				Outbounds: rule.Outbounds,
+				Strategy:  rule.Strategy,
+			})
+		}
+		profiles = append(profiles, rp)
+	}
+
+	if err := h.localServices.RoutingProfiles.SetProfiles(profiles); err != nil {
+		h.logger.Errorf("Failed to set routing profiles: %v", err)
+		return nil, fmt.Errorf("failed to set routing profiles: %w", err)
+	}
+
+	return &pb.SetRoutingProfilesResponse{
+		Success: true,
+		Message: "Routing profiles applied successfully",
+	}, nil
+}
+
+// SetOutboundPolicy replaces the outbounds Hysteria2 sends client traffic to and the rules
+// choosing between them. A policy without outbounds removes it.
+func (h *NodeManagerHandler) SetOutboundPolicy(ctx context.Context, req *pb.SetOutboundPolicyRequest) (*pb.SetOutboundPolicyResponse, error) {
+	policy := outboundPolicyFromProto(req.Policy)
+	if policy != nil {
+		h.logger.Infof("SetOutboundPolicy called: outbounds=%d rules=%d default=%s", len(policy.Outbounds), len(policy.Rules), policy.Default)
+	} else {
+		h.logger.Info("SetOutboundPolicy called: removing the policy")
+	}
+
+	if err := h.localServices.OutboundPolicy.SetPolicy(policy); err != nil {
+		h.logger.Errorf("Failed to set outbound policy: %v", err)
+		return nil, fmt.Errorf("failed to set outbound policy: %w", err)
+	}
+
+	return &pb.SetOutboundPolicyResponse{
+		Success: true,
+		Message: "Outbound policy applied successfully",
+		Policy:  outboundPolicyProto(h.localServices.OutboundPolicy.GetPolicy()),
+	}, nil
+}
+
+// GetOutboundPolicy returns the outbound policy in force, without proxy passwords
+func (h *NodeManagerHandler) GetOutboundPolicy(ctx context.Context, req *pb.GetOutboundPolicyRequest) (*pb.GetOutboundPolicyResponse, error) {
+	policy := h.localServices.OutboundPolicy.GetPolicy()
+
+	message := "No outbound policy"
+	if policy != nil {
+		message = fmt.Sprintf("%d outbound(s), %d rule(s)", len(policy.Outbounds), len(policy.Rules))
+	}
+	return &pb.GetOutboundPolicyResponse{
+		Success: true,
+		Message: message,
+		Policy:  outboundPolicyProto(policy),
+	}, nil
+}
+
+func outboundPolicyFromProto(policy *pb.OutboundPolicy) *services.OutboundPolicy {
+	if policy == nil || len(policy.Outbounds) == 0 {
+		return nil
+	}
+	result := &services.OutboundPolicy{Default: policy.DefaultOutbound}
+	for _, outbound := range policy.Outbounds {
+		result.Outbounds = append(result.Outbounds, services.PolicyOutbound{
+			Name:       outbound.Name,
+			Type:       outbound.Type,
+			Address:    outbound.Address,
+			Port:       int(outbound.Port),
+			Username:   outbound.Username,
+			Password:   outbound.Password,
+			BindDevice: outbound.BindDevice,
+		})
+	}
+	for _, rule := range policy.Rules {
+		result.Rules = append(result.Rules, hysteriaconfig.ACLRule{
+			Outbound: rule.Outbound,
+			Match:    rule.Match,
+			Value:    rule.Value,
+			Protocol: rule.Protocol,
+			Port:     rule.Port,
+		})
+	}
+	return result
+}
+
+// outboundPolicyProto leaves out proxy passwords
+func outboundPolicyProto(policy *services.OutboundPolicy) *pb.OutboundPolicy {
+	if policy == nil {
+		return nil
+	}
+	result := &pb.OutboundPolicy{DefaultOutbound: policy.Default}
+	for _, outbound := range policy.Outbounds {
+		result.Outbounds = append(result.Outbounds, &pb.PolicyOutbound{
+			Name:       outbound.Name,
+			Type:       outbound.Type,
+			Address:    outbound.Address,
+			Port:       int32(outbound.Port),
+			Username:   outbound.Username,
+			BindDevice: outbound.BindDevice,
+		})
+	}
+	for _, rule := range policy.Rules {
+		result.Rules = append(result.Rules, &pb.PolicyRule{
+			Outbound: rule.Outbound,
+			Match:    rule.Match,
+			Value:    rule.Value,
+			Protocol: rule.Protocol,
+			Port:     rule.Port,
+		})
+	}
+	return result
+}
+
+// RunProbeTests probes another node the way censors probe suspected proxies and returns the report
+func (h *NodeManagerHandler) RunProbeTests(ctx context.Context, req *pb.RunProbeTestsRequest) (*pb.RunProbeTestsResponse, error) {
+	if req.Target == nil {
+		return nil, invalidArgument("probe target is required")
+	}
+	h.logger.Infof("RunProbeTests called: node=%s target=%s", req.NodeId, req.Target.Host)
+
+	target := services.ProbeTarget{
+		Host:         req.Target.Host,
+		QUICPort:     int(req.Target.QuicPort),
+		SNIDomains:   req.Target.SniDomains,
+		FloodPackets: int(req.Target.FloodPackets),
+	}
+	for _, port := range req.Target.TlsPorts {
+		target.TLSPorts = append(target.TLSPorts, int(port))
+	}
+
+	report, err := h.localServices.ProbeRunner.Run(ctx, target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run probe tests: %w", err)
+	}
+
+	result := &pb.ProbeReport{
+		NodeId:     req.NodeId,
+		Target:     report.Target,
+		Score:      int32(report.Score),
+		StartedAt:  report.StartedAt.Unix(),
+		FinishedAt: report.FinishedAt.Unix(),
+		Checks:     make([]*pb.ProbeCheck, 0, len(report.Checks)),
+	}
+	for _, check := range report.Checks {
+		result.Checks = append(result.Checks, &pb.ProbeCheck{
+			Name:       check.Name,
+			Target:     check.Target,
+			Status:     check.Status,
+			Detail:     check.Detail,
+			DurationMs: check.Duration.Milliseconds(),
+		})
+	}
+
+	return &pb.RunProbeTestsResponse{
+		Success: true,
+		Message: fmt.Sprintf("Probe tests finished with score %d", report.Score),
+		Report:  result,
+	}, nil
+}
+
+// RunTLSCheck grades the TLS another node serves on its TCP ports and returns the report
+func (h *NodeManagerHandler) RunTLSCheck(ctx context.Context, req *pb.RunTLSCheckRequest) (*pb.RunTLSCheckResponse, error) {
+	if req.Target == nil {
+		return nil, invalidArgument("TLS check target is required")
+	}
+	h.logger.Infof("RunTLSCheck called: node=%s target=%s", req.NodeId, req.Target.Host)
+
+	target := services.ProbeTarget{
+		Host:       req.Target.Host,
+		SNIDomains: req.Target.SniDomains,
+	}
+	for _, port := range req.Target.TlsPorts {
+		target.TLSPorts = append(target.TLSPorts, int(port))
+	}
+
+	report, err := h.localServices.ProbeRunner.CheckTLS(ctx, target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run TLS checks: %w", err)
+	}
+
+	result := &pb.TLSReport{
+		NodeId:     req.NodeId,
+		Target:     report.Target,
+		Grade:      report.Grade,
+		Score:      int32(report.Score),
+		StartedAt:  report.StartedAt.Unix(),
+		FinishedAt: report.FinishedAt.Unix(),
+		Checks:     make([]*pb.ProbeCheck, 0, len(report.Checks)),
+	}
+	for _, check := range report.Checks {
+		result.Checks = append(result.Checks, &pb.ProbeCheck{
+			Name:       check.Name,
+			Target:     check.Target,
+			Status:     check.Status,
+			Detail:     check.Detail,
+			Hint:       check.Hint,
+			DurationMs: check.Duration.Milliseconds(),
+		})
+	}
+
+	return &pb.RunTLSCheckResponse{
+		Success: true,
+		Message: fmt.Sprintf("TLS checks finished with grade %s", report.Grade),
+		Report:  result,
+	}, nil
+}
+
+// RunSpeedtest measures latency and throughput between the node and the requested reflectors
+func (h *NodeManagerHandler) RunSpeedtest(ctx context.Context, req *pb.RunSpeedtestRequest) (*pb.RunSpeedtestResponse, error) {
+	h.logger.Infof("RunSpeedtest called: %d reflectors", len(req.Reflectors))
+
+	reflectors := make([]services.SpeedtestReflector, 0, len(req.Reflectors))
+	for _, reflector := range req.Reflectors {
+		reflectors = append(reflectors, services.SpeedtestReflector{
+			Region:   reflector.Region,
+			Host:     reflector.Host,
+			Port:     int(reflector.Port),
+			Type:     reflector.Type,
+			ServerID: reflector.ServerId,
+		})
+	}
+
+	results, err := h.localServices.Speedtest.Run(ctx, reflectors, int(req.Duration))
+	if err != nil {
+		return nil, fmt.Errorf("failed to run speedtest: %w", err)
+	}
+
+	resp := &pb.RunSpeedtestResponse{
+		Success: true,
+		Message: fmt.Sprintf("Speedtest completed against %d reflector(s)", len(results)),
+		Results: make([]*pb.SpeedtestResult, 0, len(results)),
+	}
+	for _, result := range results {
+		resp.Results = append(resp.Results, &pb.SpeedtestResult{
+			NodeId:       req.NodeId,
+			Region:       result.Region,
+			Host:         result.Host,
+			LatencyMs:    result.LatencyMs,
+			DownloadMbps: result.DownloadMbps,
+			UploadMbps:   result.UploadMbps,
+			Error:        result.Error,
+			MeasuredAt:   result.MeasuredAt.Unix(),
+		})
+	}
+	return resp, nil
+}
+
+// CheckEgress returns the reputation of the node's egress addresses, checking them now when
+// asked to or when no scheduled check has finished yet
+func (h *NodeManagerHandler) CheckEgress(ctx context.Context, req *pb.CheckEgressRequest) (*pb.CheckEgressResponse, error) {
+	h.logger.Infof("CheckEgress called: refresh=%t", req.Refresh)
+
+	report := h.localServices.EgressMonitor.LastReport()
+	if req.Refresh || report == nil {
+		var err error
+		if report, err = h.localServices.EgressMonitor.Check(ctx); err != nil {
+			return nil, fmt.Errorf("failed to check egress addresses: %w", err)
+		}
+	}
+
+	result := &pb.EgressReport{
+		NodeId:    req.NodeId,
+		Health:    report.Health,
+		CheckedAt: report.CheckedAt.Unix(),
+		Paths:     make([]*pb.EgressPath, 0, len(report.Paths)),
+	}
+	for _, path := range report.Paths {
+		p := &pb.EgressPath{
+			Path:    path.Path,
+			Ip:      path.IP,
+			Country: path.Country,
+			Org:     path.Org,
+			Health:  path.Health,
+			Issues:  path.Issues,
+			Error:   path.Error,
+		}
+		for _, listing := range path.Listings {
+			p.Listings = append(p.Listings, &pb.EgressListing{
+				Zone:   listing.Zone,
+				Listed: listing.Listed,
+				Codes:  listing.Codes,
+				Error:  listing.Error,
+			})
+		}
+		for _, check := range path.Services {
+			p.Services = append(p.Services, &pb.EgressServiceCheck{
+				Service: check.Service,
+				Status:  check.Status,
+				Detail:  check.Detail,
+			})
+		}
+		result.Paths = append(result.Paths, p)
+	}
+
+	return &pb.CheckEgressResponse{
+		Success: true,
+		Message: fmt.Sprintf("Egress health is %s", report.Health),
+		Report:  result,
+	}, nil
+}
+
+// CheckIntegrity reports the free space of the node's partitions and the deployed configs
+// edited outside the agent, from the last scheduled check unless refresh is set
+func (h *NodeManagerHandler) CheckIntegrity(ctx context.Context, req *pb.CheckIntegrityRequest) (*pb.CheckIntegrityResponse, error) {
+	h.logger.Infof("CheckIntegrity called: refresh=%t", req.Refresh)
+
+	report := h.localServices.Integrity.LastReport()
+	if req.Refresh || report == nil {
+		var err error
+		if report, err = h.localServices.Integrity.Check(ctx); err != nil {
+			return nil, fmt.Errorf("failed to check integrity: %w", err)
+		}
+	}
+
+	result := &pb.IntegrityReport{
+		NodeId:    req.NodeId,
+		Drifted:   report.Drifted(),
+		CheckedAt: report.CheckedAt.Unix(),
+		Disks:     make([]*pb.DiskUsage, 0, len(report.Disks)),
+		Configs:   make([]*pb.ConfigIntegrity, 0, len(report.Configs)),
+	}
+	for _, disk := range report.Disks {
+		result.Disks = append(result.Disks, &pb.DiskUsage{
+			Path:              disk.Path,
+			TotalBytes:        disk.TotalBytes,
+			FreeBytes:         disk.FreeBytes,
+			UsedPercent:       disk.UsedPercent,
+			Inodes:            disk.Inodes,
+			FreeInodes:        disk.FreeInodes,
+			InodesUsedPercent: disk.InodesUsedPercent,
+			Low:               disk.Low,
+		})
+	}
+	for _, file := range report.Configs {
+		config := &pb.ConfigIntegrity{
+			Path:           file.Path,
+			Status:         file.Status,
+			ExpectedSha256: file.Expected,
+			ActualSha256:   file.Actual,
+		}
+		if !file.ModifiedAt.IsZero() {
+			config.ModifiedAt = file.ModifiedAt.Unix()
+		}
+		result.Configs = append(result.Configs, config)
+	}
+
+	message := "Deployed configs match what the agent wrote"
+	if len(result.Drifted) > 0 {
+		message = fmt.Sprintf("%d config(s) changed outside the agent", len(result.Drifted))
+	}
+	if low := report.LowDisks(); len(low) > 0 {
+		message += fmt.Sprintf(", %d partition(s) low on space or inodes", len(low))
+	}
+	return &pb.CheckIntegrityResponse{
+		Success: true,
+		Message: message,
+		Report:  result,
+	}, nil
+}
+
+// CheckDrift compares the node with the desired protocol matrix and the configs, firewall
+// and routing rules the agent applied, re-applying them first with heal
+func (h *NodeManagerHandler) CheckDrift(ctx context.Context, req *pb.CheckDriftRequest) (*pb.CheckDriftResponse, error) {
+	h.logger.Infof("CheckDrift called: heal=%t", req.Heal)
+
+	result := &pb.DriftReport{NodeId: req.NodeId}
+	var report *services.DriftReport
+	if req.Heal {
+		heal, err := h.localServices.Drift.Heal(ctx, req.Protocols)
+		if err != nil {
+			return nil, fmt.Errorf("failed to heal drift: %w", err)
+		}
+		report = heal.Remaining
+		result.Healed = heal.Actions
+		result.HealFailed = heal.Failed
+		result.HealedAt = report.CheckedAt.Unix()
+	} else {
+		var err error
+		if report, err = h.localServices.Drift.Check(ctx, req.Protocols); err != nil {
+			return nil, fmt.Errorf("failed to check drift: %w", err)
+		}
+	}
+
+	result.CheckedAt = report.CheckedAt.Unix()
+	result.Items = make([]*pb.DriftItem, 0, len(report.Items))
+	for _, item := range report.Items {
+		result.Items = append(result.Items, &pb.DriftItem{
+			Kind:     item.Kind,
+			Target:   item.Target,
+			Expected: item.Expected,
+			Actual:   item.Actual,
+		})
+	}
+
+	message := "No drift found"
+	if len(result.Items) > 0 {
+		message = fmt.Sprintf("%d drift item(s) found", len(result.Items))
+	}
+	return &pb.CheckDriftResponse{
+		Success: true,
+		Message: message,
+		Report:  result,
+	}, nil
+}
+
+// SetNodeCapacity replaces the connection and bandwidth caps the node enforces. The user
+// cap is kept by the orchestrator and ignored here.
+func (h *NodeManagerHandler) SetNodeCapacity(ctx context.Context, req *pb.SetNodeCapacityRequest) (*pb.SetNodeCapacityResponse, error) {
+	if req.Capacity == nil {
+		return nil, invalidArgument("capacity is required")
+	}
+	h.logger.Infof("SetNodeCapacity called: max_connections=%d max_mbps=%d", req.Capacity.MaxConnections, req.Capacity.MaxMbps)
+
+	limits := services.CapacityLimits{
+		MaxConnections: int(req.Capacity.MaxConnections),
+		MaxMbps:        int(req.Capacity.MaxMbps),
+	}
+	if limits.MaxConnections < 0 || limits.MaxMbps < 0 {
+		return nil, invalidArgument("capacity limits must not be negative")
+	}
+	if err := h.localServices.Admission.SetLimits(limits); err != nil {
+		h.logger.Errorf("Failed to set capacity limits: %v", err)
+		return nil, fmt.Errorf("failed to set capacity limits: %w", err)
+	}
+
+	return &pb.SetNodeCapacityResponse{
+		Success:     true,
+		Message:     "Capacity limits applied successfully",
+		Capacity:    nodeCapacityProto(limits),
+		Utilization: capacityUtilizationProto(h.localServices.Admission.Utilization()),
+	}, nil
+}
+
+// GetNodeCapacity returns the caps in force and the last measured utilization
+func (h *NodeManagerHandler) GetNodeCapacity(ctx context.Context, req *pb.GetNodeCapacityRequest) (*pb.GetNodeCapacityResponse, error) {
+	return &pb.GetNodeCapacityResponse{
+		Success:     true,
+		Capacity:    nodeCapacityProto(h.localServices.Admission.Limits()),
+		Utilization: capacityUtilizationProto(h.localServices.Admission.Utilization()),
+	}, nil
+}
+
+func nodeCapacityProto(limits services.CapacityLimits) *pb.NodeCapacity {
+	return &pb.NodeCapacity{
+		MaxConnections: int32(limits.MaxConnections),
+		MaxMbps:        int32(limits.MaxMbps),
+	}
+}
+
+// capacityUtilizationProto converts the last measurement, nil before the first one
+func capacityUtilizationProto(utilization *services.CapacityUtilization) *pb.CapacityUtilization {
+	if utilization == nil {
+		return nil
+	}
+	return &pb.CapacityUtilization{
+		Connections:     int32(utilization.Connections),
+		Mbps:            utilization.Mbps,
+		AdmissionClosed: utilization.AdmissionClosed,
+		Reason:          utilization.Reason,
+		MeasuredAt:      utilization.MeasuredAt.Unix(),
+	}
+}
+
+// SetQoSPolicy applies a queueing policy and reports the latency measured before and after it
+func (h *NodeManagerHandler) SetQoSPolicy(ctx context.Context, req *pb.SetQoSPolicyRequest) (*pb.SetQoSPolicyResponse, error) {
+	if req.Policy == nil {
+		return nil, invalidArgument("QoS policy is required")
+	}
+	h.logger.Infof("SetQoSPolicy called: enabled=%t qdisc=%s classes=%d", req.Policy.Enabled, req.Policy.Qdisc, len(req.Policy.Classes))
+
+	policy := services.QoSPolicy{
+		Enabled:       req.Policy.Enabled,
+		Qdisc:         req.Policy.Qdisc,
+		BandwidthMbps: int(req.Policy.BandwidthMbps),
+	}
+	for _, class := range req.Policy.Classes {
+		policy.Classes = append(policy.Classes, services.QoSClass{
+			Name:     class.Name,
+			Protocol: class.Protocol,
+			Ports:    class.Ports,
+			DSCP:     class.Dscp,
+		})
+	}
+
+	status, err := h.localServices.QoS.SetPolicy(ctx, policy)
+	if err != nil {
+		h.logger.Errorf("Failed to set QoS policy: %v", err)
+		return nil, fmt.Errorf("failed to set QoS policy: %w", err)
+	}
+
+	return &pb.SetQoSPolicyResponse{
+		Success: true,
+		Message: "QoS policy applied successfully",
+		Before:  qosLatencyProto(status.Before),
+		After:   qosLatencyProto(status.After),
+	}, nil
+}
+
+// GetQoSStatus returns the queueing policy in force and the latency measurements
+func (h *NodeManagerHandler) GetQoSStatus(ctx context.Context, req *pb.GetQoSStatusRequest) (*pb.GetQoSStatusResponse, error) {
+	status := h.localServices.QoS.Status()
+
+	policy := &pb.QoSPolicy{
+		Enabled:       status.Policy.Enabled,
+		Qdisc:         status.Policy.Qdisc,
+		BandwidthMbps: int32(status.Policy.BandwidthMbps),
+	}
+	for _, class := range status.Policy.Classes {
+		policy.Classes = append(policy.Classes, &pb.QoSClass{
+			Name:     class.Name,
+			Protocol: class.Protocol,
+			Ports:    class.Ports,
+			Dscp:     class.DSCP,
+		})
+	}
+
+	resp := &pb.GetQoSStatusResponse{
+		Success:   true,
+		Policy:    policy,
+		Interface: status.Interface,
+		Qdisc:     status.Qdisc,
+		Before:    qosLatencyProto(status.Before),
+		After:     qosLatencyProto(status.After),
+		Latest:    qosLatencyProto(status.Latest),
+	}
+	if !status.AppliedAt.IsZero() {
+		resp.AppliedAt = status.AppliedAt.Unix()
+	}
+	return resp, nil
+}
+
+// qosLatencyProto converts a latency measurement, nil when it was not taken
+func qosLatencyProto(latency *services.QoSLatency) *pb.QoSLatency {
+	if latency == nil {
+		return nil
+	}
+	return &pb.QoSLatency{
+		MedianMs:   latency.MedianMs,
+		P95Ms:      latency.P95Ms,
+		Samples:    int32(latency.Samples),
+		Mbps:       latency.Mbps,
+		MeasuredAt: latency.MeasuredAt.Unix(),
+	}
+}
+
+// AddPortForward exposes a user's server on a public port of the node
+func (h *NodeManagerHandler) AddPortForward(ctx context.Context, req *pb.AddPortForwardRequest) (*pb.AddPortForwardResponse, error) {
+	if req.Forward == nil {
+		return nil, invalidArgument("port forward is required")
+	}
+	h.logger.Infof("AddPortForward called: %s %d -> %s:%d", req.Forward.Protocol, req.Forward.ListenPort, req.Forward.TargetHost, req.Forward.TargetPort)
+
+	forward, err := h.localServices.PortForwards.Add(services.PortForward{
+		ID:         req.Forward.Id,
+		Owner:      req.Forward.Owner,
+		Protocol:   req.Forward.Protocol,
+		ListenPort: int(req.Forward.ListenPort),
+		TargetHost: req.Forward.TargetHost,
+		TargetPort: int(req.Forward.TargetPort),
+	})
+	if err != nil {
+		h.logger.Errorf("Failed to add port forward: %v", err)
+		return nil, fmt.Errorf("failed to add port forward: %w", err)
+	}
+
+	return &pb.AddPortForwardResponse{
+		Success: true,
+		Message: "Port forward added successfully",
+		Forward: portForwardProto(forward),
+	}, nil
+}
+
+// RemovePortForward closes a forwarded port
+func (h *NodeManagerHandler) RemovePortForward(ctx context.Context, req *pb.RemovePortForwardRequest) (*pb.RemovePortForwardResponse, error) {
+	if req.ForwardId == "" {
+		return nil, invalidArgument("forward id is required")
+	}
+	h.logger.Infof("RemovePortForward called: %s", req.ForwardId)
+
+	if err := h.localServices.PortForwards.Remove(req.ForwardId); err != nil {
+		h.logger.Errorf("Failed to remove port forward: %v", err)
+		return nil, fmt.Errorf("failed to remove port forward: %w", err)
+	}
+
+	return &pb.RemovePortForwardResponse{
+		Success: true,
+		Message: "Port forward removed successfully",
+	}, nil
+}
+
+// ListPortForwards returns the node's forwards and the range they may listen on
+func (h *NodeManagerHandler) ListPortForwards(ctx context.Context, req *pb.ListPortForwardsRequest) (*pb.ListPortForwardsResponse, error) {
+	forwards := h.localServices.PortForwards.List()
+	minPort, maxPort := h.localServices.PortForwards.Range()
+
+	resp := &pb.ListPortForwardsResponse{
+		Success:  true,
+		Message:  fmt.Sprintf("%d port forward(s)", len(forwards)),
+		Forwards: make([]*pb.PortForward, 0, len(forwards)),
+		MinPort:  int32(minPort),
+		MaxPort:  int32(maxPort),
+	}
+	for i := range forwards {
+		resp.Forwards = append(resp.Forwards, portForwardProto(&forwards[i]))
+	}
+	return resp, nil
+}
+
+func portForwardProto(forward *services.PortForward) *pb.PortForward {
+	return &pb.PortForward{
+		Id:         forward.ID,
+		Owner:      forward.Owner,
+		Protocol:   forward.Protocol,
+		ListenPort: int32(forward.ListenPort),
+		TargetHost: forward.TargetHost,
+		TargetPort: int32(forward.TargetPort),
+		CreatedAt:  forward.CreatedAt.Unix(),
+	}
+}
+
+// CheckUpdates compares the installed component releases with the latest published ones
+func (h *NodeManagerHandler) CheckUpdates(ctx context.Context, req *pb.CheckUpdatesRequest) (*pb.CheckUpdatesResponse, error) {
+	h.logger.Info("CheckUpdates called")
+
+	updaters := []struct {
+		name    string
+		updater interface {
+			CheckUpdates(ctx context.Context) (*services.ComponentVersion, error)
+		}
+	}{
+		{"Hysteria2", h.localServices.HysteriaUpdater},
+		{"Xray", h.localServices.XrayUpdater},
+	}
+
+	// One component failing to reach GitHub should not hide the versions of the others
+	var components []*pb.ComponentVersion
+	var failures []string
+	for _, u := range updaters {
+		version, err := u.updater.CheckUpdates(ctx)
+		if err != nil {
+			h.logger.Warnf("Failed to check %s updates: %v", u.name, err)
+			failures = append(failures, fmt.Sprintf("%s: %v", u.name, err))
+			continue
+		}
+		components = append(components, componentVersionToProto(version))
+	}
+
+	if len(components) == 0 {
+		return nil, fmt.Errorf("failed to check updates: %s", strings.Join(failures, "; "))
+	}
+
+	message := "Update check completed"
+	if len(failures) > 0 {
+		message = fmt.Sprintf("Update check partially failed: %s", strings.Join(failures, "; "))
+	}
+	return &pb.CheckUpdatesResponse{
+		Success:    true,
+		Message:    message,
+		Components: components,
+	}, nil
+}
+
+// UpgradeHysteria2 replaces the Hysteria2 binary, rolling back if the new release fails
+func (h *NodeManagerHandler) UpgradeHysteria2(ctx context.Context, req *pb.UpgradeHysteria2Request) (*pb.UpgradeHysteria2Response, error) {
+	h.logger.Infof("UpgradeHysteria2 called: version=%q", req.Version)
+
+	result, err := h.localServices.HysteriaUpdater.Upgrade(ctx, req.Version)
+	resp := &pb.UpgradeHysteria2Response{}
+	if result != nil {
+		resp.PreviousVersion = result.PreviousVersion
+		resp.InstalledVersion = result.InstalledVersion
+		resp.RolledBack = result.RolledBack
+	}
+	if err != nil {
+		h.logger.Errorf("Failed to upgrade Hysteria2: %v", err)
+		resp.Message = fmt.Sprintf("Failed to upgrade Hysteria2: %v", err)
+		return resp, nil
+	}
+
+	resp.Success = true
+	if result.PreviousVersion == result.InstalledVersion {
+		resp.Message = fmt.Sprintf("Hysteria2 is already at %s", result.InstalledVersion)
+	} else {
+		resp.Message = fmt.Sprintf("Hysteria2 upgraded from %s to %s", result.PreviousVersion, result.InstalledVersion)
+	}
+	return resp, nil
+}
+
+// UpgradeXray replaces Xray-core, migrating the server config for the new release and
+// rolling back if it fails
+func (h *NodeManagerHandler) UpgradeXray(ctx context.Context, req *pb.UpgradeXrayRequest) (*pb.UpgradeXrayResponse, error) {
+	h.logger.Infof("UpgradeXray called: version=%q", req.Version)
+
+	result, err := h.localServices.XrayUpdater.Upgrade(ctx, req.Version)
+	resp := &pb.UpgradeXrayResponse{}
+	if result != nil {
+		resp.PreviousVersion = result.PreviousVersion
+		resp.InstalledVersion = result.InstalledVersion
+		resp.RolledBack = result.RolledBack
+		resp.Migrations = result.Migrations
+	}
+	if err != nil {
+		h.logger.Errorf("Failed to upgrade Xray: %v", err)
+		resp.Message = fmt.Sprintf("Failed to upgrade Xray: %v", err)
+		return resp, nil
+	}
+
+	resp.Success = true
+	if result.PreviousVersion == result.InstalledVersion {
+		resp.Message = fmt.Sprintf("Xray is already at %s", result.InstalledVersion)
+	} else {
+		resp.Message = fmt.Sprintf("Xray upgraded from %s to %s", result.PreviousVersion, result.InstalledVersion)
+	}
+	return resp, nil
+}
+
+// RenewCertificates renews the certificates expiring soon and reloads the servers using them
+func (h *NodeManagerHandler) RenewCertificates(ctx context.Context, req *pb.RenewCertificatesRequest) (*pb.RenewCertificatesResponse, error) {
+	h.logger.Info("RenewCertificates called")
+
+	if err := h.localServices.HysteriaManager.RenewCertificates(); err != nil {
+		h.logger.Errorf("Failed to renew certificates: %v", err)
+		return nil, fmt.Errorf("failed to renew certificates: %w", err)
+	}
+	if h.localServices.DecoyManager != nil {
+		h.localServices.DecoyManager.ReloadCertificates()
+	}
+
+	return &pb.RenewCertificatesResponse{
+		Success: true,
+		Message: "Certificates renewed",
+	}, nil
+}
+
+// ListCertificates returns every certificate the node holds, for the orchestrator's
+// inventory
+func (h *NodeManagerHandler) ListCertificates(ctx context.Context, req *pb.ListCertificatesRequest) (*pb.ListCertificatesResponse, error) {
+	certificates, err := h.localServices.HysteriaManager.ListCertificates()
+	if err != nil {
+		h.logger.Errorf("Failed to list certificates: %v", err)
+		return nil, fmt.Errorf("failed to list certificates: %w", err)
+	}
+
+	resp := &pb.ListCertificatesResponse{
+		Success:      true,
+		Message:      fmt.Sprintf("%d certificate(s) found", len(certificates)),
+		Certificates: make([]*pb.NodeCertificate, 0, len(certificates)),
+	}
+	for _, cert := range certificates {
+		resp.Certificates = append(resp.Certificates, &pb.NodeCertificate{
+			Domain:     cert.Domain,
+			Issuer:     cert.Issuer,
+			NotBefore:  cert.NotBefore.Unix(),
+			NotAfter:   cert.NotAfter.Unix(),
+			SelfSigned: cert.IsSelfSigned,
+			Source:     cert.Source,
+			DaysLeft:   int32(time.Until(cert.NotAfter).Hours() / 24),
+		})
+	}
+	return resp, nil
+}
+
+// IssueCertificate issues a Let's Encrypt certificate for an SNI domain and reloads the
+// servers using it
+func (h *NodeManagerHandler) IssueCertificate(ctx context.Context, req *pb.IssueCertificateRequest) (*pb.IssueCertificateResponse, error) {
+	h.logger.Infof("IssueCertificate called: domain=%s", req.Domain)
+
+	domain, err := services.NormalizeSNIDomain(req.Domain)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := h.localServices.HysteriaManager.IssueCertificate(domain, req.Email)
+	if cert == nil {
+		h.logger.Errorf("Failed to issue certificate for %s: %v", domain, err)
+		return &pb.IssueCertificateResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to issue certificate: %v", err),
+		}, nil
+	}
+	if h.localServices.DecoyManager != nil {
+		h.localServices.DecoyManager.ReloadCertificates()
+	}
+
+	resp := &pb.IssueCertificateResponse{
+		Success:  true,
+		Message:  fmt.Sprintf("Certificate for %s issued by %s", domain, cert.Issuer),
+		Issuer:   cert.Issuer,
+		NotAfter: cert.NotAfter.Unix(),
+	}
+	if err != nil {
+		h.logger.Warnf("Certificate for %s issued: %v", domain, err)
+		resp.Message = err.Error()
+	}
+	return resp, nil
+}
+
+// InstallCertificate installs a certificate an operator uploaded for an SNI domain,
+// typically one ACME cannot serve, and restarts Hysteria2 to serve it
+func (h *NodeManagerHandler) InstallCertificate(ctx context.Context, req *pb.InstallCertificateRequest) (*pb.InstallCertificateResponse, error) {
+	h.logger.Infof("InstallCertificate called: domain=%s", req.Domain)
+
+	domain, err := services.NormalizeSNIDomain(req.Domain)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := h.localServices.HysteriaManager.InstallCertificate(domain, req.CertificatePem, req.PrivateKeyPem)
+	if cert == nil {
+		h.logger.Errorf("Failed to install certificate for %s: %v", domain, err)
+		return &pb.InstallCertificateResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to install certificate: %v", err),
+		}, nil
+	}
+	if h.localServices.DecoyManager != nil {
+		h.localServices.DecoyManager.ReloadCertificates()
+	}
+
+	resp := &pb.InstallCertificateResponse{
+		Success:  true,
+		Message:  fmt.Sprintf("Certificate for %s issued by %s installed", domain, cert.Issuer),
+		Issuer:   cert.Issuer,
+		NotAfter: cert.NotAfter.Unix(),
+	}
+	if err != nil {
+		h.logger.Warnf("Certificate for %s installed: %v", domain, err)
+		resp.Message = err.Error()
+	}
+	return resp, nil
+}
+
+// PreviewServerConfig generates the config ConfigureHysteria2 or ConfigureXray would save
+// for a template, without saving it, and returns it with the config in use
+func (h *NodeManagerHandler) PreviewServerConfig(ctx context.Context, req *pb.PreviewServerConfigRequest) (*pb.PreviewServerConfigResponse, error) {
+	h.logger.Infof("PreviewServerConfig called: kind=%s", req.Kind)
+
+	var generated, current, configPath string
+	var err error
+	switch req.Kind {
+	case "hysteria2":
+		hysteria := h.localServices.HysteriaManager
+		configPath = hysteria.ConfigPath()
+		if generated, err = hysteria.GenerateConfig(req.ConfigTemplate); err == nil {
+			current, err = hysteria.CurrentConfig()
+		}
+	case "xray":
+		xray := h.localServices.XrayManager
+		configPath = xray.ConfigPath()
+		if generated, err = xray.GenerateConfig(req.Protocol, req.ConfigTemplate); err == nil {
+			current, err = xray.CurrentConfig()
+		}
+	default:
+		return nil, invalidArgument("unsupported kind %q", req.Kind)
+	}
+	if err != nil {
+		h.logger.Errorf("Failed to preview %s config: %v", req.Kind, err)
+		return nil, fmt.Errorf("failed to preview config: %w", err)
+	}
+
+	return &pb.PreviewServerConfigResponse{
+		Success:         true,
+		Message:         "Config generated",
+		ConfigPath:      configPath,
+		CurrentConfig:   current,
+		GeneratedConfig: generated,
+	}, nil
+}
+
+// BackupNodeFiles returns the node key, server configs and certificates for a
+// disaster-recovery backup
+func (h *NodeManagerHandler) BackupNodeFiles(ctx context.Context, req *pb.BackupNodeFilesRequest) (*pb.BackupNodeFilesResponse, error) {
+	h.logger.Info("BackupNodeFiles called")
+
+	files, err := h.localServices.NodeBackup.Collect()
+	if err != nil {
+		h.logger.Errorf("Failed to collect backup files: %v", err)
+		return nil, fmt.Errorf("failed to collect files: %w", err)
+	}
+
+	resp := &pb.BackupNodeFilesResponse{
+		Success: true,
+		Message: fmt.Sprintf("Collected %d files", len(files)),
+	}
+	for _, file := range files {
+		resp.Files = append(resp.Files, &pb.NodeFile{
+			Path:    file.Path,
+			Mode:    uint32(file.Mode),
+			Content: file.Content,
+		})
+	}
+	return resp, nil
+}
+
+// RestoreNodeFiles writes files from a backup back and restarts the installed servers so
+// they pick up the restored configs and certificates
+func (h *NodeManagerHandler) RestoreNodeFiles(ctx context.Context, req *pb.RestoreNodeFilesRequest) (*pb.RestoreNodeFilesResponse, error) {
+	h.logger.Infof("RestoreNodeFiles called: %d files", len(req.Files))
+
+	files := make([]services.NodeFile, 0, len(req.Files))
+	for _, file := range req.Files {
+		files = append(files, services.NodeFile{
+			Path:    file.Path,
+			Mode:    os.FileMode(file.Mode),
+			Content: file.Content,
+		})
+	}
+	if err := h.localServices.NodeBackup.Restore(files); err != nil {
+		h.logger.Errorf("Failed to restore backup files: %v", err)
+		return nil, fmt.Errorf("failed to restore files: %w", err)
+	}
+
+	// RestartServer reports failures in its response
+	restart, _ := h.RestartServer(ctx, &pb.RestartRequest{NodeId: req.NodeId})
+	if !restart.Success {
+		return &pb.RestoreNodeFilesResponse{
+			Success:       false,
+			Message:       fmt.Sprintf("Restored %d files: %s", len(files), restart.Message),
+			RestoredFiles: int32(len(files)),
+		}, nil
+	}
+	if h.localServices.DecoyManager != nil {
+		h.localServices.DecoyManager.ReloadCertificates()
+	}
+
+	return &pb.RestoreNodeFilesResponse{
+		Success:       true,
+		Message:       fmt.Sprintf("Restored %d files; %s", len(files), restart.Message),
+		RestoredFiles: int32(len(files)),
+	}, nil
+}
+
+func componentVersionToProto(version *services.ComponentVersion) *pb.ComponentVersion {
+	return &pb.ComponentVersion{
+		Name:            version.Name,
+		Installed:       version.Installed,
+		Latest:          version.Latest,
+		Pinned:          version.Pinned,
+		UpdateAvailable: version.UpdateAvailable,
+	}
+}
+
+// Xray management methods
+
+// ConfigureXray generates a single-protocol Xray config and saves it as the server config
+func (h *NodeManagerHandler) ConfigureXray(ctx context.Context, req *pb.ConfigureXrayRequest) (*pb.ConfigureXrayResponse, error) {
+	h.logger.Infof("ConfigureXray called: protocol=%s", req.Protocol)
+
+	xray := h.localServices.XrayManager
+
+	var err error
+	switch req.Protocol {
+	case services.XrayProtocolTrojan:
+		err = xray.ConfigureTrojan(req.Password)
+	case services.XrayProtocolShadowsocks2022:
+		err = xray.ConfigureShadowsocks2022(req.Method, req.Password)
+	}
+	if err != nil {
+		h.logger.Errorf("Failed to configure %s: %v", req.Protocol, err)
+		return nil, fmt.Errorf("failed to configure %s: %w", req.Protocol, err)
+	}
+
+	config, err := xray.GenerateConfig(req.Protocol, req.ConfigTemplate)
+	if err != nil {
+		h.logger.Errorf("Failed to generate Xray config: %v", err)
+		return nil, fmt.Errorf("failed to generate config: %w", err)
+	}
+
+	configPath := xray.ConfigPath()
+	if err := xray.SaveConfig(config); err != nil {
+		h.logger.Errorf("Failed to save config: %v", err)
+		return nil, fmt.Errorf("failed to save config: %w", err)
+	}
+
+	return &pb.ConfigureXrayResponse{
+		Success:         true,
+		Message:         fmt.Sprintf("Xray configured for %s", req.Protocol),
+		ConfigPath:      configPath,
+		GeneratedConfig: config,
+	}, nil
+}
+
+// AddXrayInbound adds a protocol inbound to the running Xray config
+func (h *NodeManagerHandler) AddXrayInbound(ctx context.Context, req *pb.XrayInboundRequest) (*pb.XrayInboundResponse, error) {
+	h.logger.Infof("AddXrayInbound called: protocol=%s", req.Protocol)
+
+	if err := h.localServices.XrayManager.AddInbound(req.Protocol); err != nil {
+		h.logger.Errorf("Failed to add Xray inbound: %v", err)
+		return nil, fmt.Errorf("failed to add inbound: %w", err)
+	}
+
+	if err := h.reloadXray(); err != nil {
+		return nil, fmt.Errorf("inbound saved but Xray restart failed: %w", err)
+	}
+
+	return &pb.XrayInboundResponse{
+		Success: true,
+		Message: fmt.Sprintf("%s inbound added", req.Protocol),
+	}, nil
+}
+
+// RemoveXrayInbound removes a protocol inbound from the running Xray config
+func (h *NodeManagerHandler) RemoveXrayInbound(ctx context.Context, req *pb.XrayInboundRequest) (*pb.XrayInboundResponse, error) {
+	h.logger.Infof("RemoveXrayInbound called: protocol=%s", req.Protocol)
+
+	if err := h.localServices.XrayManager.RemoveInbound(req.Protocol); err != nil {
+		h.logger.Errorf("Failed to remove Xray inbound: %v", err)
+		return nil, fmt.Errorf("failed to remove inbound: %w", err)
+	}
+
+	if err := h.reloadXray(); err != nil {
+		return nil, fmt.Errorf("inbound removed but Xray restart failed: %w", err)
+	}
+
+	return &pb.XrayInboundResponse{
+		Success: true,
+		Message: fmt.Sprintf("%s inbound removed", req.Protocol),
+	}, nil
+}
+
+// AddXrayUser adds a client to a protocol inbound
+func (h *NodeManagerHandler) AddXrayUser(ctx context.Context, req *pb.AddXrayUserRequest) (*pb.AddXrayUserResponse, error) {
+	if req.User == nil {
+		return nil, invalidArgument("user is required")
+	}
+
+	h.logger.Infof("AddXrayUser called: protocol=%s, email=%s", req.Protocol, req.User.Email)
+
+	user, err := h.localServices.XrayManager.AddUser(req.Protocol, services.XrayUser{
+		Email:    req.User.Email,
+		ID:       req.User.Id,
+		Password: req.User.Password,
+		Flow:     req.User.Flow,
+	})
+	if err != nil {
+		h.logger.Errorf("Failed to add Xray user: %v", err)
+		return nil, fmt.Errorf("failed to add user: %w", err)
+	}
+
+	resp := &pb.AddXrayUserResponse{
+		Success: true,
+		Message: fmt.Sprintf("User %s added to %s inbound", user.Email, req.Protocol),
+		User: &pb.XrayUser{
+			Email:    user.Email,
+			Id:       user.ID,
+			Password: user.Password,
+			Flow:     user.Flow,
+		},
+	}
+
+	if err := h.reloadXray(); err != nil {
+		resp.Success = false
+		resp.Message = fmt.Sprintf("User saved but Xray restart failed: %v", err)
+	}
+
+	return resp, nil
+}
+
+// RemoveXrayUser removes a client from a protocol inbound
+func (h *NodeManagerHandler) RemoveXrayUser(ctx context.Context, req *pb.RemoveXrayUserRequest) (*pb.RemoveXrayUserResponse, error) {
+	h.logger.Infof("RemoveXrayUser called: protocol=%s, email=%s", req.Protocol, req.Email)
+
+	if err := h.localServices.XrayManager.RemoveUser(req.Protocol, req.Email); err != nil {
+		h.logger.Errorf("Failed to remove Xray user: %v", err)
+		return nil, fmt.Errorf("failed to remove user: %w", err)
+	}
+
+	if err := h.reloadXray(); err != nil {
+		return nil, fmt.Errorf("user removed but Xray restart failed: %w", err)
+	}
+
+	return &pb.RemoveXrayUserResponse{
+		Success: true,
+		Message: fmt.Sprintf("User %s removed from %s inbound", req.Email, req.Protocol),
+	}, nil
+}
+
+// GetXrayConnections lists the clients online on Xray
+func (h *NodeManagerHandler) GetXrayConnections(ctx context.Context, req *pb.GetXrayConnectionsRequest) (*pb.GetXrayConnectionsResponse, error) {
+	connections, err := h.localServices.XrayManager.GetConnections(ctx)
+	if err != nil {
+		h.logger.Errorf("Failed to get Xray connections: %v", err)
+		return nil, fmt.Errorf("failed to get connections: %w", err)
+	}
+
+	return &pb.GetXrayConnectionsResponse{
+		Success:     true,
+		Message:     fmt.Sprintf("%d client(s) online", len(connections)),
+		Connections: xrayConnectionsToProto(req.NodeId, connections),
+	}, nil
+}
+
+// DisconnectXrayUser drops the connections of a user's clients
+func (h *NodeManagerHandler) DisconnectXrayUser(ctx context.Context, req *pb.DisconnectXrayUserRequest) (*pb.DisconnectXrayUserResponse, error) {
+	h.logger.Infof("DisconnectXrayUser called: user=%s, device=%s", req.UserId, req.DeviceId)
+
+	disconnected, err := h.localServices.XrayManager.DisconnectClients(ctx, req.UserId, req.DeviceId)
+	if err != nil {
+		h.logger.Errorf("Failed to disconnect Xray user: %v", err)
+		return &pb.DisconnectXrayUserResponse{
+			Success:      false,
+			Message:      fmt.Sprintf("Failed to disconnect user: %v", err),
+			Disconnected: xrayConnectionsToProto(req.NodeId, disconnected),
+		}, nil
+	}
+
+	return &pb.DisconnectXrayUserResponse{
+		Success:      true,
+		Message:      fmt.Sprintf("%d client(s) disconnected", len(disconnected)),
+		Disconnected: xrayConnectionsToProto(req.NodeId, disconnected),
+	}, nil
+}
+
+func xrayConnectionsToProto(nodeID string, connections []services.XrayConnection) []*pb.XrayConnection {
+	result := make([]*pb.XrayConnection, 0, len(connections))
+	for _, connection := range connections {
+		var lastSeen int64
+		if !connection.LastSeen.IsZero() {
+			lastSeen = connection.LastSeen.Unix()
+		}
+		result = append(result, &pb.XrayConnection{
+			NodeId:      nodeID,
+			Email:       connection.Email,
+			UserId:      connection.UserID,
+			DeviceId:    connection.DeviceID,
+			InboundTags: connection.InboundTags,
+			Ips:         connection.IPs,
+			LastSeen:    lastSeen,
+			Uplink:      connection.Uplink,
+			Downlink:    connection.Downlink,
+		})
+	}
+	return result
+}
+
+// reloadXray restarts Xray with the updated server config if it is running
+func (h *NodeManagerHandler) reloadXray() error {
+	status, err := h.localServices.XrayManager.GetXrayStatus()
+	if err != nil {
+		return err
+	}
+	if running, _ := status["running"].(bool); !running {
+		return nil
+	}
+
+	if err := h.localServices.XrayManager.RestartXray(h.localServices.XrayManager.ConfigPath()); err != nil {
+		h.logger.Errorf("Failed to restart Xray: %v", err)
+		return err
+	}
+	return nil
+}
+
+// WARP management methods
+
+// InstallWARPClient installs Cloudflare WARP client
+func (h *NodeManagerHandler) InstallWARPClient(ctx context.Context, req *pb.InstallWARPClientRequest) (*pb.InstallWARPClientResponse, error) {
+	h.logger.Info("InstallWARPClient called")
+
+	err := h.localServices.WARPManager.InstallWARPClient()
+	if err != nil {
+		h.logger.Errorf("Failed to install WARP client: %v", err)
+		return nil, fmt.Errorf("failed to install WARP client: %w", err)
+	}
+
+	return &pb.InstallWARPClientResponse{
+		Success: true,
+		Message: "WARP client installed successfully",
+	}, nil
+}
+
+// ConfigureWARP configures WARP settings
+func (h *NodeManagerHandler) ConfigureWARP(ctx context.Context, req *pb.ConfigureWARPRequest) (*pb.ConfigureWARPResponse, error) {
+	h.logger.Infof("ConfigureWARP called with enabled: %v, proxy port: %d", req.Enabled, req.ProxyPort)
+
+	// Build WARP config
+	config := services.WARPConfig{
+		Enabled:      req.Enabled,
+		ProxyPort:    int(req.ProxyPort),
+		AutoConnect:  req.AutoConnect,
+		NotifyOnFail: req.NotifyOnFail,
+		ClientType:   req.ClientType,
+		LicenseKey:   req.LicenseKey,
+		Organization: req.Organization,
+		Mode:         req.Mode,
+
+		TeamsClientID:     req.TeamsClientId,
+		TeamsClientSecret: req.TeamsClientSecret,
+	}
+
+	err := h.localServices.WARPManager.ConfigureWARP(config)
+	if err != nil {
+		h.logger.Errorf("Failed to configure WARP: %v", err)
+		return nil, fmt.Errorf("failed to configure WARP: %w", err)
+	}
+
+	return &pb.ConfigureWARPResponse{
+		Success: true,
+		Message: "WARP configured successfully",
+	}, nil
+}
+
+// ConnectWARP connects to WARP network
+func (h *NodeManagerHandler) ConnectWARP(ctx context.Context, req *pb.ConnectWARPRequest) (*pb.ConnectWARPResponse, error) {
+	h.logger.Info("ConnectWARP called")
+
+	err := h.localServices.WARPManager.ConnectWARP()
+	if err != nil {
+		h.logger.Errorf("Failed to connect to WARP: %v", err)
+		return nil, fmt.Errorf("failed to connect to WARP: %w", err)
+	}
+
+	return &pb.ConnectWARPResponse{
+		Success: true,
+		Message: "Connected to WARP successfully",
+	}, nil
+}
+
+// DisconnectWARP disconnects from WARP network
+func (h *NodeManagerHandler) DisconnectWARP(ctx context.Context, req *pb.DisconnectWARPRequest) (*pb.DisconnectWARPResponse, error) {
+	h.logger.Info("DisconnectWARP called")
+
+	err := h.localServices.WARPManager.DisconnectWARP()
+	if err != nil {
+		h.logger.Errorf("Failed to disconnect from WARP: %v", err)
+		return nil, fmt.Errorf("failed to disconnect from WARP: %w", err)
+	}
+
+	return &pb.DisconnectWARPResponse{
+		Success: true,
+		Message: "Disconnected from WARP successfully",
+	}, nil
+}
+
+// GetWARPStatus returns WARP connection status
+func (h *NodeManagerHandler) GetWARPStatus(ctx context.Context, req *pb.GetWARPStatusRequest) (*pb.GetWARPStatusResponse, error) {
+	h.logger.Info("GetWARPStatus called")
+
+	status, err := h.localServices.WARPManager.GetWARPStatus()
+	if err != nil {
+		h.logger.Errorf("Failed to get WARP status: %v", err)
+		return nil, fmt.Errorf("failed to get WARP status: %w", err)
+	}
+
+	return &pb.GetWARPStatusResponse{
+		Status: warpStatusToProto(status),
+	}, nil
+}
+
+// warpStatusToProto converts a WARP status to its protobuf form
+func warpStatusToProto(status services.WARPStatus) *pb.WARPStatus {
+	return &pb.WARPStatus{
+		Installed:      status.Installed,
+		Connected:      status.Connected,
+		Mode:           status.Mode,
+		ProxyPort:      int32(status.ProxyPort),
+		AccountType:    status.AccountType,
+		Organization:   status.Organization,
+		IpAddress:      status.IPAddress,
+		Location:       status.Location,
+		ServerLocation: status.ServerLocation,
+		LastConnected:  status.LastConnected.Unix(),
+		Uptime:         int64(status.Uptime.Seconds()),
+		BytesSent:      status.BytesSent,
+		BytesReceived:  status.BytesReceived,
+		Health:         status.Health,
+		Error:          status.Error,
+		ClientType:     status.ClientType,
+		DeviceId:       status.DeviceID,
+		DevicePosture:  status.DevicePosture,
+	}
+}
+
+// EnableWARPProxy enables WARP proxy mode
+func (h *NodeManagerHandler) EnableWARPProxy(ctx context.Context, req *pb.EnableWARPProxyRequest) (*pb.EnableWARPProxyResponse, error) {
+	h.logger.Infof("EnableWARPProxy called on port: %d", req.Port)
+
+	err := h.localServices.WARPManager.EnableProxyMode(int(req.Port))
+	if err != nil {
+		h.logger.Errorf("Failed to enable WARP proxy: %v", err)
+		return nil, fmt.Errorf("failed to enable WARP proxy: %w", err)
+	}
+
+	return &pb.EnableWARPProxyResponse{
+		Success: true,
+		Message: "WARP proxy mode enabled successfully",
+	}, nil
+}
+
+// DisableWARPProxy disables WARP proxy mode
+func (h *NodeManagerHandler) DisableWARPProxy(ctx context.Context, req *pb.DisableWARPProxyRequest) (*pb.DisableWARPProxyResponse, error) {
+	h.logger.Info("DisableWARPProxy called")
+
+	err := h.localServices.WARPManager.DisableProxyMode()
+	if err != nil {
+		h.logger.Errorf("Failed to disable WARP proxy: %v", err)
+		return nil, fmt.Errorf("failed to disable WARP proxy: %w", err)
+	}
+
+	return &pb.DisableWARPProxyResponse{
+		Success: true,
+		Message: "WARP proxy mode disabled successfully",
+	}, nil
+}
+
+// EnableWARPTrafficRouting enables traffic routing through WARP
+func (h *NodeManagerHandler) EnableWARPTrafficRouting(ctx context.Context, req *pb.EnableWARPTrafficRoutingRequest) (*pb.EnableWARPTrafficRoutingResponse, error) {
+	h.logger.Infof("EnableWARPTrafficRouting called for interface: %s", req.InterfaceName)
+
+	err := h.localServices.WARPManager.EnableTrafficRouting(req.InterfaceName)
+	if err != nil {
+		h.logger.Errorf("Failed to enable WARP traffic routing: %v", err)
+		return nil, fmt.Errorf("failed to enable WARP traffic routing: %w", err)
+	}
+
+	return &pb.EnableWARPTrafficRoutingResponse{
+		Success: true,
+		Message: "WARP traffic routing enabled successfully",
+	}, nil
+}
+
+// DisableWARPTrafficRouting disables WARP traffic routing
+func (h *NodeManagerHandler) DisableWARPTrafficRouting(ctx context.Context, req *pb.DisableWARPTrafficRoutingRequest) (*pb.DisableWARPTrafficRoutingResponse, error) {
+	h.logger.Info("DisableWARPTrafficRouting called")
+
+	err := h.localServices.WARPManager.DisableTrafficRouting()
+	if err != nil {
+		h.logger.Errorf("Failed to disable WARP traffic routing: %v", err)
+		return nil, fmt.Errorf("failed to disable WARP traffic routing: %w", err)
+	}
+
+	return &pb.DisableWARPTrafficRoutingResponse{
+		Success: true,
+		Message: "WARP traffic routing disabled successfully",
+	}, nil
+}
+
+// EnrollWARPTeams enrolls the WARP client into a Cloudflare Zero Trust organization
+func (h *NodeManagerHandler) EnrollWARPTeams(ctx context.Context, req *pb.EnrollWARPTeamsRequest) (*pb.EnrollWARPTeamsResponse, error) {
+	h.logger.Infof("EnrollWARPTeams called for organization: %s", req.Organization)
+
+	err := h.localServices.WARPManager.EnrollTeams(services.WARPTeamsEnrollment{
+		Organization: req.Organization,
+		ClientID:     req.ClientId,
+		ClientSecret: req.ClientSecret,
+		MDMConfig:    req.MdmXml,
+	})
+	if err != nil {
+		h.logger.Errorf("Failed to enroll WARP into Zero Trust: %v", err)
+		return nil, fmt.Errorf("failed to enroll WARP into Zero Trust: %w", err)
+	}
+
+	resp := &pb.EnrollWARPTeamsResponse{
+		Success: true,
+		Message: "WARP enrolled into Zero Trust successfully",
+	}
+	if status, err := h.localServices.WARPManager.GetWARPStatus(); err == nil {
+		resp.Status = warpStatusToProto(status)
+	}
+	return resp, nil
+}
+
+// UnenrollWARPTeams removes the WARP client from its Zero Trust organization
+func (h *NodeManagerHandler) UnenrollWARPTeams(ctx context.Context, req *pb.UnenrollWARPTeamsRequest) (*pb.UnenrollWARPTeamsResponse, error) {
+	h.logger.Info("UnenrollWARPTeams called")
+
+	err := h.localServices.WARPManager.UnenrollTeams()
+	if err != nil {
+		h.logger.Errorf("Failed to unenroll WARP from Zero Trust: %v", err)
+		return nil, fmt.Errorf("failed to unenroll WARP from Zero Trust: %w", err)
+	}
+
+	return &pb.UnenrollWARPTeamsResponse{
+		Success: true,
+		Message: "WARP unenrolled from Zero Trust successfully",
+	}, nil
+}
+
+// GetWARPLogs returns the recent WARP service log, from the journal or the Docker container
+func (h *NodeManagerHandler) GetWARPLogs(ctx context.Context, req *pb.GetWARPLogsRequest) (*pb.GetWARPLogsResponse, error) {
+	h.logger.Infof("GetWARPLogs called for %d lines", req.Lines)
+
+	warpConfig, _ := h.localServices.WARPManager.GetWARPConfiguration()
+	logs, err := h.localServices.WARPManager.GetWARPLogs(int(req.Lines))
+	if err != nil {
+		h.logger.Errorf("Failed to get WARP logs: %v", err)
+		return &pb.GetWARPLogsResponse{
+			Success:    false,
+			Message:    fmt.Sprintf("Failed to get WARP logs: %v", err),
+			Logs:       logs,
+			ClientType: warpConfig.ClientType,
+		}, nil
+	}
+
+	return &pb.GetWARPLogsResponse{
+		Success:    true,
+		Message:    "WARP logs retrieved successfully",
+		Logs:       logs,
+		ClientType: warpConfig.ClientType,
 	}, nil
 }
@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"hysteria2_microservices/agent-service/internal/tunnel"
+	"hysteria2_microservices/pkg/tunnelconn"
+	pb "hysteria2_microservices/proto"
+)
+
+// tunnelTransport opens the streams of the reverse tunnel on the master connection
+type tunnelTransport struct {
+	client pb.TunnelServiceClient
+	nodeID string
+	token  string
+}
+
+// NewTunnelTransport returns the transport of the reverse tunnel to the master server,
+// authenticated with the node auth token
+func NewTunnelTransport(conn grpc.ClientConnInterface, nodeID, token string) tunnel.Transport {
+	return &tunnelTransport{
+		client: pb.NewTunnelServiceClient(conn),
+		nodeID: nodeID,
+		token:  token,
+	}
+}
+
+func (t *tunnelTransport) outgoing(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+t.token, "node-id", t.nodeID)
+}
+
+func (t *tunnelTransport) Control(ctx context.Context) (tunnel.ControlStream, error) {
+	stream, err := t.client.Control(t.outgoing(ctx), &pb.TunnelOpen{NodeId: t.nodeID})
+	if err != nil {
+		return nil, err
+	}
+	return controlStream{stream}, nil
+}
+
+func (t *tunnelTransport) Data(ctx context.Context, connID string) (tunnelconn.Stream, func() error, error) {
+	ctx, cancel := context.WithCancel(t.outgoing(ctx))
+	stream, err := t.client.Data(ctx)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	if err := stream.Send(&pb.TunnelFrame{ConnId: connID}); err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	closeFn := func() error {
+		err := stream.CloseSend()
+		cancel()
+		return err
+	}
+	return dataStream{stream}, closeFn, nil
+}
+
+type controlStream struct {
+	stream pb.TunnelService_ControlClient
+}
+
+func (s controlStream) Recv() (string, error) {
+	dial, err := s.stream.Recv()
+	if err != nil {
+		return "", err
+	}
+	return dial.ConnId, nil
+}
+
+type dataStream struct {
+	stream pb.TunnelService_DataClient
+}
+
+func (s dataStream) Send(data []byte) error {
+	return s.stream.Send(&pb.TunnelFrame{Data: data})
+}
+
+func (s dataStream) Recv() ([]byte, error) {
+	frame, err := s.stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	return frame.Data, nil
+}
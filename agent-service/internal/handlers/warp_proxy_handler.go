@@ -6,6 +6,7 @@ import (
 	"fmt"
 
 	"github.com/sirupsen/logrus"
+	"hysteria2_microservices/agent-service/internal/hysteriaconfig"
 	"hysteria2_microservices/agent-service/internal/services"
 	pb "hysteria2_microservices/proto"
 )
@@ -45,62 +46,60 @@ func (h *WARPProxyHandler) SetupWARPProxyEndpoint(ctx context.Context, req *pb.S
 
 		if err := h.localServices.WARPManager.ConfigureWARP(warpConfig); err != nil {
 			h.logger.Errorf("Failed to configure WARP: %v", err)
-			return &pb.SetupWARPProxyEndpointResponse{
-				Success: false,
-				Message: fmt.Sprintf("Failed to configure WARP: %v", err),
-			}, nil
+			return nil, fmt.Errorf("failed to configure WARP: %w", err)
 		}
 
 		// Connect to WARP if auto-connect is enabled
 		if req.AutoConnect {
 			if err := h.localServices.WARPManager.ConnectWARP(); err != nil {
 				h.logger.Errorf("Failed to connect to WARP: %v", err)
-				return &pb.SetupWARPProxyEndpointResponse{
-					Success: false,
-					Message: fmt.Sprintf("Failed to connect to WARP: %v", err),
-				}, nil
+				return nil, fmt.Errorf("failed to connect to WARP: %w", err)
 			}
 		}
 
 		// Enable proxy mode
 		if err := h.localServices.WARPManager.EnableProxyMode(int(req.WarpProxyPort)); err != nil {
 			h.logger.Errorf("Failed to enable WARP proxy mode: %v", err)
-			return &pb.SetupWARPProxyEndpointResponse{
-				Success: false,
-				Message: fmt.Sprintf("Failed to enable WARP proxy mode: %v", err),
-			}, nil
+			return nil, fmt.Errorf("failed to enable WARP proxy mode: %w", err)
 		}
 	}
 
 	// 2. Configure Hysteria2 for WARP outbound
 	if req.ConfigureHysteria {
-		hysteriaConfig := map[string]interface{}{
-			"warp_enabled":    req.WarpEnabled,
-			"warp_proxy_port": req.WarpProxyPort,
-			"listen_port":     req.VpnListenPort,
-			"auth_password":   req.VpnAuthPassword,
-			"bandwidth_up":    req.BandwidthUp,
-			"bandwidth_down":  req.BandwidthDown,
+		hysteriaConfig := &hysteriaconfig.ServerConfig{
+			Listen: fmt.Sprintf(":%d", req.VpnListenPort),
+			Auth: &hysteriaconfig.Auth{
+				Type:     hysteriaconfig.AuthPassword,
+				Password: req.VpnAuthPassword,
+			},
+			Bandwidth: &hysteriaconfig.Bandwidth{
+				Up:   fmt.Sprintf("%d mbps", req.BandwidthUp),
+				Down: fmt.Sprintf("%d mbps", req.BandwidthDown),
+			},
+		}
+		if req.WarpEnabled {
+			hysteriaConfig.Outbounds = []hysteriaconfig.Outbound{
+				{
+					Name:   "warp",
+					Type:   hysteriaconfig.OutboundSOCKS5,
+					SOCKS5: &hysteriaconfig.SOCKS5Outbound{Addr: fmt.Sprintf("127.0.0.1:%d", req.WarpProxyPort)},
+				},
+				{Name: "direct", Type: hysteriaconfig.OutboundDirect},
+			}
 		}
 
 		// Convert to JSON
 		configJSON, err := json.Marshal(hysteriaConfig)
 		if err != nil {
 			h.logger.Errorf("Failed to marshal Hysteria2 config: %v", err)
-			return &pb.SetupWARPProxyEndpointResponse{
-				Success: false,
-				Message: fmt.Sprintf("Failed to create Hysteria2 config: %v", err),
-			}, nil
+			return nil, fmt.Errorf("failed to create Hysteria2 config: %w", err)
 		}
 
 		// Generate Hysteria2 configuration
 		hysteriaConfigStr, err := h.localServices.HysteriaManager.GenerateConfig(string(configJSON))
 		if err != nil {
 			h.logger.Errorf("Failed to generate Hysteria2 config: %v", err)
-			return &pb.SetupWARPProxyEndpointResponse{
-				Success: false,
-				Message: fmt.Sprintf("Failed to generate Hysteria2 config: %v", err),
-			}, nil
+			return nil, fmt.Errorf("failed to generate Hysteria2 config: %w", err)
 		}
 
 		h.logger.Infof("Hysteria2 configuration generated: %s", hysteriaConfigStr)
@@ -109,19 +108,13 @@ func (h *WARPProxyHandler) SetupWARPProxyEndpoint(ctx context.Context, req *pb.S
 	// 3. Setup traffic routing (if requested)
 	if req.SetupTrafficRouting {
 		if !req.WarpEnabled {
-			return &pb.SetupWARPProxyEndpointResponse{
-				Success: false,
-				Message: "Traffic routing requires WARP to be enabled",
-			}, nil
+			return nil, invalidArgument("traffic routing requires WARP to be enabled")
 		}
 
 		// Use NetworkManager for basic routing
 		if err := h.localServices.NetworkManager.RouteTrafficThroughWARP(req.VpnInterface); err != nil {
 			h.logger.Errorf("Failed to setup traffic routing: %v", err)
-			return &pb.SetupWARPProxyEndpointResponse{
-				Success: false,
-				Message: fmt.Sprintf("Failed to setup traffic routing: %v", err),
-			}, nil
+			return nil, fmt.Errorf("failed to setup traffic routing: %w", err)
 		}
 	}
 
@@ -129,10 +122,7 @@ func (h *WARPProxyHandler) SetupWARPProxyEndpoint(ctx context.Context, req *pb.S
 	if req.EnableMasquerading {
 		if err := h.localServices.NetworkManager.EnableMasquerading(req.VpnInterface); err != nil {
 			h.logger.Errorf("Failed to enable masquerading: %v", err)
-			return &pb.SetupWARPProxyEndpointResponse{
-				Success: false,
-				Message: fmt.Sprintf("Failed to enable masquerading: %v", err),
-			}, nil
+			return nil, fmt.Errorf("failed to enable masquerading: %w", err)
 		}
 	}
 
@@ -246,10 +236,7 @@ func (h *WARPProxyHandler) RestartWARPProxyService(ctx context.Context, req *pb.
 	// 5. Restart WARP
 	if err := h.localServices.WARPManager.ConnectWARP(); err != nil {
 		h.logger.Errorf("Failed to restart WARP: %v", err)
-		return &pb.RestartWARPProxyServiceResponse{
-			Success: false,
-			Message: fmt.Sprintf("Failed to restart WARP: %v", err),
-		}, nil
+		return nil, fmt.Errorf("failed to restart WARP: %w", err)
 	}
 
 	// 6. Restart Hysteria2 (if it was configured to start)
@@ -285,9 +272,14 @@ func (h *WARPProxyHandler) TestWARPProxyConnectivity(ctx context.Context, req *p
 	// This would require actual network tests - for now assume true if WARP is connected
 	results["internet_through_warp"] = results["warp_connection"]
 
-	// 4. Test DNS resolution
-	// For now assume true
-	results["dns_resolution"] = true
+	// 4. Test DNS resolution and that plaintext DNS cannot bypass the resolver
+	if h.localServices.DNSResolver != nil && h.localServices.DNSResolver.IsRunning() {
+		check := h.localServices.DNSResolver.CheckLeaks()
+		results["dns_resolution"] = check.Resolving
+		results["dns_leak_free"] = !check.Leaking
+	} else {
+		results["dns_resolution"] = false
+	}
 
 	// 5. Test Hysteria2 service
 	if hysteriaStatus, err := h.localServices.HysteriaManager.GetHysteria2Status(); err == nil {
@@ -0,0 +1,237 @@
+package hysteriaconfig
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ACL rule matches, the destination forms of the server's text ACL (extras/outbounds/acl)
+const (
+	ACLMatchAll     = "all"     // every destination
+	ACLMatchIP      = "ip"      // one address
+	ACLMatchCIDR    = "cidr"    // a network
+	ACLMatchDomain  = "domain"  // one domain, or *.example.com for its subdomains only
+	ACLMatchSuffix  = "suffix"  // a domain and its subdomains
+	ACLMatchGeoIP   = "geoip"   // a country, or "private", of the GeoIP database
+	ACLMatchGeoSite = "geosite" // a list of the GeoSite database, with an optional @attribute
+)
+
+// Outbounds an ACL may name without configuring them. A configured outbound of the same
+// name takes their place.
+const (
+	ACLDirect  = "direct"
+	ACLReject  = "reject"
+	ACLDefault = "default" // the first outbound, direct when there is none
+)
+
+var (
+	// The server only accepts word characters in the outbound of a rule
+	aclLinePattern     = regexp.MustCompile(`^(\w+)\s*\(([^,]+)(?:,([^,]+))?(?:,([^,]+))?\)$`)
+	aclOutboundPattern = regexp.MustCompile(`^\w+$`)
+	aclDomainPattern   = regexp.MustCompile(`^[a-z0-9_]([a-z0-9_-]*[a-z0-9_])?(\.[a-z0-9_]([a-z0-9_-]*[a-z0-9_])?)*$`)
+	aclGeoIPPattern    = regexp.MustCompile(`^[a-z]{2}$|^private$`)
+	aclGeoSitePattern  = regexp.MustCompile(`^[a-z0-9_.!-]+(@[a-z0-9_!-]+)?$`)
+)
+
+// ACLRule sends the destinations it matches to Outbound. Rules are matched in order and the
+// first match wins; destinations no rule matches go to the default outbound.
+type ACLRule struct {
+	Outbound string `json:"outbound"`
+	Match    string `json:"match"`
+	Value    string `json:"value,omitempty"`    // empty for ACLMatchAll
+	Protocol string `json:"protocol,omitempty"` // tcp or udp, empty for both
+	Port     string `json:"port,omitempty"`     // a port or a range such as 1000-2000, empty for all
+	Hijack   string `json:"hijack,omitempty"`   // address the connection goes to instead of the destination
+}
+
+// String formats the rule as a line of the text ACL, "outbound(address[, proto/port[, hijack]])".
+// It does not validate the rule.
+func (r ACLRule) String() string {
+	var address string
+	switch r.Match {
+	case ACLMatchAll:
+		address = "all"
+	case ACLMatchSuffix, ACLMatchGeoIP, ACLMatchGeoSite:
+		address = r.Match + ":" + r.Value
+	default:
+		address = r.Value
+	}
+
+	args := []string{address}
+	if r.Protocol != "" || r.Port != "" || r.Hijack != "" {
+		protocol, port := r.Protocol, r.Port
+		if protocol == "" {
+			protocol = "*"
+		}
+		if port == "" {
+			port = "*"
+		}
+		args = append(args, protocol+"/"+port)
+	}
+	if r.Hijack != "" {
+		args = append(args, r.Hijack)
+	}
+	return r.Outbound + "(" + strings.Join(args, ", ") + ")"
+}
+
+// Validate checks the rule against the syntax the server accepts
+func (r ACLRule) Validate() error {
+	if !aclOutboundPattern.MatchString(r.Outbound) {
+		return fmt.Errorf("outbound %q must be letters, digits or '_'", r.Outbound)
+	}
+
+	switch r.Match {
+	case ACLMatchAll:
+		if r.Value != "" {
+			return errors.New("all takes no value")
+		}
+	case ACLMatchIP:
+		if _, err := netip.ParseAddr(r.Value); err != nil {
+			return fmt.Errorf("invalid address %q", r.Value)
+		}
+	case ACLMatchCIDR:
+		if _, err := netip.ParsePrefix(r.Value); err != nil {
+			return fmt.Errorf("invalid network %q", r.Value)
+		}
+	case ACLMatchDomain:
+		if !aclDomainPattern.MatchString(strings.TrimPrefix(r.Value, "*.")) {
+			return fmt.Errorf("invalid domain %q", r.Value)
+		}
+	case ACLMatchSuffix:
+		if !aclDomainPattern.MatchString(r.Value) {
+			return fmt.Errorf("invalid domain %q", r.Value)
+		}
+	case ACLMatchGeoIP:
+		if !aclGeoIPPattern.MatchString(r.Value) {
+			return fmt.Errorf("invalid geoip country %q", r.Value)
+		}
+	case ACLMatchGeoSite:
+		if !aclGeoSitePattern.MatchString(r.Value) {
+			return fmt.Errorf("invalid geosite list %q", r.Value)
+		}
+	default:
+		return fmt.Errorf("unsupported match %q", r.Match)
+	}
+
+	switch r.Protocol {
+	case "", "tcp", "udp":
+	default:
+		return fmt.Errorf("unsupported protocol %q", r.Protocol)
+	}
+	if r.Port != "" {
+		if _, _, err := parseACLPortRange(r.Port); err != nil {
+			return err
+		}
+	}
+	if r.Hijack != "" {
+		if _, err := netip.ParseAddr(r.Hijack); err != nil && !aclDomainPattern.MatchString(r.Hijack) {
+			return fmt.Errorf("invalid hijack address %q", r.Hijack)
+		}
+	}
+	return nil
+}
+
+// FormatACL validates rules and formats them as the lines of an inline ACL or ACL file
+func FormatACL(rules []ACLRule) ([]string, error) {
+	lines := make([]string, len(rules))
+	for i, rule := range rules {
+		if err := rule.Validate(); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+		lines[i] = rule.String()
+	}
+	return lines, nil
+}
+
+// ParseACLRule reads a line of the text ACL. Domains and outbound names are lowercased, as
+// the server matches them without regard to case.
+func ParseACLRule(line string) (ACLRule, error) {
+	m := aclLinePattern.FindStringSubmatch(strings.TrimSpace(line))
+	if m == nil {
+		return ACLRule{}, fmt.Errorf("invalid rule %q", line)
+	}
+
+	rule := ACLRule{Outbound: strings.ToLower(m[1])}
+	address := strings.ToLower(strings.TrimSpace(m[2]))
+	switch {
+	case address == "all" || address == "*":
+		rule.Match = ACLMatchAll
+	case strings.HasPrefix(address, "suffix:"):
+		rule.Match, rule.Value = ACLMatchSuffix, strings.TrimPrefix(address, "suffix:")
+	case strings.HasPrefix(address, "geoip:"):
+		rule.Match, rule.Value = ACLMatchGeoIP, strings.TrimPrefix(address, "geoip:")
+	case strings.HasPrefix(address, "geosite:"):
+		rule.Match, rule.Value = ACLMatchGeoSite, strings.TrimPrefix(address, "geosite:")
+	case strings.Contains(address, "/"):
+		rule.Match, rule.Value = ACLMatchCIDR, address
+	default:
+		if _, err := netip.ParseAddr(address); err == nil {
+			rule.Match = ACLMatchIP
+		} else {
+			rule.Match = ACLMatchDomain
+		}
+		rule.Value = address
+	}
+
+	if protoPort := strings.ToLower(strings.TrimSpace(m[3])); protoPort != "" && protoPort != "*" {
+		protocol, port, _ := strings.Cut(protoPort, "/")
+		if protocol != "*" {
+			rule.Protocol = protocol
+		}
+		if port != "*" {
+			rule.Port = port
+		}
+	}
+	rule.Hijack = strings.TrimSpace(m[4])
+
+	if err := rule.Validate(); err != nil {
+		return ACLRule{}, fmt.Errorf("invalid rule %q: %w", line, err)
+	}
+	return rule, nil
+}
+
+// ValidateACL checks the lines of a text ACL and that every outbound they name is one of
+// outbounds or built into the server. Blank lines and comments are skipped.
+func ValidateACL(lines []string, outbounds []Outbound) error {
+	names := map[string]bool{ACLDirect: true, ACLReject: true, ACLDefault: true}
+	for _, outbound := range outbounds {
+		names[strings.ToLower(outbound.Name)] = true
+	}
+
+	for i, line := range lines {
+		if comment := strings.Index(line, "#"); comment >= 0 {
+			line = line[:comment]
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		rule, err := ParseACLRule(line)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", i+1, err)
+		}
+		if !names[rule.Outbound] {
+			return fmt.Errorf("line %d: unknown outbound %q", i+1, rule.Outbound)
+		}
+	}
+	return nil
+}
+
+func parseACLPortRange(port string) (int, int, error) {
+	first, last, isRange := strings.Cut(port, "-")
+	if !isRange {
+		last = first
+	}
+	start, err := strconv.Atoi(first)
+	if err != nil || start < 1 || start > 65535 {
+		return 0, 0, fmt.Errorf("invalid port %q", port)
+	}
+	end, err := strconv.Atoi(last)
+	if err != nil || end < start || end > 65535 {
+		return 0, 0, fmt.Errorf("invalid port %q", port)
+	}
+	return start, end, nil
+}
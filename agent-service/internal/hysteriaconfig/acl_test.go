@@ -0,0 +1,183 @@
+package hysteriaconfig
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// warpRules are the rules the agent writes when WARP carries the node's traffic
+var warpRules = []ACLRule{
+	{Outbound: "direct", Match: ACLMatchCIDR, Value: "10.0.0.0/8"},
+	{Outbound: "direct", Match: ACLMatchCIDR, Value: "fc00::/7"},
+	{Outbound: "direct", Match: ACLMatchIP, Value: "192.0.2.1"},
+	{Outbound: "direct", Match: ACLMatchSuffix, Value: "bank.example"},
+	{Outbound: "direct", Match: ACLMatchGeoIP, Value: "ru"},
+	{Outbound: "reject", Match: ACLMatchGeoSite, Value: "category-ads-all"},
+	{Outbound: "reject", Match: ACLMatchAll, Protocol: "udp", Port: "443"},
+	{Outbound: "warp", Match: ACLMatchDomain, Value: "*.streaming.example"},
+	{Outbound: "warp", Match: ACLMatchAll},
+}
+
+func TestFormatACL(t *testing.T) {
+	lines, err := FormatACL(warpRules)
+	if err != nil {
+		t.Fatalf("FormatACL: %v", err)
+	}
+	want := []string{
+		"direct(10.0.0.0/8)",
+		"direct(fc00::/7)",
+		"direct(192.0.2.1)",
+		"direct(suffix:bank.example)",
+		"direct(geoip:ru)",
+		"reject(geosite:category-ads-all)",
+		"reject(all, udp/443)",
+		"warp(*.streaming.example)",
+		"warp(all)",
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("FormatACL() =\n%s\nwant\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+
+	for i, line := range lines {
+		rule, err := ParseACLRule(line)
+		if err != nil {
+			t.Errorf("ParseACLRule(%q): %v", line, err)
+			continue
+		}
+		if rule != warpRules[i] {
+			t.Errorf("ParseACLRule(%q) = %+v, want %+v", line, rule, warpRules[i])
+		}
+	}
+}
+
+func TestFormatACLRejectsInvalidRules(t *testing.T) {
+	tests := []struct {
+		name string
+		rule ACLRule
+		want string
+	}{
+		{"dash in outbound", ACLRule{Outbound: "warp-proxy", Match: ACLMatchAll}, "must be letters"},
+		{"no outbound", ACLRule{Match: ACLMatchAll}, "must be letters"},
+		{"unknown match", ACLRule{Outbound: "direct", Match: "regex", Value: ".*"}, "unsupported match"},
+		{"all with value", ACLRule{Outbound: "direct", Match: ACLMatchAll, Value: "x"}, "no value"},
+		{"bad cidr", ACLRule{Outbound: "direct", Match: ACLMatchCIDR, Value: "10.0.0.0/33"}, "invalid network"},
+		{"bad ip", ACLRule{Outbound: "direct", Match: ACLMatchIP, Value: "10.0.0"}, "invalid address"},
+		{"comma in domain", ACLRule{Outbound: "direct", Match: ACLMatchSuffix, Value: "a.example,b.example"}, "invalid domain"},
+		{"bad country", ACLRule{Outbound: "direct", Match: ACLMatchGeoIP, Value: "russia"}, "invalid geoip"},
+		{"bad protocol", ACLRule{Outbound: "direct", Match: ACLMatchAll, Protocol: "icmp"}, "unsupported protocol"},
+		{"bad port range", ACLRule{Outbound: "direct", Match: ACLMatchAll, Port: "2000-1000"}, "invalid port"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := FormatACL([]ACLRule{tt.rule})
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("FormatACL() = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseACLRule(t *testing.T) {
+	tests := []struct {
+		line string
+		want ACLRule
+	}{
+		{"Direct( Suffix:Example.COM )", ACLRule{Outbound: "direct", Match: ACLMatchSuffix, Value: "example.com"}},
+		{"reject(*)", ACLRule{Outbound: "reject", Match: ACLMatchAll}},
+		{"warp(geosite:netflix@ads, tcp/*)", ACLRule{Outbound: "warp", Match: ACLMatchGeoSite, Value: "netflix@ads", Protocol: "tcp"}},
+		{"direct(all, */53, 127.0.0.1)", ACLRule{Outbound: "direct", Match: ACLMatchAll, Port: "53", Hijack: "127.0.0.1"}},
+		{"direct(::1)", ACLRule{Outbound: "direct", Match: ACLMatchIP, Value: "::1"}},
+	}
+	for _, tt := range tests {
+		rule, err := ParseACLRule(tt.line)
+		if err != nil {
+			t.Errorf("ParseACLRule(%q): %v", tt.line, err)
+			continue
+		}
+		if rule != tt.want {
+			t.Errorf("ParseACLRule(%q) = %+v, want %+v", tt.line, rule, tt.want)
+		}
+	}
+
+	for _, line := range []string{
+		"warp-proxy(all)",
+		"direct all",
+		"direct()",
+		"direct(all, tcp/80, 1.1.1.1, extra)",
+		"direct(all, tcp/0)",
+	} {
+		if _, err := ParseACLRule(line); err == nil {
+			t.Errorf("ParseACLRule(%q) succeeded, want an error", line)
+		}
+	}
+}
+
+func TestValidateACL(t *testing.T) {
+	outbounds := []Outbound{{Name: "warp", Type: OutboundSOCKS5, SOCKS5: &SOCKS5Outbound{Addr: "127.0.0.1:1080"}}}
+	lines := []string{
+		"# Local ranges stay on the node",
+		"direct(10.0.0.0/8) # private",
+		"",
+		"reject(suffix:ads.example)",
+		"default(geoip:cn)",
+		"WARP(all)",
+	}
+	if err := ValidateACL(lines, outbounds); err != nil {
+		t.Errorf("ValidateACL() = %v", err)
+	}
+
+	err := ValidateACL([]string{"direct(10.0.0.0/8)", "office(all)"}, outbounds)
+	if err == nil || !strings.Contains(err.Error(), `line 2: unknown outbound "office"`) {
+		t.Errorf("ValidateACL() = %v, want an unknown outbound error on line 2", err)
+	}
+}
+
+// TestACLYAML checks the acl and outbounds sections of a config built from rules
+func TestACLYAML(t *testing.T) {
+	lines, err := FormatACL(warpRules)
+	if err != nil {
+		t.Fatalf("FormatACL: %v", err)
+	}
+	cfg := baseConfig()
+	cfg.Outbounds = []Outbound{
+		{Name: "warp", Type: OutboundSOCKS5, SOCKS5: &SOCKS5Outbound{Addr: "127.0.0.1:1080"}},
+		{Name: "direct", Type: OutboundDirect},
+	}
+	cfg.ACL = &ACL{Inline: lines}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	got, err := cfg.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	path := filepath.Join("testdata", "acl.yaml")
+	if *update {
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run with -update to create it)", err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("config differs from %s:\n--- got\n%s\n--- want\n%s", path, got, want)
+	}
+
+	parsed, err := Parse(want)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	for i, line := range parsed.ACL.Inline {
+		rule, err := ParseACLRule(line)
+		if err != nil || rule != warpRules[i] {
+			t.Errorf("acl line %d %q parses as %+v, %v; want %+v", i+1, line, rule, err, warpRules[i])
+		}
+	}
+}
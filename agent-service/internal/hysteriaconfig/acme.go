@@ -0,0 +1,81 @@
+package hysteriaconfig
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ACME CAs the server can obtain certificates from
+const (
+	ACMECALetsEncrypt = "letsencrypt"
+	ACMECAZeroSSL     = "zerossl"
+)
+
+// ACME challenge types
+const (
+	ACMEChallengeHTTP = "http"
+	ACMEChallengeTLS  = "tls"
+	ACMEChallengeDNS  = "dns"
+)
+
+// ACMEDNSProviders are the DNS providers the server can solve DNS-01 challenges with
+var ACMEDNSProviders = []string{"cloudflare", "duckdns", "gandi", "godaddy", "namedotcom", "vultr"}
+
+// ACMECertificate is a certificate the server obtained itself
+type ACMECertificate struct {
+	Domain    string    `json:"domain"`
+	Issuer    string    `json:"issuer"`
+	CA        string    `json:"ca"` // storage key of the issuing CA's directory, e.g. acme-v02.api.letsencrypt.org-directory
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	Path      string    `json:"path"`
+}
+
+// ACMECertificates lists the certificates in dir, the acme.dir of a server config. The
+// server stores them in certmagic's layout, certificates/<ca>/<domain>/<domain>.crt, with
+// wildcards as "wildcard_"; a dir that does not exist yet holds none.
+func ACMECertificates(dir string) ([]ACMECertificate, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "certificates", "*", "*", "*.crt"))
+	if err != nil {
+		return nil, err
+	}
+
+	var certificates []ACMECertificate
+	for _, path := range paths {
+		domainDir := filepath.Dir(path)
+		name := filepath.Base(domainDir)
+		if filepath.Base(path) != name+".crt" {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s: no PEM certificate", path)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		certificates = append(certificates, ACMECertificate{
+			Domain:    strings.Replace(name, "wildcard_", "*", 1),
+			Issuer:    cert.Issuer.CommonName,
+			CA:        filepath.Base(filepath.Dir(domainDir)),
+			NotBefore: cert.NotBefore,
+			NotAfter:  cert.NotAfter,
+			Path:      path,
+		})
+	}
+	sort.Slice(certificates, func(i, j int) bool {
+		return certificates[i].Domain < certificates[j].Domain
+	})
+	return certificates, nil
+}
@@ -0,0 +1,121 @@
+package hysteriaconfig
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Check starts binary on a copy of cfg moved to a free loopback port and fails if the
+// server exits before duration passes. Hysteria2 parses and validates its config at
+// startup, so anything the binary cannot load is caught here. An acme block is swapped for
+// a throwaway self-signed certificate: the dry run must not request certificates or bind
+// the challenge ports.
+func Check(ctx context.Context, binary string, cfg *ServerConfig, duration time.Duration) error {
+	port, err := freeUDPPort()
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "hysteria-dryrun-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	dryRun := *cfg
+	dryRun.Listen = net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	// Drop the other listeners so the dry run does not collide with the live server
+	dryRun.TrafficStats = nil
+	if cfg.Masquerade != nil {
+		masquerade := *cfg.Masquerade
+		masquerade.ListenHTTP, masquerade.ListenHTTPS = "", ""
+		dryRun.Masquerade = &masquerade
+	}
+	if cfg.ACME != nil {
+		certPath, keyPath, err := writeSelfSignedPair(dir, cfg.ACME.Domains)
+		if err != nil {
+			return fmt.Errorf("failed to create dry run certificate: %w", err)
+		}
+		dryRun.ACME = nil
+		dryRun.TLS = &TLS{Cert: certPath, Key: keyPath}
+	}
+
+	data, err := dryRun.Marshal()
+	if err != nil {
+		return err
+	}
+	configPath := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(configPath, data, 0600); err != nil {
+		return err
+	}
+
+	runCtx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+	cmd := exec.CommandContext(runCtx, binary, "server", "-c", configPath)
+	cmd.WaitDelay = time.Second
+	output, err := cmd.CombinedOutput()
+	if errors.Is(runCtx.Err(), context.DeadlineExceeded) {
+		// Still serving when the dry run ended: the config loaded
+		return nil
+	}
+	if err == nil {
+		err = errors.New("server exited")
+	}
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	return fmt.Errorf("%v: %s", err, lines[len(lines)-1])
+}
+
+func freeUDPPort() (int, error) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return 0, fmt.Errorf("failed to find a free port: %w", err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port, nil
+}
+
+// writeSelfSignedPair writes a short-lived certificate for hosts and its key into dir
+func writeSelfSignedPair(dir string, hosts []string) (string, string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "hysteria-dryrun"},
+		DNSNames:     hosts,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		return "", "", err
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return "", "", err
+	}
+	return certPath, keyPath, nil
+}
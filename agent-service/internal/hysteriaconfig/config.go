@@ -0,0 +1,478 @@
+// Package hysteriaconfig models the Hysteria2 server config in the schema the upstream
+// server loads (apernet/hysteria, app/cmd/server.go) and writes it as YAML. Parsing is
+// strict, so a key the server would silently ignore is reported instead.
+package hysteriaconfig
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Auth types
+const (
+	AuthPassword = "password"
+	AuthUserpass = "userpass"
+	AuthHTTP     = "http"
+	AuthCommand  = "command"
+)
+
+// Outbound types
+const (
+	OutboundDirect = "direct"
+	OutboundSOCKS5 = "socks5"
+	OutboundHTTP   = "http"
+)
+
+// Masquerade types
+const (
+	MasqueradeFile   = "file"
+	MasqueradeProxy  = "proxy"
+	MasqueradeString = "string"
+)
+
+// ObfsSalamander is the only obfuscation the server supports
+const ObfsSalamander = "salamander"
+
+// ServerConfig is a Hysteria2 server config. Sections left nil are omitted and take the
+// server's defaults.
+type ServerConfig struct {
+	Listen                string        `yaml:"listen,omitempty" json:"listen,omitempty"`
+	Obfs                  *Obfs         `yaml:"obfs,omitempty" json:"obfs,omitempty"`
+	TLS                   *TLS          `yaml:"tls,omitempty" json:"tls,omitempty"`
+	ACME                  *ACME         `yaml:"acme,omitempty" json:"acme,omitempty"`
+	QUIC                  *QUIC         `yaml:"quic,omitempty" json:"quic,omitempty"`
+	Congestion            *Congestion   `yaml:"congestion,omitempty" json:"congestion,omitempty"`
+	Bandwidth             *Bandwidth    `yaml:"bandwidth,omitempty" json:"bandwidth,omitempty"`
+	IgnoreClientBandwidth bool          `yaml:"ignoreClientBandwidth,omitempty" json:"ignoreClientBandwidth,omitempty"`
+	SpeedTest             bool          `yaml:"speedTest,omitempty" json:"speedTest,omitempty"`
+	DisableUDP            bool          `yaml:"disableUDP,omitempty" json:"disableUDP,omitempty"`
+	UDPIdleTimeout        string        `yaml:"udpIdleTimeout,omitempty" json:"udpIdleTimeout,omitempty"`
+	Auth                  *Auth         `yaml:"auth,omitempty" json:"auth,omitempty"`
+	Resolver              *Resolver     `yaml:"resolver,omitempty" json:"resolver,omitempty"`
+	Sniff                 *Sniff        `yaml:"sniff,omitempty" json:"sniff,omitempty"`
+	ACL                   *ACL          `yaml:"acl,omitempty" json:"acl,omitempty"`
+	Outbounds             []Outbound    `yaml:"outbounds,omitempty" json:"outbounds,omitempty"`
+	TrafficStats          *TrafficStats `yaml:"trafficStats,omitempty" json:"trafficStats,omitempty"`
+	Masquerade            *Masquerade   `yaml:"masquerade,omitempty" json:"masquerade,omitempty"`
+}
+
+// Obfs is the obfuscation section
+type Obfs struct {
+	Type       string      `yaml:"type" json:"type"`
+	Salamander *Salamander `yaml:"salamander,omitempty" json:"salamander,omitempty"`
+}
+
+// Salamander holds the obfuscation password shared with clients
+type Salamander struct {
+	Password string `yaml:"password" json:"password"`
+}
+
+// TLS points the server at a certificate and key on disk
+type TLS struct {
+	Cert     string `yaml:"cert" json:"cert"`
+	Key      string `yaml:"key" json:"key"`
+	SNIGuard string `yaml:"sniGuard,omitempty" json:"sniGuard,omitempty"` // strict, dns-san or disable
+	ClientCA string `yaml:"clientCA,omitempty" json:"clientCA,omitempty"`
+}
+
+// ACME has the server obtain its certificate itself
+type ACME struct {
+	Domains    []string `yaml:"domains" json:"domains"`
+	Email      string   `yaml:"email,omitempty" json:"email,omitempty"`
+	CA         string   `yaml:"ca,omitempty" json:"ca,omitempty"` // letsencrypt (default) or zerossl
+	ListenHost string   `yaml:"listenHost,omitempty" json:"listenHost,omitempty"`
+	Dir        string   `yaml:"dir,omitempty" json:"dir,omitempty"`
+	Type       string   `yaml:"type,omitempty" json:"type,omitempty"` // http, tls or dns
+	HTTP       *ACMEAlt `yaml:"http,omitempty" json:"http,omitempty"`
+	TLS        *ACMEAlt `yaml:"tls,omitempty" json:"tls,omitempty"`
+	DNS        *ACMEDNS `yaml:"dns,omitempty" json:"dns,omitempty"`
+}
+
+// ACMEAlt moves an ACME challenge listener off its standard port
+type ACMEAlt struct {
+	AltPort int `yaml:"altPort,omitempty" json:"altPort,omitempty"`
+}
+
+// ACMEDNS selects the DNS provider for DNS-01 challenges
+type ACMEDNS struct {
+	Name   string            `yaml:"name" json:"name"`
+	Config map[string]string `yaml:"config,omitempty" json:"config,omitempty"`
+}
+
+// QUIC tunes the QUIC transport
+type QUIC struct {
+	InitStreamReceiveWindow uint64 `yaml:"initStreamReceiveWindow,omitempty" json:"initStreamReceiveWindow,omitempty"`
+	MaxStreamReceiveWindow  uint64 `yaml:"maxStreamReceiveWindow,omitempty" json:"maxStreamReceiveWindow,omitempty"`
+	InitConnReceiveWindow   uint64 `yaml:"initConnReceiveWindow,omitempty" json:"initConnReceiveWindow,omitempty"`
+	MaxConnReceiveWindow    uint64 `yaml:"maxConnReceiveWindow,omitempty" json:"maxConnReceiveWindow,omitempty"`
+	MaxIdleTimeout          string `yaml:"maxIdleTimeout,omitempty" json:"maxIdleTimeout,omitempty"`
+	MaxIncomingStreams      int64  `yaml:"maxIncomingStreams,omitempty" json:"maxIncomingStreams,omitempty"`
+	DisablePathMTUDiscovery bool   `yaml:"disablePathMTUDiscovery,omitempty" json:"disablePathMTUDiscovery,omitempty"`
+}
+
+// Congestion selects the congestion control used when clients send no bandwidth
+type Congestion struct {
+	Type       string `yaml:"type,omitempty" json:"type,omitempty"` // bbr or reno
+	BBRProfile string `yaml:"bbrProfile,omitempty" json:"bbrProfile,omitempty"`
+}
+
+// Bandwidth caps the server's speed per client, e.g. "100 mbps"
+type Bandwidth struct {
+	Up   string `yaml:"up,omitempty" json:"up,omitempty"`
+	Down string `yaml:"down,omitempty" json:"down,omitempty"`
+}
+
+// Auth is the client authentication section
+type Auth struct {
+	Type     string            `yaml:"type" json:"type"`
+	Password string            `yaml:"password,omitempty" json:"password,omitempty"`
+	Userpass map[string]string `yaml:"userpass,omitempty" json:"userpass,omitempty"`
+	HTTP     *AuthHTTPConfig   `yaml:"http,omitempty" json:"http,omitempty"`
+	Command  string            `yaml:"command,omitempty" json:"command,omitempty"`
+}
+
+// AuthHTTPConfig delegates authentication to an HTTP endpoint
+type AuthHTTPConfig struct {
+	URL      string `yaml:"url" json:"url"`
+	Insecure bool   `yaml:"insecure,omitempty" json:"insecure,omitempty"`
+}
+
+// Resolver is the DNS resolver the server uses for client destinations
+type Resolver struct {
+	Type  string            `yaml:"type" json:"type"` // tcp, udp, tls or https
+	TCP   *ResolverServer   `yaml:"tcp,omitempty" json:"tcp,omitempty"`
+	UDP   *ResolverServer   `yaml:"udp,omitempty" json:"udp,omitempty"`
+	TLS   *ResolverTLSLayer `yaml:"tls,omitempty" json:"tls,omitempty"`
+	HTTPS *ResolverTLSLayer `yaml:"https,omitempty" json:"https,omitempty"`
+}
+
+// ResolverServer is a plain DNS server
+type ResolverServer struct {
+	Addr    string `yaml:"addr" json:"addr"`
+	Timeout string `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+}
+
+// ResolverTLSLayer is a DNS over TLS or HTTPS server
+type ResolverTLSLayer struct {
+	Addr     string `yaml:"addr" json:"addr"`
+	Timeout  string `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	SNI      string `yaml:"sni,omitempty" json:"sni,omitempty"`
+	Insecure bool   `yaml:"insecure,omitempty" json:"insecure,omitempty"`
+}
+
+// Sniff has the server read domains from TLS and HTTP requests
+type Sniff struct {
+	Enable        bool   `yaml:"enable" json:"enable"`
+	Timeout       string `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	RewriteDomain bool   `yaml:"rewriteDomain,omitempty" json:"rewriteDomain,omitempty"`
+	TCPPorts      string `yaml:"tcpPorts,omitempty" json:"tcpPorts,omitempty"`
+	UDPPorts      string `yaml:"udpPorts,omitempty" json:"udpPorts,omitempty"`
+}
+
+// ACL routes client destinations to outbounds, from a file or inline rules
+type ACL struct {
+	File              string   `yaml:"file,omitempty" json:"file,omitempty"`
+	Inline            []string `yaml:"inline,omitempty" json:"inline,omitempty"`
+	GeoIP             string   `yaml:"geoip,omitempty" json:"geoip,omitempty"`
+	GeoSite           string   `yaml:"geosite,omitempty" json:"geosite,omitempty"`
+	GeoUpdateInterval string   `yaml:"geoUpdateInterval,omitempty" json:"geoUpdateInterval,omitempty"`
+}
+
+// Outbound is where the server sends client traffic; the first one is the default
+type Outbound struct {
+	Name   string          `yaml:"name" json:"name"`
+	Type   string          `yaml:"type" json:"type"`
+	Direct *DirectOutbound `yaml:"direct,omitempty" json:"direct,omitempty"`
+	SOCKS5 *SOCKS5Outbound `yaml:"socks5,omitempty" json:"socks5,omitempty"`
+	HTTP   *HTTPOutbound   `yaml:"http,omitempty" json:"http,omitempty"`
+}
+
+// DirectOutbound connects to destinations from the server itself
+type DirectOutbound struct {
+	Mode       string `yaml:"mode,omitempty" json:"mode,omitempty"` // auto, 64, 46, 6 or 4
+	BindIPv4   string `yaml:"bindIPv4,omitempty" json:"bindIPv4,omitempty"`
+	BindIPv6   string `yaml:"bindIPv6,omitempty" json:"bindIPv6,omitempty"`
+	BindDevice string `yaml:"bindDevice,omitempty" json:"bindDevice,omitempty"`
+	FastOpen   bool   `yaml:"fastOpen,omitempty" json:"fastOpen,omitempty"`
+}
+
+// SOCKS5Outbound sends traffic through a SOCKS5 proxy
+type SOCKS5Outbound struct {
+	Addr     string `yaml:"addr" json:"addr"`
+	Username string `yaml:"username,omitempty" json:"username,omitempty"`
+	Password string `yaml:"password,omitempty" json:"password,omitempty"`
+}
+
+// HTTPOutbound sends traffic through an HTTP proxy
+type HTTPOutbound struct {
+	URL      string `yaml:"url" json:"url"`
+	Insecure bool   `yaml:"insecure,omitempty" json:"insecure,omitempty"`
+}
+
+// TrafficStats is the HTTP API listing online clients and their traffic
+type TrafficStats struct {
+	Listen string `yaml:"listen" json:"listen"`
+	Secret string `yaml:"secret,omitempty" json:"secret,omitempty"`
+}
+
+// Masquerade is what the server answers to HTTP/3 requests that fail authentication
+type Masquerade struct {
+	Type        string             `yaml:"type" json:"type"`
+	File        *MasqueradeFileDir `yaml:"file,omitempty" json:"file,omitempty"`
+	Proxy       *MasqueradeProxyTo `yaml:"proxy,omitempty" json:"proxy,omitempty"`
+	String      *MasqueradeBody    `yaml:"string,omitempty" json:"string,omitempty"`
+	ListenHTTP  string             `yaml:"listenHTTP,omitempty" json:"listenHTTP,omitempty"`
+	ListenHTTPS string             `yaml:"listenHTTPS,omitempty" json:"listenHTTPS,omitempty"`
+	ForceHTTPS  bool               `yaml:"forceHTTPS,omitempty" json:"forceHTTPS,omitempty"`
+}
+
+// MasqueradeFileDir serves static files
+type MasqueradeFileDir struct {
+	Dir string `yaml:"dir" json:"dir"`
+}
+
+// MasqueradeProxyTo reverse proxies to a website
+type MasqueradeProxyTo struct {
+	URL         string `yaml:"url" json:"url"`
+	RewriteHost bool   `yaml:"rewriteHost,omitempty" json:"rewriteHost,omitempty"`
+	Insecure    bool   `yaml:"insecure,omitempty" json:"insecure,omitempty"`
+}
+
+// MasqueradeBody answers with a fixed response
+type MasqueradeBody struct {
+	Content    string            `yaml:"content" json:"content"`
+	Headers    map[string]string `yaml:"headers,omitempty" json:"headers,omitempty"`
+	StatusCode int               `yaml:"statusCode,omitempty" json:"statusCode,omitempty"`
+}
+
+// Parse reads a server config in YAML or JSON, rejecting keys the server does not know
+func Parse(data []byte) (*ServerConfig, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	var cfg ServerConfig
+	if err := decoder.Decode(&cfg); err != nil {
+		if errors.Is(err, io.EOF) {
+			return &cfg, nil
+		}
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Marshal writes cfg as YAML
+func (c *ServerConfig) Marshal() ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(c); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Validate checks what the server checks when it loads the config, so a config that would
+// keep the server from starting is rejected before it is written
+func (c *ServerConfig) Validate() error {
+	if c.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+			return fmt.Errorf("listen: %w", err)
+		}
+	}
+
+	switch {
+	case c.TLS != nil && c.ACME != nil:
+		return errors.New("tls and acme cannot both be set")
+	case c.TLS != nil:
+		if c.TLS.Cert == "" || c.TLS.Key == "" {
+			return errors.New("tls: cert and key are required")
+		}
+		switch c.TLS.SNIGuard {
+		case "", "strict", "dns-san", "disable":
+		default:
+			return fmt.Errorf("tls: unsupported sniGuard %q", c.TLS.SNIGuard)
+		}
+	case c.ACME != nil:
+		if len(c.ACME.Domains) == 0 {
+			return errors.New("acme: domains are required")
+		}
+		switch c.ACME.CA {
+		case "", ACMECALetsEncrypt, ACMECAZeroSSL:
+		default:
+			return fmt.Errorf("acme: unsupported ca %q", c.ACME.CA)
+		}
+		switch c.ACME.Type {
+		case "", ACMEChallengeHTTP, ACMEChallengeTLS:
+		case ACMEChallengeDNS:
+			if c.ACME.DNS == nil || c.ACME.DNS.Name == "" {
+				return errors.New("acme: dns challenges need a dns provider name")
+			}
+			if !slices.Contains(ACMEDNSProviders, c.ACME.DNS.Name) {
+				return fmt.Errorf("acme: unsupported dns provider %q", c.ACME.DNS.Name)
+			}
+		default:
+			return fmt.Errorf("acme: unsupported type %q", c.ACME.Type)
+		}
+	default:
+		return errors.New("either tls or acme is required")
+	}
+
+	if c.Obfs != nil {
+		if c.Obfs.Type != ObfsSalamander {
+			return fmt.Errorf("obfs: unsupported type %q", c.Obfs.Type)
+		}
+		if c.Obfs.Salamander == nil || c.Obfs.Salamander.Password == "" {
+			return errors.New("obfs: salamander password is required")
+		}
+	}
+
+	if c.Auth == nil {
+		return errors.New("auth is required")
+	}
+	switch c.Auth.Type {
+	case AuthPassword:
+		if c.Auth.Password == "" {
+			return errors.New("auth: password is required")
+		}
+	case AuthUserpass:
+		if len(c.Auth.Userpass) == 0 {
+			return errors.New("auth: userpass is empty")
+		}
+	case AuthHTTP:
+		if c.Auth.HTTP == nil || c.Auth.HTTP.URL == "" {
+			return errors.New("auth: http url is required")
+		}
+	case AuthCommand:
+		if c.Auth.Command == "" {
+			return errors.New("auth: command is required")
+		}
+	default:
+		return fmt.Errorf("auth: unsupported type %q", c.Auth.Type)
+	}
+
+	if c.Resolver != nil {
+		if err := c.Resolver.validate(); err != nil {
+			return fmt.Errorf("resolver: %w", err)
+		}
+	}
+
+	if c.ACL != nil && c.ACL.File != "" && len(c.ACL.Inline) > 0 {
+		return errors.New("acl: file and inline cannot both be set")
+	}
+
+	names := make(map[string]bool, len(c.Outbounds))
+	for _, outbound := range c.Outbounds {
+		if err := outbound.validate(); err != nil {
+			return fmt.Errorf("outbound %s: %w", outbound.Name, err)
+		}
+		if names[outbound.Name] {
+			return fmt.Errorf("duplicate outbound %q", outbound.Name)
+		}
+		names[outbound.Name] = true
+	}
+	// Rules of an ACL file are checked when it is written
+	if c.ACL != nil {
+		if err := ValidateACL(c.ACL.Inline, c.Outbounds); err != nil {
+			return fmt.Errorf("acl: %w", err)
+		}
+	}
+
+	if c.TrafficStats != nil && c.TrafficStats.Listen == "" {
+		return errors.New("trafficStats: listen is required")
+	}
+
+	if c.Masquerade != nil {
+		if err := c.Masquerade.validate(); err != nil {
+			return fmt.Errorf("masquerade: %w", err)
+		}
+	}
+	return nil
+}
+
+func (r *Resolver) validate() error {
+	var addr string
+	switch r.Type {
+	case "tcp":
+		if r.TCP != nil {
+			addr = r.TCP.Addr
+		}
+	case "udp":
+		if r.UDP != nil {
+			addr = r.UDP.Addr
+		}
+	case "tls":
+		if r.TLS != nil {
+			addr = r.TLS.Addr
+		}
+	case "https":
+		if r.HTTPS != nil {
+			addr = r.HTTPS.Addr
+		}
+	default:
+		return fmt.Errorf("unsupported type %q", r.Type)
+	}
+	if addr == "" {
+		return fmt.Errorf("%s addr is required", r.Type)
+	}
+	return nil
+}
+
+func (o *Outbound) validate() error {
+	if o.Name == "" {
+		return errors.New("name is required")
+	}
+	switch o.Type {
+	case OutboundDirect:
+	case OutboundSOCKS5:
+		if o.SOCKS5 == nil || o.SOCKS5.Addr == "" {
+			return errors.New("socks5 addr is required")
+		}
+	case OutboundHTTP:
+		if o.HTTP == nil || o.HTTP.URL == "" {
+			return errors.New("http url is required")
+		}
+		if _, err := url.Parse(o.HTTP.URL); err != nil {
+			return fmt.Errorf("http url: %w", err)
+		}
+	default:
+		return fmt.Errorf("unsupported type %q", o.Type)
+	}
+	return nil
+}
+
+func (m *Masquerade) validate() error {
+	switch m.Type {
+	case "":
+		// The server answers 404
+	case MasqueradeFile:
+		if m.File == nil || m.File.Dir == "" {
+			return errors.New("file dir is required")
+		}
+	case MasqueradeProxy:
+		if m.Proxy == nil || m.Proxy.URL == "" {
+			return errors.New("proxy url is required")
+		}
+		if u, err := url.Parse(m.Proxy.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("proxy url %q must be http or https", m.Proxy.URL)
+		}
+	case MasqueradeString:
+		if m.String == nil || m.String.Content == "" {
+			return errors.New("string content is required")
+		}
+		if m.String.StatusCode != 0 && (m.String.StatusCode < 100 || m.String.StatusCode > 599) {
+			return fmt.Errorf("invalid status code %d", m.String.StatusCode)
+		}
+	default:
+		return fmt.Errorf("unsupported type %q", m.Type)
+	}
+	return nil
+}
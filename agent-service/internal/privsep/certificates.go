@@ -0,0 +1,88 @@
+package privsep
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// letsEncryptLiveDir is where certbot keeps the current certificate of each lineage, readable
+// by root only
+var letsEncryptLiveDir = "/etc/letsencrypt/live"
+
+// InstallCertificate has the helper copy the Let's Encrypt certificate chain and private key
+// of domain into certPath and keyPath, named <domain>.crt and <domain>.key, so the agent can
+// serve them. The files get the owner of their directory, which must be the agent's.
+func InstallCertificate(domain, certPath, keyPath string) error {
+	return do(nil, OpInstallCertificate, domain, certPath, keyPath)
+}
+
+func checkInstallCertificate(args []string) error {
+	if len(args) != 3 {
+		return fmt.Errorf("want install-certificate <domain> <cert file> <key file>")
+	}
+	domain := args[0]
+	if !domainPattern.MatchString(domain) {
+		return fmt.Errorf("invalid domain %q", domain)
+	}
+	for i, ext := range []string{".crt", ".key"} {
+		path := args[i+1]
+		if !filepath.IsAbs(path) || filepath.Clean(path) != path || filepath.Base(path) != domain+ext {
+			return fmt.Errorf("want an absolute path to %s%s, got %q", domain, ext, path)
+		}
+		// The caller could write the files itself; the helper only supplies their content
+		if err := checkCallerOwned(filepath.Dir(path)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkCallerOwned makes sure dir is a directory of the user running the helper
+func checkCallerOwned(dir string) error {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || !info.IsDir() || stat.Uid != uint32(os.Getuid()) {
+		return fmt.Errorf("%s is not a directory of uid %d", dir, os.Getuid())
+	}
+	return nil
+}
+
+// installCertificate copies the live certificate files of domain, the key readable by the
+// directory's owner only
+func installCertificate(domain, certPath, keyPath string) error {
+	live := filepath.Join(letsEncryptLiveDir, domain)
+	cert, err := os.ReadFile(filepath.Join(live, "fullchain.pem"))
+	if err != nil {
+		return fmt.Errorf("failed to read certificate: %w", err)
+	}
+	key, err := os.ReadFile(filepath.Join(live, "privkey.pem"))
+	if err != nil {
+		return fmt.Errorf("failed to read private key: %w", err)
+	}
+	if err := writeDirOwnedFile(certPath, cert, 0644); err != nil {
+		return fmt.Errorf("failed to install certificate: %w", err)
+	}
+	if err := writeDirOwnedFile(keyPath, key, 0600); err != nil {
+		return fmt.Errorf("failed to install private key: %w", err)
+	}
+	return nil
+}
+
+// writeDirOwnedFile replaces path with data owned by the owner of its directory, which must
+// not be a symlink
+func writeDirOwnedFile(path string, data []byte, mode os.FileMode) error {
+	info, err := os.Lstat(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", filepath.Dir(path))
+	}
+	return replaceFile(path, data, mode, int(stat.Uid), int(stat.Gid))
+}
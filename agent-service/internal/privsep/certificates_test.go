@@ -0,0 +1,88 @@
+package privsep
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckInstallCertificate(t *testing.T) {
+	dir := t.TempDir()
+	link := filepath.Join(t.TempDir(), "sni")
+	if err := os.Symlink(dir, link); err != nil {
+		t.Fatal(err)
+	}
+	cert := func(dir, domain string) []string {
+		return []string{domain, filepath.Join(dir, domain+".crt"), filepath.Join(dir, domain+".key")}
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		allowed bool
+	}{
+		{"own directory", cert(dir, "vpn.example.com"), true},
+		{"punycode domain", cert(dir, "xn--e1afmkfd.xn--p1ai"), true},
+		{"symlinked directory", cert(link, "vpn.example.com"), false},
+		{"missing directory", cert(filepath.Join(dir, "missing"), "vpn.example.com"), false},
+		{"root's directory", cert("/etc", "vpn.example.com"), os.Getuid() == 0},
+		{"other file name", []string{"vpn.example.com", filepath.Join(dir, "passwd"), filepath.Join(dir, "vpn.example.com.key")}, false},
+		{"relative path", []string{"vpn.example.com", "vpn.example.com.crt", filepath.Join(dir, "vpn.example.com.key")}, false},
+		{"unclean path", []string{"vpn.example.com", dir + "/../" + filepath.Base(dir) + "/vpn.example.com.crt", filepath.Join(dir, "vpn.example.com.key")}, false},
+		{"invalid domain", cert(dir, "../vpn"), false},
+		{"missing key", cert(dir, "vpn.example.com")[:2], false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkInstallCertificate(tt.args)
+			if tt.allowed && err != nil {
+				t.Errorf("refused: %v", err)
+			}
+			if !tt.allowed && err == nil {
+				t.Error("allowed")
+			}
+		})
+	}
+}
+
+func TestInstallCertificate(t *testing.T) {
+	live := t.TempDir()
+	letsEncryptLiveDir = live
+	t.Cleanup(func() { letsEncryptLiveDir = "/etc/letsencrypt/live" })
+	lineage := filepath.Join(live, "vpn.example.com")
+	if err := os.MkdirAll(lineage, 0700); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(lineage, "fullchain.pem"), []byte("chain"), 0644)
+	os.WriteFile(filepath.Join(lineage, "privkey.pem"), []byte("key"), 0600)
+
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "vpn.example.com.crt"), filepath.Join(dir, "vpn.example.com.key")
+	if err := Run(OpInstallCertificate, []string{"vpn.example.com", certPath, keyPath}, nil); err != nil {
+		t.Fatalf("install-certificate: %v", err)
+	}
+	for path, want := range map[string]struct {
+		content string
+		mode    os.FileMode
+	}{certPath: {"chain", 0644}, keyPath: {"key", 0600}} {
+		data, _ := os.ReadFile(path)
+		info, err := os.Stat(path)
+		if err != nil || string(data) != want.content || info.Mode().Perm() != want.mode {
+			t.Errorf("%s = %q, %v, %v; want %q with mode %v", filepath.Base(path), data, info, err, want.content, want.mode)
+		}
+	}
+
+	// A renewal replaces the installed files
+	os.WriteFile(filepath.Join(lineage, "fullchain.pem"), []byte("renewed chain"), 0644)
+	if err := Run(OpInstallCertificate, []string{"vpn.example.com", certPath, keyPath}, nil); err != nil {
+		t.Fatalf("install-certificate after renewal: %v", err)
+	}
+	if data, _ := os.ReadFile(certPath); string(data) != "renewed chain" {
+		t.Errorf("certificate after renewal = %q", data)
+	}
+
+	// Without a lineage nothing is installed
+	if err := Run(OpInstallCertificate, []string{"other.example.com", filepath.Join(dir, "other.example.com.crt"), filepath.Join(dir, "other.example.com.key")}, nil); err == nil {
+		t.Error("installed a certificate certbot does not have")
+	}
+}
@@ -0,0 +1,171 @@
+package privsep
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// PackageDir is where the helper stages the package files it downloads. Only root writes
+// to it, so nothing can replace a file between its check and its install.
+const PackageDir = "/var/lib/hysteria2-agent/packages"
+
+// PackagePins lists, in SHA256SUMS format, the package files the helper installs. The
+// operator writes it, as root, from the artifact store's SHA256SUMS; a file it does not
+// list, or lists with another hash, is not installed.
+const PackagePins = "/var/lib/hysteria2-agent/packages.sha256"
+
+const (
+	maxPackageFile  = 512 << 20
+	maxPackageToken = 4096
+	packageTimeout  = 10 * time.Minute
+)
+
+// packageFilePattern matches the WARP client packages mirrored in the artifact store
+var packageFilePattern = regexp.MustCompile(`^cloudflare-warp-(amd64|arm64)\.(deb|rpm)$`)
+
+// packageFormats are the package file formats each package manager installs
+var packageFormats = map[string]string{"apt-get": "deb", "dnf": "rpm", "yum": "rpm"}
+
+// InstallPackage has the helper download a package file from url into PackageDir, check it
+// against PackagePins and install it with manager, one of apt-get, dnf or yum. token, the
+// artifact store's bearer token, is passed on stdin.
+func InstallPackage(manager, url, token string) error {
+	return do(strings.NewReader(token), OpInstallPackage, manager, url)
+}
+
+func checkInstallPackage(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("want install-package <apt-get|dnf|yum> <url>")
+	}
+	format, ok := packageFormats[args[0]]
+	if !ok {
+		return fmt.Errorf("package manager %q is not allowed", args[0])
+	}
+	u, err := url.Parse(args[1])
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || u.User != nil {
+		return fmt.Errorf("invalid package URL %q", args[1])
+	}
+	name := path.Base(u.Path)
+	if !packageFilePattern.MatchString(name) || !strings.HasSuffix(name, "."+format) {
+		return fmt.Errorf("package %q is not allowed for %s", name, args[0])
+	}
+	return nil
+}
+
+func installPackage(manager, rawURL string, stdin io.Reader) error {
+	token, err := io.ReadAll(io.LimitReader(stdin, maxPackageToken))
+	if err != nil {
+		return err
+	}
+	u, _ := url.Parse(rawURL)
+	name := path.Base(u.Path)
+
+	expected, err := pinnedHash(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(PackageDir, 0700); err != nil {
+		return err
+	}
+	if err := checkRootOwned(PackageDir); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), packageTimeout)
+	defer cancel()
+	file := filepath.Join(PackageDir, name)
+	defer os.Remove(file)
+	if err := downloadPackage(ctx, rawURL, strings.TrimSpace(string(token)), expected, file); err != nil {
+		return fmt.Errorf("failed to download %s: %w", name, err)
+	}
+
+	bin, err := resolve(manager)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, bin, "install", "-y", file)
+	cmd.Env = []string{"PATH=" + strings.Join(trustedDirs, ":"), "LANG=C", "DEBIAN_FRONTEND=noninteractive"}
+	return run(cmd)
+}
+
+// pinnedHash returns the SHA-256 PackagePins lists for the file name, matched on the base
+// name so lines copied from the artifact store's SHA256SUMS work as they are
+func pinnedHash(name string) (string, error) {
+	if err := checkRootOwned(PackagePins); err != nil {
+		return "", fmt.Errorf("package pins: %w", err)
+	}
+	data, err := os.ReadFile(PackagePins)
+	if err != nil {
+		return "", err
+	}
+	return parsePins(data, name)
+}
+
+func parsePins(data []byte, name string) (string, error) {
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || path.Base(strings.TrimPrefix(fields[1], "*")) != name {
+			continue
+		}
+		hash := strings.ToLower(fields[0])
+		if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != sha256.Size {
+			return "", fmt.Errorf("invalid pin for %s", name)
+		}
+		return hash, nil
+	}
+	return "", fmt.Errorf("%s is not pinned in %s", name, PackagePins)
+}
+
+// downloadPackage saves url to dest, removing it again unless its SHA-256 is expected
+func downloadPackage(ctx context.Context, url, token, expected, dest string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+
+	os.Remove(dest)
+	f, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, hash), io.LimitReader(resp.Body, maxPackageFile+1))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && n > maxPackageFile {
+		err = fmt.Errorf("package exceeds %d bytes", maxPackageFile)
+	}
+	if err == nil {
+		if actual := hex.EncodeToString(hash.Sum(nil)); actual != expected {
+			err = fmt.Errorf("checksum mismatch: got %s, expected %s", actual, expected)
+		}
+	}
+	if err != nil {
+		os.Remove(dest)
+	}
+	return err
+}
@@ -0,0 +1,61 @@
+package privsep
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParsePins(t *testing.T) {
+	pins := []byte("" +
+		"8d969eef6ecad3c29a3a629280e686cf0c3f5d5a86aff3ca12020c923adc6c92  warp/cloudflare-warp-amd64.deb\n" +
+		"not-a-hash  warp/cloudflare-warp-arm64.deb\n")
+
+	hash, err := parsePins(pins, "cloudflare-warp-amd64.deb")
+	if err != nil || hash != "8d969eef6ecad3c29a3a629280e686cf0c3f5d5a86aff3ca12020c923adc6c92" {
+		t.Errorf("amd64 pin = %q, %v", hash, err)
+	}
+	if _, err := parsePins(pins, "cloudflare-warp-arm64.deb"); err == nil {
+		t.Error("invalid pin accepted")
+	}
+	if _, err := parsePins(pins, "cloudflare-warp-amd64.rpm"); err == nil {
+		t.Error("unpinned package accepted")
+	}
+}
+
+func TestDownloadPackage(t *testing.T) {
+	content := []byte("package")
+	sum := sha256.Sum256(content)
+	expected := hex.EncodeToString(sum[:])
+
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	dest := filepath.Join(t.TempDir(), "cloudflare-warp-amd64.deb")
+	if err := downloadPackage(context.Background(), server.URL, "node-token", expected, dest); err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	if authorization != "Bearer node-token" {
+		t.Errorf("Authorization = %q", authorization)
+	}
+	if data, _ := os.ReadFile(dest); string(data) != "package" {
+		t.Errorf("staged %q", data)
+	}
+
+	// A file that does not match its pin is not left behind for the package manager
+	if err := downloadPackage(context.Background(), server.URL, "", "00"+expected[2:], dest); err == nil {
+		t.Error("checksum mismatch accepted")
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Errorf("mismatching file kept: %v", err)
+	}
+}
@@ -0,0 +1,776 @@
+package privsep
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Built-in helper operations, requested as the command name
+const (
+	OpWriteFile          = "write-file"          // write-file <path> <mode>, content on stdin
+	OpRemoveFile         = "remove-file"         // remove-file <path>
+	OpInstallService     = "install-service"     // install-service <init> <service> [params...]
+	OpStartService       = "start-service"       // start-service <service>, without an init system
+	OpStopService        = "stop-service"        // stop-service <service>, without an init system
+	OpReloadService      = "reload-service"      // reload-service <service>, without an init system
+	OpInstallCronJob     = "install-cron-job"    // install-cron-job <cron.d|crontab> <job>
+	OpRemoveCronJob      = "remove-cron-job"     // remove-cron-job <cron.d|crontab> <job>
+	OpAddRepository      = "add-repository"      // add-repository apt <codename> [<fingerprint>] | rpm
+	OpInstallPackage     = "install-package"     // install-package <apt-get|dnf|yum> <url>, store token on stdin
+	OpInstallCertificate = "install-certificate" // install-certificate <domain> <cert file> <key file>
+)
+
+// ServiceStateDir holds the definitions and pid files of the services the helper supervises
+// when the host has no init system. Only root writes to it.
+const ServiceStateDir = "/var/lib/hysteria2-agent/services"
+
+// RulesetDir holds the rulesets loaded with iptables-restore and nft -f. Those commands read
+// these files only, never stdin or a path the agent picks, and only once they are owned by
+// root; the agent replaces them with WriteFile.
+const RulesetDir = "/var/lib/hysteria2-agent/rulesets"
+
+// The ruleset files
+const (
+	IPTablesRuleset  = RulesetDir + "/iptables.rules"
+	IP6TablesRuleset = RulesetDir + "/ip6tables.rules"
+	FirewallRuleset  = RulesetDir + "/firewall.nft" // the firewall, also loaded at boot
+	NFTScript        = RulesetDir + "/script.nft"   // one-off nft changes
+)
+
+// trustedDirs are the only directories commands are resolved from; PATH is ignored
+var trustedDirs = []string{"/usr/sbin", "/usr/bin", "/sbin", "/bin", "/usr/local/sbin", "/usr/local/bin"}
+
+// services the agent may manage through the init system
+var allowedServices = map[string]bool{
+	"hysteria2":          true,
+	"hysteria2-firewall": true,
+	"warp-svc":           true,
+	"xray":               true,
+	"cron":               true,
+	"crond":              true,
+	"ssh":                true,
+	"sshd":               true,
+}
+
+// allowedModules are the kernel modules the agent loads
+var allowedModules = map[string]bool{
+	"tcp_bbr":      true,
+	"sch_fq":       true,
+	"sch_htb":      true,
+	"ifb":          true,
+	"nf_conntrack": true,
+	"xt_set":       true,
+}
+
+// writablePaths are the files the agent may write or remove as root, as glob patterns.
+// Units, init scripts, cron jobs and package repositories are not among them: the helper
+// renders those itself, see services.go and repository.go.
+var writablePaths = []string{
+	"/etc/sysctl.d/*hysteria*.conf",
+	IPTablesRuleset,
+	IP6TablesRuleset,
+	FirewallRuleset,
+	NFTScript,
+}
+
+// allowedPackages are the packages the agent installs and removes
+var allowedPackages = map[string]bool{
+	"cloudflare-warp": true,
+	"certbot":         true,
+	"epel-release":    true,
+}
+
+// packageFlags are the only package manager flags allowed. -o, -c and the like would point
+// the manager at another configuration, repository or root.
+var packageFlags = map[string]bool{
+	"-y":                      true,
+	"-q":                      true,
+	"--no-install-recommends": true,
+}
+
+// tldPattern matches a top-level domain, letters or the punycode form of an IDN TLD such as
+// xn--p1ai
+const tldPattern = `([A-Za-z]{2,63}|xn--[a-z0-9-]{1,59})`
+
+var (
+	sysctlKeyPattern  = regexp.MustCompile(`^net\.[a-z0-9_.]+$`)
+	unitPattern       = regexp.MustCompile(`^([a-z0-9_-]+?)(\.service)?$`)
+	domainPattern     = regexp.MustCompile(`^([A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?\.)+` + tldPattern + `$`)
+	emailPattern      = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._%+-]*@([A-Za-z0-9-]+\.)+` + tldPattern + `$`)
+	interfacePattern  = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,15}$`)
+	chainPattern      = regexp.MustCompile(`^[A-Za-z0-9_-]{1,28}$`)
+	ruleNumberPattern = regexp.MustCompile(`^[1-9][0-9]*$`)
+	nftTablePattern   = regexp.MustCompile(`^hysteria2_[a-z0-9_]+$`)
+	nftSetPattern     = regexp.MustCompile(`^[a-z0-9_]+$`)
+	nftElementPattern = regexp.MustCompile(`^\{ [0-9A-Fa-f:.]+(/[0-9]+)?( timeout [0-9]+[smhd])? \}$`)
+	nftIncludePattern = regexp.MustCompile(`(?m)^\s*include\b`)
+	ipArgPattern      = regexp.MustCompile(`^[A-Za-z0-9_.:/]+$`)
+	tcParamPattern    = regexp.MustCompile(`^[a-z0-9_.]+$`)
+	ufwPortsPattern   = regexp.MustCompile(`^[0-9]{1,5}([:,][0-9]{1,5})*$`)
+	ufwCommentPattern = regexp.MustCompile(`^[A-Za-z0-9 _.,:/()-]{1,64}$`)
+)
+
+// rule validates the arguments of one command
+type rule func(args []string) error
+
+var rules = map[string]rule{
+	"iptables":           checkIPTables,
+	"ip6tables":          checkIPTables,
+	"iptables-save":      checkIPTablesSave,
+	"ip6tables-save":     checkIPTablesSave,
+	"iptables-restore":   checkIPTablesRestore(IPTablesRuleset),
+	"ip6tables-restore":  checkIPTablesRestore(IP6TablesRuleset),
+	"nft":                checkNFT,
+	"ip":                 checkIP,
+	"tc":                 checkTC,
+	"conntrack":          checkConntrack,
+	"ufw":                checkUFW,
+	"certbot":            checkCertbot,
+	"sysctl":             checkSysctl,
+	"modprobe":           checkModprobe,
+	"systemctl":          checkSystemctl,
+	"rc-service":         checkRCService,
+	"rc-update":          checkRCUpdate,
+	"journalctl":         checkJournalctl,
+	"apt-get":            packageCommand("update", "install", "remove"),
+	"dnf":                packageCommand("install", "remove"),
+	"yum":                packageCommand("install", "remove"),
+	"apk":                packageCommand("update", "add", "del"),
+	"pkill":              checkProcessMatch,
+	"pgrep":              checkProcessMatch,
+	OpWriteFile:          checkWriteFile,
+	OpRemoveFile:         checkRemoveFile,
+	OpInstallService:     checkInstallService,
+	OpStartService:       checkServiceOp,
+	OpStopService:        checkServiceOp,
+	OpReloadService:      checkServiceOp,
+	OpInstallCronJob:     checkCronJob,
+	OpRemoveCronJob:      checkCronJob,
+	OpAddRepository:      checkAddRepository,
+	OpInstallPackage:     checkInstallPackage,
+	OpInstallCertificate: checkInstallCertificate,
+}
+
+// Check validates a command against the allowlist and returns the absolute path to run,
+// or the operation itself for the helper's built-in operations
+func Check(name string, args []string) (string, error) {
+	if strings.ContainsRune(name, '/') {
+		name = filepath.Base(name)
+	}
+	validate, ok := rules[name]
+	if !ok {
+		return "", fmt.Errorf("command %q is not allowed", name)
+	}
+	if err := validate(args); err != nil {
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+	if Builtin(name) {
+		return name, nil
+	}
+	return resolve(name)
+}
+
+// Builtin reports whether name is one of the helper's built-in operations
+func Builtin(name string) bool {
+	switch name {
+	case OpWriteFile, OpRemoveFile, OpInstallService, OpStartService, OpStopService,
+		OpReloadService, OpInstallCronJob, OpRemoveCronJob, OpAddRepository, OpInstallPackage,
+		OpInstallCertificate:
+		return true
+	}
+	return false
+}
+
+// resolve finds a command in the trusted directories
+func resolve(name string) (string, error) {
+	for _, dir := range trustedDirs {
+		path := filepath.Join(dir, name)
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() && info.Mode()&0111 != 0 {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("command %q not found in %s", name, strings.Join(trustedDirs, ":"))
+}
+
+// packageCommand allows the verbs of a package manager on the packages the agent installs
+// from the configured repositories; every package runs its install scripts as root.
+// Package files go through install-package, which downloads and checks them itself.
+func packageCommand(verbs ...string) rule {
+	return func(args []string) error {
+		verb := ""
+		for _, arg := range args {
+			if strings.HasPrefix(arg, "-") {
+				if !packageFlags[arg] {
+					return fmt.Errorf("flag %q is not allowed", arg)
+				}
+				continue
+			}
+			if verb == "" {
+				verb = arg
+				if !contains(verbs, verb) {
+					return fmt.Errorf("subcommand %q is not allowed", verb)
+				}
+				continue
+			}
+			if !allowedPackages[arg] {
+				return fmt.Errorf("package %q is not allowed", arg)
+			}
+		}
+		if verb == "" {
+			return fmt.Errorf("missing subcommand")
+		}
+		return nil
+	}
+}
+
+// checkCertbot allows issuing the certificate of one domain and renewing it:
+//
+//	certonly --standalone|--webroot -d <domain> --agree-tos -m <email> -n
+//	renew --cert-name <domain> -n
+//
+// Anything more, hooks, configuration files and directories above all, would let the
+// caller run commands as root.
+func checkCertbot(args []string) error {
+	switch {
+	case len(args) == 8 && args[0] == "certonly":
+		if args[1] != "--standalone" && args[1] != "--webroot" {
+			return fmt.Errorf("authenticator %q is not allowed", args[1])
+		}
+		if args[2] != "-d" || args[4] != "--agree-tos" || args[5] != "-m" || args[7] != "-n" {
+			return fmt.Errorf("want certonly --standalone|--webroot -d <domain> --agree-tos -m <email> -n")
+		}
+		if !domainPattern.MatchString(args[3]) {
+			return fmt.Errorf("invalid domain %q", args[3])
+		}
+		if !emailPattern.MatchString(args[6]) {
+			return fmt.Errorf("invalid email %q", args[6])
+		}
+		return nil
+	case len(args) == 4 && args[0] == "renew":
+		if args[1] != "--cert-name" || args[3] != "-n" {
+			return fmt.Errorf("want renew --cert-name <domain> -n")
+		}
+		if !domainPattern.MatchString(args[2]) {
+			return fmt.Errorf("invalid domain %q", args[2])
+		}
+		return nil
+	}
+	return fmt.Errorf("only certonly and renew of one domain are allowed")
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// iptablesTables are the tables iptables commands may name
+var iptablesTables = map[string]bool{"filter": true, "nat": true, "mangle": true, "raw": true}
+
+// iptablesCommands are the commands iptables may run, each on one chain
+var iptablesCommands = map[string]bool{
+	"-A": true, "-C": true, "-D": true, "-I": true, "-N": true, "-F": true, "-X": true, "-L": true, "-S": true,
+}
+
+// iptablesOptions are the options of the rule specs and listings the agent uses, and
+// whether each takes a value
+var iptablesOptions = map[string]bool{
+	"-p": true, "-s": true, "-d": true, "-i": true, "-o": true, "-j": true, "-m": true,
+	"--dport": true, "--sport": true, "--dports": true, "--sports": true,
+	"--to-ports": true, "--to-destination": true, "--to-source": true,
+	"--comment": true, "--ctstate": true, "--state": true, "--uid-owner": true, "--mark": true,
+	"--set-mark": true, "--set-dscp": true, "--set-dscp-class": true,
+	"!": false, "-n": false, "-v": false, "-w": false, "--line-numbers": false,
+}
+
+// iptablesMatches are the match extensions -m may load
+var iptablesMatches = map[string]bool{
+	"tcp": true, "udp": true, "comment": true, "conntrack": true, "state": true, "owner": true,
+	"mark": true, "multiport": true,
+}
+
+// checkIPTables allows one command on one chain of a known table, with the options the
+// agent's rules use. --modprobe is refused: iptables runs it as root to load modules.
+func checkIPTables(args []string) error {
+	command := ""
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-M" || strings.HasPrefix(arg, "--modprobe"):
+			return fmt.Errorf("%s is not allowed", arg)
+		case arg == "-t":
+			i++
+			if i >= len(args) || !iptablesTables[args[i]] {
+				return fmt.Errorf("table is missing or not allowed")
+			}
+		case iptablesCommands[arg]:
+			if command != "" {
+				return fmt.Errorf("more than one command")
+			}
+			command = arg
+			i++
+			if i >= len(args) || !chainPattern.MatchString(args[i]) {
+				return fmt.Errorf("%s: chain is missing or invalid", arg)
+			}
+			if i+1 < len(args) && ruleNumberPattern.MatchString(args[i+1]) {
+				i++
+			}
+		default:
+			takesValue, ok := iptablesOptions[arg]
+			if !ok {
+				return fmt.Errorf("option %q is not allowed", arg)
+			}
+			if !takesValue {
+				continue
+			}
+			i++
+			if i >= len(args) {
+				return fmt.Errorf("%s: missing value", arg)
+			}
+			if arg == "-m" && !iptablesMatches[args[i]] {
+				return fmt.Errorf("match %q is not allowed", args[i])
+			}
+		}
+	}
+	if command == "" {
+		return fmt.Errorf("missing command")
+	}
+	return nil
+}
+
+// checkIPTablesSave allows printing the ruleset, of one table or all
+func checkIPTablesSave(args []string) error {
+	if len(args) == 0 || (len(args) == 2 && args[0] == "-t" && iptablesTables[args[1]]) {
+		return nil
+	}
+	return fmt.Errorf("want [-t <table>]")
+}
+
+// checkIPTablesRestore allows loading the family's ruleset file, flushing the tables it
+// names or not
+func checkIPTablesRestore(ruleset string) rule {
+	return func(args []string) error {
+		if len(args) == 2 && args[0] == "--noflush" {
+			args = args[1:]
+		}
+		if len(args) != 1 || args[0] != ruleset {
+			return fmt.Errorf("want [--noflush] %s", ruleset)
+		}
+		return checkRootOwned(ruleset)
+	}
+}
+
+// checkNFT allows loading a ruleset file, listing the agent's tables and adding or
+// deleting set elements in them:
+//
+//	-f <firewall ruleset|script>
+//	list table inet <table>
+//	add|delete element inet <table> <set> { <address> [timeout <n>s] }
+func checkNFT(args []string) error {
+	switch {
+	case len(args) == 2 && args[0] == "-f":
+		if args[1] != FirewallRuleset && args[1] != NFTScript {
+			return fmt.Errorf("ruleset %q is not allowed", args[1])
+		}
+		return checkRootOwned(args[1])
+	case len(args) == 4 && args[0] == "list" && args[1] == "table" && args[2] == "inet":
+		if !nftTablePattern.MatchString(args[3]) {
+			return fmt.Errorf("table %q is not allowed", args[3])
+		}
+		return nil
+	case len(args) == 6 && (args[0] == "add" || args[0] == "delete") && args[1] == "element" && args[2] == "inet":
+		if !nftTablePattern.MatchString(args[3]) {
+			return fmt.Errorf("table %q is not allowed", args[3])
+		}
+		if !nftSetPattern.MatchString(args[4]) || !nftElementPattern.MatchString(args[5]) {
+			return fmt.Errorf("invalid set element %s %s", args[4], args[5])
+		}
+		return nil
+	}
+	return fmt.Errorf("only -f, list table and add or delete element are allowed")
+}
+
+// checkRootOwned makes sure only root could have written a file, such as a ruleset, or
+// created files in a directory
+func checkRootOwned(path string) error {
+	for _, p := range []string{filepath.Dir(path), path} {
+		info, err := os.Lstat(p)
+		if err != nil {
+			return err
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok || stat.Uid != 0 || info.Mode().Perm()&0022 != 0 || info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s is writable by others than root", p)
+		}
+	}
+	return nil
+}
+
+// checkRulesetContent refuses nft rulesets that include other files, which would let the
+// caller read any file as root
+func checkRulesetContent(path string, data []byte) error {
+	if strings.HasSuffix(path, ".nft") && nftIncludePattern.Match(data) {
+		return fmt.Errorf("%s: include is not allowed", path)
+	}
+	return nil
+}
+
+// sysctlDir holds the sysctl settings applied at boot
+const sysctlDir = "/etc/sysctl.d/"
+
+// checkSysctlContent allows sysctl.d files setting net.* keys only. Others such as
+// kernel.core_pattern or kernel.modprobe name programs the kernel runs as root.
+func checkSysctlContent(path string, data []byte) error {
+	if !strings.HasPrefix(path, sysctlDir) {
+		return nil
+	}
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		key, _, ok := strings.Cut(line, "=")
+		key = strings.TrimPrefix(strings.TrimSpace(key), "-")
+		if !ok || !sysctlKeyPattern.MatchString(key) {
+			return fmt.Errorf("%s:%d: only net.* keys are allowed", path, n+1)
+		}
+	}
+	return nil
+}
+
+// ipFlags are the display flags ip may take; -n, -netns, -batch and -force are not among them
+var ipFlags = map[string]bool{"-4": true, "-6": true, "-o": true, "-j": true, "-br": true, "-d": true, "-s": true}
+
+var ipObjects = map[string]bool{"link": true, "addr": true, "address": true, "route": true, "rule": true, "neigh": true}
+
+// checkIP allows reading links, addresses and routes: ip [flags] <object> [show|list] [args].
+// Nothing that changes them, enters another namespace or reads commands from a file.
+func checkIP(args []string) error {
+	i := 0
+	for ; i < len(args) && strings.HasPrefix(args[i], "-"); i++ {
+		if !ipFlags[args[i]] {
+			return fmt.Errorf("flag %q is not allowed", args[i])
+		}
+	}
+	if i >= len(args) || !ipObjects[args[i]] {
+		return fmt.Errorf("object is missing or not allowed")
+	}
+	rest := args[i+1:]
+	if len(rest) > 0 {
+		if rest[0] != "show" && rest[0] != "list" && !(rest[0] == "get" && args[i] == "route") {
+			return fmt.Errorf("subcommand %q is not allowed", rest[0])
+		}
+		rest = rest[1:]
+	}
+	for _, arg := range rest {
+		if !ipArgPattern.MatchString(arg) || arg == "netns" || arg == "exec" {
+			return fmt.Errorf("argument %q is not allowed", arg)
+		}
+	}
+	return nil
+}
+
+// tcQdiscs are the root qdiscs the agent installs
+var tcQdiscs = map[string]bool{"fq_codel": true, "cake": true, "fq": true}
+
+// checkTC allows showing and setting the root qdisc of an interface:
+//
+//	qdisc show [dev <interface> [root]]
+//	qdisc del dev <interface> root
+//	qdisc add|replace|change dev <interface> root <qdisc> [params]
+func checkTC(args []string) error {
+	if len(args) < 2 || args[0] != "qdisc" {
+		return fmt.Errorf("only qdisc is allowed")
+	}
+	verb := args[1]
+	switch verb {
+	case "show":
+		if len(args) == 2 {
+			return nil
+		}
+	case "del", "add", "replace", "change":
+	default:
+		return fmt.Errorf("subcommand %q is not allowed", verb)
+	}
+	if len(args) < 4 || args[2] != "dev" || !interfacePattern.MatchString(args[3]) {
+		return fmt.Errorf("want qdisc %s dev <interface> root", verb)
+	}
+	if verb == "show" && len(args) == 4 {
+		return nil
+	}
+	if len(args) < 5 || args[4] != "root" {
+		return fmt.Errorf("only the root qdisc is allowed")
+	}
+	params := args[5:]
+	if verb == "show" || verb == "del" {
+		if len(params) != 0 {
+			return fmt.Errorf("unexpected argument %q", params[0])
+		}
+		return nil
+	}
+	if len(params) == 0 || !tcQdiscs[params[0]] {
+		return fmt.Errorf("qdisc is missing or not allowed")
+	}
+	for _, param := range params[1:] {
+		if !tcParamPattern.MatchString(param) {
+			return fmt.Errorf("parameter %q is not allowed", param)
+		}
+	}
+	return nil
+}
+
+// checkConntrack allows listing the connection table only
+func checkConntrack(args []string) error {
+	if len(args) != 1 || args[0] != "-L" {
+		return fmt.Errorf("only -L is allowed")
+	}
+	return nil
+}
+
+// checkUFW allows reading the status, resetting and enabling ufw, setting its default
+// policies and adding or deleting rules of the form
+//
+//	[prepend|delete] allow|deny [proto tcp|udp] from <address> [to <address>] [port <ports>] [comment <text>]
+func checkUFW(args []string) error {
+	switch {
+	case len(args) == 1 && args[0] == "status",
+		len(args) == 2 && args[0] == "status" && args[1] == "verbose",
+		len(args) == 2 && args[0] == "--force" && (args[1] == "reset" || args[1] == "enable"):
+		return nil
+	case len(args) == 3 && args[0] == "default":
+		if (args[1] == "allow" || args[1] == "deny" || args[1] == "reject") &&
+			(args[2] == "incoming" || args[2] == "outgoing" || args[2] == "routed") {
+			return nil
+		}
+		return fmt.Errorf("invalid default policy %s %s", args[1], args[2])
+	}
+
+	if len(args) > 0 && (args[0] == "prepend" || args[0] == "delete") {
+		args = args[1:]
+	}
+	if len(args) == 0 || (args[0] != "allow" && args[0] != "deny") {
+		return fmt.Errorf("only status, reset, enable, default and allow or deny rules are allowed")
+	}
+	// Each keyword at most once, in ufw's order
+	keywords := []string{"proto", "from", "to", "port", "comment"}
+	for i := 1; i < len(args); i += 2 {
+		for len(keywords) > 0 && keywords[0] != args[i] {
+			keywords = keywords[1:]
+		}
+		if len(keywords) == 0 || i+1 >= len(args) {
+			return fmt.Errorf("argument %q is not allowed", args[i])
+		}
+		keywords = keywords[1:]
+		if err := checkUFWValue(args[i], args[i+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkUFWValue(keyword, value string) error {
+	valid := false
+	switch keyword {
+	case "proto":
+		valid = value == "tcp" || value == "udp"
+	case "from", "to":
+		_, _, cidrErr := net.ParseCIDR(value)
+		valid = value == "any" || net.ParseIP(value) != nil || cidrErr == nil
+	case "port":
+		valid = ufwPortsPattern.MatchString(value)
+	case "comment":
+		valid = ufwCommentPattern.MatchString(value)
+	}
+	if !valid {
+		return fmt.Errorf("invalid %s %q", keyword, value)
+	}
+	return nil
+}
+
+func checkSysctl(args []string) error {
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-w", "-n", "-q", "-e":
+			continue
+		}
+		key, _, _ := strings.Cut(args[i], "=")
+		if !sysctlKeyPattern.MatchString(key) {
+			return fmt.Errorf("key %q is not allowed", key)
+		}
+	}
+	return nil
+}
+
+func checkModprobe(args []string) error {
+	for _, arg := range args {
+		if arg == "-q" {
+			continue
+		}
+		if !allowedModules[arg] {
+			return fmt.Errorf("module %q is not allowed", arg)
+		}
+	}
+	return nil
+}
+
+func checkService(name string) error {
+	match := unitPattern.FindStringSubmatch(name)
+	if match == nil || !allowedServices[match[1]] {
+		return fmt.Errorf("service %q is not allowed", name)
+	}
+	return nil
+}
+
+func checkSystemctl(args []string) error {
+	var verb string
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-") {
+			if arg != "--now" && arg != "--quiet" {
+				return fmt.Errorf("flag %q is not allowed", arg)
+			}
+			continue
+		}
+		if verb == "" {
+			verb = arg
+			switch verb {
+			case "daemon-reload":
+			case "start", "stop", "restart", "reload", "enable", "disable", "is-active", "status":
+			default:
+				return fmt.Errorf("verb %q is not allowed", verb)
+			}
+			continue
+		}
+		if err := checkService(arg); err != nil {
+			return err
+		}
+	}
+	if verb == "" {
+		return fmt.Errorf("missing verb")
+	}
+	return nil
+}
+
+func checkRCService(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("want rc-service <service> <action>")
+	}
+	switch args[1] {
+	case "start", "stop", "restart", "reload", "status":
+	default:
+		return fmt.Errorf("action %q is not allowed", args[1])
+	}
+	return checkService(args[0])
+}
+
+func checkRCUpdate(args []string) error {
+	if len(args) < 2 || (args[0] != "add" && args[0] != "del") {
+		return fmt.Errorf("want rc-update add|del <service> [runlevel]")
+	}
+	return checkService(args[1])
+}
+
+// checkJournalctl allows reading the journal of the agent's services, never rotating or
+// vacuuming it
+func checkJournalctl(args []string) error {
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-f", "--no-pager":
+		case "-n", "-o":
+			i++
+		case "-u":
+			i++
+			if i >= len(args) {
+				return fmt.Errorf("missing unit")
+			}
+			if err := checkService(args[i]); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("argument %q is not allowed", args[i])
+		}
+	}
+	return nil
+}
+
+// checkProcessMatch allows matching the agent's servers by command line only
+func checkProcessMatch(args []string) error {
+	if len(args) != 2 || args[0] != "-f" || (args[1] != "hysteria" && args[1] != "xray") {
+		return fmt.Errorf("only -f hysteria and -f xray are allowed")
+	}
+	return nil
+}
+
+func checkPath(path string) error {
+	if !filepath.IsAbs(path) || filepath.Clean(path) != path {
+		return fmt.Errorf("path %q must be absolute and clean", path)
+	}
+	for _, pattern := range writablePaths {
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("path %q is not writable", path)
+}
+
+func checkWriteFile(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("want write-file <path> <mode>")
+	}
+	mode, err := strconv.ParseUint(args[1], 8, 32)
+	if err != nil || mode&^0755 != 0 {
+		return fmt.Errorf("invalid mode %q", args[1])
+	}
+	return checkPath(args[0])
+}
+
+func checkRemoveFile(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("want remove-file <path>")
+	}
+	return checkPath(args[0])
+}
+
+func checkInstallService(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("want install-service <init> <service> [params...]")
+	}
+	switch args[0] {
+	case InitSystemd, InitOpenRC, InitNone:
+	default:
+		return fmt.Errorf("init system %q is not supported", args[0])
+	}
+	service, ok := managedServices[args[1]]
+	if !ok {
+		return fmt.Errorf("service %q is not allowed", args[1])
+	}
+	return service.checkParams(args[2:])
+}
+
+func checkServiceOp(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("want <service>")
+	}
+	if _, ok := managedServices[args[0]]; !ok {
+		return fmt.Errorf("service %q is not allowed", args[0])
+	}
+	return nil
+}
+
+func checkCronJob(args []string) error {
+	if len(args) != 2 || (args[0] != CronDir && args[0] != CronTab) {
+		return fmt.Errorf("want <cron.d|crontab> <job>")
+	}
+	if _, ok := cronJobs[args[1]]; !ok {
+		return fmt.Errorf("cron job %q is not allowed", args[1])
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+// Package privsep lets the agent run unprivileged. Commands that need root, writes to the
+// system files the agent manages and the services and cron jobs it installs go through a
+// small setuid helper that checks them against an allowlist and audits every request before
+// running it; see cmd/agent-helper. When the agent runs as root, or no helper is
+// configured, commands run directly and the built-in operations run in the agent.
+package privsep
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxFileSize bounds the files WriteFile writes
+const maxFileSize = 1 << 20
+
+var (
+	mu     sync.RWMutex
+	helper string
+)
+
+// Enable sends privileged commands through the helper at path unless the agent runs as root
+func Enable(path string) error {
+	if path == "" || os.Geteuid() == 0 {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("privilege helper: %w", err)
+	}
+	if info.Mode()&os.ModeSetuid == 0 {
+		return fmt.Errorf("privilege helper %s is not setuid", path)
+	}
+	mu.Lock()
+	helper = path
+	mu.Unlock()
+	return nil
+}
+
+// Enabled reports whether privileged commands go through the helper
+func Enabled() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return helper != ""
+}
+
+// Privileged reports whether name is a command the helper runs as root
+func Privileged(name string) bool {
+	_, ok := rules[filepath.Base(name)]
+	return ok
+}
+
+// Command returns a command running name with args: through the helper when it is enabled
+// and the command needs root, directly otherwise. Commands the helper does not know, such
+// as warp-cli or docker, run as the agent's user.
+func Command(name string, args ...string) *exec.Cmd {
+	return CommandContext(context.Background(), name, args...)
+}
+
+// CommandContext is Command with a context that kills the command when done
+func CommandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+	mu.RLock()
+	path := helper
+	mu.RUnlock()
+	if path == "" || !Privileged(name) {
+		return exec.CommandContext(ctx, name, args...)
+	}
+	return exec.CommandContext(ctx, path, append([]string{name}, args...)...)
+}
+
+// WriteFile writes a system file the agent manages
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	return do(bytes.NewReader(data), OpWriteFile, path, strconv.FormatUint(uint64(perm.Perm()), 8))
+}
+
+// Remove removes a system file the agent manages; a missing file is not an error
+func Remove(path string) error {
+	return do(nil, OpRemoveFile, path)
+}
+
+// InstallService installs one of the agent's services with init, one of InitSystemd,
+// InitOpenRC or InitNone, and enables it at boot without starting it. The unit or init
+// script is rendered here from a fixed template; params are the service's parameters, the
+// configuration file for hysteria2.
+func InstallService(init, name string, params ...string) error {
+	return do(nil, OpInstallService, append([]string{init, name}, params...)...)
+}
+
+// StartService starts a service installed without an init system
+func StartService(name string) error {
+	return do(nil, OpStartService, name)
+}
+
+// StopService stops a service started by StartService
+func StopService(name string) error {
+	return do(nil, OpStopService, name)
+}
+
+// ReloadService sends SIGHUP to a service started by StartService
+func ReloadService(name string) error {
+	return do(nil, OpReloadService, name)
+}
+
+// InstallCronJob installs one of the agent's cron jobs, in CronDir or CronTab
+func InstallCronJob(where, name string) error {
+	return do(nil, OpInstallCronJob, where, name)
+}
+
+// RemoveCronJob removes a job installed with InstallCronJob
+func RemoveCronJob(where, name string) error {
+	return do(nil, OpRemoveCronJob, where, name)
+}
+
+// do runs a built-in operation through the helper when it is enabled, in this process
+// otherwise. Either way the operation is checked against the allowlist first.
+func do(stdin io.Reader, op string, args ...string) error {
+	if !Enabled() {
+		if _, err := Check(op, args); err != nil {
+			return err
+		}
+		if stdin == nil {
+			stdin = bytes.NewReader(nil)
+		}
+		return Run(op, args, stdin)
+	}
+	cmd := Command(op, args...)
+	cmd.Stdin = stdin
+	return run(cmd)
+}
+
+// Run carries out a built-in operation Check allowed. It needs root: the helper calls it
+// once it has become root, and so does the agent when it runs as root itself.
+func Run(op string, args []string, stdin io.Reader) error {
+	switch op {
+	case OpWriteFile:
+		mode, _ := strconv.ParseUint(args[1], 8, 32)
+		data, err := io.ReadAll(io.LimitReader(stdin, maxFileSize+1))
+		if err != nil {
+			return err
+		}
+		if len(data) > maxFileSize {
+			return fmt.Errorf("content exceeds %d bytes", maxFileSize)
+		}
+		if err := checkRulesetContent(args[0], data); err != nil {
+			return err
+		}
+		if err := checkSysctlContent(args[0], data); err != nil {
+			return err
+		}
+		return writeFile(args[0], data, os.FileMode(mode))
+	case OpRemoveFile:
+		return removeFile(args[0])
+	case OpInstallService:
+		return installService(args[0], args[1], args[2:])
+	case OpStartService:
+		return startService(args[0])
+	case OpStopService:
+		return stopService(args[0])
+	case OpReloadService:
+		return reloadService(args[0])
+	case OpInstallCronJob:
+		return installCronJob(args[0], args[1])
+	case OpRemoveCronJob:
+		return removeCronJob(args[0], args[1])
+	case OpAddRepository:
+		return addRepository(args)
+	case OpInstallPackage:
+		return installPackage(args[0], args[1], stdin)
+	case OpInstallCertificate:
+		return installCertificate(args[0], args[1], args[2])
+	}
+	return fmt.Errorf("unknown operation %q", op)
+}
+
+// writeFile replaces path with data atomically
+func writeFile(path string, data []byte, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return replaceFile(path, data, mode, -1, -1)
+}
+
+// replaceFile replaces path with data atomically, owned by uid and gid; -1 keeps the
+// writer's
+func replaceFile(path string, data []byte, mode os.FileMode, uid, gid int) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chown(uid, gid); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func run(cmd *exec.Cmd) error {
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+package privsep
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Repository families add-repository configures
+const (
+	RepositoryApt = "apt"
+	RepositoryRpm = "rpm"
+)
+
+// The WARP client repository. Its files are rendered here and the apt key is downloaded
+// here, so the agent never supplies the sources, the repository definition or the key the
+// package manager trusts.
+const (
+	warpPackageHost    = "https://pkg.cloudflareclient.com"
+	warpAptKeyring     = "/usr/share/keyrings/cloudflare-warp-archive-keyring.gpg"
+	warpAptSourcesList = "/etc/apt/sources.list.d/cloudflare-client.list"
+	warpRpmRepoFile    = "/etc/yum.repos.d/cloudflare-warp.repo"
+	maxRepositoryKey   = 1 << 20
+	repositoryTimeout  = 30 * time.Second
+)
+
+var warpRpmRepo = `[cloudflare-warp-stable]
+name=cloudflare-warp-stable
+baseurl=` + warpPackageHost + `/rpm
+type=rpm
+enabled=1
+gpgcheck=1
+gpgkey=` + warpPackageHost + `/pubkey.gpg
+`
+
+var (
+	codenamePattern    = regexp.MustCompile(`^[a-z][a-z0-9-]{0,31}$`)
+	fingerprintPattern = regexp.MustCompile(`^[0-9A-Fa-f]{40}$`)
+	fingerprintCleaner = strings.NewReplacer(" ", "", ":", "")
+)
+
+// AddRepository configures Cloudflare's WARP client repository: for RepositoryApt the
+// release codename and, optionally, the fingerprint the repository key must have; nothing
+// for RepositoryRpm, whose packages dnf checks against the gpgkey the definition names
+func AddRepository(family string, params ...string) error {
+	return do(nil, OpAddRepository, append([]string{family}, params...)...)
+}
+
+func checkAddRepository(args []string) error {
+	switch {
+	case len(args) == 1 && args[0] == RepositoryRpm:
+		return nil
+	case (len(args) == 2 || len(args) == 3) && args[0] == RepositoryApt:
+		if !codenamePattern.MatchString(args[1]) {
+			return fmt.Errorf("invalid release codename %q", args[1])
+		}
+		if len(args) == 3 && !fingerprintPattern.MatchString(fingerprintCleaner.Replace(args[2])) {
+			return fmt.Errorf("invalid key fingerprint %q", args[2])
+		}
+		return nil
+	}
+	return fmt.Errorf("want add-repository apt <codename> [<fingerprint>] or add-repository rpm")
+}
+
+func addRepository(args []string) error {
+	if args[0] == RepositoryRpm {
+		return writeFile(warpRpmRepoFile, []byte(warpRpmRepo), 0644)
+	}
+
+	arch := runtime.GOARCH
+	if arch != "amd64" && arch != "arm64" {
+		return fmt.Errorf("Cloudflare publishes no WARP client packages for %s", arch)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), repositoryTimeout)
+	defer cancel()
+	armored, err := fetchRepositoryKey(ctx, warpPackageHost+"/pubkey.gpg")
+	if err != nil {
+		return fmt.Errorf("failed to download the repository key: %w", err)
+	}
+	key, err := dearmorOpenPGP(armored)
+	if err != nil {
+		return fmt.Errorf("invalid repository key: %w", err)
+	}
+	actual, err := openPGPFingerprint(key)
+	if err != nil {
+		return fmt.Errorf("invalid repository key: %w", err)
+	}
+	if len(args) == 3 && !strings.EqualFold(fingerprintCleaner.Replace(args[2]), actual) {
+		return fmt.Errorf("repository key fingerprint %s does not match the configured %s", actual, args[2])
+	}
+
+	if err := writeFile(warpAptKeyring, key, 0644); err != nil {
+		return fmt.Errorf("failed to write the repository key: %w", err)
+	}
+	source := fmt.Sprintf("deb [arch=%s signed-by=%s] %s/ %s main\n", arch, warpAptKeyring, warpPackageHost, args[1])
+	if err := writeFile(warpAptSourcesList, []byte(source), 0644); err != nil {
+		return fmt.Errorf("failed to write the repository source: %w", err)
+	}
+	return nil
+}
+
+func fetchRepositoryKey(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := (&http.Client{Timeout: repositoryTimeout}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxRepositoryKey+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxRepositoryKey {
+		return nil, fmt.Errorf("GET %s: response exceeds %d bytes", url, maxRepositoryKey)
+	}
+	return data, nil
+}
+
+// dearmorOpenPGP decodes an ASCII-armored OpenPGP block into the binary form apt expects in
+// a signed-by keyring; binary input is returned as is
+func dearmorOpenPGP(data []byte) ([]byte, error) {
+	text := string(bytes.TrimSpace(data))
+	if !strings.HasPrefix(text, "-----BEGIN PGP") {
+		return data, nil
+	}
+
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	var body strings.Builder
+	inHeaders := true
+	for _, line := range lines[1:] {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "-----END PGP"):
+			decoded, err := base64.StdEncoding.DecodeString(body.String())
+			if err != nil {
+				return nil, err
+			}
+			if len(decoded) == 0 {
+				return nil, fmt.Errorf("empty armored block")
+			}
+			return decoded, nil
+		case inHeaders:
+			// Armor headers such as "Version: ..." end at the first blank line
+			if line == "" {
+				inHeaders = false
+			} else if !strings.Contains(line, ": ") {
+				inHeaders = false
+				body.WriteString(line)
+			}
+		case strings.HasPrefix(line, "="):
+			// CRC-24 checksum line; TLS already protects the transfer
+		default:
+			body.WriteString(line)
+		}
+	}
+	return nil, fmt.Errorf("unterminated armored block")
+}
+
+// openPGPFingerprint returns the v4 fingerprint of the primary key, the first packet of key
+func openPGPFingerprint(key []byte) (string, error) {
+	if len(key) < 2 || key[0]&0x80 == 0 {
+		return "", fmt.Errorf("not an OpenPGP packet")
+	}
+
+	var tag byte
+	var length, offset int
+	if key[0]&0x40 != 0 {
+		// New format header
+		tag = key[0] & 0x3f
+		switch first := int(key[1]); {
+		case first < 192:
+			length, offset = first, 2
+		case first < 224 && len(key) >= 3:
+			length, offset = (first-192)<<8+int(key[2])+192, 3
+		case first == 255 && len(key) >= 6:
+			length, offset = int(binary.BigEndian.Uint32(key[2:6])), 6
+		default:
+			return "", fmt.Errorf("unsupported packet length")
+		}
+	} else {
+		// Old format header
+		tag = (key[0] >> 2) & 0x0f
+		switch key[0] & 0x03 {
+		case 0:
+			length, offset = int(key[1]), 2
+		case 1:
+			if len(key) < 3 {
+				return "", fmt.Errorf("truncated packet")
+			}
+			length, offset = int(binary.BigEndian.Uint16(key[1:3])), 3
+		case 2:
+			if len(key) < 5 {
+				return "", fmt.Errorf("truncated packet")
+			}
+			length, offset = int(binary.BigEndian.Uint32(key[1:5])), 5
+		default:
+			return "", fmt.Errorf("unsupported packet length")
+		}
+	}
+
+	if tag != 6 {
+		return "", fmt.Errorf("first packet is not a public key")
+	}
+	if length > 0xffff || offset+length > len(key) {
+		return "", fmt.Errorf("truncated public key packet")
+	}
+	body := key[offset : offset+length]
+	if len(body) == 0 || body[0] != 4 {
+		return "", fmt.Errorf("unsupported public key version")
+	}
+
+	hash := sha1.New()
+	hash.Write([]byte{0x99, byte(length >> 8), byte(length)})
+	hash.Write(body)
+	return strings.ToUpper(hex.EncodeToString(hash.Sum(nil))), nil
+}
@@ -0,0 +1,506 @@
+package privsep
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+)
+
+// Init systems
+const (
+	InitSystemd = "systemd"
+	InitOpenRC  = "openrc"
+	InitNone    = "none" // the helper starts the processes and tracks their pids itself
+)
+
+// Where cron jobs go: /etc/cron.d, or root's crontab on busybox cron, which has no cron.d
+const (
+	CronDir = "cron.d"
+	CronTab = "crontab"
+)
+
+const (
+	crontabFile        = "/etc/crontabs/root"
+	serviceStopTimeout = 10 * time.Second
+)
+
+// configPathPattern matches the configuration files Hysteria2 may run on
+var configPathPattern = regexp.MustCompile(`^/[A-Za-z0-9_./-]+\.(yaml|yml|json)$`)
+
+// ServiceSpec describes an installed service; the helper renders it from managedServices
+type ServiceSpec struct {
+	Name        string // without the .service suffix
+	Description string
+	Command     []string
+	OneShot     bool // runs once at boot, e.g. to restore firewall rules
+	EarlyBoot   bool // starts before the network is up
+}
+
+// managedService is a service the agent may install. Its command is fixed but for the
+// parameters the agent passes, which it validates.
+type managedService struct {
+	description string
+	oneShot     bool
+	earlyBoot   bool
+	params      int
+	command     func(params []string) ([]string, error)
+}
+
+var managedServices = map[string]managedService{
+	"hysteria2": {
+		description: "Hysteria2 VPN Server",
+		params:      1, // the configuration file
+		command: func(params []string) ([]string, error) {
+			return []string{"/usr/local/bin/hysteria", "server", "-c", params[0]}, nil
+		},
+	},
+	"hysteria2-firewall": {
+		description: "Hysteria2 agent firewall",
+		oneShot:     true,
+		earlyBoot:   true,
+		command: func([]string) ([]string, error) {
+			nft, err := resolve("nft")
+			return []string{nft, "-f", FirewallRuleset}, err
+		},
+	},
+	"warp-svc": {
+		description: "Cloudflare WARP daemon",
+		command: func([]string) ([]string, error) {
+			warp, err := resolve("warp-svc")
+			return []string{warp}, err
+		},
+	},
+}
+
+func (s managedService) checkParams(params []string) error {
+	if len(params) != s.params {
+		return fmt.Errorf("want %d parameter(s), got %d", s.params, len(params))
+	}
+	for _, param := range params {
+		if filepath.Clean(param) != param || !configPathPattern.MatchString(param) {
+			return fmt.Errorf("invalid configuration path %q", param)
+		}
+	}
+	return nil
+}
+
+// cronJob is a job the agent may install, run as root
+type cronJob struct {
+	schedule string
+	command  string
+}
+
+var cronJobs = map[string]cronJob{
+	"hysteria-cert-renewal": {
+		schedule: "0 3 * * *",
+		command:  "/usr/local/bin/hysteria-agent renew-certificates >> /var/log/hysteria-renewal.log 2>&1",
+	},
+}
+
+var openRCTemplate = template.Must(template.New("openrc").Parse(`#!/sbin/openrc-run
+# Installed by hysteria2-agent
+
+description="{{ .Description }}"
+{{- if .OneShot }}
+
+depend() {
+{{- if .EarlyBoot }}
+	before net
+{{- end }}
+}
+
+start() {
+	ebegin "Starting ${RC_SVCNAME}"
+	{{ .Exec }}
+	eend $?
+}
+{{- else }}
+command="{{ .Binary }}"
+command_args="{{ .Args }}"
+command_background=true
+pidfile="/run/${RC_SVCNAME}.pid"
+output_log="{{ .Log }}"
+error_log="{{ .Log }}"
+
+depend() {
+	need net
+}
+{{- end }}
+`))
+
+var systemdTemplate = template.Must(template.New("systemd").Parse(`[Unit]
+Description={{ .Description }}
+{{- if .EarlyBoot }}
+DefaultDependencies=no
+Before=network-pre.target
+Wants=network-pre.target
+{{- else }}
+After=network-online.target
+Wants=network-online.target
+{{- end }}
+
+[Service]
+{{- if .OneShot }}
+Type=oneshot
+RemainAfterExit=yes
+{{- else }}
+Type=simple
+Restart=always
+RestartSec=5
+{{- end }}
+ExecStart={{ .Exec }}
+
+[Install]
+WantedBy={{ if .EarlyBoot }}sysinit.target{{ else }}multi-user.target{{ end }}
+`))
+
+// ServiceLogFile is where a service the init system does not log for writes its output
+func ServiceLogFile(name string) string {
+	return "/var/log/" + name + ".log"
+}
+
+// ServiceRunning reports whether a service the helper started without an init system runs.
+// It needs no privileges.
+func ServiceRunning(name string) bool {
+	spec, err := loadService(name)
+	if err != nil {
+		return false
+	}
+	_, ok := servicePID(spec)
+	return ok
+}
+
+func serviceSpec(name string, params []string) (*ServiceSpec, error) {
+	service, ok := managedServices[name]
+	if !ok {
+		return nil, fmt.Errorf("service %q is not allowed", name)
+	}
+	if err := service.checkParams(params); err != nil {
+		return nil, err
+	}
+	command, err := service.command(params)
+	if err != nil {
+		return nil, err
+	}
+	return &ServiceSpec{
+		Name:        name,
+		Description: service.description,
+		Command:     command,
+		OneShot:     service.oneShot,
+		EarlyBoot:   service.earlyBoot,
+	}, nil
+}
+
+// installService renders a service for the init system and enables it at boot, without
+// starting it. Without an init system the definition is kept for startService.
+func installService(init, name string, params []string) error {
+	spec, err := serviceSpec(name, params)
+	if err != nil {
+		return err
+	}
+	data := struct {
+		ServiceSpec
+		Exec   string
+		Binary string
+		Args   string
+		Log    string
+	}{
+		ServiceSpec: *spec,
+		Exec:        shellJoin(spec.Command),
+		Binary:      spec.Command[0],
+		Args:        shellJoin(spec.Command[1:]),
+		Log:         ServiceLogFile(spec.Name),
+	}
+
+	var buf bytes.Buffer
+	switch init {
+	case InitSystemd:
+		if err := systemdTemplate.Execute(&buf, data); err != nil {
+			return err
+		}
+		if err := writeFile("/etc/systemd/system/"+name+".service", buf.Bytes(), 0644); err != nil {
+			return fmt.Errorf("failed to write unit: %w", err)
+		}
+		if err := runRoot("systemctl", "daemon-reload"); err != nil {
+			return err
+		}
+		return runRoot("systemctl", "enable", name)
+	case InitOpenRC:
+		if err := openRCTemplate.Execute(&buf, data); err != nil {
+			return err
+		}
+		if err := writeFile("/etc/init.d/"+name, buf.Bytes(), 0755); err != nil {
+			return fmt.Errorf("failed to write init script: %w", err)
+		}
+		runlevel := "default"
+		if spec.EarlyBoot {
+			runlevel = "boot"
+		}
+		return runRoot("rc-update", "add", name, runlevel)
+	case InitNone:
+		definition, err := json.Marshal(spec)
+		if err != nil {
+			return err
+		}
+		if err := ensureStateDir(); err != nil {
+			return err
+		}
+		return writeFile(filepath.Join(ServiceStateDir, name+".json"), definition, 0644)
+	}
+	return fmt.Errorf("init system %q is not supported", init)
+}
+
+// startService starts a service installed without an init system, in its own session so it
+// outlives the caller, and records its pid
+func startService(name string) error {
+	spec, err := loadService(name)
+	if err != nil {
+		return err
+	}
+	if _, ok := servicePID(spec); ok {
+		return nil
+	}
+	if spec.OneShot {
+		return runRoot(spec.Command[0], spec.Command[1:]...)
+	}
+	log, err := os.OpenFile(ServiceLogFile(name), os.O_CREATE|os.O_WRONLY|os.O_APPEND|syscall.O_NOFOLLOW, 0640)
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+
+	cmd := exec.Command(spec.Command[0], spec.Command[1:]...)
+	cmd.Env = rootEnv
+	cmd.Stdout = log
+	cmd.Stderr = log
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: %w", name, err)
+	}
+	pid := cmd.Process.Pid
+	// Reap the process if it exits while the caller runs
+	go cmd.Wait()
+	return writeFile(pidFile(name), []byte(strconv.Itoa(pid)), 0644)
+}
+
+// stopService stops a service started by startService: TERM, then KILL once
+// serviceStopTimeout passes
+func stopService(name string) error {
+	spec, err := loadService(name)
+	if err != nil {
+		return err
+	}
+	pid, ok := servicePID(spec)
+	if !ok {
+		return removeFile(pidFile(name))
+	}
+	defer removeFile(pidFile(name))
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		return nil
+	}
+	deadline := time.Now().Add(serviceStopTimeout)
+	for time.Now().Before(deadline) {
+		if _, ok := servicePID(spec); !ok {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return syscall.Kill(pid, syscall.SIGKILL)
+}
+
+// reloadService asks a service started by startService to reread its configuration
+func reloadService(name string) error {
+	spec, err := loadService(name)
+	if err != nil {
+		return err
+	}
+	pid, ok := servicePID(spec)
+	if !ok {
+		return fmt.Errorf("%s is not running", name)
+	}
+	return syscall.Kill(pid, syscall.SIGHUP)
+}
+
+func pidFile(name string) string {
+	return filepath.Join(ServiceStateDir, name+".pid")
+}
+
+// loadService reads the definition installService kept, from the root-owned state directory
+func loadService(name string) (*ServiceSpec, error) {
+	if _, ok := managedServices[name]; !ok {
+		return nil, fmt.Errorf("service %q is not allowed", name)
+	}
+	data, err := os.ReadFile(filepath.Join(ServiceStateDir, name+".json"))
+	if err != nil {
+		return nil, fmt.Errorf("service %s is not installed: %w", name, err)
+	}
+	var spec ServiceSpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, fmt.Errorf("invalid service %s: %w", name, err)
+	}
+	if len(spec.Command) == 0 {
+		return nil, fmt.Errorf("service %s has no command", name)
+	}
+	return &spec, nil
+}
+
+// servicePID returns the pid of a running service. The pid file alone is not trusted: the
+// process must be root's and run the service's command line, so a stale or forged pid never
+// gets a signal meant for the service.
+func servicePID(spec *ServiceSpec) (int, bool) {
+	data, err := os.ReadFile(pidFile(spec.Name))
+	if err != nil {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 1 {
+		return 0, false
+	}
+	proc := "/proc/" + strconv.Itoa(pid)
+	info, err := os.Stat(proc)
+	if err != nil {
+		return 0, false
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); !ok || stat.Uid != 0 {
+		return 0, false
+	}
+	cmdline, err := os.ReadFile(proc + "/cmdline")
+	if err != nil {
+		return 0, false
+	}
+	args := strings.Split(strings.TrimSuffix(string(cmdline), "\x00"), "\x00")
+	if strings.Join(args, "\x00") != strings.Join(spec.Command, "\x00") {
+		return 0, false
+	}
+	return pid, true
+}
+
+// ensureStateDir creates the service state directory, or takes back one left writable by
+// others, so only root writes definitions and pid files
+func ensureStateDir() error {
+	if err := os.MkdirAll(ServiceStateDir, 0755); err != nil {
+		return err
+	}
+	info, err := os.Lstat(ServiceStateDir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", ServiceStateDir)
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && (stat.Uid != 0 || stat.Gid != 0) {
+		if err := os.Chown(ServiceStateDir, 0, 0); err != nil {
+			return err
+		}
+	}
+	return os.Chmod(ServiceStateDir, 0755)
+}
+
+// installCronJob installs a known job in /etc/cron.d, or in root's crontab on busybox cron
+func installCronJob(where, name string) error {
+	job, ok := cronJobs[name]
+	if !ok {
+		return fmt.Errorf("cron job %q is not allowed", name)
+	}
+	if where == CronTab {
+		return editCrontab(name, job.schedule+" "+job.command)
+	}
+	content := fmt.Sprintf("# Installed by hysteria2-agent\n%s root %s\n", job.schedule, job.command)
+	return writeFile("/etc/cron.d/"+name, []byte(content), 0644)
+}
+
+// removeCronJob removes a job installCronJob added
+func removeCronJob(where, name string) error {
+	if _, ok := cronJobs[name]; !ok {
+		return fmt.Errorf("cron job %q is not allowed", name)
+	}
+	if where == CronTab {
+		return editCrontab(name, "")
+	}
+	return removeFile("/etc/cron.d/" + name)
+}
+
+// editCrontab replaces the lines of job name in root's crontab with line, or removes them
+// when line is empty
+func editCrontab(name, line string) error {
+	data, err := os.ReadFile(crontabFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	marker := "# hysteria2-agent: " + name
+
+	var out []string
+	skip := false
+	for _, existing := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		switch {
+		case existing == marker:
+			skip = true
+			continue
+		case skip:
+			skip = false
+			continue
+		case existing == "" && len(out) == 0:
+			continue
+		}
+		out = append(out, existing)
+	}
+	if line != "" {
+		out = append(out, marker, line)
+	}
+	content := strings.Join(out, "\n")
+	if content != "" {
+		content += "\n"
+	}
+	return writeFile(crontabFile, []byte(content), 0600)
+}
+
+// rootEnv is the environment of the commands run as root: nothing the agent sets reaches them
+var rootEnv = []string{"PATH=" + strings.Join(trustedDirs, ":"), "LANG=C", "DEBIAN_FRONTEND=noninteractive"}
+
+// runRoot runs a command from the trusted directories with rootEnv
+func runRoot(name string, args ...string) error {
+	path := name
+	if !filepath.IsAbs(name) {
+		var err error
+		if path, err = resolve(name); err != nil {
+			return err
+		}
+	}
+	cmd := exec.Command(path, args...)
+	cmd.Env = rootEnv
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %w: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// shellJoin quotes the arguments that need it for a shell or an ExecStart line
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg != "" && !strings.ContainsAny(arg, " \t\n\"'\\$`;&|<>*?()[]{}#~") {
+			quoted[i] = arg
+		} else {
+			quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+func removeFile(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
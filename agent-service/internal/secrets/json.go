@@ -0,0 +1,85 @@
+package secrets
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// secretJSONKeys are the fields of generated Hysteria2 and Xray configs holding secrets:
+// auth, Salamander, trojan and Shadowsocks passwords, the Reality private key and the
+// Hysteria2 traffic stats API secret
+var secretJSONKeys = map[string]bool{
+	"password":   true,
+	"privateKey": true,
+	"secret":     true,
+}
+
+// secretJSONMaps are objects whose every value is a secret, such as Hysteria2 userpass auth
+// and the DNS provider credentials of ACME DNS challenges
+var secretJSONMaps = map[string]bool{
+	"userpass": true,
+	"config":   true,
+}
+
+// SealJSON seals the secret fields of a generated config. Values that are already sealed
+// are kept, so a config can be sealed again after it was edited.
+func (k *Keyring) SealJSON(data []byte) ([]byte, error) {
+	return transformJSON(data, func(key string, value string, inMap bool) (string, error) {
+		if IsSealed(value) || value == "" || !(inMap || secretJSONKeys[key]) {
+			return value, nil
+		}
+		return k.Seal(value)
+	})
+}
+
+// OpenJSON decrypts every sealed string in a generated config
+func (k *Keyring) OpenJSON(data []byte) ([]byte, error) {
+	return transformJSON(data, func(key string, value string, inMap bool) (string, error) {
+		return k.Open(value)
+	})
+}
+
+// ContainsSealed reports whether any string in a JSON or YAML document is sealed; YAML
+// leaves sealed values unquoted
+func ContainsSealed(data []byte) bool {
+	return bytes.Contains(data, []byte(Prefix))
+}
+
+func transformJSON(data []byte, fn func(key, value string, inMap bool) (string, error)) ([]byte, error) {
+	var document interface{}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	document, err := transformValue(document, "", false, fn)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(document, "", "  ")
+}
+
+func transformValue(value interface{}, key string, inMap bool, fn func(key, value string, inMap bool) (string, error)) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return fn(key, v, inMap)
+	case map[string]interface{}:
+		for field, item := range v {
+			transformed, err := transformValue(item, field, secretJSONMaps[key], fn)
+			if err != nil {
+				return nil, err
+			}
+			v[field] = transformed
+		}
+		return v, nil
+	case []interface{}:
+		for i, item := range v {
+			transformed, err := transformValue(item, key, false, fn)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = transformed
+		}
+		return v, nil
+	default:
+		return value, nil
+	}
+}
@@ -0,0 +1,105 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"hysteria2_microservices/pkg/secretstore"
+)
+
+// Provider reads secrets from an external store. Config secret fields may hold a
+// reference "<provider>:<name>" instead of the value:
+//
+//	env:HY2_AUTH_PASSWORD              an environment variable
+//	file:/run/secrets/auth_password    a file
+//	vault:hysteryvpn/nodes/de1#auth    a field of a Vault KV v2 secret, "value" by default
+//	kms:AQICAHh...                     an AWS KMS ciphertext blob
+type Provider interface {
+	Get(ctx context.Context, name string) (string, error)
+}
+
+// Resolver resolves references through the configured providers
+type Resolver struct {
+	providers map[string]Provider
+}
+
+// NewResolver creates a resolver over providers keyed by reference prefix
+func NewResolver(providers map[string]Provider) *Resolver {
+	return &Resolver{providers: providers}
+}
+
+// NewResolverFromEnv configures the env and file providers, Vault when VAULT_ADDR is set
+// and AWS KMS when AWS_REGION is set
+func NewResolverFromEnv() *Resolver {
+	providers := map[string]Provider{
+		"env":  EnvProvider{},
+		"file": FileProvider{},
+	}
+	if addr := os.Getenv("VAULT_ADDR"); addr != "" {
+		providers["vault"] = secretstore.NewVaultProvider(addr, os.Getenv("VAULT_TOKEN"), os.Getenv("VAULT_NAMESPACE"), os.Getenv("VAULT_KV_MOUNT"))
+	}
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		providers["kms"] = secretstore.NewKMSProvider(region, os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN"))
+	}
+	return NewResolver(providers)
+}
+
+// IsReference reports whether value names a secret in one of the configured providers.
+// Sealed values are not references, their "enc" prefix has no provider.
+func (r *Resolver) IsReference(value string) bool {
+	_, _, ok := r.provider(value)
+	return ok
+}
+
+// Resolve returns the secret value refers to, or value itself when it is not a reference
+func (r *Resolver) Resolve(ctx context.Context, value string) (string, error) {
+	provider, name, ok := r.provider(value)
+	if !ok {
+		return value, nil
+	}
+	secret, err := provider.Get(ctx, name)
+	if err != nil {
+		prefix, _, _ := strings.Cut(value, ":")
+		return "", fmt.Errorf("failed to read %s secret: %w", prefix, err)
+	}
+	return secret, nil
+}
+
+func (r *Resolver) provider(value string) (Provider, string, bool) {
+	prefix, name, ok := strings.Cut(value, ":")
+	if !ok || name == "" {
+		return nil, "", false
+	}
+	provider, ok := r.providers[prefix]
+	return provider, name, ok
+}
+
+// EnvProvider reads environment variables
+type EnvProvider struct{}
+
+// Get returns the variable name, failing when it is unset or empty
+func (EnvProvider) Get(ctx context.Context, name string) (string, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return value, nil
+}
+
+// FileProvider reads secrets from files
+type FileProvider struct{}
+
+// Get returns the file contents without the trailing newline
+func (FileProvider) Get(ctx context.Context, name string) (string, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	value := strings.TrimRight(string(data), "\r\n")
+	if value == "" {
+		return "", fmt.Errorf("%s is empty", name)
+	}
+	return value, nil
+}
@@ -0,0 +1,186 @@
+// Package secrets seals configuration secrets to the node's X25519 key, so passwords,
+// license keys and private keys are not stored in plaintext on disk.
+//
+// A sealed value is "enc:v1:" followed by base64 of the ephemeral public key, the nonce
+// and the AES-256-GCM ciphertext. Every value is encrypted with its own data key, derived
+// from an ephemeral key exchange with the node key, so values can be sealed with only the
+// node's public key while opening them needs the private key kept on the node.
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Prefix marks a sealed value
+const Prefix = "enc:v1:"
+
+const keyInfo = "hysteryvpn secrets v1"
+
+// ErrNoKey is returned when sealed values are found but the node key does not exist
+var ErrNoKey = errors.New("node secret key not found")
+
+// Keyring holds the node's private key
+type Keyring struct {
+	private *ecdh.PrivateKey
+}
+
+// IsSealed reports whether value was produced by Seal
+func IsSealed(value string) bool {
+	return strings.HasPrefix(value, Prefix)
+}
+
+// GenerateKey writes a new node key to path, failing if one already exists
+func GenerateKey(path string) (*Keyring, error) {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create key directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create node key: %w", err)
+	}
+	if _, err := f.WriteString(base64.StdEncoding.EncodeToString(private.Bytes()) + "\n"); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to write node key: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return &Keyring{private: private}, nil
+}
+
+// LoadKey reads the node key from path
+func LoadKey(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w at %s", ErrNoKey, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read node key: %w", err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid node key %s: %w", path, err)
+	}
+	private, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid node key %s: %w", path, err)
+	}
+	return &Keyring{private: private}, nil
+}
+
+// LoadOrGenerateKey reads the node key from path, creating it on first use
+func LoadOrGenerateKey(path string) (*Keyring, error) {
+	keyring, err := LoadKey(path)
+	if errors.Is(err, ErrNoKey) {
+		return GenerateKey(path)
+	}
+	return keyring, err
+}
+
+// PublicKey returns the base64 public key that values for this node are sealed to
+func (k *Keyring) PublicKey() string {
+	return base64.StdEncoding.EncodeToString(k.private.PublicKey().Bytes())
+}
+
+// Seal encrypts plaintext to this node's key
+func (k *Keyring) Seal(plaintext string) (string, error) {
+	return seal(k.private.PublicKey(), plaintext)
+}
+
+// SealTo encrypts plaintext to a node's base64 public key
+func SealTo(publicKey, plaintext string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(publicKey))
+	if err != nil {
+		return "", fmt.Errorf("invalid public key: %w", err)
+	}
+	recipient, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid public key: %w", err)
+	}
+	return seal(recipient, plaintext)
+}
+
+// Open decrypts a sealed value; values without the prefix are returned unchanged, so
+// configs can mix sealed and plaintext fields
+func (k *Keyring) Open(value string) (string, error) {
+	if !IsSealed(value) {
+		return value, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, Prefix))
+	if err != nil {
+		return "", fmt.Errorf("invalid sealed value: %w", err)
+	}
+	const keySize = 32
+	if len(data) < keySize {
+		return "", fmt.Errorf("invalid sealed value: too short")
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(data[:keySize])
+	if err != nil {
+		return "", fmt.Errorf("invalid sealed value: %w", err)
+	}
+	aead, err := dataKey(k.private, ephemeral, k.private.PublicKey())
+	if err != nil {
+		return "", err
+	}
+	data = data[keySize:]
+	if len(data) < aead.NonceSize() {
+		return "", fmt.Errorf("invalid sealed value: too short")
+	}
+	plaintext, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to open sealed value, it was sealed to another node key")
+	}
+	return string(plaintext), nil
+}
+
+func seal(recipient *ecdh.PublicKey, plaintext string) (string, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	aead, err := dataKey(ephemeral, recipient, recipient)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	out := append(ephemeral.PublicKey().Bytes(), nonce...)
+	out = aead.Seal(out, nonce, []byte(plaintext), nil)
+	return Prefix + base64.StdEncoding.EncodeToString(out), nil
+}
+
+// dataKey derives the AES-256-GCM key of one value from the key exchange between the
+// ephemeral and node keys, bound to the node's public key
+func dataKey(private *ecdh.PrivateKey, peer, recipient *ecdh.PublicKey) (cipher.AEAD, error) {
+	shared, err := private.ECDH(peer)
+	if err != nil {
+		return nil, fmt.Errorf("key exchange failed: %w", err)
+	}
+	key, err := hkdf.Key(sha256.New, shared, recipient.Bytes(), keyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,181 @@
+package secrets
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestKeyring(t *testing.T) *Keyring {
+	keyring, err := GenerateKey(filepath.Join(t.TempDir(), "node.key"))
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	return keyring
+}
+
+func TestSealOpen(t *testing.T) {
+	keyring := newTestKeyring(t)
+
+	sealed, err := keyring.Seal("hunter2")
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	if !IsSealed(sealed) || strings.Contains(sealed, "hunter2") {
+		t.Errorf("sealed value %q", sealed)
+	}
+	if again, _ := keyring.Seal("hunter2"); again == sealed {
+		t.Error("sealing twice gave the same value")
+	}
+	if opened, err := keyring.Open(sealed); err != nil || opened != "hunter2" {
+		t.Errorf("Open = %q, %v", opened, err)
+	}
+
+	// Values sealed with only the public key open on the node
+	sealed, err = SealTo(keyring.PublicKey(), "license-key")
+	if err != nil {
+		t.Fatalf("SealTo: %v", err)
+	}
+	if opened, err := keyring.Open(sealed); err != nil || opened != "license-key" {
+		t.Errorf("Open of a value sealed to the public key = %q, %v", opened, err)
+	}
+
+	if opened, err := keyring.Open("plain"); err != nil || opened != "plain" {
+		t.Errorf("Open of a plaintext value = %q, %v", opened, err)
+	}
+}
+
+func TestOpenRejectsOtherKeysAndTampering(t *testing.T) {
+	keyring := newTestKeyring(t)
+	sealed, _ := keyring.Seal("hunter2")
+
+	if _, err := newTestKeyring(t).Open(sealed); err == nil {
+		t.Error("another node key opened the value")
+	}
+
+	raw := []byte(sealed)
+	raw[len(raw)-2] ^= 1
+	if _, err := keyring.Open(string(raw)); err == nil {
+		t.Error("opened a tampered value")
+	}
+	for _, value := range []string{Prefix + "!!", Prefix + "c2hvcnQ="} {
+		if _, err := keyring.Open(value); err == nil {
+			t.Errorf("opened malformed value %q", value)
+		}
+	}
+	if _, err := SealTo("not a key", "x"); err == nil {
+		t.Error("sealed to an invalid public key")
+	}
+}
+
+func TestKeyFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys", "node.key")
+
+	if _, err := LoadKey(path); !errors.Is(err, ErrNoKey) {
+		t.Errorf("LoadKey of a missing key = %v, want ErrNoKey", err)
+	}
+	generated, err := LoadOrGenerateKey(path)
+	if err != nil {
+		t.Fatalf("LoadOrGenerateKey: %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("key file %v, %v; want it readable by its owner only", info, err)
+	}
+	loaded, err := LoadOrGenerateKey(path)
+	if err != nil || loaded.PublicKey() != generated.PublicKey() {
+		t.Errorf("second LoadOrGenerateKey = %v, %v; want the existing key", loaded, err)
+	}
+	if _, err := GenerateKey(path); err == nil {
+		t.Error("GenerateKey replaced an existing key")
+	}
+
+	os.WriteFile(path, []byte("not base64"), 0600)
+	if _, err := LoadKey(path); err == nil || errors.Is(err, ErrNoKey) {
+		t.Errorf("LoadKey of a corrupt key = %v", err)
+	}
+}
+
+func TestSealJSON(t *testing.T) {
+	keyring := newTestKeyring(t)
+	config := `{
+  "listen": ":443",
+  "auth": {"type": "userpass", "userpass": {"alice": "pw1", "bob": "pw2"}},
+  "obfs": {"type": "salamander", "salamander": {"password": "obfs-pw"}},
+  "inbounds": [{"streamSettings": {"realitySettings": {"privateKey": "reality-key", "shortIds": ["ab"]}}}],
+  "trafficStats": {"secret": ""}
+}`
+
+	sealed, err := keyring.SealJSON([]byte(config))
+	if err != nil {
+		t.Fatalf("SealJSON: %v", err)
+	}
+	for _, secret := range []string{"pw1", "pw2", "obfs-pw", "reality-key"} {
+		if strings.Contains(string(sealed), `"`+secret+`"`) {
+			t.Errorf("%s left in plaintext:\n%s", secret, sealed)
+		}
+	}
+	for _, kept := range []string{`":443"`, `"salamander"`, `"ab"`, `"secret": ""`} {
+		if !strings.Contains(string(sealed), kept) {
+			t.Errorf("%s not kept as is:\n%s", kept, sealed)
+		}
+	}
+	if !ContainsSealed(sealed) || ContainsSealed([]byte(config)) {
+		t.Error("ContainsSealed does not tell sealed configs apart")
+	}
+
+	// Sealing again keeps the sealed values
+	resealed, err := keyring.SealJSON(sealed)
+	if err != nil || string(resealed) != string(sealed) {
+		t.Errorf("SealJSON of a sealed config changed it: %v\n%s", err, resealed)
+	}
+
+	opened, err := keyring.OpenJSON(sealed)
+	if err != nil {
+		t.Fatalf("OpenJSON: %v", err)
+	}
+	var want, got interface{}
+	json.Unmarshal([]byte(config), &want)
+	json.Unmarshal(opened, &got)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("opened config:\n%s\nwant:\n%s", opened, config)
+	}
+}
+
+func TestSealYAML(t *testing.T) {
+	keyring := newTestKeyring(t)
+	config := `# Generated by the agent
+listen: :443
+auth:
+  type: password
+  password: auth-pw
+obfs:
+  type: salamander
+  salamander:
+    password: obfs-pw
+bandwidth:
+  up: 1 gbps
+`
+
+	sealed, err := keyring.SealYAML([]byte(config))
+	if err != nil {
+		t.Fatalf("SealYAML: %v", err)
+	}
+	if strings.Contains(string(sealed), "auth-pw") || strings.Contains(string(sealed), "obfs-pw") {
+		t.Errorf("passwords left in plaintext:\n%s", sealed)
+	}
+	if !strings.HasPrefix(string(sealed), "# Generated by the agent\nlisten: :443\nauth:") {
+		t.Errorf("comments or key order not kept:\n%s", sealed)
+	}
+
+	opened, err := keyring.OpenYAML(sealed)
+	if err != nil {
+		t.Fatalf("OpenYAML: %v", err)
+	}
+	if string(opened) != config {
+		t.Errorf("opened config:\n%s\nwant:\n%s", opened, config)
+	}
+}
@@ -0,0 +1,74 @@
+package secrets
+
+import (
+	"bytes"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SealYAML seals the secret fields of a generated YAML config, like SealJSON. The document
+// keeps its key order and comments.
+func (k *Keyring) SealYAML(data []byte) ([]byte, error) {
+	return transformYAML(data, func(key string, value string, inMap bool) (string, error) {
+		if IsSealed(value) || value == "" || !(inMap || secretJSONKeys[key]) {
+			return value, nil
+		}
+		return k.Seal(value)
+	})
+}
+
+// OpenYAML decrypts every sealed string in a generated YAML config
+func (k *Keyring) OpenYAML(data []byte) ([]byte, error) {
+	return transformYAML(data, func(key string, value string, inMap bool) (string, error) {
+		return k.Open(value)
+	})
+}
+
+func transformYAML(data []byte, fn func(key, value string, inMap bool) (string, error)) ([]byte, error) {
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	if err := transformNode(&document, "", false, fn); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&document); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func transformNode(node *yaml.Node, key string, inMap bool, fn func(key, value string, inMap bool) (string, error)) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if node.Tag != "!!str" {
+			return nil
+		}
+		value, err := fn(key, node.Value, inMap)
+		if err != nil {
+			return err
+		}
+		node.Value = value
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			field := node.Content[i].Value
+			if err := transformNode(node.Content[i+1], field, secretJSONMaps[key], fn); err != nil {
+				return err
+			}
+		}
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, item := range node.Content {
+			if err := transformNode(item, key, false, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,441 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"hysteria2_microservices/agent-service/internal/config"
+	"hysteria2_microservices/agent-service/internal/privsep"
+)
+
+// Reasons the node stops admitting new connections
+const (
+	AdmissionReasonConnections = "connections"
+	AdmissionReasonBandwidth   = "bandwidth"
+)
+
+const (
+	admissionTable     = "hysteria2_admission"
+	admissionGateChain = "gate"
+
+	admissionDefaultInterval = 10 * time.Second
+
+	// admissionReopenRatio reopens a node closed for bandwidth once traffic drops below 90%
+	// of the cap, so admission does not flap around it
+	admissionReopenRatio = 0.9
+
+	conntrackProcFile = "/proc/net/nf_conntrack"
+	netDevProcFile    = "/proc/net/dev"
+)
+
+// CapacityLimits are the caps the node enforces, 0 leaves a cap unset
+type CapacityLimits struct {
+	MaxConnections int `json:"max_connections"`
+	MaxMbps        int `json:"max_mbps"`
+}
+
+// CapacityUtilization is what the node used of its capacity at the last measurement
+type CapacityUtilization struct {
+	Connections     int       `json:"connections"`
+	Mbps            float64   `json:"mbps"`
+	RxBytesPerSec   float64   `json:"rx_bytes_per_sec"` // received on the default interface
+	TxBytesPerSec   float64   `json:"tx_bytes_per_sec"` // sent on the default interface
+	AdmissionClosed bool      `json:"admission_closed"`
+	Reason          string    `json:"reason,omitempty"` // AdmissionReason* while closed
+	MeasuredAt      time.Time `json:"measured_at"`
+}
+
+// AdmissionControllerImpl rejects new connections to the public ports once the node is at
+// capacity. The connection cap is an nftables connlimit, so it holds between measurements;
+// the bandwidth cap closes a gate chain while the measured traffic is over it. Connections
+// already open are never cut. The rules live in their own table, hooked before the
+// firewall's, and are installed whether or not the agent manages the firewall.
+type AdmissionControllerImpl struct {
+	logger *logrus.Logger
+	config *config.Config
+
+	mu          sync.Mutex
+	limits      CapacityLimits
+	installed   string // ruleset in force, replaced only when it changes
+	gateClosed  bool
+	utilization *CapacityUtilization
+
+	lastRx, lastTx uint64
+	lastAt         time.Time
+}
+
+// NewAdmissionController creates a new AdmissionController
+func NewAdmissionController(logger *logrus.Logger, cfg *config.Config) AdmissionController {
+	return &AdmissionControllerImpl{
+		logger: logger,
+		config: cfg,
+		limits: CapacityLimits{
+			MaxConnections: cfg.Capacity.MaxConnections,
+			MaxMbps:        cfg.Capacity.MaxMbps,
+		},
+	}
+}
+
+// Start restores the limits the orchestrator set and measures the node every
+// capacity.check_interval seconds until ctx is done
+func (ac *AdmissionControllerImpl) Start(ctx context.Context) error {
+	ac.mu.Lock()
+	data, err := os.ReadFile(ac.config.Capacity.StateFile)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		ac.logger.Warnf("Ignoring unreadable capacity limits: %v", err)
+	default:
+		var limits CapacityLimits
+		if err := json.Unmarshal(data, &limits); err != nil {
+			ac.logger.Warnf("Ignoring invalid capacity limits: %v", err)
+		} else {
+			ac.limits = limits
+		}
+	}
+	if err := ac.install(); err != nil {
+		ac.logger.Errorf("Capacity limits are not enforced: %v", err)
+	}
+	ac.mu.Unlock()
+
+	interval := time.Duration(ac.config.Capacity.CheckInterval) * time.Second
+	if interval <= 0 {
+		interval = admissionDefaultInterval
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			ac.measure()
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	ac.logger.Infof("Admission control started: max %d connections, max %d Mbps", ac.limits.MaxConnections, ac.limits.MaxMbps)
+	return nil
+}
+
+// SetLimits saves and enforces new limits
+func (ac *AdmissionControllerImpl) SetLimits(limits CapacityLimits) error {
+	if limits.MaxConnections < 0 || limits.MaxMbps < 0 {
+		return fmt.Errorf("capacity limits must not be negative")
+	}
+
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	data, err := json.MarshalIndent(limits, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(ac.config.Capacity.StateFile), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(ac.config.Capacity.StateFile, data, 0600); err != nil {
+		return fmt.Errorf("failed to save capacity limits: %w", err)
+	}
+	ac.limits = limits
+
+	// A gate closed under the previous bandwidth cap is checked again at the next measurement
+	if limits.MaxMbps == 0 {
+		ac.gateClosed = false
+	}
+	if err := ac.install(); err != nil {
+		return err
+	}
+	ac.logger.Infof("Capacity limits set: max %d connections, max %d Mbps", limits.MaxConnections, limits.MaxMbps)
+	return nil
+}
+
+// Limits returns the limits in force
+func (ac *AdmissionControllerImpl) Limits() CapacityLimits {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	return ac.limits
+}
+
+// Utilization returns the last measurement, nil before the first one
+func (ac *AdmissionControllerImpl) Utilization() *CapacityUtilization {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if ac.utilization == nil {
+		return nil
+	}
+	utilization := *ac.utilization
+	return &utilization
+}
+
+// measure counts the client connections and the traffic and opens or closes the gate
+func (ac *AdmissionControllerImpl) measure() {
+	services := publicServiceRules(ac.config)
+
+	connections, err := countServiceConnections(services)
+	if err != nil {
+		ac.logger.Debugf("Failed to count client connections: %v", err)
+	}
+
+	mbps, rxRate, txRate := 0.0, 0.0, 0.0
+	now := time.Now()
+	rx, tx, err := interfaceBytes(ac.config.Network.DefaultInterface)
+	if err != nil {
+		ac.logger.Debugf("Failed to read interface counters: %v", err)
+	}
+
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	// The cap applies to the busier direction; counters reset with the interface are skipped
+	measured := false
+	if err == nil && !ac.lastAt.IsZero() && rx >= ac.lastRx && tx >= ac.lastTx {
+		if elapsed := now.Sub(ac.lastAt).Seconds(); elapsed > 0 {
+			rxRate = float64(rx-ac.lastRx) / elapsed
+			txRate = float64(tx-ac.lastTx) / elapsed
+			mbps = max(rxRate, txRate) * 8 / 1e6
+			measured = true
+		}
+	}
+	if err == nil {
+		ac.lastRx, ac.lastTx, ac.lastAt = rx, tx, now
+	}
+
+	limits := ac.limits
+	closed := ac.gateClosed
+	switch {
+	case limits.MaxMbps == 0:
+		closed = false
+	case !measured:
+		// Keep the gate as it is until traffic can be measured again
+	case !closed && mbps >= float64(limits.MaxMbps):
+		closed = true
+	case closed && mbps < float64(limits.MaxMbps)*admissionReopenRatio:
+		closed = false
+	}
+	if closed != ac.gateClosed {
+		ac.gateClosed = closed
+		if err := ac.install(); err != nil {
+			ac.logger.Errorf("Failed to update admission gate: %v", err)
+		} else if closed {
+			ac.logger.Warnf("Traffic at %.0f Mbps reached the %d Mbps cap, rejecting new connections", mbps, limits.MaxMbps)
+		} else {
+			ac.logger.Infof("Traffic down to %.0f Mbps, admitting new connections again", mbps)
+		}
+	}
+
+	utilization := &CapacityUtilization{
+		Connections:   connections,
+		Mbps:          mbps,
+		RxBytesPerSec: rxRate,
+		TxBytesPerSec: txRate,
+		MeasuredAt:    now.UTC(),
+	}
+	switch {
+	case ac.gateClosed:
+		utilization.AdmissionClosed = true
+		utilization.Reason = AdmissionReasonBandwidth
+	case limits.MaxConnections > 0 && connections >= limits.MaxConnections:
+		utilization.AdmissionClosed = true
+		utilization.Reason = AdmissionReasonConnections
+	}
+	ac.utilization = utilization
+}
+
+// install brings the admission table in line with the limits; callers hold mu. The table
+// is only replaced when the connection cap or the ports change, since replacing it resets
+// the connections counted against the cap; the gate chain is flushed on its own.
+func (ac *AdmissionControllerImpl) install() error {
+	services := publicServiceRules(ac.config)
+	if ac.limits.MaxConnections == 0 && ac.limits.MaxMbps == 0 || len(services) == 0 {
+		if ac.installed != "" {
+			if err := runNFT(fmt.Sprintf("delete table inet %s\n", admissionTable)); err != nil {
+				return fmt.Errorf("failed to remove admission rules: %w", err)
+			}
+			ac.installed = ""
+		}
+		return nil
+	}
+	if _, err := exec.LookPath("nft"); err != nil {
+		return fmt.Errorf("capacity limits need nftables: nft is not installed")
+	}
+
+	ruleset := admissionRuleset(services, ac.limits.MaxConnections)
+	if ruleset != ac.installed {
+		if err := runNFT(ruleset); err != nil {
+			return fmt.Errorf("failed to install admission rules: %w", err)
+		}
+		ac.installed = ruleset
+	}
+
+	gate := fmt.Sprintf("flush chain inet %s %s\n", admissionTable, admissionGateChain)
+	if ac.gateClosed {
+		gate += fmt.Sprintf("add rule inet %s %s reject comment \"bandwidth cap\"\n", admissionTable, admissionGateChain)
+	}
+	if err := runNFT(gate); err != nil {
+		return fmt.Errorf("failed to update admission gate: %w", err)
+	}
+	return nil
+}
+
+// admissionRuleset renders the table rejecting new connections to the public ports when the
+// gate is closed or maxConnections are open
+func admissionRuleset(services []FirewallRule, maxConnections int) string {
+	elements := make([]string, 0, len(services))
+	for _, rule := range services {
+		elements = append(elements, fmt.Sprintf("%s . %s", rule.Protocol, rule.Ports))
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "table inet %s\ndelete table inet %s\n\n", admissionTable, admissionTable)
+	fmt.Fprintf(&b, "table inet %s {\n", admissionTable)
+	b.WriteString("\tchain input {\n")
+	b.WriteString("\t\ttype filter hook input priority filter - 10; policy accept;\n\n")
+	b.WriteString("\t\tct state != new accept\n")
+	fmt.Fprintf(&b, "\t\tmeta l4proto . th dport != { %s } accept\n", strings.Join(elements, ", "))
+	fmt.Fprintf(&b, "\t\tjump %s\n", admissionGateChain)
+	if maxConnections > 0 {
+		fmt.Fprintf(&b, "\t\tct count over %d reject comment \"connection cap\"\n", maxConnections)
+	}
+	b.WriteString("\t}\n\n")
+	fmt.Fprintf(&b, "\tchain %s {\n\t}\n", admissionGateChain)
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// nftScriptMu keeps one script written and loaded at a time
+var nftScriptMu sync.Mutex
+
+// runNFT loads an nft script. The privilege helper only lets nft read the fixed script
+// file, so the script is written there first.
+func runNFT(script string) error {
+	nftScriptMu.Lock()
+	defer nftScriptMu.Unlock()
+	if err := privsep.WriteFile(privsep.NFTScript, []byte(script), 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", privsep.NFTScript, err)
+	}
+	if output, err := privsep.Command("nft", "-f", privsep.NFTScript).CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// countServiceConnections counts the tracked connections to the public ports, reading the
+// conntrack table from procfs or, on kernels without it, from the conntrack tool
+func countServiceConnections(services []FirewallRule) (int, error) {
+	f, err := os.Open(conntrackProcFile)
+	if err == nil {
+		defer f.Close()
+		return countConntrackEntries(f, services)
+	}
+
+	output, err := privsep.Command("conntrack", "-L").Output()
+	if err != nil {
+		return 0, fmt.Errorf("conntrack table is not readable: %w", err)
+	}
+	return countConntrackEntries(strings.NewReader(string(output)), services)
+}
+
+// countConntrackEntries counts the entries whose original destination is one of the
+// services. TCP connections being torn down no longer count, as they do not for connlimit.
+func countConntrackEntries(r io.Reader, services []FirewallRule) (int, error) {
+	count := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var protocol string
+		port := 0
+		closing := false
+		for _, field := range strings.Fields(scanner.Text()) {
+			switch {
+			case protocol == "" && (field == "tcp" || field == "udp"):
+				protocol = field
+			case port == 0 && strings.HasPrefix(field, "dport="):
+				port, _ = strconv.Atoi(strings.TrimPrefix(field, "dport="))
+			case field == "TIME_WAIT" || field == "CLOSE" || field == "CLOSE_WAIT" || field == "LAST_ACK" || field == "FIN_WAIT":
+				closing = true
+			}
+		}
+		if protocol == "" || port == 0 || closing {
+			continue
+		}
+		for _, rule := range services {
+			if rule.Protocol == protocol && portInRange(rule.Ports, port) {
+				count++
+				break
+			}
+		}
+	}
+	return count, scanner.Err()
+}
+
+// portInRange reports whether port is ports ("443") or within it ("20000-50000")
+func portInRange(ports string, port int) bool {
+	start, end, isRange := strings.Cut(ports, "-")
+	first, err := strconv.Atoi(start)
+	if err != nil {
+		return false
+	}
+	if !isRange {
+		return port == first
+	}
+	last, err := strconv.Atoi(end)
+	return err == nil && port >= first && port <= last
+}
+
+// interfaceBytes returns the bytes the interface received and sent. Without an interface
+// every interface but loopback is summed.
+func interfaceBytes(iface string) (rx, tx uint64, err error) {
+	f, err := os.Open(netDevProcFile)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	found := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		name, counters, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		name = strings.TrimSpace(name)
+		if name == "lo" || iface != "" && name != iface {
+			continue
+		}
+		fields := strings.Fields(counters)
+		if len(fields) < 9 {
+			continue
+		}
+		received, err1 := strconv.ParseUint(fields[0], 10, 64)
+		sent, err2 := strconv.ParseUint(fields[8], 10, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		rx += received
+		tx += sent
+		found = true
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, 0, err
+	}
+	if !found {
+		return 0, 0, fmt.Errorf("interface %s not found", iface)
+	}
+	return rx, tx, nil
+}
@@ -0,0 +1,53 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Servers the agent can stop on shutdown and start again on its next start
+const (
+	ServerHysteria2 = "hysteria2"
+	ServerXray      = "xray"
+)
+
+// AgentState records how the agent last stopped. It is written as not clean when the agent
+// starts and replaced on a graceful shutdown, so a crash or kill leaves Clean false.
+type AgentState struct {
+	Clean          bool      `json:"clean"`
+	StartedAt      time.Time `json:"started_at"`
+	StoppedAt      time.Time `json:"stopped_at,omitempty"`
+	StoppedServers []string  `json:"stopped_servers,omitempty"` // servers the agent stopped on shutdown
+}
+
+// LoadAgentState reads the state file; a missing file returns os.ErrNotExist
+func LoadAgentState(path string) (*AgentState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var state AgentState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("invalid agent state %s: %w", path, err)
+	}
+	return &state, nil
+}
+
+// SaveAgentState replaces the state file atomically
+func SaveAgentState(path string, state *AgentState) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
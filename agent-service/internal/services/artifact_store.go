@@ -0,0 +1,93 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"hysteria2_microservices/agent-service/internal/config"
+)
+
+// errArtifactNotFound is returned for files the orchestrator's store does not list
+var errArtifactNotFound = errors.New("artifact not found in store")
+
+// artifactStore downloads release files from the orchestrator's artifact store in offline
+// mode. Files live at <component>/<version>/<asset>, <component>/latest names the default
+// version, and every download is checked against the store's SHA256SUMS listing.
+type artifactStore struct {
+	baseURL string
+	client  *http.Client
+}
+
+// newArtifactStore returns the configured store, or nil when the agent installs online
+func newArtifactStore(cfg *config.Config) *artifactStore {
+	if !cfg.Artifacts.Offline {
+		return nil
+	}
+	return &artifactStore{
+		baseURL: strings.TrimRight(cfg.Artifacts.URL, "/"),
+		client: &http.Client{
+			Timeout:   binaryDownloadTimeout,
+			Transport: &bearerTransport{token: cfg.Artifacts.Token, base: http.DefaultTransport},
+		},
+	}
+}
+
+// latest reads the version the operator marked as default for component
+func (s *artifactStore) latest(ctx context.Context, component string) (string, error) {
+	url, err := s.url(component + "/latest")
+	if err != nil {
+		return "", err
+	}
+	data, err := fetch(ctx, s.client, url)
+	if err != nil {
+		return "", fmt.Errorf("failed to read latest %s version from artifact store: %w", component, err)
+	}
+	version := strings.TrimSpace(string(data))
+	if version == "" {
+		return "", fmt.Errorf("artifact store has an empty %s/latest", component)
+	}
+	return version, nil
+}
+
+// download saves the store file name to dest if its SHA-256 matches the store listing
+func (s *artifactStore) download(ctx context.Context, name, dest string) error {
+	sumsURL, err := s.url("SHA256SUMS")
+	if err != nil {
+		return err
+	}
+	listing, err := fetch(ctx, s.client, sumsURL)
+	if err != nil {
+		return fmt.Errorf("failed to download artifact checksums: %w", err)
+	}
+	expected := releaseAssetHash(string(listing), name)
+	if expected == "" {
+		return fmt.Errorf("%s: %w", name, errArtifactNotFound)
+	}
+	url, _ := s.url(name)
+	if err := downloadVerified(ctx, s.client, url, expected, dest); err != nil {
+		return fmt.Errorf("failed to download %s from artifact store: %w", name, err)
+	}
+	return nil
+}
+
+func (s *artifactStore) url(name string) (string, error) {
+	if s.baseURL == "" {
+		return "", fmt.Errorf("offline mode requires artifacts.url")
+	}
+	return s.baseURL + "/" + name, nil
+}
+
+// bearerTransport authenticates store requests with the node auth token
+type bearerTransport struct {
+	token string
+	base  http.RoundTripper
+}
+
+func (t *bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+t.token)
+	return t.base.RoundTrip(req)
+}
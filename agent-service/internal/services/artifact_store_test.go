@@ -0,0 +1,178 @@
+package services
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"hysteria2_microservices/agent-service/internal/config"
+)
+
+func newTestArtifactStore(t *testing.T, token string) (*artifactStore, *fakeArtifactStore) {
+	server := newFakeArtifactStore(t, "node-token")
+	cfg := &config.Config{}
+	cfg.Artifacts = config.ArtifactsConfig{Offline: true, URL: server.URL + "/", Token: token}
+	return newArtifactStore(cfg), server
+}
+
+// tarGz packs files, in order, into a gzipped tarball
+func tarGz(t *testing.T, files ...[2]string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, file := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: file[0], Mode: 0644, Size: int64(len(file[1])), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(file[1]))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestArtifactStoreOnlyInOfflineMode(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Artifacts.URL = "https://orchestrator.example.com/artifacts"
+	if newArtifactStore(cfg) != nil {
+		t.Error("artifact store used while online")
+	}
+
+	cfg.Artifacts = config.ArtifactsConfig{Offline: true}
+	if err := newArtifactStore(cfg).download(context.Background(), "decoy/site.tar.gz", filepath.Join(t.TempDir(), "site")); err == nil {
+		t.Error("downloaded without a store URL")
+	}
+}
+
+func TestArtifactStoreLatest(t *testing.T) {
+	store, server := newTestArtifactStore(t, "node-token")
+	server.put("hysteria2/latest", []byte(" v2.6.1\n"))
+	server.put("xray/latest", []byte("\n"))
+
+	if version, err := store.latest(context.Background(), "hysteria2"); err != nil || version != "v2.6.1" {
+		t.Errorf("latest hysteria2 = %q, %v", version, err)
+	}
+	if _, err := store.latest(context.Background(), "xray"); err == nil {
+		t.Error("accepted an empty latest file")
+	}
+	if _, err := store.latest(context.Background(), "warp"); err == nil {
+		t.Error("accepted a missing latest file")
+	}
+}
+
+func TestArtifactStoreDownload(t *testing.T) {
+	store, server := newTestArtifactStore(t, "node-token")
+	server.put("warp/cloudflare-warp-amd64.deb", []byte("package"))
+	server.put("warp/cloudflare-warp-arm64.deb", []byte("package"))
+	server.tamper("warp/cloudflare-warp-arm64.deb")
+	dir := t.TempDir()
+
+	dest := filepath.Join(dir, "warp.deb")
+	if err := store.download(context.Background(), "warp/cloudflare-warp-amd64.deb", dest); err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	if data, _ := os.ReadFile(dest); string(data) != "package" {
+		t.Errorf("downloaded %q", data)
+	}
+
+	err := store.download(context.Background(), "warp/cloudflare-warp-arm64.deb", filepath.Join(dir, "arm64.deb"))
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("download of a tampered file = %v, want a checksum mismatch", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "arm64.deb")); !os.IsNotExist(err) {
+		t.Error("tampered file kept")
+	}
+
+	if err := store.download(context.Background(), "decoy/site.tar.gz", filepath.Join(dir, "site")); !errors.Is(err, errArtifactNotFound) {
+		t.Errorf("download of an unlisted file = %v, want errArtifactNotFound", err)
+	}
+
+	// The store rejects other tokens
+	stranger, _ := newTestArtifactStore(t, "other-token")
+	stranger.baseURL = store.baseURL
+	if err := stranger.download(context.Background(), "warp/cloudflare-warp-amd64.deb", filepath.Join(dir, "stranger.deb")); err == nil {
+		t.Error("downloaded with the wrong token")
+	}
+}
+
+func TestDecoyInstallsSiteFromArtifacts(t *testing.T) {
+	dm, cfg := newTestDecoy(t, nil)
+	server := useArtifactStore(t, cfg)
+	server.put("decoy/site.tar.gz", tarGz(t,
+		[2]string{"index.html", "<title>Operator site</title>"},
+		[2]string{"../../escape.txt", "contained"},
+		[2]string{"img/logo.svg", "<svg/>"},
+	))
+
+	if err := dm.InstallSite(); err != nil {
+		t.Fatalf("InstallSite: %v", err)
+	}
+	if index, _ := os.ReadFile(filepath.Join(cfg.Decoy.SiteDir, "index.html")); string(index) != "<title>Operator site</title>" {
+		t.Errorf("index.html = %q, want the operator's site", index)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.Decoy.SiteDir, "img", "logo.svg")); err != nil {
+		t.Errorf("nested file not installed: %v", err)
+	}
+	// Entries climbing out of the archive land inside the site directory
+	if _, err := os.Stat(filepath.Join(cfg.Decoy.SiteDir, "escape.txt")); err != nil {
+		t.Errorf("escaping entry not contained: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(cfg.Decoy.SiteDir), "escape.txt")); !os.IsNotExist(err) {
+		t.Error("archive wrote outside the site directory")
+	}
+}
+
+func TestDecoyInstallFallsBackToBundledSite(t *testing.T) {
+	dm, cfg := newTestDecoy(t, nil)
+	server := useArtifactStore(t, cfg)
+
+	if err := dm.InstallSite(); err != nil {
+		t.Fatalf("InstallSite without a site in the store: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.Decoy.SiteDir, "about.html")); err != nil {
+		t.Errorf("bundled site not installed: %v", err)
+	}
+
+	// An archive without an index page is an error, not a fallback
+	dm, cfg = newTestDecoy(t, nil)
+	server = useArtifactStore(t, cfg)
+	server.put("decoy/site.tar.gz", tarGz(t, [2]string{"site/index.html", "nested"}))
+	if err := dm.InstallSite(); err == nil || !strings.Contains(err.Error(), "no index.html") {
+		t.Errorf("InstallSite with a nested index = %v", err)
+	}
+}
+
+func TestHysteriaInstallFromArtifacts(t *testing.T) {
+	cfg := &config.Config{}
+	server := useArtifactStore(t, cfg)
+	server.put("hysteria2/latest", []byte("v2.6.1\n"))
+	server.put(hysteriaArtifact("v2.6.1"), fakeBinary("Version:	v2.6.1"))
+	cfg.Hysteria2.BinaryPath = filepath.Join(t.TempDir(), "bin", "hysteria")
+	hm := NewHysteriaManager(testLogger(), cfg)
+
+	if err := hm.InstallHysteria2(); err != nil {
+		t.Fatalf("InstallHysteria2: %v", err)
+	}
+	if got, _ := binaryVersion(cfg.Hysteria2.BinaryPath); got != "v2.6.1" {
+		t.Errorf("installed binary reports %q, want the latest release", got)
+	}
+
+	// A pinned version missing from the store leaves the installed binary alone
+	cfg.Hysteria2.Version = "2.6.2"
+	if err := hm.InstallHysteria2(); !errors.Is(err, errArtifactNotFound) {
+		t.Errorf("InstallHysteria2 of a missing release = %v, want errArtifactNotFound", err)
+	}
+	if got, _ := binaryVersion(cfg.Hysteria2.BinaryPath); got != "v2.6.1" {
+		t.Errorf("installed binary reports %q after a failed install", got)
+	}
+}
@@ -0,0 +1,461 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"hysteria2_microservices/agent-service/internal/config"
+	"hysteria2_microservices/agent-service/internal/privsep"
+)
+
+// Authentication failure sources watched by the guard
+const (
+	BruteForceSourceHysteria2 = "hysteria2"
+	BruteForceSourceXray      = "xray"
+	BruteForceSourceSSH       = "ssh"
+)
+
+// Ban event types reported to the orchestrator
+const (
+	BanEventBanned   = "ip_banned"
+	BanEventUnbanned = "ip_unbanned"
+)
+
+const (
+	bruteForceSweepInterval = 30 * time.Second
+	bruteForceRestartDelay  = 5 * time.Second
+	bruteForcePollInterval  = time.Second
+)
+
+// authFailurePatterns capture the client address of a failed login. Xray logs the
+// address with its port and an optional "tcp:"/"udp:" prefix; sshd logs it bare.
+var authFailurePatterns = map[string][]*regexp.Regexp{
+	BruteForceSourceHysteria2: {
+		regexp.MustCompile(`(?i)auth\w* (?:failed|error|rejected).*"addr":\s*"([^"]+)"`),
+	},
+	BruteForceSourceXray: {
+		regexp.MustCompile(`from (?:tcp:|udp:)?(\S+) rejected .*(?:invalid request user id|not a valid user|invalid user|failed to read request header)`),
+	},
+	BruteForceSourceSSH: {
+		regexp.MustCompile(`Failed (?:password|publickey|keyboard-interactive/pam) for (?:invalid user )?\S* from (\S+) port \d+`),
+		regexp.MustCompile(`Invalid user \S* from (\S+) port \d+`),
+		regexp.MustCompile(`maximum authentication attempts exceeded for (?:invalid user )?\S* from (\S+) port \d+`),
+		regexp.MustCompile(`Connection closed by (?:authenticating|invalid) user \S* (\S+) port \d+ \[preauth\]`),
+	},
+}
+
+// BanEntry is an address banned by the guard
+type BanEntry struct {
+	IP        string    `json:"ip"`
+	Source    string    `json:"source"`
+	Reason    string    `json:"reason"`
+	Failures  int       `json:"failures"`
+	BannedAt  time.Time `json:"banned_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// BanEvent is reported when an address is banned or its ban is lifted
+type BanEvent struct {
+	Type string
+	Ban  BanEntry
+}
+
+// BanEventReporter forwards ban events, typically to the orchestrator
+type BanEventReporter func(event BanEvent)
+
+// BruteForceGuardImpl follows the Hysteria2 and SSH journals and the Xray access log,
+// counts authentication failures per address and bans an address through the firewall
+// once it fails max_retries times within find_time. Bans expire after ban_time.
+type BruteForceGuardImpl struct {
+	logger   *logrus.Logger
+	config   *config.Config
+	firewall FirewallManager
+
+	mu       sync.Mutex
+	failures map[string][]time.Time
+	bans     map[string]BanEntry
+	reporter BanEventReporter
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	running  bool
+}
+
+// NewBruteForceGuard creates a new BruteForceGuard
+func NewBruteForceGuard(logger *logrus.Logger, cfg *config.Config, firewall FirewallManager) BruteForceGuard {
+	return &BruteForceGuardImpl{
+		logger:   logger,
+		config:   cfg,
+		firewall: firewall,
+		failures: make(map[string][]time.Time),
+		bans:     make(map[string]BanEntry),
+	}
+}
+
+// Start follows the configured log sources until ctx is cancelled or Stop is called
+func (g *BruteForceGuardImpl) Start(ctx context.Context) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.running {
+		return fmt.Errorf("brute-force guard is already running")
+	}
+	if !g.config.Firewall.Enabled {
+		return fmt.Errorf("brute-force guard needs the firewall to be enabled")
+	}
+	cfg := g.config.BruteForce
+	if cfg.MaxRetries < 1 || cfg.FindTime < 1 || cfg.BanTime < 1 {
+		return fmt.Errorf("max_retries, find_time and ban_time must be positive")
+	}
+	for _, entry := range cfg.Whitelist {
+		if _, _, err := net.ParseCIDR(entry); err != nil && net.ParseIP(entry) == nil {
+			return fmt.Errorf("invalid whitelist entry %q", entry)
+		}
+	}
+
+	guardCtx, cancel := context.WithCancel(ctx)
+	g.cancel = cancel
+	g.running = true
+
+	host := DetectHostOS(g.config)
+	for _, source := range cfg.Sources {
+		switch source {
+		case BruteForceSourceHysteria2:
+			g.follow(guardCtx, source, func(ctx context.Context, handle func(string)) error {
+				return host.FollowServiceLog(ctx, handle, hysteria2ServiceName)
+			})
+		case BruteForceSourceSSH:
+			g.follow(guardCtx, source, func(ctx context.Context, handle func(string)) error {
+				// Without journald sshd logs through syslog
+				if host.Init != InitSystemd {
+					return followFile(ctx, handle, host.AuthLogFile())
+				}
+				return host.FollowServiceLog(ctx, handle, "ssh", "sshd")
+			})
+		case BruteForceSourceXray:
+			g.follow(guardCtx, source, func(ctx context.Context, handle func(string)) error {
+				return followFile(ctx, handle, cfg.XrayAccessLog)
+			})
+		default:
+			g.logger.Warnf("Ignoring unknown brute-force source %q", source)
+		}
+	}
+
+	g.wg.Add(1)
+	go g.sweepLoop(guardCtx)
+
+	go func() {
+		<-guardCtx.Done()
+		g.Stop()
+	}()
+
+	g.logger.Infof("Brute-force guard watching %s: %d failures in %ds ban for %ds",
+		strings.Join(cfg.Sources, ", "), cfg.MaxRetries, cfg.FindTime, cfg.BanTime)
+	return nil
+}
+
+// Stop stops following the logs; active bans stay until they expire
+func (g *BruteForceGuardImpl) Stop() error {
+	g.mu.Lock()
+	if !g.running {
+		g.mu.Unlock()
+		return nil
+	}
+	g.running = false
+	g.cancel()
+	g.mu.Unlock()
+
+	g.wg.Wait()
+	g.logger.Info("Brute-force guard stopped")
+	return nil
+}
+
+// IsRunning reports whether the guard is following the logs
+func (g *BruteForceGuardImpl) IsRunning() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.running
+}
+
+// ListBans returns the active bans, soonest to expire first
+func (g *BruteForceGuardImpl) ListBans() []BanEntry {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	bans := make([]BanEntry, 0, len(g.bans))
+	for _, ban := range g.bans {
+		bans = append(bans, ban)
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].ExpiresAt.Before(bans[j].ExpiresAt) })
+	return bans
+}
+
+// Unban lifts a ban before it expires and forgets the address's failures
+func (g *BruteForceGuardImpl) Unban(ip string) error {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return fmt.Errorf("invalid IP address %q", ip)
+	}
+	ip = addr.String()
+
+	g.mu.Lock()
+	ban, banned := g.bans[ip]
+	if !banned {
+		g.mu.Unlock()
+		return fmt.Errorf("%s is not banned", ip)
+	}
+	delete(g.bans, ip)
+	delete(g.failures, ip)
+	g.mu.Unlock()
+
+	if err := g.firewall.Unban(ip); err != nil {
+		return err
+	}
+
+	g.logger.Infof("Unbanned %s", ip)
+	ban.Reason = "unbanned by operator"
+	g.report(BanEvent{Type: BanEventUnbanned, Ban: ban})
+	return nil
+}
+
+// SetEventReporter sets where ban events are sent
+func (g *BruteForceGuardImpl) SetEventReporter(reporter BanEventReporter) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.reporter = reporter
+}
+
+// follow runs a log follower for source and restarts it when it exits
+func (g *BruteForceGuardImpl) follow(ctx context.Context, source string, run func(ctx context.Context, handle func(string)) error) {
+	handle := func(line string) {
+		if ip := matchAuthFailure(source, line); ip != "" {
+			g.recordFailure(source, ip)
+		}
+	}
+
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		for {
+			err := run(ctx, handle)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				g.logger.Warnf("Brute-force guard lost %s log: %v", source, err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(bruteForceRestartDelay):
+			}
+		}
+	}()
+}
+
+// recordFailure counts a failure and bans ip once it reaches the threshold
+func (g *BruteForceGuardImpl) recordFailure(source, ip string) {
+	addr := net.ParseIP(ip)
+	if addr == nil || addr.IsLoopback() || sourcesContain(g.config.BruteForce.Whitelist, addr) {
+		return
+	}
+	ip = addr.String()
+
+	cfg := g.config.BruteForce
+	now := time.Now()
+
+	g.mu.Lock()
+	if _, banned := g.bans[ip]; banned {
+		g.mu.Unlock()
+		return
+	}
+	failures := append(recentFailures(g.failures[ip], now.Add(-time.Duration(cfg.FindTime)*time.Second)), now)
+	if len(failures) < cfg.MaxRetries {
+		g.failures[ip] = failures
+		g.mu.Unlock()
+		return
+	}
+	delete(g.failures, ip)
+	g.mu.Unlock()
+
+	banTime := time.Duration(cfg.BanTime) * time.Second
+	if err := g.firewall.Ban(ip, banTime); err != nil {
+		g.logger.Warnf("Failed to ban %s after %d %s authentication failures: %v", ip, len(failures), source, err)
+		return
+	}
+
+	ban := BanEntry{
+		IP:        ip,
+		Source:    source,
+		Reason:    fmt.Sprintf("%d %s authentication failures in %ds", len(failures), source, cfg.FindTime),
+		Failures:  len(failures),
+		BannedAt:  now,
+		ExpiresAt: now.Add(banTime),
+	}
+	g.mu.Lock()
+	g.bans[ip] = ban
+	g.mu.Unlock()
+
+	g.logger.Warnf("Banned %s for %s: %s", ip, banTime, ban.Reason)
+	g.report(BanEvent{Type: BanEventBanned, Ban: ban})
+}
+
+// sweepLoop lifts expired bans and drops stale failure counters
+func (g *BruteForceGuardImpl) sweepLoop(ctx context.Context) {
+	defer g.wg.Done()
+
+	ticker := time.NewTicker(bruteForceSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			g.sweep(time.Now())
+		}
+	}
+}
+
+func (g *BruteForceGuardImpl) sweep(now time.Time) {
+	g.mu.Lock()
+	var expired []BanEntry
+	for ip, ban := range g.bans {
+		if !now.Before(ban.ExpiresAt) {
+			expired = append(expired, ban)
+			delete(g.bans, ip)
+		}
+	}
+	since := now.Add(-time.Duration(g.config.BruteForce.FindTime) * time.Second)
+	for ip, failures := range g.failures {
+		if failures = recentFailures(failures, since); len(failures) == 0 {
+			delete(g.failures, ip)
+		} else {
+			g.failures[ip] = failures
+		}
+	}
+	g.mu.Unlock()
+
+	for _, ban := range expired {
+		if err := g.firewall.Unban(ban.IP); err != nil {
+			g.logger.Warnf("Failed to lift expired ban on %s: %v", ban.IP, err)
+		}
+		g.logger.Infof("Ban on %s expired", ban.IP)
+		ban.Reason = "ban expired"
+		g.report(BanEvent{Type: BanEventUnbanned, Ban: ban})
+	}
+}
+
+// report hands the event to the reporter without blocking the log followers
+func (g *BruteForceGuardImpl) report(event BanEvent) {
+	g.mu.Lock()
+	reporter := g.reporter
+	g.mu.Unlock()
+
+	if reporter != nil {
+		go reporter(event)
+	}
+}
+
+// matchAuthFailure returns the client address of an authentication failure logged by source, or ""
+func matchAuthFailure(source, line string) string {
+	for _, pattern := range authFailurePatterns[source] {
+		match := pattern.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		addr := match[1]
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			addr = host
+		}
+		if ip := net.ParseIP(strings.Trim(addr, "[]")); ip != nil {
+			return ip.String()
+		}
+	}
+	return ""
+}
+
+// recentFailures drops failures older than since; failures are in chronological order
+func recentFailures(failures []time.Time, since time.Time) []time.Time {
+	i := sort.Search(len(failures), func(i int) bool { return failures[i].After(since) })
+	return failures[i:]
+}
+
+// followCommand passes each line a long-running command writes to stdout to handle
+func followCommand(ctx context.Context, handle func(string), name string, args ...string) error {
+	cmd := privsep.CommandContext(ctx, name, args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		handle(scanner.Text())
+	}
+	if err := cmd.Wait(); err != nil {
+		return err
+	}
+	return scanner.Err()
+}
+
+// followFile passes lines appended to path to handle, reopening it after rotation or truncation
+func followFile(ctx context.Context, handle func(string), path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(file)
+
+	var partial string
+	for {
+		line, err := reader.ReadString('\n')
+		if err == nil {
+			offset += int64(len(line))
+			handle(partial + strings.TrimRight(line, "\r\n"))
+			partial = ""
+			continue
+		}
+		if err != io.EOF {
+			return err
+		}
+		offset += int64(len(line))
+		partial += line
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(bruteForcePollInterval):
+		}
+
+		current, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		opened, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		if !os.SameFile(current, opened) || current.Size() < offset {
+			return fmt.Errorf("%s was rotated", path)
+		}
+	}
+}
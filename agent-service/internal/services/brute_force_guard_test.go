@@ -0,0 +1,213 @@
+package services
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"hysteria2_microservices/agent-service/internal/config"
+)
+
+// fakeFirewall records bans instead of touching the ruleset
+type fakeFirewall struct {
+	FirewallManager
+	mu     sync.Mutex
+	banned map[string]time.Duration
+}
+
+func (f *fakeFirewall) Ban(ip string, duration time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.banned[ip] = duration
+	return nil
+}
+
+func (f *fakeFirewall) Unban(ip string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.banned, ip)
+	return nil
+}
+
+func (f *fakeFirewall) isBanned(ip string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.banned[ip]
+	return ok
+}
+
+func newTestBruteForceGuard() (*BruteForceGuardImpl, *fakeFirewall, chan BanEvent) {
+	cfg := &config.Config{}
+	cfg.BruteForce = config.BruteForceConfig{MaxRetries: 3, FindTime: 60, BanTime: 600, Whitelist: []string{"198.51.100.0/24"}}
+	firewall := &fakeFirewall{banned: map[string]time.Duration{}}
+	g := NewBruteForceGuard(testLogger(), cfg, firewall).(*BruteForceGuardImpl)
+	events := make(chan BanEvent, 4)
+	g.SetEventReporter(func(event BanEvent) { events <- event })
+	return g, firewall, events
+}
+
+func TestMatchAuthFailure(t *testing.T) {
+	tests := []struct {
+		source string
+		line   string
+		want   string
+	}{
+		{BruteForceSourceHysteria2, `2024-05-01T10:00:00Z	WARN	authentication failed	{"addr": "192.0.2.10:51234", "id": ""}`, "192.0.2.10"},
+		{BruteForceSourceHysteria2, `2024-05-01T10:00:00Z	INFO	client connected	{"addr": "192.0.2.10:51234", "id": "alice"}`, ""},
+		{BruteForceSourceXray, `2024/05/01 10:00:00 from tcp:[2001:db8::10]:443 rejected  proxy/vless/encoding: invalid request user id`, "2001:db8::10"},
+		{BruteForceSourceXray, `2024/05/01 10:00:00 from 192.0.2.11:40000 accepted tcp:example.com:443 [vless-in -> direct]`, ""},
+		{BruteForceSourceSSH, `Failed password for invalid user admin from 192.0.2.12 port 2222 ssh2`, "192.0.2.12"},
+		{BruteForceSourceSSH, `Invalid user oracle from 2001:db8::12 port 40000`, "2001:db8::12"},
+		{BruteForceSourceSSH, `Connection closed by authenticating user root 192.0.2.13 port 5555 [preauth]`, "192.0.2.13"},
+		{BruteForceSourceSSH, `Accepted publickey for root from 192.0.2.14 port 5555 ssh2`, ""},
+		{"unknown", `Failed password for root from 192.0.2.15 port 22 ssh2`, ""},
+	}
+	for _, tt := range tests {
+		if got := matchAuthFailure(tt.source, tt.line); got != tt.want {
+			t.Errorf("matchAuthFailure(%s, %q) = %q, want %q", tt.source, tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestBruteForceGuardBansAfterRetries(t *testing.T) {
+	g, firewall, events := newTestBruteForceGuard()
+
+	for i := 0; i < 2; i++ {
+		g.recordFailure(BruteForceSourceSSH, "192.0.2.20")
+	}
+	if firewall.isBanned("192.0.2.20") {
+		t.Fatal("banned before max_retries failures")
+	}
+	g.recordFailure(BruteForceSourceSSH, "192.0.2.20")
+	if firewall.banned["192.0.2.20"] != 10*time.Minute {
+		t.Fatalf("bans %v, want 192.0.2.20 for ban_time", firewall.banned)
+	}
+
+	event := <-events
+	if event.Type != BanEventBanned || event.Ban.IP != "192.0.2.20" || event.Ban.Failures != 3 || event.Ban.Source != BruteForceSourceSSH {
+		t.Errorf("event %+v, want a ban after 3 ssh failures", event)
+	}
+	if bans := g.ListBans(); len(bans) != 1 || bans[0].IP != "192.0.2.20" {
+		t.Errorf("ListBans = %+v", bans)
+	}
+
+	// Whitelisted and loopback addresses are never banned
+	for i := 0; i < 5; i++ {
+		g.recordFailure(BruteForceSourceSSH, "198.51.100.7")
+		g.recordFailure(BruteForceSourceSSH, "::1")
+	}
+	if len(firewall.banned) != 1 {
+		t.Errorf("bans %v, want only 192.0.2.20", firewall.banned)
+	}
+}
+
+func TestBruteForceGuardForgetsOldFailures(t *testing.T) {
+	g, firewall, _ := newTestBruteForceGuard()
+
+	// Two failures from before find_time do not count towards a ban
+	old := time.Now().Add(-2 * time.Minute)
+	g.failures["192.0.2.30"] = []time.Time{old, old.Add(time.Second)}
+	g.recordFailure(BruteForceSourceXray, "192.0.2.30")
+	if firewall.isBanned("192.0.2.30") {
+		t.Error("banned on failures older than find_time")
+	}
+
+	g.sweep(time.Now().Add(2 * time.Minute))
+	if len(g.failures) != 0 {
+		t.Errorf("failures %v kept past find_time", g.failures)
+	}
+}
+
+func TestBruteForceGuardLiftsBans(t *testing.T) {
+	g, firewall, events := newTestBruteForceGuard()
+	for _, ip := range []string{"192.0.2.40", "2001:db8::40"} {
+		for i := 0; i < 3; i++ {
+			g.recordFailure(BruteForceSourceHysteria2, ip)
+		}
+		<-events
+	}
+
+	if err := g.Unban("2001:0db8::40"); err != nil {
+		t.Fatalf("Unban: %v", err)
+	}
+	if event := <-events; event.Type != BanEventUnbanned || event.Ban.Reason != "unbanned by operator" {
+		t.Errorf("event %+v, want an operator unban", event)
+	}
+	if err := g.Unban("192.0.2.41"); err == nil {
+		t.Error("unbanned an address that is not banned")
+	}
+
+	g.sweep(time.Now().Add(11 * time.Minute))
+	if event := <-events; event.Type != BanEventUnbanned || event.Ban.IP != "192.0.2.40" || event.Ban.Reason != "ban expired" {
+		t.Errorf("event %+v, want the ban on 192.0.2.40 expired", event)
+	}
+	if len(firewall.banned) != 0 || len(g.ListBans()) != 0 {
+		t.Errorf("bans left after expiry: firewall %v, guard %v", firewall.banned, g.ListBans())
+	}
+}
+
+func TestBruteForceGuardStartValidates(t *testing.T) {
+	g, _, _ := newTestBruteForceGuard()
+	if err := g.Start(context.Background()); err == nil {
+		t.Error("started with the firewall disabled")
+	}
+
+	g.config.Firewall.Enabled = true
+	g.config.BruteForce.Whitelist = []string{"not-an-ip"}
+	if err := g.Start(context.Background()); err == nil {
+		t.Error("started with an invalid whitelist")
+	}
+	if g.IsRunning() {
+		t.Error("running after a failed start")
+	}
+}
+
+func TestFollowFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	if err := os.WriteFile(path, []byte("old line\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := make(chan string, 4)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- followFile(ctx, func(line string) { lines <- line }, path) }()
+
+	// Only lines appended after following starts are read, whole
+	time.Sleep(100 * time.Millisecond)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("first ")
+	f.Sync()
+	time.Sleep(100 * time.Millisecond)
+	f.WriteString("line\n")
+	f.Close()
+
+	select {
+	case line := <-lines:
+		if line != "first line" {
+			t.Errorf("line %q, want \"first line\"", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("appended line not read")
+	}
+
+	// A truncated log ends the follower so it is reopened
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("follower ended without an error after truncation")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("follower did not notice the truncation")
+	}
+}
@@ -1,6 +1,7 @@
 package services
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
@@ -12,13 +13,13 @@ import (
 	"net"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"hysteria2_microservices/agent-service/internal/config"
+	"hysteria2_microservices/agent-service/internal/privsep"
 )
 
 // CertificateManager handles SSL/TLS certificate management for SNI domains
@@ -65,14 +66,19 @@ type CertificateInfo struct {
 	NotAfter     time.Time `json:"not_after"`
 	IsSelfSigned bool      `json:"is_self_signed"`
 	Issuer       string    `json:"issuer"`
+	Source       string    `json:"source,omitempty"` // CertificateModeFiles or CertificateModeACME
 }
 
+// certbotTimeout bounds a certbot issuance or renewal
+const certbotTimeout = 5 * time.Minute
+
 type CertificateManagerImpl struct {
 	logger      *logrus.Logger
 	config      *config.Config
 	certDir     string
 	acmeClient  *acme.Client
 	certbotPath string
+	runner      *CommandRunner
 }
 
 // NewCertificateManager creates a new CertificateManager
@@ -92,6 +98,7 @@ func NewCertificateManager(logger *logrus.Logger, cfg *config.Config) Certificat
 		config:      cfg,
 		certDir:     certDir,
 		certbotPath: certbotPath,
+		runner:      NewCommandRunner(logger, cfg),
 	}
 }
 
@@ -391,21 +398,16 @@ func (cm *CertificateManagerImpl) InstallCertbot() error {
 
 	cm.logger.Info("Installing certbot...")
 
-	// Try different installation methods based on OS
-	commands := [][]string{
-		{"apt-get", "update", "-y"},
-		{"apt-get", "install", "certbot", "-y"},
-		{"yum", "install", "-y", "certbot"},
-		{"dnf", "install", "-y", "certbot"},
-	}
-
-	for i := 0; i < len(commands); i += 2 {
-		cmd := exec.Command(commands[i][0], commands[i][1:]...)
-		if err := cmd.Run(); err != nil {
-			cm.logger.Warnf("Failed to run %s: %v", commands[i][0], err)
-			continue
+	host := DetectHostOS(cm.config)
+	// certbot is in EPEL on CentOS and RHEL, not in their base repositories
+	if host.Family == OSFamilyRHEL && host.ID != "fedora" {
+		if err := host.InstallPackages("epel-release"); err != nil {
+			cm.logger.Warnf("Failed to enable EPEL: %v", err)
 		}
 	}
+	if err := host.InstallPackages("certbot"); err != nil {
+		return fmt.Errorf("failed to install certbot: %w", err)
+	}
 
 	// Check if certbot was installed
 	if !cm.IsLetsEncryptEnabled() {
@@ -416,15 +418,22 @@ func (cm *CertificateManagerImpl) InstallCertbot() error {
 	return nil
 }
 
-// CheckDNSResolution validates that domain resolves to this server
+// CheckDNSResolution validates that domain resolves to this server. A records must
+// include the node's public IPv4 address and, when the node has IPv6, AAAA records must
+// include its public IPv6 address: ACME servers prefer IPv6, so a stale AAAA record
+// fails validation even when the A record is correct.
 func (cm *CertificateManagerImpl) CheckDNSResolution(domain string) (bool, error) {
 	cm.logger.Infof("Checking DNS resolution for domain: %s", domain)
 
-	// Get server's public IP
-	publicIP, err := cm.getPublicIP()
-	if err != nil {
-		cm.logger.Warnf("Failed to get public IP: %v", err)
-		return false, err
+	// Get server's public IPs
+	publicIPv4, _ := cm.getPublicIP("tcp4")
+	var publicIPv6 string
+	if ipv6Enabled(cm.config) {
+		publicIPv6, _ = cm.getPublicIP("tcp6")
+	}
+	if publicIPv4 == "" && publicIPv6 == "" {
+		cm.logger.Warn("Failed to get public IP")
+		return false, fmt.Errorf("failed to get public IP")
 	}
 
 	// Resolve domain to IPs
@@ -434,29 +443,69 @@ func (cm *CertificateManagerImpl) CheckDNSResolution(domain string) (bool, error
 		return false, err
 	}
 
-	// Check if any IP matches our public IP
+	var v4Records, v6Records []string
 	for _, ip := range ips {
-		if ip.String() == publicIP {
-			cm.logger.Infof("DNS resolution successful: %s -> %s", domain, publicIP)
-			return true, nil
+		if ip.To4() != nil {
+			v4Records = append(v4Records, ip.String())
+		} else {
+			v6Records = append(v6Records, ip.String())
 		}
 	}
 
-	cm.logger.Warnf("Domain %s does not resolve to server IP %s", domain, publicIP)
-	return false, fmt.Errorf("domain does not resolve to server IP")
+	v4Match := publicIPv4 != "" && containsIP(v4Records, publicIPv4)
+	v6Match := publicIPv6 != "" && containsIP(v6Records, publicIPv6)
+
+	switch {
+	case len(v4Records) > 0 && publicIPv4 != "" && !v4Match:
+		cm.logger.Warnf("Domain %s A records %v do not include server IP %s", domain, v4Records, publicIPv4)
+		return false, fmt.Errorf("A records do not point to server IP %s", publicIPv4)
+	case len(v6Records) > 0 && publicIPv6 != "" && !v6Match:
+		cm.logger.Warnf("Domain %s AAAA records %v do not include server IP %s", domain, v6Records, publicIPv6)
+		return false, fmt.Errorf("AAAA records do not point to server IP %s", publicIPv6)
+	case !v4Match && !v6Match:
+		cm.logger.Warnf("Domain %s does not resolve to server IPs %s %s", domain, publicIPv4, publicIPv6)
+		return false, fmt.Errorf("domain does not resolve to server IP")
+	}
+
+	if len(v6Records) > 0 && publicIPv6 == "" {
+		cm.logger.Warnf("Domain %s has AAAA records but this node has no IPv6, IPv6 clients will fail to connect", domain)
+	}
+
+	cm.logger.Infof("DNS resolution successful: %s -> %s %s", domain, publicIPv4, publicIPv6)
+	return true, nil
+}
+
+func containsIP(records []string, ip string) bool {
+	target := net.ParseIP(ip)
+	for _, record := range records {
+		if net.ParseIP(record).Equal(target) {
+			return true
+		}
+	}
+	return false
 }
 
-// getPublicIP gets the server's public IP address
-func (cm *CertificateManagerImpl) getPublicIP() (string, error) {
+// getPublicIP gets the server's public IP address over network ("tcp4" or "tcp6")
+func (cm *CertificateManagerImpl) getPublicIP(network string) (string, error) {
 	// Try multiple services to get public IP
 	services := []string{
-		"https://api.ipify.org",
+		"https://api64.ipify.org",
 		"https://ipinfo.io/ip",
 		"https://icanhazip.com",
 	}
 
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	client := &http.Client{
+		Timeout: 15 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+	}
+
 	for _, service := range services {
-		resp, err := http.Get(service)
+		resp, err := client.Get(service)
 		if err != nil {
 			continue
 		}
@@ -467,7 +516,11 @@ func (cm *CertificateManagerImpl) getPublicIP() (string, error) {
 			if err != nil {
 				continue
 			}
-			return strings.TrimSpace(string(body)), nil
+			ip := strings.TrimSpace(string(body))
+			if net.ParseIP(ip) == nil {
+				continue
+			}
+			return ip, nil
 		}
 	}
 
@@ -495,6 +548,10 @@ func (cm *CertificateManagerImpl) ValidateDomainOwnership(domain string) (bool,
 func (cm *CertificateManagerImpl) GenerateLetsEncryptCert(domain, email string, preferredChallenge string) (certPath, keyPath string, err error) {
 	cm.logger.Infof("Generating Let's Encrypt certificate for domain: %s", domain)
 
+	if err := injectCertFault(domain); err != nil {
+		return "", "", fmt.Errorf("certbot failed: %w", err)
+	}
+
 	// Ensure certbot is installed
 	if err := cm.InstallCertbot(); err != nil {
 		return "", "", fmt.Errorf("failed to install certbot: %w", err)
@@ -510,38 +567,38 @@ func (cm *CertificateManagerImpl) GenerateLetsEncryptCert(domain, email string,
 		return "", "", err
 	}
 
-	// Prepare certbot command
-	certPath, keyPath = cm.getCertificatePaths(domain)
-
-	args := []string{
-		"certonly",
-		"--non-interactive",
-		"--agree-tos",
-		"--email", email,
-		"--domains", domain,
-		"--standalone",
-		"--cert-name", domain,
-		"--key-path", keyPath,
-		"--fullchain-path", certPath,
-	}
-
-	// Add preferred challenge if specified
-	if preferredChallenge != "" {
-		args = append(args, "--preferred-challenges", preferredChallenge)
+	// The standalone authenticator answers http-01 only. certbot keeps the certificate in
+	// /etc/letsencrypt/live/<domain>, the only form the privilege helper allows.
+	if preferredChallenge != "" && preferredChallenge != "http-01" {
+		return "", "", fmt.Errorf("challenge %s is not supported, only http-01", preferredChallenge)
 	}
+	args := []string{"certonly", "--standalone", "-d", domain, "--agree-tos", "-m", email, "-n"}
 
 	// Run certbot
-	cmd := exec.Command(cm.certbotPath, args...)
-	output, err := cmd.CombinedOutput()
+	// Issuance waits on the ACME server and the challenge, well beyond the default timeout
+	result, err := cm.runner.Exec(context.Background(), ExecOptions{Timeout: certbotTimeout}, cm.certbotPath, args...)
 	if err != nil {
-		cm.logger.Errorf("Certbot failed: %v, output: %s", err, string(output))
+		cm.logger.Errorf("Certbot failed: %v, output: %s", err, result.Combined())
 		return "", "", fmt.Errorf("certbot failed: %w", err)
 	}
+	if certPath, keyPath, err = cm.deployLetsEncryptCert(domain); err != nil {
+		return "", "", err
+	}
 
 	cm.logger.Infof("Let's Encrypt certificate generated successfully for: %s", domain)
 	return certPath, keyPath, nil
 }
 
+// deployLetsEncryptCert copies the certificate certbot keeps for domain, readable by root
+// only, into the domain's certificate files
+func (cm *CertificateManagerImpl) deployLetsEncryptCert(domain string) (certPath, keyPath string, err error) {
+	certPath, keyPath, _ = cm.GetCertificatePaths(domain)
+	if err := privsep.InstallCertificate(domain, certPath, keyPath); err != nil {
+		return "", "", fmt.Errorf("failed to install certificate from certbot: %w", err)
+	}
+	return certPath, keyPath, nil
+}
+
 // AutoRenewCertificates checks and renews all expiring certificates
 func (cm *CertificateManagerImpl) AutoRenewCertificates() error {
 	cm.logger.Info("Checking for certificates to renew...")
@@ -567,11 +624,20 @@ func (cm *CertificateManagerImpl) AutoRenewCertificates() error {
 		if expiring, err := cm.IsCertificateExpiringSoon(cert.Domain, 30); err == nil && expiring {
 			cm.logger.Infof("Renewing certificate for domain: %s", cert.Domain)
 
+			if err := injectCertFault(cert.Domain); err != nil {
+				cm.logger.Errorf("Failed to renew certificate for %s: %v", cert.Domain, err)
+				continue
+			}
+
 			// Use certbot to renew
-			cmd := exec.Command(cm.certbotPath, "renew", "--cert-name", cert.Domain, "--non-interactive")
-			output, err := cmd.CombinedOutput()
+			result, err := cm.runner.Exec(context.Background(), ExecOptions{Timeout: certbotTimeout},
+				cm.certbotPath, "renew", "--cert-name", cert.Domain, "-n")
 			if err != nil {
-				cm.logger.Errorf("Failed to renew certificate for %s: %v, output: %s", cert.Domain, err, string(output))
+				cm.logger.Errorf("Failed to renew certificate for %s: %v, output: %s", cert.Domain, err, result.Combined())
+				continue
+			}
+			if _, _, err := cm.deployLetsEncryptCert(cert.Domain); err != nil {
+				cm.logger.Errorf("Failed to install renewed certificate for %s: %v", cert.Domain, err)
 				continue
 			}
 
@@ -583,10 +649,3 @@ func (cm *CertificateManagerImpl) AutoRenewCertificates() error {
 	cm.logger.Infof("Auto-renewal completed. Renewed %d certificates", renewedCount)
 	return nil
 }
-
-// getCertificatePaths returns full paths for certificate files
-func (cm *CertificateManagerImpl) getCertificatePaths(domain string) (certPath, keyPath string) {
-	certPath = filepath.Join(cm.certDir, fmt.Sprintf("%s.fullchain.pem", domain))
-	keyPath = filepath.Join(cm.config.Hysteria2.SNIKeyPath, fmt.Sprintf("%s.privkey.pem", domain))
-	return certPath, keyPath
-}
@@ -0,0 +1,97 @@
+package services
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"hysteria2_microservices/agent-service/internal/hysteriaconfig"
+)
+
+// Hysteria2 certificate modes
+const (
+	CertificateModeFiles = "files" // certificates the agent issues with certbot or self-signs
+	CertificateModeACME  = "acme"  // Hysteria2 obtains and renews its certificate itself
+
+	defaultACMEDir = "/var/lib/hysteria/acme"
+)
+
+// CertificateModeSettings selects how the Hysteria2 server gets its certificate
+type CertificateModeSettings struct {
+	Mode        string
+	Domains     []string // acme only, empty uses the SNI domains
+	Email       string
+	CA          string
+	Challenge   string
+	ListenHost  string
+	AltPort     int
+	DNSProvider string
+	DNSConfig   map[string]string
+}
+
+// Validate checks that the settings required by the selected mode are present
+func (s CertificateModeSettings) Validate() error {
+	switch s.Mode {
+	case CertificateModeFiles:
+		return nil
+	case CertificateModeACME:
+	default:
+		return fmt.Errorf("unsupported certificate mode %q", s.Mode)
+	}
+
+	switch s.CA {
+	case "", hysteriaconfig.ACMECALetsEncrypt:
+	case hysteriaconfig.ACMECAZeroSSL:
+		if s.Email == "" {
+			return fmt.Errorf("email is required for ZeroSSL")
+		}
+	default:
+		return fmt.Errorf("unsupported ACME CA %q", s.CA)
+	}
+
+	switch s.Challenge {
+	case "", hysteriaconfig.ACMEChallengeHTTP, hysteriaconfig.ACMEChallengeTLS:
+		for _, domain := range s.Domains {
+			if strings.HasPrefix(domain, "*.") {
+				return fmt.Errorf("wildcard domain %s needs the dns challenge", domain)
+			}
+		}
+	case hysteriaconfig.ACMEChallengeDNS:
+		if !slices.Contains(hysteriaconfig.ACMEDNSProviders, s.DNSProvider) {
+			return fmt.Errorf("DNS provider must be one of %s", strings.Join(hysteriaconfig.ACMEDNSProviders, ", "))
+		}
+		if len(s.DNSConfig) == 0 {
+			return fmt.Errorf("DNS provider credentials are required for the dns challenge")
+		}
+	default:
+		return fmt.Errorf("unsupported ACME challenge %q", s.Challenge)
+	}
+
+	if s.AltPort < 0 || s.AltPort > 65535 {
+		return fmt.Errorf("invalid challenge port %d", s.AltPort)
+	}
+	return nil
+}
+
+// ACMEStatus reports the certificates Hysteria2 obtained in ACME mode
+type ACMEStatus struct {
+	Settings     CertificateModeSettings
+	Dir          string
+	Certificates []hysteriaconfig.ACMECertificate
+	Pending      []string // domains the server has no certificate for yet
+}
+
+// ExpiringSoon returns the domains whose certificate expires within days. Hysteria2 renews
+// a certificate once a third of its lifetime is left, so one still expiring soon points to
+// failing renewals.
+func (s *ACMEStatus) ExpiringSoon(days int) []string {
+	deadline := time.Now().AddDate(0, 0, days)
+	var domains []string
+	for _, cert := range s.Certificates {
+		if cert.NotAfter.Before(deadline) {
+			domains = append(domains, cert.Domain)
+		}
+	}
+	return domains
+}
@@ -0,0 +1,165 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"hysteria2_microservices/agent-service/internal/config"
+	"hysteria2_microservices/agent-service/internal/privsep"
+)
+
+const defaultCommandTimeout = 60 * time.Second
+
+// maxCommandOutput caps how much of each of stdout and stderr a command result keeps
+const maxCommandOutput = 1 << 20
+
+// ExecOptions adjust how a single command runs
+type ExecOptions struct {
+	Timeout time.Duration // overrides the runner's timeout, e.g. for package installs
+	Stdin   io.Reader
+	Env     []string // KEY=value pairs added to the runner's environment
+}
+
+// CommandResult is the outcome of a command
+type CommandResult struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+	Duration time.Duration
+}
+
+// Combined returns stdout followed by stderr
+func (r *CommandResult) Combined() string {
+	if r.Stderr == "" {
+		return r.Stdout
+	}
+	return r.Stdout + r.Stderr
+}
+
+// CommandRunner runs external commands with a timeout, captures the start of their output and logs
+// every command with its duration and exit code at debug level; callers decide which
+// failures matter. Commands that need root go through the
+// privilege helper when it is enabled. In dry-run mode commands are logged but not run
+// and succeed with no output.
+type CommandRunner struct {
+	logger    *logrus.Logger
+	timeout   time.Duration
+	env       []string
+	dryRun    bool
+	maxOutput int
+}
+
+// NewCommandRunner creates a CommandRunner from the commands section of cfg
+func NewCommandRunner(logger *logrus.Logger, cfg *config.Config) *CommandRunner {
+	timeout := time.Duration(cfg.Commands.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultCommandTimeout
+	}
+	env := os.Environ()
+	if !cfg.Commands.InheritEnv {
+		env = []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin", "LANG=C"}
+	}
+	return &CommandRunner{
+		logger:    logger,
+		timeout:   timeout,
+		env:       append(env, cfg.Commands.Env...),
+		dryRun:    cfg.Commands.DryRun,
+		maxOutput: maxCommandOutput,
+	}
+}
+
+// Run runs a command and returns its combined output, with the last line of it in the
+// error when the command fails
+func (r *CommandRunner) Run(name string, args ...string) (string, error) {
+	result, err := r.Exec(context.Background(), ExecOptions{}, name, args...)
+	return result.Combined(), err
+}
+
+// Output runs a command and returns its stdout
+func (r *CommandRunner) Output(name string, args ...string) (string, error) {
+	result, err := r.Exec(context.Background(), ExecOptions{}, name, args...)
+	return result.Stdout, err
+}
+
+// Exec runs a command until it exits, ctx is done or the timeout passes. The result is
+// never nil.
+func (r *CommandRunner) Exec(ctx context.Context, opts ExecOptions, name string, args ...string) (*CommandResult, error) {
+	fields := logrus.Fields{"command": name, "args": strings.Join(args, " ")}
+	result := &CommandResult{}
+
+	if r.dryRun {
+		r.logger.WithFields(fields).WithField("dry_run", true).Info("Skipping command")
+		return result, nil
+	}
+	if err := injectCommandFault(name, args...); err != nil {
+		r.logger.WithFields(fields).Debugf("Command failed: %v", err)
+		return result, fmt.Errorf("%s %s: %w", name, strings.Join(args, " "), err)
+	}
+
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = r.timeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := privsep.CommandContext(ctx, name, args...)
+	cmd.Env = append(append([]string(nil), r.env...), opts.Env...)
+	cmd.Stdin = opts.Stdin
+	stdout, stderr := &cappedBuffer{max: r.maxOutput}, &cappedBuffer{max: r.maxOutput}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	start := time.Now()
+	err := cmd.Run()
+	result.Duration = time.Since(start)
+	result.Stdout = stdout.String()
+	result.Stderr = stderr.String()
+	result.ExitCode = cmd.ProcessState.ExitCode()
+
+	fields["duration_ms"] = result.Duration.Milliseconds()
+	fields["exit_code"] = result.ExitCode
+	if dropped := stdout.dropped + stderr.dropped; dropped > 0 {
+		fields["output_dropped_bytes"] = dropped
+	}
+	if err == nil {
+		r.logger.WithFields(fields).Debug("Command succeeded")
+		return result, nil
+	}
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+	r.logger.WithFields(fields).Debugf("Command failed: %v", err)
+	if line := lastLine(result.Combined()); line != "" {
+		return result, fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err, line)
+	}
+	return result, fmt.Errorf("%s %s: %w", name, strings.Join(args, " "), err)
+}
+
+// cappedBuffer keeps the first max bytes written to it and counts the rest, so a chatty
+// command neither blocks nor fills the agent's memory
+type cappedBuffer struct {
+	buf     bytes.Buffer
+	max     int
+	dropped int
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	keep := min(len(p), max(b.max-b.buf.Len(), 0))
+	b.buf.Write(p[:keep])
+	b.dropped += len(p) - keep
+	return len(p), nil
+}
+
+func (b *cappedBuffer) String() string {
+	return b.buf.String()
+}
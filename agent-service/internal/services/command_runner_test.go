@@ -0,0 +1,89 @@
+package services
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestCommandRunnerExec(t *testing.T) {
+	fakes := newCommandFakes(t)
+	fakes.install(t, "chatty", "#!/bin/sh\nprintf 'abcdefghij'\nprintf 'klmnopqrst' >&2\n")
+	fakes.install(t, "slow", "#!/bin/sh\nexec sleep 5\n")
+	fakes.install(t, "touching", "#!/bin/sh\ntouch "+filepath.Join(fakes.dir, "ran")+"\n")
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	tests := []struct {
+		name       string
+		runner     CommandRunner
+		command    string
+		wantStdout string
+		wantStderr string
+		wantErr    string
+		wantRan    bool
+	}{
+		{
+			name:       "output within the cap",
+			runner:     CommandRunner{timeout: time.Second, maxOutput: 64},
+			command:    "chatty",
+			wantStdout: "abcdefghij",
+			wantStderr: "klmnopqrst",
+		},
+		{
+			name:       "output truncated",
+			runner:     CommandRunner{timeout: time.Second, maxOutput: 4},
+			command:    "chatty",
+			wantStdout: "abcd",
+			wantStderr: "klmn",
+		},
+		{
+			name:    "timeout",
+			runner:  CommandRunner{timeout: 100 * time.Millisecond, maxOutput: 64},
+			command: "slow",
+			wantErr: "timed out after 100ms",
+		},
+		{
+			name:    "run",
+			runner:  CommandRunner{timeout: time.Second, maxOutput: 64},
+			command: "touching",
+			wantRan: true,
+		},
+		{
+			name:    "dry run",
+			runner:  CommandRunner{timeout: time.Second, maxOutput: 64, dryRun: true},
+			command: "touching",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(filepath.Join(fakes.dir, "ran"))
+			tt.runner.logger = logger
+			tt.runner.env = []string{"PATH=" + os.Getenv("PATH")}
+
+			start := time.Now()
+			result, err := tt.runner.Exec(context.Background(), ExecOptions{}, tt.command)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("Exec: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("Exec error = %v, want %q", err, tt.wantErr)
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("Exec took %s", elapsed)
+			}
+			if result.Stdout != tt.wantStdout || result.Stderr != tt.wantStderr {
+				t.Errorf("output = %q, %q; want %q, %q", result.Stdout, result.Stderr, tt.wantStdout, tt.wantStderr)
+			}
+			if _, err := os.Stat(filepath.Join(fakes.dir, "ran")); (err == nil) != tt.wantRan {
+				t.Errorf("command ran = %v, want %v", err == nil, tt.wantRan)
+			}
+		})
+	}
+}
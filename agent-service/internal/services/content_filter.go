@@ -0,0 +1,635 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"hysteria2_microservices/agent-service/internal/config"
+)
+
+// Filter list actions
+const (
+	FilterActionBlock = "block"
+	FilterActionAllow = "allow"
+)
+
+// Filter list formats. Hagezi and OISD publish lists in all of them; parsing is
+// tolerant so an empty format works for any of them.
+const (
+	FilterFormatDomains  = "domains"  // example.com
+	FilterFormatWildcard = "wildcard" // *.example.com
+	FilterFormatHosts    = "hosts"    // 0.0.0.0 example.com
+	FilterFormatAdblock  = "adblock"  // ||example.com^
+)
+
+const (
+	filterPolicyFile      = "lists.json"
+	filterCacheDir        = "cache"
+	filterCheckInterval   = time.Minute
+	filterDownloadTimeout = 2 * time.Minute
+
+	xrayFilterRulePrefix  = "filter-"
+	xrayBlockOutboundTag  = "block"
+	xrayDirectOutboundTag = "direct"
+)
+
+var (
+	filterListNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+	filterDomainPattern   = regexp.MustCompile(`^[a-z0-9_]([a-z0-9_-]*[a-z0-9_])?(\.[a-z0-9_]([a-z0-9_-]*[a-z0-9_])?)+$`)
+)
+
+// FilterList is a blocklist or allowlist assigned to the node. Entries come from URL,
+// downloaded on a schedule, and from Domains; each entry matches the domain and its
+// subdomains. Users limits the list to those Xray users; Hysteria2 cannot tell users
+// apart, so such lists are not applied to it.
+type FilterList struct {
+	Name            string   `json:"name"`
+	Category        string   `json:"category,omitempty"` // "ads", "malware", "custom", ...
+	Action          string   `json:"action"`             // "block" or "allow"
+	URL             string   `json:"url,omitempty"`
+	Format          string   `json:"format,omitempty"` // empty detects the format per line
+	Domains         []string `json:"domains,omitempty"`
+	Users           []string `json:"users,omitempty"`            // Xray user emails, empty applies to everyone
+	RefreshInterval int      `json:"refresh_interval,omitempty"` // seconds, 0 uses the agent default
+}
+
+// FilterListStatus reports how many domains a list contributed and when it was last downloaded
+type FilterListStatus struct {
+	Name      string    `json:"name"`
+	Action    string    `json:"action"`
+	Domains   int       `json:"domains"`
+	FetchedAt time.Time `json:"fetched_at,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type filterListState struct {
+	domains   []string // downloaded entries, inline domains are added at compile time
+	fetchedAt time.Time
+	err       error
+}
+
+// ContentFilterImpl keeps the assigned lists on disk, downloads them on their schedule
+// and rewrites the Xray routing rules and the Hysteria2 ACL whenever a list changes.
+// The last downloaded copy of every list is kept so a restart or a failed download
+// never drops the filter.
+type ContentFilterImpl struct {
+	logger          *logrus.Logger
+	config          *config.Config
+	hysteriaManager HysteriaManager
+	xrayManager     XrayManager
+	client          *http.Client
+
+	mu     sync.Mutex
+	lists  []FilterList
+	states map[string]*filterListState
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewContentFilter creates a new ContentFilter
+func NewContentFilter(logger *logrus.Logger, cfg *config.Config, hysteriaManager HysteriaManager, xrayManager XrayManager) ContentFilter {
+	return &ContentFilterImpl{
+		logger:          logger,
+		config:          cfg,
+		hysteriaManager: hysteriaManager,
+		xrayManager:     xrayManager,
+		client:          &http.Client{Timeout: filterDownloadTimeout},
+		states:          make(map[string]*filterListState),
+	}
+}
+
+// Start restores the saved lists from their cached copies and keeps them up to date
+func (cf *ContentFilterImpl) Start(ctx context.Context) error {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+
+	if cf.cancel != nil {
+		return fmt.Errorf("content filter is already running")
+	}
+
+	data, err := os.ReadFile(filepath.Join(cf.config.Filter.StateDir, filterPolicyFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read filter lists: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &cf.lists); err != nil {
+			return fmt.Errorf("invalid filter lists: %w", err)
+		}
+	}
+
+	for _, list := range cf.lists {
+		state := &filterListState{}
+		if list.URL != "" {
+			state.domains, state.fetchedAt, state.err = cf.loadCache(list.Name)
+		}
+		cf.states[list.Name] = state
+	}
+	if len(cf.lists) > 0 {
+		if err := cf.apply(); err != nil {
+			cf.logger.Errorf("Failed to apply saved filter lists: %v", err)
+		}
+	}
+
+	filterCtx, cancel := context.WithCancel(ctx)
+	cf.cancel = cancel
+	cf.wg.Add(1)
+	go cf.refreshLoop(filterCtx)
+
+	cf.logger.Infof("Content filter started with %d lists", len(cf.lists))
+	return nil
+}
+
+// Stop stops the scheduled downloads; the compiled rules stay in place
+func (cf *ContentFilterImpl) Stop() error {
+	cf.mu.Lock()
+	cancel := cf.cancel
+	cf.cancel = nil
+	cf.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		cf.wg.Wait()
+	}
+	return nil
+}
+
+// SetLists replaces the assigned lists, downloads the new ones and applies the result.
+// An empty slice removes all filtering.
+func (cf *ContentFilterImpl) SetLists(lists []FilterList) error {
+	names := make(map[string]bool, len(lists))
+	for i := range lists {
+		if err := validateFilterList(&lists[i]); err != nil {
+			return fmt.Errorf("list %d: %w", i+1, err)
+		}
+		if names[lists[i].Name] {
+			return fmt.Errorf("duplicate list %q", lists[i].Name)
+		}
+		names[lists[i].Name] = true
+	}
+
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+
+	previous := make(map[string]FilterList, len(cf.lists))
+	for _, list := range cf.lists {
+		previous[list.Name] = list
+	}
+
+	states := make(map[string]*filterListState, len(lists))
+	for _, list := range lists {
+		state, known := cf.states[list.Name]
+		if known && previous[list.Name].URL == list.URL && previous[list.Name].Format == list.Format {
+			states[list.Name] = state
+			continue
+		}
+		state = &filterListState{}
+		if list.URL != "" {
+			cf.download(list, state)
+		}
+		states[list.Name] = state
+	}
+
+	if err := cf.saveLists(lists); err != nil {
+		return err
+	}
+	for name := range previous {
+		if !names[name] {
+			os.Remove(cf.cachePath(name))
+		}
+	}
+	cf.lists = lists
+	cf.states = states
+
+	return cf.apply()
+}
+
+// GetStatus returns the assigned lists with their domain counts and download state
+func (cf *ContentFilterImpl) GetStatus() []FilterListStatus {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+
+	statuses := make([]FilterListStatus, 0, len(cf.lists))
+	for _, list := range cf.lists {
+		status := FilterListStatus{Name: list.Name, Action: list.Action, Domains: len(list.Domains)}
+		if state := cf.states[list.Name]; state != nil {
+			status.Domains += len(state.domains)
+			status.FetchedAt = state.fetchedAt
+			if state.err != nil {
+				status.Error = state.err.Error()
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// refreshLoop downloads lists whose refresh interval has passed
+func (cf *ContentFilterImpl) refreshLoop(ctx context.Context) {
+	defer cf.wg.Done()
+
+	ticker := time.NewTicker(filterCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			cf.refreshDue(time.Now())
+		}
+	}
+}
+
+func (cf *ContentFilterImpl) refreshDue(now time.Time) {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+
+	changed := false
+	for _, list := range cf.lists {
+		state := cf.states[list.Name]
+		if list.URL == "" || state == nil {
+			continue
+		}
+		interval := list.RefreshInterval
+		if interval <= 0 {
+			interval = cf.config.Filter.RefreshInterval
+		}
+		if now.Sub(state.fetchedAt) < time.Duration(interval)*time.Second {
+			continue
+		}
+		if cf.download(list, state) {
+			changed = true
+		}
+	}
+
+	if changed {
+		if err := cf.apply(); err != nil {
+			cf.logger.Errorf("Failed to apply refreshed filter lists: %v", err)
+		}
+	}
+}
+
+// download fetches list into state, keeping the previous entries on failure. It reports
+// whether the entries changed.
+func (cf *ContentFilterImpl) download(list FilterList, state *filterListState) bool {
+	domains, err := cf.fetch(list)
+	if err != nil {
+		cf.logger.Warnf("Failed to download filter list %s: %v", list.Name, err)
+		state.err = err
+		// Retry on the next check instead of waiting a full interval
+		return false
+	}
+
+	changed := !equalStrings(domains, state.domains)
+	state.domains = domains
+	state.fetchedAt = time.Now()
+	state.err = nil
+
+	if err := cf.saveCache(list.Name, domains); err != nil {
+		cf.logger.Warnf("Failed to cache filter list %s: %v", list.Name, err)
+	}
+	cf.logger.Infof("Downloaded filter list %s: %d domains", list.Name, len(domains))
+	return changed
+}
+
+func (cf *ContentFilterImpl) fetch(list FilterList) ([]string, error) {
+	resp, err := cf.client.Get(list.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", list.URL, resp.Status)
+	}
+
+	limit := cf.config.Filter.MaxListSize
+	body := io.LimitReader(resp.Body, limit+1)
+	counter := &countingReader{r: body}
+	domains, err := parseFilterList(counter, list.Format)
+	if err != nil {
+		return nil, err
+	}
+	if counter.n > limit {
+		return nil, fmt.Errorf("list is larger than %d bytes", limit)
+	}
+	return domains, nil
+}
+
+// apply compiles the lists and reloads Xray and Hysteria2 when they are running; callers hold mu
+func (cf *ContentFilterImpl) apply() error {
+	entries := make(map[string][]string, len(cf.lists))
+	for _, list := range cf.lists {
+		domains := append([]string{}, list.Domains...)
+		if state := cf.states[list.Name]; state != nil {
+			domains = append(domains, state.domains...)
+		}
+		entries[list.Name] = domains
+	}
+	compiled := compileFilterLists(cf.lists, entries)
+
+	var errs []string
+
+	if err := cf.xrayManager.SetFilterRules(compiled.xrayRules); err != nil {
+		errs = append(errs, fmt.Sprintf("xray: %v", err))
+	} else if err := restartRunningXray(cf.xrayManager); err != nil {
+		errs = append(errs, fmt.Sprintf("xray restart: %v", err))
+	}
+
+	if err := cf.writeHysteriaACL(compiled.hysteriaACL); err != nil {
+		errs = append(errs, fmt.Sprintf("hysteria2: %v", err))
+	} else if err := reloadRunningHysteria(cf.config, cf.hysteriaManager); err != nil {
+		errs = append(errs, fmt.Sprintf("hysteria2 restart: %v", err))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to apply content filter: %s", strings.Join(errs, "; "))
+	}
+	cf.logger.Infof("Content filter applied: %d lists, %d blocked and %d allowed domains",
+		len(cf.lists), compiled.blocked, compiled.allowed)
+	return nil
+}
+
+// writeHysteriaACL writes the ACL, or removes it when no list applies to Hysteria2
+func (cf *ContentFilterImpl) writeHysteriaACL(acl string) error {
+	path := cf.config.Filter.HysteriaACLPath
+	if path == "" {
+		return nil
+	}
+	if acl == "" {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return recordDeployedConfig(cf.config, path, nil)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, []byte(acl), 0644); err != nil {
+		return err
+	}
+	return recordDeployedConfig(cf.config, path, []byte(acl))
+}
+
+func (cf *ContentFilterImpl) saveLists(lists []FilterList) error {
+	if err := os.MkdirAll(cf.config.Filter.StateDir, 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(lists, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(cf.config.Filter.StateDir, filterPolicyFile), data, 0600)
+}
+
+func (cf *ContentFilterImpl) cachePath(name string) string {
+	return filepath.Join(cf.config.Filter.StateDir, filterCacheDir, name+".txt")
+}
+
+func (cf *ContentFilterImpl) saveCache(name string, domains []string) error {
+	path := cf.cachePath(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(strings.Join(domains, "\n")+"\n"), 0600)
+}
+
+func (cf *ContentFilterImpl) loadCache(name string) ([]string, time.Time, error) {
+	path := cf.cachePath(name)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer file.Close()
+
+	domains, err := parseFilterList(file, FilterFormatDomains)
+	return domains, info.ModTime(), err
+}
+
+// compiledFilter is the routing produced from the assigned lists
+type compiledFilter struct {
+	xrayRules   []map[string]interface{}
+	hysteriaACL string
+	blocked     int
+	allowed     int
+}
+
+// compileFilterLists turns lists into Xray routing rules and a Hysteria2 ACL. Xray checks
+// allowlists before blocklists. The Hysteria2 ACL cannot send a domain on to the default
+// outbound by name, so allowlisted domains and their subdomains are removed from its
+// blocklist instead.
+func compileFilterLists(lists []FilterList, entries map[string][]string) compiledFilter {
+	var compiled compiledFilter
+
+	ordered := make([]FilterList, 0, len(lists))
+	for _, action := range []string{FilterActionAllow, FilterActionBlock} {
+		for _, list := range lists {
+			if list.Action == action {
+				ordered = append(ordered, list)
+			}
+		}
+	}
+
+	var hysteriaAllowed []string
+	hysteriaBlocked := make(map[string]bool)
+
+	for _, list := range ordered {
+		domains := uniqueStrings(entries[list.Name])
+		if len(domains) == 0 {
+			continue
+		}
+
+		rule := map[string]interface{}{
+			"type":    "field",
+			"ruleTag": xrayFilterRulePrefix + list.Name,
+		}
+		xrayDomains := make([]string, len(domains))
+		for i, domain := range domains {
+			xrayDomains[i] = "domain:" + domain
+		}
+		rule["domain"] = xrayDomains
+		if len(list.Users) > 0 {
+			rule["user"] = list.Users
+		}
+		if list.Action == FilterActionBlock {
+			rule["outboundTag"] = xrayBlockOutboundTag
+			compiled.blocked += len(domains)
+		} else {
+			compiled.allowed += len(domains)
+		}
+		compiled.xrayRules = append(compiled.xrayRules, rule)
+
+		if len(list.Users) > 0 {
+			continue
+		}
+		for _, domain := range domains {
+			if list.Action == FilterActionAllow {
+				hysteriaAllowed = append(hysteriaAllowed, domain)
+			} else {
+				hysteriaBlocked[domain] = true
+			}
+		}
+	}
+
+	var acl []string
+	for domain := range hysteriaBlocked {
+		if !domainCovered(domain, hysteriaAllowed) {
+			acl = append(acl, fmt.Sprintf("reject(suffix:%s)", domain))
+		}
+	}
+	if len(acl) > 0 {
+		sort.Strings(acl)
+		compiled.hysteriaACL = "# Generated by the agent content filter, do not edit\n" + strings.Join(acl, "\n") + "\n"
+	}
+
+	return compiled
+}
+
+// parseFilterList reads domains from a list in any of the supported formats, skipping
+// comments, exceptions and rules that are not plain domain matches
+func parseFilterList(r io.Reader, format string) ([]string, error) {
+	var domains []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' || strings.HasPrefix(line, "@@") {
+			continue
+		}
+		if i := strings.Index(line, "#"); i > 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+
+		switch {
+		case strings.HasPrefix(line, "||"):
+			line = strings.TrimPrefix(line, "||")
+			end := strings.IndexAny(line, "^$")
+			if end < 0 || line[end:] != "^" {
+				continue // rules with modifiers or paths are not domain matches
+			}
+			line = line[:end]
+		case format == FilterFormatHosts || strings.ContainsAny(line, " \t"):
+			fields := strings.Fields(line)
+			if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+				continue
+			}
+			line = fields[1]
+		}
+
+		if domain, ok := normalizeFilterDomain(line); ok {
+			domains = append(domains, domain)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return uniqueStrings(domains), nil
+}
+
+// validateFilterList checks a list and normalises its inline domains
+func validateFilterList(list *FilterList) error {
+	if !filterListNamePattern.MatchString(list.Name) {
+		return fmt.Errorf("name %q must be lowercase letters, digits, '-' or '_'", list.Name)
+	}
+	if list.Action != FilterActionBlock && list.Action != FilterActionAllow {
+		return fmt.Errorf("action must be %q or %q", FilterActionBlock, FilterActionAllow)
+	}
+	switch list.Format {
+	case "", FilterFormatDomains, FilterFormatWildcard, FilterFormatHosts, FilterFormatAdblock:
+	default:
+		return fmt.Errorf("unsupported format %q", list.Format)
+	}
+	if list.URL == "" && len(list.Domains) == 0 {
+		return fmt.Errorf("list %s has neither a URL nor domains", list.Name)
+	}
+	if list.URL != "" && !strings.HasPrefix(list.URL, "https://") && !strings.HasPrefix(list.URL, "http://") {
+		return fmt.Errorf("list URL must use http or https")
+	}
+
+	domains := make([]string, 0, len(list.Domains))
+	for _, entry := range list.Domains {
+		domain, ok := normalizeFilterDomain(entry)
+		if !ok {
+			return fmt.Errorf("invalid domain %q", entry)
+		}
+		domains = append(domains, domain)
+	}
+	list.Domains = uniqueStrings(domains)
+	return nil
+}
+
+// normalizeFilterDomain lowercases entry and strips a wildcard label and dots around it
+func normalizeFilterDomain(entry string) (string, bool) {
+	domain := strings.ToLower(strings.TrimSpace(entry))
+	domain = strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(domain, "*."), "."), ".")
+	if !filterDomainPattern.MatchString(domain) || net.ParseIP(domain) != nil {
+		return "", false
+	}
+	return domain, true
+}
+
+// domainCovered reports whether domain equals or is a subdomain of one of parents
+func domainCovered(domain string, parents []string) bool {
+	for _, parent := range parents {
+		if domain == parent || strings.HasSuffix(domain, "."+parent) {
+			return true
+		}
+	}
+	return false
+}
+
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	unique := make([]string, 0, len(values))
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			unique = append(unique, value)
+		}
+	}
+	sort.Strings(unique)
+	return unique
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// countingReader counts the bytes read so oversized downloads can be rejected
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,214 @@
+package services
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"hysteria2_microservices/agent-service/internal/config"
+)
+
+// filterXray records the filter rules of a stopped Xray
+type filterXray struct {
+	XrayManager
+	rules []map[string]interface{}
+}
+
+func (f *filterXray) SetFilterRules(rules []map[string]interface{}) error {
+	f.rules = rules
+	return nil
+}
+
+func (f *filterXray) GetXrayStatus() (map[string]interface{}, error) {
+	return map[string]interface{}{"running": false}, nil
+}
+
+func newTestContentFilter(t *testing.T) (*ContentFilterImpl, *filterXray) {
+	cfg := &config.Config{}
+	dir := t.TempDir()
+	cfg.Filter = config.FilterConfig{
+		StateDir:        dir,
+		HysteriaACLPath: filepath.Join(dir, "acl.txt"),
+		RefreshInterval: 3600,
+		MaxListSize:     1024,
+	}
+	xray := &filterXray{}
+	return NewContentFilter(testLogger(), cfg, &fakeHysteria{}, xray).(*ContentFilterImpl), xray
+}
+
+func TestParseFilterList(t *testing.T) {
+	list := strings.Join([]string{
+		"# Hagezi multi",
+		"! adblock comment",
+		"[Adblock Plus]",
+		"ads.example.com",
+		"*.Tracker.example.",
+		"0.0.0.0 hosts.example.com # inline comment",
+		"127.0.0.1 localhost.localdomain",
+		"||adblock.example.com^",
+		"||path.example.com/ads^",
+		"||modifier.example.com^$third-party",
+		"@@||exception.example.com^",
+		"192.0.2.1",
+		"ads.example.com",
+	}, "\n")
+
+	domains, err := parseFilterList(strings.NewReader(list), "")
+	if err != nil {
+		t.Fatalf("parseFilterList: %v", err)
+	}
+	want := []string{"adblock.example.com", "ads.example.com", "hosts.example.com", "localhost.localdomain", "tracker.example"}
+	if !reflect.DeepEqual(domains, want) {
+		t.Errorf("domains %v, want %v", domains, want)
+	}
+}
+
+func TestValidateFilterList(t *testing.T) {
+	tests := []struct {
+		name    string
+		list    FilterList
+		wantErr bool
+	}{
+		{"inline", FilterList{Name: "custom", Action: FilterActionBlock, Domains: []string{"Example.COM"}}, false},
+		{"url", FilterList{Name: "oisd_big", Action: FilterActionBlock, URL: "https://big.oisd.nl/domainswild", Format: FilterFormatWildcard}, false},
+		{"bad name", FilterList{Name: "../etc", Action: FilterActionBlock, Domains: []string{"example.com"}}, true},
+		{"bad action", FilterList{Name: "custom", Action: "redirect", Domains: []string{"example.com"}}, true},
+		{"bad format", FilterList{Name: "custom", Action: FilterActionBlock, URL: "https://example.com/list", Format: "rpz"}, true},
+		{"empty", FilterList{Name: "custom", Action: FilterActionAllow}, true},
+		{"file url", FilterList{Name: "custom", Action: FilterActionBlock, URL: "file:///etc/hosts"}, true},
+		{"ip domain", FilterList{Name: "custom", Action: FilterActionBlock, Domains: []string{"192.0.2.1"}}, true},
+	}
+	for _, tt := range tests {
+		if err := validateFilterList(&tt.list); (err != nil) != tt.wantErr {
+			t.Errorf("%s: validateFilterList() = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCompileFilterLists(t *testing.T) {
+	lists := []FilterList{
+		{Name: "ads", Action: FilterActionBlock},
+		{Name: "kids", Action: FilterActionBlock, Users: []string{"child@example.com"}},
+		{Name: "work", Action: FilterActionAllow},
+	}
+	compiled := compileFilterLists(lists, map[string][]string{
+		"ads":  {"example.com", "cdn.example.com", "tracker.net"},
+		"kids": {"games.example"},
+		"work": {"example.com"},
+	})
+
+	// Allowlists come first so they win in Xray
+	var tags []string
+	for _, rule := range compiled.xrayRules {
+		tags = append(tags, rule["ruleTag"].(string))
+	}
+	if !reflect.DeepEqual(tags, []string{"filter-work", "filter-ads", "filter-kids"}) {
+		t.Errorf("Xray rule order %v", tags)
+	}
+	if _, ok := compiled.xrayRules[0]["outboundTag"]; ok {
+		t.Error("allowlist rule sends traffic to an outbound")
+	}
+	if compiled.xrayRules[1]["outboundTag"] != "block" || !reflect.DeepEqual(compiled.xrayRules[2]["user"], []string{"child@example.com"}) {
+		t.Errorf("block rules %v", compiled.xrayRules[1:])
+	}
+
+	// Hysteria2 cannot tell users apart and drops allowlisted domains from its blocklist
+	want := "# Generated by the agent content filter, do not edit\nreject(suffix:tracker.net)\n"
+	if compiled.hysteriaACL != want {
+		t.Errorf("ACL:\n%s\nwant:\n%s", compiled.hysteriaACL, want)
+	}
+	if compiled.blocked != 4 || compiled.allowed != 1 {
+		t.Errorf("counted %d blocked and %d allowed domains", compiled.blocked, compiled.allowed)
+	}
+}
+
+func TestContentFilterDownloadsAndCachesLists(t *testing.T) {
+	var failing atomic.Bool
+	body := "ads.example.com\n||tracker.example^\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	cf, xray := newTestContentFilter(t)
+	lists := []FilterList{
+		{Name: "remote", Action: FilterActionBlock, URL: server.URL},
+		{Name: "custom", Action: FilterActionBlock, Domains: []string{"bad.example"}},
+	}
+	if err := cf.SetLists(lists); err != nil {
+		t.Fatalf("SetLists: %v", err)
+	}
+
+	acl, err := os.ReadFile(cf.config.Filter.HysteriaACLPath)
+	if err != nil || !strings.Contains(string(acl), "reject(suffix:tracker.example)") || !strings.Contains(string(acl), "reject(suffix:bad.example)") {
+		t.Errorf("ACL %q, %v; want both lists", acl, err)
+	}
+	if len(xray.rules) != 2 {
+		t.Errorf("Xray rules %v, want one per list", xray.rules)
+	}
+	status := cf.GetStatus()
+	if status[0].Domains != 2 || status[0].FetchedAt.IsZero() || status[1].Domains != 1 {
+		t.Errorf("status %+v", status)
+	}
+
+	// A failed refresh keeps the last good copy and reports the error
+	failing.Store(true)
+	cf.refreshDue(time.Now().Add(2 * time.Hour))
+	if status := cf.GetStatus(); status[0].Domains != 2 || status[0].Error == "" {
+		t.Errorf("status after a failed refresh %+v", status[0])
+	}
+
+	// A restarted agent filters from the cache before downloading again
+	restarted := NewContentFilter(testLogger(), cf.config, &fakeHysteria{}, &filterXray{}).(*ContentFilterImpl)
+	if err := restarted.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer restarted.Stop()
+	if status := restarted.GetStatus(); len(status) != 2 || status[0].Domains != 2 {
+		t.Errorf("status after restart %+v, want the cached list", status)
+	}
+
+	// Removing every list removes the ACL and the cache
+	if err := cf.SetLists(nil); err != nil {
+		t.Fatalf("SetLists: %v", err)
+	}
+	if _, err := os.Stat(cf.config.Filter.HysteriaACLPath); !os.IsNotExist(err) {
+		t.Errorf("ACL left behind: %v", err)
+	}
+	if _, err := os.Stat(cf.cachePath("remote")); !os.IsNotExist(err) {
+		t.Errorf("cache left behind: %v", err)
+	}
+}
+
+func TestContentFilterRejectsOversizedLists(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("ads.example.com\n", 100)))
+	}))
+	defer server.Close()
+
+	cf, _ := newTestContentFilter(t)
+	if err := cf.SetLists([]FilterList{{Name: "huge", Action: FilterActionBlock, URL: server.URL}}); err != nil {
+		t.Fatalf("SetLists: %v", err)
+	}
+	if status := cf.GetStatus(); status[0].Domains != 0 || !strings.Contains(status[0].Error, "larger than 1024 bytes") {
+		t.Errorf("status %+v, want the download rejected", status[0])
+	}
+
+	if err := cf.SetLists([]FilterList{
+		{Name: "dup", Action: FilterActionBlock, Domains: []string{"a.example"}},
+		{Name: "dup", Action: FilterActionAllow, Domains: []string{"b.example"}},
+	}); err == nil {
+		t.Error("accepted two lists with the same name")
+	}
+}
@@ -0,0 +1,495 @@
+package services
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"hysteria2_microservices/agent-service/internal/config"
+)
+
+//go:embed decoy_site
+var decoySiteFS embed.FS
+
+// DecoyManagerImpl serves a static decoy website over TCP so that active probes
+// of the node see an ordinary HTTPS site. Hysteria2 itself listens on UDP.
+type DecoyManagerImpl struct {
+	logger      *logrus.Logger
+	config      *config.Config
+	certManager CertificateManager
+
+	mu           sync.Mutex
+	certCache    map[string]*tls.Certificate
+	fallbackCert *tls.Certificate
+	httpsServer  *http.Server
+	httpServer   *http.Server
+	running      bool
+	startedAt    time.Time
+}
+
+// NewDecoyManager creates a new DecoyManager
+func NewDecoyManager(logger *logrus.Logger, cfg *config.Config, certManager CertificateManager) DecoyManager {
+	return &DecoyManagerImpl{
+		logger:      logger,
+		config:      cfg,
+		certManager: certManager,
+		certCache:   make(map[string]*tls.Certificate),
+	}
+}
+
+// InstallSite writes the bundled decoy website into the site directory unless one is already present
+func (dm *DecoyManagerImpl) InstallSite() error {
+	siteDir := dm.config.Decoy.SiteDir
+	if _, err := os.Stat(filepath.Join(siteDir, "index.html")); err == nil {
+		dm.logger.Infof("Decoy site already present in %s, skipping install", siteDir)
+		return nil
+	}
+
+	dm.logger.Infof("Installing decoy site into %s", siteDir)
+
+	if err := os.MkdirAll(siteDir, 0755); err != nil {
+		return fmt.Errorf("failed to create site directory: %w", err)
+	}
+
+	if store := newArtifactStore(dm.config); store != nil {
+		err := dm.installSiteFromArtifacts(store, siteDir)
+		if !errors.Is(err, errArtifactNotFound) {
+			return err
+		}
+		dm.logger.Info("No decoy site in the artifact store, installing the bundled one")
+	}
+
+	now := time.Now()
+	data := map[string]interface{}{
+		"Title":  dm.siteTitle(),
+		"Date":   now.AddDate(0, 0, -17).Format("January 2, 2006"),
+		"Year":   now.Year(),
+		"Server": dm.config.Decoy.ServerHeader,
+	}
+
+	return fs.WalkDir(decoySiteFS, "decoy_site", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		content, err := decoySiteFS.ReadFile(p)
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(siteDir, strings.TrimPrefix(p, "decoy_site/"))
+		if strings.HasSuffix(p, ".html") {
+			tmpl, err := template.New(path.Base(p)).Parse(string(content))
+			if err != nil {
+				return fmt.Errorf("failed to parse %s: %w", p, err)
+			}
+			var rendered strings.Builder
+			if err := tmpl.Execute(&rendered, data); err != nil {
+				return fmt.Errorf("failed to render %s: %w", p, err)
+			}
+			content = []byte(rendered.String())
+		}
+
+		if err := os.WriteFile(target, content, 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", target, err)
+		}
+		return nil
+	})
+}
+
+// installSiteFromArtifacts unpacks decoy/site.tar.gz from the artifact store into siteDir,
+// letting operators of offline nodes ship their own site
+func (dm *DecoyManagerImpl) installSiteFromArtifacts(store *artifactStore, siteDir string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), binaryDownloadTimeout)
+	defer cancel()
+
+	archive, err := os.CreateTemp("", "decoy-site-*.tar.gz")
+	if err != nil {
+		return err
+	}
+	archive.Close()
+	defer os.Remove(archive.Name())
+
+	if err := store.download(ctx, "decoy/site.tar.gz", archive.Name()); err != nil {
+		return err
+	}
+	if err := extractTarGz(archive.Name(), siteDir); err != nil {
+		return fmt.Errorf("failed to unpack decoy site: %w", err)
+	}
+	if _, err := os.Stat(filepath.Join(siteDir, "index.html")); err != nil {
+		return fmt.Errorf("decoy site archive has no index.html at its root")
+	}
+
+	dm.logger.Infof("Decoy site installed from the artifact store into %s", siteDir)
+	return nil
+}
+
+// extractTarGz unpacks the directories and regular files of a gzipped tarball into dir,
+// rejecting entries that would land outside it
+func extractTarGz(archive, dir string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := strings.TrimPrefix(path.Clean("/"+header.Name), "/")
+		if name == "" || !fs.ValidPath(name) {
+			return fmt.Errorf("invalid entry %q", header.Name)
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, tr); err != nil {
+				out.Close()
+				return err
+			}
+			if err := out.Close(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Start installs the site if needed and starts serving it in the background until ctx is cancelled
+func (dm *DecoyManagerImpl) Start(ctx context.Context) error {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	if dm.running {
+		return fmt.Errorf("decoy site is already running")
+	}
+
+	if err := dm.InstallSite(); err != nil {
+		return fmt.Errorf("failed to install decoy site: %w", err)
+	}
+
+	lis, err := net.Listen("tcp", dm.config.Decoy.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", dm.config.Decoy.ListenAddr, err)
+	}
+
+	dm.httpsServer = &http.Server{
+		Handler: dm.siteHandler(),
+		TLSConfig: &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: dm.getCertificate,
+			NextProtos:     []string{"h2", "http/1.1"},
+		},
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       60 * time.Second,
+		ErrorLog:          dm.quietErrorLog(),
+	}
+
+	go func(srv *http.Server) {
+		dm.logger.Infof("Decoy site listening on %s", lis.Addr())
+		if err := srv.ServeTLS(lis, "", ""); err != nil && err != http.ErrServerClosed {
+			dm.logger.Errorf("Decoy HTTPS server stopped: %v", err)
+		}
+	}(dm.httpsServer)
+
+	if dm.config.Decoy.HTTPListenAddr != "" {
+		dm.httpServer = &http.Server{
+			Addr:              dm.config.Decoy.HTTPListenAddr,
+			Handler:           dm.redirectHandler(),
+			ReadHeaderTimeout: 10 * time.Second,
+			ErrorLog:          dm.quietErrorLog(),
+		}
+		go func(srv *http.Server) {
+			dm.logger.Infof("Decoy HTTP redirect listening on %s", srv.Addr)
+			if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				dm.logger.Errorf("Decoy HTTP server stopped: %v", err)
+			}
+		}(dm.httpServer)
+	}
+
+	dm.running = true
+	dm.startedAt = time.Now()
+
+	go func() {
+		<-ctx.Done()
+		if err := dm.Stop(); err != nil {
+			dm.logger.Errorf("Failed to stop decoy site: %v", err)
+		}
+	}()
+
+	return nil
+}
+
+// Stop gracefully shuts down the decoy listeners
+func (dm *DecoyManagerImpl) Stop() error {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	if !dm.running {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var firstErr error
+	for _, srv := range []*http.Server{dm.httpsServer, dm.httpServer} {
+		if srv == nil {
+			continue
+		}
+		if err := srv.Shutdown(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	dm.httpsServer = nil
+	dm.httpServer = nil
+	dm.running = false
+	dm.logger.Info("Decoy site stopped")
+	return firstErr
+}
+
+// IsRunning reports whether the decoy site is being served
+func (dm *DecoyManagerImpl) IsRunning() bool {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	return dm.running
+}
+
+// ReloadCertificates drops cached certificates so renewed SNI certificates are picked up
+func (dm *DecoyManagerImpl) ReloadCertificates() {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	dm.certCache = make(map[string]*tls.Certificate)
+	dm.fallbackCert = nil
+	dm.logger.Info("Decoy certificate cache cleared")
+}
+
+// GetStatus returns the decoy site status
+func (dm *DecoyManagerImpl) GetStatus() map[string]interface{} {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	status := map[string]interface{}{
+		"enabled":      dm.config.Decoy.Enabled,
+		"running":      dm.running,
+		"listen_addr":  dm.config.Decoy.ListenAddr,
+		"site_dir":     dm.config.Decoy.SiteDir,
+		"cached_certs": len(dm.certCache),
+	}
+	if dm.running {
+		status["uptime"] = time.Since(dm.startedAt).String()
+	}
+	return status
+}
+
+// siteHandler serves the site directory without directory listings, like a stock nginx vhost
+func (dm *DecoyManagerImpl) siteHandler() http.Handler {
+	siteDir := dm.config.Decoy.SiteDir
+	files := http.FileServer(http.Dir(siteDir))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if dm.config.Decoy.ServerHeader != "" {
+			w.Header().Set("Server", dm.config.Decoy.ServerHeader)
+		}
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		name := filepath.Join(siteDir, filepath.FromSlash(path.Clean("/"+r.URL.Path)))
+		info, err := os.Stat(name)
+		if err == nil && info.IsDir() {
+			_, err = os.Stat(filepath.Join(name, "index.html"))
+		}
+		if err != nil {
+			dm.serveNotFound(w, r, siteDir)
+			return
+		}
+
+		files.ServeHTTP(w, r)
+	})
+}
+
+func (dm *DecoyManagerImpl) serveNotFound(w http.ResponseWriter, r *http.Request, siteDir string) {
+	content, err := os.ReadFile(filepath.Join(siteDir, "404.html"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(http.StatusNotFound)
+	w.Write(content)
+}
+
+// redirectHandler sends plain HTTP requests to the HTTPS site
+func (dm *DecoyManagerImpl) redirectHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if dm.config.Decoy.ServerHeader != "" {
+			w.Header().Set("Server", dm.config.Decoy.ServerHeader)
+		}
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if _, port, err := net.SplitHostPort(dm.config.Decoy.ListenAddr); err == nil && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// getCertificate picks the SNI certificate matching the requested server name,
+// falling back to the default SNI domain, the Hysteria2 certificate and finally
+// a self-signed certificate for the node hostname.
+func (dm *DecoyManagerImpl) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	serverName := strings.ToLower(hello.ServerName)
+
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	if serverName != "" {
+		if cert, ok := dm.certCache[serverName]; ok {
+			return cert, nil
+		}
+		if cert := dm.loadDomainCertificate(serverName); cert != nil {
+			dm.certCache[serverName] = cert
+			return cert, nil
+		}
+	}
+
+	if dm.fallbackCert != nil {
+		return dm.fallbackCert, nil
+	}
+
+	cert, err := dm.loadFallbackCertificate()
+	if err != nil {
+		return nil, err
+	}
+	dm.fallbackCert = cert
+	return cert, nil
+}
+
+// loadDomainCertificate loads a certificate for a configured SNI domain, preferring Let's Encrypt files
+func (dm *DecoyManagerImpl) loadDomainCertificate(domain string) *tls.Certificate {
+	if !dm.isSNIDomain(domain) {
+		return nil
+	}
+
+	// Let's Encrypt certificates are stored as fullchain/privkey, self-signed ones as crt/key
+	candidates := [][2]string{{
+		filepath.Join(dm.config.Hysteria2.SNICertPath, domain+".fullchain.pem"),
+		filepath.Join(dm.config.Hysteria2.SNIKeyPath, domain+".privkey.pem"),
+	}}
+	if certPath, keyPath, err := dm.certManager.GetCertificatePaths(domain); err == nil {
+		candidates = append(candidates, [2]string{certPath, keyPath})
+	}
+
+	for _, paths := range candidates {
+		cert, err := tls.LoadX509KeyPair(paths[0], paths[1])
+		if err == nil {
+			return &cert
+		}
+	}
+
+	dm.logger.Debugf("No certificate found for decoy domain %s", domain)
+	return nil
+}
+
+func (dm *DecoyManagerImpl) loadFallbackCertificate() (*tls.Certificate, error) {
+	if defaultSNI := dm.config.Hysteria2.DefaultSNI; defaultSNI != "" {
+		if cert := dm.loadDomainCertificate(defaultSNI); cert != nil {
+			return cert, nil
+		}
+	}
+
+	if cert, err := tls.LoadX509KeyPair(hysteria2CertPath, hysteria2KeyPath); err == nil {
+		return &cert, nil
+	}
+
+	hostname := dm.config.Node.Hostname
+	if hostname == "" {
+		hostname = "localhost"
+	}
+
+	certPath, keyPath, err := dm.certManager.GenerateSelfSignedCert(hostname)
+	if err != nil {
+		return nil, fmt.Errorf("no certificate available for decoy site: %w", err)
+	}
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load self-signed certificate: %w", err)
+	}
+	return &cert, nil
+}
+
+// quietErrorLog routes net/http errors (mostly failed handshakes from scanners) to debug level
+func (dm *DecoyManagerImpl) quietErrorLog() *log.Logger {
+	return log.New(dm.logger.WriterLevel(logrus.DebugLevel), "", 0)
+}
+
+func (dm *DecoyManagerImpl) isSNIDomain(domain string) bool {
+	if strings.EqualFold(domain, dm.config.Hysteria2.DefaultSNI) {
+		return true
+	}
+	for _, d := range dm.config.Hysteria2.SNIDomains {
+		if strings.EqualFold(d, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (dm *DecoyManagerImpl) siteTitle() string {
+	if dm.config.Decoy.SiteTitle != "" {
+		return dm.config.Decoy.SiteTitle
+	}
+	if dm.config.Hysteria2.DefaultSNI != "" {
+		return dm.config.Hysteria2.DefaultSNI
+	}
+	return "Field Notes"
+}
@@ -0,0 +1,245 @@
+package services
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"hysteria2_microservices/agent-service/internal/config"
+)
+
+// writeTestCert writes a self-signed certificate for name and returns its paths
+func writeTestCert(t *testing.T, dir, certFile, keyFile, name string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+
+	certPath, keyPath := filepath.Join(dir, certFile), filepath.Join(dir, keyFile)
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+// fakeCertManager stands in for the node's certificate store
+type fakeCertManager struct {
+	CertificateManager
+	paths       map[string][2]string
+	selfSigned  [2]string
+	generatedBy []string
+}
+
+func (f *fakeCertManager) GetCertificatePaths(domain string) (string, string, error) {
+	if paths, ok := f.paths[domain]; ok {
+		return paths[0], paths[1], nil
+	}
+	return "", "", fmt.Errorf("no certificate for %s", domain)
+}
+
+func (f *fakeCertManager) GenerateSelfSignedCert(domain string) (string, string, error) {
+	f.generatedBy = append(f.generatedBy, domain)
+	return f.selfSigned[0], f.selfSigned[1], nil
+}
+
+func newTestDecoy(t *testing.T, certs *fakeCertManager) (*DecoyManagerImpl, *config.Config) {
+	cfg := &config.Config{}
+	cfg.Decoy = config.DecoyConfig{
+		Enabled:      true,
+		ListenAddr:   ":443",
+		SiteDir:      filepath.Join(t.TempDir(), "site"),
+		ServerHeader: "nginx",
+	}
+	if certs == nil {
+		certs = &fakeCertManager{}
+	}
+	return NewDecoyManager(testLogger(), cfg, certs).(*DecoyManagerImpl), cfg
+}
+
+func TestDecoyInstallSite(t *testing.T) {
+	dm, cfg := newTestDecoy(t, nil)
+	cfg.Hysteria2.DefaultSNI = "photos.example.com"
+
+	if err := dm.InstallSite(); err != nil {
+		t.Fatalf("InstallSite: %v", err)
+	}
+	index, err := os.ReadFile(filepath.Join(cfg.Decoy.SiteDir, "index.html"))
+	if err != nil {
+		t.Fatalf("index.html: %v", err)
+	}
+	if !strings.Contains(string(index), "<title>photos.example.com</title>") || strings.Contains(string(index), "{{") {
+		t.Errorf("index.html not rendered with the site title:\n%s", index)
+	}
+	for _, name := range []string{"404.html", "about.html", "robots.txt", "style.css"} {
+		if _, err := os.Stat(filepath.Join(cfg.Decoy.SiteDir, name)); err != nil {
+			t.Errorf("%s not installed: %v", name, err)
+		}
+	}
+
+	// A site the operator put in place is left alone
+	custom := []byte("<html>custom</html>")
+	os.WriteFile(filepath.Join(cfg.Decoy.SiteDir, "index.html"), custom, 0644)
+	if err := dm.InstallSite(); err != nil {
+		t.Fatalf("second InstallSite: %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(cfg.Decoy.SiteDir, "index.html")); string(got) != string(custom) {
+		t.Errorf("existing site overwritten: %s", got)
+	}
+}
+
+func TestDecoySiteHandler(t *testing.T) {
+	dm, cfg := newTestDecoy(t, nil)
+	if err := dm.InstallSite(); err != nil {
+		t.Fatalf("InstallSite: %v", err)
+	}
+	os.Mkdir(filepath.Join(cfg.Decoy.SiteDir, "images"), 0755)
+	handler := dm.siteHandler()
+
+	tests := []struct {
+		method     string
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{http.MethodGet, "/", http.StatusOK, "Field Notes"},
+		{http.MethodHead, "/about.html", http.StatusOK, ""},
+		{http.MethodGet, "/missing", http.StatusNotFound, "Not Found"},
+		// Directories without an index are not listed
+		{http.MethodGet, "/images/", http.StatusNotFound, "Not Found"},
+		// Paths are resolved inside the site directory
+		{http.MethodGet, "/../../../etc/passwd", http.StatusNotFound, "Not Found"},
+		{http.MethodPost, "/", http.StatusMethodNotAllowed, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/", nil)
+		req.URL.Path = tt.path
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.path, w.Code, tt.wantStatus)
+		}
+		if !strings.Contains(w.Body.String(), tt.wantBody) {
+			t.Errorf("%s %s: body %q does not contain %q", tt.method, tt.path, w.Body.String(), tt.wantBody)
+		}
+		if w.Header().Get("Server") != "nginx" {
+			t.Errorf("%s %s: Server header %q, want nginx", tt.method, tt.path, w.Header().Get("Server"))
+		}
+	}
+}
+
+func TestDecoyRedirectHandler(t *testing.T) {
+	tests := []struct {
+		listen string
+		host   string
+		want   string
+	}{
+		{":443", "example.com", "https://example.com/blog?page=2"},
+		{":443", "example.com:80", "https://example.com/blog?page=2"},
+		{":8443", "example.com", "https://example.com:8443/blog?page=2"},
+	}
+	for _, tt := range tests {
+		dm, cfg := newTestDecoy(t, nil)
+		cfg.Decoy.ListenAddr = tt.listen
+
+		req := httptest.NewRequest(http.MethodGet, "/blog?page=2", nil)
+		req.Host = tt.host
+		w := httptest.NewRecorder()
+		dm.redirectHandler().ServeHTTP(w, req)
+
+		if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != tt.want {
+			t.Errorf("listen %s, host %s: %d to %q, want 301 to %q", tt.listen, tt.host, w.Code, w.Header().Get("Location"), tt.want)
+		}
+	}
+}
+
+func TestDecoyGetCertificate(t *testing.T) {
+	dir := t.TempDir()
+	sniDir := filepath.Join(dir, "sni")
+	os.Mkdir(sniDir, 0755)
+	writeTestCert(t, sniDir, "a.example.com.fullchain.pem", "a.example.com.privkey.pem", "a.example.com")
+	bCert, bKey := writeTestCert(t, dir, "b.crt", "b.key", "b.example.com")
+	selfCert, selfKey := writeTestCert(t, dir, "self.crt", "self.key", "node.example.net")
+
+	certs := &fakeCertManager{
+		paths:      map[string][2]string{"b.example.com": {bCert, bKey}},
+		selfSigned: [2]string{selfCert, selfKey},
+	}
+	dm, cfg := newTestDecoy(t, certs)
+	cfg.Hysteria2.SNICertPath = sniDir
+	cfg.Hysteria2.SNIKeyPath = sniDir
+	cfg.Hysteria2.SNIDomains = []string{"a.example.com", "b.example.com"}
+	cfg.Node.Hostname = "node.example.net"
+
+	commonName := func(serverName string) string {
+		cert, err := dm.getCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+		if err != nil {
+			t.Fatalf("getCertificate(%q): %v", serverName, err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.Subject.CommonName
+	}
+
+	// Let's Encrypt files, the certificate store, then the self-signed fallback
+	if got := commonName("A.example.com"); got != "a.example.com" {
+		t.Errorf("a.example.com served %s", got)
+	}
+	if got := commonName("b.example.com"); got != "b.example.com" {
+		t.Errorf("b.example.com served %s", got)
+	}
+	// Names that are not SNI domains of the node get the fallback, not whatever was asked for
+	if got := commonName("probe.invalid"); got != "node.example.net" {
+		t.Errorf("unknown name served %s, want the node's self-signed certificate", got)
+	}
+	if got := commonName(""); got != "node.example.net" {
+		t.Errorf("no SNI served %s, want the node's self-signed certificate", got)
+	}
+	if len(certs.generatedBy) != 1 || certs.generatedBy[0] != "node.example.net" {
+		t.Errorf("self-signed certificates generated for %v, want one for the node hostname", certs.generatedBy)
+	}
+
+	// Renewed certificates are picked up after a reload
+	writeTestCert(t, sniDir, "a.example.com.fullchain.pem", "a.example.com.privkey.pem", "renewed.example.com")
+	if got := commonName("a.example.com"); got != "a.example.com" {
+		t.Errorf("cached certificate not served: %s", got)
+	}
+	dm.ReloadCertificates()
+	if got := commonName("a.example.com"); got != "renewed.example.com" {
+		t.Errorf("after reload a.example.com served %s, want the renewed certificate", got)
+	}
+}
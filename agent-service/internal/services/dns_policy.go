@@ -0,0 +1,250 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+	"hysteria2_microservices/agent-service/internal/config"
+)
+
+// DNS routes for upstream traffic
+const (
+	DNSRouteWARP   = "warp"
+	DNSRouteDirect = "direct"
+)
+
+const (
+	dnsUpstreamSchemeDoH = "https"
+	dnsUpstreamSchemeDoT = "tls"
+	dnsDoTDefaultPort    = "853"
+	dnsUpstreamBackoff   = 30 * time.Second
+)
+
+// DNSPolicy selects the upstreams and route for each query. Rules are evaluated in
+// order and the first rule with a matching domain wins; unmatched queries use the
+// default upstreams and route.
+type DNSPolicy struct {
+	Upstreams []string         `json:"upstreams"`
+	ViaWARP   bool             `json:"via_warp"`
+	Rules     []config.DNSRule `json:"rules"`
+}
+
+// dnsUpstream is a parsed DoH ("https://1.1.1.1/dns-query") or DoT ("tls://1.1.1.1:853?sni=one.one.one.one") upstream
+type dnsUpstream struct {
+	raw        string
+	scheme     string
+	url        string
+	addr       string
+	serverName string
+}
+
+// dnsRoute is the resolved choice for one query
+type dnsRoute struct {
+	upstreams []dnsUpstream
+	viaWARP   bool
+	// strict routes fail rather than fall back to a direct connection when WARP is down
+	strict bool
+}
+
+type dnsCompiledRule struct {
+	domains []string
+	route   dnsRoute
+}
+
+// dnsCompiledPolicy is an immutable, validated DNSPolicy swapped in atomically
+type dnsCompiledPolicy struct {
+	source       DNSPolicy
+	defaultRoute dnsRoute
+	rules        []dnsCompiledRule
+}
+
+func parseDNSUpstream(raw string) (dnsUpstream, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return dnsUpstream{}, fmt.Errorf("invalid upstream %q: %w", raw, err)
+	}
+	if u.Hostname() == "" {
+		return dnsUpstream{}, fmt.Errorf("upstream %q has no host", raw)
+	}
+
+	switch u.Scheme {
+	case dnsUpstreamSchemeDoH:
+		return dnsUpstream{raw: raw, scheme: u.Scheme, url: raw}, nil
+	case dnsUpstreamSchemeDoT:
+		port := u.Port()
+		if port == "" {
+			port = dnsDoTDefaultPort
+		}
+		serverName := u.Query().Get("sni")
+		if serverName == "" {
+			serverName = u.Hostname()
+		}
+		return dnsUpstream{
+			raw:        raw,
+			scheme:     u.Scheme,
+			addr:       net.JoinHostPort(u.Hostname(), port),
+			serverName: serverName,
+		}, nil
+	default:
+		return dnsUpstream{}, fmt.Errorf("upstream %q must use https:// (DoH) or tls:// (DoT)", raw)
+	}
+}
+
+func parseDNSUpstreams(raw []string) ([]dnsUpstream, error) {
+	upstreams := make([]dnsUpstream, 0, len(raw))
+	for _, r := range raw {
+		upstream, err := parseDNSUpstream(r)
+		if err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, upstream)
+	}
+	return upstreams, nil
+}
+
+// compileDNSPolicy validates policy and resolves rule defaults
+func compileDNSPolicy(policy DNSPolicy) (*dnsCompiledPolicy, error) {
+	if len(policy.Upstreams) == 0 {
+		return nil, fmt.Errorf("no DNS upstreams configured")
+	}
+	defaults, err := parseDNSUpstreams(policy.Upstreams)
+	if err != nil {
+		return nil, err
+	}
+
+	compiled := &dnsCompiledPolicy{
+		source:       policy,
+		defaultRoute: dnsRoute{upstreams: defaults, viaWARP: policy.ViaWARP},
+	}
+
+	for i, rule := range policy.Rules {
+		if len(rule.Domains) == 0 {
+			return nil, fmt.Errorf("rule %d has no domains", i+1)
+		}
+
+		route := compiled.defaultRoute
+		route.strict = false
+		if len(rule.Upstreams) > 0 {
+			if route.upstreams, err = parseDNSUpstreams(rule.Upstreams); err != nil {
+				return nil, fmt.Errorf("rule %d: %w", i+1, err)
+			}
+		}
+		switch rule.Route {
+		case "":
+		case DNSRouteWARP:
+			route.viaWARP, route.strict = true, true
+		case DNSRouteDirect:
+			route.viaWARP = false
+		default:
+			return nil, fmt.Errorf("rule %d: unsupported route %q", i+1, rule.Route)
+		}
+
+		domains := make([]string, 0, len(rule.Domains))
+		for _, domain := range rule.Domains {
+			domain = strings.TrimPrefix(strings.TrimPrefix(strings.ToLower(strings.TrimSuffix(domain, ".")), "*."), ".")
+			if domain == "" {
+				return nil, fmt.Errorf("rule %d has an empty domain", i+1)
+			}
+			domains = append(domains, domain)
+		}
+
+		compiled.rules = append(compiled.rules, dnsCompiledRule{domains: domains, route: route})
+	}
+
+	return compiled, nil
+}
+
+// match returns the route for name; "example.com" matches the domain and its subdomains, "*" matches everything
+func (p *dnsCompiledPolicy) match(name string) dnsRoute {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, rule := range p.rules {
+		for _, domain := range rule.domains {
+			if domain == "*" || name == domain || strings.HasSuffix(name, "."+domain) {
+				return rule.route
+			}
+		}
+	}
+	return p.defaultRoute
+}
+
+// exchangeDoH sends the query with an RFC 8484 POST
+func exchangeDoH(ctx context.Context, client *http.Client, upstream dnsUpstream, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, upstream.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", upstream.raw, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, dnsMessageMaxSize))
+}
+
+// exchangeDoT sends the query over a fresh RFC 7858 connection
+func exchangeDoT(ctx context.Context, dialer proxy.ContextDialer, upstream dnsUpstream, query []byte) ([]byte, error) {
+	rawConn, err := dialer.DialContext(ctx, "tcp", upstream.addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(rawConn, &tls.Config{ServerName: upstream.serverName, MinVersion: tls.VersionTLS12})
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+
+	framed := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(framed, uint16(len(query)))
+	copy(framed[2:], query)
+	if _, err := conn.Write(framed); err != nil {
+		return nil, err
+	}
+
+	var length uint16
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	response := make([]byte, length)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// dnsQuestionName returns the name in the first question of a query
+func dnsQuestionName(query []byte) (string, error) {
+	var labels []string
+	for offset := dnsHeaderSize; offset < len(query); {
+		length := int(query[offset])
+		if length == 0 {
+			return strings.Join(labels, "."), nil
+		}
+		if length&0xc0 != 0 || offset+1+length > len(query) {
+			return "", fmt.Errorf("malformed question name")
+		}
+		labels = append(labels, string(query[offset+1:offset+1+length]))
+		offset += 1 + length
+	}
+	return "", fmt.Errorf("truncated question name")
+}
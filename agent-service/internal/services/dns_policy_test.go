@@ -0,0 +1,136 @@
+package services
+
+import (
+	"context"
+	"testing"
+
+	"hysteria2_microservices/agent-service/internal/config"
+)
+
+func TestParseDNSUpstream(t *testing.T) {
+	tests := []struct {
+		raw        string
+		wantAddr   string
+		wantServer string
+		wantErr    bool
+	}{
+		{raw: "https://1.1.1.1/dns-query"},
+		{raw: "tls://1.1.1.1", wantAddr: "1.1.1.1:853", wantServer: "1.1.1.1"},
+		{raw: "tls://9.9.9.9:8853?sni=dns.quad9.net", wantAddr: "9.9.9.9:8853", wantServer: "dns.quad9.net"},
+		{raw: "tls://[2606:4700:4700::1111]", wantAddr: "[2606:4700:4700::1111]:853", wantServer: "2606:4700:4700::1111"},
+		{raw: "udp://1.1.1.1:53", wantErr: true},
+		{raw: "1.1.1.1", wantErr: true},
+		{raw: "https:///dns-query", wantErr: true},
+	}
+	for _, tt := range tests {
+		upstream, err := parseDNSUpstream(tt.raw)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseDNSUpstream(%q) error = %v, want error %v", tt.raw, err, tt.wantErr)
+			continue
+		}
+		if err == nil && (upstream.addr != tt.wantAddr || upstream.serverName != tt.wantServer) {
+			t.Errorf("parseDNSUpstream(%q) = %s named %s, want %s named %s", tt.raw, upstream.addr, upstream.serverName, tt.wantAddr, tt.wantServer)
+		}
+	}
+}
+
+func TestCompileDNSPolicyValidates(t *testing.T) {
+	upstreams := []string{"https://1.1.1.1/dns-query"}
+	tests := []struct {
+		name   string
+		policy DNSPolicy
+	}{
+		{"no upstreams", DNSPolicy{}},
+		{"rule without domains", DNSPolicy{Upstreams: upstreams, Rules: []config.DNSRule{{Route: DNSRouteWARP}}}},
+		{"empty domain", DNSPolicy{Upstreams: upstreams, Rules: []config.DNSRule{{Domains: []string{"."}}}}},
+		{"unknown route", DNSPolicy{Upstreams: upstreams, Rules: []config.DNSRule{{Domains: []string{"ru"}, Route: "tor"}}}},
+		{"bad rule upstream", DNSPolicy{Upstreams: upstreams, Rules: []config.DNSRule{{Domains: []string{"ru"}, Upstreams: []string{"8.8.8.8"}}}}},
+	}
+	for _, tt := range tests {
+		if _, err := compileDNSPolicy(tt.policy); err == nil {
+			t.Errorf("%s: compiled", tt.name)
+		}
+	}
+}
+
+func TestDNSPolicyMatch(t *testing.T) {
+	policy, err := compileDNSPolicy(DNSPolicy{
+		Upstreams: []string{"https://1.1.1.1/dns-query"},
+		ViaWARP:   true,
+		Rules: []config.DNSRule{
+			{Domains: []string{"*.Blocked.example."}, Route: DNSRouteWARP},
+			{Domains: []string{"corp.local"}, Upstreams: []string{"tls://10.0.0.53?sni=dns.corp.local"}, Route: DNSRouteDirect},
+			{Domains: []string{"*"}, Upstreams: []string{"https://9.9.9.9/dns-query"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("compileDNSPolicy: %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		wantVia      bool
+		wantStrict   bool
+		wantUpstream string
+	}{
+		{"blocked.example", true, true, "https://1.1.1.1/dns-query"},
+		{"www.BLOCKED.example.", true, true, "https://1.1.1.1/dns-query"},
+		{"notblocked.example", true, false, "https://9.9.9.9/dns-query"},
+		{"git.corp.local", false, false, "tls://10.0.0.53?sni=dns.corp.local"},
+		// Rules without a route follow the policy's via_warp
+		{"example.com", true, false, "https://9.9.9.9/dns-query"},
+	}
+	for _, tt := range tests {
+		route := policy.match(tt.name)
+		if route.viaWARP != tt.wantVia || route.strict != tt.wantStrict || route.upstreams[0].raw != tt.wantUpstream {
+			t.Errorf("match(%q) = via WARP %v, strict %v, %s; want %v, %v, %s", tt.name,
+				route.viaWARP, route.strict, route.upstreams[0].raw, tt.wantVia, tt.wantStrict, tt.wantUpstream)
+		}
+	}
+}
+
+func TestDNSPolicyRoutesQueries(t *testing.T) {
+	public, local := newFakeDoH(t), newFakeDoH(t)
+	dr := newTestResolver(t, public.Client(), public.URL)
+	ctx := context.Background()
+
+	dr.resolve(ctx, buildDNSQuery("example.com"))
+	if err := dr.SetPolicy(DNSPolicy{
+		Upstreams: []string{public.URL},
+		Rules: []config.DNSRule{
+			{Domains: []string{"corp.local"}, Upstreams: []string{local.URL}},
+			{Domains: []string{"blocked.example"}, Route: DNSRouteWARP},
+		},
+	}); err != nil {
+		t.Fatalf("SetPolicy: %v", err)
+	}
+	if got := dr.GetPolicy(); len(got.Rules) != 2 {
+		t.Errorf("policy in effect has %d rules, want 2", len(got.Rules))
+	}
+
+	// Answers obtained through the old policy are dropped
+	dr.resolve(ctx, buildDNSQuery("example.com"))
+	dr.resolve(ctx, buildDNSQuery("git.corp.local"))
+	if got := public.queried(); len(got) != 2 {
+		t.Errorf("public upstream saw %v, want example.com twice", got)
+	}
+	if got := local.queried(); len(got) != 1 || got[0] != "git.corp.local" {
+		t.Errorf("rule upstream saw %v, want git.corp.local", got)
+	}
+
+	// Names that must go through WARP fail while WARP is off instead of leaking directly
+	response, _ := dr.resolve(ctx, buildDNSQuery("www.blocked.example"))
+	if response[3]&0x0f != dnsRcodeServFail {
+		t.Errorf("rcode %d for a WARP-only name without WARP, want SERVFAIL", response[3]&0x0f)
+	}
+	if got := public.queried(); len(got) != 2 {
+		t.Errorf("WARP-only name sent directly: %v", got)
+	}
+
+	if err := dr.SetPolicy(DNSPolicy{Upstreams: []string{"8.8.8.8:53"}}); err == nil {
+		t.Error("applied a plaintext upstream")
+	}
+	if got := dr.GetPolicy(); len(got.Rules) != 2 {
+		t.Error("a rejected policy replaced the one in effect")
+	}
+}
@@ -0,0 +1,830 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/proxy"
+	"hysteria2_microservices/agent-service/internal/config"
+	"hysteria2_microservices/agent-service/internal/hysteriaconfig"
+	"hysteria2_microservices/agent-service/internal/privsep"
+)
+
+const (
+	dnsMessageMaxSize   = 65535
+	dnsHeaderSize       = 12
+	dnsInterceptChain   = "HYSTERIA2-DNS"
+	dnsLeakProbeTimeout = 3 * time.Second
+	dnsLeakProbeDomain  = "leak-check.invalid"
+	dnsHealthCheckName  = "www.cloudflare.com"
+	dohContentType      = "application/dns-message"
+)
+
+// DNSLeakCheckResult reports whether the node resolves names and whether plaintext DNS is
+// contained. The IPv6 fields are only meaningful when IPv6 is true.
+type DNSLeakCheckResult struct {
+	Timestamp       time.Time `json:"timestamp"`
+	Resolving       bool      `json:"resolving"`
+	Intercepted     bool      `json:"intercepted"`
+	IPv6            bool      `json:"ipv6"`
+	ResolvingIPv6   bool      `json:"resolving_ipv6"`
+	InterceptedIPv6 bool      `json:"intercepted_ipv6"`
+	Leaking         bool      `json:"leaking"`
+	Message         string    `json:"message"`
+}
+
+// DNSResolverImpl is an embedded stub resolver on the node. It answers plain DNS on
+// loopback and forwards every query over DNS-over-HTTPS or DNS-over-TLS, so the only
+// DNS leaving the node is encrypted. Outgoing port 53 traffic is redirected to it with
+// iptables. Per-domain rules pick the upstreams and whether they are reached via WARP.
+type DNSResolverImpl struct {
+	logger       *logrus.Logger
+	config       *config.Config
+	directClient *http.Client
+	warpClient   *http.Client
+	warpDialer   proxy.ContextDialer
+	policy       atomic.Pointer[dnsCompiledPolicy]
+
+	mu        sync.Mutex
+	udpConns  []net.PacketConn
+	tcpLis    []net.Listener
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	running   bool
+	cache     map[string]dnsCacheEntry
+	probes    map[string]chan struct{}
+	down      map[string]time.Time
+	lastCheck *DNSLeakCheckResult
+
+	queries        atomic.Uint64
+	cacheHits      atomic.Uint64
+	upstreamErrors atomic.Uint64
+}
+
+type dnsCacheEntry struct {
+	response []byte
+	expires  time.Time
+}
+
+// NewDNSResolver creates a new DNSResolver
+func NewDNSResolver(logger *logrus.Logger, cfg *config.Config) DNSResolver {
+	return &DNSResolverImpl{
+		logger: logger,
+		config: cfg,
+		cache:  make(map[string]dnsCacheEntry),
+		probes: make(map[string]chan struct{}),
+		down:   make(map[string]time.Time),
+	}
+}
+
+// Start listens on the resolver address, installs the port 53 redirect and runs
+// periodic leak checks until ctx is cancelled or Stop is called
+func (dr *DNSResolverImpl) Start(ctx context.Context) error {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+
+	if dr.running {
+		return fmt.Errorf("DNS resolver is already running")
+	}
+	if dr.policy.Load() == nil {
+		policy, err := compileDNSPolicy(DNSPolicy{
+			Upstreams: dr.config.DNS.Upstreams,
+			ViaWARP:   dr.config.DNS.ViaWARP,
+			Rules:     dr.config.DNS.Rules,
+		})
+		if err != nil {
+			return fmt.Errorf("invalid DNS policy: %w", err)
+		}
+		dr.policy.Store(policy)
+	}
+
+	if err := dr.newClients(); err != nil {
+		return err
+	}
+
+	for i, addr := range dr.listenAddrs() {
+		udpConn, tcpLis, err := listenDNS(addr)
+		if err != nil {
+			// Only the configured address is required; the IPv6 loopback is best effort
+			if i > 0 {
+				dr.logger.Warnf("DNS resolver cannot listen on %s, IPv6 DNS will fail: %v", addr, err)
+				continue
+			}
+			return err
+		}
+		dr.udpConns = append(dr.udpConns, udpConn)
+		dr.tcpLis = append(dr.tcpLis, tcpLis)
+	}
+
+	if dr.config.DNS.Intercept {
+		if err := dr.installRedirect(); err != nil {
+			dr.closeListeners()
+			return fmt.Errorf("failed to redirect port 53: %w", err)
+		}
+	}
+
+	resolverCtx, cancel := context.WithCancel(ctx)
+	dr.cancel = cancel
+	dr.running = true
+
+	for i := range dr.udpConns {
+		dr.wg.Add(2)
+		go dr.serveUDP(resolverCtx, dr.udpConns[i])
+		go dr.serveTCP(resolverCtx, dr.tcpLis[i])
+	}
+
+	if dr.config.DNS.LeakCheckInterval > 0 {
+		dr.wg.Add(1)
+		go dr.leakCheckLoop(resolverCtx)
+	}
+
+	go func() {
+		<-resolverCtx.Done()
+		dr.Stop()
+	}()
+
+	policy := dr.policy.Load().source
+	dr.logger.Infof("DNS resolver listening on %s, forwarding to %s (via WARP: %v, rules: %d, intercept: %v)",
+		dr.config.DNS.ListenAddr, strings.Join(policy.Upstreams, ", "), policy.ViaWARP && dr.warpAvailable(), len(policy.Rules), dr.config.DNS.Intercept)
+	return nil
+}
+
+// SetPolicy validates and applies new upstreams and rules. Cached answers are dropped
+// so that no name keeps an answer obtained through the old route.
+func (dr *DNSResolverImpl) SetPolicy(policy DNSPolicy) error {
+	compiled, err := compileDNSPolicy(policy)
+	if err != nil {
+		return err
+	}
+
+	dr.mu.Lock()
+	dr.policy.Store(compiled)
+	dr.cache = make(map[string]dnsCacheEntry)
+	dr.down = make(map[string]time.Time)
+	dr.mu.Unlock()
+
+	dr.logger.Infof("DNS policy updated: upstreams %s, via WARP: %v, %d rules",
+		strings.Join(policy.Upstreams, ", "), policy.ViaWARP, len(policy.Rules))
+	return nil
+}
+
+// GetPolicy returns the policy in effect
+func (dr *DNSResolverImpl) GetPolicy() DNSPolicy {
+	if policy := dr.policy.Load(); policy != nil {
+		return policy.source
+	}
+	return DNSPolicy{
+		Upstreams: dr.config.DNS.Upstreams,
+		ViaWARP:   dr.config.DNS.ViaWARP,
+		Rules:     dr.config.DNS.Rules,
+	}
+}
+
+// Stop closes the listeners and removes the port 53 redirect
+func (dr *DNSResolverImpl) Stop() error {
+	dr.mu.Lock()
+	if !dr.running {
+		dr.mu.Unlock()
+		return nil
+	}
+	dr.running = false
+	dr.cancel()
+	err := dr.closeListeners()
+	dr.mu.Unlock()
+
+	dr.wg.Wait()
+
+	if dr.config.DNS.Intercept {
+		dr.removeRedirect()
+	}
+
+	dr.logger.Info("DNS resolver stopped")
+	return err
+}
+
+// closeListeners closes every listener; callers hold mu
+func (dr *DNSResolverImpl) closeListeners() error {
+	var err error
+	for _, conn := range dr.udpConns {
+		if closeErr := conn.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	for _, lis := range dr.tcpLis {
+		if closeErr := lis.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	dr.udpConns, dr.tcpLis = nil, nil
+	return err
+}
+
+// listenAddrs returns the configured address and, when it is the IPv4 loopback, the IPv6
+// loopback on the same port, which is where ip6tables REDIRECT delivers IPv6 DNS
+func (dr *DNSResolverImpl) listenAddrs() []string {
+	addrs := []string{dr.config.DNS.ListenAddr}
+	if host, port, err := net.SplitHostPort(dr.config.DNS.ListenAddr); err == nil && host == "127.0.0.1" && ipv6Enabled(dr.config) {
+		addrs = append(addrs, net.JoinHostPort("::1", port))
+	}
+	return addrs
+}
+
+func listenDNS(addr string) (net.PacketConn, net.Listener, error) {
+	udpConn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to listen on udp %s: %w", addr, err)
+	}
+	tcpLis, err := net.Listen("tcp", addr)
+	if err != nil {
+		udpConn.Close()
+		return nil, nil, fmt.Errorf("failed to listen on tcp %s: %w", addr, err)
+	}
+	return udpConn, tcpLis, nil
+}
+
+// IsRunning reports whether the resolver is answering queries
+func (dr *DNSResolverImpl) IsRunning() bool {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+	return dr.running
+}
+
+// GetStats returns query counters and the last leak check
+func (dr *DNSResolverImpl) GetStats() map[string]interface{} {
+	policy := dr.GetPolicy()
+
+	dr.mu.Lock()
+	running := dr.running
+	cached := len(dr.cache)
+	lastCheck := dr.lastCheck
+	down := make([]string, 0, len(dr.down))
+	for upstream, until := range dr.down {
+		if time.Now().Before(until) {
+			down = append(down, upstream)
+		}
+	}
+	dr.mu.Unlock()
+
+	stats := map[string]interface{}{
+		"running":         running,
+		"listen_addr":     dr.config.DNS.ListenAddr,
+		"upstreams":       policy.Upstreams,
+		"upstreams_down":  down,
+		"via_warp":        policy.ViaWARP && dr.warpAvailable(),
+		"rules":           len(policy.Rules),
+		"intercept":       dr.config.DNS.Intercept,
+		"queries":         dr.queries.Load(),
+		"cache_hits":      dr.cacheHits.Load(),
+		"cache_entries":   cached,
+		"upstream_errors": dr.upstreamErrors.Load(),
+	}
+	if lastCheck != nil {
+		stats["leak_check"] = *lastCheck
+	}
+	return stats
+}
+
+// LastLeakCheck returns the result of the most recent leak check, or nil if none has run
+func (dr *DNSResolverImpl) LastLeakCheck() *DNSLeakCheckResult {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+	return dr.lastCheck
+}
+
+// CheckLeaks resolves a name through the local resolver, then sends a plaintext probe
+// straight to a public resolver. The probe must be caught by the port 53 redirect and
+// answered locally; if it is not, plaintext DNS from this node reaches the internet.
+func (dr *DNSResolverImpl) CheckLeaks() DNSLeakCheckResult {
+	result := DNSLeakCheckResult{Timestamp: time.Now()}
+
+	if !dr.IsRunning() {
+		result.Leaking = true
+		result.Message = "DNS resolver is not running"
+		dr.recordLeakCheck(result)
+		return result
+	}
+
+	result.Resolving = dr.checkResolution("ip4")
+
+	intercepted, err := dr.probeInterception(dr.config.DNS.LeakCheckServer)
+	result.Intercepted = intercepted
+	result.Leaking = !intercepted
+
+	if ipv6Enabled(dr.config) && dr.config.DNS.LeakCheckServerV6 != "" {
+		result.IPv6 = true
+		result.ResolvingIPv6 = dr.checkResolution("ip6")
+
+		interceptedV6, errV6 := dr.probeInterception(dr.config.DNS.LeakCheckServerV6)
+		result.InterceptedIPv6 = interceptedV6
+		if !interceptedV6 && intercepted {
+			result.Leaking = true
+			err = errV6
+		}
+	}
+
+	switch {
+	case !result.Leaking && result.Resolving && (!result.IPv6 || result.ResolvingIPv6):
+		result.Message = "DNS is resolved over encrypted upstreams and plaintext DNS is intercepted"
+	case !result.Leaking && !result.Resolving:
+		result.Message = "Plaintext DNS is intercepted but the resolver cannot reach its upstreams"
+	case !result.Leaking:
+		result.Message = "Plaintext DNS is intercepted but AAAA lookups return no addresses"
+	case intercepted && err != nil:
+		result.Message = fmt.Sprintf("Plaintext IPv6 DNS probe to %s was not intercepted: %v", dr.config.DNS.LeakCheckServerV6, err)
+	case intercepted:
+		result.Message = fmt.Sprintf("Plaintext IPv6 DNS probe to %s was answered without passing the local resolver", dr.config.DNS.LeakCheckServerV6)
+	case err != nil:
+		result.Message = fmt.Sprintf("Plaintext DNS probe to %s was not intercepted: %v", dr.config.DNS.LeakCheckServer, err)
+	default:
+		result.Message = fmt.Sprintf("Plaintext DNS probe to %s was answered without passing the local resolver", dr.config.DNS.LeakCheckServer)
+	}
+
+	dr.recordLeakCheck(result)
+	return result
+}
+
+func (dr *DNSResolverImpl) recordLeakCheck(result DNSLeakCheckResult) {
+	dr.mu.Lock()
+	dr.lastCheck = &result
+	dr.mu.Unlock()
+
+	if result.Leaking {
+		dr.logger.Errorf("DNS leak check failed: %s", result.Message)
+	}
+}
+
+func (dr *DNSResolverImpl) leakCheckLoop(ctx context.Context) {
+	defer dr.wg.Done()
+
+	ticker := time.NewTicker(time.Duration(dr.config.DNS.LeakCheckInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			dr.CheckLeaks()
+		}
+	}
+}
+
+// checkResolution looks up A ("ip4") or AAAA ("ip6") records through the local resolver
+func (dr *DNSResolverImpl) checkResolution(network string) bool {
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, dr.config.DNS.ListenAddr)
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dr.timeout())
+	defer cancel()
+
+	addrs, err := resolver.LookupIP(ctx, network, dnsHealthCheckName)
+	return err == nil && len(addrs) > 0
+}
+
+// probeInterception sends a query for a unique name to server and reports whether the
+// local resolver received it
+func (dr *DNSResolverImpl) probeInterception(server string) (bool, error) {
+	label := make([]byte, 8)
+	if _, err := rand.Read(label); err != nil {
+		return false, err
+	}
+	query := buildDNSQuery(hex.EncodeToString(label) + "." + dnsLeakProbeDomain)
+	key := string(query[dnsHeaderSize:])
+
+	seen := make(chan struct{})
+	dr.mu.Lock()
+	dr.probes[key] = seen
+	dr.mu.Unlock()
+	defer func() {
+		dr.mu.Lock()
+		delete(dr.probes, key)
+		dr.mu.Unlock()
+	}()
+
+	conn, err := net.DialTimeout("udp", server, dnsLeakProbeTimeout)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(dnsLeakProbeTimeout))
+	if _, err := conn.Write(query); err != nil {
+		return false, err
+	}
+
+	buf := make([]byte, 512)
+	_, readErr := conn.Read(buf)
+
+	select {
+	case <-seen:
+		return true, nil
+	default:
+		return false, readErr
+	}
+}
+
+func (dr *DNSResolverImpl) serveUDP(ctx context.Context, conn net.PacketConn) {
+	defer dr.wg.Done()
+
+	buf := make([]byte, dnsMessageMaxSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			dr.logger.Debugf("DNS resolver udp read error: %v", err)
+			continue
+		}
+
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			response, err := dr.resolve(ctx, query)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(response, addr)
+		}()
+	}
+}
+
+func (dr *DNSResolverImpl) serveTCP(ctx context.Context, lis net.Listener) {
+	defer dr.wg.Done()
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			dr.logger.Debugf("DNS resolver tcp accept error: %v", err)
+			continue
+		}
+		go dr.handleTCP(ctx, conn)
+	}
+}
+
+// handleTCP serves length-prefixed queries until the client closes the connection
+func (dr *DNSResolverImpl) handleTCP(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(dr.timeout()))
+
+		var length uint16
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			return
+		}
+		query := make([]byte, length)
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+
+		response, err := dr.resolve(ctx, query)
+		if err != nil {
+			return
+		}
+
+		framed := make([]byte, 2+len(response))
+		binary.BigEndian.PutUint16(framed, uint16(len(response)))
+		copy(framed[2:], response)
+		if _, err := conn.Write(framed); err != nil {
+			return
+		}
+	}
+}
+
+// resolve answers a wire-format query from the cache or the encrypted upstreams.
+// On upstream failure the client gets SERVFAIL rather than a silent drop.
+func (dr *DNSResolverImpl) resolve(ctx context.Context, query []byte) ([]byte, error) {
+	if len(query) < dnsHeaderSize {
+		return nil, fmt.Errorf("short DNS message")
+	}
+	dr.queries.Add(1)
+
+	key := string(query[2:])
+
+	dr.mu.Lock()
+	if seen, ok := dr.probes[string(query[dnsHeaderSize:])]; ok {
+		close(seen)
+		delete(dr.probes, string(query[dnsHeaderSize:]))
+		dr.mu.Unlock()
+		return dnsErrorResponse(query, dnsRcodeRefused), nil
+	}
+	entry, cached := dr.cache[key]
+	dr.mu.Unlock()
+
+	if cached && time.Now().Before(entry.expires) {
+		dr.cacheHits.Add(1)
+		response := append([]byte(nil), entry.response...)
+		copy(response[:2], query[:2])
+		return response, nil
+	}
+
+	response, err := dr.exchange(ctx, query)
+	if err != nil {
+		dr.upstreamErrors.Add(1)
+		dr.logger.Warnf("DNS upstream query failed: %v", err)
+		return dnsErrorResponse(query, dnsRcodeServFail), nil
+	}
+
+	if rcode := response[3] & 0x0f; dr.config.DNS.CacheSize > 0 && (rcode == dnsRcodeSuccess || rcode == dnsRcodeNXDomain) {
+		dr.mu.Lock()
+		if len(dr.cache) >= dr.config.DNS.CacheSize {
+			dr.evictExpired()
+		}
+		if len(dr.cache) < dr.config.DNS.CacheSize {
+			dr.cache[key] = dnsCacheEntry{
+				response: response,
+				expires:  time.Now().Add(time.Duration(dr.config.DNS.CacheTTL) * time.Second),
+			}
+		}
+		dr.mu.Unlock()
+	}
+
+	return response, nil
+}
+
+// evictExpired drops expired answers, or every answer if none have expired; callers hold mu
+func (dr *DNSResolverImpl) evictExpired() {
+	now := time.Now()
+	for key, entry := range dr.cache {
+		if now.After(entry.expires) {
+			delete(dr.cache, key)
+		}
+	}
+	if len(dr.cache) >= dr.config.DNS.CacheSize {
+		dr.cache = make(map[string]dnsCacheEntry)
+	}
+}
+
+// exchange sends the query to the upstreams of the matching policy rule in order.
+// Upstreams that failed recently are tried last.
+func (dr *DNSResolverImpl) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	name, err := dnsQuestionName(query)
+	if err != nil {
+		return nil, err
+	}
+	route := dr.policy.Load().match(name)
+
+	viaWARP := route.viaWARP && dr.warpAvailable()
+	if route.strict && !viaWARP {
+		return nil, fmt.Errorf("%s must be resolved via WARP, which is not available", name)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dr.timeout())
+	defer cancel()
+
+	var lastErr error
+	for _, upstream := range dr.orderUpstreams(route.upstreams) {
+		response, err := dr.exchangeWith(ctx, upstream, viaWARP, query)
+		if err == nil && len(response) < dnsHeaderSize {
+			err = fmt.Errorf("%s returned a short DNS message", upstream.raw)
+		}
+		if err != nil {
+			lastErr = err
+			dr.markUpstream(upstream, false)
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		dr.markUpstream(upstream, true)
+		return response, nil
+	}
+
+	if lastErr == nil {
+		lastErr = errors.New("no upstreams")
+	}
+	return nil, lastErr
+}
+
+func (dr *DNSResolverImpl) exchangeWith(ctx context.Context, upstream dnsUpstream, viaWARP bool, query []byte) ([]byte, error) {
+	if upstream.scheme == dnsUpstreamSchemeDoT {
+		var dialer proxy.ContextDialer = &net.Dialer{}
+		if viaWARP {
+			dialer = dr.warpDialer
+		}
+		return exchangeDoT(ctx, dialer, upstream, query)
+	}
+
+	client := dr.directClient
+	if viaWARP {
+		client = dr.warpClient
+	}
+	return exchangeDoH(ctx, client, upstream, query)
+}
+
+// orderUpstreams moves upstreams inside their failure backoff to the end of the list
+func (dr *DNSResolverImpl) orderUpstreams(upstreams []dnsUpstream) []dnsUpstream {
+	now := time.Now()
+	ordered := make([]dnsUpstream, 0, len(upstreams))
+	var down []dnsUpstream
+
+	dr.mu.Lock()
+	for _, upstream := range upstreams {
+		if until, ok := dr.down[upstream.raw]; ok && now.Before(until) {
+			down = append(down, upstream)
+			continue
+		}
+		ordered = append(ordered, upstream)
+	}
+	dr.mu.Unlock()
+
+	return append(ordered, down...)
+}
+
+func (dr *DNSResolverImpl) markUpstream(upstream dnsUpstream, healthy bool) {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+
+	if healthy {
+		delete(dr.down, upstream.raw)
+		return
+	}
+	if _, ok := dr.down[upstream.raw]; !ok {
+		dr.logger.Warnf("DNS upstream %s failed, deprioritising it for %s", upstream.raw, dnsUpstreamBackoff)
+	}
+	dr.down[upstream.raw] = time.Now().Add(dnsUpstreamBackoff)
+}
+
+// newClients prepares direct and WARP transports; which one a query uses depends on its policy rule
+func (dr *DNSResolverImpl) newClients() error {
+	newTransport := func() *http.Transport {
+		return &http.Transport{
+			ForceAttemptHTTP2:   true,
+			MaxIdleConnsPerHost: 4,
+			IdleConnTimeout:     90 * time.Second,
+		}
+	}
+
+	dr.directClient = &http.Client{Transport: newTransport(), Timeout: dr.timeout()}
+	dr.warpClient = dr.directClient
+	dr.warpDialer = &net.Dialer{}
+
+	if dr.warpAvailable() {
+		proxyAddr := fmt.Sprintf("127.0.0.1:%d", dr.config.Hysteria2.WARPProxyPort)
+		proxyURL, err := url.Parse("socks5://" + proxyAddr)
+		if err != nil {
+			return fmt.Errorf("invalid WARP proxy address: %w", err)
+		}
+		transport := newTransport()
+		transport.Proxy = http.ProxyURL(proxyURL)
+		dr.warpClient = &http.Client{Transport: transport, Timeout: dr.timeout()}
+
+		dialer, err := proxy.SOCKS5("tcp", proxyAddr, nil, &net.Dialer{})
+		if err != nil {
+			return fmt.Errorf("invalid WARP proxy address: %w", err)
+		}
+		dr.warpDialer = dialer.(proxy.ContextDialer)
+	}
+
+	return nil
+}
+
+func (dr *DNSResolverImpl) warpAvailable() bool {
+	return dr.config.Hysteria2.WARPEnabled && dr.config.Hysteria2.WARPProxyPort > 0
+}
+
+func (dr *DNSResolverImpl) timeout() time.Duration {
+	return dnsTimeout(dr.config)
+}
+
+// installRedirect sends all locally generated port 53 traffic, including Hysteria2 and
+// Xray client lookups and the system resolver, to the embedded resolver
+func (dr *DNSResolverImpl) installRedirect() error {
+	port := strconv.Itoa(dnsListenPort(dr.config))
+	dr.removeRedirect()
+
+	for _, cmd := range []string{"iptables", "ip6tables"} {
+		rules := [][]string{
+			{"-t", "nat", "-N", dnsInterceptChain},
+			{"-t", "nat", "-A", dnsInterceptChain, "-p", "udp", "--dport", "53", "-j", "REDIRECT", "--to-ports", port},
+			{"-t", "nat", "-A", dnsInterceptChain, "-p", "tcp", "--dport", "53", "-j", "REDIRECT", "--to-ports", port},
+			{"-t", "nat", "-I", "OUTPUT", "-j", dnsInterceptChain},
+		}
+		for _, rule := range rules {
+			if err := dr.runCommand(cmd, rule...); err != nil {
+				if cmd == "ip6tables" {
+					dr.logger.Warnf("Failed to apply IPv6 DNS redirect, IPv6 DNS may bypass the resolver: %v", err)
+					break
+				}
+				return fmt.Errorf("%s %s: %w", cmd, strings.Join(rule, " "), err)
+			}
+		}
+	}
+	return nil
+}
+
+func (dr *DNSResolverImpl) removeRedirect() {
+	for _, cmd := range []string{"iptables", "ip6tables"} {
+		dr.runCommand(cmd, "-t", "nat", "-D", "OUTPUT", "-j", dnsInterceptChain)
+		dr.runCommand(cmd, "-t", "nat", "-F", dnsInterceptChain)
+		dr.runCommand(cmd, "-t", "nat", "-X", dnsInterceptChain)
+	}
+}
+
+func (dr *DNSResolverImpl) runCommand(name string, args ...string) error {
+	dr.logger.Debugf("Running command: %s %v", name, args)
+	output, err := privsep.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// DNS response codes used by the resolver
+const (
+	dnsRcodeSuccess  = 0
+	dnsRcodeServFail = 2
+	dnsRcodeNXDomain = 3
+	dnsRcodeRefused  = 5
+)
+
+// dnsErrorResponse turns a query into a response carrying rcode and no answers
+func dnsErrorResponse(query []byte, rcode byte) []byte {
+	response := append([]byte(nil), query...)
+	response[2] |= 0x80                               // QR: response
+	response[3] = 0x80 | (response[3] & 0x70) | rcode // RA, keep Z/AD/CD
+	return response
+}
+
+// buildDNSQuery encodes a recursive A query for name
+func buildDNSQuery(name string) []byte {
+	query := make([]byte, dnsHeaderSize, dnsHeaderSize+len(name)+6)
+	rand.Read(query[:2])
+	query[2] = 0x01                          // RD
+	binary.BigEndian.PutUint16(query[4:], 1) // QDCOUNT
+
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		query = append(query, byte(len(label)))
+		query = append(query, label...)
+	}
+	query = append(query, 0, 0, 1, 0, 1) // root, QTYPE A, QCLASS IN
+	return query
+}
+
+func dnsTimeout(cfg *config.Config) time.Duration {
+	if cfg.DNS.Timeout <= 0 {
+		return 5 * time.Second
+	}
+	return time.Duration(cfg.DNS.Timeout) * time.Second
+}
+
+// dnsListenPort returns the resolver port that port 53 traffic is redirected to
+func dnsListenPort(cfg *config.Config) int {
+	if _, port, err := net.SplitHostPort(cfg.DNS.ListenAddr); err == nil {
+		if p, err := strconv.Atoi(port); err == nil {
+			return p
+		}
+	}
+	return 53
+}
+
+// hysteriaResolverConfig points the Hysteria2 server at the local resolver
+func hysteriaResolverConfig(cfg *config.Config) *hysteriaconfig.Resolver {
+	return &hysteriaconfig.Resolver{
+		Type: "udp",
+		UDP: &hysteriaconfig.ResolverServer{
+			Addr:    cfg.DNS.ListenAddr,
+			Timeout: dnsTimeout(cfg).String(),
+		},
+	}
+}
+
+// xrayDNSConfig points Xray's built-in DNS at the local resolver; freedom outbounds
+// use it when their domainStrategy is UseIP
+func xrayDNSConfig(cfg *config.Config) map[string]interface{} {
+	host, _, err := net.SplitHostPort(cfg.DNS.ListenAddr)
+	if err != nil || host == "" {
+		host = "127.0.0.1"
+	}
+	return map[string]interface{}{
+		"servers": []interface{}{
+			map[string]interface{}{
+				"address": host,
+				"port":    dnsListenPort(cfg),
+			},
+		},
+		"queryStrategy": "UseIP",
+	}
+}
@@ -0,0 +1,266 @@
+package services
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"hysteria2_microservices/agent-service/internal/config"
+)
+
+// dnsAnswer answers query with a single A record for ip, dropping any EDNS record
+func dnsAnswer(query []byte, ip net.IP) []byte {
+	end := dnsHeaderSize
+	for query[end] != 0 {
+		end += 1 + int(query[end])
+	}
+	response := append([]byte(nil), query[:end+5]...) // root, QTYPE, QCLASS
+	response[2] |= 0x80
+	response[3] = 0x80
+	binary.BigEndian.PutUint16(response[6:], 1)  // ANCOUNT
+	binary.BigEndian.PutUint16(response[10:], 0) // ARCOUNT
+	response = append(response, 0xc0, dnsHeaderSize, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+	return append(response, ip.To4()...)
+}
+
+// fakeDoH is an RFC 8484 upstream answering every name with 192.0.2.1, or failing
+type fakeDoH struct {
+	*httptest.Server
+	mu      sync.Mutex
+	names   []string
+	failing bool
+}
+
+func newFakeDoH(t *testing.T) *fakeDoH {
+	f := &fakeDoH{}
+	f.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, _ := io.ReadAll(r.Body)
+		name, err := dnsQuestionName(query)
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != dohContentType || err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		f.mu.Lock()
+		f.names = append(f.names, name)
+		failing := f.failing
+		f.mu.Unlock()
+		if failing {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", dohContentType)
+		w.Write(dnsAnswer(query, net.IPv4(192, 0, 2, 1)))
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeDoH) setFailing(failing bool) {
+	f.mu.Lock()
+	f.failing = failing
+	f.mu.Unlock()
+}
+
+func (f *fakeDoH) queried() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.names...)
+}
+
+// newTestResolver returns a resolver forwarding to upstreams without listening or
+// touching iptables
+func newTestResolver(t *testing.T, client *http.Client, upstreams ...string) *DNSResolverImpl {
+	cfg := &config.Config{}
+	cfg.DNS = config.DNSConfig{Upstreams: upstreams, Timeout: 2, CacheSize: 16, CacheTTL: 60}
+	dr := NewDNSResolver(testLogger(), cfg).(*DNSResolverImpl)
+	if err := dr.SetPolicy(DNSPolicy{Upstreams: upstreams}); err != nil {
+		t.Fatalf("SetPolicy: %v", err)
+	}
+	if err := dr.newClients(); err != nil {
+		t.Fatalf("newClients: %v", err)
+	}
+	dr.directClient = client
+	return dr
+}
+
+func TestDNSResolverResolvesAndCaches(t *testing.T) {
+	upstream := newFakeDoH(t)
+	dr := newTestResolver(t, upstream.Client(), upstream.URL)
+	ctx := context.Background()
+
+	query := buildDNSQuery("example.com")
+	response, err := dr.resolve(ctx, query)
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	if response[0] != query[0] || response[1] != query[1] || response[3]&0x0f != dnsRcodeSuccess || binary.BigEndian.Uint16(response[6:]) != 1 {
+		t.Errorf("response header % x, want the query ID and one answer", response[:dnsHeaderSize])
+	}
+
+	// The same question with another ID is answered from the cache under the new ID
+	again := buildDNSQuery("example.com")
+	again[0], again[1] = query[0]^0xff, query[1]
+	cached, err := dr.resolve(ctx, again)
+	if err != nil {
+		t.Fatalf("resolve cached: %v", err)
+	}
+	if cached[0] != again[0] || string(cached[2:]) != string(response[2:]) {
+		t.Error("cached answer differs or keeps the first query's ID")
+	}
+	if got := upstream.queried(); len(got) != 1 || got[0] != "example.com" {
+		t.Errorf("upstream saw %v, want one query for example.com", got)
+	}
+	if stats := dr.GetStats(); stats["queries"] != uint64(2) || stats["cache_hits"] != uint64(1) {
+		t.Errorf("stats = %v, want 2 queries with 1 cache hit", stats)
+	}
+
+	if _, err := dr.resolve(ctx, []byte{0, 1}); err == nil {
+		t.Error("resolved a message shorter than a header")
+	}
+}
+
+func TestDNSResolverFailsOver(t *testing.T) {
+	primary, secondary := newFakeDoH(t), newFakeDoH(t)
+	primary.setFailing(true)
+	// Both test servers share one certificate authority
+	dr := newTestResolver(t, primary.Client(), primary.URL, secondary.URL)
+	ctx := context.Background()
+
+	response, _ := dr.resolve(ctx, buildDNSQuery("a.example.com"))
+	if response[3]&0x0f != dnsRcodeSuccess {
+		t.Fatalf("rcode %d, want an answer from the second upstream", response[3]&0x0f)
+	}
+	// The failed upstream is tried last while it backs off
+	dr.resolve(ctx, buildDNSQuery("b.example.com"))
+	if got := primary.queried(); len(got) != 1 {
+		t.Errorf("failed upstream queried for %v, want only the first name", got)
+	}
+	if down := dr.GetStats()["upstreams_down"].([]string); len(down) != 1 || down[0] != primary.URL {
+		t.Errorf("upstreams down = %v, want the primary", down)
+	}
+
+	// Clients get SERVFAIL rather than silence once every upstream fails
+	secondary.setFailing(true)
+	query := buildDNSQuery("c.example.com")
+	response, err := dr.resolve(ctx, query)
+	if err != nil || response[3]&0x0f != dnsRcodeServFail || response[0] != query[0] {
+		t.Errorf("resolve = rcode %d, %v; want SERVFAIL for the query", response[3]&0x0f, err)
+	}
+	if dr.GetStats()["upstream_errors"] != uint64(1) {
+		t.Errorf("upstream errors = %v, want 1", dr.GetStats()["upstream_errors"])
+	}
+}
+
+func TestDNSResolverServesUDPAndTCP(t *testing.T) {
+	upstream := newFakeDoH(t)
+	dr := newTestResolver(t, upstream.Client(), upstream.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	udpConn, tcpLis, err := listenDNS("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listenDNS: %v", err)
+	}
+	defer udpConn.Close()
+	defer tcpLis.Close()
+	dr.wg.Add(2)
+	go dr.serveUDP(ctx, udpConn)
+	go dr.serveTCP(ctx, tcpLis)
+
+	// Plain DNS clients are answered over both transports
+	for _, network := range []string{"udp", "tcp"} {
+		resolver := &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				if network == "udp" {
+					return d.DialContext(ctx, network, udpConn.LocalAddr().String())
+				}
+				return d.DialContext(ctx, network, tcpLis.Addr().String())
+			},
+		}
+		lookupCtx, lookupCancel := context.WithTimeout(ctx, 5*time.Second)
+		addrs, err := resolver.LookupIP(lookupCtx, "ip4", network+".example.com")
+		lookupCancel()
+		if err != nil || len(addrs) != 1 || !addrs[0].Equal(net.IPv4(192, 0, 2, 1)) {
+			t.Errorf("lookup over %s = %v, %v; want 192.0.2.1", network, addrs, err)
+		}
+	}
+}
+
+func TestDNSLeakProbe(t *testing.T) {
+	upstream := newFakeDoH(t)
+	dr := newTestResolver(t, upstream.Client(), upstream.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	udpConn, tcpLis, err := listenDNS("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listenDNS: %v", err)
+	}
+	defer udpConn.Close()
+	defer tcpLis.Close()
+	dr.wg.Add(1)
+	go dr.serveUDP(ctx, udpConn)
+
+	// A probe that reaches the resolver was intercepted, and never goes upstream
+	intercepted, err := dr.probeInterception(udpConn.LocalAddr().String())
+	if !intercepted || err != nil {
+		t.Errorf("probe through the resolver: intercepted %v, %v", intercepted, err)
+	}
+	if got := upstream.queried(); len(got) != 0 {
+		t.Errorf("probe forwarded upstream: %v", got)
+	}
+
+	// A public resolver answering the probe itself means plaintext DNS escapes
+	rogue, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rogue.Close()
+	go func() {
+		buf := make([]byte, 512)
+		n, addr, err := rogue.ReadFrom(buf)
+		if err == nil {
+			rogue.WriteTo(dnsErrorResponse(buf[:n], dnsRcodeNXDomain), addr)
+		}
+	}()
+	if intercepted, _ := dr.probeInterception(rogue.LocalAddr().String()); intercepted {
+		t.Error("probe answered elsewhere counted as intercepted")
+	}
+
+	// A stopped resolver is reported as leaking
+	if result := dr.CheckLeaks(); !result.Leaking || dr.LastLeakCheck() == nil {
+		t.Errorf("check with the resolver stopped = %+v, want leaking", result)
+	}
+}
+
+func TestDNSClientSettings(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.DNS.ListenAddr = "127.0.0.1:5353"
+	cfg.DNS.Timeout = 3
+
+	if port := dnsListenPort(cfg); port != 5353 {
+		t.Errorf("dnsListenPort = %d, want 5353", port)
+	}
+	resolver := hysteriaResolverConfig(cfg)
+	if resolver.Type != "udp" || resolver.UDP.Addr != "127.0.0.1:5353" || resolver.UDP.Timeout != "3s" {
+		t.Errorf("Hysteria2 resolver = %+v, want the local resolver", resolver.UDP)
+	}
+	server := xrayDNSConfig(cfg)["servers"].([]interface{})[0].(map[string]interface{})
+	if server["address"] != "127.0.0.1" || server["port"] != 5353 {
+		t.Errorf("Xray DNS server = %v, want the local resolver", server)
+	}
+
+	cfg.DNS.ListenAddr = "bad"
+	if port := dnsListenPort(cfg); port != 53 {
+		t.Errorf("dnsListenPort without a port = %d, want 53", port)
+	}
+}
@@ -0,0 +1,284 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"hysteria2_microservices/agent-service/internal/config"
+)
+
+// Drift item kinds
+const (
+	DriftConfig   = "config"   // deployed config edited or removed out of band
+	DriftProtocol = "protocol" // protocol matrix or Xray inbound differing from the desired one
+	DriftService  = "service"  // server running when it should be stopped, or the reverse
+	DriftFirewall = "firewall" // baseline or saved rule missing from the live ruleset
+	DriftRouting  = "routing"  // saved masquerading or WARP routing rule not installed
+)
+
+// DriftItem is one difference between the node and its desired state
+type DriftItem struct {
+	Kind     string `json:"kind"`
+	Target   string `json:"target"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+}
+
+// DriftReport lists the differences found by one drift check
+type DriftReport struct {
+	Items     []DriftItem `json:"items"`
+	CheckedAt time.Time   `json:"checked_at"`
+}
+
+// DriftHealReport is the outcome of re-applying the desired state: what was done, what could
+// not be done and the drift left afterwards
+type DriftHealReport struct {
+	Actions   []string     `json:"actions"`
+	Failed    []string     `json:"failed,omitempty"`
+	Remaining *DriftReport `json:"remaining"`
+}
+
+// DriftDetectorImpl compares the node with its desired state: the configs, firewall rules
+// and routing rules the agent last applied, and the protocol matrix the orchestrator holds.
+// Heal re-applies them. Checks and heals run one at a time.
+type DriftDetectorImpl struct {
+	logger          *logrus.Logger
+	config          *config.Config
+	integrity       IntegrityMonitor
+	protocols       ProtocolReconciler
+	hysteriaManager HysteriaManager
+	xrayManager     XrayManager
+	firewall        FirewallManager
+	network         NetworkManager
+
+	mu sync.Mutex
+}
+
+// NewDriftDetector creates a new DriftDetector
+func NewDriftDetector(logger *logrus.Logger, cfg *config.Config, integrity IntegrityMonitor, protocols ProtocolReconciler,
+	hysteriaManager HysteriaManager, xrayManager XrayManager, firewall FirewallManager, network NetworkManager) DriftDetector {
+	return &DriftDetectorImpl{
+		logger:          logger,
+		config:          cfg,
+		integrity:       integrity,
+		protocols:       protocols,
+		hysteriaManager: hysteriaManager,
+		xrayManager:     xrayManager,
+		firewall:        firewall,
+		network:         network,
+	}
+}
+
+// Check compares the node with desired, the orchestrator's protocol matrix. An empty matrix
+// compares the servers with the one the agent last applied.
+func (dd *DriftDetectorImpl) Check(ctx context.Context, desired map[string]bool) (*DriftReport, error) {
+	dd.mu.Lock()
+	defer dd.mu.Unlock()
+	return dd.check(ctx, desired)
+}
+
+// Heal re-applies the desired state: deployed configs are written back and the servers
+// reading them restarted, the protocol matrix reconciled, stopped servers started, and the
+// firewall and routing rules re-installed. Every item is attempted even if an earlier one
+// fails.
+func (dd *DriftDetectorImpl) Heal(ctx context.Context, desired map[string]bool) (*DriftHealReport, error) {
+	dd.mu.Lock()
+	defer dd.mu.Unlock()
+
+	report, err := dd.check(ctx, desired)
+	if err != nil {
+		return nil, err
+	}
+
+	heal := &DriftHealReport{}
+	done := func(action string, err error) {
+		if err != nil {
+			dd.logger.Errorf("Failed to heal drift, %s: %v", action, err)
+			heal.Failed = append(heal.Failed, fmt.Sprintf("%s: %v", action, err))
+			return
+		}
+		heal.Actions = append(heal.Actions, action)
+	}
+
+	kinds := make(map[string]bool)
+	restartHysteria, restartXray := false, false
+	for _, item := range report.Items {
+		kinds[item.Kind] = true
+		if item.Kind != DriftConfig {
+			continue
+		}
+		done("restore "+item.Target, restoreDeployedConfig(dd.config, item.Target))
+		if item.Target == dd.xrayManager.ConfigPath() {
+			restartXray = true
+		} else {
+			// The other watched files are the Hysteria2 config and ACLs
+			restartHysteria = true
+		}
+	}
+
+	if kinds[DriftProtocol] || kinds[DriftService] {
+		matrix := desired
+		if len(matrix) == 0 {
+			matrix = dd.protocols.GetProtocols()
+		}
+		if len(matrix) > 0 {
+			_, err := dd.protocols.Reconcile(matrix)
+			done("reconcile protocols", err)
+		}
+	}
+	// Reconcile only starts what it enables, so restart the servers still down or reading a
+	// restored config
+	if dd.hysteria2Wanted(desired) && (restartHysteria || !dd.hysteria2Running()) {
+		done("reload hysteria2", dd.hysteriaManager.ReloadHysteria2(hysteria2ConfigPath))
+	}
+	if dd.xrayWanted(desired) && (restartXray || !dd.xrayRunning()) {
+		done("restart xray", dd.xrayManager.RestartXray(dd.xrayManager.ConfigPath()))
+	}
+
+	if kinds[DriftFirewall] {
+		done("reinstall firewall", dd.firewall.EnsureBaseline())
+	}
+	if kinds[DriftRouting] {
+		routing, err := dd.network.Reconcile()
+		if err == nil && len(routing.Failed) > 0 {
+			err = fmt.Errorf("%s", strings.Join(routing.Failed, "; "))
+		}
+		done("reinstall routing", err)
+	}
+
+	if heal.Remaining, err = dd.check(ctx, desired); err != nil {
+		return nil, err
+	}
+	dd.logger.Infof("Drift healed: %d item(s) found, %d left", len(report.Items), len(heal.Remaining.Items))
+	return heal, nil
+}
+
+func (dd *DriftDetectorImpl) check(ctx context.Context, desired map[string]bool) (*DriftReport, error) {
+	report := &DriftReport{}
+
+	integrity, err := dd.integrity.Check(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check deployed configs: %w", err)
+	}
+	for _, file := range integrity.Configs {
+		if file.Status == ConfigIntact {
+			continue
+		}
+		actual := file.Actual
+		if file.Status == ConfigMissing {
+			actual = ConfigMissing
+		}
+		report.Items = append(report.Items, DriftItem{Kind: DriftConfig, Target: file.Path, Expected: file.Expected, Actual: actual})
+	}
+
+	protocols := make([]string, 0, len(desired))
+	for protocol := range desired {
+		protocols = append(protocols, protocol)
+	}
+	sort.Strings(protocols)
+	for _, protocol := range protocols {
+		if applied := protocolEnabled(dd.config, protocol); applied != desired[protocol] {
+			report.Items = append(report.Items, DriftItem{Kind: DriftProtocol, Target: protocol, Expected: enabledState(desired[protocol]), Actual: enabledState(applied)})
+		}
+	}
+	for _, protocol := range xrayMatrixProtocols {
+		if !dd.xrayManager.IsXrayInstalled() || !dd.protocolWanted(desired, protocol) {
+			continue
+		}
+		exists, err := dd.xrayManager.HasInbound(protocol)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Xray inbounds: %w", err)
+		}
+		if !exists {
+			report.Items = append(report.Items, DriftItem{Kind: DriftProtocol, Target: protocol + " inbound", Expected: "present", Actual: "absent"})
+		}
+	}
+
+	if wanted, running := dd.hysteria2Wanted(desired), dd.hysteria2Running(); wanted != running {
+		report.Items = append(report.Items, DriftItem{Kind: DriftService, Target: hysteria2ServiceName, Expected: runningState(wanted), Actual: runningState(running)})
+	}
+	if wanted, running := dd.xrayWanted(desired), dd.xrayRunning(); wanted != running {
+		report.Items = append(report.Items, DriftItem{Kind: DriftService, Target: "xray", Expected: runningState(wanted), Actual: runningState(running)})
+	}
+
+	missing, err := dd.firewall.Verify()
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify firewall: %w", err)
+	}
+	for _, rule := range missing {
+		report.Items = append(report.Items, DriftItem{Kind: DriftFirewall, Target: rule, Expected: "installed", Actual: "missing"})
+	}
+
+	routing, err := dd.network.CheckRouting()
+	if err != nil {
+		return nil, fmt.Errorf("failed to check routing: %w", err)
+	}
+	for _, rule := range routing.Missing {
+		report.Items = append(report.Items, DriftItem{Kind: DriftRouting, Target: rule, Expected: "installed", Actual: "missing"})
+	}
+
+	report.CheckedAt = time.Now().UTC()
+	return report, nil
+}
+
+// protocolWanted follows desired, falling back to the applied matrix for protocols it leaves out
+func (dd *DriftDetectorImpl) protocolWanted(desired map[string]bool, protocol string) bool {
+	if enabled, ok := desired[protocol]; ok {
+		return enabled
+	}
+	return protocolEnabled(dd.config, protocol)
+}
+
+func (dd *DriftDetectorImpl) hysteria2Wanted(desired map[string]bool) bool {
+	return dd.protocolWanted(desired, ProtocolHysteria2)
+}
+
+// xrayWanted reports whether Xray should run; nodes without Xray installed serve Hysteria2 only
+func (dd *DriftDetectorImpl) xrayWanted(desired map[string]bool) bool {
+	if !dd.xrayManager.IsXrayInstalled() {
+		return false
+	}
+	for _, protocol := range xrayMatrixProtocols {
+		if dd.protocolWanted(desired, protocol) {
+			return true
+		}
+	}
+	return false
+}
+
+func (dd *DriftDetectorImpl) hysteria2Running() bool {
+	status, err := dd.hysteriaManager.GetHysteria2Status()
+	if err != nil {
+		return false
+	}
+	running, _ := status["running"].(bool)
+	return running
+}
+
+func (dd *DriftDetectorImpl) xrayRunning() bool {
+	status, err := dd.xrayManager.GetXrayStatus()
+	if err != nil {
+		return false
+	}
+	running, _ := status["running"].(bool)
+	return running
+}
+
+func enabledState(enabled bool) string {
+	if enabled {
+		return "enabled"
+	}
+	return "disabled"
+}
+
+func runningState(running bool) string {
+	if running {
+		return "running"
+	}
+	return "stopped"
+}
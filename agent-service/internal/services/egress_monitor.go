@@ -0,0 +1,518 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"hysteria2_microservices/agent-service/internal/config"
+)
+
+// Egress paths
+const (
+	EgressPathDirect = "direct"
+	EgressPathWARP   = "warp"
+)
+
+// Egress health, from best to worst. An address on a blocklist is dirty; one a service
+// blocks or restricts, or that geolocates outside the node's country, is degraded.
+const (
+	EgressHealthClean    = "clean"
+	EgressHealthDegraded = "degraded"
+	EgressHealthDirty    = "dirty"
+	EgressHealthUnknown  = "unknown"
+)
+
+// Service check statuses
+const (
+	EgressServiceOK         = "ok"
+	EgressServiceRestricted = "restricted"
+	EgressServiceBlocked    = "blocked"
+	EgressServiceError      = "error"
+)
+
+const (
+	egressDefaultTimeout = 10 * time.Second
+	egressMaxBody        = 256 << 10
+
+	// Netflix titles telling a full catalogue from an originals-only one: Breaking Bad is
+	// licensed per region, LEGO Ninjago is a Netflix original available everywhere
+	netflixLicensedTitle = "70143836"
+	netflixOriginalTitle = "81280792"
+)
+
+// EgressListing is the answer of one DNS blocklist for an address
+type EgressListing struct {
+	Zone   string   `json:"zone"`
+	Listed bool     `json:"listed"`
+	Codes  []string `json:"codes,omitempty"` // 127.0.0.x return codes naming the lists
+	Error  string   `json:"error,omitempty"`
+}
+
+// EgressServiceCheck is how a streaming or search service treats an address
+type EgressServiceCheck struct {
+	Service string `json:"service"`
+	Status  string `json:"status"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// EgressPath is the address traffic leaves the node from on one path and its reputation
+type EgressPath struct {
+	Path     string               `json:"path"`
+	IP       string               `json:"ip"`
+	Country  string               `json:"country,omitempty"`
+	Org      string               `json:"org,omitempty"`
+	Health   string               `json:"health"`
+	Issues   []string             `json:"issues,omitempty"`
+	Listings []EgressListing      `json:"listings,omitempty"`
+	Services []EgressServiceCheck `json:"services,omitempty"`
+	Error    string               `json:"error,omitempty"`
+}
+
+// EgressReport is the result of one check of every egress path; Health is the worst of theirs
+type EgressReport struct {
+	Health    string       `json:"health"`
+	Paths     []EgressPath `json:"paths"`
+	CheckedAt time.Time    `json:"checked_at"`
+}
+
+// Path returns the report of the named path, or nil
+func (r *EgressReport) Path(name string) *EgressPath {
+	for i := range r.Paths {
+		if r.Paths[i].Path == name {
+			return &r.Paths[i]
+		}
+	}
+	return nil
+}
+
+// EgressReporter is called with the previous report, nil on the first check, and the new
+// one whenever the overall health changes
+type EgressReporter func(previous, current *EgressReport)
+
+// EgressHealthLevel orders health values for metrics: 0 clean, 1 degraded, 2 dirty and -1
+// when unknown
+func EgressHealthLevel(health string) float64 {
+	switch health {
+	case EgressHealthClean:
+		return 0
+	case EgressHealthDegraded:
+		return 1
+	case EgressHealthDirty:
+		return 2
+	}
+	return -1
+}
+
+// EgressMonitorImpl discovers the node's egress addresses through echo services and checks
+// them against DNS blocklists, a geolocation lookup and the services configured. Checks run
+// one at a time; the last report is kept for the heartbeat and node status.
+type EgressMonitorImpl struct {
+	logger *logrus.Logger
+	config *config.Config
+
+	checking sync.Mutex // held for the duration of a check
+
+	mu       sync.RWMutex
+	last     *EgressReport
+	reporter EgressReporter
+	cancel   context.CancelFunc
+}
+
+// NewEgressMonitor creates a new EgressMonitor
+func NewEgressMonitor(logger *logrus.Logger, cfg *config.Config) EgressMonitor {
+	return &EgressMonitorImpl{
+		logger: logger,
+		config: cfg,
+	}
+}
+
+// Start checks once right away, then every egress.interval seconds until ctx is done
+func (em *EgressMonitorImpl) Start(ctx context.Context) error {
+	cfg := em.config.Egress
+	if !cfg.Enabled {
+		return nil
+	}
+	interval := time.Duration(cfg.Interval) * time.Second
+	if interval <= 0 {
+		return fmt.Errorf("invalid egress.interval %d", cfg.Interval)
+	}
+
+	em.mu.Lock()
+	defer em.mu.Unlock()
+	if em.cancel != nil {
+		return fmt.Errorf("egress checks are already running")
+	}
+
+	checkCtx, cancel := context.WithCancel(ctx)
+	em.cancel = cancel
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if _, err := em.Check(checkCtx); err != nil && checkCtx.Err() == nil {
+				em.logger.Warnf("Egress check failed: %v", err)
+			}
+			select {
+			case <-checkCtx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	em.logger.Infof("Egress checks started, every %s", interval)
+	return nil
+}
+
+// SetReporter sets where health changes are sent
+func (em *EgressMonitorImpl) SetReporter(reporter EgressReporter) {
+	em.mu.Lock()
+	defer em.mu.Unlock()
+	em.reporter = reporter
+}
+
+// LastReport returns the report of the last finished check, or nil before the first
+func (em *EgressMonitorImpl) LastReport() *EgressReport {
+	em.mu.RLock()
+	defer em.mu.RUnlock()
+	return em.last
+}
+
+// Check discovers and checks every egress path now. A path that cannot be checked is
+// reported with its error rather than failing the check.
+func (em *EgressMonitorImpl) Check(ctx context.Context) (*EgressReport, error) {
+	em.checking.Lock()
+	defer em.checking.Unlock()
+
+	paths := []string{EgressPathDirect}
+	if em.warpAvailable() {
+		paths = append(paths, EgressPathWARP)
+	}
+
+	report := &EgressReport{Health: EgressHealthUnknown}
+	for _, name := range paths {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		client, err := em.client(name)
+		if err != nil {
+			report.Paths = append(report.Paths, EgressPath{Path: name, Health: EgressHealthUnknown, Error: err.Error()})
+			continue
+		}
+		path := em.checkPath(ctx, name, client)
+		if path.Error != "" {
+			em.logger.Warnf("Egress check of the %s path failed: %s", name, path.Error)
+		}
+		report.Paths = append(report.Paths, path)
+		report.Health = worseEgressHealth(report.Health, path.Health)
+	}
+	report.CheckedAt = time.Now().UTC()
+
+	em.mu.Lock()
+	previous := em.last
+	em.last = report
+	reporter := em.reporter
+	em.mu.Unlock()
+
+	if previous == nil || previous.Health != report.Health {
+		em.logger.Infof("Egress health is %s", report.Health)
+		if reporter != nil {
+			reporter(previous, report)
+		}
+	}
+	return report, nil
+}
+
+func (em *EgressMonitorImpl) checkPath(ctx context.Context, name string, client *http.Client) EgressPath {
+	path := EgressPath{Path: name, Health: EgressHealthUnknown}
+
+	ip, err := em.discover(ctx, client)
+	if err != nil {
+		path.Error = err.Error()
+		return path
+	}
+	path.IP = ip.String()
+	path.Health = EgressHealthClean
+
+	if em.config.Egress.GeoURL != "" {
+		country, org, err := em.geolocate(ctx, client, ip)
+		if err != nil {
+			path.Issues = append(path.Issues, fmt.Sprintf("geolocation failed: %v", err))
+		}
+		path.Country, path.Org = country, org
+		// WARP exits from the nearest Cloudflare location, which need not be the node's country
+		if name == EgressPathDirect && country != "" && em.config.Node.Country != "" && !strings.EqualFold(country, em.config.Node.Country) {
+			path.Health = EgressHealthDegraded
+			path.Issues = append(path.Issues, fmt.Sprintf("geolocated in %s instead of %s", country, strings.ToUpper(em.config.Node.Country)))
+		}
+	}
+
+	for _, zone := range em.config.Egress.DNSBLs {
+		listing := em.lookupDNSBL(ctx, ip, zone)
+		if listing.Listed {
+			path.Health = EgressHealthDirty
+			path.Issues = append(path.Issues, "listed on "+zone)
+		}
+		path.Listings = append(path.Listings, listing)
+	}
+
+	for _, service := range em.config.Egress.Services {
+		check := em.checkService(ctx, client, service)
+		if check.Status == EgressServiceBlocked || check.Status == EgressServiceRestricted {
+			path.Health = worseEgressHealth(path.Health, EgressHealthDegraded)
+			path.Issues = append(path.Issues, fmt.Sprintf("%s %s", service, check.Status))
+		}
+		path.Services = append(path.Services, check)
+	}
+	return path
+}
+
+// discover asks the echo services in turn for the address the request came from
+func (em *EgressMonitorImpl) discover(ctx context.Context, client *http.Client) (netip.Addr, error) {
+	if len(em.config.Egress.EchoURLs) == 0 {
+		return netip.Addr{}, fmt.Errorf("no egress.echo_urls configured")
+	}
+
+	var lastErr error
+	for _, echoURL := range em.config.Egress.EchoURLs {
+		_, body, err := em.get(ctx, client, echoURL)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		ip, err := netip.ParseAddr(strings.TrimSpace(string(body)))
+		if err != nil {
+			lastErr = fmt.Errorf("%s answered with no address", echoURL)
+			continue
+		}
+		return ip.Unmap(), nil
+	}
+	return netip.Addr{}, fmt.Errorf("failed to discover the egress address: %w", lastErr)
+}
+
+func (em *EgressMonitorImpl) geolocate(ctx context.Context, client *http.Client, ip netip.Addr) (string, string, error) {
+	geoURL := strings.ReplaceAll(em.config.Egress.GeoURL, "{ip}", ip.String())
+	resp, body, err := em.get(ctx, client, geoURL)
+	if err != nil {
+		return "", "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("geolocation lookup returned %s", resp.Status)
+	}
+
+	var info struct {
+		Country string `json:"country"`
+		Org     string `json:"org"`
+	}
+	if err := json.Unmarshal(body, &info); err != nil {
+		return "", "", fmt.Errorf("invalid geolocation answer: %w", err)
+	}
+	return strings.ToUpper(info.Country), info.Org, nil
+}
+
+// lookupDNSBL queries zone for ip. Lists answer with a 127.0.0.x address when the address
+// is listed and NXDOMAIN when it is not; 127.255.255.x means the query itself was refused,
+// which Spamhaus does for public and high-volume resolvers.
+func (em *EgressMonitorImpl) lookupDNSBL(ctx context.Context, ip netip.Addr, zone string) EgressListing {
+	listing := EgressListing{Zone: zone}
+
+	ctx, cancel := context.WithTimeout(ctx, em.timeout())
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupHost(ctx, reverseDNSName(ip)+"."+zone)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			listing.Error = err.Error()
+		}
+		return listing
+	}
+
+	for _, addr := range addrs {
+		code, err := netip.ParseAddr(addr)
+		if err != nil || !code.Is4() || code.As4()[0] != 127 {
+			continue
+		}
+		if octets := code.As4(); octets[1] == 255 && octets[2] == 255 {
+			listing.Error = fmt.Sprintf("query refused by the list (%s), use a resolver it accepts", addr)
+			return listing
+		}
+		listing.Listed = true
+		listing.Codes = append(listing.Codes, addr)
+	}
+	return listing
+}
+
+func (em *EgressMonitorImpl) checkService(ctx context.Context, client *http.Client, service string) EgressServiceCheck {
+	check := EgressServiceCheck{Service: service}
+	var err error
+	switch service {
+	case "netflix":
+		check.Status, check.Detail, err = em.checkNetflix(ctx, client)
+	case "youtube":
+		check.Status, check.Detail, err = em.checkYouTube(ctx, client)
+	case "google":
+		check.Status, check.Detail, err = em.checkGoogle(ctx, client)
+	default:
+		err = fmt.Errorf("unknown service %q", service)
+	}
+	if err != nil {
+		check.Status = EgressServiceError
+		check.Detail = err.Error()
+	}
+	return check
+}
+
+// checkNetflix tells a full catalogue from an originals-only one, which Netflix serves to
+// addresses it takes for proxies, and from a block
+func (em *EgressMonitorImpl) checkNetflix(ctx context.Context, client *http.Client) (string, string, error) {
+	resp, _, err := em.get(ctx, client, "https://www.netflix.com/title/"+netflixLicensedTitle)
+	if err != nil {
+		return "", "", err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return EgressServiceOK, "full catalogue", nil
+	case http.StatusForbidden:
+		return EgressServiceBlocked, "access denied", nil
+	}
+
+	resp, _, err = em.get(ctx, client, "https://www.netflix.com/title/"+netflixOriginalTitle)
+	if err != nil {
+		return "", "", err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return EgressServiceRestricted, "Netflix originals only", nil
+	}
+	return EgressServiceBlocked, "titles unavailable: " + resp.Status, nil
+}
+
+func (em *EgressMonitorImpl) checkYouTube(ctx context.Context, client *http.Client) (string, string, error) {
+	resp, body, err := em.get(ctx, client, "https://www.youtube.com/premium")
+	if err != nil {
+		return "", "", err
+	}
+	if isGoogleCaptcha(resp) {
+		return EgressServiceBlocked, "served a captcha", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return EgressServiceBlocked, resp.Status, nil
+	}
+	if strings.Contains(string(body), "Premium is not available in your country") {
+		return EgressServiceRestricted, "Premium not available", nil
+	}
+	return EgressServiceOK, "", nil
+}
+
+// checkGoogle detects the captcha Google puts in front of search for addresses it saw abuse from
+func (em *EgressMonitorImpl) checkGoogle(ctx context.Context, client *http.Client) (string, string, error) {
+	resp, _, err := em.get(ctx, client, "https://www.google.com/search?q=hysteria")
+	if err != nil {
+		return "", "", err
+	}
+	if isGoogleCaptcha(resp) {
+		return EgressServiceBlocked, "served a captcha", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return EgressServiceBlocked, resp.Status, nil
+	}
+	return EgressServiceOK, "", nil
+}
+
+func isGoogleCaptcha(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusTooManyRequests || strings.HasPrefix(resp.Request.URL.Path, "/sorry/")
+}
+
+// get fetches rawURL with a browser user agent, following redirects, and reads a bounded body
+func (em *EgressMonitorImpl) get(ctx context.Context, client *http.Client, rawURL string) (*http.Response, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0 Safari/537.36")
+	req.Header.Set("Accept-Language", "en-US,en;q=0.9")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, egressMaxBody))
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, body, nil
+}
+
+// client returns an HTTP client leaving through the path: directly over IPv4, which the
+// blocklists and services mostly judge, or through the WARP SOCKS5 proxy
+func (em *EgressMonitorImpl) client(path string) (*http.Client, error) {
+	dialer := &net.Dialer{Timeout: em.timeout()}
+	transport := &http.Transport{
+		TLSHandshakeTimeout: em.timeout(),
+		DisableKeepAlives:   true,
+	}
+	switch path {
+	case EgressPathDirect:
+		transport.DialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "tcp4", addr)
+		}
+	case EgressPathWARP:
+		proxyURL, err := url.Parse("socks5://127.0.0.1:" + strconv.Itoa(em.config.Hysteria2.WARPProxyPort))
+		if err != nil {
+			return nil, fmt.Errorf("invalid WARP proxy address: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+		transport.DialContext = dialer.DialContext
+	default:
+		return nil, fmt.Errorf("unknown egress path %q", path)
+	}
+	return &http.Client{Transport: transport, Timeout: 2 * em.timeout()}, nil
+}
+
+func (em *EgressMonitorImpl) warpAvailable() bool {
+	return em.config.Hysteria2.WARPEnabled && em.config.Hysteria2.WARPProxyPort > 0
+}
+
+func (em *EgressMonitorImpl) timeout() time.Duration {
+	if em.config.Egress.Timeout > 0 {
+		return time.Duration(em.config.Egress.Timeout) * time.Second
+	}
+	return egressDefaultTimeout
+}
+
+// worseEgressHealth returns the worse of two health values; unknown only wins over unknown
+func worseEgressHealth(a, b string) string {
+	if EgressHealthLevel(b) > EgressHealthLevel(a) {
+		return b
+	}
+	return a
+}
+
+// reverseDNSName returns the label sequence DNSBLs are queried with: the octets of an IPv4
+// address or the nibbles of an IPv6 one, in reverse order
+func reverseDNSName(ip netip.Addr) string {
+	if ip.Is4() {
+		b := ip.As4()
+		return fmt.Sprintf("%d.%d.%d.%d", b[3], b[2], b[1], b[0])
+	}
+	b := ip.As16()
+	labels := make([]string, 0, 32)
+	for i := len(b) - 1; i >= 0; i-- {
+		labels = append(labels, strconv.FormatUint(uint64(b[i]&0x0f), 16), strconv.FormatUint(uint64(b[i]>>4), 16))
+	}
+	return strings.Join(labels, ".")
+}
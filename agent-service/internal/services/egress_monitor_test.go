@@ -0,0 +1,104 @@
+package services
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"hysteria2_microservices/agent-service/internal/config"
+)
+
+func TestReverseDNSName(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"192.0.2.10", "10.2.0.192"},
+		{"2001:db8::1", "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2"},
+	}
+	for _, tt := range tests {
+		if got := reverseDNSName(netip.MustParseAddr(tt.ip)); got != tt.want {
+			t.Errorf("reverseDNSName(%s) = %s, want %s", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestWorseEgressHealth(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want string
+	}{
+		{EgressHealthUnknown, EgressHealthClean, EgressHealthClean},
+		{EgressHealthClean, EgressHealthUnknown, EgressHealthClean},
+		{EgressHealthClean, EgressHealthDegraded, EgressHealthDegraded},
+		{EgressHealthDirty, EgressHealthDegraded, EgressHealthDirty},
+	}
+	for _, tt := range tests {
+		if got := worseEgressHealth(tt.a, tt.b); got != tt.want {
+			t.Errorf("worseEgressHealth(%s, %s) = %s, want %s", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestEgressCheckPath(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/broken":
+			w.Write([]byte("<html>maintenance</html>"))
+		case "/ip":
+			w.Write([]byte("::ffff:198.51.100.7\n"))
+		case "/geo/198.51.100.7":
+			w.Write([]byte(`{"country": "nl", "org": "AS64500 Example Hosting"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name       string
+		path       string
+		country    string
+		wantHealth string
+	}{
+		{"in the node's country", EgressPathDirect, "NL", EgressHealthClean},
+		{"in another country", EgressPathDirect, "DE", EgressHealthDegraded},
+		// WARP exits wherever Cloudflare is nearest
+		{"WARP in another country", EgressPathWARP, "DE", EgressHealthClean},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{}
+			cfg.Node.Country = tt.country
+			cfg.Egress.EchoURLs = []string{server.URL + "/broken", server.URL + "/ip"}
+			cfg.Egress.GeoURL = server.URL + "/geo/{ip}"
+			em := NewEgressMonitor(testLogger(), cfg).(*EgressMonitorImpl)
+
+			path := em.checkPath(context.Background(), tt.path, server.Client())
+			if path.Error != "" {
+				t.Fatalf("checkPath: %s", path.Error)
+			}
+			if path.IP != "198.51.100.7" || path.Country != "NL" || path.Org != "AS64500 Example Hosting" {
+				t.Errorf("path = %+v", path)
+			}
+			if path.Health != tt.wantHealth {
+				t.Errorf("health = %s, want %s (issues %v)", path.Health, tt.wantHealth, path.Issues)
+			}
+		})
+	}
+}
+
+func TestEgressCheckPathWithoutAddress(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	cfg := &config.Config{}
+	cfg.Egress.EchoURLs = []string{server.URL + "/ip"}
+	em := NewEgressMonitor(testLogger(), cfg).(*EgressMonitorImpl)
+	path := em.checkPath(context.Background(), EgressPathDirect, server.Client())
+	if path.Error == "" || path.Health != EgressHealthUnknown {
+		t.Errorf("path = %+v, want an unknown health and the error", path)
+	}
+}
@@ -0,0 +1,19 @@
+package services
+
+import "errors"
+
+// Errors the gRPC handlers report with a specific ErrorCode. Wrap them with %w so the code
+// survives added context.
+var (
+	ErrWARPNotInstalled    = errors.New("WARP client is not installed")
+	ErrWARPNotConnected    = errors.New("WARP is not connected")
+	ErrServerNotInstalled  = errors.New("server is not installed")
+	ErrConfigInvalid       = errors.New("config is invalid")
+	ErrInvalidDomain       = errors.New("invalid domain")
+	ErrDomainConflict      = errors.New("domain conflict")
+	ErrFirewallClosed      = errors.New("firewall is closed: agent is shutting down")
+	ErrPortInUse           = errors.New("port is in use")
+	ErrPortForwardNotFound = errors.New("port forward not found")
+
+	ErrInvalidOutboundPolicy = errors.New("invalid outbound policy")
+)
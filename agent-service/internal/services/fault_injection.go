@@ -0,0 +1,157 @@
+//go:build chaos
+
+package services
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// faultInjection is the faults an agent built with -tags chaos injects, read from the
+// environment at start. Every fault is off until its variable is set:
+//
+//	CHAOS_COMMAND_FAILURE_RATE  share of system commands failing without running, 0-1
+//	CHAOS_COMMANDS              comma-separated commands that may fail, e.g. "iptables,systemctl"; all when empty
+//	CHAOS_SYSTEMCTL_DELAY       delay before every systemctl command, e.g. "15s"
+//	CHAOS_CERT_FAILURE_RATE     share of certificate issuances and renewals failing, 0-1
+//	CHAOS_WARP_DISCONNECT_RATE  share of WARP status checks finding WARP disconnected, 0-1
+//	CHAOS_SEED                  random seed, for repeatable runs
+type faultInjection struct {
+	commandFailureRate float64
+	commands           map[string]bool
+	systemctlDelay     time.Duration
+	certFailureRate    float64
+	warpDisconnectRate float64
+	errs               []string
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+var faults = loadFaultInjection()
+
+func loadFaultInjection() *faultInjection {
+	f := &faultInjection{commands: map[string]bool{}}
+	f.commandFailureRate = f.rate("CHAOS_COMMAND_FAILURE_RATE")
+	f.certFailureRate = f.rate("CHAOS_CERT_FAILURE_RATE")
+	f.warpDisconnectRate = f.rate("CHAOS_WARP_DISCONNECT_RATE")
+	for _, name := range strings.Split(os.Getenv("CHAOS_COMMANDS"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			f.commands[name] = true
+		}
+	}
+	if value := os.Getenv("CHAOS_SYSTEMCTL_DELAY"); value != "" {
+		delay, err := time.ParseDuration(value)
+		if err != nil || delay < 0 {
+			f.errs = append(f.errs, fmt.Sprintf("CHAOS_SYSTEMCTL_DELAY=%q is not a duration", value))
+		} else {
+			f.systemctlDelay = delay
+		}
+	}
+
+	seed := time.Now().UnixNano()
+	if value := os.Getenv("CHAOS_SEED"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			f.errs = append(f.errs, fmt.Sprintf("CHAOS_SEED=%q is not an integer", value))
+		} else {
+			seed = parsed
+		}
+	}
+	f.rand = rand.New(rand.NewSource(seed))
+	return f
+}
+
+func (f *faultInjection) rate(key string) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return 0
+	}
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil || rate < 0 || rate > 1 {
+		f.errs = append(f.errs, fmt.Sprintf("%s=%q is not a rate between 0 and 1", key, value))
+		return 0
+	}
+	return rate
+}
+
+// hit reports whether a fault injected at rate strikes this time
+func (f *faultInjection) hit(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rand.Float64() < rate
+}
+
+// injectedCommandError stands for a command failing; it has an exit code like the errors
+// of commands that ran, so it is reported as COMMAND_FAILED
+type injectedCommandError struct {
+	name string
+}
+
+func (e *injectedCommandError) Error() string { return "injected fault: " + e.name + " failed" }
+func (e *injectedCommandError) ExitCode() int { return 1 }
+
+// FaultInjectionEnabled reports whether any fault is injected
+func FaultInjectionEnabled() bool {
+	return faults.commandFailureRate > 0 || faults.systemctlDelay > 0 || faults.certFailureRate > 0 || faults.warpDisconnectRate > 0
+}
+
+// LogFaultInjection warns about the faults injected and the variables ignored
+func LogFaultInjection(logger *logrus.Logger) {
+	for _, msg := range faults.errs {
+		logger.Warnf("Ignoring fault injection setting: %s", msg)
+	}
+	if !FaultInjectionEnabled() {
+		logger.Info("Agent built with fault injection, no faults configured")
+		return
+	}
+	logger.Warnf("FAULT INJECTION ENABLED, not for production nodes: command_failure_rate=%g commands=%v systemctl_delay=%s cert_failure_rate=%g warp_disconnect_rate=%g",
+		faults.commandFailureRate, faults.commandNames(), faults.systemctlDelay, faults.certFailureRate, faults.warpDisconnectRate)
+}
+
+func (f *faultInjection) commandNames() []string {
+	names := make([]string, 0, len(f.commands))
+	for name := range f.commands {
+		names = append(names, name)
+	}
+	return names
+}
+
+// injectCommandFault delays systemctl and fails the command before it runs when a fault hits
+func injectCommandFault(name string, args ...string) error {
+	base := filepath.Base(name)
+	if base == "systemctl" && faults.systemctlDelay > 0 {
+		time.Sleep(faults.systemctlDelay)
+	}
+	if len(faults.commands) > 0 && !faults.commands[base] {
+		return nil
+	}
+	if faults.hit(faults.commandFailureRate) {
+		return &injectedCommandError{name: strings.TrimSpace(base + " " + strings.Join(args, " "))}
+	}
+	return nil
+}
+
+// injectCertFault fails the issuance or renewal of the domain's certificate when a fault hits
+func injectCertFault(domain string) error {
+	if faults.hit(faults.certFailureRate) {
+		return &injectedCommandError{name: "certbot for " + domain}
+	}
+	return nil
+}
+
+// injectWARPDisconnect reports whether a WARP status check should find WARP disconnected
+func injectWARPDisconnect() bool {
+	return faults.hit(faults.warpDisconnectRate)
+}
@@ -0,0 +1,20 @@
+//go:build !chaos
+
+package services
+
+import "github.com/sirupsen/logrus"
+
+// Fault injection is compiled in only with -tags chaos (see `make agent-chaos`), so the
+// CHAOS_* variables have no effect on production builds
+
+// FaultInjectionEnabled reports whether any fault is injected
+func FaultInjectionEnabled() bool { return false }
+
+// LogFaultInjection is a no-op without fault injection
+func LogFaultInjection(logger *logrus.Logger) {}
+
+func injectCommandFault(name string, args ...string) error { return nil }
+
+func injectCertFault(domain string) error { return nil }
+
+func injectWARPDisconnect() bool { return false }
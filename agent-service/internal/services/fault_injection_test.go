@@ -0,0 +1,69 @@
+//go:build chaos
+
+package services
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadFaultInjection(t *testing.T) {
+	t.Setenv("CHAOS_COMMAND_FAILURE_RATE", "0.25")
+	t.Setenv("CHAOS_COMMANDS", " iptables, systemctl,,")
+	t.Setenv("CHAOS_SYSTEMCTL_DELAY", "15s")
+	t.Setenv("CHAOS_CERT_FAILURE_RATE", "1.5")
+	t.Setenv("CHAOS_WARP_DISCONNECT_RATE", "half")
+	t.Setenv("CHAOS_SEED", "42")
+
+	f := loadFaultInjection()
+	if f.commandFailureRate != 0.25 || f.systemctlDelay != 15*time.Second {
+		t.Errorf("command faults = %g, %s; want 0.25, 15s", f.commandFailureRate, f.systemctlDelay)
+	}
+	if len(f.commands) != 2 || !f.commands["iptables"] || !f.commands["systemctl"] {
+		t.Errorf("commands = %v, want iptables and systemctl", f.commands)
+	}
+	// Rates out of range are ignored with a warning
+	if f.certFailureRate != 0 || f.warpDisconnectRate != 0 || len(f.errs) != 2 {
+		t.Errorf("invalid rates = %g, %g with errors %v; want both off and reported", f.certFailureRate, f.warpDisconnectRate, f.errs)
+	}
+
+	// The same seed injects the same faults
+	again := loadFaultInjection()
+	for i := 0; i < 20; i++ {
+		if f.hit(0.5) != again.hit(0.5) {
+			t.Fatal("same seed, different faults")
+		}
+	}
+}
+
+func TestInjectCommandFault(t *testing.T) {
+	saved := faults
+	t.Cleanup(func() { faults = saved })
+	t.Setenv("CHAOS_COMMAND_FAILURE_RATE", "1")
+	t.Setenv("CHAOS_COMMANDS", "touching")
+	faults = loadFaultInjection()
+
+	if !FaultInjectionEnabled() {
+		t.Error("fault injection off with a command failure rate")
+	}
+	if err := injectCommandFault("/usr/sbin/iptables", "-L"); err != nil {
+		t.Errorf("command not listed failed: %v", err)
+	}
+
+	// A failing command does not run and looks like a command that exited non-zero
+	fakes := newCommandFakes(t)
+	fakes.install(t, "touching", "#!/bin/sh\ntouch "+filepath.Join(fakes.dir, "ran")+"\n")
+	runner := &CommandRunner{logger: testLogger(), timeout: time.Second, maxOutput: maxCommandOutput}
+	_, err := runner.Exec(context.Background(), ExecOptions{}, filepath.Join(fakes.dir, "touching"), "now")
+	var exitErr interface{ ExitCode() int }
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+		t.Errorf("Exec = %v, want an injected exit code", err)
+	}
+	if _, err := os.Stat(filepath.Join(fakes.dir, "ran")); err == nil {
+		t.Error("command ran despite the injected failure")
+	}
+}
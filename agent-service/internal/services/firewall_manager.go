@@ -0,0 +1,767 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"hysteria2_microservices/agent-service/internal/config"
+	"hysteria2_microservices/agent-service/internal/hysteriaconfig"
+	"hysteria2_microservices/agent-service/internal/privsep"
+)
+
+// Firewall backends
+const (
+	FirewallBackendAuto     = "auto"
+	FirewallBackendNFTables = "nftables"
+	FirewallBackendUFW      = "ufw"
+)
+
+const (
+	firewallTable       = "hysteria2_agent"
+	firewallStateFile   = "rules.json"
+	firewallPrevFile    = "rules.prev.json"
+	firewallServiceName = "hysteria2-firewall"
+	firewallBanSetV4    = "banned_v4"
+	firewallBanSetV6    = "banned_v6"
+)
+
+// FirewallRule allows inbound traffic to Ports ("443" or "20000-50000") over Protocol
+// ("tcp" or "udp") from Sources (IPs or CIDRs, empty allows any)
+type FirewallRule struct {
+	Protocol string   `json:"protocol"`
+	Ports    string   `json:"ports"`
+	Sources  []string `json:"sources,omitempty"`
+	Comment  string   `json:"comment,omitempty"`
+}
+
+// FirewallState is what the manager persists: the backend in use and the rules added on top of the baseline
+type FirewallState struct {
+	Backend   string         `json:"backend"`
+	Rules     []FirewallRule `json:"rules"`
+	AppliedAt time.Time      `json:"applied_at"`
+}
+
+// FirewallStatus describes the ruleset in force on the node
+type FirewallStatus struct {
+	Enabled   bool           `json:"enabled"`
+	Backend   string         `json:"backend"`
+	Baseline  []FirewallRule `json:"baseline"`
+	Rules     []FirewallRule `json:"rules"`
+	AppliedAt time.Time      `json:"applied_at"`
+	Active    string         `json:"active"` // ruleset as listed by the backend
+}
+
+// FirewallManagerImpl keeps the node closed by default. Every ruleset it installs drops
+// inbound traffic except loopback, established connections, ICMP and the allowed ports;
+// the baseline for SSH, agent gRPC and the VPN services cannot be removed, so an update
+// can never lock the orchestrator out. With nftables the rules live in a dedicated table
+// reloaded at boot by a oneshot unit; ufw persists its own rules. Temporary bans drop
+// an address before any allow rule and are re-added whenever the ruleset is replaced.
+type FirewallManagerImpl struct {
+	logger *logrus.Logger
+	config *config.Config
+
+	mu     sync.Mutex
+	bans   map[string]time.Time // ip -> expiry
+	closed bool                 // the agent is shutting down, see Close
+}
+
+// NewFirewallManager creates a new FirewallManager
+func NewFirewallManager(logger *logrus.Logger, cfg *config.Config) FirewallManager {
+	return &FirewallManagerImpl{
+		logger: logger,
+		config: cfg,
+		bans:   make(map[string]time.Time),
+	}
+}
+
+// EnsureBaseline installs the baseline plus any saved rules, so a freshly provisioned
+// node is closed as soon as the agent starts. It is also called to reopen the public
+// ports after they change; with the firewall disabled it does nothing.
+func (fm *FirewallManagerImpl) EnsureBaseline() error {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	if fm.closed {
+		return ErrFirewallClosed
+	}
+	if !fm.config.Firewall.Enabled {
+		return nil
+	}
+
+	state, err := fm.loadState(firewallStateFile)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			fm.logger.Warnf("Ignoring unreadable firewall state: %v", err)
+		}
+		state = &FirewallState{Backend: fm.config.Firewall.Backend}
+	}
+	return fm.apply(state.Backend, state.Rules, false)
+}
+
+// Apply replaces the additional rules. The current rules are kept so Restore can roll back.
+func (fm *FirewallManagerImpl) Apply(backend string, rules []FirewallRule) error {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	if fm.closed {
+		return ErrFirewallClosed
+	}
+
+	for i := range rules {
+		if err := validateFirewallRule(&rules[i]); err != nil {
+			return fmt.Errorf("rule %d: %w", i+1, err)
+		}
+	}
+	if backend == "" {
+		backend = fm.config.Firewall.Backend
+	}
+	return fm.apply(backend, rules, true)
+}
+
+// Restore re-applies the rules that were in force before the last Apply
+func (fm *FirewallManagerImpl) Restore() error {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	if fm.closed {
+		return ErrFirewallClosed
+	}
+
+	prev, err := fm.loadState(firewallPrevFile)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("no previous firewall ruleset to restore")
+		}
+		return err
+	}
+	return fm.apply(prev.Backend, prev.Rules, true)
+}
+
+// Ban drops all inbound traffic from ip for duration. Addresses allowed to manage the node
+// cannot be banned.
+func (fm *FirewallManagerImpl) Ban(ip string, duration time.Duration) error {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	if fm.closed {
+		return ErrFirewallClosed
+	}
+
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return fmt.Errorf("invalid IP address %q", ip)
+	}
+	if duration <= 0 {
+		return fmt.Errorf("ban duration must be positive")
+	}
+	if sourcesContain(fm.managementSources(), addr) || sourcesContain(fm.config.Firewall.SSHSources, addr) {
+		return fmt.Errorf("refusing to ban %s: it is allowed to manage the node", ip)
+	}
+
+	state, err := fm.loadState(firewallStateFile)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("firewall baseline is not installed")
+		}
+		return err
+	}
+
+	ip = addr.String()
+	if _, banned := fm.bans[ip]; banned {
+		// Refresh the ban rather than stacking a second ufw rule
+		fm.removeBan(state.Backend, ip)
+	}
+	if err := fm.addBan(state.Backend, ip, duration); err != nil {
+		return fmt.Errorf("failed to ban %s: %w", ip, err)
+	}
+	fm.bans[ip] = time.Now().Add(duration)
+	return nil
+}
+
+// Unban lifts a ban before it expires
+func (fm *FirewallManagerImpl) Unban(ip string) error {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	if fm.closed {
+		return ErrFirewallClosed
+	}
+
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return fmt.Errorf("invalid IP address %q", ip)
+	}
+	ip = addr.String()
+
+	expiry, banned := fm.bans[ip]
+	if !banned {
+		return fmt.Errorf("%s is not banned", ip)
+	}
+	delete(fm.bans, ip)
+
+	state, err := fm.loadState(firewallStateFile)
+	if err != nil {
+		return err
+	}
+	// nftables already dropped an expired element on its own
+	if err := fm.removeBan(state.Backend, ip); err != nil && time.Now().Before(expiry) {
+		return fmt.Errorf("failed to unban %s: %w", ip, err)
+	}
+	return nil
+}
+
+// GetRules returns the baseline, the additional rules and the live ruleset
+func (fm *FirewallManagerImpl) GetRules() (*FirewallStatus, error) {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+
+	status := &FirewallStatus{
+		Enabled:  fm.config.Firewall.Enabled,
+		Backend:  fm.config.Firewall.Backend,
+		Baseline: fm.baselineRules(),
+	}
+
+	state, err := fm.loadState(firewallStateFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if state != nil {
+		status.Backend = state.Backend
+		status.Rules = state.Rules
+		status.AppliedAt = state.AppliedAt
+	}
+
+	switch status.Backend {
+	case FirewallBackendNFTables:
+		status.Active, _ = fm.runCommandWithOutput("nft", "list", "table", "inet", firewallTable)
+	case FirewallBackendUFW:
+		status.Active, _ = fm.runCommandWithOutput("ufw", "status", "verbose")
+	}
+	return status, nil
+}
+
+// Verify returns the baseline and saved rules missing from the live ruleset, and the
+// default-deny policy when it is off, e.g. after the table was flushed or ufw reset by
+// hand. Nothing is missing with the firewall disabled.
+func (fm *FirewallManagerImpl) Verify() ([]string, error) {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	if !fm.config.Firewall.Enabled {
+		return nil, nil
+	}
+
+	state, err := fm.loadState(firewallStateFile)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []string{"baseline not installed"}, nil
+		}
+		return nil, err
+	}
+	ruleset := append(fm.baselineRules(), state.Rules...)
+
+	var missing []string
+	switch state.Backend {
+	case FirewallBackendNFTables:
+		active, err := fm.runCommandWithOutput("nft", "list", "table", "inet", firewallTable)
+		if err != nil {
+			return []string{fmt.Sprintf("table inet %s", firewallTable)}, nil
+		}
+		if !strings.Contains(active, "policy drop;") {
+			missing = append(missing, "default deny policy")
+		}
+		for _, rule := range ruleset {
+			if !strings.Contains(active, fmt.Sprintf("%s dport %s accept", rule.Protocol, rule.Ports)) {
+				missing = append(missing, firewallRuleName(rule))
+			}
+		}
+	case FirewallBackendUFW:
+		active, err := fm.runCommandWithOutput("ufw", "status", "verbose")
+		if err != nil {
+			return nil, fmt.Errorf("failed to list ufw rules: %w", err)
+		}
+		if !strings.Contains(active, "Status: active") {
+			return []string{"ufw enabled"}, nil
+		}
+		if !strings.Contains(active, "deny (incoming)") {
+			missing = append(missing, "default deny policy")
+		}
+		for _, rule := range ruleset {
+			if !strings.Contains(active, fmt.Sprintf("%s/%s", strings.Replace(rule.Ports, "-", ":", 1), rule.Protocol)) {
+				missing = append(missing, firewallRuleName(rule))
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported firewall backend %q", state.Backend)
+	}
+	return missing, nil
+}
+
+// Close waits for a ruleset change in progress and refuses further ones, so the agent never
+// exits halfway through replacing the rules. The rules in force stay installed.
+func (fm *FirewallManagerImpl) Close() {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	fm.closed = true
+}
+
+// apply installs baseline + rules with the backend and saves the state; callers hold mu
+func (fm *FirewallManagerImpl) apply(backend string, rules []FirewallRule, keepPrevious bool) error {
+	backend, err := fm.resolveBackend(backend)
+	if err != nil {
+		return err
+	}
+
+	ruleset := append(fm.baselineRules(), rules...)
+
+	switch backend {
+	case FirewallBackendNFTables:
+		err = fm.applyNFTables(ruleset)
+	case FirewallBackendUFW:
+		err = fm.applyUFW(ruleset)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to apply %s ruleset: %w", backend, err)
+	}
+
+	if keepPrevious {
+		if prev, err := fm.loadState(firewallStateFile); err == nil {
+			if err := fm.saveState(firewallPrevFile, prev); err != nil {
+				fm.logger.Warnf("Failed to keep previous firewall ruleset: %v", err)
+			}
+		}
+	}
+	if err := fm.saveState(firewallStateFile, &FirewallState{Backend: backend, Rules: rules, AppliedAt: time.Now()}); err != nil {
+		return fmt.Errorf("ruleset applied but could not be saved: %w", err)
+	}
+
+	// Replacing the ruleset cleared the bans
+	for ip, expiry := range fm.bans {
+		remaining := time.Until(expiry)
+		if remaining <= 0 {
+			delete(fm.bans, ip)
+			continue
+		}
+		if err := fm.addBan(backend, ip, remaining); err != nil {
+			fm.logger.Warnf("Failed to restore ban on %s: %v", ip, err)
+		}
+	}
+
+	fm.logger.Infof("Firewall ruleset applied with %s: %d baseline and %d additional rules", backend, len(ruleset)-len(rules), len(rules))
+	return nil
+}
+
+// baselineRules opens SSH, the agent gRPC port to the orchestrator and the public ports of the enabled services
+func (fm *FirewallManagerImpl) baselineRules() []FirewallRule {
+	cfg := fm.config
+	var rules []FirewallRule
+
+	if cfg.Firewall.SSHPort > 0 {
+		rules = append(rules, FirewallRule{Protocol: "tcp", Ports: strconv.Itoa(cfg.Firewall.SSHPort), Sources: cfg.Firewall.SSHSources, Comment: "ssh"})
+	}
+
+	management := fm.managementSources()
+	if len(management) == 0 {
+		fm.logger.Warn("No orchestrator address known, agent gRPC port is open to any source")
+	}
+	rules = append(rules, FirewallRule{Protocol: "tcp", Ports: strconv.Itoa(cfg.Node.GRPCPort), Sources: management, Comment: "agent grpc"})
+
+	return append(rules, publicServiceRules(cfg)...)
+}
+
+// publicServiceRules opens the public ports clients connect to
+func publicServiceRules(cfg *config.Config) []FirewallRule {
+	var rules []FirewallRule
+
+	// Hysteria2 and the QUIC relay share the public UDP port
+	if protocolEnabled(cfg, ProtocolHysteria2) {
+		ports := []int{cfg.Hysteria2.DefaultListenPort}
+		ports = append(ports, cfg.Hysteria2.ListenPorts...)
+		for _, port := range uniquePorts(ports) {
+			rules = append(rules, FirewallRule{Protocol: "udp", Ports: strconv.Itoa(port), Comment: "hysteria2"})
+		}
+		if cfg.Hysteria2.PortHopping && cfg.Hysteria2.HopStartPort > 0 && cfg.Hysteria2.HopEndPort > cfg.Hysteria2.HopStartPort {
+			rules = append(rules, FirewallRule{Protocol: "udp", Ports: fmt.Sprintf("%d-%d", cfg.Hysteria2.HopStartPort, cfg.Hysteria2.HopEndPort), Comment: "hysteria2 port hopping"})
+		}
+	}
+
+	var tcpPorts []int
+	if cfg.PortMux.Enabled {
+		tcpPorts = append(tcpPorts, publicListenPort(cfg.PortMux.ListenAddr))
+	} else {
+		if protocolEnabled(cfg, XrayProtocolVLESS) || protocolEnabled(cfg, XrayProtocolVLESSReality) {
+			tcpPorts = append(tcpPorts, cfg.Xray.ListenPort)
+		}
+		if protocolEnabled(cfg, XrayProtocolTrojan) {
+			tcpPorts = append(tcpPorts, cfg.Xray.TrojanPort)
+		}
+		if cfg.Decoy.Enabled {
+			tcpPorts = append(tcpPorts, publicListenPort(cfg.Decoy.ListenAddr))
+		}
+	}
+	if cfg.Decoy.Enabled {
+		tcpPorts = append(tcpPorts, publicListenPort(cfg.Decoy.HTTPListenAddr))
+	}
+	// The CA reaches Hysteria2's own ACME challenge listener on the standard port, which an
+	// alt port setup forwards
+	if protocolEnabled(cfg, ProtocolHysteria2) && cfg.Hysteria2.CertMode == CertificateModeACME {
+		switch cfg.Hysteria2.ACMEChallenge {
+		case "", hysteriaconfig.ACMEChallengeHTTP:
+			tcpPorts = append(tcpPorts, 80)
+		case hysteriaconfig.ACMEChallengeTLS:
+			tcpPorts = append(tcpPorts, 443)
+		}
+	}
+	for _, port := range uniquePorts(tcpPorts) {
+		rules = append(rules, FirewallRule{Protocol: "tcp", Ports: strconv.Itoa(port), Comment: "vpn"})
+	}
+
+	// Shadowsocks is not behind the port mux and uses both transports
+	if protocolEnabled(cfg, XrayProtocolShadowsocks2022) && cfg.Xray.ShadowsocksPort > 0 {
+		for _, protocol := range []string{"tcp", "udp"} {
+			rules = append(rules, FirewallRule{Protocol: protocol, Ports: strconv.Itoa(cfg.Xray.ShadowsocksPort), Comment: "shadowsocks-2022"})
+		}
+	}
+
+	return rules
+}
+
+// managementSources returns the configured orchestrator CIDRs, or the addresses master_server resolves to
+func (fm *FirewallManagerImpl) managementSources() []string {
+	if len(fm.config.Firewall.ManagementSources) > 0 {
+		return fm.config.Firewall.ManagementSources
+	}
+
+	host := fm.config.MasterServer
+	if u, err := url.Parse(host); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "" {
+		return nil
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		fm.logger.Warnf("Failed to resolve master server %s for the firewall: %v", host, err)
+		return nil
+	}
+	sources := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		sources = append(sources, ip.String())
+	}
+	return sources
+}
+
+func (fm *FirewallManagerImpl) resolveBackend(backend string) (string, error) {
+	switch backend {
+	case FirewallBackendNFTables, FirewallBackendUFW:
+		if _, err := exec.LookPath(firewallBackendCommand(backend)); err != nil {
+			return "", fmt.Errorf("%s is not installed", backend)
+		}
+		return backend, nil
+	case "", FirewallBackendAuto:
+		// Prefer ufw when the host already manages its firewall with it
+		if _, err := exec.LookPath("ufw"); err == nil {
+			if output, err := fm.runCommandWithOutput("ufw", "status"); err == nil && strings.Contains(output, "Status: active") {
+				return FirewallBackendUFW, nil
+			}
+		}
+		if _, err := exec.LookPath("nft"); err == nil {
+			return FirewallBackendNFTables, nil
+		}
+		if _, err := exec.LookPath("ufw"); err == nil {
+			return FirewallBackendUFW, nil
+		}
+		return "", fmt.Errorf("neither nft nor ufw is installed")
+	default:
+		return "", fmt.Errorf("unsupported firewall backend %q", backend)
+	}
+}
+
+// applyNFTables atomically replaces the agent's table and installs the boot unit that
+// reloads it. The ruleset goes to the fixed file the privilege helper lets nft load.
+func (fm *FirewallManagerImpl) applyNFTables(rules []FirewallRule) error {
+	if err := privsep.WriteFile(privsep.FirewallRuleset, []byte(nftRuleset(rules)), 0600); err != nil {
+		return err
+	}
+
+	if err := fm.runCommand("nft", "-f", privsep.FirewallRuleset); err != nil {
+		return err
+	}
+
+	host := DetectHostOS(fm.config)
+	if host.Init == InitNone {
+		fm.logger.Warn("No init system to reload the firewall at boot, the firewall will not survive a reboot")
+		return nil
+	}
+	if err := host.InstallService(firewallServiceName); err != nil {
+		fm.logger.Warnf("Failed to install %s, the firewall will not survive a reboot: %v", firewallServiceName, err)
+	}
+	return nil
+}
+
+// applyUFW resets ufw to the ruleset; ufw restores its rules at boot by itself
+func (fm *FirewallManagerImpl) applyUFW(rules []FirewallRule) error {
+	commands := [][]string{
+		{"--force", "reset"},
+		{"default", "deny", "incoming"},
+		{"default", "allow", "outgoing"},
+	}
+	for _, rule := range rules {
+		ports := strings.Replace(rule.Ports, "-", ":", 1)
+		sources := rule.Sources
+		if len(sources) == 0 {
+			sources = []string{"any"}
+		}
+		for _, source := range sources {
+			args := []string{"allow", "proto", rule.Protocol, "from", source, "to", "any", "port", ports}
+			if rule.Comment != "" {
+				args = append(args, "comment", rule.Comment)
+			}
+			commands = append(commands, args)
+		}
+	}
+	commands = append(commands, []string{"--force", "enable"})
+
+	for _, args := range commands {
+		if err := fm.runCommand("ufw", args...); err != nil {
+			return fmt.Errorf("ufw %s: %w", strings.Join(args, " "), err)
+		}
+	}
+	return nil
+}
+
+// addBan blocks ip with the backend; nftables expires the element itself, ufw bans are lifted by Unban
+func (fm *FirewallManagerImpl) addBan(backend, ip string, duration time.Duration) error {
+	switch backend {
+	case FirewallBackendNFTables:
+		element := fmt.Sprintf("{ %s timeout %ds }", ip, int(duration.Seconds()+0.5))
+		return fm.runCommand("nft", "add", "element", "inet", firewallTable, nftBanSet(ip), element)
+	case FirewallBackendUFW:
+		return fm.runCommand("ufw", "prepend", "deny", "from", ip)
+	default:
+		return fmt.Errorf("unsupported firewall backend %q", backend)
+	}
+}
+
+func (fm *FirewallManagerImpl) removeBan(backend, ip string) error {
+	switch backend {
+	case FirewallBackendNFTables:
+		return fm.runCommand("nft", "delete", "element", "inet", firewallTable, nftBanSet(ip), fmt.Sprintf("{ %s }", ip))
+	case FirewallBackendUFW:
+		return fm.runCommand("ufw", "delete", "deny", "from", ip)
+	default:
+		return fmt.Errorf("unsupported firewall backend %q", backend)
+	}
+}
+
+func (fm *FirewallManagerImpl) loadState(name string) (*FirewallState, error) {
+	data, err := os.ReadFile(filepath.Join(fm.config.Firewall.StateDir, name))
+	if err != nil {
+		return nil, err
+	}
+	var state FirewallState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("invalid firewall state %s: %w", name, err)
+	}
+	return &state, nil
+}
+
+func (fm *FirewallManagerImpl) saveState(name string, state *FirewallState) error {
+	if err := os.MkdirAll(fm.config.Firewall.StateDir, 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(fm.config.Firewall.StateDir, name), data, 0600)
+}
+
+func (fm *FirewallManagerImpl) runCommand(name string, args ...string) error {
+	fm.logger.Debugf("Running command: %s %v", name, args)
+	if err := injectCommandFault(name, args...); err != nil {
+		return err
+	}
+	output, err := privsep.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func (fm *FirewallManagerImpl) runCommandWithOutput(name string, args ...string) (string, error) {
+	fm.logger.Debugf("Running command with output: %s %v", name, args)
+	if err := injectCommandFault(name, args...); err != nil {
+		return "", err
+	}
+	output, err := privsep.Command(name, args...).Output()
+	return string(output), err
+}
+
+// nftRuleset renders rules as a script that atomically replaces the agent's table
+func nftRuleset(rules []FirewallRule) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "table inet %s\ndelete table inet %s\n\n", firewallTable, firewallTable)
+	fmt.Fprintf(&b, "table inet %s {\n", firewallTable)
+	fmt.Fprintf(&b, "\tset %s {\n\t\ttype ipv4_addr\n\t\tflags timeout\n\t}\n\n", firewallBanSetV4)
+	fmt.Fprintf(&b, "\tset %s {\n\t\ttype ipv6_addr\n\t\tflags timeout\n\t}\n\n", firewallBanSetV6)
+	b.WriteString("\tchain input {\n")
+	b.WriteString("\t\ttype filter hook input priority filter; policy drop;\n\n")
+	b.WriteString("\t\tiif \"lo\" accept\n")
+	fmt.Fprintf(&b, "\t\tip saddr @%s drop\n", firewallBanSetV4)
+	fmt.Fprintf(&b, "\t\tip6 saddr @%s drop\n", firewallBanSetV6)
+	b.WriteString("\t\tct state established,related accept\n")
+	b.WriteString("\t\tct state invalid drop\n")
+	b.WriteString("\t\tmeta l4proto { icmp, ipv6-icmp } accept\n\n")
+
+	for _, rule := range rules {
+		comment := ""
+		if rule.Comment != "" {
+			comment = fmt.Sprintf(" comment %q", rule.Comment)
+		}
+		if len(rule.Sources) == 0 {
+			fmt.Fprintf(&b, "\t\t%s dport %s accept%s\n", rule.Protocol, rule.Ports, comment)
+			continue
+		}
+
+		var v4, v6 []string
+		for _, source := range rule.Sources {
+			if strings.Contains(source, ":") {
+				v6 = append(v6, source)
+			} else {
+				v4 = append(v4, source)
+			}
+		}
+		if len(v4) > 0 {
+			fmt.Fprintf(&b, "\t\tip saddr { %s } %s dport %s accept%s\n", strings.Join(v4, ", "), rule.Protocol, rule.Ports, comment)
+		}
+		if len(v6) > 0 {
+			fmt.Fprintf(&b, "\t\tip6 saddr { %s } %s dport %s accept%s\n", strings.Join(v6, ", "), rule.Protocol, rule.Ports, comment)
+		}
+	}
+
+	b.WriteString("\t}\n}\n")
+	return b.String()
+}
+
+// firewallRuleName describes a rule in drift reports, e.g. "udp 443 (hysteria2)"
+func firewallRuleName(rule FirewallRule) string {
+	name := rule.Protocol + " " + rule.Ports
+	if rule.Comment != "" {
+		name += " (" + rule.Comment + ")"
+	}
+	return name
+}
+
+// nftBanSet returns the ban set for the address family of ip
+func nftBanSet(ip string) string {
+	if strings.Contains(ip, ":") {
+		return firewallBanSetV6
+	}
+	return firewallBanSetV4
+}
+
+// sourcesContain reports whether ip is one of sources (IPs or CIDRs)
+func sourcesContain(sources []string, ip net.IP) bool {
+	for _, source := range sources {
+		if _, ipnet, err := net.ParseCIDR(source); err == nil {
+			if ipnet.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if sourceIP := net.ParseIP(source); sourceIP != nil && sourceIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateFirewallRule checks a rule and normalises its protocol and sources
+func validateFirewallRule(rule *FirewallRule) error {
+	rule.Protocol = strings.ToLower(rule.Protocol)
+	if rule.Protocol != "tcp" && rule.Protocol != "udp" {
+		return fmt.Errorf("protocol must be tcp or udp, got %q", rule.Protocol)
+	}
+
+	start, end, isRange := strings.Cut(rule.Ports, "-")
+	first, err := strconv.Atoi(start)
+	if err != nil || first < 1 || first > 65535 {
+		return fmt.Errorf("invalid port %q", rule.Ports)
+	}
+	if isRange {
+		last, err := strconv.Atoi(end)
+		if err != nil || last <= first || last > 65535 {
+			return fmt.Errorf("invalid port range %q", rule.Ports)
+		}
+	}
+
+	for i, source := range rule.Sources {
+		if _, ipnet, err := net.ParseCIDR(source); err == nil {
+			rule.Sources[i] = ipnet.String()
+			continue
+		}
+		if net.ParseIP(source) == nil {
+			return fmt.Errorf("invalid source %q", source)
+		}
+	}
+
+	// Comments end up inside quoted nft and ufw arguments
+	if strings.ContainsAny(rule.Comment, "\"\\\n") {
+		return fmt.Errorf("comment must not contain quotes, backslashes or newlines")
+	}
+	return nil
+}
+
+// protocolEnabled follows the node protocol matrix; a node without a matrix serves every protocol
+func protocolEnabled(cfg *config.Config, protocol string) bool {
+	if cfg.Node.Protocols == nil {
+		return true
+	}
+	enabled, ok := cfg.Node.Protocols[protocol]
+	return !ok || enabled
+}
+
+// publicListenPort returns the port of a listen address, or 0 when it is empty or bound to loopback
+func publicListenPort(addr string) int {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return 0
+	}
+	p, _ := strconv.Atoi(port)
+	return p
+}
+
+func uniquePorts(ports []int) []int {
+	seen := make(map[int]bool, len(ports))
+	var unique []int
+	for _, port := range ports {
+		if port > 0 && !seen[port] {
+			seen[port] = true
+			unique = append(unique, port)
+		}
+	}
+	sort.Ints(unique)
+	return unique
+}
+
+func firewallBackendCommand(backend string) string {
+	if backend == FirewallBackendNFTables {
+		return "nft"
+	}
+	return backend
+}
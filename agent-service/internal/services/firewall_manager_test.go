@@ -0,0 +1,243 @@
+package services
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"hysteria2_microservices/agent-service/internal/config"
+)
+
+func newTestFirewallManager(t *testing.T) *FirewallManagerImpl {
+	cfg := &config.Config{}
+	cfg.Node.GRPCPort = 50051
+	cfg.Hysteria2.DefaultListenPort = 443
+	cfg.Node.Protocols = map[string]bool{ProtocolHysteria2: true}
+	cfg.Firewall = config.FirewallConfig{
+		Enabled:           true,
+		Backend:           FirewallBackendUFW,
+		SSHPort:           22,
+		SSHSources:        []string{"198.51.100.0/24"},
+		ManagementSources: []string{"203.0.113.1"},
+		StateDir:          t.TempDir(),
+	}
+	return NewFirewallManager(testLogger(), cfg).(*FirewallManagerImpl)
+}
+
+func TestPublicServiceRules(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Hysteria2.DefaultListenPort = 443
+	cfg.Hysteria2.ListenPorts = []int{443, 8443}
+	cfg.Hysteria2.PortHopping = true
+	cfg.Hysteria2.HopStartPort, cfg.Hysteria2.HopEndPort = 20000, 50000
+	cfg.Hysteria2.CertMode = CertificateModeACME
+	cfg.Xray.ListenPort, cfg.Xray.TrojanPort, cfg.Xray.ShadowsocksPort = 443, 8444, 8388
+	cfg.Node.Protocols = map[string]bool{XrayProtocolTrojan: false}
+
+	var got []string
+	for _, rule := range publicServiceRules(cfg) {
+		got = append(got, rule.Protocol+" "+rule.Ports)
+	}
+	// Trojan is off in the matrix; the ACME HTTP challenge needs port 80
+	want := []string{"udp 443", "udp 8443", "udp 20000-50000", "tcp 80", "tcp 443", "tcp 8388", "udp 8388"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("rules %v, want %v", got, want)
+	}
+
+	// Behind the port mux only the mux port is open for TCP
+	cfg.PortMux.Enabled = true
+	cfg.PortMux.ListenAddr = ":8443"
+	got = nil
+	for _, rule := range publicServiceRules(cfg) {
+		if rule.Protocol == "tcp" && rule.Comment == "vpn" {
+			got = append(got, rule.Ports)
+		}
+	}
+	if !reflect.DeepEqual(got, []string{"80", "8443"}) {
+		t.Errorf("TCP ports behind the mux %v, want 80 and 8443", got)
+	}
+}
+
+func TestValidateFirewallRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    FirewallRule
+		wantErr bool
+	}{
+		{"port", FirewallRule{Protocol: "TCP", Ports: "443"}, false},
+		{"range with sources", FirewallRule{Protocol: "udp", Ports: "20000-50000", Sources: []string{"10.1.2.3/8", "2001:db8::1"}}, false},
+		{"unknown protocol", FirewallRule{Protocol: "icmp", Ports: "443"}, true},
+		{"port zero", FirewallRule{Protocol: "tcp", Ports: "0"}, true},
+		{"reversed range", FirewallRule{Protocol: "tcp", Ports: "50000-20000"}, true},
+		{"port out of range", FirewallRule{Protocol: "tcp", Ports: "65536"}, true},
+		{"bad source", FirewallRule{Protocol: "tcp", Ports: "443", Sources: []string{"example.com"}}, true},
+		{"quote in comment", FirewallRule{Protocol: "tcp", Ports: "443", Comment: `x" accept`}, true},
+	}
+	for _, tt := range tests {
+		if err := validateFirewallRule(&tt.rule); (err != nil) != tt.wantErr {
+			t.Errorf("%s: validateFirewallRule() = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	rule := FirewallRule{Protocol: "UDP", Ports: "53", Sources: []string{"10.1.2.3/8"}}
+	validateFirewallRule(&rule)
+	if rule.Protocol != "udp" || rule.Sources[0] != "10.0.0.0/8" {
+		t.Errorf("normalised rule %+v, want udp from 10.0.0.0/8", rule)
+	}
+}
+
+func TestNFTRuleset(t *testing.T) {
+	ruleset := nftRuleset([]FirewallRule{
+		{Protocol: "tcp", Ports: "22", Sources: []string{"198.51.100.0/24", "2001:db8::/32"}, Comment: "ssh"},
+		{Protocol: "udp", Ports: "443", Comment: "hysteria2"},
+	})
+
+	// The table is replaced as a whole and drops anything not allowed
+	for _, want := range []string{
+		"delete table inet hysteria2_agent",
+		"policy drop;",
+		"ip saddr { 198.51.100.0/24 } tcp dport 22 accept comment \"ssh\"",
+		"ip6 saddr { 2001:db8::/32 } tcp dport 22 accept comment \"ssh\"",
+		"udp dport 443 accept comment \"hysteria2\"",
+	} {
+		if !strings.Contains(ruleset, want) {
+			t.Errorf("ruleset lacks %q:\n%s", want, ruleset)
+		}
+	}
+	// Banned addresses are dropped before any allow rule
+	if strings.Index(ruleset, "ip saddr @banned_v4 drop") > strings.Index(ruleset, "dport") {
+		t.Errorf("bans come after allow rules:\n%s", ruleset)
+	}
+}
+
+func TestFirewallApplyKeepsBaseline(t *testing.T) {
+	fakes := fakeCommands(t, nil, "ufw")
+	fm := newTestFirewallManager(t)
+
+	extra := []FirewallRule{{Protocol: "tcp", Ports: "9100", Sources: []string{"10.0.0.5"}, Comment: "metrics"}}
+	if err := fm.Apply("", extra); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	calls := fakes.calls()
+	want := []string{
+		"ufw --force reset",
+		"ufw default deny incoming",
+		"ufw default allow outgoing",
+		"ufw allow proto tcp from 198.51.100.0/24 to any port 22 comment ssh",
+		"ufw allow proto tcp from 203.0.113.1 to any port 50051 comment agent grpc",
+		"ufw allow proto udp from any to any port 443 comment hysteria2",
+		"ufw allow proto tcp from 10.0.0.5 to any port 9100 comment metrics",
+		"ufw --force enable",
+	}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("ufw calls:\n%s\nwant:\n%s", strings.Join(calls, "\n"), strings.Join(want, "\n"))
+	}
+
+	// Restore goes back to the rules before the last Apply
+	if err := fm.Apply("", nil); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if err := fm.Restore(); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	status, err := fm.GetRules()
+	if err != nil {
+		t.Fatalf("GetRules: %v", err)
+	}
+	if status.Backend != FirewallBackendUFW || len(status.Baseline) != 3 || !reflect.DeepEqual(status.Rules, extra) {
+		t.Errorf("status after Restore: backend %s, %d baseline rules, rules %+v", status.Backend, len(status.Baseline), status.Rules)
+	}
+
+	if err := fm.Apply("", []FirewallRule{{Protocol: "tcp", Ports: "0"}}); err == nil {
+		t.Error("applied an invalid rule")
+	}
+	if err := fm.Apply("iptables", nil); err == nil {
+		t.Error("applied with an unsupported backend")
+	}
+
+	fm.Close()
+	if err := fm.Apply("", extra); !errors.Is(err, ErrFirewallClosed) {
+		t.Errorf("Apply after Close = %v, want ErrFirewallClosed", err)
+	}
+}
+
+func TestFirewallBans(t *testing.T) {
+	fakes := fakeCommands(t, nil, "nft", "ufw")
+	fm := newTestFirewallManager(t)
+
+	if err := fm.Ban("192.0.2.7", time.Minute); err == nil {
+		t.Error("banned without a baseline installed")
+	}
+	if err := fm.saveState(firewallStateFile, &FirewallState{Backend: FirewallBackendNFTables}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The orchestrator and SSH admins can never be locked out
+	for _, ip := range []string{"203.0.113.1", "198.51.100.20"} {
+		if err := fm.Ban(ip, time.Minute); err == nil {
+			t.Errorf("banned management address %s", ip)
+		}
+	}
+	if err := fm.Ban("2001:0db8::7", time.Minute); err != nil {
+		t.Fatalf("Ban: %v", err)
+	}
+	if err := fm.Unban("2001:db8::7"); err != nil {
+		t.Fatalf("Unban: %v", err)
+	}
+	if err := fm.Unban("2001:db8::7"); err == nil {
+		t.Error("unbanned an address twice")
+	}
+	want := []string{
+		"nft add element inet hysteria2_agent banned_v6 { 2001:db8::7 timeout 60s }",
+		"nft delete element inet hysteria2_agent banned_v6 { 2001:db8::7 }",
+	}
+	if calls := fakes.calls(); !reflect.DeepEqual(calls, want) {
+		t.Errorf("nft calls %v, want %v", calls, want)
+	}
+
+	// Bans outlive a ruleset replacement
+	if err := fm.Ban("192.0.2.7", time.Hour); err != nil {
+		t.Fatalf("Ban: %v", err)
+	}
+	if err := fm.Apply(FirewallBackendUFW, nil); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if calls := fakes.calls(); calls[len(calls)-1] != "ufw prepend deny from 192.0.2.7" {
+		t.Errorf("last call %q, want the ban added back", calls[len(calls)-1])
+	}
+}
+
+func TestFirewallVerify(t *testing.T) {
+	fakes := fakeCommands(t, nil, "ufw")
+	fm := newTestFirewallManager(t)
+
+	if missing, _ := fm.Verify(); !reflect.DeepEqual(missing, []string{"baseline not installed"}) {
+		t.Errorf("Verify before the baseline = %v", missing)
+	}
+	if err := fm.EnsureBaseline(); err != nil {
+		t.Fatalf("EnsureBaseline: %v", err)
+	}
+
+	// The Hysteria2 port was removed by hand
+	fakes.setOutput(t, "ufw", "Status: active\nDefault: deny (incoming), allow (outgoing)\n\n"+
+		"22/tcp    ALLOW IN    198.51.100.0/24\n50051/tcp    ALLOW IN    203.0.113.1\n")
+	missing, err := fm.Verify()
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if !reflect.DeepEqual(missing, []string{"udp 443 (hysteria2)"}) {
+		t.Errorf("missing %v, want the Hysteria2 port", missing)
+	}
+
+	fakes.setOutput(t, "ufw", "Status: inactive\n")
+	if missing, _ := fm.Verify(); !reflect.DeepEqual(missing, []string{"ufw enabled"}) {
+		t.Errorf("missing %v with ufw off", missing)
+	}
+
+	fm.config.Firewall.Enabled = false
+	if missing, _ := fm.Verify(); missing != nil {
+		t.Errorf("missing %v with the firewall disabled", missing)
+	}
+}
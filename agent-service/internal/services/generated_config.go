@@ -0,0 +1,118 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"hysteria2_microservices/agent-service/internal/config"
+	"hysteria2_microservices/agent-service/internal/secrets"
+)
+
+// writeGeneratedConfig saves a generated Hysteria2 or Xray server config. With
+// secrets.encrypt_generated the secret fields are sealed to the node key and the file is
+// readable by root only; the servers then run from a decrypted copy in the runtime
+// directory, see runtimeConfigPath.
+func writeGeneratedConfig(cfg *config.Config, path string, data []byte) error {
+	mode := os.FileMode(0644)
+	if cfg.Secrets.EncryptGenerated {
+		keyring, err := secrets.LoadOrGenerateKey(cfg.Secrets.KeyFile)
+		if err != nil {
+			return err
+		}
+		if isYAMLConfig(path) {
+			data, err = keyring.SealYAML(data)
+		} else {
+			data, err = keyring.SealJSON(data)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to seal config secrets: %w", err)
+		}
+		mode = 0600
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create config directory: %w", err)
+	}
+	if err := os.WriteFile(path, data, mode); err != nil {
+		return err
+	}
+	// WriteFile keeps the mode of an existing file
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+	return recordDeployedConfig(cfg, path, data)
+}
+
+// readGeneratedConfig reads a generated server config with its secrets decrypted
+func readGeneratedConfig(cfg *config.Config, path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return openGeneratedConfig(cfg, path, data)
+}
+
+// readCurrentConfig reads a generated server config for display, treating a missing file
+// as an empty config
+func readCurrentConfig(cfg *config.Config, path string) (string, error) {
+	data, err := readGeneratedConfig(cfg, path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return string(data), nil
+}
+
+func openGeneratedConfig(cfg *config.Config, path string, data []byte) ([]byte, error) {
+	if !secrets.ContainsSealed(data) {
+		return data, nil
+	}
+	keyring, err := secrets.LoadKey(cfg.Secrets.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	var opened []byte
+	if isYAMLConfig(path) {
+		opened, err = keyring.OpenYAML(data)
+	} else {
+		opened, err = keyring.OpenJSON(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt config secrets: %w", err)
+	}
+	return opened, nil
+}
+
+// runtimeConfigPath returns the config file a server should run from: path itself when it
+// holds no sealed secrets, otherwise a decrypted copy written to the runtime directory,
+// which is expected to be on tmpfs so plaintext secrets never reach the disk
+func runtimeConfigPath(cfg *config.Config, path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil || !secrets.ContainsSealed(data) {
+		// A missing file is reported by the server itself
+		return path, nil
+	}
+	opened, err := openGeneratedConfig(cfg, path, data)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(cfg.Secrets.RuntimeDir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create runtime directory: %w", err)
+	}
+	runtimePath := filepath.Join(cfg.Secrets.RuntimeDir, filepath.Base(filepath.Dir(path))+"-"+filepath.Base(path))
+	if err := os.WriteFile(runtimePath, opened, 0600); err != nil {
+		return "", fmt.Errorf("failed to write runtime config: %w", err)
+	}
+	return runtimePath, nil
+}
+
+// isYAMLConfig reports whether a generated config is YAML, like the Hysteria2 server
+// config, rather than JSON
+func isYAMLConfig(path string) bool {
+	ext := filepath.Ext(path)
+	return ext == ".yaml" || ext == ".yml"
+}
@@ -0,0 +1,112 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"hysteria2_microservices/agent-service/internal/config"
+	"hysteria2_microservices/agent-service/internal/secrets"
+)
+
+const testHysteriaConfig = "listen: :443\nauth:\n  type: password\n  password: auth-pw\n"
+
+func newTestSecretsConfig(t *testing.T, encrypt bool) *config.Config {
+	dir := t.TempDir()
+	cfg := &config.Config{}
+	cfg.Secrets.EncryptGenerated = encrypt
+	cfg.Secrets.KeyFile = filepath.Join(dir, "node.key")
+	cfg.Secrets.RuntimeDir = filepath.Join(dir, "run")
+	return cfg
+}
+
+func TestWriteGeneratedConfigSealsSecrets(t *testing.T) {
+	cfg := newTestSecretsConfig(t, true)
+	path := filepath.Join(t.TempDir(), "hysteria", "config.yaml")
+	// An existing world-readable config is tightened
+	os.MkdirAll(filepath.Dir(path), 0755)
+	os.WriteFile(path, []byte(testHysteriaConfig), 0644)
+
+	if err := writeGeneratedConfig(cfg, path, []byte(testHysteriaConfig)); err != nil {
+		t.Fatalf("writeGeneratedConfig: %v", err)
+	}
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), "auth-pw") || !secrets.ContainsSealed(data) {
+		t.Errorf("config on disk:\n%s\nwant the password sealed", data)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+		t.Errorf("config mode %v, want 0600", info.Mode().Perm())
+	}
+	if _, err := os.Stat(cfg.Secrets.KeyFile); err != nil {
+		t.Errorf("node key not generated: %v", err)
+	}
+
+	if current, err := readCurrentConfig(cfg, path); err != nil || current != testHysteriaConfig {
+		t.Errorf("readCurrentConfig = %q, %v; want the decrypted config", current, err)
+	}
+
+	// The server runs from a decrypted copy in the runtime directory
+	runtimePath, err := runtimeConfigPath(cfg, path)
+	if err != nil {
+		t.Fatalf("runtimeConfigPath: %v", err)
+	}
+	if runtimePath != filepath.Join(cfg.Secrets.RuntimeDir, "hysteria-config.yaml") {
+		t.Errorf("runtime path %s", runtimePath)
+	}
+	if data, _ := os.ReadFile(runtimePath); string(data) != testHysteriaConfig {
+		t.Errorf("runtime config:\n%s\nwant the decrypted config", data)
+	}
+	if info, _ := os.Stat(runtimePath); info.Mode().Perm() != 0600 {
+		t.Errorf("runtime config mode %v, want 0600", info.Mode().Perm())
+	}
+
+	// Without the node key the secrets cannot be read
+	os.Remove(cfg.Secrets.KeyFile)
+	if _, err := readGeneratedConfig(cfg, path); err == nil {
+		t.Error("read a sealed config without the node key")
+	}
+}
+
+func TestWriteGeneratedConfigPlaintext(t *testing.T) {
+	cfg := newTestSecretsConfig(t, false)
+	path := filepath.Join(t.TempDir(), "xray", "config.json")
+	plain := []byte(`{"inbounds": [{"settings": {"clients": [{"password": "trojan-pw"}]}}]}`)
+
+	if err := writeGeneratedConfig(cfg, path, plain); err != nil {
+		t.Fatalf("writeGeneratedConfig: %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != string(plain) {
+		t.Errorf("config on disk:\n%s\nwant it unchanged", data)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0644 {
+		t.Errorf("config mode %v, want 0644", info.Mode().Perm())
+	}
+	if _, err := os.Stat(cfg.Secrets.KeyFile); !os.IsNotExist(err) {
+		t.Error("node key generated without encryption")
+	}
+
+	if runtimePath, err := runtimeConfigPath(cfg, path); err != nil || runtimePath != path {
+		t.Errorf("runtimeConfigPath = %s, %v; want the config itself", runtimePath, err)
+	}
+	if current, err := readCurrentConfig(cfg, filepath.Join(filepath.Dir(path), "missing.json")); err != nil || current != "" {
+		t.Errorf("readCurrentConfig of a missing config = %q, %v", current, err)
+	}
+}
+
+func TestWriteGeneratedConfigSealsJSON(t *testing.T) {
+	cfg := newTestSecretsConfig(t, true)
+	path := filepath.Join(t.TempDir(), "xray", "config.json")
+	plain := `{"inbounds": [{"streamSettings": {"realitySettings": {"privateKey": "reality-key"}}}]}`
+
+	if err := writeGeneratedConfig(cfg, path, []byte(plain)); err != nil {
+		t.Fatalf("writeGeneratedConfig: %v", err)
+	}
+	if data, _ := os.ReadFile(path); strings.Contains(string(data), "reality-key") {
+		t.Errorf("config on disk:\n%s\nwant the private key sealed", data)
+	}
+	opened, err := readGeneratedConfig(cfg, path)
+	if err != nil || !strings.Contains(string(opened), `"privateKey": "reality-key"`) {
+		t.Errorf("readGeneratedConfig = %s, %v", opened, err)
+	}
+}
@@ -0,0 +1,406 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"hysteria2_microservices/agent-service/internal/config"
+	"hysteria2_microservices/agent-service/internal/privsep"
+)
+
+// Init systems
+const (
+	InitSystemd = privsep.InitSystemd
+	InitOpenRC  = privsep.InitOpenRC
+	InitNone    = privsep.InitNone // the privilege helper starts and supervises the processes
+)
+
+// Package managers
+const (
+	PackageManagerApt = "apt"
+	PackageManagerDnf = "dnf"
+	PackageManagerYum = "yum"
+	PackageManagerApk = "apk"
+)
+
+// Distribution families, from the os-release ID and ID_LIKE
+const (
+	OSFamilyDebian = "debian"
+	OSFamilyRHEL   = "rhel"
+	OSFamilyAlpine = "alpine"
+)
+
+const hostCommandTimeout = 10 * time.Minute // package installs
+
+// HostOS is the distribution the agent runs on and how it installs packages and manages
+// services there. Debian and Ubuntu use apt, CentOS, RHEL, Rocky and Fedora dnf or yum,
+// and Alpine apk; services run under systemd, OpenRC, or the agent itself when neither is
+// running, as in most containers.
+type HostOS struct {
+	ID             string // os-release ID, e.g. "ubuntu"
+	Version        string // os-release VERSION_ID
+	Codename       string // os-release VERSION_CODENAME, e.g. "bookworm"
+	Family         string // debian, rhel, alpine, or empty when unknown
+	PackageManager string // empty when none is found
+	Init           string
+}
+
+var (
+	hostOSOnce sync.Once
+	hostOS     *HostOS
+)
+
+// DetectHostOS returns the host, detected on first use; the system section of cfg
+// overrides the init system and package manager
+func DetectHostOS(cfg *config.Config) *HostOS {
+	hostOSOnce.Do(func() {
+		hostOS = detectHostOS("/etc/os-release")
+		if cfg != nil && cfg.System.Init != "" {
+			hostOS.Init = cfg.System.Init
+		}
+		if cfg != nil && cfg.System.PackageManager != "" {
+			hostOS.PackageManager = cfg.System.PackageManager
+		}
+	})
+	return hostOS
+}
+
+func detectHostOS(osRelease string) *HostOS {
+	fields := map[string]string{}
+	if data, err := os.ReadFile(osRelease); err == nil {
+		fields = parseOSRelease(data)
+	}
+	h := &HostOS{
+		ID:       fields["ID"],
+		Version:  fields["VERSION_ID"],
+		Codename: fields["VERSION_CODENAME"],
+		Family:   osFamily(fields["ID"], fields["ID_LIKE"]),
+	}
+
+	candidates := []string{PackageManagerApt, PackageManagerDnf, PackageManagerYum, PackageManagerApk}
+	switch h.Family {
+	case OSFamilyRHEL:
+		candidates = []string{PackageManagerDnf, PackageManagerYum}
+	case OSFamilyAlpine:
+		candidates = []string{PackageManagerApk}
+	case OSFamilyDebian:
+		candidates = []string{PackageManagerApt}
+	}
+	for _, manager := range candidates {
+		binary := manager
+		if manager == PackageManagerApt {
+			binary = "apt-get"
+		}
+		if _, err := exec.LookPath(binary); err == nil {
+			h.PackageManager = manager
+			break
+		}
+	}
+
+	h.Init = InitNone
+	if info, err := os.Stat("/run/systemd/system"); err == nil && info.IsDir() {
+		h.Init = InitSystemd
+	} else if _, err := os.Stat("/run/openrc"); err == nil {
+		h.Init = InitOpenRC
+	}
+	return h
+}
+
+// parseOSRelease reads the KEY=value lines of an os-release file
+func parseOSRelease(data []byte) map[string]string {
+	fields := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok || strings.HasPrefix(key, "#") {
+			continue
+		}
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		} else {
+			value = strings.Trim(value, `'"`)
+		}
+		fields[key] = value
+	}
+	return fields
+}
+
+func osFamily(id, idLike string) string {
+	for _, name := range append([]string{id}, strings.Fields(idLike)...) {
+		switch name {
+		case "debian", "ubuntu":
+			return OSFamilyDebian
+		case "rhel", "centos", "fedora", "rocky", "almalinux":
+			return OSFamilyRHEL
+		case "alpine":
+			return OSFamilyAlpine
+		}
+	}
+	return ""
+}
+
+// PackageFormat is the extension of the packages the package manager installs from files
+func (h *HostOS) PackageFormat() string {
+	switch h.PackageManager {
+	case PackageManagerApt:
+		return "deb"
+	case PackageManagerDnf, PackageManagerYum:
+		return "rpm"
+	case PackageManagerApk:
+		return "apk"
+	}
+	return ""
+}
+
+// InstallPackages installs packages from the distribution's repositories
+func (h *HostOS) InstallPackages(packages ...string) error {
+	switch h.PackageManager {
+	case PackageManagerApt:
+		if _, err := runHostCommand("apt-get", "update"); err != nil {
+			return err
+		}
+		_, err := runHostCommand("apt-get", append([]string{"install", "-y", "--no-install-recommends"}, packages...)...)
+		return err
+	case PackageManagerDnf, PackageManagerYum:
+		_, err := runHostCommand(h.PackageManager, append([]string{"install", "-y"}, packages...)...)
+		return err
+	case PackageManagerApk:
+		if _, err := runHostCommand("apk", "update"); err != nil {
+			return err
+		}
+		_, err := runHostCommand("apk", append([]string{"add"}, packages...)...)
+		return err
+	}
+	return fmt.Errorf("no supported package manager found on %s", h.describe())
+}
+
+// InstallPackageFrom installs the package file at url, resolving its dependencies from the
+// configured repositories. The privilege helper downloads the file itself, into a directory
+// only root writes to, and installs it only if its SHA-256 is pinned in privsep.PackagePins;
+// token authenticates the download.
+func (h *HostOS) InstallPackageFrom(url, token string) error {
+	switch h.PackageManager {
+	case PackageManagerApt:
+		return privsep.InstallPackage("apt-get", url, token)
+	case PackageManagerDnf, PackageManagerYum:
+		return privsep.InstallPackage(h.PackageManager, url, token)
+	}
+	return fmt.Errorf("no package manager installing package files found on %s", h.describe())
+}
+
+// RemovePackages uninstalls packages
+func (h *HostOS) RemovePackages(packages ...string) error {
+	switch h.PackageManager {
+	case PackageManagerApt:
+		_, err := runHostCommand("apt-get", append([]string{"remove", "-y"}, packages...)...)
+		return err
+	case PackageManagerDnf, PackageManagerYum:
+		_, err := runHostCommand(h.PackageManager, append([]string{"remove", "-y"}, packages...)...)
+		return err
+	case PackageManagerApk:
+		_, err := runHostCommand("apk", append([]string{"del"}, packages...)...)
+		return err
+	}
+	return fmt.Errorf("no supported package manager found on %s", h.describe())
+}
+
+// InstallService installs one of the agent's services with the init system and enables it
+// at boot, without starting it; params are the service's parameters, see
+// privsep.InstallService. The privilege helper renders the unit or init script itself.
+// Without an init system the helper keeps the definition to start the process itself;
+// nothing starts it at boot but the agent.
+func (h *HostOS) InstallService(name string, params ...string) error {
+	if err := privsep.InstallService(h.Init, name, params...); err != nil {
+		return fmt.Errorf("failed to install %s: %w", name, err)
+	}
+	return nil
+}
+
+// StartService starts a service installed with the init system, or by InstallService when
+// there is none
+func (h *HostOS) StartService(name string) error {
+	switch h.Init {
+	case InitSystemd:
+		_, err := runHostCommand("systemctl", "start", name)
+		return err
+	case InitOpenRC:
+		_, err := runHostCommand("rc-service", name, "start")
+		return err
+	}
+
+	return privsep.StartService(name)
+}
+
+// StopService stops a service
+func (h *HostOS) StopService(name string) error {
+	switch h.Init {
+	case InitSystemd:
+		_, err := runHostCommand("systemctl", "stop", name)
+		return err
+	case InitOpenRC:
+		_, err := runHostCommand("rc-service", name, "stop")
+		return err
+	}
+
+	return privsep.StopService(name)
+}
+
+// RestartService restarts a service
+func (h *HostOS) RestartService(name string) error {
+	switch h.Init {
+	case InitSystemd:
+		_, err := runHostCommand("systemctl", "restart", name)
+		return err
+	case InitOpenRC:
+		_, err := runHostCommand("rc-service", name, "restart")
+		return err
+	}
+	if err := h.StopService(name); err != nil {
+		return err
+	}
+	return h.StartService(name)
+}
+
+// ReloadService asks a service to reread its configuration
+func (h *HostOS) ReloadService(name string) error {
+	switch h.Init {
+	case InitSystemd:
+		_, err := runHostCommand("systemctl", "reload", name)
+		return err
+	case InitOpenRC:
+		_, err := runHostCommand("rc-service", name, "reload")
+		return err
+	}
+	return privsep.ReloadService(name)
+}
+
+// ServiceActive reports whether a service is running
+func (h *HostOS) ServiceActive(name string) bool {
+	switch h.Init {
+	case InitSystemd:
+		output, _ := runHostCommand("systemctl", "is-active", name)
+		return strings.TrimSpace(output) == "active"
+	case InitOpenRC:
+		_, err := runHostCommand("rc-service", name, "status")
+		return err == nil
+	}
+	return privsep.ServiceRunning(name)
+}
+
+// ServiceLogs returns the last lines a service logged
+func (h *HostOS) ServiceLogs(name string, lines int) (string, error) {
+	if h.Init == InitSystemd {
+		return runHostCommand("journalctl", "-u", name, "-n", strconv.Itoa(lines), "--no-pager", "-o", "short-iso")
+	}
+	return tailFile(privsep.ServiceLogFile(name), lines)
+}
+
+// FollowServiceLog passes the lines a service logs from now on to handle until ctx is done
+func (h *HostOS) FollowServiceLog(ctx context.Context, handle func(string), names ...string) error {
+	if h.Init == InitSystemd {
+		args := []string{"-f", "-n", "0", "-o", "cat"}
+		for _, name := range names {
+			args = append(args, "-u", name+".service")
+		}
+		return followCommand(ctx, handle, "journalctl", args...)
+	}
+	return followFile(ctx, handle, privsep.ServiceLogFile(names[0]))
+}
+
+// AuthLogFile is where sshd logs logins when journald does not hold them
+func (h *HostOS) AuthLogFile() string {
+	switch h.Family {
+	case OSFamilyRHEL:
+		return "/var/log/secure"
+	case OSFamilyAlpine:
+		return "/var/log/messages"
+	}
+	return "/var/log/auth.log"
+}
+
+// CronService is the name of the cron daemon's service
+func (h *HostOS) CronService() string {
+	if h.Family == OSFamilyDebian || h.Family == "" {
+		return "cron"
+	}
+	return "crond"
+}
+
+// InstallCronJob installs one of the agent's cron jobs, whose schedule and command the
+// privilege helper keeps. Alpine's busybox cron has no /etc/cron.d, so the job goes into
+// root's crontab there.
+func (h *HostOS) InstallCronJob(name string) error {
+	return privsep.InstallCronJob(h.cronTable(), name)
+}
+
+// RemoveCronJob removes a job added with InstallCronJob
+func (h *HostOS) RemoveCronJob(name string) error {
+	return privsep.RemoveCronJob(h.cronTable(), name)
+}
+
+func (h *HostOS) cronTable() string {
+	if h.Family == OSFamilyAlpine {
+		return privsep.CronTab
+	}
+	return privsep.CronDir
+}
+
+func (h *HostOS) describe() string {
+	if h.ID == "" {
+		return "this host"
+	}
+	return strings.TrimSpace(h.ID + " " + h.Version)
+}
+
+// tailFile returns up to the last lines of a file
+func tailFile(path string, lines int) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	// The last 256KB hold more lines than are ever asked for
+	const window = 256 << 10
+	if info, err := file.Stat(); err == nil && info.Size() > window {
+		if _, err := file.Seek(-window, io.SeekEnd); err != nil {
+			return "", err
+		}
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return "", err
+	}
+	all := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(all) > lines {
+		all = all[len(all)-lines:]
+	}
+	return strings.Join(all, "\n"), nil
+}
+
+// runHostCommand runs a command and returns its combined output, with the last output line
+// in the error when it fails
+func runHostCommand(name string, args ...string) (string, error) {
+	if err := injectCommandFault(name, args...); err != nil {
+		return "", fmt.Errorf("%s %s: %w", name, strings.Join(args, " "), err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), hostCommandTimeout)
+	defer cancel()
+
+	cmd := privsep.CommandContext(ctx, name, args...)
+	cmd.Env = append(os.Environ(), "DEBIAN_FRONTEND=noninteractive")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return string(output), fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err, lastLine(string(output)))
+	}
+	return string(output), nil
+}
@@ -0,0 +1,146 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseOSRelease(t *testing.T) {
+	fields := parseOSRelease([]byte(`# Rocky Linux
+NAME="Rocky Linux"
+ID="rocky"
+ID_LIKE='rhel centos fedora'
+VERSION_ID=9.3
+PRETTY_NAME="Rocky \"Blue Onyx\""
+not a field
+`))
+	want := map[string]string{
+		"NAME":        "Rocky Linux",
+		"ID":          "rocky",
+		"ID_LIKE":     "rhel centos fedora",
+		"VERSION_ID":  "9.3",
+		"PRETTY_NAME": `Rocky "Blue Onyx"`,
+	}
+	if !reflect.DeepEqual(fields, want) {
+		t.Errorf("fields = %v, want %v", fields, want)
+	}
+}
+
+func TestDetectHostOS(t *testing.T) {
+	tests := []struct {
+		name        string
+		osRelease   string
+		binaries    []string
+		wantFamily  string
+		wantManager string
+		wantFormat  string
+	}{
+		{"debian", "ID=debian\nVERSION_ID=\"12\"\nVERSION_CODENAME=bookworm\n", []string{"apt-get", "dnf"}, OSFamilyDebian, PackageManagerApt, "deb"},
+		{"derivative", "ID=linuxmint\nID_LIKE=\"ubuntu debian\"\n", []string{"apt-get"}, OSFamilyDebian, PackageManagerApt, "deb"},
+		{"rhel with yum only", "ID=\"centos\"\nVERSION_ID=\"7\"\n", []string{"yum", "apt-get"}, OSFamilyRHEL, PackageManagerYum, "rpm"},
+		{"fedora", "ID=fedora\n", []string{"dnf", "yum"}, OSFamilyRHEL, PackageManagerDnf, "rpm"},
+		{"alpine", "ID=alpine\nVERSION_ID=3.19.1\n", []string{"apk"}, OSFamilyAlpine, PackageManagerApk, "apk"},
+		{"family without its manager", "ID=alpine\n", []string{"apt-get"}, OSFamilyAlpine, "", ""},
+		{"unknown distribution", "ID=arch\n", []string{"apk"}, "", PackageManagerApk, "apk"},
+		{"no os-release", "", []string{"dnf"}, "", PackageManagerDnf, "rpm"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakes := newCommandFakes(t)
+			for _, binary := range tt.binaries {
+				fakes.install(t, binary, "#!/bin/sh\nexit 0\n")
+			}
+			t.Setenv("PATH", fakes.dir)
+			osRelease := filepath.Join(t.TempDir(), "os-release")
+			if tt.osRelease != "" {
+				os.WriteFile(osRelease, []byte(tt.osRelease), 0644)
+			}
+
+			h := detectHostOS(osRelease)
+			if h.Family != tt.wantFamily || h.PackageManager != tt.wantManager || h.PackageFormat() != tt.wantFormat {
+				t.Errorf("host = %+v with format %q; want family %q, manager %q, format %q", h, h.PackageFormat(), tt.wantFamily, tt.wantManager, tt.wantFormat)
+			}
+		})
+	}
+}
+
+func TestHostOSInstallPackages(t *testing.T) {
+	tests := []struct {
+		manager   string
+		wantCalls []string
+	}{
+		{PackageManagerApt, []string{"apt-get update", "apt-get install -y --no-install-recommends wireguard-tools nftables"}},
+		{PackageManagerDnf, []string{"dnf install -y wireguard-tools nftables"}},
+		{PackageManagerApk, []string{"apk update", "apk add wireguard-tools nftables"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.manager, func(t *testing.T) {
+			fakes := fakeCommands(t, nil, "apt-get", "dnf", "apk")
+			h := &HostOS{PackageManager: tt.manager}
+			if err := h.InstallPackages("wireguard-tools", "nftables"); err != nil {
+				t.Fatal(err)
+			}
+			if calls := fakes.calls(); !reflect.DeepEqual(calls, tt.wantCalls) {
+				t.Errorf("ran %q, want %q", calls, tt.wantCalls)
+			}
+		})
+	}
+
+	h := &HostOS{ID: "arch", Version: "rolling"}
+	if err := h.InstallPackages("nftables"); err == nil || !strings.Contains(err.Error(), "arch rolling") {
+		t.Errorf("install without a package manager = %v, want an error naming the host", err)
+	}
+}
+
+func TestHostOSServices(t *testing.T) {
+	fakes := fakeCommands(t, map[string]int{"rc-service status": 3}, "systemctl", "rc-service")
+	fakes.setOutput(t, "systemctl", "active\n")
+
+	systemd := &HostOS{Init: InitSystemd}
+	openrc := &HostOS{Init: InitOpenRC}
+	systemd.RestartService("hysteria2")
+	openrc.RestartService("hysteria2")
+	if !systemd.ServiceActive("hysteria2") {
+		t.Error("active systemd service reported stopped")
+	}
+	if openrc.ServiceActive("hysteria2") {
+		t.Error("stopped OpenRC service reported running")
+	}
+	want := []string{"systemctl restart hysteria2", "rc-service hysteria2 restart", "systemctl is-active hysteria2", "rc-service hysteria2 status"}
+	if calls := fakes.calls(); !reflect.DeepEqual(calls, want) {
+		t.Errorf("ran %q, want %q", calls, want)
+	}
+}
+
+func TestHostOSDistributionFiles(t *testing.T) {
+	tests := []struct {
+		family      string
+		wantAuthLog string
+		wantCron    string
+	}{
+		{OSFamilyDebian, "/var/log/auth.log", "cron"},
+		{OSFamilyRHEL, "/var/log/secure", "crond"},
+		{OSFamilyAlpine, "/var/log/messages", "crond"},
+		{"", "/var/log/auth.log", "cron"},
+	}
+	for _, tt := range tests {
+		h := &HostOS{Family: tt.family}
+		if h.AuthLogFile() != tt.wantAuthLog || h.CronService() != tt.wantCron {
+			t.Errorf("%q: auth log %s, cron %s; want %s, %s", tt.family, h.AuthLogFile(), h.CronService(), tt.wantAuthLog, tt.wantCron)
+		}
+	}
+}
+
+func TestTailFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hysteria2.log")
+	os.WriteFile(path, []byte("one\ntwo\nthree\n"), 0644)
+	if got, err := tailFile(path, 2); err != nil || got != "two\nthree" {
+		t.Errorf("tailFile = %q, %v; want the last two lines", got, err)
+	}
+	if got, _ := tailFile(path, 10); got != "one\ntwo\nthree" {
+		t.Errorf("tailFile past the start = %q", got)
+	}
+}
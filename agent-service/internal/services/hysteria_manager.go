@@ -1,15 +1,24 @@
 package services
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"hysteria2_microservices/agent-service/internal/config"
+	"hysteria2_microservices/agent-service/internal/hysteriaconfig"
 )
 
 // HysteriaManager handles Hysteria2 VPN server management
@@ -17,15 +26,26 @@ type HysteriaManager interface {
 	InstallHysteria2() error
 	IsHysteria2Installed() bool
 	GenerateConfig(configTemplate string) (string, error)
+	SaveConfig(configPath, content string) error
 	StartHysteria2(configPath string) error
 	StopHysteria2() error
 	RestartHysteria2(configPath string) error
+	ForceRestartHysteria2(configPath string) error
+	ReloadHysteria2(configPath string) error
+	SetReloadReporter(reporter ReloadReporter)
+	WithDrained(fn func() error) error
+	ConfigPath() string
+	CurrentConfig() (string, error)
 	GetHysteria2Status() (map[string]interface{}, error)
 	EnablePortHopping(startPort, endPort, interval int) error
 	DisablePortHopping() error
 	EnableSalamander(password string) error
 	DisableSalamander() error
 
+	// Masquerade methods
+	ConfigureMasquerade(settings MasqueradeSettings) error
+	GetMasqueradeStatus() map[string]interface{}
+
 	// Advanced obfuscation methods for Russian DPI bypass
 	EnableAdvancedObfuscation() error
 	DisableAdvancedObfuscation() error
@@ -42,6 +62,7 @@ type HysteriaManager interface {
 	EnableTrafficShaping() error
 	DisableTrafficShaping() error
 	GetObfuscationStatus() (map[string]interface{}, error)
+	ApplyObfuscation(settings ObfuscationSettings) (ObfuscationSettings, error)
 
 	// SNI-related methods
 	ConfigureSNI(domains []string, defaultSNI string) error
@@ -52,12 +73,21 @@ type HysteriaManager interface {
 	DisableSNI() error
 	AddSNIDomain(domain string) error
 	RemoveSNIDomain(domain string) error
+	CheckSNIDomainDNS(domain string) SNIDomainCheck
+
+	// Certificate mode methods
+	ConfigureCertificateMode(settings CertificateModeSettings) error
+	GetACMEStatus() (*ACMEStatus, error)
+	ListCertificates() ([]CertificateInfo, error)
 
 	// Let's Encrypt automation
 	AutoConfigureSNICertificates(domains []string, email string) error
 	SetupInitialCertificates(domains []string, email string) error
 	EnableAutoRenewal() error
 	DisableAutoRenewal() error
+	RenewCertificates() error
+	IssueCertificate(domain, email string) (*CertificateInfo, error)
+	InstallCertificate(domain, certPEM, keyPEM string) (*CertificateInfo, error)
 	ValidateAllDomains(domains []string) error
 }
 
@@ -82,6 +112,20 @@ type HysteriaManagerImpl struct {
 	logger             *logrus.Logger
 	config             *config.Config
 	certificateManager CertificateManager
+	runner             *CommandRunner
+
+	restartMu     sync.Mutex // one restart or reload at a time
+	stateMu       sync.Mutex
+	running       string // digest of the config the server was started with
+	drainDeadline time.Time
+	drainCut      chan struct{} // closed to end the drain in progress early
+	forced        int           // forced restarts waiting for restartMu
+	reporter      ReloadReporter
+
+	// Draining loads its ruleset and counts connections through these
+	loadNFT          func(script string) error
+	countConnections func(services []FirewallRule) (int, error)
+	drainPoll        time.Duration
 }
 
 // NewHysteriaManager creates a new HysteriaManager
@@ -91,20 +135,67 @@ func NewHysteriaManager(logger *logrus.Logger, cfg *config.Config) HysteriaManag
 		logger:             logger,
 		config:             cfg,
 		certificateManager: certManager,
+		runner:             NewCommandRunner(logger, cfg),
+		loadNFT:            runNFT,
+		countConnections:   countServiceConnections,
+		drainPoll:          hysteria2DrainPoll,
 	}
 }
 
-// InstallHysteria2 installs Hysteria2 using the official script
+// InstallHysteria2 installs the Hysteria2 release binary, from GitHub checked against the
+// release's hashes.txt, or from the orchestrator's artifact store in offline mode, at the
+// pinned version when one is configured and the latest release otherwise
 func (hm *HysteriaManagerImpl) InstallHysteria2() error {
-	hm.logger.Info("Installing Hysteria2...")
+	ctx, cancel := context.WithTimeout(context.Background(), binaryDownloadTimeout)
+	defer cancel()
+
+	store := newArtifactStore(hm.config)
+	client := &http.Client{Timeout: binaryDownloadTimeout}
+
+	version := hm.config.Hysteria2.Version
+	if version == "" {
+		var latest string
+		var err error
+		if store != nil {
+			latest, err = store.latest(ctx, "hysteria2")
+		} else {
+			latest, err = latestReleaseTag(ctx, client, hysteriaRepository)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to install Hysteria2: %w", err)
+		}
+		version = latest
+	}
+	version = normalizeHysteriaVersion(version)
+	if !hysteriaVersionPattern.MatchString(version) {
+		return fmt.Errorf("invalid hysteria2 version %q", version)
+	}
+	if store != nil {
+		hm.logger.Infof("Installing Hysteria2 %s from the artifact store...", version)
+	} else {
+		hm.logger.Infof("Installing Hysteria2 %s...", version)
+	}
+
+	binaryPath := hysteriaBinaryPath(hm.config)
+	if err := os.MkdirAll(filepath.Dir(binaryPath), 0755); err != nil {
+		return fmt.Errorf("failed to create binary directory: %w", err)
+	}
+	candidate := binaryPath + ".new"
+	defer os.Remove(candidate)
 
-	// Use the official install script
-	cmd := exec.Command("bash", "-c", "bash <(curl -fsSL https://get.hy2.sh/)")
-	output, err := cmd.CombinedOutput()
+	var err error
+	if store != nil {
+		err = store.download(ctx, hysteriaArtifact(version), candidate)
+	} else {
+		err = downloadHysteriaRelease(ctx, client, version, candidate)
+	}
 	if err != nil {
-		hm.logger.Errorf("Failed to install Hysteria2: %v, output: %s", err, string(output))
+		hm.logger.Errorf("Failed to install Hysteria2: %v", err)
 		return fmt.Errorf("failed to install Hysteria2: %w", err)
 	}
+	if err := os.Rename(candidate, binaryPath); err != nil {
+		return fmt.Errorf("failed to install Hysteria2 binary: %w", err)
+	}
 
 	hm.logger.Info("Hysteria2 installed successfully")
 	return nil
@@ -117,51 +208,48 @@ func (hm *HysteriaManagerImpl) IsHysteria2Installed() bool {
 	return err == nil
 }
 
-// GenerateConfig generates Hysteria2 configuration based on template
+// GenerateConfig generates the Hysteria2 server config in YAML. A template, in YAML or JSON,
+// must use the server's own schema; the agent's options are applied on top of it.
 func (hm *HysteriaManagerImpl) GenerateConfig(configTemplate string) (string, error) {
 	hm.logger.Info("Generating Hysteria2 configuration")
 
-	var hysteriaConfig map[string]interface{}
+	var serverConfig *hysteriaconfig.ServerConfig
 
 	if configTemplate != "" {
 		// Parse custom config template
-		err := json.Unmarshal([]byte(configTemplate), &hysteriaConfig)
+		parsed, err := hysteriaconfig.Parse([]byte(configTemplate))
 		if err != nil {
 			return "", fmt.Errorf("invalid config template: %w", err)
 		}
+		serverConfig = parsed
+		// Templates without certificates use the node's
+		if serverConfig.TLS == nil && serverConfig.ACME == nil {
+			hm.setCertificates(serverConfig)
+		}
 	} else {
 		// Generate default config
-		hysteriaConfig = hm.generateDefaultConfig()
+		serverConfig = hm.generateDefaultConfig()
 	}
 
 	// Apply configuration options
-	hm.applyConfigOptions(hysteriaConfig)
-
-	// Convert to JSON
-	configJSON, err := json.MarshalIndent(hysteriaConfig, "", "  ")
-	if err != nil {
-		return "", fmt.Errorf("failed to marshal config: %w", err)
-	}
+	hm.applyConfigOptions(serverConfig)
 
-	return string(configJSON), nil
+	return hm.marshalConfig(serverConfig)
 }
 
-func (hm *HysteriaManagerImpl) generateDefaultConfig() map[string]interface{} {
-	config := map[string]interface{}{
-		"listen": fmt.Sprintf(":%d", hm.config.Hysteria2.DefaultListenPort),
-		"tls": map[string]interface{}{
-			"cert": "/etc/hysteria/cert.pem",
-			"key":  "/etc/hysteria/key.pem",
+func (hm *HysteriaManagerImpl) generateDefaultConfig() *hysteriaconfig.ServerConfig {
+	serverConfig := &hysteriaconfig.ServerConfig{
+		Listen: hm.listenAddress(),
+		Auth: &hysteriaconfig.Auth{
+			Type:     hm.config.Hysteria2.AuthType,
+			Password: hm.config.Hysteria2.AuthPassword,
 		},
-		"auth": map[string]interface{}{
-			"type":     hm.config.Hysteria2.AuthType,
-			"password": hm.config.Hysteria2.AuthPassword,
-		},
-		"bandwidth": map[string]interface{}{
-			"up":   fmt.Sprintf("%d mbps", hm.config.Hysteria2.UpMbps),
-			"down": fmt.Sprintf("%d mbps", hm.config.Hysteria2.DownMbps),
+		Bandwidth: &hysteriaconfig.Bandwidth{
+			Up:   fmt.Sprintf("%d mbps", hm.config.Hysteria2.UpMbps),
+			Down: fmt.Sprintf("%d mbps", hm.config.Hysteria2.DownMbps),
 		},
 	}
+	hm.setCertificates(serverConfig)
 
 	// Configure based on WARP settings
 	if hm.config.Hysteria2.WARPEnabled {
@@ -171,24 +259,20 @@ func (hm *HysteriaManagerImpl) generateDefaultConfig() map[string]interface{} {
 			warpPort = 1080 // default
 		}
 
-		// Create WARP outbound configuration
-		outboundConfig := map[string]interface{}{
-			"name": "warp-proxy",
-			"type": "socks5",
-			"addr": fmt.Sprintf("127.0.0.1:%d", warpPort),
-		}
-
-		// Add additional WARP-specific settings
-		if hm.config.Hysteria2.WARPOrganization != "" {
-			outboundConfig["organization"] = hm.config.Hysteria2.WARPOrganization
+		// The first outbound is the default one, so all traffic goes through WARP; the named
+		// direct outbound serves the ACL's direct rules
+		serverConfig.Outbounds = []hysteriaconfig.Outbound{
+			{
+				Name:   hysteriaWARPOutbound,
+				Type:   hysteriaconfig.OutboundSOCKS5,
+				SOCKS5: &hysteriaconfig.SOCKS5Outbound{Addr: fmt.Sprintf("127.0.0.1:%d", warpPort)},
+			},
+			{Name: hysteriaDirectOutbound, Type: hysteriaconfig.OutboundDirect},
 		}
 
-		// Configure traffic routing rules for WARP
-		config["outbound"] = outboundConfig
-
-		// Configure ACL rules for traffic through WARP
-		config["acl"] = map[string]interface{}{
-			"file": "/etc/hysteria/acl.yaml",
+		// The traffic router's ACL keeps local ranges and the WARP bypass off WARP
+		if _, err := os.Stat(warpACLPath); err == nil {
+			serverConfig.ACL = &hysteriaconfig.ACL{File: warpACLPath}
 		}
 
 		// WARP mode uses custom routing instead of traditional masquerade
@@ -196,149 +280,192 @@ func (hm *HysteriaManagerImpl) generateDefaultConfig() map[string]interface{} {
 		hm.logger.Info("WARP outbound proxy configured - all traffic will route through WARP")
 	} else if !hm.config.Hysteria2.SalamanderEnabled {
 		// Fallback to traditional masquerade
-		config["masquerade"] = map[string]interface{}{
-			"type": "proxy",
-			"proxy": map[string]interface{}{
-				"url":         "https://www.google.com",
-				"rewriteHost": true,
-			},
-		}
-		hm.logger.Info("Traditional masquerade configured")
+		serverConfig.Masquerade = hm.buildMasqueradeConfig()
+		hm.logger.Infof("Traditional masquerade configured (%s mode)", hm.masqueradeType())
 	}
 
-	return config
+	return serverConfig
 }
 
-func (hm *HysteriaManagerImpl) applyConfigOptions(config map[string]interface{}) {
+func (hm *HysteriaManagerImpl) applyConfigOptions(serverConfig *hysteriaconfig.ServerConfig) {
 	// Apply WARP configuration first (highest priority)
 	if hm.config.Hysteria2.WARPEnabled {
 		// Remove masquerade when WARP is enabled
-		delete(config, "masquerade")
+		serverConfig.Masquerade = nil
 		// WARP is mutually exclusive with Salamander obfuscation
 		if hm.config.Hysteria2.SalamanderEnabled {
 			hm.logger.Warn("WARP and Salamander obfuscation are mutually exclusive. WARP takes priority.")
 			hm.config.Hysteria2.SalamanderEnabled = false
-			delete(config, "obfs")
+			serverConfig.Obfs = nil
 		}
 		hm.logger.Info("WARP enabled - traditional masquerade and obfuscation disabled")
 	} else {
 		// Apply Salamander obfuscation (mutually exclusive with masquerade)
 		if hm.config.Hysteria2.SalamanderEnabled {
-			config["obfs"] = map[string]interface{}{
-				"type":     "salamander",
-				"password": hm.config.Hysteria2.SalamanderPassword,
+			serverConfig.Obfs = &hysteriaconfig.Obfs{
+				Type:       hysteriaconfig.ObfsSalamander,
+				Salamander: &hysteriaconfig.Salamander{Password: hm.config.Hysteria2.SalamanderPassword},
 			}
 			// Remove masquerade if obfs is enabled
-			delete(config, "masquerade")
+			serverConfig.Masquerade = nil
 			hm.logger.Info("Obfuscation enabled - masquerade disabled for compatibility")
 		} else {
 			// Apply default masquerade only if obfs is not enabled and WARP is not enabled
-			if _, exists := config["masquerade"]; !exists {
-				config["masquerade"] = map[string]interface{}{
-					"type": "proxy",
-					"proxy": map[string]interface{}{
-						"url":         "https://www.google.com",
-						"rewriteHost": true,
-					},
-				}
-				hm.logger.Info("Masquerade configured - obfuscation and WARP disabled")
+			if serverConfig.Masquerade == nil {
+				serverConfig.Masquerade = hm.buildMasqueradeConfig()
+				hm.logger.Infof("Masquerade configured (%s mode) - obfuscation and WARP disabled", hm.masqueradeType())
 			}
 		}
 	}
 
-	// Apply Port Hopping
-	if hm.config.Hysteria2.PortHopping {
-		config["hopping"] = map[string]interface{}{
-			"interval": hm.config.Hysteria2.HopInterval,
-			"start":    hm.config.Hysteria2.HopStartPort,
-			"end":      hm.config.Hysteria2.HopEndPort,
+	// Resolve client destinations through the local DoH resolver
+	if hm.config.DNS.Enabled {
+		serverConfig.Resolver = hysteriaResolverConfig(hm.config)
+	}
+
+	// Block and allow the domains of the assigned content filter lists, send those of the
+	// assigned routing profiles to their outbounds and the rest where the outbound policy says
+	routing, err := loadHysteriaRouting(hm.config)
+	if err != nil {
+		hm.logger.Errorf("Failed to load routing profiles: %v", err)
+	}
+	if policy, err := loadOutboundPolicy(hm.config); err != nil {
+		hm.logger.Errorf("Failed to load outbound policy: %v", err)
+	} else if policy != nil {
+		if compiled, err := compileOutboundPolicy(policy, hm.config.Hysteria2); err != nil {
+			hm.logger.Errorf("Outbound policy not applied: %v", err)
+		} else {
+			routing = mergeOutboundPolicy(routing, compiled)
 		}
 	}
+	if acl, err := hysteriaACLConfig(hm.config.Filter.HysteriaACLPath, routing); err != nil {
+		hm.logger.Errorf("Failed to read content filter ACL: %v", err)
+	} else if acl != nil {
+		serverConfig.ACL = acl
+	}
+	if routing != nil && len(routing.Outbounds) > 0 {
+		serverConfig.Outbounds = routing.Outbounds
+	}
+
+	// Send what would go through WARP to the backup egress while WARP is failed over
+	if state, err := loadWARPFailover(hm.config); err != nil {
+		hm.logger.Errorf("Failed to read WARP failover state: %v", err)
+	} else if state.Active {
+		if err := applyWARPFailover(serverConfig, hm.config); err != nil {
+			hm.logger.Errorf("WARP failover not applied: %v", err)
+		}
+	}
+
+	// Expose the online clients to the session tracker
+	if hm.config.Sessions.Enabled {
+		serverConfig.TrafficStats = &hysteriaconfig.TrafficStats{
+			Listen: hm.config.Sessions.TrafficStatsListen,
+			Secret: hm.config.Sessions.TrafficStatsSecret,
+		}
+	}
+
+	// Port hopping is not a server setting: clients hop across the range the firewall
+	// opens, and the range is redirected to the listen port outside of Hysteria2
+}
+
+// marshalConfig checks a server config and writes it as YAML
+func (hm *HysteriaManagerImpl) marshalConfig(serverConfig *hysteriaconfig.ServerConfig) (string, error) {
+	if err := hm.validateConfig(serverConfig); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrConfigInvalid, err)
+	}
+	data, err := serverConfig.Marshal()
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal config: %w", err)
+	}
+	return string(data), nil
+}
+
+// SaveConfig writes a server config, sealing its secrets when generated configs are
+// encrypted. When Hysteria2 is installed the config is first loaded by the binary itself
+// on a loopback port, so a config the server would refuse is never saved.
+func (hm *HysteriaManagerImpl) SaveConfig(configPath, content string) error {
+	serverConfig, err := hysteriaconfig.Parse([]byte(content))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrConfigInvalid, err)
+	}
+	if err := serverConfig.Validate(); err != nil {
+		return fmt.Errorf("%w: %v", ErrConfigInvalid, err)
+	}
+	if binary, err := exec.LookPath("hysteria"); err == nil {
+		if err := hysteriaconfig.Check(context.Background(), binary, serverConfig, configDryRunDuration); err != nil {
+			return fmt.Errorf("%w: hysteria rejected the config: %v", ErrConfigInvalid, err)
+		}
+	}
+	return writeGeneratedConfig(hm.config, configPath, []byte(content))
 }
 
 // StartHysteria2 starts the Hysteria2 service
 func (hm *HysteriaManagerImpl) StartHysteria2(configPath string) error {
 	hm.logger.Infof("Starting Hysteria2 with config: %s", configPath)
 
+	configPath, err := runtimeConfigPath(hm.config, configPath)
+	if err != nil {
+		return fmt.Errorf("failed to prepare config: %w", err)
+	}
+
 	if hm.config.Hysteria2.EnableSystemd {
-		return hm.startWithSystemd(configPath)
+		if err := hm.startAsService(configPath); err != nil {
+			return err
+		}
+		hm.setRunningDigest(configDigest(configPath))
+		return nil
 	}
 
 	// Start directly
 	cmd := exec.Command("hysteria", "server", "-c", configPath)
-	err := cmd.Start()
-	if err != nil {
+	// In its own session the server outlives the agent and keeps serving clients while it restarts
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
 		return fmt.Errorf("failed to start Hysteria2: %w", err)
 	}
+	hm.setRunningDigest(configDigest(configPath))
 
 	hm.logger.Info("Hysteria2 started successfully")
 	return nil
 }
 
-func (hm *HysteriaManagerImpl) startWithSystemd(configPath string) error {
-	// Create systemd service file
-	serviceContent := fmt.Sprintf(`[Unit]
-Description=Hysteria2 VPN Server
-After=network.target
-
-[Service]
-Type=simple
-User=root
-ExecStart=/usr/local/bin/hysteria server -c %s
-Restart=always
-RestartSec=5
-
-[Install]
-WantedBy=multi-user.target
-`, configPath)
-
-	err := hm.runCommand("echo", serviceContent, "|", "tee", "/etc/systemd/system/hysteria2.service")
-	if err != nil {
-		return fmt.Errorf("failed to create systemd service: %w", err)
-	}
-
-	// Reload systemd and start service
-	if err := hm.runCommand("systemctl", "daemon-reload"); err != nil {
-		return fmt.Errorf("failed to reload systemd: %w", err)
+// startAsService installs Hysteria2 as a service of the host's init system and starts it
+func (hm *HysteriaManagerImpl) startAsService(configPath string) error {
+	host := DetectHostOS(hm.config)
+	if err := host.InstallService(hysteria2ServiceName, configPath); err != nil {
+		return fmt.Errorf("failed to install hysteria2 service: %w", err)
 	}
 
-	if err := hm.runCommand("systemctl", "enable", "hysteria2"); err != nil {
-		return fmt.Errorf("failed to enable hysteria2 service: %w", err)
-	}
-
-	if err := hm.runCommand("systemctl", "start", "hysteria2"); err != nil {
+	if err := host.StartService(hysteria2ServiceName); err != nil {
 		return fmt.Errorf("failed to start hysteria2 service: %w", err)
 	}
 
-	hm.logger.Info("Hysteria2 started with systemd")
+	hm.logger.Infof("Hysteria2 started with %s", host.Init)
 	return nil
 }
 
 // StopHysteria2 stops the Hysteria2 service
 func (hm *HysteriaManagerImpl) StopHysteria2() error {
 	hm.logger.Info("Stopping Hysteria2")
+	hm.setRunningDigest("")
 
 	if hm.config.Hysteria2.EnableSystemd {
-		return hm.runCommand("systemctl", "stop", "hysteria2")
+		return DetectHostOS(hm.config).StopService(hysteria2ServiceName)
 	}
 
 	// Kill process directly (not ideal, but for demo)
 	return hm.runCommand("pkill", "-f", "hysteria")
 }
 
-// RestartHysteria2 restarts the Hysteria2 service
-func (hm *HysteriaManagerImpl) RestartHysteria2(configPath string) error {
-	hm.logger.Info("Restarting Hysteria2")
-
-	if hm.config.Hysteria2.EnableSystemd {
-		return hm.runCommand("systemctl", "restart", "hysteria2")
-	}
-
-	if err := hm.StopHysteria2(); err != nil {
-		hm.logger.Warnf("Failed to stop Hysteria2: %v", err)
-	}
+// ConfigPath returns the server config file Hysteria2 runs from
+func (hm *HysteriaManagerImpl) ConfigPath() string {
+	return hysteria2ConfigPath
+}
 
-	return hm.StartHysteria2(configPath)
+// CurrentConfig returns the saved server config with its secrets decrypted, or an empty
+// string when Hysteria2 has not been configured yet
+func (hm *HysteriaManagerImpl) CurrentConfig() (string, error) {
+	return readCurrentConfig(hm.config, hysteria2ConfigPath)
 }
 
 // GetHysteria2Status returns Hysteria2 service status
@@ -350,18 +477,18 @@ func (hm *HysteriaManagerImpl) GetHysteria2Status() (map[string]interface{}, err
 	}
 
 	if hm.config.Hysteria2.EnableSystemd {
-		// Check systemd status
-		cmd := exec.Command("systemctl", "is-active", "hysteria2")
-		output, err := cmd.Output()
-		if err == nil && strings.TrimSpace(string(output)) == "active" {
-			status["running"] = true
-		}
+		host := DetectHostOS(hm.config)
+		status["init"] = host.Init
+		status["running"] = host.ServiceActive(hysteria2ServiceName)
 	} else {
 		// Check if process is running
 		cmd := exec.Command("pgrep", "-f", "hysteria")
 		err := cmd.Run()
 		status["running"] = err == nil
 	}
+	if deadline := hm.draining(); !deadline.IsZero() {
+		status["draining_until"] = deadline.Unix()
+	}
 
 	return status, nil
 }
@@ -411,11 +538,102 @@ func (hm *HysteriaManagerImpl) DisableSalamander() error {
 	return nil
 }
 
+// ConfigureMasquerade validates and applies the masquerade mode used when a
+// client fails Hysteria2 authentication. Changes take effect on the next config generation.
+func (hm *HysteriaManagerImpl) ConfigureMasquerade(settings MasqueradeSettings) error {
+	hm.logger.Infof("Configuring masquerade: type=%s", settings.Type)
+
+	if err := settings.Validate(); err != nil {
+		return fmt.Errorf("invalid masquerade settings: %w", err)
+	}
+
+	if settings.Type == MasqueradeTypeFile {
+		info, err := os.Stat(settings.FileDir)
+		if err != nil {
+			return fmt.Errorf("masquerade directory is not accessible: %w", err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("masquerade path %s is not a directory", settings.FileDir)
+		}
+	}
+
+	hm.config.Hysteria2.MasqueradeType = settings.Type
+	hm.config.Hysteria2.MasqueradeProxyURL = settings.ProxyURL
+	hm.config.Hysteria2.MasqueradeRewriteHost = settings.RewriteHost
+	hm.config.Hysteria2.MasqueradeFileDir = settings.FileDir
+	hm.config.Hysteria2.MasqueradeStringContent = settings.StringContent
+	hm.config.Hysteria2.MasqueradeStringStatus = settings.StringStatus
+	hm.config.Hysteria2.MasqueradeStringHeaders = settings.StringHeaders
+
+	if hm.config.Hysteria2.SalamanderEnabled || hm.config.Hysteria2.WARPEnabled {
+		hm.logger.Warn("Masquerade settings saved but inactive while Salamander or WARP is enabled")
+	}
+
+	hm.logger.Infof("Masquerade configured successfully (%s mode)", settings.Type)
+	return nil
+}
+
+// GetMasqueradeStatus returns the effective masquerade configuration
+func (hm *HysteriaManagerImpl) GetMasqueradeStatus() map[string]interface{} {
+	return map[string]interface{}{
+		"type":   hm.masqueradeType(),
+		"active": !hm.config.Hysteria2.SalamanderEnabled && !hm.config.Hysteria2.WARPEnabled,
+		"config": hm.buildMasqueradeConfig(),
+	}
+}
+
+// masqueradeType returns the configured masquerade type, falling back to proxy mode
+func (hm *HysteriaManagerImpl) masqueradeType() string {
+	switch hm.config.Hysteria2.MasqueradeType {
+	case MasqueradeTypeString, MasqueradeTypeFile, MasqueradeTypeProxy:
+		return hm.config.Hysteria2.MasqueradeType
+	default:
+		return MasqueradeTypeProxy
+	}
+}
+
+// buildMasqueradeConfig builds the Hysteria2 masquerade section for the configured mode
+func (hm *HysteriaManagerImpl) buildMasqueradeConfig() *hysteriaconfig.Masquerade {
+	cfg := hm.config.Hysteria2
+
+	switch hm.masqueradeType() {
+	case MasqueradeTypeString:
+		status := cfg.MasqueradeStringStatus
+		if status == 0 {
+			status = 200
+		}
+		return &hysteriaconfig.Masquerade{
+			Type: hysteriaconfig.MasqueradeString,
+			String: &hysteriaconfig.MasqueradeBody{
+				Content:    cfg.MasqueradeStringContent,
+				Headers:    cfg.MasqueradeStringHeaders,
+				StatusCode: status,
+			},
+		}
+	case MasqueradeTypeFile:
+		return &hysteriaconfig.Masquerade{
+			Type: hysteriaconfig.MasqueradeFile,
+			File: &hysteriaconfig.MasqueradeFileDir{Dir: cfg.MasqueradeFileDir},
+		}
+	default:
+		proxyURL := cfg.MasqueradeProxyURL
+		if proxyURL == "" {
+			proxyURL = defaultMasqueradeProxyURL
+		}
+		return &hysteriaconfig.Masquerade{
+			Type: hysteriaconfig.MasqueradeProxy,
+			Proxy: &hysteriaconfig.MasqueradeProxyTo{
+				URL:         proxyURL,
+				RewriteHost: cfg.MasqueradeRewriteHost,
+			},
+		}
+	}
+}
+
 // runCommand executes a system command
 func (hm *HysteriaManagerImpl) runCommand(name string, args ...string) error {
-	cmd := exec.Command(name, args...)
-	hm.logger.Debugf("Running command: %s %v", name, args)
-	return cmd.Run()
+	_, err := hm.runner.Run(name, args...)
+	return err
 }
 
 // SNI-related methods implementation
@@ -424,6 +642,19 @@ func (hm *HysteriaManagerImpl) runCommand(name string, args ...string) error {
 func (hm *HysteriaManagerImpl) ConfigureSNI(domains []string, defaultSNI string) error {
 	hm.logger.Infof("Configuring SNI for domains: %v", domains)
 
+	domains, err := NormalizeSNIDomains(domains)
+	if err != nil {
+		return err
+	}
+	if defaultSNI != "" {
+		if defaultSNI, err = NormalizeSNIDomain(defaultSNI); err != nil {
+			return err
+		}
+		if !containsString(domains, defaultSNI) {
+			return fmt.Errorf("%w: default SNI %s is not one of the domains", ErrInvalidDomain, defaultSNI)
+		}
+	}
+
 	// Update configuration
 	hm.config.Hysteria2.SNIEnabled = true
 	hm.config.Hysteria2.SNIDomains = domains
@@ -472,45 +703,38 @@ func (hm *HysteriaManagerImpl) GenerateCertificatesForDomains(domains []string)
 	return nil
 }
 
-// UpdateServerConfigWithSNI generates Hysteria2 config with SNI support
+// UpdateServerConfigWithSNI generates Hysteria2 config with SNI support. Hysteria2 serves a
+// single certificate, so the default SNI domain's certificate is used and must also cover
+// the other domains; the server rejects handshakes for names it does not list.
 func (hm *HysteriaManagerImpl) UpdateServerConfigWithSNI() (string, error) {
 	hm.logger.Info("Generating Hysteria2 configuration with SNI support")
 
-	var hysteriaConfig map[string]interface{}
-
 	// Generate base config
-	hysteriaConfig = hm.generateDefaultConfig()
+	serverConfig := hm.generateDefaultConfig()
 
 	// Apply configuration options
-	hm.applyConfigOptions(hysteriaConfig)
+	hm.applyConfigOptions(serverConfig)
 
-	// Apply SNI configuration
-	if hm.config.Hysteria2.SNIEnabled {
-		sniConfig := hm.buildSNIConfig()
-		if len(sniConfig) > 0 {
-			hysteriaConfig["sni"] = sniConfig
+	// Apply SNI configuration; in ACME mode the server obtains a certificate for the SNI
+	// domains itself
+	if hm.config.Hysteria2.SNIEnabled && hm.certificateMode() != CertificateModeACME {
+		if tls := hm.buildSNIConfig(); tls != nil {
+			serverConfig.TLS = tls
 		}
 	}
 
-	// Validate mutual exclusivity
-	if err := hm.validateConfig(hysteriaConfig); err != nil {
-		return "", fmt.Errorf("configuration validation failed: %w", err)
-	}
+	return hm.marshalConfig(serverConfig)
+}
 
-	// Convert to JSON
-	configJSON, err := json.MarshalIndent(hysteriaConfig, "", "  ")
-	if err != nil {
-		return "", fmt.Errorf("failed to marshal config: %w", err)
+// validateConfig checks the schema and for configuration conflicts
+func (hm *HysteriaManagerImpl) validateConfig(serverConfig *hysteriaconfig.ServerConfig) error {
+	if err := serverConfig.Validate(); err != nil {
+		return err
 	}
 
-	return string(configJSON), nil
-}
-
-// validateConfig checks for configuration conflicts and invalid combinations
-func (hm *HysteriaManagerImpl) validateConfig(config map[string]interface{}) error {
 	// Check for obfs and masquerade conflict
-	_, hasObfs := config["obfs"]
-	_, hasMasquerade := config["masquerade"]
+	hasObfs := serverConfig.Obfs != nil
+	hasMasquerade := serverConfig.Masquerade != nil
 
 	if hasObfs && hasMasquerade {
 		return fmt.Errorf("obfuscation and masquerade cannot be enabled simultaneously")
@@ -528,31 +752,31 @@ func (hm *HysteriaManagerImpl) validateConfig(config map[string]interface{}) err
 	return nil
 }
 
-// buildSNIConfig creates SNI configuration structure
-func (hm *HysteriaManagerImpl) buildSNIConfig() map[string]interface{} {
-	sniConfig := map[string]interface{}{
-		"enabled": true,
-		"domains": make([]map[string]interface{}, 0),
-	}
-
-	for _, domain := range hm.config.Hysteria2.SNIDomains {
-		if domain == "" {
-			continue
-		}
-
-		domainConfig := map[string]interface{}{
-			"domain": domain,
-			"cert":   fmt.Sprintf("/etc/hysteria/sni/%s.crt", domain),
-			"key":    fmt.Sprintf("/etc/hysteria/sni/%s.key", domain),
+// buildSNIConfig creates the tls section serving the default SNI domain's certificate, nil
+// when there is no domain
+func (hm *HysteriaManagerImpl) buildSNIConfig() *hysteriaconfig.TLS {
+	domain := hm.config.Hysteria2.DefaultSNI
+	if domain == "" {
+		for _, candidate := range hm.config.Hysteria2.SNIDomains {
+			if candidate != "" {
+				domain = candidate
+				break
+			}
 		}
-		sniConfig["domains"] = append(sniConfig["domains"].([]map[string]interface{}), domainConfig)
 	}
-
-	if hm.config.Hysteria2.DefaultSNI != "" {
-		sniConfig["default"] = hm.config.Hysteria2.DefaultSNI
+	if domain == "" {
+		return nil
 	}
 
-	return sniConfig
+	certDir := hm.config.Hysteria2.SNICertPath
+	if certDir == "" {
+		certDir = "/etc/hysteria/sni"
+	}
+	return &hysteriaconfig.TLS{
+		Cert:     filepath.Join(certDir, domain+".crt"),
+		Key:      filepath.Join(certDir, domain+".key"),
+		SNIGuard: "dns-san",
+	}
 }
 
 // GetSNIStatus returns current SNI configuration status
@@ -564,6 +788,7 @@ func (hm *HysteriaManagerImpl) GetSNIStatus() (map[string]interface{}, error) {
 		"auto_mode":   hm.config.Hysteria2.SNIAutoMode,
 		"auto_renew":  hm.config.Hysteria2.SNIAutoRenew,
 		"cert_dir":    hm.config.Hysteria2.SNICertPath,
+		"cert_mode":   hm.certificateMode(),
 	}
 
 	// Get certificate information if SNI is enabled
@@ -604,14 +829,15 @@ func (hm *HysteriaManagerImpl) DisableSNI() error {
 
 // AddSNIDomain adds a new domain to SNI configuration
 func (hm *HysteriaManagerImpl) AddSNIDomain(domain string) error {
-	if domain == "" {
-		return fmt.Errorf("domain cannot be empty")
+	domain, err := NormalizeSNIDomain(domain)
+	if err != nil {
+		return err
 	}
 
-	// Check if domain already exists
+	// Check if domain already exists, comparing configured domains in normalized form
 	for _, existingDomain := range hm.config.Hysteria2.SNIDomains {
-		if existingDomain == domain {
-			return fmt.Errorf("domain %s already exists in SNI configuration", domain)
+		if existing, err := NormalizeSNIDomain(existingDomain); err == nil && existing == domain {
+			return fmt.Errorf("%w: domain %s already exists in SNI configuration", ErrDomainConflict, domain)
 		}
 	}
 
@@ -664,6 +890,188 @@ func (hm *HysteriaManagerImpl) RemoveSNIDomain(domain string) error {
 	return fmt.Errorf("domain %s not found in SNI configuration", domain)
 }
 
+// ConfigureCertificateMode selects whether Hysteria2 serves the certificates the agent
+// manages or obtains its own through ACME. Switching to ACME removes the certbot renewal
+// job, as the server renews its certificate itself. Changes take effect on the next config
+// generation.
+func (hm *HysteriaManagerImpl) ConfigureCertificateMode(settings CertificateModeSettings) error {
+	hm.logger.Infof("Configuring certificate mode: %s", settings.Mode)
+
+	domains, err := NormalizeSNIDomains(settings.Domains)
+	if err != nil {
+		return err
+	}
+	settings.Domains = domains
+	if err := settings.Validate(); err != nil {
+		return fmt.Errorf("invalid certificate mode: %w", err)
+	}
+
+	if settings.Mode == CertificateModeACME {
+		if len(settings.Domains) == 0 && len(hm.config.Hysteria2.SNIDomains) == 0 {
+			return fmt.Errorf("ACME needs domains when the node has no SNI domains")
+		}
+		if err := os.MkdirAll(hm.acmeDir(), 0700); err != nil {
+			return fmt.Errorf("failed to create ACME directory: %w", err)
+		}
+	}
+
+	hm.config.Hysteria2.CertMode = settings.Mode
+	hm.config.Hysteria2.ACMEDomains = settings.Domains
+	hm.config.Hysteria2.ACMEEmail = settings.Email
+	hm.config.Hysteria2.ACMECA = settings.CA
+	hm.config.Hysteria2.ACMEChallenge = settings.Challenge
+	hm.config.Hysteria2.ACMEListenHost = settings.ListenHost
+	hm.config.Hysteria2.ACMEAltPort = settings.AltPort
+	hm.config.Hysteria2.ACMEDNSProvider = settings.DNSProvider
+	hm.config.Hysteria2.ACMEDNSConfig = settings.DNSConfig
+
+	if settings.Mode == CertificateModeACME {
+		if err := hm.DisableAutoRenewal(); err != nil {
+			hm.logger.Warnf("Failed to remove certbot renewal job: %v", err)
+		}
+	}
+
+	hm.logger.Infof("Certificate mode configured successfully (%s)", settings.Mode)
+	return nil
+}
+
+// GetACMEStatus returns the ACME settings and the certificates Hysteria2 has obtained
+func (hm *HysteriaManagerImpl) GetACMEStatus() (*ACMEStatus, error) {
+	status := &ACMEStatus{
+		Settings: CertificateModeSettings{
+			Mode:        hm.certificateMode(),
+			Domains:     hm.config.Hysteria2.ACMEDomains,
+			Email:       hm.config.Hysteria2.ACMEEmail,
+			CA:          hm.config.Hysteria2.ACMECA,
+			Challenge:   hm.config.Hysteria2.ACMEChallenge,
+			ListenHost:  hm.config.Hysteria2.ACMEListenHost,
+			AltPort:     hm.config.Hysteria2.ACMEAltPort,
+			DNSProvider: hm.config.Hysteria2.ACMEDNSProvider,
+		},
+		Dir: hm.acmeDir(),
+	}
+	if status.Settings.Mode != CertificateModeACME {
+		return status, nil
+	}
+
+	certificates, err := hysteriaconfig.ACMECertificates(status.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ACME certificates: %w", err)
+	}
+	status.Certificates = certificates
+	for _, domain := range hm.acmeDomains() {
+		if !slices.ContainsFunc(certificates, func(cert hysteriaconfig.ACMECertificate) bool { return cert.Domain == domain }) {
+			status.Pending = append(status.Pending, domain)
+		}
+	}
+	return status, nil
+}
+
+// ListCertificates returns the certificate files the agent manages followed by the ones
+// Hysteria2 obtained through ACME
+func (hm *HysteriaManagerImpl) ListCertificates() ([]CertificateInfo, error) {
+	certificates, err := hm.certificateManager.ListCertificates()
+	if err != nil {
+		return nil, err
+	}
+	for i := range certificates {
+		certificates[i].Source = CertificateModeFiles
+	}
+
+	acmeCertificates, err := hysteriaconfig.ACMECertificates(hm.acmeDir())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ACME certificates: %w", err)
+	}
+	for _, cert := range acmeCertificates {
+		certificates = append(certificates, CertificateInfo{
+			Domain:    cert.Domain,
+			CertPath:  cert.Path,
+			NotBefore: cert.NotBefore,
+			NotAfter:  cert.NotAfter,
+			Issuer:    cert.Issuer,
+			Source:    CertificateModeACME,
+		})
+	}
+	return certificates, nil
+}
+
+// certificateMode returns the configured certificate mode, falling back to files
+func (hm *HysteriaManagerImpl) certificateMode() string {
+	if hm.config.Hysteria2.CertMode == CertificateModeACME {
+		return CertificateModeACME
+	}
+	return CertificateModeFiles
+}
+
+// setCertificates points the server at the node's certificate files, or at the acme block
+// in ACME mode
+func (hm *HysteriaManagerImpl) setCertificates(serverConfig *hysteriaconfig.ServerConfig) {
+	if hm.certificateMode() == CertificateModeACME {
+		serverConfig.TLS = nil
+		serverConfig.ACME = hm.buildACMEConfig()
+		return
+	}
+	serverConfig.ACME = nil
+	serverConfig.TLS = &hysteriaconfig.TLS{Cert: hysteria2CertPath, Key: hysteria2KeyPath}
+}
+
+// buildACMEConfig creates the acme section from the agent configuration
+func (hm *HysteriaManagerImpl) buildACMEConfig() *hysteriaconfig.ACME {
+	cfg := hm.config.Hysteria2
+	email := cfg.ACMEEmail
+	if email == "" {
+		email = cfg.SNIEmail
+	}
+	challenge := cfg.ACMEChallenge
+	if challenge == "" {
+		challenge = hysteriaconfig.ACMEChallengeHTTP
+	}
+
+	acme := &hysteriaconfig.ACME{
+		Domains:    hm.acmeDomains(),
+		Email:      email,
+		CA:         cfg.ACMECA,
+		ListenHost: cfg.ACMEListenHost,
+		Dir:        hm.acmeDir(),
+		Type:       challenge,
+	}
+	switch challenge {
+	case hysteriaconfig.ACMEChallengeHTTP:
+		if cfg.ACMEAltPort > 0 {
+			acme.HTTP = &hysteriaconfig.ACMEAlt{AltPort: cfg.ACMEAltPort}
+		}
+	case hysteriaconfig.ACMEChallengeTLS:
+		if cfg.ACMEAltPort > 0 {
+			acme.TLS = &hysteriaconfig.ACMEAlt{AltPort: cfg.ACMEAltPort}
+		}
+	case hysteriaconfig.ACMEChallengeDNS:
+		acme.DNS = &hysteriaconfig.ACMEDNS{Name: cfg.ACMEDNSProvider, Config: cfg.ACMEDNSConfig}
+	}
+	return acme
+}
+
+// acmeDomains returns the domains Hysteria2 obtains a certificate for, the SNI domains
+// unless ACME domains are configured
+func (hm *HysteriaManagerImpl) acmeDomains() []string {
+	if len(hm.config.Hysteria2.ACMEDomains) > 0 {
+		return hm.config.Hysteria2.ACMEDomains
+	}
+	var domains []string
+	for _, domain := range hm.config.Hysteria2.SNIDomains {
+		if domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+func (hm *HysteriaManagerImpl) acmeDir() string {
+	if hm.config.Hysteria2.ACMEDir != "" {
+		return hm.config.Hysteria2.ACMEDir
+	}
+	return defaultACMEDir
+}
+
 // ===== LET'S ENCRYPT AUTOMATION METHODS =====
 
 // AutoConfigureSNICertificates automatically configures SNI with Let's Encrypt certificates
@@ -758,6 +1166,9 @@ func (hm *HysteriaManagerImpl) SetupInitialCertificates(domains []string, email
 	return hm.GenerateCertificatesForDomains(domains)
 }
 
+// certRenewalCronJob is the cron job renewing the Let's Encrypt certificates
+const certRenewalCronJob = "hysteria-cert-renewal"
+
 // EnableAutoRenewal sets up automatic certificate renewal
 func (hm *HysteriaManagerImpl) EnableAutoRenewal() error {
 	hm.logger.Info("Enabling automatic certificate renewal")
@@ -766,17 +1177,14 @@ func (hm *HysteriaManagerImpl) EnableAutoRenewal() error {
 		return fmt.Errorf("Let's Encrypt not available, cannot enable auto-renewal")
 	}
 
-	// Create cron job for renewal (simple approach using systemd timer)
-	cronJob := `# Auto-renew Let's Encrypt certificates
-0 3 * * * root /usr/local/bin/hysteria-agent renew-certificates >> /var/log/hysteria-renewal.log 2>&1`
-
-	cronPath := "/etc/cron.d/hysteria-cert-renewal"
-	if err := os.WriteFile(cronPath, []byte(cronJob), 0644); err != nil {
+	// Create cron job for renewal
+	host := DetectHostOS(hm.config)
+	if err := host.InstallCronJob(certRenewalCronJob); err != nil {
 		return fmt.Errorf("failed to create cron job: %w", err)
 	}
 
 	// Reload cron service
-	if err := hm.runCommand("systemctl", "reload", "cron"); err != nil {
+	if err := host.ReloadService(host.CronService()); err != nil {
 		hm.logger.Warnf("Failed to reload cron service: %v", err)
 	}
 
@@ -788,12 +1196,12 @@ func (hm *HysteriaManagerImpl) EnableAutoRenewal() error {
 func (hm *HysteriaManagerImpl) DisableAutoRenewal() error {
 	hm.logger.Info("Disabling automatic certificate renewal")
 
-	cronPath := "/etc/cron.d/hysteria-cert-renewal"
-	if err := os.Remove(cronPath); err != nil && !os.IsNotExist(err) {
+	host := DetectHostOS(hm.config)
+	if err := host.RemoveCronJob(certRenewalCronJob); err != nil {
 		return fmt.Errorf("failed to remove cron job: %w", err)
 	}
 
-	if err := hm.runCommand("systemctl", "reload", "cron"); err != nil {
+	if err := host.ReloadService(host.CronService()); err != nil {
 		hm.logger.Warnf("Failed to reload cron service: %v", err)
 	}
 
@@ -801,6 +1209,19 @@ func (hm *HysteriaManagerImpl) DisableAutoRenewal() error {
 	return nil
 }
 
+// RenewCertificates renews the Let's Encrypt certificates expiring within 30 days and
+// restarts Hysteria2 so it serves them. In ACME mode Hysteria2 renews its own certificate
+// and is not restarted.
+func (hm *HysteriaManagerImpl) RenewCertificates() error {
+	if err := hm.certificateManager.AutoRenewCertificates(); err != nil {
+		return fmt.Errorf("failed to renew certificates: %w", err)
+	}
+	if !hm.IsHysteria2Installed() || hm.certificateMode() == CertificateModeACME {
+		return nil
+	}
+	return hm.RestartHysteria2(hysteria2ConfigPath)
+}
+
 // ValidateAllDomains validates multiple domains
 func (hm *HysteriaManagerImpl) ValidateAllDomains(domains []string) error {
 	hm.logger.Infof("Validating %d domains", len(domains))
@@ -945,12 +1366,22 @@ func (hm *HysteriaManagerImpl) DisableAdvancedObfuscation() error {
 func (hm *HysteriaManagerImpl) EnableQUICObfuscation() error {
 	hm.logger.Info("Enabling QUIC obfuscation")
 
+	if hm.config.Hysteria2.QUICObfuscationKey == "" {
+		key := make([]byte, 24)
+		if _, err := rand.Read(key); err != nil {
+			return fmt.Errorf("failed to generate QUIC obfuscation key: %w", err)
+		}
+		hm.config.Hysteria2.QUICObfuscationKey = base64.RawURLEncoding.EncodeToString(key)
+		hm.logger.Info("Generated new QUIC obfuscation key - clients must be updated")
+	}
+
 	hm.config.Hysteria2.QUICObfuscationEnabled = true
 	hm.config.Hysteria2.QUICScrambleTransform = true
 	hm.config.Hysteria2.QUICPacketPadding = 1300
 	hm.config.Hysteria2.QUICTimingRandomization = true
 
-	hm.logger.Info("QUIC obfuscation enabled")
+	// The relay takes over the public port; Hysteria2 moves to loopback on the next config generation
+	hm.logger.Infof("QUIC obfuscation enabled - Hysteria2 will listen on %s behind the relay", hm.listenAddress())
 	return nil
 }
 
@@ -966,6 +1397,18 @@ func (hm *HysteriaManagerImpl) DisableQUICObfuscation() error {
 	return nil
 }
 
+// listenAddress returns the Hysteria2 listen address, moving it to loopback
+// when the QUIC obfuscation relay owns the public port
+func (hm *HysteriaManagerImpl) listenAddress() string {
+	if hm.config.Hysteria2.QUICObfuscationEnabled {
+		return fmt.Sprintf("127.0.0.1:%d", hm.config.Hysteria2.QUICRelayUpstreamPort)
+	}
+	if ipv6Enabled(hm.config) {
+		return fmt.Sprintf("[::]:%d", hm.config.Hysteria2.DefaultListenPort)
+	}
+	return fmt.Sprintf(":%d", hm.config.Hysteria2.DefaultListenPort)
+}
+
 // ConfigureQUICScrambleTransform configures QUIC scramble transform
 func (hm *HysteriaManagerImpl) ConfigureQUICScrambleTransform(enabled bool) error {
 	hm.logger.Infof("Configuring QUIC scramble transform: %v", enabled)
@@ -1049,15 +1492,86 @@ func (hm *HysteriaManagerImpl) DisableTrafficShaping() error {
 	return nil
 }
 
+// ApplyObfuscation sets every obfuscation knob from settings at once, turning off the ones
+// the settings leave off, and returns the settings with a generated Salamander password.
+// Changes take effect on the next config generation; the caller restarts the QUIC relay
+// and updates the Reality inbound.
+func (hm *HysteriaManagerImpl) ApplyObfuscation(settings ObfuscationSettings) (ObfuscationSettings, error) {
+	if err := settings.Validate(); err != nil {
+		return settings, err
+	}
+	hm.logger.Infof("Applying obfuscation preset %q", settings.Preset)
+
+	if settings.Salamander {
+		if settings.SalamanderPassword == "" {
+			password := make([]byte, 24)
+			if _, err := rand.Read(password); err != nil {
+				return settings, fmt.Errorf("failed to generate Salamander password: %w", err)
+			}
+			settings.SalamanderPassword = base64.RawURLEncoding.EncodeToString(password)
+		}
+		hm.EnableSalamander(settings.SalamanderPassword)
+	} else {
+		hm.DisableSalamander()
+	}
+
+	if settings.PortHopping {
+		interval := settings.HopInterval
+		if interval == 0 {
+			interval = 30
+		}
+		hm.EnablePortHopping(settings.HopStartPort, settings.HopEndPort, interval)
+		settings.HopInterval = interval
+	} else {
+		hm.DisablePortHopping()
+	}
+
+	if settings.QUICObfuscation {
+		if err := hm.EnableQUICObfuscation(); err != nil {
+			return settings, err
+		}
+		if settings.PacketPadding > 0 {
+			hm.config.Hysteria2.QUICPacketPadding = settings.PacketPadding
+		}
+		hm.config.Hysteria2.QUICTimingJitterMs = settings.TimingJitterMs
+		hm.config.Hysteria2.QUICTimingRandomization = settings.TimingJitterMs > 0
+	} else {
+		hm.DisableQUICObfuscation()
+	}
+
+	if len(settings.Fingerprints) > 0 {
+		hm.EnableTLSFingerprintRotation(settings.Fingerprints)
+	} else {
+		hm.DisableTLSFingerprintRotation()
+	}
+	if len(settings.RealityTargets) > 0 {
+		hm.EnableVLESSReality(settings.RealityTargets)
+	} else {
+		hm.DisableVLESSReality()
+	}
+	if settings.TrafficShaping {
+		hm.EnableTrafficShaping()
+	} else {
+		hm.DisableTrafficShaping()
+	}
+
+	hm.config.Hysteria2.ObfuscationPreset = settings.Preset
+	return settings, nil
+}
+
 // GetObfuscationStatus returns current obfuscation configuration status
 func (hm *HysteriaManagerImpl) GetObfuscationStatus() (map[string]interface{}, error) {
 	status := map[string]interface{}{
+		"preset":                       hm.config.Hysteria2.ObfuscationPreset,
 		"advanced_obfuscation_enabled": hm.config.Hysteria2.AdvancedObfuscationEnabled,
 		"quic_obfuscation": map[string]interface{}{
 			"enabled":              hm.config.Hysteria2.QUICObfuscationEnabled,
 			"scramble_transform":   hm.config.Hysteria2.QUICScrambleTransform,
 			"packet_padding":       hm.config.Hysteria2.QUICPacketPadding,
 			"timing_randomization": hm.config.Hysteria2.QUICTimingRandomization,
+			"timing_jitter_ms":     hm.config.Hysteria2.QUICTimingJitterMs,
+			"obfuscation_key":      hm.config.Hysteria2.QUICObfuscationKey,
+			"relay_upstream":       hm.listenAddress(),
 		},
 		"tls_fingerprint": map[string]interface{}{
 			"rotation_enabled": hm.config.Hysteria2.TLSFingerprintRotation,
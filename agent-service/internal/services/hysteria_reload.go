@@ -0,0 +1,315 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"hysteria2_microservices/agent-service/internal/config"
+)
+
+// Reload event types
+const (
+	ReloadEventDrainStarted = "hysteria2_drain_started" // new connections rejected until the restart
+	ReloadEventRestarted    = "hysteria2_restarted"     // drained server restarted, or failed to
+	ReloadEventUndrained    = "hysteria2_undrained"     // drained server admits new connections without a restart
+)
+
+const (
+	hysteria2DrainTable = "hysteria2_drain"
+	hysteria2DrainPoll  = 2 * time.Second
+)
+
+// ReloadEvent announces the window in which a draining Hysteria2 server rejects new
+// connections, and its end
+type ReloadEvent struct {
+	Type        string
+	Connections int           // client connections open, -1 when they could not be counted
+	Deadline    time.Time     // restart at the latest, for ReloadEventDrainStarted
+	Drained     time.Duration // time spent draining, for ReloadEventRestarted and ReloadEventUndrained
+	Error       string        // restart failure, for ReloadEventRestarted
+}
+
+// ReloadReporter is called when a drain starts and when the drained server restarted
+type ReloadReporter func(event ReloadEvent)
+
+// SetReloadReporter sets where drain windows are announced
+func (hm *HysteriaManagerImpl) SetReloadReporter(reporter ReloadReporter) {
+	hm.stateMu.Lock()
+	defer hm.stateMu.Unlock()
+	hm.reporter = reporter
+}
+
+// RestartHysteria2 restarts the Hysteria2 service on configPath, draining it first
+func (hm *HysteriaManagerImpl) RestartHysteria2(configPath string) error {
+	return hm.restart(configPath, true, true)
+}
+
+// ForceRestartHysteria2 restarts the Hysteria2 service on configPath without draining it.
+// A drain in progress is cut short, so the restart waiting on it goes ahead at once.
+func (hm *HysteriaManagerImpl) ForceRestartHysteria2(configPath string) error {
+	hm.stateMu.Lock()
+	hm.forced++
+	if hm.drainCut != nil {
+		close(hm.drainCut)
+		hm.drainCut = nil
+	}
+	hm.stateMu.Unlock()
+
+	hm.restartMu.Lock()
+	defer hm.restartMu.Unlock()
+	hm.stateMu.Lock()
+	hm.forced--
+	hm.stateMu.Unlock()
+
+	return hm.restartLocked(configPath, true, false)
+}
+
+// ReloadHysteria2 has Hysteria2 serve configPath. The server cannot reload in place: it
+// ignores SIGHUP, and users are only picked up without a restart through http auth. So a
+// server already running this very config is left alone, and any other one is restarted
+// as RestartHysteria2 does.
+func (hm *HysteriaManagerImpl) ReloadHysteria2(configPath string) error {
+	return hm.restart(configPath, false, true)
+}
+
+// restart restarts Hysteria2 unless it runs configPath already and force is false. With
+// drain, clients of a running server are drained first: new connections are rejected until
+// the server restarted, giving clients hysteria2.drain_timeout seconds to move to other nodes.
+func (hm *HysteriaManagerImpl) restart(configPath string, force, drain bool) error {
+	hm.restartMu.Lock()
+	defer hm.restartMu.Unlock()
+	return hm.restartLocked(configPath, force, drain)
+}
+
+func (hm *HysteriaManagerImpl) restartLocked(configPath string, force, drain bool) error {
+	// Refresh the decrypted copy the service runs from before it rereads the config
+	runtimePath, err := runtimeConfigPath(hm.config, configPath)
+	if err != nil {
+		return fmt.Errorf("failed to prepare config: %w", err)
+	}
+	digest := configDigest(runtimePath)
+	running := hm.hysteria2Running()
+	if !force && running && digest != "" && digest == hm.runningDigest() {
+		hm.logger.Info("Hysteria2 already runs this config, not restarting")
+		return nil
+	}
+
+	var drained time.Duration
+	left := 0
+	if running && drain {
+		start := time.Now()
+		var closed bool
+		if left, closed = hm.drain(); closed {
+			drained = time.Since(start)
+			defer hm.undrain()
+		}
+	}
+
+	hm.logger.Info("Restarting Hysteria2")
+	err = hm.restartServer(configPath, runtimePath)
+	if err == nil {
+		hm.setRunningDigest(digest)
+	}
+
+	if drained > 0 {
+		event := ReloadEvent{Type: ReloadEventRestarted, Connections: left, Drained: drained}
+		if err != nil {
+			event.Error = err.Error()
+		}
+		hm.report(event)
+	}
+	return err
+}
+
+// WithDrained runs fn on a drained Hysteria2 server, for work breaking the connections it
+// carries without restarting it. The server admits new connections again once fn returned.
+func (hm *HysteriaManagerImpl) WithDrained(fn func() error) error {
+	hm.restartMu.Lock()
+	defer hm.restartMu.Unlock()
+
+	if !hm.hysteria2Running() {
+		return fn()
+	}
+	start := time.Now()
+	left, closed := hm.drain()
+	err := fn()
+	if closed {
+		hm.undrain()
+		hm.report(ReloadEvent{Type: ReloadEventUndrained, Connections: left, Drained: time.Since(start)})
+	}
+	return err
+}
+
+func (hm *HysteriaManagerImpl) restartServer(configPath, runtimePath string) error {
+	if hm.config.Hysteria2.EnableSystemd {
+		// Rewrite the service too, as services installed by earlier agents ran config.json
+		host := DetectHostOS(hm.config)
+		if err := host.InstallService(hysteria2ServiceName, runtimePath); err != nil {
+			return fmt.Errorf("failed to install hysteria2 service: %w", err)
+		}
+		return host.RestartService(hysteria2ServiceName)
+	}
+
+	if err := hm.StopHysteria2(); err != nil {
+		hm.logger.Warnf("Failed to stop Hysteria2: %v", err)
+	}
+
+	return hm.StartHysteria2(configPath)
+}
+
+// drain rejects new connections to the Hysteria2 ports, then waits until
+// hysteria2.drain_connections or fewer are left, hysteria2.drain_timeout passed or a forced
+// restart cut it short. It returns the connections left and whether the ports were closed;
+// undrain opens them again.
+func (hm *HysteriaManagerImpl) drain() (int, bool) {
+	timeout := time.Duration(hm.config.Hysteria2.DrainTimeout) * time.Second
+	services := hysteria2ServiceRules(hm.config)
+	if timeout <= 0 || len(services) == 0 {
+		return 0, false
+	}
+
+	// Connections that cannot be counted are waited for until the timeout
+	connections, err := hm.countConnections(services)
+	if err != nil {
+		hm.logger.Warnf("Failed to count Hysteria2 connections, draining for %s: %v", timeout, err)
+		connections = -1
+	} else if connections <= hm.config.Hysteria2.DrainConnections {
+		return connections, false
+	}
+
+	// A forced restart is waiting for this one, which then goes ahead without draining
+	hm.stateMu.Lock()
+	forced := hm.forced > 0
+	hm.stateMu.Unlock()
+	if forced {
+		return connections, false
+	}
+
+	if err := hm.loadNFT(hysteria2DrainRuleset(services)); err != nil {
+		hm.logger.Warnf("Failed to close Hysteria2 to new connections, restarting without draining: %v", err)
+		return connections, false
+	}
+
+	deadline := time.Now().Add(timeout)
+	cut := make(chan struct{})
+	hm.stateMu.Lock()
+	hm.drainDeadline = deadline
+	hm.drainCut = cut
+	hm.stateMu.Unlock()
+	defer func() {
+		hm.stateMu.Lock()
+		if hm.drainCut == cut {
+			hm.drainCut = nil
+		}
+		hm.stateMu.Unlock()
+	}()
+	hm.logger.Infof("Draining Hysteria2 until %s: %d connection(s) open", deadline.Format(time.RFC3339), connections)
+	hm.report(ReloadEvent{Type: ReloadEventDrainStarted, Connections: connections, Deadline: deadline})
+
+	for time.Now().Before(deadline) {
+		select {
+		case <-cut:
+			hm.logger.Warnf("Hysteria2 drain cut short by a forced restart: %d connection(s) left", connections)
+			return connections, true
+		case <-time.After(min(hm.drainPoll, time.Until(deadline))):
+		}
+		count, err := hm.countConnections(services)
+		if err != nil {
+			continue
+		}
+		if connections = count; connections <= hm.config.Hysteria2.DrainConnections {
+			hm.logger.Infof("Hysteria2 drained: %d connection(s) left", connections)
+			break
+		}
+	}
+	return connections, true
+}
+
+// undrain admits new connections to the restarted server
+func (hm *HysteriaManagerImpl) undrain() {
+	if err := hm.loadNFT(fmt.Sprintf("delete table inet %s\n", hysteria2DrainTable)); err != nil {
+		hm.logger.Errorf("Failed to reopen Hysteria2 to new connections: %v", err)
+	}
+	hm.stateMu.Lock()
+	hm.drainDeadline = time.Time{}
+	hm.stateMu.Unlock()
+}
+
+// hysteria2DrainRuleset renders the table rejecting new connections to the Hysteria2 ports.
+// Its hook runs before the admission table's, and connections already open pass.
+func hysteria2DrainRuleset(services []FirewallRule) string {
+	elements := make([]string, 0, len(services))
+	for _, rule := range services {
+		elements = append(elements, fmt.Sprintf("%s . %s", rule.Protocol, rule.Ports))
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "table inet %s\ndelete table inet %s\n\n", hysteria2DrainTable, hysteria2DrainTable)
+	fmt.Fprintf(&b, "table inet %s {\n", hysteria2DrainTable)
+	b.WriteString("\tchain input {\n")
+	b.WriteString("\t\ttype filter hook input priority filter - 20; policy accept;\n\n")
+	fmt.Fprintf(&b, "\t\tct state new meta l4proto . th dport { %s } reject comment \"draining\"\n", strings.Join(elements, ", "))
+	b.WriteString("\t}\n")
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// hysteria2ServiceRules are the public ports Hysteria2 serves clients on
+func hysteria2ServiceRules(cfg *config.Config) []FirewallRule {
+	var rules []FirewallRule
+	for _, rule := range publicServiceRules(cfg) {
+		if rule.Protocol == "udp" && strings.HasPrefix(rule.Comment, "hysteria2") {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// draining returns when a drain in progress ends at the latest, zero when none is
+func (hm *HysteriaManagerImpl) draining() time.Time {
+	hm.stateMu.Lock()
+	defer hm.stateMu.Unlock()
+	return hm.drainDeadline
+}
+
+func (hm *HysteriaManagerImpl) report(event ReloadEvent) {
+	hm.stateMu.Lock()
+	reporter := hm.reporter
+	hm.stateMu.Unlock()
+	if reporter != nil {
+		reporter(event)
+	}
+}
+
+func (hm *HysteriaManagerImpl) runningDigest() string {
+	hm.stateMu.Lock()
+	defer hm.stateMu.Unlock()
+	return hm.running
+}
+
+// setRunningDigest records the config the server was started with, empty when unknown
+func (hm *HysteriaManagerImpl) setRunningDigest(digest string) {
+	hm.stateMu.Lock()
+	defer hm.stateMu.Unlock()
+	hm.running = digest
+}
+
+func (hm *HysteriaManagerImpl) hysteria2Running() bool {
+	status, err := hm.GetHysteria2Status()
+	if err != nil {
+		return false
+	}
+	running, _ := status["running"].(bool)
+	return running
+}
+
+// configDigest hashes the config a server runs from, empty when it cannot be read
+func configDigest(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return contentHash(data)
+}
@@ -0,0 +1,180 @@
+package services
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"hysteria2_microservices/agent-service/internal/config"
+)
+
+func TestHysteria2DrainRuleset(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Hysteria2.DefaultListenPort = 443
+	cfg.Hysteria2.ListenPorts = []int{8443, 443}
+	cfg.Hysteria2.PortHopping = true
+	cfg.Hysteria2.HopStartPort = 20000
+	cfg.Hysteria2.HopEndPort = 30000
+
+	want := `table inet hysteria2_drain
+delete table inet hysteria2_drain
+
+table inet hysteria2_drain {
+	chain input {
+		type filter hook input priority filter - 20; policy accept;
+
+		ct state new meta l4proto . th dport { udp . 443, udp . 8443, udp . 20000-30000 } reject comment "draining"
+	}
+}
+`
+	if got := hysteria2DrainRuleset(hysteria2ServiceRules(cfg)); got != want {
+		t.Errorf("ruleset:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+// drainFakes stands in for nft and conntrack. Each count returns the next of counts, the
+// last one over and over.
+type drainFakes struct {
+	mu      sync.Mutex
+	counts  []int
+	scripts []string
+}
+
+func (f *drainFakes) loadNFT(script string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.scripts = append(f.scripts, script)
+	return nil
+}
+
+func (f *drainFakes) countConnections([]FirewallRule) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	count := f.counts[0]
+	if len(f.counts) > 1 {
+		f.counts = f.counts[1:]
+	}
+	return count, nil
+}
+
+// loaded returns the kinds of scripts loaded: "drain" or "undrain"
+func (f *drainFakes) loaded() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var kinds []string
+	for _, script := range f.scripts {
+		if strings.Contains(script, "reject") {
+			kinds = append(kinds, "drain")
+		} else {
+			kinds = append(kinds, "undrain")
+		}
+	}
+	return kinds
+}
+
+func newDrainTestManager(t *testing.T, timeout int, counts ...int) (*HysteriaManagerImpl, *drainFakes) {
+	cfg := &config.Config{}
+	cfg.Hysteria2.DefaultListenPort = 443
+	cfg.Hysteria2.DrainTimeout = timeout
+	cfg.Hysteria2.DrainConnections = 2
+	fakes := &drainFakes{counts: counts}
+	return &HysteriaManagerImpl{
+		logger:           testLogger(),
+		config:           cfg,
+		runner:           &CommandRunner{logger: testLogger(), timeout: time.Second, maxOutput: maxCommandOutput},
+		loadNFT:          fakes.loadNFT,
+		countConnections: fakes.countConnections,
+		drainPoll:        10 * time.Millisecond,
+	}, fakes
+}
+
+func TestHysteria2Drain(t *testing.T) {
+	tests := []struct {
+		name       string
+		counts     []int
+		wantLeft   int
+		wantClosed bool
+		wantWait   time.Duration
+	}{
+		{"few connections", []int{2}, 2, false, 0},
+		{"drained early", []int{5, 4, 1}, 1, true, 0},
+		{"timeout", []int{5}, 5, true, time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hm, fakes := newDrainTestManager(t, 1, tt.counts...)
+			start := time.Now()
+			left, closed := hm.drain()
+			elapsed := time.Since(start)
+			if left != tt.wantLeft || closed != tt.wantClosed {
+				t.Errorf("drain = %d, %v; want %d, %v", left, closed, tt.wantLeft, tt.wantClosed)
+			}
+			if elapsed < tt.wantWait || elapsed > tt.wantWait+500*time.Millisecond {
+				t.Errorf("drain took %s, want %s", elapsed, tt.wantWait)
+			}
+			if loaded := fakes.loaded(); tt.wantClosed != (len(loaded) == 1 && loaded[0] == "drain") {
+				t.Errorf("scripts loaded = %v", loaded)
+			}
+		})
+	}
+}
+
+// installFailingHysteria2 makes Hysteria2 look running and fail to start again: pgrep finds
+// it, pkill stops it and no hysteria binary is on PATH
+func installFailingHysteria2(t *testing.T) {
+	fakes := newCommandFakes(t)
+	fakes.install(t, "pgrep", "#!/bin/sh\nexit 0\n")
+	fakes.install(t, "pkill", "#!/bin/sh\nexit 0\n")
+	t.Setenv("PATH", fakes.dir)
+}
+
+func TestHysteria2RestartUndrainsAfterFailure(t *testing.T) {
+	installFailingHysteria2(t)
+	hm, fakes := newDrainTestManager(t, 5, 5, 1)
+	var events []ReloadEvent
+	hm.SetReloadReporter(func(event ReloadEvent) { events = append(events, event) })
+
+	if err := hm.RestartHysteria2(t.TempDir() + "/config.yaml"); err == nil {
+		t.Fatal("restart without a hysteria binary succeeded")
+	}
+	if loaded := fakes.loaded(); len(loaded) != 2 || loaded[0] != "drain" || loaded[1] != "undrain" {
+		t.Errorf("scripts loaded = %v, want drain then undrain", loaded)
+	}
+	if !hm.draining().IsZero() {
+		t.Error("still draining after the restart")
+	}
+	if len(events) != 2 || events[1].Type != ReloadEventRestarted || events[1].Error == "" {
+		t.Errorf("events = %+v, want the drain and the failed restart", events)
+	}
+}
+
+func TestHysteria2ForcedRestartCutsDrainShort(t *testing.T) {
+	installFailingHysteria2(t)
+	hm, fakes := newDrainTestManager(t, 30, 5)
+	started := make(chan struct{})
+	hm.SetReloadReporter(func(event ReloadEvent) {
+		if event.Type == ReloadEventDrainStarted {
+			close(started)
+		}
+	})
+
+	configPath := t.TempDir() + "/config.yaml"
+	done := make(chan struct{})
+	go func() {
+		hm.RestartHysteria2(configPath)
+		close(done)
+	}()
+	<-started
+
+	start := time.Now()
+	hm.ForceRestartHysteria2(configPath)
+	<-done
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("forced restart took %s", elapsed)
+	}
+	// The forced restart does not drain again
+	if loaded := fakes.loaded(); len(loaded) != 2 || loaded[0] != "drain" || loaded[1] != "undrain" {
+		t.Errorf("scripts loaded = %v, want one drain and undrain", loaded)
+	}
+}
@@ -0,0 +1,454 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"hysteria2_microservices/agent-service/internal/config"
+	"hysteria2_microservices/agent-service/internal/hysteriaconfig"
+)
+
+const (
+	hysteriaRepository     = "apernet/hysteria"
+	hysteriaReleaseTagBase = "app/"
+
+	releaseRequestTimeout  = 30 * time.Second
+	binaryDownloadTimeout  = 5 * time.Minute
+	configDryRunDuration   = 3 * time.Second
+	healthCheckPollPeriod  = 3 * time.Second
+	defaultHealthCheckTime = 15 * time.Second
+)
+
+var hysteriaVersionPattern = regexp.MustCompile(`^v\d+\.\d+\.\d+(-[0-9A-Za-z.]+)?$`)
+
+// ComponentVersion compares the installed release of a component with the latest
+// published one and the version pinned in the agent config
+type ComponentVersion struct {
+	Name            string `json:"name"`
+	Installed       string `json:"installed"`
+	Latest          string `json:"latest"`
+	Pinned          string `json:"pinned,omitempty"`
+	UpdateAvailable bool   `json:"update_available"`
+}
+
+// UpgradeResult reports the versions before and after an upgrade. RolledBack is set when
+// the new release failed its checks and the previous binary was restored. Migrations
+// lists the config rewrites the new release needed.
+type UpgradeResult struct {
+	PreviousVersion  string   `json:"previous_version"`
+	InstalledVersion string   `json:"installed_version"`
+	RolledBack       bool     `json:"rolled_back"`
+	Migrations       []string `json:"migrations,omitempty"`
+}
+
+// HysteriaUpdaterImpl replaces the Hysteria2 binary with a verified release, checking that
+// the running config still loads and rolling back when the server does not stay up
+type HysteriaUpdaterImpl struct {
+	logger          *logrus.Logger
+	config          *config.Config
+	hysteriaManager HysteriaManager
+	client          *http.Client
+	artifacts       *artifactStore
+	mu              sync.Mutex
+}
+
+// NewHysteriaUpdater creates a new HysteriaUpdater
+func NewHysteriaUpdater(logger *logrus.Logger, cfg *config.Config, hysteriaManager HysteriaManager) HysteriaUpdater {
+	return &HysteriaUpdaterImpl{
+		logger:          logger,
+		config:          cfg,
+		hysteriaManager: hysteriaManager,
+		client:          &http.Client{Timeout: binaryDownloadTimeout},
+		artifacts:       newArtifactStore(cfg),
+	}
+}
+
+// CheckUpdates compares the installed release with the latest GitHub release, or the
+// artifact store's default in offline mode. With a pinned version, an update is
+// available whenever the installed release differs from it.
+func (hu *HysteriaUpdaterImpl) CheckUpdates(ctx context.Context) (*ComponentVersion, error) {
+	status := &ComponentVersion{
+		Name:   "hysteria2",
+		Pinned: normalizeHysteriaVersion(hu.config.Hysteria2.Version),
+	}
+
+	installed, err := binaryVersion(hu.binaryPath())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read installed version: %w", err)
+	}
+	status.Installed = installed
+
+	latest, err := hu.latestRelease(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get latest release: %w", err)
+	}
+	status.Latest = normalizeHysteriaVersion(latest)
+
+	target := status.Pinned
+	if target == "" {
+		target = status.Latest
+	}
+	status.UpdateAvailable = status.Installed != target
+	return status, nil
+}
+
+// Upgrade installs version, or the pinned or latest release when empty. The download is
+// verified against the release hashes and dry-run against the current config before it
+// replaces the binary; if the restarted server does not stay up the previous binary is
+// restored and the returned error explains why.
+func (hu *HysteriaUpdaterImpl) Upgrade(ctx context.Context, version string) (*UpgradeResult, error) {
+	hu.mu.Lock()
+	defer hu.mu.Unlock()
+
+	binaryPath := hu.binaryPath()
+	previous, err := binaryVersion(binaryPath)
+	if err != nil {
+		return nil, fmt.Errorf("hysteria2 %w: %v", ErrServerNotInstalled, err)
+	}
+	result := &UpgradeResult{PreviousVersion: previous, InstalledVersion: previous}
+
+	target, err := hu.targetVersion(ctx, version)
+	if err != nil {
+		return nil, err
+	}
+	if target == previous {
+		hu.logger.Infof("Hysteria2 is already at %s", target)
+		return result, nil
+	}
+
+	hu.logger.Infof("Upgrading Hysteria2 from %s to %s", previous, target)
+
+	candidate := binaryPath + ".new"
+	defer os.Remove(candidate)
+	if err := hu.download(ctx, target, candidate); err != nil {
+		return nil, err
+	}
+	if got, err := binaryVersion(candidate); err != nil || got != target {
+		return nil, fmt.Errorf("downloaded binary reports version %q, expected %s", got, target)
+	}
+	if err := hu.validateConfig(ctx, candidate); err != nil {
+		return nil, fmt.Errorf("current config is not compatible with %s: %w", target, err)
+	}
+
+	status, err := hu.hysteriaManager.GetHysteria2Status()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hysteria2 status: %w", err)
+	}
+	wasRunning, _ := status["running"].(bool)
+
+	backup := binaryPath + ".prev"
+	if err := copyFile(binaryPath, backup, 0755); err != nil {
+		return nil, fmt.Errorf("failed to back up current binary: %w", err)
+	}
+	// Renaming over the binary leaves a running server on the old inode until restarted
+	if err := os.Rename(candidate, binaryPath); err != nil {
+		return nil, fmt.Errorf("failed to install new binary: %w", err)
+	}
+
+	if healthErr := hu.restartAndCheck(ctx, wasRunning, target); healthErr != nil {
+		hu.logger.Errorf("Hysteria2 %s failed health checks, rolling back to %s: %v", target, previous, healthErr)
+		if err := hu.rollback(backup, wasRunning); err != nil {
+			return result, fmt.Errorf("health check failed (%v) and rollback failed: %w", healthErr, err)
+		}
+		result.RolledBack = true
+		return result, fmt.Errorf("health check failed, rolled back to %s: %w", previous, healthErr)
+	}
+
+	result.InstalledVersion = target
+	hu.logger.Infof("Hysteria2 upgraded to %s", target)
+	return result, nil
+}
+
+func (hu *HysteriaUpdaterImpl) binaryPath() string {
+	return hysteriaBinaryPath(hu.config)
+}
+
+func (hu *HysteriaUpdaterImpl) latestRelease(ctx context.Context) (string, error) {
+	if hu.artifacts != nil {
+		return hu.artifacts.latest(ctx, "hysteria2")
+	}
+	return latestReleaseTag(ctx, hu.client, hysteriaRepository)
+}
+
+func (hu *HysteriaUpdaterImpl) targetVersion(ctx context.Context, version string) (string, error) {
+	if version == "" {
+		version = hu.config.Hysteria2.Version
+	}
+	if version == "" {
+		latest, err := hu.latestRelease(ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to get latest release: %w", err)
+		}
+		version = latest
+	}
+	version = normalizeHysteriaVersion(version)
+	if !hysteriaVersionPattern.MatchString(version) {
+		return "", fmt.Errorf("invalid hysteria2 version %q", version)
+	}
+	return version, nil
+}
+
+// download fetches the release binary for this architecture and checks it against the
+// SHA-256 listed in the release's hashes.txt, or in the artifact store's listing
+func (hu *HysteriaUpdaterImpl) download(ctx context.Context, version, dest string) error {
+	if hu.artifacts != nil {
+		return hu.artifacts.download(ctx, hysteriaArtifact(version), dest)
+	}
+
+	return downloadHysteriaRelease(ctx, hu.client, version, dest)
+}
+
+// downloadHysteriaRelease fetches the GitHub release binary for this architecture and
+// checks it against the SHA-256 listed in the release's hashes.txt
+func downloadHysteriaRelease(ctx context.Context, client *http.Client, version, dest string) error {
+	asset := hysteriaAsset()
+	base := fmt.Sprintf("https://github.com/%s/releases/download/%s%s/", hysteriaRepository, hysteriaReleaseTagBase, version)
+
+	hashes, err := fetch(ctx, client, base+"hashes.txt")
+	if err != nil {
+		return fmt.Errorf("failed to download release hashes: %w", err)
+	}
+	expected := releaseAssetHash(string(hashes), asset)
+	if expected == "" {
+		return fmt.Errorf("release %s lists no hash for %s", version, asset)
+	}
+
+	if err := downloadVerified(ctx, client, base+asset, expected, dest); err != nil {
+		return fmt.Errorf("failed to download %s: %w", asset, err)
+	}
+	return nil
+}
+
+// validateConfig starts the candidate binary on the current config, moved to a loopback
+// port, and fails if it exits before the dry run ends. Hysteria2 parses and validates its
+// config at startup, so fields the new release cannot load are caught here.
+func (hu *HysteriaUpdaterImpl) validateConfig(ctx context.Context, binary string) error {
+	data, err := readGeneratedConfig(hu.config, hysteria2ConfigPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read config: %w", err)
+	}
+
+	serverConfig, err := hysteriaconfig.Parse(data)
+	if err != nil {
+		return fmt.Errorf("failed to parse config: %w", err)
+	}
+	return hysteriaconfig.Check(ctx, binary, serverConfig, configDryRunDuration)
+}
+
+// restartAndCheck restarts a server that was running and requires it to stay active for
+// the health check period; systemd restarting a crashing server shows as inactive
+func (hu *HysteriaUpdaterImpl) restartAndCheck(ctx context.Context, wasRunning bool, target string) error {
+	if got, err := binaryVersion(hu.binaryPath()); err != nil || got != target {
+		return fmt.Errorf("installed binary reports version %q", got)
+	}
+	if !wasRunning {
+		return nil
+	}
+	if err := hu.hysteriaManager.RestartHysteria2(hysteria2ConfigPath); err != nil {
+		return fmt.Errorf("failed to restart: %w", err)
+	}
+
+	period := time.Duration(hu.config.Hysteria2.UpgradeHealthCheck) * time.Second
+	if period <= 0 {
+		period = defaultHealthCheckTime
+	}
+	deadline := time.Now().Add(period)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(healthCheckPollPeriod):
+		}
+
+		status, err := hu.hysteriaManager.GetHysteria2Status()
+		if err != nil {
+			return err
+		}
+		if running, _ := status["running"].(bool); !running {
+			return fmt.Errorf("server is not running")
+		}
+		if time.Now().After(deadline) {
+			return nil
+		}
+	}
+}
+
+func (hu *HysteriaUpdaterImpl) rollback(backup string, wasRunning bool) error {
+	if err := os.Rename(backup, hu.binaryPath()); err != nil {
+		return fmt.Errorf("failed to restore previous binary: %w", err)
+	}
+	if !wasRunning {
+		return nil
+	}
+	return hu.hysteriaManager.RestartHysteria2(hysteria2ConfigPath)
+}
+
+func hysteriaBinaryPath(cfg *config.Config) string {
+	if cfg.Hysteria2.BinaryPath != "" {
+		return cfg.Hysteria2.BinaryPath
+	}
+	return "/usr/local/bin/hysteria"
+}
+
+func hysteriaAsset() string {
+	return "hysteria-" + runtime.GOOS + "-" + runtime.GOARCH
+}
+
+// hysteriaArtifact is the path of a release binary in the orchestrator's artifact store
+func hysteriaArtifact(version string) string {
+	return "hysteria2/" + version + "/" + hysteriaAsset()
+}
+
+// normalizeHysteriaVersion turns "2.6.1" and release tags such as "app/v2.6.1" into "v2.6.1"
+func normalizeHysteriaVersion(version string) string {
+	version = strings.TrimPrefix(strings.TrimSpace(version), hysteriaReleaseTagBase)
+	if version != "" && !strings.HasPrefix(version, "v") {
+		version = "v" + version
+	}
+	return version
+}
+
+// binaryVersion runs "<binary> version" and returns the Version line, e.g. "v2.6.1"
+func binaryVersion(binary string) (string, error) {
+	if _, err := os.Stat(binary); err != nil {
+		return "", err
+	}
+	output, err := exec.Command(binary, "version").Output()
+	if err != nil {
+		return "", err
+	}
+	scanner := bufio.NewScanner(strings.NewReader(string(output)))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if ok && strings.TrimSpace(key) == "Version" {
+			return normalizeHysteriaVersion(value), nil
+		}
+	}
+	return "", fmt.Errorf("no version in output of %s version", filepath.Base(binary))
+}
+
+// latestReleaseTag returns the tag of the latest non-prerelease GitHub release of repo
+func latestReleaseTag(ctx context.Context, client *http.Client, repo string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, releaseRequestTimeout)
+	defer cancel()
+
+	data, err := fetch(ctx, client, "https://api.github.com/repos/"+repo+"/releases/latest")
+	if err != nil {
+		return "", err
+	}
+	var release struct {
+		TagName string `json:"tag_name"`
+	}
+	if err := json.Unmarshal(data, &release); err != nil {
+		return "", fmt.Errorf("invalid release response: %w", err)
+	}
+	if release.TagName == "" {
+		return "", fmt.Errorf("release has no tag")
+	}
+	return release.TagName, nil
+}
+
+// releaseAssetHash finds the SHA-256 of asset in a sha256sum-style listing
+func releaseAssetHash(listing, asset string) string {
+	for _, line := range strings.Split(listing, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == asset {
+			return strings.ToLower(fields[0])
+		}
+	}
+	return ""
+}
+
+func fetch(ctx context.Context, client *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// downloadVerified saves url to dest as an executable only if its SHA-256 matches expected
+func downloadVerified(ctx context.Context, client *http.Client, url, expected, dest string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+
+	f, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, hash), resp.Body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dest)
+		return err
+	}
+
+	if actual := hex.EncodeToString(hash.Sum(nil)); actual != expected {
+		os.Remove(dest)
+		return fmt.Errorf("checksum mismatch: got %s, expected %s", actual, expected)
+	}
+	return nil
+}
+
+func copyFile(src, dest string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func lastLine(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	return lines[len(lines)-1]
+}
@@ -0,0 +1,333 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"hysteria2_microservices/agent-service/internal/config"
+)
+
+// fakeArtifactStore serves files and their SHA256SUMS listing to agents presenting token
+type fakeArtifactStore struct {
+	*httptest.Server
+	mu    sync.Mutex
+	files map[string][]byte
+	sums  map[string]string // overrides the listed hash of a file
+}
+
+func newFakeArtifactStore(t *testing.T, token string) *fakeArtifactStore {
+	s := &fakeArtifactStore{files: map[string][]byte{}, sums: map[string]string{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		if name == "SHA256SUMS" {
+			for file, data := range s.files {
+				sum := sha256.Sum256(data)
+				hash := hex.EncodeToString(sum[:])
+				if override, ok := s.sums[file]; ok {
+					hash = override
+				}
+				fmt.Fprintf(w, "%s  %s\n", hash, file)
+			}
+			return
+		}
+		data, ok := s.files[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// useArtifactStore puts cfg in offline mode against a fake store accepting node-token
+func useArtifactStore(t *testing.T, cfg *config.Config) *fakeArtifactStore {
+	store := newFakeArtifactStore(t, "node-token")
+	cfg.Artifacts = config.ArtifactsConfig{Offline: true, URL: store.URL, Token: "node-token"}
+	return store
+}
+
+func (s *fakeArtifactStore) put(name string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[name] = data
+}
+
+// tamper lists a wrong hash for name
+func (s *fakeArtifactStore) tamper(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sums[name] = strings.Repeat("0", 64)
+}
+
+// fakeBinary is a script answering "version" like the Hysteria2 and Xray binaries
+func fakeBinary(versionLine string) []byte {
+	return []byte("#!/bin/sh\necho '" + versionLine + "'\n")
+}
+
+// fakeService is a server the updaters restart; it crashes after a restart when crashing is
+// set and comes back on the restart after that
+type fakeService struct {
+	mu       sync.Mutex
+	running  bool
+	crashing bool
+	restarts int
+}
+
+func (s *fakeService) status() (map[string]interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return map[string]interface{}{"running": s.running}, nil
+}
+
+func (s *fakeService) restart() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.restarts++
+	s.running = !s.crashing || s.restarts > 1
+	return nil
+}
+
+type upgradeHysteria struct {
+	HysteriaManager
+	*fakeService
+}
+
+func (h *upgradeHysteria) GetHysteria2Status() (map[string]interface{}, error) { return h.status() }
+func (h *upgradeHysteria) RestartHysteria2(configPath string) error            { return h.restart() }
+
+func newTestHysteriaUpdater(t *testing.T, running bool) (*HysteriaUpdaterImpl, *fakeArtifactStore, *upgradeHysteria) {
+	cfg := &config.Config{}
+	store := useArtifactStore(t, cfg)
+	cfg.Hysteria2.BinaryPath = filepath.Join(t.TempDir(), "hysteria")
+	cfg.Hysteria2.UpgradeHealthCheck = 1
+	if err := os.WriteFile(cfg.Hysteria2.BinaryPath, fakeBinary("Version:	v2.6.0"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	hysteria := &upgradeHysteria{fakeService: &fakeService{running: running}}
+	return NewHysteriaUpdater(testLogger(), cfg, hysteria).(*HysteriaUpdaterImpl), store, hysteria
+}
+
+func TestHysteriaCheckUpdates(t *testing.T) {
+	hu, store, _ := newTestHysteriaUpdater(t, false)
+	store.put("hysteria2/latest", []byte("app/v2.6.1\n"))
+
+	status, err := hu.CheckUpdates(context.Background())
+	if err != nil {
+		t.Fatalf("CheckUpdates: %v", err)
+	}
+	if status.Installed != "v2.6.0" || status.Latest != "v2.6.1" || !status.UpdateAvailable {
+		t.Errorf("status %+v, want v2.6.1 available over v2.6.0", status)
+	}
+
+	// A pinned version wins over the latest release
+	hu.config.Hysteria2.Version = "2.6.0"
+	if status, _ := hu.CheckUpdates(context.Background()); status.Pinned != "v2.6.0" || status.UpdateAvailable {
+		t.Errorf("status %+v, want no update while pinned to the installed release", status)
+	}
+}
+
+func TestHysteriaUpgrade(t *testing.T) {
+	hu, store, hysteria := newTestHysteriaUpdater(t, false)
+	store.put(hysteriaArtifact("v2.6.1"), fakeBinary("Version:	v2.6.1"))
+
+	result, err := hu.Upgrade(context.Background(), "2.6.1")
+	if err != nil {
+		t.Fatalf("Upgrade: %v", err)
+	}
+	if result.PreviousVersion != "v2.6.0" || result.InstalledVersion != "v2.6.1" || result.RolledBack {
+		t.Errorf("result %+v, want v2.6.0 upgraded to v2.6.1", result)
+	}
+	if got, _ := binaryVersion(hu.binaryPath()); got != "v2.6.1" {
+		t.Errorf("installed binary reports %s", got)
+	}
+	if got, _ := binaryVersion(hu.binaryPath() + ".prev"); got != "v2.6.0" {
+		t.Errorf("backup reports %s, want the previous release", got)
+	}
+	// A stopped server is left stopped
+	if hysteria.restarts != 0 {
+		t.Errorf("restarted a stopped server %d times", hysteria.restarts)
+	}
+
+	if result, err := hu.Upgrade(context.Background(), "v2.6.1"); err != nil || result.InstalledVersion != "v2.6.1" {
+		t.Errorf("upgrade to the installed release = %+v, %v", result, err)
+	}
+	if _, err := hu.Upgrade(context.Background(), "latest; rm -rf /"); err == nil {
+		t.Error("accepted an invalid version")
+	}
+}
+
+func TestHysteriaUpgradeRejectsBadDownloads(t *testing.T) {
+	hu, store, _ := newTestHysteriaUpdater(t, false)
+
+	// Tampered binary
+	store.put(hysteriaArtifact("v2.6.1"), fakeBinary("Version:	v2.6.1"))
+	store.tamper(hysteriaArtifact("v2.6.1"))
+	if _, err := hu.Upgrade(context.Background(), "v2.6.1"); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("Upgrade with a tampered binary = %v, want a checksum mismatch", err)
+	}
+
+	// A binary that is not the requested release
+	store.put(hysteriaArtifact("v2.6.2"), fakeBinary("Version:	v2.5.0"))
+	if _, err := hu.Upgrade(context.Background(), "v2.6.2"); err == nil {
+		t.Error("installed a binary reporting another version")
+	}
+
+	if got, _ := binaryVersion(hu.binaryPath()); got != "v2.6.0" {
+		t.Errorf("installed binary reports %s after rejected downloads", got)
+	}
+	if _, err := os.Stat(hu.binaryPath() + ".new"); !os.IsNotExist(err) {
+		t.Errorf("candidate binary left behind: %v", err)
+	}
+}
+
+// TestUpgradeRollsBack upgrades each server to a release that does not stay up
+func TestUpgradeRollsBack(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T) (upgrade func(context.Context, string) (*UpgradeResult, error), service *fakeService, restored func() bool)
+	}{
+		{"hysteria", func(t *testing.T) (func(context.Context, string) (*UpgradeResult, error), *fakeService, func() bool) {
+			hu, store, hysteria := newTestHysteriaUpdater(t, true)
+			store.put(hysteriaArtifact("v2.6.1"), fakeBinary("Version:	v2.6.1"))
+			return hu.Upgrade, hysteria.fakeService, func() bool {
+				got, _ := binaryVersion(hu.binaryPath())
+				return got == "v2.6.0"
+			}
+		}},
+		{"xray", func(t *testing.T) (func(context.Context, string) (*UpgradeResult, error), *fakeService, func() bool) {
+			xu, store, xray := newTestXrayUpdater(t, true)
+			store.put(xrayReleaseArtifact("v2.6.1"), fakeXrayRelease(t, "2.6.1", "0"))
+			return xu.Upgrade, xray.fakeService, func() bool {
+				got, _ := xrayBinaryVersion(xu.config.Xray.BinaryPath)
+				data, _ := os.ReadFile(xray.configPath)
+				return got == "v1.7.5" && string(data) == legacyXrayConfig
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upgrade, service, restored := tt.setup(t)
+			service.crashing = true
+
+			result, err := upgrade(context.Background(), "v2.6.1")
+			if err == nil || !result.RolledBack || result.InstalledVersion != result.PreviousVersion {
+				t.Fatalf("Upgrade = %+v, %v; want rolled back", result, err)
+			}
+			if !restored() {
+				t.Error("previous release not restored")
+			}
+			// Restarted on the new release, then again on the restored one
+			if service.restarts != 2 || !service.running {
+				t.Errorf("restarted %d times, running %v", service.restarts, service.running)
+			}
+		})
+	}
+}
+
+func TestReleaseHelpers(t *testing.T) {
+	for in, want := range map[string]string{"2.6.1": "v2.6.1", "app/v2.6.1": "v2.6.1", " v2.6.1\n": "v2.6.1", "": ""} {
+		if got := normalizeHysteriaVersion(in); got != want {
+			t.Errorf("normalizeHysteriaVersion(%q) = %q, want %q", in, got, want)
+		}
+	}
+
+	listing := "ABCDEF  hysteria-linux-amd64\n123456 *hysteria-linux-arm64\nbad line\n"
+	if got := releaseAssetHash(listing, "hysteria-linux-amd64"); got != "abcdef" {
+		t.Errorf("hash for amd64 = %q", got)
+	}
+	if got := releaseAssetHash(listing, "hysteria-linux-arm64"); got != "123456" {
+		t.Errorf("hash for a binary-mode entry = %q", got)
+	}
+	if got := releaseAssetHash(listing, "hysteria-linux-arm"); got != "" {
+		t.Errorf("hash for a missing asset = %q", got)
+	}
+}
+
+// githubTransport answers requests for GitHub from a fake release server
+type githubTransport struct {
+	server *httptest.Server
+}
+
+func (g githubTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != "github.com" && req.URL.Host != "api.github.com" {
+		return nil, fmt.Errorf("unexpected request to %s", req.URL)
+	}
+	req = req.Clone(req.Context())
+	req.URL.Scheme, req.URL.Host = "http", strings.TrimPrefix(g.server.URL, "http://")
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestDownloadHysteriaRelease(t *testing.T) {
+	binary := fakeBinary("Version:	v2.6.1")
+	sum := sha256.Sum256(binary)
+	hashes := hex.EncodeToString(sum[:]) + "  " + hysteriaAsset() + "\n"
+	release := "/" + hysteriaRepository + "/releases/download/app/v2.6.1/"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/" + hysteriaRepository + "/releases/latest":
+			fmt.Fprint(w, `{"tag_name": "app/v2.6.1"}`)
+		case release + "hashes.txt":
+			fmt.Fprint(w, hashes)
+		case release + hysteriaAsset():
+			w.Write(binary)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: githubTransport{server}}
+	ctx := context.Background()
+
+	if latest, err := latestReleaseTag(ctx, client, hysteriaRepository); err != nil || normalizeHysteriaVersion(latest) != "v2.6.1" {
+		t.Fatalf("latest release = %q, %v; want v2.6.1", latest, err)
+	}
+	dest := filepath.Join(t.TempDir(), "hysteria.new")
+	if err := downloadHysteriaRelease(ctx, client, "v2.6.1", dest); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(dest); string(data) != string(binary) {
+		t.Error("downloaded binary differs from the release")
+	}
+
+	// A binary not matching hashes.txt is refused and not kept
+	hashes = strings.Repeat("0", 64) + "  " + hysteriaAsset() + "\n"
+	tampered := filepath.Join(t.TempDir(), "hysteria.new")
+	if err := downloadHysteriaRelease(ctx, client, "v2.6.1", tampered); err == nil {
+		t.Error("download with a wrong hash succeeded")
+	}
+	if _, err := os.Stat(tampered); err == nil {
+		t.Error("binary with a wrong hash kept")
+	}
+	hashes = ""
+	if err := downloadHysteriaRelease(ctx, client, "v2.6.1", tampered); err == nil || !strings.Contains(err.Error(), "lists no hash") {
+		t.Errorf("download without a listed hash = %v", err)
+	}
+	if err := downloadHysteriaRelease(ctx, client, "v2.7.0", tampered); err == nil {
+		t.Error("download of a missing release succeeded")
+	}
+}
+
+func TestAddWARPRepositoryUnsupportedHost(t *testing.T) {
+	for _, host := range []*HostOS{{ID: "alpine", PackageManager: PackageManagerApk}, {}} {
+		if err := addWARPRepository(host, ""); err == nil || !strings.Contains(err.Error(), "no WARP client packages") {
+			t.Errorf("WARP repository on %s = %v, want no packages", host.describe(), err)
+		}
+	}
+}
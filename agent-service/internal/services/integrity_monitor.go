@@ -0,0 +1,517 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"hysteria2_microservices/agent-service/internal/config"
+	"hysteria2_microservices/agent-service/internal/secrets"
+)
+
+// Deployed config statuses
+const (
+	ConfigIntact   = "intact"
+	ConfigModified = "modified" // edited out of band since the agent wrote it
+	ConfigMissing  = "missing"  // removed out of band
+)
+
+// DiskUsage is the space and inodes left on the partition holding a directory the node
+// depends on
+type DiskUsage struct {
+	Path              string  `json:"path"`
+	TotalBytes        uint64  `json:"total_bytes"`
+	FreeBytes         uint64  `json:"free_bytes"` // available to unprivileged users, as df shows
+	UsedPercent       float64 `json:"used_percent"`
+	Inodes            uint64  `json:"inodes"`
+	FreeInodes        uint64  `json:"free_inodes"`
+	InodesUsedPercent float64 `json:"inodes_used_percent"`
+	Low               bool    `json:"low"` // space or inodes in use above integrity.disk_warn_percent
+}
+
+// ConfigIntegrity compares a deployed config with the hash the agent recorded when it wrote it
+type ConfigIntegrity struct {
+	Path       string    `json:"path"`
+	Status     string    `json:"status"`
+	Expected   string    `json:"expected,omitempty"` // SHA-256 of the content the agent wrote
+	Actual     string    `json:"actual,omitempty"`
+	ModifiedAt time.Time `json:"modified_at,omitzero"`
+}
+
+// IntegrityReport is the state of the node's partitions and deployed configs at one check
+type IntegrityReport struct {
+	Disks     []DiskUsage       `json:"disks"`
+	Configs   []ConfigIntegrity `json:"configs"`
+	CheckedAt time.Time         `json:"checked_at"`
+}
+
+// Drifted returns the paths of the configs that no longer match what the agent deployed
+func (r *IntegrityReport) Drifted() []string {
+	var paths []string
+	for _, file := range r.Configs {
+		if file.Status != ConfigIntact {
+			paths = append(paths, file.Path)
+		}
+	}
+	return paths
+}
+
+// LowDisks returns the directories whose partition runs out of space or inodes
+func (r *IntegrityReport) LowDisks() []string {
+	var paths []string
+	for _, disk := range r.Disks {
+		if disk.Low {
+			paths = append(paths, disk.Path)
+		}
+	}
+	return paths
+}
+
+// IntegrityReporter is called with the previous report, nil on the first check, and the new
+// one whenever the drifted configs or the partitions low on space change
+type IntegrityReporter func(previous, current *IntegrityReport)
+
+// IntegrityMonitorImpl checks the free space of the partitions holding the server configs,
+// certificates and logs, and whether the deployed configs still hold what the agent wrote.
+// Checks run one at a time; the last report is kept for the heartbeat.
+type IntegrityMonitorImpl struct {
+	logger *logrus.Logger
+	config *config.Config
+
+	checking sync.Mutex // held for the duration of a check
+
+	mu       sync.RWMutex
+	last     *IntegrityReport
+	reporter IntegrityReporter
+	cancel   context.CancelFunc
+}
+
+// NewIntegrityMonitor creates a new IntegrityMonitor
+func NewIntegrityMonitor(logger *logrus.Logger, cfg *config.Config) IntegrityMonitor {
+	return &IntegrityMonitorImpl{
+		logger: logger,
+		config: cfg,
+	}
+}
+
+// Start checks once right away, then every integrity.interval seconds until ctx is done
+func (im *IntegrityMonitorImpl) Start(ctx context.Context) error {
+	cfg := im.config.Integrity
+	if !cfg.Enabled {
+		return nil
+	}
+	interval := time.Duration(cfg.Interval) * time.Second
+	if interval <= 0 {
+		return fmt.Errorf("invalid integrity.interval %d", cfg.Interval)
+	}
+
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	if im.cancel != nil {
+		return fmt.Errorf("integrity checks are already running")
+	}
+
+	checkCtx, cancel := context.WithCancel(ctx)
+	im.cancel = cancel
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if _, err := im.Check(checkCtx); err != nil && checkCtx.Err() == nil {
+				im.logger.Warnf("Integrity check failed: %v", err)
+			}
+			select {
+			case <-checkCtx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	im.logger.Infof("Integrity checks started, every %s", interval)
+	return nil
+}
+
+// SetReporter sets where changes are sent
+func (im *IntegrityMonitorImpl) SetReporter(reporter IntegrityReporter) {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	im.reporter = reporter
+}
+
+// LastReport returns the report of the last finished check, or nil before the first
+func (im *IntegrityMonitorImpl) LastReport() *IntegrityReport {
+	im.mu.RLock()
+	defer im.mu.RUnlock()
+	return im.last
+}
+
+// Check measures the partitions and hashes the deployed configs now. A config the agent
+// has no hash of, written before the agent recorded them, is taken as deployed.
+func (im *IntegrityMonitorImpl) Check(ctx context.Context) (*IntegrityReport, error) {
+	im.checking.Lock()
+	defer im.checking.Unlock()
+
+	report := &IntegrityReport{}
+	for _, dir := range im.diskPaths() {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		usage, ok, err := diskUsage(dir)
+		if err != nil {
+			im.logger.Warnf("Failed to measure the partition of %s: %v", dir, err)
+			continue
+		}
+		if ok {
+			warn := float64(im.config.Integrity.DiskWarnPercent)
+			usage.Low = warn > 0 && (usage.UsedPercent >= warn || usage.InodesUsedPercent >= warn)
+			report.Disks = append(report.Disks, usage)
+		}
+	}
+
+	configs, err := im.checkConfigs()
+	if err != nil {
+		return nil, err
+	}
+	report.Configs = configs
+	report.CheckedAt = time.Now().UTC()
+
+	im.mu.Lock()
+	previous := im.last
+	im.last = report
+	reporter := im.reporter
+	im.mu.Unlock()
+
+	if previous == nil || !slices.Equal(previous.Drifted(), report.Drifted()) || !slices.Equal(previous.LowDisks(), report.LowDisks()) {
+		if drifted := report.Drifted(); len(drifted) > 0 {
+			im.logger.Warnf("Configs changed outside the agent: %v", drifted)
+		}
+		if low := report.LowDisks(); len(low) > 0 {
+			im.logger.Warnf("Partitions low on space or inodes: %v", low)
+		}
+		if reporter != nil {
+			reporter(previous, report)
+		}
+	}
+	return report, nil
+}
+
+func (im *IntegrityMonitorImpl) checkConfigs() ([]ConfigIntegrity, error) {
+	integrityManifestMu.Lock()
+	defer integrityManifestMu.Unlock()
+
+	manifest, err := loadIntegrityManifest(im.config.Integrity.ManifestFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var configs []ConfigIntegrity
+	baselined := false
+	for _, path := range deployedConfigPaths(im.config) {
+		expected, recorded := manifest.Files[path]
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			if recorded {
+				configs = append(configs, ConfigIntegrity{Path: path, Status: ConfigMissing, Expected: expected.SHA256})
+			}
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat %s: %w", path, err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		actual := contentHash(data)
+
+		if !recorded {
+			manifest.Files[path] = integrityEntry{SHA256: actual, DeployedAt: info.ModTime().UTC()}
+			expected = manifest.Files[path]
+			baselined = true
+			if err := saveDeployedCopy(im.config, data); err != nil {
+				im.logger.Warnf("Failed to keep a copy of %s, drift in it cannot be healed: %v", path, err)
+			}
+			im.logger.Infof("Recorded %s as deployed", path)
+		}
+		result := ConfigIntegrity{Path: path, Status: ConfigIntact, Expected: expected.SHA256, Actual: actual}
+		if actual != expected.SHA256 {
+			result.Status = ConfigModified
+			result.ModifiedAt = info.ModTime().UTC()
+		}
+		configs = append(configs, result)
+	}
+
+	if baselined {
+		if err := saveIntegrityManifest(im.config.Integrity.ManifestFile, manifest); err != nil {
+			return nil, err
+		}
+	}
+	return configs, nil
+}
+
+// diskPaths returns the directories whose partitions are checked: the configured ones and
+// the config and certificate directories of Hysteria2 and Xray
+func (im *IntegrityMonitorImpl) diskPaths() []string {
+	cfg := im.config
+	candidates := append([]string{}, cfg.Integrity.DiskPaths...)
+	candidates = append(candidates,
+		filepath.Dir(hysteria2ConfigPath),
+		cfg.Hysteria2.SNICertPath,
+		cfg.Hysteria2.SNIKeyPath,
+		cfg.Hysteria2.ACMEDir,
+	)
+	if cfg.Xray.ConfigPath != "" {
+		candidates = append(candidates, filepath.Dir(cfg.Xray.ConfigPath))
+	}
+	if cfg.Xray.CertPath != "" {
+		candidates = append(candidates, filepath.Dir(cfg.Xray.CertPath))
+	}
+
+	seen := make(map[string]bool)
+	var paths []string
+	for _, path := range candidates {
+		if path == "" {
+			continue
+		}
+		path = filepath.Clean(path)
+		if !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// diskUsage measures the partition holding dir. A directory that does not exist is skipped,
+// since a node only has the ones for the servers it runs.
+func diskUsage(dir string) (DiskUsage, bool, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		if os.IsNotExist(err) {
+			return DiskUsage{}, false, nil
+		}
+		return DiskUsage{}, false, err
+	}
+
+	blockSize := uint64(stat.Bsize)
+	usage := DiskUsage{
+		Path:       dir,
+		TotalBytes: stat.Blocks * blockSize,
+		FreeBytes:  stat.Bavail * blockSize,
+		Inodes:     stat.Files,
+		FreeInodes: stat.Ffree,
+	}
+	// Like df, blocks reserved for root count as neither used nor available
+	if used := stat.Blocks - stat.Bfree; used+stat.Bavail > 0 {
+		usage.UsedPercent = percentOf(used, used+stat.Bavail)
+	}
+	// Some filesystems, btrfs among them, allocate inodes dynamically and report none
+	if stat.Files > 0 {
+		usage.InodesUsedPercent = percentOf(stat.Files-stat.Ffree, stat.Files)
+	}
+	return usage, true, nil
+}
+
+func percentOf(part, total uint64) float64 {
+	return float64(int(float64(part)/float64(total)*10000)) / 100
+}
+
+// integrityManifestMu serializes reads and writes of the manifest by the writers of
+// deployed configs and the monitor
+var integrityManifestMu sync.Mutex
+
+type integrityEntry struct {
+	SHA256     string    `json:"sha256"`
+	DeployedAt time.Time `json:"deployed_at"`
+}
+
+type integrityManifest struct {
+	Files map[string]integrityEntry `json:"files"`
+}
+
+// deployedConfigPaths lists the configs the agent writes and watches for edits made
+// outside it: the server configs and the Hysteria2 ACLs
+func deployedConfigPaths(cfg *config.Config) []string {
+	var paths []string
+	for _, path := range []string{hysteria2ConfigPath, cfg.Xray.ConfigPath, cfg.Filter.HysteriaACLPath, warpACLPath} {
+		if path == "" {
+			continue
+		}
+		path = filepath.Clean(path)
+		if !slices.Contains(paths, path) {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// recordDeployedConfig records the content the agent wrote to a deployed config, nil when
+// it removed the file, so the integrity check does not take the change for drift. A copy
+// of the content is kept for restoreDeployedConfig. Paths that are not watched are ignored.
+func recordDeployedConfig(cfg *config.Config, path string, data []byte) error {
+	path = filepath.Clean(path)
+	if cfg.Integrity.ManifestFile == "" || !slices.Contains(deployedConfigPaths(cfg), path) {
+		return nil
+	}
+
+	integrityManifestMu.Lock()
+	defer integrityManifestMu.Unlock()
+
+	manifest, err := loadIntegrityManifest(cfg.Integrity.ManifestFile)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		delete(manifest.Files, path)
+	} else {
+		if err := saveDeployedCopy(cfg, data); err != nil {
+			return err
+		}
+		manifest.Files[path] = integrityEntry{SHA256: contentHash(data), DeployedAt: time.Now().UTC()}
+	}
+	if err := saveIntegrityManifest(cfg.Integrity.ManifestFile, manifest); err != nil {
+		return err
+	}
+	pruneDeployedCopies(cfg, manifest)
+	return nil
+}
+
+// restoreDeployedConfig writes back the content the agent last deployed to path, undoing
+// edits made outside it. Configs recorded before copies were kept cannot be restored.
+func restoreDeployedConfig(cfg *config.Config, path string) error {
+	path = filepath.Clean(path)
+
+	integrityManifestMu.Lock()
+	defer integrityManifestMu.Unlock()
+
+	manifest, err := loadIntegrityManifest(cfg.Integrity.ManifestFile)
+	if err != nil {
+		return err
+	}
+	entry, ok := manifest.Files[path]
+	if !ok {
+		return fmt.Errorf("no deployed content recorded for %s", path)
+	}
+	data, err := os.ReadFile(filepath.Join(deployedCopyDir(cfg), entry.SHA256))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("no copy of the content deployed to %s was kept", path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read the deployed copy of %s: %w", path, err)
+	}
+	if contentHash(data) != entry.SHA256 {
+		return fmt.Errorf("the deployed copy of %s is corrupt", path)
+	}
+
+	// Sealed configs are readable by root only, see writeGeneratedConfig
+	mode := os.FileMode(0644)
+	if secrets.ContainsSealed(data) {
+		mode = 0600
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create config directory: %w", err)
+	}
+	if err := os.WriteFile(path, data, mode); err != nil {
+		return err
+	}
+	return os.Chmod(path, mode)
+}
+
+// deployedCopyDir holds the content of the deployed configs next to the manifest, one file
+// per SHA-256
+func deployedCopyDir(cfg *config.Config) string {
+	return filepath.Join(filepath.Dir(cfg.Integrity.ManifestFile), "deployed")
+}
+
+func saveDeployedCopy(cfg *config.Config, data []byte) error {
+	if cfg.Integrity.ManifestFile == "" {
+		return nil
+	}
+	dir := deployedCopyDir(cfg)
+	path := filepath.Join(dir, contentHash(data))
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create deployed copy directory: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to keep deployed copy: %w", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// pruneDeployedCopies removes the copies of content no longer deployed; failures only leave
+// a stale copy behind
+func pruneDeployedCopies(cfg *config.Config, manifest *integrityManifest) {
+	entries, err := os.ReadDir(deployedCopyDir(cfg))
+	if err != nil {
+		return
+	}
+	deployed := make(map[string]bool, len(manifest.Files))
+	for _, entry := range manifest.Files {
+		deployed[entry.SHA256] = true
+	}
+	for _, entry := range entries {
+		if !deployed[entry.Name()] {
+			os.Remove(filepath.Join(deployedCopyDir(cfg), entry.Name()))
+		}
+	}
+}
+
+func loadIntegrityManifest(path string) (*integrityManifest, error) {
+	manifest := &integrityManifest{Files: make(map[string]integrityEntry)}
+	if path == "" {
+		return manifest, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return manifest, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read integrity manifest: %w", err)
+	}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse integrity manifest: %w", err)
+	}
+	if manifest.Files == nil {
+		manifest.Files = make(map[string]integrityEntry)
+	}
+	return manifest, nil
+}
+
+func saveIntegrityManifest(path string, manifest *integrityManifest) error {
+	if path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create integrity manifest directory: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write integrity manifest: %w", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
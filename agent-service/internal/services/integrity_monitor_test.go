@@ -0,0 +1,122 @@
+package services
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"hysteria2_microservices/agent-service/internal/config"
+)
+
+func newTestIntegrityMonitor(t *testing.T) (*IntegrityMonitorImpl, string) {
+	dir := t.TempDir()
+	cfg := &config.Config{}
+	cfg.Integrity.ManifestFile = filepath.Join(dir, "state", "integrity.json")
+	cfg.Integrity.DiskPaths = []string{dir, filepath.Join(dir, "missing")}
+	cfg.Xray.ConfigPath = filepath.Join(dir, "xray", "config.json")
+	if err := os.MkdirAll(filepath.Dir(cfg.Xray.ConfigPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return NewIntegrityMonitor(testLogger(), cfg).(*IntegrityMonitorImpl), cfg.Xray.ConfigPath
+}
+
+func configStatus(report *IntegrityReport, path string) string {
+	for _, file := range report.Configs {
+		if file.Path == path {
+			return file.Status
+		}
+	}
+	return ""
+}
+
+func TestIntegrityCheck(t *testing.T) {
+	im, xrayConfig := newTestIntegrityMonitor(t)
+	var reports int
+	im.SetReporter(func(previous, current *IntegrityReport) { reports++ })
+	ctx := context.Background()
+	os.WriteFile(xrayConfig, []byte(`{"inbounds": []}`), 0644)
+
+	// A config written before the agent recorded it is taken as deployed
+	report, err := im.Check(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := configStatus(report, xrayConfig); got != ConfigIntact {
+		t.Errorf("status of an unrecorded config = %q, want intact", got)
+	}
+	// Partitions of directories the node lacks are skipped
+	if len(report.Disks) != 2 || report.Disks[0].Path != im.config.Integrity.DiskPaths[0] || report.Disks[1].Path != filepath.Dir(xrayConfig) {
+		t.Errorf("disks = %+v, want the temporary and Xray config directories", report.Disks)
+	}
+	if low := report.LowDisks(); len(low) != 0 || report.Disks[0].TotalBytes == 0 {
+		t.Errorf("low disks = %v without a warning threshold", low)
+	}
+	if _, err := im.Check(ctx); err != nil || reports != 1 {
+		t.Errorf("unchanged check: %v, %d reports; want the first report only", err, reports)
+	}
+
+	os.WriteFile(xrayConfig, []byte(`{"inbounds": [{"port": 22}]}`), 0644)
+	report, _ = im.Check(ctx)
+	if drifted := report.Drifted(); len(drifted) != 1 || drifted[0] != xrayConfig || reports != 2 {
+		t.Errorf("drifted = %v with %d reports, want the edited config reported", drifted, reports)
+	}
+
+	// The edit is undone from the copy kept at deployment
+	if err := restoreDeployedConfig(im.config, xrayConfig); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(xrayConfig); string(data) != `{"inbounds": []}` {
+		t.Errorf("restored config = %s", data)
+	}
+	if report, _ = im.Check(ctx); len(report.Drifted()) != 0 || reports != 3 {
+		t.Errorf("drifted after the restore = %v with %d reports", report.Drifted(), reports)
+	}
+
+	os.Remove(xrayConfig)
+	if report, _ = im.Check(ctx); configStatus(report, xrayConfig) != ConfigMissing {
+		t.Errorf("status of a removed config = %q, want missing", configStatus(report, xrayConfig))
+	}
+	if im.LastReport() != report {
+		t.Error("last report is not the latest check")
+	}
+}
+
+func TestRecordDeployedConfig(t *testing.T) {
+	im, xrayConfig := newTestIntegrityMonitor(t)
+	ctx := context.Background()
+
+	// Content the agent writes itself is not drift
+	for _, content := range []string{`{"inbounds": []}`, `{"inbounds": [{"port": 443}]}`} {
+		os.WriteFile(xrayConfig, []byte(content), 0644)
+		if err := recordDeployedConfig(im.config, xrayConfig, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+		if report, _ := im.Check(ctx); configStatus(report, xrayConfig) != ConfigIntact {
+			t.Errorf("status after deploying %s = %q, want intact", content, configStatus(report, xrayConfig))
+		}
+	}
+	// Only the copy of the content deployed now is kept
+	if copies, _ := os.ReadDir(deployedCopyDir(im.config)); len(copies) != 1 || copies[0].Name() != contentHash([]byte(`{"inbounds": [{"port": 443}]}`)) {
+		t.Errorf("deployed copies = %v", copies)
+	}
+
+	// A config the agent removes is no longer expected
+	os.Remove(xrayConfig)
+	if err := recordDeployedConfig(im.config, xrayConfig, nil); err != nil {
+		t.Fatal(err)
+	}
+	if report, _ := im.Check(ctx); len(report.Configs) != 0 {
+		t.Errorf("configs after the removal = %+v", report.Configs)
+	}
+	if err := restoreDeployedConfig(im.config, xrayConfig); err == nil {
+		t.Error("restored a config the agent removed")
+	}
+
+	// Paths that are not watched are not recorded
+	other := filepath.Join(t.TempDir(), "notes.txt")
+	recordDeployedConfig(im.config, other, []byte("notes"))
+	if manifest, _ := loadIntegrityManifest(im.config.Integrity.ManifestFile); len(manifest.Files) != 0 {
+		t.Errorf("manifest = %+v, want nothing recorded", manifest.Files)
+	}
+}
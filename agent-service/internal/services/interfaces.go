@@ -3,6 +3,8 @@ package services
 import (
 	"context"
 	"time"
+
+	"hysteria2_microservices/pkg/events"
 )
 
 // ConfigManager handles configuration management
@@ -51,6 +53,13 @@ type NetworkManager interface {
 	GetWARPStatus() (map[string]interface{}, error)
 	RouteTrafficThroughWARP(interfaceName string) error
 	DisableWarpRouting() error
+
+	// Re-apply the saved masquerading and WARP routing rules, e.g. after a reboot
+	Reconcile() (*RoutingReport, error)
+	CheckRouting() (*RoutingReport, error)
+
+	// Remove the agent's iptables chains in an emergency
+	FlushAgentRules() ([]string, error)
 }
 
 // WARPManager handles Cloudflare WARP client operations
@@ -65,6 +74,7 @@ type WARPManager interface {
 	ConnectWARP() error
 	DisconnectWARP() error
 	RestartWARP() error
+	Reregister() error
 	IsWARPConnected() (bool, error)
 
 	// Proxy configuration
@@ -82,6 +92,8 @@ type WARPManager interface {
 	GetWARPStatus() (WARPStatus, error)
 	StartStatusMonitoring(ctx context.Context, interval time.Duration) (<-chan WARPStatus, error)
 	StopStatusMonitoring() error
+	CheckWARPHealth() error
+	GetWARPLogs(lines int) (string, error)
 
 	// Traffic routing
 	EnableTrafficRouting(interfaceName string) error
@@ -92,23 +104,27 @@ type WARPManager interface {
 	SetLicenseKey(licenseKey string) error
 	SetOrganization(organization string) error
 	GetLicenseInfo() (WARPLicenseInfo, error)
+	EnrollTeams(enrollment WARPTeamsEnrollment) error
+	UnenrollTeams() error
 }
 
 // WARPConfig holds WARP configuration
 type WARPConfig struct {
-	Enabled         bool     `json:"enabled"`
-	ProxyPort       int      `json:"proxy_port"`
-	AutoConnect     bool     `json:"auto_connect"`
-	NotifyOnFail    bool     `json:"notify_on_fail"`
-	ClientType      string   `json:"client_type"` // "local", "docker"
-	LicenseKey      string   `json:"license_key"`
-	Organization    string   `json:"organization"`
-	Mode            string   `json:"mode"` // "proxy", "warp"
-	DnsEnabled      bool     `json:"dns_enabled"`
-	DnsServers      []string `json:"dns_servers"`
-	ExcludeLAN      bool     `json:"exclude_lan"`
-	SplitTunnel     bool     `json:"split_tunnel"`
-	SplitTunnelApps []string `json:"split_tunnel_apps"`
+	Enabled           bool     `json:"enabled"`
+	ProxyPort         int      `json:"proxy_port"`
+	AutoConnect       bool     `json:"auto_connect"`
+	NotifyOnFail      bool     `json:"notify_on_fail"`
+	ClientType        string   `json:"client_type"` // "local", "docker"
+	LicenseKey        string   `json:"license_key"`
+	Organization      string   `json:"organization"`
+	TeamsClientID     string   `json:"teams_client_id,omitempty"`
+	TeamsClientSecret string   `json:"teams_client_secret,omitempty"`
+	Mode              string   `json:"mode"` // "proxy", "warp"
+	DnsEnabled        bool     `json:"dns_enabled"`
+	DnsServers        []string `json:"dns_servers"`
+	ExcludeLAN        bool     `json:"exclude_lan"`
+	SplitTunnel       bool     `json:"split_tunnel"`
+	SplitTunnelApps   []string `json:"split_tunnel_apps"`
 }
 
 // WARPStatus holds WARP status information
@@ -116,6 +132,7 @@ type WARPStatus struct {
 	Installed      bool          `json:"installed"`
 	Connected      bool          `json:"connected"`
 	Mode           string        `json:"mode"`
+	ClientType     string        `json:"client_type"` // "local", "docker"
 	ProxyPort      int           `json:"proxy_port"`
 	AccountType    string        `json:"account_type"`
 	Organization   string        `json:"organization"`
@@ -128,6 +145,19 @@ type WARPStatus struct {
 	BytesReceived  int64         `json:"bytes_received"`
 	Health         string        `json:"health"` // "good", "warning", "error"
 	Error          string        `json:"error,omitempty"`
+
+	// Zero Trust enrollment, set when the client belongs to Organization
+	DeviceID      string            `json:"device_id,omitempty"`
+	DevicePosture map[string]string `json:"device_posture,omitempty"` // Posture check ID -> result
+}
+
+// WARPTeamsEnrollment enrolls the WARP client into a Cloudflare Zero Trust organization,
+// either with a service token or with a complete mdm.xml from the Zero Trust dashboard
+type WARPTeamsEnrollment struct {
+	Organization string `json:"organization"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	MDMConfig    string `json:"mdm_config,omitempty"`
 }
 
 // WARPLicenseInfo holds license information
@@ -142,7 +172,7 @@ type WARPLicenseInfo struct {
 	Error        string    `json:"error,omitempty"`
 }
 
-// XrayManager handles Xray-core VPN server management for VLESS, Reality, and other protocols
+// XrayManager handles Xray-core VPN server management for VLESS, Reality, trojan and Shadowsocks-2022
 type XrayManager interface {
 	// Installation and lifecycle
 	InstallXray() error
@@ -159,13 +189,228 @@ type XrayManager interface {
 	// Protocol-specific configuration
 	ConfigureVLESS(uuid, dest string, flow string) error
 	ConfigureReality(dest, serverNames string, privateKey string, shortIds []string) error
+	SetRealityTargets(serverNames []string) error
 	GenerateRealityKeys() (privateKey, publicKey string, err error)
+	ConfigureTrojan(password string) error
+	ConfigureShadowsocks2022(method, password string) error
+
+	// Inbound and user management on the server config
+	ConfigPath() string
+	CurrentConfig() (string, error)
+	SaveConfig(content string) error
+	HasInbound(protocol string) (bool, error)
+	AddInbound(protocol string) error
+	RemoveInbound(protocol string) error
+	AddUser(protocol string, user XrayUser) (XrayUser, error)
+	RemoveUser(protocol, email string) error
+	SetFilterRules(rules []map[string]interface{}) error
+	SetProfileRouting(outbounds, balancers, rules []map[string]interface{}) error
+
+	// Online clients through the Xray handler and stats API
+	GetConnections(ctx context.Context) ([]XrayConnection, error)
+	DisconnectClients(ctx context.Context, userID, deviceID string) ([]XrayConnection, error)
 
 	// Certificate management for Reality
 	GenerateRealityCert(domain string) error
 	ValidateRealityCert(domain string) (bool, error)
 }
 
+// DecoyManager serves a decoy website to non-VPN traffic hitting the node on TCP 443
+type DecoyManager interface {
+	InstallSite() error
+	Start(ctx context.Context) error
+	Stop() error
+	IsRunning() bool
+	ReloadCertificates()
+	GetStatus() map[string]interface{}
+}
+
+// QUICRelay fronts Hysteria2 with a UDP relay that pads, scrambles and jitters QUIC packets
+type QUICRelay interface {
+	Start(ctx context.Context) error
+	Stop() error
+	IsRunning() bool
+	GetStats() map[string]interface{}
+}
+
+// PortMux shares one TCP port between Xray and the decoy site by routing on TLS SNI and ALPN
+type PortMux interface {
+	Start(ctx context.Context) error
+	Stop() error
+	IsRunning() bool
+	GetStats() map[string]interface{}
+}
+
+// ProtocolReconciler converges running services to the per-node protocol matrix
+type ProtocolReconciler interface {
+	Reconcile(desired map[string]bool) (map[string]string, error)
+	GetProtocols() map[string]bool
+}
+
+// DNSResolver answers DNS on the node over DoH and keeps plaintext DNS from leaving it
+type DNSResolver interface {
+	Start(ctx context.Context) error
+	Stop() error
+	IsRunning() bool
+	GetStats() map[string]interface{}
+	CheckLeaks() DNSLeakCheckResult
+	LastLeakCheck() *DNSLeakCheckResult
+	SetPolicy(policy DNSPolicy) error
+	GetPolicy() DNSPolicy
+}
+
+// FirewallManager keeps the node behind a default-deny inbound ruleset
+type FirewallManager interface {
+	EnsureBaseline() error
+	Apply(backend string, rules []FirewallRule) error
+	Restore() error
+	GetRules() (*FirewallStatus, error)
+	Verify() ([]string, error)
+	Ban(ip string, duration time.Duration) error
+	Unban(ip string) error
+	Close()
+}
+
+// BruteForceGuard bans addresses that keep failing authentication
+type BruteForceGuard interface {
+	Start(ctx context.Context) error
+	Stop() error
+	IsRunning() bool
+	ListBans() []BanEntry
+	Unban(ip string) error
+	SetEventReporter(reporter BanEventReporter)
+}
+
+// SecretRotator re-reads config secrets kept in external stores and restarts the servers
+// using the ones that changed
+type SecretRotator interface {
+	Start(ctx context.Context) error
+}
+
+// SessionTracker reports clients connecting to and disconnecting from the node and
+// disconnects the clients the api-service hands back. With an event bus it also publishes
+// the traffic of every client since the previous poll.
+type SessionTracker interface {
+	Start(ctx context.Context) error
+	Kick(ctx context.Context, clientIDs []string) error
+	SetEventBus(bus *events.Bus)
+}
+
+// ContentFilter compiles domain blocklists and allowlists into Xray routing and the Hysteria2 ACL
+type ContentFilter interface {
+	Start(ctx context.Context) error
+	Stop() error
+	SetLists(lists []FilterList) error
+	GetStatus() []FilterListStatus
+}
+
+// RoutingProfileManager compiles routing profiles into Xray routing and balancers and
+// Hysteria2 outbounds and ACL rules
+type RoutingProfileManager interface {
+	Start(ctx context.Context) error
+	SetProfiles(profiles []RoutingProfile) error
+}
+
+// OutboundPolicyManager chooses which outbound Hysteria2 sends each destination to
+type OutboundPolicyManager interface {
+	Start(ctx context.Context) error
+	SetPolicy(policy *OutboundPolicy) error
+	GetPolicy() *OutboundPolicy
+}
+
+// ProbeRunner runs active-probing checks and TLS checks from this node against another node
+type ProbeRunner interface {
+	Run(ctx context.Context, target ProbeTarget) (*ProbeReport, error)
+	CheckTLS(ctx context.Context, target ProbeTarget) (*TLSReport, error)
+}
+
+// SpeedtestRunner measures latency and throughput between this node and reflectors
+type SpeedtestRunner interface {
+	Run(ctx context.Context, reflectors []SpeedtestReflector, duration int) ([]SpeedtestResult, error)
+}
+
+// EgressMonitor checks the reputation of the addresses the node's traffic leaves from
+type EgressMonitor interface {
+	Start(ctx context.Context) error
+	Check(ctx context.Context) (*EgressReport, error)
+	LastReport() *EgressReport
+	SetReporter(reporter EgressReporter)
+}
+
+// WARPFailover moves the traffic meant for WARP to a backup egress while WARP is unhealthy
+type WARPFailover interface {
+	Start(ctx context.Context) error
+	State() WARPFailoverState
+	SetReporter(reporter WARPFailoverReporter)
+}
+
+// WARPRotator gives WARP a new egress on a schedule and when its address gets blocklisted
+type WARPRotator interface {
+	Start(ctx context.Context) error
+	Rotate(ctx context.Context, reason string) error
+	State() WARPRotationState
+	SetReporter(reporter WARPRotationReporter)
+}
+
+// IntegrityMonitor checks the free space of the partitions the node depends on and whether
+// the deployed configs were edited outside the agent
+type IntegrityMonitor interface {
+	Start(ctx context.Context) error
+	Check(ctx context.Context) (*IntegrityReport, error)
+	LastReport() *IntegrityReport
+	SetReporter(reporter IntegrityReporter)
+}
+
+// DriftDetector compares the node's configs, firewall, routing and servers with their
+// desired state and re-applies it
+type DriftDetector interface {
+	Check(ctx context.Context, desired map[string]bool) (*DriftReport, error)
+	Heal(ctx context.Context, desired map[string]bool) (*DriftHealReport, error)
+}
+
+// AdmissionController rejects new client connections once the node reaches its capacity
+type AdmissionController interface {
+	Start(ctx context.Context) error
+	SetLimits(limits CapacityLimits) error
+	Limits() CapacityLimits
+	Utilization() *CapacityUtilization
+}
+
+// QoSManager sets up the queueing and DSCP marking of the node's egress traffic
+type QoSManager interface {
+	Start(ctx context.Context) error
+	SetPolicy(ctx context.Context, policy QoSPolicy) (*QoSStatus, error)
+	Status() *QoSStatus
+	Latency() *QoSLatency
+}
+
+// PortForwarder exposes services users run elsewhere on public ports of the node
+type PortForwarder interface {
+	Start(ctx context.Context) error
+	Add(forward PortForward) (*PortForward, error)
+	Remove(id string) error
+	List() []PortForward
+	Range() (minPort, maxPort int)
+}
+
+// HysteriaUpdater manages the installed Hysteria2 release
+type HysteriaUpdater interface {
+	CheckUpdates(ctx context.Context) (*ComponentVersion, error)
+	Upgrade(ctx context.Context, version string) (*UpgradeResult, error)
+}
+
+// XrayUpdater manages the installed Xray-core release
+type XrayUpdater interface {
+	CheckUpdates(ctx context.Context) (*ComponentVersion, error)
+	Upgrade(ctx context.Context, version string) (*UpgradeResult, error)
+}
+
+// NodeBackup reads and restores the node files needed to recover it after a loss
+type NodeBackup interface {
+	Collect() ([]NodeFile, error)
+	Restore(files []NodeFile) error
+}
+
 // LocalServices aggregates all local services
 type LocalServices struct {
 	ConfigManager    ConfigManager
@@ -175,4 +420,29 @@ type LocalServices struct {
 	HysteriaManager  HysteriaManager
 	XrayManager      XrayManager
 	WARPManager      WARPManager
+	DecoyManager     DecoyManager
+	QUICRelay        QUICRelay
+	PortMux          PortMux
+	Protocols        ProtocolReconciler
+	DNSResolver      DNSResolver
+	Firewall         FirewallManager
+	BruteForceGuard  BruteForceGuard
+	ContentFilter    ContentFilter
+	RoutingProfiles  RoutingProfileManager
+	OutboundPolicy   OutboundPolicyManager
+	ProbeRunner      ProbeRunner
+	Speedtest        SpeedtestRunner
+	EgressMonitor    EgressMonitor
+	WARPFailover     WARPFailover
+	WARPRotator      WARPRotator
+	Integrity        IntegrityMonitor
+	Drift            DriftDetector
+	Admission        AdmissionController
+	QoS              QoSManager
+	PortForwards     PortForwarder
+	HysteriaUpdater  HysteriaUpdater
+	XrayUpdater      XrayUpdater
+	SecretRotator    SecretRotator
+	SessionTracker   SessionTracker
+	NodeBackup       NodeBackup
 }
@@ -0,0 +1,100 @@
+package services
+
+import (
+	"net"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"hysteria2_microservices/agent-service/internal/config"
+	"hysteria2_microservices/agent-service/internal/privsep"
+)
+
+// ipFamily holds what differs between IPv4 and IPv6 when programming the kernel.
+// ip6tables covers both the legacy and the nftables backend (iptables-nft).
+type ipFamily struct {
+	name            string
+	iptables        string
+	iptablesSave    string
+	iptablesRestore string
+	ruleset         string // the file iptables-restore loads, see privsep.RulesetDir
+	forwarding      string // sysctl that enables forwarding
+	localRanges     []string
+}
+
+var (
+	ipv4Family = ipFamily{
+		name:            "IPv4",
+		iptables:        "iptables",
+		iptablesSave:    "iptables-save",
+		iptablesRestore: "iptables-restore",
+		ruleset:         privsep.IPTablesRuleset,
+		forwarding:      "net.ipv4.ip_forward",
+		localRanges: []string{
+			"127.0.0.0/8",
+			"10.0.0.0/8",
+			"172.16.0.0/12",
+			"192.168.0.0/16",
+			"100.64.0.0/10",
+		},
+	}
+	ipv6Family = ipFamily{
+		name:            "IPv6",
+		iptables:        "ip6tables",
+		iptablesSave:    "ip6tables-save",
+		iptablesRestore: "ip6tables-restore",
+		ruleset:         privsep.IP6TablesRuleset,
+		forwarding:      "net.ipv6.conf.all.forwarding",
+		localRanges: []string{
+			"::1/128",
+			"fc00::/7",
+			"fe80::/10",
+		},
+	}
+)
+
+// ipFamilies returns IPv4, plus IPv6 when it is enabled in the config and on the host
+func ipFamilies(cfg *config.Config) []ipFamily {
+	if ipv6Enabled(cfg) {
+		return []ipFamily{ipv4Family, ipv6Family}
+	}
+	return []ipFamily{ipv4Family}
+}
+
+// ipv6Enabled reports whether the node should serve and route IPv6
+func ipv6Enabled(cfg *config.Config) bool {
+	return cfg.Network.EnableIPv6 && hostHasIPv6()
+}
+
+// hostHasIPv6 reports whether the kernel has IPv6 enabled and a global IPv6 address is configured
+func hostHasIPv6() bool {
+	if data, err := os.ReadFile("/proc/sys/net/ipv6/conf/all/disable_ipv6"); err == nil && strings.TrimSpace(string(data)) != "0" {
+		return false
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() == nil && ipnet.IP.IsGlobalUnicast() {
+			return true
+		}
+	}
+	return false
+}
+
+// forEachFamily runs apply for every enabled family. IPv4 errors are returned; IPv6 errors
+// are logged so that a host with partial IPv6 support keeps working over IPv4.
+func forEachFamily(cfg *config.Config, logger *logrus.Logger, apply func(family ipFamily) error) error {
+	for _, family := range ipFamilies(cfg) {
+		if err := apply(family); err != nil {
+			if family.name == ipv6Family.name {
+				logger.Warnf("Failed to apply IPv6 rules, IPv6 traffic may bypass them: %v", err)
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
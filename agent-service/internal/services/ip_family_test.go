@@ -0,0 +1,242 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"hysteria2_microservices/agent-service/internal/config"
+	"hysteria2_microservices/agent-service/internal/hysteriaconfig"
+)
+
+// commandFakes are scripts first on PATH standing in for system commands
+type commandFakes struct {
+	dir string
+}
+
+// newCommandFakes puts an empty directory for fake commands first on PATH
+func newCommandFakes(t *testing.T) *commandFakes {
+	f := &commandFakes{dir: t.TempDir()}
+	t.Setenv("PATH", f.dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return f
+}
+
+// install writes script as the command name
+func (f *commandFakes) install(t *testing.T, name, script string) {
+	if err := os.WriteFile(filepath.Join(f.dir, name), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fakeCommands puts scripts for names first on PATH. Each records its command line, prints
+// the output set for it and exits with the status exits gives "name arg" when arg is among
+// its arguments, or 0.
+func fakeCommands(t *testing.T, exits map[string]int, names ...string) *commandFakes {
+	f := newCommandFakes(t)
+	for _, name := range names {
+		script := fmt.Sprintf("#!/bin/sh\necho \"%s $*\" >> %s\n", name, filepath.Join(f.dir, "calls.log"))
+		script += fmt.Sprintf("[ -f %[1]s ] && cat %[1]s\n", filepath.Join(f.dir, name+".out"))
+		for arg, code := range exits {
+			if strings.HasPrefix(arg, name+" ") {
+				script += fmt.Sprintf("case \" $* \" in *\" %s \"*) exit %d;; esac\n", strings.TrimPrefix(arg, name+" "), code)
+			}
+		}
+		f.install(t, name, script+"exit 0\n")
+	}
+	return f
+}
+
+// calls returns the command lines run so far
+func (f *commandFakes) calls() []string {
+	data, _ := os.ReadFile(filepath.Join(f.dir, "calls.log"))
+	if len(data) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+// setOutput makes name print output whenever it runs
+func (f *commandFakes) setOutput(t *testing.T, name, output string) {
+	if err := os.WriteFile(filepath.Join(f.dir, name+".out"), []byte(output), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func callsTo(calls []string, name string) []string {
+	var matched []string
+	for _, call := range calls {
+		if strings.HasPrefix(call, name+" ") {
+			matched = append(matched, call)
+		}
+	}
+	return matched
+}
+
+func newTestNetworkManager(t *testing.T, enableIPv6 bool) *NetworkManagerImpl {
+	cfg := &config.Config{}
+	cfg.Network.EnableIPv6 = enableIPv6
+	cfg.Network.StateFile = filepath.Join(t.TempDir(), "routing.json")
+	return NewNetworkManager(testLogger(), cfg).(*NetworkManagerImpl)
+}
+
+func TestMasqueradingSkipsIPv6WhenDisabled(t *testing.T) {
+	fakes := fakeCommands(t, map[string]int{"iptables -C": 1}, "sysctl", "iptables", "ip6tables")
+	nm := newTestNetworkManager(t, false)
+
+	if err := nm.EnableMasquerading("eth0"); err != nil {
+		t.Fatalf("EnableMasquerading: %v", err)
+	}
+	got := fakes.calls()
+	if sysctl := callsTo(got, "sysctl"); len(sysctl) != 1 || sysctl[0] != "sysctl -w net.ipv4.ip_forward=1" {
+		t.Errorf("sysctl calls %v, want IPv4 forwarding only", sysctl)
+	}
+	if added := callsTo(got, "iptables"); len(added) != 2 || !strings.HasPrefix(added[1], "iptables -t nat -A POSTROUTING -o eth0 -j MASQUERADE") {
+		t.Errorf("iptables calls %v, want a check then the MASQUERADE rule", added)
+	}
+	if v6 := callsTo(got, "ip6tables"); len(v6) != 0 {
+		t.Errorf("ip6tables called with IPv6 disabled: %v", v6)
+	}
+}
+
+func TestMasqueradingPerFamily(t *testing.T) {
+	fakes := fakeCommands(t, map[string]int{"iptables -C": 1, "ip6tables -C": 1}, "sysctl", "iptables", "ip6tables")
+	nm := newTestNetworkManager(t, true)
+
+	if err := nm.EnableMasquerading("eth0"); err != nil {
+		t.Fatalf("EnableMasquerading: %v", err)
+	}
+	if err := nm.DisableMasquerading("eth0"); err != nil {
+		t.Fatalf("DisableMasquerading: %v", err)
+	}
+
+	// IPv6 rules follow the IPv4 ones only when the host has IPv6
+	got := fakes.calls()
+	var want []string
+	if hostHasIPv6() {
+		want = []string{
+			"ip6tables -t nat -C POSTROUTING -o eth0 -j MASQUERADE",
+			"ip6tables -t nat -A POSTROUTING -o eth0 -j MASQUERADE",
+			"ip6tables -t nat -D POSTROUTING -o eth0 -j MASQUERADE",
+		}
+		if sysctl := callsTo(got, "sysctl"); len(sysctl) != 2 || sysctl[1] != "sysctl -w net.ipv6.conf.all.forwarding=1" {
+			t.Errorf("sysctl calls %v, want IPv4 then IPv6 forwarding", sysctl)
+		}
+	}
+	if v6 := callsTo(got, "ip6tables"); strings.Join(v6, "\n") != strings.Join(want, "\n") {
+		t.Errorf("ip6tables calls %v, want %v", v6, want)
+	}
+	if v4 := callsTo(got, "iptables"); len(v4) != 3 || v4[2] != "iptables -t nat -D POSTROUTING -o eth0 -j MASQUERADE" {
+		t.Errorf("iptables calls %v, want check, add and delete", v4)
+	}
+}
+
+func TestMasqueradingIgnoresIPv6Failures(t *testing.T) {
+	if !hostHasIPv6() {
+		t.Skip("host has no IPv6")
+	}
+	fakeCommands(t, map[string]int{"iptables -C": 1, "ip6tables -C": 1, "ip6tables nat": 3}, "sysctl", "iptables", "ip6tables")
+	nm := newTestNetworkManager(t, true)
+
+	// A host with a broken ip6tables keeps IPv4 masquerading
+	if err := nm.EnableMasquerading("eth0"); err != nil {
+		t.Errorf("EnableMasquerading failed on an IPv6 error: %v", err)
+	}
+	if enabled, _ := nm.IsMasqueradingEnabled("eth0"); enabled {
+		t.Error("IsMasqueradingEnabled with the IPv4 rule missing")
+	}
+}
+
+func TestRoutingChainsKeepLocalRangesPerFamily(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.DNS.ListenAddr = "127.0.0.1:5353"
+	tr := NewTrafficRouter(testLogger(), cfg).(*TrafficRouterImpl)
+
+	for _, tt := range []struct {
+		family ipFamily
+		want   string
+		other  string
+	}{
+		{ipv4Family, "-d 10.0.0.0/8 -j RETURN", "-d fc00::/7 -j RETURN"},
+		{ipv6Family, "-d fc00::/7 -j RETURN", "-d 10.0.0.0/8 -j RETURN"},
+	} {
+		rules := strings.Join(tr.routingChains(tt.family, 40000, "hy0")[0].Rules, "\n")
+		if !strings.Contains(rules, tt.want) || strings.Contains(rules, tt.other) {
+			t.Errorf("%s WARP chain:\n%s\nwant %q and not %q", tt.family.name, rules, tt.want, tt.other)
+		}
+		if !strings.Contains(rules, "-p udp --dport 53 -j REDIRECT --to-ports 5353") {
+			t.Errorf("%s WARP chain does not send DNS to the local resolver:\n%s", tt.family.name, rules)
+		}
+	}
+}
+
+func TestWARPACLKeepsLocalRangesDirect(t *testing.T) {
+	rules, err := warpACLRules(&config.Config{}, true)
+	if err != nil {
+		t.Fatalf("warpACLRules: %v", err)
+	}
+	direct := map[string]bool{}
+	for _, rule := range rules[:len(rules)-1] {
+		if rule.Outbound == hysteriaDirectOutbound && rule.Match == hysteriaconfig.ACLMatchCIDR {
+			direct[rule.Value] = true
+		}
+	}
+	for _, cidr := range []string{"10.0.0.0/8", "100.64.0.0/10", "::1/128", "fc00::/7", "fe80::/10"} {
+		if !direct[cidr] {
+			t.Errorf("%s does not stay on the node", cidr)
+		}
+	}
+	if last := rules[len(rules)-1]; last.Outbound != hysteriaWARPOutbound || last.Match != hysteriaconfig.ACLMatchAll {
+		t.Errorf("last rule %+v, want everything else through WARP", last)
+	}
+}
+
+func TestListenAddressesFollowIPv6(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Hysteria2.DefaultListenPort = 443
+	hm := NewHysteriaManager(testLogger(), cfg).(*HysteriaManagerImpl)
+	xm := NewXrayManager(testLogger(), cfg).(*XrayManagerImpl)
+
+	inbound := map[string]interface{}{"protocol": "vless"}
+	xm.bindInbound(inbound)
+	if addr := hm.listenAddress(); addr != ":443" || inbound["listen"] != nil {
+		t.Errorf("with IPv6 disabled: Hysteria2 on %q, Xray on %v", addr, inbound["listen"])
+	}
+
+	cfg.Network.EnableIPv6 = true
+	inbound = map[string]interface{}{"protocol": "vless"}
+	xm.bindInbound(inbound)
+	wantHysteria, wantXray := ":443", interface{}(nil)
+	if hostHasIPv6() {
+		wantHysteria, wantXray = "[::]:443", "::"
+	}
+	if addr := hm.listenAddress(); addr != wantHysteria || inbound["listen"] != wantXray {
+		t.Errorf("with IPv6 enabled: Hysteria2 on %q, Xray on %v; want %q and %v", addr, inbound["listen"], wantHysteria, wantXray)
+	}
+
+	// An explicit address is kept
+	inbound = map[string]interface{}{"protocol": "vless", "listen": "203.0.113.10"}
+	xm.bindInbound(inbound)
+	if inbound["listen"] != "203.0.113.10" {
+		t.Errorf("explicit listen address replaced with %v", inbound["listen"])
+	}
+}
+
+func TestContainsIP(t *testing.T) {
+	records := []string{"203.0.113.10", "2001:db8::1"}
+	for _, tt := range []struct {
+		ip   string
+		want bool
+	}{
+		{"203.0.113.10", true},
+		{"2001:0db8:0:0::1", true},
+		{"2001:db8::2", false},
+		{"::ffff:203.0.113.11", false},
+		{"", false},
+	} {
+		if got := containsIP(records, tt.ip); got != tt.want {
+			t.Errorf("containsIP(%q) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	"hysteria2_microservices/agent-service/internal/privsep"
+)
+
+// agentChainPrefix starts the name of every iptables chain the agent owns
+const agentChainPrefix = "HYSTERIA2-"
+
+// iptablesChain is a chain owned by the agent. It is replaced as a whole and jumped to
+// from a built-in chain of its table.
+type iptablesChain struct {
+	Table string
+	Name  string
+	Hook  string   // built-in chain that jumps to it, e.g. "OUTPUT"
+	Rules []string // rule specs appended to the chain, without "-A <chain>"
+}
+
+// iptablesRuleset renders chains in iptables-restore format for a --noflush restore: each
+// chain is created or flushed and refilled, and the jump from its hook is added unless the
+// current ruleset, as printed by iptables-save, already has it. The tables are committed
+// one at a time, so a failure can leave earlier tables replaced; see applyIPTablesRuleset.
+func iptablesRuleset(current string, chains []iptablesChain) string {
+	jumps := make(map[string]bool)
+	table := ""
+	for _, line := range strings.Split(current, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "*") {
+			table = line[1:]
+		} else if strings.HasPrefix(line, "-A ") {
+			jumps[table+" "+line] = true
+		}
+	}
+
+	var b strings.Builder
+	for i, chain := range chains {
+		if i == 0 || chains[i-1].Table != chain.Table {
+			fmt.Fprintf(&b, "*%s\n", chain.Table)
+		}
+		fmt.Fprintf(&b, ":%s - [0:0]\n", chain.Name)
+		for _, rule := range chain.Rules {
+			fmt.Fprintf(&b, "-A %s %s\n", chain.Name, rule)
+		}
+		if jump := fmt.Sprintf("-A %s -j %s", chain.Hook, chain.Name); !jumps[chain.Table+" "+jump] {
+			b.WriteString(jump + "\n")
+		}
+		if i == len(chains)-1 || chains[i+1].Table != chain.Table {
+			b.WriteString("COMMIT\n")
+		}
+	}
+	return b.String()
+}
+
+// applyIPTablesRuleset installs the chains for one family with iptables-restore. The
+// ruleset in force is saved first and restored in full if any table fails to apply, so a
+// failure never leaves a partial ruleset behind.
+func applyIPTablesRuleset(logger *logrus.Logger, family ipFamily, chains []iptablesChain) error {
+	snapshot, err := runIPTablesCommand(logger, family.iptablesSave)
+	if err != nil {
+		return fmt.Errorf("failed to save %s rules: %w", family.name, err)
+	}
+
+	if err := restoreIPTables(logger, family, iptablesRuleset(snapshot, chains), "--noflush"); err != nil {
+		if rbErr := restoreIPTables(logger, family, snapshot); rbErr != nil {
+			return fmt.Errorf("failed to apply %s rules: %v; restoring the previous rules also failed: %w", family.name, err, rbErr)
+		}
+		return fmt.Errorf("failed to apply %s rules, previous rules restored: %w", family.name, err)
+	}
+	return nil
+}
+
+// withoutIPTablesChains drops the chains named with prefix, their rules and the rules
+// jumping to them from a ruleset printed by iptables-save. It returns the ruleset left and
+// the chains dropped, as "<table> <chain>".
+func withoutIPTablesChains(current, prefix string) (string, []string) {
+	var b strings.Builder
+	var dropped []string
+	table := ""
+	for _, line := range strings.Split(current, "\n") {
+		trimmed := strings.TrimSpace(line)
+		fields := strings.Fields(trimmed)
+		switch {
+		case strings.HasPrefix(trimmed, "*"):
+			table = trimmed[1:]
+		case strings.HasPrefix(trimmed, ":"+prefix):
+			dropped = append(dropped, table+" "+strings.TrimPrefix(fields[0], ":"))
+			continue
+		case len(fields) >= 2 && fields[0] == "-A" && strings.HasPrefix(fields[1], prefix):
+			continue
+		case jumpsTo(fields, prefix):
+			continue
+		}
+		b.WriteString(line + "\n")
+	}
+	return strings.TrimSuffix(b.String(), "\n"), dropped
+}
+
+// jumpsTo tells whether the rule fields jump or go to a chain named with prefix
+func jumpsTo(fields []string, prefix string) bool {
+	for i := 0; i+1 < len(fields); i++ {
+		if (fields[i] == "-j" || fields[i] == "-g") && strings.HasPrefix(fields[i+1], prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// restoreMu keeps one ruleset file written and loaded at a time
+var restoreMu sync.Mutex
+
+// restoreIPTables loads ruleset with the family's iptables-restore. The privilege helper only
+// lets it read the family's fixed ruleset file, so the ruleset is written there first.
+func restoreIPTables(logger *logrus.Logger, family ipFamily, ruleset string, args ...string) error {
+	restoreMu.Lock()
+	defer restoreMu.Unlock()
+	if err := privsep.WriteFile(family.ruleset, []byte(ruleset), 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", family.ruleset, err)
+	}
+	_, err := runIPTablesCommand(logger, family.iptablesRestore, append(args, family.ruleset)...)
+	return err
+}
+
+func runIPTablesCommand(logger *logrus.Logger, name string, args ...string) (string, error) {
+	logger.Debugf("Running command: %s %v", name, args)
+	if err := injectCommandFault(name, args...); err != nil {
+		return "", err
+	}
+	cmd := privsep.Command(name, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
@@ -0,0 +1,54 @@
+package services
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// Hysteria2 masquerade modes
+const (
+	MasqueradeTypeString = "string"
+	MasqueradeTypeFile   = "file"
+	MasqueradeTypeProxy  = "proxy"
+
+	defaultMasqueradeProxyURL = "https://www.google.com"
+)
+
+// MasqueradeSettings describes what Hysteria2 serves to clients that fail authentication
+type MasqueradeSettings struct {
+	Type          string
+	ProxyURL      string
+	RewriteHost   bool
+	FileDir       string
+	StringContent string
+	StringStatus  int
+	StringHeaders map[string]string
+}
+
+// Validate checks that the settings required by the selected mode are present
+func (s MasqueradeSettings) Validate() error {
+	switch s.Type {
+	case MasqueradeTypeProxy:
+		if s.ProxyURL == "" {
+			return fmt.Errorf("proxy URL is required for proxy masquerade")
+		}
+		u, err := url.Parse(s.ProxyURL)
+		if err != nil {
+			return fmt.Errorf("invalid proxy URL: %w", err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("proxy URL must be an absolute http(s) URL")
+		}
+	case MasqueradeTypeFile:
+		if s.FileDir == "" {
+			return fmt.Errorf("directory is required for file masquerade")
+		}
+	case MasqueradeTypeString:
+		if s.StringStatus != 0 && (s.StringStatus < 100 || s.StringStatus > 599) {
+			return fmt.Errorf("invalid status code %d", s.StringStatus)
+		}
+	default:
+		return fmt.Errorf("unsupported masquerade type %q", s.Type)
+	}
+	return nil
+}
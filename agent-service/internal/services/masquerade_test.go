@@ -0,0 +1,150 @@
+package services
+
+import (
+	"io"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"hysteria2_microservices/agent-service/internal/config"
+	"hysteria2_microservices/agent-service/internal/hysteriaconfig"
+)
+
+// testLogger discards what the services under test log
+func testLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logger
+}
+
+func TestMasqueradeSettingsValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings MasqueradeSettings
+		wantErr  bool
+	}{
+		{"proxy", MasqueradeSettings{Type: MasqueradeTypeProxy, ProxyURL: "https://example.com"}, false},
+		{"proxy without URL", MasqueradeSettings{Type: MasqueradeTypeProxy}, true},
+		{"proxy with relative URL", MasqueradeSettings{Type: MasqueradeTypeProxy, ProxyURL: "example.com/path"}, true},
+		{"proxy to another scheme", MasqueradeSettings{Type: MasqueradeTypeProxy, ProxyURL: "ftp://example.com"}, true},
+		{"file", MasqueradeSettings{Type: MasqueradeTypeFile, FileDir: "/var/www/decoy"}, false},
+		{"file without directory", MasqueradeSettings{Type: MasqueradeTypeFile}, true},
+		{"string with default status", MasqueradeSettings{Type: MasqueradeTypeString, StringContent: "hello"}, false},
+		{"string with status", MasqueradeSettings{Type: MasqueradeTypeString, StringStatus: 404}, false},
+		{"string with invalid status", MasqueradeSettings{Type: MasqueradeTypeString, StringStatus: 42}, true},
+		{"unknown type", MasqueradeSettings{Type: "redirect"}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.settings.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: Validate() = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func newTestHysteriaManager(t *testing.T) (*HysteriaManagerImpl, *config.Config) {
+	cfg := &config.Config{}
+	return NewHysteriaManager(testLogger(), cfg).(*HysteriaManagerImpl), cfg
+}
+
+func TestConfigureMasquerade(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name     string
+		settings MasqueradeSettings
+		want     *hysteriaconfig.Masquerade
+	}{
+		{
+			name:     "proxy",
+			settings: MasqueradeSettings{Type: MasqueradeTypeProxy, ProxyURL: "https://news.example.com", RewriteHost: true},
+			want: &hysteriaconfig.Masquerade{
+				Type:  "proxy",
+				Proxy: &hysteriaconfig.MasqueradeProxyTo{URL: "https://news.example.com", RewriteHost: true},
+			},
+		},
+		{
+			name:     "file",
+			settings: MasqueradeSettings{Type: MasqueradeTypeFile, FileDir: dir},
+			want: &hysteriaconfig.Masquerade{
+				Type: "file",
+				File: &hysteriaconfig.MasqueradeFileDir{Dir: dir},
+			},
+		},
+		{
+			name:     "string with default status",
+			settings: MasqueradeSettings{Type: MasqueradeTypeString, StringContent: "Not here"},
+			want: &hysteriaconfig.Masquerade{
+				Type:   "string",
+				String: &hysteriaconfig.MasqueradeBody{Content: "Not here", StatusCode: 200},
+			},
+		},
+		{
+			name: "string with headers",
+			settings: MasqueradeSettings{
+				Type:          MasqueradeTypeString,
+				StringContent: "gone",
+				StringStatus:  410,
+				StringHeaders: map[string]string{"Server": "nginx"},
+			},
+			want: &hysteriaconfig.Masquerade{
+				Type: "string",
+				String: &hysteriaconfig.MasqueradeBody{
+					Content:    "gone",
+					StatusCode: 410,
+					Headers:    map[string]string{"Server": "nginx"},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hm, _ := newTestHysteriaManager(t)
+			if err := hm.ConfigureMasquerade(tt.settings); err != nil {
+				t.Fatalf("ConfigureMasquerade: %v", err)
+			}
+			status := hm.GetMasqueradeStatus()
+			if status["type"] != tt.settings.Type || status["active"] != true {
+				t.Errorf("status = %v, want active %s", status, tt.settings.Type)
+			}
+			if got := status["config"]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("config = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigureMasqueradeRejectsMissingDirectory(t *testing.T) {
+	hm, cfg := newTestHysteriaManager(t)
+	cfg.Hysteria2.MasqueradeType = MasqueradeTypeString
+
+	err := hm.ConfigureMasquerade(MasqueradeSettings{Type: MasqueradeTypeFile, FileDir: filepath.Join(t.TempDir(), "missing")})
+	if err == nil {
+		t.Fatal("accepted a directory that does not exist")
+	}
+	// A rejected change leaves the running mode alone
+	if cfg.Hysteria2.MasqueradeType != MasqueradeTypeString || cfg.Hysteria2.MasqueradeFileDir != "" {
+		t.Errorf("config changed to %s %q", cfg.Hysteria2.MasqueradeType, cfg.Hysteria2.MasqueradeFileDir)
+	}
+}
+
+func TestMasqueradeDefaultsToProxy(t *testing.T) {
+	hm, cfg := newTestHysteriaManager(t)
+	cfg.Hysteria2.MasqueradeType = "unknown"
+
+	want := &hysteriaconfig.Masquerade{
+		Type:  "proxy",
+		Proxy: &hysteriaconfig.MasqueradeProxyTo{URL: defaultMasqueradeProxyURL},
+	}
+	if got := hm.buildMasqueradeConfig(); !reflect.DeepEqual(got, want) {
+		t.Errorf("config = %+v, want %+v", got, want)
+	}
+
+	// Salamander replaces the masquerade
+	cfg.Hysteria2.SalamanderEnabled = true
+	if hm.GetMasqueradeStatus()["active"] != false {
+		t.Error("masquerade reported active with Salamander enabled")
+	}
+}
@@ -3,6 +3,7 @@ package services
 import (
 	"fmt"
 	"os/exec"
+	"runtime"
 	"strings"
 	"time"
 
@@ -14,6 +15,7 @@ import (
 type NetworkManagerImpl struct {
 	logger *logrus.Logger
 	config *config.Config
+	runner *CommandRunner
 }
 
 // NewNetworkManager creates a new NetworkManager
@@ -21,26 +23,40 @@ func NewNetworkManager(logger *logrus.Logger, cfg *config.Config) NetworkManager
 	return &NetworkManagerImpl{
 		logger: logger,
 		config: cfg,
+		runner: NewCommandRunner(logger, cfg),
 	}
 }
 
-// EnableMasquerading enables IP masquerading on the specified interface
+// EnableMasquerading enables IP masquerading on the specified interface for IPv4 and, when available, IPv6
 func (nm *NetworkManagerImpl) EnableMasquerading(interfaceName string) error {
 	nm.logger.Infof("Enabling masquerading on interface: %s", interfaceName)
 
-	// Enable IP forwarding
-	if err := nm.runCommand("sysctl", "-w", "net.ipv4.ip_forward=1"); err != nil {
-		nm.logger.Errorf("Failed to enable IP forwarding: %v", err)
-		return fmt.Errorf("failed to enable IP forwarding: %w", err)
-	}
+	err := forEachFamily(nm.config, nm.logger, func(family ipFamily) error {
+		// Enable IP forwarding
+		if err := nm.runCommand("sysctl", "-w", family.forwarding+"=1"); err != nil {
+			return fmt.Errorf("failed to enable %s forwarding: %w", family.name, err)
+		}
 
-	// Add iptables rule for masquerading
-	cmd := fmt.Sprintf("-t nat -A POSTROUTING -o %s -j MASQUERADE", interfaceName)
-	if err := nm.runCommand("iptables", strings.Fields(cmd)...); err != nil {
-		nm.logger.Errorf("Failed to add masquerading rule: %v", err)
-		return fmt.Errorf("failed to add masquerading rule: %w", err)
+		// Add iptables rule for masquerading unless it is already there
+		if err := nm.runCommand(family.iptables, strings.Fields(masqueradeRule("-C", interfaceName))...); err == nil {
+			return nil
+		}
+		if err := nm.runCommand(family.iptables, strings.Fields(masqueradeRule("-A", interfaceName))...); err != nil {
+			return fmt.Errorf("failed to add %s masquerading rule: %w", family.name, err)
+		}
+		return nil
+	})
+	if err != nil {
+		nm.logger.Errorf("Failed to enable masquerading: %v", err)
+		return err
 	}
 
+	nm.updateRoutingState(func(state *RoutingState) {
+		if !containsString(state.Masquerade, interfaceName) {
+			state.Masquerade = append(state.Masquerade, interfaceName)
+		}
+	})
+
 	nm.logger.Infof("Masquerading enabled successfully on interface: %s", interfaceName)
 	return nil
 }
@@ -50,24 +66,46 @@ func (nm *NetworkManagerImpl) DisableMasquerading(interfaceName string) error {
 	nm.logger.Infof("Disabling masquerading on interface: %s", interfaceName)
 
 	// Remove iptables rule for masquerading
-	cmd := fmt.Sprintf("-t nat -D POSTROUTING -o %s -j MASQUERADE", interfaceName)
-	if err := nm.runCommand("iptables", strings.Fields(cmd)...); err != nil {
-		nm.logger.Errorf("Failed to remove masquerading rule: %v", err)
-		return fmt.Errorf("failed to remove masquerading rule: %w", err)
+	err := forEachFamily(nm.config, nm.logger, func(family ipFamily) error {
+		if err := nm.runCommand(family.iptables, strings.Fields(masqueradeRule("-D", interfaceName))...); err != nil {
+			return fmt.Errorf("failed to remove %s masquerading rule: %w", family.name, err)
+		}
+		return nil
+	})
+	if err != nil {
+		nm.logger.Errorf("Failed to disable masquerading: %v", err)
+		return err
 	}
 
+	nm.updateRoutingState(func(state *RoutingState) {
+		kept := state.Masquerade[:0]
+		for _, iface := range state.Masquerade {
+			if iface != interfaceName {
+				kept = append(kept, iface)
+			}
+		}
+		state.Masquerade = kept
+	})
+
 	nm.logger.Infof("Masquerading disabled successfully on interface: %s", interfaceName)
 	return nil
 }
 
-// IsMasqueradingEnabled checks if masquerading is enabled on the specified interface
+// IsMasqueradingEnabled checks if masquerading is enabled on the specified interface.
+// The IPv4 rule decides the result; a missing IPv6 rule is only logged.
 func (nm *NetworkManagerImpl) IsMasqueradingEnabled(interfaceName string) (bool, error) {
-	cmd := fmt.Sprintf("-t nat -C POSTROUTING -o %s -j MASQUERADE", interfaceName)
+	cmd := masqueradeRule("-C", interfaceName)
 	err := nm.runCommand("iptables", strings.Fields(cmd)...)
 	if err != nil {
 		// If the rule doesn't exist, iptables -C returns exit code 1
 		return false, nil
 	}
+
+	if ipv6Enabled(nm.config) {
+		if err := nm.runCommand("ip6tables", strings.Fields(cmd)...); err != nil {
+			nm.logger.Warnf("IPv6 masquerading is not enabled on interface: %s", interfaceName)
+		}
+	}
 	return true, nil
 }
 
@@ -98,17 +136,42 @@ func (nm *NetworkManagerImpl) GetNetworkInterfaces() ([]string, error) {
 
 // runCommand executes a system command and returns error if any
 func (nm *NetworkManagerImpl) runCommand(name string, args ...string) error {
-	cmd := exec.Command(name, args...)
-	nm.logger.Debugf("Running command: %s %v", name, args)
-	return cmd.Run()
+	_, err := nm.runner.Run(name, args...)
+	return err
 }
 
 // runCommandWithOutput executes a system command and returns its output
 func (nm *NetworkManagerImpl) runCommandWithOutput(name string, args ...string) (string, error) {
-	cmd := exec.Command(name, args...)
-	nm.logger.Debugf("Running command with output: %s %v", name, args)
-	output, err := cmd.Output()
-	return string(output), err
+	return nm.runner.Output(name, args...)
+}
+
+// FlushAgentRules removes every iptables chain the agent owns and the jumps to them, for
+// each IP family, leaving the rules of the operator and other software. It is the way out
+// when agent rules cut the node off; the services put their chains back when their
+// settings are applied again. Returns the chains removed, as "IPv4 nat HYSTERIA2-WARP".
+func (nm *NetworkManagerImpl) FlushAgentRules() ([]string, error) {
+	var removed []string
+	err := forEachFamily(nm.config, nm.logger, func(family ipFamily) error {
+		current, err := runIPTablesCommand(nm.logger, family.iptablesSave)
+		if err != nil {
+			return fmt.Errorf("failed to save %s rules: %w", family.name, err)
+		}
+		ruleset, chains := withoutIPTablesChains(current, agentChainPrefix)
+		if len(chains) == 0 {
+			return nil
+		}
+		if err := restoreIPTables(nm.logger, family, ruleset); err != nil {
+			return fmt.Errorf("failed to restore %s rules: %w", family.name, err)
+		}
+		for _, chain := range chains {
+			removed = append(removed, family.name+" "+chain)
+		}
+		return nil
+	})
+	if len(removed) > 0 {
+		nm.logger.Warnf("Flushed agent iptables chains: %s", strings.Join(removed, ", "))
+	}
+	return removed, err
 }
 
 // ===== WARP CLIENT MANAGEMENT =====
@@ -123,24 +186,45 @@ func (nm *NetworkManagerImpl) InstallWARPClient() error {
 		return nil
 	}
 
-	// Add Cloudflare repository and install
-	commands := [][]string{
-		{"curl", "-fsSL", "https://pkg.cloudflareclient.com/pubkey.gpg", "|", "gpg", "--yes", "--dearmor", "--output", "/usr/share/keyrings/cloudflare-warp-archive-keyring.gpg"},
-		{"sh", "-c", "echo \"deb [arch=amd64 signed-by=/usr/share/keyrings/cloudflare-warp-archive-keyring.gpg] https://pkg.cloudflareclient.com/ $(lsb_release -cs) main\" | tee /etc/apt/sources.list.d/cloudflare-client.list"},
-		{"apt", "update"},
-		{"apt", "install", "-y", "cloudflare-warp"},
+	if store := newArtifactStore(nm.config); store != nil {
+		return nm.installWARPFromArtifacts(store)
 	}
 
-	for _, cmd := range commands {
-		if err := nm.runCommand("sh", "-c", strings.Join(cmd, " ")); err != nil {
-			return fmt.Errorf("failed to execute command %v: %w", cmd, err)
-		}
+	// Add Cloudflare repository and install
+	host := DetectHostOS(nm.config)
+	if err := addWARPRepository(host, nm.config.Hysteria2.WARPRepoKeyFingerprint); err != nil {
+		return err
+	}
+	if err := host.InstallPackages("cloudflare-warp"); err != nil {
+		return fmt.Errorf("failed to install WARP client package: %w", err)
 	}
 
 	nm.logger.Info("WARP client installed successfully")
 	return nil
 }
 
+// installWARPFromArtifacts installs the cloudflare-warp package mirrored in the artifact
+// store, the .deb or .rpm the host installs; the package manager resolves its dependencies
+// from whatever local mirror the node is configured with. The file is downloaded and
+// checked as root, against the hashes the operator pinned on the node.
+func (nm *NetworkManagerImpl) installWARPFromArtifacts(store *artifactStore) error {
+	host := DetectHostOS(nm.config)
+	format := host.PackageFormat()
+	if format != "deb" && format != "rpm" {
+		return fmt.Errorf("Cloudflare publishes no WARP client packages for %s", host.describe())
+	}
+	url, err := store.url("warp/cloudflare-warp-" + runtime.GOARCH + "." + format)
+	if err != nil {
+		return err
+	}
+	if err := host.InstallPackageFrom(url, nm.config.Artifacts.Token); err != nil {
+		return fmt.Errorf("failed to install WARP client package: %w", err)
+	}
+
+	nm.logger.Info("WARP client installed successfully from the artifact store")
+	return nil
+}
+
 // isWARPInstalled checks if WARP client is installed
 func (nm *NetworkManagerImpl) isWARPInstalled() bool {
 	cmd := exec.Command("which", "warp-cli")
@@ -153,7 +237,7 @@ func (nm *NetworkManagerImpl) ConfigureWARPProxy(port int) error {
 	nm.logger.Infof("Configuring WARP proxy mode on port %d", port)
 
 	if !nm.isWARPInstalled() {
-		return fmt.Errorf("WARP client is not installed")
+		return ErrWARPNotInstalled
 	}
 
 	// Register WARP client (if not already registered)
@@ -180,7 +264,7 @@ func (nm *NetworkManagerImpl) StartWARPService() error {
 	nm.logger.Info("Starting WARP service")
 
 	if !nm.isWARPInstalled() {
-		return fmt.Errorf("WARP client is not installed")
+		return ErrWARPNotInstalled
 	}
 
 	// Connect to WARP
@@ -197,7 +281,7 @@ func (nm *NetworkManagerImpl) StopWARPService() error {
 	nm.logger.Info("Stopping WARP service")
 
 	if !nm.isWARPInstalled() {
-		return fmt.Errorf("WARP client is not installed")
+		return ErrWARPNotInstalled
 	}
 
 	// Disconnect from WARP
@@ -226,7 +310,7 @@ func (nm *NetworkManagerImpl) RestartWARPService() error {
 // IsWARPConnected checks if WARP is connected
 func (nm *NetworkManagerImpl) IsWARPConnected() (bool, error) {
 	if !nm.isWARPInstalled() {
-		return false, fmt.Errorf("WARP client is not installed")
+		return false, ErrWARPNotInstalled
 	}
 
 	output, err := nm.runCommandWithOutput("warp-cli", "status")
@@ -293,47 +377,61 @@ func (nm *NetworkManagerImpl) GetWARPStatus() (map[string]interface{}, error) {
 func (nm *NetworkManagerImpl) RouteTrafficThroughWARP(interfaceName string) error {
 	nm.logger.Infof("Configuring traffic routing through WARP on interface: %s", interfaceName)
 
-	// Enable IP forwarding
-	if err := nm.runCommand("sysctl", "-w", "net.ipv4.ip_forward=1"); err != nil {
-		return fmt.Errorf("failed to enable IP forwarding: %w", err)
-	}
-
-	// Clear existing NAT rules for this interface
-	nm.runCommand("iptables", "-t", "nat", "-F", "OUTPUT")
-	nm.runCommand("iptables", "-t", "nat", "-F", "POSTROUTING")
-
 	// Configure routing through WARP using iptables
-	// Redirect HTTP/HTTPS traffic to WARP proxy
-	warpPort := nm.config.Hysteria2.WARPProxyPort
-	if warpPort == 0 {
-		warpPort = 1080 // default
-	}
+	rules := warpRoutingRules("-A", interfaceName, nm.warpPort())
 
-	rules := []string{
-		// Redirect HTTP/HTTPS traffic to SOCKS5 proxy
-		fmt.Sprintf("-t nat -A OUTPUT -p tcp --dport 80 -j REDIRECT --to-ports %d", warpPort),
-		fmt.Sprintf("-t nat -A OUTPUT -p tcp --dport 443 -j REDIRECT --to-ports %d", warpPort),
-		// Masquerade traffic going out through the interface
-		fmt.Sprintf("-t nat -A POSTROUTING -o %s -j MASQUERADE", interfaceName),
-	}
+	err := forEachFamily(nm.config, nm.logger, func(family ipFamily) error {
+		// Enable IP forwarding
+		if err := nm.runCommand("sysctl", "-w", family.forwarding+"=1"); err != nil {
+			return fmt.Errorf("failed to enable %s forwarding: %w", family.name, err)
+		}
+
+		// Clear existing NAT rules for this interface
+		nm.runCommand(family.iptables, "-t", "nat", "-F", "OUTPUT")
+		nm.runCommand(family.iptables, "-t", "nat", "-F", "POSTROUTING")
 
-	for _, rule := range rules {
-		if err := nm.runCommand("iptables", strings.Fields(rule)...); err != nil {
-			return fmt.Errorf("failed to apply routing rule %s: %w", rule, err)
+		for _, rule := range rules {
+			if err := nm.runCommand(family.iptables, strings.Fields(rule)...); err != nil {
+				return fmt.Errorf("failed to apply %s routing rule %s: %w", family.name, rule, err)
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
+	nm.updateRoutingState(func(state *RoutingState) {
+		state.WARPInterface = interfaceName
+	})
+
 	nm.logger.Info("Traffic routing configured through WARP successfully")
 	return nil
 }
 
+// warpPort is the WARP proxy HTTP/HTTPS traffic is redirected to
+func (nm *NetworkManagerImpl) warpPort() int {
+	if nm.config.Hysteria2.WARPProxyPort == 0 {
+		return 1080 // default
+	}
+	return nm.config.Hysteria2.WARPProxyPort
+}
+
 // DisableWarpRouting disables WARP-specific routing rules
 func (nm *NetworkManagerImpl) DisableWarpRouting() error {
 	nm.logger.Info("Disabling WARP routing rules")
 
 	// Clear NAT rules that redirect to WARP
-	nm.runCommand("iptables", "-t", "nat", "-F", "OUTPUT")
-	nm.runCommand("iptables", "-t", "nat", "-F", "POSTROUTING")
+	for _, family := range ipFamilies(nm.config) {
+		nm.runCommand(family.iptables, "-t", "nat", "-F", "OUTPUT")
+		nm.runCommand(family.iptables, "-t", "nat", "-F", "POSTROUTING")
+	}
+
+	// Flushing POSTROUTING also removed the masquerade rules
+	nm.updateRoutingState(func(state *RoutingState) {
+		state.WARPInterface = ""
+		state.Masquerade = nil
+	})
 
 	nm.logger.Info("WARP routing rules disabled")
 	return nil
@@ -0,0 +1,189 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+	"hysteria2_microservices/agent-service/internal/config"
+)
+
+const (
+	// nodeBackupMaxFileSize skips anything in the certificate directories that is clearly
+	// not a certificate or key
+	nodeBackupMaxFileSize = 1 << 20
+
+	// warpACLPath is the Hysteria2 ACL the traffic router writes for WARP routing
+	warpACLPath = "/etc/hysteria/acl.yaml"
+)
+
+// NodeFile is a file backed up from or restored to the node
+type NodeFile struct {
+	Path    string
+	Mode    os.FileMode
+	Content []byte
+}
+
+// NodeBackupImpl collects the files a node cannot rebuild from the orchestrator's state:
+// the node key sealing secrets at rest, the server configs holding the Reality private
+// key, the Hysteria2 ACLs and the certificates. Generated configs are backed up as stored,
+// so sealed secrets stay sealed to the node key that is backed up with them.
+type NodeBackupImpl struct {
+	logger   *logrus.Logger
+	config   *config.Config
+	hysteria HysteriaManager
+	xray     XrayManager
+}
+
+// NewNodeBackup creates a new NodeBackup
+func NewNodeBackup(logger *logrus.Logger, cfg *config.Config, hysteria HysteriaManager, xray XrayManager) NodeBackup {
+	return &NodeBackupImpl{
+		logger:   logger,
+		config:   cfg,
+		hysteria: hysteria,
+		xray:     xray,
+	}
+}
+
+// Collect reads the critical files present on the node, ordered by path. Missing files are
+// skipped, since a node only has the ones for the servers it runs.
+func (nb *NodeBackupImpl) Collect() ([]NodeFile, error) {
+	var files []NodeFile
+	for _, path := range nb.filePaths() {
+		file, ok, err := readNodeFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			files = append(files, file)
+		}
+	}
+
+	for _, dir := range nb.certDirs() {
+		entries, err := os.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", dir, err)
+		}
+		for _, entry := range entries {
+			if !entry.Type().IsRegular() {
+				continue
+			}
+			file, ok, err := readNodeFile(filepath.Join(dir, entry.Name()))
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				files = append(files, file)
+			}
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	nb.logger.Infof("Collected %d files for backup", len(files))
+	return files, nil
+}
+
+// Restore writes backed up files back in place. Only paths Collect would have read are
+// accepted, so a backup cannot be used to write elsewhere on the node.
+func (nb *NodeBackupImpl) Restore(files []NodeFile) error {
+	allowed := make(map[string]bool)
+	for _, path := range nb.filePaths() {
+		allowed[path] = true
+	}
+	dirs := make(map[string]bool)
+	for _, dir := range nb.certDirs() {
+		dirs[dir] = true
+	}
+
+	for _, file := range files {
+		path := filepath.Clean(file.Path)
+		if !allowed[path] && !dirs[filepath.Dir(path)] {
+			return fmt.Errorf("refusing to restore %s: not a backed up location", file.Path)
+		}
+	}
+
+	for _, file := range files {
+		path := filepath.Clean(file.Path)
+		mode := file.Mode.Perm()
+		if mode == 0 {
+			mode = 0600
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return fmt.Errorf("failed to create directory for %s: %w", path, err)
+		}
+		tmp := path + ".restore"
+		if err := os.WriteFile(tmp, file.Content, mode); err != nil {
+			return fmt.Errorf("failed to write %s: %w", path, err)
+		}
+		if err := os.Chmod(tmp, mode); err != nil {
+			os.Remove(tmp)
+			return fmt.Errorf("failed to set mode of %s: %w", path, err)
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			os.Remove(tmp)
+			return fmt.Errorf("failed to replace %s: %w", path, err)
+		}
+		if err := recordDeployedConfig(nb.config, path, file.Content); err != nil {
+			return err
+		}
+	}
+
+	nb.logger.Infof("Restored %d files from backup", len(files))
+	return nil
+}
+
+func (nb *NodeBackupImpl) filePaths() []string {
+	paths := []string{
+		nb.config.Secrets.KeyFile,
+		nb.hysteria.ConfigPath(),
+		nb.xray.ConfigPath(),
+		nb.config.Xray.CertPath,
+		nb.config.Xray.KeyPath,
+		nb.config.Filter.HysteriaACLPath,
+		warpACLPath,
+	}
+	var result []string
+	for _, path := range paths {
+		if path != "" {
+			result = append(result, filepath.Clean(path))
+		}
+	}
+	return result
+}
+
+func (nb *NodeBackupImpl) certDirs() []string {
+	var dirs []string
+	for _, dir := range []string{nb.config.Hysteria2.SNICertPath, nb.config.Hysteria2.SNIKeyPath} {
+		if dir == "" {
+			continue
+		}
+		dir = filepath.Clean(dir)
+		if len(dirs) == 0 || dirs[0] != dir {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+func readNodeFile(path string) (NodeFile, bool, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return NodeFile{}, false, nil
+	}
+	if err != nil {
+		return NodeFile{}, false, fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	if !info.Mode().IsRegular() || info.Size() > nodeBackupMaxFileSize {
+		return NodeFile{}, false, nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return NodeFile{}, false, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return NodeFile{Path: path, Mode: info.Mode().Perm(), Content: content}, true, nil
+}
@@ -0,0 +1,66 @@
+package services
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// TLSFingerprints are the uTLS fingerprints client configs can imitate
+var TLSFingerprints = []string{"chrome", "firefox", "safari", "ios", "android", "edge", "360", "qq", "random", "randomized"}
+
+// ObfuscationSettings is the complete set of obfuscation knobs an orchestrator preset sets
+// on a node. Knobs the settings leave off are turned off.
+type ObfuscationSettings struct {
+	Preset             string // name of the preset the settings came from, informational
+	Salamander         bool
+	SalamanderPassword string // generated when salamander is on and none is given
+	PortHopping        bool
+	HopStartPort       int
+	HopEndPort         int
+	HopInterval        int // seconds
+	QUICObfuscation    bool
+	PacketPadding      int // quic obfuscation only, 0 keeps the relay default
+	TimingJitterMs     int // quic obfuscation only, 0 disables timing randomization
+	Fingerprints       []string
+	RealityTargets     []string // sites the Reality inbound borrows, the first is the dest
+	TrafficShaping     bool
+}
+
+// Validate checks the ranges of the enabled knobs
+func (s ObfuscationSettings) Validate() error {
+	if s.Salamander && s.SalamanderPassword != "" && len(s.SalamanderPassword) < 8 {
+		return fmt.Errorf("salamander password must be at least 8 characters")
+	}
+
+	if s.PortHopping {
+		if s.HopStartPort < 1 || s.HopEndPort > 65535 || s.HopStartPort >= s.HopEndPort {
+			return fmt.Errorf("invalid port hopping range %d-%d", s.HopStartPort, s.HopEndPort)
+		}
+		if s.HopInterval != 0 && s.HopInterval < 5 {
+			return fmt.Errorf("hop interval must be at least 5 seconds, got %d", s.HopInterval)
+		}
+	}
+
+	if !s.QUICObfuscation && (s.PacketPadding != 0 || s.TimingJitterMs != 0) {
+		return fmt.Errorf("packet padding and timing jitter need QUIC obfuscation")
+	}
+	if s.PacketPadding != 0 && (s.PacketPadding < 1200 || s.PacketPadding > 1500) {
+		return fmt.Errorf("packet padding must be between 1200-1500 bytes, got %d", s.PacketPadding)
+	}
+	if s.TimingJitterMs < 0 || s.TimingJitterMs > 1000 {
+		return fmt.Errorf("timing jitter must be between 0-1000 ms, got %d", s.TimingJitterMs)
+	}
+
+	for _, fingerprint := range s.Fingerprints {
+		if !slices.Contains(TLSFingerprints, fingerprint) {
+			return fmt.Errorf("fingerprint %q must be one of %s", fingerprint, strings.Join(TLSFingerprints, ", "))
+		}
+	}
+	for _, target := range s.RealityTargets {
+		if target == "" || strings.ContainsAny(target, ":/ ") {
+			return fmt.Errorf("invalid Reality target %q", target)
+		}
+	}
+	return nil
+}
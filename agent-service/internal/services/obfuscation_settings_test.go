@@ -0,0 +1,72 @@
+package services
+
+import (
+	"testing"
+
+	"hysteria2_microservices/agent-service/internal/config"
+)
+
+func TestObfuscationSettingsValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings ObfuscationSettings
+		wantErr  bool
+	}{
+		{"nothing on", ObfuscationSettings{}, false},
+		{"preset", ObfuscationSettings{Salamander: true, PortHopping: true, HopStartPort: 20000, HopEndPort: 50000, HopInterval: 30, Fingerprints: []string{"chrome", "ios"}, RealityTargets: []string{"www.microsoft.com"}}, false},
+		{"short salamander password", ObfuscationSettings{Salamander: true, SalamanderPassword: "short"}, true},
+		{"hopping range reversed", ObfuscationSettings{PortHopping: true, HopStartPort: 50000, HopEndPort: 20000}, true},
+		{"hopping too often", ObfuscationSettings{PortHopping: true, HopStartPort: 20000, HopEndPort: 50000, HopInterval: 1}, true},
+		{"padding without the relay", ObfuscationSettings{PacketPadding: 1300}, true},
+		{"jitter too long", ObfuscationSettings{QUICObfuscation: true, TimingJitterMs: 2000}, true},
+		{"unknown fingerprint", ObfuscationSettings{Fingerprints: []string{"netscape"}}, true},
+		{"reality target with a port", ObfuscationSettings{RealityTargets: []string{"www.microsoft.com:443"}}, true},
+		{"empty reality target", ObfuscationSettings{RealityTargets: []string{""}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.settings.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestApplyObfuscation(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Hysteria2.QUICObfuscationEnabled = true
+	cfg.Hysteria2.TrafficShapingEnabled = true
+	hm := &HysteriaManagerImpl{logger: testLogger(), config: cfg}
+
+	applied, err := hm.ApplyObfuscation(ObfuscationSettings{
+		Preset:         "russia",
+		Salamander:     true,
+		PortHopping:    true,
+		HopStartPort:   20000,
+		HopEndPort:     50000,
+		Fingerprints:   []string{"chrome"},
+		RealityTargets: []string{"dl.google.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The password is generated and the interval defaulted for the orchestrator to keep
+	if len(applied.SalamanderPassword) < 8 || applied.SalamanderPassword != cfg.Hysteria2.SalamanderPassword || applied.HopInterval != 30 {
+		t.Errorf("applied = %+v", applied)
+	}
+	h := cfg.Hysteria2
+	if !h.SalamanderEnabled || !h.PortHopping || h.HopInterval != 30 || !h.TLSFingerprintRotation || !h.VLESSRealityEnabled || h.ObfuscationPreset != "russia" {
+		t.Errorf("knobs the preset sets are off: %+v", h)
+	}
+	// Knobs the settings leave off are turned off
+	if h.QUICObfuscationEnabled || h.TrafficShapingEnabled {
+		t.Errorf("knobs the preset leaves off are on: QUIC %v, shaping %v", h.QUICObfuscationEnabled, h.TrafficShapingEnabled)
+	}
+
+	if _, err := hm.ApplyObfuscation(ObfuscationSettings{Preset: "broken", Fingerprints: []string{"netscape"}}); err == nil {
+		t.Error("invalid settings applied")
+	}
+	if cfg.Hysteria2.ObfuscationPreset != "russia" {
+		t.Errorf("invalid settings changed the preset to %q", cfg.Hysteria2.ObfuscationPreset)
+	}
+}
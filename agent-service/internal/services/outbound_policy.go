@@ -0,0 +1,277 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"hysteria2_microservices/agent-service/internal/config"
+	"hysteria2_microservices/agent-service/internal/hysteriaconfig"
+)
+
+// Outbound policy outbound types. Another node is reached through the SOCKS5 or HTTP proxy
+// it serves.
+const (
+	PolicyOutboundDirect = "direct"
+	PolicyOutboundWARP   = "warp"
+	PolicyOutboundSOCKS5 = "socks5"
+	PolicyOutboundHTTP   = "http"
+)
+
+const (
+	outboundPolicyFile = "outbound_policy.json"
+
+	// Hysteria2 names of policy outbounds, kept apart from those of the routing profiles
+	hysteriaPolicyPrefix = "policy_"
+)
+
+var policyOutboundNamePattern = regexp.MustCompile(`^[a-z0-9_]{1,32}$`)
+
+// OutboundPolicy chooses where Hysteria2 sends client traffic: Rules send destinations to
+// named Outbounds, and the rest goes to Default. For example RU-destined traffic direct and
+// everything else through WARP.
+type OutboundPolicy struct {
+	Outbounds []PolicyOutbound         `json:"outbounds"`
+	Rules     []hysteriaconfig.ACLRule `json:"rules,omitempty"` // Outbound names one of Outbounds or "reject"
+	Default   string                   `json:"default"`         // the first outbound when empty
+}
+
+// PolicyOutbound is a named way out of the node
+type PolicyOutbound struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	Address    string `json:"address,omitempty"` // socks5 and http
+	Port       int    `json:"port,omitempty"`
+	Username   string `json:"username,omitempty"`
+	Password   string `json:"password,omitempty"`
+	BindDevice string `json:"bind_device,omitempty"` // direct: leave through this interface
+}
+
+// OutboundPolicyManagerImpl keeps the node's outbound policy on disk. Hysteria2 picks it up
+// whenever its config is generated, after the content filter and routing profile rules.
+type OutboundPolicyManagerImpl struct {
+	logger          *logrus.Logger
+	config          *config.Config
+	hysteriaManager HysteriaManager
+
+	mu     sync.Mutex
+	policy *OutboundPolicy
+}
+
+// NewOutboundPolicyManager creates a new OutboundPolicyManager
+func NewOutboundPolicyManager(logger *logrus.Logger, cfg *config.Config, hysteriaManager HysteriaManager) OutboundPolicyManager {
+	return &OutboundPolicyManagerImpl{
+		logger:          logger,
+		config:          cfg,
+		hysteriaManager: hysteriaManager,
+	}
+}
+
+// Start restores the saved policy
+func (op *OutboundPolicyManagerImpl) Start(ctx context.Context) error {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	policy, err := loadOutboundPolicy(op.config)
+	if err != nil {
+		return fmt.Errorf("failed to read outbound policy: %w", err)
+	}
+	op.policy = policy
+	if policy != nil {
+		op.logger.Infof("Outbound policy restored: %d outbounds, %d rules, default %s", len(policy.Outbounds), len(policy.Rules), policy.Default)
+	}
+	return nil
+}
+
+// SetPolicy replaces the policy and reloads Hysteria2 when it is running. A policy without
+// outbounds removes it, sending traffic out the way the node does by default.
+func (op *OutboundPolicyManagerImpl) SetPolicy(policy *OutboundPolicy) error {
+	if policy != nil && len(policy.Outbounds) == 0 {
+		policy = nil
+	}
+	if policy != nil {
+		if policy.Default == "" {
+			policy.Default = policy.Outbounds[0].Name
+		}
+		if _, err := compileOutboundPolicy(policy, op.config.Hysteria2); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidOutboundPolicy, err)
+		}
+	}
+
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	if err := op.save(policy); err != nil {
+		return fmt.Errorf("failed to save outbound policy: %w", err)
+	}
+	op.policy = policy
+
+	if err := reloadRunningHysteria(op.config, op.hysteriaManager); err != nil {
+		return fmt.Errorf("failed to reload hysteria2: %w", err)
+	}
+	if policy == nil {
+		op.logger.Info("Outbound policy removed")
+	} else {
+		op.logger.Infof("Outbound policy applied: %d outbounds, %d rules, default %s", len(policy.Outbounds), len(policy.Rules), policy.Default)
+	}
+	return nil
+}
+
+// GetPolicy returns the policy in force, nil when there is none
+func (op *OutboundPolicyManagerImpl) GetPolicy() *OutboundPolicy {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	return op.policy
+}
+
+func (op *OutboundPolicyManagerImpl) save(policy *OutboundPolicy) error {
+	path := filepath.Join(op.config.Routing.StateDir, outboundPolicyFile)
+	if policy == nil {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	if err := os.MkdirAll(op.config.Routing.StateDir, 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(policy, "", "  ")
+	if err != nil {
+		return err
+	}
+	// The file holds proxy credentials
+	return os.WriteFile(path, data, 0600)
+}
+
+// loadOutboundPolicy reads the saved policy, nil when there is none
+func loadOutboundPolicy(cfg *config.Config) (*OutboundPolicy, error) {
+	data, err := os.ReadFile(filepath.Join(cfg.Routing.StateDir, outboundPolicyFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var policy OutboundPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// compileOutboundPolicy turns the policy into Hysteria2 outbounds, the default one first as
+// Hysteria2 sends unmatched traffic to its first outbound, and ACL rules: the local ranges
+// direct, then the policy rules, then everything else to the default
+func compileOutboundPolicy(policy *OutboundPolicy, hysteria config.Hysteria2Config) (hysteriaRouting, error) {
+	var compiled hysteriaRouting
+
+	names := make(map[string]string, len(policy.Outbounds))
+	for i, outbound := range policy.Outbounds {
+		hysteriaOutbound, err := hysteriaPolicyOutbound(outbound, hysteria)
+		if err != nil {
+			return compiled, fmt.Errorf("outbound %d: %w", i+1, err)
+		}
+		if names[outbound.Name] != "" {
+			return compiled, fmt.Errorf("duplicate outbound %q", outbound.Name)
+		}
+		names[outbound.Name] = hysteriaOutbound.Name
+
+		if outbound.Name == policy.Default {
+			compiled.Outbounds = append([]hysteriaconfig.Outbound{*hysteriaOutbound}, compiled.Outbounds...)
+		} else {
+			compiled.Outbounds = append(compiled.Outbounds, *hysteriaOutbound)
+		}
+	}
+	if names[policy.Default] == "" {
+		return compiled, fmt.Errorf("default outbound %q is not one of the outbounds", policy.Default)
+	}
+
+	rules := localRangeACLRules()
+	for i, rule := range policy.Rules {
+		switch {
+		case rule.Outbound == hysteriaconfig.ACLReject:
+		case names[rule.Outbound] != "":
+			rule.Outbound = names[rule.Outbound]
+		default:
+			return compiled, fmt.Errorf("rule %d: unknown outbound %q", i+1, rule.Outbound)
+		}
+		if err := rule.Validate(); err != nil {
+			return compiled, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+		rules = append(rules, rule)
+	}
+	rules = append(rules, hysteriaconfig.ACLRule{Outbound: names[policy.Default], Match: hysteriaconfig.ACLMatchAll})
+
+	lines, err := hysteriaconfig.FormatACL(rules)
+	if err != nil {
+		return compiled, err
+	}
+	compiled.ACL = lines
+	return compiled, nil
+}
+
+func hysteriaPolicyOutbound(outbound PolicyOutbound, hysteria config.Hysteria2Config) (*hysteriaconfig.Outbound, error) {
+	if !policyOutboundNamePattern.MatchString(outbound.Name) {
+		return nil, fmt.Errorf("name %q must be up to 32 lowercase letters, digits or '_'", outbound.Name)
+	}
+	result := &hysteriaconfig.Outbound{Name: hysteriaPolicyPrefix + outbound.Name, Type: outbound.Type}
+
+	switch outbound.Type {
+	case PolicyOutboundDirect:
+		if outbound.BindDevice != "" {
+			result.Direct = &hysteriaconfig.DirectOutbound{BindDevice: outbound.BindDevice}
+		}
+		return result, nil
+	case PolicyOutboundWARP:
+		if !hysteria.WARPEnabled {
+			return nil, fmt.Errorf("WARP is not enabled on this node")
+		}
+		result.Type = hysteriaconfig.OutboundSOCKS5
+		result.SOCKS5 = &hysteriaconfig.SOCKS5Outbound{Addr: warpProxyAddr(hysteria)}
+		return result, nil
+	}
+
+	if outbound.Address == "" {
+		return nil, fmt.Errorf("address is required")
+	}
+	if outbound.Port < 1 || outbound.Port > 65535 {
+		return nil, fmt.Errorf("invalid port %d", outbound.Port)
+	}
+	addr := net.JoinHostPort(outbound.Address, strconv.Itoa(outbound.Port))
+
+	switch outbound.Type {
+	case PolicyOutboundSOCKS5:
+		result.SOCKS5 = &hysteriaconfig.SOCKS5Outbound{Addr: addr, Username: outbound.Username, Password: outbound.Password}
+	case PolicyOutboundHTTP:
+		proxyURL := url.URL{Scheme: "http", Host: addr}
+		if outbound.Username != "" {
+			proxyURL.User = url.UserPassword(outbound.Username, outbound.Password)
+		}
+		result.HTTP = &hysteriaconfig.HTTPOutbound{URL: proxyURL.String()}
+	default:
+		return nil, fmt.Errorf("unsupported type %q", outbound.Type)
+	}
+	return result, nil
+}
+
+// mergeOutboundPolicy adds the compiled policy to the routing of the profiles. The policy's
+// outbounds go first so its default becomes Hysteria2's, and its rules last so the profile
+// rules still match first.
+func mergeOutboundPolicy(routing *hysteriaRouting, policy hysteriaRouting) *hysteriaRouting {
+	if routing == nil {
+		return &policy
+	}
+	return &hysteriaRouting{
+		Outbounds: append(append([]hysteriaconfig.Outbound{}, policy.Outbounds...), routing.Outbounds...),
+		ACL:       append(append([]string{}, routing.ACL...), policy.ACL...),
+	}
+}
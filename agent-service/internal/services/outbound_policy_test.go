@@ -0,0 +1,119 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"hysteria2_microservices/agent-service/internal/config"
+	"hysteria2_microservices/agent-service/internal/hysteriaconfig"
+)
+
+func TestCompileOutboundPolicy(t *testing.T) {
+	hysteria := config.Hysteria2Config{WARPEnabled: true, WARPProxyPort: 40000}
+	policy := &OutboundPolicy{
+		Outbounds: []PolicyOutbound{
+			{Name: "direct", Type: PolicyOutboundDirect, BindDevice: "eth1"},
+			{Name: "warp", Type: PolicyOutboundWARP},
+			{Name: "node_b", Type: PolicyOutboundHTTP, Address: "2001:db8::10", Port: 3128, Username: "u", Password: "p@ss"},
+		},
+		Rules: []hysteriaconfig.ACLRule{
+			{Outbound: "direct", Match: hysteriaconfig.ACLMatchGeoIP, Value: "ru"},
+			{Outbound: hysteriaconfig.ACLReject, Match: hysteriaconfig.ACLMatchSuffix, Value: "ads.example.com"},
+		},
+		Default: "warp",
+	}
+	compiled, err := compileOutboundPolicy(policy, hysteria)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The default goes first, as Hysteria2 sends unmatched traffic to its first outbound
+	if len(compiled.Outbounds) != 3 || compiled.Outbounds[0].Name != "policy_warp" || compiled.Outbounds[0].SOCKS5.Addr != "127.0.0.1:40000" {
+		t.Fatalf("outbounds = %+v", compiled.Outbounds)
+	}
+	if direct := compiled.Outbounds[1]; direct.Name != "policy_direct" || direct.Direct == nil || direct.Direct.BindDevice != "eth1" {
+		t.Errorf("direct outbound = %+v", direct)
+	}
+	if proxy := compiled.Outbounds[2]; proxy.HTTP == nil || proxy.HTTP.URL != "http://u:p%40ss@[2001:db8::10]:3128" {
+		t.Errorf("http outbound = %+v", proxy)
+	}
+
+	// Local ranges stay direct, then the policy rules, then the default for everything else
+	local := len(localRangeACLRules())
+	if len(compiled.ACL) != local+3 {
+		t.Fatalf("ACL = %v", compiled.ACL)
+	}
+	want := []string{"policy_direct(geoip:ru)", "reject(suffix:ads.example.com)", "policy_warp(all)"}
+	for i, line := range compiled.ACL[local:] {
+		if line != want[i] {
+			t.Errorf("ACL line %d = %q, want %q", local+i+1, line, want[i])
+		}
+	}
+
+	tests := map[string]*OutboundPolicy{
+		"unknown rule outbound":   {Outbounds: policy.Outbounds[:1], Default: "direct", Rules: []hysteriaconfig.ACLRule{{Outbound: "node_c", Match: hysteriaconfig.ACLMatchAll}}},
+		"unknown default":         {Outbounds: policy.Outbounds[:1], Default: "warp"},
+		"duplicate outbound":      {Outbounds: []PolicyOutbound{policy.Outbounds[0], policy.Outbounds[0]}, Default: "direct"},
+		"bad name":                {Outbounds: []PolicyOutbound{{Name: "Node-B", Type: PolicyOutboundDirect}}, Default: "Node-B"},
+		"proxy without address":   {Outbounds: []PolicyOutbound{{Name: "node_b", Type: PolicyOutboundSOCKS5, Port: 1080}}, Default: "node_b"},
+		"proxy port out of range": {Outbounds: []PolicyOutbound{{Name: "node_b", Type: PolicyOutboundSOCKS5, Address: "192.0.2.10", Port: 70000}}, Default: "node_b"},
+		"unsupported type":        {Outbounds: []PolicyOutbound{{Name: "node_b", Type: "vmess", Address: "192.0.2.10", Port: 443}}, Default: "node_b"},
+	}
+	for name, policy := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := compileOutboundPolicy(policy, hysteria); err == nil {
+				t.Error("compileOutboundPolicy succeeded")
+			}
+		})
+	}
+
+	if _, err := compileOutboundPolicy(&OutboundPolicy{Outbounds: policy.Outbounds[1:2], Default: "warp"}, config.Hysteria2Config{}); err == nil || !strings.Contains(err.Error(), "WARP is not enabled") {
+		t.Errorf("WARP outbound without WARP = %v", err)
+	}
+}
+
+func TestOutboundPolicyManager(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Routing.StateDir = t.TempDir()
+	op := NewOutboundPolicyManager(testLogger(), cfg, &fakeHysteria{}).(*OutboundPolicyManagerImpl)
+
+	err := op.SetPolicy(&OutboundPolicy{Outbounds: []PolicyOutbound{{Name: "node_b", Type: PolicyOutboundSOCKS5, Address: "192.0.2.10", Port: 1080, Password: "secret"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first outbound is the default when none is named
+	if policy := op.GetPolicy(); policy.Default != "node_b" {
+		t.Errorf("default = %q, want node_b", policy.Default)
+	}
+	path := filepath.Join(cfg.Routing.StateDir, outboundPolicyFile)
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("saved policy: %v, want a file only root reads", err)
+	}
+
+	restarted := NewOutboundPolicyManager(testLogger(), cfg, &fakeHysteria{}).(*OutboundPolicyManagerImpl)
+	if err := restarted.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if policy := restarted.GetPolicy(); policy == nil || policy.Outbounds[0].Password != "secret" {
+		t.Errorf("restored policy = %+v", policy)
+	}
+
+	if err := op.SetPolicy(&OutboundPolicy{Outbounds: []PolicyOutbound{{Name: "warp", Type: PolicyOutboundWARP}}}); !errors.Is(err, ErrInvalidOutboundPolicy) {
+		t.Errorf("invalid policy = %v, want ErrInvalidOutboundPolicy", err)
+	}
+	if op.GetPolicy().Default != "node_b" {
+		t.Error("invalid policy replaced the one in force")
+	}
+
+	// A policy without outbounds removes it
+	if err := op.SetPolicy(&OutboundPolicy{}); err != nil || op.GetPolicy() != nil {
+		t.Errorf("removing the policy: %v, policy %+v", err, op.GetPolicy())
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("saved policy kept after the removal: %v", err)
+	}
+}
@@ -0,0 +1,323 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"hysteria2_microservices/agent-service/internal/config"
+	"hysteria2_microservices/agent-service/internal/privsep"
+)
+
+const (
+	portForwardChain        = "HYSTERIA2-PORTFWD"
+	portForwardSNATChain    = "HYSTERIA2-PORTFWD-SNAT"
+	portForwardForwardChain = "HYSTERIA2-PORTFWD-FWD"
+)
+
+// PortForward exposes TargetHost:TargetPort on the node's public ListenPort
+type PortForward struct {
+	ID         string    `json:"id"`
+	Owner      string    `json:"owner,omitempty"` // user the forward was set up for
+	Protocol   string    `json:"protocol"`        // "tcp" or "udp"
+	ListenPort int       `json:"listen_port"`
+	TargetHost string    `json:"target_host"` // public IPv4 or IPv6 address
+	TargetPort int       `json:"target_port"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// PortForwarderImpl DNATs the public ports of the forwards to their targets. The
+// HYSTERIA2-PORTFWD nat chain rewrites the destination, HYSTERIA2-PORTFWD-SNAT masquerades
+// the forwarded connections so replies come back through the node, and
+// HYSTERIA2-PORTFWD-FWD lets them through a FORWARD policy of drop.
+type PortForwarderImpl struct {
+	logger *logrus.Logger
+	config *config.Config
+
+	mu       sync.Mutex
+	forwards []PortForward
+}
+
+// NewPortForwarder creates a new PortForwarder
+func NewPortForwarder(logger *logrus.Logger, cfg *config.Config) PortForwarder {
+	return &PortForwarderImpl{
+		logger: logger,
+		config: cfg,
+	}
+}
+
+// Start restores the forwards the orchestrator set and installs their rules
+func (pf *PortForwarderImpl) Start(ctx context.Context) error {
+	if !pf.config.PortForward.Enabled {
+		pf.logger.Info("Port forwarding disabled")
+		return nil
+	}
+
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	data, err := os.ReadFile(pf.config.PortForward.StateFile)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		pf.logger.Warnf("Ignoring unreadable port forwards: %v", err)
+	default:
+		if err := json.Unmarshal(data, &pf.forwards); err != nil {
+			pf.logger.Warnf("Ignoring invalid port forwards: %v", err)
+			pf.forwards = nil
+		}
+	}
+
+	if err := pf.apply(pf.forwards); err != nil {
+		return fmt.Errorf("failed to install port forwards: %w", err)
+	}
+	pf.logger.Infof("Port forwarder started: %d forward(s) on ports %d-%d", len(pf.forwards), pf.config.PortForward.MinPort, pf.config.PortForward.MaxPort)
+	return nil
+}
+
+// Add checks a forward against the node's own ports and the other forwards, installs it
+// and saves it. A forward the node fails to install is not saved.
+func (pf *PortForwarderImpl) Add(forward PortForward) (*PortForward, error) {
+	if !pf.config.PortForward.Enabled {
+		return nil, fmt.Errorf("port forwarding is disabled on this node")
+	}
+	if err := pf.validate(&forward); err != nil {
+		return nil, err
+	}
+
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	for _, existing := range pf.forwards {
+		if existing.Protocol == forward.Protocol && existing.ListenPort == forward.ListenPort {
+			return nil, fmt.Errorf("%w: %s port %d is forwarded already", ErrPortInUse, forward.Protocol, forward.ListenPort)
+		}
+	}
+	if err := portFree(forward.Protocol, forward.ListenPort); err != nil {
+		return nil, fmt.Errorf("%w: %s port %d is used on the node: %v", ErrPortInUse, forward.Protocol, forward.ListenPort, err)
+	}
+
+	if forward.ID == "" {
+		forward.ID = uuid.New().String()
+	}
+	forward.CreatedAt = time.Now().UTC()
+
+	forwards := append(append([]PortForward(nil), pf.forwards...), forward)
+	if err := pf.apply(forwards); err != nil {
+		return nil, err
+	}
+	if err := pf.save(forwards); err != nil {
+		return nil, err
+	}
+	pf.forwards = forwards
+
+	pf.logger.Infof("Port forward added: %s %d -> %s", forward.Protocol, forward.ListenPort, net.JoinHostPort(forward.TargetHost, strconv.Itoa(forward.TargetPort)))
+	return &forward, nil
+}
+
+// Remove uninstalls a forward and forgets it
+func (pf *PortForwarderImpl) Remove(id string) error {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	forwards := make([]PortForward, 0, len(pf.forwards))
+	var removed *PortForward
+	for i := range pf.forwards {
+		if pf.forwards[i].ID == id {
+			removed = &pf.forwards[i]
+			continue
+		}
+		forwards = append(forwards, pf.forwards[i])
+	}
+	if removed == nil {
+		return fmt.Errorf("%w: %s", ErrPortForwardNotFound, id)
+	}
+
+	if err := pf.apply(forwards); err != nil {
+		return err
+	}
+	if err := pf.save(forwards); err != nil {
+		return err
+	}
+	pf.logger.Infof("Port forward removed: %s %d", removed.Protocol, removed.ListenPort)
+	pf.forwards = forwards
+	return nil
+}
+
+// List returns the forwards by listen port
+func (pf *PortForwarderImpl) List() []PortForward {
+	pf.mu.Lock()
+	forwards := append([]PortForward(nil), pf.forwards...)
+	pf.mu.Unlock()
+
+	sort.Slice(forwards, func(i, j int) bool {
+		if forwards[i].ListenPort != forwards[j].ListenPort {
+			return forwards[i].ListenPort < forwards[j].ListenPort
+		}
+		return forwards[i].Protocol < forwards[j].Protocol
+	})
+	return forwards
+}
+
+// Range returns the ports forwards may listen on
+func (pf *PortForwarderImpl) Range() (minPort, maxPort int) {
+	return pf.config.PortForward.MinPort, pf.config.PortForward.MaxPort
+}
+
+// apply replaces the three chains with the rules of forwards. Forwards to IPv6 targets are
+// only installed when the node serves IPv6.
+func (pf *PortForwarderImpl) apply(forwards []PortForward) error {
+	if len(forwards) > 0 {
+		if err := forEachFamily(pf.config, pf.logger, func(family ipFamily) error {
+			return pf.runCommand("sysctl", "-w", family.forwarding+"=1")
+		}); err != nil {
+			return fmt.Errorf("failed to enable forwarding: %w", err)
+		}
+	}
+
+	return forEachFamily(pf.config, pf.logger, func(family ipFamily) error {
+		var dnat, snat, forward []string
+		for _, fwd := range forwards {
+			if isIPv6(fwd.TargetHost) != (family.name == ipv6Family.name) {
+				continue
+			}
+			comment := strconv.Quote("port forward " + fwd.ID)
+			toTarget := fmt.Sprintf("-p %s -d %s --dport %d -m conntrack --ctstate DNAT", fwd.Protocol, fwd.TargetHost, fwd.TargetPort)
+			fromTarget := fmt.Sprintf("-p %s -s %s --sport %d -m conntrack --ctstate RELATED,ESTABLISHED", fwd.Protocol, fwd.TargetHost, fwd.TargetPort)
+			dnat = append(dnat, fmt.Sprintf("-p %s --dport %d -m comment --comment %s -j DNAT --to-destination %s",
+				fwd.Protocol, fwd.ListenPort, comment, net.JoinHostPort(fwd.TargetHost, strconv.Itoa(fwd.TargetPort))))
+			snat = append(snat, fmt.Sprintf("%s -m comment --comment %s -j MASQUERADE", toTarget, comment))
+			forward = append(forward,
+				fmt.Sprintf("%s -m comment --comment %s -j ACCEPT", toTarget, comment),
+				fmt.Sprintf("%s -m comment --comment %s -j ACCEPT", fromTarget, comment),
+			)
+		}
+		return applyIPTablesRuleset(pf.logger, family, []iptablesChain{
+			{Table: "nat", Name: portForwardChain, Hook: "PREROUTING", Rules: dnat},
+			{Table: "nat", Name: portForwardSNATChain, Hook: "POSTROUTING", Rules: snat},
+			{Table: "filter", Name: portForwardForwardChain, Hook: "FORWARD", Rules: forward},
+		})
+	})
+}
+
+func (pf *PortForwarderImpl) save(forwards []PortForward) error {
+	data, err := json.MarshalIndent(forwards, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(pf.config.PortForward.StateFile), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(pf.config.PortForward.StateFile, data, 0600); err != nil {
+		return fmt.Errorf("failed to save port forwards: %w", err)
+	}
+	return nil
+}
+
+// validate checks a forward and normalises its protocol and target. The listen port must
+// be in the configured range and clear of the ports the node serves on; the target must
+// be a public address, so a forward cannot reach the node's own or its neighbours' services.
+func (pf *PortForwarderImpl) validate(forward *PortForward) error {
+	forward.Protocol = strings.ToLower(forward.Protocol)
+	if forward.Protocol != "tcp" && forward.Protocol != "udp" {
+		return fmt.Errorf("protocol must be tcp or udp, got %q", forward.Protocol)
+	}
+
+	cfg := pf.config.PortForward
+	if forward.ListenPort < cfg.MinPort || forward.ListenPort > cfg.MaxPort {
+		return fmt.Errorf("listen port must be between %d and %d", cfg.MinPort, cfg.MaxPort)
+	}
+	for _, reserved := range reservedPortRules(pf.config) {
+		if reserved.Protocol == forward.Protocol && portInRange(reserved.Ports, forward.ListenPort) {
+			return fmt.Errorf("%w: %s port %d is used by %s", ErrPortInUse, forward.Protocol, forward.ListenPort, reserved.Comment)
+		}
+	}
+
+	if forward.TargetPort < 1 || forward.TargetPort > 65535 {
+		return fmt.Errorf("target port must be between 1 and 65535")
+	}
+	ip := net.ParseIP(strings.Trim(forward.TargetHost, "[]"))
+	if ip == nil {
+		return fmt.Errorf("target must be an IP address, got %q", forward.TargetHost)
+	}
+	if !ip.IsGlobalUnicast() || localAddress(ip) {
+		return fmt.Errorf("target %s is not a public address", ip)
+	}
+	if ip.To4() == nil && !ipv6Enabled(pf.config) {
+		return fmt.Errorf("target %s is IPv6, which this node does not serve", ip)
+	}
+	forward.TargetHost = ip.String()
+	return nil
+}
+
+// reservedPortRules are the ports a forward must not take over: the public service ports,
+// their port hopping range, SSH and the agent's gRPC port
+func reservedPortRules(cfg *config.Config) []FirewallRule {
+	rules := publicServiceRules(cfg)
+	for _, protocol := range []string{"tcp", "udp"} {
+		if cfg.Firewall.SSHPort > 0 {
+			rules = append(rules, FirewallRule{Protocol: protocol, Ports: strconv.Itoa(cfg.Firewall.SSHPort), Comment: "ssh"})
+		}
+		if cfg.Node.GRPCPort > 0 {
+			rules = append(rules, FirewallRule{Protocol: protocol, Ports: strconv.Itoa(cfg.Node.GRPCPort), Comment: "agent grpc"})
+		}
+	}
+	return rules
+}
+
+// portFree reports whether a local listener holds the port, which the forward would shadow
+func portFree(protocol string, port int) error {
+	addr := fmt.Sprintf(":%d", port)
+	if protocol == "udp" {
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return ln.Close()
+}
+
+// localAddress reports whether ip is in a loopback, private or carrier-grade NAT range
+func localAddress(ip net.IP) bool {
+	for _, family := range []ipFamily{ipv4Family, ipv6Family} {
+		for _, cidr := range family.localRanges {
+			if _, network, err := net.ParseCIDR(cidr); err == nil && network.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isIPv6(host string) bool {
+	ip := net.ParseIP(host)
+	return ip != nil && ip.To4() == nil
+}
+
+func (pf *PortForwarderImpl) runCommand(name string, args ...string) error {
+	pf.logger.Debugf("Running command: %s %v", name, args)
+	if err := injectCommandFault(name, args...); err != nil {
+		return err
+	}
+	output, err := privsep.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,343 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"hysteria2_microservices/agent-service/internal/config"
+)
+
+const portMuxDialTimeout = 5 * time.Second
+
+var errClientHelloCaptured = errors.New("client hello captured")
+
+// PortMuxImpl accepts TCP connections on the shared public port, peeks at the TLS
+// ClientHello and splices each connection to the backend selected by SNI and ALPN.
+// TLS is never terminated here, so Reality and TLS inbounds behind it work unchanged.
+type PortMuxImpl struct {
+	logger *logrus.Logger
+	config *config.Config
+
+	mu       sync.Mutex
+	listener net.Listener
+	routes   []config.PortMuxRoute
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	running  bool
+	backends map[string]uint64
+
+	accepted       atomic.Uint64
+	active         atomic.Int64
+	handshakeFails atomic.Uint64
+	dialFails      atomic.Uint64
+}
+
+// NewPortMux creates a new PortMux
+func NewPortMux(logger *logrus.Logger, cfg *config.Config) PortMux {
+	return &PortMuxImpl{
+		logger:   logger,
+		config:   cfg,
+		backends: make(map[string]uint64),
+	}
+}
+
+// Start listens on the shared port and routes connections until ctx is cancelled or Stop is called
+func (pm *PortMuxImpl) Start(ctx context.Context) error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if pm.running {
+		return fmt.Errorf("port mux is already running")
+	}
+
+	routes := pm.effectiveRoutes()
+	if err := pm.checkBackends(routes); err != nil {
+		return err
+	}
+
+	lis, err := net.Listen("tcp", pm.config.PortMux.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", pm.config.PortMux.ListenAddr, err)
+	}
+
+	muxCtx, cancel := context.WithCancel(ctx)
+	pm.listener = lis
+	pm.routes = routes
+	pm.cancel = cancel
+	pm.running = true
+
+	pm.wg.Add(1)
+	go pm.acceptLoop(muxCtx)
+
+	go func() {
+		<-muxCtx.Done()
+		pm.Stop()
+	}()
+
+	pm.logger.Infof("Port mux listening on %s with %d routes, default backend %s",
+		lis.Addr(), len(routes), pm.config.PortMux.DefaultBackend)
+	return nil
+}
+
+// Stop closes the listener; established connections are left to finish
+func (pm *PortMuxImpl) Stop() error {
+	pm.mu.Lock()
+	if !pm.running {
+		pm.mu.Unlock()
+		return nil
+	}
+	pm.running = false
+	pm.cancel()
+	err := pm.listener.Close()
+	pm.mu.Unlock()
+
+	pm.wg.Wait()
+	pm.logger.Info("Port mux stopped")
+	return err
+}
+
+// IsRunning reports whether the mux is accepting connections
+func (pm *PortMuxImpl) IsRunning() bool {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	return pm.running
+}
+
+// GetStats returns connection counters and the active routing table
+func (pm *PortMuxImpl) GetStats() map[string]interface{} {
+	pm.mu.Lock()
+	backends := make(map[string]uint64, len(pm.backends))
+	for backend, count := range pm.backends {
+		backends[backend] = count
+	}
+	routes := make([]map[string]interface{}, 0, len(pm.routes))
+	for _, route := range pm.routes {
+		routes = append(routes, map[string]interface{}{
+			"sni":     route.SNI,
+			"alpn":    route.ALPN,
+			"backend": route.Backend,
+		})
+	}
+	running := pm.running
+	pm.mu.Unlock()
+
+	return map[string]interface{}{
+		"running":                running,
+		"listen_addr":            pm.config.PortMux.ListenAddr,
+		"default_backend":        pm.config.PortMux.DefaultBackend,
+		"routes":                 routes,
+		"accepted":               pm.accepted.Load(),
+		"active_connections":     pm.active.Load(),
+		"handshake_failures":     pm.handshakeFails.Load(),
+		"dial_failures":          pm.dialFails.Load(),
+		"connections_by_backend": backends,
+	}
+}
+
+// effectiveRoutes returns the configured routes, or when none are configured a
+// route sending the Reality server names to the local Xray inbound
+func (pm *PortMuxImpl) effectiveRoutes() []config.PortMuxRoute {
+	if len(pm.config.PortMux.Routes) > 0 {
+		return pm.config.PortMux.Routes
+	}
+
+	var routes []config.PortMuxRoute
+	if len(pm.config.Xray.RealityServerNames) > 0 {
+		routes = append(routes, config.PortMuxRoute{
+			SNI:     pm.config.Xray.RealityServerNames,
+			Backend: net.JoinHostPort("127.0.0.1", strconv.Itoa(pm.config.Xray.ListenPort)),
+		})
+	}
+	return routes
+}
+
+// checkBackends rejects backends that would loop connections back into the mux
+func (pm *PortMuxImpl) checkBackends(routes []config.PortMuxRoute) error {
+	_, listenPort, err := net.SplitHostPort(pm.config.PortMux.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("invalid listen address %q: %w", pm.config.PortMux.ListenAddr, err)
+	}
+
+	backends := []string{pm.config.PortMux.DefaultBackend}
+	for _, route := range routes {
+		backends = append(backends, route.Backend)
+	}
+
+	for _, backend := range backends {
+		host, port, err := net.SplitHostPort(backend)
+		if err != nil {
+			return fmt.Errorf("invalid backend %q: %w", backend, err)
+		}
+		if port == listenPort && (host == "" || host == "127.0.0.1" || host == "localhost" || host == "::1") {
+			return fmt.Errorf("backend %s points back at the mux listener; move it to another port", backend)
+		}
+	}
+	return nil
+}
+
+func (pm *PortMuxImpl) acceptLoop(ctx context.Context) {
+	defer pm.wg.Done()
+
+	for {
+		conn, err := pm.listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			pm.logger.Debugf("Port mux accept error: %v", err)
+			continue
+		}
+
+		pm.accepted.Add(1)
+		go pm.handle(conn)
+	}
+}
+
+func (pm *PortMuxImpl) handle(conn net.Conn) {
+	pm.active.Add(1)
+	defer pm.active.Add(-1)
+	defer conn.Close()
+
+	timeout := time.Duration(pm.config.PortMux.HandshakeTimeout) * time.Second
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+	sni, alpn, peeked, err := peekClientHello(conn)
+	if err != nil {
+		if len(peeked) == 0 {
+			// Nothing arrived before the deadline; drop it like a silent port would
+			pm.handshakeFails.Add(1)
+			return
+		}
+		// Not TLS: plain HTTP and probes go to the default backend
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	backend := pm.route(sni, alpn)
+
+	pm.mu.Lock()
+	pm.backends[backend]++
+	pm.mu.Unlock()
+
+	upstream, err := net.DialTimeout("tcp", backend, portMuxDialTimeout)
+	if err != nil {
+		pm.dialFails.Add(1)
+		pm.logger.Warnf("Port mux failed to reach backend %s for sni=%q: %v", backend, sni, err)
+		return
+	}
+	defer upstream.Close()
+
+	if _, err := upstream.Write(peeked); err != nil {
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, conn)
+		closeWrite(upstream)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, upstream)
+		closeWrite(conn)
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
+
+// route returns the backend of the first route matching sni and alpn
+func (pm *PortMuxImpl) route(sni string, alpn []string) string {
+	pm.mu.Lock()
+	routes := pm.routes
+	pm.mu.Unlock()
+
+	for _, route := range routes {
+		if matchesSNI(route.SNI, sni) && matchesALPN(route.ALPN, alpn) {
+			return route.Backend
+		}
+	}
+	return pm.config.PortMux.DefaultBackend
+}
+
+func matchesSNI(patterns []string, sni string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	sni = strings.ToLower(sni)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if pattern == sni {
+			return true
+		}
+		if strings.HasPrefix(pattern, "*.") && strings.HasSuffix(sni, pattern[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesALPN(wanted, offered []string) bool {
+	if len(wanted) == 0 {
+		return true
+	}
+	for _, w := range wanted {
+		for _, o := range offered {
+			if w == o {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// peekClientHello reads the TLS ClientHello from conn without answering it and
+// returns its SNI and ALPN along with every byte consumed, so the connection can
+// be replayed to the backend. Non-TLS input returns an error with the bytes read.
+func peekClientHello(conn net.Conn) (string, []string, []byte, error) {
+	var buf bytes.Buffer
+	var sni string
+	var alpn []string
+
+	err := tls.Server(readOnlyConn{Conn: conn, r: io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni = hello.ServerName
+			alpn = append([]string(nil), hello.SupportedProtos...)
+			return nil, errClientHelloCaptured
+		},
+	}).Handshake()
+
+	if errors.Is(err, errClientHelloCaptured) {
+		return sni, alpn, buf.Bytes(), nil
+	}
+	return "", nil, buf.Bytes(), err
+}
+
+// readOnlyConn feeds the TLS stack from a recording reader and refuses writes,
+// so peeking never sends an alert to the client
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error) { return 0, io.ErrClosedPipe }
+
+func closeWrite(conn net.Conn) {
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+		return
+	}
+	conn.Close()
+}
@@ -0,0 +1,219 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"hysteria2_microservices/agent-service/internal/config"
+)
+
+func TestPortMuxMatching(t *testing.T) {
+	sniTests := []struct {
+		patterns []string
+		sni      string
+		want     bool
+	}{
+		{nil, "anything.example.com", true},
+		{[]string{"www.microsoft.com"}, "WWW.Microsoft.com", true},
+		{[]string{"*.example.com"}, "cdn.example.com", true},
+		{[]string{"*.example.com"}, "example.com", false},
+		{[]string{"www.microsoft.com"}, "", false},
+	}
+	for _, tt := range sniTests {
+		if got := matchesSNI(tt.patterns, tt.sni); got != tt.want {
+			t.Errorf("matchesSNI(%v, %q) = %v, want %v", tt.patterns, tt.sni, got, tt.want)
+		}
+	}
+
+	alpnTests := []struct {
+		wanted  []string
+		offered []string
+		want    bool
+	}{
+		{nil, nil, true},
+		{[]string{"h2"}, []string{"h2", "http/1.1"}, true},
+		{[]string{"h2"}, []string{"http/1.1"}, false},
+		{[]string{"h2"}, nil, false},
+	}
+	for _, tt := range alpnTests {
+		if got := matchesALPN(tt.wanted, tt.offered); got != tt.want {
+			t.Errorf("matchesALPN(%v, %v) = %v, want %v", tt.wanted, tt.offered, got, tt.want)
+		}
+	}
+}
+
+func TestPortMuxRejectsLoopingBackends(t *testing.T) {
+	tests := []struct {
+		backend string
+		wantErr bool
+	}{
+		{"127.0.0.1:8443", false},
+		{"203.0.113.5:443", false},
+		{"127.0.0.1:443", true},
+		{"localhost:443", true},
+		{"[::1]:443", true},
+		{"no-port", true},
+	}
+	for _, tt := range tests {
+		cfg := &config.Config{}
+		cfg.PortMux = config.PortMuxConfig{ListenAddr: ":443", DefaultBackend: "127.0.0.1:8080"}
+		pm := NewPortMux(testLogger(), cfg).(*PortMuxImpl)
+		err := pm.checkBackends([]config.PortMuxRoute{{Backend: tt.backend}})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("backend %s: checkBackends() = %v, want error %v", tt.backend, err, tt.wantErr)
+		}
+	}
+}
+
+func TestPortMuxDefaultRoutesReality(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Xray.RealityServerNames = []string{"www.microsoft.com"}
+	cfg.Xray.ListenPort = 8443
+	pm := NewPortMux(testLogger(), cfg).(*PortMuxImpl)
+
+	routes := pm.effectiveRoutes()
+	if len(routes) != 1 || routes[0].Backend != "127.0.0.1:8443" || routes[0].SNI[0] != "www.microsoft.com" {
+		t.Errorf("routes = %+v, want the Reality names to the Xray inbound", routes)
+	}
+
+	cfg.PortMux.Routes = []config.PortMuxRoute{{ALPN: []string{"h2"}, Backend: "127.0.0.1:9000"}}
+	if routes := pm.effectiveRoutes(); len(routes) != 1 || routes[0].Backend != "127.0.0.1:9000" {
+		t.Errorf("routes = %+v, want the configured routes", routes)
+	}
+}
+
+// testBackend accepts connections and reports the first bytes each one sends
+type testBackend struct {
+	addr     string
+	received chan string
+}
+
+// listenLoopback listens on a loopback TCP port until the test ends and runs serve, when set,
+// on each connection it accepts
+func listenLoopback(t *testing.T, serve func(net.Conn)) net.Listener {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	if serve == nil {
+		return lis
+	}
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return lis
+}
+
+func newTestBackend(t *testing.T, reply string) *testBackend {
+	b := &testBackend{received: make(chan string, 4)}
+	b.addr = listenLoopback(t, func(conn net.Conn) {
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		b.received <- line
+		io.WriteString(conn, reply)
+	}).Addr().String()
+	return b
+}
+
+func (b *testBackend) wait(t *testing.T) string {
+	t.Helper()
+	select {
+	case got := <-b.received:
+		return got
+	case <-time.After(5 * time.Second):
+		t.Fatalf("nothing reached backend %s", b.addr)
+		return ""
+	}
+}
+
+func TestPortMuxRoutesConnections(t *testing.T) {
+	reality := newTestBackend(t, "")
+	h2 := newTestBackend(t, "")
+	decoy := newTestBackend(t, "HTTP/1.1 200 OK\r\n\r\n")
+
+	cfg := &config.Config{}
+	cfg.PortMux = config.PortMuxConfig{
+		ListenAddr:     "127.0.0.1:0",
+		DefaultBackend: decoy.addr,
+		Routes: []config.PortMuxRoute{
+			{SNI: []string{"www.microsoft.com"}, Backend: reality.addr},
+			{ALPN: []string{"h2"}, Backend: h2.addr},
+		},
+		HandshakeTimeout: 5,
+	}
+	pm := NewPortMux(testLogger(), cfg).(*PortMuxImpl)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := pm.Start(ctx); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer pm.Stop()
+	addr := pm.listener.Addr().String()
+
+	// handshake sends a ClientHello through the mux; backends are not TLS servers, so the
+	// handshake itself fails once the backend hangs up
+	handshake := func(serverName string, alpn ...string) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("dial mux: %v", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		tls.Client(conn, &tls.Config{ServerName: serverName, NextProtos: alpn, InsecureSkipVerify: true}).Handshake()
+	}
+
+	handshake("www.microsoft.com", "h2")
+	// The ClientHello is replayed to the backend untouched
+	if got := reality.wait(t); len(got) == 0 || got[0] != 0x16 {
+		t.Errorf("Reality backend received %q, want a TLS handshake record", got)
+	}
+	handshake("cdn.example.com", "h2", "http/1.1")
+	h2.wait(t)
+	handshake("cdn.example.com", "http/1.1")
+	decoy.wait(t)
+
+	// Plain HTTP falls through to the default backend with every byte intact
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial mux: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET / HTTP/1.1\r\n\r\n")
+	if got := decoy.wait(t); got != "GET / HTTP/1.1\r\n" {
+		t.Errorf("default backend received %q, want the request line", got)
+	}
+	if reply, _ := bufio.NewReader(conn).ReadString('\n'); !strings.HasPrefix(reply, "HTTP/1.1 200") {
+		t.Errorf("client got %q, want the backend's answer", reply)
+	}
+
+	stats := pm.GetStats()
+	byBackend := stats["connections_by_backend"].(map[string]uint64)
+	if byBackend[reality.addr] != 1 || byBackend[h2.addr] != 1 || byBackend[decoy.addr] != 2 || stats["accepted"] != uint64(4) {
+		t.Errorf("stats = %v, want 1 Reality, 1 h2 and 2 default connections", stats)
+	}
+
+	if err := pm.Start(ctx); err == nil {
+		t.Error("started a running mux")
+	}
+	cancel()
+	for deadline := time.Now().Add(time.Second); pm.IsRunning() && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if pm.IsRunning() {
+		t.Error("mux still running after its context was cancelled")
+	}
+}
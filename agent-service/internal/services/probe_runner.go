@@ -0,0 +1,452 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"hysteria2_microservices/agent-service/internal/config"
+)
+
+// Probe check results
+const (
+	ProbeStatusPass = "pass"
+	ProbeStatusWarn = "warn"
+	ProbeStatusFail = "fail"
+	ProbeStatusSkip = "skip"
+)
+
+const (
+	probeDialTimeout        = 5 * time.Second
+	probeReadTimeout        = 5 * time.Second
+	probeFloodDefault       = 200
+	probeFloodMax           = 1000
+	probeFloodInterval      = 2 * time.Millisecond
+	probeQUICResponseWindow = 2 * time.Second
+	probeQUICPacketSize     = 1200
+)
+
+// ProbeTarget describes the public surface of the node under test
+type ProbeTarget struct {
+	Host         string
+	TLSPorts     []int
+	QUICPort     int
+	SNIDomains   []string
+	FloodPackets int
+}
+
+// ProbeCheck is the outcome of a single probe
+type ProbeCheck struct {
+	Name     string
+	Target   string
+	Status   string
+	Detail   string
+	Hint     string // remediation of TLS checks that did not pass
+	Duration time.Duration
+}
+
+// ProbeReport collects the checks run against one node. Score is the share of
+// passed checks, warnings counting half, from 0 to 100.
+type ProbeReport struct {
+	Target     string
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Score      int
+	Checks     []ProbeCheck
+}
+
+// ProbeRunnerImpl imitates the probes censors send to suspected proxies: TLS
+// handshakes with the node's SNI domains and with unknown ones, plaintext on TLS
+// ports, replayed ClientHellos and floods of undecryptable QUIC Initial packets.
+// It runs on one node against another so the traffic arrives from outside.
+type ProbeRunnerImpl struct {
+	logger *logrus.Logger
+	config *config.Config
+}
+
+// NewProbeRunner creates a new ProbeRunner
+func NewProbeRunner(logger *logrus.Logger, cfg *config.Config) ProbeRunner {
+	return &ProbeRunnerImpl{
+		logger: logger,
+		config: cfg,
+	}
+}
+
+// Run probes target and returns the report; individual probe failures are recorded as checks
+func (pr *ProbeRunnerImpl) Run(ctx context.Context, target ProbeTarget) (*ProbeReport, error) {
+	if target.Host == "" {
+		return nil, fmt.Errorf("target host is required")
+	}
+	if len(target.TLSPorts) == 0 && target.QUICPort == 0 {
+		return nil, fmt.Errorf("target has no TLS or QUIC ports to probe")
+	}
+	if target.FloodPackets <= 0 {
+		target.FloodPackets = probeFloodDefault
+	}
+	if target.FloodPackets > probeFloodMax {
+		target.FloodPackets = probeFloodMax
+	}
+
+	report := &ProbeReport{
+		Target:    target.Host,
+		StartedAt: time.Now(),
+	}
+	pr.logger.Infof("Running probe tests against %s", target.Host)
+
+	for _, port := range target.TLSPorts {
+		addr := net.JoinHostPort(target.Host, strconv.Itoa(port))
+		for _, domain := range target.SNIDomains {
+			report.Checks = append(report.Checks, pr.timed("tls_sni", addr+" "+domain, func() (string, string) {
+				return pr.probeSNI(ctx, addr, domain)
+			}))
+		}
+		report.Checks = append(report.Checks, pr.timed("tls_unknown_sni", addr, func() (string, string) {
+			return pr.probeUnknownSNI(ctx, addr)
+		}))
+		report.Checks = append(report.Checks, pr.timed("non_tls", addr, func() (string, string) {
+			return pr.probeNonTLS(ctx, addr, target.SNIDomains)
+		}))
+		report.Checks = append(report.Checks, pr.timed("handshake_replay", addr, func() (string, string) {
+			return pr.probeReplay(ctx, addr, target.SNIDomains)
+		}))
+	}
+
+	if target.QUICPort > 0 {
+		addr := net.JoinHostPort(target.Host, strconv.Itoa(target.QUICPort))
+		report.Checks = append(report.Checks, pr.timed("quic_initial_flood", addr, func() (string, string) {
+			return pr.probeQUICFlood(ctx, addr, target.FloodPackets)
+		}))
+	}
+
+	report.FinishedAt = time.Now()
+	report.Score = probeScore(report.Checks)
+	pr.logger.Infof("Probe tests against %s finished with score %d", target.Host, report.Score)
+	return report, nil
+}
+
+// PublicTLSPorts returns the TCP ports where this node answers TLS to clients, which
+// are the ports other nodes probe
+func PublicTLSPorts(cfg *config.Config) []int {
+	var ports []int
+	if cfg.PortMux.Enabled {
+		return uniquePorts([]int{publicListenPort(cfg.PortMux.ListenAddr)})
+	}
+	if protocolEnabled(cfg, XrayProtocolVLESS) || protocolEnabled(cfg, XrayProtocolVLESSReality) {
+		ports = append(ports, cfg.Xray.ListenPort)
+	}
+	if protocolEnabled(cfg, XrayProtocolTrojan) {
+		ports = append(ports, cfg.Xray.TrojanPort)
+	}
+	if cfg.Decoy.Enabled {
+		ports = append(ports, publicListenPort(cfg.Decoy.ListenAddr))
+	}
+	return uniquePorts(ports)
+}
+
+func (pr *ProbeRunnerImpl) timed(name, target string, probe func() (string, string)) ProbeCheck {
+	started := time.Now()
+	status, detail := probe()
+	return ProbeCheck{
+		Name:     name,
+		Target:   target,
+		Status:   status,
+		Detail:   detail,
+		Duration: time.Since(started),
+	}
+}
+
+// probeSNI expects a handshake with a certificate valid for the domain, which is what
+// the real site or a Reality inbound borrowing it presents
+func (pr *ProbeRunnerImpl) probeSNI(ctx context.Context, addr, domain string) (string, string) {
+	state, err := probeHandshake(ctx, addr, domain, nil)
+	if err != nil {
+		return ProbeStatusFail, fmt.Sprintf("handshake failed: %v", err)
+	}
+	if len(state.PeerCertificates) == 0 {
+		return ProbeStatusFail, "no certificate presented"
+	}
+	leaf := state.PeerCertificates[0]
+	if err := leaf.VerifyHostname(domain); err != nil {
+		return ProbeStatusFail, fmt.Sprintf("certificate for %s does not cover the domain", strings.Join(leaf.DNSNames, ","))
+	}
+	if time.Now().After(leaf.NotAfter) {
+		return ProbeStatusWarn, fmt.Sprintf("certificate expired at %s", leaf.NotAfter.Format(time.RFC3339))
+	}
+	return ProbeStatusPass, fmt.Sprintf("certificate issued by %s", leaf.Issuer.String())
+}
+
+// probeUnknownSNI sends a domain the node does not serve. An ordinary server either
+// completes the handshake with a default certificate or answers with a TLS alert.
+func (pr *ProbeRunnerImpl) probeUnknownSNI(ctx context.Context, addr string) (string, string) {
+	domain := randomProbeLabel() + ".com"
+	_, err := probeHandshake(ctx, addr, domain, nil)
+	switch {
+	case err == nil:
+		return ProbeStatusPass, fmt.Sprintf("handshake completed for %s", domain)
+	case isTLSAlert(err):
+		return ProbeStatusPass, fmt.Sprintf("answered %s with %v", domain, err)
+	case isTimeout(err):
+		return ProbeStatusFail, fmt.Sprintf("no answer for %s, the connection hung", domain)
+	default:
+		return ProbeStatusWarn, fmt.Sprintf("connection dropped without a TLS alert for %s: %v", domain, err)
+	}
+}
+
+// probeNonTLS sends plaintext HTTP to a TLS port. Web servers reply with an alert or an
+// HTTP error; a proxy waiting silently for its own protocol stands out.
+func (pr *ProbeRunnerImpl) probeNonTLS(ctx context.Context, addr string, domains []string) (string, string) {
+	host := addr
+	if len(domains) > 0 {
+		host = domains[0]
+	}
+
+	dialer := net.Dialer{Timeout: probeDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return ProbeStatusFail, fmt.Sprintf("connect failed: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(probeReadTimeout))
+	if _, err := fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\nUser-Agent: Mozilla/5.0\r\n\r\n", host); err != nil {
+		return ProbeStatusWarn, fmt.Sprintf("write failed: %v", err)
+	}
+
+	buf := make([]byte, 16)
+	n, err := conn.Read(buf)
+	switch {
+	case n > 0 && buf[0] == 0x15:
+		return ProbeStatusPass, "answered with a TLS alert"
+	case n > 0 && bytes.HasPrefix(buf[:n], []byte("HTTP/")):
+		return ProbeStatusPass, "answered with an HTTP error"
+	case n > 0:
+		return ProbeStatusWarn, fmt.Sprintf("answered with unexpected bytes %x", buf[:n])
+	case isTimeout(err):
+		return ProbeStatusFail, "no answer, the connection was held open silently"
+	default:
+		return ProbeStatusWarn, fmt.Sprintf("connection closed without an answer: %v", err)
+	}
+}
+
+// probeReplay records the ClientHello of a fresh handshake and sends the same bytes on a
+// new connection. The node must answer the replay the way it answered the original.
+func (pr *ProbeRunnerImpl) probeReplay(ctx context.Context, addr string, domains []string) (string, string) {
+	domain := randomProbeLabel() + ".com"
+	if len(domains) > 0 {
+		domain = domains[0]
+	}
+
+	var hello bytes.Buffer
+	_, err := probeHandshake(ctx, addr, domain, &hello)
+	alerted := isTLSAlert(err)
+	if err != nil && !alerted {
+		return ProbeStatusSkip, fmt.Sprintf("original handshake failed: %v", err)
+	}
+	original := hello.Bytes()
+	if len(original) == 0 {
+		return ProbeStatusSkip, "no ClientHello was recorded"
+	}
+
+	dialer := net.Dialer{Timeout: probeDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return ProbeStatusFail, fmt.Sprintf("connect failed: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(probeReadTimeout))
+	if _, err := conn.Write(original); err != nil {
+		return ProbeStatusFail, fmt.Sprintf("replay write failed: %v", err)
+	}
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		if isTimeout(err) {
+			return ProbeStatusFail, "replayed ClientHello got no answer"
+		}
+		return ProbeStatusFail, fmt.Sprintf("replayed ClientHello was dropped: %v", err)
+	}
+	if alerted && header[0] == 0x15 {
+		return ProbeStatusPass, "replayed ClientHello was answered with an alert, like the original"
+	}
+	if header[0] != 0x16 {
+		return ProbeStatusWarn, fmt.Sprintf("replayed ClientHello was answered with record type %d instead of a ServerHello", header[0])
+	}
+	return ProbeStatusPass, "replayed ClientHello was answered with a ServerHello"
+}
+
+// probeQUICFlood sends Initial packets that cannot be decrypted, as scanners do, and
+// checks the port stays silent to them and still answers version negotiation afterwards
+func (pr *ProbeRunnerImpl) probeQUICFlood(ctx context.Context, addr string, packets int) (string, string) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return ProbeStatusFail, fmt.Sprintf("failed to resolve %s: %v", addr, err)
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return ProbeStatusFail, fmt.Sprintf("failed to open UDP socket: %v", err)
+	}
+	defer conn.Close()
+
+	answeredBefore := probeVersionNegotiation(conn)
+
+	sent := 0
+	for ; sent < packets; sent++ {
+		if ctx.Err() != nil {
+			break
+		}
+		if _, err := conn.Write(junkQUICInitial(1)); err != nil {
+			return ProbeStatusFail, fmt.Sprintf("flood stopped after %d packets: %v", sent, err)
+		}
+		time.Sleep(probeFloodInterval)
+	}
+
+	responses := 0
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(probeQUICResponseWindow))
+	for {
+		if _, err := conn.Read(buf); err != nil {
+			break
+		}
+		responses++
+	}
+
+	answeredAfter := probeVersionNegotiation(conn)
+
+	detail := fmt.Sprintf("%d of %d junk Initial packets answered", responses, sent)
+	switch {
+	case answeredBefore && !answeredAfter:
+		return ProbeStatusFail, detail + ", the port stopped answering after the flood"
+	case responses > 0:
+		return ProbeStatusWarn, detail
+	case !answeredBefore:
+		return ProbeStatusPass, detail + ", the port does not answer version negotiation (obfuscated)"
+	default:
+		return ProbeStatusPass, detail
+	}
+}
+
+// probeVersionNegotiation sends an Initial with a reserved version, which every QUIC
+// server answers with a Version Negotiation packet
+func probeVersionNegotiation(conn *net.UDPConn) bool {
+	if _, err := conn.Write(junkQUICInitial(0x1a2a3a4a)); err != nil {
+		return false
+	}
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(probeReadTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return false
+		}
+		// Version Negotiation: long header with version 0
+		if n >= 5 && buf[0]&0x80 != 0 && buf[1]|buf[2]|buf[3]|buf[4] == 0 {
+			return true
+		}
+	}
+}
+
+// junkQUICInitial builds a long-header Initial packet with random connection IDs and a
+// random payload, padded to the minimum client Initial size
+func junkQUICInitial(version uint32) []byte {
+	packet := make([]byte, probeQUICPacketSize)
+	rand.Read(packet)
+	packet[0] = 0xc0 | packet[0]&0x0f
+	packet[1] = byte(version >> 24)
+	packet[2] = byte(version >> 16)
+	packet[3] = byte(version >> 8)
+	packet[4] = byte(version)
+	packet[5] = 8  // DCID length
+	packet[14] = 8 // SCID length
+	return packet
+}
+
+// probeHandshake runs a TLS handshake without verification, optionally recording the
+// bytes sent before the first server response
+func probeHandshake(ctx context.Context, addr, serverName string, hello *bytes.Buffer) (tls.ConnectionState, error) {
+	dialer := net.Dialer{Timeout: probeDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(probeReadTimeout))
+	if hello != nil {
+		conn = &helloRecordingConn{Conn: conn, hello: hello}
+	}
+	client := tls.Client(conn, &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"h2", "http/1.1"},
+	})
+	if err := client.HandshakeContext(ctx); err != nil {
+		return tls.ConnectionState{}, err
+	}
+	return client.ConnectionState(), nil
+}
+
+// helloRecordingConn copies writes into hello until the first read
+type helloRecordingConn struct {
+	net.Conn
+	hello *bytes.Buffer
+	read  bool
+}
+
+func (c *helloRecordingConn) Write(p []byte) (int, error) {
+	if !c.read {
+		c.hello.Write(p)
+	}
+	return c.Conn.Write(p)
+}
+
+func (c *helloRecordingConn) Read(p []byte) (int, error) {
+	c.read = true
+	return c.Conn.Read(p)
+}
+
+func probeScore(checks []ProbeCheck) int {
+	total, points := 0, 0
+	for _, check := range checks {
+		switch check.Status {
+		case ProbeStatusPass:
+			points += 2
+		case ProbeStatusWarn:
+			points++
+		case ProbeStatusSkip:
+			continue
+		}
+		total += 2
+	}
+	if total == 0 {
+		return 0
+	}
+	return points * 100 / total
+}
+
+// isTLSAlert reports whether the server ended the handshake with an alert; crypto/tls
+// does not export the error type for alerts received by a client
+func isTLSAlert(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "remote error: tls:")
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func randomProbeLabel() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,157 @@
+package services
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"hysteria2_microservices/agent-service/internal/config"
+)
+
+func newTestProbeRunner() *ProbeRunnerImpl {
+	return NewProbeRunner(testLogger(), &config.Config{}).(*ProbeRunnerImpl)
+}
+
+func TestProbeRunWellBehavedServer(t *testing.T) {
+	// The test server's certificate covers example.com, like a site a node borrows
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	tlsPort, _ := strconv.Atoi(port)
+
+	report, err := newTestProbeRunner().Run(context.Background(), ProbeTarget{
+		Host:       host,
+		TLSPorts:   []int{tlsPort},
+		SNIDomains: []string{"example.com"},
+	})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	var names []string
+	for _, check := range report.Checks {
+		names = append(names, check.Name)
+		if check.Status != ProbeStatusPass {
+			t.Errorf("%s on %s: %s (%s)", check.Name, check.Target, check.Status, check.Detail)
+		}
+	}
+	if want := []string{"tls_sni", "tls_unknown_sni", "non_tls", "handshake_replay"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("checks %v, want %v", names, want)
+	}
+	if report.Score != 100 {
+		t.Errorf("score %d, want 100", report.Score)
+	}
+
+	// A domain the certificate does not cover fails
+	if status, detail := newTestProbeRunner().probeSNI(context.Background(), server.Listener.Addr().String(), "www.other.test"); status != ProbeStatusFail {
+		t.Errorf("probeSNI for an uncovered domain = %s (%s), want fail", status, detail)
+	}
+}
+
+func TestProbeDetectsSilentProxy(t *testing.T) {
+	// A proxy that holds connections open waiting for its own protocol
+	lis := listenLoopback(t, func(conn net.Conn) {
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if status, detail := newTestProbeRunner().probeUnknownSNI(ctx, lis.Addr().String()); status != ProbeStatusFail {
+		t.Errorf("probeUnknownSNI on a silent port = %s (%s), want fail", status, detail)
+	}
+}
+
+func TestProbeNonTLSDroppedConnection(t *testing.T) {
+	lis := listenLoopback(t, func(conn net.Conn) { conn.Close() })
+
+	if status, detail := newTestProbeRunner().probeNonTLS(context.Background(), lis.Addr().String(), nil); status != ProbeStatusWarn {
+		t.Errorf("probeNonTLS on a port closing connections = %s (%s), want warn", status, detail)
+	}
+}
+
+// fakeQUICServer answers version negotiation, and with answerJunk every other packet too
+func fakeQUICServer(t *testing.T, answerJunk bool) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n >= 5 && string(buf[1:5]) == "\x1a\x2a\x3a\x4a" {
+				conn.WriteTo([]byte{0x80, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, addr)
+			} else if answerJunk {
+				conn.WriteTo([]byte{0x40, 1, 2, 3}, addr)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestProbeQUICFlood(t *testing.T) {
+	pr := newTestProbeRunner()
+
+	status, detail := pr.probeQUICFlood(context.Background(), fakeQUICServer(t, false), 10)
+	if status != ProbeStatusPass || !strings.HasPrefix(detail, "0 of 10") {
+		t.Errorf("flood against a silent server = %s (%s), want pass", status, detail)
+	}
+
+	status, detail = pr.probeQUICFlood(context.Background(), fakeQUICServer(t, true), 10)
+	if status != ProbeStatusWarn || !strings.HasPrefix(detail, "10 of 10") {
+		t.Errorf("flood against a server answering junk = %s (%s), want warn", status, detail)
+	}
+}
+
+func TestProbeRunValidates(t *testing.T) {
+	pr := newTestProbeRunner()
+	if _, err := pr.Run(context.Background(), ProbeTarget{TLSPorts: []int{443}}); err == nil {
+		t.Error("ran without a host")
+	}
+	if _, err := pr.Run(context.Background(), ProbeTarget{Host: "203.0.113.10"}); err == nil {
+		t.Error("ran without ports")
+	}
+}
+
+func TestProbeScore(t *testing.T) {
+	checks := []ProbeCheck{
+		{Status: ProbeStatusPass},
+		{Status: ProbeStatusWarn},
+		{Status: ProbeStatusFail},
+		{Status: ProbeStatusSkip},
+	}
+	if score := probeScore(checks); score != 50 {
+		t.Errorf("score %d, want 50 with a warning counting half and skips ignored", score)
+	}
+	if score := probeScore([]ProbeCheck{{Status: ProbeStatusSkip}}); score != 0 {
+		t.Errorf("score %d with only skipped checks, want 0", score)
+	}
+}
+
+func TestPublicTLSPorts(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Xray.ListenPort, cfg.Xray.TrojanPort = 443, 8443
+	cfg.Decoy.Enabled = true
+	cfg.Decoy.ListenAddr = "127.0.0.1:8080"
+	if ports := PublicTLSPorts(cfg); !reflect.DeepEqual(ports, []int{443, 8443}) {
+		t.Errorf("ports %v, want the Xray ports without the loopback decoy", ports)
+	}
+
+	cfg.PortMux.Enabled = true
+	cfg.PortMux.ListenAddr = "0.0.0.0:443"
+	if ports := PublicTLSPorts(cfg); !reflect.DeepEqual(ports, []int{443}) {
+		t.Errorf("ports behind the mux %v, want 443", ports)
+	}
+}
@@ -0,0 +1,214 @@
+package services
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"hysteria2_microservices/agent-service/internal/config"
+)
+
+// ProtocolHysteria2 is the protocol matrix key for the Hysteria2 server
+const ProtocolHysteria2 = "hysteria2"
+
+const (
+	hysteria2ConfigPath  = "/etc/hysteria/config.yaml"
+	hysteria2CertPath    = "/etc/hysteria/cert.pem"
+	hysteria2KeyPath     = "/etc/hysteria/key.pem"
+	hysteria2ServiceName = "hysteria2"
+)
+
+// Reconcile outcomes reported per protocol
+const (
+	reconcileStarted   = "started"
+	reconcileStopped   = "stopped"
+	reconcileAdded     = "inbound added"
+	reconcileRemoved   = "inbound removed"
+	reconcileUnchanged = "unchanged"
+)
+
+// xrayMatrixProtocols are the protocol matrix keys served by Xray inbounds
+var xrayMatrixProtocols = []string{
+	XrayProtocolVLESS,
+	XrayProtocolVLESSReality,
+	XrayProtocolTrojan,
+	XrayProtocolShadowsocks2022,
+}
+
+// ProtocolReconcilerImpl starts and stops Hysteria2 and adds and removes Xray inbounds
+// so the node serves exactly the protocols enabled in its matrix
+type ProtocolReconcilerImpl struct {
+	logger          *logrus.Logger
+	config          *config.Config
+	hysteriaManager HysteriaManager
+	xrayManager     XrayManager
+
+	mu sync.Mutex
+}
+
+// NewProtocolReconciler creates a new ProtocolReconciler
+func NewProtocolReconciler(logger *logrus.Logger, cfg *config.Config, hysteriaManager HysteriaManager, xrayManager XrayManager) ProtocolReconciler {
+	return &ProtocolReconcilerImpl{
+		logger:          logger,
+		config:          cfg,
+		hysteriaManager: hysteriaManager,
+		xrayManager:     xrayManager,
+	}
+}
+
+// Reconcile applies the desired matrix and returns the outcome for each protocol.
+// Protocols missing from desired are left as they are. Every protocol is attempted
+// even if an earlier one fails; the error lists the ones that could not be applied.
+func (pr *ProtocolReconcilerImpl) Reconcile(desired map[string]bool) (map[string]string, error) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	for protocol := range desired {
+		if protocol != ProtocolHysteria2 && !isXrayMatrixProtocol(protocol) {
+			return nil, fmt.Errorf("unsupported protocol %q", protocol)
+		}
+	}
+
+	protocols := make([]string, 0, len(desired))
+	for protocol := range desired {
+		protocols = append(protocols, protocol)
+	}
+	sort.Strings(protocols)
+
+	if pr.config.Node.Protocols == nil {
+		pr.config.Node.Protocols = make(map[string]bool)
+	}
+
+	results := make(map[string]string, len(desired))
+	var failed []string
+	xrayChanged := false
+
+	for _, protocol := range protocols {
+		enabled := desired[protocol]
+
+		var result string
+		var err error
+		if protocol == ProtocolHysteria2 {
+			result, err = pr.reconcileHysteria2(enabled)
+		} else {
+			result, err = pr.reconcileXrayInbound(protocol, enabled)
+			if err == nil && result != reconcileUnchanged {
+				xrayChanged = true
+			}
+		}
+
+		if err != nil {
+			pr.logger.Errorf("Failed to reconcile %s (enabled=%t): %v", protocol, enabled, err)
+			results[protocol] = fmt.Sprintf("error: %v", err)
+			failed = append(failed, protocol)
+			continue
+		}
+
+		results[protocol] = result
+		pr.config.Node.Protocols[protocol] = enabled
+	}
+
+	if xrayChanged {
+		if err := pr.applyXray(); err != nil {
+			pr.logger.Errorf("Failed to apply Xray changes: %v", err)
+			return results, fmt.Errorf("protocol matrix saved but Xray could not be reloaded: %w", err)
+		}
+	}
+
+	if len(failed) > 0 {
+		return results, fmt.Errorf("failed to reconcile %s", strings.Join(failed, ", "))
+	}
+
+	pr.logger.Infof("Protocol matrix reconciled: %v", results)
+	return results, nil
+}
+
+// GetProtocols returns the last applied protocol matrix
+func (pr *ProtocolReconcilerImpl) GetProtocols() map[string]bool {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	protocols := make(map[string]bool, len(pr.config.Node.Protocols))
+	for protocol, enabled := range pr.config.Node.Protocols {
+		protocols[protocol] = enabled
+	}
+	return protocols
+}
+
+func (pr *ProtocolReconcilerImpl) reconcileHysteria2(enabled bool) (string, error) {
+	status, err := pr.hysteriaManager.GetHysteria2Status()
+	if err != nil {
+		return "", fmt.Errorf("failed to get Hysteria2 status: %w", err)
+	}
+	running, _ := status["running"].(bool)
+
+	switch {
+	case enabled && !running:
+		config, err := pr.hysteriaManager.GenerateConfig("")
+		if err != nil {
+			return "", fmt.Errorf("failed to generate config: %w", err)
+		}
+		if err := writeGeneratedConfig(pr.config, hysteria2ConfigPath, []byte(config)); err != nil {
+			return "", fmt.Errorf("failed to save config: %w", err)
+		}
+		if err := pr.hysteriaManager.StartHysteria2(hysteria2ConfigPath); err != nil {
+			return "", err
+		}
+		return reconcileStarted, nil
+	case !enabled && running:
+		if err := pr.hysteriaManager.StopHysteria2(); err != nil {
+			return "", err
+		}
+		return reconcileStopped, nil
+	default:
+		return reconcileUnchanged, nil
+	}
+}
+
+func (pr *ProtocolReconcilerImpl) reconcileXrayInbound(protocol string, enabled bool) (string, error) {
+	exists, err := pr.xrayManager.HasInbound(protocol)
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case enabled && !exists:
+		if err := pr.xrayManager.AddInbound(protocol); err != nil {
+			return "", err
+		}
+		return reconcileAdded, nil
+	case !enabled && exists:
+		if err := pr.xrayManager.RemoveInbound(protocol); err != nil {
+			return "", err
+		}
+		return reconcileRemoved, nil
+	default:
+		return reconcileUnchanged, nil
+	}
+}
+
+// applyXray restarts Xray with the updated inbounds, or stops it once no Xray protocol is enabled
+func (pr *ProtocolReconcilerImpl) applyXray() error {
+	for _, protocol := range xrayMatrixProtocols {
+		if pr.config.Node.Protocols[protocol] {
+			return pr.xrayManager.RestartXray(pr.xrayManager.ConfigPath())
+		}
+	}
+
+	pr.logger.Info("No Xray protocols enabled, stopping Xray")
+	if err := pr.xrayManager.StopXray(); err != nil {
+		pr.logger.Warnf("Failed to stop Xray: %v", err)
+	}
+	return nil
+}
+
+func isXrayMatrixProtocol(protocol string) bool {
+	for _, p := range xrayMatrixProtocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,141 @@
+package services
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"hysteria2_microservices/agent-service/internal/config"
+)
+
+type fakeHysteria struct {
+	HysteriaManager
+	running bool
+	stopped int
+}
+
+func (f *fakeHysteria) GetHysteria2Status() (map[string]interface{}, error) {
+	return map[string]interface{}{"running": f.running}, nil
+}
+
+func (f *fakeHysteria) StopHysteria2() error {
+	f.running = false
+	f.stopped++
+	return nil
+}
+
+// fakeXray keeps inbounds in memory and records restarts
+type fakeXray struct {
+	XrayManager
+	inbounds  map[string]bool
+	failAdd   string
+	restarted int
+	stopped   int
+}
+
+func (f *fakeXray) HasInbound(protocol string) (bool, error) { return f.inbounds[protocol], nil }
+
+func (f *fakeXray) AddInbound(protocol string) error {
+	if protocol == f.failAdd {
+		return errors.New("port already in use")
+	}
+	f.inbounds[protocol] = true
+	return nil
+}
+
+func (f *fakeXray) RemoveInbound(protocol string) error {
+	delete(f.inbounds, protocol)
+	return nil
+}
+
+func (f *fakeXray) ConfigPath() string { return "/etc/xray/config.json" }
+
+func (f *fakeXray) RestartXray(configPath string) error {
+	f.restarted++
+	return nil
+}
+
+func (f *fakeXray) StopXray() error {
+	f.stopped++
+	return nil
+}
+
+func newTestReconciler(hysteriaRunning bool, inbounds ...string) (*ProtocolReconcilerImpl, *fakeHysteria, *fakeXray) {
+	hysteria := &fakeHysteria{running: hysteriaRunning}
+	xray := &fakeXray{inbounds: map[string]bool{}}
+	for _, protocol := range inbounds {
+		xray.inbounds[protocol] = true
+	}
+	return NewProtocolReconciler(testLogger(), &config.Config{}, hysteria, xray).(*ProtocolReconcilerImpl), hysteria, xray
+}
+
+func TestReconcileProtocols(t *testing.T) {
+	pr, hysteria, xray := newTestReconciler(true, XrayProtocolVLESSReality)
+
+	results, err := pr.Reconcile(map[string]bool{
+		ProtocolHysteria2:           false,
+		XrayProtocolVLESSReality:    true,
+		XrayProtocolTrojan:          true,
+		XrayProtocolShadowsocks2022: false,
+	})
+	if err != nil {
+		t.Fatalf("Reconcile: %v", err)
+	}
+
+	want := map[string]string{
+		ProtocolHysteria2:           reconcileStopped,
+		XrayProtocolVLESSReality:    reconcileUnchanged,
+		XrayProtocolTrojan:          reconcileAdded,
+		XrayProtocolShadowsocks2022: reconcileUnchanged,
+	}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("results = %v, want %v", results, want)
+	}
+	if hysteria.stopped != 1 || !xray.inbounds[XrayProtocolTrojan] || xray.restarted != 1 {
+		t.Errorf("hysteria stopped %d times, inbounds %v, xray restarted %d times", hysteria.stopped, xray.inbounds, xray.restarted)
+	}
+	if got := pr.GetProtocols(); !got[XrayProtocolTrojan] || got[ProtocolHysteria2] {
+		t.Errorf("matrix = %v", got)
+	}
+
+	// Nothing changes on a second pass, so Xray is left running
+	if _, err := pr.Reconcile(map[string]bool{XrayProtocolTrojan: true}); err != nil || xray.restarted != 1 {
+		t.Errorf("second pass: err %v, xray restarted %d times", err, xray.restarted)
+	}
+}
+
+func TestReconcileStopsXrayWithoutProtocols(t *testing.T) {
+	pr, _, xray := newTestReconciler(false, XrayProtocolTrojan)
+
+	results, err := pr.Reconcile(map[string]bool{XrayProtocolTrojan: false})
+	if err != nil {
+		t.Fatalf("Reconcile: %v", err)
+	}
+	if results[XrayProtocolTrojan] != reconcileRemoved || xray.stopped != 1 || xray.restarted != 0 {
+		t.Errorf("results %v, xray stopped %d and restarted %d times; want it stopped", results, xray.stopped, xray.restarted)
+	}
+}
+
+func TestReconcileReportsFailures(t *testing.T) {
+	pr, _, xray := newTestReconciler(false)
+	xray.failAdd = XrayProtocolTrojan
+
+	results, err := pr.Reconcile(map[string]bool{XrayProtocolTrojan: true, XrayProtocolVLESS: true})
+	if err == nil {
+		t.Fatal("Reconcile succeeded with a failed inbound")
+	}
+	// The other protocols are still applied
+	if results[XrayProtocolVLESS] != reconcileAdded || results[XrayProtocolTrojan] != "error: port already in use" {
+		t.Errorf("results = %v", results)
+	}
+	if got := pr.GetProtocols(); got[XrayProtocolTrojan] || !got[XrayProtocolVLESS] {
+		t.Errorf("matrix = %v, want only vless recorded", got)
+	}
+
+	if _, err := pr.Reconcile(map[string]bool{"vmess": true, XrayProtocolTrojan: false}); err == nil {
+		t.Error("accepted an unsupported protocol")
+	}
+	if len(xray.inbounds) != 1 {
+		t.Errorf("inbounds changed by a rejected matrix: %v", xray.inbounds)
+	}
+}
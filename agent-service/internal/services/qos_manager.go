@@ -0,0 +1,466 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"hysteria2_microservices/agent-service/internal/config"
+	"hysteria2_microservices/agent-service/internal/privsep"
+)
+
+// QoS queueing disciplines
+const (
+	QoSQdiscFQCoDel = "fq_codel"
+	QoSQdiscCake    = "cake"
+)
+
+const (
+	qosChain = "HYSTERIA2-QOS"
+
+	qosDefaultProbeSamples = 10
+	qosProbeTimeout        = 2 * time.Second
+	qosProbeSpacing        = 100 * time.Millisecond
+
+	// qosSettleDelay lets the queue built up under the old qdisc drain before latency is
+	// measured under the new one
+	qosSettleDelay = 3 * time.Second
+)
+
+// qosDSCPClasses are the class names the iptables DSCP target accepts
+var qosDSCPClasses = map[string]bool{
+	"CS0": true, "CS1": true, "CS2": true, "CS3": true, "CS4": true, "CS5": true, "CS6": true, "CS7": true,
+	"AF11": true, "AF12": true, "AF13": true,
+	"AF21": true, "AF22": true, "AF23": true,
+	"AF31": true, "AF32": true, "AF33": true,
+	"AF41": true, "AF42": true, "AF43": true,
+	"EF": true,
+}
+
+// QoSClass marks the packets the node sends to or from Ports with a DSCP class. CAKE's
+// diffserv4 tins serve EF and CS5-CS7 first and CS1 last; fq_codel ignores the marks, but
+// they travel on to the networks beyond the node.
+type QoSClass struct {
+	Name     string `json:"name"`
+	Protocol string `json:"protocol,omitempty"` // "tcp" or "udp", empty for both
+	Ports    string `json:"ports"`              // "53" or "20000-50000", as source or destination
+	DSCP     string `json:"dscp"`               // "EF", "AF41", "CS1"...
+}
+
+// QoSPolicy is the queueing of the node's egress interface. Classes are matched in order and
+// the first match wins; a policy without classes uses the agent's default classes.
+type QoSPolicy struct {
+	Enabled       bool       `json:"enabled"`
+	Qdisc         string     `json:"qdisc"`          // QoSQdiscFQCoDel or QoSQdiscCake
+	BandwidthMbps int        `json:"bandwidth_mbps"` // rate CAKE shapes to, 0 leaves it unshaped
+	Classes       []QoSClass `json:"classes,omitempty"`
+}
+
+// QoSLatency is the TCP handshake time to the probe targets. It is taken with whatever the
+// node carries at the time, since the delay queued behind that traffic is what the qdisc
+// changes, and Mbps records how busy the interface was.
+type QoSLatency struct {
+	MedianMs   float64   `json:"median_ms"`
+	P95Ms      float64   `json:"p95_ms"`
+	Samples    int       `json:"samples"`
+	Mbps       float64   `json:"mbps"` // sent on the interface while measuring
+	MeasuredAt time.Time `json:"measured_at"`
+}
+
+// QoSStatus is the policy in force and the latency measured around its last change
+type QoSStatus struct {
+	Policy    QoSPolicy   `json:"policy"`
+	Interface string      `json:"interface"`
+	Qdisc     string      `json:"qdisc,omitempty"`  // root qdisc as tc reports it
+	Before    *QoSLatency `json:"before,omitempty"` // just before the policy was applied
+	After     *QoSLatency `json:"after,omitempty"`  // once it had settled
+	Latest    *QoSLatency `json:"latest,omitempty"` // last periodic measurement
+	AppliedAt time.Time   `json:"applied_at"`
+}
+
+// QoSManagerImpl sets up the root qdisc of the egress interface and fills the
+// HYSTERIA2-QOS mangle chain with a DSCP rule per traffic class. The chain is hooked on
+// POSTROUTING so forwarded client traffic is marked along with the node's own.
+type QoSManagerImpl struct {
+	logger *logrus.Logger
+	config *config.Config
+
+	// applyMu serialises policy changes, which measure for several seconds; mu guards status
+	applyMu sync.Mutex
+	mu      sync.Mutex
+	status  QoSStatus
+}
+
+// NewQoSManager creates a new QoSManager
+func NewQoSManager(logger *logrus.Logger, cfg *config.Config) QoSManager {
+	return &QoSManagerImpl{
+		logger: logger,
+		config: cfg,
+		status: QoSStatus{
+			Policy: QoSPolicy{
+				Enabled:       cfg.QoS.Enabled,
+				Qdisc:         cfg.QoS.Qdisc,
+				BandwidthMbps: cfg.QoS.BandwidthMbps,
+			},
+		},
+	}
+}
+
+// Start restores the policy the orchestrator set, applies it and measures latency every
+// qos.probe_interval seconds until ctx is done
+func (qm *QoSManagerImpl) Start(ctx context.Context) error {
+	qm.mu.Lock()
+	data, err := os.ReadFile(qm.config.QoS.StateFile)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		qm.logger.Warnf("Ignoring unreadable QoS policy: %v", err)
+	default:
+		var saved QoSStatus
+		if err := json.Unmarshal(data, &saved); err != nil {
+			qm.logger.Warnf("Ignoring invalid QoS policy: %v", err)
+		} else {
+			qm.status = saved
+		}
+	}
+	policy := qm.status.Policy
+	qm.mu.Unlock()
+
+	qm.applyMu.Lock()
+	if err := validateQoSPolicy(&policy); err != nil {
+		qm.logger.Errorf("QoS policy is not applied: %v", err)
+	} else if policy.Enabled {
+		if err := qm.apply(policy); err != nil {
+			qm.logger.Errorf("QoS policy is not applied: %v", err)
+		}
+	}
+	qm.applyMu.Unlock()
+
+	interval := time.Duration(qm.config.QoS.ProbeInterval) * time.Second
+	if interval > 0 && len(qm.config.QoS.ProbeTargets) > 0 {
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ticker.C:
+				case <-ctx.Done():
+					return
+				}
+
+				latency, err := qm.measureLatency(ctx)
+				if err != nil {
+					qm.logger.Debugf("Failed to measure latency: %v", err)
+					continue
+				}
+				qm.mu.Lock()
+				qm.status.Latest = latency
+				qm.mu.Unlock()
+			}
+		}()
+	}
+
+	qm.logger.Infof("QoS manager started: enabled=%t qdisc=%s", policy.Enabled, policy.Qdisc)
+	return nil
+}
+
+// SetPolicy applies and saves a policy, measuring latency before and after it so the effect
+// can be compared. A policy the node fails to apply is not saved.
+func (qm *QoSManagerImpl) SetPolicy(ctx context.Context, policy QoSPolicy) (*QoSStatus, error) {
+	if err := validateQoSPolicy(&policy); err != nil {
+		return nil, err
+	}
+
+	qm.applyMu.Lock()
+	defer qm.applyMu.Unlock()
+
+	before, err := qm.measureLatency(ctx)
+	if err != nil {
+		qm.logger.Warnf("Failed to measure latency before applying QoS policy: %v", err)
+	}
+
+	if err := qm.apply(policy); err != nil {
+		return nil, err
+	}
+	appliedAt := time.Now().UTC()
+
+	var after *QoSLatency
+	select {
+	case <-time.After(qosSettleDelay):
+		if after, err = qm.measureLatency(ctx); err != nil {
+			qm.logger.Warnf("Failed to measure latency after applying QoS policy: %v", err)
+		}
+	case <-ctx.Done():
+	}
+
+	qm.mu.Lock()
+	qm.status.Policy = policy
+	qm.status.Before = before
+	qm.status.After = after
+	qm.status.AppliedAt = appliedAt
+	if after != nil {
+		qm.status.Latest = after
+	}
+	saved := qm.status
+	qm.mu.Unlock()
+
+	if err := qm.save(saved); err != nil {
+		return nil, err
+	}
+
+	qm.logger.Infof("QoS policy applied: enabled=%t qdisc=%s classes=%d", policy.Enabled, policy.Qdisc, len(policy.Classes))
+	return qm.Status(), nil
+}
+
+// Status returns the policy in force, the root qdisc tc reports and the latency measurements
+func (qm *QoSManagerImpl) Status() *QoSStatus {
+	qm.mu.Lock()
+	status := qm.status
+	qm.mu.Unlock()
+
+	status.Interface = qm.qosInterface()
+	if output, err := privsep.Command("tc", "qdisc", "show", "dev", status.Interface, "root").Output(); err == nil {
+		status.Qdisc = strings.TrimSpace(string(output))
+	}
+	return &status
+}
+
+// Latency returns the last latency measurement, nil before the first one
+func (qm *QoSManagerImpl) Latency() *QoSLatency {
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+	if qm.status.Latest == nil {
+		return nil
+	}
+	latency := *qm.status.Latest
+	return &latency
+}
+
+// apply replaces the root qdisc and the DSCP rules with the policy's, or restores the
+// kernel's default qdisc and removes the rules when it is disabled
+func (qm *QoSManagerImpl) apply(policy QoSPolicy) error {
+	iface := qm.qosInterface()
+
+	if !policy.Enabled {
+		// Deleting the root qdisc falls back to the default; it fails when none was set
+		if err := qm.runCommand("tc", "qdisc", "del", "dev", iface, "root"); err != nil {
+			qm.logger.Debugf("No root qdisc to remove on %s: %v", iface, err)
+		}
+		qm.removeMarking()
+		return nil
+	}
+
+	if _, err := exec.LookPath("tc"); err != nil {
+		return fmt.Errorf("QoS needs tc from iproute2: tc is not installed")
+	}
+	if err := qm.runCommand("tc", qosQdiscArgs(iface, policy)...); err != nil {
+		return fmt.Errorf("failed to set %s qdisc on %s: %w", policy.Qdisc, iface, err)
+	}
+
+	classes := policy.Classes
+	if len(classes) == 0 {
+		classes = defaultQoSClasses(qm.config)
+	}
+	return forEachFamily(qm.config, qm.logger, func(family ipFamily) error {
+		return applyIPTablesRuleset(qm.logger, family, []iptablesChain{
+			{Table: "mangle", Name: qosChain, Hook: "POSTROUTING", Rules: qosMarkingRules(classes)},
+		})
+	})
+}
+
+// removeMarking removes the DSCP rules; IPv6 rules are removed even when IPv6 has since
+// been disabled. The OUTPUT jump is left over from agents that created the chain empty.
+func (qm *QoSManagerImpl) removeMarking() {
+	for _, family := range []ipFamily{ipv4Family, ipv6Family} {
+		qm.runCommand(family.iptables, "-t", "mangle", "-D", "POSTROUTING", "-j", qosChain)
+		qm.runCommand(family.iptables, "-t", "mangle", "-D", "OUTPUT", "-j", qosChain)
+		qm.runCommand(family.iptables, "-t", "mangle", "-F", qosChain)
+		qm.runCommand(family.iptables, "-t", "mangle", "-X", qosChain)
+	}
+}
+
+func (qm *QoSManagerImpl) save(status QoSStatus) error {
+	status.Latest = nil
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(qm.config.QoS.StateFile), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(qm.config.QoS.StateFile, data, 0600); err != nil {
+		return fmt.Errorf("failed to save QoS policy: %w", err)
+	}
+	return nil
+}
+
+// measureLatency times TCP handshakes to every probe target qos.probe_samples times
+func (qm *QoSManagerImpl) measureLatency(ctx context.Context) (*QoSLatency, error) {
+	targets := qm.config.QoS.ProbeTargets
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no QoS probe targets configured")
+	}
+	samples := qm.config.QoS.ProbeSamples
+	if samples <= 0 {
+		samples = qosDefaultProbeSamples
+	}
+
+	iface := qm.qosInterface()
+	_, txStart, txErr := interfaceBytes(iface)
+	started := time.Now()
+
+	dialer := net.Dialer{Timeout: qosProbeTimeout}
+	rtts := make([]float64, 0, samples*len(targets))
+	var lastErr error
+	for i := 0; i < samples; i++ {
+		for _, target := range targets {
+			dialed := time.Now()
+			conn, err := dialer.DialContext(ctx, "tcp", target)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			rtts = append(rtts, float64(time.Since(dialed).Microseconds())/1000)
+			conn.Close()
+		}
+
+		select {
+		case <-time.After(qosProbeSpacing):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if len(rtts) == 0 {
+		return nil, fmt.Errorf("no probe target answered: %w", lastErr)
+	}
+
+	sort.Float64s(rtts)
+	latency := &QoSLatency{
+		MedianMs:   rtts[len(rtts)/2],
+		P95Ms:      rtts[(len(rtts)*95+99)/100-1],
+		Samples:    len(rtts),
+		MeasuredAt: time.Now().UTC(),
+	}
+	if _, txEnd, err := interfaceBytes(iface); err == nil && txErr == nil && txEnd >= txStart {
+		latency.Mbps = float64(txEnd-txStart) * 8 / time.Since(started).Seconds() / 1e6
+	}
+	return latency, nil
+}
+
+func (qm *QoSManagerImpl) qosInterface() string {
+	if qm.config.QoS.Interface != "" {
+		return qm.config.QoS.Interface
+	}
+	return qm.config.Network.DefaultInterface
+}
+
+func (qm *QoSManagerImpl) runCommand(name string, args ...string) error {
+	qm.logger.Debugf("Running command: %s %v", name, args)
+	if err := injectCommandFault(name, args...); err != nil {
+		return err
+	}
+	output, err := privsep.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// qosQdiscArgs returns the tc arguments replacing the root qdisc of iface
+func qosQdiscArgs(iface string, policy QoSPolicy) []string {
+	args := []string{"qdisc", "replace", "dev", iface, "root", policy.Qdisc}
+	if policy.Qdisc != QoSQdiscCake {
+		return args
+	}
+	if policy.BandwidthMbps > 0 {
+		args = append(args, "bandwidth", fmt.Sprintf("%dmbit", policy.BandwidthMbps))
+	} else {
+		args = append(args, "unlimited")
+	}
+	return append(args, "diffserv4")
+}
+
+// qosMarkingRules renders the DSCP rules of the classes. The DSCP target does not stop the
+// chain, so each mark is followed by a RETURN to make the first matching class win.
+func qosMarkingRules(classes []QoSClass) []string {
+	var rules []string
+	for _, class := range classes {
+		protocols := []string{"tcp", "udp"}
+		if class.Protocol != "" {
+			protocols = []string{class.Protocol}
+		}
+		ports := strings.Replace(class.Ports, "-", ":", 1)
+		for _, protocol := range protocols {
+			for _, direction := range []string{"--sport", "--dport"} {
+				match := fmt.Sprintf("-p %s %s %s", protocol, direction, ports)
+				rules = append(rules,
+					fmt.Sprintf("%s -m comment --comment %s -j DSCP --set-dscp-class %s", match, strconv.Quote(class.Name), class.DSCP),
+					match+" -j RETURN",
+				)
+			}
+		}
+	}
+	return rules
+}
+
+// defaultQoSClasses puts DNS and the agent's own control traffic ahead of client traffic
+func defaultQoSClasses(cfg *config.Config) []QoSClass {
+	classes := []QoSClass{{Name: "dns", Ports: "53", DSCP: "EF"}}
+	if cfg.Node.GRPCPort > 0 {
+		classes = append(classes, QoSClass{Name: "agent", Protocol: "tcp", Ports: strconv.Itoa(cfg.Node.GRPCPort), DSCP: "CS6"})
+	}
+	return classes
+}
+
+// validateQoSPolicy checks a policy and normalises its qdisc and classes
+func validateQoSPolicy(policy *QoSPolicy) error {
+	policy.Qdisc = strings.ToLower(policy.Qdisc)
+	if policy.Qdisc == "" {
+		policy.Qdisc = QoSQdiscFQCoDel
+	}
+	if policy.Qdisc != QoSQdiscFQCoDel && policy.Qdisc != QoSQdiscCake {
+		return fmt.Errorf("qdisc must be %s or %s, got %q", QoSQdiscFQCoDel, QoSQdiscCake, policy.Qdisc)
+	}
+	if policy.BandwidthMbps < 0 {
+		return fmt.Errorf("bandwidth must not be negative")
+	}
+
+	names := make(map[string]bool, len(policy.Classes))
+	for i := range policy.Classes {
+		class := &policy.Classes[i]
+		if class.Name == "" || strings.ContainsAny(class.Name, "\"\\\n") {
+			return fmt.Errorf("class %d: name is required and must not contain quotes, backslashes or newlines", i+1)
+		}
+		if names[class.Name] {
+			return fmt.Errorf("duplicate class %q", class.Name)
+		}
+		names[class.Name] = true
+
+		class.Protocol = strings.ToLower(class.Protocol)
+		class.DSCP = strings.ToUpper(class.DSCP)
+		if !qosDSCPClasses[class.DSCP] {
+			return fmt.Errorf("class %q: unknown DSCP class %q", class.Name, class.DSCP)
+		}
+		// Ports are checked the same way for either protocol
+		protocol := class.Protocol
+		if protocol == "" {
+			protocol = "tcp"
+		}
+		if err := validateFirewallRule(&FirewallRule{Protocol: protocol, Ports: class.Ports}); err != nil {
+			return fmt.Errorf("class %q: %w", class.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package services
+
+import (
+	"reflect"
+	"testing"
+
+	"hysteria2_microservices/agent-service/internal/config"
+)
+
+func TestQoSQdiscArgs(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy QoSPolicy
+		want   []string
+	}{
+		{"fq_codel", QoSPolicy{Qdisc: QoSQdiscFQCoDel, BandwidthMbps: 100}, []string{"qdisc", "replace", "dev", "eth0", "root", "fq_codel"}},
+		{"shaped cake", QoSPolicy{Qdisc: QoSQdiscCake, BandwidthMbps: 950}, []string{"qdisc", "replace", "dev", "eth0", "root", "cake", "bandwidth", "950mbit", "diffserv4"}},
+		{"unshaped cake", QoSPolicy{Qdisc: QoSQdiscCake}, []string{"qdisc", "replace", "dev", "eth0", "root", "cake", "unlimited", "diffserv4"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := qosQdiscArgs("eth0", tt.policy); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("qosQdiscArgs = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQoSMarkingRules(t *testing.T) {
+	got := qosMarkingRules([]QoSClass{
+		{Name: "agent", Protocol: "tcp", Ports: "50051", DSCP: "CS6"},
+		{Name: "bulk", Protocol: "udp", Ports: "20000-30000", DSCP: "CS1"},
+	})
+	// Every mark returns, so the first matching class wins
+	want := []string{
+		`-p tcp --sport 50051 -m comment --comment "agent" -j DSCP --set-dscp-class CS6`,
+		`-p tcp --sport 50051 -j RETURN`,
+		`-p tcp --dport 50051 -m comment --comment "agent" -j DSCP --set-dscp-class CS6`,
+		`-p tcp --dport 50051 -j RETURN`,
+		`-p udp --sport 20000:30000 -m comment --comment "bulk" -j DSCP --set-dscp-class CS1`,
+		`-p udp --sport 20000:30000 -j RETURN`,
+		`-p udp --dport 20000:30000 -m comment --comment "bulk" -j DSCP --set-dscp-class CS1`,
+		`-p udp --dport 20000:30000 -j RETURN`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("qosMarkingRules =\n%v\nwant\n%v", got, want)
+	}
+
+	// Classes without a protocol mark TCP and UDP
+	if got := qosMarkingRules([]QoSClass{{Name: "dns", Ports: "53", DSCP: "EF"}}); len(got) != 8 {
+		t.Errorf("rules of a class for both protocols = %v", got)
+	}
+}
+
+func TestValidateQoSPolicy(t *testing.T) {
+	policy := QoSPolicy{Qdisc: "CAKE", Classes: []QoSClass{{Name: "dns", Protocol: "UDP", Ports: "53", DSCP: "ef"}}}
+	if err := validateQoSPolicy(&policy); err != nil {
+		t.Fatal(err)
+	}
+	if policy.Qdisc != QoSQdiscCake || policy.Classes[0].Protocol != "udp" || policy.Classes[0].DSCP != "EF" {
+		t.Errorf("normalised policy = %+v", policy)
+	}
+	if policy := (QoSPolicy{}); validateQoSPolicy(&policy) != nil || policy.Qdisc != QoSQdiscFQCoDel {
+		t.Errorf("empty policy = %+v, want fq_codel", policy)
+	}
+
+	tests := map[string]QoSPolicy{
+		"unknown qdisc":      {Qdisc: "htb"},
+		"negative bandwidth": {BandwidthMbps: -1},
+		"unknown DSCP class": {Classes: []QoSClass{{Name: "dns", Ports: "53", DSCP: "AF44"}}},
+		"quoted name":        {Classes: []QoSClass{{Name: `dns" -j ACCEPT`, Ports: "53", DSCP: "EF"}}},
+		"duplicate class":    {Classes: []QoSClass{{Name: "dns", Ports: "53", DSCP: "EF"}, {Name: "dns", Ports: "853", DSCP: "EF"}}},
+		"invalid ports":      {Classes: []QoSClass{{Name: "dns", Ports: "53;reboot", DSCP: "EF"}}},
+	}
+	for name, policy := range tests {
+		t.Run(name, func(t *testing.T) {
+			if err := validateQoSPolicy(&policy); err == nil {
+				t.Error("validateQoSPolicy succeeded")
+			}
+		})
+	}
+}
+
+func TestDefaultQoSClasses(t *testing.T) {
+	cfg := &config.Config{}
+	if classes := defaultQoSClasses(cfg); len(classes) != 1 || classes[0].Name != "dns" {
+		t.Errorf("classes without a gRPC port = %+v", classes)
+	}
+	cfg.Node.GRPCPort = 50051
+	if classes := defaultQoSClasses(cfg); len(classes) != 2 || classes[1].Ports != "50051" || classes[1].DSCP != "CS6" {
+		t.Errorf("classes = %+v, want the agent's port in CS6", classes)
+	}
+}
@@ -0,0 +1,110 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	quicObfsSaltLen   = 8
+	quicObfsHeaderLen = 2 // big-endian payload length, lets the receiver strip padding
+	quicObfsMaxPacket = 65535
+)
+
+var errQUICObfsShortPacket = errors.New("obfuscated packet too short")
+
+// QUICObfuscator implements the wire transform applied by the QUIC relay.
+// Encode and Decode are symmetric so clients can share the same code.
+//
+// Wire format: [salt (scramble only)] [length] [payload] [padding], where
+// everything after the salt is XORed with SHA-256(key || salt) when scrambling.
+type QUICObfuscator struct {
+	key      []byte
+	scramble bool
+	padTo    int
+}
+
+// NewQUICObfuscator creates an obfuscator. padTo <= 0 disables padding.
+func NewQUICObfuscator(key string, scramble bool, padTo int) *QUICObfuscator {
+	return &QUICObfuscator{
+		key:      []byte(key),
+		scramble: scramble,
+		padTo:    padTo,
+	}
+}
+
+// Overhead returns the bytes added to every packet before padding
+func (o *QUICObfuscator) Overhead() int {
+	if o.scramble {
+		return quicObfsSaltLen + quicObfsHeaderLen
+	}
+	return quicObfsHeaderLen
+}
+
+// Encode wraps a QUIC datagram, padding it to the configured size and scrambling it if enabled
+func (o *QUICObfuscator) Encode(payload []byte) ([]byte, error) {
+	size := o.Overhead() + len(payload)
+	if size > quicObfsMaxPacket {
+		return nil, fmt.Errorf("packet of %d bytes exceeds maximum size", len(payload))
+	}
+	if size < o.padTo {
+		size = o.padTo
+	}
+
+	packet := make([]byte, size)
+	offset := 0
+	if o.scramble {
+		if _, err := rand.Read(packet[:quicObfsSaltLen]); err != nil {
+			return nil, fmt.Errorf("failed to generate salt: %w", err)
+		}
+		offset = quicObfsSaltLen
+	}
+
+	binary.BigEndian.PutUint16(packet[offset:], uint16(len(payload)))
+	copy(packet[offset+quicObfsHeaderLen:], payload)
+
+	if padStart := offset + quicObfsHeaderLen + len(payload); padStart < size {
+		if _, err := rand.Read(packet[padStart:]); err != nil {
+			return nil, fmt.Errorf("failed to generate padding: %w", err)
+		}
+	}
+
+	if o.scramble {
+		o.xor(packet[:quicObfsSaltLen], packet[quicObfsSaltLen:])
+	}
+	return packet, nil
+}
+
+// Decode reverses Encode and returns the original datagram. The input slice is modified in place.
+func (o *QUICObfuscator) Decode(packet []byte) ([]byte, error) {
+	if len(packet) < o.Overhead() {
+		return nil, errQUICObfsShortPacket
+	}
+
+	body := packet
+	if o.scramble {
+		body = packet[quicObfsSaltLen:]
+		o.xor(packet[:quicObfsSaltLen], body)
+	}
+
+	length := int(binary.BigEndian.Uint16(body))
+	if quicObfsHeaderLen+length > len(body) {
+		return nil, fmt.Errorf("invalid payload length %d", length)
+	}
+	return body[quicObfsHeaderLen : quicObfsHeaderLen+length], nil
+}
+
+// xor applies the salamander-style keystream derived from the key and per-packet salt
+func (o *QUICObfuscator) xor(salt, data []byte) {
+	h := sha256.New()
+	h.Write(o.key)
+	h.Write(salt)
+	stream := h.Sum(nil)
+
+	for i := range data {
+		data[i] ^= stream[i%len(stream)]
+	}
+}
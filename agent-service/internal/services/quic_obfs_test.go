@@ -0,0 +1,199 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"hysteria2_microservices/agent-service/internal/config"
+)
+
+func TestQUICObfuscatorRoundTrip(t *testing.T) {
+	payload := bytes.Repeat([]byte("quic"), 100)
+
+	tests := []struct {
+		name     string
+		scramble bool
+		padTo    int
+		wantSize int
+	}{
+		{"length prefix only", false, 0, 2 + 400},
+		{"padded", false, 1350, 1350},
+		{"scrambled", true, 0, 8 + 2 + 400},
+		{"scrambled and padded", true, 1350, 1350},
+		// Padding never truncates a larger packet
+		{"padding below packet size", true, 100, 8 + 2 + 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := NewQUICObfuscator("shared-key", tt.scramble, tt.padTo)
+			packet, err := o.Encode(payload)
+			if err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+			if len(packet) != tt.wantSize {
+				t.Errorf("encoded %d bytes, want %d", len(packet), tt.wantSize)
+			}
+			if tt.scramble && bytes.Contains(packet, []byte("quicquic")) {
+				t.Error("scrambled packet carries the payload in the clear")
+			}
+
+			decoded, err := o.Decode(packet)
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if !bytes.Equal(decoded, payload) {
+				t.Errorf("decoded %q, want the original payload", decoded)
+			}
+		})
+	}
+}
+
+func TestQUICObfuscatorSaltsEveryPacket(t *testing.T) {
+	o := NewQUICObfuscator("shared-key", true, 0)
+	a, _ := o.Encode([]byte("same payload"))
+	b, _ := o.Encode([]byte("same payload"))
+	if bytes.Equal(a, b) {
+		t.Error("identical payloads encoded identically")
+	}
+
+	// A client with another key does not recover the payload
+	other := NewQUICObfuscator("other-key", true, 0)
+	if decoded, err := other.Decode(a); err == nil && bytes.Equal(decoded, []byte("same payload")) {
+		t.Error("decoded with the wrong key")
+	}
+}
+
+func TestQUICObfuscatorRejectsMalformedPackets(t *testing.T) {
+	o := NewQUICObfuscator("", false, 0)
+
+	if _, err := o.Decode([]byte{0x01}); err == nil {
+		t.Error("accepted a packet shorter than the header")
+	}
+	// The length prefix claims more than the packet holds
+	if _, err := o.Decode([]byte{0x00, 0x10, 'a', 'b'}); err == nil {
+		t.Error("accepted a length beyond the packet")
+	}
+	if _, err := o.Encode(make([]byte, quicObfsMaxPacket)); err == nil {
+		t.Error("encoded a payload that does not fit in a datagram")
+	}
+
+	scrambled := NewQUICObfuscator("key", true, 0)
+	if _, err := scrambled.Decode(make([]byte, quicObfsSaltLen+1)); err == nil {
+		t.Error("accepted a scrambled packet without a length")
+	}
+}
+
+// freeUDPPort returns a loopback UDP port nothing listens on
+func freeUDPPort(t *testing.T) int {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestQUICRelay(t *testing.T) {
+	// Hysteria2 stand-in answering every datagram with "ack:" and the datagram
+	upstream, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen upstream: %v", err)
+	}
+	defer upstream.Close()
+	received := make(chan []byte, 8)
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := upstream.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			received <- append([]byte(nil), buf[:n]...)
+			upstream.WriteToUDP(append([]byte("ack:"), buf[:n]...), addr)
+		}
+	}()
+
+	cfg := &config.Config{}
+	cfg.Hysteria2.DefaultListenPort = freeUDPPort(t)
+	cfg.Hysteria2.QUICRelayUpstreamPort = upstream.LocalAddr().(*net.UDPAddr).Port
+	cfg.Hysteria2.QUICScrambleTransform = true
+	cfg.Hysteria2.QUICObfuscationKey = "shared-key"
+	cfg.Hysteria2.QUICPacketPadding = 1200
+	cfg.Hysteria2.QUICTimingRandomization = true
+	cfg.Hysteria2.QUICTimingJitterMs = 5
+
+	relay := NewQUICRelay(testLogger(), cfg).(*QUICRelayImpl)
+	if err := relay.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer relay.Stop()
+
+	client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: cfg.Hysteria2.DefaultListenPort})
+	if err != nil {
+		t.Fatalf("dial relay: %v", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	obfs := NewQUICObfuscator("shared-key", true, 1200)
+
+	// Probes that do not decode are dropped without an answer
+	client.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+
+	packet, _ := obfs.Encode([]byte("initial"))
+	if _, err := client.Write(packet); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	select {
+	case got := <-received:
+		if string(got) != "initial" {
+			t.Errorf("Hysteria2 received %q, want the decoded datagram", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing forwarded to Hysteria2")
+	}
+
+	buf := make([]byte, 2048)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("read answer: %v", err)
+	}
+	if n != 1200 {
+		t.Errorf("answer is %d bytes, want padded to 1200", n)
+	}
+	answer, err := obfs.Decode(buf[:n])
+	if err != nil || string(answer) != "ack:initial" {
+		t.Errorf("answer decoded to %q (%v), want ack:initial", answer, err)
+	}
+
+	// The relay counts a packet once it is written, which may be after the client read it
+	stats := relay.GetStats()
+	for deadline := time.Now().Add(time.Second); stats["packets_out"] != uint64(1) && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+		stats = relay.GetStats()
+	}
+	if stats["active_sessions"] != 1 || stats["packets_in"] != uint64(1) || stats["packets_out"] != uint64(1) || stats["packets_dropped"] != uint64(1) {
+		t.Errorf("stats = %v, want one session, one packet each way and the probe dropped", stats)
+	}
+
+	if err := relay.Stop(); err != nil {
+		t.Errorf("Stop: %v", err)
+	}
+	if relay.IsRunning() || relay.GetStats()["active_sessions"] != 0 {
+		t.Error("relay still running or holding sessions after Stop")
+	}
+}
+
+func TestQUICRelayNeedsKeyToScramble(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Hysteria2.QUICScrambleTransform = true
+
+	relay := NewQUICRelay(testLogger(), cfg)
+	if err := relay.Start(context.Background()); err == nil {
+		relay.Stop()
+		t.Fatal("started scrambling without a key")
+	}
+}
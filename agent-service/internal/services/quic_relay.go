@@ -0,0 +1,320 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"hysteria2_microservices/agent-service/internal/config"
+)
+
+const (
+	quicRelayBufferSize     = 65535
+	quicRelayQueueSize      = 512
+	quicRelaySessionTimeout = 2 * time.Minute
+	quicRelayJanitorPeriod  = 30 * time.Second
+)
+
+// QUICRelayImpl is a UDP relay in front of Hysteria2 that applies packet padding,
+// scrambling and timing jitter according to the QUIC* obfuscation settings.
+// Clients send obfuscated datagrams to the public port; the relay decodes them and
+// forwards plain QUIC to Hysteria2 on a loopback port.
+type QUICRelayImpl struct {
+	logger *logrus.Logger
+	config *config.Config
+
+	mu         sync.Mutex
+	conn       *net.UDPConn
+	obfuscator *QUICObfuscator
+	sessions   map[string]*quicRelaySession
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+	running    bool
+
+	packetsIn  atomic.Uint64
+	packetsOut atomic.Uint64
+	dropped    atomic.Uint64
+}
+
+type quicRelaySession struct {
+	clientAddr *net.UDPAddr
+	upstream   *net.UDPConn
+	lastSeen   atomic.Int64
+	outbound   chan []byte
+	closeOnce  sync.Once
+}
+
+// NewQUICRelay creates a new QUICRelay
+func NewQUICRelay(logger *logrus.Logger, cfg *config.Config) QUICRelay {
+	return &QUICRelayImpl{
+		logger:   logger,
+		config:   cfg,
+		sessions: make(map[string]*quicRelaySession),
+	}
+}
+
+// Start listens on the public Hysteria2 port and relays traffic until ctx is cancelled or Stop is called
+func (r *QUICRelayImpl) Start(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.running {
+		return fmt.Errorf("QUIC relay is already running")
+	}
+
+	h := r.config.Hysteria2
+	if h.QUICScrambleTransform && h.QUICObfuscationKey == "" {
+		return fmt.Errorf("QUIC scramble transform requires an obfuscation key")
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", h.DefaultListenPort))
+	if err != nil {
+		return fmt.Errorf("failed to resolve listen address: %w", err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	padTo := 0
+	if h.QUICPacketPadding > 0 {
+		padTo = h.QUICPacketPadding
+	}
+
+	relayCtx, cancel := context.WithCancel(ctx)
+	r.conn = conn
+	r.obfuscator = NewQUICObfuscator(h.QUICObfuscationKey, h.QUICScrambleTransform, padTo)
+	r.cancel = cancel
+	r.running = true
+
+	r.wg.Add(2)
+	go r.readLoop(relayCtx)
+	go r.janitor(relayCtx)
+
+	go func() {
+		<-relayCtx.Done()
+		r.Stop()
+	}()
+
+	r.logger.Infof("QUIC relay listening on %s, forwarding to 127.0.0.1:%d (scramble=%v, padding=%d, jitter=%v)",
+		addr, h.QUICRelayUpstreamPort, h.QUICScrambleTransform, padTo, h.QUICTimingRandomization)
+	return nil
+}
+
+// Stop closes the public socket and all upstream sessions
+func (r *QUICRelayImpl) Stop() error {
+	r.mu.Lock()
+	if !r.running {
+		r.mu.Unlock()
+		return nil
+	}
+	r.running = false
+	r.cancel()
+	err := r.conn.Close()
+	for key, session := range r.sessions {
+		session.close()
+		delete(r.sessions, key)
+	}
+	r.mu.Unlock()
+
+	r.wg.Wait()
+	r.logger.Info("QUIC relay stopped")
+	return err
+}
+
+// IsRunning reports whether the relay is accepting traffic
+func (r *QUICRelayImpl) IsRunning() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.running
+}
+
+// GetStats returns relay counters
+func (r *QUICRelayImpl) GetStats() map[string]interface{} {
+	r.mu.Lock()
+	sessions := len(r.sessions)
+	running := r.running
+	r.mu.Unlock()
+
+	return map[string]interface{}{
+		"running":         running,
+		"active_sessions": sessions,
+		"packets_in":      r.packetsIn.Load(),
+		"packets_out":     r.packetsOut.Load(),
+		"packets_dropped": r.dropped.Load(),
+	}
+}
+
+// readLoop decodes client datagrams and forwards them to Hysteria2
+func (r *QUICRelayImpl) readLoop(ctx context.Context) {
+	defer r.wg.Done()
+
+	buf := make([]byte, quicRelayBufferSize)
+	for {
+		n, clientAddr, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			r.logger.Debugf("QUIC relay read error: %v", err)
+			continue
+		}
+
+		payload, err := r.obfuscator.Decode(buf[:n])
+		if err != nil {
+			// Probes and garbage are silently dropped, like a closed port would
+			r.dropped.Add(1)
+			continue
+		}
+		r.packetsIn.Add(1)
+
+		session, err := r.getSession(ctx, clientAddr)
+		if err != nil {
+			r.logger.Warnf("Failed to create relay session for %s: %v", clientAddr, err)
+			r.dropped.Add(1)
+			continue
+		}
+		session.lastSeen.Store(time.Now().UnixNano())
+
+		if _, err := session.upstream.Write(payload); err != nil {
+			r.logger.Debugf("Failed to forward packet upstream for %s: %v", clientAddr, err)
+			r.dropped.Add(1)
+		}
+	}
+}
+
+func (r *QUICRelayImpl) getSession(ctx context.Context, clientAddr *net.UDPAddr) (*quicRelaySession, error) {
+	key := clientAddr.String()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.running {
+		return nil, fmt.Errorf("QUIC relay is stopped")
+	}
+	if session, ok := r.sessions[key]; ok {
+		return session, nil
+	}
+
+	upstreamAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: r.config.Hysteria2.QUICRelayUpstreamPort}
+	upstream, err := net.DialUDP("udp", nil, upstreamAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	session := &quicRelaySession{
+		clientAddr: clientAddr,
+		upstream:   upstream,
+		outbound:   make(chan []byte, quicRelayQueueSize),
+	}
+	session.lastSeen.Store(time.Now().UnixNano())
+	r.sessions[key] = session
+
+	r.wg.Add(2)
+	go r.upstreamLoop(session)
+	go r.writeLoop(ctx, session)
+
+	r.logger.Debugf("QUIC relay session opened for %s", key)
+	return session, nil
+}
+
+// upstreamLoop encodes Hysteria2 responses and queues them for the client
+func (r *QUICRelayImpl) upstreamLoop(session *quicRelaySession) {
+	defer r.wg.Done()
+	defer close(session.outbound)
+
+	buf := make([]byte, quicRelayBufferSize)
+	for {
+		n, err := session.upstream.Read(buf)
+		if err != nil {
+			return
+		}
+
+		packet, err := r.obfuscator.Encode(buf[:n])
+		if err != nil {
+			r.dropped.Add(1)
+			continue
+		}
+
+		select {
+		case session.outbound <- packet:
+		default:
+			r.dropped.Add(1)
+		}
+	}
+}
+
+// writeLoop sends queued packets to the client. With timing randomization each
+// packet is held for a random delay, but never sent before the previous one,
+// so jitter does not reorder packets or compound under load.
+func (r *QUICRelayImpl) writeLoop(ctx context.Context, session *quicRelaySession) {
+	defer r.wg.Done()
+
+	maxJitter := time.Duration(r.config.Hysteria2.QUICTimingJitterMs) * time.Millisecond
+	jitter := r.config.Hysteria2.QUICTimingRandomization && maxJitter > 0
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	var lastSend time.Time
+	for packet := range session.outbound {
+		if jitter {
+			sendAt := time.Now().Add(time.Duration(rng.Int63n(int64(maxJitter))))
+			if sendAt.Before(lastSend) {
+				sendAt = lastSend
+			}
+			if wait := time.Until(sendAt); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+					return
+				}
+			}
+			lastSend = sendAt
+		}
+
+		if _, err := r.conn.WriteToUDP(packet, session.clientAddr); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			r.dropped.Add(1)
+			continue
+		}
+		r.packetsOut.Add(1)
+	}
+}
+
+// janitor closes sessions that have been idle longer than the session timeout
+func (r *QUICRelayImpl) janitor(ctx context.Context) {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(quicRelayJanitorPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			cutoff := time.Now().Add(-quicRelaySessionTimeout).UnixNano()
+			r.mu.Lock()
+			for key, session := range r.sessions {
+				if session.lastSeen.Load() < cutoff {
+					session.close()
+					delete(r.sessions, key)
+					r.logger.Debugf("QUIC relay session for %s expired", key)
+				}
+			}
+			r.mu.Unlock()
+		}
+	}
+}
+
+func (s *quicRelaySession) close() {
+	s.closeOnce.Do(func() {
+		s.upstream.Close()
+	})
+}
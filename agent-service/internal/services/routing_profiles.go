@@ -0,0 +1,709 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"hysteria2_microservices/agent-service/internal/config"
+	"hysteria2_microservices/agent-service/internal/hysteriaconfig"
+)
+
+// Routes a profile rule may send traffic to besides the outbounds of the profile
+const (
+	RoutingOutboundDirect = "direct" // the node's default outbound
+	RoutingOutboundWARP   = "warp"   // the local WARP SOCKS5 proxy
+	RoutingOutboundBlock  = "block"
+)
+
+// Routing profile outbound types
+const (
+	RoutingOutboundSocks       = "socks"
+	RoutingOutboundHTTP        = "http"
+	RoutingOutboundShadowsocks = "shadowsocks"
+	RoutingOutboundTrojan      = "trojan"
+)
+
+// Balancer strategies for rules sending traffic to several outbounds
+const (
+	RoutingStrategyRandom     = "random"
+	RoutingStrategyRoundRobin = "roundRobin"
+)
+
+const (
+	routingProfilesFile = "profiles.json"
+	routingHysteriaFile = "hysteria.json"
+
+	xrayProfilePrefix      = "profile-"
+	xrayProfileWARPTag     = xrayProfilePrefix + "warp"
+	hysteriaWARPOutbound   = "warp"
+	hysteriaDirectOutbound = "direct"
+)
+
+var (
+	routingGeositePattern = regexp.MustCompile(`^geosite:[a-z0-9_-]+(@[a-z0-9_-]+)?$`)
+	routingGeoIPPattern   = regexp.MustCompile(`^geoip:[a-z]{2}$`)
+)
+
+// RoutingProfile sends the domains and addresses of its rules to chosen outbounds, such
+// as "Netflix via node X" or "local banking direct". Users limits the profile to those
+// Xray users; Hysteria2 cannot tell users apart, so such profiles are not applied to it.
+type RoutingProfile struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description,omitempty"`
+	Outbounds   []RoutingOutbound `json:"outbounds,omitempty"`
+	Rules       []RoutingRule     `json:"rules"`
+	Users       []string          `json:"users,omitempty"` // Xray user emails, empty applies to everyone
+}
+
+// RoutingOutbound is a proxy rules of the profile can send traffic to, usually another node
+type RoutingOutbound struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"` // "socks", "http", "shadowsocks" or "trojan"
+	Address  string `json:"address"`
+	Port     int    `json:"port"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Method   string `json:"method,omitempty"` // shadowsocks cipher
+	SNI      string `json:"sni,omitempty"`    // trojan TLS server name, the address when empty
+}
+
+// RoutingRule sends domains, with their subdomains, and addresses to Outbounds: "direct",
+// "warp", "block" or outbounds of the profile. Traffic sent to several outbounds is
+// balanced between them by Xray; Hysteria2 cannot balance and uses the first it supports.
+type RoutingRule struct {
+	Domains   []string `json:"domains,omitempty"` // "example.com" or "geosite:netflix"
+	IPs       []string `json:"ips,omitempty"`     // "203.0.113.0/24", "2001:db8::1" or "geoip:ru"
+	Outbounds []string `json:"outbounds"`
+	Strategy  string   `json:"strategy,omitempty"` // "random" (default) or "roundRobin"
+}
+
+// hysteriaRouting is the compiled routing Hysteria2 picks up when its config is generated
+type hysteriaRouting struct {
+	Outbounds []hysteriaconfig.Outbound `json:"outbounds,omitempty"`
+	ACL       []string                  `json:"acl,omitempty"`
+}
+
+// RoutingProfileManagerImpl keeps the assigned profiles on disk and compiles them into
+// Xray outbounds, balancers and routing rules and into Hysteria2 outbounds and ACL rules
+type RoutingProfileManagerImpl struct {
+	logger          *logrus.Logger
+	config          *config.Config
+	hysteriaManager HysteriaManager
+	xrayManager     XrayManager
+
+	mu       sync.Mutex
+	profiles []RoutingProfile
+}
+
+// NewRoutingProfileManager creates a new RoutingProfileManager
+func NewRoutingProfileManager(logger *logrus.Logger, cfg *config.Config, hysteriaManager HysteriaManager, xrayManager XrayManager) RoutingProfileManager {
+	return &RoutingProfileManagerImpl{
+		logger:          logger,
+		config:          cfg,
+		hysteriaManager: hysteriaManager,
+		xrayManager:     xrayManager,
+	}
+}
+
+// Start restores the saved profiles
+func (rp *RoutingProfileManagerImpl) Start(ctx context.Context) error {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	data, err := os.ReadFile(filepath.Join(rp.config.Routing.StateDir, routingProfilesFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read routing profiles: %w", err)
+	}
+	if err := json.Unmarshal(data, &rp.profiles); err != nil {
+		return fmt.Errorf("invalid routing profiles: %w", err)
+	}
+
+	if len(rp.profiles) > 0 {
+		if err := rp.apply(); err != nil {
+			return err
+		}
+	}
+	rp.logger.Infof("Routing profiles restored: %d profiles", len(rp.profiles))
+	return nil
+}
+
+// SetProfiles replaces the assigned profiles and applies them. An empty slice removes all
+// profile routing.
+func (rp *RoutingProfileManagerImpl) SetProfiles(profiles []RoutingProfile) error {
+	names := make(map[string]bool, len(profiles))
+	for i := range profiles {
+		if err := validateRoutingProfile(&profiles[i]); err != nil {
+			return fmt.Errorf("profile %d: %w", i+1, err)
+		}
+		if names[profiles[i].Name] {
+			return fmt.Errorf("duplicate profile %q", profiles[i].Name)
+		}
+		names[profiles[i].Name] = true
+	}
+	if _, err := compileRoutingProfiles(profiles, rp.config.Hysteria2); err != nil {
+		return err
+	}
+
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	if err := rp.saveProfiles(profiles); err != nil {
+		return err
+	}
+	rp.profiles = profiles
+
+	return rp.apply()
+}
+
+// apply compiles the profiles and reloads Xray and Hysteria2 when they are running; callers hold mu
+func (rp *RoutingProfileManagerImpl) apply() error {
+	compiled, err := compileRoutingProfiles(rp.profiles, rp.config.Hysteria2)
+	if err != nil {
+		return err
+	}
+
+	var errs []string
+
+	if err := rp.xrayManager.SetProfileRouting(compiled.xrayOutbounds, compiled.xrayBalancers, compiled.xrayRules); err != nil {
+		errs = append(errs, fmt.Sprintf("xray: %v", err))
+	} else if err := restartRunningXray(rp.xrayManager); err != nil {
+		errs = append(errs, fmt.Sprintf("xray restart: %v", err))
+	}
+
+	if err := rp.saveHysteriaRouting(compiled.hysteria); err != nil {
+		errs = append(errs, fmt.Sprintf("hysteria2: %v", err))
+	} else if err := reloadRunningHysteria(rp.config, rp.hysteriaManager); err != nil {
+		errs = append(errs, fmt.Sprintf("hysteria2 restart: %v", err))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to apply routing profiles: %s", strings.Join(errs, "; "))
+	}
+	if compiled.hysteriaSkipped > 0 {
+		rp.logger.Warnf("%d routing profile rules only use outbounds Hysteria2 does not support and apply to Xray only", compiled.hysteriaSkipped)
+	}
+	rp.logger.Infof("Routing profiles applied: %d profiles, %d Xray rules, %d Hysteria2 ACL rules",
+		len(rp.profiles), len(compiled.xrayRules), len(compiled.hysteria.ACL))
+	return nil
+}
+
+func (rp *RoutingProfileManagerImpl) saveProfiles(profiles []RoutingProfile) error {
+	if err := os.MkdirAll(rp.config.Routing.StateDir, 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(profiles, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(rp.config.Routing.StateDir, routingProfilesFile), data, 0600)
+}
+
+// saveHysteriaRouting writes the compiled Hysteria2 routing, or removes it when no
+// profile applies to Hysteria2
+func (rp *RoutingProfileManagerImpl) saveHysteriaRouting(routing hysteriaRouting) error {
+	path := filepath.Join(rp.config.Routing.StateDir, routingHysteriaFile)
+	if len(routing.ACL) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	if err := os.MkdirAll(rp.config.Routing.StateDir, 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(routing, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// loadHysteriaRouting reads the routing compiled from the profiles, nil when there is none
+func loadHysteriaRouting(cfg *config.Config) (*hysteriaRouting, error) {
+	data, err := os.ReadFile(filepath.Join(cfg.Routing.StateDir, routingHysteriaFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var routing hysteriaRouting
+	if err := json.Unmarshal(data, &routing); err != nil {
+		return nil, err
+	}
+	return &routing, nil
+}
+
+// hysteriaACLConfig returns the Hysteria2 acl section: the content filter ACL followed by
+// the routing profile rules, so filtered domains are rejected whatever profile matches them
+func hysteriaACLConfig(filterACLPath string, routing *hysteriaRouting) (*hysteriaconfig.ACL, error) {
+	var filterACL []byte
+	if filterACLPath != "" {
+		data, err := os.ReadFile(filterACLPath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		filterACL = data
+	}
+
+	if routing == nil || len(routing.ACL) == 0 {
+		if filterACL == nil {
+			return nil, nil
+		}
+		return &hysteriaconfig.ACL{File: filterACLPath}, nil
+	}
+
+	var inline []string
+	for _, line := range strings.Split(string(filterACL), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			inline = append(inline, line)
+		}
+	}
+	inline = append(inline, routing.ACL...)
+	return &hysteriaconfig.ACL{Inline: inline}, nil
+}
+
+// restartRunningXray restarts Xray on its current config if it is running
+func restartRunningXray(xrayManager XrayManager) error {
+	status, err := xrayManager.GetXrayStatus()
+	if err != nil {
+		return nil
+	}
+	if running, _ := status["running"].(bool); !running {
+		return nil
+	}
+	return xrayManager.RestartXray(xrayManager.ConfigPath())
+}
+
+// reloadRunningHysteria regenerates the Hysteria2 config and restarts Hysteria2 if it is running
+func reloadRunningHysteria(cfg *config.Config, hysteriaManager HysteriaManager) error {
+	status, err := hysteriaManager.GetHysteria2Status()
+	if err != nil {
+		return err
+	}
+	if running, _ := status["running"].(bool); !running {
+		return nil
+	}
+
+	hysteriaConfig, err := hysteriaManager.GenerateConfig("")
+	if err != nil {
+		return err
+	}
+	if err := writeGeneratedConfig(cfg, hysteria2ConfigPath, []byte(hysteriaConfig)); err != nil {
+		return err
+	}
+	return hysteriaManager.ReloadHysteria2(hysteria2ConfigPath)
+}
+
+// compiledRouting is the routing produced from the assigned profiles
+type compiledRouting struct {
+	xrayOutbounds   []map[string]interface{}
+	xrayBalancers   []map[string]interface{}
+	xrayRules       []map[string]interface{}
+	hysteria        hysteriaRouting
+	hysteriaSkipped int
+}
+
+// compileRoutingProfiles turns profiles into Xray outbounds, balancers and routing rules
+// and Hysteria2 outbounds and ACL rules. Xray rules sending traffic to the default outbound
+// are left without an outboundTag, and balancer selectors name it with an empty tag.
+// Xray ANDs the conditions of a rule, so domains and addresses get a rule each.
+func compileRoutingProfiles(profiles []RoutingProfile, hysteria config.Hysteria2Config) (compiledRouting, error) {
+	var compiled compiledRouting
+
+	usesWARP := false
+	hysteriaOutbounds := make(map[string]bool)
+
+	for _, profile := range profiles {
+		outbounds := make(map[string]RoutingOutbound, len(profile.Outbounds))
+		for _, outbound := range profile.Outbounds {
+			outbounds[outbound.Name] = outbound
+		}
+
+		// Only the outbounds rules use are added
+		xrayTags := make(map[string]string)
+		hysteriaNames := make(map[string]string)
+		for _, rule := range profile.Rules {
+			for _, name := range rule.Outbounds {
+				outbound, ok := outbounds[name]
+				if !ok || xrayTags[name] != "" {
+					continue
+				}
+				tag := xrayProfilePrefix + profile.Name + "-" + name
+				xrayTags[name] = tag
+				compiled.xrayOutbounds = append(compiled.xrayOutbounds, xrayRoutingOutbound(tag, outbound))
+
+				if len(profile.Users) > 0 {
+					continue
+				}
+				if hysteriaOutbound := hysteriaRoutingOutbound(profile.Name, outbound); hysteriaOutbound != nil {
+					hysteriaNames[name] = hysteriaOutbound.Name
+					compiled.hysteria.Outbounds = append(compiled.hysteria.Outbounds, *hysteriaOutbound)
+				}
+			}
+		}
+
+		for i, rule := range profile.Rules {
+			ruleTag := fmt.Sprintf("%s%s-%d", xrayProfilePrefix, profile.Name, i+1)
+
+			target := map[string]interface{}{}
+			if len(rule.Outbounds) == 1 {
+				switch name := rule.Outbounds[0]; name {
+				case RoutingOutboundDirect:
+				case RoutingOutboundBlock:
+					target["outboundTag"] = xrayBlockOutboundTag
+				case RoutingOutboundWARP:
+					target["outboundTag"] = xrayProfileWARPTag
+				default:
+					target["outboundTag"] = xrayTags[name]
+				}
+			} else {
+				selector := make([]string, 0, len(rule.Outbounds))
+				for _, name := range rule.Outbounds {
+					switch name {
+					case RoutingOutboundDirect:
+						selector = append(selector, "")
+					case RoutingOutboundWARP:
+						selector = append(selector, xrayProfileWARPTag)
+					default:
+						selector = append(selector, xrayTags[name])
+					}
+				}
+				strategy := rule.Strategy
+				if strategy == "" {
+					strategy = RoutingStrategyRandom
+				}
+				compiled.xrayBalancers = append(compiled.xrayBalancers, map[string]interface{}{
+					"tag":      ruleTag,
+					"selector": selector,
+					"strategy": map[string]interface{}{"type": strategy},
+				})
+				target["balancerTag"] = ruleTag
+			}
+			for _, name := range rule.Outbounds {
+				if name == RoutingOutboundWARP {
+					usesWARP = true
+				}
+			}
+
+			for _, match := range []struct {
+				field   string
+				entries []string
+			}{
+				{"domain", xrayRoutingDomains(rule.Domains)},
+				{"ip", rule.IPs},
+			} {
+				if len(match.entries) == 0 {
+					continue
+				}
+				xrayRule := map[string]interface{}{
+					"type":      "field",
+					"ruleTag":   ruleTag + "-" + match.field,
+					match.field: match.entries,
+				}
+				for key, value := range target {
+					xrayRule[key] = value
+				}
+				if len(profile.Users) > 0 {
+					xrayRule["user"] = profile.Users
+				}
+				compiled.xrayRules = append(compiled.xrayRules, xrayRule)
+			}
+
+			if len(profile.Users) > 0 {
+				continue
+			}
+			name := hysteriaRuleOutbound(rule.Outbounds, hysteriaNames)
+			if name == hysteriaWARPOutbound {
+				hysteriaOutbounds[hysteriaWARPOutbound] = true
+			}
+			if name == "" {
+				compiled.hysteriaSkipped++
+				continue
+			}
+			for _, domain := range rule.Domains {
+				if !strings.HasPrefix(domain, "geosite:") {
+					domain = "suffix:" + domain
+				}
+				compiled.hysteria.ACL = append(compiled.hysteria.ACL, fmt.Sprintf("%s(%s)", name, domain))
+			}
+			for _, ip := range rule.IPs {
+				compiled.hysteria.ACL = append(compiled.hysteria.ACL, fmt.Sprintf("%s(%s)", name, ip))
+			}
+		}
+	}
+
+	if usesWARP {
+		if !hysteria.WARPEnabled {
+			return compiledRouting{}, fmt.Errorf("routing profiles send traffic to WARP, which is not enabled on this node")
+		}
+		port := hysteria.WARPProxyPort
+		if port == 0 {
+			port = 1080
+		}
+		compiled.xrayOutbounds = append(compiled.xrayOutbounds, map[string]interface{}{
+			"tag":      xrayProfileWARPTag,
+			"protocol": "socks",
+			"settings": map[string]interface{}{
+				"servers": []interface{}{
+					map[string]interface{}{"address": "127.0.0.1", "port": port},
+				},
+			},
+		})
+		if hysteriaOutbounds[hysteriaWARPOutbound] {
+			compiled.hysteria.Outbounds = append(compiled.hysteria.Outbounds, hysteriaconfig.Outbound{
+				Name:   hysteriaWARPOutbound,
+				Type:   hysteriaconfig.OutboundSOCKS5,
+				SOCKS5: &hysteriaconfig.SOCKS5Outbound{Addr: fmt.Sprintf("127.0.0.1:%d", port)},
+			})
+		}
+	}
+
+	if len(compiled.hysteria.ACL) == 0 {
+		compiled.hysteria.Outbounds = nil
+	} else {
+		// The first outbound is Hysteria2's default, which stays direct
+		compiled.hysteria.Outbounds = append([]hysteriaconfig.Outbound{
+			{Name: hysteriaDirectOutbound, Type: hysteriaconfig.OutboundDirect},
+		}, compiled.hysteria.Outbounds...)
+	}
+
+	return compiled, nil
+}
+
+// hysteriaRuleOutbound returns the first of outbounds Hysteria2 can send traffic to, by its
+// Hysteria2 name, or "" when it supports none of them
+func hysteriaRuleOutbound(outbounds []string, hysteriaNames map[string]string) string {
+	for _, outbound := range outbounds {
+		switch outbound {
+		case RoutingOutboundDirect:
+			return hysteriaDirectOutbound
+		case RoutingOutboundBlock:
+			return "reject"
+		case RoutingOutboundWARP:
+			return hysteriaWARPOutbound
+		}
+		if name := hysteriaNames[outbound]; name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+func xrayRoutingDomains(domains []string) []string {
+	if len(domains) == 0 {
+		return nil
+	}
+	entries := make([]string, len(domains))
+	for i, domain := range domains {
+		if strings.HasPrefix(domain, "geosite:") {
+			entries[i] = domain
+		} else {
+			entries[i] = "domain:" + domain
+		}
+	}
+	return entries
+}
+
+func xrayRoutingOutbound(tag string, outbound RoutingOutbound) map[string]interface{} {
+	server := map[string]interface{}{
+		"address": outbound.Address,
+		"port":    outbound.Port,
+	}
+	result := map[string]interface{}{
+		"tag":      tag,
+		"protocol": outbound.Type,
+		"settings": map[string]interface{}{
+			"servers": []interface{}{server},
+		},
+	}
+
+	switch outbound.Type {
+	case RoutingOutboundSocks, RoutingOutboundHTTP:
+		if outbound.Username != "" {
+			server["users"] = []interface{}{
+				map[string]interface{}{"user": outbound.Username, "pass": outbound.Password},
+			}
+		}
+	case RoutingOutboundShadowsocks:
+		server["method"] = outbound.Method
+		server["password"] = outbound.Password
+	case RoutingOutboundTrojan:
+		server["password"] = outbound.Password
+		serverName := outbound.SNI
+		if serverName == "" {
+			serverName = outbound.Address
+		}
+		result["streamSettings"] = map[string]interface{}{
+			"network":     "tcp",
+			"security":    "tls",
+			"tlsSettings": map[string]interface{}{"serverName": serverName},
+		}
+	}
+	return result
+}
+
+// hysteriaRoutingOutbound returns the Hysteria2 outbound for outbound, or nil for types
+// Hysteria2 cannot connect through
+func hysteriaRoutingOutbound(profile string, outbound RoutingOutbound) *hysteriaconfig.Outbound {
+	// ACL rules only accept word characters in outbound names
+	name := strings.ReplaceAll(profile+"_"+outbound.Name, "-", "_")
+	addr := net.JoinHostPort(outbound.Address, strconv.Itoa(outbound.Port))
+
+	switch outbound.Type {
+	case RoutingOutboundSocks:
+		socks := &hysteriaconfig.SOCKS5Outbound{Addr: addr}
+		if outbound.Username != "" {
+			socks.Username = outbound.Username
+			socks.Password = outbound.Password
+		}
+		return &hysteriaconfig.Outbound{Name: name, Type: hysteriaconfig.OutboundSOCKS5, SOCKS5: socks}
+	case RoutingOutboundHTTP:
+		proxyURL := url.URL{Scheme: "http", Host: addr}
+		if outbound.Username != "" {
+			proxyURL.User = url.UserPassword(outbound.Username, outbound.Password)
+		}
+		return &hysteriaconfig.Outbound{Name: name, Type: hysteriaconfig.OutboundHTTP, HTTP: &hysteriaconfig.HTTPOutbound{URL: proxyURL.String()}}
+	default:
+		return nil
+	}
+}
+
+// validateRoutingProfile checks a profile and normalises the domains and addresses of its rules
+func validateRoutingProfile(profile *RoutingProfile) error {
+	if !filterListNamePattern.MatchString(profile.Name) {
+		return fmt.Errorf("name %q must be lowercase letters, digits, '-' or '_'", profile.Name)
+	}
+	if len(profile.Rules) == 0 {
+		return fmt.Errorf("profile %s has no rules", profile.Name)
+	}
+
+	outbounds := make(map[string]bool, len(profile.Outbounds))
+	for _, outbound := range profile.Outbounds {
+		if err := validateRoutingOutbound(outbound); err != nil {
+			return fmt.Errorf("outbound %s: %w", outbound.Name, err)
+		}
+		if outbounds[outbound.Name] {
+			return fmt.Errorf("duplicate outbound %q", outbound.Name)
+		}
+		outbounds[outbound.Name] = true
+	}
+
+	for i := range profile.Rules {
+		rule := &profile.Rules[i]
+		if len(rule.Domains) == 0 && len(rule.IPs) == 0 {
+			return fmt.Errorf("rule %d has neither domains nor addresses", i+1)
+		}
+		if len(rule.Outbounds) == 0 {
+			return fmt.Errorf("rule %d has no outbound", i+1)
+		}
+		for _, name := range rule.Outbounds {
+			switch {
+			case name == RoutingOutboundBlock:
+				if len(rule.Outbounds) > 1 {
+					return fmt.Errorf("rule %d cannot balance %q with other outbounds", i+1, RoutingOutboundBlock)
+				}
+			case name == RoutingOutboundDirect || name == RoutingOutboundWARP || outbounds[name]:
+			default:
+				return fmt.Errorf("rule %d: unknown outbound %q", i+1, name)
+			}
+		}
+		switch rule.Strategy {
+		case "", RoutingStrategyRandom, RoutingStrategyRoundRobin:
+		default:
+			return fmt.Errorf("rule %d: unsupported strategy %q", i+1, rule.Strategy)
+		}
+
+		domains := make([]string, 0, len(rule.Domains))
+		for _, entry := range rule.Domains {
+			entry = strings.ToLower(strings.TrimSpace(entry))
+			if routingGeositePattern.MatchString(entry) {
+				domains = append(domains, entry)
+				continue
+			}
+			domain, ok := normalizeFilterDomain(entry)
+			if !ok {
+				return fmt.Errorf("rule %d: invalid domain %q", i+1, entry)
+			}
+			domains = append(domains, domain)
+		}
+		rule.Domains = uniqueStrings(domains)
+
+		ips := make([]string, 0, len(rule.IPs))
+		for _, entry := range rule.IPs {
+			ip, ok := normalizeRoutingIP(entry)
+			if !ok {
+				return fmt.Errorf("rule %d: invalid address %q", i+1, entry)
+			}
+			ips = append(ips, ip)
+		}
+		rule.IPs = uniqueStrings(ips)
+	}
+	return nil
+}
+
+func validateRoutingOutbound(outbound RoutingOutbound) error {
+	if !filterListNamePattern.MatchString(outbound.Name) {
+		return fmt.Errorf("name %q must be lowercase letters, digits, '-' or '_'", outbound.Name)
+	}
+	switch outbound.Name {
+	case RoutingOutboundDirect, RoutingOutboundWARP, RoutingOutboundBlock:
+		return fmt.Errorf("name %q is reserved", outbound.Name)
+	}
+	if outbound.Address == "" {
+		return fmt.Errorf("address is required")
+	}
+	if outbound.Port < 1 || outbound.Port > 65535 {
+		return fmt.Errorf("invalid port %d", outbound.Port)
+	}
+
+	switch outbound.Type {
+	case RoutingOutboundSocks, RoutingOutboundHTTP:
+	case RoutingOutboundShadowsocks:
+		if outbound.Method == "" || outbound.Password == "" {
+			return fmt.Errorf("shadowsocks outbounds need a method and a password")
+		}
+	case RoutingOutboundTrojan:
+		if outbound.Password == "" {
+			return fmt.Errorf("trojan outbounds need a password")
+		}
+	default:
+		return fmt.Errorf("unsupported type %q", outbound.Type)
+	}
+	return nil
+}
+
+// normalizeRoutingIP accepts an address, a network in CIDR notation or a geoip: country
+func normalizeRoutingIP(entry string) (string, bool) {
+	entry = strings.ToLower(strings.TrimSpace(entry))
+	if routingGeoIPPattern.MatchString(entry) {
+		return entry, true
+	}
+	if strings.Contains(entry, "/") {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return "", false
+		}
+		return prefix.Masked().String(), true
+	}
+	addr, err := netip.ParseAddr(entry)
+	if err != nil || addr.Zone() != "" {
+		return "", false
+	}
+	return addr.Unmap().String(), true
+}
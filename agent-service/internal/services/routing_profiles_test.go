@@ -0,0 +1,146 @@
+package services
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"hysteria2_microservices/agent-service/internal/config"
+	"hysteria2_microservices/agent-service/internal/hysteriaconfig"
+)
+
+func TestValidateRoutingProfile(t *testing.T) {
+	profile := RoutingProfile{
+		Name:      "streaming",
+		Outbounds: []RoutingOutbound{{Name: "node-x", Type: RoutingOutboundSocks, Address: "192.0.2.10", Port: 1080}},
+		Rules: []RoutingRule{{
+			Domains:   []string{" Netflix.com ", "netflix.com", "geosite:netflix"},
+			IPs:       []string{"198.51.100.7/24", "::ffff:203.0.113.9", "GEOIP:NL"},
+			Outbounds: []string{"node-x", RoutingOutboundDirect},
+		}},
+	}
+	if err := validateRoutingProfile(&profile); err != nil {
+		t.Fatal(err)
+	}
+	rule := profile.Rules[0]
+	if !reflect.DeepEqual(rule.Domains, []string{"geosite:netflix", "netflix.com"}) {
+		t.Errorf("domains = %v", rule.Domains)
+	}
+	if !reflect.DeepEqual(rule.IPs, []string{"198.51.100.0/24", "203.0.113.9", "geoip:nl"}) {
+		t.Errorf("addresses = %v", rule.IPs)
+	}
+
+	tests := map[string]RoutingProfile{
+		"bad name":         {Name: "Streaming", Rules: profile.Rules},
+		"no rules":         {Name: "streaming"},
+		"unknown outbound": {Name: "streaming", Rules: []RoutingRule{{Domains: []string{"netflix.com"}, Outbounds: []string{"node-y"}}}},
+		"block balanced":   {Name: "streaming", Rules: []RoutingRule{{Domains: []string{"netflix.com"}, Outbounds: []string{RoutingOutboundBlock, RoutingOutboundDirect}}}},
+		"empty rule":       {Name: "streaming", Rules: []RoutingRule{{Outbounds: []string{RoutingOutboundDirect}}}},
+		"invalid address":  {Name: "streaming", Rules: []RoutingRule{{IPs: []string{"198.51.100.300"}, Outbounds: []string{RoutingOutboundDirect}}}},
+		"reserved outbound name": {
+			Name:      "streaming",
+			Outbounds: []RoutingOutbound{{Name: RoutingOutboundWARP, Type: RoutingOutboundSocks, Address: "192.0.2.10", Port: 1080}},
+			Rules:     []RoutingRule{{Domains: []string{"netflix.com"}, Outbounds: []string{RoutingOutboundDirect}}},
+		},
+		"shadowsocks without password": {
+			Name:      "streaming",
+			Outbounds: []RoutingOutbound{{Name: "node-x", Type: RoutingOutboundShadowsocks, Address: "192.0.2.10", Port: 8388, Method: "aes-256-gcm"}},
+			Rules:     []RoutingRule{{Domains: []string{"netflix.com"}, Outbounds: []string{"node-x"}}},
+		},
+	}
+	for name, profile := range tests {
+		t.Run(name, func(t *testing.T) {
+			if err := validateRoutingProfile(&profile); err == nil {
+				t.Error("validateRoutingProfile succeeded")
+			}
+		})
+	}
+}
+
+func TestCompileRoutingProfiles(t *testing.T) {
+	profiles := []RoutingProfile{
+		{
+			Name:      "streaming",
+			Outbounds: []RoutingOutbound{{Name: "node-x", Type: RoutingOutboundSocks, Address: "192.0.2.10", Port: 1080}},
+			Rules: []RoutingRule{
+				{Domains: []string{"netflix.com", "geosite:disney"}, Outbounds: []string{"node-x"}},
+				{IPs: []string{"203.0.113.0/24"}, Outbounds: []string{RoutingOutboundWARP, RoutingOutboundDirect}, Strategy: RoutingStrategyRoundRobin},
+			},
+		},
+		// Hysteria2 cannot tell users apart, so this profile only reaches Xray
+		{
+			Name:  "vip",
+			Rules: []RoutingRule{{Domains: []string{"ads.example.com"}, Outbounds: []string{RoutingOutboundBlock}}},
+			Users: []string{"vip@example.com"},
+		},
+	}
+	hysteria := config.Hysteria2Config{WARPEnabled: true, WARPProxyPort: 40000}
+
+	compiled, err := compileRoutingProfiles(profiles, hysteria)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantACL := []string{
+		"streaming_node_x(suffix:netflix.com)",
+		"streaming_node_x(geosite:disney)",
+		"warp(203.0.113.0/24)",
+	}
+	if !reflect.DeepEqual(compiled.hysteria.ACL, wantACL) {
+		t.Errorf("Hysteria2 ACL = %v, want %v", compiled.hysteria.ACL, wantACL)
+	}
+	var names []string
+	for _, outbound := range compiled.hysteria.Outbounds {
+		names = append(names, outbound.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"direct", "streaming_node_x", "warp"}) {
+		t.Errorf("Hysteria2 outbounds = %v, want direct first", names)
+	}
+	if warp := compiled.hysteria.Outbounds[2]; warp.Type != hysteriaconfig.OutboundSOCKS5 || warp.SOCKS5.Addr != "127.0.0.1:40000" {
+		t.Errorf("WARP outbound = %+v", warp)
+	}
+
+	// Domains and addresses get a rule each; the balanced rule names the default outbound ""
+	if len(compiled.xrayRules) != 3 {
+		t.Fatalf("Xray rules = %v", compiled.xrayRules)
+	}
+	if rule := compiled.xrayRules[0]; rule["outboundTag"] != "profile-streaming-node-x" ||
+		!reflect.DeepEqual(rule["domain"], []string{"domain:netflix.com", "geosite:disney"}) {
+		t.Errorf("first Xray rule = %v", rule)
+	}
+	if len(compiled.xrayBalancers) != 1 || !reflect.DeepEqual(compiled.xrayBalancers[0]["selector"], []string{xrayProfileWARPTag, ""}) {
+		t.Errorf("Xray balancers = %v", compiled.xrayBalancers)
+	}
+	if rule := compiled.xrayRules[2]; rule["outboundTag"] != xrayBlockOutboundTag || !reflect.DeepEqual(rule["user"], []string{"vip@example.com"}) {
+		t.Errorf("user rule = %v", rule)
+	}
+}
+
+func TestCompileRoutingProfilesNeedsWARP(t *testing.T) {
+	profiles := []RoutingProfile{{
+		Name:  "streaming",
+		Rules: []RoutingRule{{Domains: []string{"netflix.com"}, Outbounds: []string{RoutingOutboundWARP}}},
+	}}
+	if _, err := compileRoutingProfiles(profiles, config.Hysteria2Config{}); err == nil || !strings.Contains(err.Error(), "WARP") {
+		t.Errorf("compileRoutingProfiles without WARP = %v, want an error", err)
+	}
+}
+
+// Rules only sending traffic to outbounds Hysteria2 cannot connect through are left to Xray
+func TestCompileRoutingProfilesSkipsUnsupportedOutbounds(t *testing.T) {
+	profiles := []RoutingProfile{{
+		Name:      "streaming",
+		Outbounds: []RoutingOutbound{{Name: "node-x", Type: RoutingOutboundTrojan, Address: "node-x.example.com", Port: 443, Password: "secret"}},
+		Rules:     []RoutingRule{{Domains: []string{"netflix.com"}, Outbounds: []string{"node-x"}}},
+	}}
+	compiled, err := compileRoutingProfiles(profiles, config.Hysteria2Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compiled.hysteriaSkipped != 1 || len(compiled.hysteria.ACL) != 0 || compiled.hysteria.Outbounds != nil {
+		t.Errorf("Hysteria2 routing = %+v, %d skipped; want the rule skipped", compiled.hysteria, compiled.hysteriaSkipped)
+	}
+	if len(compiled.xrayOutbounds) != 1 || compiled.xrayOutbounds[0]["streamSettings"] == nil {
+		t.Errorf("Xray outbounds = %v, want the trojan outbound over TLS", compiled.xrayOutbounds)
+	}
+}
@@ -0,0 +1,193 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RoutingState is the masquerading and WARP routing the node should have. iptables rules do
+// not survive a reboot, so the agent saves what was enabled and re-applies it on start.
+type RoutingState struct {
+	Masquerade    []string  `json:"masquerade,omitempty"`     // interfaces masqueraded
+	WARPInterface string    `json:"warp_interface,omitempty"` // interface routed through WARP, empty when disabled
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// RoutingReport is the outcome of a reconciliation of the kernel rules with the saved state
+type RoutingReport struct {
+	Checked  int      `json:"checked"`
+	Missing  []string `json:"missing,omitempty"`  // rules that were not installed
+	Repaired []string `json:"repaired,omitempty"` // missing rules installed again
+	Failed   []string `json:"failed,omitempty"`   // missing rules that could not be installed
+}
+
+// Both the node's and WARP manager's NetworkManager update the state file
+var routingStateMu sync.Mutex
+
+// Reconcile checks that the saved masquerading and WARP routing rules are installed, e.g.
+// after a reboot, and installs the missing ones
+func (nm *NetworkManagerImpl) Reconcile() (*RoutingReport, error) {
+	return nm.reconcileRouting(true)
+}
+
+// CheckRouting reports the saved masquerading and WARP routing rules that are not
+// installed, without installing them
+func (nm *NetworkManagerImpl) CheckRouting() (*RoutingReport, error) {
+	return nm.reconcileRouting(false)
+}
+
+func (nm *NetworkManagerImpl) reconcileRouting(repair bool) (*RoutingReport, error) {
+	state, err := nm.loadRoutingState()
+	if err != nil {
+		return nil, err
+	}
+	report := &RoutingReport{}
+
+	// WARP routing first: it flushes POSTROUTING, masquerade rules included
+	if state.WARPInterface != "" {
+		report.Checked++
+		name := "warp routing " + state.WARPInterface
+		if !nm.warpRoutingInstalled(state.WARPInterface) {
+			report.Missing = append(report.Missing, name)
+			if repair {
+				if err := nm.RouteTrafficThroughWARP(state.WARPInterface); err != nil {
+					report.Failed = append(report.Failed, fmt.Sprintf("%s: %v", name, err))
+				} else {
+					report.Repaired = append(report.Repaired, name)
+				}
+			}
+		}
+	}
+
+	for _, iface := range state.Masquerade {
+		report.Checked++
+		name := "masquerade " + iface
+		if nm.masqueradeInstalled(iface) {
+			continue
+		}
+		report.Missing = append(report.Missing, name)
+		if !repair {
+			continue
+		}
+		if err := nm.EnableMasquerading(iface); err != nil {
+			report.Failed = append(report.Failed, fmt.Sprintf("%s: %v", name, err))
+		} else {
+			report.Repaired = append(report.Repaired, name)
+		}
+	}
+
+	return report, nil
+}
+
+// masqueradeInstalled reports whether forwarding and the masquerade rule are in place for every family
+func (nm *NetworkManagerImpl) masqueradeInstalled(iface string) bool {
+	for _, family := range ipFamilies(nm.config) {
+		if !nm.forwardingEnabled(family) {
+			return false
+		}
+		if err := nm.runCommand(family.iptables, strings.Fields(masqueradeRule("-C", iface))...); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// warpRoutingInstalled reports whether forwarding and every WARP routing rule are in place
+func (nm *NetworkManagerImpl) warpRoutingInstalled(iface string) bool {
+	for _, family := range ipFamilies(nm.config) {
+		if !nm.forwardingEnabled(family) {
+			return false
+		}
+		for _, rule := range warpRoutingRules("-C", iface, nm.warpPort()) {
+			if err := nm.runCommand(family.iptables, strings.Fields(rule)...); err != nil {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (nm *NetworkManagerImpl) forwardingEnabled(family ipFamily) bool {
+	output, err := nm.runCommandWithOutput("sysctl", "-n", family.forwarding)
+	return err == nil && strings.TrimSpace(output) == "1"
+}
+
+// updateRoutingState applies update to the saved state
+func (nm *NetworkManagerImpl) updateRoutingState(update func(state *RoutingState)) {
+	routingStateMu.Lock()
+	defer routingStateMu.Unlock()
+
+	state, err := nm.loadRoutingState()
+	if err != nil {
+		nm.logger.Warnf("Replacing unreadable routing state: %v", err)
+		state = &RoutingState{}
+	}
+	update(state)
+	state.UpdatedAt = time.Now().UTC()
+
+	if err := saveRoutingState(nm.config.Network.StateFile, state); err != nil {
+		nm.logger.Errorf("Failed to save routing state, the rules will not be restored after a reboot: %v", err)
+	}
+}
+
+// loadRoutingState reads the saved state; nothing saved yet is an empty state
+func (nm *NetworkManagerImpl) loadRoutingState() (*RoutingState, error) {
+	data, err := os.ReadFile(nm.config.Network.StateFile)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &RoutingState{}, nil
+		}
+		return nil, err
+	}
+	var state RoutingState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("invalid routing state %s: %w", nm.config.Network.StateFile, err)
+	}
+	return &state, nil
+}
+
+func saveRoutingState(path string, state *RoutingState) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// masqueradeRule is the masquerade rule for iface with the iptables action, e.g. "-A" or "-C"
+func masqueradeRule(action, iface string) string {
+	return fmt.Sprintf("-t nat %s POSTROUTING -o %s -j MASQUERADE", action, iface)
+}
+
+// warpRoutingRules are the rules RouteTrafficThroughWARP installs, with the iptables action
+func warpRoutingRules(action, iface string, warpPort int) []string {
+	return []string{
+		// Redirect HTTP/HTTPS traffic to SOCKS5 proxy
+		fmt.Sprintf("-t nat %s OUTPUT -p tcp --dport 80 -j REDIRECT --to-ports %d", action, warpPort),
+		fmt.Sprintf("-t nat %s OUTPUT -p tcp --dport 443 -j REDIRECT --to-ports %d", action, warpPort),
+		// Masquerade traffic going out through the interface
+		masqueradeRule(action, iface),
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,131 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"hysteria2_microservices/agent-service/internal/config"
+)
+
+// SecretRotatorImpl periodically re-reads secrets referenced from the agent config, such
+// as Vault or KMS values, and applies rotated ones. Hysteria2 gets a regenerated config
+// and Xray is restarted so it loads a rotated certificate key; rotated Xray inbound
+// credentials apply to inbounds added after the rotation.
+type SecretRotatorImpl struct {
+	logger          *logrus.Logger
+	config          *config.Config
+	hysteriaManager HysteriaManager
+	xrayManager     XrayManager
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+}
+
+// NewSecretRotator creates a rotator for the servers managed by hysteriaManager and xrayManager
+func NewSecretRotator(logger *logrus.Logger, cfg *config.Config, hysteriaManager HysteriaManager, xrayManager XrayManager) SecretRotator {
+	return &SecretRotatorImpl{
+		logger:          logger,
+		config:          cfg,
+		hysteriaManager: hysteriaManager,
+		xrayManager:     xrayManager,
+	}
+}
+
+// Start refreshes the secrets every secrets.refresh_interval seconds until ctx is done
+func (sr *SecretRotatorImpl) Start(ctx context.Context) error {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	if sr.cancel != nil {
+		return fmt.Errorf("secret rotation is already running")
+	}
+	interval := time.Duration(sr.config.Secrets.RefreshInterval) * time.Second
+	if interval <= 0 {
+		return nil
+	}
+
+	rotateCtx, cancel := context.WithCancel(ctx)
+	sr.cancel = cancel
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-rotateCtx.Done():
+				return
+			case <-ticker.C:
+				sr.rotate(rotateCtx)
+			}
+		}
+	}()
+
+	sr.logger.Infof("Secret rotation started, refreshing every %s", interval)
+	return nil
+}
+
+func (sr *SecretRotatorImpl) rotate(ctx context.Context) {
+	changed, err := sr.config.RefreshSecrets(ctx)
+	if err != nil {
+		sr.logger.Errorf("Failed to refresh secrets, keeping the previous values: %v", err)
+	}
+	if len(changed) == 0 {
+		return
+	}
+	sr.logger.Infof("Secrets rotated: %s", strings.Join(changed, ", "))
+
+	var hysteria, xray bool
+	for _, name := range changed {
+		switch {
+		case strings.HasPrefix(name, "hysteria2."):
+			hysteria = true
+		case name == "xray.key_path":
+			xray = true
+		}
+	}
+
+	if hysteria {
+		if err := sr.reloadHysteria(); err != nil {
+			sr.logger.Errorf("Failed to apply rotated Hysteria2 secrets: %v", err)
+		}
+	}
+	if xray {
+		if err := sr.restartXray(); err != nil {
+			sr.logger.Errorf("Failed to apply rotated Xray certificate key: %v", err)
+		}
+	}
+}
+
+// reloadHysteria regenerates the Hysteria2 config with the rotated secrets
+func (sr *SecretRotatorImpl) reloadHysteria() error {
+	status, err := sr.hysteriaManager.GetHysteria2Status()
+	if err != nil {
+		return err
+	}
+	if running, _ := status["running"].(bool); !running {
+		return nil
+	}
+
+	hysteriaConfig, err := sr.hysteriaManager.GenerateConfig("")
+	if err != nil {
+		return err
+	}
+	if err := writeGeneratedConfig(sr.config, hysteria2ConfigPath, []byte(hysteriaConfig)); err != nil {
+		return err
+	}
+	return sr.hysteriaManager.ReloadHysteria2(hysteria2ConfigPath)
+}
+
+func (sr *SecretRotatorImpl) restartXray() error {
+	status, err := sr.xrayManager.GetXrayStatus()
+	if err != nil {
+		return err
+	}
+	if running, _ := status["running"].(bool); !running {
+		return nil
+	}
+	return sr.xrayManager.RestartXray(sr.xrayManager.ConfigPath())
+}
@@ -0,0 +1,570 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"hysteria2_microservices/agent-service/internal/config"
+	"hysteria2_microservices/pkg/events"
+)
+
+const (
+	// sessionRequestTimeout bounds each call to the traffic stats API and the api-service
+	sessionRequestTimeout = 10 * time.Second
+	// maxPendingConnections bounds the finished sessions kept while the api-service is unreachable
+	maxPendingConnections = 5000
+	// clientAddrTTL is how long the address of a client that is not online is kept, for
+	// connections the next poll has not seen yet
+	clientAddrTTL = 5 * time.Minute
+	// clientLogRestartDelay is the wait before following the Hysteria2 log again
+	clientLogRestartDelay = 10 * time.Second
+)
+
+// sessionEvent is a client that connected, changed its connection count or disconnected
+type sessionEvent struct {
+	Type        string    `json:"type"` // "connect" or "disconnect"
+	ClientID    string    `json:"client_id"`
+	UserID      string    `json:"user_id"`
+	DeviceID    string    `json:"device_id,omitempty"`
+	Protocol    string    `json:"protocol"`
+	Connections int       `json:"connections,omitempty"`
+	Upload      int64     `json:"upload,omitempty"`
+	Download    int64     `json:"download,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+// clientTraffic is what the traffic stats API counted for a client since Hysteria2
+// started: tx is what the client sent, rx what it received
+type clientTraffic struct {
+	Tx int64 `json:"tx"`
+	Rx int64 `json:"rx"`
+}
+
+// sessionReport is posted to the api-service after every poll. With Resync the connect
+// events list every online client and the api-service drops the node's other sessions.
+type sessionReport struct {
+	Events []sessionEvent `json:"events"`
+	Resync bool           `json:"resync"`
+}
+
+// connectionRecord is a finished session as the api-service analytics stores it; duration
+// is in seconds
+type connectionRecord struct {
+	UserID      string    `json:"user_id"`
+	DeviceID    string    `json:"device_id"`
+	Protocol    string    `json:"protocol"`
+	ClientIP    string    `json:"client_ip"`
+	Upload      int64     `json:"upload"`
+	Download    int64     `json:"download"`
+	Duration    int64     `json:"duration"`
+	ConnectedAt time.Time `json:"connected_at"`
+}
+
+type connectionReport struct {
+	Connections []connectionRecord `json:"connections"`
+}
+
+// clientAddr is the address a client last connected from, as Hysteria2 logged it
+type clientAddr struct {
+	ip   string
+	seen time.Time
+}
+
+// clientConnectedLog is the structured part of the Hysteria2 "client connected" log line
+type clientConnectedLog struct {
+	Addr string `json:"addr"`
+	ID   string `json:"id"`
+}
+
+type sessionReportResponse struct {
+	Data struct {
+		Disconnect []string `json:"disconnect"`
+	} `json:"data"`
+}
+
+// SessionTrackerImpl polls the Hysteria2 traffic stats API for the online clients and
+// reports the changes since the previous poll to the api-service. Every report keeps the
+// node's sessions alive there; the response names the clients to disconnect. With
+// sessions.connection_log the sessions that ended are posted to the api-service analytics
+// as well, with the client address taken from the Hysteria2 log.
+type SessionTrackerImpl struct {
+	logger *logrus.Logger
+	config *config.Config
+	client *http.Client
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	bus    *events.Bus
+
+	// Owned by the polling goroutine: the clients acknowledged by the api-service, the
+	// traffic counters of that poll and the counters each online client's session began at
+	online  map[string]int
+	traffic map[string]clientTraffic
+	base    map[string]clientTraffic
+	synced  bool
+
+	// Also owned by the polling goroutine: when each online client's session began and the
+	// finished sessions not yet accepted by the api-service
+	started map[string]time.Time
+	pending []connectionRecord
+
+	// The address of every client by auth ID, written by the log follower
+	addrMu sync.Mutex
+	addrs  map[string]clientAddr
+}
+
+// NewSessionTracker creates a tracker for the Hysteria2 server configured by cfg
+func NewSessionTracker(logger *logrus.Logger, cfg *config.Config) SessionTracker {
+	return &SessionTrackerImpl{
+		logger:  logger,
+		config:  cfg,
+		client:  &http.Client{Timeout: sessionRequestTimeout},
+		online:  make(map[string]int),
+		traffic: make(map[string]clientTraffic),
+		base:    make(map[string]clientTraffic),
+		started: make(map[string]time.Time),
+		addrs:   make(map[string]clientAddr),
+	}
+}
+
+// SetEventBus publishes the traffic counted between polls to bus; set before Start
+func (st *SessionTrackerImpl) SetEventBus(bus *events.Bus) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.bus = bus
+}
+
+// Start polls every sessions.poll_interval seconds until ctx is done
+func (st *SessionTrackerImpl) Start(ctx context.Context) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	cfg := st.config.Sessions
+	if !cfg.Enabled {
+		return nil
+	}
+	if st.cancel != nil {
+		return fmt.Errorf("session tracking is already running")
+	}
+	if cfg.APIURL == "" || st.config.Node.ID == "" {
+		return fmt.Errorf("session tracking needs sessions.api_url and node.id")
+	}
+	interval := time.Duration(cfg.PollInterval) * time.Second
+	if interval <= 0 {
+		return fmt.Errorf("invalid sessions.poll_interval %d", cfg.PollInterval)
+	}
+
+	pollCtx, cancel := context.WithCancel(ctx)
+	st.cancel = cancel
+	if cfg.ConnectionLog {
+		go st.followClients(pollCtx)
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-pollCtx.Done():
+				return
+			case <-ticker.C:
+				if err := st.poll(pollCtx); err != nil {
+					st.logger.Warnf("Session report failed: %v", err)
+				}
+			}
+		}
+	}()
+
+	st.logger.Infof("Session tracking started, reporting every %s", interval)
+	return nil
+}
+
+// poll reads the online clients and reports the changes. The baseline only advances once
+// the api-service accepted a report, so a failed report is sent again on the next poll.
+func (st *SessionTrackerImpl) poll(ctx context.Context) error {
+	online, err := st.onlineClients(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read online clients: %w", err)
+	}
+
+	// Session bytes are best effort; sessions are reported without them
+	traffic, err := st.clientTraffic(ctx)
+	if err != nil {
+		st.logger.Debugf("Failed to read client traffic: %v", err)
+	}
+
+	previous := st.online
+	if !st.synced {
+		previous = nil
+	}
+	report := sessionReport{Events: diffSessions(previous, online, time.Now()), Resync: !st.synced}
+	base := st.sessionBase(previous, online, traffic)
+	for i := range report.Events {
+		event := &report.Events[i]
+		start, ok := base[event.ClientID]
+		if !ok {
+			start = st.base[event.ClientID]
+		}
+		if current, ok := traffic[event.ClientID]; ok {
+			event.Upload = max(current.Tx-start.Tx, 0)
+			event.Download = max(current.Rx-start.Rx, 0)
+		}
+	}
+
+	disconnect, err := st.report(ctx, report)
+	if err != nil {
+		return err
+	}
+	st.online = online
+	st.base = base
+	if traffic != nil {
+		st.publishTraffic(st.traffic, traffic)
+		st.traffic = traffic
+	}
+	st.synced = true
+
+	if st.config.Sessions.ConnectionLog {
+		st.recordConnections(report.Events, online)
+		if err := st.reportConnections(ctx); err != nil {
+			st.logger.Warnf("Connection report failed, %d sessions pending: %v", len(st.pending), err)
+		}
+	}
+
+	if len(disconnect) > 0 {
+		if err := st.Kick(ctx, disconnect); err != nil {
+			return err
+		}
+		st.logger.Infof("Disconnected clients: %s", strings.Join(disconnect, ", "))
+	}
+	return nil
+}
+
+// recordConnections notes when new sessions began and queues the sessions that ended for the
+// analytics. Sessions already online when the agent started are counted from the first poll.
+func (st *SessionTrackerImpl) recordConnections(events []sessionEvent, online map[string]int) {
+	st.addrMu.Lock()
+	defer st.addrMu.Unlock()
+
+	for _, event := range events {
+		switch event.Type {
+		case "connect":
+			if _, ok := st.started[event.ClientID]; !ok {
+				st.started[event.ClientID] = event.Time
+			}
+		case "disconnect":
+			connectedAt, ok := st.started[event.ClientID]
+			if !ok {
+				connectedAt = event.Time
+			}
+			delete(st.started, event.ClientID)
+			if len(st.pending) >= maxPendingConnections {
+				st.pending = st.pending[1:]
+			}
+			st.pending = append(st.pending, connectionRecord{
+				UserID:      event.UserID,
+				DeviceID:    event.DeviceID,
+				Protocol:    event.Protocol,
+				ClientIP:    st.addrs[event.ClientID].ip,
+				Upload:      event.Upload,
+				Download:    event.Download,
+				Duration:    int64(event.Time.Sub(connectedAt).Seconds()),
+				ConnectedAt: connectedAt,
+			})
+		}
+	}
+
+	// Addresses of clients that left are kept a while for connections the next poll finds
+	now := time.Now()
+	for id, addr := range st.addrs {
+		if _, ok := online[id]; !ok && now.Sub(addr.seen) > clientAddrTTL {
+			delete(st.addrs, id)
+		}
+	}
+}
+
+// reportConnections posts the finished sessions to the api-service analytics. They are kept
+// for the next poll when the api-service is unreachable and dropped when its analytics is off.
+func (st *SessionTrackerImpl) reportConnections(ctx context.Context) error {
+	if len(st.pending) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(connectionReport{Connections: st.pending})
+	if err != nil {
+		return err
+	}
+	endpoint := strings.TrimRight(st.config.Sessions.APIURL, "/") + "/api/v1/agent/nodes/" + url.PathEscape(st.config.Node.ID) + "/connections"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+st.config.Sessions.Token)
+
+	resp, err := st.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+	case resp.StatusCode == http.StatusServiceUnavailable:
+		st.logger.Debugf("Dropping %d sessions, api-service analytics is off", len(st.pending))
+	default:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	st.pending = nil
+	return nil
+}
+
+// followClients learns the address of every client from the "client connected" lines of
+// the Hysteria2 log until ctx is done
+func (st *SessionTrackerImpl) followClients(ctx context.Context) {
+	host := DetectHostOS(st.config)
+	for {
+		err := host.FollowServiceLog(ctx, st.handleClientLog, hysteria2ServiceName)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			st.logger.Warnf("Session tracking lost the Hysteria2 log: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(clientLogRestartDelay):
+		}
+	}
+}
+
+func (st *SessionTrackerImpl) handleClientLog(line string) {
+	id, ip := parseClientConnected(line)
+	if id == "" {
+		return
+	}
+	st.addrMu.Lock()
+	defer st.addrMu.Unlock()
+	st.addrs[id] = clientAddr{ip: ip, seen: time.Now()}
+}
+
+// parseClientConnected returns the auth ID and address of a Hysteria2 log line such as
+// `INFO	client connected	{"addr": "203.0.113.7:51820", "id": "<user_id>@<device_id>", "tx": 0}`
+func parseClientConnected(line string) (id, ip string) {
+	i := strings.Index(line, "client connected")
+	if i < 0 {
+		return "", ""
+	}
+	start := strings.IndexByte(line[i:], '{')
+	if start < 0 {
+		return "", ""
+	}
+	var fields clientConnectedLog
+	if err := json.NewDecoder(strings.NewReader(line[i+start:])).Decode(&fields); err != nil || fields.ID == "" {
+		return "", ""
+	}
+	host, _, err := net.SplitHostPort(fields.Addr)
+	if err != nil {
+		host = fields.Addr
+	}
+	if net.ParseIP(host) == nil {
+		return "", ""
+	}
+	return fields.ID, host
+}
+
+// publishTraffic publishes what every client sent and received since the previous poll.
+// Nothing is published on the first poll: the counters then include traffic from before the
+// agent started, which may have been published already.
+func (st *SessionTrackerImpl) publishTraffic(previous, current map[string]clientTraffic) {
+	if st.bus == nil || len(previous) == 0 {
+		return
+	}
+	now := time.Now()
+	batch := events.TrafficBatch{NodeID: st.config.Node.ID}
+	for id, counters := range current {
+		delta := trafficDelta(previous[id], counters)
+		if delta.Tx == 0 && delta.Rx == 0 {
+			continue
+		}
+		userID, deviceID, _ := strings.Cut(id, "@")
+		batch.Samples = append(batch.Samples, events.TrafficSample{
+			UserID:     userID,
+			DeviceID:   deviceID,
+			Upload:     delta.Tx,
+			Download:   delta.Rx,
+			RecordedAt: now,
+		})
+	}
+	if len(batch.Samples) == 0 {
+		return
+	}
+	if err := st.bus.Publish(events.TrafficSubject(st.config.Node.ID), events.TypeTraffic, batch); err != nil {
+		st.logger.Warnf("Failed to publish traffic of %d clients: %v", len(batch.Samples), err)
+	}
+}
+
+// trafficDelta is the traffic counted between two polls; counters lower than before mean
+// Hysteria2 restarted and counted from zero since
+func trafficDelta(previous, current clientTraffic) clientTraffic {
+	if current.Tx < previous.Tx || current.Rx < previous.Rx {
+		return current
+	}
+	return clientTraffic{Tx: current.Tx - previous.Tx, Rx: current.Rx - previous.Rx}
+}
+
+// sessionBase returns the counters the sessions of the online clients began at. A new
+// session begins at the counters of the previous poll, or of this one when the tracker has
+// none yet; counters lower than that mean Hysteria2 restarted and began again at zero.
+func (st *SessionTrackerImpl) sessionBase(previous, online map[string]int, traffic map[string]clientTraffic) map[string]clientTraffic {
+	base := make(map[string]clientTraffic, len(online))
+	for id := range online {
+		start, ok := st.base[id]
+		if _, known := previous[id]; !known || !ok {
+			if start, ok = st.traffic[id]; !ok && len(st.traffic) == 0 {
+				start = traffic[id]
+			}
+		}
+		if current, ok := traffic[id]; ok && (current.Tx < start.Tx || current.Rx < start.Rx) {
+			start = clientTraffic{}
+		}
+		base[id] = start
+	}
+	return base
+}
+
+// diffSessions returns connect events for new clients and clients whose connection count
+// changed, and disconnect events for clients that went offline
+func diffSessions(previous, current map[string]int, now time.Time) []sessionEvent {
+	events := []sessionEvent{}
+	for id, connections := range current {
+		if previous[id] != connections {
+			events = append(events, newSessionEvent("connect", id, connections, now))
+		}
+	}
+	for id := range previous {
+		if _, ok := current[id]; !ok {
+			events = append(events, newSessionEvent("disconnect", id, 0, now))
+		}
+	}
+	return events
+}
+
+// newSessionEvent splits the Hysteria2 auth ID "<user_id>[@<device_id>]" of a client
+func newSessionEvent(eventType, clientID string, connections int, now time.Time) sessionEvent {
+	userID, deviceID, _ := strings.Cut(clientID, "@")
+	return sessionEvent{
+		Type:        eventType,
+		ClientID:    clientID,
+		UserID:      userID,
+		DeviceID:    deviceID,
+		Protocol:    "hysteria2",
+		Connections: connections,
+		Time:        now,
+	}
+}
+
+// onlineClients returns the number of connections of every online client by auth ID
+func (st *SessionTrackerImpl) onlineClients(ctx context.Context) (map[string]int, error) {
+	req, err := st.trafficStatsRequest(ctx, http.MethodGet, "/online", nil)
+	if err != nil {
+		return nil, err
+	}
+	online := map[string]int{}
+	if err := st.do(req, &online); err != nil {
+		return nil, err
+	}
+	return online, nil
+}
+
+// clientTraffic returns the traffic of every client Hysteria2 has seen by auth ID, without
+// clearing the counters
+func (st *SessionTrackerImpl) clientTraffic(ctx context.Context) (map[string]clientTraffic, error) {
+	req, err := st.trafficStatsRequest(ctx, http.MethodGet, "/traffic", nil)
+	if err != nil {
+		return nil, err
+	}
+	traffic := map[string]clientTraffic{}
+	if err := st.do(req, &traffic); err != nil {
+		return nil, err
+	}
+	return traffic, nil
+}
+
+// Kick disconnects clients through the traffic stats API. Clients can reconnect unless
+// their credentials are revoked as well.
+func (st *SessionTrackerImpl) Kick(ctx context.Context, clientIDs []string) error {
+	body, err := json.Marshal(clientIDs)
+	if err != nil {
+		return err
+	}
+	req, err := st.trafficStatsRequest(ctx, http.MethodPost, "/kick", body)
+	if err != nil {
+		return err
+	}
+	if err := st.do(req, nil); err != nil {
+		return fmt.Errorf("failed to kick clients: %w", err)
+	}
+	return nil
+}
+
+func (st *SessionTrackerImpl) trafficStatsRequest(ctx context.Context, method, path string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, "http://"+st.config.Sessions.TrafficStatsListen+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if secret := st.config.Sessions.TrafficStatsSecret; secret != "" {
+		req.Header.Set("Authorization", secret)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+// report posts the events and returns the clients the api-service wants disconnected
+func (st *SessionTrackerImpl) report(ctx context.Context, report sessionReport) ([]string, error) {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := strings.TrimRight(st.config.Sessions.APIURL, "/") + "/api/v1/agent/nodes/" + url.PathEscape(st.config.Node.ID) + "/sessions"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+st.config.Sessions.Token)
+
+	var resp sessionReportResponse
+	if err := st.do(req, &resp); err != nil {
+		return nil, fmt.Errorf("failed to report sessions: %w", err)
+	}
+	return resp.Data.Disconnect, nil
+}
+
+func (st *SessionTrackerImpl) do(req *http.Request, out interface{}) error {
+	resp, err := st.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
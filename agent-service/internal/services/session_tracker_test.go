@@ -0,0 +1,192 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"hysteria2_microservices/agent-service/internal/config"
+)
+
+func TestParseClientConnected(t *testing.T) {
+	tests := []struct {
+		line   string
+		wantID string
+		wantIP string
+	}{
+		{`2024-01-31T12:00:00Z	INFO	client connected	{"addr": "203.0.113.7:51820", "id": "u1@iphone", "tx": 0}`, "u1@iphone", "203.0.113.7"},
+		{`Jan 31 12:00:00 node hysteria[812]: INFO	client connected	{"addr": "[2001:db8::7]:443", "id": "u2"}`, "u2", "2001:db8::7"},
+		{`2024-01-31T12:00:00Z	INFO	client disconnected	{"addr": "203.0.113.7:51820", "id": "u1"}`, "", ""},
+		{`2024-01-31T12:00:00Z	INFO	client connected	{"addr": "not-an-address", "id": "u1"}`, "", ""},
+		{`2024-01-31T12:00:00Z	INFO	client connected	{"addr": "203.0.113.7:51820"}`, "", ""},
+	}
+	for _, tt := range tests {
+		id, ip := parseClientConnected(tt.line)
+		if id != tt.wantID || ip != tt.wantIP {
+			t.Errorf("parseClientConnected(%q) = %q, %q; want %q, %q", tt.line, id, ip, tt.wantID, tt.wantIP)
+		}
+	}
+}
+
+func newTestSessionTracker(apiURL string) *SessionTrackerImpl {
+	cfg := &config.Config{}
+	cfg.Node.ID = "node-1"
+	cfg.Sessions = config.SessionsConfig{APIURL: apiURL, Token: "secret", ConnectionLog: true}
+	return NewSessionTracker(testLogger(), cfg).(*SessionTrackerImpl)
+}
+
+func TestRecordConnectionsBuildsFinishedSessions(t *testing.T) {
+	st := newTestSessionTracker("")
+	st.handleClientLog(`INFO	client connected	{"addr": "203.0.113.7:51820", "id": "u1@iphone"}`)
+
+	connected := time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC)
+	st.recordConnections(diffSessions(nil, map[string]int{"u1@iphone": 1}, connected), map[string]int{"u1@iphone": 1})
+	// A later connect event for another connection keeps the session's start
+	st.recordConnections(diffSessions(map[string]int{"u1@iphone": 1}, map[string]int{"u1@iphone": 2}, connected.Add(time.Minute)), map[string]int{"u1@iphone": 2})
+
+	disconnect := diffSessions(map[string]int{"u1@iphone": 2}, map[string]int{}, connected.Add(90*time.Second))
+	disconnect[0].Upload, disconnect[0].Download = 100, 2000
+	st.recordConnections(disconnect, map[string]int{})
+
+	want := connectionRecord{
+		UserID:      "u1",
+		DeviceID:    "iphone",
+		Protocol:    "hysteria2",
+		ClientIP:    "203.0.113.7",
+		Upload:      100,
+		Download:    2000,
+		Duration:    90,
+		ConnectedAt: connected,
+	}
+	if len(st.pending) != 1 || st.pending[0] != want {
+		t.Fatalf("pending = %+v, want %+v", st.pending, want)
+	}
+	if _, ok := st.started["u1@iphone"]; ok {
+		t.Error("session start kept after the disconnect")
+	}
+	// The address is kept for a reconnect the next poll finds
+	if st.addrs["u1@iphone"].ip != "203.0.113.7" {
+		t.Error("recent client address pruned")
+	}
+
+	st.addrs["u1@iphone"] = clientAddr{ip: "203.0.113.7", seen: time.Now().Add(-clientAddrTTL - time.Second)}
+	st.recordConnections(nil, map[string]int{})
+	if _, ok := st.addrs["u1@iphone"]; ok {
+		t.Error("stale client address kept")
+	}
+}
+
+func TestReportConnections(t *testing.T) {
+	status := http.StatusOK
+	var got []connectionReport
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/agent/nodes/node-1/connections" || r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("posted to %s with %q", r.URL.Path, r.Header.Get("Authorization"))
+		}
+		var report connectionReport
+		json.NewDecoder(r.Body).Decode(&report)
+		got = append(got, report)
+		w.WriteHeader(status)
+	}))
+	defer api.Close()
+
+	st := newTestSessionTracker(api.URL)
+	ctx := context.Background()
+	st.pending = []connectionRecord{{UserID: "u1"}}
+
+	// Sessions are kept while the api-service fails
+	status = http.StatusInternalServerError
+	if err := st.reportConnections(ctx); err == nil || len(st.pending) != 1 {
+		t.Fatalf("failed report: err %v, %d pending; want an error and 1 pending", err, len(st.pending))
+	}
+	status = http.StatusOK
+	if err := st.reportConnections(ctx); err != nil || len(st.pending) != 0 {
+		t.Fatalf("report: err %v, %d pending; want none", err, len(st.pending))
+	}
+	// Without analytics on the api-service the sessions are dropped
+	st.pending = []connectionRecord{{UserID: "u2"}}
+	status = http.StatusServiceUnavailable
+	if err := st.reportConnections(ctx); err != nil || len(st.pending) != 0 {
+		t.Fatalf("report with analytics off: err %v, %d pending; want none", err, len(st.pending))
+	}
+	// Nothing to report makes no request
+	if err := st.reportConnections(ctx); err != nil || len(got) != 3 {
+		t.Errorf("empty report: err %v, %d requests; want 3", err, len(got))
+	}
+	if len(got[1].Connections) != 1 || got[1].Connections[0].UserID != "u1" {
+		t.Errorf("reported %+v, want the u1 session", got[1])
+	}
+}
+
+func TestSessionTrackerPoll(t *testing.T) {
+	online := map[string]int{"u1@iphone": 1, "u2": 2}
+	var kicked []string
+	stats := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "stats-secret" {
+			t.Errorf("%s without the traffic stats secret", r.URL.Path)
+		}
+		switch r.URL.Path {
+		case "/online":
+			json.NewEncoder(w).Encode(online)
+		case "/traffic":
+			json.NewEncoder(w).Encode(map[string]clientTraffic{})
+		case "/kick":
+			json.NewDecoder(r.Body).Decode(&kicked)
+		}
+	}))
+	defer stats.Close()
+
+	status := http.StatusOK
+	var disconnect []string
+	var reports []sessionReport
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/agent/nodes/node-1/sessions" || r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("posted to %s with %q", r.URL.Path, r.Header.Get("Authorization"))
+		}
+		var report sessionReport
+		json.NewDecoder(r.Body).Decode(&report)
+		reports = append(reports, report)
+		w.WriteHeader(status)
+		var resp sessionReportResponse
+		resp.Data.Disconnect = disconnect
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer api.Close()
+
+	st := newTestSessionTracker(api.URL)
+	st.config.Sessions.ConnectionLog = false
+	st.config.Sessions.TrafficStatsListen = stats.Listener.Addr().String()
+	st.config.Sessions.TrafficStatsSecret = "stats-secret"
+	ctx := context.Background()
+
+	// The first report lists every online client and resyncs the node
+	if err := st.poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 1 || !reports[0].Resync || len(reports[0].Events) != 2 {
+		t.Fatalf("first report = %+v, want a resync with both clients", reports)
+	}
+
+	// A report the api-service refuses is sent again on the next poll
+	delete(online, "u2")
+	status = http.StatusInternalServerError
+	if err := st.poll(ctx); err == nil {
+		t.Fatal("refused report succeeded")
+	}
+	status = http.StatusOK
+	disconnect = []string{"u1@iphone"}
+	if err := st.poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	last := reports[len(reports)-1]
+	if last.Resync || len(last.Events) != 1 || last.Events[0].Type != "disconnect" || last.Events[0].ClientID != "u2" {
+		t.Errorf("report after the failure = %+v, want the u2 disconnect", last)
+	}
+	// Clients the api-service names are kicked
+	if len(kicked) != 1 || kicked[0] != "u1@iphone" {
+		t.Errorf("kicked %v, want u1@iphone", kicked)
+	}
+}
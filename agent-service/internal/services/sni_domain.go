@@ -0,0 +1,185 @@
+package services
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// wildcardProbeLabel is resolved in place of the "*" of a wildcard domain: a wildcard
+// record answers for any label
+const wildcardProbeLabel = "sni-check"
+
+// sniDomainProfile maps domains the way TLS clients send them: lower-case, IDNA A-labels
+var sniDomainProfile = idna.New(
+	idna.MapForLookup(),
+	idna.BidiRule(),
+	idna.VerifyDNSLength(true),
+	idna.Transitional(false),
+)
+
+// SNIDomainCheck is the result of the pre-flight DNS check of an SNI domain. A failed
+// check does not reject the domain: DNS may be updated after the node is configured.
+type SNIDomainCheck struct {
+	Domain         string `json:"domain"`
+	ResolvesToNode bool   `json:"resolves_to_node"`
+	Message        string `json:"message,omitempty"`
+}
+
+// NormalizeSNIDomain validates an SNI domain and returns the form it is stored and compared
+// in: lower-case ASCII without a trailing dot, e.g. "xn--e1afmkfd.xn--p1ai" for
+// "пример.рф". A wildcard must be the whole leftmost label of a name with at least two
+// more labels, e.g. "*.example.com".
+func NormalizeSNIDomain(domain string) (string, error) {
+	name := strings.TrimSuffix(strings.TrimSpace(domain), ".")
+	if name == "" {
+		return "", fmt.Errorf("%w: domain cannot be empty", ErrInvalidDomain)
+	}
+
+	wildcard := strings.HasPrefix(name, "*.")
+	if wildcard {
+		name = name[2:]
+	}
+	if strings.Contains(name, "*") {
+		return "", fmt.Errorf("%w: %q: a wildcard must be the whole leftmost label", ErrInvalidDomain, domain)
+	}
+	if net.ParseIP(name) != nil {
+		return "", fmt.Errorf("%w: %q: SNI requires a host name, not an IP address", ErrInvalidDomain, domain)
+	}
+
+	ascii, err := sniDomainProfile.ToASCII(name)
+	if err != nil {
+		return "", fmt.Errorf("%w: %q: %v", ErrInvalidDomain, domain, err)
+	}
+	if !strings.Contains(ascii, ".") {
+		return "", fmt.Errorf("%w: %q: a fully qualified name is required", ErrInvalidDomain, domain)
+	}
+
+	if wildcard {
+		return "*." + ascii, nil
+	}
+	return ascii, nil
+}
+
+// NormalizeSNIDomains normalizes a domain list and rejects names listed twice, including
+// spellings that normalize to the same name
+func NormalizeSNIDomains(domains []string) ([]string, error) {
+	normalized := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		name, err := NormalizeSNIDomain(domain)
+		if err != nil {
+			return nil, err
+		}
+		if containsString(normalized, name) {
+			return nil, fmt.Errorf("%w: %s is listed twice", ErrDomainConflict, name)
+		}
+		normalized = append(normalized, name)
+	}
+	return normalized, nil
+}
+
+// CheckSNIDomainDNS checks that a normalized domain resolves to this node
+func (hm *HysteriaManagerImpl) CheckSNIDomainDNS(domain string) SNIDomainCheck {
+	check := SNIDomainCheck{Domain: domain}
+
+	name := domain
+	if strings.HasPrefix(name, "*.") {
+		name = wildcardProbeLabel + name[1:]
+	}
+	ok, err := hm.certificateManager.CheckDNSResolution(name)
+	check.ResolvesToNode = ok
+	if err != nil {
+		check.Message = err.Error()
+	}
+	return check
+}
+
+// IssueCertificate obtains a Let's Encrypt certificate for a normalized SNI domain that
+// resolves to this node, installs it in place of the domain's certificate and restarts
+// Hysteria2 so it serves it. Wildcards need the DNS-01 challenge and are rejected.
+func (hm *HysteriaManagerImpl) IssueCertificate(domain, email string) (*CertificateInfo, error) {
+	if strings.HasPrefix(domain, "*.") {
+		return nil, fmt.Errorf("%w: %s: wildcard certificates cannot be issued with the HTTP-01 challenge", ErrInvalidDomain, domain)
+	}
+	if email == "" {
+		email = hm.config.Hysteria2.SNIEmail
+	}
+	if email == "" {
+		return nil, fmt.Errorf("email is required for Let's Encrypt certificates")
+	}
+	challenge := hm.config.Hysteria2.SNIPreferredChallenge
+	if challenge == "" {
+		challenge = "http-01"
+	}
+
+	// The certificate is copied from certbot's lineage into the domain's files, which the
+	// agent can read when it runs unprivileged
+	certPath, keyPath, err := hm.certificateManager.GenerateLetsEncryptCert(domain, email, challenge)
+	if err != nil {
+		return nil, err
+	}
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read issued certificate: %w", err)
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read issued private key: %w", err)
+	}
+	issued, err := hm.installDomainCertificate(domain, string(certPEM), string(keyPEM))
+	if err != nil {
+		return issued, err
+	}
+	hm.logger.Infof("Let's Encrypt certificate for %s installed, valid until %s", domain, issued.NotAfter.Format("2006-01-02"))
+	return issued, nil
+}
+
+// InstallCertificate installs an operator-provided certificate chain and key for a
+// normalized SNI domain in place of the domain's certificate and restarts Hysteria2 so it
+// serves it
+func (hm *HysteriaManagerImpl) InstallCertificate(domain, certPEM, keyPEM string) (*CertificateInfo, error) {
+	if _, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM)); err != nil {
+		return nil, fmt.Errorf("certificate and private key do not match: %w", err)
+	}
+
+	installed, err := hm.installDomainCertificate(domain, certPEM, keyPEM)
+	if err != nil {
+		return installed, err
+	}
+	hm.logger.Infof("Uploaded certificate for %s installed, issued by %s, valid until %s", domain, installed.Issuer, installed.NotAfter.Format("2006-01-02"))
+	return installed, nil
+}
+
+// installDomainCertificate saves the domain's certificate files and restarts Hysteria2. A
+// failed restart returns the installed certificate with the error.
+func (hm *HysteriaManagerImpl) installDomainCertificate(domain, certPEM, keyPEM string) (*CertificateInfo, error) {
+	if _, _, err := hm.certificateManager.InstallCertificate(domain, certPEM, keyPEM); err != nil {
+		return nil, err
+	}
+
+	certificates, err := hm.certificateManager.ListCertificates()
+	if err != nil {
+		return nil, err
+	}
+	var installed *CertificateInfo
+	for i := range certificates {
+		if certificates[i].Domain == domain {
+			installed = &certificates[i]
+			break
+		}
+	}
+	if installed == nil {
+		return nil, fmt.Errorf("installed certificate for %s not found", domain)
+	}
+
+	if hm.IsHysteria2Installed() {
+		if err := hm.RestartHysteria2(hysteria2ConfigPath); err != nil {
+			return installed, fmt.Errorf("certificate installed but Hysteria2 failed to restart: %w", err)
+		}
+	}
+	return installed, nil
+}
@@ -0,0 +1,147 @@
+package services
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"hysteria2_microservices/agent-service/internal/config"
+	"hysteria2_microservices/agent-service/internal/privsep"
+)
+
+func TestNormalizeSNIDomain(t *testing.T) {
+	longLabel := strings.Repeat("a", 64)
+	tests := []struct {
+		domain string
+		want   string // empty when the domain is invalid
+	}{
+		{"vpn.example.com", "vpn.example.com"},
+		{"VPN.Example.COM", "vpn.example.com"},
+		{" vpn.example.com. ", "vpn.example.com"},
+		{"пример.рф", "xn--e1afmkfd.xn--p1ai"},
+		{"Пример.РФ.", "xn--e1afmkfd.xn--p1ai"},
+		{"xn--e1afmkfd.xn--p1ai", "xn--e1afmkfd.xn--p1ai"},
+		{"*.example.com", "*.example.com"},
+		{"*.Пример.рф", "*.xn--e1afmkfd.xn--p1ai"},
+		{strings.Repeat("a", 63) + ".example.com", strings.Repeat("a", 63) + ".example.com"},
+		{longLabel + ".example.com", ""},
+		{"vpn." + longLabel + ".com", ""},
+		{"", ""},
+		{".", ""},
+		{"localhost", ""},
+		{"*.com", ""},
+		{"*", ""},
+		{"vpn.*.example.com", ""},
+		{"*vpn.example.com", ""},
+		{"**.example.com", ""},
+		{"vpn..example.com", ""},
+		{"203.0.113.7", ""},
+		{"2001:db8::1", ""},
+	}
+	for _, tt := range tests {
+		got, err := NormalizeSNIDomain(tt.domain)
+		if tt.want == "" {
+			if !errors.Is(err, ErrInvalidDomain) {
+				t.Errorf("NormalizeSNIDomain(%q) = %q, %v; want ErrInvalidDomain", tt.domain, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("NormalizeSNIDomain(%q) = %q, %v; want %q", tt.domain, got, err, tt.want)
+		}
+	}
+}
+
+func TestNormalizeSNIDomainsRejectsDuplicates(t *testing.T) {
+	if _, err := NormalizeSNIDomains([]string{"vpn.example.com", "VPN.example.com."}); !errors.Is(err, ErrDomainConflict) {
+		t.Errorf("NormalizeSNIDomains with a respelled duplicate = %v, want ErrDomainConflict", err)
+	}
+	got, err := NormalizeSNIDomains([]string{"Пример.РФ", "*.example.com"})
+	if err != nil || len(got) != 2 || got[0] != "xn--e1afmkfd.xn--p1ai" || got[1] != "*.example.com" {
+		t.Errorf("NormalizeSNIDomains = %v, %v", got, err)
+	}
+}
+
+// The names the normalizer produces must pass the helper's certbot policy, or their
+// certificates cannot be issued when the agent runs unprivileged
+func TestNormalizedSNIDomainsPassCertbotPolicy(t *testing.T) {
+	for _, domain := range []string{"vpn.example.com", "Пример.РФ", "vpn.bücher.de", "cdn.例え.jp"} {
+		name, err := NormalizeSNIDomain(domain)
+		if err != nil {
+			t.Fatalf("NormalizeSNIDomain(%q): %v", domain, err)
+		}
+		for _, args := range [][]string{
+			{"certonly", "--standalone", "-d", name, "--agree-tos", "-m", "admin@example.com", "-n"},
+			{"renew", "--cert-name", name, "-n"},
+		} {
+			// Hosts without certbot fail to resolve it once the arguments are accepted
+			if _, err := privsep.Check("certbot", args); err != nil && !strings.Contains(err.Error(), "not found") {
+				t.Errorf("certbot %s refused for %q: %v", args[0], domain, err)
+			}
+		}
+	}
+}
+
+func TestIssueCertificateRejects(t *testing.T) {
+	hm := &HysteriaManagerImpl{logger: testLogger(), config: &config.Config{}}
+
+	if _, err := hm.IssueCertificate("*.example.com", "ops@example.com"); !errors.Is(err, ErrInvalidDomain) {
+		t.Errorf("wildcard = %v, want ErrInvalidDomain", err)
+	}
+	// Without an email in the request or sni_email there is no Let's Encrypt account
+	if _, err := hm.IssueCertificate("vpn.example.com", ""); err == nil || !strings.Contains(err.Error(), "email") {
+		t.Errorf("no email = %v, want an error", err)
+	}
+}
+
+// fakeCertificates issues certificates into dir and remembers what was installed
+type fakeCertificates struct {
+	CertificateManager
+	dir       string
+	challenge string
+	installed map[string]string
+}
+
+func (f *fakeCertificates) GenerateLetsEncryptCert(domain, email, challenge string) (string, string, error) {
+	f.challenge = challenge
+	certPath, keyPath := filepath.Join(f.dir, "fullchain.pem"), filepath.Join(f.dir, "privkey.pem")
+	os.WriteFile(certPath, []byte("issued chain of "+domain), 0600)
+	os.WriteFile(keyPath, []byte("issued key of "+domain), 0600)
+	return certPath, keyPath, nil
+}
+
+func (f *fakeCertificates) InstallCertificate(domain, certContent, keyContent string) (string, string, error) {
+	f.installed[domain] = certContent + "|" + keyContent
+	return "", "", nil
+}
+
+func (f *fakeCertificates) ListCertificates() ([]CertificateInfo, error) {
+	var certificates []CertificateInfo
+	for domain := range f.installed {
+		certificates = append(certificates, CertificateInfo{Domain: domain})
+	}
+	return certificates, nil
+}
+
+func TestIssueCertificate(t *testing.T) {
+	// No hysteria binary on PATH, so nothing is restarted
+	t.Setenv("PATH", t.TempDir())
+	certificates := &fakeCertificates{dir: t.TempDir(), installed: map[string]string{}}
+	cfg := &config.Config{}
+	cfg.Hysteria2.SNIEmail = "ops@example.com"
+	hm := &HysteriaManagerImpl{logger: testLogger(), config: cfg, certificateManager: certificates}
+
+	issued, err := hm.IssueCertificate("vpn.example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issued.Domain != "vpn.example.com" || certificates.challenge != "http-01" {
+		t.Errorf("issued %+v with %s", issued, certificates.challenge)
+	}
+	// The certificate certbot issued replaces the domain's own
+	if got := certificates.installed["vpn.example.com"]; got != "issued chain of vpn.example.com|issued key of vpn.example.com" {
+		t.Errorf("installed %q", got)
+	}
+}
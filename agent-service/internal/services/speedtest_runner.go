@@ -0,0 +1,223 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os/exec"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"hysteria2_microservices/agent-service/internal/config"
+)
+
+// Reflector types
+const (
+	SpeedtestTypeIPerf3 = "iperf3"
+	SpeedtestTypeOokla  = "speedtest"
+)
+
+const (
+	speedtestDefaultDuration = 5
+	speedtestMaxDuration     = 30
+	speedtestPingCount       = 5
+	speedtestDialTimeout     = 5 * time.Second
+	iperf3DefaultPort        = 5201
+)
+
+// SpeedtestReflector is a measurement endpoint standing in for the clients of a region:
+// an iperf3 server, or a Speedtest.net server ID for the Ookla CLI
+type SpeedtestReflector struct {
+	Region   string
+	Host     string
+	Port     int
+	Type     string
+	ServerID string
+}
+
+// SpeedtestResult is the latency and throughput between this node and one reflector.
+// Download is reflector to node, upload node to reflector.
+type SpeedtestResult struct {
+	Region       string
+	Host         string
+	LatencyMs    float64
+	DownloadMbps float64
+	UploadMbps   float64
+	Error        string
+	MeasuredAt   time.Time
+}
+
+// SpeedtestRunnerImpl measures the node against reflectors with iperf3 or the Ookla CLI
+type SpeedtestRunnerImpl struct {
+	logger *logrus.Logger
+	config *config.Config
+}
+
+// NewSpeedtestRunner creates a new SpeedtestRunner
+func NewSpeedtestRunner(logger *logrus.Logger, cfg *config.Config) SpeedtestRunner {
+	return &SpeedtestRunnerImpl{
+		logger: logger,
+		config: cfg,
+	}
+}
+
+// Run measures every reflector in turn, so tests do not compete for the uplink.
+// A failed reflector is reported in its result rather than failing the run.
+func (sr *SpeedtestRunnerImpl) Run(ctx context.Context, reflectors []SpeedtestReflector, duration int) ([]SpeedtestResult, error) {
+	if len(reflectors) == 0 {
+		return nil, fmt.Errorf("at least one reflector is required")
+	}
+	if duration <= 0 {
+		duration = speedtestDefaultDuration
+	}
+	if duration > speedtestMaxDuration {
+		duration = speedtestMaxDuration
+	}
+
+	results := make([]SpeedtestResult, 0, len(reflectors))
+	for _, reflector := range reflectors {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		var result SpeedtestResult
+		var err error
+		switch reflector.Type {
+		case "", SpeedtestTypeIPerf3:
+			result, err = sr.runIPerf3(ctx, reflector, duration)
+		case SpeedtestTypeOokla:
+			result, err = sr.runOokla(ctx, reflector)
+		default:
+			err = fmt.Errorf("unsupported reflector type %q", reflector.Type)
+		}
+		result.Region = reflector.Region
+		result.Host = reflector.Host
+		result.MeasuredAt = time.Now()
+		if err != nil {
+			sr.logger.Warnf("Speedtest against %s (%s) failed: %v", reflector.Host, reflector.Region, err)
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (sr *SpeedtestRunnerImpl) runIPerf3(ctx context.Context, reflector SpeedtestReflector, duration int) (SpeedtestResult, error) {
+	var result SpeedtestResult
+	if reflector.Host == "" {
+		return result, fmt.Errorf("reflector host is required")
+	}
+	port := reflector.Port
+	if port == 0 {
+		port = iperf3DefaultPort
+	}
+
+	latency, err := tcpConnectLatency(ctx, net.JoinHostPort(reflector.Host, strconv.Itoa(port)))
+	if err != nil {
+		return result, fmt.Errorf("reflector unreachable: %w", err)
+	}
+	result.LatencyMs = latency
+
+	if _, err := exec.LookPath("iperf3"); err != nil {
+		return result, fmt.Errorf("iperf3 is not installed")
+	}
+	// iperf3 servers accept one test at a time, so the two directions run back to back
+	if result.UploadMbps, err = iperf3Throughput(ctx, reflector.Host, port, duration, false); err != nil {
+		return result, fmt.Errorf("upload test failed: %w", err)
+	}
+	if result.DownloadMbps, err = iperf3Throughput(ctx, reflector.Host, port, duration, true); err != nil {
+		return result, fmt.Errorf("download test failed: %w", err)
+	}
+	return result, nil
+}
+
+func (sr *SpeedtestRunnerImpl) runOokla(ctx context.Context, reflector SpeedtestReflector) (SpeedtestResult, error) {
+	var result SpeedtestResult
+	if _, err := exec.LookPath("speedtest"); err != nil {
+		return result, fmt.Errorf("speedtest CLI is not installed")
+	}
+
+	args := []string{"--accept-license", "--accept-gdpr", "--format=json"}
+	if reflector.ServerID != "" {
+		args = append(args, "--server-id="+reflector.ServerID)
+	} else if reflector.Host != "" {
+		args = append(args, "--host="+reflector.Host)
+	}
+	output, err := exec.CommandContext(ctx, "speedtest", args...).Output()
+	if err != nil {
+		return result, fmt.Errorf("speedtest failed: %w", err)
+	}
+
+	var report struct {
+		Ping struct {
+			Latency float64 `json:"latency"`
+		} `json:"ping"`
+		Download struct {
+			Bandwidth float64 `json:"bandwidth"` // bytes per second
+		} `json:"download"`
+		Upload struct {
+			Bandwidth float64 `json:"bandwidth"`
+		} `json:"upload"`
+	}
+	if err := json.Unmarshal(output, &report); err != nil {
+		return result, fmt.Errorf("failed to parse speedtest output: %w", err)
+	}
+	result.LatencyMs = report.Ping.Latency
+	result.DownloadMbps = report.Download.Bandwidth * 8 / 1e6
+	result.UploadMbps = report.Upload.Bandwidth * 8 / 1e6
+	return result, nil
+}
+
+// iperf3Throughput runs one TCP test; reverse has the reflector send to the node
+func iperf3Throughput(ctx context.Context, host string, port, duration int, reverse bool) (float64, error) {
+	args := []string{"-c", host, "-p", strconv.Itoa(port), "-t", strconv.Itoa(duration), "-J"}
+	if reverse {
+		args = append(args, "-R")
+	}
+	// iperf3 exits non-zero on errors but still prints them in the JSON report
+	output, runErr := exec.CommandContext(ctx, "iperf3", args...).Output()
+
+	var report struct {
+		Error string `json:"error"`
+		End   struct {
+			SumReceived struct {
+				BitsPerSecond float64 `json:"bits_per_second"`
+			} `json:"sum_received"`
+		} `json:"end"`
+	}
+	if err := json.Unmarshal(output, &report); err != nil {
+		if runErr != nil {
+			return 0, runErr
+		}
+		return 0, fmt.Errorf("failed to parse iperf3 output: %w", err)
+	}
+	if report.Error != "" {
+		return 0, fmt.Errorf("%s", report.Error)
+	}
+	return report.End.SumReceived.BitsPerSecond / 1e6, nil
+}
+
+// tcpConnectLatency returns the median TCP handshake time in milliseconds
+func tcpConnectLatency(ctx context.Context, addr string) (float64, error) {
+	dialer := net.Dialer{Timeout: speedtestDialTimeout}
+	samples := make([]float64, 0, speedtestPingCount)
+	var lastErr error
+	for i := 0; i < speedtestPingCount; i++ {
+		started := time.Now()
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		samples = append(samples, float64(time.Since(started).Microseconds())/1000)
+		conn.Close()
+	}
+	if len(samples) == 0 {
+		return 0, lastErr
+	}
+	sort.Float64s(samples)
+	return samples[len(samples)/2], nil
+}
@@ -0,0 +1,89 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"hysteria2_microservices/agent-service/internal/config"
+)
+
+// listenReflector accepts TCP connections the way an iperf3 server does
+func listenReflector(t *testing.T) (string, int) {
+	addr := listenLoopback(t, func(conn net.Conn) { conn.Close() }).Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+func newTestSpeedtestRunner() *SpeedtestRunnerImpl {
+	return NewSpeedtestRunner(testLogger(), &config.Config{}).(*SpeedtestRunnerImpl)
+}
+
+func TestSpeedtestIPerf3(t *testing.T) {
+	fakes := fakeCommands(t, nil, "iperf3")
+	fakes.setOutput(t, "iperf3", `{"start": {}, "end": {"sum_received": {"bits_per_second": 94500000}}}`)
+	host, port := listenReflector(t)
+
+	results, err := newTestSpeedtestRunner().Run(context.Background(), []SpeedtestReflector{{Region: "eu", Host: host, Port: port}}, 100)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	result := results[0]
+	if result.Error != "" || result.Region != "eu" || result.LatencyMs <= 0 || result.UploadMbps != 94.5 || result.DownloadMbps != 94.5 {
+		t.Errorf("result %+v, want 94.5 Mbps both ways", result)
+	}
+
+	// Upload then download, capped at the longest test duration
+	base := fmt.Sprintf("iperf3 -c %s -p %d -t 30 -J", host, port)
+	if calls := fakes.calls(); !reflect.DeepEqual(calls, []string{base, base + " -R"}) {
+		t.Errorf("iperf3 calls %v", calls)
+	}
+}
+
+func TestSpeedtestReportsFailuresPerReflector(t *testing.T) {
+	fakes := fakeCommands(t, map[string]int{"iperf3 -J": 1}, "iperf3", "speedtest")
+	fakes.setOutput(t, "iperf3", `{"start": {}, "error": "the server is busy running a test. try again later"}`)
+	fakes.setOutput(t, "speedtest", `{"type": "result", "ping": {"latency": 12.5}, "download": {"bandwidth": 12500000}, "upload": {"bandwidth": 2500000}}`)
+	host, port := listenReflector(t)
+
+	// A port nothing listens on
+	lis := listenLoopback(t, nil)
+	downPort := lis.Addr().(*net.TCPAddr).Port
+	lis.Close()
+
+	results, err := newTestSpeedtestRunner().Run(context.Background(), []SpeedtestReflector{
+		{Region: "busy", Host: host, Port: port},
+		{Region: "down", Host: "127.0.0.1", Port: downPort},
+		{Region: "ookla", Type: SpeedtestTypeOokla, ServerID: "1234"},
+		{Region: "other", Type: "ndt7", Host: host},
+	}, 0)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(results) != 4 {
+		t.Fatalf("%d results, want one per reflector", len(results))
+	}
+
+	if !strings.Contains(results[0].Error, "the server is busy") {
+		t.Errorf("busy reflector error %q, want iperf3's error", results[0].Error)
+	}
+	if !strings.HasPrefix(results[1].Error, "reflector unreachable") {
+		t.Errorf("unreachable reflector error %q", results[1].Error)
+	}
+	if ookla := results[2]; ookla.Error != "" || ookla.LatencyMs != 12.5 || ookla.DownloadMbps != 100 || ookla.UploadMbps != 20 {
+		t.Errorf("Ookla result %+v, want 12.5 ms, 100 down and 20 up", ookla)
+	}
+	if !strings.Contains(results[3].Error, "unsupported reflector type") {
+		t.Errorf("unknown type error %q", results[3].Error)
+	}
+
+	if calls := callsTo(fakes.calls(), "speedtest"); len(calls) != 1 || !strings.HasSuffix(calls[0], "--format=json --server-id=1234") {
+		t.Errorf("speedtest calls %v, want the server ID", calls)
+	}
+
+	if _, err := newTestSpeedtestRunner().Run(context.Background(), nil, 5); err == nil {
+		t.Error("ran without reflectors")
+	}
+}
@@ -4,11 +4,12 @@ import (
 	"bufio"
 	"fmt"
 	"os"
-	"os/exec"
 	"runtime"
 	"strings"
 
 	"github.com/sirupsen/logrus"
+
+	"hysteria2_microservices/agent-service/internal/privsep"
 )
 
 // SystemManagerImpl implements SystemManager interface
@@ -66,6 +67,9 @@ func (sm *SystemManagerImpl) IsBBREnabled() (bool, error) {
 	return false, nil
 }
 
+// bbrSysctlFile makes BBR persistent across reboots
+const bbrSysctlFile = "/etc/sysctl.d/99-hysteria-bbr.conf"
+
 // EnableBBR enables BBR congestion control
 func (sm *SystemManagerImpl) EnableBBR() error {
 	sm.logger.Info("Enabling BBR congestion control")
@@ -73,21 +77,21 @@ func (sm *SystemManagerImpl) EnableBBR() error {
 	// Check if bbr module is available
 	if _, err := os.Stat("/lib/modules/$(uname -r)/kernel/net/ipv4/tcp_bbr.ko"); os.IsNotExist(err) {
 		// Try to load bbr module
-		cmd := exec.Command("modprobe", "tcp_bbr")
+		cmd := privsep.Command("modprobe", "tcp_bbr")
 		if err := cmd.Run(); err != nil {
 			sm.logger.Warnf("Failed to load tcp_bbr module: %v", err)
 		}
 	}
 
 	// Set bbr as default congestion control
-	cmd := exec.Command("sysctl", "-w", "net.ipv4.tcp_congestion_control=bbr")
+	cmd := privsep.Command("sysctl", "-w", "net.ipv4.tcp_congestion_control=bbr")
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("failed to set BBR: %w", err)
 	}
 
 	// Make it persistent
-	cmd = exec.Command("echo", "net.ipv4.tcp_congestion_control=bbr", ">>", "/etc/sysctl.conf")
-	if err := cmd.Run(); err != nil {
+	err := privsep.WriteFile(bbrSysctlFile, []byte("net.ipv4.tcp_congestion_control=bbr\n"), 0644)
+	if err != nil {
 		sm.logger.Warnf("Failed to make BBR persistent: %v", err)
 	}
 
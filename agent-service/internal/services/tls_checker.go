@@ -0,0 +1,268 @@
+package services
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TLS grades, from best to worst
+const (
+	TLSGradeA = "A" // every check passed
+	TLSGradeB = "B" // warnings only
+	TLSGradeC = "C" // legacy protocols or broken cipher suites
+	TLSGradeF = "F" // a certificate clients reject
+)
+
+// tlsExpiryWarning is how long before expiry a served certificate is reported
+const tlsExpiryWarning = 14 * 24 * time.Hour
+
+// TLSReport grades the TLS a node serves on its TCP ports as clients see it
+type TLSReport struct {
+	Target     string
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Grade      string
+	Score      int
+	Checks     []ProbeCheck
+}
+
+// CheckTLS validates what target serves on its TLS ports: the certificate chain of every
+// SNI domain, OCSP stapling, the protocol versions and the cipher suites it accepts. Like
+// probes it runs on another node so the handshakes come from outside. Hysteria2 is not
+// checked: QUIC always runs TLS 1.3.
+func (pr *ProbeRunnerImpl) CheckTLS(ctx context.Context, target ProbeTarget) (*TLSReport, error) {
+	if target.Host == "" {
+		return nil, fmt.Errorf("target host is required")
+	}
+	if len(target.TLSPorts) == 0 {
+		return nil, fmt.Errorf("target has no TLS ports to check")
+	}
+
+	report := &TLSReport{
+		Target:    target.Host,
+		StartedAt: time.Now(),
+	}
+	pr.logger.Infof("Running TLS checks against %s", target.Host)
+
+	for _, port := range target.TLSPorts {
+		addr := net.JoinHostPort(target.Host, strconv.Itoa(port))
+		for _, domain := range target.SNIDomains {
+			report.Checks = append(report.Checks, pr.timed("tls_chain", addr+" "+domain, func() (string, string) {
+				return checkTLSChain(ctx, addr, domain)
+			}))
+			report.Checks = append(report.Checks, pr.timed("ocsp_stapling", addr+" "+domain, func() (string, string) {
+				return checkOCSPStapling(ctx, addr, domain)
+			}))
+		}
+
+		serverName := ""
+		if len(target.SNIDomains) > 0 {
+			serverName = target.SNIDomains[0]
+		}
+		report.Checks = append(report.Checks, pr.timed("tls_versions", addr, func() (string, string) {
+			return checkTLSVersions(ctx, addr, serverName)
+		}))
+		report.Checks = append(report.Checks, pr.timed("weak_ciphers", addr, func() (string, string) {
+			return checkWeakCiphers(ctx, addr, serverName)
+		}))
+	}
+
+	for i := range report.Checks {
+		report.Checks[i].Hint = tlsHint(&report.Checks[i])
+	}
+	report.FinishedAt = time.Now()
+	report.Score = probeScore(report.Checks)
+	report.Grade = tlsGrade(report.Checks)
+	pr.logger.Infof("TLS checks against %s finished with grade %s", target.Host, report.Grade)
+	return report, nil
+}
+
+// checkTLSChain verifies the served chain against the system roots, the way browsers and
+// most clients without a pinned CA do
+func checkTLSChain(ctx context.Context, addr, domain string) (string, string) {
+	state, err := tlsHandshake(ctx, addr, &tls.Config{ServerName: domain})
+	if err == nil {
+		leaf := state.PeerCertificates[0]
+		if left := time.Until(leaf.NotAfter); left < tlsExpiryWarning {
+			return ProbeStatusWarn, fmt.Sprintf("certificate expires in %d day(s), on %s", int(left.Hours()/24), leaf.NotAfter.Format("2006-01-02"))
+		}
+		return ProbeStatusPass, fmt.Sprintf("chain of %d certificate(s) issued by %s verified", len(state.PeerCertificates), leaf.Issuer.CommonName)
+	}
+
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	switch {
+	case errors.As(err, &unknownAuthority):
+		if cert := unknownAuthority.Cert; cert != nil && cert.Issuer.String() == cert.Subject.String() {
+			return ProbeStatusFail, "self-signed certificate"
+		}
+		return ProbeStatusFail, "chain does not lead to a trusted root: intermediates are missing or the CA is not public"
+	case errors.As(err, &hostname):
+		return ProbeStatusFail, fmt.Sprintf("certificate for %s does not cover %s", strings.Join(hostname.Certificate.DNSNames, ","), domain)
+	case errors.As(err, &invalid) && invalid.Reason == x509.Expired:
+		return ProbeStatusFail, "certificate expired"
+	default:
+		return ProbeStatusFail, fmt.Sprintf("handshake failed: %v", err)
+	}
+}
+
+// checkOCSPStapling expects an OCSP response in the handshake when the certificate names a
+// responder; without a staple clients query the CA or skip revocation checks
+func checkOCSPStapling(ctx context.Context, addr, domain string) (string, string) {
+	state, err := tlsHandshake(ctx, addr, &tls.Config{ServerName: domain, InsecureSkipVerify: true})
+	if err != nil {
+		return ProbeStatusSkip, fmt.Sprintf("handshake failed: %v", err)
+	}
+	if len(state.OCSPResponse) > 0 {
+		return ProbeStatusPass, fmt.Sprintf("OCSP response of %d bytes stapled", len(state.OCSPResponse))
+	}
+	if len(state.PeerCertificates[0].OCSPServer) == 0 {
+		return ProbeStatusSkip, "certificate names no OCSP responder"
+	}
+	return ProbeStatusWarn, "no OCSP response stapled"
+}
+
+// checkTLSVersions expects TLS 1.0 and 1.1 to be refused and TLS 1.3 to be offered
+func checkTLSVersions(ctx context.Context, addr, serverName string) (string, string) {
+	var legacy []string
+	for _, version := range []uint16{tls.VersionTLS10, tls.VersionTLS11} {
+		if _, err := tlsHandshake(ctx, addr, tlsVersionConfig(serverName, version)); err == nil {
+			legacy = append(legacy, tls.VersionName(version))
+		}
+	}
+	if len(legacy) > 0 {
+		return ProbeStatusFail, "accepts " + strings.Join(legacy, " and ")
+	}
+	if _, err := tlsHandshake(ctx, addr, tlsVersionConfig(serverName, tls.VersionTLS13)); err != nil {
+		return ProbeStatusWarn, fmt.Sprintf("TLS 1.3 refused: %v", err)
+	}
+	return ProbeStatusPass, "TLS 1.0 and 1.1 refused, TLS 1.3 accepted"
+}
+
+// checkWeakCiphers offers only suites modern guidelines drop and expects the server to
+// refuse them: RSA key exchange, 3DES and RC4 fail the check, CBC modes with ECDHE warn
+func checkWeakCiphers(ctx context.Context, addr, serverName string) (string, string) {
+	broken, legacy := weakCipherSuites()
+	for _, offered := range []struct {
+		suites []uint16
+		status string
+	}{{broken, ProbeStatusFail}, {legacy, ProbeStatusWarn}} {
+		config := tlsVersionConfig(serverName, tls.VersionTLS12)
+		config.MinVersion = tls.VersionTLS10
+		config.CipherSuites = offered.suites
+
+		state, err := tlsHandshake(ctx, addr, config)
+		if err == nil {
+			return offered.status, fmt.Sprintf("negotiated %s on %s", tls.CipherSuiteName(state.CipherSuite), tls.VersionName(state.Version))
+		}
+		if isTimeout(err) {
+			return ProbeStatusSkip, "no answer"
+		}
+	}
+	return ProbeStatusPass, "weak cipher suites refused"
+}
+
+// weakCipherSuites returns the TLS 1.2 suites without forward secrecy or with broken
+// ciphers, and the ones using CBC modes with ECDHE
+func weakCipherSuites() (broken, legacy []uint16) {
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if !slices.Contains(suite.SupportedVersions, tls.VersionTLS12) {
+			continue
+		}
+		switch {
+		case suite.Insecure || strings.HasPrefix(suite.Name, "TLS_RSA_"):
+			broken = append(broken, suite.ID)
+		case strings.Contains(suite.Name, "_CBC_"):
+			legacy = append(legacy, suite.ID)
+		}
+	}
+	return broken, legacy
+}
+
+func tlsVersionConfig(serverName string, version uint16) *tls.Config {
+	return &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		MinVersion:         version,
+		MaxVersion:         version,
+	}
+}
+
+// tlsHandshake runs one handshake with config and returns the connection state
+func tlsHandshake(ctx context.Context, addr string, config *tls.Config) (tls.ConnectionState, error) {
+	dialer := net.Dialer{Timeout: probeDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(probeReadTimeout))
+	client := tls.Client(conn, config)
+	if err := client.HandshakeContext(ctx); err != nil {
+		return tls.ConnectionState{}, err
+	}
+	state := client.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return state, fmt.Errorf("no certificate presented")
+	}
+	return state, nil
+}
+
+// tlsGrade grades the checks: a certificate clients reject fails the node, other failures
+// cap it at C and warnings at B
+func tlsGrade(checks []ProbeCheck) string {
+	grade := TLSGradeA
+	for _, check := range checks {
+		switch {
+		case check.Status == ProbeStatusFail && check.Name == "tls_chain":
+			return TLSGradeF
+		case check.Status == ProbeStatusFail:
+			grade = TLSGradeC
+		case check.Status == ProbeStatusWarn && grade == TLSGradeA:
+			grade = TLSGradeB
+		}
+	}
+	return grade
+}
+
+// tlsHint tells the operator how to fix a check that did not pass
+func tlsHint(check *ProbeCheck) string {
+	if check.Status != ProbeStatusFail && check.Status != ProbeStatusWarn {
+		return ""
+	}
+	switch check.Name {
+	case "tls_chain":
+		switch {
+		case strings.HasPrefix(check.Detail, "certificate expires"), check.Detail == "certificate expired":
+			return "Renew the certificate: POST /api/v1/nodes/{id}/certificates/renew, or upload a new one"
+		case check.Detail == "self-signed certificate":
+			return "Issue a Let's Encrypt certificate for the domain or upload one signed by a CA clients trust"
+		case strings.HasPrefix(check.Detail, "chain does not lead"):
+			return "Serve the full chain, the certificate followed by its intermediates; clients of an internal CA must have its root installed"
+		case strings.Contains(check.Detail, "does not cover"):
+			return "Add the domain to the certificate or serve the domain's own certificate"
+		default:
+			return "Check that the service on this port is running and serves TLS for the domain"
+		}
+	case "ocsp_stapling":
+		return "Enable OCSP stapling on the service listening on this port so clients do not have to query the CA"
+	case "tls_versions":
+		if check.Status == ProbeStatusFail {
+			return "Set the minimum TLS version of the service on this port to 1.2"
+		}
+		return "Enable TLS 1.3 on the service listening on this port"
+	case "weak_ciphers":
+		return "Allow only ECDHE key exchange with AES-GCM or ChaCha20-Poly1305 cipher suites"
+	}
+	return ""
+}
@@ -2,12 +2,13 @@ package services
 
 import (
 	"fmt"
+	"net"
 	"os"
-	"os/exec"
 	"strings"
 
 	"github.com/sirupsen/logrus"
 	"hysteria2_microservices/agent-service/internal/config"
+	"hysteria2_microservices/agent-service/internal/hysteriaconfig"
 )
 
 // TrafficRouter handles advanced traffic routing through WARP
@@ -31,6 +32,7 @@ type TrafficRouter interface {
 type TrafficRouterImpl struct {
 	logger *logrus.Logger
 	config *config.Config
+	runner *CommandRunner
 }
 
 // NewTrafficRouter creates a new TrafficRouter
@@ -38,6 +40,7 @@ func NewTrafficRouter(logger *logrus.Logger, cfg *config.Config) TrafficRouter {
 	return &TrafficRouterImpl{
 		logger: logger,
 		config: cfg,
+		runner: NewCommandRunner(logger, cfg),
 	}
 }
 
@@ -64,35 +67,20 @@ func (tr *TrafficRouterImpl) ConfigureVPNTroughWARP(warpPort int, vpnInterface s
 	return nil
 }
 
-// CreateHysteriaACL creates ACL configuration for Hysteria2
+// CreateHysteriaACL writes the Hysteria2 ACL file. Local ranges and the WARP bypass stay
+// direct; the rest goes through WARP when it is enabled.
 func (tr *TrafficRouterImpl) CreateHysteriaACL(warpEnabled bool) error {
 	tr.logger.Infof("Creating Hysteria2 ACL configuration (WARP enabled: %v)", warpEnabled)
 
-	aclContent := `# Hysteria2 ACL Configuration for WARP Integration
-# This ACL controls how traffic is routed through the VPN
-
-# Local network bypass - don't route LAN traffic through VPN
-- src, 127.0.0.1/8, dst, 127.0.0.1/8
-- src, 10.0.0.0/8, dst, 10.0.0.0/8
-- src, 172.16.0.0/12, dst, 172.16.0.0/12
-- src, 192.168.0.0/16, dst, 192.168.0.0/16
-
-# Private network ranges
-- src, 100.64.0.0/10, dst, 100.64.0.0/10
-
-# When WARP is enabled, route all other traffic through WARP
-`
-
-	if warpEnabled {
-		aclContent += `# Route all internet traffic through WARP
-# This is handled by the outbound proxy configuration
-# All non-local traffic will be sent to WARP SOCKS5 proxy
-`
-	} else {
-		aclContent += `# Allow all other traffic (traditional routing)
-+
-`
+	rules, err := warpACLRules(tr.config, warpEnabled)
+	if err != nil {
+		return err
+	}
+	lines, err := hysteriaconfig.FormatACL(rules)
+	if err != nil {
+		return fmt.Errorf("invalid Hysteria2 ACL: %w", err)
 	}
+	aclContent := "# Generated by the agent traffic router, do not edit\n" + strings.Join(lines, "\n") + "\n"
 
 	// Ensure ACL directory exists
 	aclDir := "/etc/hysteria"
@@ -101,72 +89,118 @@ func (tr *TrafficRouterImpl) CreateHysteriaACL(warpEnabled bool) error {
 	}
 
 	// Write ACL file
-	aclPath := "/etc/hysteria/acl.yaml"
-	if err := os.WriteFile(aclPath, []byte(aclContent), 0644); err != nil {
+	if err := os.WriteFile(warpACLPath, []byte(aclContent), 0644); err != nil {
 		return fmt.Errorf("failed to write ACL file: %w", err)
 	}
+	if err := recordDeployedConfig(tr.config, warpACLPath, []byte(aclContent)); err != nil {
+		return err
+	}
 
-	tr.logger.Info("Hysteria2 ACL configuration created successfully")
+	tr.logger.Infof("Hysteria2 ACL configuration created: %d rules", len(rules))
 	return nil
 }
 
-// SetupIPTablesRules creates iptables rules for traffic routing
-func (tr *TrafficRouterImpl) SetupIPTablesRules(warpPort int, vpnInterface string) error {
-	tr.logger.Infof("Setting up iptables rules (WARP port: %d, VPN interface: %s)", warpPort, vpnInterface)
-
-	// Clear existing rules first
-	if err := tr.cleanupExistingRules(); err != nil {
-		tr.logger.Warnf("Failed to cleanup existing rules: %v", err)
+// warpACLRules sends the local ranges of both families and the WARP bypass to the direct
+// outbound, then everything else to WARP or, with WARP disabled, direct as well. The first
+// match wins, so the catch-all comes last.
+func warpACLRules(cfg *config.Config, warpEnabled bool) ([]hysteriaconfig.ACLRule, error) {
+	rules := localRangeACLRules()
+	for _, entry := range cfg.Hysteria2.WARPBypass {
+		rule := warpBypassRule(entry)
+		if err := rule.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid WARP bypass entry %q: %w", entry, err)
+		}
+		rules = append(rules, rule)
 	}
 
-	rules := []string{
-		// NAT table rules
-		"-t nat -N HYSTERIA2-WARP",
-
-		// Skip local traffic
-		"-t nat -A HYSTERIA2-WARP -d 127.0.0.0/8 -j RETURN",
-		"-t nat -A HYSTERIA2-WARP -d 10.0.0.0/8 -j RETURN",
-		"-t nat -A HYSTERIA2-WARP -d 172.16.0.0/12 -j RETURN",
-		"-t nat -A HYSTERIA2-WARP -d 192.168.0.0/16 -j RETURN",
-		"-t nat -A HYSTERIA2-WARP -d 100.64.0.0/10 -j RETURN",
-
-		// Redirect HTTP/HTTPS to WARP proxy
-		fmt.Sprintf("-t nat -A HYSTERIA2-WARP -p tcp --dport 80 -j REDIRECT --to-ports %d", warpPort),
-		fmt.Sprintf("-t nat -A HYSTERIA2-WARP -p tcp --dport 443 -j REDIRECT --to-ports %d", warpPort),
-
-		// Redirect DNS to prevent leaks
-		"-t nat -A HYSTERIA2-WARP -p udp --dport 53 -j REDIRECT --to-ports 53",
-		"-t nat -A HYSTERIA2-WARP -p tcp --dport 53 -j REDIRECT --to-ports 53",
-
-		// Apply the chain to OUTPUT
-		"-t nat -A OUTPUT -j HYSTERIA2-WARP",
+	outbound := hysteriaDirectOutbound
+	if warpEnabled {
+		outbound = hysteriaWARPOutbound
+	}
+	return append(rules, hysteriaconfig.ACLRule{Outbound: outbound, Match: hysteriaconfig.ACLMatchAll}), nil
+}
 
-		// Filter table rules
-		"-t filter -N HYSTERIA2-FORWARD",
+// localRangeACLRules keeps the local ranges of both families on the node
+func localRangeACLRules() []hysteriaconfig.ACLRule {
+	var rules []hysteriaconfig.ACLRule
+	for _, family := range []ipFamily{ipv4Family, ipv6Family} {
+		for _, cidr := range family.localRanges {
+			rules = append(rules, hysteriaconfig.ACLRule{Outbound: hysteriaDirectOutbound, Match: hysteriaconfig.ACLMatchCIDR, Value: cidr})
+		}
+	}
+	return rules
+}
 
-		// Allow forwarding for VPN interface
-		fmt.Sprintf("-t filter -A FORWARD -i %s -j ACCEPT", vpnInterface),
-		fmt.Sprintf("-t filter -A FORWARD -o %s -j ACCEPT", vpnInterface),
+// warpBypassRule reads a WARP bypass entry: an address, a network, geoip:<country>,
+// geosite:<list> or a domain, which also covers its subdomains
+func warpBypassRule(entry string) hysteriaconfig.ACLRule {
+	entry = strings.ToLower(strings.TrimSpace(entry))
+	rule := hysteriaconfig.ACLRule{Outbound: hysteriaDirectOutbound, Value: entry}
+	switch {
+	case strings.HasPrefix(entry, "geoip:"):
+		rule.Match, rule.Value = hysteriaconfig.ACLMatchGeoIP, strings.TrimPrefix(entry, "geoip:")
+	case strings.HasPrefix(entry, "geosite:"):
+		rule.Match, rule.Value = hysteriaconfig.ACLMatchGeoSite, strings.TrimPrefix(entry, "geosite:")
+	case strings.Contains(entry, "/"):
+		rule.Match = hysteriaconfig.ACLMatchCIDR
+	case net.ParseIP(entry) != nil:
+		rule.Match = hysteriaconfig.ACLMatchIP
+	default:
+		rule.Match, rule.Value = hysteriaconfig.ACLMatchSuffix, strings.TrimPrefix(strings.TrimPrefix(entry, "*."), ".")
+	}
+	return rule
+}
 
-		// Apply forward rules
-		"-t filter -A FORWARD -j HYSTERIA2-FORWARD",
+// SetupIPTablesRules installs the routing chains for IPv4, and for IPv6 when the node has
+// it. Each family's chains are replaced in one iptables-restore transaction that rolls
+// back to the previous rules on failure, so re-running it never duplicates or half-applies
+// rules.
+func (tr *TrafficRouterImpl) SetupIPTablesRules(warpPort int, vpnInterface string) error {
+	tr.logger.Infof("Setting up iptables rules (WARP port: %d, VPN interface: %s)", warpPort, vpnInterface)
 
-		// Mangle table for QoS if needed
-		"-t mangle -N HYSTERIA2-QOS",
-		"-t mangle -A OUTPUT -j HYSTERIA2-QOS",
+	// Chains left over from when IPv6 was enabled
+	if !ipv6Enabled(tr.config) {
+		tr.cleanupFamilyRules(ipv6Family)
 	}
 
-	// Apply all rules
-	for _, rule := range rules {
-		if err := tr.runCommand("iptables", strings.Fields(rule)...); err != nil {
-			return fmt.Errorf("failed to apply rule '%s': %w", rule, err)
-		}
+	err := forEachFamily(tr.config, tr.logger, func(family ipFamily) error {
+		return applyIPTablesRuleset(tr.logger, family, tr.routingChains(family, warpPort, vpnInterface))
+	})
+	if err != nil {
+		return err
 	}
 
 	tr.logger.Info("iptables rules configured successfully")
 	return nil
 }
 
+// routingChains builds the complete ruleset of the router for one family
+func (tr *TrafficRouterImpl) routingChains(family ipFamily, warpPort int, vpnInterface string) []iptablesChain {
+	// Skip local traffic
+	var warp []string
+	for _, cidr := range family.localRanges {
+		warp = append(warp, fmt.Sprintf("-d %s -j RETURN", cidr))
+	}
+	warp = append(warp,
+		// Redirect HTTP/HTTPS to WARP proxy
+		fmt.Sprintf("-p tcp --dport 80 -j REDIRECT --to-ports %d", warpPort),
+		fmt.Sprintf("-p tcp --dport 443 -j REDIRECT --to-ports %d", warpPort),
+
+		// Redirect DNS to the local resolver to prevent leaks
+		fmt.Sprintf("-p udp --dport 53 -j REDIRECT --to-ports %d", dnsListenPort(tr.config)),
+		fmt.Sprintf("-p tcp --dport 53 -j REDIRECT --to-ports %d", dnsListenPort(tr.config)),
+	)
+
+	return []iptablesChain{
+		{Table: "nat", Name: "HYSTERIA2-WARP", Hook: "OUTPUT", Rules: warp},
+		// Allow forwarding for VPN interface
+		{Table: "filter", Name: "HYSTERIA2-FORWARD", Hook: "FORWARD", Rules: []string{
+			fmt.Sprintf("-i %s -j ACCEPT", vpnInterface),
+			fmt.Sprintf("-o %s -j ACCEPT", vpnInterface),
+		}},
+	}
+}
+
 // CleanupRoutingRules removes all routing rules
 func (tr *TrafficRouterImpl) CleanupRoutingRules() error {
 	tr.logger.Info("Cleaning up routing rules")
@@ -177,17 +211,21 @@ func (tr *TrafficRouterImpl) CleanupRoutingRules() error {
 // GetRoutingStatus returns current routing configuration status
 func (tr *TrafficRouterImpl) GetRoutingStatus() (map[string]interface{}, error) {
 	status := map[string]interface{}{
-		"ip_forwarding": false,
-		"nat_rules":     0,
-		"filter_rules":  0,
-		"warp_rules":    false,
+		"ip_forwarding":   false,
+		"ipv6_enabled":    ipv6Enabled(tr.config),
+		"ipv6_forwarding": false,
+		"nat_rules":       0,
+		"filter_rules":    0,
+		"warp_rules":      false,
+		"ipv6_warp_rules": false,
 	}
 
 	// Check IP forwarding
-	if output, err := tr.runCommandWithOutput("sysctl", "net.ipv4.ip_forward"); err == nil {
-		if strings.Contains(output, "1") {
-			status["ip_forwarding"] = true
-		}
+	if output, err := tr.runCommandWithOutput("sysctl", "-n", ipv4Family.forwarding); err == nil {
+		status["ip_forwarding"] = strings.TrimSpace(output) == "1"
+	}
+	if output, err := tr.runCommandWithOutput("sysctl", "-n", ipv6Family.forwarding); err == nil {
+		status["ipv6_forwarding"] = strings.TrimSpace(output) == "1"
 	}
 
 	// Count NAT rules
@@ -206,6 +244,9 @@ func (tr *TrafficRouterImpl) GetRoutingStatus() (map[string]interface{}, error)
 	if warpOutput, err := tr.runCommandWithOutput("iptables", "-t", "nat", "-L", "HYSTERIA2-WARP"); err == nil {
 		status["warp_rules"] = strings.Contains(warpOutput, "REDIRECT")
 	}
+	if warpOutput, err := tr.runCommandWithOutput("ip6tables", "-t", "nat", "-L", "HYSTERIA2-WARP"); err == nil {
+		status["ipv6_warp_rules"] = strings.Contains(warpOutput, "REDIRECT")
+	}
 
 	return status, nil
 }
@@ -213,44 +254,46 @@ func (tr *TrafficRouterImpl) GetRoutingStatus() (map[string]interface{}, error)
 // Helper methods
 
 func (tr *TrafficRouterImpl) enableIPForwarding() error {
-	return tr.runCommand("sysctl", "-w", "net.ipv4.ip_forward=1")
+	return forEachFamily(tr.config, tr.logger, func(family ipFamily) error {
+		return tr.runCommand("sysctl", "-w", family.forwarding+"=1")
+	})
 }
 
 func (tr *TrafficRouterImpl) cleanupExistingRules() error {
-	// Flush and delete custom chains
-	chains := []string{"HYSTERIA2-WARP", "HYSTERIA2-FORWARD", "HYSTERIA2-QOS"}
-	tables := []string{"nat", "filter", "mangle"}
+	// IPv6 chains are removed even when IPv6 has since been disabled
+	tr.cleanupFamilyRules(ipv4Family)
+	tr.cleanupFamilyRules(ipv6Family)
+	return nil
+}
+
+func (tr *TrafficRouterImpl) cleanupFamilyRules(family ipFamily) {
+	// Flush and delete custom chains; HYSTERIA2-QOS belongs to the QoS manager
+	chains := []string{"HYSTERIA2-WARP", "HYSTERIA2-FORWARD"}
+	tables := []string{"nat", "filter"}
 
 	for _, table := range tables {
 		// Flush each chain
 		for _, chain := range chains {
-			tr.runCommand("iptables", "-t", table, "-F", chain)
+			tr.runCommand(family.iptables, "-t", table, "-F", chain)
 		}
 	}
 
 	for _, chain := range chains {
 		// Delete from OUTPUT/FORWARD
-		tr.runCommand("iptables", "-D", "OUTPUT", "-j", chain)
-		tr.runCommand("iptables", "-D", "FORWARD", "-j", chain)
+		tr.runCommand(family.iptables, "-t", "nat", "-D", "OUTPUT", "-j", chain)
+		tr.runCommand(family.iptables, "-D", "FORWARD", "-j", chain)
 
 		// Delete chains
-		tr.runCommand("iptables", "-t", "nat", "-X", chain)
-		tr.runCommand("iptables", "-t", "filter", "-X", chain)
-		tr.runCommand("iptables", "-t", "mangle", "-X", chain)
+		tr.runCommand(family.iptables, "-t", "nat", "-X", chain)
+		tr.runCommand(family.iptables, "-t", "filter", "-X", chain)
 	}
-
-	return nil
 }
 
 func (tr *TrafficRouterImpl) runCommand(name string, args ...string) error {
-	cmd := exec.Command(name, args...)
-	tr.logger.Debugf("Running command: %s %v", name, args)
-	return cmd.Run()
+	_, err := tr.runner.Run(name, args...)
+	return err
 }
 
 func (tr *TrafficRouterImpl) runCommandWithOutput(name string, args ...string) (string, error) {
-	cmd := exec.Command(name, args...)
-	tr.logger.Debugf("Running command with output: %s %v", name, args)
-	output, err := cmd.Output()
-	return string(output), err
+	return tr.runner.Output(name, args...)
 }
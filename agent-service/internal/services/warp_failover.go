@@ -0,0 +1,257 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"hysteria2_microservices/agent-service/internal/config"
+	"hysteria2_microservices/agent-service/internal/hysteriaconfig"
+)
+
+// WARPFailoverState tells whether the backup egress carries the traffic meant for WARP
+type WARPFailoverState struct {
+	Active bool      `json:"active"`
+	Since  time.Time `json:"since,omitempty"`  // when the last switch happened
+	Reason string    `json:"reason,omitempty"` // health issues that made the agent fail over
+	Backup string    `json:"backup,omitempty"` // the backup egress, without credentials
+
+	// Whether failover runs, and consecutive checks finding WARP unhealthy or healthy; not saved
+	Enabled         bool `json:"-"`
+	UnhealthyChecks int  `json:"-"`
+	HealthyChecks   int  `json:"-"`
+}
+
+// WARPFailoverReporter is called with the new state after every switch
+type WARPFailoverReporter func(state WARPFailoverState)
+
+// WARPFailoverImpl follows the WARP monitor's checks. After FailAfter unhealthy checks in a
+// row it points the Hysteria2 outbounds that go through the WARP proxy at the backup egress,
+// and after RecoverAfter healthy ones it points them back. The state is saved so a restarted
+// agent keeps the backup until WARP has recovered.
+type WARPFailoverImpl struct {
+	logger          *logrus.Logger
+	config          *config.Config
+	monitor         WARPMonitor
+	hysteriaManager HysteriaManager
+
+	mu       sync.Mutex
+	state    WARPFailoverState
+	lastSeen time.Time
+	reporter WARPFailoverReporter
+}
+
+// NewWARPFailover creates a new WARPFailover
+func NewWARPFailover(logger *logrus.Logger, cfg *config.Config, monitor WARPMonitor, hysteriaManager HysteriaManager) WARPFailover {
+	return &WARPFailoverImpl{
+		logger:          logger,
+		config:          cfg,
+		monitor:         monitor,
+		hysteriaManager: hysteriaManager,
+	}
+}
+
+// Start restores the saved state and starts the WARP monitor
+func (wf *WARPFailoverImpl) Start(ctx context.Context) error {
+	cfg := wf.config.WARPFailover
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.FailAfter < 1 || cfg.RecoverAfter < 1 {
+		return fmt.Errorf("invalid warp_failover thresholds: fail_after %d, recover_after %d", cfg.FailAfter, cfg.RecoverAfter)
+	}
+	if _, err := warpBackupOutbound(cfg.Backup); err != nil {
+		return fmt.Errorf("invalid warp_failover.backup: %w", err)
+	}
+
+	state, err := loadWARPFailover(wf.config)
+	if err != nil {
+		return fmt.Errorf("failed to read WARP failover state: %w", err)
+	}
+	state.Enabled = true
+	wf.mu.Lock()
+	wf.state = state
+	wf.mu.Unlock()
+	if state.Active {
+		wf.logger.Warnf("WARP failed over to %s since %s, waiting for it to recover", state.Backup, state.Since.Format(time.RFC3339))
+	}
+
+	if err := wf.monitor.RegisterStatusCallback(wf.observe); err != nil {
+		return err
+	}
+	if err := wf.monitor.Start(ctx); err != nil {
+		return fmt.Errorf("failed to start WARP monitor: %w", err)
+	}
+	wf.logger.Infof("WARP failover started: to %s after %d unhealthy checks, back after %d healthy ones",
+		redactedBackup(cfg.Backup), cfg.FailAfter, cfg.RecoverAfter)
+	return nil
+}
+
+// SetReporter sets where switches are sent
+func (wf *WARPFailoverImpl) SetReporter(reporter WARPFailoverReporter) {
+	wf.mu.Lock()
+	defer wf.mu.Unlock()
+	wf.reporter = reporter
+}
+
+// State returns the failover state and the current run of healthy or unhealthy checks;
+// Enabled is false until failover has started
+func (wf *WARPFailoverImpl) State() WARPFailoverState {
+	wf.mu.Lock()
+	defer wf.mu.Unlock()
+	return wf.state
+}
+
+// observe counts a WARP monitor check and switches once a run of checks reaches its threshold.
+// The monitor runs callbacks on a worker pool, so checks older than the last one are dropped.
+func (wf *WARPFailoverImpl) observe(status WARPMonitoringStatus) {
+	wf.mu.Lock()
+	defer wf.mu.Unlock()
+
+	if !wf.config.Hysteria2.WARPEnabled || status.Timestamp.Before(wf.lastSeen) {
+		return
+	}
+	wf.lastSeen = status.Timestamp
+
+	if status.WARPConnected && status.WARPProxyWorking {
+		wf.state.HealthyChecks++
+		wf.state.UnhealthyChecks = 0
+	} else {
+		wf.state.UnhealthyChecks++
+		wf.state.HealthyChecks = 0
+	}
+
+	cfg := wf.config.WARPFailover
+	switch {
+	case !wf.state.Active && wf.state.UnhealthyChecks >= cfg.FailAfter:
+		reason := strings.Join(status.HealthIssues, ", ")
+		if reason == "" {
+			reason = "WARP unhealthy"
+		}
+		wf.switchTo(true, reason)
+	case wf.state.Active && wf.state.HealthyChecks >= cfg.RecoverAfter:
+		wf.switchTo(false, "")
+	}
+}
+
+// switchTo saves the new state and regenerates the Hysteria2 config, which reads it. A
+// failed reload is logged; the state holds and the next generated config follows it.
+func (wf *WARPFailoverImpl) switchTo(active bool, reason string) {
+	wf.state.Active = active
+	wf.state.Since = time.Now().UTC()
+	wf.state.Reason = reason
+	wf.state.Backup = redactedBackup(wf.config.WARPFailover.Backup)
+
+	if err := wf.save(); err != nil {
+		wf.logger.Errorf("Failed to save WARP failover state: %v", err)
+	}
+	if active {
+		wf.logger.Warnf("WARP unhealthy for %d checks (%s), failing over to %s", wf.state.UnhealthyChecks, reason, wf.state.Backup)
+	} else {
+		wf.logger.Infof("WARP healthy for %d checks, switching back from %s", wf.state.HealthyChecks, wf.state.Backup)
+	}
+	if err := reloadRunningHysteria(wf.config, wf.hysteriaManager); err != nil {
+		wf.logger.Errorf("Failed to reload hysteria2 after WARP failover: %v", err)
+	}
+
+	if wf.reporter != nil {
+		go wf.reporter(wf.state)
+	}
+}
+
+func (wf *WARPFailoverImpl) save() error {
+	path := wf.config.WARPFailover.StateFile
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(wf.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// loadWARPFailover reads the saved state; WARP carries its traffic when there is none or
+// failover is disabled
+func loadWARPFailover(cfg *config.Config) (WARPFailoverState, error) {
+	var state WARPFailoverState
+	if !cfg.WARPFailover.Enabled {
+		return state, nil
+	}
+	data, err := os.ReadFile(cfg.WARPFailover.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
+
+// applyWARPFailover points every outbound going through the WARP proxy at the backup,
+// keeping its name so the ACL rules naming it still apply
+func applyWARPFailover(serverConfig *hysteriaconfig.ServerConfig, cfg *config.Config) error {
+	backup, err := warpBackupOutbound(cfg.WARPFailover.Backup)
+	if err != nil {
+		return err
+	}
+	warpAddr := warpProxyAddr(cfg.Hysteria2)
+	for i, outbound := range serverConfig.Outbounds {
+		if outbound.SOCKS5 == nil || outbound.SOCKS5.Addr != warpAddr {
+			continue
+		}
+		replacement := backup
+		replacement.Name = outbound.Name
+		serverConfig.Outbounds[i] = replacement
+	}
+	return nil
+}
+
+// warpBackupOutbound reads the backup egress: "direct", or a socks5:// or http(s):// URL
+// with optional credentials
+func warpBackupOutbound(backup string) (hysteriaconfig.Outbound, error) {
+	if backup == "" || backup == PolicyOutboundDirect {
+		return hysteriaconfig.Outbound{Type: hysteriaconfig.OutboundDirect}, nil
+	}
+	u, err := url.Parse(backup)
+	if err != nil || u.Host == "" || u.Port() == "" {
+		return hysteriaconfig.Outbound{}, fmt.Errorf("%q is not direct or a proxy URL with a port", redactedBackup(backup))
+	}
+	switch u.Scheme {
+	case "socks5":
+		socks := &hysteriaconfig.SOCKS5Outbound{Addr: u.Host, Username: u.User.Username()}
+		socks.Password, _ = u.User.Password()
+		return hysteriaconfig.Outbound{Type: hysteriaconfig.OutboundSOCKS5, SOCKS5: socks}, nil
+	case "http", "https":
+		return hysteriaconfig.Outbound{Type: hysteriaconfig.OutboundHTTP, HTTP: &hysteriaconfig.HTTPOutbound{URL: backup}}, nil
+	}
+	return hysteriaconfig.Outbound{}, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+}
+
+// redactedBackup drops the credentials of a backup proxy URL
+func redactedBackup(backup string) string {
+	u, err := url.Parse(backup)
+	if err != nil || u.User == nil {
+		return backup
+	}
+	u.User = nil
+	return u.String()
+}
+
+// warpProxyAddr is the address of the WARP client's local SOCKS5 proxy
+func warpProxyAddr(hysteria config.Hysteria2Config) string {
+	port := hysteria.WARPProxyPort
+	if port == 0 {
+		port = 1080
+	}
+	return fmt.Sprintf("127.0.0.1:%d", port)
+}
@@ -0,0 +1,1079 @@
+package services
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"hysteria2_microservices/agent-service/internal/config"
+	"hysteria2_microservices/agent-service/internal/privsep"
+)
+
+const (
+	warpCommandTimeout   = 30 * time.Second
+	warpConnectTimeout   = 20 * time.Second
+	warpProxyDialTimeout = 3 * time.Second
+	defaultWARPLogLines  = 200
+	maxWARPLogLines      = 5000
+)
+
+// warpBackend runs the WARP client either on the host or in a container. The manager
+// drives both through warp-cli; the backends differ in installation, service lifecycle,
+// health and where the service logs go.
+type warpBackend interface {
+	install() error
+	uninstall() error
+	installed() bool
+	start() error
+	stop() error
+	cli(args ...string) (string, error)
+	health() error
+	logs(lines int) (string, error)
+	// mdmPath is where warp-svc reads its managed deployment (Zero Trust) settings
+	mdmPath() string
+}
+
+// WARPManagerImpl manages the Cloudflare WARP client that Hysteria2 and Xray use as a
+// SOCKS5 outbound, with the client running locally or in Docker per warp_client_type
+type WARPManagerImpl struct {
+	logger         *logrus.Logger
+	config         *config.Config
+	networkManager NetworkManager
+
+	mu            sync.Mutex
+	connectedAt   time.Time
+	monitorCancel context.CancelFunc
+}
+
+// NewWARPManager creates a new WARPManager
+func NewWARPManager(logger *logrus.Logger, cfg *config.Config) WARPManager {
+	return &WARPManagerImpl{
+		logger:         logger,
+		config:         cfg,
+		networkManager: NewNetworkManager(logger, cfg),
+	}
+}
+
+// backend is chosen per call since ConfigureWARP can switch the client type
+func (wm *WARPManagerImpl) backend() warpBackend {
+	if wm.config.Hysteria2.WARPClientType == "docker" {
+		return &dockerWARPBackend{logger: wm.logger, config: wm.config}
+	}
+	return &localWARPBackend{logger: wm.logger, networkManager: wm.networkManager, host: DetectHostOS(wm.config)}
+}
+
+// InstallWARPClient installs the client for the configured backend
+func (wm *WARPManagerImpl) InstallWARPClient() error {
+	wm.logger.Infof("Installing WARP client (%s)", wm.clientType())
+	if err := wm.backend().install(); err != nil {
+		return fmt.Errorf("failed to install WARP client: %w", err)
+	}
+	return nil
+}
+
+// UninstallWARPClient removes the client for the configured backend
+func (wm *WARPManagerImpl) UninstallWARPClient() error {
+	wm.logger.Infof("Uninstalling WARP client (%s)", wm.clientType())
+	return wm.backend().uninstall()
+}
+
+// IsWARPInstalled checks whether the configured backend is installed
+func (wm *WARPManagerImpl) IsWARPInstalled() bool {
+	return wm.backend().installed()
+}
+
+// SetupWARPSystemdService makes the WARP service start on boot: the warp-svc unit for the
+// local client, the container's restart policy for Docker
+func (wm *WARPManagerImpl) SetupWARPSystemdService() error {
+	return wm.backend().start()
+}
+
+// ConnectWARP starts the service, registers the device if needed and connects
+func (wm *WARPManagerImpl) ConnectWARP() error {
+	backend := wm.backend()
+	if _, ok := backend.(*localWARPBackend); ok && !backend.installed() {
+		return ErrWARPNotInstalled
+	}
+	if err := backend.start(); err != nil {
+		return fmt.Errorf("failed to start WARP service: %w", err)
+	}
+	if err := wm.ensureRegistered(backend); err != nil {
+		return err
+	}
+	if _, err := backend.cli("connect"); err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+
+	deadline := time.Now().Add(warpConnectTimeout)
+	for {
+		if connected, _ := wm.isConnected(backend); connected {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("WARP did not connect within %s: %w", warpConnectTimeout, ErrWARPNotConnected)
+		}
+		time.Sleep(time.Second)
+	}
+
+	wm.mu.Lock()
+	wm.connectedAt = time.Now()
+	wm.mu.Unlock()
+	wm.logger.Info("WARP connected")
+	return nil
+}
+
+// DisconnectWARP disconnects the client, leaving the service running
+func (wm *WARPManagerImpl) DisconnectWARP() error {
+	if _, err := wm.backend().cli("disconnect"); err != nil {
+		return fmt.Errorf("failed to disconnect: %w", err)
+	}
+	wm.mu.Lock()
+	wm.connectedAt = time.Time{}
+	wm.mu.Unlock()
+	wm.logger.Info("WARP disconnected")
+	return nil
+}
+
+// RestartWARP restarts the service and reconnects when auto-connect is on
+func (wm *WARPManagerImpl) RestartWARP() error {
+	backend := wm.backend()
+	if err := backend.stop(); err != nil {
+		wm.logger.Warnf("Failed to stop WARP service: %v", err)
+	}
+	if err := backend.start(); err != nil {
+		return fmt.Errorf("failed to start WARP service: %w", err)
+	}
+	if wm.config.Hysteria2.WARPAutoConnect {
+		return wm.ConnectWARP()
+	}
+	return nil
+}
+
+// Reregister replaces the consumer registration with a new one, which WARP gives a new
+// egress address, and connects again. The license key and proxy mode are applied to the new
+// registration. A Zero Trust device's registration belongs to its organization and is kept.
+func (wm *WARPManagerImpl) Reregister() error {
+	backend := wm.backend()
+	if wm.teamsEnrolled(backend) {
+		return fmt.Errorf("WARP is enrolled in Zero Trust organization %s, its registration cannot be replaced", wm.config.Hysteria2.WARPOrganization)
+	}
+
+	if err := wm.DisconnectWARP(); err != nil {
+		wm.logger.Warnf("Failed to disconnect WARP before re-registering: %v", err)
+	}
+	if _, err := backend.cli("registration", "delete"); err != nil {
+		wm.logger.Warnf("Failed to delete WARP registration: %v", err)
+	}
+	if _, err := backend.cli("registration", "new"); err != nil {
+		return fmt.Errorf("failed to register WARP client: %w", err)
+	}
+	if key := wm.config.Hysteria2.WARPLicenseKey; key != "" {
+		if _, err := backend.cli("registration", "license", key); err != nil {
+			wm.logger.Warnf("Failed to apply the license key to the new WARP registration: %v", err)
+		}
+	}
+	if err := wm.EnableProxyMode(wm.config.Hysteria2.WARPProxyPort); err != nil {
+		return err
+	}
+	if err := wm.ConnectWARP(); err != nil {
+		return err
+	}
+	wm.logger.Info("WARP re-registered")
+	return nil
+}
+
+// IsWARPConnected checks the client's connection status
+func (wm *WARPManagerImpl) IsWARPConnected() (bool, error) {
+	return wm.isConnected(wm.backend())
+}
+
+func (wm *WARPManagerImpl) isConnected(backend warpBackend) (bool, error) {
+	if injectWARPDisconnect() {
+		wm.logger.Warn("Injected fault: WARP reported disconnected")
+		return false, nil
+	}
+	output, err := backend.cli("status")
+	if err != nil {
+		return false, fmt.Errorf("failed to get WARP status: %w", err)
+	}
+	// "Status update: Connected"; a plain substring match would also accept "Disconnected"
+	return strings.HasPrefix(parseWARPFields(output)["status update"], "Connected"), nil
+}
+
+// EnableProxyMode serves WARP as a SOCKS5 proxy on 127.0.0.1:port
+func (wm *WARPManagerImpl) EnableProxyMode(port int) error {
+	if port <= 0 || port > 65535 {
+		return fmt.Errorf("invalid proxy port: %d", port)
+	}
+	wm.config.Hysteria2.WARPProxyPort = port
+
+	backend := wm.backend()
+	// The container publishes the port, so start recreates it when the port changed
+	if err := backend.start(); err != nil {
+		return fmt.Errorf("failed to start WARP service: %w", err)
+	}
+	if _, ok := backend.(*localWARPBackend); ok && wm.teamsEnrolled(backend) {
+		// The organization's managed settings lock the mode; the port lives in mdm.xml
+		if err := wm.writeMDM(backend, wm.teamsEnrollment()); err != nil {
+			return err
+		}
+		if err := wm.restartService(backend); err != nil {
+			return err
+		}
+	} else if ok {
+		if _, err := backend.cli("mode", "proxy"); err != nil {
+			return fmt.Errorf("failed to set proxy mode: %w", err)
+		}
+		if _, err := backend.cli("proxy", "port", strconv.Itoa(port)); err != nil {
+			return fmt.Errorf("failed to set proxy port: %w", err)
+		}
+	}
+
+	wm.logger.Infof("WARP proxy mode enabled on 127.0.0.1:%d (%s)", port, wm.clientType())
+	return nil
+}
+
+// DisableProxyMode stops serving the proxy. The local client is disconnected rather than
+// switched to full-tunnel mode, which would route the node's own traffic through WARP.
+func (wm *WARPManagerImpl) DisableProxyMode() error {
+	backend := wm.backend()
+	if _, ok := backend.(*dockerWARPBackend); ok {
+		return backend.stop()
+	}
+	return wm.DisconnectWARP()
+}
+
+// GetProxyPort returns the configured SOCKS5 port
+func (wm *WARPManagerImpl) GetProxyPort() (int, error) {
+	return wm.config.Hysteria2.WARPProxyPort, nil
+}
+
+// SetProxyPort changes the SOCKS5 port, applying it when WARP is enabled
+func (wm *WARPManagerImpl) SetProxyPort(port int) error {
+	if !wm.config.Hysteria2.WARPEnabled {
+		if port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid proxy port: %d", port)
+		}
+		wm.config.Hysteria2.WARPProxyPort = port
+		return nil
+	}
+	return wm.EnableProxyMode(port)
+}
+
+// ConfigureWARP stores the configuration and, when enabled, installs and starts the
+// client and applies the license key. Connecting and proxy mode are separate steps.
+func (wm *WARPManagerImpl) ConfigureWARP(cfg WARPConfig) error {
+	if cfg.ClientType == "" {
+		cfg.ClientType = wm.clientType()
+	}
+	if cfg.ProxyPort == 0 {
+		cfg.ProxyPort = wm.config.Hysteria2.WARPProxyPort
+	}
+	if err := wm.ValidateConfiguration(cfg); err != nil {
+		return err
+	}
+
+	// Stop the old backend's service when switching, so both do not hold the port
+	if cfg.ClientType != wm.clientType() && wm.backend().installed() {
+		if err := wm.backend().stop(); err != nil {
+			wm.logger.Warnf("Failed to stop %s WARP client: %v", wm.clientType(), err)
+		}
+	}
+
+	wm.config.Hysteria2.WARPEnabled = cfg.Enabled
+	wm.config.Hysteria2.WARPProxyPort = cfg.ProxyPort
+	wm.config.Hysteria2.WARPAutoConnect = cfg.AutoConnect
+	wm.config.Hysteria2.WARPNotifyOnFail = cfg.NotifyOnFail
+	wm.config.Hysteria2.WARPClientType = cfg.ClientType
+	if cfg.Organization != "" {
+		wm.config.Hysteria2.WARPOrganization = cfg.Organization
+	}
+	if cfg.TeamsClientID != "" {
+		wm.config.Hysteria2.WARPTeamsClientID = cfg.TeamsClientID
+		wm.config.Hysteria2.WARPTeamsClientSecret = cfg.TeamsClientSecret
+	}
+
+	if !cfg.Enabled {
+		wm.logger.Info("WARP disabled")
+		return nil
+	}
+
+	backend := wm.backend()
+	if !backend.installed() {
+		if err := wm.InstallWARPClient(); err != nil {
+			return err
+		}
+	}
+	if err := backend.start(); err != nil {
+		return fmt.Errorf("failed to start WARP service: %w", err)
+	}
+	// A Zero Trust device has no consumer license; enroll it when a service token is configured
+	if enrollment := wm.teamsEnrollment(); enrollment.ClientID != "" {
+		if !wm.teamsEnrolled(backend) {
+			if err := wm.EnrollTeams(enrollment); err != nil {
+				return err
+			}
+		}
+	} else if cfg.LicenseKey != "" && cfg.LicenseKey != wm.config.Hysteria2.WARPLicenseKey {
+		if err := wm.SetLicenseKey(cfg.LicenseKey); err != nil {
+			return err
+		}
+	}
+
+	wm.logger.Infof("WARP configured: client=%s proxy_port=%d", cfg.ClientType, cfg.ProxyPort)
+	return nil
+}
+
+// GetWARPConfiguration returns the current configuration; the license key and service
+// token secret are omitted
+func (wm *WARPManagerImpl) GetWARPConfiguration() (WARPConfig, error) {
+	return WARPConfig{
+		Enabled:       wm.config.Hysteria2.WARPEnabled,
+		ProxyPort:     wm.config.Hysteria2.WARPProxyPort,
+		AutoConnect:   wm.config.Hysteria2.WARPAutoConnect,
+		NotifyOnFail:  wm.config.Hysteria2.WARPNotifyOnFail,
+		ClientType:    wm.clientType(),
+		Organization:  wm.config.Hysteria2.WARPOrganization,
+		TeamsClientID: wm.config.Hysteria2.WARPTeamsClientID,
+		Mode:          "proxy",
+	}, nil
+}
+
+// ValidateConfiguration checks a configuration before it is applied
+func (wm *WARPManagerImpl) ValidateConfiguration(cfg WARPConfig) error {
+	if cfg.ProxyPort <= 0 || cfg.ProxyPort > 65535 {
+		return fmt.Errorf("invalid WARP proxy port: %d (must be 1-65535)", cfg.ProxyPort)
+	}
+	switch cfg.ClientType {
+	case "local", "docker":
+	default:
+		return fmt.Errorf("invalid WARP client type: %s (valid types: local, docker)", cfg.ClientType)
+	}
+	switch cfg.Mode {
+	case "", "proxy":
+	case "warp":
+		if cfg.ClientType == "docker" {
+			return fmt.Errorf("the docker WARP client only supports proxy mode")
+		}
+	default:
+		return fmt.Errorf("invalid WARP mode: %s (valid modes: proxy, warp)", cfg.Mode)
+	}
+	if (cfg.TeamsClientID == "") != (cfg.TeamsClientSecret == "") {
+		return fmt.Errorf("a Zero Trust service token needs both a client ID and a client secret")
+	}
+	if cfg.TeamsClientID != "" && cfg.Organization == "" && wm.config.Hysteria2.WARPOrganization == "" {
+		return fmt.Errorf("a Zero Trust service token needs the organization (team name)")
+	}
+	return nil
+}
+
+// GetWARPStatus reports installation, connection, account and health
+func (wm *WARPManagerImpl) GetWARPStatus() (WARPStatus, error) {
+	status := WARPStatus{
+		ClientType: wm.clientType(),
+		Mode:       "proxy",
+		ProxyPort:  wm.config.Hysteria2.WARPProxyPort,
+		Health:     "error",
+	}
+
+	backend := wm.backend()
+	status.Installed = backend.installed()
+	if !status.Installed {
+		status.Error = "WARP client is not installed"
+		return status, nil
+	}
+
+	if err := wm.checkHealth(backend); err != nil {
+		status.Error = err.Error()
+		return status, nil
+	}
+
+	connected, err := wm.isConnected(backend)
+	if err != nil {
+		status.Error = err.Error()
+		return status, nil
+	}
+	status.Connected = connected
+	status.Health = "good"
+	if !connected {
+		status.Health = "warning"
+	}
+
+	if output, err := backend.cli("registration", "show"); err == nil {
+		fields := parseWARPFields(output)
+		status.AccountType = fields["account type"]
+		status.Organization = fields["organization"]
+		if status.Organization != "" {
+			status.DeviceID = fields["device id"]
+			status.DevicePosture = wm.devicePosture(backend)
+		}
+	}
+
+	wm.mu.Lock()
+	if connected && !wm.connectedAt.IsZero() {
+		status.LastConnected = wm.connectedAt
+		status.Uptime = time.Since(wm.connectedAt).Truncate(time.Second)
+	}
+	wm.mu.Unlock()
+	return status, nil
+}
+
+// StartStatusMonitoring polls GetWARPStatus every interval until ctx is cancelled or
+// StopStatusMonitoring is called
+func (wm *WARPManagerImpl) StartStatusMonitoring(ctx context.Context, interval time.Duration) (<-chan WARPStatus, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("invalid monitoring interval: %s", interval)
+	}
+
+	wm.mu.Lock()
+	if wm.monitorCancel != nil {
+		wm.mu.Unlock()
+		return nil, fmt.Errorf("status monitoring is already running")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	wm.monitorCancel = cancel
+	wm.mu.Unlock()
+
+	updates := make(chan WARPStatus, 1)
+	go func() {
+		defer close(updates)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			status, err := wm.GetWARPStatus()
+			if err != nil {
+				status.Error = err.Error()
+			}
+			select {
+			case updates <- status:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return updates, nil
+}
+
+// StopStatusMonitoring stops the monitor started by StartStatusMonitoring
+func (wm *WARPManagerImpl) StopStatusMonitoring() error {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	if wm.monitorCancel != nil {
+		wm.monitorCancel()
+		wm.monitorCancel = nil
+	}
+	return nil
+}
+
+// EnableTrafficRouting redirects outgoing web traffic on the interface to the WARP proxy
+func (wm *WARPManagerImpl) EnableTrafficRouting(interfaceName string) error {
+	return wm.networkManager.RouteTrafficThroughWARP(interfaceName)
+}
+
+// DisableTrafficRouting removes the redirect rules
+func (wm *WARPManagerImpl) DisableTrafficRouting() error {
+	return wm.networkManager.DisableWarpRouting()
+}
+
+// GetRoutingRules lists the NAT rules redirecting traffic to the WARP proxy port
+func (wm *WARPManagerImpl) GetRoutingRules() ([]string, error) {
+	output, err := runWARPCommand("iptables", "-t", "nat", "-S", "OUTPUT")
+	if err != nil {
+		return nil, err
+	}
+	target := "--to-ports " + strconv.Itoa(wm.config.Hysteria2.WARPProxyPort)
+	var rules []string
+	for _, line := range strings.Split(output, "\n") {
+		if strings.Contains(line, target) {
+			rules = append(rules, strings.TrimSpace(line))
+		}
+	}
+	return rules, nil
+}
+
+// SetLicenseKey attaches a WARP+ license to the registration
+func (wm *WARPManagerImpl) SetLicenseKey(licenseKey string) error {
+	backend := wm.backend()
+	if err := wm.ensureRegistered(backend); err != nil {
+		return err
+	}
+	if _, err := backend.cli("registration", "license", licenseKey); err != nil {
+		return fmt.Errorf("failed to set license key: %w", err)
+	}
+	wm.config.Hysteria2.WARPLicenseKey = licenseKey
+	wm.logger.Info("WARP license key applied")
+	return nil
+}
+
+// SetOrganization records the Zero Trust organization the client belongs to
+func (wm *WARPManagerImpl) SetOrganization(organization string) error {
+	wm.config.Hysteria2.WARPOrganization = organization
+	return nil
+}
+
+// GetLicenseInfo reads the account type and organization of the registration
+func (wm *WARPManagerImpl) GetLicenseInfo() (WARPLicenseInfo, error) {
+	output, err := wm.backend().cli("registration", "show")
+	if err != nil {
+		return WARPLicenseInfo{Error: err.Error()}, fmt.Errorf("failed to read registration: %w", err)
+	}
+	fields := parseWARPFields(output)
+	accountType := fields["account type"]
+	return WARPLicenseInfo{
+		HasLicense:   accountType != "" && !strings.EqualFold(accountType, "Free"),
+		LicenseType:  accountType,
+		Organization: fields["organization"],
+		IsValid:      accountType != "",
+	}, nil
+}
+
+// GetWARPLogs returns the last lines logged by the WARP service: the warp-svc journal for
+// the local client, the container output for Docker
+func (wm *WARPManagerImpl) GetWARPLogs(lines int) (string, error) {
+	if lines <= 0 {
+		lines = defaultWARPLogLines
+	}
+	if lines > maxWARPLogLines {
+		lines = maxWARPLogLines
+	}
+	return wm.backend().logs(lines)
+}
+
+// CheckWARPHealth fails when the WARP service is down or, while connected, the proxy port
+// does not accept connections
+func (wm *WARPManagerImpl) CheckWARPHealth() error {
+	return wm.checkHealth(wm.backend())
+}
+
+func (wm *WARPManagerImpl) checkHealth(backend warpBackend) error {
+	if err := backend.health(); err != nil {
+		return err
+	}
+	connected, err := wm.isConnected(backend)
+	if err != nil {
+		return err
+	}
+	if !connected {
+		// Nothing listens on the proxy port until the client connects
+		return nil
+	}
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(wm.config.Hysteria2.WARPProxyPort))
+	conn, err := net.DialTimeout("tcp", addr, warpProxyDialTimeout)
+	if err != nil {
+		return fmt.Errorf("WARP proxy is not accepting connections on %s: %w", addr, err)
+	}
+	conn.Close()
+	return nil
+}
+
+// ensureRegistered creates a consumer registration unless the client already has one.
+// An enrolled client registers itself with the organization from mdm.xml.
+func (wm *WARPManagerImpl) ensureRegistered(backend warpBackend) error {
+	if _, err := backend.cli("registration", "show"); err == nil || wm.teamsEnrolled(backend) {
+		return nil
+	}
+	if _, err := backend.cli("registration", "new"); err != nil {
+		return fmt.Errorf("failed to register WARP client: %w", err)
+	}
+	return nil
+}
+
+// EnrollTeams moves the client into a Cloudflare Zero Trust organization. warp-svc reads the
+// organization and service token from mdm.xml on start and registers the device itself,
+// so the enrollment replaces any consumer registration and restarts the service.
+func (wm *WARPManagerImpl) EnrollTeams(enrollment WARPTeamsEnrollment) error {
+	if enrollment.MDMConfig != "" {
+		organization, err := parseMDMOrganization(enrollment.MDMConfig)
+		if err != nil {
+			return err
+		}
+		enrollment.Organization = organization
+	} else {
+		if enrollment.Organization == "" {
+			enrollment.Organization = wm.config.Hysteria2.WARPOrganization
+		}
+		if enrollment.Organization == "" {
+			return fmt.Errorf("Zero Trust organization (team name) is required")
+		}
+		if enrollment.ClientID == "" || enrollment.ClientSecret == "" {
+			return fmt.Errorf("a service token client ID and client secret are required")
+		}
+	}
+
+	backend := wm.backend()
+	if !backend.installed() {
+		if err := wm.InstallWARPClient(); err != nil {
+			return err
+		}
+	}
+	if err := wm.writeMDM(backend, enrollment); err != nil {
+		return err
+	}
+	// Leaves the consumer registration; errors when there is none
+	backend.cli("registration", "delete")
+	if err := wm.restartService(backend); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(warpConnectTimeout)
+	for {
+		output, err := backend.cli("registration", "show")
+		if err == nil && strings.EqualFold(parseWARPFields(output)["organization"], enrollment.Organization) {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("WARP did not enroll into %s within %s, check the service token and the device enrollment policy in the WARP logs",
+				enrollment.Organization, warpConnectTimeout)
+		}
+		time.Sleep(time.Second)
+	}
+
+	wm.config.Hysteria2.WARPOrganization = enrollment.Organization
+	wm.config.Hysteria2.WARPTeamsClientID = enrollment.ClientID
+	wm.config.Hysteria2.WARPTeamsClientSecret = enrollment.ClientSecret
+	wm.config.Hysteria2.WARPLicenseKey = ""
+	wm.logger.Infof("WARP enrolled into Zero Trust organization %s", enrollment.Organization)
+	return nil
+}
+
+// UnenrollTeams removes the managed settings and the organization's registration; the
+// client registers as a consumer device on the next connect
+func (wm *WARPManagerImpl) UnenrollTeams() error {
+	backend := wm.backend()
+	if err := os.Remove(backend.mdmPath()); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove %s: %w", backend.mdmPath(), err)
+	}
+	if _, err := backend.cli("registration", "delete"); err != nil {
+		wm.logger.Warnf("Failed to delete Zero Trust registration: %v", err)
+	}
+	if err := wm.restartService(backend); err != nil {
+		return err
+	}
+
+	wm.logger.Infof("WARP left Zero Trust organization %s", wm.config.Hysteria2.WARPOrganization)
+	wm.config.Hysteria2.WARPOrganization = ""
+	wm.config.Hysteria2.WARPTeamsClientID = ""
+	wm.config.Hysteria2.WARPTeamsClientSecret = ""
+	return nil
+}
+
+func (wm *WARPManagerImpl) teamsEnrollment() WARPTeamsEnrollment {
+	return WARPTeamsEnrollment{
+		Organization: wm.config.Hysteria2.WARPOrganization,
+		ClientID:     wm.config.Hysteria2.WARPTeamsClientID,
+		ClientSecret: wm.config.Hysteria2.WARPTeamsClientSecret,
+	}
+}
+
+func (wm *WARPManagerImpl) teamsEnrolled(backend warpBackend) bool {
+	_, err := os.Stat(backend.mdmPath())
+	return err == nil
+}
+
+// writeMDM writes the enrollment's mdm.xml, generated from the service token unless the
+// operator supplied one. The local client serves the SOCKS5 proxy itself; in the
+// container WARP tunnels and the image's own proxy listens on WARPContainerPort.
+func (wm *WARPManagerImpl) writeMDM(backend warpBackend, enrollment WARPTeamsEnrollment) error {
+	data := enrollment.MDMConfig
+	if data == "" {
+		mode, port := "proxy", wm.config.Hysteria2.WARPProxyPort
+		if _, ok := backend.(*dockerWARPBackend); ok {
+			mode, port = "warp", 0
+		}
+		data = buildMDMConfig(enrollment, mode, port, wm.config.Hysteria2.WARPAutoConnect)
+	}
+
+	path := backend.mdmPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(path), err)
+	}
+	// Holds the service token secret
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+func (wm *WARPManagerImpl) restartService(backend warpBackend) error {
+	if err := backend.stop(); err != nil {
+		wm.logger.Warnf("Failed to stop WARP service: %v", err)
+	}
+	if err := backend.start(); err != nil {
+		return fmt.Errorf("failed to start WARP service: %w", err)
+	}
+	return nil
+}
+
+// devicePosture returns the result of each posture check the organization runs on the
+// device, or nil when the client reports none
+func (wm *WARPManagerImpl) devicePosture(backend warpBackend) map[string]string {
+	output, err := backend.cli("debug", "posture")
+	if err != nil {
+		wm.logger.Debugf("Failed to read WARP device posture: %v", err)
+		return nil
+	}
+	posture := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		check, result, ok := strings.Cut(line, ":")
+		check, result = strings.TrimSpace(check), strings.TrimSpace(result)
+		if ok && check != "" && result != "" {
+			posture[check] = result
+		}
+	}
+	if len(posture) == 0 {
+		return nil
+	}
+	return posture
+}
+
+func (wm *WARPManagerImpl) clientType() string {
+	if wm.config.Hysteria2.WARPClientType == "docker" {
+		return "docker"
+	}
+	return "local"
+}
+
+// warpServiceName is the daemon of the cloudflare-warp package
+const warpServiceName = "warp-svc"
+
+// localWARPBackend drives the cloudflare-warp package and its warp-svc daemon. The package
+// ships a systemd unit only; elsewhere the daemon runs as a service the agent installs.
+type localWARPBackend struct {
+	logger         *logrus.Logger
+	networkManager NetworkManager
+	host           *HostOS
+}
+
+func (b *localWARPBackend) install() error {
+	return b.networkManager.InstallWARPClient()
+}
+
+func (b *localWARPBackend) uninstall() error {
+	return b.host.RemovePackages("cloudflare-warp")
+}
+
+func (b *localWARPBackend) installed() bool {
+	_, err := exec.LookPath("warp-cli")
+	return err == nil
+}
+
+func (b *localWARPBackend) start() error {
+	if b.host.Init != InitSystemd {
+		if err := b.host.InstallService(warpServiceName); err != nil {
+			return err
+		}
+		return b.host.StartService(warpServiceName)
+	}
+	_, err := runWARPCommand("systemctl", "enable", "--now", warpServiceName)
+	return err
+}
+
+func (b *localWARPBackend) stop() error {
+	return b.host.StopService(warpServiceName)
+}
+
+func (b *localWARPBackend) cli(args ...string) (string, error) {
+	return runWARPCommand("warp-cli", append([]string{"--accept-tos"}, args...)...)
+}
+
+func (b *localWARPBackend) health() error {
+	if !b.host.ServiceActive(warpServiceName) {
+		return fmt.Errorf("%s is not running", warpServiceName)
+	}
+	return nil
+}
+
+func (b *localWARPBackend) logs(lines int) (string, error) {
+	return b.host.ServiceLogs(warpServiceName, lines)
+}
+
+func (b *localWARPBackend) mdmPath() string {
+	return "/var/lib/cloudflare-warp/mdm.xml"
+}
+
+// dockerWARPBackend runs the WARP client in a container whose SOCKS5 proxy is published
+// on the node's loopback only, so it never becomes an open proxy. Registration state lives
+// in a mounted directory and survives the container being recreated.
+type dockerWARPBackend struct {
+	logger *logrus.Logger
+	config *config.Config
+}
+
+// install pulls the image, or loads warp/warp-image.tar from the artifact store offline
+func (b *dockerWARPBackend) install() error {
+	if _, err := exec.LookPath("docker"); err != nil {
+		return fmt.Errorf("docker is not installed")
+	}
+
+	if store := newArtifactStore(b.config); store != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), binaryDownloadTimeout)
+		defer cancel()
+
+		image, err := os.CreateTemp("", "warp-image-*.tar")
+		if err != nil {
+			return err
+		}
+		image.Close()
+		defer os.Remove(image.Name())
+
+		if err := store.download(ctx, "warp/warp-image.tar", image.Name()); err != nil {
+			return err
+		}
+		_, err = runWARPCommandTimeout(binaryDownloadTimeout, "docker", "load", "-i", image.Name())
+		return err
+	}
+
+	_, err := runWARPCommandTimeout(binaryDownloadTimeout, "docker", "pull", b.config.Hysteria2.WARPDockerImage)
+	return err
+}
+
+func (b *dockerWARPBackend) uninstall() error {
+	b.remove()
+	_, err := runWARPCommand("docker", "image", "rm", b.config.Hysteria2.WARPDockerImage)
+	return err
+}
+
+func (b *dockerWARPBackend) installed() bool {
+	_, err := runWARPCommand("docker", "image", "inspect", b.config.Hysteria2.WARPDockerImage)
+	return err == nil
+}
+
+// start runs the container, recreating it when the published port no longer matches the
+// configured proxy port since Docker cannot change port bindings in place
+func (b *dockerWARPBackend) start() error {
+	state := b.state()
+	if state != "" && b.publishedPort() != b.config.Hysteria2.WARPProxyPort {
+		b.logger.Infof("Recreating WARP container for proxy port %d", b.config.Hysteria2.WARPProxyPort)
+		b.remove()
+		state = ""
+	}
+
+	switch state {
+	case "running":
+		return nil
+	case "":
+		return b.create()
+	default:
+		_, err := runWARPCommand("docker", "start", b.name())
+		return err
+	}
+}
+
+func (b *dockerWARPBackend) create() error {
+	if err := os.MkdirAll(b.config.Hysteria2.WARPDataDir, 0700); err != nil {
+		return fmt.Errorf("failed to create WARP data directory: %w", err)
+	}
+
+	args := []string{
+		"run", "-d",
+		"--name", b.name(),
+		"--restart", "unless-stopped",
+		"--publish", fmt.Sprintf("127.0.0.1:%d:%d", b.config.Hysteria2.WARPProxyPort, b.config.Hysteria2.WARPContainerPort),
+		"--cap-add", "NET_ADMIN",
+		"--cap-add", "MKNOD",
+		"--cap-add", "AUDIT_WRITE",
+		"--sysctl", "net.ipv4.conf.all.src_valid_mark=1",
+		"--sysctl", "net.ipv6.conf.all.disable_ipv6=0",
+		"--volume", b.config.Hysteria2.WARPDataDir + ":/var/lib/cloudflare-warp",
+		"--log-opt", "max-size=10m",
+	}
+	if key := b.config.Hysteria2.WARPLicenseKey; key != "" {
+		args = append(args, "--env", "WARP_LICENSE_KEY="+key)
+	}
+	args = append(args, b.config.Hysteria2.WARPDockerImage)
+
+	if _, err := runWARPCommand("docker", args...); err != nil {
+		return fmt.Errorf("failed to create WARP container: %w", err)
+	}
+	b.logger.Infof("WARP container %s started, proxy on 127.0.0.1:%d", b.name(), b.config.Hysteria2.WARPProxyPort)
+	return nil
+}
+
+func (b *dockerWARPBackend) stop() error {
+	if b.state() == "" {
+		return nil
+	}
+	_, err := runWARPCommand("docker", "stop", b.name())
+	return err
+}
+
+func (b *dockerWARPBackend) remove() {
+	if _, err := runWARPCommand("docker", "rm", "-f", b.name()); err != nil {
+		b.logger.Debugf("Failed to remove WARP container: %v", err)
+	}
+}
+
+func (b *dockerWARPBackend) cli(args ...string) (string, error) {
+	return runWARPCommand("docker", append([]string{"exec", b.name(), "warp-cli", "--accept-tos"}, args...)...)
+}
+
+// health requires the container to be running and not reported unhealthy by an image
+// healthcheck
+func (b *dockerWARPBackend) health() error {
+	output, err := runWARPCommand("docker", "inspect", "-f",
+		"{{.State.Status}} {{if .State.Health}}{{.State.Health.Status}}{{end}}", b.name())
+	if err != nil {
+		return fmt.Errorf("WARP container %s does not exist", b.name())
+	}
+	fields := strings.Fields(output)
+	if len(fields) == 0 || fields[0] != "running" {
+		return fmt.Errorf("WARP container is %s", strings.TrimSpace(output))
+	}
+	if len(fields) > 1 && fields[1] == "unhealthy" {
+		return fmt.Errorf("WARP container is unhealthy")
+	}
+	return nil
+}
+
+func (b *dockerWARPBackend) logs(lines int) (string, error) {
+	return runWARPCommand("docker", "logs", "--timestamps", "--tail", strconv.Itoa(lines), b.name())
+}
+
+// mdmPath is inside the data directory mounted at /var/lib/cloudflare-warp
+func (b *dockerWARPBackend) mdmPath() string {
+	return filepath.Join(b.config.Hysteria2.WARPDataDir, "mdm.xml")
+}
+
+// state returns the container status, e.g. "running" or "exited", or "" if it does not exist
+func (b *dockerWARPBackend) state() string {
+	output, err := runWARPCommand("docker", "inspect", "-f", "{{.State.Status}}", b.name())
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(output)
+}
+
+func (b *dockerWARPBackend) publishedPort() int {
+	output, err := runWARPCommand("docker", "inspect", "-f",
+		"{{range $p, $b := .HostConfig.PortBindings}}{{range $b}}{{.HostPort}} {{end}}{{end}}", b.name())
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(output)
+	if len(fields) == 0 {
+		return 0
+	}
+	port, _ := strconv.Atoi(fields[0])
+	return port
+}
+
+func (b *dockerWARPBackend) name() string {
+	if b.config.Hysteria2.WARPContainerName != "" {
+		return b.config.Hysteria2.WARPContainerName
+	}
+	return "hysteria-warp"
+}
+
+// buildMDMConfig renders the managed deployment settings for a service token enrollment;
+// port is omitted when zero
+func buildMDMConfig(enrollment WARPTeamsEnrollment, mode string, port int, autoConnect bool) string {
+	var b strings.Builder
+	b.WriteString("<dict>\n")
+	entry := func(key, kind, value string) {
+		fmt.Fprintf(&b, "  <key>%s</key>\n  <%s>", key, kind)
+		xml.EscapeText(&b, []byte(value))
+		fmt.Fprintf(&b, "</%s>\n", kind)
+	}
+	entry("organization", "string", enrollment.Organization)
+	entry("auth_client_id", "string", enrollment.ClientID)
+	entry("auth_client_secret", "string", enrollment.ClientSecret)
+	entry("service_mode", "string", mode)
+	if port > 0 {
+		entry("proxy_port", "integer", strconv.Itoa(port))
+	}
+	if autoConnect {
+		entry("auto_connect", "integer", "1")
+	}
+	b.WriteString("  <key>onboarding</key>\n  <false/>\n")
+	b.WriteString("</dict>\n")
+	return b.String()
+}
+
+// parseMDMOrganization checks that an operator supplied mdm.xml is well formed and
+// returns the organization it enrolls into
+func parseMDMOrganization(data string) (string, error) {
+	decoder := xml.NewDecoder(strings.NewReader(data))
+	var key, organization string
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("invalid mdm.xml: %w", err)
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		var text string
+		switch start.Name.Local {
+		case "key":
+			if err := decoder.DecodeElement(&text, &start); err != nil {
+				return "", fmt.Errorf("invalid mdm.xml: %w", err)
+			}
+			key = strings.TrimSpace(text)
+		case "string":
+			if err := decoder.DecodeElement(&text, &start); err != nil {
+				return "", fmt.Errorf("invalid mdm.xml: %w", err)
+			}
+			if key == "organization" && organization == "" {
+				organization = strings.TrimSpace(text)
+			}
+			key = ""
+		}
+	}
+	if organization == "" {
+		return "", fmt.Errorf("mdm.xml does not set an organization")
+	}
+	return organization, nil
+}
+
+// parseWARPFields reads "Key: value" lines of warp-cli output into a map keyed by the
+// lower-cased key
+func parseWARPFields(output string) map[string]string {
+	fields := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		fields[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(value)
+	}
+	return fields
+}
+
+func runWARPCommand(name string, args ...string) (string, error) {
+	return runWARPCommandTimeout(warpCommandTimeout, name, args...)
+}
+
+// runWARPCommandTimeout runs a command and returns its combined output, with the last
+// output line in the error when it fails
+func runWARPCommandTimeout(timeout time.Duration, name string, args ...string) (string, error) {
+	if err := injectCommandFault(name, args...); err != nil {
+		return "", fmt.Errorf("%s %s: %w", name, strings.Join(args, " "), err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	output, err := privsep.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		return string(output), fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err, lastLine(string(output)))
+	}
+	return string(output), nil
+}
@@ -0,0 +1,510 @@
+package services
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"hysteria2_microservices/agent-service/internal/config"
+)
+
+// fakeDockerScript keeps one container's state in files under %[1]s and runs warp-cli
+// inside it only while it is running. The mdm file holds the path of the mounted mdm.xml.
+const fakeDockerScript = `#!/bin/sh
+D=%[1]s
+echo "docker $*" >> $D/calls.log
+case "$1" in
+pull|load) touch $D/image ;;
+image)
+	case "$2" in
+	inspect) [ -f $D/image ] || { echo "Error: No such image: $3"; exit 1; } ;;
+	rm) rm -f $D/image ;;
+	esac ;;
+run)
+	for arg; do case "$arg" in 127.0.0.1:*) echo "$arg" | cut -d: -f2 > $D/port ;; esac; done
+	echo running > $D/state ;;
+start) echo running > $D/state ;;
+stop) echo exited > $D/state; rm -f $D/warp ;;
+rm) rm -f $D/state $D/port $D/warp ;;
+inspect)
+	[ -f $D/state ] || { echo "Error: No such object: $4"; exit 1; }
+	case "$3" in
+	*PortBindings*) echo "$(cat $D/port) " ;;
+	*Health*) echo "$(cat $D/state) $(cat $D/health 2>/dev/null)" ;;
+	*) cat $D/state ;;
+	esac ;;
+logs) echo "2026-10-16T12:00:00Z warp-svc started" ;;
+exec)
+	[ "$(cat $D/state 2>/dev/null)" = running ] || { echo "Error: container is not running"; exit 1; }
+	shift 4
+	case "$*" in
+	status) echo "Status update: $(cat $D/warp 2>/dev/null || echo Disconnected)" ;;
+	connect) echo Connected > $D/warp ;;
+	disconnect) rm -f $D/warp ;;
+	"registration show")
+		# warp-svc registers with the organization in mdm.xml on start
+		if [ -f "$(cat $D/mdm 2>/dev/null)" ]; then
+			org=$(sed -n '/<key>organization<\/key>/{n;s/.*<string>\(.*\)<\/string>.*/\1/p;}' "$(cat $D/mdm)")
+			printf 'Account type: Team\nOrganization: %%s\nDevice ID: zt-device\n' "$org"
+			exit 0
+		fi
+		[ -f $D/registration ] || { echo "Error: Missing registration"; exit 1; }; cat $D/registration ;;
+	"debug posture") [ -f $D/posture ] || exit 1; cat $D/posture ;;
+	"registration new") printf 'Account type: Free\nDevice ID: consumer-device\n' > $D/registration ;;
+	"registration delete") [ -f $D/registration ] || exit 1; rm $D/registration ;;
+	"registration license "*) echo "Account type: Limited" > $D/registration ;;
+	*) exit 1 ;;
+	esac ;;
+esac
+exit 0
+`
+
+// dockerFake is a docker command first on PATH running a single simulated WARP container
+type dockerFake struct {
+	*commandFakes
+}
+
+func fakeDocker(t *testing.T) *dockerFake {
+	f := &dockerFake{newCommandFakes(t)}
+	f.install(t, "docker", fmt.Sprintf(fakeDockerScript, f.dir))
+	return f
+}
+
+// set writes one piece of the simulated container's state
+func (f *dockerFake) set(t *testing.T, name, value string) {
+	if err := os.WriteFile(filepath.Join(f.dir, name), []byte(value+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// listenProxy stands in for the SOCKS5 port the container publishes
+func listenProxy(t *testing.T) int {
+	return listenLoopback(t, nil).Addr().(*net.TCPAddr).Port
+}
+
+func newTestDockerWARP(t *testing.T) (*WARPManagerImpl, *config.Config) {
+	cfg := &config.Config{}
+	cfg.Hysteria2.WARPClientType = "docker"
+	cfg.Hysteria2.WARPDockerImage = "example/warp:latest"
+	cfg.Hysteria2.WARPContainerPort = 1080
+	cfg.Hysteria2.WARPDataDir = filepath.Join(t.TempDir(), "warp")
+	cfg.Hysteria2.WARPProxyPort = 40000
+	cfg.Network.StateFile = filepath.Join(t.TempDir(), "routing.json")
+	return NewWARPManager(testLogger(), cfg).(*WARPManagerImpl), cfg
+}
+
+func TestWARPDockerConfigureAndConnect(t *testing.T) {
+	docker := fakeDocker(t)
+	wm, cfg := newTestDockerWARP(t)
+	cfg.Hysteria2.WARPLicenseKey = "abc-123"
+	port := listenProxy(t)
+
+	err := wm.ConfigureWARP(WARPConfig{Enabled: true, ClientType: "docker", ProxyPort: port, LicenseKey: "abc-123"})
+	if err != nil {
+		t.Fatalf("ConfigureWARP: %v", err)
+	}
+	calls := docker.calls()
+	if !slices.Contains(calls, "docker pull example/warp:latest") {
+		t.Errorf("calls %v, want the image pulled", calls)
+	}
+	run := callsTo(calls, "docker run")
+	if len(run) != 1 {
+		t.Fatalf("docker run calls %v, want one container created", run)
+	}
+	for _, arg := range []string{
+		fmt.Sprintf("--publish 127.0.0.1:%d:1080", port),
+		"--restart unless-stopped",
+		"--volume " + cfg.Hysteria2.WARPDataDir + ":/var/lib/cloudflare-warp",
+		"--env WARP_LICENSE_KEY=abc-123",
+	} {
+		if !strings.Contains(run[0], arg) {
+			t.Errorf("%s, want %s", run[0], arg)
+		}
+	}
+	if info, err := os.Stat(cfg.Hysteria2.WARPDataDir); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("data directory %v, %v; want it created private", info, err)
+	}
+	// The key was passed to the container, not applied again
+	if license := callsTo(calls, "docker exec hysteria-warp warp-cli --accept-tos registration license"); len(license) != 0 {
+		t.Errorf("license applied again: %v", license)
+	}
+
+	if err := wm.ConnectWARP(); err != nil {
+		t.Fatalf("ConnectWARP: %v", err)
+	}
+	if !slices.Contains(docker.calls(), "docker exec hysteria-warp warp-cli --accept-tos registration new") {
+		t.Error("unregistered client not registered before connecting")
+	}
+
+	status, err := wm.GetWARPStatus()
+	if err != nil {
+		t.Fatalf("GetWARPStatus: %v", err)
+	}
+	if !status.Installed || !status.Connected || status.Health != "good" || status.ClientType != "docker" || status.AccountType != "Free" {
+		t.Errorf("status %+v, want a connected, healthy docker client", status)
+	}
+	if status.LastConnected.IsZero() {
+		t.Error("connection time not recorded")
+	}
+
+	if err := wm.DisableProxyMode(); err != nil {
+		t.Fatalf("DisableProxyMode: %v", err)
+	}
+	if calls := docker.calls(); calls[len(calls)-1] != "docker stop hysteria-warp" {
+		t.Errorf("last call %s, want the container stopped", calls[len(calls)-1])
+	}
+}
+
+func TestWARPDockerRecreatesContainerForNewPort(t *testing.T) {
+	docker := fakeDocker(t)
+	docker.set(t, "image", "")
+	wm, cfg := newTestDockerWARP(t)
+
+	if err := wm.SetupWARPSystemdService(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	// Starting a running container on the same port is a no-op
+	if err := wm.EnableProxyMode(40000); err != nil {
+		t.Fatalf("EnableProxyMode: %v", err)
+	}
+	if run := callsTo(docker.calls(), "docker run"); len(run) != 1 {
+		t.Errorf("docker run calls %v, want the running container kept", run)
+	}
+
+	if err := wm.EnableProxyMode(40001); err != nil {
+		t.Fatalf("EnableProxyMode: %v", err)
+	}
+	calls := docker.calls()
+	run := callsTo(calls, "docker run")
+	if len(run) != 2 || !strings.Contains(run[1], "--publish 127.0.0.1:40001:1080") {
+		t.Errorf("docker run calls %v, want the container recreated on 40001", run)
+	}
+	if !slices.Contains(calls, "docker rm -f hysteria-warp") {
+		t.Errorf("calls %v, want the old container removed", calls)
+	}
+	if cfg.Hysteria2.WARPProxyPort != 40001 {
+		t.Errorf("proxy port %d not saved", cfg.Hysteria2.WARPProxyPort)
+	}
+
+	// A stopped container on the right port is started rather than recreated
+	docker.set(t, "state", "exited")
+	if err := wm.SetupWARPSystemdService(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	if calls := docker.calls(); calls[len(calls)-1] != "docker start hysteria-warp" {
+		t.Errorf("last call %s, want the container started", calls[len(calls)-1])
+	}
+
+	if err := wm.EnableProxyMode(70000); err == nil {
+		t.Error("accepted an invalid proxy port")
+	}
+}
+
+func TestWARPDockerHealth(t *testing.T) {
+	docker := fakeDocker(t)
+	docker.set(t, "image", "")
+	wm, cfg := newTestDockerWARP(t)
+	cfg.Hysteria2.WARPProxyPort = listenProxy(t)
+
+	if err := wm.CheckWARPHealth(); err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Errorf("health without a container = %v", err)
+	}
+	if status, _ := wm.GetWARPStatus(); !status.Installed || status.Health != "error" {
+		t.Errorf("status without a container %+v, want installed with an error", status)
+	}
+
+	if err := wm.SetupWARPSystemdService(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	// Not connected yet: nothing listens on the proxy port
+	if err := wm.CheckWARPHealth(); err != nil {
+		t.Errorf("health of a disconnected running container = %v", err)
+	}
+	if status, _ := wm.GetWARPStatus(); status.Health != "warning" || status.Connected {
+		t.Errorf("status %+v, want a warning while disconnected", status)
+	}
+
+	docker.set(t, "health", "unhealthy")
+	if err := wm.CheckWARPHealth(); err == nil || !strings.Contains(err.Error(), "unhealthy") {
+		t.Errorf("health of an unhealthy container = %v", err)
+	}
+	docker.set(t, "health", "healthy")
+
+	// Connected, but the proxy port does not accept connections
+	docker.set(t, "warp", "Connected")
+	cfg.Hysteria2.WARPProxyPort = 1
+	if err := wm.CheckWARPHealth(); err == nil || !strings.Contains(err.Error(), "not accepting connections") {
+		t.Errorf("health with the proxy down = %v", err)
+	}
+
+	docker.set(t, "state", "exited")
+	if err := wm.CheckWARPHealth(); err == nil || !strings.Contains(err.Error(), "exited") {
+		t.Errorf("health of a stopped container = %v", err)
+	}
+}
+
+func TestWARPDockerLogsAndUninstall(t *testing.T) {
+	docker := fakeDocker(t)
+	docker.set(t, "image", "")
+	wm, _ := newTestDockerWARP(t)
+
+	if logs, err := wm.GetWARPLogs(0); err != nil || !strings.Contains(logs, "warp-svc started") {
+		t.Errorf("GetWARPLogs = %q, %v", logs, err)
+	}
+	wm.GetWARPLogs(1000000)
+	if logs := callsTo(docker.calls(), "docker logs"); len(logs) != 2 ||
+		logs[0] != "docker logs --timestamps --tail 200 hysteria-warp" ||
+		logs[1] != "docker logs --timestamps --tail 5000 hysteria-warp" {
+		t.Errorf("docker logs calls %v, want the default and the maximum line counts", logs)
+	}
+
+	if err := wm.UninstallWARPClient(); err != nil {
+		t.Fatalf("UninstallWARPClient: %v", err)
+	}
+	if wm.IsWARPInstalled() {
+		t.Error("image still present after uninstall")
+	}
+	if calls := docker.calls(); !slices.Contains(calls, "docker rm -f hysteria-warp") || !slices.Contains(calls, "docker image rm example/warp:latest") {
+		t.Errorf("calls %v, want the container and image removed", calls)
+	}
+}
+
+func TestWARPDockerOfflineInstall(t *testing.T) {
+	docker := fakeDocker(t)
+	wm, cfg := newTestDockerWARP(t)
+	store := useArtifactStore(t, cfg)
+
+	if err := wm.InstallWARPClient(); err == nil {
+		t.Error("installed without an image in the artifact store")
+	}
+
+	store.put("warp/warp-image.tar", []byte("image layers"))
+	if err := wm.InstallWARPClient(); err != nil {
+		t.Fatalf("InstallWARPClient: %v", err)
+	}
+	calls := docker.calls()
+	if load := callsTo(calls, "docker load"); len(load) != 1 || !strings.HasPrefix(load[0], "docker load -i ") {
+		t.Errorf("docker load calls %v, want the image loaded from the downloaded file", load)
+	}
+	if pull := callsTo(calls, "docker pull"); len(pull) != 0 {
+		t.Errorf("pulled offline: %v", pull)
+	}
+}
+
+func TestValidateWARPConfiguration(t *testing.T) {
+	wm, _ := newTestDockerWARP(t)
+	tests := []struct {
+		name  string
+		cfg   WARPConfig
+		valid bool
+	}{
+		{"docker proxy", WARPConfig{ProxyPort: 40000, ClientType: "docker", Mode: "proxy"}, true},
+		{"local tunnel", WARPConfig{ProxyPort: 40000, ClientType: "local", Mode: "warp"}, true},
+		{"docker tunnel", WARPConfig{ProxyPort: 40000, ClientType: "docker", Mode: "warp"}, false},
+		{"unknown client", WARPConfig{ProxyPort: 40000, ClientType: "podman"}, false},
+		{"unknown mode", WARPConfig{ProxyPort: 40000, ClientType: "local", Mode: "tun"}, false},
+		{"no port", WARPConfig{ClientType: "local"}, false},
+	}
+	for _, tt := range tests {
+		if err := wm.ValidateConfiguration(tt.cfg); (err == nil) != tt.valid {
+			t.Errorf("%s: ValidateConfiguration = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
+
+// newTestTeamsWARP starts a container holding a consumer registration, with the fake
+// enrolling it from the data directory's mdm.xml
+func newTestTeamsWARP(t *testing.T) (*WARPManagerImpl, *config.Config, *dockerFake) {
+	docker := fakeDocker(t)
+	docker.set(t, "image", "")
+	docker.set(t, "registration", "Account type: Limited")
+	wm, cfg := newTestDockerWARP(t)
+	docker.set(t, "mdm", filepath.Join(cfg.Hysteria2.WARPDataDir, "mdm.xml"))
+	cfg.Hysteria2.WARPLicenseKey = "abc-123"
+	if err := wm.SetupWARPSystemdService(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	return wm, cfg, docker
+}
+
+func TestWARPTeamsEnrollWithServiceToken(t *testing.T) {
+	wm, cfg, docker := newTestTeamsWARP(t)
+	docker.set(t, "posture", "disk-encryption: pass\nfirewall: fail\n")
+
+	err := wm.EnrollTeams(WARPTeamsEnrollment{Organization: "acme", ClientID: "id.access", ClientSecret: "s3cr<t&"})
+	if err != nil {
+		t.Fatalf("EnrollTeams: %v", err)
+	}
+
+	mdmPath := filepath.Join(cfg.Hysteria2.WARPDataDir, "mdm.xml")
+	info, err := os.Stat(mdmPath)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("mdm.xml %v, %v; want it readable by root only", info, err)
+	}
+	mdm, _ := os.ReadFile(mdmPath)
+	for _, want := range []string{
+		"<key>organization</key>\n  <string>acme</string>",
+		"<string>s3cr&lt;t&amp;</string>",
+		"<key>service_mode</key>\n  <string>warp</string>",
+	} {
+		if !strings.Contains(string(mdm), want) {
+			t.Errorf("mdm.xml missing %q:\n%s", want, mdm)
+		}
+	}
+	// The container's own proxy serves the port, not warp-svc
+	if strings.Contains(string(mdm), "proxy_port") {
+		t.Errorf("mdm.xml for the container sets a proxy port:\n%s", mdm)
+	}
+
+	calls := docker.calls()
+	if !slices.Contains(calls, "docker exec hysteria-warp warp-cli --accept-tos registration delete") {
+		t.Error("consumer registration not deleted")
+	}
+	if i := slices.Index(calls, "docker stop hysteria-warp"); i < 0 || !slices.Contains(calls[i:], "docker start hysteria-warp") {
+		t.Errorf("calls %v, want the container restarted to read mdm.xml", calls)
+	}
+	h := cfg.Hysteria2
+	if h.WARPOrganization != "acme" || h.WARPTeamsClientID != "id.access" || h.WARPTeamsClientSecret != "s3cr<t&" || h.WARPLicenseKey != "" {
+		t.Errorf("config %+v, want the enrollment saved and the license key dropped", h)
+	}
+
+	status, _ := wm.GetWARPStatus()
+	if status.Organization != "acme" || status.AccountType != "Team" || status.DeviceID != "zt-device" {
+		t.Errorf("status %+v, want the organization's device", status)
+	}
+	if want := map[string]string{"disk-encryption": "pass", "firewall": "fail"}; !reflect.DeepEqual(status.DevicePosture, want) {
+		t.Errorf("device posture %v, want %v", status.DevicePosture, want)
+	}
+
+	if err := wm.Reregister(); err == nil || !strings.Contains(err.Error(), "acme") {
+		t.Errorf("Reregister of an enrolled device = %v, want refused", err)
+	}
+
+	if err := wm.UnenrollTeams(); err != nil {
+		t.Fatalf("UnenrollTeams: %v", err)
+	}
+	if _, err := os.Stat(mdmPath); !os.IsNotExist(err) {
+		t.Error("mdm.xml kept after leaving the organization")
+	}
+	if h := cfg.Hysteria2; h.WARPOrganization != "" || h.WARPTeamsClientID != "" || h.WARPTeamsClientSecret != "" {
+		t.Errorf("config %+v, want the enrollment cleared", h)
+	}
+	if status, _ := wm.GetWARPStatus(); status.Organization != "" || status.DevicePosture != nil {
+		t.Errorf("status %+v after leaving the organization", status)
+	}
+}
+
+func TestWARPTeamsEnrollWithMDMConfig(t *testing.T) {
+	wm, cfg, _ := newTestTeamsWARP(t)
+	mdmPath := filepath.Join(cfg.Hysteria2.WARPDataDir, "mdm.xml")
+
+	err := wm.EnrollTeams(WARPTeamsEnrollment{MDMConfig: "<dict>\n  <key>service_mode</key>\n  <string>warp</string>\n</dict>\n"})
+	if err == nil || !strings.Contains(err.Error(), "does not set an organization") {
+		t.Errorf("EnrollTeams with mdm.xml lacking an organization = %v", err)
+	}
+	if err := wm.EnrollTeams(WARPTeamsEnrollment{MDMConfig: "<dict><key>organization</key>"}); err == nil {
+		t.Error("accepted malformed mdm.xml")
+	}
+	if _, err := os.Stat(mdmPath); !os.IsNotExist(err) {
+		t.Error("rejected mdm.xml written")
+	}
+
+	supplied := "<dict>\n  <key>organization</key>\n  <string>beta</string>\n  <key>auth_client_id</key>\n  <string>x</string>\n</dict>\n"
+	if err := wm.EnrollTeams(WARPTeamsEnrollment{Organization: "ignored", MDMConfig: supplied}); err != nil {
+		t.Fatalf("EnrollTeams: %v", err)
+	}
+	if data, _ := os.ReadFile(mdmPath); string(data) != supplied {
+		t.Errorf("mdm.xml:\n%s\nwant the operator's file as given", data)
+	}
+	if cfg.Hysteria2.WARPOrganization != "beta" {
+		t.Errorf("organization %q, want the one mdm.xml enrolls into", cfg.Hysteria2.WARPOrganization)
+	}
+
+	if err := wm.EnrollTeams(WARPTeamsEnrollment{Organization: "acme", ClientID: "id.access"}); err == nil {
+		t.Error("enrolled without a client secret")
+	}
+}
+
+func TestWARPConfigureEnrollsWithServiceToken(t *testing.T) {
+	wm, cfg, docker := newTestTeamsWARP(t)
+
+	err := wm.ConfigureWARP(WARPConfig{
+		Enabled:           true,
+		ClientType:        "docker",
+		ProxyPort:         40000,
+		LicenseKey:        "def-456",
+		Organization:      "acme",
+		TeamsClientID:     "id.access",
+		TeamsClientSecret: "secret",
+	})
+	if err != nil {
+		t.Fatalf("ConfigureWARP: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.Hysteria2.WARPDataDir, "mdm.xml")); err != nil {
+		t.Errorf("not enrolled: %v", err)
+	}
+	// A Zero Trust device has no consumer license to apply
+	if license := callsTo(docker.calls(), "docker exec hysteria-warp warp-cli --accept-tos registration license"); len(license) != 0 {
+		t.Errorf("license applied to an enrolled device: %v", license)
+	}
+
+	if got, _ := wm.GetWARPConfiguration(); got.Organization != "acme" || got.TeamsClientID != "id.access" || got.TeamsClientSecret != "" {
+		t.Errorf("configuration %+v, want the organization and client ID without the secret", got)
+	}
+}
+
+func TestValidateWARPTeamsConfiguration(t *testing.T) {
+	wm, cfg := newTestDockerWARP(t)
+	base := WARPConfig{ProxyPort: 40000, ClientType: "docker"}
+
+	partial := base
+	partial.Organization, partial.TeamsClientID = "acme", "id.access"
+	if err := wm.ValidateConfiguration(partial); err == nil {
+		t.Error("accepted a client ID without a secret")
+	}
+
+	token := base
+	token.TeamsClientID, token.TeamsClientSecret = "id.access", "secret"
+	if err := wm.ValidateConfiguration(token); err == nil {
+		t.Error("accepted a service token without an organization")
+	}
+	cfg.Hysteria2.WARPOrganization = "acme"
+	if err := wm.ValidateConfiguration(token); err != nil {
+		t.Errorf("service token for the configured organization: %v", err)
+	}
+}
+
+func TestBuildMDMConfig(t *testing.T) {
+	enrollment := WARPTeamsEnrollment{Organization: "Acme & Co", ClientID: "id.access", ClientSecret: "secret"}
+
+	local := buildMDMConfig(enrollment, "proxy", 40000, true)
+	for _, want := range []string{
+		"<key>service_mode</key>\n  <string>proxy</string>",
+		"<key>proxy_port</key>\n  <integer>40000</integer>",
+		"<key>auto_connect</key>\n  <integer>1</integer>",
+		"<key>onboarding</key>\n  <false/>",
+	} {
+		if !strings.Contains(local, want) {
+			t.Errorf("mdm.xml missing %q:\n%s", want, local)
+		}
+	}
+	if organization, err := parseMDMOrganization(local); err != nil || organization != "Acme & Co" {
+		t.Errorf("parseMDMOrganization = %q, %v", organization, err)
+	}
+
+	container := buildMDMConfig(enrollment, "warp", 0, false)
+	if strings.Contains(container, "proxy_port") || strings.Contains(container, "auto_connect") {
+		t.Errorf("mdm.xml without a port or auto-connect:\n%s", container)
+	}
+
+	// The organization is the string following its key, not the first string
+	mdm := "<dict><key>auth_client_id</key><string>id</string><key>organization</key><string> beta </string></dict>"
+	if organization, _ := parseMDMOrganization(mdm); organization != "beta" {
+		t.Errorf("organization %q, want beta", organization)
+	}
+}
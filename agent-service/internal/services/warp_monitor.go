@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"net/url"
 	"sync"
 	"time"
 
@@ -40,6 +41,7 @@ type WARPMonitoringStatus struct {
 	WARPOrganization   string    `json:"warp_organization"`
 	WARPAccountType    string    `json:"warp_account_type"`
 	WARPServerLocation string    `json:"warp_server_location"`
+	WARPProxyWorking   bool      `json:"warp_proxy_working"` // a request through the WARP proxy succeeded
 
 	// Network metrics
 	BytesSent       int64 `json:"bytes_sent"`
@@ -394,6 +396,7 @@ func (wm *WARPMonitorImpl) collectStatus() {
 
 		if status.WARPConnected {
 			status.ConnectionUptime = time.Since(wm.lastConnected)
+			status.WARPProxyWorking = wm.checkProxyFunctionality()
 		}
 		status.LastConnected = wm.lastConnected
 		status.DisconnectionCount = wm.disconnections
@@ -476,9 +479,14 @@ func (wm *WARPMonitorImpl) worker() {
 }
 
 func (wm *WARPMonitorImpl) checkProxyFunctionality() bool {
-	// Simple proxy check - try to make HTTP request through WARP
+	// Make an HTTP request through the WARP SOCKS5 proxy
+	proxyURL, err := url.Parse("socks5://" + warpProxyAddr(wm.config.Hysteria2))
+	if err != nil {
+		return false
+	}
 	client := &http.Client{
-		Timeout: 10 * time.Second,
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), DisableKeepAlives: true},
+		Timeout:   10 * time.Second,
 	}
 
 	resp, err := client.Get("https://1.1.1.1")
@@ -574,6 +582,8 @@ func (wm *WARPMonitorImpl) identifyHealthIssues(status WARPMonitoringStatus) []s
 
 	if !status.WARPConnected {
 		issues = append(issues, "WARP not connected")
+	} else if !status.WARPProxyWorking {
+		issues = append(issues, "WARP proxy not working")
 	}
 
 	if status.LatencyMs > 500 {
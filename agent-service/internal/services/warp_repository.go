@@ -0,0 +1,24 @@
+package services
+
+import (
+	"fmt"
+
+	"hysteria2_microservices/agent-service/internal/privsep"
+)
+
+// addWARPRepository configures Cloudflare's package repository for the host's package
+// manager. The privilege helper renders the repository files and downloads the apt key
+// itself; fingerprint, when set, pins that key.
+func addWARPRepository(host *HostOS, fingerprint string) error {
+	switch host.PackageManager {
+	case PackageManagerApt:
+		params := []string{host.Codename}
+		if fingerprint != "" {
+			params = append(params, fingerprint)
+		}
+		return privsep.AddRepository(privsep.RepositoryApt, params...)
+	case PackageManagerDnf, PackageManagerYum:
+		return privsep.AddRepository(privsep.RepositoryRpm)
+	}
+	return fmt.Errorf("Cloudflare publishes no WARP client packages for %s", host.describe())
+}
@@ -0,0 +1,269 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"hysteria2_microservices/agent-service/internal/config"
+)
+
+// WARP rotation modes
+const (
+	WARPRotationReconnect  = "reconnect"  // disconnect and connect the client again
+	WARPRotationReregister = "reregister" // replace the registration, which gets a new address
+)
+
+// Reasons for a WARP rotation
+const (
+	WARPRotationScheduled = "scheduled"
+	WARPRotationListed    = "blocklisted"
+)
+
+// warpRotationTick is how often the rotator looks whether a rotation is due
+const warpRotationTick = time.Minute
+
+// WARPRotationState is the last rotation of WARP
+type WARPRotationState struct {
+	Enabled    bool      `json:"-"`
+	LastAt     time.Time `json:"last_at,omitempty"`
+	LastReason string    `json:"last_reason,omitempty"`
+	LastMode   string    `json:"last_mode,omitempty"`  // the mode used, reconnect when re-registering was impossible
+	LastError  string    `json:"last_error,omitempty"` // empty when the rotation succeeded
+	PreviousIP string    `json:"previous_ip,omitempty"`
+	Drained    float64   `json:"drained_seconds,omitempty"`
+}
+
+// WARPRotationReporter is called with the state after every rotation
+type WARPRotationReporter func(state WARPRotationState)
+
+// WARPRotatorImpl rotates WARP's egress on the warp_rotation schedule and when the egress
+// check finds the WARP address on a blocklist, at most once per min_interval. The time of the
+// last rotation is saved, so the schedule carries over agent restarts.
+type WARPRotatorImpl struct {
+	logger          *logrus.Logger
+	config          *config.Config
+	warpManager     WARPManager
+	hysteriaManager HysteriaManager
+	egressMonitor   EgressMonitor
+
+	rotating sync.Mutex // held for the duration of a rotation
+
+	mu       sync.Mutex
+	state    WARPRotationState
+	started  time.Time // the schedule counts from here until the first rotation
+	reporter WARPRotationReporter
+	cancel   context.CancelFunc
+}
+
+// NewWARPRotator creates a new WARPRotator
+func NewWARPRotator(logger *logrus.Logger, cfg *config.Config, warpManager WARPManager, hysteriaManager HysteriaManager, egressMonitor EgressMonitor) WARPRotator {
+	return &WARPRotatorImpl{
+		logger:          logger,
+		config:          cfg,
+		warpManager:     warpManager,
+		hysteriaManager: hysteriaManager,
+		egressMonitor:   egressMonitor,
+	}
+}
+
+// Start restores the last rotation and looks every minute whether the next one is due
+func (wr *WARPRotatorImpl) Start(ctx context.Context) error {
+	cfg := wr.config.WARPRotation
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.Mode != WARPRotationReconnect && cfg.Mode != WARPRotationReregister {
+		return fmt.Errorf("invalid warp_rotation.mode %q", cfg.Mode)
+	}
+	if cfg.Interval < 0 || cfg.MinInterval < 0 {
+		return fmt.Errorf("invalid warp_rotation intervals: interval %d, min_interval %d", cfg.Interval, cfg.MinInterval)
+	}
+
+	state, err := wr.load()
+	if err != nil {
+		return fmt.Errorf("failed to read WARP rotation state: %w", err)
+	}
+	state.Enabled = true
+
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	if wr.cancel != nil {
+		return fmt.Errorf("WARP rotation is already running")
+	}
+	wr.state = state
+	wr.started = time.Now()
+
+	rotateCtx, cancel := context.WithCancel(ctx)
+	wr.cancel = cancel
+	go func() {
+		ticker := time.NewTicker(warpRotationTick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-rotateCtx.Done():
+				return
+			case <-ticker.C:
+				wr.check(rotateCtx)
+			}
+		}
+	}()
+
+	wr.logger.Infof("WARP rotation started: %s every %ds, on blocklist listings %t", cfg.Mode, cfg.Interval, cfg.OnBlocklist)
+	return nil
+}
+
+// SetReporter sets where rotations are sent
+func (wr *WARPRotatorImpl) SetReporter(reporter WARPRotationReporter) {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	wr.reporter = reporter
+}
+
+// State returns the last rotation; Enabled is false until rotation has started
+func (wr *WARPRotatorImpl) State() WARPRotationState {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	return wr.state
+}
+
+// check rotates when the schedule says so or the last egress check after the previous
+// rotation found the WARP address listed
+func (wr *WARPRotatorImpl) check(ctx context.Context) {
+	if !wr.config.Hysteria2.WARPEnabled {
+		return
+	}
+	cfg := wr.config.WARPRotation
+	wr.mu.Lock()
+	last, scheduledFrom := wr.state.LastAt, wr.state.LastAt
+	if scheduledFrom.IsZero() {
+		scheduledFrom = wr.started
+	}
+	wr.mu.Unlock()
+
+	now := time.Now()
+	if now.Before(last.Add(time.Duration(cfg.MinInterval) * time.Second)) {
+		return
+	}
+
+	reason := ""
+	if cfg.Interval > 0 && !now.Before(scheduledFrom.Add(time.Duration(cfg.Interval)*time.Second)) {
+		reason = WARPRotationScheduled
+	}
+	if cfg.OnBlocklist {
+		if report := wr.egressMonitor.LastReport(); report != nil && report.CheckedAt.After(last) {
+			if path := report.Path(EgressPathWARP); path != nil && path.Health == EgressHealthDirty {
+				reason = WARPRotationListed
+			}
+		}
+	}
+	if reason == "" {
+		return
+	}
+	if err := wr.Rotate(ctx, reason); err != nil {
+		wr.logger.Errorf("WARP rotation failed: %v", err)
+	}
+}
+
+// Rotate reconnects or re-registers WARP now, on a drained Hysteria2 when warp_rotation.drain
+// is set, then checks the new egress address
+func (wr *WARPRotatorImpl) Rotate(ctx context.Context, reason string) error {
+	wr.rotating.Lock()
+	defer wr.rotating.Unlock()
+
+	cfg := wr.config.WARPRotation
+	state := WARPRotationState{Enabled: true, LastAt: time.Now().UTC(), LastReason: reason, LastMode: cfg.Mode}
+	if report := wr.egressMonitor.LastReport(); report != nil {
+		if path := report.Path(EgressPathWARP); path != nil {
+			state.PreviousIP = path.IP
+		}
+	}
+	wr.logger.Infof("Rotating WARP (%s, %s)", state.LastMode, reason)
+
+	rotate := func() error {
+		if state.LastMode == WARPRotationReregister {
+			err := wr.warpManager.Reregister()
+			if err == nil {
+				return nil
+			}
+			if connected, _ := wr.warpManager.IsWARPConnected(); !connected {
+				return err
+			}
+			// A Zero Trust device keeps its registration; a reconnect still may change the address
+			wr.logger.Warnf("Reconnecting WARP instead of re-registering: %v", err)
+			state.LastMode = WARPRotationReconnect
+		}
+		if err := wr.warpManager.DisconnectWARP(); err != nil {
+			wr.logger.Warnf("Failed to disconnect WARP: %v", err)
+		}
+		return wr.warpManager.ConnectWARP()
+	}
+
+	start := time.Now()
+	var err error
+	if cfg.Drain {
+		err = wr.hysteriaManager.WithDrained(rotate)
+	} else {
+		err = rotate()
+	}
+	state.Drained = time.Since(start).Round(time.Second).Seconds()
+	if err != nil {
+		state.LastError = err.Error()
+	}
+
+	wr.mu.Lock()
+	wr.state = state
+	reporter := wr.reporter
+	wr.mu.Unlock()
+	if saveErr := wr.save(state); saveErr != nil {
+		wr.logger.Errorf("Failed to save WARP rotation state: %v", saveErr)
+	}
+	if reporter != nil {
+		reporter(state)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Learn the new address and whether it is listed as well
+	if wr.config.Egress.Enabled {
+		go func() {
+			if _, err := wr.egressMonitor.Check(ctx); err != nil && ctx.Err() == nil {
+				wr.logger.Warnf("Egress check after WARP rotation failed: %v", err)
+			}
+		}()
+	}
+	wr.logger.Infof("WARP rotated (%s, %s)", state.LastMode, reason)
+	return nil
+}
+
+func (wr *WARPRotatorImpl) load() (WARPRotationState, error) {
+	var state WARPRotationState
+	data, err := os.ReadFile(wr.config.WARPRotation.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
+
+func (wr *WARPRotatorImpl) save(state WARPRotationState) error {
+	path := wr.config.WARPRotation.StateFile
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,922 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// Xray protocols with server-side inbound and user management
+const (
+	XrayProtocolVLESS           = "vless"
+	XrayProtocolVLESSReality    = "vless-reality"
+	XrayProtocolTrojan          = "trojan"
+	XrayProtocolShadowsocks2022 = "shadowsocks-2022"
+
+	defaultShadowsocks2022Method = "2022-blake3-aes-128-gcm"
+)
+
+// shadowsocks2022KeySizes maps each SIP022 method to the length of its base64 pre-shared key
+var shadowsocks2022KeySizes = map[string]int{
+	"2022-blake3-aes-128-gcm":       16,
+	"2022-blake3-aes-256-gcm":       32,
+	"2022-blake3-chacha20-poly1305": 32,
+}
+
+// trojanALPN and trojanCipherSuites match the TLS settings the API service generates
+// for trojan, so clients presenting a browser uTLS fingerprint negotiate as expected
+var trojanALPN = []string{"h2", "http/1.1"}
+
+const trojanCipherSuites = "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256:TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:" +
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384:TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:" +
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256:TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256"
+
+// XrayUser is a client account on an Xray inbound. Email identifies the user
+// for removal and statistics; ID is used by VLESS, Password by trojan and Shadowsocks-2022.
+type XrayUser struct {
+	Email    string
+	ID       string
+	Password string
+	Flow     string
+}
+
+// GenerateShadowsocks2022Key returns a random base64 key of the size required by method
+func GenerateShadowsocks2022Key(method string) (string, error) {
+	size, ok := shadowsocks2022KeySizes[method]
+	if !ok {
+		return "", fmt.Errorf("unsupported Shadowsocks-2022 method: %s", method)
+	}
+
+	key := make([]byte, size)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("failed to generate key: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// validateShadowsocks2022Key checks that key is base64 of the length required by method
+func validateShadowsocks2022Key(method, key string) error {
+	size, ok := shadowsocks2022KeySizes[method]
+	if !ok {
+		return fmt.Errorf("unsupported Shadowsocks-2022 method: %s", method)
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return fmt.Errorf("key must be base64: %w", err)
+	}
+	if len(decoded) != size {
+		return fmt.Errorf("%s requires a %d-byte key, got %d bytes", method, size, len(decoded))
+	}
+	return nil
+}
+
+// ConfigureTrojan sets the trojan server password, generating one if empty
+func (xm *XrayManagerImpl) ConfigureTrojan(password string) error {
+	xm.logger.Info("Configuring trojan")
+
+	if password == "" {
+		key := make([]byte, 18)
+		if _, err := rand.Read(key); err != nil {
+			return fmt.Errorf("failed to generate trojan password: %w", err)
+		}
+		password = base64.RawURLEncoding.EncodeToString(key)
+		xm.logger.Info("Generated new trojan password")
+	} else if len(password) < 8 {
+		return fmt.Errorf("trojan password must be at least 8 characters")
+	}
+
+	xm.config.Xray.TrojanPassword = password
+
+	xm.logger.Info("Trojan configured successfully")
+	return nil
+}
+
+// ConfigureShadowsocks2022 sets the Shadowsocks-2022 method and server key, generating the key if empty
+func (xm *XrayManagerImpl) ConfigureShadowsocks2022(method, password string) error {
+	if method == "" {
+		method = defaultShadowsocks2022Method
+	}
+	xm.logger.Infof("Configuring Shadowsocks-2022 with method: %s", method)
+
+	if password == "" {
+		key, err := GenerateShadowsocks2022Key(method)
+		if err != nil {
+			return err
+		}
+		password = key
+		xm.logger.Info("Generated new Shadowsocks-2022 server key")
+	} else if err := validateShadowsocks2022Key(method, password); err != nil {
+		return fmt.Errorf("invalid Shadowsocks-2022 key: %w", err)
+	}
+
+	xm.config.Xray.ShadowsocksMethod = method
+	xm.config.Xray.ShadowsocksPassword = password
+
+	xm.logger.Info("Shadowsocks-2022 configured successfully")
+	return nil
+}
+
+// ConfigPath returns the server config file managed by AddInbound and AddUser
+func (xm *XrayManagerImpl) ConfigPath() string {
+	return xm.config.Xray.ConfigPath
+}
+
+// CurrentConfig returns the saved server config with its secrets decrypted, or an empty
+// string when Xray has not been configured yet
+func (xm *XrayManagerImpl) CurrentConfig() (string, error) {
+	return readCurrentConfig(xm.config, xm.config.Xray.ConfigPath)
+}
+
+// SaveConfig replaces the server config, sealing its secrets when generated configs are encrypted
+func (xm *XrayManagerImpl) SaveConfig(content string) error {
+	return writeGeneratedConfig(xm.config, xm.config.Xray.ConfigPath, []byte(content))
+}
+
+// HasInbound reports whether the server config has an inbound for protocol
+func (xm *XrayManagerImpl) HasInbound(protocol string) (bool, error) {
+	xm.mu.Lock()
+	defer xm.mu.Unlock()
+
+	config, err := xm.loadServerConfig()
+	if err != nil {
+		return false, err
+	}
+
+	inbounds, _ := config["inbounds"].([]interface{})
+	return findInbound(inbounds, protocol) >= 0, nil
+}
+
+// AddInbound adds the inbound for protocol to the server config, creating the config if needed
+func (xm *XrayManagerImpl) AddInbound(protocol string) error {
+	xm.logger.Infof("Adding Xray inbound for protocol: %s", protocol)
+
+	inbound, err := xm.buildInbound(protocol)
+	if err != nil {
+		return err
+	}
+
+	xm.mu.Lock()
+	defer xm.mu.Unlock()
+
+	config, err := xm.loadServerConfig()
+	if err != nil {
+		return err
+	}
+
+	inbounds, _ := config["inbounds"].([]interface{})
+	if index := findInbound(inbounds, protocol); index >= 0 {
+		return fmt.Errorf("inbound for %s already exists", protocol)
+	}
+	for _, existing := range inbounds {
+		if existingMap, ok := existing.(map[string]interface{}); ok && portOf(existingMap) == inbound["port"] {
+			return fmt.Errorf("port %v is already used by another inbound", inbound["port"])
+		}
+	}
+
+	config["inbounds"] = append(inbounds, inbound)
+	if err := xm.saveServerConfig(config); err != nil {
+		return err
+	}
+
+	xm.logger.Infof("Xray inbound for %s added on port %v", protocol, inbound["port"])
+	return nil
+}
+
+// RemoveInbound removes the inbound for protocol from the server config
+func (xm *XrayManagerImpl) RemoveInbound(protocol string) error {
+	xm.logger.Infof("Removing Xray inbound for protocol: %s", protocol)
+
+	xm.mu.Lock()
+	defer xm.mu.Unlock()
+
+	config, err := xm.loadServerConfig()
+	if err != nil {
+		return err
+	}
+
+	inbounds, _ := config["inbounds"].([]interface{})
+	index := findInbound(inbounds, protocol)
+	if index < 0 {
+		return fmt.Errorf("no inbound configured for %s", protocol)
+	}
+
+	config["inbounds"] = append(inbounds[:index], inbounds[index+1:]...)
+	if err := xm.saveServerConfig(config); err != nil {
+		return err
+	}
+
+	xm.logger.Infof("Xray inbound for %s removed", protocol)
+	return nil
+}
+
+// AddUser adds a client to the inbound for protocol and returns it with any generated
+// credentials filled in. Xray must be restarted to pick up the change.
+func (xm *XrayManagerImpl) AddUser(protocol string, user XrayUser) (XrayUser, error) {
+	xm.logger.Infof("Adding %s user: %s", protocol, user.Email)
+
+	if user.Email == "" {
+		return user, fmt.Errorf("user email is required")
+	}
+
+	xm.mu.Lock()
+	defer xm.mu.Unlock()
+
+	config, err := xm.loadServerConfig()
+	if err != nil {
+		return user, err
+	}
+
+	settings, err := inboundSettings(config, protocol)
+	if err != nil {
+		return user, err
+	}
+
+	clients, _ := settings["clients"].([]interface{})
+	for _, existing := range clients {
+		if existingMap, ok := existing.(map[string]interface{}); ok && existingMap["email"] == user.Email {
+			return user, fmt.Errorf("user %s already exists on %s inbound", user.Email, protocol)
+		}
+	}
+
+	user, err = prepareUser(protocol, settings, user)
+	if err != nil {
+		return user, err
+	}
+	settings["clients"] = append(clients, clientEntry(protocol, user))
+
+	if err := xm.saveServerConfig(config); err != nil {
+		return user, err
+	}
+
+	xm.logger.Infof("User %s added to %s inbound", user.Email, protocol)
+	return user, nil
+}
+
+// RemoveUser removes the client with the given email from the inbound for protocol
+func (xm *XrayManagerImpl) RemoveUser(protocol, email string) error {
+	xm.logger.Infof("Removing %s user: %s", protocol, email)
+
+	xm.mu.Lock()
+	defer xm.mu.Unlock()
+
+	config, err := xm.loadServerConfig()
+	if err != nil {
+		return err
+	}
+
+	settings, err := inboundSettings(config, protocol)
+	if err != nil {
+		return err
+	}
+
+	clients, _ := settings["clients"].([]interface{})
+	remaining := make([]interface{}, 0, len(clients))
+	for _, existing := range clients {
+		if existingMap, ok := existing.(map[string]interface{}); ok && existingMap["email"] == email {
+			continue
+		}
+		remaining = append(remaining, existing)
+	}
+	if len(remaining) == len(clients) {
+		return fmt.Errorf("user %s not found on %s inbound", email, protocol)
+	}
+	settings["clients"] = remaining
+
+	if err := xm.saveServerConfig(config); err != nil {
+		return err
+	}
+
+	xm.logger.Infof("User %s removed from %s inbound", email, protocol)
+	return nil
+}
+
+// buildInbound returns a standalone inbound for protocol
+func (xm *XrayManagerImpl) buildInbound(protocol string) (map[string]interface{}, error) {
+	var config map[string]interface{}
+	switch protocol {
+	case XrayProtocolVLESS:
+		config = xm.generateVLESSConfig()
+	case XrayProtocolVLESSReality:
+		config = xm.generateVLESSRealityConfig()
+	case XrayProtocolTrojan:
+		inbound, err := xm.trojanInbound()
+		if err == nil {
+			xm.bindInbound(inbound)
+		}
+		return inbound, err
+	case XrayProtocolShadowsocks2022:
+		return xm.shadowsocks2022Inbound()
+	default:
+		return nil, fmt.Errorf("unsupported protocol: %s", protocol)
+	}
+
+	inbound := config["inbounds"].([]map[string]interface{})[0]
+	inbound["tag"] = inboundTag(protocol)
+	xm.bindInbound(inbound)
+	return inbound, nil
+}
+
+// generateTrojanConfig generates a trojan over TLS configuration
+func (xm *XrayManagerImpl) generateTrojanConfig() (map[string]interface{}, error) {
+	inbound, err := xm.trojanInbound()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"inbounds":  []map[string]interface{}{inbound},
+		"outbounds": defaultOutbounds(),
+	}, nil
+}
+
+// generateShadowsocks2022Config generates a Shadowsocks-2022 configuration
+func (xm *XrayManagerImpl) generateShadowsocks2022Config() (map[string]interface{}, error) {
+	inbound, err := xm.shadowsocks2022Inbound()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"inbounds":  []map[string]interface{}{inbound},
+		"outbounds": defaultOutbounds(),
+	}, nil
+}
+
+func (xm *XrayManagerImpl) trojanInbound() (map[string]interface{}, error) {
+	if xm.config.Xray.TrojanPassword == "" {
+		if err := xm.ConfigureTrojan(""); err != nil {
+			return nil, err
+		}
+	}
+
+	return map[string]interface{}{
+		"tag":      inboundTag(XrayProtocolTrojan),
+		"port":     xm.config.Xray.TrojanPort,
+		"protocol": "trojan",
+		"settings": map[string]interface{}{
+			"clients": []map[string]interface{}{
+				{
+					"password": xm.config.Xray.TrojanPassword,
+					"email":    "default",
+				},
+			},
+		},
+		"streamSettings": map[string]interface{}{
+			"network":  "tcp",
+			"security": "tls",
+			"tlsSettings": map[string]interface{}{
+				"alpn":         trojanALPN,
+				"minVersion":   "1.2",
+				"cipherSuites": trojanCipherSuites,
+				"certificates": []map[string]interface{}{
+					{
+						"certificateFile": xm.config.Xray.CertPath,
+						"keyFile":         xm.config.Xray.KeyPath,
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+func (xm *XrayManagerImpl) shadowsocks2022Inbound() (map[string]interface{}, error) {
+	if xm.config.Xray.ShadowsocksPassword == "" || xm.config.Xray.ShadowsocksMethod == "" {
+		if err := xm.ConfigureShadowsocks2022(xm.config.Xray.ShadowsocksMethod, xm.config.Xray.ShadowsocksPassword); err != nil {
+			return nil, err
+		}
+	}
+
+	// Without clients the inbound runs single-user with the server key; AddUser switches
+	// it to multi-user, where clients authenticate with "<server key>:<user key>"
+	return map[string]interface{}{
+		"tag":      inboundTag(XrayProtocolShadowsocks2022),
+		"port":     xm.config.Xray.ShadowsocksPort,
+		"protocol": "shadowsocks",
+		"settings": map[string]interface{}{
+			"method":   xm.config.Xray.ShadowsocksMethod,
+			"password": xm.config.Xray.ShadowsocksPassword,
+			"network":  "tcp,udp",
+		},
+	}, nil
+}
+
+// validateTrojanConfig validates trojan configuration
+func (xm *XrayManagerImpl) validateTrojanConfig(config map[string]interface{}) error {
+	inbounds, ok := config["inbounds"].([]interface{})
+	if !ok {
+		return fmt.Errorf("inbounds not found or invalid")
+	}
+
+	found := false
+	for _, inbound := range inbounds {
+		inboundMap, ok := inbound.(map[string]interface{})
+		if !ok || inboundMap["protocol"] != "trojan" {
+			continue
+		}
+		found = true
+
+		settings, ok := inboundMap["settings"].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("trojan settings not found")
+		}
+
+		clients, ok := settings["clients"].([]interface{})
+		if !ok || len(clients) == 0 {
+			return fmt.Errorf("no trojan clients configured")
+		}
+		for _, client := range clients {
+			clientMap, ok := client.(map[string]interface{})
+			if !ok || clientMap["password"] == nil || clientMap["password"] == "" {
+				return fmt.Errorf("trojan client without password")
+			}
+		}
+
+		streamSettings, ok := inboundMap["streamSettings"].(map[string]interface{})
+		if !ok || streamSettings["security"] != "tls" {
+			return fmt.Errorf("trojan inbound requires TLS")
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("no trojan inbound configured")
+	}
+	return nil
+}
+
+// validateShadowsocks2022Config validates Shadowsocks-2022 configuration
+func (xm *XrayManagerImpl) validateShadowsocks2022Config(config map[string]interface{}) error {
+	inbounds, ok := config["inbounds"].([]interface{})
+	if !ok {
+		return fmt.Errorf("inbounds not found or invalid")
+	}
+
+	found := false
+	for _, inbound := range inbounds {
+		inboundMap, ok := inbound.(map[string]interface{})
+		if !ok || inboundMap["protocol"] != "shadowsocks" {
+			continue
+		}
+
+		settings, ok := inboundMap["settings"].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("shadowsocks settings not found")
+		}
+
+		method, _ := settings["method"].(string)
+		if !strings.HasPrefix(method, "2022-") {
+			continue
+		}
+		found = true
+
+		password, _ := settings["password"].(string)
+		if err := validateShadowsocks2022Key(method, password); err != nil {
+			return fmt.Errorf("invalid server key: %w", err)
+		}
+
+		clients, _ := settings["clients"].([]interface{})
+		for _, client := range clients {
+			clientMap, ok := client.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("invalid shadowsocks client")
+			}
+			userKey, _ := clientMap["password"].(string)
+			if err := validateShadowsocks2022Key(method, userKey); err != nil {
+				return fmt.Errorf("invalid key for user %v: %w", clientMap["email"], err)
+			}
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("no Shadowsocks-2022 inbound configured")
+	}
+	return nil
+}
+
+// SetFilterRules replaces the content filter routing rules in the server config. Rules
+// are tagged with ruleTag so they can be swapped without touching other routing; rules
+// without an outboundTag are sent to the default outbound. Xray must be restarted to
+// pick up the change.
+func (xm *XrayManagerImpl) SetFilterRules(rules []map[string]interface{}) error {
+	xm.mu.Lock()
+	defer xm.mu.Unlock()
+
+	config, err := xm.loadServerConfig()
+	if err != nil {
+		return err
+	}
+
+	routing, _ := config["routing"].(map[string]interface{})
+	if routing == nil {
+		routing = map[string]interface{}{}
+	}
+	existing, _ := routing["rules"].([]interface{})
+
+	var kept []interface{}
+	for _, rule := range existing {
+		if ruleMap, ok := rule.(map[string]interface{}); ok {
+			if tag, _ := ruleMap["ruleTag"].(string); strings.HasPrefix(tag, xrayFilterRulePrefix) {
+				continue
+			}
+		}
+		kept = append(kept, rule)
+	}
+
+	outbounds := outboundList(config)
+	defaultTag := ensureOutboundTag(outbounds)
+	if len(rules) > 0 && !hasOutbound(outbounds, xrayBlockOutboundTag) {
+		outbounds = append(outbounds, map[string]interface{}{
+			"protocol": "blackhole",
+			"tag":      xrayBlockOutboundTag,
+		})
+	}
+	config["outbounds"] = outbounds
+
+	// Filter rules go first so they apply before any other routing
+	merged := make([]interface{}, 0, len(rules)+len(kept))
+	for _, rule := range rules {
+		if rule["outboundTag"] == nil || rule["outboundTag"] == "" {
+			rule["outboundTag"] = defaultTag
+		}
+		merged = append(merged, rule)
+	}
+	merged = append(merged, kept...)
+
+	if len(merged) == 0 {
+		delete(routing, "rules")
+	} else {
+		routing["rules"] = merged
+	}
+	if len(routing) == 0 {
+		delete(config, "routing")
+	} else {
+		config["routing"] = routing
+	}
+
+	if err := xm.saveServerConfig(config); err != nil {
+		return err
+	}
+
+	xm.logger.Infof("Xray content filter rules updated: %d rules", len(rules))
+	return nil
+}
+
+// SetProfileRouting replaces the routing profile outbounds, balancers and rules in the
+// server config. Everything is tagged with the "profile-" prefix so it can be swapped
+// without touching other routing. Rules go after the content filter rules so filtered
+// domains stay blocked; rules without an outboundTag or balancerTag, and empty balancer
+// selectors, stand for the default outbound. Xray must be restarted to pick up the change.
+func (xm *XrayManagerImpl) SetProfileRouting(outbounds, balancers, rules []map[string]interface{}) error {
+	xm.mu.Lock()
+	defer xm.mu.Unlock()
+
+	config, err := xm.loadServerConfig()
+	if err != nil {
+		return err
+	}
+
+	routing, _ := config["routing"].(map[string]interface{})
+	if routing == nil {
+		routing = map[string]interface{}{}
+	}
+
+	var keptOutbounds []interface{}
+	for _, outbound := range outboundList(config) {
+		if outboundMap, ok := outbound.(map[string]interface{}); ok {
+			if tag, _ := outboundMap["tag"].(string); strings.HasPrefix(tag, xrayProfilePrefix) {
+				continue
+			}
+		}
+		keptOutbounds = append(keptOutbounds, outbound)
+	}
+	defaultTag := ensureOutboundTag(keptOutbounds)
+	for _, outbound := range outbounds {
+		keptOutbounds = append(keptOutbounds, outbound)
+	}
+
+	var keptBalancers []interface{}
+	existingBalancers, _ := routing["balancers"].([]interface{})
+	for _, balancer := range existingBalancers {
+		if balancerMap, ok := balancer.(map[string]interface{}); ok {
+			if tag, _ := balancerMap["tag"].(string); strings.HasPrefix(tag, xrayProfilePrefix) {
+				continue
+			}
+		}
+		keptBalancers = append(keptBalancers, balancer)
+	}
+	for _, balancer := range balancers {
+		if selector, ok := balancer["selector"].([]string); ok {
+			for i, tag := range selector {
+				if tag == "" {
+					selector[i] = defaultTag
+				}
+			}
+		}
+		keptBalancers = append(keptBalancers, balancer)
+	}
+
+	// Profile rules go between the content filter rules and any other routing
+	existingRules, _ := routing["rules"].([]interface{})
+	var filterRules, otherRules []interface{}
+	for _, rule := range existingRules {
+		tag := ""
+		if ruleMap, ok := rule.(map[string]interface{}); ok {
+			tag, _ = ruleMap["ruleTag"].(string)
+		}
+		switch {
+		case strings.HasPrefix(tag, xrayProfilePrefix):
+		case strings.HasPrefix(tag, xrayFilterRulePrefix):
+			filterRules = append(filterRules, rule)
+		default:
+			otherRules = append(otherRules, rule)
+		}
+	}
+	merged := make([]interface{}, 0, len(filterRules)+len(rules)+len(otherRules))
+	merged = append(merged, filterRules...)
+	for _, rule := range rules {
+		if rule["balancerTag"] == nil && (rule["outboundTag"] == nil || rule["outboundTag"] == "") {
+			rule["outboundTag"] = defaultTag
+		}
+		if rule["outboundTag"] == xrayBlockOutboundTag && !hasOutbound(keptOutbounds, xrayBlockOutboundTag) {
+			keptOutbounds = append(keptOutbounds, map[string]interface{}{
+				"protocol": "blackhole",
+				"tag":      xrayBlockOutboundTag,
+			})
+		}
+		merged = append(merged, rule)
+	}
+	merged = append(merged, otherRules...)
+
+	// Address rules only see requests by domain once Xray resolves them
+	for _, rule := range rules {
+		if _, ok := rule["ip"]; ok && routing["domainStrategy"] == nil {
+			routing["domainStrategy"] = "IPIfNonMatch"
+			break
+		}
+	}
+
+	config["outbounds"] = keptOutbounds
+	if len(keptBalancers) == 0 {
+		delete(routing, "balancers")
+	} else {
+		routing["balancers"] = keptBalancers
+	}
+	if len(merged) == 0 {
+		delete(routing, "rules")
+	} else {
+		routing["rules"] = merged
+	}
+	if len(routing) == 0 {
+		delete(config, "routing")
+	} else {
+		config["routing"] = routing
+	}
+
+	if err := xm.saveServerConfig(config); err != nil {
+		return err
+	}
+
+	xm.logger.Infof("Xray routing profile rules updated: %d rules, %d balancers", len(rules), len(balancers))
+	return nil
+}
+
+// SetRealityTargets points the Reality inbound at other sites to borrow, the first one
+// being the dest. The inbound in the server config is updated when it exists, otherwise
+// the targets apply once it is added. Xray must be restarted to pick up the change.
+func (xm *XrayManagerImpl) SetRealityTargets(serverNames []string) error {
+	if len(serverNames) == 0 {
+		return fmt.Errorf("at least one server name must be provided")
+	}
+
+	xm.mu.Lock()
+	defer xm.mu.Unlock()
+
+	xm.config.Xray.RealityServerNames = serverNames
+	xm.config.Xray.RealityDest = net.JoinHostPort(serverNames[0], "443")
+
+	config, err := xm.loadServerConfig()
+	if err != nil {
+		return err
+	}
+	inbounds, _ := config["inbounds"].([]interface{})
+	index := findInbound(inbounds, XrayProtocolVLESSReality)
+	if index < 0 {
+		return nil
+	}
+
+	streamSettings, _ := inbounds[index].(map[string]interface{})["streamSettings"].(map[string]interface{})
+	reality, _ := streamSettings["realitySettings"].(map[string]interface{})
+	if reality == nil {
+		return fmt.Errorf("reality inbound has no realitySettings")
+	}
+	reality["dest"] = xm.config.Xray.RealityDest
+	reality["serverNames"] = serverNames
+
+	if err := xm.saveServerConfig(config); err != nil {
+		return err
+	}
+
+	xm.logger.Infof("Reality targets set to %v", serverNames)
+	return nil
+}
+
+// loadServerConfig reads the server config, returning an empty one if it does not exist yet
+func (xm *XrayManagerImpl) loadServerConfig() (map[string]interface{}, error) {
+	content, err := readGeneratedConfig(xm.config, xm.config.Xray.ConfigPath)
+	if os.IsNotExist(err) {
+		config := map[string]interface{}{
+			"inbounds":  []interface{}{},
+			"outbounds": defaultOutbounds(),
+		}
+		if err := xm.applyConfigOptions("", config); err != nil {
+			return nil, err
+		}
+		return config, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Xray config: %w", err)
+	}
+
+	var config map[string]interface{}
+	if err := json.Unmarshal(content, &config); err != nil {
+		return nil, fmt.Errorf("invalid JSON in Xray config: %w", err)
+	}
+	return config, nil
+}
+
+func (xm *XrayManagerImpl) saveServerConfig(config map[string]interface{}) error {
+	configJSON, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal config: %w", err)
+	}
+
+	if err := writeGeneratedConfig(xm.config, xm.config.Xray.ConfigPath, configJSON); err != nil {
+		return fmt.Errorf("failed to save Xray config: %w", err)
+	}
+	return nil
+}
+
+// prepareUser validates user for protocol and generates a Shadowsocks-2022 key if none was given
+func prepareUser(protocol string, settings map[string]interface{}, user XrayUser) (XrayUser, error) {
+	switch protocol {
+	case XrayProtocolVLESS, XrayProtocolVLESSReality:
+		if user.ID == "" {
+			return user, fmt.Errorf("VLESS users require an ID")
+		}
+	case XrayProtocolTrojan:
+		if len(user.Password) < 8 {
+			return user, fmt.Errorf("trojan password must be at least 8 characters")
+		}
+	case XrayProtocolShadowsocks2022:
+		method, _ := settings["method"].(string)
+		if method == "2022-blake3-chacha20-poly1305" {
+			return user, fmt.Errorf("%s does not support multiple users", method)
+		}
+		if user.Password == "" {
+			key, err := GenerateShadowsocks2022Key(method)
+			if err != nil {
+				return user, err
+			}
+			user.Password = key
+		} else if err := validateShadowsocks2022Key(method, user.Password); err != nil {
+			return user, fmt.Errorf("invalid user key: %w", err)
+		}
+	default:
+		return user, fmt.Errorf("unsupported protocol: %s", protocol)
+	}
+	return user, nil
+}
+
+// clientEntry builds the inbound client entry for user in the format expected by protocol
+func clientEntry(protocol string, user XrayUser) map[string]interface{} {
+	if protocol == XrayProtocolVLESS || protocol == XrayProtocolVLESSReality {
+		return map[string]interface{}{
+			"id":    user.ID,
+			"flow":  user.Flow,
+			"email": user.Email,
+		}
+	}
+	return map[string]interface{}{
+		"password": user.Password,
+		"email":    user.Email,
+	}
+}
+
+// inboundSettings returns the settings object of the inbound for protocol
+func inboundSettings(config map[string]interface{}, protocol string) (map[string]interface{}, error) {
+	inbounds, _ := config["inbounds"].([]interface{})
+	index := findInbound(inbounds, protocol)
+	if index < 0 {
+		return nil, fmt.Errorf("no inbound configured for %s", protocol)
+	}
+
+	inbound := inbounds[index].(map[string]interface{})
+	settings, ok := inbound["settings"].(map[string]interface{})
+	if !ok {
+		settings = map[string]interface{}{}
+		inbound["settings"] = settings
+	}
+	return settings, nil
+}
+
+// findInbound returns the index of the inbound for protocol, matching by tag and
+// falling back to the wire protocol for configs written before inbounds were tagged
+func findInbound(inbounds []interface{}, protocol string) int {
+	fallback := -1
+	for i, inbound := range inbounds {
+		inboundMap, ok := inbound.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if inboundMap["tag"] == inboundTag(protocol) {
+			return i
+		}
+		if fallback < 0 && inboundMap["tag"] == nil && matchesProtocol(inboundMap, protocol) {
+			fallback = i
+		}
+	}
+	return fallback
+}
+
+func matchesProtocol(inbound map[string]interface{}, protocol string) bool {
+	settings, _ := inbound["settings"].(map[string]interface{})
+	streamSettings, _ := inbound["streamSettings"].(map[string]interface{})
+
+	switch protocol {
+	case XrayProtocolVLESS:
+		return inbound["protocol"] == "vless" && (streamSettings == nil || streamSettings["security"] != "reality")
+	case XrayProtocolVLESSReality:
+		return inbound["protocol"] == "vless" && streamSettings != nil && streamSettings["security"] == "reality"
+	case XrayProtocolTrojan:
+		return inbound["protocol"] == "trojan"
+	case XrayProtocolShadowsocks2022:
+		method, _ := settings["method"].(string)
+		return inbound["protocol"] == "shadowsocks" && strings.HasPrefix(method, "2022-")
+	default:
+		return false
+	}
+}
+
+func inboundTag(protocol string) string {
+	return protocol + "-in"
+}
+
+// portOf normalises the inbound port so loaded (float64) and generated (int) values compare equal
+func portOf(inbound map[string]interface{}) interface{} {
+	if port, ok := inbound["port"].(float64); ok {
+		return int(port)
+	}
+	return inbound["port"]
+}
+
+// outboundList returns the outbounds of a loaded or generated config as one slice type
+func outboundList(config map[string]interface{}) []interface{} {
+	switch outbounds := config["outbounds"].(type) {
+	case []interface{}:
+		return outbounds
+	case []map[string]interface{}:
+		list := make([]interface{}, 0, len(outbounds))
+		for _, outbound := range outbounds {
+			list = append(list, outbound)
+		}
+		return list
+	default:
+		return nil
+	}
+}
+
+// ensureOutboundTag returns the tag of the default (first) outbound, tagging it "direct" if needed
+func ensureOutboundTag(outbounds []interface{}) string {
+	if len(outbounds) == 0 {
+		return xrayDirectOutboundTag
+	}
+	outbound, ok := outbounds[0].(map[string]interface{})
+	if !ok {
+		return xrayDirectOutboundTag
+	}
+	if tag, _ := outbound["tag"].(string); tag != "" {
+		return tag
+	}
+	outbound["tag"] = xrayDirectOutboundTag
+	return xrayDirectOutboundTag
+}
+
+func hasOutbound(outbounds []interface{}, tag string) bool {
+	for _, outbound := range outbounds {
+		if outboundMap, ok := outbound.(map[string]interface{}); ok && outboundMap["tag"] == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func defaultOutbounds() []map[string]interface{} {
+	return []map[string]interface{}{
+		{
+			"protocol": "freedom",
+			"settings": map[string]interface{}{},
+		},
+	}
+}
@@ -0,0 +1,186 @@
+package services
+
+import (
+	"encoding/base64"
+	"path/filepath"
+	"testing"
+
+	"hysteria2_microservices/agent-service/internal/config"
+)
+
+func newTestXrayManager(t *testing.T) (*XrayManagerImpl, *config.Config) {
+	cfg := &config.Config{}
+	cfg.Xray.ConfigPath = filepath.Join(t.TempDir(), "config.json")
+	cfg.Xray.CertPath = "/etc/xray/cert.pem"
+	cfg.Xray.KeyPath = "/etc/xray/key.pem"
+	cfg.Xray.TrojanPort = 8443
+	cfg.Xray.ShadowsocksPort = 8388
+	return NewXrayManager(testLogger(), cfg).(*XrayManagerImpl), cfg
+}
+
+// savedInbound reads the inbound for protocol back from the server config file
+func savedInbound(t *testing.T, xm *XrayManagerImpl, protocol string) map[string]interface{} {
+	t.Helper()
+	config, err := xm.loadServerConfig()
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	inbounds, _ := config["inbounds"].([]interface{})
+	index := findInbound(inbounds, protocol)
+	if index < 0 {
+		t.Fatalf("no %s inbound saved", protocol)
+	}
+	return inbounds[index].(map[string]interface{})
+}
+
+func TestValidateShadowsocks2022Key(t *testing.T) {
+	key16 := base64.StdEncoding.EncodeToString(make([]byte, 16))
+	key32 := base64.StdEncoding.EncodeToString(make([]byte, 32))
+
+	tests := []struct {
+		method  string
+		key     string
+		wantErr bool
+	}{
+		{"2022-blake3-aes-128-gcm", key16, false},
+		{"2022-blake3-aes-256-gcm", key32, false},
+		{"2022-blake3-chacha20-poly1305", key32, false},
+		{"2022-blake3-aes-256-gcm", key16, true},
+		{"2022-blake3-aes-128-gcm", "not base64!", true},
+		{"aes-128-gcm", key16, true},
+	}
+	for _, tt := range tests {
+		if err := validateShadowsocks2022Key(tt.method, tt.key); (err != nil) != tt.wantErr {
+			t.Errorf("validateShadowsocks2022Key(%s, %q) = %v, want error %v", tt.method, tt.key, err, tt.wantErr)
+		}
+	}
+
+	for method := range shadowsocks2022KeySizes {
+		key, err := GenerateShadowsocks2022Key(method)
+		if err != nil {
+			t.Fatalf("GenerateShadowsocks2022Key(%s): %v", method, err)
+		}
+		if err := validateShadowsocks2022Key(method, key); err != nil {
+			t.Errorf("generated %s key rejected: %v", method, err)
+		}
+	}
+}
+
+func TestXrayTrojanLifecycle(t *testing.T) {
+	xm, cfg := newTestXrayManager(t)
+
+	if err := xm.ConfigureTrojan("short"); err == nil {
+		t.Error("accepted a trojan password under 8 characters")
+	}
+	if err := xm.AddInbound(XrayProtocolTrojan); err != nil {
+		t.Fatalf("AddInbound: %v", err)
+	}
+	if len(cfg.Xray.TrojanPassword) < 8 {
+		t.Errorf("generated trojan password %q", cfg.Xray.TrojanPassword)
+	}
+	if err := xm.AddInbound(XrayProtocolTrojan); err == nil {
+		t.Error("added a second trojan inbound")
+	}
+
+	inbound := savedInbound(t, xm, XrayProtocolTrojan)
+	stream := inbound["streamSettings"].(map[string]interface{})
+	tls := stream["tlsSettings"].(map[string]interface{})
+	if inbound["port"] != float64(8443) || stream["security"] != "tls" || tls["minVersion"] != "1.2" || tls["cipherSuites"] != trojanCipherSuites {
+		t.Errorf("trojan inbound = %v, want TLS on 8443 with the browser suites", inbound)
+	}
+
+	if _, err := xm.AddUser(XrayProtocolTrojan, XrayUser{Email: "alice", Password: "short"}); err == nil {
+		t.Error("added a user with a short password")
+	}
+	if _, err := xm.AddUser(XrayProtocolTrojan, XrayUser{Email: "alice", Password: "alice-password"}); err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	if _, err := xm.AddUser(XrayProtocolTrojan, XrayUser{Email: "alice", Password: "other-password"}); err == nil {
+		t.Error("added alice twice")
+	}
+
+	config, _ := xm.loadServerConfig()
+	if err := xm.validateTrojanConfig(config); err != nil {
+		t.Errorf("saved config does not validate: %v", err)
+	}
+	clients := savedInbound(t, xm, XrayProtocolTrojan)["settings"].(map[string]interface{})["clients"].([]interface{})
+	if len(clients) != 2 || clients[1].(map[string]interface{})["password"] != "alice-password" {
+		t.Errorf("clients = %v, want the default client and alice", clients)
+	}
+
+	if err := xm.RemoveUser(XrayProtocolTrojan, "alice"); err != nil {
+		t.Fatalf("RemoveUser: %v", err)
+	}
+	if err := xm.RemoveUser(XrayProtocolTrojan, "alice"); err == nil {
+		t.Error("removed alice twice")
+	}
+	if err := xm.RemoveInbound(XrayProtocolTrojan); err != nil {
+		t.Fatalf("RemoveInbound: %v", err)
+	}
+	if ok, err := xm.HasInbound(XrayProtocolTrojan); err != nil || ok {
+		t.Errorf("HasInbound after removal = %v, %v", ok, err)
+	}
+}
+
+func TestXrayShadowsocks2022Lifecycle(t *testing.T) {
+	xm, cfg := newTestXrayManager(t)
+
+	if err := xm.AddInbound(XrayProtocolShadowsocks2022); err != nil {
+		t.Fatalf("AddInbound: %v", err)
+	}
+	if cfg.Xray.ShadowsocksMethod != defaultShadowsocks2022Method {
+		t.Errorf("method %q, want the default %s", cfg.Xray.ShadowsocksMethod, defaultShadowsocks2022Method)
+	}
+	if err := validateShadowsocks2022Key(cfg.Xray.ShadowsocksMethod, cfg.Xray.ShadowsocksPassword); err != nil {
+		t.Errorf("generated server key: %v", err)
+	}
+
+	user, err := xm.AddUser(XrayProtocolShadowsocks2022, XrayUser{Email: "bob"})
+	if err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	if err := validateShadowsocks2022Key(defaultShadowsocks2022Method, user.Password); err != nil {
+		t.Errorf("generated user key: %v", err)
+	}
+	if _, err := xm.AddUser(XrayProtocolShadowsocks2022, XrayUser{Email: "carol", Password: base64.StdEncoding.EncodeToString(make([]byte, 32))}); err == nil {
+		t.Error("added a user key of the wrong size")
+	}
+
+	inbound := savedInbound(t, xm, XrayProtocolShadowsocks2022)
+	settings := inbound["settings"].(map[string]interface{})
+	if inbound["protocol"] != "shadowsocks" || settings["network"] != "tcp,udp" || len(settings["clients"].([]interface{})) != 1 {
+		t.Errorf("shadowsocks inbound = %v, want one user over tcp and udp", inbound)
+	}
+	config, _ := xm.loadServerConfig()
+	if err := xm.validateShadowsocks2022Config(config); err != nil {
+		t.Errorf("saved config does not validate: %v", err)
+	}
+}
+
+func TestXrayShadowsocks2022ChaChaIsSingleUser(t *testing.T) {
+	xm, _ := newTestXrayManager(t)
+	if err := xm.ConfigureShadowsocks2022("2022-blake3-chacha20-poly1305", ""); err != nil {
+		t.Fatalf("ConfigureShadowsocks2022: %v", err)
+	}
+	if err := xm.AddInbound(XrayProtocolShadowsocks2022); err != nil {
+		t.Fatalf("AddInbound: %v", err)
+	}
+	if _, err := xm.AddUser(XrayProtocolShadowsocks2022, XrayUser{Email: "bob"}); err == nil {
+		t.Error("added a user to a single-user method")
+	}
+}
+
+func TestXrayAddInboundRejectsPortInUse(t *testing.T) {
+	xm, cfg := newTestXrayManager(t)
+	cfg.Xray.ShadowsocksPort = cfg.Xray.TrojanPort
+
+	if err := xm.AddInbound(XrayProtocolTrojan); err != nil {
+		t.Fatalf("AddInbound: %v", err)
+	}
+	if err := xm.AddInbound(XrayProtocolShadowsocks2022); err == nil {
+		t.Error("added a second inbound on the trojan port")
+	}
+	if err := xm.AddInbound("vmess"); err == nil {
+		t.Error("added an unsupported protocol")
+	}
+}
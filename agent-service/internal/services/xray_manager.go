@@ -1,10 +1,15 @@
 package services
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
 
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
@@ -16,6 +21,9 @@ type XrayManagerImpl struct {
 	logger             *logrus.Logger
 	config             *config.Config
 	certificateManager CertificateManager
+
+	// mu serialises read-modify-write cycles on the server config
+	mu sync.Mutex
 }
 
 // NewXrayManager creates a new XrayManager
@@ -28,19 +36,50 @@ func NewXrayManager(logger *logrus.Logger, cfg *config.Config) XrayManager {
 	}
 }
 
-// InstallXray installs Xray-core using the official script
+// InstallXray installs the pinned or latest Xray-core release from GitHub, or from the
+// orchestrator's artifact store in offline mode, verified against its published SHA-256
 func (xm *XrayManagerImpl) InstallXray() error {
 	xm.logger.Info("Installing Xray-core...")
 
-	// Use the official install script
-	cmd := exec.Command("bash", "-c", "bash <(curl -L https://github.com/XTLS/Xray-install/raw/main/install-release.sh) install")
-	output, err := cmd.CombinedOutput()
+	ctx, cancel := context.WithTimeout(context.Background(), binaryDownloadTimeout)
+	defer cancel()
+	client := &http.Client{Timeout: binaryDownloadTimeout}
+	artifacts := newArtifactStore(xm.config)
+
+	version := normalizeXrayVersion(xm.config.Xray.Version)
+	if version == "" {
+		latest, err := latestXrayRelease(ctx, client, artifacts)
+		if err != nil {
+			return fmt.Errorf("failed to get latest Xray-core release: %w", err)
+		}
+		version = normalizeXrayVersion(latest)
+	}
+	if !xrayVersionPattern.MatchString(version) {
+		return fmt.Errorf("invalid xray version %q", version)
+	}
+
+	binaryPath := xrayBinaryPath(xm.config)
+	if err := os.MkdirAll(filepath.Dir(binaryPath), 0755); err != nil {
+		return fmt.Errorf("failed to create binary directory: %w", err)
+	}
+	workDir, err := os.MkdirTemp(filepath.Dir(binaryPath), ".xray-install-")
 	if err != nil {
-		xm.logger.Errorf("Failed to install Xray-core: %v, output: %s", err, string(output))
+		return fmt.Errorf("failed to create work directory: %w", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	if err := downloadXrayRelease(ctx, client, artifacts, version, workDir); err != nil {
+		xm.logger.Errorf("Failed to install Xray-core: %v", err)
 		return fmt.Errorf("failed to install Xray-core: %w", err)
 	}
+	if err := installXrayGeoFiles(workDir, xrayAssetDir(xm.config)); err != nil {
+		return fmt.Errorf("failed to install Xray geo files: %w", err)
+	}
+	if err := os.Rename(filepath.Join(workDir, "xray"), binaryPath); err != nil {
+		return fmt.Errorf("failed to install Xray-core binary: %w", err)
+	}
 
-	xm.logger.Info("Xray-core installed successfully")
+	xm.logger.Infof("Xray-core %s installed successfully", version)
 	return nil
 }
 
@@ -55,14 +94,19 @@ func (xm *XrayManagerImpl) IsXrayInstalled() bool {
 func (xm *XrayManagerImpl) StartXray(configPath string) error {
 	xm.logger.Infof("Starting Xray with config: %s", configPath)
 
+	configPath, err := runtimeConfigPath(xm.config, configPath)
+	if err != nil {
+		return fmt.Errorf("failed to prepare config: %w", err)
+	}
 	if err := xm.validateConfigFile(configPath); err != nil {
-		return fmt.Errorf("invalid config file: %w", err)
+		return fmt.Errorf("%w: %v", ErrConfigInvalid, err)
 	}
 
 	// Start directly
-	cmd := exec.Command("xray", "run", "-c", configPath)
-	err := cmd.Start()
-	if err != nil {
+	cmd := exec.Command(xrayBinaryPath(xm.config), "run", "-c", configPath)
+	// In its own session the server outlives the agent and keeps serving clients while it restarts
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
 		return fmt.Errorf("failed to start Xray: %w", err)
 	}
 
@@ -151,17 +195,21 @@ func (xm *XrayManagerImpl) ValidateConfig(protocol string, config map[string]int
 		return xm.validateVLESSConfig(config)
 	case "vless-reality":
 		return xm.validateVLESSRealityConfig(config)
+	case XrayProtocolTrojan:
+		return xm.validateTrojanConfig(config)
+	case XrayProtocolShadowsocks2022:
+		return xm.validateShadowsocks2022Config(config)
 	default:
 		return fmt.Errorf("unsupported protocol: %s", protocol)
 	}
 }
 
 // ConfigureVLESS configures VLESS protocol settings
-func (xm *XrayManagerImpl) ConfigureVLESS(uuid, dest string, flow string) error {
-	xm.logger.Infof("Configuring VLESS with UUID: %s, dest: %s, flow: %s", uuid, dest, flow)
+func (xm *XrayManagerImpl) ConfigureVLESS(id, dest string, flow string) error {
+	xm.logger.Infof("Configuring VLESS with UUID: %s, dest: %s, flow: %s", id, dest, flow)
 
 	// Validate UUID
-	if _, err := uuid.Parse(uuid); err != nil {
+	if _, err := uuid.Parse(id); err != nil {
 		return fmt.Errorf("invalid UUID: %w", err)
 	}
 
@@ -251,6 +299,10 @@ func (xm *XrayManagerImpl) generateDefaultConfig(protocol string) (map[string]in
 		return xm.generateVLESSConfig(), nil
 	case "vless-reality":
 		return xm.generateVLESSRealityConfig(), nil
+	case XrayProtocolTrojan:
+		return xm.generateTrojanConfig()
+	case XrayProtocolShadowsocks2022:
+		return xm.generateShadowsocks2022Config()
 	default:
 		return nil, fmt.Errorf("unsupported protocol: %s", protocol)
 	}
@@ -289,8 +341,6 @@ func (xm *XrayManagerImpl) generateVLESSConfig() map[string]interface{} {
 
 // generateVLESSRealityConfig generates VLESS + Reality configuration
 func (xm *XrayManagerImpl) generateVLESSRealityConfig() map[string]interface{} {
-	privateKey, publicKey, _ := xm.GenerateRealityKeys()
-
 	return map[string]interface{}{
 		"inbounds": []map[string]interface{}{
 			{
@@ -306,14 +356,14 @@ func (xm *XrayManagerImpl) generateVLESSRealityConfig() map[string]interface{} {
 					"decryption": "none",
 				},
 				"streamSettings": map[string]interface{}{
-					"network": "tcp",
+					"network":  "tcp",
 					"security": "reality",
 					"realitySettings": map[string]interface{}{
-						"dest":         xm.config.Xray.RealityDest,
-						"serverNames":  xm.config.Xray.RealityServerNames,
-						"privateKey":   xm.config.Xray.RealityPrivateKey,
-						"publicKey":    xm.config.Xray.RealityPublicKey,
-						"shortIds":     xm.config.Xray.RealityShortIds,
+						"dest":        xm.config.Xray.RealityDest,
+						"serverNames": xm.config.Xray.RealityServerNames,
+						"privateKey":  xm.config.Xray.RealityPrivateKey,
+						"publicKey":   xm.config.Xray.RealityPublicKey,
+						"shortIds":    xm.config.Xray.RealityShortIds,
 					},
 				},
 			},
@@ -331,35 +381,117 @@ func (xm *XrayManagerImpl) generateVLESSRealityConfig() map[string]interface{} {
 func (xm *XrayManagerImpl) generateRealityConfig() map[string]interface{} {
 	return xm.generateVLESSRealityConfig()
 }
-}
 
 // applyConfigOptions applies additional configuration options
 func (xm *XrayManagerImpl) applyConfigOptions(protocol string, config map[string]interface{}) error {
 	// Add logging
-	config["log"] = map[string]interface{}{
+	logConfig := map[string]interface{}{
 		"loglevel": "warning",
 	}
+	// The brute-force guard reads rejected clients from the access log
+	if xm.config.BruteForce.Enabled && xm.config.BruteForce.XrayAccessLog != "" {
+		if err := os.MkdirAll(filepath.Dir(xm.config.BruteForce.XrayAccessLog), 0755); err != nil {
+			xm.logger.Warnf("Failed to create Xray log directory: %v", err)
+		}
+		logConfig["access"] = xm.config.BruteForce.XrayAccessLog
+	}
+	config["log"] = logConfig
 
-	// Add API for statistics if enabled
+	// Add the handler and stats API if enabled, with per-user traffic and online tracking
+	// for listing and disconnecting clients
 	if xm.config.Xray.EnableAPI {
 		config["api"] = map[string]interface{}{
 			"tag":      "api",
-			"services": []string{"StatsService"},
+			"listen":   xm.config.Xray.APIListen,
+			"services": []string{"HandlerService", "StatsService"},
+		}
+		config["stats"] = map[string]interface{}{}
+		config["policy"] = map[string]interface{}{
+			"levels": map[string]interface{}{
+				"0": map[string]interface{}{
+					"statsUserUplink":   true,
+					"statsUserDownlink": true,
+					"statsUserOnline":   true,
+				},
+			},
 		}
 
-		// Add stats outbound
-		outbounds := config["outbounds"].([]map[string]interface{})
-		outbounds = append(outbounds, map[string]interface{}{
+		// Add stats outbound; configs parsed from a template hold []interface{}
+		apiOutbound := map[string]interface{}{
 			"protocol": "freedom",
 			"tag":      "api",
 			"settings": map[string]interface{}{},
-		})
-		config["outbounds"] = outbounds
+		}
+		switch outbounds := config["outbounds"].(type) {
+		case []map[string]interface{}:
+			config["outbounds"] = append(outbounds, apiOutbound)
+		case []interface{}:
+			config["outbounds"] = append(outbounds, apiOutbound)
+		default:
+			config["outbounds"] = []interface{}{apiOutbound}
+		}
+	}
+
+	// Resolve destinations through the local DoH resolver instead of the system's plaintext DNS
+	if xm.config.DNS.Enabled {
+		config["dns"] = xrayDNSConfig(xm.config)
+		switch outbounds := config["outbounds"].(type) {
+		case []map[string]interface{}:
+			for _, outbound := range outbounds {
+				useResolverDNS(outbound)
+			}
+		case []interface{}:
+			for _, outbound := range outbounds {
+				if outboundMap, ok := outbound.(map[string]interface{}); ok {
+					useResolverDNS(outboundMap)
+				}
+			}
+		}
+	}
+
+	// Behind the port mux inbounds are only reachable through it
+	switch inbounds := config["inbounds"].(type) {
+	case []map[string]interface{}:
+		for _, inbound := range inbounds {
+			xm.bindInbound(inbound)
+		}
+	case []interface{}:
+		for _, inbound := range inbounds {
+			if inboundMap, ok := inbound.(map[string]interface{}); ok {
+				xm.bindInbound(inboundMap)
+			}
+		}
 	}
 
 	return nil
 }
 
+// bindInbound moves TLS and Reality inbounds to loopback when the port mux owns the public port.
+// Shadowsocks has no ClientHello to route on, so it keeps listening on its own port.
+// Public inbounds without an explicit address listen dual-stack when the node has IPv6.
+func (xm *XrayManagerImpl) bindInbound(inbound map[string]interface{}) {
+	if xm.config.PortMux.Enabled && inbound["protocol"] != "shadowsocks" {
+		inbound["listen"] = "127.0.0.1"
+		return
+	}
+	if _, ok := inbound["listen"]; !ok && ipv6Enabled(xm.config) {
+		inbound["listen"] = "::"
+	}
+}
+
+// useResolverDNS makes a freedom outbound resolve domains with Xray's DNS settings
+func useResolverDNS(outbound map[string]interface{}) {
+	if outbound["protocol"] != "freedom" || outbound["tag"] == "api" {
+		return
+	}
+	settings, ok := outbound["settings"].(map[string]interface{})
+	if !ok {
+		settings = map[string]interface{}{}
+		outbound["settings"] = settings
+	}
+	settings["domainStrategy"] = "UseIP"
+}
+
 // validateConfigFile validates Xray config file
 func (xm *XrayManagerImpl) validateConfigFile(configPath string) error {
 	if _, err := os.Stat(configPath); os.IsNotExist(err) {
@@ -0,0 +1,213 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// xrayAPITimeout bounds each call to the Xray API
+const xrayAPITimeout = 10 * time.Second
+
+// XrayConnection is a client with open connections to Xray. Clients are known by their
+// email, "<user_id>" or "<user_id>@<device_id>".
+type XrayConnection struct {
+	Email       string
+	UserID      string
+	DeviceID    string
+	InboundTags []string
+	IPs         []string
+	LastSeen    time.Time
+	Uplink      int64 // bytes since Xray started
+	Downlink    int64
+}
+
+// GetConnections lists the clients online on Xray, read from the stats API
+func (xm *XrayManagerImpl) GetConnections(ctx context.Context) ([]XrayConnection, error) {
+	if !xm.config.Xray.EnableAPI {
+		return nil, fmt.Errorf("the Xray API is disabled (xray.enable_api)")
+	}
+
+	clients, err := xm.inboundClients()
+	if err != nil {
+		return nil, err
+	}
+	traffic, err := xm.userTraffic(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	connections := []XrayConnection{}
+	for email, tags := range clients {
+		ips, lastSeen, err := xm.onlineIPs(ctx, email)
+		if err != nil {
+			return nil, err
+		}
+		if len(ips) == 0 {
+			continue
+		}
+		userID, deviceID, _ := strings.Cut(email, "@")
+		connections = append(connections, XrayConnection{
+			Email:       email,
+			UserID:      userID,
+			DeviceID:    deviceID,
+			InboundTags: tags,
+			IPs:         ips,
+			LastSeen:    lastSeen,
+			Uplink:      traffic[email+">>>uplink"],
+			Downlink:    traffic[email+">>>downlink"],
+		})
+	}
+	sort.Slice(connections, func(i, j int) bool {
+		return connections[i].Email < connections[j].Email
+	})
+	return connections, nil
+}
+
+// DisconnectClients removes the clients of a user, or only of one of their devices, from
+// the running inbounds, which drops their connections. The saved config is left alone, so
+// the clients can connect again once Xray restarts.
+func (xm *XrayManagerImpl) DisconnectClients(ctx context.Context, userID, deviceID string) ([]XrayConnection, error) {
+	if !xm.config.Xray.EnableAPI {
+		return nil, fmt.Errorf("the Xray API is disabled (xray.enable_api)")
+	}
+	if userID == "" {
+		return nil, fmt.Errorf("user ID is required")
+	}
+
+	clients, err := xm.inboundClients()
+	if err != nil {
+		return nil, err
+	}
+
+	disconnected := []XrayConnection{}
+	for email, tags := range clients {
+		user, device, _ := strings.Cut(email, "@")
+		if user != userID || (deviceID != "" && device != deviceID) {
+			continue
+		}
+		for _, tag := range tags {
+			if _, err := xm.runAPI(ctx, "rmu", "-tag="+tag, email); err != nil {
+				return disconnected, fmt.Errorf("failed to remove %s from inbound %s: %w", email, tag, err)
+			}
+		}
+		xm.logger.Infof("Xray client %s disconnected from %s", email, strings.Join(tags, ", "))
+		disconnected = append(disconnected, XrayConnection{
+			Email:       email,
+			UserID:      user,
+			DeviceID:    device,
+			InboundTags: tags,
+		})
+	}
+	return disconnected, nil
+}
+
+// inboundClients returns the tags of the inbounds holding every client email in the server config
+func (xm *XrayManagerImpl) inboundClients() (map[string][]string, error) {
+	xm.mu.Lock()
+	config, err := xm.loadServerConfig()
+	xm.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	clients := make(map[string][]string)
+	inbounds, _ := config["inbounds"].([]interface{})
+	for _, inbound := range inbounds {
+		inboundMap, ok := inbound.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		tag, _ := inboundMap["tag"].(string)
+		settings, _ := inboundMap["settings"].(map[string]interface{})
+		entries, _ := settings["clients"].([]interface{})
+		if tag == "" || tag == "api" {
+			continue
+		}
+		for _, entry := range entries {
+			entryMap, _ := entry.(map[string]interface{})
+			if email, _ := entryMap["email"].(string); email != "" {
+				clients[email] = append(clients[email], tag)
+			}
+		}
+	}
+	return clients, nil
+}
+
+// userTraffic returns the user traffic counters keyed by "<email>>>>uplink" and "<email>>>>downlink"
+func (xm *XrayManagerImpl) userTraffic(ctx context.Context) (map[string]int64, error) {
+	output, err := xm.runAPI(ctx, "statsquery", "-pattern", "user>>>")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query Xray stats: %w", err)
+	}
+
+	var result struct {
+		Stat []struct {
+			Name  string      `json:"name"`
+			Value json.Number `json:"value"`
+		} `json:"stat"`
+	}
+	if err := json.Unmarshal(output, &result); err != nil {
+		return nil, fmt.Errorf("invalid Xray stats: %w", err)
+	}
+
+	traffic := make(map[string]int64, len(result.Stat))
+	for _, stat := range result.Stat {
+		// "user>>>{email}>>>traffic>>>uplink"
+		email, direction, ok := strings.Cut(strings.TrimPrefix(stat.Name, "user>>>"), ">>>traffic>>>")
+		if !ok {
+			continue
+		}
+		value, _ := strconv.ParseInt(stat.Value.String(), 10, 64)
+		traffic[email+">>>"+direction] = value
+	}
+	return traffic, nil
+}
+
+// onlineIPs returns the addresses a client is connected from and when it was last active
+func (xm *XrayManagerImpl) onlineIPs(ctx context.Context, email string) ([]string, time.Time, error) {
+	output, err := xm.runAPI(ctx, "statsonlineiplist", "-email", email)
+	if err != nil {
+		// Xray reports clients that never connected as unknown counters
+		if strings.Contains(err.Error(), "not found") {
+			return nil, time.Time{}, nil
+		}
+		return nil, time.Time{}, fmt.Errorf("failed to query online IPs of %s: %w", email, err)
+	}
+
+	var result struct {
+		IPs map[string]json.Number `json:"ips"` // address -> last activity, unix seconds
+	}
+	if err := json.Unmarshal(output, &result); err != nil {
+		return nil, time.Time{}, fmt.Errorf("invalid Xray online IPs: %w", err)
+	}
+
+	ips := make([]string, 0, len(result.IPs))
+	var lastSeen time.Time
+	for ip, seen := range result.IPs {
+		ips = append(ips, ip)
+		if unix, err := seen.Int64(); err == nil && time.Unix(unix, 0).After(lastSeen) {
+			lastSeen = time.Unix(unix, 0)
+		}
+	}
+	sort.Strings(ips)
+	return ips, lastSeen, nil
+}
+
+// runAPI runs an "xray api" command against the local API listener
+func (xm *XrayManagerImpl) runAPI(ctx context.Context, command string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, xrayAPITimeout)
+	defer cancel()
+
+	cmdArgs := append([]string{"api", command, "--server=" + xm.config.Xray.APIListen}, args...)
+	output, err := exec.CommandContext(ctx, xrayBinaryPath(xm.config), cmdArgs...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return output, nil
+}
@@ -0,0 +1,593 @@
+package services
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"hysteria2_microservices/agent-service/internal/config"
+)
+
+const (
+	xrayRepository = "XTLS/Xray-core"
+
+	xrayConfigTestTimeout = 30 * time.Second
+)
+
+var xrayVersionPattern = regexp.MustCompile(`^v\d+\.\d+\.\d+$`)
+
+// xrayReleaseArch maps GOARCH to the architecture suffix of the Xray-linux-*.zip assets
+var xrayReleaseArch = map[string]string{
+	"amd64":    "64",
+	"386":      "32",
+	"arm64":    "arm64-v8a",
+	"arm":      "arm32-v7a",
+	"riscv64":  "riscv64",
+	"s390x":    "s390x",
+	"loong64":  "loong64",
+	"mips64le": "mips64le",
+	"ppc64le":  "ppc64le",
+}
+
+// xrayGeoFiles are the routing databases shipped in every release archive
+var xrayGeoFiles = []string{"geoip.dat", "geosite.dat"}
+
+// xrayConfigMigration rewrites a server config that a release starting at since no longer
+// accepts. apply reports whether it changed anything.
+type xrayConfigMigration struct {
+	since       string
+	description string
+	apply       func(serverConfig map[string]interface{}) bool
+}
+
+// xrayConfigMigrations are applied in order to every release boundary an upgrade crosses
+var xrayConfigMigrations = []xrayConfigMigration{
+	{
+		since:       "v1.8.0",
+		description: "replace legacy XTLS with TLS and the xtls-rprx-vision flow",
+		apply:       migrateLegacyXTLS,
+	},
+}
+
+// XrayUpdaterImpl replaces Xray-core with a verified release, migrating the server config
+// across schema changes and rolling back when the server does not stay up
+type XrayUpdaterImpl struct {
+	logger      *logrus.Logger
+	config      *config.Config
+	xrayManager XrayManager
+	client      *http.Client
+	artifacts   *artifactStore
+	mu          sync.Mutex
+}
+
+// NewXrayUpdater creates a new XrayUpdater
+func NewXrayUpdater(logger *logrus.Logger, cfg *config.Config, xrayManager XrayManager) XrayUpdater {
+	return &XrayUpdaterImpl{
+		logger:      logger,
+		config:      cfg,
+		xrayManager: xrayManager,
+		client:      &http.Client{Timeout: binaryDownloadTimeout},
+		artifacts:   newArtifactStore(cfg),
+	}
+}
+
+// CheckUpdates compares the installed release with the latest GitHub release, or the
+// artifact store's default in offline mode. With a pinned version, an update is
+// available whenever the installed release differs from it.
+func (xu *XrayUpdaterImpl) CheckUpdates(ctx context.Context) (*ComponentVersion, error) {
+	status := &ComponentVersion{
+		Name:   "xray",
+		Pinned: normalizeXrayVersion(xu.config.Xray.Version),
+	}
+
+	installed, err := xrayBinaryVersion(xrayBinaryPath(xu.config))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read installed version: %w", err)
+	}
+	status.Installed = installed
+
+	latest, err := latestXrayRelease(ctx, xu.client, xu.artifacts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get latest release: %w", err)
+	}
+	status.Latest = normalizeXrayVersion(latest)
+
+	target := status.Pinned
+	if target == "" {
+		target = status.Latest
+	}
+	status.UpdateAvailable = status.Installed != target
+	return status, nil
+}
+
+// Upgrade installs version, or the pinned or latest release when empty. The release
+// archive is verified against its published SHA-256, the server config is migrated for
+// any schema change between the two releases and tested with the new binary before
+// anything is replaced; if the restarted server does not stay up the previous binary and
+// config are restored and the returned error explains why.
+func (xu *XrayUpdaterImpl) Upgrade(ctx context.Context, version string) (*UpgradeResult, error) {
+	xu.mu.Lock()
+	defer xu.mu.Unlock()
+
+	binaryPath := xrayBinaryPath(xu.config)
+	previous, err := xrayBinaryVersion(binaryPath)
+	if err != nil {
+		return nil, fmt.Errorf("xray %w: %v", ErrServerNotInstalled, err)
+	}
+	result := &UpgradeResult{PreviousVersion: previous, InstalledVersion: previous}
+
+	target, err := xu.targetVersion(ctx, version)
+	if err != nil {
+		return nil, err
+	}
+	if target == previous {
+		xu.logger.Infof("Xray is already at %s", target)
+		return result, nil
+	}
+
+	xu.logger.Infof("Upgrading Xray from %s to %s", previous, target)
+
+	// Unpacked next to the binary so installing it is a rename on the same filesystem
+	workDir, err := os.MkdirTemp(filepath.Dir(binaryPath), ".xray-upgrade-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create work directory: %w", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	if err := downloadXrayRelease(ctx, xu.client, xu.artifacts, target, workDir); err != nil {
+		return nil, err
+	}
+	candidate := filepath.Join(workDir, "xray")
+	if got, err := xrayBinaryVersion(candidate); err != nil || got != target {
+		return nil, fmt.Errorf("downloaded binary reports version %q, expected %s", got, target)
+	}
+
+	configPath := xu.xrayManager.ConfigPath()
+	migrated, applied, err := migrateXrayConfigFile(configPath, previous, target)
+	if err != nil {
+		return nil, err
+	}
+	result.Migrations = applied
+
+	testConfig := migrated
+	if testConfig == nil {
+		if testConfig, err = os.ReadFile(configPath); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read config: %w", err)
+		}
+	}
+	if testConfig != nil {
+		// The test runs on a decrypted copy inside the private work directory
+		if testConfig, err = openGeneratedConfig(xu.config, configPath, testConfig); err != nil {
+			return nil, err
+		}
+		testPath := filepath.Join(workDir, "config.json")
+		if err := os.WriteFile(testPath, testConfig, 0600); err != nil {
+			return nil, fmt.Errorf("failed to write test config: %w", err)
+		}
+		if err := xrayTestConfig(ctx, candidate, testPath, workDir); err != nil {
+			return nil, fmt.Errorf("config is not compatible with %s: %w", target, err)
+		}
+	}
+
+	status, err := xu.xrayManager.GetXrayStatus()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get xray status: %w", err)
+	}
+	wasRunning, _ := status["running"].(bool)
+
+	backup := binaryPath + ".prev"
+	if err := copyFile(binaryPath, backup, 0755); err != nil {
+		return nil, fmt.Errorf("failed to back up current binary: %w", err)
+	}
+	configBackup := ""
+	if migrated != nil {
+		configBackup = configPath + ".prev"
+		if err := copyFile(configPath, configBackup, 0644); err != nil {
+			return nil, fmt.Errorf("failed to back up current config: %w", err)
+		}
+		if err := writeGeneratedConfig(xu.config, configPath, migrated); err != nil {
+			return nil, fmt.Errorf("failed to write migrated config: %w", err)
+		}
+		xu.logger.Infof("Migrated Xray config for %s: %s", target, strings.Join(applied, "; "))
+	}
+	if err := os.Rename(candidate, binaryPath); err != nil {
+		xu.restoreConfig(configBackup, configPath)
+		return nil, fmt.Errorf("failed to install new binary: %w", err)
+	}
+	// Newer geo databases stay readable by older releases, so they are not rolled back
+	if err := installXrayGeoFiles(workDir, xrayAssetDir(xu.config)); err != nil {
+		xu.logger.Warnf("Failed to install Xray geo files: %v", err)
+	}
+
+	if healthErr := xu.restartAndCheck(ctx, wasRunning, target, configPath); healthErr != nil {
+		xu.logger.Errorf("Xray %s failed health checks, rolling back to %s: %v", target, previous, healthErr)
+		if err := xu.rollback(backup, configBackup, configPath, wasRunning); err != nil {
+			return result, fmt.Errorf("health check failed (%v) and rollback failed: %w", healthErr, err)
+		}
+		result.RolledBack = true
+		return result, fmt.Errorf("health check failed, rolled back to %s: %w", previous, healthErr)
+	}
+
+	result.InstalledVersion = target
+	xu.logger.Infof("Xray upgraded to %s", target)
+	return result, nil
+}
+
+func (xu *XrayUpdaterImpl) targetVersion(ctx context.Context, version string) (string, error) {
+	if version == "" {
+		version = xu.config.Xray.Version
+	}
+	if version == "" {
+		latest, err := latestXrayRelease(ctx, xu.client, xu.artifacts)
+		if err != nil {
+			return "", fmt.Errorf("failed to get latest release: %w", err)
+		}
+		version = latest
+	}
+	version = normalizeXrayVersion(version)
+	if !xrayVersionPattern.MatchString(version) {
+		return "", fmt.Errorf("invalid xray version %q", version)
+	}
+	return version, nil
+}
+
+// restartAndCheck restarts a server that was running and requires it to stay up for the
+// health check period
+func (xu *XrayUpdaterImpl) restartAndCheck(ctx context.Context, wasRunning bool, target, configPath string) error {
+	if got, err := xrayBinaryVersion(xrayBinaryPath(xu.config)); err != nil || got != target {
+		return fmt.Errorf("installed binary reports version %q", got)
+	}
+	if !wasRunning {
+		return nil
+	}
+	if err := xu.xrayManager.RestartXray(configPath); err != nil {
+		return fmt.Errorf("failed to restart: %w", err)
+	}
+
+	period := time.Duration(xu.config.Xray.UpgradeHealthCheck) * time.Second
+	if period <= 0 {
+		period = defaultHealthCheckTime
+	}
+	deadline := time.Now().Add(period)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(healthCheckPollPeriod):
+		}
+
+		status, err := xu.xrayManager.GetXrayStatus()
+		if err != nil {
+			return err
+		}
+		if running, _ := status["running"].(bool); !running {
+			return fmt.Errorf("server is not running")
+		}
+		if time.Now().After(deadline) {
+			return nil
+		}
+	}
+}
+
+func (xu *XrayUpdaterImpl) rollback(backup, configBackup, configPath string, wasRunning bool) error {
+	if err := os.Rename(backup, xrayBinaryPath(xu.config)); err != nil {
+		return fmt.Errorf("failed to restore previous binary: %w", err)
+	}
+	xu.restoreConfig(configBackup, configPath)
+	if !wasRunning {
+		return nil
+	}
+	return xu.xrayManager.RestartXray(configPath)
+}
+
+func (xu *XrayUpdaterImpl) restoreConfig(configBackup, configPath string) {
+	if configBackup == "" {
+		return
+	}
+	if err := os.Rename(configBackup, configPath); err != nil {
+		xu.logger.Errorf("Failed to restore previous Xray config from %s: %v", configBackup, err)
+	}
+}
+
+func xrayBinaryPath(cfg *config.Config) string {
+	if cfg.Xray.BinaryPath != "" {
+		return cfg.Xray.BinaryPath
+	}
+	return "/usr/local/bin/xray"
+}
+
+func xrayAssetDir(cfg *config.Config) string {
+	if cfg.Xray.AssetDir != "" {
+		return cfg.Xray.AssetDir
+	}
+	return "/usr/local/share/xray"
+}
+
+// latestXrayRelease returns the newest GitHub release, or the artifact store's default
+// when artifacts is set
+func latestXrayRelease(ctx context.Context, client *http.Client, artifacts *artifactStore) (string, error) {
+	if artifacts != nil {
+		return artifacts.latest(ctx, "xray")
+	}
+	return latestReleaseTag(ctx, client, xrayRepository)
+}
+
+// downloadXrayRelease fetches the release archive for this architecture, checks it against
+// the SHA-256 in its .dgst file, or the store listing when artifacts is set, and unpacks
+// the binary and geo files into dir
+func downloadXrayRelease(ctx context.Context, client *http.Client, artifacts *artifactStore, version, dir string) error {
+	arch, ok := xrayReleaseArch[runtime.GOARCH]
+	if !ok || runtime.GOOS != "linux" {
+		return fmt.Errorf("no xray release for %s/%s", runtime.GOOS, runtime.GOARCH)
+	}
+	asset := "Xray-linux-" + arch + ".zip"
+	archive := filepath.Join(dir, asset)
+	defer os.Remove(archive)
+
+	if artifacts != nil {
+		if err := artifacts.download(ctx, "xray/"+version+"/"+asset, archive); err != nil {
+			return err
+		}
+	} else {
+		base := fmt.Sprintf("https://github.com/%s/releases/download/%s/", xrayRepository, version)
+
+		digests, err := fetch(ctx, client, base+asset+".dgst")
+		if err != nil {
+			return fmt.Errorf("failed to download release digest: %w", err)
+		}
+		expected := xrayDigestSHA256(string(digests))
+		if expected == "" {
+			return fmt.Errorf("release %s lists no SHA-256 for %s", version, asset)
+		}
+		if err := downloadVerified(ctx, client, base+asset, expected, archive); err != nil {
+			return fmt.Errorf("failed to download %s: %w", asset, err)
+		}
+	}
+
+	files := map[string]os.FileMode{"xray": 0755}
+	for _, name := range xrayGeoFiles {
+		files[name] = 0644
+	}
+	if err := extractZipFiles(archive, dir, files); err != nil {
+		return fmt.Errorf("failed to unpack %s: %w", asset, err)
+	}
+	return nil
+}
+
+// installXrayGeoFiles copies the geo databases unpacked in dir to the asset directory,
+// where Xray looks for them when they are not next to the binary
+func installXrayGeoFiles(dir, assetDir string) error {
+	if err := os.MkdirAll(assetDir, 0755); err != nil {
+		return err
+	}
+	for _, name := range xrayGeoFiles {
+		tmp := filepath.Join(assetDir, name+".new")
+		if err := copyFile(filepath.Join(dir, name), tmp, 0644); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		if err := os.Rename(tmp, filepath.Join(assetDir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// xrayTestConfig loads configPath with "xray run -test", which builds every inbound,
+// outbound and routing rule without starting the server
+func xrayTestConfig(ctx context.Context, binary, configPath, assetDir string) error {
+	ctx, cancel := context.WithTimeout(ctx, xrayConfigTestTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, binary, "run", "-test", "-c", configPath)
+	cmd.Env = append(os.Environ(), "XRAY_LOCATION_ASSET="+assetDir)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, lastLine(string(output)))
+	}
+	return nil
+}
+
+// migrateXrayConfigFile applies the migrations between from and to to the config at path.
+// It returns nil data when the config is missing or nothing needed rewriting.
+func migrateXrayConfigFile(path, from, to string) ([]byte, []string, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	var serverConfig map[string]interface{}
+	if err := json.Unmarshal(data, &serverConfig); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+
+	applied := migrateXrayConfig(serverConfig, from, to)
+	if len(applied) == 0 {
+		return nil, nil, nil
+	}
+	migrated, err := json.MarshalIndent(serverConfig, "", "  ")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal migrated config: %w", err)
+	}
+	return migrated, applied, nil
+}
+
+// migrateXrayConfig applies in place the migrations introduced after from and up to to,
+// returning the descriptions of those that changed the config. Downgrades migrate nothing.
+func migrateXrayConfig(serverConfig map[string]interface{}, from, to string) []string {
+	var applied []string
+	for _, migration := range xrayConfigMigrations {
+		if compareXrayVersions(migration.since, from) <= 0 || compareXrayVersions(migration.since, to) > 0 {
+			continue
+		}
+		if migration.apply(serverConfig) {
+			applied = append(applied, migration.since+": "+migration.description)
+		}
+	}
+	return applied
+}
+
+// migrateLegacyXTLS rewrites inbounds using the XTLS security layer and the
+// xtls-rprx-origin, -direct and -splice flows, all removed in v1.8.0, to TLS with the
+// vision flow that replaced them
+func migrateLegacyXTLS(serverConfig map[string]interface{}) bool {
+	inbounds, _ := serverConfig["inbounds"].([]interface{})
+	changed := false
+	for _, item := range inbounds {
+		inbound, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		if stream, ok := inbound["streamSettings"].(map[string]interface{}); ok && stream["security"] == "xtls" {
+			stream["security"] = "tls"
+			if xtlsSettings, ok := stream["xtlsSettings"]; ok {
+				if _, exists := stream["tlsSettings"]; !exists {
+					stream["tlsSettings"] = xtlsSettings
+				}
+				delete(stream, "xtlsSettings")
+			}
+			changed = true
+		}
+
+		settings, _ := inbound["settings"].(map[string]interface{})
+		clients, _ := settings["clients"].([]interface{})
+		for _, c := range clients {
+			client, ok := c.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			flow, _ := client["flow"].(string)
+			if strings.HasPrefix(flow, "xtls-rprx-") && !strings.HasPrefix(flow, "xtls-rprx-vision") {
+				client["flow"] = "xtls-rprx-vision"
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// compareXrayVersions orders "vX.Y.Z" versions numerically
+func compareXrayVersions(a, b string) int {
+	pa := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	pb := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var na, nb int
+		if i < len(pa) {
+			na, _ = strconv.Atoi(pa[i])
+		}
+		if i < len(pb) {
+			nb, _ = strconv.Atoi(pb[i])
+		}
+		if na != nb {
+			if na < nb {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// normalizeXrayVersion turns "25.1.30" into "v25.1.30"
+func normalizeXrayVersion(version string) string {
+	version = strings.TrimSpace(version)
+	if version != "" && !strings.HasPrefix(version, "v") {
+		version = "v" + version
+	}
+	return version
+}
+
+// xrayBinaryVersion runs "<binary> version", whose first line reads
+// "Xray 25.1.30 (Xray, Penetrates Everything.) ...", and returns "v25.1.30"
+func xrayBinaryVersion(binary string) (string, error) {
+	if _, err := os.Stat(binary); err != nil {
+		return "", err
+	}
+	output, err := exec.Command(binary, "version").Output()
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(output))
+	if len(fields) < 2 || fields[0] != "Xray" {
+		return "", fmt.Errorf("no version in output of %s version", filepath.Base(binary))
+	}
+	return normalizeXrayVersion(fields[1]), nil
+}
+
+// xrayDigestSHA256 reads the SHA-256 from a release .dgst file, which holds openssl dgst
+// lines such as "SHA2-256= <hex>"
+func xrayDigestSHA256(digests string) string {
+	for _, line := range strings.Split(digests, "\n") {
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "SHA2-256", "SHA256":
+			return strings.ToLower(strings.TrimSpace(value))
+		}
+	}
+	return ""
+}
+
+// extractZipFiles unpacks the top-level entries named in files into dir with the given
+// modes, failing if any of them is missing from the archive
+func extractZipFiles(archive, dir string, files map[string]os.FileMode) error {
+	r, err := zip.OpenReader(archive)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	found := 0
+	for _, f := range r.File {
+		mode, ok := files[f.Name]
+		if !ok {
+			continue
+		}
+		if err := extractZipFile(f, filepath.Join(dir, f.Name), mode); err != nil {
+			return fmt.Errorf("%s: %w", f.Name, err)
+		}
+		found++
+	}
+	if found != len(files) {
+		return fmt.Errorf("archive is missing expected files")
+	}
+	return nil
+}
+
+func extractZipFile(f *zip.File, dest string, mode os.FileMode) error {
+	in, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,194 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"hysteria2_microservices/agent-service/internal/config"
+)
+
+const legacyXrayConfig = `{
+  "inbounds": [{
+    "protocol": "vless",
+    "settings": {"clients": [{"id": "c0ffee00-0000-4000-8000-000000000001", "flow": "xtls-rprx-direct"}]},
+    "streamSettings": {"security": "xtls", "xtlsSettings": {"certificates": [{"certificateFile": "/etc/xray/cert.pem"}]}}
+  }]
+}`
+
+type upgradeXray struct {
+	XrayManager
+	*fakeService
+	configPath string
+}
+
+func (x *upgradeXray) ConfigPath() string                             { return x.configPath }
+func (x *upgradeXray) GetXrayStatus() (map[string]interface{}, error) { return x.status() }
+func (x *upgradeXray) RestartXray(configPath string) error            { return x.restart() }
+
+// fakeXrayRelease builds a release archive whose binary reports version and runs its
+// config test with testExit
+func fakeXrayRelease(t *testing.T, version, testExit string) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	files := map[string]string{
+		"xray": "#!/bin/sh\ncase \"$1\" in\n" +
+			"version) echo 'Xray " + version + " (Xray, Penetrates Everything.) Custom (go1.22 linux/amd64)' ;;\n" +
+			"run) echo 'Failed to start: unknown security xtls'; exit " + testExit + " ;;\nesac\n",
+		"geoip.dat":   "geoip " + version,
+		"geosite.dat": "geosite " + version,
+		"README.md":   "not extracted",
+	}
+	for name, content := range files {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(content))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func xrayReleaseArtifact(version string) string {
+	return "xray/" + version + "/Xray-linux-" + xrayReleaseArch[runtime.GOARCH] + ".zip"
+}
+
+func newTestXrayUpdater(t *testing.T, running bool) (*XrayUpdaterImpl, *fakeArtifactStore, *upgradeXray) {
+	if _, ok := xrayReleaseArch[runtime.GOARCH]; !ok || runtime.GOOS != "linux" {
+		t.Skip("no Xray release for this platform")
+	}
+	dir := t.TempDir()
+	cfg := &config.Config{}
+	store := useArtifactStore(t, cfg)
+	cfg.Xray.BinaryPath = filepath.Join(dir, "xray")
+	cfg.Xray.AssetDir = filepath.Join(dir, "share")
+	cfg.Xray.UpgradeHealthCheck = 1
+	if err := os.WriteFile(cfg.Xray.BinaryPath, fakeBinary("Xray 1.7.5 (Xray, Penetrates Everything.)"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	xray := &upgradeXray{fakeService: &fakeService{running: running}, configPath: filepath.Join(dir, "config.json")}
+	if err := os.WriteFile(xray.configPath, []byte(legacyXrayConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return NewXrayUpdater(testLogger(), cfg, xray).(*XrayUpdaterImpl), store, xray
+}
+
+func TestXrayUpgradeMigratesConfig(t *testing.T) {
+	xu, store, xray := newTestXrayUpdater(t, false)
+	store.put(xrayReleaseArtifact("v1.8.4"), fakeXrayRelease(t, "1.8.4", "0"))
+
+	result, err := xu.Upgrade(context.Background(), "1.8.4")
+	if err != nil {
+		t.Fatalf("Upgrade: %v", err)
+	}
+	if result.PreviousVersion != "v1.7.5" || result.InstalledVersion != "v1.8.4" || len(result.Migrations) != 1 {
+		t.Errorf("result %+v, want v1.7.5 upgraded to v1.8.4 with the XTLS migration", result)
+	}
+
+	data, _ := os.ReadFile(xray.configPath)
+	var migrated struct {
+		Inbounds []struct {
+			Settings struct {
+				Clients []struct {
+					Flow string `json:"flow"`
+				} `json:"clients"`
+			} `json:"settings"`
+			StreamSettings map[string]interface{} `json:"streamSettings"`
+		} `json:"inbounds"`
+	}
+	if err := json.Unmarshal(data, &migrated); err != nil {
+		t.Fatalf("migrated config: %v", err)
+	}
+	inbound := migrated.Inbounds[0]
+	if inbound.Settings.Clients[0].Flow != "xtls-rprx-vision" || inbound.StreamSettings["security"] != "tls" || inbound.StreamSettings["tlsSettings"] == nil {
+		t.Errorf("migrated config %s", data)
+	}
+	if _, ok := inbound.StreamSettings["xtlsSettings"]; ok {
+		t.Error("xtlsSettings kept after the migration")
+	}
+	if prev, _ := os.ReadFile(xray.configPath + ".prev"); string(prev) != legacyXrayConfig {
+		t.Error("previous config not kept")
+	}
+
+	if geo, _ := os.ReadFile(filepath.Join(xu.config.Xray.AssetDir, "geosite.dat")); string(geo) != "geosite 1.8.4" {
+		t.Errorf("geosite.dat = %q, want the release's", geo)
+	}
+	if got, _ := xrayBinaryVersion(xu.config.Xray.BinaryPath); got != "v1.8.4" {
+		t.Errorf("installed binary reports %s", got)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(xu.config.Xray.BinaryPath), "README.md")); !os.IsNotExist(err) {
+		t.Error("extracted a file outside the expected set")
+	}
+}
+
+func TestXrayUpgradeRejectsIncompatibleConfig(t *testing.T) {
+	xu, store, xray := newTestXrayUpdater(t, false)
+
+	store.put(xrayReleaseArtifact("v1.8.4"), fakeXrayRelease(t, "1.8.4", "1"))
+	_, err := xu.Upgrade(context.Background(), "v1.8.4")
+	if err == nil || !strings.Contains(err.Error(), "unknown security xtls") {
+		t.Errorf("Upgrade with a failing config test = %v, want the test output", err)
+	}
+
+	store.put(xrayReleaseArtifact("v1.8.5"), fakeXrayRelease(t, "1.8.5", "0"))
+	store.tamper(xrayReleaseArtifact("v1.8.5"))
+	if _, err := xu.Upgrade(context.Background(), "v1.8.5"); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("Upgrade with a tampered archive = %v, want a checksum mismatch", err)
+	}
+
+	// Nothing was replaced
+	if got, _ := xrayBinaryVersion(xu.config.Xray.BinaryPath); got != "v1.7.5" {
+		t.Errorf("installed binary reports %s", got)
+	}
+	if data, _ := os.ReadFile(xray.configPath); string(data) != legacyXrayConfig {
+		t.Error("config rewritten by a rejected upgrade")
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(filepath.Dir(xray.configPath), ".xray-upgrade-*")); len(leftovers) != 0 {
+		t.Errorf("work directories left behind: %v", leftovers)
+	}
+}
+
+func TestMigrateXrayConfigVersions(t *testing.T) {
+	tests := []struct {
+		from, to string
+		want     int
+	}{
+		{"v1.7.5", "v1.8.4", 1},
+		{"v1.7.5", "v1.8.0", 1},
+		{"v1.8.0", "v25.1.30", 0},
+		{"v1.8.4", "v1.7.5", 0},
+	}
+	for _, tt := range tests {
+		var serverConfig map[string]interface{}
+		json.Unmarshal([]byte(legacyXrayConfig), &serverConfig)
+		if applied := migrateXrayConfig(serverConfig, tt.from, tt.to); len(applied) != tt.want {
+			t.Errorf("%s to %s applied %v, want %d migrations", tt.from, tt.to, applied, tt.want)
+		}
+	}
+
+	if compareXrayVersions("v1.10.0", "v1.9.9") != 1 || compareXrayVersions("v1.8", "v1.8.0") != 0 {
+		t.Error("versions are not compared numerically")
+	}
+}
+
+func TestXrayDigestSHA256(t *testing.T) {
+	digests := "MD5= 0123\nSHA1= 4567\nSHA2-256= ABCDEF0123\nSHA2-512= 89ab\n"
+	if got := xrayDigestSHA256(digests); got != "abcdef0123" {
+		t.Errorf("xrayDigestSHA256 = %q", got)
+	}
+	if got := xrayDigestSHA256("MD5= 0123\n"); got != "" {
+		t.Errorf("xrayDigestSHA256 without SHA-256 = %q", got)
+	}
+	if normalizeXrayVersion(" 25.1.30 ") != "v25.1.30" {
+		t.Error("version not normalised")
+	}
+}
@@ -0,0 +1,139 @@
+// Package tunnel opens the agent's end of the tunnel to the orchestrator, for nodes behind
+// NAT or firewalls the orchestrator cannot dial. The agent keeps a control stream open and
+// opens a data stream for every connection the orchestrator asks for, serving the
+// NodeManager over it as if it were TCP.
+package tunnel
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"hysteria2_microservices/pkg/tunnelconn"
+)
+
+const (
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+)
+
+// ControlStream delivers the dials of the orchestrator
+type ControlStream interface {
+	// Recv returns the connection ID of the next dial
+	Recv() (string, error)
+}
+
+// Transport opens the streams of the tunnel to the orchestrator
+type Transport interface {
+	// Control opens the control stream of the tunnel
+	Control(ctx context.Context) (ControlStream, error)
+	// Data opens the data stream answering dial connID; closeFn ends it
+	Data(ctx context.Context, connID string) (stream tunnelconn.Stream, closeFn func() error, err error)
+}
+
+// Client holds the tunnel open, reconnecting with backoff whenever it drops, and is the
+// net.Listener of the connections the orchestrator dials over it
+type Client struct {
+	transport Transport
+	logger    *logrus.Logger
+
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewClient returns a Client opening the tunnel over transport
+func NewClient(transport Transport, logger *logrus.Logger) *Client {
+	return &Client{
+		transport: transport,
+		logger:    logger,
+		conns:     make(chan net.Conn),
+		closed:    make(chan struct{}),
+	}
+}
+
+// Run holds the tunnel open until ctx is cancelled
+func (c *Client) Run(ctx context.Context) error {
+	backoff := minBackoff
+	for {
+		started := time.Now()
+		err := c.serve(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		// A tunnel that stayed up a while was not refused; reconnect promptly
+		if time.Since(started) > maxBackoff {
+			backoff = minBackoff
+		}
+		c.logger.Warnf("Tunnel to master server closed, reconnecting in %s: %v", backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-c.closed:
+			return nil
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// serve opens the control stream and answers its dials until it fails
+func (c *Client) serve(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	control, err := c.transport.Control(ctx)
+	if err != nil {
+		return err
+	}
+	c.logger.Info("Tunnel to master server open")
+	for {
+		connID, err := control.Recv()
+		if err != nil {
+			return err
+		}
+		// Connections outlive the control stream that dialed them
+		go c.open(context.WithoutCancel(ctx), connID)
+	}
+}
+
+func (c *Client) open(ctx context.Context, connID string) {
+	stream, closeFn, err := c.transport.Data(ctx, connID)
+	if err != nil {
+		c.logger.Warnf("Failed to answer tunnel dial %s: %v", connID, err)
+		return
+	}
+	conn := tunnelconn.NewConn(stream, tunnelconn.Addr("agent"), tunnelconn.Addr("orchestrator"), closeFn)
+	select {
+	case c.conns <- conn:
+	case <-c.closed:
+		conn.Close()
+	}
+}
+
+// Accept returns the next connection the orchestrator dialed
+func (c *Client) Accept() (net.Conn, error) {
+	select {
+	case conn := <-c.conns:
+		return conn, nil
+	case <-c.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting connections; Run returns at its next reconnect
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *Client) Addr() net.Addr {
+	return tunnelconn.Addr("tunnel")
+}
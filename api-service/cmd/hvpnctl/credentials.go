@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"hysteria2_microservices/api-service/pkg/apiclient"
+)
+
+// credentials are what login saves: the server signed in to and its tokens
+type credentials struct {
+	Server string           `json:"server"`
+	Email  string           `json:"email"`
+	Tokens apiclient.Tokens `json:"tokens"`
+}
+
+func defaultCredentialsFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ".hvpnctl-credentials.json"
+	}
+	return filepath.Join(dir, "hvpnctl", "credentials.json")
+}
+
+func login(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("login", flag.ExitOnError)
+	email := fs.String("email", os.Getenv("HVPN_EMAIL"), "admin email")
+	passwordStdin := fs.Bool("password-stdin", false, "read the password from stdin")
+	fs.Parse(args)
+
+	server := *serverURL
+	if server == "" {
+		if saved, err := loadCredentials(); err == nil {
+			server = saved.Server
+		}
+	}
+	if server == "" {
+		fmt.Fprintln(os.Stderr, "login needs -server or HVPN_SERVER")
+		os.Exit(2)
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+	if *email == "" {
+		*email = prompt(reader, "Email: ")
+	}
+	password := os.Getenv("HVPN_PASSWORD")
+	switch {
+	case *passwordStdin:
+		password = readLine(reader)
+	case password == "":
+		password = prompt(reader, "Password: ")
+	}
+
+	client := apiclient.NewClient(server)
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	user, err := client.Login(ctx, *email, password)
+	exitOnError(err)
+	if user.Role != "admin" {
+		fmt.Fprintf(os.Stderr, "warning: %s is not an admin, most commands will be refused\n", user.Email)
+	}
+
+	exitOnError(saveCredentials(credentials{Server: server, Email: user.Email, Tokens: client.Tokens()}))
+	fmt.Printf("signed in to %s as %s\n", server, user.Email)
+}
+
+// signedIn returns a client with the saved tokens, saving them again whenever they are
+// refreshed
+func signedIn() *apiclient.Client {
+	saved, err := loadCredentials()
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Fprintln(os.Stderr, "not signed in, run hvpnctl login")
+		os.Exit(1)
+	}
+	exitOnError(err)
+	if *serverURL != "" && strings.TrimRight(*serverURL, "/") != strings.TrimRight(saved.Server, "/") {
+		fmt.Fprintf(os.Stderr, "signed in to %s, run hvpnctl login for %s\n", saved.Server, *serverURL)
+		os.Exit(1)
+	}
+
+	client := apiclient.NewClient(saved.Server)
+	client.SetTokens(saved.Tokens)
+	client.OnRefresh(func(tokens apiclient.Tokens) {
+		saved.Tokens = tokens
+		if err := saveCredentials(*saved); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: failed to save refreshed tokens: %v\n", err)
+		}
+	})
+	return client
+}
+
+func loadCredentials() (*credentials, error) {
+	data, err := os.ReadFile(*credentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	var saved credentials
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("invalid credentials file %s: %w", *credentialsFile, err)
+	}
+	return &saved, nil
+}
+
+// saveCredentials writes the tokens readable by the user only
+func saveCredentials(saved credentials) error {
+	if err := os.MkdirAll(filepath.Dir(*credentialsFile), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(*credentialsFile, data, 0600)
+}
+
+func removeCredentials() error {
+	if err := os.Remove(*credentialsFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func prompt(reader *bufio.Reader, label string) string {
+	fmt.Fprint(os.Stderr, label)
+	return readLine(reader)
+}
+
+func readLine(reader *bufio.Reader) string {
+	line, err := reader.ReadString('\n')
+	if err != nil && line == "" {
+		exitOnError(fmt.Errorf("failed to read stdin: %w", err))
+	}
+	return strings.TrimRight(line, "\r\n")
+}
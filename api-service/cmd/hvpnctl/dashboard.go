@@ -0,0 +1,499 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"hysteria2_microservices/api-service/pkg/apiclient"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+const (
+	// dashboardWorkers bounds the node metrics and sessions requests in flight per refresh
+	dashboardWorkers = 8
+	// maxAlerts is how many recent alerts the dashboard remembers
+	maxAlerts = 50
+	// streamRetry is how long to wait before reconnecting a dropped alert stream
+	streamRetry = 5 * time.Second
+)
+
+var (
+	titleStyle    = lipgloss.NewStyle().Bold(true)
+	headerStyle   = lipgloss.NewStyle().Bold(true).Faint(true)
+	selectedStyle = lipgloss.NewStyle().Reverse(true)
+	faintStyle    = lipgloss.NewStyle().Faint(true)
+	upStyle       = lipgloss.NewStyle().Foreground(lipgloss.Color("6"))
+	downStyle     = lipgloss.NewStyle().Foreground(lipgloss.Color("5"))
+
+	statusStyles = map[string]lipgloss.Style{
+		"online":      lipgloss.NewStyle().Foreground(lipgloss.Color("2")),
+		"offline":     lipgloss.NewStyle().Foreground(lipgloss.Color("1")),
+		"error":       lipgloss.NewStyle().Foreground(lipgloss.Color("1")),
+		"maintenance": lipgloss.NewStyle().Foreground(lipgloss.Color("3")),
+	}
+	severityStyles = map[string]lipgloss.Style{
+		"critical": lipgloss.NewStyle().Foreground(lipgloss.Color("1")).Bold(true),
+		"warning":  lipgloss.NewStyle().Foreground(lipgloss.Color("3")),
+		"info":     lipgloss.NewStyle().Foreground(lipgloss.Color("4")),
+	}
+)
+
+// dashboard shows the fleet live in the terminal: node health, online users, bandwidth
+// graphs from the nodes' metrics and recent alerts. Nodes are polled every refresh; alerts
+// arrive over the WebSocket, along with the node status changes seen between polls.
+func dashboard(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("dashboard", flag.ExitOnError)
+	refresh := fs.Duration("refresh", 10*time.Second, "how often to poll the nodes")
+	history := fs.Int("history", 60, "metrics per node to graph, up to 1000")
+	fs.Parse(args)
+	if *refresh <= 0 || *history < 1 || *history > 1000 {
+		fmt.Fprintln(os.Stderr, "dashboard needs a positive -refresh and -history between 1 and 1000")
+		os.Exit(2)
+	}
+
+	client := signedIn()
+	saved, err := loadCredentials()
+	exitOnError(err)
+
+	model := &dashboardModel{
+		client:  client,
+		server:  saved.Server,
+		refresh: *refresh,
+		history: *history,
+	}
+	program := tea.NewProgram(model, tea.WithAltScreen(), tea.WithContext(ctx))
+	go streamAlerts(ctx, client, program)
+
+	if _, err := program.Run(); err != nil && ctx.Err() == nil {
+		exitOnError(err)
+	}
+}
+
+// streamAlerts forwards the alerts room to the dashboard, reconnecting until ctx is done
+func streamAlerts(ctx context.Context, client *apiclient.Client, program *tea.Program) {
+	for {
+		err := client.Stream(ctx, []string{"alerts"}, func(msg apiclient.StreamMessage) {
+			if msg.Type != "alert" {
+				return
+			}
+			var alert apiclient.Alert
+			if err := json.Unmarshal(msg.Data, &alert); err != nil {
+				return
+			}
+			at := msg.Timestamp
+			if at.IsZero() {
+				at = time.Now()
+			}
+			program.Send(alertMsg{at: at, alert: alert})
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		program.Send(streamErrMsg{err: err})
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(streamRetry):
+		}
+	}
+}
+
+// nodeView is a node as of the last poll. Metrics are oldest first.
+type nodeView struct {
+	node     apiclient.Node
+	metrics  []apiclient.NodeMetric
+	sessions []apiclient.Session
+	err      error
+}
+
+func (v nodeView) latest() *apiclient.NodeMetric {
+	if len(v.metrics) == 0 {
+		return nil
+	}
+	return &v.metrics[len(v.metrics)-1]
+}
+
+type dashboardAlert struct {
+	at    time.Time
+	alert apiclient.Alert
+}
+
+type (
+	snapshotMsg struct {
+		nodes []nodeView
+		at    time.Time
+		err   error
+	}
+	tickMsg      struct{ generation int }
+	alertMsg     dashboardAlert
+	streamErrMsg struct{ err error }
+)
+
+type dashboardModel struct {
+	client  *apiclient.Client
+	server  string
+	refresh time.Duration
+	history int
+
+	nodes     []nodeView
+	selected  int
+	alerts    []dashboardAlert // newest first
+	updated   time.Time
+	err       error
+	streamErr error
+	loading   bool
+	// generation drops ticks scheduled before a manual refresh, so polls never double up
+	generation int
+
+	width, height int
+}
+
+func (m *dashboardModel) Init() tea.Cmd {
+	m.loading = true
+	return m.poll
+}
+
+func (m *dashboardModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width, m.height = msg.Width, msg.Height
+
+	case tea.KeyMsg:
+		switch msg.String() {
+		case "q", "ctrl+c", "esc":
+			return m, tea.Quit
+		case "j", "down":
+			if m.selected < len(m.nodes)-1 {
+				m.selected++
+			}
+		case "k", "up":
+			if m.selected > 0 {
+				m.selected--
+			}
+		case "r":
+			if !m.loading {
+				m.loading = true
+				return m, m.poll
+			}
+		}
+
+	case tickMsg:
+		if msg.generation == m.generation && !m.loading {
+			m.loading = true
+			return m, m.poll
+		}
+
+	case snapshotMsg:
+		m.loading = false
+		m.generation++
+		m.err = msg.err
+		if msg.err == nil {
+			m.noteStatusChanges(msg.nodes, msg.at)
+			m.setNodes(msg.nodes)
+			m.updated = msg.at
+		}
+		generation := m.generation
+		return m, tea.Tick(m.refresh, func(time.Time) tea.Msg { return tickMsg{generation: generation} })
+
+	case alertMsg:
+		m.streamErr = nil
+		m.addAlert(dashboardAlert(msg))
+
+	case streamErrMsg:
+		m.streamErr = msg.err
+	}
+	return m, nil
+}
+
+// poll fetches the nodes, then each node's metrics and sessions
+func (m *dashboardModel) poll() tea.Msg {
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	var nodes []apiclient.Node
+	for page := 1; ; page++ {
+		list, err := m.client.ListNodes(ctx, apiclient.NodeFilter{Page: page, Limit: 100})
+		if err != nil {
+			return snapshotMsg{err: err}
+		}
+		nodes = append(nodes, list.Nodes...)
+		if len(list.Nodes) == 0 || int64(len(nodes)) >= list.Total {
+			break
+		}
+	}
+
+	views := make([]nodeView, len(nodes))
+	sem := make(chan struct{}, dashboardWorkers)
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		wg.Add(1)
+		go func(i int, node apiclient.Node) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			view := nodeView{node: node}
+			metrics, err := m.client.GetNodeMetrics(ctx, node.ID, m.history)
+			if err != nil {
+				view.err = err
+			}
+			// Metrics come newest first; the graphs run left to right
+			for j := len(metrics) - 1; j >= 0; j-- {
+				view.metrics = append(view.metrics, metrics[j])
+			}
+			if view.sessions, err = m.client.GetNodeSessions(ctx, node.ID); err != nil && view.err == nil {
+				view.err = err
+			}
+			views[i] = view
+		}(i, node)
+	}
+	wg.Wait()
+
+	sort.Slice(views, func(i, j int) bool { return views[i].node.Name < views[j].node.Name })
+	return snapshotMsg{nodes: views, at: time.Now()}
+}
+
+// setNodes replaces the nodes, keeping the same node selected when it is still there
+func (m *dashboardModel) setNodes(nodes []nodeView) {
+	selectedID := ""
+	if m.selected < len(m.nodes) {
+		selectedID = m.nodes[m.selected].node.ID
+	}
+	m.nodes = nodes
+	m.selected = 0
+	for i, view := range nodes {
+		if view.node.ID == selectedID {
+			m.selected = i
+		}
+	}
+}
+
+// noteStatusChanges raises an alert for every node whose status changed since the last poll
+func (m *dashboardModel) noteStatusChanges(nodes []nodeView, at time.Time) {
+	previous := make(map[string]string, len(m.nodes))
+	for _, view := range m.nodes {
+		previous[view.node.ID] = view.node.Status
+	}
+	for _, view := range nodes {
+		was, known := previous[view.node.ID]
+		if !known || was == view.node.Status {
+			continue
+		}
+		severity := "info"
+		switch view.node.Status {
+		case "offline", "error":
+			severity = "critical"
+		case "maintenance":
+			severity = "warning"
+		}
+		m.addAlert(dashboardAlert{at: at, alert: apiclient.Alert{
+			Severity: severity,
+			Code:     "NODE_" + strings.ToUpper(view.node.Status),
+			Message:  fmt.Sprintf("%s went from %s to %s", view.node.Name, was, view.node.Status),
+		}})
+	}
+}
+
+func (m *dashboardModel) addAlert(alert dashboardAlert) {
+	m.alerts = append([]dashboardAlert{alert}, m.alerts...)
+	if len(m.alerts) > maxAlerts {
+		m.alerts = m.alerts[:maxAlerts]
+	}
+}
+
+func (m *dashboardModel) View() string {
+	var b strings.Builder
+
+	status := "updated " + m.updated.Local().Format(time.TimeOnly)
+	switch {
+	case m.updated.IsZero():
+		status = "loading..."
+	case m.loading:
+		status += ", refreshing..."
+	}
+	fmt.Fprintf(&b, "%s  %s\n", titleStyle.Render("hvpnctl dashboard "+m.server), faintStyle.Render(status))
+	if m.err != nil {
+		b.WriteString(severityStyles["critical"].Render(describeError(m.err)) + "\n")
+	}
+	b.WriteString("\n")
+
+	b.WriteString(m.viewFleet())
+	b.WriteString("\n")
+	b.WriteString(m.viewNodes())
+	b.WriteString("\n")
+	b.WriteString(m.viewGraphs())
+	b.WriteString("\n")
+	b.WriteString(m.viewAlerts(m.alertRows(b.String())))
+	b.WriteString(faintStyle.Render("j/k select  r refresh  q quit"))
+	return b.String()
+}
+
+func (m *dashboardModel) viewFleet() string {
+	online, connections := 0, 0
+	var up, down int64
+	users := make(map[string]bool)
+	for _, view := range m.nodes {
+		if view.node.Status == "online" {
+			online++
+		}
+		for _, session := range view.sessions {
+			users[session.UserID] = true
+			connections += session.Connections
+		}
+		if latest := view.latest(); latest != nil {
+			up += latest.BandwidthUp
+			down += latest.BandwidthDown
+		}
+	}
+	return fmt.Sprintf("%d/%d nodes online  %d users online  %d connections  %s %s  %s %s\n",
+		online, len(m.nodes), len(users), connections,
+		upStyle.Render("↑"), formatRate(up), downStyle.Render("↓"), formatRate(down))
+}
+
+func (m *dashboardModel) viewNodes() string {
+	const row = "%-20s %-12s %-10s %6s %6s %6s %6s %12s %12s"
+
+	var b strings.Builder
+	b.WriteString(headerStyle.Render(fmt.Sprintf(row, "NAME", "STATUS", "HEARTBEAT", "CPU", "MEM", "USERS", "CONNS", "UP", "DOWN")) + "\n")
+	if len(m.nodes) == 0 && !m.updated.IsZero() {
+		b.WriteString(faintStyle.Render("no nodes") + "\n")
+	}
+	for i, view := range m.nodes {
+		cpu, mem, conns, up, down := "-", "-", "-", "-", "-"
+		if latest := view.latest(); latest != nil {
+			cpu = fmt.Sprintf("%.0f%%", latest.CPUUsage)
+			mem = fmt.Sprintf("%.0f%%", latest.MemoryUsage)
+			conns = fmt.Sprint(latest.ActiveConnections)
+			up = formatRate(latest.BandwidthUp)
+			down = formatRate(latest.BandwidthDown)
+		}
+		users := make(map[string]bool)
+		for _, session := range view.sessions {
+			users[session.UserID] = true
+		}
+
+		line := fmt.Sprintf(row, truncate(view.node.Name, 20), view.node.Status, heartbeatAge(view.node.LastHeartbeat),
+			cpu, mem, fmt.Sprint(len(users)), conns, up, down)
+		if i == m.selected {
+			line = selectedStyle.Render(line)
+		} else if style, ok := statusStyles[view.node.Status]; ok {
+			line = style.Render(line)
+		}
+		b.WriteString(line + "\n")
+	}
+	return b.String()
+}
+
+// viewGraphs draws the selected node's bandwidth, one column per heartbeat
+func (m *dashboardModel) viewGraphs() string {
+	if m.selected >= len(m.nodes) {
+		return ""
+	}
+	view := m.nodes[m.selected]
+	title := titleStyle.Render("Bandwidth " + view.node.Name)
+	if view.err != nil {
+		return title + "  " + severityStyles["warning"].Render(describeError(view.err)) + "\n"
+	}
+	if len(view.metrics) == 0 {
+		return title + "  " + faintStyle.Render("no metrics yet") + "\n"
+	}
+
+	width := m.width - 16
+	if width < 10 {
+		width = 60
+	}
+	up := make([]int64, len(view.metrics))
+	down := make([]int64, len(view.metrics))
+	var peak int64
+	for i, metric := range view.metrics {
+		up[i], down[i] = metric.BandwidthUp, metric.BandwidthDown
+		peak = max(peak, up[i], down[i])
+	}
+	return fmt.Sprintf("%s  %s\n%s %s\n%s %s\n", title, faintStyle.Render("peak "+formatRate(peak)),
+		upStyle.Render("↑"), upStyle.Render(sparkline(up, peak, width)),
+		downStyle.Render("↓"), downStyle.Render(sparkline(down, peak, width)))
+}
+
+// alertRows is how many alerts fit below what is drawn already, keeping a line for the keys
+func (m *dashboardModel) alertRows(drawn string) int {
+	if m.height == 0 {
+		return 10
+	}
+	return max(m.height-strings.Count(drawn, "\n")-3, 1)
+}
+
+func (m *dashboardModel) viewAlerts(rows int) string {
+	var b strings.Builder
+	b.WriteString(titleStyle.Render("Recent alerts"))
+	if m.streamErr != nil {
+		b.WriteString("  " + faintStyle.Render("alert stream down: "+describeError(m.streamErr)))
+	}
+	b.WriteString("\n")
+	if len(m.alerts) == 0 {
+		b.WriteString(faintStyle.Render("none") + "\n")
+	}
+	for i, alert := range m.alerts {
+		if i == rows {
+			break
+		}
+		severity := fmt.Sprintf("%-8s", alert.alert.Severity)
+		if style, ok := severityStyles[alert.alert.Severity]; ok {
+			severity = style.Render(severity)
+		}
+		fmt.Fprintf(&b, "%s %s %s\n", faintStyle.Render(alert.at.Local().Format(time.TimeOnly)), severity, alert.alert.Message)
+	}
+	return b.String()
+}
+
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// sparkline draws the last width values scaled to peak
+func sparkline(values []int64, peak int64, width int) string {
+	if len(values) > width {
+		values = values[len(values)-width:]
+	}
+	var b strings.Builder
+	for _, v := range values {
+		level := 0
+		if peak > 0 {
+			level = int(v * int64(len(sparkBlocks)-1) / peak)
+		}
+		b.WriteRune(sparkBlocks[level])
+	}
+	return b.String()
+}
+
+func heartbeatAge(at *time.Time) string {
+	if at == nil {
+		return "never"
+	}
+	return time.Since(*at).Round(time.Second).String()
+}
+
+func formatRate(bytesPerSec int64) string {
+	return formatBytes(bytesPerSec) + "/s"
+}
+
+func truncate(s string, n int) string {
+	if len([]rune(s)) <= n {
+		return s
+	}
+	return string([]rune(s)[:n-1]) + "…"
+}
+
+func describeError(err error) string {
+	if apiclient.IsUnauthorized(err) {
+		return "session expired, run hvpnctl login"
+	}
+	return err.Error()
+}
@@ -0,0 +1,455 @@
+// hvpnctl runs the API's admin tasks from a shell, so scripts do not have to juggle JWTs
+// with curl. It signs in once and keeps the tokens, refreshing them as they expire.
+//
+//	hvpnctl login [-email e] [-password-stdin]          sign in and save the tokens
+//	hvpnctl logout                                      forget the saved tokens
+//	hvpnctl users list [-search s] [-status s] [-role r] [-page n] [-limit n]
+//	hvpnctl users create -username u -email e [-password p] [-role r] [-group g] [-data-limit-gb n]
+//	hvpnctl users nodes <user-id>                       the nodes assigned to the user
+//	hvpnctl users assign|unassign <user-id> <node-id>...
+//	hvpnctl nodes list [-status s] [-location l]
+//	hvpnctl nodes push <node-id> [-check]               push the desired config to the node
+//	hvpnctl nodes logs <node-id> [-n lines] [-f] [-interval d]
+//	hvpnctl subscription <user-id> [-format f] [-o file]
+//	hvpnctl dashboard [-refresh d] [-history n]          live node health, users, bandwidth and alerts
+//
+// Global flags go before the command: -server url, or HVPN_SERVER, on login; -credentials
+// file, ~/.config/hvpnctl/credentials.json by default; -json for machine-readable output.
+// login reads the password from HVPN_PASSWORD, stdin with -password-stdin, or a prompt.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"hysteria2_microservices/api-service/pkg/apiclient"
+)
+
+var (
+	serverURL       = flag.String("server", os.Getenv("HVPN_SERVER"), "API service URL, e.g. https://vpn.example.com")
+	credentialsFile = flag.String("credentials", defaultCredentialsFile(), "file keeping the tokens")
+	jsonOut         = flag.Bool("json", false, "print JSON")
+	timeout         = flag.Duration("timeout", time.Minute, "time allowed for the command, logs -f aside")
+)
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	switch args[0] {
+	case "login":
+		login(ctx, args[1:])
+	case "logout":
+		exitOnError(removeCredentials())
+	case "users":
+		users(ctx, subcommand(args), args[2:])
+	case "nodes":
+		nodes(ctx, subcommand(args), args[2:])
+	case "subscription":
+		subscription(ctx, args[1:])
+	case "dashboard":
+		dashboard(ctx, args[1:])
+	default:
+		usage()
+	}
+}
+
+func users(ctx context.Context, command string, args []string) {
+	client := signedIn()
+	switch command {
+	case "list":
+		fs := flag.NewFlagSet("users list", flag.ExitOnError)
+		filter := apiclient.UserFilter{}
+		fs.StringVar(&filter.Search, "search", "", "username or email containing")
+		fs.StringVar(&filter.Status, "status", "", "active, suspended or deleted")
+		fs.StringVar(&filter.Role, "role", "", "admin, reseller or user")
+		fs.IntVar(&filter.Page, "page", 1, "page")
+		fs.IntVar(&filter.Limit, "limit", 100, "users per page, up to 100")
+		fs.Parse(args)
+
+		ctx, cancel := withTimeout(ctx)
+		defer cancel()
+		list, err := client.ListUsers(ctx, filter)
+		exitOnError(err)
+		if *jsonOut {
+			printJSON(list)
+			return
+		}
+		tw := newTable()
+		fmt.Fprintln(tw, "ID\tUSERNAME\tEMAIL\tROLE\tSTATUS\tUSED\tLIMIT")
+		for _, user := range list.Users {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", user.ID, user.Username, user.Email, user.Role, user.Status,
+				formatBytes(user.DataUsed), formatLimit(user.DataLimit))
+		}
+		tw.Flush()
+		fmt.Printf("page %d, %d of %d users\n", list.Page, len(list.Users), list.Total)
+
+	case "create":
+		fs := flag.NewFlagSet("users create", flag.ExitOnError)
+		user := apiclient.NewUser{}
+		fs.StringVar(&user.Username, "username", "", "username (required)")
+		fs.StringVar(&user.Email, "email", "", "email (required)")
+		fs.StringVar(&user.Password, "password", "", "password; a random one is generated and printed when empty")
+		fs.StringVar(&user.Role, "role", "", "admin or user")
+		fs.StringVar(&user.UserGroup, "group", "", "user group")
+		fullName := fs.String("full-name", "", "full name")
+		notes := fs.String("notes", "", "notes")
+		dataLimit := fs.Int64("data-limit-gb", 0, "data limit in GiB, 0 for unlimited")
+		fs.Parse(args)
+		if user.Username == "" || user.Email == "" {
+			fmt.Fprintln(os.Stderr, "users create needs -username and -email")
+			os.Exit(2)
+		}
+		if *fullName != "" {
+			user.FullName = fullName
+		}
+		if *notes != "" {
+			user.Notes = notes
+		}
+		user.DataLimit = *dataLimit << 30
+		generated := user.Password == ""
+		if generated {
+			user.Password = randomPassword()
+		}
+
+		ctx, cancel := withTimeout(ctx)
+		defer cancel()
+		created, err := client.CreateUser(ctx, user)
+		exitOnError(err)
+		if *jsonOut {
+			result := map[string]interface{}{"user": created}
+			if generated {
+				result["password"] = user.Password
+			}
+			printJSON(result)
+			return
+		}
+		fmt.Printf("created %s (%s)\n", created.Username, created.ID)
+		if generated {
+			fmt.Printf("password: %s\n", user.Password)
+		}
+
+	case "nodes":
+		if len(args) != 1 {
+			usage()
+		}
+		ctx, cancel := withTimeout(ctx)
+		defer cancel()
+		assigned, err := client.GetUserNodes(ctx, args[0])
+		exitOnError(err)
+		printNodes(assigned)
+
+	case "assign", "unassign":
+		if len(args) < 2 {
+			usage()
+		}
+		ctx, cancel := withTimeout(ctx)
+		defer cancel()
+		assigned, err := client.GetUserNodes(ctx, args[0])
+		exitOnError(err)
+
+		selected := make(map[string]bool, len(args)-1)
+		for _, nodeID := range args[1:] {
+			selected[nodeID] = true
+		}
+		var nodeIDs []string
+		for _, node := range assigned {
+			if !selected[node.ID] {
+				nodeIDs = append(nodeIDs, node.ID)
+			}
+		}
+		if command == "assign" {
+			nodeIDs = append(nodeIDs, args[1:]...)
+		}
+		assigned, err = client.SetUserNodes(ctx, args[0], nodeIDs)
+		exitOnError(err)
+		printNodes(assigned)
+
+	default:
+		usage()
+	}
+}
+
+func nodes(ctx context.Context, command string, args []string) {
+	client := signedIn()
+	switch command {
+	case "list":
+		fs := flag.NewFlagSet("nodes list", flag.ExitOnError)
+		filter := apiclient.NodeFilter{}
+		fs.StringVar(&filter.Status, "status", "", "online, offline, maintenance or error")
+		fs.StringVar(&filter.Location, "location", "", "location")
+		fs.IntVar(&filter.Page, "page", 1, "page")
+		fs.IntVar(&filter.Limit, "limit", 100, "nodes per page, up to 100")
+		fs.Parse(args)
+
+		ctx, cancel := withTimeout(ctx)
+		defer cancel()
+		list, err := client.ListNodes(ctx, filter)
+		exitOnError(err)
+		if *jsonOut {
+			printJSON(list)
+			return
+		}
+		printNodes(list.Nodes)
+		fmt.Printf("page %d, %d of %d nodes\n", list.Page, len(list.Nodes), list.Total)
+
+	case "push":
+		fs := flag.NewFlagSet("nodes push", flag.ExitOnError)
+		check := fs.Bool("check", false, "only report how the node drifted from its desired config")
+		nodeID := nodeArg(fs, args)
+
+		ctx, cancel := withTimeout(ctx)
+		defer cancel()
+		drift, err := client.CheckDrift(ctx, nodeID, !*check)
+		exitOnError(err)
+		if *jsonOut {
+			printJSON(drift)
+		} else {
+			printDrift(drift)
+		}
+		exitUnless(len(drift.HealFailed) == 0 && (!*check || len(drift.Items) == 0))
+
+	case "logs":
+		fs := flag.NewFlagSet("nodes logs", flag.ExitOnError)
+		lines := fs.Int("n", 100, "lines to show, up to 1000")
+		follow := fs.Bool("f", false, "keep printing new lines")
+		interval := fs.Duration("interval", 5*time.Second, "how often -f polls the node")
+		nodeID := nodeArg(fs, args)
+		tailLogs(ctx, client, nodeID, *lines, *follow, *interval)
+
+	default:
+		usage()
+	}
+}
+
+// tailLogs prints the node's last lines and, following, the lines added between polls. The
+// API only returns the last lines, so a poll's new lines are those after its overlap with
+// the previous one.
+func tailLogs(ctx context.Context, client *apiclient.Client, nodeID string, lines int, follow bool, interval time.Duration) {
+	fetch := func() []string {
+		ctx, cancel := withTimeout(ctx)
+		defer cancel()
+		logs, err := client.GetNodeLogs(ctx, nodeID, lines)
+		if ctx.Err() != nil && follow {
+			os.Exit(0)
+		}
+		exitOnError(err)
+		return logs
+	}
+
+	previous := fetch()
+	printLines(previous)
+	if !follow {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		current := fetch()
+		printLines(newLines(previous, current))
+		previous = current
+	}
+}
+
+// newLines returns the lines of current after the longest run ending previous that
+// current starts with; all of current when they do not overlap
+func newLines(previous, current []string) []string {
+	for start := max(0, len(previous)-len(current)); start < len(previous); start++ {
+		overlap := len(previous) - start
+		if equalLines(previous[start:], current[:overlap]) {
+			return current[overlap:]
+		}
+	}
+	return current
+}
+
+func equalLines(a, b []string) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func subscription(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("subscription", flag.ExitOnError)
+	format := fs.String("format", "", "sing-box, clash, ...; the service's default when empty")
+	output := fs.String("o", "", "write the config to this file instead of stdout")
+	if len(args) < 1 || strings.HasPrefix(args[0], "-") {
+		usage()
+	}
+	userID := args[0]
+	fs.Parse(args[1:])
+
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	sub, err := signedIn().GetUserSubscription(ctx, userID, *format)
+	exitOnError(err)
+
+	if *output == "" {
+		printJSON(sub.Config)
+		return
+	}
+	data, err := json.MarshalIndent(sub.Config, "", "  ")
+	exitOnError(err)
+	exitOnError(os.WriteFile(*output, append(data, '\n'), 0600))
+	if sub.Userinfo != "" {
+		fmt.Fprintln(os.Stderr, sub.Userinfo)
+	}
+}
+
+func printNodes(nodes []apiclient.Node) {
+	if *jsonOut {
+		printJSON(nodes)
+		return
+	}
+	tw := newTable()
+	fmt.Fprintln(tw, "ID\tNAME\tADDRESS\tLOCATION\tSTATUS\tLAST HEARTBEAT")
+	for _, node := range nodes {
+		heartbeat := "-"
+		if node.LastHeartbeat != nil {
+			heartbeat = node.LastHeartbeat.Local().Format(time.DateTime)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", node.ID, node.Name, node.IPAddress, node.Location, node.Status, heartbeat)
+	}
+	tw.Flush()
+}
+
+func printDrift(drift *apiclient.NodeDrift) {
+	if len(drift.Items) == 0 {
+		fmt.Printf("%s matches its desired config\n", drift.NodeName)
+	} else {
+		fmt.Printf("%s drifted:\n", drift.NodeName)
+		for _, item := range drift.Items {
+			fmt.Printf("  %s %s: expected %s, found %s\n", item.Kind, item.Target, item.Expected, item.Actual)
+		}
+	}
+	for _, action := range drift.Healed {
+		fmt.Printf("  pushed: %s\n", action)
+	}
+	for _, action := range drift.HealFailed {
+		fmt.Printf("  failed: %s\n", action)
+	}
+}
+
+func printLines(lines []string) {
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+}
+
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	exitOnError(enc.Encode(v))
+}
+
+func newTable() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+}
+
+func formatLimit(n int64) string {
+	if n == 0 {
+		return "unlimited"
+	}
+	return formatBytes(n)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func randomPassword() string {
+	buf := make([]byte, 15)
+	_, err := rand.Read(buf)
+	exitOnError(err)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// nodeArg reads the node ID, which comes before the command's flags
+func nodeArg(fs *flag.FlagSet, args []string) string {
+	if len(args) < 1 || strings.HasPrefix(args[0], "-") {
+		usage()
+	}
+	fs.Parse(args[1:])
+	return args[0]
+}
+
+func withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, *timeout)
+}
+
+func subcommand(args []string) string {
+	if len(args) < 2 {
+		usage()
+	}
+	return args[1]
+}
+
+func exitUnless(success bool) {
+	if !success {
+		os.Exit(1)
+	}
+}
+
+func exitOnError(err error) {
+	if err == nil {
+		return
+	}
+	if apiclient.IsUnauthorized(err) {
+		fmt.Fprintln(os.Stderr, "session expired, run hvpnctl login")
+	} else {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	os.Exit(1)
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `usage: hvpnctl [-server url] [-credentials file] [-json] [-timeout d] command
+
+commands:
+  login [-email e] [-password-stdin]            sign in and save the tokens
+  logout                                        forget the saved tokens
+  users list [-search s] [-status s] [-role r] [-page n] [-limit n]
+  users create -username u -email e [-password p] [-role r] [-group g] [-data-limit-gb n]
+  users nodes <user-id>                         the nodes assigned to the user
+  users assign|unassign <user-id> <node-id>...  change the user's nodes
+  nodes list [-status s] [-location l]
+  nodes push <node-id> [-check]                 push the desired config to the node
+  nodes logs <node-id> [-n lines] [-f] [-interval d]
+  subscription <user-id> [-format f] [-o file]  export the user's subscription
+  dashboard [-refresh d] [-history n]           live node health, users, bandwidth and alerts`)
+	os.Exit(2)
+}
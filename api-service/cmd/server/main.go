@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log"
 	"os"
 	"os/signal"
@@ -15,12 +16,26 @@ import (
 
 	"hysteria2_microservices/api-service/internal/config"
 	"hysteria2_microservices/api-service/internal/database"
+	"hysteria2_microservices/api-service/internal/graph"
 	"hysteria2_microservices/api-service/internal/handlers"
 	"hysteria2_microservices/api-service/internal/middleware"
+	"hysteria2_microservices/api-service/internal/models"
 	"hysteria2_microservices/api-service/internal/repositories"
 	"hysteria2_microservices/api-service/internal/services"
+	serviceInterfaces "hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/internal/utils"
 	"hysteria2_microservices/api-service/pkg/cache"
+	"hysteria2_microservices/api-service/pkg/clickhouse"
+	"hysteria2_microservices/api-service/pkg/directory"
+	"hysteria2_microservices/api-service/pkg/geoip"
+	"hysteria2_microservices/api-service/pkg/health"
+	"hysteria2_microservices/api-service/pkg/lease"
 	"hysteria2_microservices/api-service/pkg/logger"
+	"hysteria2_microservices/api-service/pkg/mailer"
+	"hysteria2_microservices/api-service/pkg/oidc"
+	"hysteria2_microservices/api-service/pkg/orchestrator"
+	"hysteria2_microservices/api-service/pkg/wshub"
+	"hysteria2_microservices/pkg/events"
 )
 
 func main() {
@@ -34,7 +49,11 @@ func main() {
 	appLogger := logger.NewLogger(cfg.LogLevel)
 
 	// Initialize database
-	db, err := database.NewConnection(cfg.DatabaseURL)
+	var databasePassword func() string
+	if cfg.DatabasePassword != nil {
+		databasePassword = cfg.DatabasePassword.Value
+	}
+	db, err := database.NewConnection(cfg.DatabaseURL, databasePassword)
 	if err != nil {
 		appLogger.Fatal("Failed to connect to database", "error", err)
 	}
@@ -61,37 +80,297 @@ func main() {
 		}
 	}()
 
+	// Singleton jobs run on one replica at a time under Redis leases
+	locker := lease.NewLocker(redisClient, time.Second*time.Duration(cfg.LeaseTTLSeconds))
+
 	// Initialize repositories
 	userRepo := repositories.NewUserRepository(db)
 	deviceRepo := repositories.NewDeviceRepository(db)
 	sessionRepo := repositories.NewSessionRepository(db)
 	trafficRepo := repositories.NewTrafficRepository(db)
 	nodeRepo := repositories.NewNodeRepository(db)
+	retentionRepo := repositories.NewRetentionRepository(db)
+	xrayConfigRepo := repositories.NewXrayConfigRepository(db, appLogger)
+	hysteriaConfigRepo := repositories.NewHysteriaConfigRepository(db, appLogger)
+	jwtKeyRepo := repositories.NewJWTKeyRepository(db)
+	voucherRepo := repositories.NewVoucherRepository(db)
+	resellerRepo := repositories.NewResellerRepository(db)
+	reportScheduleRepo := repositories.NewReportScheduleRepository(db)
+	userIdentityRepo := repositories.NewUserIdentityRepository(db)
+	allowedNetworkRepo := repositories.NewAllowedNetworkRepository(db)
+	connectionLogRepo := repositories.NewConnectionLogRepository(db)
+	privacyRepo := repositories.NewPrivacyRepository(db)
+	auditRepo := repositories.NewAuditRepository(db)
+	telemetryRepo := repositories.NewTelemetryRepository(db)
+	asnPolicyRepo := repositories.NewASNPolicyRepository(db)
+	portForwardRepo := repositories.NewPortForwardRepository(db)
+
+	// Optional event bus shared with the orchestrator and the agents
+	var eventBus *events.Bus
+	if cfg.EventsNATSURL != "" {
+		if eventBus, err = events.New(events.Config{
+			Options: events.Options{
+				URL:      cfg.EventsNATSURL,
+				Name:     "api-service",
+				Token:    cfg.EventsNATSToken,
+				User:     cfg.EventsNATSUser,
+				Password: cfg.EventsNATSPassword,
+			},
+			Source: "api-service",
+			MaxAge: time.Hour * time.Duration(cfg.EventsRetentionHours),
+			Outbox: cfg.EventsOutboxSize,
+			OnError: func(err error) {
+				appLogger.Error("Event bus error", "error", err)
+			},
+		}); err != nil {
+			appLogger.Fatal("Failed to configure the event bus", "error", err)
+		}
+	}
+	auditService := services.NewAuditService(auditRepo, eventBus, appLogger)
 
 	// Initialize services
-	authService := services.NewAuthService(userRepo, sessionRepo, redisClient, cfg.JWTSecret, time.Hour*time.Duration(cfg.JWTExpiryHour))
-	userService := services.NewUserService(userRepo, deviceRepo, redisClient)
-	nodeService := services.NewNodeService(nodeRepo, appLogger)
+	// Refresh tokens live 24 times longer than access tokens; retired keys are kept that long
+	jwtExpiry := time.Hour * time.Duration(cfg.JWTExpiryHour)
+	jwtKeyService := services.NewJWTKeyService(jwtKeyRepo, locker, time.Hour*time.Duration(cfg.JWTKeyRotationHours), jwtExpiry*24, appLogger)
+	if err := jwtKeyService.Start(context.Background()); err != nil {
+		appLogger.Fatal("Failed to load JWT signing keys", "error", err)
+	}
+	defer jwtKeyService.Stop()
+
+	// Networks the admin API and the agent endpoints accept requests from
+	allowlistService, err := services.NewAllowlistService(allowedNetworkRepo, map[string][]string{
+		models.AllowedNetworkAdmin: cfg.AdminAllowedCIDRs,
+		models.AllowedNetworkAgent: cfg.AgentAllowedCIDRs,
+	}, time.Second*time.Duration(cfg.AllowlistRefreshSeconds), appLogger)
+	if err != nil {
+		appLogger.Fatal("Failed to configure allowed networks", "error", err)
+	}
+	allowlistService.Start(context.Background())
+	defer allowlistService.Stop()
+
+	// Optional LDAP or Active Directory sync, which may also check passwords
+	var directoryService serviceInterfaces.DirectoryService
+	var passwordFallback serviceInterfaces.PasswordAuthenticator
+	if cfg.LDAPURL != "" {
+		directoryClient := directory.NewClient(directory.Config{
+			URL:                cfg.LDAPURL,
+			StartTLS:           cfg.LDAPStartTLS,
+			InsecureSkipVerify: cfg.LDAPInsecureSkipVerify,
+			BindDN:             cfg.LDAPBindDN,
+			BindPassword:       cfg.LDAPBindPassword,
+			BaseDN:             cfg.LDAPBaseDN,
+			UserFilter:         cfg.LDAPUserFilter,
+			IDAttr:             cfg.LDAPIDAttr,
+			UsernameAttr:       cfg.LDAPUsernameAttr,
+			EmailAttr:          cfg.LDAPEmailAttr,
+			NameAttr:           cfg.LDAPNameAttr,
+			GroupAttr:          cfg.LDAPGroupAttr,
+		})
+		if directoryService, err = services.NewDirectoryService(directoryClient, userIdentityRepo, userRepo, redisClient, locker, services.DirectoryOptions{
+			RoleMapping:    cfg.LDAPRoleMapping,
+			DefaultRole:    cfg.LDAPDefaultRole,
+			PlanMapping:    cfg.LDAPPlanMapping,
+			DefaultPlan:    cfg.LDAPDefaultPlan,
+			SuspendMissing: cfg.LDAPSuspendMissing,
+			Interval:       time.Minute * time.Duration(cfg.LDAPSyncIntervalMinutes),
+		}, appLogger); err != nil {
+			appLogger.Fatal("Failed to configure directory sync", "error", err)
+		}
+		if cfg.LDAPAuthFallback {
+			passwordFallback = directoryService
+		}
+	}
+
+	// Optional SMTP relay for mailing scheduled reports and account emails
+	var smtpMailer *mailer.Mailer
+	if cfg.SMTPAddr != "" {
+		if smtpMailer, err = mailer.New(cfg.SMTPAddr, cfg.SMTPUsername, cfg.SMTPPassword, cfg.SMTPFrom); err != nil {
+			appLogger.Fatal("Failed to configure SMTP", "error", err)
+		}
+	}
+	mailTemplates, err := mailer.LoadTemplates(cfg.MailTemplatesDir)
+	if err != nil {
+		appLogger.Fatal("Failed to load mail templates", "error", err)
+	}
+	emailService := services.NewEmailService(userRepo, redisClient, locker, smtpMailer, mailTemplates, cfg.PortalURL, appLogger)
+
+	if cfg.RequireEmailVerification && smtpMailer == nil {
+		appLogger.Fatal("REQUIRE_EMAIL_VERIFICATION needs SMTP_ADDR to mail verification links")
+	}
+	// Legacy HS256 tokens are only validated during the migration to signing keys
+	legacySecret := ""
+	if cfg.JWTLegacyHS256 {
+		legacySecret = cfg.JWTSecret.Value()
+	}
+	authService := services.NewAuthService(userRepo, sessionRepo, redisClient, jwtKeyService, legacySecret, jwtExpiry, passwordFallback,
+		emailService, services.EmailAuthOptions{
+			ResetTTL:            time.Minute * time.Duration(cfg.PasswordResetTTLMinutes),
+			VerificationTTL:     time.Hour * time.Duration(cfg.EmailVerificationTTLHours),
+			RequireVerification: cfg.RequireEmailVerification,
+			RequestsPerIPHour:   cfg.AuthEmailRequestsPerIPHour,
+			TokenSecret:         cfg.EmailTokenSecret,
+		})
+	userService := services.NewUserService(userRepo, deviceRepo, redisClient, emailService)
+	voucherService := services.NewVoucherService(voucherRepo, userRepo, redisClient, cfg.VoucherRedeemsPerIPHour, appLogger)
+	liveSessionService := services.NewLiveSessionService(redisClient, appLogger)
+	connectionLogPolicy := models.ConnectionLogPolicy{
+		Mode:          cfg.ConnectionLogMode,
+		RetentionDays: cfg.ConnectionLogRetentionDays,
+	}
+	connectionLogService := services.NewConnectionLogService(connectionLogRepo, connectionLogPolicy, appLogger)
+	nodeService := services.NewNodeService(nodeRepo, userRepo, appLogger)
+	resellerService := services.NewResellerService(resellerRepo, userRepo, nodeRepo, redisClient, appLogger)
+	retentionService := services.NewRetentionService(retentionRepo, redisClient, locker, models.RetentionPolicy{
+		RawTrafficDays:    cfg.TrafficRawRetentionDays,
+		HourlyTrafficDays: cfg.TrafficHourlyRetentionDays,
+		NodeMetricsDays:   cfg.NodeMetricsRetentionDays,
+		ConnectionLogDays: cfg.ConnectionLogRetentionDays,
+		TelemetryDays:     cfg.TelemetryRetentionDays,
+		PartitionsAhead:   cfg.RetentionPartitionsAhead,
+		Interval:          time.Minute * time.Duration(cfg.RetentionIntervalMinutes),
+	}, appLogger)
+
+	// Optional GeoIP database for locating clients that do not pass their country
+	var geoDB *geoip.DB
+	if cfg.GeoIPCSVPath != "" {
+		if geoDB, err = geoip.Load(cfg.GeoIPCSVPath); err != nil {
+			appLogger.Error("Failed to load GeoIP database, locating clients by country header only", "path", cfg.GeoIPCSVPath, "error", err)
+		} else {
+			appLogger.Info("GeoIP database loaded", "ranges", geoDB.Len())
+		}
+	}
+	recommendationService := services.NewRecommendationService(nodeRepo, telemetryRepo, geoDB, cfg.RegionCountries,
+		time.Hour*time.Duration(cfg.RecommendWindowHours), appLogger)
+
+	subscriptionService := services.NewSubscriptionService(userRepo, nodeRepo, xrayConfigRepo, hysteriaConfigRepo, recommendationService, asnPolicyRepo,
+		cfg.TLSFingerprints, time.Hour*time.Duration(cfg.TLSFingerprintRotationHours), appLogger)
+
+	// Optional orchestrator gateway, called with short-lived admin tokens signed by the
+	// current JWT signing key
+	var orchestratorClient *orchestrator.Client
+	if cfg.OrchestratorGatewayURL != "" {
+		orchestratorClient = orchestrator.NewClient(cfg.OrchestratorGatewayURL, func() (string, error) {
+			kid, key, err := jwtKeyService.SigningKey()
+			if err != nil {
+				return "", err
+			}
+			return utils.GenerateServiceJWT("api-service", "admin", kid, key, time.Minute)
+		})
+	}
+	xrayService := services.NewXrayService(xrayConfigRepo, userRepo, deviceRepo, orchestratorClient, appLogger)
+	telemetryService := services.NewTelemetryService(telemetryRepo, userRepo, geoDB, orchestratorClient, appLogger)
+	reachabilityService := services.NewReachabilityService(telemetryRepo, asnPolicyRepo, appLogger)
+	warpService := services.NewWARPService(orchestratorClient, appLogger)
+	obfuscationService := services.NewObfuscationService(orchestratorClient, appLogger)
+	sniService := services.NewSNIService(orchestratorClient, appLogger)
+	driftService := services.NewDriftService(orchestratorClient, appLogger)
+	portForwardService := services.NewPortForwardService(portForwardRepo, userRepo, nodeRepo, orchestratorClient,
+		cfg.PortForwardQuotas, cfg.PortForwardDefaultQuota, appLogger)
+
+	// Optional ClickHouse analytics sink
+	var clickhouseClient *clickhouse.Client
+	if cfg.ClickHouseURL != "" {
+		clickhouseClient = clickhouse.NewClient(cfg.ClickHouseURL, cfg.ClickHouseDatabase, cfg.ClickHouseUser, cfg.ClickHousePassword)
+	}
+	var asnDB *geoip.DB
+	if clickhouseClient != nil && cfg.GeoIPASNCSVPath != "" {
+		if asnDB, err = geoip.LoadASN(cfg.GeoIPASNCSVPath); err != nil {
+			appLogger.Error("Failed to load ASN database, recording connections without it", "path", cfg.GeoIPASNCSVPath, "error", err)
+		} else {
+			appLogger.Info("ASN database loaded", "ranges", asnDB.Len())
+		}
+	}
+	analyticsService := services.NewAnalyticsService(clickhouseClient, cfg.AnalyticsBatchSize, time.Second*time.Duration(cfg.AnalyticsFlushSeconds),
+		connectionLogPolicy, geoDB, asnDB, appLogger)
+	if err := analyticsService.EnsureSchema(context.Background()); err != nil {
+		appLogger.Error("Failed to prepare analytics schema", "error", err)
+	}
+	defer func() {
+		if err := analyticsService.Close(); err != nil {
+			appLogger.Error("Failed to flush analytics", "error", err)
+		}
+	}()
+
+	reportService := services.NewReportService(reportScheduleRepo, trafficRepo, userRepo, nodeRepo, resellerRepo,
+		analyticsService, smtpMailer, appLogger)
+	privacyService := services.NewPrivacyService(privacyRepo, userRepo, liveSessionService, analyticsService, redisClient, appLogger)
+
+	// Optional OpenID Connect single sign-on alongside password login
+	var ssoHandler *handlers.SSOHandler
+	if cfg.OIDCIssuerURL != "" {
+		provider := oidc.NewProvider(oidc.Config{
+			IssuerURL:    cfg.OIDCIssuerURL,
+			ClientID:     cfg.OIDCClientID,
+			ClientSecret: cfg.OIDCClientSecret,
+			RedirectURL:  cfg.OIDCRedirectURL,
+			Scopes:       cfg.OIDCScopes,
+		})
+		ssoService, err := services.NewSSOService(provider, userIdentityRepo, userRepo, redisClient, services.SSOOptions{
+			GroupsClaim:   cfg.OIDCGroupsClaim,
+			RoleMapping:   cfg.OIDCRoleMapping,
+			DefaultRole:   cfg.OIDCDefaultRole,
+			AutoProvision: cfg.OIDCAutoProvision,
+		}, appLogger)
+		if err != nil {
+			appLogger.Fatal("Failed to configure single sign-on", "error", err)
+		}
+		ssoHandler = handlers.NewSSOHandler(ssoService, authService, cfg.OIDCPostLoginRedirect, appLogger)
+	}
 
 	// Initialize handlers
 	authHandler := handlers.NewAuthHandler(authService, appLogger)
+	jwtKeyHandler := handlers.NewJWTKeyHandler(jwtKeyService, appLogger)
 	userHandler := handlers.NewUserHandler(userService, appLogger)
 	nodeHandler := handlers.NewNodeHandler(nodeService, appLogger)
 
 	// Initialize WebSocket handler first (no dependency on trafficService yet)
-	wsHandler := handlers.NewWebSocketHandler(nil, appLogger) // Will set trafficService later
+	wsHub := wshub.New(redisClient, wshub.Options{
+		SendBuffer:   cfg.WSSendBuffer,
+		DropPolicy:   cfg.WSDropPolicy,
+		PingInterval: time.Second * time.Duration(cfg.WSPingSeconds),
+		Channel:      cfg.WSRedisChannel,
+	}, appLogger)
+	wsHandler := handlers.NewWebSocketHandler(nil, wsHub, appLogger) // Will set trafficService later
 
 	// Initialize traffic service with wsHandler
-	trafficService := services.NewTrafficService(trafficRepo, redisClient, wsHandler)
+	trafficService := services.NewTrafficService(trafficRepo, redisClient, wsHandler, models.TrafficIngestPolicy{
+		BatchSize:     cfg.TrafficIngestBatchSize,
+		FlushInterval: time.Millisecond * time.Duration(cfg.TrafficIngestFlushMillis),
+		MaxPending:    int64(cfg.TrafficIngestMaxPending),
+	}, appLogger)
 
 	// Set trafficService in wsHandler
 	wsHandler.SetTrafficService(trafficService)
 
 	// Initialize remaining handlers
 	trafficHandler := handlers.NewTrafficHandler(trafficService, appLogger)
+	retentionHandler := handlers.NewRetentionHandler(retentionService, appLogger)
+	analyticsHandler := handlers.NewAnalyticsHandler(analyticsService, appLogger)
+	subscriptionHandler := handlers.NewSubscriptionHandler(subscriptionService, appLogger)
+	recommendationHandler := handlers.NewRecommendationHandler(recommendationService, appLogger)
+	liveSessionHandler := handlers.NewLiveSessionHandler(liveSessionService, connectionLogService, wsHandler, appLogger)
+	xrayHandler := handlers.NewXrayHandler(xrayService, appLogger)
+	voucherHandler := handlers.NewVoucherHandler(voucherService, authService, appLogger)
+	resellerHandler := handlers.NewResellerHandler(resellerService, appLogger)
+	meHandler := handlers.NewMeHandler(userService, authService, trafficService, appLogger)
+	reportHandler := handlers.NewReportHandler(reportService, appLogger)
+	privacyHandler := handlers.NewPrivacyHandler(privacyService, appLogger)
+	allowlistHandler := handlers.NewAllowlistHandler(allowlistService, appLogger)
+	auditHandler := handlers.NewAuditHandler(auditService, appLogger)
+	telemetryHandler := handlers.NewTelemetryHandler(telemetryService, appLogger)
+	reachabilityHandler := handlers.NewReachabilityHandler(reachabilityService, appLogger)
+	warpHandler := handlers.NewWARPHandler(warpService, appLogger)
+	obfuscationHandler := handlers.NewObfuscationHandler(obfuscationService, appLogger)
+	sniHandler := handlers.NewSNIHandler(sniService, appLogger)
+	driftHandler := handlers.NewDriftHandler(driftService, appLogger)
+	portForwardHandler := handlers.NewPortForwardHandler(portForwardService, appLogger)
 
 	// Create Fiber app
 	app := fiber.New(fiber.Config{
+		// The proxy header is only read from trusted proxies, never from clients
+		ProxyHeader:             cfg.ProxyHeader,
+		EnableTrustedProxyCheck: true,
+		TrustedProxies:          cfg.TrustedProxies,
 		ErrorHandler: func(c *fiber.Ctx, err error) error {
 			code := fiber.StatusInternalServerError
 			if e, ok := err.(*fiber.Error); ok {
@@ -107,15 +386,47 @@ func main() {
 	app.Use(recover.New())
 	app.Use(cors.New(cors.Config{
 		AllowOrigins: cfg.AllowOrigins,
-		AllowHeaders: "Origin, Content-Type, Accept, Authorization",
+		AllowHeaders: "Origin, Content-Type, Accept, Authorization, " + middleware.BreakGlassHeader,
 	}))
 	app.Use(middleware.Logging(appLogger))
 	app.Use(middleware.Metrics())
 
-	// Health check
-	app.Get("/health", func(c *fiber.Ctx) error {
-		return c.JSON(fiber.Map{"status": "ok"})
-	})
+	// Health checks: Postgres is critical, Redis and the orchestrator only degrade the service
+	healthChecks := []health.Check{
+		{Name: "postgres", Critical: true, Probe: func(ctx context.Context) error {
+			sqlDB, err := db.DB()
+			if err != nil {
+				return err
+			}
+			return sqlDB.PingContext(ctx)
+		}},
+		{Name: "redis", Probe: redisClient.Ping},
+	}
+	if eventBus != nil {
+		healthChecks = append(healthChecks, health.Check{Name: "events", Probe: func(context.Context) error {
+			if !eventBus.Connected() {
+				return errors.New("not connected to NATS")
+			}
+			return nil
+		}})
+	}
+	if cfg.OrchestratorGRPCAddr != "" {
+		orchestratorHealth, err := health.NewGRPCClient(cfg.OrchestratorGRPCAddr, "")
+		if err != nil {
+			appLogger.Fatal("Failed to create orchestrator health client", "error", err)
+		}
+		defer orchestratorHealth.Close()
+		healthChecks = append(healthChecks, health.Check{Name: "orchestrator", Probe: orchestratorHealth.Probe})
+	}
+	healthChecker := health.NewChecker(time.Duration(cfg.HealthCheckTimeoutSeconds)*time.Second, healthChecks...)
+	healthHandler := handlers.NewHealthHandler(healthChecker, appLogger)
+
+	app.Get("/health", healthHandler.Readiness)
+	app.Get("/health/live", healthHandler.Liveness)
+	app.Get("/health/ready", healthHandler.Readiness)
+
+	// Public keys for verifying access tokens
+	app.Get("/.well-known/jwks.json", jwtKeyHandler.GetJWKS)
 
 	// Metrics endpoint - TODO: Implement proper Fiber-compatible prometheus handler
 	// app.Get("/metrics", func(c *fiber.Ctx) error {
@@ -131,44 +442,253 @@ func main() {
 	auth.Post("/register", authHandler.Register)
 	auth.Post("/login", authHandler.Login)
 	auth.Post("/refresh", authHandler.RefreshToken)
+	auth.Post("/forgot", authHandler.ForgotPassword)
+	auth.Post("/reset", authHandler.ResetPassword)
+	auth.Post("/verify-email", authHandler.VerifyEmail)
+	auth.Post("/verify-email/resend", authHandler.ResendVerification)
+	auth.Post("/redeem", voucherHandler.Redeem)
+	if ssoHandler != nil {
+		auth.Get("/oidc/login", ssoHandler.Login)
+		auth.Get("/oidc/callback", ssoHandler.Callback)
+	}
+
+	// Agent routes, registered before the JWT protected group
+	if cfg.NodeAuthToken == "" {
+		appLogger.Warn("NODE_AUTH_TOKEN is not set; agent session reports will be rejected")
+	}
+	agent := api.Group("/agent",
+		middleware.IPAllowlist(allowlistService, models.AllowedNetworkAgent, cfg.BreakGlassToken, appLogger),
+		middleware.NodeAuth(cfg.NodeAuthToken))
+	agent.Post("/nodes/:id/sessions", liveSessionHandler.ReportSessions)
+	agent.Post("/nodes/:id/traffic", trafficHandler.IngestTraffic)
+	agent.Post("/nodes/:id/connections", analyticsHandler.RequireEnabled, analyticsHandler.IngestConnections)
 
-	// Protected routes
-	protected := api.Group("", middleware.JWTAuth(authService))
+	// Protected routes; admins are held to the admin networks on every route
+	adminNetworks := middleware.AdminIPAllowlist(allowlistService, cfg.BreakGlassToken, appLogger)
+	protected := api.Group("", middleware.JWTAuth(authService), adminNetworks, middleware.Audit(auditService, appLogger))
+
+	// Account management is admin-only; end users reach their own account through /me.
+	// Routes users may call for their own data check ownership in the handler.
+	adminOnly := middleware.RequireRole("admin")
 
 	// User routes
 	users := protected.Group("/users")
-	users.Get("", userHandler.GetUsers)
-	users.Post("", userHandler.CreateUser)
-	users.Get("/:id", userHandler.GetUser)
-	users.Put("/:id", userHandler.UpdateUser)
-	users.Delete("/:id", userHandler.DeleteUser)
+	users.Get("", adminOnly, userHandler.GetUsers)
+	users.Post("", adminOnly, userHandler.CreateUser)
+	users.Get("/:id", adminOnly, userHandler.GetUser)
+	users.Put("/:id", adminOnly, userHandler.UpdateUser)
+	users.Delete("/:id", adminOnly, userHandler.DeleteUser)
+	users.Get("/:id/configs/:protocol/qr", subscriptionHandler.GetConfigQR)
+	users.Get("/:id/subscription", subscriptionHandler.GetUserSubscription)
+	users.Get("/:id/sessions", liveSessionHandler.GetUserSessions)
+	users.Get("/:id/connection-log", liveSessionHandler.GetUserConnectionLog)
+	users.Get("/:id/export", privacyHandler.ExportUser)
+	users.Get("/:id/nodes", adminOnly, nodeHandler.GetUserNodes)
+	users.Put("/:id/nodes", adminOnly, nodeHandler.SetUserNodes)
+	users.Post("/:id/erasure", privacyHandler.RequestErasure)
+	users.Delete("/:id/sessions", adminOnly, liveSessionHandler.DisconnectUserSessions)
 
 	// Device routes
-	users.Group("/:userId/devices").Get("", userHandler.GetUserDevices)
+	users.Group("/:userId/devices", adminOnly).Get("", userHandler.GetUserDevices)
 
 	// Node routes
 	nodes := protected.Group("/nodes")
-	nodes.Get("", nodeHandler.GetNodes)
-	nodes.Post("", nodeHandler.CreateNode)
-	nodes.Get("/:id", nodeHandler.GetNode)
-	nodes.Put("/:id", nodeHandler.UpdateNode)
-	nodes.Delete("/:id", nodeHandler.DeleteNode)
-	nodes.Get("/:id/metrics", nodeHandler.GetNodeMetrics)
-	nodes.Post("/:id/restart", nodeHandler.RestartNode)
-	nodes.Get("/:id/logs", nodeHandler.GetNodeLogs)
+	nodes.Get("", adminOnly, nodeHandler.GetNodes)
+	nodes.Post("", adminOnly, nodeHandler.CreateNode)
+	nodes.Get("/recommend", recommendationHandler.RecommendNodes) // before /:id
+	nodes.Get("/:id", adminOnly, nodeHandler.GetNode)
+	nodes.Put("/:id", adminOnly, nodeHandler.UpdateNode)
+	nodes.Delete("/:id", adminOnly, nodeHandler.DeleteNode)
+	nodes.Get("/:id/metrics", adminOnly, nodeHandler.GetNodeMetrics)
+	nodes.Post("/:id/restart", adminOnly, nodeHandler.RestartNode)
+	nodes.Get("/:id/logs", adminOnly, nodeHandler.GetNodeLogs)
+	nodes.Get("/:id/sessions", adminOnly, liveSessionHandler.GetNodeSessions)
+	nodes.Get("/:id/connection-log", adminOnly, liveSessionHandler.GetNodeConnectionLog)
+	nodes.Delete("/:id/sessions/:clientId", adminOnly, liveSessionHandler.DisconnectNodeSession)
+	nodes.Get("/:id/warp", adminOnly, warpHandler.GetStatus)
+	nodes.Put("/:id/warp", adminOnly, warpHandler.Configure)
+	nodes.Post("/:id/warp/connect", adminOnly, warpHandler.Connect)
+	nodes.Post("/:id/warp/disconnect", adminOnly, warpHandler.Disconnect)
+	nodes.Post("/:id/warp/proxy", adminOnly, warpHandler.EnableProxy)
+	nodes.Delete("/:id/warp/proxy", adminOnly, warpHandler.DisableProxy)
+	nodes.Post("/:id/warp/routing", adminOnly, warpHandler.EnableRouting)
+	nodes.Delete("/:id/warp/routing", adminOnly, warpHandler.DisableRouting)
+	nodes.Post("/:id/warp/test", adminOnly, warpHandler.TestConnectivity)
+	nodes.Get("/:id/warp/logs", adminOnly, warpHandler.GetLogs)
+	nodes.Get("/:id/obfuscation", adminOnly, obfuscationHandler.GetObfuscation)
+	nodes.Put("/:id/obfuscation", adminOnly, obfuscationHandler.SetObfuscation)
+	nodes.Patch("/:id/obfuscation", adminOnly, obfuscationHandler.UpdateObfuscation)
+	nodes.Post("/:id/sni/domains", adminOnly, sniHandler.AddDomain)
+	nodes.Delete("/:id/sni/domains/:domain", adminOnly, sniHandler.RemoveDomain)
+	nodes.Get("/:id/certificates", adminOnly, sniHandler.GetCertificates)
+	nodes.Post("/:id/certificates/renew", adminOnly, sniHandler.RenewCertificates)
+	nodes.Post("/:id/tls-check", adminOnly, sniHandler.CheckTLS)
+	nodes.Get("/:id/tls-reports", adminOnly, sniHandler.ListTLSReports)
+	nodes.Post("/:id/drift-check", adminOnly, driftHandler.CheckDrift)
+	nodes.Put("/:id/drift-policy", adminOnly, driftHandler.SetDriftPolicy)
+
+	// Drift of every node from its desired state
+	protected.Get("/drift", adminOnly, driftHandler.ListDrift)
+
+	// Certificate inventory of every node
+	certificates := protected.Group("/certificates", adminOnly)
+	certificates.Get("", sniHandler.ListInventory)
+	certificates.Post("/renew", sniHandler.BulkRenew)
+	certificates.Get("/uploads", sniHandler.ListUploads)
+	certificates.Post("/uploads", sniHandler.UploadCertificate)
+	certificates.Delete("/uploads/:domain", sniHandler.DeleteUpload)
+	certificates.Get("/tls-grades", sniHandler.ListTLSGrades)
 
 	// Traffic routes
-	traffic := protected.Group("/traffic")
+	traffic := protected.Group("/traffic", adminOnly)
 	traffic.Get("/users/:userId", trafficHandler.GetUserTraffic)
 	traffic.Get("/summary", trafficHandler.GetTrafficSummary)
 
+	// Client subscription
+	protected.Get("/subscription", subscriptionHandler.GetSubscription)
+
+	// Client telemetry from apps whose user opted in
+	protected.Post("/telemetry", telemetryHandler.ReportTelemetry)
+
+	// Self-service portal
+	me := protected.Group("/me")
+	me.Get("", meHandler.GetMe)
+	me.Get("/usage", meHandler.GetUsage)
+	me.Get("/subscription", subscriptionHandler.GetSubscription)
+	me.Put("/password", meHandler.ChangePassword)
+	me.Put("/telemetry", telemetryHandler.SetConsent)
+	me.Get("/devices", meHandler.GetDevices)
+	me.Patch("/devices/:id", meHandler.RenameDevice)
+	me.Delete("/devices/:id", meHandler.RemoveDevice)
+	me.Get("/port-forwards", portForwardHandler.GetMyForwards)
+	me.Post("/port-forwards", portForwardHandler.AddMyForward)
+	me.Delete("/port-forwards/:id", portForwardHandler.RemoveMyForward)
+
+	// Reseller routes, scoped to the users the caller owns
+	reseller := protected.Group("/reseller", middleware.RequireRole("reseller"), resellerHandler.RequireReseller)
+	reseller.Get("", resellerHandler.GetQuota)
+	reseller.Get("/users", resellerHandler.GetUsers)
+	reseller.Post("/users", resellerHandler.CreateUser)
+	reseller.Get("/users/:id", resellerHandler.GetUser)
+	reseller.Put("/users/:id", resellerHandler.UpdateUser)
+	reseller.Delete("/users/:id", resellerHandler.DeleteUser)
+	reseller.Get("/traffic", resellerHandler.GetTraffic)
+	reseller.Get("/nodes", resellerHandler.GetNodes)
+
+	// Admin routes
+	admin := protected.Group("/admin", adminOnly)
+	admin.Get("/retention", retentionHandler.GetRetentionStatus)
+	admin.Post("/retention/run", retentionHandler.RunRetention)
+	if directoryService != nil {
+		directoryHandler := handlers.NewDirectoryHandler(directoryService, appLogger)
+		admin.Get("/directory", directoryHandler.GetSyncStatus)
+		admin.Post("/directory/sync", directoryHandler.RunSync)
+	}
+	admin.Get("/allowlist", allowlistHandler.GetNetworks)
+	admin.Post("/allowlist", allowlistHandler.AddNetwork)
+	admin.Delete("/allowlist/:id", allowlistHandler.RemoveNetwork)
+	admin.Get("/port-forwards", portForwardHandler.GetForwards)
+	admin.Delete("/port-forwards/:id", portForwardHandler.RemoveForward)
+	admin.Get("/jwt/keys", jwtKeyHandler.GetKeys)
+	admin.Post("/jwt/keys/rotate", jwtKeyHandler.RotateKey)
+	admin.Get("/xray/connections", xrayHandler.GetXrayConnections)
+	admin.Delete("/xray/users/:userId/connections", xrayHandler.DisconnectXrayUser)
+	admin.Get("/vouchers", voucherHandler.GetVouchers)
+	admin.Post("/vouchers", voucherHandler.CreateVouchers)
+	admin.Delete("/vouchers/:id", voucherHandler.RevokeVoucher)
+	admin.Get("/resellers", resellerHandler.GetResellers)
+	admin.Post("/resellers", resellerHandler.CreateReseller)
+	admin.Get("/resellers/:id", resellerHandler.GetReseller)
+	admin.Put("/resellers/:id", resellerHandler.UpdateReseller)
+	admin.Delete("/resellers/:id", resellerHandler.DeleteReseller)
+	admin.Get("/reports", reportHandler.GetReport)
+	admin.Get("/report-schedules", reportHandler.GetSchedules)
+	admin.Post("/report-schedules", reportHandler.CreateSchedule)
+	admin.Get("/report-schedules/:id", reportHandler.GetSchedule)
+	admin.Put("/report-schedules/:id", reportHandler.UpdateSchedule)
+	admin.Delete("/report-schedules/:id", reportHandler.DeleteSchedule)
+	admin.Post("/report-schedules/:id/run", reportHandler.RunSchedule)
+	admin.Get("/erasures", privacyHandler.GetErasures)
+	admin.Get("/erasures/:id", privacyHandler.GetErasure)
+	admin.Get("/audit-events", auditHandler.GetAuditEvents)
+	admin.Get("/reachability", reachabilityHandler.GetReachability)
+	admin.Get("/asn-protocols", reachabilityHandler.GetPolicies)
+	admin.Put("/asn-protocols/:asn", reachabilityHandler.SetPolicy)
+	admin.Delete("/asn-protocols/:asn", reachabilityHandler.DeletePolicy)
+
+	// GraphQL gateway for dashboard queries
+	graph.Register(admin, graph.NewResolver(nodeService, userService, nodeRepo, userRepo, appLogger))
+
+	// Analytics routes
+	analytics := protected.Group("/analytics", adminOnly, analyticsHandler.RequireEnabled)
+	analytics.Post("/connections", analyticsHandler.RecordConnections)
+	analytics.Get("/top-talkers", analyticsHandler.GetTopTalkers)
+	analytics.Get("/countries", analyticsHandler.GetCountryUsage)
+	analytics.Get("/protocols", analyticsHandler.GetProtocolBreakdown)
+
 	// WebSocket routes
-	app.Get("/ws", middleware.JWTAuth(authService), wsHandler.WebSocketUpgrade())
+	app.Get("/ws", middleware.JWTAuth(authService), adminNetworks, wsHandler.WebSocketUpgrade())
 
 	appLogger.Info("Server started", "port", cfg.Port)
 
 	g, gctx := errgroup.WithContext(context.Background())
 
+	// Start the event bus and its consumers: the audit trail of every service and the
+	// traffic nodes publish
+	if eventBus != nil {
+		eventBus.Start(gctx)
+		defer eventBus.Stop()
+		auditService.Start(gctx)
+		trafficService.ConsumeEvents(gctx, eventBus)
+	}
+
+	// Start background retention pruner
+	retentionService.Start(gctx)
+	defer retentionService.Stop()
+
+	// Start scheduled directory sync
+	if directoryService != nil {
+		directoryService.Start(gctx)
+		defer directoryService.Stop()
+	}
+
+	// Start delivering scheduled reports
+	reportService.Start(gctx)
+	defer reportService.Stop()
+
+	// Start mailing quota warnings and expiry reminders
+	emailService.Start(gctx)
+	defer emailService.Stop()
+
+	// Start running requested data erasures
+	privacyService.Start(gctx)
+	defer privacyService.Stop()
+
+	// Start writing buffered traffic samples
+	trafficService.Start(gctx)
+	defer trafficService.Stop()
+
+	// Start relaying dashboard messages between replicas
+	wsHub.Start(gctx)
+	defer wsHub.Stop()
+
+	// Re-read secrets from their providers; the database picks up a rotated password on
+	// its next connection
+	if cfg.JWTLegacyHS256 {
+		cfg.JWTSecret.OnRotate(func(secret string) {
+			authService.SetJWTSecret(secret)
+			appLogger.Info("JWT secret rotated", "source", cfg.JWTSecret.Ref())
+		})
+	}
+	if cfg.DatabasePassword != nil {
+		cfg.DatabasePassword.OnRotate(func(string) {
+			appLogger.Info("Database password rotated", "source", cfg.DatabasePassword.Ref())
+		})
+	}
+	cfg.Secrets.StartRotation(gctx, time.Minute*time.Duration(cfg.SecretRefreshMinutes), func(err error) {
+		appLogger.Error("Failed to refresh secrets", "error", err)
+	}, cfg.JWTSecret, cfg.DatabasePassword)
+
 	// Start server
 	g.Go(func() error {
 		return app.Listen(":" + cfg.Port)
@@ -1,30 +1,71 @@
 package database
 
 import (
+	"context"
 	"fmt"
 	"hysteria2_microservices/api-service/internal/models"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 )
 
-func NewConnection(databaseURL string) (*gorm.DB, error) {
-	db, err := gorm.Open(postgres.Open(databaseURL), &gorm.Config{
+// NewConnection opens the database and migrates the schema. When password is set it is
+// called for every new connection, so a rotated password is picked up without a restart
+// while open connections keep working; otherwise the password in databaseURL is used.
+func NewConnection(databaseURL string, password func() string) (*gorm.DB, error) {
+	dialector := postgres.Open(databaseURL)
+	if password != nil {
+		connConfig, err := pgx.ParseConfig(databaseURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid database URL: %w", err)
+		}
+		sqlDB := stdlib.OpenDB(*connConfig, stdlib.OptionBeforeConnect(func(ctx context.Context, cc *pgx.ConnConfig) error {
+			cc.Password = password()
+			return nil
+		}))
+		dialector = postgres.New(postgres.Config{Conn: sqlDB})
+	}
+
+	db, err := gorm.Open(dialector, &gorm.Config{
 		Logger: logger.Default.LogMode(logger.Info),
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to database: %w", err)
 	}
 
+	// The role check constraint was renamed when the reseller role was added; drop the
+	// original so AutoMigrate can create the new one
+	if db.Migrator().HasConstraint(&models.User{}, "chk_users_role") {
+		if err := db.Migrator().DropConstraint(&models.User{}, "chk_users_role"); err != nil {
+			return nil, fmt.Errorf("failed to drop role constraint: %w", err)
+		}
+	}
+
 	// Auto migrate the schema
 	if err := db.AutoMigrate(
 		&models.User{},
 		&models.Device{},
 		&models.Session{},
 		&models.TrafficStats{},
+		&models.TrafficStatsHourly{},
 		&models.HysteriaConfig{},
 		&models.XrayConfig{},
+		&models.JWTSigningKey{},
+		&models.Voucher{},
+		&models.VoucherRedemption{},
+		&models.Reseller{},
+		&models.ReportSchedule{},
+		&models.UserIdentity{},
+		&models.AllowedNetwork{},
+		&models.ConnectionLog{},
+		&models.ClientTelemetry{},
+		&models.ASNProtocolPolicy{},
+		&models.DataErasure{},
+		&models.AuditEvent{},
+		&models.PortForward{},
 	); err != nil {
 		return nil, fmt.Errorf("failed to migrate database: %w", err)
 	}
@@ -0,0 +1,70 @@
+package graph
+
+import (
+	"fmt"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/models"
+)
+
+const (
+	heartbeatStaleAfter = 5 * time.Minute
+	highCPUThreshold    = 90.0
+	highMemoryThreshold = 90.0
+)
+
+// nodeAlerts derives dashboard alerts from a node's state and its latest metric
+func nodeAlerts(node *models.VPSNode, latest *models.NodeMetric, deployments []*models.Deployment) []*Alert {
+	var alerts []*Alert
+
+	switch node.Status {
+	case "offline":
+		alerts = append(alerts, &Alert{Severity: "critical", Code: "NODE_OFFLINE", Message: "Node is offline"})
+	case "error":
+		alerts = append(alerts, &Alert{Severity: "critical", Code: "NODE_ERROR", Message: "Node reported an error state"})
+	case "maintenance":
+		alerts = append(alerts, &Alert{Severity: "info", Code: "NODE_MAINTENANCE", Message: "Node is in maintenance"})
+	}
+
+	if node.LastHeartbeat == nil {
+		alerts = append(alerts, &Alert{Severity: "warning", Code: "NO_HEARTBEAT", Message: "Node has never sent a heartbeat"})
+	} else if since := time.Since(*node.LastHeartbeat); since > heartbeatStaleAfter {
+		alerts = append(alerts, &Alert{
+			Severity: "warning",
+			Code:     "HEARTBEAT_STALE",
+			Message:  fmt.Sprintf("Last heartbeat %s ago", since.Truncate(time.Second)),
+		})
+	}
+
+	if latest != nil {
+		if latest.CPUUsage >= highCPUThreshold {
+			alerts = append(alerts, &Alert{Severity: "warning", Code: "HIGH_CPU", Message: fmt.Sprintf("CPU usage at %.1f%%", latest.CPUUsage)})
+		}
+		if latest.MemoryUsage >= highMemoryThreshold {
+			alerts = append(alerts, &Alert{Severity: "warning", Code: "HIGH_MEMORY", Message: fmt.Sprintf("Memory usage at %.1f%%", latest.MemoryUsage)})
+		}
+		if latest.DiskLowPartitions > 0 {
+			alerts = append(alerts, &Alert{
+				Severity: "warning",
+				Code:     "DISK_LOW",
+				Message:  fmt.Sprintf("%d partition(s) low on space or inodes, fullest at %.1f%% space and %.1f%% inodes", latest.DiskLowPartitions, latest.DiskUsedPercent, latest.DiskInodesUsedPercent),
+			})
+		}
+		if latest.ConfigDriftFiles > 0 {
+			alerts = append(alerts, &Alert{Severity: "warning", Code: "CONFIG_DRIFT", Message: fmt.Sprintf("%d deployed config(s) changed outside the agent", latest.ConfigDriftFiles)})
+		}
+		if latest.WARPFailoverActive {
+			alerts = append(alerts, &Alert{Severity: "warning", Code: "WARP_FAILOVER", Message: "WARP is unhealthy, its traffic leaves through the backup egress"})
+		}
+	}
+
+	if len(deployments) > 0 && deployments[0].Status == "failed" {
+		alerts = append(alerts, &Alert{
+			Severity: "critical",
+			Code:     "DEPLOYMENT_FAILED",
+			Message:  fmt.Sprintf("Deployment %s failed: %s", deployments[0].ConfigVersion, deployments[0].ErrorMessage),
+		})
+	}
+
+	return alerts
+}
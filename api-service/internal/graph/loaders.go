@@ -0,0 +1,182 @@
+package graph
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/models"
+	repoInterfaces "hysteria2_microservices/api-service/internal/repositories/interfaces"
+
+	"github.com/google/uuid"
+)
+
+type loadersKey struct{}
+
+// maxMetricsPerNode is the largest metrics(limit:) accepted, as in GET /nodes/:id/metrics
+const maxMetricsPerNode = 1000
+
+// batchWait is how long a loader collects keys before issuing a single query
+const batchWait = 2 * time.Millisecond
+
+// Loaders holds the per-request dataloaders that batch GORM lookups so that
+// resolving a list of nodes costs one query per relation instead of one per node
+type Loaders struct {
+	Assignments *loader[[]*models.NodeAssignment]
+	Deployments *loader[[]*models.Deployment]
+	Users       *loader[*models.User]
+
+	nodeRepo  repoInterfaces.NodeRepository
+	metricsMu sync.Mutex
+	metrics   map[int]*loader[[]*models.NodeMetric]
+}
+
+func NewLoaders(nodeRepo repoInterfaces.NodeRepository, userRepo repoInterfaces.UserRepository) *Loaders {
+	return &Loaders{
+		nodeRepo: nodeRepo,
+		metrics:  make(map[int]*loader[[]*models.NodeMetric]),
+		Assignments: newLoader(func(ctx context.Context, ids []uuid.UUID) (map[uuid.UUID][]*models.NodeAssignment, error) {
+			assignments, err := nodeRepo.GetAssignmentsByNodeIDs(ctx, ids)
+			if err != nil {
+				return nil, err
+			}
+			result := make(map[uuid.UUID][]*models.NodeAssignment, len(ids))
+			for _, a := range assignments {
+				result[a.NodeID] = append(result[a.NodeID], a)
+			}
+			return result, nil
+		}),
+		Deployments: newLoader(func(ctx context.Context, ids []uuid.UUID) (map[uuid.UUID][]*models.Deployment, error) {
+			deployments, err := nodeRepo.GetDeploymentsByNodeIDs(ctx, ids)
+			if err != nil {
+				return nil, err
+			}
+			result := make(map[uuid.UUID][]*models.Deployment, len(ids))
+			for _, d := range deployments {
+				result[d.NodeID] = append(result[d.NodeID], d)
+			}
+			return result, nil
+		}),
+		Users: newLoader(func(ctx context.Context, ids []uuid.UUID) (map[uuid.UUID]*models.User, error) {
+			users, err := userRepo.GetByIDs(ctx, ids)
+			if err != nil {
+				return nil, err
+			}
+			result := make(map[uuid.UUID]*models.User, len(users))
+			for _, u := range users {
+				result[u.ID] = u
+			}
+			return result, nil
+		}),
+	}
+}
+
+// Metrics returns the loader of the latest limit metrics of each node. Nodes asked for with
+// the same limit share a query.
+func (l *Loaders) Metrics(limit int) *loader[[]*models.NodeMetric] {
+	l.metricsMu.Lock()
+	defer l.metricsMu.Unlock()
+
+	if metrics, ok := l.metrics[limit]; ok {
+		return metrics
+	}
+	metrics := newLoader(func(ctx context.Context, ids []uuid.UUID) (map[uuid.UUID][]*models.NodeMetric, error) {
+		metrics, err := l.nodeRepo.GetMetricsByNodeIDs(ctx, ids, limit)
+		if err != nil {
+			return nil, err
+		}
+		result := make(map[uuid.UUID][]*models.NodeMetric, len(ids))
+		for _, m := range metrics {
+			result[m.NodeID] = append(result[m.NodeID], m)
+		}
+		return result, nil
+	})
+	l.metrics[limit] = metrics
+	return metrics
+}
+
+// WithLoaders attaches a fresh set of loaders to the request context
+func WithLoaders(ctx context.Context, loaders *Loaders) context.Context {
+	return context.WithValue(ctx, loadersKey{}, loaders)
+}
+
+func loadersFrom(ctx context.Context) *Loaders {
+	loaders, _ := ctx.Value(loadersKey{}).(*Loaders)
+	return loaders
+}
+
+type batchFunc[V any] func(ctx context.Context, ids []uuid.UUID) (map[uuid.UUID]V, error)
+
+type loaderResult[V any] struct {
+	value V
+	err   error
+}
+
+// loader is a minimal batching and caching dataloader keyed by UUID
+type loader[V any] struct {
+	fetch batchFunc[V]
+
+	mu      sync.Mutex
+	cache   map[uuid.UUID]*loaderResult[V]
+	pending map[uuid.UUID][]chan struct{}
+	batch   []uuid.UUID
+}
+
+func newLoader[V any](fetch batchFunc[V]) *loader[V] {
+	return &loader[V]{
+		fetch:   fetch,
+		cache:   make(map[uuid.UUID]*loaderResult[V]),
+		pending: make(map[uuid.UUID][]chan struct{}),
+	}
+}
+
+// Load returns the value for id, batching it with other loads issued within batchWait
+func (l *loader[V]) Load(ctx context.Context, id uuid.UUID) (V, error) {
+	l.mu.Lock()
+	if res, ok := l.cache[id]; ok {
+		l.mu.Unlock()
+		return res.value, res.err
+	}
+
+	done := make(chan struct{})
+	waiters, queued := l.pending[id]
+	l.pending[id] = append(waiters, done)
+	if !queued {
+		l.batch = append(l.batch, id)
+		if len(l.batch) == 1 {
+			time.AfterFunc(batchWait, func() { l.dispatch(ctx) })
+		}
+	}
+	l.mu.Unlock()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		var zero V
+		return zero, ctx.Err()
+	}
+
+	l.mu.Lock()
+	res := l.cache[id]
+	l.mu.Unlock()
+	return res.value, res.err
+}
+
+func (l *loader[V]) dispatch(ctx context.Context) {
+	l.mu.Lock()
+	ids := l.batch
+	l.batch = nil
+	l.mu.Unlock()
+
+	values, err := l.fetch(ctx, ids)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, id := range ids {
+		l.cache[id] = &loaderResult[V]{value: values[id], err: err}
+		for _, done := range l.pending[id] {
+			close(done)
+		}
+		delete(l.pending, id)
+	}
+}
@@ -0,0 +1,16 @@
+package graph
+
+import "hysteria2_microservices/api-service/internal/models"
+
+type NodeList struct {
+	Nodes []*models.VPSNode `json:"nodes"`
+	Total int               `json:"total"`
+	Page  int               `json:"page"`
+	Limit int               `json:"limit"`
+}
+
+type Alert struct {
+	Severity string `json:"severity"`
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+}
@@ -0,0 +1,28 @@
+package graph
+
+//go:generate go tool gqlgen generate --config ../../gqlgen.yml
+
+import (
+	repoInterfaces "hysteria2_microservices/api-service/internal/repositories/interfaces"
+	serviceInterfaces "hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/logger"
+)
+
+// Resolver is the root resolver shared by all GraphQL requests
+type Resolver struct {
+	nodeService serviceInterfaces.NodeService
+	userService serviceInterfaces.UserService
+	nodeRepo    repoInterfaces.NodeRepository
+	userRepo    repoInterfaces.UserRepository
+	logger      *logger.Logger
+}
+
+func NewResolver(nodeService serviceInterfaces.NodeService, userService serviceInterfaces.UserService, nodeRepo repoInterfaces.NodeRepository, userRepo repoInterfaces.UserRepository, logger *logger.Logger) *Resolver {
+	return &Resolver{
+		nodeService: nodeService,
+		userService: userService,
+		nodeRepo:    nodeRepo,
+		userRepo:    userRepo,
+		logger:      logger,
+	}
+}
@@ -0,0 +1,110 @@
+package graph
+
+// This file will be automatically regenerated based on the schema, any resolver implementations
+// will be copied through when generating and any unknown code will be moved to the end.
+// Code generated by github.com/99designs/gqlgen version v0.17.81
+
+import (
+	"context"
+	"fmt"
+
+	"hysteria2_microservices/api-service/internal/models"
+
+	"github.com/google/uuid"
+)
+
+// Metrics is the resolver for the metrics field.
+func (r *nodeResolver) Metrics(ctx context.Context, obj *models.VPSNode, limit int) ([]*models.NodeMetric, error) {
+	if limit < 0 || limit > maxMetricsPerNode {
+		return nil, fmt.Errorf("limit must be between 0 and %d", maxMetricsPerNode)
+	}
+	if limit == 0 {
+		return []*models.NodeMetric{}, nil
+	}
+	return loadersFrom(ctx).Metrics(limit).Load(ctx, obj.ID)
+}
+
+// Assignments is the resolver for the assignments field.
+func (r *nodeResolver) Assignments(ctx context.Context, obj *models.VPSNode) ([]*models.NodeAssignment, error) {
+	return loadersFrom(ctx).Assignments.Load(ctx, obj.ID)
+}
+
+// Deployments is the resolver for the deployments field.
+func (r *nodeResolver) Deployments(ctx context.Context, obj *models.VPSNode) ([]*models.Deployment, error) {
+	return loadersFrom(ctx).Deployments.Load(ctx, obj.ID)
+}
+
+// Alerts is the resolver for the alerts field.
+func (r *nodeResolver) Alerts(ctx context.Context, obj *models.VPSNode) ([]*Alert, error) {
+	loaders := loadersFrom(ctx)
+
+	metrics, err := loaders.Metrics(1).Load(ctx, obj.ID)
+	if err != nil {
+		return nil, err
+	}
+	deployments, err := loaders.Deployments.Load(ctx, obj.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var latest *models.NodeMetric
+	if len(metrics) > 0 {
+		latest = metrics[0]
+	}
+	return nodeAlerts(obj, latest, deployments), nil
+}
+
+// User is the resolver for the user field.
+func (r *nodeAssignmentResolver) User(ctx context.Context, obj *models.NodeAssignment) (*models.User, error) {
+	return loadersFrom(ctx).Users.Load(ctx, obj.UserID)
+}
+
+// Node is the resolver for the node field.
+func (r *queryResolver) Node(ctx context.Context, id uuid.UUID) (*models.VPSNode, error) {
+	return r.nodeService.GetNodeByID(ctx, id)
+}
+
+// Nodes is the resolver for the nodes field.
+func (r *queryResolver) Nodes(ctx context.Context, status *string, location *string, page *int, limit *int) (*NodeList, error) {
+	p, l := 1, 20
+	if page != nil && *page > 0 {
+		p = *page
+	}
+	if limit != nil && *limit > 0 && *limit <= 100 {
+		l = *limit
+	}
+
+	var statusFilter, locationFilter string
+	if status != nil {
+		statusFilter = *status
+	}
+	if location != nil {
+		locationFilter = *location
+	}
+
+	nodes, total, err := r.nodeService.ListNodes(ctx, p, l, statusFilter, locationFilter)
+	if err != nil {
+		r.logger.Error("Failed to list nodes", "error", err)
+		return nil, err
+	}
+
+	return &NodeList{Nodes: nodes, Total: int(total), Page: p, Limit: l}, nil
+}
+
+// User is the resolver for the user field.
+func (r *queryResolver) User(ctx context.Context, id uuid.UUID) (*models.User, error) {
+	return r.userService.GetUserByID(ctx, id)
+}
+
+// Node returns NodeResolver implementation.
+func (r *Resolver) Node() NodeResolver { return &nodeResolver{r} }
+
+// NodeAssignment returns NodeAssignmentResolver implementation.
+func (r *Resolver) NodeAssignment() NodeAssignmentResolver { return &nodeAssignmentResolver{r} }
+
+// Query returns QueryResolver implementation.
+func (r *Resolver) Query() QueryResolver { return &queryResolver{r} }
+
+type nodeResolver struct{ *Resolver }
+type nodeAssignmentResolver struct{ *Resolver }
+type queryResolver struct{ *Resolver }
@@ -0,0 +1,230 @@
+package graph
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/99designs/gqlgen/client"
+	"github.com/google/uuid"
+
+	"hysteria2_microservices/api-service/internal/models"
+	repoInterfaces "hysteria2_microservices/api-service/internal/repositories/interfaces"
+	serviceInterfaces "hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/logger"
+)
+
+// fakeNodes serves the node queries from memory and counts the repository calls the
+// loaders make
+type fakeNodes struct {
+	repoInterfaces.NodeRepository
+
+	nodes   []*models.VPSNode
+	metrics map[uuid.UUID]int // number of metrics stored per node
+
+	mu           sync.Mutex
+	metricCalls  [][]uuid.UUID
+	metricLimits []int
+	assignCalls  int
+}
+
+// fakeNodeService answers the queries resolved through the node service from fakeNodes
+type fakeNodeService struct {
+	serviceInterfaces.NodeService
+	*fakeNodes
+}
+
+func (f fakeNodeService) ListNodes(ctx context.Context, page, limit int, statusFilter, locationFilter string) ([]*models.VPSNode, int64, error) {
+	return f.nodes, int64(len(f.nodes)), nil
+}
+
+func (f fakeNodeService) GetNodeByID(ctx context.Context, id uuid.UUID) (*models.VPSNode, error) {
+	for _, node := range f.nodes {
+		if node.ID == id {
+			return node, nil
+		}
+	}
+	return nil, fmt.Errorf("node not found")
+}
+
+// GetMetricsByNodeIDs returns the latest limit metrics of each node, newest first, the
+// first at 50% CPU and each older one 1% lower
+func (f *fakeNodes) GetMetricsByNodeIDs(ctx context.Context, nodeIDs []uuid.UUID, limit int) ([]*models.NodeMetric, error) {
+	f.mu.Lock()
+	f.metricCalls = append(f.metricCalls, nodeIDs)
+	f.metricLimits = append(f.metricLimits, limit)
+	f.mu.Unlock()
+
+	var metrics []*models.NodeMetric
+	recorded := time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC)
+	for _, id := range nodeIDs {
+		for i := 0; i < min(limit, f.metrics[id]); i++ {
+			metrics = append(metrics, &models.NodeMetric{
+				ID:         uuid.New(),
+				NodeID:     id,
+				CPUUsage:   50 - float64(i),
+				RecordedAt: recorded.Add(-time.Duration(i) * time.Minute),
+			})
+		}
+	}
+	return metrics, nil
+}
+
+func (f *fakeNodes) GetAssignmentsByNodeIDs(ctx context.Context, nodeIDs []uuid.UUID) ([]*models.NodeAssignment, error) {
+	f.mu.Lock()
+	f.assignCalls++
+	f.mu.Unlock()
+	return nil, nil
+}
+
+func (f *fakeNodes) GetDeploymentsByNodeIDs(ctx context.Context, nodeIDs []uuid.UUID) ([]*models.Deployment, error) {
+	return nil, nil
+}
+
+func newTestClient(t *testing.T, nodes *fakeNodes) *client.Client {
+	resolver := NewResolver(fakeNodeService{fakeNodes: nodes}, nil, nodes, nil, logger.NewLogger("error"))
+	return client.New(newHandler(resolver))
+}
+
+func testNodes(n, metricsEach int) *fakeNodes {
+	f := &fakeNodes{metrics: make(map[uuid.UUID]int)}
+	heartbeat := time.Now()
+	for i := 0; i < n; i++ {
+		node := &models.VPSNode{ID: uuid.New(), Name: fmt.Sprintf("node-%d", i), Status: "online", LastHeartbeat: &heartbeat}
+		f.nodes = append(f.nodes, node)
+		f.metrics[node.ID] = metricsEach
+	}
+	return f
+}
+
+type metricsResponse struct {
+	Node struct {
+		Metrics []struct {
+			CPUUsage float64
+		}
+	}
+}
+
+func TestNodeMetricsLimit(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  int
+	}{
+		{"default", `query($id: UUID!) { node(id: $id) { metrics { cpuUsage } } }`, 20},
+		// More than the default must not be cut to it
+		{"above default", `query($id: UUID!) { node(id: $id) { metrics(limit: 150) { cpuUsage } } }`, 150},
+		{"below default", `query($id: UUID!) { node(id: $id) { metrics(limit: 3) { cpuUsage } } }`, 3},
+		{"zero", `query($id: UUID!) { node(id: $id) { metrics(limit: 0) { cpuUsage } } }`, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes := testNodes(1, 500)
+			c := newTestClient(t, nodes)
+
+			var resp metricsResponse
+			if err := c.Post(tt.query, &resp, client.Var("id", nodes.nodes[0].ID.String())); err != nil {
+				t.Fatalf("query: %v", err)
+			}
+			if len(resp.Node.Metrics) != tt.want {
+				t.Fatalf("got %d metrics, want %d", len(resp.Node.Metrics), tt.want)
+			}
+			if tt.want > 0 && resp.Node.Metrics[0].CPUUsage != 50 {
+				t.Errorf("first metric at %.0f%% CPU, want the newest at 50%%", resp.Node.Metrics[0].CPUUsage)
+			}
+		})
+	}
+}
+
+func TestNodeMetricsLimitOutOfRange(t *testing.T) {
+	nodes := testNodes(1, 10)
+	c := newTestClient(t, nodes)
+
+	for _, limit := range []int{-1, maxMetricsPerNode + 1} {
+		var resp metricsResponse
+		query := fmt.Sprintf(`query($id: UUID!) { node(id: $id) { metrics(limit: %d) { cpuUsage } } }`, limit)
+		if err := c.Post(query, &resp, client.Var("id", nodes.nodes[0].ID.String())); err == nil {
+			t.Errorf("limit %d accepted", limit)
+		}
+	}
+	if len(nodes.metricCalls) != 0 {
+		t.Errorf("queried metrics %d times for invalid limits", len(nodes.metricCalls))
+	}
+}
+
+func TestNodesBatchRelations(t *testing.T) {
+	nodes := testNodes(5, 30)
+	c := newTestClient(t, nodes)
+
+	var resp struct {
+		Nodes struct {
+			Total int
+			Nodes []struct {
+				Name        string
+				Metrics     []struct{ CPUUsage float64 }
+				Assignments []struct{ ID string }
+				Alerts      []struct{ Code string }
+			}
+		}
+	}
+	query := `{ nodes { total nodes { name metrics(limit: 25) { cpuUsage } assignments { id } alerts { code } } } }`
+	if err := c.Post(query, &resp); err != nil {
+		t.Fatalf("query: %v", err)
+	}
+
+	if resp.Nodes.Total != 5 || len(resp.Nodes.Nodes) != 5 {
+		t.Fatalf("got %d of %d nodes, want 5", len(resp.Nodes.Nodes), resp.Nodes.Total)
+	}
+	for _, node := range resp.Nodes.Nodes {
+		if len(node.Metrics) != 25 {
+			t.Errorf("%s: got %d metrics, want 25", node.Name, len(node.Metrics))
+		}
+		if len(node.Alerts) != 0 {
+			t.Errorf("%s: unexpected alerts %v", node.Name, node.Alerts)
+		}
+	}
+
+	// One query for the metrics field and one for the latest metric behind the alerts,
+	// each covering every node
+	if len(nodes.metricCalls) != 2 {
+		t.Fatalf("queried metrics %d times, want 2", len(nodes.metricCalls))
+	}
+	for i, ids := range nodes.metricCalls {
+		if len(ids) != 5 {
+			t.Errorf("metrics query %d (limit %d) covered %d nodes, want 5", i, nodes.metricLimits[i], len(ids))
+		}
+	}
+	if nodes.assignCalls != 1 {
+		t.Errorf("queried assignments %d times, want 1", nodes.assignCalls)
+	}
+}
+
+func TestNodeAlerts(t *testing.T) {
+	nodes := testNodes(1, 1)
+	nodes.nodes[0].Status = "offline"
+	nodes.nodes[0].LastHeartbeat = nil
+	c := newTestClient(t, nodes)
+
+	var resp struct {
+		Node struct {
+			Alerts []struct {
+				Severity string
+				Code     string
+			}
+		}
+	}
+	if err := c.Post(`query($id: UUID!) { node(id: $id) { alerts { severity code } } }`, &resp, client.Var("id", nodes.nodes[0].ID.String())); err != nil {
+		t.Fatalf("query: %v", err)
+	}
+
+	var codes []string
+	for _, alert := range resp.Node.Alerts {
+		codes = append(codes, alert.Severity+" "+alert.Code)
+	}
+	if fmt.Sprint(codes) != "[critical NODE_OFFLINE warning NO_HEARTBEAT]" {
+		t.Errorf("alerts = %v, want NODE_OFFLINE and NO_HEARTBEAT", codes)
+	}
+}
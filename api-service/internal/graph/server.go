@@ -0,0 +1,28 @@
+package graph
+
+import (
+	"net/http"
+
+	"github.com/99designs/gqlgen/graphql/handler"
+	"github.com/99designs/gqlgen/graphql/playground"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+)
+
+// Register mounts the GraphQL endpoint and playground on router
+func Register(router fiber.Router, resolver *Resolver) {
+	router.All("/graphql", adaptor.HTTPHandler(newHandler(resolver)))
+	router.Get("/graphql/playground", adaptor.HTTPHandler(playground.Handler("GraphQL", "/api/v1/admin/graphql")))
+
+	resolver.logger.Info("GraphQL gateway enabled")
+}
+
+func newHandler(resolver *Resolver) http.Handler {
+	srv := handler.NewDefaultServer(NewExecutableSchema(Config{Resolvers: resolver}))
+
+	// Fresh loaders per request so cached rows never leak between requests
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := WithLoaders(r.Context(), NewLoaders(resolver.nodeRepo, resolver.userRepo))
+		srv.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
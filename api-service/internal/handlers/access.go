@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// canAccessUser reports whether the caller may read a user's data: users may only read
+// their own, admins may read any
+func canAccessUser(c *fiber.Ctx, userID uuid.UUID) bool {
+	callerID, _ := c.Locals("user_id").(string)
+	role, _ := c.Locals("role").(string)
+	return callerID == userID.String() || role == "admin"
+}
+
+// forbidden answers 403 to a caller reaching another user's data
+func forbidden(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+		"error": "Insufficient permissions",
+		"code":  "FORBIDDEN",
+	})
+}
+
+// callerID is the ID of the authenticated user
+func callerID(c *fiber.Ctx) (uuid.UUID, bool) {
+	raw, _ := c.Locals("user_id").(string)
+	userID, err := uuid.Parse(raw)
+	return userID, err == nil
+}
+
+func invalidCaller(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+		"error": "Invalid user",
+		"code":  "UNAUTHORIZED",
+	})
+}
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"errors"
+
+	"hysteria2_microservices/api-service/internal/models"
+	"hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/logger"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+type AllowlistHandler struct {
+	allowlistService interfaces.AllowlistService
+	logger           *logger.Logger
+}
+
+type AddNetworkRequest struct {
+	Scope       string `json:"scope" validate:"required,oneof=admin agent"`
+	CIDR        string `json:"cidr" validate:"required,notblank,max=50"`
+	Description string `json:"description" validate:"max=255"`
+}
+
+func NewAllowlistHandler(allowlistService interfaces.AllowlistService, logger *logger.Logger) *AllowlistHandler {
+	return &AllowlistHandler{
+		allowlistService: allowlistService,
+		logger:           logger,
+	}
+}
+
+// GetNetworks lists the stored networks along with the environment's, which cannot be
+// removed here, and the address the caller is seen from
+func (h *AllowlistHandler) GetNetworks(c *fiber.Ctx) error {
+	networks, err := h.allowlistService.ListNetworks(c.Context())
+	if err != nil {
+		h.logger.Error("Failed to list allowed networks", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to list allowed networks",
+			"code":  "ALLOWLIST_FAILED",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"data": networks,
+		"static": fiber.Map{
+			models.AllowedNetworkAdmin: h.allowlistService.StaticNetworks(models.AllowedNetworkAdmin),
+			models.AllowedNetworkAgent: h.allowlistService.StaticNetworks(models.AllowedNetworkAgent),
+		},
+		"client_ip": c.IP(),
+	})
+}
+
+func (h *AllowlistHandler) AddNetwork(c *fiber.Ctx) error {
+	var req AddNetworkRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+			"code":  "INVALID_REQUEST",
+		})
+	}
+	if ok, err := validateRequest(c, &req); !ok {
+		return err
+	}
+
+	network := &models.AllowedNetwork{
+		Scope:       req.Scope,
+		CIDR:        req.CIDR,
+		Description: req.Description,
+	}
+	if adminID, ok := callerID(c); ok {
+		network.CreatedBy = &adminID
+	}
+
+	if err := h.allowlistService.AddNetwork(c.Context(), network, c.IP()); err != nil {
+		return h.changeFailed(c, err, "Failed to add allowed network")
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"data": network,
+	})
+}
+
+func (h *AllowlistHandler) RemoveNetwork(c *fiber.Ctx) error {
+	networkID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid network ID",
+			"code":  "INVALID_NETWORK_ID",
+		})
+	}
+
+	if err := h.allowlistService.RemoveNetwork(c.Context(), networkID, c.IP()); err != nil {
+		return h.changeFailed(c, err, "Failed to remove allowed network")
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Allowed network removed",
+	})
+}
+
+func (h *AllowlistHandler) changeFailed(c *fiber.Ctx, err error, message string) error {
+	switch {
+	case errors.Is(err, interfaces.ErrNetworkInvalid):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+			"code":  "INVALID_NETWORK",
+		})
+	case errors.Is(err, interfaces.ErrAllowlistLockout):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "The change would lock your address " + c.IP() + " out of the admin API",
+			"code":  "ALLOWLIST_LOCKOUT",
+		})
+	case errors.Is(err, interfaces.ErrNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Allowed network not found",
+			"code":  "NETWORK_NOT_FOUND",
+		})
+	}
+	h.logger.Error(message, "error", err)
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": message,
+		"code":  "ALLOWLIST_UPDATE_FAILED",
+	})
+}
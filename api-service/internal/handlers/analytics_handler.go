@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"net/netip"
+	"strconv"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/models"
+	"hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/logger"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// maxConnectionReportRecords bounds one agent report; larger reports must be split
+const maxConnectionReportRecords = 5000
+
+type AnalyticsHandler struct {
+	analyticsService interfaces.AnalyticsService
+	logger           *logger.Logger
+}
+
+func NewAnalyticsHandler(analyticsService interfaces.AnalyticsService, logger *logger.Logger) *AnalyticsHandler {
+	return &AnalyticsHandler{
+		analyticsService: analyticsService,
+		logger:           logger,
+	}
+}
+
+// RequireEnabled rejects analytics requests when ClickHouse is not configured
+func (h *AnalyticsHandler) RequireEnabled(c *fiber.Ctx) error {
+	if !h.analyticsService.Enabled() {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": "Analytics is not configured",
+			"code":  "ANALYTICS_DISABLED",
+		})
+	}
+	return c.Next()
+}
+
+func (h *AnalyticsHandler) RecordConnections(c *fiber.Ctx) error {
+	var records []models.ConnectionRecord
+	if err := c.BodyParser(&records); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+			"code":  "INVALID_REQUEST",
+		})
+	}
+
+	return h.record(c, records)
+}
+
+// IngestConnections records the sessions that ended on a node, as reported by its agent.
+// The records are attributed to the node in the path whatever they name.
+func (h *AnalyticsHandler) IngestConnections(c *fiber.Ctx) error {
+	nodeID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid node ID",
+			"code":  "INVALID_NODE_ID",
+		})
+	}
+
+	var report models.ConnectionReport
+	if err := c.BodyParser(&report); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+			"code":  "INVALID_REQUEST",
+		})
+	}
+	if len(report.Connections) > maxConnectionReportRecords {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+			"error": "Too many connections in one report",
+			"code":  "REPORT_TOO_LARGE",
+		})
+	}
+	for i := range report.Connections {
+		record := &report.Connections[i]
+		if _, err := uuid.Parse(record.UserID); err != nil || record.Upload < 0 || record.Download < 0 || record.Duration < 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Connections need a user and non-negative byte counts and duration",
+				"code":  "INVALID_CONNECTION",
+			})
+		}
+		if record.ClientIP != "" {
+			if _, err := netip.ParseAddr(record.ClientIP); err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "Invalid client address",
+					"code":  "INVALID_CONNECTION",
+				})
+			}
+		}
+		record.NodeID = nodeID.String()
+	}
+
+	return h.record(c, report.Connections)
+}
+
+func (h *AnalyticsHandler) record(c *fiber.Ctx, records []models.ConnectionRecord) error {
+	for i := range records {
+		if records[i].ConnectedAt.IsZero() {
+			records[i].ConnectedAt = time.Now()
+		}
+		if err := h.analyticsService.RecordConnection(c.Context(), &records[i]); err != nil {
+			h.logger.Error("Failed to record connection", "error", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to record connections",
+				"code":  "ANALYTICS_WRITE_FAILED",
+			})
+		}
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"message": "Connections accepted",
+		"data":    fiber.Map{"accepted": len(records)},
+	})
+}
+
+func (h *AnalyticsHandler) GetTopTalkers(c *fiber.Ctx) error {
+	from, to := parseAnalyticsRange(c)
+	limit, _ := strconv.Atoi(c.Query("limit", "10"))
+
+	result, err := h.analyticsService.GetTopTalkers(c.Context(), from, to, limit)
+	if err != nil {
+		h.logger.Error("Failed to get top talkers", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get top talkers",
+			"code":  "ANALYTICS_QUERY_FAILED",
+		})
+	}
+
+	return c.JSON(fiber.Map{"data": result, "from": from, "to": to})
+}
+
+func (h *AnalyticsHandler) GetCountryUsage(c *fiber.Ctx) error {
+	from, to := parseAnalyticsRange(c)
+
+	result, err := h.analyticsService.GetCountryUsage(c.Context(), from, to)
+	if err != nil {
+		h.logger.Error("Failed to get country usage", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get country usage",
+			"code":  "ANALYTICS_QUERY_FAILED",
+		})
+	}
+
+	return c.JSON(fiber.Map{"data": result, "from": from, "to": to})
+}
+
+func (h *AnalyticsHandler) GetProtocolBreakdown(c *fiber.Ctx) error {
+	from, to := parseAnalyticsRange(c)
+
+	result, err := h.analyticsService.GetProtocolBreakdown(c.Context(), from, to)
+	if err != nil {
+		h.logger.Error("Failed to get protocol breakdown", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get protocol breakdown",
+			"code":  "ANALYTICS_QUERY_FAILED",
+		})
+	}
+
+	return c.JSON(fiber.Map{"data": result, "from": from, "to": to})
+}
+
+// parseAnalyticsRange reads optional RFC3339 from/to params, defaulting to the last 24 hours
+func parseAnalyticsRange(c *fiber.Ctx) (time.Time, time.Time) {
+	to := time.Now()
+	from := to.Add(-24 * time.Hour)
+
+	if fromStr := c.Query("from"); fromStr != "" {
+		if parsed, err := time.Parse(time.RFC3339, fromStr); err == nil {
+			from = parsed
+		}
+	}
+	if toStr := c.Query("to"); toStr != "" {
+		if parsed, err := time.Parse(time.RFC3339, toStr); err == nil {
+			to = parsed
+		}
+	}
+
+	return from, to
+}
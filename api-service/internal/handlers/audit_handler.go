@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"hysteria2_microservices/api-service/internal/models"
+	"hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/logger"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type AuditHandler struct {
+	auditService interfaces.AuditService
+	logger       *logger.Logger
+}
+
+func NewAuditHandler(auditService interfaces.AuditService, logger *logger.Logger) *AuditHandler {
+	return &AuditHandler{
+		auditService: auditService,
+		logger:       logger,
+	}
+}
+
+// GetAuditEvents lists the audit trail of all services, newest first, filtered by source,
+// actor and action
+func (h *AuditHandler) GetAuditEvents(c *fiber.Ctx) error {
+	page, limit := pagination(c)
+	filter := models.AuditFilter{
+		Source: c.Query("source"),
+		Actor:  c.Query("actor"),
+		Action: c.Query("action"),
+	}
+
+	auditEvents, total, err := h.auditService.List(c.Context(), filter, page, limit)
+	if err != nil {
+		h.logger.Error("Failed to list audit events", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to list audit events",
+			"code":  "AUDIT_LIST_FAILED",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"data":  auditEvents,
+		"total": total,
+		"page":  page,
+		"limit": limit,
+	})
+}
@@ -1,6 +1,8 @@
 package handlers
 
 import (
+	"errors"
+
 	"github.com/gofiber/fiber/v2"
 
 	"hysteria2_microservices/api-service/internal/services/interfaces"
@@ -15,7 +17,7 @@ type AuthHandler struct {
 type RegisterRequest struct {
 	Username string `json:"username" validate:"required,min=3,max=50"`
 	Email    string `json:"email" validate:"required,email"`
-	Password string `json:"password" validate:"required,min=8"`
+	Password string `json:"password" validate:"required,notblank,min=8"`
 }
 
 type LoginRequest struct {
@@ -27,6 +29,20 @@ type RefreshRequest struct {
 	RefreshToken string `json:"refresh_token" validate:"required"`
 }
 
+// EmailRequest names the account a password reset or verification link is mailed to
+type EmailRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token" validate:"required,max=512"`
+	Password string `json:"password" validate:"required,notblank,min=8"`
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token" validate:"required,max=512"`
+}
+
 func NewAuthHandler(authService interfaces.AuthService, logger *logger.Logger) *AuthHandler {
 	return &AuthHandler{
 		authService: authService,
@@ -43,6 +59,9 @@ func (h *AuthHandler) Register(c *fiber.Ctx) error {
 			"code":  "INVALID_REQUEST",
 		})
 	}
+	if ok, err := validateRequest(c, &req); !ok {
+		return err
+	}
 
 	user, err := h.authService.Register(c.Context(), req.Username, req.Email, req.Password)
 	if err != nil {
@@ -53,6 +72,24 @@ func (h *AuthHandler) Register(c *fiber.Ctx) error {
 		})
 	}
 
+	h.logger.Info("User registered successfully", "user_id", user.ID, "username", user.Username)
+
+	userData := fiber.Map{
+		"id":       user.ID,
+		"username": user.Username,
+		"email":    user.Email,
+		"role":     user.Role,
+		"status":   user.Status,
+	}
+
+	// Accounts that must verify their email first sign in once they followed the link
+	if h.authService.VerificationRequired() {
+		return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+			"user":                  userData,
+			"verification_required": true,
+		})
+	}
+
 	// Generate token pair
 	tokenPair, err := h.authService.GenerateTokenPair(user.ID)
 	if err != nil {
@@ -63,16 +100,8 @@ func (h *AuthHandler) Register(c *fiber.Ctx) error {
 		})
 	}
 
-	h.logger.Info("User registered successfully", "user_id", user.ID, "username", user.Username)
-
 	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
-		"user": fiber.Map{
-			"id":       user.ID,
-			"username": user.Username,
-			"email":    user.Email,
-			"role":     user.Role,
-			"status":   user.Status,
-		},
+		"user":  userData,
 		"token": tokenPair,
 	})
 }
@@ -85,8 +114,18 @@ func (h *AuthHandler) Login(c *fiber.Ctx) error {
 			"error": "Invalid request body",
 		})
 	}
+	if ok, err := validateRequest(c, &req); !ok {
+		return err
+	}
 
 	user, err := h.authService.Login(c.Context(), req.Email, req.Password)
+	if errors.Is(err, interfaces.ErrEmailNotVerified) {
+		h.logger.Warn("Login with unverified email", "email", req.Email)
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Email is not verified",
+			"code":  "EMAIL_NOT_VERIFIED",
+		})
+	}
 	if err != nil {
 		h.logger.Warn("Failed login attempt", "email", req.Email, "error", err)
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
@@ -125,6 +164,9 @@ func (h *AuthHandler) RefreshToken(c *fiber.Ctx) error {
 			"error": "Invalid request body",
 		})
 	}
+	if ok, err := validateRequest(c, &req); !ok {
+		return err
+	}
 
 	tokenPair, err := h.authService.RefreshToken(req.RefreshToken)
 	if err != nil {
@@ -140,3 +182,123 @@ func (h *AuthHandler) RefreshToken(c *fiber.Ctx) error {
 		"token": tokenPair,
 	})
 }
+
+// ForgotPassword mails a password reset link. It answers the same whether or not the email
+// has an account.
+func (h *AuthHandler) ForgotPassword(c *fiber.Ctx) error {
+	var req EmailRequest
+	if err := c.BodyParser(&req); err != nil {
+		return invalidRequestBody(c)
+	}
+	if ok, err := validateRequest(c, &req); !ok {
+		return err
+	}
+
+	// The connection address: forwarded headers are set by the client and would let it
+	// pick a new address for every attempt
+	if err := h.authService.RequestPasswordReset(c.Context(), req.Email, c.IP()); err != nil {
+		return h.emailRequestFailure(c, err, "Failed to request password reset")
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"message": "If the email belongs to an account, a reset link was sent to it",
+	})
+}
+
+// ResetPassword sets a new password with the token of a reset link. The account's sessions
+// are invalidated, so it signs in again with the new password.
+func (h *AuthHandler) ResetPassword(c *fiber.Ctx) error {
+	var req ResetPasswordRequest
+	if err := c.BodyParser(&req); err != nil {
+		return invalidRequestBody(c)
+	}
+	if ok, err := validateRequest(c, &req); !ok {
+		return err
+	}
+
+	err := h.authService.ResetPassword(c.Context(), req.Token, req.Password, c.IP())
+	if errors.Is(err, interfaces.ErrEmailTokenInvalid) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Reset link is invalid or expired",
+			"code":  "RESET_TOKEN_INVALID",
+		})
+	}
+	if err != nil {
+		return h.emailRequestFailure(c, err, "Failed to reset password")
+	}
+
+	h.logger.Info("Password reset", "ip", c.IP())
+
+	return c.JSON(fiber.Map{
+		"message": "Password reset",
+	})
+}
+
+// VerifyEmail confirms the email of an account with the token of a verification link
+func (h *AuthHandler) VerifyEmail(c *fiber.Ctx) error {
+	var req VerifyEmailRequest
+	if err := c.BodyParser(&req); err != nil {
+		return invalidRequestBody(c)
+	}
+	if ok, err := validateRequest(c, &req); !ok {
+		return err
+	}
+
+	user, err := h.authService.VerifyEmail(c.Context(), req.Token, c.IP())
+	if errors.Is(err, interfaces.ErrEmailTokenInvalid) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Verification link is invalid or expired",
+			"code":  "VERIFICATION_TOKEN_INVALID",
+		})
+	}
+	if err != nil {
+		return h.emailRequestFailure(c, err, "Failed to verify email")
+	}
+
+	h.logger.Info("Email verified", "user_id", user.ID)
+
+	return c.JSON(fiber.Map{
+		"message": "Email verified",
+	})
+}
+
+// ResendVerification mails a new verification link. Like ForgotPassword, it answers the
+// same for any email.
+func (h *AuthHandler) ResendVerification(c *fiber.Ctx) error {
+	var req EmailRequest
+	if err := c.BodyParser(&req); err != nil {
+		return invalidRequestBody(c)
+	}
+	if ok, err := validateRequest(c, &req); !ok {
+		return err
+	}
+
+	if err := h.authService.RequestVerification(c.Context(), req.Email, c.IP()); err != nil {
+		return h.emailRequestFailure(c, err, "Failed to request email verification")
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"message": "If the email belongs to an unverified account, a verification link was sent to it",
+	})
+}
+
+func (h *AuthHandler) emailRequestFailure(c *fiber.Ctx, err error, message string) error {
+	switch {
+	case errors.Is(err, interfaces.ErrRateLimited):
+		h.logger.Warn("Email request rate limit exceeded", "ip", c.IP(), "path", c.Path())
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+			"error": "Too many requests, try again later",
+			"code":  "RATE_LIMIT_EXCEEDED",
+		})
+	case errors.Is(err, interfaces.ErrEmailDisabled):
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": "Email delivery is not configured",
+			"code":  "EMAIL_DISABLED",
+		})
+	}
+	h.logger.Error(message, "error", err)
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": message,
+		"code":  "INTERNAL_ERROR",
+	})
+}
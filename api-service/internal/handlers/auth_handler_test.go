@@ -69,6 +69,42 @@ func (m *MockAuthService) InvalidateUserSessions(ctx context.Context, userID uui
 	return args.Error(0)
 }
 
+func (m *MockAuthService) ChangePassword(ctx context.Context, userID uuid.UUID, currentPassword, newPassword string) error {
+	args := m.Called(ctx, userID, currentPassword, newPassword)
+	return args.Error(0)
+}
+
+func (m *MockAuthService) RequestPasswordReset(ctx context.Context, email, ip string) error {
+	args := m.Called(ctx, email, ip)
+	return args.Error(0)
+}
+
+func (m *MockAuthService) ResetPassword(ctx context.Context, token, newPassword, ip string) error {
+	args := m.Called(ctx, token, newPassword, ip)
+	return args.Error(0)
+}
+
+func (m *MockAuthService) RequestVerification(ctx context.Context, email, ip string) error {
+	args := m.Called(ctx, email, ip)
+	return args.Error(0)
+}
+
+func (m *MockAuthService) VerifyEmail(ctx context.Context, token, ip string) (*models.User, error) {
+	args := m.Called(ctx, token, ip)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*models.User), args.Error(1)
+}
+
+func (m *MockAuthService) VerificationRequired() bool {
+	return m.Called().Bool(0)
+}
+
+func (m *MockAuthService) SetJWTSecret(secret string) {
+	m.Called(secret)
+}
+
 type AuthHandlerTestSuite struct {
 	suite.Suite
 	app           *fiber.App
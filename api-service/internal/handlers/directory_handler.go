@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"errors"
+
+	"hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/logger"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type DirectoryHandler struct {
+	directoryService interfaces.DirectoryService
+	logger           *logger.Logger
+}
+
+func NewDirectoryHandler(directoryService interfaces.DirectoryService, logger *logger.Logger) *DirectoryHandler {
+	return &DirectoryHandler{
+		directoryService: directoryService,
+		logger:           logger,
+	}
+}
+
+func (h *DirectoryHandler) GetSyncStatus(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"last_report": h.directoryService.GetLastReport(c.Context()),
+	})
+}
+
+func (h *DirectoryHandler) RunSync(c *fiber.Ctx) error {
+	report, err := h.directoryService.Sync(c.Context())
+	if errors.Is(err, interfaces.ErrJobRunning) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Directory sync is already running",
+			"code":  "JOB_RUNNING",
+		})
+	}
+	if err != nil {
+		h.logger.Error("Failed to sync directory", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":  "Failed to sync directory",
+			"code":   "DIRECTORY_SYNC_FAILED",
+			"report": report,
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"data":    report,
+		"message": "Directory sync completed",
+	})
+}
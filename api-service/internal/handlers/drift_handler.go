@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/logger"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// DriftHandler reports for admins how nodes drifted from their desired state: configs
+// edited by hand, servers stopped, firewall and routing rules gone. Nodes are checked on
+// the orchestrator's schedule; a check can also be run, and healed, on demand.
+type DriftHandler struct {
+	driftService interfaces.DriftService
+	logger       *logger.Logger
+}
+
+// DriftCheckRequest runs a drift check; heal re-applies the desired state whatever the
+// node's policy
+type DriftCheckRequest struct {
+	Heal bool `json:"heal"`
+}
+
+// DriftPolicyRequest selects what scheduled checks do with a node's drift
+type DriftPolicyRequest struct {
+	Policy string `json:"policy" validate:"required,oneof=report heal"`
+}
+
+func NewDriftHandler(driftService interfaces.DriftService, logger *logger.Logger) *DriftHandler {
+	return &DriftHandler{
+		driftService: driftService,
+		logger:       logger,
+	}
+}
+
+// CheckDrift compares the node with its desired state now; the body is optional
+func (h *DriftHandler) CheckDrift(c *fiber.Ctx) error {
+	nodeID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return invalidNodeID(c)
+	}
+
+	var req DriftCheckRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+				"code":  "INVALID_REQUEST",
+			})
+		}
+	}
+
+	drift, err := h.driftService.Check(c.Context(), nodeID, req.Heal)
+	if err != nil {
+		h.logger.Error("Failed to check drift", "error", err, "node_id", nodeID, "heal", req.Heal)
+		return orchestratorFailure(c, err, "Failed to check drift")
+	}
+
+	return c.JSON(fiber.Map{
+		"data": drift,
+	})
+}
+
+// ListDrift returns the last drift check of every node, only the drifted ones with
+// ?drifted=true
+func (h *DriftHandler) ListDrift(c *fiber.Ctx) error {
+	drifts, err := h.driftService.List(c.Context(), c.QueryBool("drifted", false))
+	if err != nil {
+		h.logger.Error("Failed to list drift", "error", err)
+		return orchestratorFailure(c, err, "Failed to list drift")
+	}
+
+	return c.JSON(fiber.Map{
+		"data": drifts,
+	})
+}
+
+// SetDriftPolicy selects whether scheduled checks only report the node's drift or heal it
+func (h *DriftHandler) SetDriftPolicy(c *fiber.Ctx) error {
+	nodeID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return invalidNodeID(c)
+	}
+
+	var req DriftPolicyRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+			"code":  "INVALID_REQUEST",
+		})
+	}
+	if ok, err := validateRequest(c, &req); !ok {
+		return err
+	}
+
+	message, err := h.driftService.SetPolicy(c.Context(), nodeID, req.Policy)
+	if err != nil {
+		h.logger.Error("Failed to set drift policy", "error", err, "node_id", nodeID, "policy", req.Policy)
+		return orchestratorFailure(c, err, "Failed to set drift policy")
+	}
+
+	return c.JSON(fiber.Map{
+		"message": message,
+	})
+}
@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"time"
+
+	"hysteria2_microservices/api-service/pkg/health"
+	"hysteria2_microservices/api-service/pkg/logger"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type HealthHandler struct {
+	checker   *health.Checker
+	startedAt time.Time
+	logger    *logger.Logger
+}
+
+func NewHealthHandler(checker *health.Checker, logger *logger.Logger) *HealthHandler {
+	return &HealthHandler{
+		checker:   checker,
+		startedAt: time.Now(),
+		logger:    logger,
+	}
+}
+
+// Liveness reports that the process serves requests, without touching dependencies, so a
+// database outage does not get the service restarted
+func (h *HealthHandler) Liveness(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"status":         health.StatusOK,
+		"uptime_seconds": int64(time.Since(h.startedAt).Seconds()),
+	})
+}
+
+// Readiness probes every dependency and answers 503 while a critical one is down. A
+// degraded service, e.g. with Redis or the orchestrator unreachable, stays ready.
+func (h *HealthHandler) Readiness(c *fiber.Ctx) error {
+	report := h.checker.Run(c.Context())
+	if report.Status == health.StatusOK {
+		return c.JSON(report)
+	}
+
+	for _, result := range report.Checks {
+		if result.Status == health.CheckFailed {
+			h.logger.Warn("Health check failed", "dependency", result.Name, "critical", result.Critical, "error", result.Error)
+		}
+	}
+	if report.Status == health.StatusDown {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(report)
+	}
+	return c.JSON(report)
+}
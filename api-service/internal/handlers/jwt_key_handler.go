@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/logger"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type JWTKeyHandler struct {
+	keyService interfaces.JWTKeyService
+	logger     *logger.Logger
+}
+
+func NewJWTKeyHandler(keyService interfaces.JWTKeyService, logger *logger.Logger) *JWTKeyHandler {
+	return &JWTKeyHandler{
+		keyService: keyService,
+		logger:     logger,
+	}
+}
+
+// GetJWKS publishes the public keys tokens are signed with
+func (h *JWTKeyHandler) GetJWKS(c *fiber.Ctx) error {
+	// Short enough for verifiers to pick up a rotated key before it signs many tokens
+	c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+	return c.JSON(h.keyService.JWKS())
+}
+
+func (h *JWTKeyHandler) GetKeys(c *fiber.Ctx) error {
+	keys, err := h.keyService.ListKeys(c.Context())
+	if err != nil {
+		h.logger.Error("Failed to list JWT signing keys", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to list signing keys",
+			"code":  "JWT_KEYS_FAILED",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"data": keys,
+	})
+}
+
+func (h *JWTKeyHandler) RotateKey(c *fiber.Ctx) error {
+	key, err := h.keyService.Rotate(c.Context())
+	if err != nil {
+		h.logger.Error("Failed to rotate JWT signing key", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to rotate signing key",
+			"code":  "JWT_ROTATION_FAILED",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"data":    key,
+		"message": "Signing key rotated",
+	})
+}
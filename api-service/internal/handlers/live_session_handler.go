@@ -0,0 +1,265 @@
+package handlers
+
+import (
+	"net/url"
+
+	"hysteria2_microservices/api-service/internal/models"
+	"hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/logger"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+type LiveSessionHandler struct {
+	sessionService       interfaces.LiveSessionService
+	connectionLogService interfaces.ConnectionLogService
+	webSocketService     interfaces.WebSocketService
+	logger               *logger.Logger
+}
+
+func NewLiveSessionHandler(sessionService interfaces.LiveSessionService, connectionLogService interfaces.ConnectionLogService, wsService interfaces.WebSocketService, logger *logger.Logger) *LiveSessionHandler {
+	return &LiveSessionHandler{
+		sessionService:       sessionService,
+		connectionLogService: connectionLogService,
+		webSocketService:     wsService,
+		logger:               logger,
+	}
+}
+
+// ReportSessions receives the connect and disconnect events of a node's agent and answers
+// with the clients the agent should disconnect
+func (h *LiveSessionHandler) ReportSessions(c *fiber.Ctx) error {
+	nodeID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid node ID",
+			"code":  "INVALID_NODE_ID",
+		})
+	}
+
+	var report models.SessionReport
+	if err := c.BodyParser(&report); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+			"code":  "INVALID_REQUEST",
+		})
+	}
+
+	disconnect, err := h.sessionService.Report(c.Context(), nodeID, &report)
+	if err != nil {
+		h.logger.Error("Failed to record session report", "error", err, "node_id", nodeID)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to record sessions",
+			"code":  "SESSION_REPORT_FAILED",
+		})
+	}
+	// Failing here makes the agent send the report again, which the log applies cleanly
+	if err := h.connectionLogService.Record(c.Context(), nodeID, &report); err != nil {
+		h.logger.Error("Failed to record connection log", "error", err, "node_id", nodeID)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to record connection log",
+			"code":  "CONNECTION_LOG_FAILED",
+		})
+	}
+
+	// Tell the admins watching the node how its sessions changed
+	if len(report.Events) > 0 || report.Resync {
+		connects, disconnects := 0, 0
+		for _, event := range report.Events {
+			switch event.Type {
+			case "connect":
+				connects++
+			case "disconnect":
+				disconnects++
+			}
+		}
+		h.webSocketService.BroadcastNodeEvent(nodeID, "sessions", fiber.Map{
+			"connects":    connects,
+			"disconnects": disconnects,
+			"resync":      report.Resync,
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"data": fiber.Map{"disconnect": disconnect},
+	})
+}
+
+// GetUserSessions lists a user's live sessions. Users may only list their own; admins may
+// list any.
+func (h *LiveSessionHandler) GetUserSessions(c *fiber.Ctx) error {
+	userID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid user ID",
+			"code":  "INVALID_USER_ID",
+		})
+	}
+	if !canAccessUser(c, userID) {
+		return forbidden(c)
+	}
+
+	sessions, err := h.sessionService.ListByUser(c.Context(), userID)
+	if err != nil {
+		h.logger.Error("Failed to list user sessions", "error", err, "user_id", userID)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to list sessions",
+			"code":  "SESSIONS_FAILED",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"data": sessions,
+	})
+}
+
+// GetUserConnectionLog lists a user's past and open sessions, newest first. Users may only
+// list their own; admins may list any.
+func (h *LiveSessionHandler) GetUserConnectionLog(c *fiber.Ctx) error {
+	userID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid user ID",
+			"code":  "INVALID_USER_ID",
+		})
+	}
+	if !canAccessUser(c, userID) {
+		return forbidden(c)
+	}
+	page, limit := pagination(c)
+
+	logs, total, err := h.connectionLogService.ListByUser(c.Context(), userID, page, limit)
+	if err != nil {
+		h.logger.Error("Failed to list user connection log", "error", err, "user_id", userID)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to list connection log",
+			"code":  "CONNECTION_LOG_FAILED",
+		})
+	}
+
+	return h.connectionLogPage(c, logs, total, page, limit)
+}
+
+// GetNodeConnectionLog lists the sessions of a node, newest first
+func (h *LiveSessionHandler) GetNodeConnectionLog(c *fiber.Ctx) error {
+	nodeID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid node ID",
+			"code":  "INVALID_NODE_ID",
+		})
+	}
+	page, limit := pagination(c)
+
+	logs, total, err := h.connectionLogService.ListByNode(c.Context(), nodeID, page, limit)
+	if err != nil {
+		h.logger.Error("Failed to list node connection log", "error", err, "node_id", nodeID)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to list connection log",
+			"code":  "CONNECTION_LOG_FAILED",
+		})
+	}
+
+	return h.connectionLogPage(c, logs, total, page, limit)
+}
+
+// connectionLogPage answers with a page of the log and the policy it was kept under, so an
+// empty log under the off mode is not mistaken for no activity
+func (h *LiveSessionHandler) connectionLogPage(c *fiber.Ctx, logs []*models.ConnectionLog, total int64, page, limit int) error {
+	policy := h.connectionLogService.Policy()
+	return c.JSON(fiber.Map{
+		"data":           logs,
+		"total":          total,
+		"page":           page,
+		"limit":          limit,
+		"mode":           policy.Mode,
+		"retention_days": policy.RetentionDays,
+	})
+}
+
+// DisconnectUserSessions disconnects the user from every node
+func (h *LiveSessionHandler) DisconnectUserSessions(c *fiber.Ctx) error {
+	userID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid user ID",
+			"code":  "INVALID_USER_ID",
+		})
+	}
+
+	sessions, err := h.sessionService.DisconnectUser(c.Context(), userID)
+	if err != nil {
+		h.logger.Error("Failed to disconnect user sessions", "error", err, "user_id", userID)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to disconnect sessions",
+			"code":  "SESSION_DISCONNECT_FAILED",
+		})
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"data":    sessions,
+		"message": "Disconnect requested",
+	})
+}
+
+func (h *LiveSessionHandler) GetNodeSessions(c *fiber.Ctx) error {
+	nodeID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid node ID",
+			"code":  "INVALID_NODE_ID",
+		})
+	}
+
+	sessions, err := h.sessionService.ListByNode(c.Context(), nodeID)
+	if err != nil {
+		h.logger.Error("Failed to list node sessions", "error", err, "node_id", nodeID)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to list sessions",
+			"code":  "SESSIONS_FAILED",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"data": sessions,
+	})
+}
+
+// DisconnectNodeSession disconnects one client from a node
+func (h *LiveSessionHandler) DisconnectNodeSession(c *fiber.Ctx) error {
+	nodeID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid node ID",
+			"code":  "INVALID_NODE_ID",
+		})
+	}
+	clientID, err := url.PathUnescape(c.Params("clientId"))
+	if err != nil || clientID == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid client ID",
+			"code":  "INVALID_CLIENT_ID",
+		})
+	}
+
+	session, err := h.sessionService.Disconnect(c.Context(), nodeID, clientID)
+	if err != nil {
+		h.logger.Error("Failed to disconnect session", "error", err, "node_id", nodeID, "client_id", clientID)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to disconnect session",
+			"code":  "SESSION_DISCONNECT_FAILED",
+		})
+	}
+	if session == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Session not found",
+			"code":  "SESSION_NOT_FOUND",
+		})
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"data":    session,
+		"message": "Disconnect requested",
+	})
+}
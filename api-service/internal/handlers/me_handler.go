@@ -0,0 +1,281 @@
+package handlers
+
+import (
+	"errors"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/logger"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// MeHandler serves the self-service portal. Every route acts on the caller's own account,
+// taken from the token rather than the path.
+type MeHandler struct {
+	userService    interfaces.UserService
+	authService    interfaces.AuthService
+	trafficService interfaces.TrafficService
+	logger         *logger.Logger
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" validate:"required"`
+	NewPassword     string `json:"new_password" validate:"required,notblank,min=8"`
+}
+
+type RenameDeviceRequest struct {
+	Name string `json:"name" validate:"required,notblank,max=100"`
+}
+
+func NewMeHandler(userService interfaces.UserService, authService interfaces.AuthService, trafficService interfaces.TrafficService, logger *logger.Logger) *MeHandler {
+	return &MeHandler{
+		userService:    userService,
+		authService:    authService,
+		trafficService: trafficService,
+		logger:         logger,
+	}
+}
+
+// GetMe returns the caller's profile without the fields only admins manage, such as notes
+func (h *MeHandler) GetMe(c *fiber.Ctx) error {
+	userID, ok := callerID(c)
+	if !ok {
+		return invalidCaller(c)
+	}
+
+	user, err := h.userService.GetUserByID(c.Context(), userID)
+	if err != nil {
+		h.logger.Error("Failed to get user", "error", err, "user_id", userID)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+			"code":  "USER_NOT_FOUND",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"id":               user.ID,
+		"username":         user.Username,
+		"email":            user.Email,
+		"full_name":        user.FullName,
+		"status":           user.Status,
+		"role":             user.Role,
+		"data_limit":       user.DataLimit,
+		"data_used":        user.DataUsed,
+		"expiry_date":      user.ExpiryDate,
+		"created_at":       user.CreatedAt,
+		"last_login":       user.LastLogin,
+		"telemetry_opt_in": user.TelemetryOptIn,
+	})
+}
+
+// GetUsage returns the caller's quota and traffic totals, by default for the last 30 days
+func (h *MeHandler) GetUsage(c *fiber.Ctx) error {
+	userID, ok := callerID(c)
+	if !ok {
+		return invalidCaller(c)
+	}
+
+	now := time.Now()
+	from := now.AddDate(0, 0, -30)
+	to := now
+
+	var err error
+	if fromStr := c.Query("from"); fromStr != "" {
+		if from, err = time.Parse(time.RFC3339, fromStr); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid from time format (use RFC3339)",
+				"code":  "INVALID_TIME_RANGE",
+			})
+		}
+	}
+	if toStr := c.Query("to"); toStr != "" {
+		if to, err = time.Parse(time.RFC3339, toStr); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid to time format (use RFC3339)",
+				"code":  "INVALID_TIME_RANGE",
+			})
+		}
+	}
+
+	user, err := h.userService.GetUserByID(c.Context(), userID)
+	if err != nil {
+		h.logger.Error("Failed to get user", "error", err, "user_id", userID)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+			"code":  "USER_NOT_FOUND",
+		})
+	}
+
+	traffic, err := h.trafficService.GetUserTraffic(c.Context(), userID, from, to)
+	if err != nil {
+		h.logger.Error("Failed to get user traffic", "error", err, "user_id", userID)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get usage",
+			"code":  "USAGE_FAILED",
+		})
+	}
+
+	var upload, download int64
+	for _, stats := range traffic {
+		upload += stats.Upload
+		download += stats.Download
+	}
+
+	// A data limit of 0 means unlimited, reported as a null remainder
+	var remaining *int64
+	if user.DataLimit > 0 {
+		left := user.DataLimit - user.DataUsed
+		if left < 0 {
+			left = 0
+		}
+		remaining = &left
+	}
+
+	return c.JSON(fiber.Map{
+		"data_limit":     user.DataLimit,
+		"data_used":      user.DataUsed,
+		"data_remaining": remaining,
+		"expiry_date":    user.ExpiryDate,
+		"from":           from,
+		"to":             to,
+		"upload":         upload,
+		"download":       download,
+		"total":          upload + download,
+	})
+}
+
+func (h *MeHandler) GetDevices(c *fiber.Ctx) error {
+	userID, ok := callerID(c)
+	if !ok {
+		return invalidCaller(c)
+	}
+
+	devices, err := h.userService.GetUserDevices(c.Context(), userID)
+	if err != nil {
+		h.logger.Error("Failed to get user devices", "error", err, "user_id", userID)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get devices",
+			"code":  "DEVICES_FAILED",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"devices": devices,
+	})
+}
+
+func (h *MeHandler) RenameDevice(c *fiber.Ctx) error {
+	userID, ok := callerID(c)
+	if !ok {
+		return invalidCaller(c)
+	}
+
+	deviceID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid device ID",
+			"code":  "INVALID_DEVICE_ID",
+		})
+	}
+
+	var req RenameDeviceRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+			"code":  "INVALID_REQUEST",
+		})
+	}
+	if ok, err := validateRequest(c, &req); !ok {
+		return err
+	}
+
+	device, err := h.userService.RenameDevice(c.Context(), userID, deviceID, req.Name)
+	if err != nil {
+		return h.deviceFailure(c, err, userID, deviceID, "Failed to rename device")
+	}
+
+	return c.JSON(device)
+}
+
+func (h *MeHandler) RemoveDevice(c *fiber.Ctx) error {
+	userID, ok := callerID(c)
+	if !ok {
+		return invalidCaller(c)
+	}
+
+	deviceID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid device ID",
+			"code":  "INVALID_DEVICE_ID",
+		})
+	}
+
+	if err := h.userService.RemoveDevice(c.Context(), userID, deviceID); err != nil {
+		return h.deviceFailure(c, err, userID, deviceID, "Failed to remove device")
+	}
+
+	h.logger.Info("Device removed", "user_id", userID, "device_id", deviceID)
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// ChangePassword replaces the caller's password. Existing sessions are invalidated, so the
+// portal should sign in again with the new password.
+func (h *MeHandler) ChangePassword(c *fiber.Ctx) error {
+	userID, ok := callerID(c)
+	if !ok {
+		return invalidCaller(c)
+	}
+
+	var req ChangePasswordRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+			"code":  "INVALID_REQUEST",
+		})
+	}
+	if ok, err := validateRequest(c, &req); !ok {
+		return err
+	}
+
+	err := h.authService.ChangePassword(c.Context(), userID, req.CurrentPassword, req.NewPassword)
+	if errors.Is(err, interfaces.ErrInvalidCredentials) {
+		h.logger.Warn("Password change with wrong current password", "user_id", userID)
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Current password is incorrect",
+			"code":  "INVALID_CURRENT_PASSWORD",
+		})
+	}
+	if err != nil {
+		h.logger.Error("Failed to change password", "error", err, "user_id", userID)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to change password",
+			"code":  "PASSWORD_CHANGE_FAILED",
+		})
+	}
+
+	h.logger.Info("Password changed", "user_id", userID)
+
+	return c.JSON(fiber.Map{
+		"message": "Password changed",
+	})
+}
+
+// deviceFailure answers 404 for devices that are missing or belong to another user, so
+// device IDs of other accounts cannot be probed
+func (h *MeHandler) deviceFailure(c *fiber.Ctx, err error, userID, deviceID uuid.UUID, message string) error {
+	if errors.Is(err, interfaces.ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Device not found",
+			"code":  "DEVICE_NOT_FOUND",
+		})
+	}
+	h.logger.Error(message, "error", err, "user_id", userID, "device_id", deviceID)
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": message,
+		"code":  "DEVICE_UPDATE_FAILED",
+	})
+}
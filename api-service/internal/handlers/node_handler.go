@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"strconv"
 
 	"hysteria2_microservices/api-service/internal/models"
@@ -18,10 +19,10 @@ type NodeHandler struct {
 
 type CreateNodeRequest struct {
 	Name         string            `json:"name" validate:"required,min=2,max=100"`
-	Hostname     string            `json:"hostname" validate:"required,min=2,max=255"`
+	Hostname     string            `json:"hostname" validate:"required,hostname_rfc1123,max=255"`
 	IPAddress    string            `json:"ip_address" validate:"required,ip"`
 	Location     string            `json:"location" validate:"omitempty,max=100"`
-	Country      string            `json:"country" validate:"omitempty,len=2"`
+	Country      string            `json:"country" validate:"omitempty,len=2,alpha"`
 	GRPCPort     int               `json:"grpc_port" validate:"omitempty,min=1,max=65535"`
 	Capabilities map[string]string `json:"capabilities"`
 	Metadata     map[string]string `json:"metadata"`
@@ -29,16 +30,22 @@ type CreateNodeRequest struct {
 
 type UpdateNodeRequest struct {
 	Name         *string            `json:"name" validate:"omitempty,min=2,max=100"`
-	Hostname     *string            `json:"hostname" validate:"omitempty,min=2,max=255"`
+	Hostname     *string            `json:"hostname" validate:"omitempty,hostname_rfc1123,max=255"`
 	IPAddress    *string            `json:"ip_address" validate:"omitempty,ip"`
 	Location     *string            `json:"location" validate:"omitempty,max=100"`
-	Country      *string            `json:"country" validate:"omitempty,len=2"`
+	Country      *string            `json:"country" validate:"omitempty,len=2,alpha"`
 	GRPCPort     *int               `json:"grpc_port" validate:"omitempty,min=1,max=65535"`
 	Status       *string            `json:"status" validate:"omitempty,oneof=online offline maintenance error"`
 	Capabilities *map[string]string `json:"capabilities"`
 	Metadata     *map[string]string `json:"metadata"`
 }
 
+// UserNodesRequest replaces the nodes assigned to a user; an empty list removes every
+// assignment
+type UserNodesRequest struct {
+	NodeIDs []string `json:"node_ids" validate:"omitempty,max=100,dive,uuid"`
+}
+
 func NewNodeHandler(nodeService interfaces.NodeService, logger *logger.Logger) *NodeHandler {
 	return &NodeHandler{
 		nodeService: nodeService,
@@ -109,6 +116,9 @@ func (h *NodeHandler) CreateNode(c *fiber.Ctx) error {
 			"error": "Invalid request body",
 		})
 	}
+	if ok, err := validateRequest(c, &req); !ok {
+		return err
+	}
 
 	// Set default values
 	if req.GRPCPort == 0 {
@@ -165,6 +175,9 @@ func (h *NodeHandler) UpdateNode(c *fiber.Ctx) error {
 			"error": "Invalid request body",
 		})
 	}
+	if ok, err := validateRequest(c, &req); !ok {
+		return err
+	}
 
 	node, err := h.nodeService.GetNodeByID(c.Context(), nodeID)
 	if err != nil {
@@ -326,3 +339,69 @@ func (h *NodeHandler) GetNodeLogs(c *fiber.Ctx) error {
 		"lines": lines,
 	})
 }
+
+// GetUserNodes returns the nodes assigned to the user
+func (h *NodeHandler) GetUserNodes(c *fiber.Ctx) error {
+	userID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return invalidUserID(c)
+	}
+
+	nodes, err := h.nodeService.GetUserNodes(c.Context(), userID)
+	if err != nil {
+		return h.userNodesFailure(c, err, "Failed to get user nodes")
+	}
+
+	return c.JSON(fiber.Map{
+		"nodes": nodes,
+	})
+}
+
+// SetUserNodes replaces the nodes assigned to the user. Subscriptions only offer the
+// assigned nodes; a user without assignments is offered every online node.
+func (h *NodeHandler) SetUserNodes(c *fiber.Ctx) error {
+	userID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return invalidUserID(c)
+	}
+
+	var req UserNodesRequest
+	if err := c.BodyParser(&req); err != nil {
+		return invalidRequestBody(c)
+	}
+	if ok, err := validateRequest(c, &req); !ok {
+		return err
+	}
+	nodeIDs := make([]uuid.UUID, 0, len(req.NodeIDs))
+	for _, id := range req.NodeIDs {
+		nodeIDs = append(nodeIDs, uuid.MustParse(id))
+	}
+
+	nodes, err := h.nodeService.SetUserNodes(c.Context(), userID, nodeIDs)
+	if err != nil {
+		return h.userNodesFailure(c, err, "Failed to assign nodes")
+	}
+
+	return c.JSON(fiber.Map{
+		"nodes": nodes,
+	})
+}
+
+func (h *NodeHandler) userNodesFailure(c *fiber.Ctx, err error, message string) error {
+	switch {
+	case errors.Is(err, interfaces.ErrNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+			"code":  "USER_NOT_FOUND",
+		})
+	case errors.Is(err, interfaces.ErrNodeNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+			"code":  "NODE_NOT_FOUND",
+		})
+	}
+	h.logger.Error(message, "error", err)
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": message,
+	})
+}
@@ -77,6 +77,16 @@ func (m *MockNodeService) GetOnlineNodes(ctx context.Context) ([]*models.VPSNode
 	return args.Get(0).([]*models.VPSNode), args.Error(1)
 }
 
+func (m *MockNodeService) GetUserNodes(ctx context.Context, userID uuid.UUID) ([]*models.VPSNode, error) {
+	args := m.Called(ctx, userID)
+	return args.Get(0).([]*models.VPSNode), args.Error(1)
+}
+
+func (m *MockNodeService) SetUserNodes(ctx context.Context, userID uuid.UUID, nodeIDs []uuid.UUID) ([]*models.VPSNode, error) {
+	args := m.Called(ctx, userID, nodeIDs)
+	return args.Get(0).([]*models.VPSNode), args.Error(1)
+}
+
 type NodeHandlerTestSuite struct {
 	suite.Suite
 	app         *fiber.App
@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"hysteria2_microservices/api-service/internal/models"
+	"hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/logger"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// ObfuscationHandler manages the obfuscation of a node for admins: presets, custom settings
+// and single knobs such as Salamander. Calls go through the orchestrator, which rejects
+// nodes in a running obfuscation experiment.
+type ObfuscationHandler struct {
+	obfuscationService interfaces.ObfuscationService
+	logger             *logger.Logger
+}
+
+// NodeObfuscationRequest applies a preset, or the given settings when no preset is named.
+// Naming neither turns obfuscation off.
+type NodeObfuscationRequest struct {
+	Preset   string                      `json:"preset" validate:"max=50"`
+	Settings *ObfuscationSettingsRequest `json:"settings"`
+}
+
+type ObfuscationSettingsRequest struct {
+	Salamander         bool     `json:"salamander"`
+	SalamanderPassword string   `json:"salamander_password" validate:"omitempty,min=8,max=128"`
+	PortHopping        bool     `json:"port_hopping"`
+	HopStartPort       int      `json:"hop_start_port" validate:"min=0,max=65535"`
+	HopEndPort         int      `json:"hop_end_port" validate:"min=0,max=65535"`
+	HopInterval        int      `json:"hop_interval" validate:"min=0,max=3600"`
+	QUICObfuscation    bool     `json:"quic_obfuscation"`
+	PacketPadding      int      `json:"packet_padding" validate:"min=0,max=1500"`
+	TimingJitterMs     int      `json:"timing_jitter_ms" validate:"min=0,max=1000"`
+	Fingerprints       []string `json:"fingerprints" validate:"max=10,dive,max=30"`
+	RealityTargets     []string `json:"reality_targets" validate:"max=10,dive,max=253"`
+	TrafficShaping     bool     `json:"traffic_shaping"`
+}
+
+// ObfuscationChangeRequest switches single knobs; omitted fields keep their applied value
+type ObfuscationChangeRequest struct {
+	Salamander         *bool    `json:"salamander"`
+	SalamanderPassword *string  `json:"salamander_password" validate:"omitempty,min=8,max=128"`
+	PortHopping        *bool    `json:"port_hopping"`
+	HopStartPort       *int     `json:"hop_start_port" validate:"omitempty,min=1,max=65535"`
+	HopEndPort         *int     `json:"hop_end_port" validate:"omitempty,min=1,max=65535"`
+	HopInterval        *int     `json:"hop_interval" validate:"omitempty,min=0,max=3600"`
+	QUICObfuscation    *bool    `json:"quic_obfuscation"`
+	PacketPadding      *int     `json:"packet_padding" validate:"omitempty,min=0,max=1500"`
+	TimingJitterMs     *int     `json:"timing_jitter_ms" validate:"omitempty,min=0,max=1000"`
+	Fingerprints       []string `json:"fingerprints" validate:"omitempty,max=10,dive,max=30"`
+	RealityTargets     []string `json:"reality_targets" validate:"omitempty,max=10,dive,max=253"`
+	TrafficShaping     *bool    `json:"traffic_shaping"`
+}
+
+func NewObfuscationHandler(obfuscationService interfaces.ObfuscationService, logger *logger.Logger) *ObfuscationHandler {
+	return &ObfuscationHandler{
+		obfuscationService: obfuscationService,
+		logger:             logger,
+	}
+}
+
+// GetObfuscation returns the node's preset and settings, including the Salamander password
+// client configs need
+func (h *ObfuscationHandler) GetObfuscation(c *fiber.Ctx) error {
+	nodeID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return invalidNodeID(c)
+	}
+
+	obfuscation, err := h.obfuscationService.Get(c.Context(), nodeID)
+	if err != nil {
+		h.logger.Error("Failed to get obfuscation", "error", err, "node_id", nodeID)
+		return orchestratorFailure(c, err, "Failed to get obfuscation")
+	}
+
+	return c.JSON(fiber.Map{
+		"data": obfuscation,
+	})
+}
+
+// SetObfuscation replaces the node's obfuscation with a preset or custom settings
+func (h *ObfuscationHandler) SetObfuscation(c *fiber.Ctx) error {
+	nodeID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return invalidNodeID(c)
+	}
+
+	var req NodeObfuscationRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+			"code":  "INVALID_REQUEST",
+		})
+	}
+	if ok, err := validateRequest(c, &req); !ok {
+		return err
+	}
+	if req.Preset != "" && req.Settings != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Give either a preset or settings",
+			"code":  "INVALID_REQUEST",
+		})
+	}
+
+	var obfuscation *models.NodeObfuscation
+	if req.Settings != nil {
+		settings := req.Settings
+		obfuscation, err = h.obfuscationService.ApplySettings(c.Context(), nodeID, &models.ObfuscationSettings{
+			Salamander:         settings.Salamander,
+			SalamanderPassword: settings.SalamanderPassword,
+			PortHopping:        settings.PortHopping,
+			HopStartPort:       settings.HopStartPort,
+			HopEndPort:         settings.HopEndPort,
+			HopInterval:        settings.HopInterval,
+			QUICObfuscation:    settings.QUICObfuscation,
+			PacketPadding:      settings.PacketPadding,
+			TimingJitterMs:     settings.TimingJitterMs,
+			Fingerprints:       settings.Fingerprints,
+			RealityTargets:     settings.RealityTargets,
+			TrafficShaping:     settings.TrafficShaping,
+		})
+	} else {
+		obfuscation, err = h.obfuscationService.ApplyPreset(c.Context(), nodeID, req.Preset)
+	}
+	if err != nil {
+		h.logger.Error("Failed to apply obfuscation", "error", err, "node_id", nodeID, "preset", req.Preset)
+		return orchestratorFailure(c, err, "Failed to apply obfuscation")
+	}
+
+	return c.JSON(fiber.Map{
+		"data": obfuscation,
+	})
+}
+
+// UpdateObfuscation switches single knobs, e.g. {"salamander": false}, keeping the rest
+// of the applied settings. The node no longer follows its preset afterwards.
+func (h *ObfuscationHandler) UpdateObfuscation(c *fiber.Ctx) error {
+	nodeID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return invalidNodeID(c)
+	}
+
+	var req ObfuscationChangeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+			"code":  "INVALID_REQUEST",
+		})
+	}
+	if ok, err := validateRequest(c, &req); !ok {
+		return err
+	}
+
+	obfuscation, err := h.obfuscationService.Update(c.Context(), nodeID, &models.ObfuscationChange{
+		Salamander:         req.Salamander,
+		SalamanderPassword: req.SalamanderPassword,
+		PortHopping:        req.PortHopping,
+		HopStartPort:       req.HopStartPort,
+		HopEndPort:         req.HopEndPort,
+		HopInterval:        req.HopInterval,
+		QUICObfuscation:    req.QUICObfuscation,
+		PacketPadding:      req.PacketPadding,
+		TimingJitterMs:     req.TimingJitterMs,
+		Fingerprints:       req.Fingerprints,
+		RealityTargets:     req.RealityTargets,
+		TrafficShaping:     req.TrafficShaping,
+	})
+	if err != nil {
+		h.logger.Error("Failed to update obfuscation", "error", err, "node_id", nodeID)
+		return orchestratorFailure(c, err, "Failed to update obfuscation")
+	}
+
+	return c.JSON(fiber.Map{
+		"data": obfuscation,
+	})
+}
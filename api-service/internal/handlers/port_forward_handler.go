@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"errors"
+
+	"hysteria2_microservices/api-service/internal/models"
+	"hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/logger"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// PortForwardHandler lets users expose a server they run elsewhere, e.g. a game server,
+// on a public port of a node they are assigned to, and admins see and remove the forwards
+type PortForwardHandler struct {
+	portForwardService interfaces.PortForwardService
+	logger             *logger.Logger
+}
+
+// AddPortForwardRequest asks the node to forward listen_port to target_host:target_port;
+// the node's agent tells which ports it forwards
+type AddPortForwardRequest struct {
+	NodeID      string `json:"node_id" validate:"required,uuid"`
+	Protocol    string `json:"protocol" validate:"required,oneof=tcp udp"`
+	ListenPort  int    `json:"listen_port" validate:"required,min=1,max=65535"`
+	TargetHost  string `json:"target_host" validate:"required,ip"`
+	TargetPort  int    `json:"target_port" validate:"required,min=1,max=65535"`
+	Description string `json:"description" validate:"max=255"`
+}
+
+func NewPortForwardHandler(portForwardService interfaces.PortForwardService, logger *logger.Logger) *PortForwardHandler {
+	return &PortForwardHandler{
+		portForwardService: portForwardService,
+		logger:             logger,
+	}
+}
+
+// GetMyForwards lists the caller's forwards and how many their plan allows
+func (h *PortForwardHandler) GetMyForwards(c *fiber.Ctx) error {
+	userID, ok := callerID(c)
+	if !ok {
+		return invalidCaller(c)
+	}
+
+	forwards, err := h.portForwardService.ListUserForwards(c.Context(), userID)
+	if err != nil {
+		h.logger.Error("Failed to list port forwards", "error", err, "user_id", userID)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to list port forwards",
+			"code":  "PORT_FORWARDS_FAILED",
+		})
+	}
+	quota, err := h.portForwardService.Quota(c.Context(), userID)
+	if err != nil {
+		return h.changeFailed(c, err, "Failed to get port forward quota")
+	}
+
+	return c.JSON(fiber.Map{
+		"data":  forwards,
+		"quota": quota,
+	})
+}
+
+func (h *PortForwardHandler) AddMyForward(c *fiber.Ctx) error {
+	userID, ok := callerID(c)
+	if !ok {
+		return invalidCaller(c)
+	}
+
+	var req AddPortForwardRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+			"code":  "INVALID_REQUEST",
+		})
+	}
+	if ok, err := validateRequest(c, &req); !ok {
+		return err
+	}
+
+	forward := &models.PortForward{
+		UserID:      userID,
+		NodeID:      uuid.MustParse(req.NodeID),
+		Protocol:    req.Protocol,
+		ListenPort:  req.ListenPort,
+		TargetHost:  req.TargetHost,
+		TargetPort:  req.TargetPort,
+		Description: req.Description,
+	}
+	if err := h.portForwardService.AddForward(c.Context(), forward); err != nil {
+		return h.changeFailed(c, err, "Failed to add port forward")
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"data": forward,
+	})
+}
+
+func (h *PortForwardHandler) RemoveMyForward(c *fiber.Ctx) error {
+	userID, ok := callerID(c)
+	if !ok {
+		return invalidCaller(c)
+	}
+	forwardID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return invalidForwardID(c)
+	}
+
+	if err := h.portForwardService.RemoveForward(c.Context(), forwardID, &userID); err != nil {
+		return h.changeFailed(c, err, "Failed to remove port forward")
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Port forward removed",
+	})
+}
+
+// GetForwards lists every user's forwards, those of one node with ?node_id=
+func (h *PortForwardHandler) GetForwards(c *fiber.Ctx) error {
+	var nodeID *uuid.UUID
+	if raw := c.Query("node_id"); raw != "" {
+		id, err := uuid.Parse(raw)
+		if err != nil {
+			return invalidNodeID(c)
+		}
+		nodeID = &id
+	}
+
+	forwards, err := h.portForwardService.ListForwards(c.Context(), nodeID)
+	if err != nil {
+		h.logger.Error("Failed to list port forwards", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to list port forwards",
+			"code":  "PORT_FORWARDS_FAILED",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"data": forwards,
+	})
+}
+
+func (h *PortForwardHandler) RemoveForward(c *fiber.Ctx) error {
+	forwardID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return invalidForwardID(c)
+	}
+
+	if err := h.portForwardService.RemoveForward(c.Context(), forwardID, nil); err != nil {
+		return h.changeFailed(c, err, "Failed to remove port forward")
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Port forward removed",
+	})
+}
+
+func (h *PortForwardHandler) changeFailed(c *fiber.Ctx, err error, message string) error {
+	switch {
+	case errors.Is(err, interfaces.ErrPortForwardQuota):
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": err.Error(),
+			"code":  "PORT_FORWARD_QUOTA_EXCEEDED",
+		})
+	case errors.Is(err, interfaces.ErrNodeNotAssigned):
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Port forwards can only be added on nodes assigned to you",
+			"code":  "NODE_NOT_ASSIGNED",
+		})
+	case errors.Is(err, interfaces.ErrPortTaken):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": err.Error(),
+			"code":  "PORT_IN_USE",
+		})
+	case errors.Is(err, interfaces.ErrNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Port forward not found",
+			"code":  "PORT_FORWARD_NOT_FOUND",
+		})
+	}
+	h.logger.Error(message, "error", err)
+	return orchestratorFailure(c, err, message)
+}
+
+func invalidForwardID(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+		"error": "Invalid port forward ID",
+		"code":  "INVALID_PORT_FORWARD_ID",
+	})
+}
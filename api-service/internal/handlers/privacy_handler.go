@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+
+	"hysteria2_microservices/api-service/internal/models"
+	"hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/logger"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+type PrivacyHandler struct {
+	privacyService interfaces.PrivacyService
+	logger         *logger.Logger
+}
+
+// ErasureRequest asks to erase a user's data; the mode defaults to delete
+type ErasureRequest struct {
+	Mode string `json:"mode" validate:"omitempty,oneof=delete anonymize"`
+}
+
+func NewPrivacyHandler(privacyService interfaces.PrivacyService, logger *logger.Logger) *PrivacyHandler {
+	return &PrivacyHandler{
+		privacyService: privacyService,
+		logger:         logger,
+	}
+}
+
+// ExportUser downloads everything stored about a user as JSON. Users may only export their
+// own data; admins may export anyone's.
+func (h *PrivacyHandler) ExportUser(c *fiber.Ctx) error {
+	userID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return invalidUserID(c)
+	}
+	if !canAccessUser(c, userID) {
+		return forbidden(c)
+	}
+
+	export, err := h.privacyService.ExportUser(c.Context(), userID)
+	if err != nil {
+		return h.failure(c, err, "Failed to export user data", "user_id", userID)
+	}
+
+	c.Set(fiber.HeaderContentDisposition, mime.FormatMediaType("attachment", map[string]string{
+		"filename": fmt.Sprintf("user-%s-%s.json", userID, export.ExportedAt.Format("2006-01-02")),
+	}))
+	return c.JSON(export)
+}
+
+// RequestErasure queues the erasure of a user's data. Users may only erase their own data;
+// admins may erase anyone's.
+func (h *PrivacyHandler) RequestErasure(c *fiber.Ctx) error {
+	userID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return invalidUserID(c)
+	}
+	if !canAccessUser(c, userID) {
+		return forbidden(c)
+	}
+
+	var req ErasureRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return invalidRequestBody(c)
+		}
+	}
+	if ok, err := validateRequest(c, &req); !ok {
+		return err
+	}
+	if req.Mode == "" {
+		req.Mode = models.ErasureDelete
+	}
+
+	var requestedBy *uuid.UUID
+	if caller, ok := callerID(c); ok {
+		requestedBy = &caller
+	}
+	erasure, err := h.privacyService.RequestErasure(c.Context(), userID, req.Mode, requestedBy)
+	if err != nil {
+		return h.failure(c, err, "Failed to request data erasure", "user_id", userID)
+	}
+
+	h.logger.Info("Data erasure queued", "erasure_id", erasure.ID, "user_id", userID, "mode", req.Mode)
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"data":    erasure,
+		"message": "Erasure queued",
+	})
+}
+
+func (h *PrivacyHandler) GetErasures(c *fiber.Ctx) error {
+	page, limit := pagination(c)
+
+	erasures, total, err := h.privacyService.ListErasures(c.Context(), page, limit)
+	if err != nil {
+		return h.failure(c, err, "Failed to list data erasures")
+	}
+
+	return c.JSON(fiber.Map{
+		"data":  erasures,
+		"total": total,
+		"page":  page,
+		"limit": limit,
+	})
+}
+
+// GetErasure returns an erasure; once completed it carries the certificate
+func (h *PrivacyHandler) GetErasure(c *fiber.Ctx) error {
+	erasureID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid erasure ID",
+			"code":  "INVALID_ERASURE_ID",
+		})
+	}
+
+	erasure, err := h.privacyService.GetErasure(c.Context(), erasureID)
+	if err != nil {
+		return h.failure(c, err, "Failed to get data erasure", "erasure_id", erasureID)
+	}
+
+	return c.JSON(fiber.Map{
+		"data": erasure,
+	})
+}
+
+func (h *PrivacyHandler) failure(c *fiber.Ctx, err error, message string, fields ...interface{}) error {
+	switch {
+	case errors.Is(err, interfaces.ErrNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Not found",
+			"code":  "NOT_FOUND",
+		})
+	case errors.Is(err, interfaces.ErrErasureInProgress):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "An erasure of the user is already in progress",
+			"code":  "ERASURE_IN_PROGRESS",
+		})
+	}
+
+	h.logger.Error(append([]interface{}{message, "error", err}, fields...)...)
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": message,
+		"code":  "INTERNAL_ERROR",
+	})
+}
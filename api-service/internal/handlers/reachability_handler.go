@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/models"
+	"hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/logger"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Reachability covers the last week unless asked otherwise, at most 90 days
+const (
+	defaultReachabilityHours = 7 * 24
+	maxReachabilityHours     = 90 * 24
+)
+
+// ReachabilityHandler serves per-ASN reachability and the protocols subscriptions recommend
+// per ASN
+type ReachabilityHandler struct {
+	reachabilityService interfaces.ReachabilityService
+	logger              *logger.Logger
+}
+
+type ASNPolicyRequest struct {
+	Name      string   `json:"name" validate:"max=100"`
+	Protocols []string `json:"protocols" validate:"required,min=1,max=4"`
+}
+
+func NewReachabilityHandler(reachabilityService interfaces.ReachabilityService, logger *logger.Logger) *ReachabilityHandler {
+	return &ReachabilityHandler{
+		reachabilityService: reachabilityService,
+		logger:              logger,
+	}
+}
+
+// GetReachability returns client telemetry and probe results by ASN over the last hours
+func (h *ReachabilityHandler) GetReachability(c *fiber.Ctx) error {
+	hours := c.QueryInt("hours", defaultReachabilityHours)
+	if hours <= 0 || hours > maxReachabilityHours {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "hours must be between 1 and " + strconv.Itoa(maxReachabilityHours),
+			"code":  "INVALID_RANGE",
+		})
+	}
+
+	since := time.Now().Add(-time.Duration(hours) * time.Hour)
+	reachability, err := h.reachabilityService.GetReachability(c.Context(), since)
+	if err != nil {
+		h.logger.Error("Failed to get reachability", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get reachability",
+			"code":  "REACHABILITY_FAILED",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"data":  reachability,
+		"since": since,
+	})
+}
+
+func (h *ReachabilityHandler) GetPolicies(c *fiber.Ctx) error {
+	policies, err := h.reachabilityService.ListPolicies(c.Context())
+	if err != nil {
+		h.logger.Error("Failed to get ASN protocol policies", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get ASN protocol policies",
+			"code":  "ASN_POLICIES_FAILED",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"data": policies,
+	})
+}
+
+// SetPolicy creates or replaces the protocols recommended to clients in an ASN
+func (h *ReachabilityHandler) SetPolicy(c *fiber.Ctx) error {
+	asn, ok := asnParam(c)
+	if !ok {
+		return invalidASN(c)
+	}
+
+	var req ASNPolicyRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+			"code":  "INVALID_REQUEST",
+		})
+	}
+	if ok, err := validateRequest(c, &req); !ok {
+		return err
+	}
+
+	policy := &models.ASNProtocolPolicy{
+		ASN:       asn,
+		Name:      req.Name,
+		Protocols: req.Protocols,
+	}
+	if err := h.reachabilityService.SetPolicy(c.Context(), policy); err != nil {
+		if errors.Is(err, interfaces.ErrPolicyInvalid) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+				"code":  "INVALID_ASN_POLICY",
+			})
+		}
+		h.logger.Error("Failed to set ASN protocol policy", "error", err, "asn", asn)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to set ASN protocol policy",
+			"code":  "ASN_POLICY_UPDATE_FAILED",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"data": policy,
+	})
+}
+
+func (h *ReachabilityHandler) DeletePolicy(c *fiber.Ctx) error {
+	asn, ok := asnParam(c)
+	if !ok {
+		return invalidASN(c)
+	}
+
+	if err := h.reachabilityService.DeletePolicy(c.Context(), asn); err != nil {
+		if errors.Is(err, interfaces.ErrNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "ASN protocol policy not found",
+				"code":  "ASN_POLICY_NOT_FOUND",
+			})
+		}
+		h.logger.Error("Failed to delete ASN protocol policy", "error", err, "asn", asn)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete ASN protocol policy",
+			"code":  "ASN_POLICY_UPDATE_FAILED",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "ASN protocol policy removed",
+	})
+}
+
+func asnParam(c *fiber.Ctx) (uint32, bool) {
+	return parseASN(c.Params("asn"))
+}
+
+// parseASN reads an AS number with or without its AS prefix, as in "AS8359" or "8359"
+func parseASN(value string) (uint32, bool) {
+	value = strings.TrimPrefix(strings.ToUpper(value), "AS")
+	asn, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || asn == 0 {
+		return 0, false
+	}
+	return uint32(asn), true
+}
+
+func invalidASN(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+		"error": "Invalid ASN",
+		"code":  "INVALID_ASN",
+	})
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"hysteria2_microservices/api-service/internal/models"
+	"hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/logger"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type RecommendationHandler struct {
+	recommendationService interfaces.RecommendationService
+	logger                *logger.Logger
+}
+
+func NewRecommendationHandler(recommendationService interfaces.RecommendationService, logger *logger.Logger) *RecommendationHandler {
+	return &RecommendationHandler{
+		recommendationService: recommendationService,
+		logger:                logger,
+	}
+}
+
+// RecommendNodes ranks the online nodes for the client, located by the ip, country and
+// region query parameters or else by the request itself
+func (h *RecommendationHandler) RecommendNodes(c *fiber.Ctx) error {
+	location := h.recommendationService.Locate(clientLocation(c))
+
+	nodes, err := h.recommendationService.Recommend(c.Context(), location, c.QueryInt("limit", 0))
+	if err != nil {
+		h.logger.Error("Failed to recommend nodes", "ip", location.IP, "region", location.Region, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to recommend nodes",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"client": location,
+		"nodes":  nodes,
+	})
+}
+
+// clientLocation reads an explicit location from the query, falling back to the
+// CDN-provided country header and the client address
+func clientLocation(c *fiber.Ctx) models.ClientLocation {
+	loc := requestLocation(c)
+	if ip := c.Query("ip"); ip != "" {
+		loc.IP = ip
+	}
+	if country := c.Query("country"); country != "" {
+		loc.Country = country
+	}
+	loc.Region = c.Query("region")
+	// Apps know the ASN from their own lookups; a bad value just leaves it unknown
+	if asn, ok := parseASN(c.Query("asn")); ok {
+		loc.ASN = asn
+	}
+	return loc
+}
+
+// requestLocation locates the client by its address and, when the request came through a
+// trusted proxy, the CDN-provided country header
+func requestLocation(c *fiber.Ctx) models.ClientLocation {
+	// IP reads the proxy header only from trusted proxies
+	loc := models.ClientLocation{IP: c.IP()}
+	if c.IsProxyTrusted() {
+		loc.Country = c.Get("CF-IPCountry")
+	}
+	// Cloudflare reports XX for unknown and T1 for Tor exits
+	if loc.Country == "XX" || loc.Country == "T1" {
+		loc.Country = ""
+	}
+	return loc
+}
@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"hysteria2_microservices/api-service/internal/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestLocationTrustsOnlyProxies(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted []string
+		want    models.ClientLocation
+	}{
+		// app.Test connects from 0.0.0.0
+		{"trusted proxy", []string{"0.0.0.0"}, models.ClientLocation{IP: "203.0.113.7", Country: "DE"}},
+		{"untrusted peer", []string{"10.0.0.1"}, models.ClientLocation{IP: "0.0.0.0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := fiber.New(fiber.Config{
+				ProxyHeader:             fiber.HeaderXForwardedFor,
+				EnableTrustedProxyCheck: true,
+				TrustedProxies:          tt.trusted,
+			})
+			app.Get("/", func(c *fiber.Ctx) error {
+				return c.JSON(requestLocation(c))
+			})
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set(fiber.HeaderXForwardedFor, "203.0.113.7")
+			req.Header.Set("CF-IPCountry", "DE")
+			resp, err := app.Test(req)
+			require.NoError(t, err)
+
+			var got models.ClientLocation
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&got))
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,281 @@
+package handlers
+
+import (
+	"errors"
+	"mime"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/models"
+	"hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/logger"
+	"hysteria2_microservices/api-service/pkg/validation"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+type ReportHandler struct {
+	reportService interfaces.ReportService
+	logger        *logger.Logger
+}
+
+// ReportQuery selects an on-demand report. Without from and to it covers the last complete
+// period.
+type ReportQuery struct {
+	Scope  string `json:"scope" validate:"required,oneof=user node tenant"`
+	ID     string `json:"id" validate:"required,uuid"`
+	Period string `json:"period" validate:"oneof=daily weekly monthly"`
+	Format string `json:"format" validate:"oneof=json csv pdf"`
+}
+
+// ReportScheduleRequest creates or replaces a schedule. A webhook token left out keeps the
+// current one.
+type ReportScheduleRequest struct {
+	Name         string   `json:"name" validate:"required,notblank,max=100"`
+	Scope        string   `json:"scope" validate:"required,oneof=user node tenant"`
+	SubjectID    string   `json:"subject_id" validate:"required,uuid"`
+	Period       string   `json:"period" validate:"required,oneof=daily weekly monthly"`
+	Format       string   `json:"format" validate:"omitempty,oneof=csv pdf"`
+	Emails       []string `json:"emails" validate:"max=20,dive,email"`
+	WebhookURL   string   `json:"webhook_url" validate:"omitempty,http_url,max=500"`
+	WebhookToken *string  `json:"webhook_token" validate:"omitempty,max=500"`
+	Enabled      *bool    `json:"enabled"`
+}
+
+func NewReportHandler(reportService interfaces.ReportService, logger *logger.Logger) *ReportHandler {
+	return &ReportHandler{
+		reportService: reportService,
+		logger:        logger,
+	}
+}
+
+// GetReport builds a usage report as JSON, CSV or PDF
+func (h *ReportHandler) GetReport(c *fiber.Ctx) error {
+	query := ReportQuery{
+		Scope:  c.Query("scope"),
+		ID:     c.Query("id"),
+		Period: c.Query("period", models.ReportMonthly),
+		Format: c.Query("format", "json"),
+	}
+	if ok, err := validateRequest(c, &query); !ok {
+		return err
+	}
+
+	to := models.ReportPeriodStart(query.Period, time.Now())
+	from := models.AddReportPeriods(query.Period, to, -1)
+	if c.Query("from") != "" || c.Query("to") != "" {
+		var errFrom, errTo error
+		from, errFrom = time.Parse(time.RFC3339, c.Query("from"))
+		to, errTo = time.Parse(time.RFC3339, c.Query("to"))
+		if errFrom != nil || errTo != nil || !to.After(from) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "from and to must both be RFC3339 times, from before to",
+				"code":  "INVALID_TIME_RANGE",
+			})
+		}
+	}
+
+	subjectID := uuid.MustParse(query.ID)
+	report, err := h.reportService.Generate(c.Context(), query.Scope, subjectID, from, to)
+	if err != nil {
+		return h.failure(c, err, "Failed to generate report", "scope", query.Scope, "subject_id", subjectID)
+	}
+
+	if query.Format == "json" {
+		return c.JSON(report)
+	}
+
+	data, contentType, err := h.reportService.Render(report, query.Format)
+	if err != nil {
+		return h.failure(c, err, "Failed to render report", "scope", query.Scope, "subject_id", subjectID)
+	}
+	c.Set(fiber.HeaderContentType, contentType)
+	c.Set(fiber.HeaderContentDisposition, mime.FormatMediaType("attachment", map[string]string{
+		"filename": report.Filename(query.Format),
+	}))
+	return c.Send(data)
+}
+
+func (h *ReportHandler) GetSchedules(c *fiber.Ctx) error {
+	page, limit := pagination(c)
+
+	schedules, total, err := h.reportService.ListSchedules(c.Context(), page, limit)
+	if err != nil {
+		return h.failure(c, err, "Failed to list report schedules")
+	}
+
+	return c.JSON(fiber.Map{
+		"data":  schedules,
+		"total": total,
+		"page":  page,
+		"limit": limit,
+	})
+}
+
+func (h *ReportHandler) GetSchedule(c *fiber.Ctx) error {
+	scheduleID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return invalidScheduleID(c)
+	}
+
+	schedule, err := h.reportService.GetSchedule(c.Context(), scheduleID)
+	if err != nil {
+		return h.failure(c, err, "Failed to get report schedule", "schedule_id", scheduleID)
+	}
+
+	return c.JSON(schedule)
+}
+
+func (h *ReportHandler) CreateSchedule(c *fiber.Ctx) error {
+	var req ReportScheduleRequest
+	if err := c.BodyParser(&req); err != nil {
+		return invalidRequestBody(c)
+	}
+	if ok, err := validateRequest(c, &req); !ok {
+		return err
+	}
+
+	schedule := &models.ReportSchedule{Enabled: true}
+	if creator, ok := callerID(c); ok {
+		schedule.CreatedBy = &creator
+	}
+	req.apply(schedule)
+
+	if err := h.reportService.CreateSchedule(c.Context(), schedule); err != nil {
+		return h.failure(c, err, "Failed to create report schedule", "scope", req.Scope, "subject_id", req.SubjectID)
+	}
+
+	h.logger.Info("Report schedule created", "schedule_id", schedule.ID, "scope", schedule.Scope,
+		"subject_id", schedule.SubjectID, "period", schedule.Period)
+
+	return c.Status(fiber.StatusCreated).JSON(schedule)
+}
+
+func (h *ReportHandler) UpdateSchedule(c *fiber.Ctx) error {
+	scheduleID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return invalidScheduleID(c)
+	}
+
+	var req ReportScheduleRequest
+	if err := c.BodyParser(&req); err != nil {
+		return invalidRequestBody(c)
+	}
+	if ok, err := validateRequest(c, &req); !ok {
+		return err
+	}
+
+	schedule, err := h.reportService.GetSchedule(c.Context(), scheduleID)
+	if err != nil {
+		return h.failure(c, err, "Failed to get report schedule", "schedule_id", scheduleID)
+	}
+	req.apply(schedule)
+
+	if err := h.reportService.UpdateSchedule(c.Context(), schedule); err != nil {
+		return h.failure(c, err, "Failed to update report schedule", "schedule_id", scheduleID)
+	}
+
+	return c.JSON(schedule)
+}
+
+func (h *ReportHandler) DeleteSchedule(c *fiber.Ctx) error {
+	scheduleID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return invalidScheduleID(c)
+	}
+
+	if err := h.reportService.DeleteSchedule(c.Context(), scheduleID); err != nil {
+		return h.failure(c, err, "Failed to delete report schedule", "schedule_id", scheduleID)
+	}
+
+	h.logger.Info("Report schedule deleted", "schedule_id", scheduleID)
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// RunSchedule delivers the schedule's report of the last complete period now, without
+// moving its next run
+func (h *ReportHandler) RunSchedule(c *fiber.Ctx) error {
+	scheduleID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return invalidScheduleID(c)
+	}
+
+	schedule, err := h.reportService.RunSchedule(c.Context(), scheduleID)
+	if err != nil {
+		if errors.Is(err, interfaces.ErrDeliveryFailed) {
+			h.logger.Warn("Report delivery failed", "schedule_id", scheduleID, "error", err)
+			return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+				"error":    err.Error(),
+				"code":     "DELIVERY_FAILED",
+				"schedule": schedule,
+			})
+		}
+		return h.failure(c, err, "Failed to run report schedule", "schedule_id", scheduleID)
+	}
+
+	return c.JSON(fiber.Map{
+		"data":    schedule,
+		"message": "Report delivered",
+	})
+}
+
+// apply copies the request onto a schedule
+func (req *ReportScheduleRequest) apply(schedule *models.ReportSchedule) {
+	schedule.Name = req.Name
+	schedule.Scope = req.Scope
+	schedule.SubjectID = uuid.MustParse(req.SubjectID)
+	schedule.Period = req.Period
+	schedule.Format = req.Format
+	if schedule.Format == "" {
+		schedule.Format = "csv"
+	}
+	schedule.Emails = req.Emails
+	schedule.WebhookURL = req.WebhookURL
+	if req.WebhookToken != nil {
+		schedule.WebhookToken = *req.WebhookToken
+	}
+	if req.Enabled != nil {
+		schedule.Enabled = *req.Enabled
+	}
+}
+
+func (h *ReportHandler) failure(c *fiber.Ctx, err error, message string, fields ...interface{}) error {
+	var validationErr *validation.Error
+	switch {
+	case errors.As(err, &validationErr):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "Invalid request",
+			"code":    "VALIDATION_ERROR",
+			"details": validationErr.Fields,
+		})
+	case errors.Is(err, interfaces.ErrNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Not found",
+			"code":  "NOT_FOUND",
+		})
+	case errors.Is(err, interfaces.ErrAnalyticsDisabled):
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": "Node reports need analytics, which is not configured",
+			"code":  "ANALYTICS_DISABLED",
+		})
+	case errors.Is(err, interfaces.ErrEmailDisabled):
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": "Email delivery is not configured",
+			"code":  "EMAIL_DISABLED",
+		})
+	}
+
+	h.logger.Error(append([]interface{}{message, "error", err}, fields...)...)
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": message,
+		"code":  "INTERNAL_ERROR",
+	})
+}
+
+func invalidScheduleID(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+		"error": "Invalid schedule ID",
+		"code":  "INVALID_SCHEDULE_ID",
+	})
+}
@@ -0,0 +1,468 @@
+package handlers
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/models"
+	"hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/logger"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// ResellerHandler serves the platform admin endpoints managing reseller quotas and the
+// reseller-scoped endpoints, which act on the caller's own users only
+type ResellerHandler struct {
+	resellerService interfaces.ResellerService
+	logger          *logger.Logger
+}
+
+type CreateResellerRequest struct {
+	UserID    string `json:"user_id" validate:"required,uuid"`
+	MaxUsers  int    `json:"max_users" validate:"min=0"`
+	DataQuota int64  `json:"data_quota" validate:"min=0"`
+}
+
+type UpdateResellerRequest struct {
+	MaxUsers  *int   `json:"max_users" validate:"omitempty,min=0"`
+	DataQuota *int64 `json:"data_quota" validate:"omitempty,min=0"`
+}
+
+type CreateResellerUserRequest struct {
+	Username   string     `json:"username" validate:"required,min=3,max=50"`
+	Email      string     `json:"email" validate:"required,email"`
+	Password   string     `json:"password" validate:"required,notblank,min=8"`
+	FullName   *string    `json:"full_name"`
+	DataLimit  int64      `json:"data_limit" validate:"min=0"`
+	ExpiryDate *time.Time `json:"expiry_date"`
+	Notes      *string    `json:"notes"`
+}
+
+type UpdateResellerUserRequest struct {
+	Email      *string    `json:"email" validate:"omitempty,email"`
+	FullName   *string    `json:"full_name"`
+	Status     *string    `json:"status" validate:"omitempty,oneof=active suspended"`
+	DataLimit  *int64     `json:"data_limit" validate:"omitempty,min=0"`
+	ExpiryDate *time.Time `json:"expiry_date"`
+	Notes      *string    `json:"notes"`
+}
+
+func NewResellerHandler(resellerService interfaces.ResellerService, logger *logger.Logger) *ResellerHandler {
+	return &ResellerHandler{
+		resellerService: resellerService,
+		logger:          logger,
+	}
+}
+
+func (h *ResellerHandler) GetResellers(c *fiber.Ctx) error {
+	page, limit := pagination(c)
+
+	resellers, total, err := h.resellerService.ListResellers(c.Context(), page, limit)
+	if err != nil {
+		h.logger.Error("Failed to list resellers", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to list resellers",
+			"code":  "RESELLERS_FAILED",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"data":  resellers,
+		"total": total,
+		"page":  page,
+		"limit": limit,
+	})
+}
+
+func (h *ResellerHandler) GetReseller(c *fiber.Ctx) error {
+	resellerID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return invalidResellerID(c)
+	}
+
+	reseller, err := h.resellerService.GetReseller(c.Context(), resellerID)
+	if err != nil {
+		return h.failure(c, err, "Failed to get reseller", "reseller_id", resellerID)
+	}
+
+	return c.JSON(reseller)
+}
+
+// CreateReseller gives an existing platform user the reseller role with a quota
+func (h *ResellerHandler) CreateReseller(c *fiber.Ctx) error {
+	var req CreateResellerRequest
+	if err := c.BodyParser(&req); err != nil {
+		return invalidRequestBody(c)
+	}
+	if ok, err := validateRequest(c, &req); !ok {
+		return err
+	}
+
+	reseller := &models.Reseller{
+		UserID:    uuid.MustParse(req.UserID),
+		MaxUsers:  req.MaxUsers,
+		DataQuota: req.DataQuota,
+	}
+	if err := h.resellerService.CreateReseller(c.Context(), reseller); err != nil {
+		return h.failure(c, err, "Failed to create reseller", "user_id", req.UserID)
+	}
+
+	h.logger.Info("Reseller created", "reseller_id", reseller.UserID, "max_users", reseller.MaxUsers, "data_quota", reseller.DataQuota)
+
+	return c.Status(fiber.StatusCreated).JSON(reseller)
+}
+
+func (h *ResellerHandler) UpdateReseller(c *fiber.Ctx) error {
+	resellerID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return invalidResellerID(c)
+	}
+
+	var req UpdateResellerRequest
+	if err := c.BodyParser(&req); err != nil {
+		return invalidRequestBody(c)
+	}
+	if ok, err := validateRequest(c, &req); !ok {
+		return err
+	}
+
+	reseller, err := h.resellerService.GetReseller(c.Context(), resellerID)
+	if err != nil {
+		return h.failure(c, err, "Failed to get reseller", "reseller_id", resellerID)
+	}
+	if req.MaxUsers != nil {
+		reseller.MaxUsers = *req.MaxUsers
+	}
+	if req.DataQuota != nil {
+		reseller.DataQuota = *req.DataQuota
+	}
+
+	if err := h.resellerService.UpdateReseller(c.Context(), reseller); err != nil {
+		return h.failure(c, err, "Failed to update reseller", "reseller_id", resellerID)
+	}
+
+	h.logger.Info("Reseller quota updated", "reseller_id", resellerID, "max_users", reseller.MaxUsers, "data_quota", reseller.DataQuota)
+
+	return c.JSON(reseller)
+}
+
+func (h *ResellerHandler) DeleteReseller(c *fiber.Ctx) error {
+	resellerID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return invalidResellerID(c)
+	}
+
+	if err := h.resellerService.DeleteReseller(c.Context(), resellerID); err != nil {
+		return h.failure(c, err, "Failed to delete reseller", "reseller_id", resellerID)
+	}
+
+	h.logger.Info("Reseller deleted", "reseller_id", resellerID)
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// RequireReseller admits callers with a reseller quota. Admins pass the role check but own
+// no users, so they are turned away here too.
+func (h *ResellerHandler) RequireReseller(c *fiber.Ctx) error {
+	resellerID, ok := callerID(c)
+	if !ok {
+		return invalidCaller(c)
+	}
+
+	if _, err := h.resellerService.GetReseller(c.Context(), resellerID); err != nil {
+		if errors.Is(err, interfaces.ErrNotFound) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "Caller is not a reseller",
+				"code":  "NOT_A_RESELLER",
+			})
+		}
+		return h.failure(c, err, "Failed to get reseller", "reseller_id", resellerID)
+	}
+	return c.Next()
+}
+
+// GetQuota returns the caller's quota and how much of it their users take
+func (h *ResellerHandler) GetQuota(c *fiber.Ctx) error {
+	resellerID, _ := callerID(c)
+
+	reseller, err := h.resellerService.GetReseller(c.Context(), resellerID)
+	if err != nil {
+		return h.failure(c, err, "Failed to get reseller", "reseller_id", resellerID)
+	}
+
+	return c.JSON(fiber.Map{
+		"max_users":  reseller.MaxUsers,
+		"data_quota": reseller.DataQuota,
+		"usage":      reseller.Usage,
+	})
+}
+
+func (h *ResellerHandler) GetUsers(c *fiber.Ctx) error {
+	resellerID, _ := callerID(c)
+	page, limit := pagination(c)
+
+	users, total, err := h.resellerService.ListUsers(c.Context(), resellerID, page, limit, c.Query("search"), c.Query("status"))
+	if err != nil {
+		return h.failure(c, err, "Failed to get users", "reseller_id", resellerID)
+	}
+
+	return c.JSON(fiber.Map{
+		"users": users,
+		"total": total,
+		"page":  page,
+		"limit": limit,
+	})
+}
+
+func (h *ResellerHandler) GetUser(c *fiber.Ctx) error {
+	resellerID, _ := callerID(c)
+	userID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return invalidUserID(c)
+	}
+
+	user, err := h.resellerService.GetUser(c.Context(), resellerID, userID)
+	if err != nil {
+		return h.failure(c, err, "Failed to get user", "reseller_id", resellerID, "user_id", userID)
+	}
+
+	return c.JSON(user)
+}
+
+func (h *ResellerHandler) CreateUser(c *fiber.Ctx) error {
+	resellerID, _ := callerID(c)
+
+	var req CreateResellerUserRequest
+	if err := c.BodyParser(&req); err != nil {
+		return invalidRequestBody(c)
+	}
+	if ok, err := validateRequest(c, &req); !ok {
+		return err
+	}
+
+	user := &models.User{
+		Username:   req.Username,
+		Email:      req.Email,
+		Password:   req.Password, // Hashed in service
+		FullName:   req.FullName,
+		Status:     "active",
+		DataLimit:  req.DataLimit,
+		ExpiryDate: req.ExpiryDate,
+		Notes:      req.Notes,
+	}
+	if err := h.resellerService.CreateUser(c.Context(), resellerID, user); err != nil {
+		return h.failure(c, err, "Failed to create user", "reseller_id", resellerID, "username", req.Username)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(user)
+}
+
+func (h *ResellerHandler) UpdateUser(c *fiber.Ctx) error {
+	resellerID, _ := callerID(c)
+	userID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return invalidUserID(c)
+	}
+
+	var req UpdateResellerUserRequest
+	if err := c.BodyParser(&req); err != nil {
+		return invalidRequestBody(c)
+	}
+	if ok, err := validateRequest(c, &req); !ok {
+		return err
+	}
+
+	user, err := h.resellerService.GetUser(c.Context(), resellerID, userID)
+	if err != nil {
+		return h.failure(c, err, "Failed to get user", "reseller_id", resellerID, "user_id", userID)
+	}
+	if req.Email != nil {
+		user.Email = *req.Email
+	}
+	if req.FullName != nil {
+		user.FullName = req.FullName
+	}
+	if req.Status != nil {
+		user.Status = *req.Status
+	}
+	if req.DataLimit != nil {
+		user.DataLimit = *req.DataLimit
+	}
+	if req.ExpiryDate != nil {
+		user.ExpiryDate = req.ExpiryDate
+	}
+	if req.Notes != nil {
+		user.Notes = req.Notes
+	}
+
+	if err := h.resellerService.UpdateUser(c.Context(), resellerID, user); err != nil {
+		return h.failure(c, err, "Failed to update user", "reseller_id", resellerID, "user_id", userID)
+	}
+
+	return c.JSON(user)
+}
+
+func (h *ResellerHandler) DeleteUser(c *fiber.Ctx) error {
+	resellerID, _ := callerID(c)
+	userID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return invalidUserID(c)
+	}
+
+	if err := h.resellerService.DeleteUser(c.Context(), resellerID, userID); err != nil {
+		return h.failure(c, err, "Failed to delete user", "reseller_id", resellerID, "user_id", userID)
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// GetTraffic returns the traffic of the caller's users, by default for the last 30 days
+func (h *ResellerHandler) GetTraffic(c *fiber.Ctx) error {
+	resellerID, _ := callerID(c)
+
+	now := time.Now()
+	from := now.AddDate(0, 0, -30)
+	to := now
+
+	var err error
+	if fromStr := c.Query("from"); fromStr != "" {
+		if from, err = time.Parse(time.RFC3339, fromStr); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid from time format (use RFC3339)",
+				"code":  "INVALID_TIME_RANGE",
+			})
+		}
+	}
+	if toStr := c.Query("to"); toStr != "" {
+		if to, err = time.Parse(time.RFC3339, toStr); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid to time format (use RFC3339)",
+				"code":  "INVALID_TIME_RANGE",
+			})
+		}
+	}
+
+	traffic, err := h.resellerService.GetTraffic(c.Context(), resellerID, from, to)
+	if err != nil {
+		return h.failure(c, err, "Failed to get traffic", "reseller_id", resellerID)
+	}
+
+	return c.JSON(traffic)
+}
+
+// GetNodes lists the nodes available to the caller without their addresses and metadata
+func (h *ResellerHandler) GetNodes(c *fiber.Ctx) error {
+	resellerID, _ := callerID(c)
+
+	nodes, err := h.resellerService.GetNodes(c.Context(), resellerID)
+	if err != nil {
+		return h.failure(c, err, "Failed to get nodes", "reseller_id", resellerID)
+	}
+
+	view := make([]fiber.Map, 0, len(nodes))
+	for _, node := range nodes {
+		view = append(view, fiber.Map{
+			"id":             node.ID,
+			"name":           node.Name,
+			"location":       node.Location,
+			"country":        node.Country,
+			"status":         node.Status,
+			"last_heartbeat": node.LastHeartbeat,
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"nodes": view,
+	})
+}
+
+// failure answers the errors of the reseller service. Users of other resellers are
+// reported as not found.
+func (h *ResellerHandler) failure(c *fiber.Ctx, err error, message string, fields ...interface{}) error {
+	switch {
+	case errors.Is(err, interfaces.ErrNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Not found",
+			"code":  "NOT_FOUND",
+		})
+	case errors.Is(err, interfaces.ErrQuotaExceeded):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": err.Error(),
+			"code":  "QUOTA_EXCEEDED",
+		})
+	case errors.Is(err, interfaces.ErrUsernameTaken):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Username already exists",
+			"code":  "USERNAME_TAKEN",
+		})
+	case errors.Is(err, interfaces.ErrEmailTaken):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Email already exists",
+			"code":  "EMAIL_TAKEN",
+		})
+	case errors.Is(err, interfaces.ErrResellerExists):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "User already is a reseller",
+			"code":  "RESELLER_EXISTS",
+		})
+	case errors.Is(err, interfaces.ErrResellerIneligible):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Admins and reseller users cannot become resellers",
+			"code":  "RESELLER_INELIGIBLE",
+		})
+	case errors.Is(err, interfaces.ErrResellerHasUsers):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Reseller still owns users",
+			"code":  "RESELLER_HAS_USERS",
+		})
+	}
+
+	h.logger.Error(append([]interface{}{message, "error", err}, fields...)...)
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": message,
+		"code":  "INTERNAL_ERROR",
+	})
+}
+
+// pagination reads the page and limit query parameters, limiting pages to 100 items
+func pagination(c *fiber.Ctx) (int, int) {
+	page := 1
+	limit := 50
+
+	if p := c.Query("page"); p != "" {
+		if parsed, err := strconv.Atoi(p); err == nil && parsed > 0 {
+			page = parsed
+		}
+	}
+
+	if l := c.Query("limit"); l != "" {
+		if parsed, err := strconv.Atoi(l); err == nil && parsed > 0 && parsed <= 100 {
+			limit = parsed
+		}
+	}
+	return page, limit
+}
+
+func invalidResellerID(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+		"error": "Invalid reseller ID",
+		"code":  "INVALID_RESELLER_ID",
+	})
+}
+
+func invalidUserID(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+		"error": "Invalid user ID",
+		"code":  "INVALID_USER_ID",
+	})
+}
+
+func invalidRequestBody(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+		"error": "Invalid request body",
+		"code":  "INVALID_REQUEST",
+	})
+}
@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"errors"
+
+	"hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/logger"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type RetentionHandler struct {
+	retentionService interfaces.RetentionService
+	logger           *logger.Logger
+}
+
+func NewRetentionHandler(retentionService interfaces.RetentionService, logger *logger.Logger) *RetentionHandler {
+	return &RetentionHandler{
+		retentionService: retentionService,
+		logger:           logger,
+	}
+}
+
+func (h *RetentionHandler) GetRetentionStatus(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"policy":      h.retentionService.GetPolicy(),
+		"last_report": h.retentionService.GetLastReport(c.Context()),
+	})
+}
+
+func (h *RetentionHandler) RunRetention(c *fiber.Ctx) error {
+	report, err := h.retentionService.RunOnce(c.Context())
+	if errors.Is(err, interfaces.ErrJobRunning) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Retention is already running",
+			"code":  "JOB_RUNNING",
+		})
+	}
+	if err != nil {
+		h.logger.Error("Failed to run retention", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":  "Failed to run retention",
+			"code":   "RETENTION_FAILED",
+			"report": report,
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"data":    report,
+		"message": "Retention run completed",
+	})
+}
@@ -0,0 +1,329 @@
+package handlers
+
+import (
+	"net/url"
+
+	"hysteria2_microservices/api-service/internal/models"
+	"hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/logger"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// SNIHandler manages the SNI domains of a node and the certificates it serves them with,
+// for admins
+type SNIHandler struct {
+	sniService interfaces.SNIService
+	logger     *logger.Logger
+}
+
+type SNIDomainRequest struct {
+	Domain           string `json:"domain" validate:"required,max=253"`
+	ManageDNS        bool   `json:"manage_dns"`
+	Overwrite        bool   `json:"overwrite"`
+	IssueCertificate bool   `json:"issue_certificate"`
+	Email            string `json:"email" validate:"omitempty,email"`
+	WaitSeconds      int    `json:"wait_seconds" validate:"min=0,max=600"`
+}
+
+// CertificateRenewalRequest renews on the given nodes, or on every node holding a
+// certificate that matches the filters when none is given
+type CertificateRenewalRequest struct {
+	NodeIDs            []string `json:"node_ids" validate:"max=500,dive,uuid"`
+	ExpiringWithinDays int      `json:"expiring_within_days" validate:"min=0,max=365"`
+	SelfSigned         bool     `json:"self_signed"`
+}
+
+// CertificateUploadRequest carries PEM: the leaf followed by its intermediates, its key and,
+// for an internal CA, the CA's root certificates
+type CertificateUploadRequest struct {
+	Domain         string `json:"domain" validate:"required,max=253"`
+	CertificatePEM string `json:"certificate_pem" validate:"required,max=65536"`
+	PrivateKeyPEM  string `json:"private_key_pem" validate:"required,max=16384"`
+	CABundlePEM    string `json:"ca_bundle_pem" validate:"max=262144"`
+}
+
+func NewSNIHandler(sniService interfaces.SNIService, logger *logger.Logger) *SNIHandler {
+	return &SNIHandler{
+		sniService: sniService,
+		logger:     logger,
+	}
+}
+
+// AddDomain adds a domain to the node. The call waits up to wait_seconds for the domain to
+// resolve to the node, a domain that does not is still added.
+func (h *SNIHandler) AddDomain(c *fiber.Ctx) error {
+	nodeID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return invalidNodeID(c)
+	}
+
+	var req SNIDomainRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+			"code":  "INVALID_REQUEST",
+		})
+	}
+	if ok, err := validateRequest(c, &req); !ok {
+		return err
+	}
+
+	result, err := h.sniService.AddDomain(c.Context(), nodeID, &models.SNIDomainOnboarding{
+		Domain:           req.Domain,
+		ManageDNS:        req.ManageDNS,
+		Overwrite:        req.Overwrite,
+		IssueCertificate: req.IssueCertificate,
+		Email:            req.Email,
+		WaitSeconds:      req.WaitSeconds,
+	})
+	if err != nil {
+		h.logger.Error("Failed to add SNI domain", "error", err, "node_id", nodeID, "domain", req.Domain)
+		return orchestratorFailure(c, err, "Failed to add SNI domain")
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"data": result,
+	})
+}
+
+func (h *SNIHandler) RemoveDomain(c *fiber.Ctx) error {
+	nodeID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return invalidNodeID(c)
+	}
+	domain, err := url.PathUnescape(c.Params("domain"))
+	if err != nil || domain == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid domain",
+			"code":  "INVALID_DOMAIN",
+		})
+	}
+
+	domains, err := h.sniService.RemoveDomain(c.Context(), nodeID, domain)
+	if err != nil {
+		h.logger.Error("Failed to remove SNI domain", "error", err, "node_id", nodeID, "domain", domain)
+		return orchestratorFailure(c, err, "Failed to remove SNI domain")
+	}
+
+	return c.JSON(fiber.Map{
+		"data": domains,
+	})
+}
+
+func (h *SNIHandler) GetCertificates(c *fiber.Ctx) error {
+	nodeID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return invalidNodeID(c)
+	}
+
+	status, err := h.sniService.GetCertificates(c.Context(), nodeID)
+	if err != nil {
+		h.logger.Error("Failed to get certificate status", "error", err, "node_id", nodeID)
+		return orchestratorFailure(c, err, "Failed to get certificate status")
+	}
+
+	return c.JSON(fiber.Map{
+		"data": status,
+	})
+}
+
+// RenewCertificates forces the node to renew its certificates now
+func (h *SNIHandler) RenewCertificates(c *fiber.Ctx) error {
+	nodeID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return invalidNodeID(c)
+	}
+
+	message, err := h.sniService.RenewCertificates(c.Context(), nodeID)
+	if err != nil {
+		h.logger.Error("Failed to renew certificates", "error", err, "node_id", nodeID)
+		return orchestratorFailure(c, err, "Failed to renew certificates")
+	}
+
+	return c.JSON(fiber.Map{
+		"message": message,
+	})
+}
+
+// ListInventory returns the certificates of every node as the orchestrator last synced
+// them. Filters: node_id, domain, expiring_within (days) and self_signed.
+func (h *SNIHandler) ListInventory(c *fiber.Ctx) error {
+	filter := models.CertificateFilter{
+		Domain:             c.Query("domain"),
+		ExpiringWithinDays: c.QueryInt("expiring_within", 0),
+		SelfSigned:         c.QueryBool("self_signed", false),
+	}
+	if raw := c.Query("node_id"); raw != "" {
+		nodeID, err := uuid.Parse(raw)
+		if err != nil {
+			return invalidNodeID(c)
+		}
+		filter.NodeID = &nodeID
+	}
+	if filter.ExpiringWithinDays < 0 || filter.ExpiringWithinDays > 365 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "expiring_within must be between 0 and 365 days",
+			"code":  "INVALID_REQUEST",
+		})
+	}
+
+	certificates, err := h.sniService.ListInventory(c.Context(), filter)
+	if err != nil {
+		h.logger.Error("Failed to list certificates", "error", err)
+		return orchestratorFailure(c, err, "Failed to list certificates")
+	}
+
+	return c.JSON(fiber.Map{
+		"data": certificates,
+	})
+}
+
+// BulkRenew renews certificates on several nodes. Nodes are renewed one after another, so
+// the call may take minutes; the failures are reported per node.
+func (h *SNIHandler) BulkRenew(c *fiber.Ctx) error {
+	var req CertificateRenewalRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+			"code":  "INVALID_REQUEST",
+		})
+	}
+	if ok, err := validateRequest(c, &req); !ok {
+		return err
+	}
+
+	nodeIDs := make([]uuid.UUID, 0, len(req.NodeIDs))
+	for _, raw := range req.NodeIDs {
+		nodeIDs = append(nodeIDs, uuid.MustParse(raw))
+	}
+	renewal, err := h.sniService.BulkRenew(c.Context(), nodeIDs, models.CertificateFilter{
+		ExpiringWithinDays: req.ExpiringWithinDays,
+		SelfSigned:         req.SelfSigned,
+	})
+	if err != nil {
+		h.logger.Error("Failed to renew certificates", "error", err, "nodes", len(nodeIDs))
+		return orchestratorFailure(c, err, "Failed to renew certificates")
+	}
+
+	return c.JSON(fiber.Map{
+		"data": renewal,
+	})
+}
+
+// UploadCertificate uploads a certificate for a domain ACME cannot serve and installs it on
+// every node serving a domain it covers. The orchestrator rejects a key that does not match,
+// a certificate not valid for the domain and a chain it cannot verify with 400; nodes that
+// could not be updated are listed in the failures and get the certificate at a later
+// inventory sync.
+func (h *SNIHandler) UploadCertificate(c *fiber.Ctx) error {
+	var req CertificateUploadRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+			"code":  "INVALID_REQUEST",
+		})
+	}
+	if ok, err := validateRequest(c, &req); !ok {
+		return err
+	}
+
+	distribution, err := h.sniService.Upload(c.Context(), &models.CertificateUpload{
+		Domain:         req.Domain,
+		CertificatePEM: req.CertificatePEM,
+		PrivateKeyPEM:  req.PrivateKeyPEM,
+		CABundlePEM:    req.CABundlePEM,
+	})
+	if err != nil {
+		h.logger.Error("Failed to upload certificate", "error", err, "domain", req.Domain)
+		return orchestratorFailure(c, err, "Failed to upload certificate")
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"data": distribution,
+	})
+}
+
+func (h *SNIHandler) ListUploads(c *fiber.Ctx) error {
+	certificates, err := h.sniService.ListUploads(c.Context())
+	if err != nil {
+		h.logger.Error("Failed to list uploaded certificates", "error", err)
+		return orchestratorFailure(c, err, "Failed to list uploaded certificates")
+	}
+
+	return c.JSON(fiber.Map{
+		"data": certificates,
+	})
+}
+
+// DeleteUpload deletes the upload of a domain. Nodes keep serving the certificate until it
+// is replaced.
+func (h *SNIHandler) DeleteUpload(c *fiber.Ctx) error {
+	domain, err := url.PathUnescape(c.Params("domain"))
+	if err != nil || domain == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid domain",
+			"code":  "INVALID_DOMAIN",
+		})
+	}
+
+	message, err := h.sniService.DeleteUpload(c.Context(), domain)
+	if err != nil {
+		h.logger.Error("Failed to delete uploaded certificate", "error", err, "domain", domain)
+		return orchestratorFailure(c, err, "Failed to delete uploaded certificate")
+	}
+
+	return c.JSON(fiber.Map{
+		"message": message,
+	})
+}
+
+// CheckTLS has another node grade the TLS the node serves on its TCP ports and returns the
+// report with a remediation hint for every check that did not pass
+func (h *SNIHandler) CheckTLS(c *fiber.Ctx) error {
+	nodeID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return invalidNodeID(c)
+	}
+
+	report, err := h.sniService.CheckTLS(c.Context(), nodeID)
+	if err != nil {
+		h.logger.Error("Failed to run TLS check", "error", err, "node_id", nodeID)
+		return orchestratorFailure(c, err, "Failed to run TLS check")
+	}
+
+	return c.JSON(fiber.Map{
+		"data": report,
+	})
+}
+
+func (h *SNIHandler) ListTLSReports(c *fiber.Ctx) error {
+	nodeID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return invalidNodeID(c)
+	}
+
+	reports, err := h.sniService.ListTLSReports(c.Context(), &nodeID)
+	if err != nil {
+		h.logger.Error("Failed to list TLS reports", "error", err, "node_id", nodeID)
+		return orchestratorFailure(c, err, "Failed to list TLS reports")
+	}
+
+	return c.JSON(fiber.Map{
+		"data": reports,
+	})
+}
+
+// ListTLSGrades returns the latest TLS report of every checked node, worst grade first
+func (h *SNIHandler) ListTLSGrades(c *fiber.Ctx) error {
+	reports, err := h.sniService.ListTLSReports(c.Context(), nil)
+	if err != nil {
+		h.logger.Error("Failed to list TLS reports", "error", err)
+		return orchestratorFailure(c, err, "Failed to list TLS reports")
+	}
+
+	return c.JSON(fiber.Map{
+		"data": reports,
+	})
+}
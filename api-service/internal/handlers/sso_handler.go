@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+
+	"hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/logger"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type SSOHandler struct {
+	ssoService        interfaces.SSOService
+	authService       interfaces.AuthService
+	postLoginRedirect string
+	logger            *logger.Logger
+}
+
+// NewSSOHandler creates the single sign-on handler. With a postLoginRedirect the callback
+// sends the browser there with the tokens in the URL fragment; without one it answers like
+// the password login.
+func NewSSOHandler(ssoService interfaces.SSOService, authService interfaces.AuthService, postLoginRedirect string, logger *logger.Logger) *SSOHandler {
+	return &SSOHandler{
+		ssoService:        ssoService,
+		authService:       authService,
+		postLoginRedirect: postLoginRedirect,
+		logger:            logger,
+	}
+}
+
+// Login sends the browser to the provider's sign-in page
+func (h *SSOHandler) Login(c *fiber.Ctx) error {
+	authURL, err := h.ssoService.Begin(c.Context())
+	if err != nil {
+		h.logger.Error("Failed to start single sign-on", "error", err)
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"error": "Identity provider is unavailable",
+			"code":  "SSO_FAILED",
+		})
+	}
+	return c.Redirect(authURL, fiber.StatusFound)
+}
+
+// Callback completes a sign-in the provider redirected back with and issues tokens
+func (h *SSOHandler) Callback(c *fiber.Ctx) error {
+	if providerErr := c.Query("error"); providerErr != "" {
+		h.logger.Warn("Identity provider refused sign-in", "error", providerErr, "description", c.Query("error_description"))
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Sign-in was refused by the identity provider: " + providerErr,
+			"code":  "SSO_DENIED",
+		})
+	}
+
+	state, code := c.Query("state"), c.Query("code")
+	if state == "" || code == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "state and code are required",
+			"code":  "SSO_STATE_INVALID",
+		})
+	}
+
+	user, err := h.ssoService.Complete(c.Context(), state, code)
+	if err != nil {
+		switch {
+		case errors.Is(err, interfaces.ErrSSOStateInvalid):
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Sign-in expired or was already completed, please start again",
+				"code":  "SSO_STATE_INVALID",
+			})
+		case errors.Is(err, interfaces.ErrSSODenied):
+			h.logger.Warn("Single sign-on denied", "error", err)
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": err.Error(),
+				"code":  "SSO_DENIED",
+			})
+		case errors.Is(err, interfaces.ErrUsernameTaken):
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "No free username could be derived for the account",
+				"code":  "USERNAME_TAKEN",
+			})
+		}
+		h.logger.Error("Failed to complete single sign-on", "error", err)
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"error": "Single sign-on failed",
+			"code":  "SSO_FAILED",
+		})
+	}
+
+	tokenPair, err := h.authService.GenerateTokenPair(user.ID)
+	if err != nil {
+		h.logger.Error("Failed to generate token pair", "error", err, "user_id", user.ID)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate tokens",
+			"code":  "TOKEN_GENERATION_FAILED",
+		})
+	}
+
+	h.logger.Info("User logged in with single sign-on", "user_id", user.ID, "username", user.Username, "role", user.Role)
+
+	if h.postLoginRedirect != "" {
+		// The fragment never reaches a server, so the tokens stay out of access logs
+		fragment := url.Values{
+			"access_token":  {tokenPair.AccessToken},
+			"refresh_token": {tokenPair.RefreshToken},
+			"expires_in":    {strconv.FormatInt(tokenPair.ExpiresIn, 10)},
+			"token_type":    {"Bearer"},
+		}
+		return c.Redirect(h.postLoginRedirect+"#"+fragment.Encode(), fiber.StatusFound)
+	}
+
+	return c.JSON(fiber.Map{
+		"user": fiber.Map{
+			"id":       user.ID,
+			"username": user.Username,
+			"email":    user.Email,
+			"role":     user.Role,
+			"status":   user.Status,
+		},
+		"token": tokenPair,
+	})
+}
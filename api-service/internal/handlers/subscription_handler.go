@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/logger"
+	"hysteria2_microservices/api-service/pkg/qrcode"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+type SubscriptionHandler struct {
+	subscriptionService interfaces.SubscriptionService
+	logger              *logger.Logger
+}
+
+func NewSubscriptionHandler(subscriptionService interfaces.SubscriptionService, logger *logger.Logger) *SubscriptionHandler {
+	return &SubscriptionHandler{
+		subscriptionService: subscriptionService,
+		logger:              logger,
+	}
+}
+
+// GetSubscription returns the caller's client config with nodes ordered for the client's
+// location. Profile-Update-Interval tells clients to re-fetch once per fingerprint
+// rotation period.
+func (h *SubscriptionHandler) GetSubscription(c *fiber.Ctx) error {
+	userIDStr, _ := c.Locals("user_id").(string)
+	userID, err := uuid.Parse(userIDStr)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid user",
+			"code":  "UNAUTHORIZED",
+		})
+	}
+
+	return h.sendSubscription(c, userID)
+}
+
+// GetUserSubscription exports a user's subscription the way their client would fetch it.
+// Users may only fetch their own; admins may fetch any.
+func (h *SubscriptionHandler) GetUserSubscription(c *fiber.Ctx) error {
+	userID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return invalidUserID(c)
+	}
+	if !canAccessUser(c, userID) {
+		return forbidden(c)
+	}
+
+	return h.sendSubscription(c, userID)
+}
+
+// sendSubscription generates the user's subscription in the ?format requested, sing-box by
+// default, with the headers subscription clients read
+func (h *SubscriptionHandler) sendSubscription(c *fiber.Ctx, userID uuid.UUID) error {
+	format := c.Query("format", "sing-box")
+
+	sub, err := h.subscriptionService.GenerateSubscription(c.Context(), userID, format, clientLocation(c))
+	if err != nil {
+		h.logger.Error("Failed to generate subscription", "user_id", userID, "format", format, "error", err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Failed to generate subscription",
+			"code":  "SUBSCRIPTION_FAILED",
+		})
+	}
+
+	var expire int64
+	if sub.ExpiresAt != nil {
+		expire = sub.ExpiresAt.Unix()
+	}
+
+	c.Set("Profile-Update-Interval", strconv.Itoa(sub.UpdateIntervalHours))
+	c.Set("Subscription-Userinfo", fmt.Sprintf("upload=%d; download=%d; total=%d; expire=%d",
+		sub.Upload, sub.Download, sub.Total, expire))
+	c.Set("X-Fingerprint", sub.Fingerprint)
+	c.Set("X-Fingerprint-Rotates-At", sub.RotatesAt.Format(time.RFC3339))
+
+	return c.JSON(sub.Config)
+}
+
+// GetConfigQR renders the share link for one of a user's protocols as a QR code for
+// scanning into a mobile client. Users may only fetch their own; admins may fetch any.
+func (h *SubscriptionHandler) GetConfigQR(c *fiber.Ctx) error {
+	userID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid user ID",
+			"code":  "INVALID_USER_ID",
+		})
+	}
+
+	if !canAccessUser(c, userID) {
+		return forbidden(c)
+	}
+
+	var nodeID uuid.UUID
+	if raw := c.Query("node_id"); raw != "" {
+		if nodeID, err = uuid.Parse(raw); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid node ID",
+				"code":  "INVALID_NODE_ID",
+			})
+		}
+	}
+
+	protocol := c.Params("protocol")
+	link, err := h.subscriptionService.GetShareLink(c.Context(), userID, protocol, nodeID)
+	if err != nil {
+		h.logger.Error("Failed to build share link", "user_id", userID, "protocol", protocol, "error", err)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "No config available for protocol",
+			"code":  "CONFIG_NOT_FOUND",
+		})
+	}
+
+	image, contentType, err := qrcode.Encode(link.URI, c.Query("format", qrcode.FormatPNG), c.QueryInt("size", 256))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+			"code":  "INVALID_QR_PARAMS",
+		})
+	}
+
+	c.Set(fiber.HeaderContentType, contentType)
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	c.Set("X-Share-URI", link.URI)
+	c.Set("X-Node-ID", link.NodeID.String())
+	return c.Send(image)
+}
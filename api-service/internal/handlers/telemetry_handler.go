@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"errors"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/models"
+	"hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/logger"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// TelemetryHandler takes connection outcomes from client apps whose user opted in
+type TelemetryHandler struct {
+	telemetryService interfaces.TelemetryService
+	logger           *logger.Logger
+}
+
+type TelemetryConsentRequest struct {
+	Enabled *bool `json:"enabled" validate:"required"`
+}
+
+type TelemetryReportRequest struct {
+	ASN    uint32                  `json:"asn"`
+	ISP    string                  `json:"isp" validate:"max=100"`
+	Events []TelemetryEventRequest `json:"events" validate:"required,min=1,max=100,dive"`
+}
+
+type TelemetryEventRequest struct {
+	NodeID         string     `json:"node_id" validate:"required,uuid"`
+	Protocol       string     `json:"protocol" validate:"required,max=30"`
+	Success        bool       `json:"success"`
+	HandshakeMs    int        `json:"handshake_ms" validate:"min=0,max=120000"`
+	ThroughputKbps int        `json:"throughput_kbps" validate:"min=0"`
+	FailureReason  string     `json:"failure_reason" validate:"max=200"`
+	OccurredAt     *time.Time `json:"occurred_at"`
+}
+
+func NewTelemetryHandler(telemetryService interfaces.TelemetryService, logger *logger.Logger) *TelemetryHandler {
+	return &TelemetryHandler{
+		telemetryService: telemetryService,
+		logger:           logger,
+	}
+}
+
+// SetConsent turns the caller's telemetry opt-in on or off
+func (h *TelemetryHandler) SetConsent(c *fiber.Ctx) error {
+	userID, ok := callerID(c)
+	if !ok {
+		return invalidCaller(c)
+	}
+
+	var req TelemetryConsentRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+			"code":  "INVALID_REQUEST",
+		})
+	}
+	if ok, err := validateRequest(c, &req); !ok {
+		return err
+	}
+
+	if err := h.telemetryService.SetOptIn(c.Context(), userID, *req.Enabled); err != nil {
+		if errors.Is(err, interfaces.ErrNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "User not found",
+				"code":  "USER_NOT_FOUND",
+			})
+		}
+		h.logger.Error("Failed to update telemetry consent", "error", err, "user_id", userID)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update telemetry consent",
+			"code":  "TELEMETRY_CONSENT_FAILED",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"telemetry_opt_in": *req.Enabled,
+	})
+}
+
+// ReportTelemetry stores the connection attempts a client app made. The caller's address
+// only resolves their country and is not stored.
+func (h *TelemetryHandler) ReportTelemetry(c *fiber.Ctx) error {
+	userID, ok := callerID(c)
+	if !ok {
+		return invalidCaller(c)
+	}
+
+	var req TelemetryReportRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+			"code":  "INVALID_REQUEST",
+		})
+	}
+	if ok, err := validateRequest(c, &req); !ok {
+		return err
+	}
+
+	report := &models.TelemetryReport{
+		ASN:    req.ASN,
+		ISP:    req.ISP,
+		Events: make([]models.TelemetryEvent, 0, len(req.Events)),
+	}
+	for _, event := range req.Events {
+		entry := models.TelemetryEvent{
+			NodeID:         uuid.MustParse(event.NodeID),
+			Protocol:       event.Protocol,
+			Success:        event.Success,
+			HandshakeMs:    event.HandshakeMs,
+			ThroughputKbps: event.ThroughputKbps,
+			FailureReason:  event.FailureReason,
+		}
+		if event.OccurredAt != nil {
+			entry.OccurredAt = *event.OccurredAt
+		}
+		report.Events = append(report.Events, entry)
+	}
+
+	// Located by the request alone, so apps cannot pick the country they count for
+	accepted, err := h.telemetryService.Ingest(c.Context(), userID, requestLocation(c), report)
+	if err != nil {
+		switch {
+		case errors.Is(err, interfaces.ErrTelemetryOptOut):
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "Telemetry is not enabled, opt in with PUT /api/v1/me/telemetry",
+				"code":  "TELEMETRY_NOT_ENABLED",
+			})
+		case errors.Is(err, interfaces.ErrNotFound):
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "User not found",
+				"code":  "USER_NOT_FOUND",
+			})
+		}
+		h.logger.Error("Failed to store telemetry", "error", err, "events", len(report.Events))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to store telemetry",
+			"code":  "TELEMETRY_REPORT_FAILED",
+		})
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"data": fiber.Map{"accepted": accepted},
+	})
+}
@@ -1,8 +1,10 @@
 package handlers
 
 import (
+	"errors"
 	"time"
 
+	"hysteria2_microservices/api-service/internal/models"
 	"hysteria2_microservices/api-service/internal/services/interfaces"
 	"hysteria2_microservices/api-service/pkg/logger"
 
@@ -10,6 +12,9 @@ import (
 	"github.com/google/uuid"
 )
 
+// maxTrafficReportSamples bounds one agent report; larger reports must be split
+const maxTrafficReportSamples = 10000
+
 type TrafficHandler struct {
 	trafficService interfaces.TrafficService
 	logger         *logger.Logger
@@ -100,3 +105,57 @@ func (h *TrafficHandler) GetTrafficSummary(c *fiber.Ctx) error {
 
 	return c.JSON(summary)
 }
+
+// IngestTraffic queues the traffic samples an agent counted since its previous report. The
+// samples are written shortly after, so the report is answered with 202.
+func (h *TrafficHandler) IngestTraffic(c *fiber.Ctx) error {
+	nodeID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid node ID",
+			"code":  "INVALID_NODE_ID",
+		})
+	}
+
+	var report models.TrafficReport
+	if err := c.BodyParser(&report); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+			"code":  "INVALID_REQUEST",
+		})
+	}
+	if len(report.Samples) > maxTrafficReportSamples {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+			"error": "Too many samples in one report",
+			"code":  "REPORT_TOO_LARGE",
+		})
+	}
+	for _, sample := range report.Samples {
+		if sample.UserID == uuid.Nil || sample.Upload < 0 || sample.Download < 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Samples need a user and non-negative byte counts",
+				"code":  "INVALID_SAMPLE",
+			})
+		}
+	}
+
+	if err := h.trafficService.IngestSamples(c.Context(), report.Samples); err != nil {
+		if errors.Is(err, interfaces.ErrIngestBackpressure) {
+			h.logger.Warn("Traffic report refused, ingestion backed up", "node_id", nodeID, "samples", len(report.Samples))
+			c.Set(fiber.HeaderRetryAfter, "5")
+			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+				"error": "Traffic ingestion is backed up, try again later",
+				"code":  "INGEST_BACKPRESSURE",
+			})
+		}
+		h.logger.Error("Failed to queue traffic report", "error", err, "node_id", nodeID)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to record traffic",
+			"code":  "TRAFFIC_REPORT_FAILED",
+		})
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"data": fiber.Map{"accepted": len(report.Samples)},
+	})
+}
@@ -19,9 +19,10 @@ type UserHandler struct {
 type CreateUserRequest struct {
 	Username  string  `json:"username" validate:"required,min=3,max=50"`
 	Email     string  `json:"email" validate:"required,email"`
-	Password  string  `json:"password" validate:"required,min=8"`
+	Password  string  `json:"password" validate:"required,notblank,min=8"`
 	FullName  *string `json:"full_name"`
 	Role      string  `json:"role" validate:"omitempty,oneof=admin user"`
+	UserGroup string  `json:"user_group" validate:"max=50"`
 	DataLimit int64   `json:"data_limit" validate:"min=0"`
 	Notes     *string `json:"notes"`
 }
@@ -32,6 +33,7 @@ type UpdateUserRequest struct {
 	FullName  *string `json:"full_name"`
 	Status    *string `json:"status" validate:"omitempty,oneof=active suspended deleted"`
 	Role      *string `json:"role" validate:"omitempty,oneof=admin user"`
+	UserGroup *string `json:"user_group" validate:"omitempty,max=50"`
 	DataLimit *int64  `json:"data_limit" validate:"omitempty,min=0"`
 	Notes     *string `json:"notes"`
 }
@@ -107,6 +109,9 @@ func (h *UserHandler) CreateUser(c *fiber.Ctx) error {
 			"error": "Invalid request body",
 		})
 	}
+	if ok, err := validateRequest(c, &req); !ok {
+		return err
+	}
 
 	user := &models.User{
 		Username:  req.Username,
@@ -114,6 +119,7 @@ func (h *UserHandler) CreateUser(c *fiber.Ctx) error {
 		Password:  req.Password, // Will be hashed in service
 		FullName:  req.FullName,
 		Role:      req.Role,
+		UserGroup: req.UserGroup,
 		DataLimit: req.DataLimit,
 		Status:    "active",
 		Notes:     req.Notes,
@@ -147,6 +153,9 @@ func (h *UserHandler) UpdateUser(c *fiber.Ctx) error {
 			"error": "Invalid request body",
 		})
 	}
+	if ok, err := validateRequest(c, &req); !ok {
+		return err
+	}
 
 	user, err := h.userService.GetUserByID(c.Context(), userID)
 	if err != nil {
@@ -172,6 +181,9 @@ func (h *UserHandler) UpdateUser(c *fiber.Ctx) error {
 	if req.Role != nil {
 		user.Role = *req.Role
 	}
+	if req.UserGroup != nil {
+		user.UserGroup = *req.UserGroup
+	}
 	if req.DataLimit != nil {
 		user.DataLimit = *req.DataLimit
 	}
@@ -58,6 +58,19 @@ func (m *MockUserService) GetUserDevices(ctx context.Context, userID uuid.UUID)
 	return args.Get(0).([]*models.Device), args.Error(1)
 }
 
+func (m *MockUserService) RenameDevice(ctx context.Context, userID, deviceID uuid.UUID, name string) (*models.Device, error) {
+	args := m.Called(ctx, userID, deviceID, name)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*models.Device), args.Error(1)
+}
+
+func (m *MockUserService) RemoveDevice(ctx context.Context, userID, deviceID uuid.UUID) error {
+	args := m.Called(ctx, userID, deviceID)
+	return args.Error(0)
+}
+
 func (m *MockUserService) UpdateUserDataUsage(ctx context.Context, userID uuid.UUID, dataUsed int64) error {
 	args := m.Called(ctx, userID, dataUsed)
 	return args.Error(0)
@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"errors"
+
+	"hysteria2_microservices/api-service/pkg/validation"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// validateRequest checks the validate tags of a parsed request body. It answers 400 with
+// the rejected fields and returns false when the request is invalid.
+func validateRequest(c *fiber.Ctx, req interface{}) (bool, error) {
+	err := validation.Struct(req)
+	if err == nil {
+		return true, nil
+	}
+
+	var validationErr *validation.Error
+	if !errors.As(err, &validationErr) {
+		return false, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to validate request",
+			"code":  "INTERNAL_ERROR",
+		})
+	}
+	return false, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+		"error":   "Invalid request",
+		"code":    "VALIDATION_ERROR",
+		"details": validationErr.Fields,
+	})
+}
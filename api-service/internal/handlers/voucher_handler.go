@@ -0,0 +1,260 @@
+package handlers
+
+import (
+	"errors"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/models"
+	"hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/logger"
+	"hysteria2_microservices/api-service/pkg/validation"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+type VoucherHandler struct {
+	voucherService interfaces.VoucherService
+	authService    interfaces.AuthService
+	logger         *logger.Logger
+}
+
+type CreateVouchersRequest struct {
+	Count        int        `json:"count" validate:"omitempty,min=1,max=1000"`
+	Plan         string     `json:"plan" validate:"max=50"`
+	DurationDays int        `json:"duration_days" validate:"min=0"`
+	DataLimit    int64      `json:"data_limit" validate:"min=0"`
+	MaxUses      int        `json:"max_uses" validate:"omitempty,min=1"`
+	Trial        bool       `json:"trial"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+}
+
+// RedeemVoucherRequest redeems a voucher into the account with the email, or into a new
+// account named username when there is none
+type RedeemVoucherRequest struct {
+	Code              string `json:"code" validate:"required,notblank,max=32"`
+	DeviceFingerprint string `json:"device_fingerprint" validate:"required,notblank,max=128"`
+	Username          string `json:"username" validate:"omitempty,min=3,max=50"`
+	Email             string `json:"email" validate:"required,email"`
+	Password          string `json:"password" validate:"required,notblank,min=8"`
+}
+
+func NewVoucherHandler(voucherService interfaces.VoucherService, authService interfaces.AuthService, logger *logger.Logger) *VoucherHandler {
+	return &VoucherHandler{
+		voucherService: voucherService,
+		authService:    authService,
+		logger:         logger,
+	}
+}
+
+func (h *VoucherHandler) CreateVouchers(c *fiber.Ctx) error {
+	var req CreateVouchersRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+			"code":  "INVALID_REQUEST",
+		})
+	}
+	if ok, err := validateRequest(c, &req); !ok {
+		return err
+	}
+	if req.Count == 0 {
+		req.Count = 1
+	}
+	if req.MaxUses == 0 {
+		req.MaxUses = 1
+	}
+
+	template := &models.Voucher{
+		Plan:         req.Plan,
+		DurationDays: req.DurationDays,
+		DataLimit:    req.DataLimit,
+		MaxUses:      req.MaxUses,
+		Trial:        req.Trial,
+		ExpiresAt:    req.ExpiresAt,
+	}
+	if adminID, ok := callerID(c); ok {
+		template.CreatedBy = &adminID
+	}
+
+	vouchers, err := h.voucherService.CreateVouchers(c.Context(), template, req.Count)
+	if err != nil {
+		h.logger.Error("Failed to create vouchers", "error", err, "count", req.Count)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create vouchers",
+			"code":  "VOUCHER_CREATE_FAILED",
+		})
+	}
+
+	h.logger.Info("Vouchers created", "count", len(vouchers), "plan", req.Plan, "trial", req.Trial)
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"data": vouchers,
+	})
+}
+
+func (h *VoucherHandler) GetVouchers(c *fiber.Ctx) error {
+	page, limit := pagination(c)
+
+	vouchers, total, err := h.voucherService.ListVouchers(c.Context(), page, limit)
+	if err != nil {
+		h.logger.Error("Failed to list vouchers", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to list vouchers",
+			"code":  "VOUCHERS_FAILED",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"data":  vouchers,
+		"total": total,
+		"page":  page,
+		"limit": limit,
+	})
+}
+
+func (h *VoucherHandler) RevokeVoucher(c *fiber.Ctx) error {
+	voucherID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid voucher ID",
+			"code":  "INVALID_VOUCHER_ID",
+		})
+	}
+
+	err = h.voucherService.RevokeVoucher(c.Context(), voucherID)
+	if errors.Is(err, interfaces.ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Voucher not found or already revoked",
+			"code":  "VOUCHER_NOT_FOUND",
+		})
+	}
+	if err != nil {
+		h.logger.Error("Failed to revoke voucher", "error", err, "voucher_id", voucherID)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke voucher",
+			"code":  "VOUCHER_REVOKE_FAILED",
+		})
+	}
+
+	h.logger.Info("Voucher revoked", "voucher_id", voucherID)
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// Redeem applies a voucher and signs the account in. It answers 201 when the voucher
+// created the account and 200 when it topped up an existing one.
+func (h *VoucherHandler) Redeem(c *fiber.Ctx) error {
+	var req RedeemVoucherRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+			"code":  "INVALID_REQUEST",
+		})
+	}
+	if ok, err := validateRequest(c, &req); !ok {
+		return err
+	}
+
+	// The connection address: forwarded headers are set by the client and would let it
+	// pick a new address for every attempt
+	result, err := h.voucherService.Redeem(c.Context(), &interfaces.RedeemRequest{
+		Code:              req.Code,
+		DeviceFingerprint: req.DeviceFingerprint,
+		IPAddress:         c.IP(),
+		Username:          req.Username,
+		Email:             req.Email,
+		Password:          req.Password,
+	})
+	if err != nil {
+		return h.redeemFailure(c, err)
+	}
+
+	tokenPair, err := h.authService.GenerateTokenPair(result.User.ID)
+	if err != nil {
+		h.logger.Error("Failed to generate token pair", "error", err, "user_id", result.User.ID)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate tokens",
+			"code":  "TOKEN_GENERATION_FAILED",
+		})
+	}
+
+	status := fiber.StatusOK
+	if result.Created {
+		status = fiber.StatusCreated
+	}
+	return c.Status(status).JSON(fiber.Map{
+		"user": fiber.Map{
+			"id":          result.User.ID,
+			"username":    result.User.Username,
+			"email":       result.User.Email,
+			"role":        result.User.Role,
+			"status":      result.User.Status,
+			"user_group":  result.User.UserGroup,
+			"data_limit":  result.User.DataLimit,
+			"expiry_date": result.User.ExpiryDate,
+		},
+		"voucher": fiber.Map{
+			"plan":          result.Voucher.Plan,
+			"duration_days": result.Voucher.DurationDays,
+			"data_limit":    result.Voucher.DataLimit,
+			"trial":         result.Voucher.Trial,
+		},
+		"created": result.Created,
+		"token":   tokenPair,
+	})
+}
+
+func (h *VoucherHandler) redeemFailure(c *fiber.Ctx, err error) error {
+	var validationErr *validation.Error
+	switch {
+	case errors.As(err, &validationErr):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "Invalid request",
+			"code":    "VALIDATION_ERROR",
+			"details": validationErr.Fields,
+		})
+	case errors.Is(err, interfaces.ErrRateLimited):
+		h.logger.Warn("Voucher redeem rate limit exceeded", "ip", c.IP())
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+			"error": "Too many redeem attempts, try again later",
+			"code":  "RATE_LIMIT_EXCEEDED",
+		})
+	case errors.Is(err, interfaces.ErrVoucherInvalid):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Voucher is invalid or no longer available",
+			"code":  "VOUCHER_INVALID",
+		})
+	case errors.Is(err, interfaces.ErrVoucherRedeemed):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Voucher was already redeemed on this device",
+			"code":  "VOUCHER_ALREADY_REDEEMED",
+		})
+	case errors.Is(err, interfaces.ErrTrialUsed):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "A trial was already redeemed on this device",
+			"code":  "TRIAL_ALREADY_USED",
+		})
+	case errors.Is(err, interfaces.ErrTrialExistingAccount):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Trial vouchers only create new accounts",
+			"code":  "TRIAL_EXISTING_ACCOUNT",
+		})
+	case errors.Is(err, interfaces.ErrUsernameTaken):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Username already exists",
+			"code":  "USERNAME_TAKEN",
+		})
+	case errors.Is(err, interfaces.ErrInvalidCredentials):
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid credentials",
+			"code":  "INVALID_CREDENTIALS",
+		})
+	}
+
+	h.logger.Error("Failed to redeem voucher", "error", err)
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": "Failed to redeem voucher",
+		"code":  "REDEEM_FAILED",
+	})
+}
@@ -0,0 +1,286 @@
+package handlers
+
+import (
+	"hysteria2_microservices/api-service/internal/models"
+	"hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/logger"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultWARPLogLines = 200
+	maxWARPLogLines     = 5000
+)
+
+// WARPHandler manages the Cloudflare WARP client of a node for admins. Calls go through the
+// orchestrator, so its error codes, e.g. WARP_NOT_INSTALLED or NODE_UNREACHABLE, are passed
+// on.
+type WARPHandler struct {
+	warpService interfaces.WARPService
+	logger      *logger.Logger
+}
+
+type WARPSettingsRequest struct {
+	Enabled           *bool  `json:"enabled" validate:"required"`
+	ProxyPort         int    `json:"proxy_port" validate:"min=0,max=65535"`
+	AutoConnect       bool   `json:"auto_connect"`
+	NotifyOnFail      bool   `json:"notify_on_fail"`
+	ClientType        string `json:"client_type" validate:"omitempty,oneof=local docker"`
+	LicenseKey        string `json:"license_key" validate:"max=64"`
+	Organization      string `json:"organization" validate:"max=100"`
+	Mode              string `json:"mode" validate:"omitempty,oneof=proxy warp"`
+	TeamsClientID     string `json:"teams_client_id" validate:"max=200"`
+	TeamsClientSecret string `json:"teams_client_secret" validate:"max=200"`
+}
+
+type WARPProxyRequest struct {
+	Port int `json:"port" validate:"required,min=1,max=65535"`
+}
+
+type WARPRoutingRequest struct {
+	Interface string `json:"interface" validate:"required,max=15"`
+}
+
+func NewWARPHandler(warpService interfaces.WARPService, logger *logger.Logger) *WARPHandler {
+	return &WARPHandler{
+		warpService: warpService,
+		logger:      logger,
+	}
+}
+
+func (h *WARPHandler) GetStatus(c *fiber.Ctx) error {
+	nodeID, ok := h.nodeID(c)
+	if !ok {
+		return invalidNodeID(c)
+	}
+
+	status, err := h.warpService.GetStatus(c.Context(), nodeID)
+	if err != nil {
+		h.logger.Error("Failed to get WARP status", "error", err, "node_id", nodeID)
+		return orchestratorFailure(c, err, "Failed to get WARP status")
+	}
+
+	return c.JSON(fiber.Map{
+		"data": status,
+	})
+}
+
+// Configure replaces the node's WARP settings. Omitted secrets are sent empty, which keeps
+// the ones stored on the node.
+func (h *WARPHandler) Configure(c *fiber.Ctx) error {
+	nodeID, ok := h.nodeID(c)
+	if !ok {
+		return invalidNodeID(c)
+	}
+
+	var req WARPSettingsRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+			"code":  "INVALID_REQUEST",
+		})
+	}
+	if ok, err := validateRequest(c, &req); !ok {
+		return err
+	}
+
+	message, err := h.warpService.Configure(c.Context(), nodeID, &models.NodeWARPSettings{
+		Enabled:           *req.Enabled,
+		ProxyPort:         req.ProxyPort,
+		AutoConnect:       req.AutoConnect,
+		NotifyOnFail:      req.NotifyOnFail,
+		ClientType:        req.ClientType,
+		LicenseKey:        req.LicenseKey,
+		Organization:      req.Organization,
+		Mode:              req.Mode,
+		TeamsClientID:     req.TeamsClientID,
+		TeamsClientSecret: req.TeamsClientSecret,
+	})
+	if err != nil {
+		h.logger.Error("Failed to configure WARP", "error", err, "node_id", nodeID)
+		return orchestratorFailure(c, err, "Failed to configure WARP")
+	}
+
+	return c.JSON(fiber.Map{
+		"message": message,
+	})
+}
+
+func (h *WARPHandler) Connect(c *fiber.Ctx) error {
+	nodeID, ok := h.nodeID(c)
+	if !ok {
+		return invalidNodeID(c)
+	}
+
+	message, err := h.warpService.Connect(c.Context(), nodeID)
+	if err != nil {
+		h.logger.Error("Failed to connect WARP", "error", err, "node_id", nodeID)
+		return orchestratorFailure(c, err, "Failed to connect WARP")
+	}
+
+	return c.JSON(fiber.Map{
+		"message": message,
+	})
+}
+
+func (h *WARPHandler) Disconnect(c *fiber.Ctx) error {
+	nodeID, ok := h.nodeID(c)
+	if !ok {
+		return invalidNodeID(c)
+	}
+
+	message, err := h.warpService.Disconnect(c.Context(), nodeID)
+	if err != nil {
+		h.logger.Error("Failed to disconnect WARP", "error", err, "node_id", nodeID)
+		return orchestratorFailure(c, err, "Failed to disconnect WARP")
+	}
+
+	return c.JSON(fiber.Map{
+		"message": message,
+	})
+}
+
+func (h *WARPHandler) EnableProxy(c *fiber.Ctx) error {
+	nodeID, ok := h.nodeID(c)
+	if !ok {
+		return invalidNodeID(c)
+	}
+
+	var req WARPProxyRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+			"code":  "INVALID_REQUEST",
+		})
+	}
+	if ok, err := validateRequest(c, &req); !ok {
+		return err
+	}
+
+	message, err := h.warpService.EnableProxy(c.Context(), nodeID, req.Port)
+	if err != nil {
+		h.logger.Error("Failed to enable WARP proxy", "error", err, "node_id", nodeID)
+		return orchestratorFailure(c, err, "Failed to enable WARP proxy")
+	}
+
+	return c.JSON(fiber.Map{
+		"message": message,
+	})
+}
+
+func (h *WARPHandler) DisableProxy(c *fiber.Ctx) error {
+	nodeID, ok := h.nodeID(c)
+	if !ok {
+		return invalidNodeID(c)
+	}
+
+	message, err := h.warpService.DisableProxy(c.Context(), nodeID)
+	if err != nil {
+		h.logger.Error("Failed to disable WARP proxy", "error", err, "node_id", nodeID)
+		return orchestratorFailure(c, err, "Failed to disable WARP proxy")
+	}
+
+	return c.JSON(fiber.Map{
+		"message": message,
+	})
+}
+
+// EnableRouting routes the traffic of a node interface, e.g. the VPN's, through WARP
+func (h *WARPHandler) EnableRouting(c *fiber.Ctx) error {
+	nodeID, ok := h.nodeID(c)
+	if !ok {
+		return invalidNodeID(c)
+	}
+
+	var req WARPRoutingRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+			"code":  "INVALID_REQUEST",
+		})
+	}
+	if ok, err := validateRequest(c, &req); !ok {
+		return err
+	}
+
+	message, err := h.warpService.EnableRouting(c.Context(), nodeID, req.Interface)
+	if err != nil {
+		h.logger.Error("Failed to enable WARP traffic routing", "error", err, "node_id", nodeID)
+		return orchestratorFailure(c, err, "Failed to enable WARP traffic routing")
+	}
+
+	return c.JSON(fiber.Map{
+		"message": message,
+	})
+}
+
+func (h *WARPHandler) DisableRouting(c *fiber.Ctx) error {
+	nodeID, ok := h.nodeID(c)
+	if !ok {
+		return invalidNodeID(c)
+	}
+
+	message, err := h.warpService.DisableRouting(c.Context(), nodeID)
+	if err != nil {
+		h.logger.Error("Failed to disable WARP traffic routing", "error", err, "node_id", nodeID)
+		return orchestratorFailure(c, err, "Failed to disable WARP traffic routing")
+	}
+
+	return c.JSON(fiber.Map{
+		"message": message,
+	})
+}
+
+// TestConnectivity has the node check its WARP proxy end to end; failed checks are part of
+// the result rather than an error
+func (h *WARPHandler) TestConnectivity(c *fiber.Ctx) error {
+	nodeID, ok := h.nodeID(c)
+	if !ok {
+		return invalidNodeID(c)
+	}
+
+	result, err := h.warpService.TestConnectivity(c.Context(), nodeID)
+	if err != nil {
+		h.logger.Error("Failed to test WARP connectivity", "error", err, "node_id", nodeID)
+		return orchestratorFailure(c, err, "Failed to test WARP connectivity")
+	}
+
+	return c.JSON(fiber.Map{
+		"data": result,
+	})
+}
+
+func (h *WARPHandler) GetLogs(c *fiber.Ctx) error {
+	nodeID, ok := h.nodeID(c)
+	if !ok {
+		return invalidNodeID(c)
+	}
+	lines := c.QueryInt("lines", defaultWARPLogLines)
+	if lines <= 0 || lines > maxWARPLogLines {
+		lines = defaultWARPLogLines
+	}
+
+	logs, err := h.warpService.GetLogs(c.Context(), nodeID, lines)
+	if err != nil {
+		h.logger.Error("Failed to get WARP logs", "error", err, "node_id", nodeID)
+		return orchestratorFailure(c, err, "Failed to get WARP logs")
+	}
+
+	return c.JSON(fiber.Map{
+		"data": logs,
+	})
+}
+
+func (h *WARPHandler) nodeID(c *fiber.Ctx) (uuid.UUID, bool) {
+	nodeID, err := uuid.Parse(c.Params("id"))
+	return nodeID, err == nil
+}
+
+func invalidNodeID(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+		"error": "Invalid node ID",
+		"code":  "INVALID_NODE_ID",
+	})
+}
@@ -1,12 +1,15 @@
 package handlers
 
 import (
-	"fmt"
+	"context"
+	"encoding/json"
+	"strings"
 	"time"
 
 	"hysteria2_microservices/api-service/internal/models"
 	serviceInterfaces "hysteria2_microservices/api-service/internal/services/interfaces"
 	"hysteria2_microservices/api-service/pkg/logger"
+	"hysteria2_microservices/api-service/pkg/wshub"
 
 	"github.com/gofiber/fiber/v2"
 	ws "github.com/gofiber/websocket/v2"
@@ -20,27 +23,46 @@ const (
 	WSTrafficUpdate WSMessageType = "traffic_update"
 	WSUserStatus    WSMessageType = "user_status"
 	WSDeviceOnline  WSMessageType = "device_online"
+	WSNodeEvent     WSMessageType = "node_event"
+	WSAlert         WSMessageType = "alert"
+	WSSubscribed    WSMessageType = "subscribed"
+	WSUnsubscribed  WSMessageType = "unsubscribed"
 	WSError         WSMessageType = "error"
 )
 
+// Rooms clients subscribe to: a user's traffic and status, a node's events and the
+// operator alerts
+const (
+	userRoomPrefix = "traffic:user:"
+	nodeRoomPrefix = "node:"
+	alertsRoom     = "alerts"
+)
+
+func userRoom(userID string) string { return userRoomPrefix + userID }
+
+func nodeRoom(nodeID string) string { return nodeRoomPrefix + nodeID }
+
 type WSMessage struct {
 	Type      WSMessageType `json:"type"`
 	UserID    string        `json:"user_id,omitempty"`
+	Room      string        `json:"room,omitempty"`
 	Data      interface{}   `json:"data,omitempty"`
 	Timestamp time.Time     `json:"timestamp"`
 }
 
+// WebSocketHandler serves the dashboard over WebSocket. Connections are kept in a hub that
+// fans messages out by room, across replicas when the hub shares a Redis channel.
 type WebSocketHandler struct {
 	trafficService serviceInterfaces.TrafficService
+	hub            *wshub.Hub
 	logger         *logger.Logger
-	clients        map[string]*ws.Conn
 }
 
-func NewWebSocketHandler(trafficService serviceInterfaces.TrafficService, logger *logger.Logger) *WebSocketHandler {
+func NewWebSocketHandler(trafficService serviceInterfaces.TrafficService, hub *wshub.Hub, logger *logger.Logger) *WebSocketHandler {
 	return &WebSocketHandler{
 		trafficService: trafficService,
+		hub:            hub,
 		logger:         logger,
-		clients:        make(map[string]*ws.Conn),
 	}
 }
 
@@ -49,46 +71,39 @@ func (h *WebSocketHandler) SetTrafficService(trafficService serviceInterfaces.Tr
 	h.trafficService = trafficService
 }
 
-// WebSocket upgrade middleware
+// WebSocketUpgrade serves a connection. The client joins its own traffic room and may
+// subscribe to more rooms with {"type": "subscribe", "room": "..."}; node rooms and alerts
+// are for admins only. A client that answers neither messages nor pings within the pong
+// timeout is disconnected.
 func (h *WebSocketHandler) WebSocketUpgrade() func(*fiber.Ctx) error {
 	return ws.New(func(c *ws.Conn) {
 		// Get user ID from context (set by JWT middleware)
-		userID := c.Locals("user_id")
-		if userID == nil {
+		userIDStr, ok := c.Locals("user_id").(string)
+		if !ok || userIDStr == "" {
 			h.logger.Warn("WebSocket connection without user ID")
 			c.Close()
 			return
 		}
+		role, _ := c.Locals("role").(string)
 
-		userIDStr, ok := userID.(string)
-		if !ok {
-			h.logger.Warn("Invalid user ID in WebSocket connection")
-			c.Close()
-			return
-		}
-
-		// Register client
-		clientKey := fmt.Sprintf("user_%s", userIDStr)
-		h.clients[clientKey] = c
+		client := h.hub.Register(c)
+		defer client.Close()
+		client.Join(userRoom(userIDStr))
 		h.logger.Info("WebSocket client connected", "user_id", userIDStr)
+		defer h.logger.Info("WebSocket client disconnected", "user_id", userIDStr)
 
-		// Clean up on disconnect
-		defer func() {
-			delete(h.clients, clientKey)
-			h.logger.Info("WebSocket client disconnected", "user_id", userIDStr)
-		}()
-
-		// Send welcome message
-		welcomeMsg := WSMessage{
-			Type:      WSUserStatus,
-			UserID:    userIDStr,
-			Data:      map[string]string{"status": "connected"},
-			Timestamp: time.Now(),
-		}
-		if err := h.sendMessage(c, welcomeMsg); err != nil {
-			h.logger.Error("Failed to send welcome message", "error", err)
-			return
-		}
+		// Every message and pong proves the client is alive
+		timeout := h.hub.PongTimeout()
+		c.SetReadDeadline(time.Now().Add(timeout))
+		c.SetPongHandler(func(string) error {
+			return c.SetReadDeadline(time.Now().Add(timeout))
+		})
+
+		h.send(client, WSMessage{
+			Type:   WSUserStatus,
+			UserID: userIDStr,
+			Data:   map[string]string{"status": "connected"},
+		})
 
 		// Handle incoming messages
 		for {
@@ -100,110 +115,144 @@ func (h *WebSocketHandler) WebSocketUpgrade() func(*fiber.Ctx) error {
 				}
 				break
 			}
+			c.SetReadDeadline(time.Now().Add(timeout))
 
 			// Handle client messages (ping, subscribe, etc.)
-			h.handleClientMessage(c, userIDStr, msg)
+			h.handleClientMessage(client, userIDStr, role, msg)
 		}
 	})
 }
 
-func (h *WebSocketHandler) handleClientMessage(c *ws.Conn, userID string, msg WSMessage) {
+func (h *WebSocketHandler) handleClientMessage(client *wshub.Client, userID, role string, msg WSMessage) {
 	switch msg.Type {
 	case "ping":
 		// Respond to ping
-		pongMsg := WSMessage{
-			Type:      "pong",
-			UserID:    userID,
-			Data:      map[string]string{"timestamp": time.Now().Format(time.RFC3339)},
-			Timestamp: time.Now(),
-		}
-		h.sendMessage(c, pongMsg)
+		h.send(client, WSMessage{
+			Type:   "pong",
+			UserID: userID,
+			Data:   map[string]string{"timestamp": time.Now().Format(time.RFC3339)},
+		})
 
 	case "subscribe_traffic":
-		// Client wants to subscribe to traffic updates
-		h.logger.Info("Client subscribed to traffic updates", "user_id", userID)
+		// Older clients ask for their own traffic, which they always receive
+		h.send(client, WSMessage{Type: WSSubscribed, Room: userRoom(userID)})
+
+	case "subscribe":
+		if !canJoinRoom(userID, role, msg.Room) {
+			h.send(client, WSMessage{
+				Type: WSError,
+				Room: msg.Room,
+				Data: map[string]string{"code": "FORBIDDEN", "error": "Cannot subscribe to this room"},
+			})
+			return
+		}
+		client.Join(msg.Room)
+		h.send(client, WSMessage{Type: WSSubscribed, Room: msg.Room})
+
+	case "unsubscribe":
+		client.Leave(msg.Room)
+		h.send(client, WSMessage{Type: WSUnsubscribed, Room: msg.Room})
 
 	default:
 		h.logger.Warn("Unknown WebSocket message type", "type", msg.Type, "user_id", userID)
 	}
 }
 
-func (h *WebSocketHandler) sendMessage(c *ws.Conn, msg WSMessage) error {
-	return c.WriteJSON(msg)
+// canJoinRoom reports whether a caller may subscribe to a room: users only to their own
+// traffic, admins to any user, node or the alerts
+func canJoinRoom(userID, role, room string) bool {
+	if role == "admin" {
+		return room == alertsRoom ||
+			(strings.HasPrefix(room, userRoomPrefix) && isUUID(strings.TrimPrefix(room, userRoomPrefix))) ||
+			(strings.HasPrefix(room, nodeRoomPrefix) && isUUID(strings.TrimPrefix(room, nodeRoomPrefix)))
+	}
+	return room == userRoom(userID)
 }
 
-// Broadcast traffic update to specific user
-func (h *WebSocketHandler) BroadcastTrafficUpdate(userID uuid.UUID, stats *models.TrafficStats) {
-	clientKey := fmt.Sprintf("user_%s", userID.String())
-	if conn, exists := h.clients[clientKey]; exists {
-		msg := WSMessage{
-			Type:      WSTrafficUpdate,
-			UserID:    userID.String(),
-			Data:      stats,
-			Timestamp: time.Now(),
-		}
+func isUUID(s string) bool {
+	_, err := uuid.Parse(s)
+	return err == nil
+}
 
-		if err := h.sendMessage(conn, msg); err != nil {
-			h.logger.Error("Failed to send traffic update", "error", err, "user_id", userID)
-			// Remove dead connection
-			delete(h.clients, clientKey)
-		} else {
-			h.logger.Debug("Traffic update sent", "user_id", userID, "upload", stats.Upload, "download", stats.Download)
-		}
+// send queues a message for one client
+func (h *WebSocketHandler) send(client *wshub.Client, msg WSMessage) {
+	msg.Timestamp = time.Now()
+	data, err := json.Marshal(msg)
+	if err != nil {
+		h.logger.Error("Failed to encode WebSocket message", "error", err, "type", msg.Type)
+		return
 	}
+	client.Send(data)
+}
+
+// publish sends a message to the members of a room on every replica
+func (h *WebSocketHandler) publish(room string, msg WSMessage) {
+	msg.Room = room
+	msg.Timestamp = time.Now()
+	data, err := json.Marshal(msg)
+	if err != nil {
+		h.logger.Error("Failed to encode WebSocket message", "error", err, "type", msg.Type)
+		return
+	}
+	h.hub.Publish(context.Background(), room, data)
+}
+
+// Broadcast traffic update to specific user
+func (h *WebSocketHandler) BroadcastTrafficUpdate(userID uuid.UUID, stats *models.TrafficStats) {
+	h.publish(userRoom(userID.String()), WSMessage{
+		Type:   WSTrafficUpdate,
+		UserID: userID.String(),
+		Data:   stats,
+	})
 }
 
 // Broadcast user status update
 func (h *WebSocketHandler) BroadcastUserStatus(userID uuid.UUID, status string) {
-	clientKey := fmt.Sprintf("user_%s", userID.String())
-	if conn, exists := h.clients[clientKey]; exists {
-		msg := WSMessage{
-			Type:      WSUserStatus,
-			UserID:    userID.String(),
-			Data:      map[string]string{"status": status},
-			Timestamp: time.Now(),
-		}
-
-		if err := h.sendMessage(conn, msg); err != nil {
-			h.logger.Error("Failed to send user status", "error", err, "user_id", userID)
-			delete(h.clients, clientKey)
-		}
-	}
+	h.publish(userRoom(userID.String()), WSMessage{
+		Type:   WSUserStatus,
+		UserID: userID.String(),
+		Data:   map[string]string{"status": status},
+	})
 }
 
 // Broadcast device online/offline status
 func (h *WebSocketHandler) BroadcastDeviceStatus(deviceID uuid.UUID, userID uuid.UUID, online bool) {
-	clientKey := fmt.Sprintf("user_%s", userID.String())
-	if conn, exists := h.clients[clientKey]; exists {
-		status := "offline"
-		if online {
-			status = "online"
-		}
+	status := "offline"
+	if online {
+		status = "online"
+	}
+	h.publish(userRoom(userID.String()), WSMessage{
+		Type:   WSDeviceOnline,
+		UserID: userID.String(),
+		Data:   map[string]interface{}{"device_id": deviceID.String(), "status": status},
+	})
+}
 
-		msg := WSMessage{
-			Type:      WSDeviceOnline,
-			UserID:    userID.String(),
-			Data:      map[string]interface{}{"device_id": deviceID.String(), "status": status},
-			Timestamp: time.Now(),
-		}
+// BroadcastNodeEvent sends an event of a node to the admins watching it
+func (h *WebSocketHandler) BroadcastNodeEvent(nodeID uuid.UUID, event string, data interface{}) {
+	h.publish(nodeRoom(nodeID.String()), WSMessage{
+		Type: WSNodeEvent,
+		Data: map[string]interface{}{"node_id": nodeID.String(), "event": event, "data": data},
+	})
+}
 
-		if err := h.sendMessage(conn, msg); err != nil {
-			h.logger.Error("Failed to send device status", "error", err, "device_id", deviceID)
-			delete(h.clients, clientKey)
-		}
-	}
+// BroadcastAlert sends an operator alert to the admins subscribed to alerts
+func (h *WebSocketHandler) BroadcastAlert(severity, code, message string) {
+	h.publish(alertsRoom, WSMessage{
+		Type: WSAlert,
+		Data: map[string]string{"severity": severity, "code": code, "message": message},
+	})
 }
 
 // Get connected clients count
 func (h *WebSocketHandler) GetConnectedClientsCount() int {
-	return len(h.clients)
+	return h.hub.Clients()
 }
 
-// Get connected clients for specific user
+// IsUserConnected reports whether an update for the user may reach a client; with several
+// replicas it cannot tell and is always true
 func (h *WebSocketHandler) IsUserConnected(userID uuid.UUID) bool {
-	clientKey := fmt.Sprintf("user_%s", userID.String())
-	_, exists := h.clients[clientKey]
-	return exists
+	return h.hub.HasMembers(userRoom(userID.String()))
 }
 
 // Ensure WebSocketHandler implements WebSocketService interface
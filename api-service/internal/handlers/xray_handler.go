@@ -1,11 +1,13 @@
 package handlers
 
 import (
+	"errors"
 	"strconv"
 
 	"hysteria2_microservices/api-service/internal/models"
 	serviceInterfaces "hysteria2_microservices/api-service/internal/services/interfaces"
 	"hysteria2_microservices/api-service/pkg/logger"
+	"hysteria2_microservices/api-service/pkg/orchestrator"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
@@ -154,9 +156,7 @@ func (h *XrayHandler) GetXrayConnections(c *fiber.Ctx) error {
 	connections, err := h.xrayService.GetActiveConnections(c.Context())
 	if err != nil {
 		h.logger.Errorf("Failed to get active connections: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to get active connections",
-		})
+		return orchestratorFailure(c, err, "Failed to get active connections")
 	}
 
 	// Simple pagination (in real implementation, this would be more sophisticated)
@@ -194,9 +194,7 @@ func (h *XrayHandler) DisconnectXrayUser(c *fiber.Ctx) error {
 
 	if err := h.xrayService.DisconnectUser(c.Context(), userID, deviceID); err != nil {
 		h.logger.Errorf("Failed to disconnect user: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to disconnect user",
-		})
+		return orchestratorFailure(c, err, "Failed to disconnect user")
 	}
 
 	return c.JSON(fiber.Map{
@@ -219,3 +217,28 @@ func (h *XrayHandler) ReloadXrayConfiguration(c *fiber.Ctx) error {
 		"message": "Configuration reloaded successfully",
 	})
 }
+
+// orchestratorFailure answers with the status and ErrorCode of a failed orchestrator call, so
+// clients can tell e.g. an unreachable node from a bug; other errors are internal
+func orchestratorFailure(c *fiber.Ctx, err error, message string) error {
+	var orchestratorErr *orchestrator.Error
+	if !errors.As(err, &orchestratorErr) || orchestratorErr.Code == "" {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": message,
+		})
+	}
+
+	statusCode := orchestratorErr.StatusCode
+	// The orchestrator rejecting the service token is this service's fault, not the client's
+	if statusCode == fiber.StatusUnauthorized || statusCode == fiber.StatusForbidden {
+		statusCode = fiber.StatusBadGateway
+	}
+	resp := fiber.Map{
+		"error": message,
+		"code":  orchestratorErr.Code,
+	}
+	if len(orchestratorErr.Details) > 0 {
+		resp["details"] = orchestratorErr.Details
+	}
+	return c.Status(statusCode).JSON(resp)
+}
@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"crypto/subtle"
+
+	"hysteria2_microservices/api-service/internal/models"
+	"hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/logger"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// BreakGlassHeader carries the emergency token letting a request past the network
+// allowlists, for when admins find themselves locked out
+const BreakGlassHeader = "X-Break-Glass-Token"
+
+// IPAllowlist refuses requests from clients outside the networks allowed for scope. A
+// request with the break-glass token passes from anywhere and is logged, as is a wrong
+// token; an empty breakGlassToken disables the bypass. Authentication still applies.
+func IPAllowlist(allowlist interfaces.AllowlistService, scope, breakGlassToken string, logger *logger.Logger) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		ip := c.IP()
+		if allowlist.Allows(scope, ip) {
+			return c.Next()
+		}
+
+		if provided := c.Get(BreakGlassHeader); provided != "" {
+			if breakGlassToken != "" && subtle.ConstantTimeCompare([]byte(provided), []byte(breakGlassToken)) == 1 {
+				logger.Warn("Break-glass token used", "scope", scope, "ip", ip, "method", c.Method(), "path", c.Path())
+				return c.Next()
+			}
+			logger.Warn("Invalid break-glass token", "scope", scope, "ip", ip, "path", c.Path())
+		}
+
+		logger.Warn("Request from network not allowed", "scope", scope, "ip", ip, "path", c.Path())
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Access from this network is not allowed",
+			"code":  "IP_NOT_ALLOWED",
+		})
+	}
+}
+
+// AdminIPAllowlist holds requests authenticated as an admin to the admin networks on every
+// route, so an admin token is of no use outside them. It must run after JWTAuth.
+func AdminIPAllowlist(allowlist interfaces.AllowlistService, breakGlassToken string, logger *logger.Logger) fiber.Handler {
+	check := IPAllowlist(allowlist, models.AllowedNetworkAdmin, breakGlassToken, logger)
+	return func(c *fiber.Ctx) error {
+		if role, _ := c.Locals("role").(string); role != "admin" {
+			return c.Next()
+		}
+		return check(c)
+	}
+}
@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"context"
+	"strings"
+
+	"hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/logger"
+	"hysteria2_microservices/pkg/events"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Audit records every request that changed something, by the caller the JWT names. Reads
+// and refused requests are not recorded.
+func Audit(auditService interfaces.AuditService, logger *logger.Logger) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		err := c.Next()
+
+		switch c.Method() {
+		case fiber.MethodGet, fiber.MethodHead, fiber.MethodOptions:
+			return err
+		}
+		status := c.Response().StatusCode()
+		if err != nil || status >= fiber.StatusBadRequest {
+			return err
+		}
+
+		actor, _ := c.Locals("user_id").(string)
+		event := &events.AuditEvent{
+			Actor:  actor,
+			Action: c.Method() + " " + c.Route().Path,
+			Target: auditTarget(c),
+			Details: map[string]string{
+				"path": c.Path(),
+				"ip":   c.IP(),
+			},
+		}
+		if role, _ := c.Locals("role").(string); role != "" {
+			event.Details["role"] = role
+		}
+		// The request context is recycled once the handler returns
+		if recordErr := auditService.Record(context.Background(), event); recordErr != nil {
+			logger.Error("Failed to record audit event", "action", event.Action, "error", recordErr)
+		}
+		return err
+	}
+}
+
+// auditTarget is the ID the route was called on, the last one when it names several
+func auditTarget(c *fiber.Ctx) string {
+	target := ""
+	for _, param := range c.Route().Params {
+		if strings.EqualFold(param, "id") || strings.HasSuffix(param, "Id") {
+			target = c.Params(param)
+		}
+	}
+	return target
+}
@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"crypto/subtle"
 	"hysteria2_microservices/api-service/internal/services/interfaces"
 	"hysteria2_microservices/api-service/pkg/logger"
 	"strings"
@@ -109,3 +110,19 @@ func RequireRole(requiredRole string) fiber.Handler {
 		return c.Next()
 	}
 }
+
+// NodeAuth admits agents presenting the shared node auth token as a bearer token. With no
+// token configured every request is rejected.
+func NodeAuth(token string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		provided, ok := strings.CutPrefix(c.Get("Authorization"), "Bearer ")
+		if token == "" || !ok || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Invalid node token",
+				"code":  "INVALID_NODE_TOKEN",
+			})
+		}
+
+		return c.Next()
+	}
+}
@@ -55,6 +55,42 @@ func (m *MockAuthServiceForMiddleware) InvalidateUserSessions(ctx context.Contex
 	return args.Error(0)
 }
 
+func (m *MockAuthServiceForMiddleware) ChangePassword(ctx context.Context, userID uuid.UUID, currentPassword, newPassword string) error {
+	args := m.Called(ctx, userID, currentPassword, newPassword)
+	return args.Error(0)
+}
+
+func (m *MockAuthServiceForMiddleware) RequestPasswordReset(ctx context.Context, email, ip string) error {
+	args := m.Called(ctx, email, ip)
+	return args.Error(0)
+}
+
+func (m *MockAuthServiceForMiddleware) ResetPassword(ctx context.Context, token, newPassword, ip string) error {
+	args := m.Called(ctx, token, newPassword, ip)
+	return args.Error(0)
+}
+
+func (m *MockAuthServiceForMiddleware) RequestVerification(ctx context.Context, email, ip string) error {
+	args := m.Called(ctx, email, ip)
+	return args.Error(0)
+}
+
+func (m *MockAuthServiceForMiddleware) VerifyEmail(ctx context.Context, token, ip string) (*models.User, error) {
+	args := m.Called(ctx, token, ip)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*models.User), args.Error(1)
+}
+
+func (m *MockAuthServiceForMiddleware) VerificationRequired() bool {
+	return m.Called().Bool(0)
+}
+
+func (m *MockAuthServiceForMiddleware) SetJWTSecret(secret string) {
+	m.Called(secret)
+}
+
 // MockLoggerForMiddleware is a mock implementation of logger.Logger for middleware testing
 type MockLoggerForMiddleware struct {
 	mock.Mock
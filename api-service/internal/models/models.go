@@ -1,6 +1,7 @@
 package models
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/google/uuid"
@@ -14,7 +15,9 @@ type User struct {
 	Password   string     `json:"-" gorm:"not null"` // Never return password in JSON
 	FullName   *string    `json:"full_name"`
 	Status     string     `json:"status" gorm:"default:'active';check:status IN ('active','suspended','deleted')"`
-	Role       string     `json:"role" gorm:"default:'user';check:role IN ('admin','user')"`
+	Role       string     `json:"role" gorm:"default:'user';check:chk_users_roles,role IN ('admin','reseller','user')"`
+	UserGroup  string     `json:"user_group" gorm:"size:50;index"`
+	ResellerID *uuid.UUID `json:"reseller_id" gorm:"type:uuid;index"` // reseller owning the user, nil for platform users
 	DataLimit  int64      `json:"data_limit" gorm:"default:0"`
 	DataUsed   int64      `json:"data_used" gorm:"default:0"`
 	ExpiryDate *time.Time `json:"expiry_date"`
@@ -23,6 +26,13 @@ type User struct {
 	LastLogin  *time.Time `json:"last_login"`
 	Notes      *string    `json:"notes"`
 
+	// TelemetryOptIn is set by the user to let their apps report connection outcomes
+	TelemetryOptIn bool `json:"telemetry_opt_in" gorm:"default:false"`
+
+	// EmailVerificationPending is set for accounts that registered themselves until they
+	// follow the verification link mailed to them
+	EmailVerificationPending bool `json:"email_verification_pending" gorm:"default:false"`
+
 	// Relations
 	Devices []Device `json:"devices,omitempty" gorm:"foreignKey:UserID"`
 }
@@ -75,6 +85,94 @@ type TrafficStats struct {
 	Device *Device `json:"device,omitempty" gorm:"foreignKey:DeviceID"`
 }
 
+type TrafficStatsHourly struct {
+	ID        uuid.UUID  `json:"id" gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	UserID    uuid.UUID  `json:"user_id" gorm:"not null"`
+	DeviceID  *uuid.UUID `json:"device_id"`
+	Bucket    time.Time  `json:"bucket" gorm:"not null;index"`
+	Upload    int64      `json:"upload" gorm:"default:0"`
+	Download  int64      `json:"download" gorm:"default:0"`
+	Total     int64      `json:"total" gorm:"default:0"`
+	Samples   int        `json:"samples" gorm:"default:0"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// TrafficSample is the traffic of a user, or one of their devices, an agent counted since
+// its previous sample
+type TrafficSample struct {
+	UserID     uuid.UUID  `json:"user_id"`
+	DeviceID   *uuid.UUID `json:"device_id,omitempty"`
+	Upload     int64      `json:"upload"`
+	Download   int64      `json:"download"`
+	RecordedAt time.Time  `json:"recorded_at"`
+}
+
+// TrafficReport is a batch of samples an agent sends
+type TrafficReport struct {
+	Samples []TrafficSample `json:"samples"`
+}
+
+// TrafficIngestPolicy is how reported samples are buffered and written: up to BatchSize per
+// write, at least every FlushInterval, refusing reports while MaxPending samples wait
+type TrafficIngestPolicy struct {
+	BatchSize     int           `json:"batch_size"`
+	FlushInterval time.Duration `json:"flush_interval"`
+	MaxPending    int64         `json:"max_pending"`
+}
+
+type RetentionPolicy struct {
+	RawTrafficDays    int           `json:"raw_traffic_days"`
+	HourlyTrafficDays int           `json:"hourly_traffic_days"`
+	NodeMetricsDays   int           `json:"node_metrics_days"`
+	ConnectionLogDays int           `json:"connection_log_days"`
+	TelemetryDays     int           `json:"telemetry_days"`
+	PartitionsAhead   int           `json:"partitions_ahead"`
+	Interval          time.Duration `json:"interval"`
+}
+
+type RetentionReport struct {
+	StartedAt             time.Time `json:"started_at"`
+	FinishedAt            time.Time `json:"finished_at"`
+	PartitionsCreated     int       `json:"partitions_created"`
+	PartitionsDropped     int       `json:"partitions_dropped"`
+	HourlyRowsUpserted    int64     `json:"hourly_rows_upserted"`
+	RawRowsDeleted        int64     `json:"raw_rows_deleted"`
+	HourlyRowsDeleted     int64     `json:"hourly_rows_deleted"`
+	MetricRowsDeleted     int64     `json:"metric_rows_deleted"`
+	ConnectionLogsDeleted int64     `json:"connection_logs_deleted"`
+	TelemetryRowsDeleted  int64     `json:"telemetry_rows_deleted"`
+	Error                 string    `json:"error,omitempty"`
+}
+
+// JWTSigningKey is an ES256 key access and refresh tokens are signed with. The newest
+// active key signs new tokens; a retired key keeps validating the tokens it signed until
+// ExpiresAt, when the longest-lived of them has expired.
+type JWTSigningKey struct {
+	ID         string     `json:"kid" gorm:"primaryKey;size:64"`
+	Algorithm  string     `json:"alg" gorm:"not null;default:'ES256'"`
+	PrivateKey string     `json:"-" gorm:"not null"` // PKCS#8 PEM
+	PublicKey  string     `json:"public_key" gorm:"not null"`
+	CreatedAt  time.Time  `json:"created_at"`
+	RetiredAt  *time.Time `json:"retired_at"`
+	ExpiresAt  *time.Time `json:"expires_at" gorm:"index"`
+}
+
+// JWK is a public signing key in JSON Web Key format (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+}
+
+// JWKS is the published set of keys tokens may be signed with
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
 type HysteriaConfig struct {
 	ID         uuid.UUID              `json:"id" gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
 	UserID     uuid.UUID              `json:"user_id" gorm:"not null"`
@@ -142,11 +240,548 @@ type Connection struct {
 	ID          string    `json:"id"`
 	UserID      string    `json:"user_id"`
 	DeviceID    string    `json:"device_id"`
+	NodeID      string    `json:"node_id,omitempty"`
 	Address     string    `json:"address"`
 	Upload      int64     `json:"upload"`
 	Download    int64     `json:"download"`
 	Duration    int64     `json:"duration"`
 	ConnectedAt time.Time `json:"connected_at"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+// NodeWARPStatus is the state of the Cloudflare WARP client on a node
+type NodeWARPStatus struct {
+	Installed       bool              `json:"installed"`
+	Connected       bool              `json:"connected"`
+	Mode            string            `json:"mode"`
+	ProxyPort       int               `json:"proxy_port"`
+	AccountType     string            `json:"account_type"`
+	Organization    string            `json:"organization"`
+	IPAddress       string            `json:"ip_address"`
+	Location        string            `json:"location"`
+	ServerLocation  string            `json:"server_location"`
+	LastConnectedAt *time.Time        `json:"last_connected_at"`
+	UptimeSeconds   int64             `json:"uptime_seconds"`
+	BytesSent       int64             `json:"bytes_sent"`
+	BytesReceived   int64             `json:"bytes_received"`
+	Health          string            `json:"health"`
+	Error           string            `json:"error,omitempty"`
+	ClientType      string            `json:"client_type"` // "local" or "docker"
+	DeviceID        string            `json:"device_id,omitempty"`
+	DevicePosture   map[string]string `json:"device_posture,omitempty"`
+}
+
+// NodeWARPSettings replaces the WARP configuration of a node. The license key and Zero
+// Trust service token only go to the node.
+type NodeWARPSettings struct {
+	Enabled           bool   `json:"enabled"`
+	ProxyPort         int    `json:"proxy_port"`
+	AutoConnect       bool   `json:"auto_connect"`
+	NotifyOnFail      bool   `json:"notify_on_fail"`
+	ClientType        string `json:"client_type"`
+	LicenseKey        string `json:"-"`
+	Organization      string `json:"organization"`
+	Mode              string `json:"mode"`
+	TeamsClientID     string `json:"-"`
+	TeamsClientSecret string `json:"-"`
+}
+
+// WARPConnectivity is the outcome of a node checking its WARP proxy, by check
+type WARPConnectivity struct {
+	Success bool            `json:"success"`
+	Message string          `json:"message"`
+	Results map[string]bool `json:"results"`
+}
+
+// WARPLogs is the recent log of a node's WARP service
+type WARPLogs struct {
+	Logs       string `json:"logs"`
+	ClientType string `json:"client_type"`
+	Error      string `json:"error,omitempty"` // set when the log could only be read in part
+}
+
+// ObfuscationSettings is every obfuscation knob of a node at once; knobs left off are
+// turned off
+type ObfuscationSettings struct {
+	Salamander         bool     `json:"salamander"`
+	SalamanderPassword string   `json:"salamander_password,omitempty"` // per node, generated when empty
+	PortHopping        bool     `json:"port_hopping"`
+	HopStartPort       int      `json:"hop_start_port"`
+	HopEndPort         int      `json:"hop_end_port"`
+	HopInterval        int      `json:"hop_interval"` // seconds
+	QUICObfuscation    bool     `json:"quic_obfuscation"`
+	PacketPadding      int      `json:"packet_padding"`
+	TimingJitterMs     int      `json:"timing_jitter_ms"`
+	Fingerprints       []string `json:"fingerprints"`
+	RealityTargets     []string `json:"reality_targets"`
+	TrafficShaping     bool     `json:"traffic_shaping"`
+}
+
+// NodeObfuscation is the obfuscation applied to a node. Preset is empty for custom
+// settings; Settings is nil when the node keeps what is configured on its agent.
+type NodeObfuscation struct {
+	Preset   string               `json:"preset"`
+	Settings *ObfuscationSettings `json:"settings"`
+}
+
+// ObfuscationChange switches single obfuscation knobs of a node, keeping the others as
+// applied. Nil fields are left alone.
+type ObfuscationChange struct {
+	Salamander         *bool
+	SalamanderPassword *string
+	PortHopping        *bool
+	HopStartPort       *int
+	HopEndPort         *int
+	HopInterval        *int
+	QUICObfuscation    *bool
+	PacketPadding      *int
+	TimingJitterMs     *int
+	Fingerprints       []string
+	RealityTargets     []string
+	TrafficShaping     *bool
+}
+
+// SNIDomainOnboarding adds a domain to a node's SNI configuration
+type SNIDomainOnboarding struct {
+	Domain           string
+	ManageDNS        bool // point the domain's records at the node through Cloudflare
+	Overwrite        bool // replace records pointing elsewhere
+	IssueCertificate bool
+	Email            string
+	WaitSeconds      int
+}
+
+// SNIDomainResult is the outcome of adding a domain to a node. A domain whose certificate
+// could not be issued is still added, CertificateError says why.
+type SNIDomainResult struct {
+	Domain              string     `json:"domain"`
+	ResolvesToNode      bool       `json:"resolves_to_node"`
+	DNSMessage          string     `json:"dns_message,omitempty"`
+	CertificateIssued   bool       `json:"certificate_issued"`
+	CertificateIssuer   string     `json:"certificate_issuer,omitempty"`
+	CertificateNotAfter *time.Time `json:"certificate_not_after,omitempty"`
+	CertificateError    string     `json:"certificate_error,omitempty"`
+	Message             string     `json:"message"`
+}
+
+// NodeSNIDomains is a node's SNI domains
+type NodeSNIDomains struct {
+	Domains       []string `json:"domains"`
+	PrimaryDomain string   `json:"primary_domain"`
+}
+
+// NodeCertificate is a certificate a node obtained through ACME
+type NodeCertificate struct {
+	Domain    string    `json:"domain"`
+	Issuer    string    `json:"issuer"`
+	CA        string    `json:"ca"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	DaysLeft  int       `json:"days_left"`
+}
+
+// NodeCertificateStatus is how a node gets its certificates and the ones it holds.
+// Certificates are only listed when the node could report them, Message says why not.
+type NodeCertificateStatus struct {
+	Mode         string            `json:"mode"` // "files" or "acme"
+	CA           string            `json:"ca,omitempty"`
+	Challenge    string            `json:"challenge,omitempty"`
+	Email        string            `json:"email,omitempty"`
+	Certificates []NodeCertificate `json:"certificates"`
+	Pending      []string          `json:"pending"`       // domains without a certificate yet
+	ExpiringSoon []string          `json:"expiring_soon"` // within 30 days
+	Message      string            `json:"message,omitempty"`
+}
+
+// InventoryCertificate is a certificate a node served at the orchestrator's last sync
+type InventoryCertificate struct {
+	Domain     string    `json:"domain"`
+	Issuer     string    `json:"issuer"`
+	Source     string    `json:"source"` // "files" or "acme"
+	SelfSigned bool      `json:"self_signed"`
+	NotBefore  time.Time `json:"not_before"`
+	NotAfter   time.Time `json:"not_after"`
+	DaysLeft   int       `json:"days_left"`
+	NodeID     string    `json:"node_id"`
+	NodeName   string    `json:"node_name"`
+	SyncedAt   time.Time `json:"synced_at"`
+}
+
+// CertificateFilter narrows the certificate inventory; zero fields match everything
+type CertificateFilter struct {
+	NodeID             *uuid.UUID
+	Domain             string
+	ExpiringWithinDays int
+	SelfSigned         bool
+}
+
+// CertificateRenewal is the outcome of renewing certificates on several nodes
+type CertificateRenewal struct {
+	Message  string            `json:"message"`
+	Renewed  []string          `json:"renewed"`
+	Failures map[string]string `json:"failures"` // node ID -> error
+}
+
+// UploadedCertificate is a certificate an admin uploaded for a domain ACME cannot serve,
+// installed on every node serving a domain it covers
+type UploadedCertificate struct {
+	Domain      string    `json:"domain"`
+	Issuer      string    `json:"issuer"`
+	Fingerprint string    `json:"fingerprint"` // SHA-256 of the leaf, hex
+	NotBefore   time.Time `json:"not_before"`
+	NotAfter    time.Time `json:"not_after"`
+	CustomCA    bool      `json:"custom_ca"`
+	NodeIDs     []string  `json:"node_ids"`
+	UploadedAt  time.Time `json:"uploaded_at"`
+}
+
+// CertificateUpload is a certificate chain and key for a domain, with the roots of an
+// internal CA when the chain does not lead to a public root
+type CertificateUpload struct {
+	Domain         string
+	CertificatePEM string
+	PrivateKeyPEM  string
+	CABundlePEM    string
+}
+
+// CertificateDistribution is the outcome of an upload on the nodes serving its domain
+type CertificateDistribution struct {
+	Message     string               `json:"message"`
+	Certificate *UploadedCertificate `json:"certificate"`
+	Installed   []string             `json:"installed"`
+	Failures    map[string]string    `json:"failures"` // node ID -> error
+}
+
+// TLSCheck is one check of a TLS report; hint says how to fix a check that did not pass
+type TLSCheck struct {
+	Name       string `json:"name"` // tls_chain, ocsp_stapling, tls_versions, weak_ciphers
+	Target     string `json:"target"`
+	Status     string `json:"status"` // pass, warn, fail, skip
+	Detail     string `json:"detail,omitempty"`
+	Hint       string `json:"hint,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// TLSReport grades the TLS a node serves on its TCP ports as another node saw it: A, B with
+// warnings, C for legacy protocols or broken cipher suites, F for a certificate clients reject
+type TLSReport struct {
+	ID           string     `json:"id"`
+	NodeID       string     `json:"node_id"`
+	ProberNodeID string     `json:"prober_node_id"`
+	Target       string     `json:"target"`
+	Grade        string     `json:"grade"`
+	Score        int        `json:"score"`
+	StartedAt    time.Time  `json:"started_at"`
+	FinishedAt   time.Time  `json:"finished_at"`
+	Checks       []TLSCheck `json:"checks"`
+}
+
+// DriftItem is one difference between a node and its desired state: a deployed config
+// edited by hand, a protocol or server in the wrong state, a missing firewall or routing rule
+type DriftItem struct {
+	Kind     string `json:"kind"` // config, protocol, service, firewall, routing
+	Target   string `json:"target"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+}
+
+// NodeDrift is what the last drift check of a node found. Nodes with the heal policy are
+// healed when a scheduled check finds drift; the items are then the drift left.
+type NodeDrift struct {
+	NodeID     string      `json:"node_id"`
+	NodeName   string      `json:"node_name"`
+	Policy     string      `json:"policy"` // report, heal
+	Items      []DriftItem `json:"items"`
+	Healed     []string    `json:"healed,omitempty"` // actions taken by the last heal
+	HealFailed []string    `json:"heal_failed,omitempty"`
+	CheckedAt  time.Time   `json:"checked_at"`
+	HealedAt   *time.Time  `json:"healed_at,omitempty"`
+}
+
+// PortForward is a public port of a node the node's agent forwards to a user's server, e.g.
+// a game server. Its ID is the forward's ID on the agent too.
+type PortForward struct {
+	ID          uuid.UUID `json:"id" gorm:"type:uuid;primaryKey"`
+	UserID      uuid.UUID `json:"user_id" gorm:"type:uuid;not null;index"`
+	NodeID      uuid.UUID `json:"node_id" gorm:"type:uuid;not null;uniqueIndex:idx_port_forwards_listen"`
+	Protocol    string    `json:"protocol" gorm:"size:3;not null;uniqueIndex:idx_port_forwards_listen"` // tcp, udp
+	ListenPort  int       `json:"listen_port" gorm:"not null;uniqueIndex:idx_port_forwards_listen"`
+	TargetHost  string    `json:"target_host" gorm:"size:45;not null"`
+	TargetPort  int       `json:"target_port" gorm:"not null"`
+	Description string    `json:"description" gorm:"size:255"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// LiveSession is a client currently connected to a node. Live sessions are kept in Redis
+// while the node keeps reporting them.
+type LiveSession struct {
+	ClientID    string    `json:"client_id"` // ID the node's server knows the client by
+	UserID      string    `json:"user_id"`
+	DeviceID    string    `json:"device_id,omitempty"`
+	NodeID      string    `json:"node_id"`
+	Protocol    string    `json:"protocol"`
+	Connections int       `json:"connections"`
+	ConnectedAt time.Time `json:"connected_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// SessionEvent is a client connecting to or disconnecting from a node, as reported by its
+// agent. A connect event for a known client updates its connection count.
+type SessionEvent struct {
+	Type        string    `json:"type"` // "connect" or "disconnect"
+	ClientID    string    `json:"client_id"`
+	UserID      string    `json:"user_id"`
+	DeviceID    string    `json:"device_id"`
+	Protocol    string    `json:"protocol"`
+	Connections int       `json:"connections"`
+	Upload      int64     `json:"upload"`   // bytes since the session started, when the node reports them
+	Download    int64     `json:"download"` // bytes since the session started, when the node reports them
+	Time        time.Time `json:"time"`
+}
+
+// SessionReport is the batch of events an agent posts after every poll. With Resync the
+// connect events list every client online on the node and all other sessions are dropped.
+type SessionReport struct {
+	Events []SessionEvent `json:"events"`
+	Resync bool           `json:"resync"`
+}
+
+// Connection log modes. Metadata keeps what accounting needs and drops client addresses and
+// destinations; off keeps nothing about connections beyond the live session list.
+const (
+	ConnectionLogOff      = "off"
+	ConnectionLogMetadata = "metadata"
+	ConnectionLogFull     = "full"
+)
+
+// ConnectionLogPolicy is what is kept about client connections and for how long; 0 days
+// keeps them until deleted
+type ConnectionLogPolicy struct {
+	Mode          string `json:"mode"`
+	RetentionDays int    `json:"retention_days"`
+}
+
+// ConnectionLog is one client session on a node, from the agent's connect and disconnect
+// events. A session still open has no DisconnectedAt and the bytes of its last report.
+type ConnectionLog struct {
+	ID             uuid.UUID  `json:"id" gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	UserID         uuid.UUID  `json:"user_id" gorm:"type:uuid;not null;index"`
+	DeviceID       string     `json:"device_id,omitempty" gorm:"size:255"`
+	NodeID         uuid.UUID  `json:"node_id" gorm:"type:uuid;not null;index:idx_connection_logs_node_client"`
+	ClientID       string     `json:"client_id" gorm:"size:255;not null;index:idx_connection_logs_node_client"`
+	Protocol       string     `json:"protocol" gorm:"size:30"`
+	Upload         int64      `json:"upload"`
+	Download       int64      `json:"download"`
+	ConnectedAt    time.Time  `json:"connected_at" gorm:"not null;index"`
+	DisconnectedAt *time.Time `json:"disconnected_at"`
+}
+
+// ConnectionRecord is a single finished client connection exported to the analytics store
+type ConnectionRecord struct {
+	UserID        string    `json:"user_id"`
+	DeviceID      string    `json:"device_id"`
+	NodeID        string    `json:"node_id"`
+	Protocol      string    `json:"protocol"`
+	ClientIP      string    `json:"client_ip"`
+	ClientASN     uint32    `json:"client_asn"`
+	ClientCountry string    `json:"client_country"`
+	Upload        int64     `json:"upload"`
+	Download      int64     `json:"download"`
+	Duration      int64     `json:"duration"`
+	Destination   string    `json:"destination,omitempty"` // host the client reached, when the node reports it
+	ConnectedAt   time.Time `json:"connected_at"`
+}
+
+// ConnectionReport is a batch of sessions that ended on a node, as its agent sends them
+type ConnectionReport struct {
+	Connections []ConnectionRecord `json:"connections"`
+}
+
+// ConnectionFilter narrows analytics queries to some users and/or a node; empty fields
+// match every connection
+type ConnectionFilter struct {
+	UserIDs []uuid.UUID
+	NodeID  *uuid.UUID
+}
+
+type TopTalker struct {
+	UserID      string `json:"user_id"`
+	Upload      int64  `json:"upload"`
+	Download    int64  `json:"download"`
+	Total       int64  `json:"total"`
+	Connections int64  `json:"connections"`
+}
+
+type CountryUsage struct {
+	Country     string `json:"country"`
+	Users       int64  `json:"users"`
+	Total       int64  `json:"total"`
+	Connections int64  `json:"connections"`
+}
+
+type ProtocolUsage struct {
+	Protocol    string `json:"protocol"`
+	Total       int64  `json:"total"`
+	Connections int64  `json:"connections"`
+}
+
+type DestinationUsage struct {
+	Destination string `json:"destination"`
+	Total       int64  `json:"total"`
+	Connections int64  `json:"connections"`
+}
+
+// ClientSubscription is a generated client config bundle with the uTLS fingerprint
+// selected for the current rotation period
+type ClientSubscription struct {
+	Format              string                 `json:"format"`
+	Fingerprint         string                 `json:"fingerprint"`
+	RotatesAt           time.Time              `json:"rotates_at"`
+	UpdateIntervalHours int                    `json:"update_interval_hours"`
+	Upload              int64                  `json:"-"`
+	Download            int64                  `json:"-"`
+	Total               int64                  `json:"-"`
+	ExpiresAt           *time.Time             `json:"-"`
+	Config              map[string]interface{} `json:"config"`
+}
+
+// ShareLink is a single-node connection URI (hy2://, vless://, trojan://) for importing into mobile clients
+type ShareLink struct {
+	Protocol string    `json:"protocol"`
+	NodeID   uuid.UUID `json:"node_id"`
+	NodeName string    `json:"node_name"`
+	URI      string    `json:"uri"`
+}
+
+// ClientTelemetry is a connection attempt an opted-in client app reported. It keeps no
+// user, device or address: the country is resolved from the request and the ASN is the
+// one the app reports for its network.
+type ClientTelemetry struct {
+	ID             uuid.UUID `json:"id" gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	NodeID         uuid.UUID `json:"node_id" gorm:"type:uuid;not null;index"`
+	Protocol       string    `json:"protocol" gorm:"size:30;not null"`
+	Success        bool      `json:"success" gorm:"not null"`
+	HandshakeMs    int       `json:"handshake_ms"`
+	ThroughputKbps int       `json:"throughput_kbps"` // 0 when the app did not measure it
+	FailureReason  string    `json:"failure_reason,omitempty" gorm:"size:50"`
+	ASN            uint32    `json:"asn" gorm:"index"`
+	ISP            string    `json:"isp,omitempty" gorm:"size:100"`
+	Country        string    `json:"country,omitempty" gorm:"size:2"`
+	ReportedAt     time.Time `json:"reported_at" gorm:"not null;index"`
+}
+
+// TelemetryReport is a batch of connection attempts a client app sends. ASN and ISP
+// describe the network the app is on and apply to every event.
+type TelemetryReport struct {
+	ASN    uint32           `json:"asn"`
+	ISP    string           `json:"isp"`
+	Events []TelemetryEvent `json:"events"`
+}
+
+// TelemetryEvent is one connection attempt in a TelemetryReport
+type TelemetryEvent struct {
+	NodeID         uuid.UUID `json:"node_id"`
+	Protocol       string    `json:"protocol"`
+	Success        bool      `json:"success"`
+	HandshakeMs    int       `json:"handshake_ms"`
+	ThroughputKbps int       `json:"throughput_kbps"`
+	FailureReason  string    `json:"failure_reason"` // e.g. "timeout", "reset", "tls"
+	OccurredAt     time.Time `json:"occurred_at"`    // zero for now
+}
+
+// TelemetryFilter selects the client telemetry of an ASN or, without one, of a country;
+// an empty filter selects every client
+type TelemetryFilter struct {
+	ASN     uint32
+	Country string
+}
+
+// NodeReliability aggregates the recent client telemetry of a node
+type NodeReliability struct {
+	NodeID      uuid.UUID `json:"node_id"`
+	Attempts    int       `json:"attempts"`
+	Successes   int       `json:"successes"`
+	SuccessRate float64   `json:"success_rate"`
+}
+
+// ProtocolReachability aggregates the client telemetry of one protocol from one ASN
+type ProtocolReachability struct {
+	ASN               uint32  `json:"asn"`
+	ISP               string  `json:"isp"` // the name clients report most often
+	Protocol          string  `json:"protocol"`
+	Attempts          int     `json:"attempts"`
+	Successes         int     `json:"successes"`
+	SuccessRate       float64 `json:"success_rate"`
+	MedianHandshakeMs float64 `json:"median_handshake_ms"` // successful attempts
+}
+
+// ASNProbeSummary aggregates the probe reports of prober nodes inside an ASN, set as "asn"
+// in the prober's metadata
+type ASNProbeSummary struct {
+	ASN          uint32    `json:"asn"`
+	Reports      int       `json:"reports"`
+	AvgScore     float64   `json:"avg_score"`
+	LastProbedAt time.Time `json:"last_probed_at"`
+}
+
+// ASNReachability is how well the nodes can be reached from one ASN: per protocol from
+// client telemetry, by probes from nodes inside the ASN, and the protocols subscriptions
+// recommend there
+type ASNReachability struct {
+	ASN                  uint32                  `json:"asn"`
+	ISP                  string                  `json:"isp"`
+	Attempts             int                     `json:"attempts"`
+	SuccessRate          float64                 `json:"success_rate"`
+	Protocols            []*ProtocolReachability `json:"protocols"`
+	Probes               *ASNProbeSummary        `json:"probes"`                // nil without probers in the ASN
+	RecommendedProtocols []string                `json:"recommended_protocols"` // the ASN's policy
+	// SuggestedProtocols ranks the protocols with enough telemetry by success rate, as a
+	// starting point for a policy
+	SuggestedProtocols []string `json:"suggested_protocols"`
+}
+
+// ASNProtocolPolicy lists the protocols subscriptions put first for clients in an ASN, in
+// order of preference. Protocols left out stay in the subscription as fallbacks.
+type ASNProtocolPolicy struct {
+	ID        uuid.UUID `json:"id" gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	ASN       uint32    `json:"asn" gorm:"uniqueIndex;not null"`
+	Name      string    `json:"name" gorm:"size:100"` // ISP, for operators
+	Protocols []string  `json:"protocols" gorm:"serializer:json;type:jsonb"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ClientLocation is where a client connects from; Region names the speedtest reflector
+// region measured for that location
+type ClientLocation struct {
+	IP      string `json:"ip,omitempty"`
+	Country string `json:"country,omitempty"`
+	Region  string `json:"region,omitempty"`
+	ASN     uint32 `json:"asn,omitempty"` // reported by the client app
+}
+
+// RegionLatency aggregates the recent successful speedtests of a node for one region
+type RegionLatency struct {
+	NodeID          uuid.UUID `json:"node_id"`
+	AvgLatencyMs    float64   `json:"avg_latency_ms"`
+	AvgDownloadMbps float64   `json:"avg_download_mbps"`
+	Samples         int       `json:"samples"`
+}
+
+// NodeRecommendation is a node ranked for a client location. LatencyMs is nil when the
+// node has no recent speedtests for the client's region.
+type NodeRecommendation struct {
+	Node         *VPSNode `json:"node"`
+	Score        float64  `json:"score"`
+	LatencyMs    *float64 `json:"latency_ms"`
+	DownloadMbps *float64 `json:"download_mbps"`
+	Load         float64  `json:"load"`
+	Headroom     float64  `json:"headroom"`
+	Users        int      `json:"users"` // active users assigned to the node
+	Full         bool     `json:"full"`  // at its user, connection or bandwidth cap
+	// Reliability is the share of successful client connections from the client's ASN, or
+	// its country when the ASN is unknown, nil without enough telemetry
+	Reliability *float64 `json:"reliability"`
 }
 
 type VPSNode struct {
@@ -163,6 +798,7 @@ type VPSNode struct {
 	CreatedAt     time.Time              `json:"created_at" gorm:"default:CURRENT_TIMESTAMP"`
 	LastHeartbeat *time.Time             `json:"last_heartbeat" gorm:"index"`
 	Metadata      map[string]interface{} `json:"metadata" gorm:"type:jsonb"`
+	Protocols     map[string]interface{} `json:"protocols" gorm:"type:jsonb"` // protocol -> enabled, empty enables all
 
 	// Relations
 	Assignments []NodeAssignment `json:"assignments,omitempty" gorm:"foreignKey:NodeID"`
@@ -192,6 +828,13 @@ type NodeMetric struct {
 	ActiveConnections int       `json:"active_connections"`
 	RecordedAt        time.Time `json:"recorded_at" gorm:"default:CURRENT_TIMESTAMP;index"`
 
+	DiskUsedPercent       float64 `json:"disk_used_percent" gorm:"type:decimal(5,2)"`
+	DiskInodesUsedPercent float64 `json:"disk_inodes_used_percent" gorm:"type:decimal(5,2)"`
+	DiskLowPartitions     int     `json:"disk_low_partitions" gorm:"default:0"`
+	ConfigDriftFiles      int     `json:"config_drift_files" gorm:"default:0"`
+
+	WARPFailoverActive bool `json:"warp_failover_active" gorm:"default:false"`
+
 	// Relations
 	Node *VPSNode `json:"node,omitempty" gorm:"foreignKey:NodeID"`
 }
@@ -209,6 +852,272 @@ type Deployment struct {
 	Node *VPSNode `json:"node,omitempty" gorm:"foreignKey:NodeID"`
 }
 
+// Voucher is a redeem code that creates an account or tops up an existing one. Plan sets
+// the user group, DurationDays extends the expiry date and DataLimit adds to the data
+// limit; zero leaves them unchanged. Trial vouchers only create accounts, and a device
+// redeems at most one of them.
+type Voucher struct {
+	ID           uuid.UUID  `json:"id" gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	Code         string     `json:"code" gorm:"size:32;uniqueIndex;not null"`
+	Plan         string     `json:"plan" gorm:"size:50"`
+	DurationDays int        `json:"duration_days" gorm:"default:0"`
+	DataLimit    int64      `json:"data_limit" gorm:"default:0"`
+	MaxUses      int        `json:"max_uses" gorm:"default:1"`
+	Uses         int        `json:"uses" gorm:"default:0"`
+	Trial        bool       `json:"trial" gorm:"default:false"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+	RevokedAt    *time.Time `json:"revoked_at"`
+	CreatedBy    *uuid.UUID `json:"created_by" gorm:"type:uuid"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// VoucherRedemption records who redeemed a voucher and from where. A device fingerprint
+// redeems each voucher once.
+type VoucherRedemption struct {
+	ID                uuid.UUID `json:"id" gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	VoucherID         uuid.UUID `json:"voucher_id" gorm:"type:uuid;not null;uniqueIndex:idx_voucher_redemptions_device"`
+	UserID            uuid.UUID `json:"user_id" gorm:"type:uuid;not null;index"`
+	DeviceFingerprint string    `json:"device_fingerprint" gorm:"size:128;not null;uniqueIndex:idx_voucher_redemptions_device;index"`
+	IPAddress         string    `json:"ip_address" gorm:"size:45"`
+	Trial             bool      `json:"trial" gorm:"default:false"`
+	CreatedAt         time.Time `json:"created_at"`
+}
+
+// IsRedeemable reports whether the voucher can still be redeemed at now
+func (v *Voucher) IsRedeemable(now time.Time) bool {
+	if v.RevokedAt != nil || v.Uses >= v.MaxUses {
+		return false
+	}
+	return v.ExpiresAt == nil || v.ExpiresAt.After(now)
+}
+
+// Reseller holds the quota of a user with the reseller role, who creates and manages users
+// of their own. MaxUsers and DataQuota of 0 are unlimited. Under a data quota every user
+// of the reseller needs a data limit, and their limits together may not exceed it.
+type Reseller struct {
+	UserID    uuid.UUID `json:"user_id" gorm:"type:uuid;primaryKey"`
+	MaxUsers  int       `json:"max_users" gorm:"default:0"`
+	DataQuota int64     `json:"data_quota" gorm:"default:0"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	Usage *ResellerUsage `json:"usage,omitempty" gorm:"-"`
+
+	// Relations
+	User *User `json:"user,omitempty" gorm:"foreignKey:UserID"`
+}
+
+// ResellerUsage is the part of a reseller's quota their users take
+type ResellerUsage struct {
+	Users         int64 `json:"users"`
+	DataAllocated int64 `json:"data_allocated"`
+	DataUsed      int64 `json:"data_used"`
+}
+
+// ReportSchedule delivers a usage report of a user, a node or a reseller's users (tenant)
+// after every period ends, to email recipients and/or a webhook
+type ReportSchedule struct {
+	ID           uuid.UUID  `json:"id" gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	Name         string     `json:"name" gorm:"size:100;not null"`
+	Scope        string     `json:"scope" gorm:"size:20;not null;check:scope IN ('user','node','tenant')"`
+	SubjectID    uuid.UUID  `json:"subject_id" gorm:"type:uuid;not null;index"`
+	Period       string     `json:"period" gorm:"size:20;not null;check:period IN ('daily','weekly','monthly')"`
+	Format       string     `json:"format" gorm:"size:10;not null;default:'csv';check:format IN ('csv','pdf')"`
+	Emails       []string   `json:"emails" gorm:"serializer:json;type:jsonb"`
+	WebhookURL   string     `json:"webhook_url" gorm:"size:500"`
+	WebhookToken string     `json:"-" gorm:"size:500"` // sent as a bearer token
+	Enabled      bool       `json:"enabled" gorm:"not null"`
+	NextRunAt    time.Time  `json:"next_run_at" gorm:"not null;index"`
+	LastRunAt    *time.Time `json:"last_run_at"`
+	LastError    string     `json:"last_error" gorm:"type:text"`
+	CreatedBy    *uuid.UUID `json:"created_by" gorm:"type:uuid"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
+
+// UserIdentity links a user to their account at an OpenID provider, by the provider's
+// issuer and its stable subject identifier
+type UserIdentity struct {
+	ID          uuid.UUID  `json:"id" gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	UserID      uuid.UUID  `json:"user_id" gorm:"type:uuid;not null;index"`
+	Issuer      string     `json:"issuer" gorm:"size:255;not null;uniqueIndex:idx_user_identities_subject"`
+	Subject     string     `json:"subject" gorm:"size:255;not null;uniqueIndex:idx_user_identities_subject"`
+	Email       string     `json:"email" gorm:"size:255"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastLoginAt *time.Time `json:"last_login_at"`
+}
+
+// AllowedNetwork is a network admins or node agents may connect from, on top of the ones
+// configured in the environment. A scope without networks is not restricted.
+type AllowedNetwork struct {
+	ID          uuid.UUID  `json:"id" gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	Scope       string     `json:"scope" gorm:"size:20;not null;index"`
+	CIDR        string     `json:"cidr" gorm:"column:cidr;size:50;not null"`
+	Description string     `json:"description" gorm:"size:255"`
+	CreatedBy   *uuid.UUID `json:"created_by" gorm:"type:uuid"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// Scopes of allowed networks: the admin API, and the agent endpoints of api-service and the
+// orchestrator's gRPC port
+const (
+	AllowedNetworkAdmin = "admin"
+	AllowedNetworkAgent = "agent"
+)
+
+// DirectorySyncReport tells what a sync of the LDAP directory changed
+type DirectorySyncReport struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Entries    int       `json:"entries"`
+	Created    int       `json:"created"`
+	Linked     int       `json:"linked"`
+	Updated    int       `json:"updated"`
+	Suspended  int       `json:"suspended"`
+	Skipped    int       `json:"skipped"`
+	Failed     int       `json:"failed"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// UsageReport is the usage of a user, node or tenant in a period. Rows break it down by
+// device for a user and by user otherwise. Session counts and top destinations come from
+// the analytics store and are left out when analytics is disabled.
+type UsageReport struct {
+	Scope           string             `json:"scope"`
+	SubjectID       uuid.UUID          `json:"subject_id"`
+	SubjectName     string             `json:"subject_name"`
+	From            time.Time          `json:"from"`
+	To              time.Time          `json:"to"`
+	GeneratedAt     time.Time          `json:"generated_at"`
+	Upload          int64              `json:"upload"`
+	Download        int64              `json:"download"`
+	Total           int64              `json:"total"`
+	Sessions        *int64             `json:"sessions,omitempty"`
+	Rows            []UsageReportRow   `json:"rows"`
+	TopDestinations []DestinationUsage `json:"top_destinations,omitempty"`
+}
+
+type UsageReportRow struct {
+	ID       uuid.UUID `json:"id"`
+	Name     string    `json:"name"`
+	Upload   int64     `json:"upload"`
+	Download int64     `json:"download"`
+	Total    int64     `json:"total"`
+	Sessions *int64    `json:"sessions,omitempty"`
+}
+
+// Report periods run from midnight UTC; weeks start on Monday
+const (
+	ReportDaily   = "daily"
+	ReportWeekly  = "weekly"
+	ReportMonthly = "monthly"
+)
+
+// ReportPeriodStart returns the start of the report period containing t
+func ReportPeriodStart(period string, t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch period {
+	case ReportWeekly:
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	case ReportMonthly:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return day
+}
+
+// AddReportPeriods moves the start of a report period by n periods
+func AddReportPeriods(period string, start time.Time, n int) time.Time {
+	switch period {
+	case ReportWeekly:
+		return start.AddDate(0, 0, 7*n)
+	case ReportMonthly:
+		return start.AddDate(0, n, 0)
+	}
+	return start.AddDate(0, 0, n)
+}
+
+// Filename names the file a report is rendered to
+func (r *UsageReport) Filename(format string) string {
+	return fmt.Sprintf("usage-%s-%s-%s.%s", r.Scope, r.SubjectID, r.From.Format("2006-01-02"), format)
+}
+
+// UserDataExport is everything stored about a user, as handed to them on request. Traffic
+// is summed per day; connection log entries are left out when the log is off.
+type UserDataExport struct {
+	ExportedAt         time.Time           `json:"exported_at"`
+	User               *User               `json:"user"`
+	Devices            []Device            `json:"devices"`
+	Sessions           []Session           `json:"sessions"`
+	Identities         []UserIdentity      `json:"identities"`
+	VoucherRedemptions []VoucherRedemption `json:"voucher_redemptions"`
+	ConnectionLog      []ConnectionLog     `json:"connection_log"`
+	Traffic            []DailyTraffic      `json:"traffic"`
+}
+
+// DailyTraffic is a user's traffic on one UTC day
+type DailyTraffic struct {
+	Day      time.Time `json:"day"`
+	Upload   int64     `json:"upload"`
+	Download int64     `json:"download"`
+	Total    int64     `json:"total"`
+}
+
+// Data erasure modes: delete removes the user and everything stored about them; anonymize
+// keeps the user's traffic under an account stripped of everything that identifies them
+const (
+	ErasureDelete    = "delete"
+	ErasureAnonymize = "anonymize"
+)
+
+// Data erasure job states
+const (
+	ErasurePending   = "pending"
+	ErasureRunning   = "running"
+	ErasureCompleted = "completed"
+	ErasureFailed    = "failed"
+)
+
+// DataErasure is a request to erase a user's data, run in the background. Once completed it
+// is the certificate of the erasure: the rows it removed or anonymized by table and a
+// SHA-256 digest of them, kept after the user is gone.
+type DataErasure struct {
+	ID              uuid.UUID        `json:"id" gorm:"type:uuid;default:gen_random_uuid();primaryKey"`
+	UserID          uuid.UUID        `json:"user_id" gorm:"type:uuid;not null;index"`
+	Mode            string           `json:"mode" gorm:"size:20;not null;check:mode IN ('delete','anonymize')"`
+	Status          string           `json:"status" gorm:"size:20;not null;index;check:status IN ('pending','running','completed','failed')"`
+	RequestedBy     *uuid.UUID       `json:"requested_by" gorm:"type:uuid"`
+	Records         map[string]int64 `json:"records,omitempty" gorm:"serializer:json;type:jsonb"`
+	AnalyticsErased bool             `json:"analytics_erased"`
+	Certificate     string           `json:"certificate,omitempty" gorm:"size:64"`
+	Error           string           `json:"error,omitempty" gorm:"type:text"`
+	CreatedAt       time.Time        `json:"created_at"`
+	StartedAt       *time.Time       `json:"started_at"`
+	CompletedAt     *time.Time       `json:"completed_at"`
+}
+
+// AuditEvent is a record of something done on one of the services, received over the event
+// bus. Its ID is the event's, so an event delivered twice is recorded once.
+type AuditEvent struct {
+	ID         string            `json:"id" gorm:"size:64;primaryKey"`
+	Source     string            `json:"source" gorm:"size:100;not null;index"` // service, or "agent/<node id>"
+	Actor      string            `json:"actor,omitempty" gorm:"size:100;index"`
+	Action     string            `json:"action" gorm:"size:255;not null;index"`
+	Target     string            `json:"target,omitempty" gorm:"size:255"`
+	Severity   string            `json:"severity" gorm:"size:20;not null"`
+	Message    string            `json:"message,omitempty" gorm:"type:text"`
+	Details    map[string]string `json:"details,omitempty" gorm:"serializer:json;type:jsonb"`
+	OccurredAt time.Time         `json:"occurred_at" gorm:"not null;index"`
+	CreatedAt  time.Time         `json:"created_at"`
+}
+
+// AuditFilter narrows a listing of audit events; empty fields match everything
+type AuditFilter struct {
+	Source string
+	Actor  string
+	Action string
+}
+
 type ServiceStatus struct {
 	IsRunning         bool          `json:"is_running"`
 	Version           string        `json:"version"`
@@ -236,6 +1145,10 @@ func (TrafficStats) TableName() string {
 	return "traffic_stats"
 }
 
+func (TrafficStatsHourly) TableName() string {
+	return "traffic_stats_hourly"
+}
+
 func (HysteriaConfig) TableName() string {
 	return "hysteria_configs"
 }
@@ -244,6 +1157,50 @@ func (XrayConfig) TableName() string {
 	return "xray_configs"
 }
 
+func (Voucher) TableName() string {
+	return "vouchers"
+}
+
+func (VoucherRedemption) TableName() string {
+	return "voucher_redemptions"
+}
+
+func (Reseller) TableName() string {
+	return "resellers"
+}
+
+func (ReportSchedule) TableName() string {
+	return "report_schedules"
+}
+
+func (UserIdentity) TableName() string {
+	return "user_identities"
+}
+
+func (AllowedNetwork) TableName() string {
+	return "allowed_networks"
+}
+
+func (ConnectionLog) TableName() string {
+	return "connection_logs"
+}
+
+func (ClientTelemetry) TableName() string {
+	return "client_telemetry"
+}
+
+func (ASNProtocolPolicy) TableName() string {
+	return "asn_protocol_policies"
+}
+
+func (DataErasure) TableName() string {
+	return "data_erasures"
+}
+
+func (AuditEvent) TableName() string {
+	return "audit_events"
+}
+
 func (VPSNode) TableName() string {
 	return "vps_nodes"
 }
@@ -292,6 +1249,13 @@ func (t *TrafficStats) BeforeCreate(tx *gorm.DB) error {
 	return nil
 }
 
+func (t *TrafficStatsHourly) BeforeCreate(tx *gorm.DB) error {
+	if t.ID == uuid.Nil {
+		t.ID = uuid.New()
+	}
+	return nil
+}
+
 func (h *HysteriaConfig) BeforeCreate(tx *gorm.DB) error {
 	if h.ID == uuid.Nil {
 		h.ID = uuid.New()
@@ -299,6 +1263,55 @@ func (h *HysteriaConfig) BeforeCreate(tx *gorm.DB) error {
 	return nil
 }
 
+func (v *Voucher) BeforeCreate(tx *gorm.DB) error {
+	if v.ID == uuid.Nil {
+		v.ID = uuid.New()
+	}
+	return nil
+}
+
+func (r *VoucherRedemption) BeforeCreate(tx *gorm.DB) error {
+	if r.ID == uuid.Nil {
+		r.ID = uuid.New()
+	}
+	return nil
+}
+
+func (r *ReportSchedule) BeforeCreate(tx *gorm.DB) error {
+	if r.ID == uuid.Nil {
+		r.ID = uuid.New()
+	}
+	return nil
+}
+
+func (i *UserIdentity) BeforeCreate(tx *gorm.DB) error {
+	if i.ID == uuid.Nil {
+		i.ID = uuid.New()
+	}
+	return nil
+}
+
+func (n *AllowedNetwork) BeforeCreate(tx *gorm.DB) error {
+	if n.ID == uuid.Nil {
+		n.ID = uuid.New()
+	}
+	return nil
+}
+
+func (t *ClientTelemetry) BeforeCreate(tx *gorm.DB) error {
+	if t.ID == uuid.Nil {
+		t.ID = uuid.New()
+	}
+	return nil
+}
+
+func (p *ASNProtocolPolicy) BeforeCreate(tx *gorm.DB) error {
+	if p.ID == uuid.Nil {
+		p.ID = uuid.New()
+	}
+	return nil
+}
+
 func (v *VPSNode) BeforeCreate(tx *gorm.DB) error {
 	if v.ID == uuid.Nil {
 		v.ID = uuid.New()
@@ -326,3 +1339,13 @@ func (d *Deployment) BeforeCreate(tx *gorm.DB) error {
 	}
 	return nil
 }
+
+// IsProtocolEnabled reports whether the node's protocol matrix enables protocol.
+// Nodes without a matrix predate it and serve every protocol.
+func (v *VPSNode) IsProtocolEnabled(protocol string) bool {
+	if len(v.Protocols) == 0 {
+		return true
+	}
+	enabled, _ := v.Protocols[protocol].(bool)
+	return enabled
+}
@@ -0,0 +1,49 @@
+package repositories
+
+import (
+	"context"
+
+	"hysteria2_microservices/api-service/internal/models"
+	repoInterfaces "hysteria2_microservices/api-service/internal/repositories/interfaces"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type allowedNetworkRepository struct {
+	db *gorm.DB
+}
+
+func NewAllowedNetworkRepository(db *gorm.DB) repoInterfaces.AllowedNetworkRepository {
+	return &allowedNetworkRepository{db: db}
+}
+
+func (r *allowedNetworkRepository) List(ctx context.Context) ([]*models.AllowedNetwork, error) {
+	var networks []*models.AllowedNetwork
+	err := r.db.WithContext(ctx).Order("scope, created_at").Find(&networks).Error
+	return networks, err
+}
+
+func (r *allowedNetworkRepository) Create(ctx context.Context, network *models.AllowedNetwork) error {
+	return r.db.WithContext(ctx).Create(network).Error
+}
+
+func (r *allowedNetworkRepository) GetByID(ctx context.Context, id uuid.UUID) (*models.AllowedNetwork, error) {
+	var network models.AllowedNetwork
+	err := r.db.WithContext(ctx).Where("id = ?", id).First(&network).Error
+	if err != nil {
+		return nil, err
+	}
+	return &network, nil
+}
+
+func (r *allowedNetworkRepository) Delete(ctx context.Context, id uuid.UUID) error {
+	result := r.db.WithContext(ctx).Delete(&models.AllowedNetwork{}, "id = ?", id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
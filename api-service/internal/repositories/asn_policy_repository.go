@@ -0,0 +1,53 @@
+package repositories
+
+import (
+	"context"
+
+	"hysteria2_microservices/api-service/internal/models"
+	repoInterfaces "hysteria2_microservices/api-service/internal/repositories/interfaces"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type asnPolicyRepository struct {
+	db *gorm.DB
+}
+
+func NewASNPolicyRepository(db *gorm.DB) repoInterfaces.ASNPolicyRepository {
+	return &asnPolicyRepository{db: db}
+}
+
+func (r *asnPolicyRepository) List(ctx context.Context) ([]*models.ASNProtocolPolicy, error) {
+	var policies []*models.ASNProtocolPolicy
+	err := r.db.WithContext(ctx).Order("asn").Find(&policies).Error
+	return policies, err
+}
+
+func (r *asnPolicyRepository) GetByASN(ctx context.Context, asn uint32) (*models.ASNProtocolPolicy, error) {
+	var policy models.ASNProtocolPolicy
+	err := r.db.WithContext(ctx).Where("asn = ?", asn).First(&policy).Error
+	if err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// Save creates the policy of an ASN or replaces the existing one
+func (r *asnPolicyRepository) Save(ctx context.Context, policy *models.ASNProtocolPolicy) error {
+	return r.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "asn"}},
+		DoUpdates: clause.AssignmentColumns([]string{"name", "protocols", "updated_at"}),
+	}).Create(policy).Error
+}
+
+func (r *asnPolicyRepository) Delete(ctx context.Context, asn uint32) error {
+	result := r.db.WithContext(ctx).Delete(&models.ASNProtocolPolicy{}, "asn = ?", asn)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
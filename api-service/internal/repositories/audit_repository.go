@@ -0,0 +1,49 @@
+package repositories
+
+import (
+	"context"
+
+	"hysteria2_microservices/api-service/internal/models"
+	repoInterfaces "hysteria2_microservices/api-service/internal/repositories/interfaces"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type auditRepository struct {
+	db *gorm.DB
+}
+
+func NewAuditRepository(db *gorm.DB) repoInterfaces.AuditRepository {
+	return &auditRepository{db: db}
+}
+
+// Create stores the event unless one with its ID is stored already
+func (r *auditRepository) Create(ctx context.Context, event *models.AuditEvent) error {
+	return r.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(event).Error
+}
+
+// List returns a page of the events filter matches, newest first, and their total
+func (r *auditRepository) List(ctx context.Context, filter models.AuditFilter, offset, limit int) ([]*models.AuditEvent, int64, error) {
+	query := r.db.WithContext(ctx).Model(&models.AuditEvent{})
+	if filter.Source != "" {
+		query = query.Where("source = ?", filter.Source)
+	}
+	if filter.Actor != "" {
+		query = query.Where("actor = ?", filter.Actor)
+	}
+	if filter.Action != "" {
+		query = query.Where("action = ?", filter.Action)
+	}
+
+	var events []*models.AuditEvent
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	err := query.Offset(offset).Limit(limit).Order("occurred_at DESC").Find(&events).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	return events, total, nil
+}
@@ -0,0 +1,76 @@
+package repositories
+
+import (
+	"context"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/models"
+	repoInterfaces "hysteria2_microservices/api-service/internal/repositories/interfaces"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type connectionLogRepository struct {
+	db *gorm.DB
+}
+
+func NewConnectionLogRepository(db *gorm.DB) repoInterfaces.ConnectionLogRepository {
+	return &connectionLogRepository{db: db}
+}
+
+func (r *connectionLogRepository) Create(ctx context.Context, log *models.ConnectionLog) error {
+	return r.db.WithContext(ctx).Create(log).Error
+}
+
+// GetOpen returns the client's session on the node that has not ended yet
+func (r *connectionLogRepository) GetOpen(ctx context.Context, nodeID uuid.UUID, clientID string) (*models.ConnectionLog, error) {
+	var log models.ConnectionLog
+	err := r.db.WithContext(ctx).
+		Where("node_id = ? AND client_id = ? AND disconnected_at IS NULL", nodeID, clientID).
+		Order("connected_at DESC").
+		First(&log).Error
+	if err != nil {
+		return nil, err
+	}
+	return &log, nil
+}
+
+func (r *connectionLogRepository) Update(ctx context.Context, log *models.ConnectionLog) error {
+	return r.db.WithContext(ctx).Save(log).Error
+}
+
+// CloseOpenExcept ends the node's open sessions of every client but clientIDs at at
+func (r *connectionLogRepository) CloseOpenExcept(ctx context.Context, nodeID uuid.UUID, clientIDs []string, at time.Time) (int64, error) {
+	query := r.db.WithContext(ctx).Model(&models.ConnectionLog{}).
+		Where("node_id = ? AND disconnected_at IS NULL", nodeID)
+	if len(clientIDs) > 0 {
+		query = query.Where("client_id NOT IN ?", clientIDs)
+	}
+	result := query.Update("disconnected_at", at)
+	return result.RowsAffected, result.Error
+}
+
+func (r *connectionLogRepository) ListByUser(ctx context.Context, userID uuid.UUID, offset, limit int) ([]*models.ConnectionLog, int64, error) {
+	return r.list(r.db.WithContext(ctx).Model(&models.ConnectionLog{}).Where("user_id = ?", userID), offset, limit)
+}
+
+func (r *connectionLogRepository) ListByNode(ctx context.Context, nodeID uuid.UUID, offset, limit int) ([]*models.ConnectionLog, int64, error) {
+	return r.list(r.db.WithContext(ctx).Model(&models.ConnectionLog{}).Where("node_id = ?", nodeID), offset, limit)
+}
+
+// list returns a page of the sessions query matches, newest first, and their total
+func (r *connectionLogRepository) list(query *gorm.DB, offset, limit int) ([]*models.ConnectionLog, int64, error) {
+	var logs []*models.ConnectionLog
+	var total int64
+
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	err := query.Offset(offset).Limit(limit).Order("connected_at DESC").Find(&logs).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	return logs, total, nil
+}
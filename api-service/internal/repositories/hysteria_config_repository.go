@@ -0,0 +1,110 @@
+package repositories
+
+import (
+	"context"
+
+	"hysteria2_microservices/api-service/internal/models"
+	repoInterfaces "hysteria2_microservices/api-service/internal/repositories/interfaces"
+	"hysteria2_microservices/api-service/pkg/logger"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type HysteriaConfigRepositoryImpl struct {
+	db     *gorm.DB
+	logger *logger.Logger
+}
+
+func NewHysteriaConfigRepository(db *gorm.DB, logger *logger.Logger) repoInterfaces.HysteriaConfigRepository {
+	return &HysteriaConfigRepositoryImpl{
+		db:     db,
+		logger: logger,
+	}
+}
+
+func (r *HysteriaConfigRepositoryImpl) Create(ctx context.Context, config *models.HysteriaConfig) error {
+	r.logger.Infof("Creating Hysteria config for user %s", config.UserID)
+
+	if err := r.db.WithContext(ctx).Create(config).Error; err != nil {
+		r.logger.Errorf("Failed to create Hysteria config: %v", err)
+		return err
+	}
+
+	r.logger.Infof("Hysteria config created successfully: %s", config.ID)
+	return nil
+}
+
+func (r *HysteriaConfigRepositoryImpl) GetByUserID(ctx context.Context, userID uuid.UUID) ([]*models.HysteriaConfig, error) {
+	r.logger.Infof("Getting Hysteria configs for user %s", userID)
+
+	var configs []*models.HysteriaConfig
+	if err := r.db.WithContext(ctx).
+		Where("user_id = ?", userID).
+		Preload("User").
+		Preload("Device").
+		Find(&configs).Error; err != nil {
+		r.logger.Errorf("Failed to get Hysteria configs for user %s: %v", userID, err)
+		return nil, err
+	}
+
+	return configs, nil
+}
+
+func (r *HysteriaConfigRepositoryImpl) GetActiveByUserID(ctx context.Context, userID uuid.UUID) ([]*models.HysteriaConfig, error) {
+	r.logger.Infof("Getting active Hysteria configs for user %s", userID)
+
+	var configs []*models.HysteriaConfig
+	if err := r.db.WithContext(ctx).
+		Where("user_id = ? AND is_active = ?", userID, true).
+		Preload("User").
+		Preload("Device").
+		Find(&configs).Error; err != nil {
+		r.logger.Errorf("Failed to get active Hysteria configs for user %s: %v", userID, err)
+		return nil, err
+	}
+
+	return configs, nil
+}
+
+func (r *HysteriaConfigRepositoryImpl) Update(ctx context.Context, config *models.HysteriaConfig) error {
+	r.logger.Infof("Updating Hysteria config %s", config.ID)
+
+	if err := r.db.WithContext(ctx).Save(config).Error; err != nil {
+		r.logger.Errorf("Failed to update Hysteria config %s: %v", config.ID, err)
+		return err
+	}
+
+	r.logger.Infof("Hysteria config updated successfully: %s", config.ID)
+	return nil
+}
+
+func (r *HysteriaConfigRepositoryImpl) Delete(ctx context.Context, id uuid.UUID) error {
+	r.logger.Infof("Deleting Hysteria config %s", id)
+
+	if err := r.db.WithContext(ctx).Delete(&models.HysteriaConfig{}, id).Error; err != nil {
+		r.logger.Errorf("Failed to delete Hysteria config %s: %v", id, err)
+		return err
+	}
+
+	r.logger.Infof("Hysteria config deleted successfully: %s", id)
+	return nil
+}
+
+func (r *HysteriaConfigRepositoryImpl) SetActive(ctx context.Context, userID uuid.UUID, deviceID *uuid.UUID, active bool) error {
+	r.logger.Infof("Setting Hysteria configs active status for user %s, device %v, active: %v", userID, deviceID, active)
+
+	query := r.db.WithContext(ctx).Model(&models.HysteriaConfig{}).Where("user_id = ?", userID)
+
+	if deviceID != nil {
+		query = query.Where("device_id = ?", *deviceID)
+	}
+
+	if err := query.Update("is_active", active).Error; err != nil {
+		r.logger.Errorf("Failed to update active status for Hysteria configs: %v", err)
+		return err
+	}
+
+	r.logger.Info("Hysteria config active status updated successfully")
+	return nil
+}
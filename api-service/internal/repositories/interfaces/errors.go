@@ -0,0 +1,11 @@
+package interfaces
+
+import "errors"
+
+var (
+	// ErrVoucherUnavailable is returned when a voucher is revoked, expired or has no uses
+	// left at the time a redemption claims it
+	ErrVoucherUnavailable = errors.New("voucher is no longer available")
+	// ErrQuotaExceeded is returned when a user would take a reseller over their quota
+	ErrQuotaExceeded = errors.New("reseller quota exceeded")
+)
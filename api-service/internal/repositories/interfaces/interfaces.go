@@ -18,6 +18,12 @@ type UserRepository interface {
 	List(ctx context.Context, offset, limit int, search string, status, role string) ([]*models.User, int64, error)
 	UpdateLastLogin(ctx context.Context, id uuid.UUID) error
 	UpdateDataUsage(ctx context.Context, id uuid.UUID, dataUsed int64) error
+	GetByIDs(ctx context.Context, ids []uuid.UUID) ([]*models.User, error)
+	// ListNearDataLimit returns the active users with a data limit who used at least ratio
+	// of it
+	ListNearDataLimit(ctx context.Context, ratio float64) ([]*models.User, error)
+	// ListExpiring returns the active users whose expiry date is in [from, to)
+	ListExpiring(ctx context.Context, from, to time.Time) ([]*models.User, error)
 }
 
 type DeviceRepository interface {
@@ -46,8 +52,129 @@ type TrafficRepository interface {
 	GetByUserID(ctx context.Context, userID uuid.UUID, from, to time.Time) ([]*models.TrafficStats, error)
 	GetByDeviceID(ctx context.Context, deviceID uuid.UUID, from, to time.Time) ([]*models.TrafficStats, error)
 	GetSummary(ctx context.Context, from, to time.Time) (*models.TrafficSummary, error)
+	GetUserDeviceTraffic(ctx context.Context, userID uuid.UUID, from, to time.Time) ([]models.DeviceTrafficRank, error)
 	UpdateUserTraffic(ctx context.Context, userID uuid.UUID, upload, download int64) error
 	UpdateDeviceTraffic(ctx context.Context, deviceID uuid.UUID, upload, download int64) error
+	CopySamples(ctx context.Context, samples []models.TrafficSample) error
+}
+
+type RetentionRepository interface {
+	EnsurePartitions(ctx context.Context, table string, monthsAhead int) (int, error)
+	DropPartitionsBefore(ctx context.Context, table string, cutoff time.Time) (int, error)
+	RollupHourlyTraffic(ctx context.Context, from, to time.Time) (int64, error)
+	DeleteRawTrafficBefore(ctx context.Context, cutoff time.Time) (int64, error)
+	DeleteHourlyTrafficBefore(ctx context.Context, cutoff time.Time) (int64, error)
+	DeleteNodeMetricsBefore(ctx context.Context, cutoff time.Time) (int64, error)
+	DeleteConnectionLogsBefore(ctx context.Context, cutoff time.Time) (int64, error)
+	DeleteClientTelemetryBefore(ctx context.Context, cutoff time.Time) (int64, error)
+}
+
+type ConnectionLogRepository interface {
+	Create(ctx context.Context, log *models.ConnectionLog) error
+	GetOpen(ctx context.Context, nodeID uuid.UUID, clientID string) (*models.ConnectionLog, error)
+	Update(ctx context.Context, log *models.ConnectionLog) error
+	CloseOpenExcept(ctx context.Context, nodeID uuid.UUID, clientIDs []string, at time.Time) (int64, error)
+	ListByUser(ctx context.Context, userID uuid.UUID, offset, limit int) ([]*models.ConnectionLog, int64, error)
+	ListByNode(ctx context.Context, nodeID uuid.UUID, offset, limit int) ([]*models.ConnectionLog, int64, error)
+}
+
+type TelemetryRepository interface {
+	CreateBatch(ctx context.Context, events []*models.ClientTelemetry) error
+	GetNodeReliability(ctx context.Context, filter models.TelemetryFilter, since time.Time) ([]*models.NodeReliability, error)
+	GetReachability(ctx context.Context, since time.Time) ([]*models.ProtocolReachability, error)
+	GetProbeSummaries(ctx context.Context, since time.Time) ([]*models.ASNProbeSummary, error)
+}
+
+type ASNPolicyRepository interface {
+	List(ctx context.Context) ([]*models.ASNProtocolPolicy, error)
+	GetByASN(ctx context.Context, asn uint32) (*models.ASNProtocolPolicy, error)
+	Save(ctx context.Context, policy *models.ASNProtocolPolicy) error
+	Delete(ctx context.Context, asn uint32) error
+}
+
+type AuditRepository interface {
+	Create(ctx context.Context, event *models.AuditEvent) error
+	List(ctx context.Context, filter models.AuditFilter, offset, limit int) ([]*models.AuditEvent, int64, error)
+}
+
+type PrivacyRepository interface {
+	ExportUser(ctx context.Context, userID uuid.UUID) (*models.UserDataExport, error)
+	DeleteUser(ctx context.Context, userID uuid.UUID) (map[string]int64, error)
+	AnonymizeUser(ctx context.Context, userID uuid.UUID) (map[string]int64, error)
+	CreateErasure(ctx context.Context, erasure *models.DataErasure) error
+	GetErasure(ctx context.Context, id uuid.UUID) (*models.DataErasure, error)
+	ListErasures(ctx context.Context, offset, limit int) ([]*models.DataErasure, int64, error)
+	HasOpenErasure(ctx context.Context, userID uuid.UUID) (bool, error)
+	ListRunnable(ctx context.Context, staleBefore time.Time, limit int) ([]*models.DataErasure, error)
+	ClaimErasure(ctx context.Context, erasure *models.DataErasure, startedAt time.Time) (bool, error)
+	FinishErasure(ctx context.Context, erasure *models.DataErasure) error
+}
+
+type JWTKeyRepository interface {
+	List(ctx context.Context) ([]*models.JWTSigningKey, error)
+	Rotate(ctx context.Context, key *models.JWTSigningKey, expiresAt time.Time) error
+	DeleteExpired(ctx context.Context) (int64, error)
+}
+
+type VoucherRepository interface {
+	CreateBatch(ctx context.Context, vouchers []*models.Voucher) error
+	GetByID(ctx context.Context, id uuid.UUID) (*models.Voucher, error)
+	GetByCode(ctx context.Context, code string) (*models.Voucher, error)
+	List(ctx context.Context, offset, limit int) ([]*models.Voucher, int64, error)
+	Revoke(ctx context.Context, id uuid.UUID) error
+	HasRedemption(ctx context.Context, voucherID uuid.UUID, deviceFingerprint string) (bool, error)
+	HasTrialRedemption(ctx context.Context, deviceFingerprint string) (bool, error)
+	Redeem(ctx context.Context, voucherID uuid.UUID, user *models.User, redemption *models.VoucherRedemption) error
+}
+
+type ResellerRepository interface {
+	Create(ctx context.Context, reseller *models.Reseller) error
+	GetByUserID(ctx context.Context, userID uuid.UUID) (*models.Reseller, error)
+	List(ctx context.Context, offset, limit int) ([]*models.Reseller, int64, error)
+	Update(ctx context.Context, reseller *models.Reseller) error
+	Delete(ctx context.Context, userID uuid.UUID) error
+	GetUsage(ctx context.Context, resellerID uuid.UUID) (*models.ResellerUsage, error)
+	ListUsers(ctx context.Context, resellerID uuid.UUID, offset, limit int, search, status string) ([]*models.User, int64, error)
+	GetUser(ctx context.Context, resellerID, userID uuid.UUID) (*models.User, error)
+	CreateUser(ctx context.Context, resellerID uuid.UUID, user *models.User) error
+	UpdateUser(ctx context.Context, resellerID uuid.UUID, user *models.User) error
+	DeleteUser(ctx context.Context, resellerID, userID uuid.UUID) error
+	GetUserTraffic(ctx context.Context, resellerID uuid.UUID, from, to time.Time) ([]models.UserTrafficRank, error)
+}
+
+type ReportScheduleRepository interface {
+	Create(ctx context.Context, schedule *models.ReportSchedule) error
+	GetByID(ctx context.Context, id uuid.UUID) (*models.ReportSchedule, error)
+	List(ctx context.Context, offset, limit int) ([]*models.ReportSchedule, int64, error)
+	Update(ctx context.Context, schedule *models.ReportSchedule) error
+	Delete(ctx context.Context, id uuid.UUID) error
+	ListDue(ctx context.Context, now time.Time, limit int) ([]*models.ReportSchedule, error)
+	Claim(ctx context.Context, schedule *models.ReportSchedule, nextRunAt time.Time) (bool, error)
+	RecordRun(ctx context.Context, id uuid.UUID, ranAt time.Time, runErr string) error
+}
+
+type UserIdentityRepository interface {
+	GetBySubject(ctx context.Context, issuer, subject string) (*models.UserIdentity, error)
+	ListByIssuer(ctx context.Context, issuer string) ([]*models.UserIdentity, error)
+	Link(ctx context.Context, user *models.User, identity *models.UserIdentity) error
+	RecordLogin(ctx context.Context, id uuid.UUID, email string, at time.Time) error
+}
+
+type AllowedNetworkRepository interface {
+	List(ctx context.Context) ([]*models.AllowedNetwork, error)
+	Create(ctx context.Context, network *models.AllowedNetwork) error
+	GetByID(ctx context.Context, id uuid.UUID) (*models.AllowedNetwork, error)
+	Delete(ctx context.Context, id uuid.UUID) error
+}
+
+type PortForwardRepository interface {
+	Create(ctx context.Context, forward *models.PortForward) error
+	GetByID(ctx context.Context, id uuid.UUID) (*models.PortForward, error)
+	ListByUserID(ctx context.Context, userID uuid.UUID) ([]*models.PortForward, error)
+	List(ctx context.Context, nodeID *uuid.UUID) ([]*models.PortForward, error)
+	CountByUserID(ctx context.Context, userID uuid.UUID) (int64, error)
+	PortTaken(ctx context.Context, nodeID uuid.UUID, protocol string, port int) (bool, error)
+	Delete(ctx context.Context, id uuid.UUID) error
 }
 
 type HysteriaConfigRepository interface {
@@ -76,4 +203,11 @@ type NodeRepository interface {
 	List(ctx context.Context, page, limit int, statusFilter, locationFilter string) ([]*models.VPSNode, int64, error)
 	GetOnlineNodes(ctx context.Context) ([]*models.VPSNode, error)
 	UpdateStatus(ctx context.Context, id uuid.UUID, status string) error
+	GetMetricsByNodeIDs(ctx context.Context, nodeIDs []uuid.UUID, limit int) ([]*models.NodeMetric, error)
+	GetAssignmentsByNodeIDs(ctx context.Context, nodeIDs []uuid.UUID) ([]*models.NodeAssignment, error)
+	GetAssignedNodes(ctx context.Context, userID uuid.UUID) ([]*models.VPSNode, error)
+	SetAssignedNodes(ctx context.Context, userID uuid.UUID, nodeIDs []uuid.UUID) error
+	CountActiveUsersByNodeIDs(ctx context.Context, nodeIDs []uuid.UUID) (map[uuid.UUID]int, error)
+	GetDeploymentsByNodeIDs(ctx context.Context, nodeIDs []uuid.UUID) ([]*models.Deployment, error)
+	GetRegionLatencies(ctx context.Context, region string, since time.Time) ([]*models.RegionLatency, error)
 }
@@ -0,0 +1,47 @@
+package repositories
+
+import (
+	"context"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/models"
+	repoInterfaces "hysteria2_microservices/api-service/internal/repositories/interfaces"
+
+	"gorm.io/gorm"
+)
+
+type jwtKeyRepository struct {
+	db *gorm.DB
+}
+
+func NewJWTKeyRepository(db *gorm.DB) repoInterfaces.JWTKeyRepository {
+	return &jwtKeyRepository{db: db}
+}
+
+// List returns the keys that still validate tokens, newest first
+func (r *jwtKeyRepository) List(ctx context.Context) ([]*models.JWTSigningKey, error) {
+	var keys []*models.JWTSigningKey
+	err := r.db.WithContext(ctx).
+		Where("expires_at IS NULL OR expires_at > NOW()").
+		Order("created_at DESC").
+		Find(&keys).Error
+	return keys, err
+}
+
+// Rotate retires the active keys, keeping them until expiresAt, and adds key as the new
+// signing key
+func (r *jwtKeyRepository) Rotate(ctx context.Context, key *models.JWTSigningKey, expiresAt time.Time) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.JWTSigningKey{}).
+			Where("retired_at IS NULL").
+			Updates(map[string]interface{}{"retired_at": time.Now(), "expires_at": expiresAt}).Error; err != nil {
+			return err
+		}
+		return tx.Create(key).Error
+	})
+}
+
+func (r *jwtKeyRepository) DeleteExpired(ctx context.Context) (int64, error) {
+	result := r.db.WithContext(ctx).Where("expires_at <= NOW()").Delete(&models.JWTSigningKey{})
+	return result.RowsAffected, result.Error
+}
@@ -4,9 +4,11 @@ import (
 	"context"
 	"hysteria2_microservices/api-service/internal/models"
 	"hysteria2_microservices/api-service/internal/repositories/interfaces"
+	"time"
 
 	"github.com/google/uuid"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type nodeRepository struct {
@@ -74,3 +76,96 @@ func (r *nodeRepository) GetOnlineNodes(ctx context.Context) ([]*models.VPSNode,
 func (r *nodeRepository) UpdateStatus(ctx context.Context, id uuid.UUID, status string) error {
 	return r.db.WithContext(ctx).Model(&models.VPSNode{}).Where("id = ?", id).Update("status", status).Error
 }
+
+// GetMetricsByNodeIDs returns up to limit most recent metrics per node
+func (r *nodeRepository) GetMetricsByNodeIDs(ctx context.Context, nodeIDs []uuid.UUID, limit int) ([]*models.NodeMetric, error) {
+	var metrics []*models.NodeMetric
+	err := r.db.WithContext(ctx).Raw(`
+		SELECT * FROM (
+			SELECT node_metrics.*, ROW_NUMBER() OVER (PARTITION BY node_id ORDER BY recorded_at DESC) AS rn
+			FROM node_metrics WHERE node_id IN ?
+		) ranked WHERE rn <= ? ORDER BY node_id, recorded_at DESC`, nodeIDs, limit).
+		Scan(&metrics).Error
+	return metrics, err
+}
+
+func (r *nodeRepository) GetAssignmentsByNodeIDs(ctx context.Context, nodeIDs []uuid.UUID) ([]*models.NodeAssignment, error) {
+	var assignments []*models.NodeAssignment
+	err := r.db.WithContext(ctx).Where("node_id IN ?", nodeIDs).Order("assigned_at DESC").Find(&assignments).Error
+	return assignments, err
+}
+
+// GetAssignedNodes returns the nodes the user has an active assignment on, regardless of node status
+func (r *nodeRepository) GetAssignedNodes(ctx context.Context, userID uuid.UUID) ([]*models.VPSNode, error) {
+	var nodes []*models.VPSNode
+	err := r.db.WithContext(ctx).
+		Joins("JOIN node_assignments ON node_assignments.node_id = vps_nodes.id").
+		Where("node_assignments.user_id = ? AND node_assignments.is_active = ?", userID, true).
+		Find(&nodes).Error
+	return nodes, err
+}
+
+// SetAssignedNodes makes nodeIDs the user's active assignments, deactivating the others
+func (r *nodeRepository) SetAssignedNodes(ctx context.Context, userID uuid.UUID, nodeIDs []uuid.UUID) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		deactivate := tx.Model(&models.NodeAssignment{}).Where("user_id = ?", userID)
+		if len(nodeIDs) > 0 {
+			deactivate = deactivate.Where("node_id NOT IN ?", nodeIDs)
+		}
+		if err := deactivate.Update("is_active", false).Error; err != nil {
+			return err
+		}
+		for _, nodeID := range nodeIDs {
+			assignment := &models.NodeAssignment{UserID: userID, NodeID: nodeID, IsActive: true}
+			err := tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "user_id"}, {Name: "node_id"}},
+				DoUpdates: clause.Assignments(map[string]interface{}{"is_active": true}),
+			}).Create(assignment).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// CountActiveUsersByNodeIDs counts the active users with an active assignment on each node
+func (r *nodeRepository) CountActiveUsersByNodeIDs(ctx context.Context, nodeIDs []uuid.UUID) (map[uuid.UUID]int, error) {
+	var rows []struct {
+		NodeID uuid.UUID
+		Users  int
+	}
+	err := r.db.WithContext(ctx).Model(&models.NodeAssignment{}).
+		Select("node_assignments.node_id, COUNT(DISTINCT node_assignments.user_id) AS users").
+		Joins("JOIN users ON users.id = node_assignments.user_id").
+		Where("node_assignments.node_id IN ? AND node_assignments.is_active = ? AND users.status = ?", nodeIDs, true, "active").
+		Group("node_assignments.node_id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[uuid.UUID]int, len(rows))
+	for _, row := range rows {
+		counts[row.NodeID] = row.Users
+	}
+	return counts, nil
+}
+
+func (r *nodeRepository) GetDeploymentsByNodeIDs(ctx context.Context, nodeIDs []uuid.UUID) ([]*models.Deployment, error) {
+	var deployments []*models.Deployment
+	err := r.db.WithContext(ctx).Where("node_id IN ?", nodeIDs).Order("deployed_at DESC NULLS LAST").Find(&deployments).Error
+	return deployments, err
+}
+
+// GetRegionLatencies averages the successful speedtests each node ran against the region's
+// reflectors since the given time. The orchestrator writes node_speedtests.
+func (r *nodeRepository) GetRegionLatencies(ctx context.Context, region string, since time.Time) ([]*models.RegionLatency, error) {
+	var latencies []*models.RegionLatency
+	err := r.db.WithContext(ctx).Table("node_speedtests").
+		Select("node_id, AVG(latency_ms) AS avg_latency_ms, AVG(download_mbps) AS avg_download_mbps, COUNT(*) AS samples").
+		Where("region = ? AND measured_at > ? AND error = ''", region, since).
+		Group("node_id").
+		Scan(&latencies).Error
+	return latencies, err
+}
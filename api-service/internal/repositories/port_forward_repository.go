@@ -0,0 +1,74 @@
+package repositories
+
+import (
+	"context"
+
+	"hysteria2_microservices/api-service/internal/models"
+	repoInterfaces "hysteria2_microservices/api-service/internal/repositories/interfaces"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type portForwardRepository struct {
+	db *gorm.DB
+}
+
+func NewPortForwardRepository(db *gorm.DB) repoInterfaces.PortForwardRepository {
+	return &portForwardRepository{db: db}
+}
+
+func (r *portForwardRepository) Create(ctx context.Context, forward *models.PortForward) error {
+	return r.db.WithContext(ctx).Create(forward).Error
+}
+
+func (r *portForwardRepository) GetByID(ctx context.Context, id uuid.UUID) (*models.PortForward, error) {
+	var forward models.PortForward
+	err := r.db.WithContext(ctx).Where("id = ?", id).First(&forward).Error
+	if err != nil {
+		return nil, err
+	}
+	return &forward, nil
+}
+
+func (r *portForwardRepository) ListByUserID(ctx context.Context, userID uuid.UUID) ([]*models.PortForward, error) {
+	var forwards []*models.PortForward
+	err := r.db.WithContext(ctx).Where("user_id = ?", userID).Order("created_at").Find(&forwards).Error
+	return forwards, err
+}
+
+func (r *portForwardRepository) List(ctx context.Context, nodeID *uuid.UUID) ([]*models.PortForward, error) {
+	query := r.db.WithContext(ctx).Order("node_id, listen_port, protocol")
+	if nodeID != nil {
+		query = query.Where("node_id = ?", *nodeID)
+	}
+	var forwards []*models.PortForward
+	err := query.Find(&forwards).Error
+	return forwards, err
+}
+
+func (r *portForwardRepository) CountByUserID(ctx context.Context, userID uuid.UUID) (int64, error) {
+	var count int64
+	err := r.db.WithContext(ctx).Model(&models.PortForward{}).Where("user_id = ?", userID).Count(&count).Error
+	return count, err
+}
+
+// PortTaken reports whether the node already forwards the port for the protocol
+func (r *portForwardRepository) PortTaken(ctx context.Context, nodeID uuid.UUID, protocol string, port int) (bool, error) {
+	var count int64
+	err := r.db.WithContext(ctx).Model(&models.PortForward{}).
+		Where("node_id = ? AND protocol = ? AND listen_port = ?", nodeID, protocol, port).
+		Count(&count).Error
+	return count > 0, err
+}
+
+func (r *portForwardRepository) Delete(ctx context.Context, id uuid.UUID) error {
+	result := r.db.WithContext(ctx).Delete(&models.PortForward{}, "id = ?", id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package repositories
+
+import (
+	"context"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/models"
+	repoInterfaces "hysteria2_microservices/api-service/internal/repositories/interfaces"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// erasureStep is one statement of an erasure; the rows it affects are counted under table
+type erasureStep struct {
+	table string
+	query string
+}
+
+// Statements shared by both erasure modes: credentials, logins and links to other accounts
+// go, and the rows other users own stop pointing at the user. Every query takes the user ID
+// as its only parameter.
+var erasureCommonSteps = []erasureStep{
+	{"sessions", "DELETE FROM sessions WHERE user_id = @user"},
+	{"hysteria_configs", "DELETE FROM hysteria_configs WHERE user_id = @user"},
+	{"xray_configs", "DELETE FROM xray_configs WHERE user_id = @user"},
+	{"user_identities", "DELETE FROM user_identities WHERE user_id = @user"},
+	{"node_assignments", "DELETE FROM node_assignments WHERE user_id = @user"},
+	{"report_schedules", "DELETE FROM report_schedules WHERE scope IN ('user', 'tenant') AND subject_id = @user"},
+	{"report_schedules", "UPDATE report_schedules SET created_by = NULL WHERE created_by = @user"},
+	{"vouchers", "UPDATE vouchers SET created_by = NULL WHERE created_by = @user"},
+	{"allowed_networks", "UPDATE allowed_networks SET created_by = NULL WHERE created_by = @user"},
+	{"data_erasures", "UPDATE data_erasures SET requested_by = NULL WHERE requested_by = @user AND user_id <> @user"},
+	{"reseller_users", "UPDATE users SET reseller_id = NULL WHERE reseller_id = @user"},
+	{"resellers", "DELETE FROM resellers WHERE user_id = @user"},
+}
+
+var erasureDeleteSteps = []erasureStep{
+	{"traffic_stats", "DELETE FROM traffic_stats WHERE user_id = @user"},
+	{"traffic_stats_hourly", "DELETE FROM traffic_stats_hourly WHERE user_id = @user"},
+	{"connection_logs", "DELETE FROM connection_logs WHERE user_id = @user"},
+	{"voucher_redemptions", "DELETE FROM voucher_redemptions WHERE user_id = @user"},
+	{"devices", "DELETE FROM devices WHERE user_id = @user"},
+	{"users", "DELETE FROM users WHERE id = @user"},
+}
+
+// Anonymizing keeps traffic and sessions for accounting, tied to devices and an account
+// that no longer say whose they are
+var erasureAnonymizeSteps = []erasureStep{
+	{"connection_logs", "UPDATE connection_logs SET device_id = '', client_id = user_id::text WHERE user_id = @user"},
+	{"voucher_redemptions", "UPDATE voucher_redemptions SET ip_address = '', device_fingerprint = 'erased-' || id WHERE user_id = @user"},
+	{"devices", `UPDATE devices SET name = 'erased', device_id = 'erased-' || id, public_key = '', ip_address = NULL,
+		status = 'inactive', last_seen = NULL WHERE user_id = @user`},
+	{"users", `UPDATE users SET username = 'erased-' || id, email = 'erased-' || id || '@invalid', password = '',
+		full_name = NULL, notes = NULL, user_group = '', last_login = NULL, status = 'deleted', updated_at = NOW()
+		WHERE id = @user`},
+}
+
+type privacyRepository struct {
+	db *gorm.DB
+}
+
+func NewPrivacyRepository(db *gorm.DB) repoInterfaces.PrivacyRepository {
+	return &privacyRepository{db: db}
+}
+
+// ExportUser collects everything stored about a user
+func (r *privacyRepository) ExportUser(ctx context.Context, userID uuid.UUID) (*models.UserDataExport, error) {
+	db := r.db.WithContext(ctx)
+	export := &models.UserDataExport{
+		ExportedAt:         time.Now().UTC(),
+		Devices:            []models.Device{},
+		Sessions:           []models.Session{},
+		Identities:         []models.UserIdentity{},
+		VoucherRedemptions: []models.VoucherRedemption{},
+		ConnectionLog:      []models.ConnectionLog{},
+		Traffic:            []models.DailyTraffic{},
+	}
+
+	var user models.User
+	if err := db.Where("id = ?", userID).First(&user).Error; err != nil {
+		return nil, err
+	}
+	export.User = &user
+
+	if err := db.Where("user_id = ?", userID).Order("created_at").Find(&export.Devices).Error; err != nil {
+		return nil, err
+	}
+	if err := db.Where("user_id = ?", userID).Order("created_at").Find(&export.Sessions).Error; err != nil {
+		return nil, err
+	}
+	if err := db.Where("user_id = ?", userID).Order("created_at").Find(&export.Identities).Error; err != nil {
+		return nil, err
+	}
+	if err := db.Where("user_id = ?", userID).Order("created_at").Find(&export.VoucherRedemptions).Error; err != nil {
+		return nil, err
+	}
+	if err := db.Where("user_id = ?", userID).Order("connected_at").Find(&export.ConnectionLog).Error; err != nil {
+		return nil, err
+	}
+
+	// Hourly aggregates cover the traffic rolled up so far, raw samples the hours after
+	err := db.Raw(`
+		SELECT day, SUM(upload) AS upload, SUM(download) AS download, SUM(total) AS total
+		FROM (
+			SELECT date_trunc('day', bucket AT TIME ZONE 'UTC') AS day, upload, download, total
+			FROM traffic_stats_hourly WHERE user_id = @user
+			UNION ALL
+			SELECT date_trunc('day', recorded_at AT TIME ZONE 'UTC'), upload, download, upload + download
+			FROM traffic_stats
+			WHERE user_id = @user AND recorded_at >= COALESCE(
+				(SELECT MAX(bucket) + INTERVAL '1 hour' FROM traffic_stats_hourly WHERE user_id = @user), '-infinity')
+		) traffic
+		GROUP BY day ORDER BY day`,
+		map[string]interface{}{"user": userID}).Scan(&export.Traffic).Error
+	if err != nil {
+		return nil, err
+	}
+	return export, nil
+}
+
+// DeleteUser removes the user and every row about them, and returns the rows affected by
+// table
+func (r *privacyRepository) DeleteUser(ctx context.Context, userID uuid.UUID) (map[string]int64, error) {
+	return r.erase(ctx, userID, erasureDeleteSteps)
+}
+
+// AnonymizeUser strips the user's account and devices of everything identifying them and
+// returns the rows affected by table
+func (r *privacyRepository) AnonymizeUser(ctx context.Context, userID uuid.UUID) (map[string]int64, error) {
+	return r.erase(ctx, userID, erasureAnonymizeSteps)
+}
+
+func (r *privacyRepository) erase(ctx context.Context, userID uuid.UUID, steps []erasureStep) (map[string]int64, error) {
+	records := map[string]int64{}
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, step := range append(append([]erasureStep{}, erasureCommonSteps...), steps...) {
+			result := tx.Exec(step.query, map[string]interface{}{"user": userID})
+			if result.Error != nil {
+				return result.Error
+			}
+			records[step.table] += result.RowsAffected
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func (r *privacyRepository) CreateErasure(ctx context.Context, erasure *models.DataErasure) error {
+	return r.db.WithContext(ctx).Create(erasure).Error
+}
+
+func (r *privacyRepository) GetErasure(ctx context.Context, id uuid.UUID) (*models.DataErasure, error) {
+	var erasure models.DataErasure
+	err := r.db.WithContext(ctx).Where("id = ?", id).First(&erasure).Error
+	if err != nil {
+		return nil, err
+	}
+	return &erasure, nil
+}
+
+func (r *privacyRepository) ListErasures(ctx context.Context, offset, limit int) ([]*models.DataErasure, int64, error) {
+	var erasures []*models.DataErasure
+	var total int64
+
+	query := r.db.WithContext(ctx).Model(&models.DataErasure{})
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	err := query.Offset(offset).Limit(limit).Order("created_at DESC").Find(&erasures).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	return erasures, total, nil
+}
+
+// HasOpenErasure reports whether an erasure of the user has not completed yet
+func (r *privacyRepository) HasOpenErasure(ctx context.Context, userID uuid.UUID) (bool, error) {
+	var count int64
+	err := r.db.WithContext(ctx).Model(&models.DataErasure{}).
+		Where("user_id = ? AND status <> ?", userID, models.ErasureCompleted).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// ListRunnable returns the pending erasures, the ones an instance started before staleBefore
+// without finishing and the ones that failed before it, oldest first
+func (r *privacyRepository) ListRunnable(ctx context.Context, staleBefore time.Time, limit int) ([]*models.DataErasure, error) {
+	var erasures []*models.DataErasure
+	err := r.db.WithContext(ctx).
+		Where("status = ? OR (status = ? AND started_at < ?) OR (status = ? AND completed_at < ?)",
+			models.ErasurePending, models.ErasureRunning, staleBefore, models.ErasureFailed, staleBefore).
+		Order("created_at").
+		Limit(limit).
+		Find(&erasures).Error
+	return erasures, err
+}
+
+// ClaimErasure marks an erasure running unless another instance did so first, and reports
+// whether this caller got it
+func (r *privacyRepository) ClaimErasure(ctx context.Context, erasure *models.DataErasure, startedAt time.Time) (bool, error) {
+	query := r.db.WithContext(ctx).Model(&models.DataErasure{}).Where("id = ? AND status = ?", erasure.ID, erasure.Status)
+	if erasure.StartedAt == nil {
+		query = query.Where("started_at IS NULL")
+	} else {
+		query = query.Where("started_at = ?", *erasure.StartedAt)
+	}
+
+	result := query.Updates(map[string]interface{}{
+		"status":     models.ErasureRunning,
+		"started_at": startedAt,
+	})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// FinishErasure records the outcome of a claimed erasure
+func (r *privacyRepository) FinishErasure(ctx context.Context, erasure *models.DataErasure) error {
+	return r.db.WithContext(ctx).Model(erasure).
+		Select("status", "records", "analytics_erased", "certificate", "error", "completed_at").
+		Updates(erasure).Error
+}
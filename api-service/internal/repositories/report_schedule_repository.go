@@ -0,0 +1,94 @@
+package repositories
+
+import (
+	"context"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/models"
+	repoInterfaces "hysteria2_microservices/api-service/internal/repositories/interfaces"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type reportScheduleRepository struct {
+	db *gorm.DB
+}
+
+func NewReportScheduleRepository(db *gorm.DB) repoInterfaces.ReportScheduleRepository {
+	return &reportScheduleRepository{db: db}
+}
+
+func (r *reportScheduleRepository) Create(ctx context.Context, schedule *models.ReportSchedule) error {
+	return r.db.WithContext(ctx).Create(schedule).Error
+}
+
+func (r *reportScheduleRepository) GetByID(ctx context.Context, id uuid.UUID) (*models.ReportSchedule, error) {
+	var schedule models.ReportSchedule
+	err := r.db.WithContext(ctx).Where("id = ?", id).First(&schedule).Error
+	if err != nil {
+		return nil, err
+	}
+	return &schedule, nil
+}
+
+func (r *reportScheduleRepository) List(ctx context.Context, offset, limit int) ([]*models.ReportSchedule, int64, error) {
+	var schedules []*models.ReportSchedule
+	var total int64
+
+	query := r.db.WithContext(ctx).Model(&models.ReportSchedule{})
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	err := query.Offset(offset).Limit(limit).Order("created_at DESC").Find(&schedules).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	return schedules, total, nil
+}
+
+func (r *reportScheduleRepository) Update(ctx context.Context, schedule *models.ReportSchedule) error {
+	return r.db.WithContext(ctx).Save(schedule).Error
+}
+
+func (r *reportScheduleRepository) Delete(ctx context.Context, id uuid.UUID) error {
+	result := r.db.WithContext(ctx).Where("id = ?", id).Delete(&models.ReportSchedule{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// ListDue returns the enabled schedules whose next run is due, oldest first
+func (r *reportScheduleRepository) ListDue(ctx context.Context, now time.Time, limit int) ([]*models.ReportSchedule, error) {
+	var schedules []*models.ReportSchedule
+	err := r.db.WithContext(ctx).
+		Where("enabled AND next_run_at <= ?", now).
+		Order("next_run_at").
+		Limit(limit).
+		Find(&schedules).Error
+	return schedules, err
+}
+
+// Claim moves a due schedule to its next run unless another instance did so first, and
+// reports whether this caller got the run
+func (r *reportScheduleRepository) Claim(ctx context.Context, schedule *models.ReportSchedule, nextRunAt time.Time) (bool, error) {
+	result := r.db.WithContext(ctx).Model(&models.ReportSchedule{}).
+		Where("id = ? AND next_run_at = ?", schedule.ID, schedule.NextRunAt).
+		Update("next_run_at", nextRunAt)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+func (r *reportScheduleRepository) RecordRun(ctx context.Context, id uuid.UUID, ranAt time.Time, runErr string) error {
+	return r.db.WithContext(ctx).Model(&models.ReportSchedule{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"last_run_at": ranAt,
+		"last_error":  runErr,
+	}).Error
+}
@@ -0,0 +1,229 @@
+package repositories
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/models"
+	repoInterfaces "hysteria2_microservices/api-service/internal/repositories/interfaces"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type resellerRepository struct {
+	db *gorm.DB
+}
+
+func NewResellerRepository(db *gorm.DB) repoInterfaces.ResellerRepository {
+	return &resellerRepository{db: db}
+}
+
+// Create stores a reseller's quota and gives the user the reseller role
+func (r *resellerRepository) Create(ctx context.Context, reseller *models.Reseller) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(reseller).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.User{}).Where("id = ?", reseller.UserID).Update("role", "reseller").Error
+	})
+}
+
+func (r *resellerRepository) GetByUserID(ctx context.Context, userID uuid.UUID) (*models.Reseller, error) {
+	var reseller models.Reseller
+	err := r.db.WithContext(ctx).Preload("User").Where("user_id = ?", userID).First(&reseller).Error
+	if err != nil {
+		return nil, err
+	}
+	return &reseller, nil
+}
+
+func (r *resellerRepository) List(ctx context.Context, offset, limit int) ([]*models.Reseller, int64, error) {
+	var resellers []*models.Reseller
+	var total int64
+
+	query := r.db.WithContext(ctx).Model(&models.Reseller{})
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	err := query.Preload("User").Offset(offset).Limit(limit).Order("created_at DESC").Find(&resellers).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	return resellers, total, nil
+}
+
+func (r *resellerRepository) Update(ctx context.Context, reseller *models.Reseller) error {
+	return r.db.WithContext(ctx).Model(&models.Reseller{}).Where("user_id = ?", reseller.UserID).Updates(map[string]interface{}{
+		"max_users":  reseller.MaxUsers,
+		"data_quota": reseller.DataQuota,
+		"updated_at": time.Now(),
+	}).Error
+}
+
+// Delete removes a reseller's quota and returns the user to the user role
+func (r *resellerRepository) Delete(ctx context.Context, userID uuid.UUID) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Delete(&models.Reseller{}, "user_id = ?", userID)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return tx.Model(&models.User{}).Where("id = ?", userID).Update("role", "user").Error
+	})
+}
+
+func (r *resellerRepository) GetUsage(ctx context.Context, resellerID uuid.UUID) (*models.ResellerUsage, error) {
+	return resellerUsage(r.db.WithContext(ctx), resellerID, uuid.Nil)
+}
+
+func (r *resellerRepository) ListUsers(ctx context.Context, resellerID uuid.UUID, offset, limit int, search, status string) ([]*models.User, int64, error) {
+	var users []*models.User
+	var total int64
+
+	query := r.db.WithContext(ctx).Model(&models.User{}).Where("reseller_id = ?", resellerID)
+	if search != "" {
+		query = query.Where("username ILIKE ? OR email ILIKE ?", "%"+search+"%", "%"+search+"%")
+	}
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	err := query.Offset(offset).Limit(limit).Order("created_at DESC").Find(&users).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	return users, total, nil
+}
+
+func (r *resellerRepository) GetUser(ctx context.Context, resellerID, userID uuid.UUID) (*models.User, error) {
+	var user models.User
+	err := r.db.WithContext(ctx).Where("id = ? AND reseller_id = ?", userID, resellerID).First(&user).Error
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// CreateUser creates a user owned by the reseller if the reseller's quota allows it
+func (r *resellerRepository) CreateUser(ctx context.Context, resellerID uuid.UUID, user *models.User) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := checkResellerQuota(tx, resellerID, user, true); err != nil {
+			return err
+		}
+		user.ResellerID = &resellerID
+		return tx.Create(user).Error
+	})
+}
+
+// UpdateUser saves a reseller's user if the reseller's quota allows its new data limit
+func (r *resellerRepository) UpdateUser(ctx context.Context, resellerID uuid.UUID, user *models.User) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := checkResellerQuota(tx, resellerID, user, false); err != nil {
+			return err
+		}
+		result := tx.Model(&models.User{}).Where("id = ? AND reseller_id = ?", user.ID, resellerID).Updates(map[string]interface{}{
+			"email":       user.Email,
+			"full_name":   user.FullName,
+			"status":      user.Status,
+			"data_limit":  user.DataLimit,
+			"expiry_date": user.ExpiryDate,
+			"notes":       user.Notes,
+			"updated_at":  time.Now(),
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return nil
+	})
+}
+
+func (r *resellerRepository) DeleteUser(ctx context.Context, resellerID, userID uuid.UUID) error {
+	result := r.db.WithContext(ctx).Delete(&models.User{}, "id = ? AND reseller_id = ?", userID, resellerID)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// GetUserTraffic returns the traffic of each of the reseller's users in the period, largest
+// first
+func (r *resellerRepository) GetUserTraffic(ctx context.Context, resellerID uuid.UUID, from, to time.Time) ([]models.UserTrafficRank, error) {
+	var ranks []models.UserTrafficRank
+	err := r.db.WithContext(ctx).Model(&models.TrafficStats{}).
+		Select("users.id as user_id, users.username, COALESCE(SUM(traffic_stats.upload), 0) as upload, COALESCE(SUM(traffic_stats.download), 0) as download").
+		Joins("JOIN users ON traffic_stats.user_id = users.id").
+		Where("users.reseller_id = ? AND traffic_stats.recorded_at BETWEEN ? AND ?", resellerID, from, to).
+		Group("users.id, users.username").
+		Order("COALESCE(SUM(traffic_stats.upload + traffic_stats.download), 0) DESC").
+		Scan(&ranks).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range ranks {
+		ranks[i].Total = ranks[i].Upload + ranks[i].Download
+	}
+	return ranks, nil
+}
+
+// checkResellerQuota locks the reseller's quota for the rest of the transaction, so
+// concurrent requests cannot both take its last share, and checks that user fits in it
+// next to the reseller's other users
+func checkResellerQuota(tx *gorm.DB, resellerID uuid.UUID, user *models.User, isNew bool) error {
+	var reseller models.Reseller
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("user_id = ?", resellerID).First(&reseller).Error; err != nil {
+		return err
+	}
+
+	// Deleted users free their share of the quota
+	if user.Status == "deleted" {
+		return nil
+	}
+
+	usage, err := resellerUsage(tx, resellerID, user.ID)
+	if err != nil {
+		return err
+	}
+	if isNew && reseller.MaxUsers > 0 && usage.Users >= int64(reseller.MaxUsers) {
+		return fmt.Errorf("%w: user limit of %d reached", repoInterfaces.ErrQuotaExceeded, reseller.MaxUsers)
+	}
+	if reseller.DataQuota > 0 {
+		if user.DataLimit <= 0 {
+			return fmt.Errorf("%w: users need a data limit under a data quota", repoInterfaces.ErrQuotaExceeded)
+		}
+		if usage.DataAllocated+user.DataLimit > reseller.DataQuota {
+			return fmt.Errorf("%w: %d of %d bytes already allocated", repoInterfaces.ErrQuotaExceeded,
+				usage.DataAllocated, reseller.DataQuota)
+		}
+	}
+	return nil
+}
+
+// resellerUsage sums the quota taken by a reseller's users other than except
+func resellerUsage(db *gorm.DB, resellerID, except uuid.UUID) (*models.ResellerUsage, error) {
+	var usage models.ResellerUsage
+	err := db.Model(&models.User{}).
+		Select("COUNT(*) as users, COALESCE(SUM(data_limit), 0) as data_allocated, COALESCE(SUM(data_used), 0) as data_used").
+		Where("reseller_id = ? AND id <> ? AND status <> ?", resellerID, except, "deleted").
+		Scan(&usage).Error
+	if err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}
@@ -0,0 +1,73 @@
+package repositories
+
+import (
+	"context"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/models"
+	repoInterfaces "hysteria2_microservices/api-service/internal/repositories/interfaces"
+
+	"gorm.io/gorm"
+)
+
+type retentionRepository struct {
+	db *gorm.DB
+}
+
+func NewRetentionRepository(db *gorm.DB) repoInterfaces.RetentionRepository {
+	return &retentionRepository{db: db}
+}
+
+func (r *retentionRepository) EnsurePartitions(ctx context.Context, table string, monthsAhead int) (int, error) {
+	var created int
+	err := r.db.WithContext(ctx).Raw("SELECT ensure_monthly_partitions(?, ?)", table, monthsAhead).Scan(&created).Error
+	return created, err
+}
+
+func (r *retentionRepository) DropPartitionsBefore(ctx context.Context, table string, cutoff time.Time) (int, error) {
+	var dropped int
+	err := r.db.WithContext(ctx).Raw("SELECT drop_partitions_before(?, ?)", table, cutoff).Scan(&dropped).Error
+	return dropped, err
+}
+
+func (r *retentionRepository) RollupHourlyTraffic(ctx context.Context, from, to time.Time) (int64, error) {
+	// Replace (not add) bucket totals so re-running a window is idempotent
+	result := r.db.WithContext(ctx).Exec(`
+		INSERT INTO traffic_stats_hourly (id, user_id, device_id, bucket, upload, download, total, samples, created_at)
+		SELECT gen_random_uuid(), user_id, device_id, date_trunc('hour', recorded_at) AS bucket,
+			COALESCE(SUM(upload), 0), COALESCE(SUM(download), 0), COALESCE(SUM(upload + download), 0), COUNT(*), NOW()
+		FROM traffic_stats
+		WHERE recorded_at >= ? AND recorded_at < ?
+		GROUP BY user_id, device_id, date_trunc('hour', recorded_at)
+		ON CONFLICT (user_id, (COALESCE(device_id, '00000000-0000-0000-0000-000000000000'::uuid)), bucket)
+		DO UPDATE SET upload = EXCLUDED.upload, download = EXCLUDED.download, total = EXCLUDED.total, samples = EXCLUDED.samples`,
+		from, to)
+	return result.RowsAffected, result.Error
+}
+
+func (r *retentionRepository) DeleteRawTrafficBefore(ctx context.Context, cutoff time.Time) (int64, error) {
+	result := r.db.WithContext(ctx).Where("recorded_at < ?", cutoff).Delete(&models.TrafficStats{})
+	return result.RowsAffected, result.Error
+}
+
+func (r *retentionRepository) DeleteHourlyTrafficBefore(ctx context.Context, cutoff time.Time) (int64, error) {
+	result := r.db.WithContext(ctx).Where("bucket < ?", cutoff).Delete(&models.TrafficStatsHourly{})
+	return result.RowsAffected, result.Error
+}
+
+func (r *retentionRepository) DeleteNodeMetricsBefore(ctx context.Context, cutoff time.Time) (int64, error) {
+	result := r.db.WithContext(ctx).Where("recorded_at < ?", cutoff).Delete(&models.NodeMetric{})
+	return result.RowsAffected, result.Error
+}
+
+// DeleteConnectionLogsBefore deletes the sessions that ended before cutoff, and the ones
+// left open since before it by nodes that never reported them ending
+func (r *retentionRepository) DeleteConnectionLogsBefore(ctx context.Context, cutoff time.Time) (int64, error) {
+	result := r.db.WithContext(ctx).Where("COALESCE(disconnected_at, connected_at) < ?", cutoff).Delete(&models.ConnectionLog{})
+	return result.RowsAffected, result.Error
+}
+
+func (r *retentionRepository) DeleteClientTelemetryBefore(ctx context.Context, cutoff time.Time) (int64, error) {
+	result := r.db.WithContext(ctx).Where("reported_at < ?", cutoff).Delete(&models.ClientTelemetry{})
+	return result.RowsAffected, result.Error
+}
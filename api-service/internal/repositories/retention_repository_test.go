@@ -0,0 +1,140 @@
+package repositories
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// testDB opens the database in TEST_DATABASE_URL, in UTC. The partition tests run the
+// functions from migrations/003_traffic_partitioning.sql there, on a scratch table they drop
+// afterwards.
+func testDB(t testing.TB) *gorm.DB {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	db, err := gorm.Open(postgres.Open(url), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatalf("database handle: %v", err)
+	}
+	// One connection, so the session time zone below applies to every statement
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+	if err := db.Exec("SET TIME ZONE 'UTC'").Error; err != nil {
+		t.Fatalf("set time zone: %v", err)
+	}
+	return db
+}
+
+// monthlyTable creates a table partitioned like traffic_stats with a partition for each month
+// and a default partition
+func monthlyTable(t *testing.T, db *gorm.DB, months ...time.Time) string {
+	table := "retention_test_" + uuid.NewString()[:8]
+	statements := []string{
+		fmt.Sprintf("CREATE TABLE %s (recorded_at TIMESTAMP WITH TIME ZONE NOT NULL) PARTITION BY RANGE (recorded_at)", table),
+		fmt.Sprintf("CREATE TABLE %s_default PARTITION OF %s DEFAULT", table, table),
+	}
+	for _, month := range months {
+		statements = append(statements, fmt.Sprintf("CREATE TABLE %s_%s PARTITION OF %s FOR VALUES FROM ('%s') TO ('%s')",
+			table, month.Format("2006_01"), table, month.Format(time.DateOnly), month.AddDate(0, 1, 0).Format(time.DateOnly)))
+	}
+	t.Cleanup(func() { db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s CASCADE", table)) })
+
+	for _, statement := range statements {
+		if err := db.Exec(statement).Error; err != nil {
+			t.Fatalf("create partitions: %v", err)
+		}
+	}
+	return table
+}
+
+func partitionsOf(t *testing.T, db *gorm.DB, table string) []string {
+	var names []string
+	err := db.Raw(`
+		SELECT c.relname FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		JOIN pg_class p ON p.oid = i.inhparent
+		WHERE p.relname = ? ORDER BY c.relname`, table).Scan(&names).Error
+	if err != nil {
+		t.Fatalf("list partitions: %v", err)
+	}
+	return names
+}
+
+func TestDropPartitionsBeforeKeepsPartitionWithCutoff(t *testing.T) {
+	db := testDB(t)
+	repo := NewRetentionRepository(db)
+	ctx := context.Background()
+	month := func(m time.Month) time.Time { return time.Date(2026, m, 1, 0, 0, 0, 0, time.UTC) }
+	table := monthlyTable(t, db, month(time.January), month(time.February), month(time.March))
+
+	steps := []struct {
+		cutoff      time.Time
+		wantDropped int
+		wantLeft    []string
+	}{
+		// February still holds rows newer than the cutoff, only January is entirely older
+		{time.Date(2026, 2, 28, 23, 0, 0, 0, time.UTC), 1, []string{"2026_02", "2026_03", "default"}},
+		// A cutoff on the bound drops the month that ends there
+		{month(time.March), 1, []string{"2026_03", "default"}},
+		// The default partition is never dropped
+		{time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC), 1, []string{"default"}},
+	}
+	for _, step := range steps {
+		dropped, err := repo.DropPartitionsBefore(ctx, table, step.cutoff)
+		if err != nil {
+			t.Fatalf("drop before %v: %v", step.cutoff, err)
+		}
+		if dropped != step.wantDropped {
+			t.Errorf("drop before %v dropped %d, want %d", step.cutoff, dropped, step.wantDropped)
+		}
+
+		var want []string
+		for _, suffix := range step.wantLeft {
+			want = append(want, table+"_"+suffix)
+		}
+		if got := partitionsOf(t, db, table); strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("after drop before %v: partitions %v, want %v", step.cutoff, got, want)
+		}
+	}
+}
+
+func TestEnsurePartitionsIsIdempotent(t *testing.T) {
+	db := testDB(t)
+	repo := NewRetentionRepository(db)
+	ctx := context.Background()
+	table := monthlyTable(t, db)
+
+	created, err := repo.EnsurePartitions(ctx, table, 2)
+	if err != nil {
+		t.Fatalf("ensure partitions: %v", err)
+	}
+	// The current month and the two after it
+	if created != 3 {
+		t.Errorf("created %d partitions, want 3", created)
+	}
+	if created, err := repo.EnsurePartitions(ctx, table, 2); err != nil || created != 0 {
+		t.Errorf("second run created %d partitions (%v), want none", created, err)
+	}
+
+	current := time.Now().UTC()
+	current = time.Date(current.Year(), current.Month(), 1, 0, 0, 0, 0, time.UTC)
+	want := []string{table + "_" + current.Format("2006_01"), table + "_" + current.AddDate(0, 1, 0).Format("2006_01"),
+		table + "_" + current.AddDate(0, 2, 0).Format("2006_01"), table + "_default"}
+	if got := partitionsOf(t, db, table); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("partitions %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,85 @@
+package repositories
+
+import (
+	"context"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/models"
+	repoInterfaces "hysteria2_microservices/api-service/internal/repositories/interfaces"
+
+	"gorm.io/gorm"
+)
+
+type telemetryRepository struct {
+	db *gorm.DB
+}
+
+func NewTelemetryRepository(db *gorm.DB) repoInterfaces.TelemetryRepository {
+	return &telemetryRepository{db: db}
+}
+
+func (r *telemetryRepository) CreateBatch(ctx context.Context, events []*models.ClientTelemetry) error {
+	return r.db.WithContext(ctx).Create(&events).Error
+}
+
+// GetNodeReliability counts the connection attempts reported for each node since the given
+// time and how many succeeded, from the clients filter selects
+func (r *telemetryRepository) GetNodeReliability(ctx context.Context, filter models.TelemetryFilter, since time.Time) ([]*models.NodeReliability, error) {
+	query := r.db.WithContext(ctx).Model(&models.ClientTelemetry{}).
+		Select("node_id, COUNT(*) AS attempts, COUNT(*) FILTER (WHERE success) AS successes").
+		Where("reported_at > ?", since)
+	switch {
+	case filter.ASN != 0:
+		query = query.Where("asn = ?", filter.ASN)
+	case filter.Country != "":
+		query = query.Where("country = ?", filter.Country)
+	}
+
+	var rows []*models.NodeReliability
+	if err := query.Group("node_id").Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		if row.Attempts > 0 {
+			row.SuccessRate = float64(row.Successes) / float64(row.Attempts)
+		}
+	}
+	return rows, nil
+}
+
+// GetReachability aggregates the telemetry of clients that reported their ASN since the
+// given time by ASN and protocol
+func (r *telemetryRepository) GetReachability(ctx context.Context, since time.Time) ([]*models.ProtocolReachability, error) {
+	var rows []*models.ProtocolReachability
+	err := r.db.WithContext(ctx).Model(&models.ClientTelemetry{}).
+		Select(`asn, MODE() WITHIN GROUP (ORDER BY isp) AS isp, protocol,
+			COUNT(*) AS attempts, COUNT(*) FILTER (WHERE success) AS successes,
+			COALESCE(PERCENTILE_CONT(0.5) WITHIN GROUP (ORDER BY handshake_ms) FILTER (WHERE success), 0) AS median_handshake_ms`).
+		Where("reported_at > ? AND asn <> 0", since).
+		Group("asn, protocol").
+		Order("asn, protocol").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		if row.Attempts > 0 {
+			row.SuccessRate = float64(row.Successes) / float64(row.Attempts)
+		}
+	}
+	return rows, nil
+}
+
+// GetProbeSummaries aggregates the probe reports since the given time by the ASN operators
+// set as "asn" in the prober node's metadata. The orchestrator writes probe_reports.
+func (r *telemetryRepository) GetProbeSummaries(ctx context.Context, since time.Time) ([]*models.ASNProbeSummary, error) {
+	var rows []*models.ASNProbeSummary
+	err := r.db.WithContext(ctx).Table("probe_reports").
+		Select(`(vps_nodes.metadata->>'asn')::bigint AS asn, COUNT(*) AS reports,
+			AVG(probe_reports.score) AS avg_score, MAX(COALESCE(probe_reports.finished_at, probe_reports.created_at)) AS last_probed_at`).
+		Joins("JOIN vps_nodes ON vps_nodes.id = probe_reports.prober_node_id").
+		Where("probe_reports.created_at > ? AND vps_nodes.metadata->>'asn' ~ '^[0-9]+$'", since).
+		Group("1").
+		Scan(&rows).Error
+	return rows, err
+}
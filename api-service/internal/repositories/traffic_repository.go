@@ -8,9 +8,17 @@ import (
 	repoInterfaces "hysteria2_microservices/api-service/internal/repositories/interfaces"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
 	"gorm.io/gorm"
 )
 
+// trafficCopyColumns are the traffic_stats columns CopySamples writes; id takes its default
+var trafficCopyColumns = []string{"user_id", "device_id", "upload", "download", "total", "recorded_at", "created_at"}
+
+// trafficInsertBatch is the number of rows of one multi-row insert when COPY is unavailable
+const trafficInsertBatch = 1000
+
 type trafficRepository struct {
 	db *gorm.DB
 }
@@ -23,6 +31,62 @@ func (r *trafficRepository) Create(ctx context.Context, traffic *models.TrafficS
 	return r.db.WithContext(ctx).Create(traffic).Error
 }
 
+// CopySamples writes samples to traffic_stats with COPY on a pgx connection, and with
+// multi-row inserts on any other driver
+func (r *trafficRepository) CopySamples(ctx context.Context, samples []models.TrafficSample) error {
+	if len(samples) == 0 {
+		return nil
+	}
+
+	sqlDB, err := r.db.DB()
+	if err != nil {
+		return err
+	}
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	now := time.Now()
+	copied := false
+	err = conn.Raw(func(driverConn interface{}) error {
+		pgxConn, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return nil
+		}
+		copied = true
+		rows := make([][]interface{}, len(samples))
+		for i, sample := range samples {
+			var deviceID interface{}
+			if sample.DeviceID != nil {
+				deviceID = *sample.DeviceID
+			}
+			rows[i] = []interface{}{sample.UserID, deviceID, sample.Upload, sample.Download,
+				sample.Upload + sample.Download, sample.RecordedAt, now}
+		}
+		_, err := pgxConn.Conn().CopyFrom(ctx, pgx.Identifier{"traffic_stats"}, trafficCopyColumns, pgx.CopyFromRows(rows))
+		return err
+	})
+	if err != nil || copied {
+		return err
+	}
+
+	stats := make([]models.TrafficStats, len(samples))
+	for i, sample := range samples {
+		stats[i] = models.TrafficStats{
+			UserID:     sample.UserID,
+			DeviceID:   sample.DeviceID,
+			Upload:     sample.Upload,
+			Download:   sample.Download,
+			Total:      sample.Upload + sample.Download,
+			RecordedAt: sample.RecordedAt,
+			CreatedAt:  now,
+		}
+	}
+	return r.db.WithContext(ctx).CreateInBatches(stats, trafficInsertBatch).Error
+}
+
 func (r *trafficRepository) GetByUserID(ctx context.Context, userID uuid.UUID, from, to time.Time) ([]*models.TrafficStats, error) {
 	var traffic []*models.TrafficStats
 	err := r.db.WithContext(ctx).
@@ -108,6 +172,27 @@ func (r *trafficRepository) GetSummary(ctx context.Context, from, to time.Time)
 	return summary, nil
 }
 
+// GetUserDeviceTraffic returns a user's traffic in the period by device, largest first.
+// Traffic recorded without a device is reported under uuid.Nil.
+func (r *trafficRepository) GetUserDeviceTraffic(ctx context.Context, userID uuid.UUID, from, to time.Time) ([]models.DeviceTrafficRank, error) {
+	var ranks []models.DeviceTrafficRank
+	err := r.db.WithContext(ctx).Model(&models.TrafficStats{}).
+		Select("COALESCE(devices.id, ?::uuid) as device_id, COALESCE(devices.name, '') as device_name, traffic_stats.user_id, COALESCE(SUM(traffic_stats.upload), 0) as upload, COALESCE(SUM(traffic_stats.download), 0) as download", uuid.Nil).
+		Joins("LEFT JOIN devices ON traffic_stats.device_id = devices.id").
+		Where("traffic_stats.user_id = ? AND traffic_stats.recorded_at BETWEEN ? AND ?", userID, from, to).
+		Group("devices.id, devices.name, traffic_stats.user_id").
+		Order("COALESCE(SUM(traffic_stats.upload + traffic_stats.download), 0) DESC").
+		Scan(&ranks).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range ranks {
+		ranks[i].Total = ranks[i].Upload + ranks[i].Download
+	}
+	return ranks, nil
+}
+
 func (r *trafficRepository) UpdateUserTraffic(ctx context.Context, userID uuid.UUID, upload, download int64) error {
 	// Insert new traffic record
 	traffic := &models.TrafficStats{
@@ -0,0 +1,116 @@
+package repositories
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// The traffic benchmarks write to the database in TEST_DATABASE_URL, which must have the
+// schema migrated, and remove their rows afterwards. They report samples/s, to compare with
+// the 10k samples/s agents send at peak:
+//
+//	TEST_DATABASE_URL=postgres://... go test -run '^$' -bench Traffic ./internal/repositories/
+
+const benchmarkUsers = 100
+
+func benchmarkDB(b *testing.B) (*gorm.DB, []uuid.UUID) {
+	db := testDB(b)
+
+	users := make([]uuid.UUID, benchmarkUsers)
+	for i := range users {
+		users[i] = uuid.New()
+	}
+	b.Cleanup(func() {
+		if err := db.Where("user_id IN ?", users).Delete(&models.TrafficStats{}).Error; err != nil {
+			b.Errorf("remove benchmark rows: %v", err)
+		}
+	})
+	return db, users
+}
+
+func benchmarkSamples(users []uuid.UUID, n int) []models.TrafficSample {
+	now := time.Now()
+	samples := make([]models.TrafficSample, n)
+	for i := range samples {
+		samples[i] = models.TrafficSample{
+			UserID:     users[i%len(users)],
+			Upload:     int64(i * 1024),
+			Download:   int64(i * 4096),
+			RecordedAt: now,
+		}
+	}
+	return samples
+}
+
+func reportSampleRate(b *testing.B, perOp int) {
+	b.ReportMetric(float64(b.N*perOp)/b.Elapsed().Seconds(), "samples/s")
+}
+
+// BenchmarkTrafficSingleInsert is the path before batching: one GORM insert per sample
+func BenchmarkTrafficSingleInsert(b *testing.B) {
+	db, users := benchmarkDB(b)
+	repo := NewTrafficRepository(db)
+	ctx := context.Background()
+	now := time.Now()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := repo.Create(ctx, &models.TrafficStats{
+			UserID:     users[i%len(users)],
+			Upload:     1024,
+			Download:   4096,
+			Total:      5120,
+			RecordedAt: now,
+		}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	reportSampleRate(b, 1)
+}
+
+func BenchmarkTrafficMultiRowInsert(b *testing.B) {
+	const batch = 5000
+	db, users := benchmarkDB(b)
+	ctx := context.Background()
+	samples := benchmarkSamples(users, batch)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		stats := make([]models.TrafficStats, len(samples))
+		for j, sample := range samples {
+			stats[j] = models.TrafficStats{
+				UserID:     sample.UserID,
+				Upload:     sample.Upload,
+				Download:   sample.Download,
+				Total:      sample.Upload + sample.Download,
+				RecordedAt: sample.RecordedAt,
+			}
+		}
+		if err := db.WithContext(ctx).CreateInBatches(stats, trafficInsertBatch).Error; err != nil {
+			b.Fatal(err)
+		}
+	}
+	reportSampleRate(b, batch)
+}
+
+func BenchmarkTrafficCopy(b *testing.B) {
+	const batch = 5000
+	db, users := benchmarkDB(b)
+	repo := NewTrafficRepository(db)
+	ctx := context.Background()
+	samples := benchmarkSamples(users, batch)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := repo.CopySamples(ctx, samples); err != nil {
+			b.Fatal(err)
+		}
+	}
+	reportSampleRate(b, batch)
+}
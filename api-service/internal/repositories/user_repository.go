@@ -2,6 +2,8 @@ package repositories
 
 import (
 	"context"
+	"time"
+
 	"hysteria2_microservices/api-service/internal/models"
 	"hysteria2_microservices/api-service/internal/repositories/interfaces"
 
@@ -94,3 +96,25 @@ func (r *userRepository) UpdateLastLogin(ctx context.Context, id uuid.UUID) erro
 func (r *userRepository) UpdateDataUsage(ctx context.Context, id uuid.UUID, dataUsed int64) error {
 	return r.db.WithContext(ctx).Model(&models.User{}).Where("id = ?", id).Update("data_used", dataUsed).Error
 }
+
+func (r *userRepository) GetByIDs(ctx context.Context, ids []uuid.UUID) ([]*models.User, error) {
+	var users []*models.User
+	err := r.db.WithContext(ctx).Where("id IN ?", ids).Find(&users).Error
+	return users, err
+}
+
+func (r *userRepository) ListNearDataLimit(ctx context.Context, ratio float64) ([]*models.User, error) {
+	var users []*models.User
+	err := r.db.WithContext(ctx).
+		Where("status = ? AND data_limit > 0 AND data_used >= data_limit * ?", "active", ratio).
+		Find(&users).Error
+	return users, err
+}
+
+func (r *userRepository) ListExpiring(ctx context.Context, from, to time.Time) ([]*models.User, error) {
+	var users []*models.User
+	err := r.db.WithContext(ctx).
+		Where("status = ? AND expiry_date >= ? AND expiry_date < ?", "active", from, to).
+		Find(&users).Error
+	return users, err
+}
@@ -0,0 +1,122 @@
+package repositories
+
+import (
+	"context"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/models"
+	repoInterfaces "hysteria2_microservices/api-service/internal/repositories/interfaces"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type voucherRepository struct {
+	db *gorm.DB
+}
+
+func NewVoucherRepository(db *gorm.DB) repoInterfaces.VoucherRepository {
+	return &voucherRepository{db: db}
+}
+
+func (r *voucherRepository) CreateBatch(ctx context.Context, vouchers []*models.Voucher) error {
+	return r.db.WithContext(ctx).Create(&vouchers).Error
+}
+
+func (r *voucherRepository) GetByID(ctx context.Context, id uuid.UUID) (*models.Voucher, error) {
+	var voucher models.Voucher
+	err := r.db.WithContext(ctx).Where("id = ?", id).First(&voucher).Error
+	if err != nil {
+		return nil, err
+	}
+	return &voucher, nil
+}
+
+func (r *voucherRepository) GetByCode(ctx context.Context, code string) (*models.Voucher, error) {
+	var voucher models.Voucher
+	err := r.db.WithContext(ctx).Where("code = ?", code).First(&voucher).Error
+	if err != nil {
+		return nil, err
+	}
+	return &voucher, nil
+}
+
+func (r *voucherRepository) List(ctx context.Context, offset, limit int) ([]*models.Voucher, int64, error) {
+	var vouchers []*models.Voucher
+	var total int64
+
+	query := r.db.WithContext(ctx).Model(&models.Voucher{})
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	err := query.Offset(offset).Limit(limit).Order("created_at DESC").Find(&vouchers).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	return vouchers, total, nil
+}
+
+func (r *voucherRepository) Revoke(ctx context.Context, id uuid.UUID) error {
+	result := r.db.WithContext(ctx).Model(&models.Voucher{}).
+		Where("id = ? AND revoked_at IS NULL", id).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (r *voucherRepository) HasRedemption(ctx context.Context, voucherID uuid.UUID, deviceFingerprint string) (bool, error) {
+	var count int64
+	err := r.db.WithContext(ctx).Model(&models.VoucherRedemption{}).
+		Where("voucher_id = ? AND device_fingerprint = ?", voucherID, deviceFingerprint).
+		Count(&count).Error
+	return count > 0, err
+}
+
+func (r *voucherRepository) HasTrialRedemption(ctx context.Context, deviceFingerprint string) (bool, error) {
+	var count int64
+	err := r.db.WithContext(ctx).Model(&models.VoucherRedemption{}).
+		Where("trial = ? AND device_fingerprint = ?", true, deviceFingerprint).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// Redeem claims one use of a voucher and, in the same transaction, creates the user when
+// it has no ID yet or saves its plan, data limit and expiry date, then records the
+// redemption. It returns ErrVoucherUnavailable when the use cannot be claimed, e.g. when a
+// concurrent redemption took the last one.
+func (r *voucherRepository) Redeem(ctx context.Context, voucherID uuid.UUID, user *models.User, redemption *models.VoucherRedemption) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		claim := tx.Model(&models.Voucher{}).
+			Where("id = ? AND uses < max_uses AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > NOW())", voucherID).
+			Update("uses", gorm.Expr("uses + 1"))
+		if claim.Error != nil {
+			return claim.Error
+		}
+		if claim.RowsAffected == 0 {
+			return repoInterfaces.ErrVoucherUnavailable
+		}
+
+		if user.ID == uuid.Nil {
+			if err := tx.Create(user).Error; err != nil {
+				return err
+			}
+		} else if err := tx.Model(&models.User{}).Where("id = ?", user.ID).Updates(map[string]interface{}{
+			"user_group":  user.UserGroup,
+			"data_limit":  user.DataLimit,
+			"expiry_date": user.ExpiryDate,
+			"updated_at":  time.Now(),
+		}).Error; err != nil {
+			return err
+		}
+
+		redemption.VoucherID = voucherID
+		redemption.UserID = user.ID
+		return tx.Create(redemption).Error
+	})
+}
@@ -0,0 +1,225 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/models"
+	repoInterfaces "hysteria2_microservices/api-service/internal/repositories/interfaces"
+	serviceInterfaces "hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/logger"
+	"hysteria2_microservices/pkg/ipallow"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var allowlistScopes = []string{models.AllowedNetworkAdmin, models.AllowedNetworkAgent}
+
+type allowlistService struct {
+	repo     repoInterfaces.AllowedNetworkRepository
+	static   map[string]ipallow.List
+	interval time.Duration
+	logger   *logger.Logger
+
+	mu       sync.RWMutex
+	lists    map[string]ipallow.List
+	stopChan chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// NewAllowlistService takes the networks of the environment by scope, which always apply,
+// and how often to re-read the ones in the database
+func NewAllowlistService(repo repoInterfaces.AllowedNetworkRepository, static map[string][]string, interval time.Duration, logger *logger.Logger) (serviceInterfaces.AllowlistService, error) {
+	parsed := make(map[string]ipallow.List, len(allowlistScopes))
+	for _, scope := range allowlistScopes {
+		list, err := ipallow.Parse(static[scope])
+		if err != nil {
+			return nil, fmt.Errorf("%s allowlist: %w", scope, err)
+		}
+		parsed[scope] = list
+	}
+
+	return &allowlistService{
+		repo:     repo,
+		static:   parsed,
+		interval: interval,
+		logger:   logger,
+		lists:    parsed,
+		stopChan: make(chan struct{}),
+	}, nil
+}
+
+// Start loads the stored networks before returning, so no request is served with the
+// environment's alone, then re-reads them every interval
+func (s *allowlistService) Start(ctx context.Context) {
+	if err := s.refresh(ctx); err != nil {
+		s.logger.Error("Failed to load allowed networks", "error", err)
+	}
+	if s.interval <= 0 {
+		return
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			case <-s.stopChan:
+				return
+			}
+
+			// A failed refresh keeps the networks loaded before rather than opening up
+			s.reload(ctx)
+		}
+	}()
+}
+
+func (s *allowlistService) Stop() {
+	s.stopOnce.Do(func() { close(s.stopChan) })
+	s.wg.Wait()
+}
+
+func (s *allowlistService) Allows(scope, ip string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lists[scope].Allows(ip)
+}
+
+func (s *allowlistService) StaticNetworks(scope string) []string {
+	networks := make([]string, 0, len(s.static[scope]))
+	for _, prefix := range s.static[scope] {
+		networks = append(networks, prefix.String())
+	}
+	return networks
+}
+
+func (s *allowlistService) ListNetworks(ctx context.Context) ([]*models.AllowedNetwork, error) {
+	return s.repo.List(ctx)
+}
+
+// AddNetwork stores a network in its canonical form. An admin network must keep the caller
+// allowed: the first one added turns the restriction on, so it has to include them.
+func (s *allowlistService) AddNetwork(ctx context.Context, network *models.AllowedNetwork, callerIP string) error {
+	if !validAllowlistScope(network.Scope) {
+		return fmt.Errorf("%w: unknown scope %q", serviceInterfaces.ErrNetworkInvalid, network.Scope)
+	}
+	prefix, err := ipallow.ParsePrefix(network.CIDR)
+	if err != nil {
+		return fmt.Errorf("%w: %v", serviceInterfaces.ErrNetworkInvalid, err)
+	}
+	network.CIDR = prefix.String()
+
+	networks, err := s.repo.List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list allowed networks: %w", err)
+	}
+	if network.Scope == models.AllowedNetworkAdmin && !s.build(append(networks, network))[network.Scope].Allows(callerIP) {
+		return serviceInterfaces.ErrAllowlistLockout
+	}
+
+	if err := s.repo.Create(ctx, network); err != nil {
+		return fmt.Errorf("failed to create allowed network: %w", err)
+	}
+	s.logger.Info("Allowed network added", "scope", network.Scope, "cidr", network.CIDR, "id", network.ID)
+	s.reload(ctx)
+	return nil
+}
+
+// RemoveNetwork deletes a stored network, unless the caller is allowed through it alone
+func (s *allowlistService) RemoveNetwork(ctx context.Context, id uuid.UUID, callerIP string) error {
+	network, err := s.repo.GetByID(ctx, id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return serviceInterfaces.ErrNotFound
+		}
+		return fmt.Errorf("failed to get allowed network: %w", err)
+	}
+
+	networks, err := s.repo.List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list allowed networks: %w", err)
+	}
+	remaining := make([]*models.AllowedNetwork, 0, len(networks))
+	for _, n := range networks {
+		if n.ID != id {
+			remaining = append(remaining, n)
+		}
+	}
+	if network.Scope == models.AllowedNetworkAdmin && !s.build(remaining)[network.Scope].Allows(callerIP) {
+		return serviceInterfaces.ErrAllowlistLockout
+	}
+
+	if err := s.repo.Delete(ctx, id); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return serviceInterfaces.ErrNotFound
+		}
+		return fmt.Errorf("failed to delete allowed network: %w", err)
+	}
+	s.logger.Info("Allowed network removed", "scope", network.Scope, "cidr", network.CIDR, "id", id)
+	s.reload(ctx)
+	return nil
+}
+
+// reload re-reads the stored networks; changes made here apply right away on this
+// instance, the others pick them up on their next refresh
+func (s *allowlistService) reload(ctx context.Context) {
+	if err := s.refresh(ctx); err != nil {
+		s.logger.Error("Failed to refresh allowed networks", "error", err)
+	}
+}
+
+func (s *allowlistService) refresh(ctx context.Context) error {
+	networks, err := s.repo.List(ctx)
+	if err != nil {
+		return err
+	}
+	lists := s.build(networks)
+
+	s.mu.Lock()
+	s.lists = lists
+	s.mu.Unlock()
+	return nil
+}
+
+// build joins the environment's networks and the stored ones by scope. Stored networks are
+// validated on the way in, so one that does not parse was written around the API and is
+// skipped.
+func (s *allowlistService) build(networks []*models.AllowedNetwork) map[string]ipallow.List {
+	lists := make(map[string]ipallow.List, len(allowlistScopes))
+	for _, scope := range allowlistScopes {
+		lists[scope] = append(ipallow.List(nil), s.static[scope]...)
+	}
+	for _, network := range networks {
+		if !validAllowlistScope(network.Scope) {
+			continue
+		}
+		prefix, err := ipallow.ParsePrefix(network.CIDR)
+		if err != nil {
+			s.logger.Warn("Skipping invalid allowed network", "id", network.ID, "cidr", network.CIDR)
+			continue
+		}
+		lists[network.Scope] = append(lists[network.Scope], prefix)
+	}
+	return lists
+}
+
+func validAllowlistScope(scope string) bool {
+	for _, known := range allowlistScopes {
+		if scope == known {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,344 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/models"
+	serviceInterfaces "hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/clickhouse"
+	"hysteria2_microservices/api-service/pkg/geoip"
+	"hysteria2_microservices/api-service/pkg/logger"
+
+	"github.com/google/uuid"
+)
+
+const connectionsTable = "connection_events"
+
+const connectionsSchema = `CREATE TABLE IF NOT EXISTS connection_events (
+	user_id LowCardinality(String),
+	device_id String,
+	node_id LowCardinality(String),
+	protocol LowCardinality(String),
+	client_ip String,
+	client_asn UInt32,
+	client_country LowCardinality(String),
+	upload Int64,
+	download Int64,
+	duration Int64,
+	destination String DEFAULT '',
+	connected_at DateTime
+) ENGINE = MergeTree
+PARTITION BY toYYYYMM(connected_at)
+ORDER BY (connected_at, user_id)
+TTL connected_at + INTERVAL 1 YEAR`
+
+// connectionsMigrations add the columns of tables created by older versions
+var connectionsMigrations = []string{
+	"ALTER TABLE connection_events ADD COLUMN IF NOT EXISTS destination String DEFAULT ''",
+}
+
+var errAnalyticsDisabled = fmt.Errorf("analytics is disabled")
+
+type analyticsService struct {
+	client        *clickhouse.Client
+	connectionLog models.ConnectionLogPolicy
+	countries     *geoip.DB
+	asns          *geoip.DB
+	logger        *logger.Logger
+	batchSize     int
+	flushInterval time.Duration
+
+	mu       sync.Mutex
+	buffer   []interface{}
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewAnalyticsService creates the ClickHouse sink. A nil client disables analytics. The
+// connection log policy decides which connection records are kept, with which fields and
+// for how long. Records are located with the countries and asns databases, either of which
+// may be nil.
+func NewAnalyticsService(client *clickhouse.Client, batchSize int, flushInterval time.Duration, connectionLog models.ConnectionLogPolicy,
+	countries, asns *geoip.DB, logger *logger.Logger) serviceInterfaces.AnalyticsService {
+	if batchSize <= 0 {
+		batchSize = 1000
+	}
+	if flushInterval <= 0 {
+		flushInterval = 5 * time.Second
+	}
+
+	s := &analyticsService{
+		client:        client,
+		connectionLog: connectionLog,
+		countries:     countries,
+		asns:          asns,
+		logger:        logger,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		stopChan:      make(chan struct{}),
+	}
+
+	if client != nil {
+		s.wg.Add(1)
+		go s.flushLoop()
+	}
+
+	return s
+}
+
+func (s *analyticsService) Enabled() bool {
+	return s.client != nil
+}
+
+func (s *analyticsService) EnsureSchema(ctx context.Context) error {
+	if !s.Enabled() {
+		return nil
+	}
+	if err := s.client.Exec(ctx, connectionsSchema); err != nil {
+		return err
+	}
+	for _, migration := range connectionsMigrations {
+		if err := s.client.Exec(ctx, migration); err != nil {
+			return err
+		}
+	}
+	if days := s.connectionLog.RetentionDays; days > 0 {
+		return s.client.Exec(ctx, fmt.Sprintf("ALTER TABLE %s MODIFY TTL connected_at + INTERVAL %d DAY", connectionsTable, days))
+	}
+	return nil
+}
+
+// RecordConnection buffers a record and flushes once the batch is full. The country and
+// autonomous system of the client address fill in the ones the record lacks. With the
+// connection log off the record is dropped; in metadata mode its client address and
+// destination are, after locating it.
+func (s *analyticsService) RecordConnection(ctx context.Context, record *models.ConnectionRecord) error {
+	if !s.Enabled() {
+		return errAnalyticsDisabled
+	}
+	if record.ClientIP != "" {
+		if record.ClientCountry == "" {
+			record.ClientCountry = s.countries.Country(record.ClientIP)
+		}
+		if record.ClientASN == 0 {
+			record.ClientASN, _ = s.asns.ASN(record.ClientIP)
+		}
+	}
+	switch s.connectionLog.Mode {
+	case models.ConnectionLogOff:
+		return nil
+	case models.ConnectionLogMetadata:
+		record.ClientIP = ""
+		record.Destination = ""
+	}
+
+	row := map[string]interface{}{
+		"user_id":        record.UserID,
+		"device_id":      record.DeviceID,
+		"node_id":        record.NodeID,
+		"protocol":       record.Protocol,
+		"client_ip":      record.ClientIP,
+		"client_asn":     record.ClientASN,
+		"client_country": record.ClientCountry,
+		"upload":         record.Upload,
+		"download":       record.Download,
+		"duration":       record.Duration,
+		"destination":    record.Destination,
+		"connected_at":   record.ConnectedAt.UTC().Format("2006-01-02 15:04:05"),
+	}
+
+	s.mu.Lock()
+	s.buffer = append(s.buffer, row)
+	full := len(s.buffer) >= s.batchSize
+	s.mu.Unlock()
+
+	if full {
+		return s.flush(ctx)
+	}
+	return nil
+}
+
+// EraseUser deletes a user's connection records, or with anonymize clears their device,
+// client address and destinations. Buffered records are flushed first so none escape;
+// ClickHouse applies the change in the background.
+func (s *analyticsService) EraseUser(ctx context.Context, userID uuid.UUID, anonymize bool) error {
+	if !s.Enabled() {
+		return errAnalyticsDisabled
+	}
+	if err := s.flush(ctx); err != nil {
+		return err
+	}
+
+	if anonymize {
+		return s.client.Exec(ctx, fmt.Sprintf("ALTER TABLE %s UPDATE device_id = '', client_ip = '', destination = '' WHERE user_id = '%s'",
+			connectionsTable, userID))
+	}
+	return s.client.Exec(ctx, fmt.Sprintf("ALTER TABLE %s DELETE WHERE user_id = '%s'", connectionsTable, userID))
+}
+
+func (s *analyticsService) GetTopTalkers(ctx context.Context, from, to time.Time, limit int) ([]models.TopTalker, error) {
+	if !s.Enabled() {
+		return nil, errAnalyticsDisabled
+	}
+	if limit <= 0 || limit > 1000 {
+		limit = 10
+	}
+
+	query := fmt.Sprintf(`SELECT user_id, sum(upload) AS upload, sum(download) AS download,
+		sum(upload + download) AS total, count() AS connections
+		FROM %s WHERE %s
+		GROUP BY user_id ORDER BY total DESC LIMIT %d`, connectionsTable, timeRange(from, to), limit)
+
+	var result []models.TopTalker
+	err := s.client.Query(ctx, query, &result)
+	return result, err
+}
+
+func (s *analyticsService) GetCountryUsage(ctx context.Context, from, to time.Time) ([]models.CountryUsage, error) {
+	if !s.Enabled() {
+		return nil, errAnalyticsDisabled
+	}
+
+	query := fmt.Sprintf(`SELECT client_country AS country, uniqExact(user_id) AS users,
+		sum(upload + download) AS total, count() AS connections
+		FROM %s WHERE %s
+		GROUP BY country ORDER BY total DESC`, connectionsTable, timeRange(from, to))
+
+	var result []models.CountryUsage
+	err := s.client.Query(ctx, query, &result)
+	return result, err
+}
+
+func (s *analyticsService) GetProtocolBreakdown(ctx context.Context, from, to time.Time) ([]models.ProtocolUsage, error) {
+	if !s.Enabled() {
+		return nil, errAnalyticsDisabled
+	}
+
+	query := fmt.Sprintf(`SELECT protocol, sum(upload + download) AS total, count() AS connections
+		FROM %s WHERE %s
+		GROUP BY protocol ORDER BY total DESC`, connectionsTable, timeRange(from, to))
+
+	var result []models.ProtocolUsage
+	err := s.client.Query(ctx, query, &result)
+	return result, err
+}
+
+// GetUserUsage returns the traffic and connection count of every user matching the filter,
+// largest first
+func (s *analyticsService) GetUserUsage(ctx context.Context, from, to time.Time, filter models.ConnectionFilter) ([]models.TopTalker, error) {
+	if !s.Enabled() {
+		return nil, errAnalyticsDisabled
+	}
+
+	query := fmt.Sprintf(`SELECT user_id, sum(upload) AS upload, sum(download) AS download,
+		sum(upload + download) AS total, count() AS connections
+		FROM %s WHERE %s%s
+		GROUP BY user_id ORDER BY total DESC`, connectionsTable, timeRange(from, to), connectionFilter(filter))
+
+	var result []models.TopTalker
+	err := s.client.Query(ctx, query, &result)
+	return result, err
+}
+
+// GetTopDestinations returns the hosts reached by the connections matching the filter that
+// carried the most traffic. Connections whose node does not report destinations are left out.
+func (s *analyticsService) GetTopDestinations(ctx context.Context, from, to time.Time, filter models.ConnectionFilter, limit int) ([]models.DestinationUsage, error) {
+	if !s.Enabled() {
+		return nil, errAnalyticsDisabled
+	}
+	if limit <= 0 || limit > 1000 {
+		limit = 10
+	}
+
+	query := fmt.Sprintf(`SELECT destination, sum(upload + download) AS total, count() AS connections
+		FROM %s WHERE %s AND destination != ''%s
+		GROUP BY destination ORDER BY total DESC LIMIT %d`, connectionsTable, timeRange(from, to), connectionFilter(filter), limit)
+
+	var result []models.DestinationUsage
+	err := s.client.Query(ctx, query, &result)
+	return result, err
+}
+
+// Close stops the flush loop and writes any buffered records
+func (s *analyticsService) Close() error {
+	if !s.Enabled() {
+		return nil
+	}
+	close(s.stopChan)
+	s.wg.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return s.flush(ctx)
+}
+
+func (s *analyticsService) flushLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			if err := s.flush(ctx); err != nil {
+				s.logger.Error("Failed to flush analytics batch", "error", err)
+			}
+			cancel()
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+func (s *analyticsService) flush(ctx context.Context) error {
+	s.mu.Lock()
+	batch := s.buffer
+	s.buffer = nil
+	s.mu.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	if err := s.client.InsertJSON(ctx, connectionsTable, batch); err != nil {
+		// Put the batch back so it is retried on the next flush, capped to avoid unbounded growth
+		s.mu.Lock()
+		if len(s.buffer)+len(batch) <= s.batchSize*10 {
+			s.buffer = append(batch, s.buffer...)
+		}
+		s.mu.Unlock()
+		return fmt.Errorf("failed to insert %d analytics records: %w", len(batch), err)
+	}
+
+	s.logger.Debug("Flushed analytics batch", "records", len(batch))
+	return nil
+}
+
+// connectionFilter renders the conditions of a filter, to follow a time range. UUIDs print
+// as plain hex and dashes, so they are safe to inline.
+func connectionFilter(filter models.ConnectionFilter) string {
+	var conditions strings.Builder
+	if len(filter.UserIDs) > 0 {
+		ids := make([]string, len(filter.UserIDs))
+		for i, id := range filter.UserIDs {
+			ids[i] = "'" + id.String() + "'"
+		}
+		fmt.Fprintf(&conditions, " AND user_id IN (%s)", strings.Join(ids, ", "))
+	}
+	if filter.NodeID != nil {
+		fmt.Fprintf(&conditions, " AND node_id = '%s'", filter.NodeID.String())
+	}
+	return conditions.String()
+}
+
+func timeRange(from, to time.Time) string {
+	const layout = "2006-01-02 15:04:05"
+	return fmt.Sprintf("connected_at BETWEEN toDateTime('%s') AND toDateTime('%s')",
+		from.UTC().Format(layout), to.UTC().Format(layout))
+}
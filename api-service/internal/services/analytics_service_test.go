@@ -0,0 +1,119 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/models"
+	"hysteria2_microservices/api-service/pkg/clickhouse"
+	"hysteria2_microservices/api-service/pkg/geoip"
+	"hysteria2_microservices/api-service/pkg/logger"
+)
+
+// fakeClickHouse keeps the rows inserted over the HTTP interface
+type fakeClickHouse struct {
+	mu   sync.Mutex
+	rows []map[string]interface{}
+}
+
+func (f *fakeClickHouse) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Query().Get("query"), "INSERT INTO "+connectionsTable) {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		var row map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &row); err == nil {
+			f.rows = append(f.rows, row)
+		}
+	}
+}
+
+func newTestAnalytics(t *testing.T, mode string) (*fakeClickHouse, func(*models.ConnectionRecord)) {
+	store := &fakeClickHouse{}
+	server := httptest.NewServer(store)
+	t.Cleanup(server.Close)
+
+	countries, err := geoip.Parse(strings.NewReader("5.8.0.0,5.8.255.255,RU\n"))
+	if err != nil {
+		t.Fatalf("countries: %v", err)
+	}
+	asns, err := geoip.ParseASN(strings.NewReader("5.8.0.0,5.8.255.255,12389,Rostelecom\n"))
+	if err != nil {
+		t.Fatalf("asns: %v", err)
+	}
+
+	// A batch of one writes every record as it is recorded
+	s := NewAnalyticsService(clickhouse.NewClient(server.URL, "test", "", ""), 1, time.Hour,
+		models.ConnectionLogPolicy{Mode: mode}, countries, asns, logger.NewLogger("error"))
+	t.Cleanup(func() { s.Close() })
+
+	return store, func(record *models.ConnectionRecord) {
+		if err := s.RecordConnection(context.Background(), record); err != nil {
+			t.Fatalf("RecordConnection: %v", err)
+		}
+	}
+}
+
+func TestRecordConnectionLocatesClient(t *testing.T) {
+	store, record := newTestAnalytics(t, models.ConnectionLogFull)
+
+	record(&models.ConnectionRecord{UserID: "u1", ClientIP: "5.8.17.4", Destination: "example.com", ConnectedAt: time.Now()})
+	// What the record already says about the client is kept
+	record(&models.ConnectionRecord{UserID: "u2", ClientIP: "5.8.17.4", ClientCountry: "KZ", ClientASN: 9198, ConnectedAt: time.Now()})
+	record(&models.ConnectionRecord{UserID: "u3", ClientIP: "192.0.2.1", ConnectedAt: time.Now()})
+
+	want := []struct {
+		country string
+		asn     float64
+	}{{"RU", 12389}, {"KZ", 9198}, {"", 0}}
+	if len(store.rows) != len(want) {
+		t.Fatalf("inserted %d rows, want %d", len(store.rows), len(want))
+	}
+	for i, w := range want {
+		row := store.rows[i]
+		if row["client_country"] != w.country || row["client_asn"] != w.asn {
+			t.Errorf("row %d located as %v AS%v, want %q AS%v", i, row["client_country"], row["client_asn"], w.country, w.asn)
+		}
+	}
+	if store.rows[0]["client_ip"] != "5.8.17.4" || store.rows[0]["destination"] != "example.com" {
+		t.Errorf("full mode dropped the address or destination: %v", store.rows[0])
+	}
+}
+
+func TestRecordConnectionMetadataModeKeepsLocationOnly(t *testing.T) {
+	store, record := newTestAnalytics(t, models.ConnectionLogMetadata)
+
+	record(&models.ConnectionRecord{UserID: "u1", ClientIP: "5.8.17.4", Destination: "example.com", ConnectedAt: time.Now()})
+
+	if len(store.rows) != 1 {
+		t.Fatalf("inserted %d rows, want 1", len(store.rows))
+	}
+	row := store.rows[0]
+	if row["client_ip"] != "" || row["destination"] != "" {
+		t.Errorf("metadata mode kept the address or destination: %v", row)
+	}
+	// The client is located before its address is dropped
+	if row["client_country"] != "RU" || row["client_asn"] != float64(12389) {
+		t.Errorf("located as %v AS%v, want RU AS12389", row["client_country"], row["client_asn"])
+	}
+}
+
+func TestRecordConnectionOffModeDropsRecords(t *testing.T) {
+	store, record := newTestAnalytics(t, models.ConnectionLogOff)
+
+	record(&models.ConnectionRecord{UserID: "u1", ClientIP: "5.8.17.4", ConnectedAt: time.Now()})
+
+	if len(store.rows) != 0 {
+		t.Errorf("inserted %v with the connection log off", store.rows)
+	}
+}
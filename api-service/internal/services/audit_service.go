@@ -0,0 +1,86 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/models"
+	repoInterfaces "hysteria2_microservices/api-service/internal/repositories/interfaces"
+	"hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/logger"
+	"hysteria2_microservices/pkg/events"
+
+	"github.com/google/uuid"
+)
+
+// auditSource is the source of the audit events the API records
+const auditSource = "api-service"
+
+type auditService struct {
+	repo   repoInterfaces.AuditRepository
+	bus    *events.Bus
+	logger *logger.Logger
+}
+
+// NewAuditService returns the audit trail. bus may be nil, in which case only the API's
+// own events are recorded.
+func NewAuditService(repo repoInterfaces.AuditRepository, bus *events.Bus, logger *logger.Logger) interfaces.AuditService {
+	return &auditService{
+		repo:   repo,
+		bus:    bus,
+		logger: logger,
+	}
+}
+
+// Start stores the audit events of every service as they arrive on the bus, catching up on
+// those published while the API was down
+func (s *auditService) Start(ctx context.Context) {
+	if s.bus == nil {
+		return
+	}
+	s.bus.Consume(ctx, events.ConsumerOptions{
+		Durable:       "api-audit",
+		FilterSubject: events.AuditSubjects,
+	}, func(ctx context.Context, event *events.Event) error {
+		var audit events.AuditEvent
+		if err := json.Unmarshal(event.Data, &audit); err != nil {
+			return events.Permanent(fmt.Errorf("malformed audit event %s: %w", event.ID, err))
+		}
+		return s.repo.Create(ctx, auditRecord(event.ID, event.Source, event.Time, &audit))
+	})
+}
+
+// Record adds an event of the API to the audit trail
+func (s *auditService) Record(ctx context.Context, event *events.AuditEvent) error {
+	if event.Severity == "" {
+		event.Severity = "info"
+	}
+	if s.bus != nil {
+		return s.bus.Publish(events.AuditSubject(auditSource), events.TypeAudit, event)
+	}
+	return s.repo.Create(ctx, auditRecord(uuid.NewString(), auditSource, time.Now(), event))
+}
+
+func (s *auditService) List(ctx context.Context, filter models.AuditFilter, page, limit int) ([]*models.AuditEvent, int64, error) {
+	offset := (page - 1) * limit
+	return s.repo.List(ctx, filter, offset, limit)
+}
+
+func auditRecord(id, source string, at time.Time, event *events.AuditEvent) *models.AuditEvent {
+	if at.IsZero() {
+		at = time.Now()
+	}
+	return &models.AuditEvent{
+		ID:         id,
+		Source:     source,
+		Actor:      event.Actor,
+		Action:     event.Action,
+		Target:     event.Target,
+		Severity:   event.Severity,
+		Message:    event.Message,
+		Details:    event.Details,
+		OccurredAt: at,
+	}
+}
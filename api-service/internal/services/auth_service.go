@@ -2,9 +2,17 @@ package services
 
 import (
 	"context"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"hysteria2_microservices/api-service/internal/models"
@@ -16,23 +24,42 @@ import (
 	"github.com/afex/hystrix-go/hystrix"
 	"github.com/google/uuid"
 	"golang.org/x/crypto/argon2"
+	"gorm.io/gorm"
 )
 
 type authService struct {
 	userRepo    repoInterfaces.UserRepository
 	sessionRepo repoInterfaces.SessionRepository
 	redis       *cache.RedisClient
-	jwtSecret   string
+	keys        serviceInterfaces.JWTKeyService
 	jwtExpiry   time.Duration
+	email       serviceInterfaces.EmailService
+
+	emailOptions EmailAuthOptions
+
+	// passwordFallback checks the passwords the user table does not match, nil when there
+	// is none
+	passwordFallback serviceInterfaces.PasswordAuthenticator
+
+	// The HS256 secrets validate tokens issued before signing keys were introduced, empty
+	// unless JWT_LEGACY_HS256 is set; previousSecret keeps them valid across a rotation of
+	// JWT_SECRET
+	secretMu       sync.RWMutex
+	jwtSecret      string
+	previousSecret string
 }
 
-func NewAuthService(userRepo repoInterfaces.UserRepository, sessionRepo repoInterfaces.SessionRepository, redis *cache.RedisClient, jwtSecret string, jwtExpiry time.Duration) serviceInterfaces.AuthService {
+func NewAuthService(userRepo repoInterfaces.UserRepository, sessionRepo repoInterfaces.SessionRepository, redis *cache.RedisClient, keys serviceInterfaces.JWTKeyService, jwtSecret string, jwtExpiry time.Duration, passwordFallback serviceInterfaces.PasswordAuthenticator, email serviceInterfaces.EmailService, emailOptions EmailAuthOptions) serviceInterfaces.AuthService {
 	return &authService{
-		userRepo:    userRepo,
-		sessionRepo: sessionRepo,
-		redis:       redis,
-		jwtSecret:   jwtSecret,
-		jwtExpiry:   jwtExpiry,
+		userRepo:         userRepo,
+		sessionRepo:      sessionRepo,
+		redis:            redis,
+		keys:             keys,
+		jwtSecret:        jwtSecret,
+		jwtExpiry:        jwtExpiry,
+		passwordFallback: passwordFallback,
+		email:            email,
+		emailOptions:     emailOptions,
 	}
 }
 
@@ -46,18 +73,19 @@ func (s *authService) Register(ctx context.Context, username, email, password st
 	}
 
 	// Hash password
-	hashedPassword, err := s.hashPassword(password)
+	hashedPassword, err := hashPassword(password)
 	if err != nil {
 		return nil, fmt.Errorf("failed to hash password: %w", err)
 	}
 
-	// Create user
+	// Create user; the email is verified by following the link mailed below
 	user := &models.User{
-		Username: username,
-		Email:    email,
-		Password: hashedPassword,
-		Status:   "active",
-		Role:     "user",
+		Username:                 username,
+		Email:                    email,
+		Password:                 hashedPassword,
+		Status:                   "active",
+		Role:                     "user",
+		EmailVerificationPending: true,
 	}
 
 	err = hystrix.Do("create_user", func() error {
@@ -72,26 +100,34 @@ func (s *authService) Register(ctx context.Context, username, email, password st
 		// Log error but don't fail registration
 		fmt.Printf("Failed to update last login: %v\n", err)
 	}
+	if s.email.Enabled() {
+		if err := s.sendVerification(ctx, user); err != nil {
+			fmt.Printf("Failed to send verification email: %v\n", err)
+		}
+	}
 
 	return user, nil
 }
 
 func (s *authService) Login(ctx context.Context, email, password string) (*models.User, error) {
-	// Get user by email
+	// Get user by email and check password, falling back to the directory
 	user, err := s.userRepo.GetByEmail(ctx, email)
-	if err != nil {
-		return nil, fmt.Errorf("invalid credentials")
-	}
-
-	// Check password
-	if !s.verifyPassword(password, user.Password) {
-		return nil, fmt.Errorf("invalid credentials")
+	if err != nil || !verifyPassword(password, user.Password) {
+		if s.passwordFallback == nil {
+			return nil, fmt.Errorf("invalid credentials")
+		}
+		if user, err = s.passwordFallback.Authenticate(ctx, email, password); err != nil {
+			return nil, fmt.Errorf("invalid credentials")
+		}
 	}
 
 	// Check if user is active
 	if user.Status != "active" {
 		return nil, fmt.Errorf("account is not active")
 	}
+	if s.emailOptions.RequireVerification && user.EmailVerificationPending {
+		return nil, serviceInterfaces.ErrEmailNotVerified
+	}
 
 	// Update last login
 	if err := s.userRepo.UpdateLastLogin(ctx, user.ID); err != nil {
@@ -101,13 +137,25 @@ func (s *authService) Login(ctx context.Context, email, password string) (*model
 	return user, nil
 }
 
+// GenerateTokenPair issues tokens carrying the user's current username and role, so a
+// role change takes effect at the next refresh
 func (s *authService) GenerateTokenPair(userID uuid.UUID) (*serviceInterfaces.TokenPair, error) {
-	accessToken, err := utils.GenerateJWT(userID, s.jwtSecret, s.jwtExpiry)
+	user, err := s.userRepo.GetByID(context.Background(), userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+
+	kid, key, err := s.keys.SigningKey()
+	if err != nil {
+		return nil, err
+	}
+
+	accessToken, err := utils.GenerateJWT(userID, user.Username, user.Role, kid, key, s.jwtExpiry)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate access token: %w", err)
 	}
 
-	refreshToken, err := utils.GenerateJWT(userID, s.jwtSecret, s.jwtExpiry*24)
+	refreshToken, err := utils.GenerateJWT(userID, user.Username, user.Role, kid, key, s.jwtExpiry*24)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate refresh token: %w", err)
 	}
@@ -120,24 +168,323 @@ func (s *authService) GenerateTokenPair(userID uuid.UUID) (*serviceInterfaces.To
 }
 
 func (s *authService) ValidateToken(token string) (*serviceInterfaces.Claims, error) {
-	return utils.ValidateJWT(token, s.jwtSecret)
+	return utils.ValidateJWT(token, s.keys.PublicKey, s.secrets()...)
 }
 
 func (s *authService) RefreshToken(refreshToken string) (*serviceInterfaces.TokenPair, error) {
-	claims, err := utils.ValidateJWT(refreshToken, s.jwtSecret)
+	claims, err := s.ValidateToken(refreshToken)
+	if err != nil {
+		return nil, fmt.Errorf("invalid refresh token: %w", err)
+	}
+
+	userID, err := uuid.Parse(claims.UserID)
 	if err != nil {
 		return nil, fmt.Errorf("invalid refresh token: %w", err)
 	}
 
 	// Generate new token pair
-	return s.GenerateTokenPair(uuid.MustParse(claims.UserID))
+	return s.GenerateTokenPair(userID)
+}
+
+// SetJWTSecret replaces the secret legacy HS256 tokens are validated with. Tokens signed
+// with the previous secret stay valid until they expire or the secret rotates again.
+func (s *authService) SetJWTSecret(secret string) {
+	s.secretMu.Lock()
+	defer s.secretMu.Unlock()
+	if secret == s.jwtSecret {
+		return
+	}
+	s.previousSecret = s.jwtSecret
+	s.jwtSecret = secret
+}
+
+func (s *authService) secrets() []string {
+	s.secretMu.RLock()
+	defer s.secretMu.RUnlock()
+	if s.previousSecret == "" {
+		return []string{s.jwtSecret}
+	}
+	return []string{s.jwtSecret, s.previousSecret}
 }
 
 func (s *authService) InvalidateUserSessions(ctx context.Context, userID uuid.UUID) error {
 	return s.sessionRepo.InvalidateUserSessions(ctx, userID)
 }
 
-func (s *authService) hashPassword(password string) (string, error) {
+// ChangePassword replaces a user's password once the current one is confirmed and
+// invalidates the user's sessions
+func (s *authService) ChangePassword(ctx context.Context, userID uuid.UUID, currentPassword, newPassword string) error {
+	// Read from the database: cached users carry no password hash
+	user, err := s.userRepo.GetByID(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("failed to get user: %w", err)
+	}
+
+	if !verifyPassword(currentPassword, user.Password) {
+		return serviceInterfaces.ErrInvalidCredentials
+	}
+
+	hashedPassword, err := hashPassword(newPassword)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+	user.Password = hashedPassword
+
+	if err := s.userRepo.Update(ctx, user); err != nil {
+		return fmt.Errorf("failed to update password: %w", err)
+	}
+	s.redis.Del(ctx, fmt.Sprintf("user:%s", userID.String()))
+
+	return s.sessionRepo.InvalidateUserSessions(ctx, userID)
+}
+
+// Purposes of the tokens mailed to users
+const (
+	emailTokenReset  = "reset"
+	emailTokenVerify = "verify"
+
+	// emailRequestWindow is the window of the attempt limits on the email endpoints
+	emailRequestWindow = time.Hour
+	// emailsPerAccountHour bounds the links mailed to one account, so the endpoints cannot
+	// flood a mailbox
+	emailsPerAccountHour = 3
+)
+
+// EmailAuthOptions configure the password reset and email verification links
+type EmailAuthOptions struct {
+	ResetTTL        time.Duration
+	VerificationTTL time.Duration
+	// RequireVerification refuses to sign in accounts that registered themselves until
+	// their email is verified
+	RequireVerification bool
+	// RequestsPerIPHour bounds the reset and verification requests of an IP address; 0
+	// disables the limit
+	RequestsPerIPHour int
+	// TokenSecret is the HMAC key of the tokens; no token is issued or accepted without it
+	TokenSecret string
+}
+
+// issueEmailToken creates a single-use token for a user. The token carries the user, its
+// purpose and expiry signed with the email token secret, so forged and expired tokens are refused
+// without a lookup; Redis keeps the ones not used yet, and a new token voids the user's
+// previous one for the purpose.
+func (s *authService) issueEmailToken(ctx context.Context, purpose string, userID uuid.UUID, ttl time.Duration) (string, error) {
+	if s.emailOptions.TokenSecret == "" {
+		return "", fmt.Errorf("email token secret is not configured")
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	payload := fmt.Sprintf("%s|%s|%d|%s", purpose, userID, time.Now().Add(ttl).Unix(), hex.EncodeToString(nonce))
+	token := base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(signEmailToken(s.emailOptions.TokenSecret, payload))
+
+	userKey := fmt.Sprintf("email_token:%s:user:%s", purpose, userID)
+	var previous string
+	if err := s.redis.Get(ctx, userKey, &previous); err == nil {
+		s.redis.Del(ctx, previous)
+	}
+	if err := s.redis.Set(ctx, emailTokenKey(token), userID.String(), ttl); err != nil {
+		return "", fmt.Errorf("failed to store token: %w", err)
+	}
+	if err := s.redis.Set(ctx, userKey, emailTokenKey(token), ttl); err != nil {
+		return "", fmt.Errorf("failed to store token: %w", err)
+	}
+	return token, nil
+}
+
+// consumeEmailToken checks a token of the purpose and uses it up, returning its user
+func (s *authService) consumeEmailToken(ctx context.Context, purpose, token string) (uuid.UUID, error) {
+	encodedPayload, encodedSig, ok := strings.Cut(token, ".")
+	if !ok {
+		return uuid.Nil, serviceInterfaces.ErrEmailTokenInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return uuid.Nil, serviceInterfaces.ErrEmailTokenInvalid
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encodedSig)
+	if err != nil {
+		return uuid.Nil, serviceInterfaces.ErrEmailTokenInvalid
+	}
+	if s.emailOptions.TokenSecret == "" || !hmac.Equal(sig, signEmailToken(s.emailOptions.TokenSecret, string(payload))) {
+		return uuid.Nil, serviceInterfaces.ErrEmailTokenInvalid
+	}
+
+	fields := strings.Split(string(payload), "|")
+	if len(fields) != 4 || fields[0] != purpose {
+		return uuid.Nil, serviceInterfaces.ErrEmailTokenInvalid
+	}
+	userID, err := uuid.Parse(fields[1])
+	if err != nil {
+		return uuid.Nil, serviceInterfaces.ErrEmailTokenInvalid
+	}
+	expires, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil || time.Now().Unix() >= expires {
+		return uuid.Nil, serviceInterfaces.ErrEmailTokenInvalid
+	}
+
+	var stored string
+	if err := s.redis.GetDel(ctx, emailTokenKey(token), &stored); err != nil || stored != userID.String() {
+		return uuid.Nil, serviceInterfaces.ErrEmailTokenInvalid
+	}
+	s.redis.Del(ctx, fmt.Sprintf("email_token:%s:user:%s", purpose, userID))
+	return userID, nil
+}
+
+func signEmailToken(secret, payload string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// emailTokenKey keeps tokens hashed, so the keys in Redis cannot be used as links
+func emailTokenKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "email_token:" + hex.EncodeToString(sum[:])
+}
+
+func (s *authService) countIPRequest(ctx context.Context, ip string) error {
+	return countAttempt(ctx, s.redis, "auth_email_ip:"+ip, s.emailOptions.RequestsPerIPHour, emailRequestWindow)
+}
+
+// activeUserByEmail returns the active account with the email, nil when there is none
+func (s *authService) activeUserByEmail(ctx context.Context, email string) (*models.User, error) {
+	user, err := s.userRepo.GetByEmail(ctx, email)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+	if user.Status != "active" {
+		return nil, nil
+	}
+	return user, nil
+}
+
+// RequestPasswordReset mails a reset link to the active account with the email. Unknown
+// emails and inactive accounts succeed without mail, so the answer does not tell which
+// emails have accounts.
+func (s *authService) RequestPasswordReset(ctx context.Context, email, ip string) error {
+	if !s.email.Enabled() {
+		return serviceInterfaces.ErrEmailDisabled
+	}
+	if err := s.countIPRequest(ctx, ip); err != nil {
+		return err
+	}
+
+	user, err := s.activeUserByEmail(ctx, email)
+	if user == nil {
+		return err
+	}
+	// Past the account's limit the request is dropped like one for an unknown email
+	if err := countAttempt(ctx, s.redis, fmt.Sprintf("auth_email_user:%s:%s", emailTokenReset, user.ID), emailsPerAccountHour, emailRequestWindow); err != nil {
+		return nil
+	}
+
+	token, err := s.issueEmailToken(ctx, emailTokenReset, user.ID, s.emailOptions.ResetTTL)
+	if err != nil {
+		return err
+	}
+	s.email.SendPasswordReset(user, token, s.emailOptions.ResetTTL)
+	return nil
+}
+
+// ResetPassword sets a new password with a reset token, which is used up, and invalidates
+// the user's sessions. Following the link proves the user reads the mailbox, so a pending
+// email verification is completed too.
+func (s *authService) ResetPassword(ctx context.Context, token, newPassword, ip string) error {
+	if err := s.countIPRequest(ctx, ip); err != nil {
+		return err
+	}
+	id, err := s.consumeEmailToken(ctx, emailTokenReset, token)
+	if err != nil {
+		return err
+	}
+
+	user, err := s.userRepo.GetByID(ctx, id)
+	if err != nil || user.Status != "active" {
+		return serviceInterfaces.ErrEmailTokenInvalid
+	}
+
+	hashedPassword, err := hashPassword(newPassword)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+	user.Password = hashedPassword
+	user.EmailVerificationPending = false
+
+	if err := s.userRepo.Update(ctx, user); err != nil {
+		return fmt.Errorf("failed to update password: %w", err)
+	}
+	s.redis.Del(ctx, fmt.Sprintf("user:%s", id.String()))
+
+	return s.sessionRepo.InvalidateUserSessions(ctx, id)
+}
+
+// RequestVerification mails a new verification link to the active account with the email
+// when its email is not verified yet. Like password resets, it succeeds without mail
+// otherwise.
+func (s *authService) RequestVerification(ctx context.Context, email, ip string) error {
+	if !s.email.Enabled() {
+		return serviceInterfaces.ErrEmailDisabled
+	}
+	if err := s.countIPRequest(ctx, ip); err != nil {
+		return err
+	}
+
+	user, err := s.activeUserByEmail(ctx, email)
+	if user == nil || !user.EmailVerificationPending {
+		return err
+	}
+	if err := countAttempt(ctx, s.redis, fmt.Sprintf("auth_email_user:%s:%s", emailTokenVerify, user.ID), emailsPerAccountHour, emailRequestWindow); err != nil {
+		return nil
+	}
+	return s.sendVerification(ctx, user)
+}
+
+func (s *authService) sendVerification(ctx context.Context, user *models.User) error {
+	token, err := s.issueEmailToken(ctx, emailTokenVerify, user.ID, s.emailOptions.VerificationTTL)
+	if err != nil {
+		return err
+	}
+	s.email.SendVerification(user, token, s.emailOptions.VerificationTTL)
+	return nil
+}
+
+// VerifyEmail marks the email of a verification token's user verified and welcomes them
+func (s *authService) VerifyEmail(ctx context.Context, token, ip string) (*models.User, error) {
+	if err := s.countIPRequest(ctx, ip); err != nil {
+		return nil, err
+	}
+	id, err := s.consumeEmailToken(ctx, emailTokenVerify, token)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.userRepo.GetByID(ctx, id)
+	if err != nil {
+		return nil, serviceInterfaces.ErrEmailTokenInvalid
+	}
+	if !user.EmailVerificationPending {
+		return user, nil
+	}
+	user.EmailVerificationPending = false
+	if err := s.userRepo.Update(ctx, user); err != nil {
+		return nil, fmt.Errorf("failed to verify email: %w", err)
+	}
+	s.redis.Del(ctx, fmt.Sprintf("user:%s", id.String()))
+	s.email.SendWelcome(user)
+	return user, nil
+}
+
+func (s *authService) VerificationRequired() bool {
+	return s.emailOptions.RequireVerification
+}
+
+func hashPassword(password string) (string, error) {
 	// Generate salt
 	salt := make([]byte, 32)
 	if _, err := rand.Read(salt); err != nil {
@@ -155,7 +502,7 @@ func (s *authService) hashPassword(password string) (string, error) {
 	return fmt.Sprintf("%x", hashedPassword), nil
 }
 
-func (s *authService) verifyPassword(password, hashedPassword string) bool {
+func verifyPassword(password, hashedPassword string) bool {
 	// Decode hex string
 	hashBytes := make([]byte, len(hashedPassword)/2)
 	if _, err := fmt.Sscanf(hashedPassword, "%x", &hashBytes); err != nil {
@@ -0,0 +1,103 @@
+package services
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	serviceInterfaces "hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/internal/utils"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// signedEmailToken builds a token the way issueEmailToken does, signed with secret
+func signedEmailToken(secret, purpose string, userID uuid.UUID, expires time.Time) string {
+	payload := fmt.Sprintf("%s|%s|%d|%s", purpose, userID, expires.Unix(), "00112233445566778899aabbccddeeff")
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(signEmailToken(secret, payload))
+}
+
+// The tokens below are refused before the Redis lookup, so the service has no Redis
+func TestConsumeEmailTokenRefusesBeforeLookup(t *testing.T) {
+	userID := uuid.New()
+	future := time.Now().Add(time.Hour)
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"empty key", signedEmailToken("", emailTokenReset, userID, future)},
+		{"other key", signedEmailToken("jwt-secret", emailTokenReset, userID, future)},
+		{"other purpose", signedEmailToken("email-secret", emailTokenVerify, userID, future)},
+		{"expired", signedEmailToken("email-secret", emailTokenReset, userID, time.Now().Add(-time.Minute))},
+		{"no signature", base64.RawURLEncoding.EncodeToString([]byte("reset|" + userID.String()))},
+	}
+	s := &authService{emailOptions: EmailAuthOptions{TokenSecret: "email-secret"}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := s.consumeEmailToken(context.Background(), emailTokenReset, tt.token); !errors.Is(err, serviceInterfaces.ErrEmailTokenInvalid) {
+				t.Errorf("consumeEmailToken = %v, want ErrEmailTokenInvalid", err)
+			}
+		})
+	}
+}
+
+func TestEmailTokensNeedSecret(t *testing.T) {
+	s := &authService{}
+	if _, err := s.issueEmailToken(context.Background(), emailTokenReset, uuid.New(), time.Hour); err == nil {
+		t.Error("issued a token without a secret")
+	}
+	token := signedEmailToken("", emailTokenReset, uuid.New(), time.Now().Add(time.Hour))
+	if _, err := s.consumeEmailToken(context.Background(), emailTokenReset, token); !errors.Is(err, serviceInterfaces.ErrEmailTokenInvalid) {
+		t.Errorf("consumeEmailToken without a secret = %v, want ErrEmailTokenInvalid", err)
+	}
+}
+
+// staticKeys serves a single signing key
+type staticKeys struct {
+	serviceInterfaces.JWTKeyService
+	kid string
+	key *ecdsa.PrivateKey
+}
+
+func (k staticKeys) PublicKey(kid string) (*ecdsa.PublicKey, error) {
+	if kid != k.kid {
+		return nil, fmt.Errorf("unknown key %s", kid)
+	}
+	return &k.key.PublicKey, nil
+}
+
+// Tokens that are not a user's are refused before the user lookup, so the service has no
+// repositories
+func TestRefreshTokenRefusesNonUserTokens(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &authService{keys: staticKeys{kid: "current", key: key}, jwtSecret: "legacy"}
+
+	service, err := utils.GenerateServiceJWT("api-service", "admin", "current", key, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"user_id": "api-service",
+		"exp":     time.Now().Add(time.Minute).Unix(),
+	}).SignedString([]byte("legacy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, token := range map[string]string{"service token": service, "non-UUID user": legacy} {
+		if _, err := s.RefreshToken(token); err == nil {
+			t.Errorf("%s refreshed", name)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"hysteria2_microservices/api-service/internal/models"
+	repoInterfaces "hysteria2_microservices/api-service/internal/repositories/interfaces"
+	"hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/logger"
+)
+
+// connectionLogService records a row per client session: the node, when it connected and
+// disconnected and the bytes the agent counted. Sessions carry no client addresses or
+// destinations, so the log is the same in the metadata and full modes; off records nothing.
+type connectionLogService struct {
+	repo   repoInterfaces.ConnectionLogRepository
+	policy models.ConnectionLogPolicy
+	logger *logger.Logger
+}
+
+func NewConnectionLogService(repo repoInterfaces.ConnectionLogRepository, policy models.ConnectionLogPolicy, logger *logger.Logger) interfaces.ConnectionLogService {
+	return &connectionLogService{
+		repo:   repo,
+		policy: policy,
+		logger: logger,
+	}
+}
+
+func (s *connectionLogService) Policy() models.ConnectionLogPolicy {
+	return s.policy
+}
+
+// Record applies the events of a node's session report. Reports the agent sends again
+// after a failure apply cleanly: a connect updates the open session and a disconnect of a
+// session already ended is ignored. A resync ends the node's sessions it does not list.
+func (s *connectionLogService) Record(ctx context.Context, nodeID uuid.UUID, report *models.SessionReport) error {
+	if s.policy.Mode == models.ConnectionLogOff {
+		return nil
+	}
+
+	connected := []string{}
+	for i := range report.Events {
+		event := &report.Events[i]
+		if event.ClientID == "" {
+			continue
+		}
+		if event.Time.IsZero() {
+			event.Time = time.Now()
+		}
+
+		var err error
+		switch event.Type {
+		case "connect":
+			connected = append(connected, event.ClientID)
+			err = s.connect(ctx, nodeID, event)
+		case "disconnect":
+			err = s.disconnect(ctx, nodeID, event)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if report.Resync {
+		closed, err := s.repo.CloseOpenExcept(ctx, nodeID, connected, time.Now())
+		if err != nil {
+			return err
+		}
+		if closed > 0 {
+			s.logger.Info("Ended sessions missing from node resync", "node_id", nodeID, "sessions", closed)
+		}
+	}
+	return nil
+}
+
+func (s *connectionLogService) connect(ctx context.Context, nodeID uuid.UUID, event *models.SessionEvent) error {
+	open, err := s.repo.GetOpen(ctx, nodeID, event.ClientID)
+	if err == nil {
+		// The agent counts bytes from when it first saw the session, and from zero again
+		// after a restart; keep the larger count
+		if event.Upload+event.Download > open.Upload+open.Download {
+			open.Upload, open.Download = event.Upload, event.Download
+			return s.repo.Update(ctx, open)
+		}
+		return nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	userID, err := uuid.Parse(event.UserID)
+	if err != nil {
+		s.logger.Warn("Not logging session of unknown user", "node_id", nodeID, "client_id", event.ClientID)
+		return nil
+	}
+	return s.repo.Create(ctx, &models.ConnectionLog{
+		UserID:      userID,
+		DeviceID:    event.DeviceID,
+		NodeID:      nodeID,
+		ClientID:    event.ClientID,
+		Protocol:    event.Protocol,
+		Upload:      event.Upload,
+		Download:    event.Download,
+		ConnectedAt: event.Time,
+	})
+}
+
+func (s *connectionLogService) disconnect(ctx context.Context, nodeID uuid.UUID, event *models.SessionEvent) error {
+	open, err := s.repo.GetOpen(ctx, nodeID, event.ClientID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if event.Upload+event.Download > open.Upload+open.Download {
+		open.Upload, open.Download = event.Upload, event.Download
+	}
+	disconnectedAt := event.Time
+	open.DisconnectedAt = &disconnectedAt
+	return s.repo.Update(ctx, open)
+}
+
+func (s *connectionLogService) ListByUser(ctx context.Context, userID uuid.UUID, page, limit int) ([]*models.ConnectionLog, int64, error) {
+	return s.repo.ListByUser(ctx, userID, (page-1)*limit, limit)
+}
+
+func (s *connectionLogService) ListByNode(ctx context.Context, nodeID uuid.UUID, page, limit int) ([]*models.ConnectionLog, int64, error) {
+	return s.repo.ListByNode(ctx, nodeID, (page-1)*limit, limit)
+}
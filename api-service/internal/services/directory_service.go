@@ -0,0 +1,437 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/models"
+	repoInterfaces "hysteria2_microservices/api-service/internal/repositories/interfaces"
+	serviceInterfaces "hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/cache"
+	"hysteria2_microservices/api-service/pkg/directory"
+	"hysteria2_microservices/api-service/pkg/lease"
+	"hysteria2_microservices/api-service/pkg/logger"
+
+	"gorm.io/gorm"
+)
+
+// Syncs are leased so one replica at a time syncs, and their report is kept in Redis so
+// every replica shows the last one
+const (
+	directoryLease     = "directory-sync"
+	directoryReportKey = "directory:last_report"
+)
+
+// DirectoryOptions control which directory users get accounts and with which role and plan
+type DirectoryOptions struct {
+	// RoleMapping maps directory groups to roles; the highest role of a user's groups wins
+	RoleMapping []directory.GroupMapping
+	// DefaultRole is given to users in no mapped group; empty leaves them without an account
+	DefaultRole string
+	// PlanMapping maps directory groups to plans (user groups); the first match wins
+	PlanMapping []directory.GroupMapping
+	// DefaultPlan is given to users in no mapped group; empty leaves their plan alone
+	DefaultPlan string
+	// SuspendMissing suspends the users of accounts removed from the directory
+	SuspendMissing bool
+	// Interval is the time between scheduled syncs; 0 syncs on request only
+	Interval time.Duration
+}
+
+type syncOutcome int
+
+const (
+	syncUnchanged syncOutcome = iota
+	syncCreated
+	syncLinked
+	syncUpdated
+	syncSkipped
+)
+
+type directoryService struct {
+	client       *directory.Client
+	identityRepo repoInterfaces.UserIdentityRepository
+	userRepo     repoInterfaces.UserRepository
+	redis        *cache.RedisClient
+	locker       *lease.Locker
+	options      DirectoryOptions
+	logger       *logger.Logger
+
+	stopChan chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+func NewDirectoryService(client *directory.Client, identityRepo repoInterfaces.UserIdentityRepository, userRepo repoInterfaces.UserRepository, redis *cache.RedisClient, locker *lease.Locker, options DirectoryOptions, logger *logger.Logger) (serviceInterfaces.DirectoryService, error) {
+	for _, mapping := range options.RoleMapping {
+		if _, ok := externalRoleRank[mapping.Value]; !ok {
+			return nil, fmt.Errorf("group %q maps to role %q; the directory sync grants admin or user", mapping.Group, mapping.Value)
+		}
+	}
+	if _, ok := externalRoleRank[options.DefaultRole]; options.DefaultRole != "" && !ok {
+		return nil, fmt.Errorf("default role %q; the directory sync grants admin or user", options.DefaultRole)
+	}
+
+	return &directoryService{
+		client:       client,
+		identityRepo: identityRepo,
+		userRepo:     userRepo,
+		redis:        redis,
+		locker:       locker,
+		options:      options,
+		logger:       logger,
+		stopChan:     make(chan struct{}),
+	}, nil
+}
+
+// Start syncs immediately and then on every interval, unless syncs run on request only
+func (s *directoryService) Start(ctx context.Context) {
+	if s.options.Interval <= 0 {
+		return
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(s.options.Interval)
+		defer ticker.Stop()
+
+		for {
+			if _, err := s.Sync(ctx); errors.Is(err, serviceInterfaces.ErrJobRunning) {
+				s.logger.Debug("Directory sync skipped, running elsewhere")
+			} else if err != nil {
+				s.logger.Error("Directory sync failed", "error", err)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			case <-s.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+func (s *directoryService) Stop() {
+	s.stopOnce.Do(func() { close(s.stopChan) })
+	s.wg.Wait()
+}
+
+// GetLastReport returns the report of the last sync on any replica, nil before the first
+func (s *directoryService) GetLastReport(ctx context.Context) *models.DirectorySyncReport {
+	var report models.DirectorySyncReport
+	if err := s.redis.Get(ctx, directoryReportKey, &report); err != nil {
+		return nil
+	}
+	return &report
+}
+
+// Sync creates, links and updates the accounts of the directory users and suspends those
+// no longer entitled to one. Failures of single users are counted and logged without
+// stopping the sync. It returns ErrJobRunning while a sync is in progress on any replica.
+func (s *directoryService) Sync(ctx context.Context) (*models.DirectorySyncReport, error) {
+	var report *models.DirectorySyncReport
+	err := s.locker.Run(ctx, directoryLease, func(ctx context.Context) error {
+		report = &models.DirectorySyncReport{StartedAt: time.Now()}
+		err := s.sync(ctx, report)
+		report.FinishedAt = time.Now()
+		if err != nil {
+			report.Error = err.Error()
+		}
+		if err := s.redis.Set(ctx, directoryReportKey, report, 0); err != nil {
+			s.logger.Error("Failed to store directory sync report", "error", err)
+		}
+		return err
+	})
+	if errors.Is(err, lease.ErrHeld) {
+		return nil, serviceInterfaces.ErrJobRunning
+	}
+	if report == nil {
+		return nil, err
+	}
+
+	s.logger.Info("Directory sync finished",
+		"entries", report.Entries,
+		"created", report.Created,
+		"linked", report.Linked,
+		"updated", report.Updated,
+		"suspended", report.Suspended,
+		"skipped", report.Skipped,
+		"failed", report.Failed)
+
+	return report, err
+}
+
+func (s *directoryService) sync(ctx context.Context, report *models.DirectorySyncReport) error {
+	entries, err := s.client.Users(ctx)
+	if err != nil {
+		return err
+	}
+	report.Entries = len(entries)
+
+	identities, err := s.identityRepo.ListByIssuer(ctx, s.client.Server())
+	if err != nil {
+		return fmt.Errorf("failed to list directory identities: %w", err)
+	}
+	bySubject := make(map[string]*models.UserIdentity, len(identities))
+	for _, identity := range identities {
+		bySubject[identity.Subject] = identity
+	}
+
+	seen := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		seen[entry.ID] = true
+		_, outcome, err := s.apply(ctx, entry, bySubject[entry.ID])
+		if err != nil {
+			report.Failed++
+			s.logger.Error("Failed to sync directory user", "dn", entry.DN, "error", err)
+			continue
+		}
+		switch outcome {
+		case syncCreated:
+			report.Created++
+		case syncLinked:
+			report.Linked++
+		case syncUpdated:
+			report.Updated++
+		case syncSkipped:
+			report.Skipped++
+		}
+	}
+
+	if !s.options.SuspendMissing {
+		return nil
+	}
+	// An empty result more likely is a wrong base DN or filter than a directory without users
+	if len(entries) == 0 && len(identities) > 0 {
+		return fmt.Errorf("directory returned no users; not suspending %d synced accounts", len(identities))
+	}
+	for _, identity := range identities {
+		if seen[identity.Subject] {
+			continue
+		}
+		suspended, err := s.suspend(ctx, identity)
+		if err != nil {
+			report.Failed++
+			s.logger.Error("Failed to suspend user removed from directory", "user_id", identity.UserID, "error", err)
+			continue
+		}
+		if suspended {
+			report.Suspended++
+		}
+	}
+	return nil
+}
+
+// Authenticate binds to the directory as the user with login as username or email, then
+// syncs their account, creating it on their first login
+func (s *directoryService) Authenticate(ctx context.Context, login, password string) (*models.User, error) {
+	entry, err := s.client.Authenticate(ctx, login, password)
+	if err != nil {
+		if errors.Is(err, directory.ErrInvalidCredentials) {
+			return nil, serviceInterfaces.ErrInvalidCredentials
+		}
+		s.logger.Error("Directory authentication failed", "error", err)
+		return nil, err
+	}
+
+	identity, err := s.identityRepo.GetBySubject(ctx, s.client.Server(), entry.ID)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("failed to get identity: %w", err)
+	}
+
+	user, outcome, err := s.apply(ctx, *entry, identity)
+	if err != nil {
+		return nil, err
+	}
+	if outcome == syncSkipped {
+		return nil, serviceInterfaces.ErrInvalidCredentials
+	}
+	if outcome == syncCreated {
+		s.logger.Info("User provisioned at directory login", "user_id", user.ID, "username", user.Username)
+	}
+	return user, nil
+}
+
+// apply syncs the account of a directory user. Without an identity the user is linked to
+// the account with their email address or gets a new one, provided they are entitled to
+// one.
+func (s *directoryService) apply(ctx context.Context, entry directory.Entry, identity *models.UserIdentity) (*models.User, syncOutcome, error) {
+	role := s.role(entry.Groups)
+	entitled := role != "" && !entry.Disabled
+
+	if identity != nil {
+		user, err := s.userRepo.GetByID(ctx, identity.UserID)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to get user: %w", err)
+		}
+		return s.save(ctx, user, entry, role, entitled, syncUnchanged)
+	}
+
+	if !entitled {
+		return nil, syncSkipped, nil
+	}
+	if entry.Email == "" {
+		s.logger.Warn("Directory user has no email address", "dn", entry.DN)
+		return nil, syncSkipped, nil
+	}
+	identity = &models.UserIdentity{
+		Issuer:  s.client.Server(),
+		Subject: entry.ID,
+		Email:   entry.Email,
+	}
+
+	user, err := s.userRepo.GetByEmail(ctx, entry.Email)
+	if err == nil {
+		if err := s.identityRepo.Link(ctx, user, identity); err != nil {
+			return nil, 0, fmt.Errorf("failed to link identity: %w", err)
+		}
+		return s.save(ctx, user, entry, role, entitled, syncLinked)
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, 0, fmt.Errorf("failed to get user: %w", err)
+	}
+
+	name := entry.Username
+	if name == "" {
+		name, _, _ = strings.Cut(entry.Email, "@")
+	}
+	username, err := freeUsername(ctx, s.userRepo, name, identity.Issuer+"\x00"+entry.ID)
+	if err != nil {
+		return nil, 0, err
+	}
+	// The account signs in by binding to the directory only
+	hashedPassword, err := unusablePassword()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	user = &models.User{
+		Username: username,
+		Email:    entry.Email,
+		Password: hashedPassword,
+		Role:     role,
+	}
+	s.update(user, entry, role, entitled)
+	if err := s.identityRepo.Link(ctx, user, identity); err != nil {
+		return nil, 0, fmt.Errorf("failed to create user: %w", err)
+	}
+	return user, syncCreated, nil
+}
+
+// save stores the changes the directory entry makes to an existing account
+func (s *directoryService) save(ctx context.Context, user *models.User, entry directory.Entry, role string, entitled bool, outcome syncOutcome) (*models.User, syncOutcome, error) {
+	// Deleted accounts stay deleted
+	if user.Status == "deleted" {
+		return user, syncSkipped, nil
+	}
+	if !s.update(user, entry, role, entitled) {
+		return user, outcome, nil
+	}
+
+	if err := s.userRepo.Update(ctx, user); err != nil {
+		return nil, 0, fmt.Errorf("failed to update user: %w", err)
+	}
+	s.redis.Del(ctx, fmt.Sprintf("user:%s", user.ID.String()))
+	if outcome == syncUnchanged {
+		outcome = syncUpdated
+	}
+	return user, outcome, nil
+}
+
+// update makes an account follow its directory entry and reports whether it changed. The
+// directory decides the status, so accounts suspended here are reactivated while the entry
+// is entitled; roles of resellers and their users are left to the reseller API.
+func (s *directoryService) update(user *models.User, entry directory.Entry, role string, entitled bool) bool {
+	changed := false
+
+	status := "suspended"
+	if entitled {
+		status = "active"
+	}
+	if user.Status != status {
+		user.Status = status
+		changed = true
+	}
+	if entitled && user.Role != role && user.Role != "reseller" && user.ResellerID == nil {
+		s.logger.Info("Role changed by directory sync", "user_id", user.ID, "from", user.Role, "to", role)
+		user.Role = role
+		changed = true
+	}
+	if plan := s.plan(entry.Groups); plan != "" && user.UserGroup != plan {
+		user.UserGroup = plan
+		changed = true
+	}
+	if entry.Name != "" && (user.FullName == nil || *user.FullName != entry.Name) {
+		name := entry.Name
+		user.FullName = &name
+		changed = true
+	}
+	if entry.Email != "" && !strings.EqualFold(user.Email, entry.Email) {
+		user.Email = entry.Email
+		changed = true
+	}
+	return changed
+}
+
+// suspend suspends the active account of an identity removed from the directory
+func (s *directoryService) suspend(ctx context.Context, identity *models.UserIdentity) (bool, error) {
+	user, err := s.userRepo.GetByID(ctx, identity.UserID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	if user.Status != "active" {
+		return false, nil
+	}
+
+	user.Status = "suspended"
+	if err := s.userRepo.Update(ctx, user); err != nil {
+		return false, err
+	}
+	s.redis.Del(ctx, fmt.Sprintf("user:%s", user.ID.String()))
+	s.logger.Info("User removed from directory suspended", "user_id", user.ID, "username", user.Username)
+	return true, nil
+}
+
+// role returns the highest role the groups map to, or the default role
+func (s *directoryService) role(groups []string) string {
+	role := ""
+	for _, mapping := range s.options.RoleMapping {
+		if externalRoleRank[mapping.Value] > externalRoleRank[role] && memberOf(groups, mapping) {
+			role = mapping.Value
+		}
+	}
+	if role == "" {
+		return s.options.DefaultRole
+	}
+	return role
+}
+
+// plan returns the plan of the first mapping the groups match, or the default plan
+func (s *directoryService) plan(groups []string) string {
+	for _, mapping := range s.options.PlanMapping {
+		if memberOf(groups, mapping) {
+			return mapping.Value
+		}
+	}
+	return s.options.DefaultPlan
+}
+
+func memberOf(groups []string, mapping directory.GroupMapping) bool {
+	for _, group := range groups {
+		if mapping.Matches(group) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/models"
+	serviceInterfaces "hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/logger"
+	"hysteria2_microservices/api-service/pkg/orchestrator"
+
+	"github.com/google/uuid"
+)
+
+// driftService passes drift checks of nodes through to the orchestrator, which schedules
+// them, keeps the last report of every node and heals nodes by their policy
+type driftService struct {
+	orchestrator *orchestrator.Client // nil when no orchestrator gateway is configured
+	logger       *logger.Logger
+}
+
+func NewDriftService(orchestrator *orchestrator.Client, logger *logger.Logger) serviceInterfaces.DriftService {
+	return &driftService{
+		orchestrator: orchestrator,
+		logger:       logger,
+	}
+}
+
+// Check compares a node with its desired state now, healing the drift found with heal
+func (s *driftService) Check(ctx context.Context, nodeID uuid.UUID, heal bool) (*models.NodeDrift, error) {
+	if err := s.available(); err != nil {
+		return nil, err
+	}
+	report, err := s.orchestrator.CheckDrift(ctx, nodeID.String(), heal)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check drift: %w", err)
+	}
+	if report.HealedAt > 0 {
+		s.logger.Info("Node drift healed", "node_id", nodeID, "healed", report.Healed, "failed", report.HealFailed, "left", len(report.Items))
+	}
+
+	result := nodeDrift(*report)
+	return &result, nil
+}
+
+// List returns the last drift check of every node, the most drifted first
+func (s *driftService) List(ctx context.Context, driftedOnly bool) ([]models.NodeDrift, error) {
+	if err := s.available(); err != nil {
+		return nil, err
+	}
+	reports, err := s.orchestrator.ListDrift(ctx, driftedOnly)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list drift: %w", err)
+	}
+
+	result := make([]models.NodeDrift, 0, len(reports))
+	for _, report := range reports {
+		result = append(result, nodeDrift(report))
+	}
+	return result, nil
+}
+
+func (s *driftService) SetPolicy(ctx context.Context, nodeID uuid.UUID, policy string) (string, error) {
+	if err := s.available(); err != nil {
+		return "", err
+	}
+	message, err := s.orchestrator.SetDriftPolicy(ctx, nodeID.String(), policy)
+	if err != nil {
+		return "", fmt.Errorf("failed to set drift policy: %w", err)
+	}
+	return message, nil
+}
+
+func (s *driftService) available() error {
+	if s.orchestrator == nil {
+		return fmt.Errorf("orchestrator gateway is not configured")
+	}
+	return nil
+}
+
+func nodeDrift(report orchestrator.DriftReport) models.NodeDrift {
+	result := models.NodeDrift{
+		NodeID:     report.NodeID,
+		NodeName:   report.NodeName,
+		Policy:     report.Policy,
+		Items:      make([]models.DriftItem, 0, len(report.Items)),
+		Healed:     report.Healed,
+		HealFailed: report.HealFailed,
+		CheckedAt:  time.Unix(report.CheckedAt, 0).UTC(),
+	}
+	for _, item := range report.Items {
+		result.Items = append(result.Items, models.DriftItem{
+			Kind:     item.Kind,
+			Target:   item.Target,
+			Expected: item.Expected,
+			Actual:   item.Actual,
+		})
+	}
+	if report.HealedAt > 0 {
+		at := time.Unix(report.HealedAt, 0).UTC()
+		result.HealedAt = &at
+	}
+	return result
+}
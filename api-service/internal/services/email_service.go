@@ -0,0 +1,258 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/models"
+	repoInterfaces "hysteria2_microservices/api-service/internal/repositories/interfaces"
+	serviceInterfaces "hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/cache"
+	"hysteria2_microservices/api-service/pkg/lease"
+	"hysteria2_microservices/api-service/pkg/logger"
+	"hysteria2_microservices/api-service/pkg/mailer"
+)
+
+// Notice runs are leased so one replica at a time mails them, and every notice sent is
+// remembered in Redis so it goes out once
+const (
+	emailNoticeLease    = "email_notices"
+	emailNoticeInterval = time.Hour
+)
+
+var (
+	// quotaWarningPercents are the shares of their data limit users are warned at
+	quotaWarningPercents = []int{80, 100}
+	// expiryReminderDays are how many days before their expiry users are reminded
+	expiryReminderDays = []int{7, 1}
+)
+
+type emailService struct {
+	userRepo  repoInterfaces.UserRepository
+	redis     *cache.RedisClient
+	locker    *lease.Locker
+	mailer    *mailer.Mailer
+	templates *mailer.Templates
+	portalURL string
+	logger    *logger.Logger
+
+	stopChan chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// NewEmailService creates the account mail sender. A nil mailer disables email; portalURL
+// is the user portal the links in messages point to.
+func NewEmailService(userRepo repoInterfaces.UserRepository, redis *cache.RedisClient, locker *lease.Locker,
+	mailer *mailer.Mailer, templates *mailer.Templates, portalURL string, logger *logger.Logger) serviceInterfaces.EmailService {
+	return &emailService{
+		userRepo:  userRepo,
+		redis:     redis,
+		locker:    locker,
+		mailer:    mailer,
+		templates: templates,
+		portalURL: strings.TrimRight(portalURL, "/"),
+		logger:    logger,
+		stopChan:  make(chan struct{}),
+	}
+}
+
+func (s *emailService) Enabled() bool {
+	return s.mailer != nil
+}
+
+func (s *emailService) SendWelcome(user *models.User) {
+	s.background(user, mailer.TemplateWelcome, mailer.WelcomeData{
+		Username: user.Username,
+		Email:    user.Email,
+		LoginURL: s.portalURL + "/login",
+	})
+}
+
+func (s *emailService) SendPasswordReset(user *models.User, token string, expiresIn time.Duration) {
+	s.background(user, mailer.TemplatePasswordReset, mailer.PasswordResetData{
+		Username:  user.Username,
+		ResetURL:  s.portalURL + "/reset-password?token=" + token,
+		ExpiresIn: expiresIn,
+	})
+}
+
+func (s *emailService) SendVerification(user *models.User, token string, expiresIn time.Duration) {
+	s.background(user, mailer.TemplateVerifyEmail, mailer.VerifyEmailData{
+		Username:  user.Username,
+		VerifyURL: s.portalURL + "/verify-email?token=" + token,
+		ExpiresIn: expiresIn,
+	})
+}
+
+// SendInvoice mails an invoice, with its document attached when pdf is not empty
+func (s *emailService) SendInvoice(ctx context.Context, user *models.User, invoice mailer.Invoice, pdf []byte) error {
+	if s.mailer == nil {
+		return serviceInterfaces.ErrEmailDisabled
+	}
+
+	var attachments []mailer.Attachment
+	if len(pdf) > 0 {
+		attachments = append(attachments, mailer.Attachment{
+			Filename:    fmt.Sprintf("invoice-%s.pdf", invoice.Number),
+			ContentType: "application/pdf",
+			Data:        pdf,
+		})
+	}
+	return s.mailer.Deliver(user.Email, s.templates, mailer.TemplateInvoice, mailer.InvoiceData{
+		Username: user.Username,
+		Invoice:  invoice,
+		Attached: len(attachments) > 0,
+	}, attachments...)
+}
+
+// background mails a message without holding up the request that caused it
+func (s *emailService) background(user *models.User, template string, data interface{}) {
+	if s.mailer == nil {
+		return
+	}
+	to, userID := user.Email, user.ID
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if err := s.mailer.Deliver(to, s.templates, template, data); err != nil {
+			s.logger.Error("Failed to send email", "template", template, "user_id", userID, "error", err)
+			return
+		}
+		s.logger.Info("Email sent", "template", template, "user_id", userID)
+	}()
+}
+
+// Start sends the due notices immediately and then every hour
+func (s *emailService) Start(ctx context.Context) {
+	if s.mailer == nil {
+		return
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(emailNoticeInterval)
+		defer ticker.Stop()
+
+		for {
+			if err := s.RunNotices(ctx); errors.Is(err, serviceInterfaces.ErrJobRunning) {
+				s.logger.Debug("Email notices skipped, running elsewhere")
+			} else if err != nil {
+				s.logger.Error("Email notices failed", "error", err)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			case <-s.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the notice runs and waits for the messages still being sent
+func (s *emailService) Stop() {
+	s.stopOnce.Do(func() { close(s.stopChan) })
+	s.wg.Wait()
+}
+
+func (s *emailService) RunNotices(ctx context.Context) error {
+	if s.mailer == nil {
+		return serviceInterfaces.ErrEmailDisabled
+	}
+	err := s.locker.Run(ctx, emailNoticeLease, func(ctx context.Context) error {
+		return errors.Join(s.sendQuotaWarnings(ctx), s.sendExpiryReminders(ctx))
+	})
+	if errors.Is(err, lease.ErrHeld) {
+		return serviceInterfaces.ErrJobRunning
+	}
+	return err
+}
+
+// sendQuotaWarnings warns users at the highest share of their limit they reached. A raised
+// limit warns again.
+func (s *emailService) sendQuotaWarnings(ctx context.Context) error {
+	users, err := s.userRepo.ListNearDataLimit(ctx, float64(quotaWarningPercents[0])/100)
+	if err != nil {
+		return fmt.Errorf("failed to list users near their data limit: %w", err)
+	}
+
+	for _, user := range users {
+		percent := int(user.DataUsed * 100 / user.DataLimit)
+		threshold := 0
+		for _, p := range quotaWarningPercents {
+			if percent >= p {
+				threshold = p
+			}
+		}
+		if threshold == 0 {
+			continue
+		}
+
+		key := fmt.Sprintf("email:quota:%s:%d:%d", user.ID, user.DataLimit, threshold)
+		s.notify(ctx, user, key, 31*24*time.Hour, mailer.TemplateQuotaWarning, mailer.QuotaWarningData{
+			Username:  user.Username,
+			Used:      user.DataUsed,
+			Limit:     user.DataLimit,
+			Percent:   percent,
+			PortalURL: s.portalURL,
+		})
+	}
+	return nil
+}
+
+// sendExpiryReminders reminds users a week and a day before they expire. A renewal moves
+// the expiry date and reminds again.
+func (s *emailService) sendExpiryReminders(ctx context.Context) error {
+	now := time.Now()
+	users, err := s.userRepo.ListExpiring(ctx, now, now.AddDate(0, 0, expiryReminderDays[0]))
+	if err != nil {
+		return fmt.Errorf("failed to list expiring users: %w", err)
+	}
+
+	for _, user := range users {
+		left := user.ExpiryDate.Sub(now)
+		window := expiryReminderDays[0]
+		for _, days := range expiryReminderDays {
+			if left <= time.Duration(days)*24*time.Hour {
+				window = days
+			}
+		}
+
+		key := fmt.Sprintf("email:expiry:%s:%d:%d", user.ID, user.ExpiryDate.Unix(), window)
+		s.notify(ctx, user, key, left+24*time.Hour, mailer.TemplateExpiryReminder, mailer.ExpiryReminderData{
+			Username:  user.Username,
+			ExpiresAt: *user.ExpiryDate,
+			DaysLeft:  int((left + 24*time.Hour - 1) / (24 * time.Hour)),
+			PortalURL: s.portalURL,
+		})
+	}
+	return nil
+}
+
+// notify mails a notice unless key shows it was sent. A failed send forgets the key, so the
+// next run tries again.
+func (s *emailService) notify(ctx context.Context, user *models.User, key string, ttl time.Duration, template string, data interface{}) {
+	first, err := s.redis.SetNX(ctx, key, time.Now().UTC().Format(time.RFC3339), ttl)
+	if err != nil {
+		s.logger.Error("Failed to record email notice", "template", template, "user_id", user.ID, "error", err)
+		return
+	}
+	if !first {
+		return
+	}
+
+	if err := s.mailer.Deliver(user.Email, s.templates, template, data); err != nil {
+		s.logger.Error("Failed to send email notice", "template", template, "user_id", user.ID, "error", err)
+		s.redis.Del(ctx, key)
+		return
+	}
+	s.logger.Info("Email notice sent", "template", template, "user_id", user.ID)
+}
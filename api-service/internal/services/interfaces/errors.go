@@ -0,0 +1,99 @@
+package interfaces
+
+import (
+	"errors"
+
+	repoInterfaces "hysteria2_microservices/api-service/internal/repositories/interfaces"
+)
+
+var (
+	// ErrInvalidCredentials is returned when a password does not match the user's
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// ErrEmailTokenInvalid is returned for a password reset or email verification token
+	// that is forged, used or expired
+	ErrEmailTokenInvalid = errors.New("invalid or expired token")
+	// ErrEmailNotVerified is returned when signing in an account whose email is not verified
+	// while verification is required
+	ErrEmailNotVerified = errors.New("email is not verified")
+	// ErrNotFound is returned when a record does not exist or belongs to another user
+	ErrNotFound = errors.New("not found")
+	// ErrRateLimited is returned when a client made too many attempts
+	ErrRateLimited = errors.New("too many attempts")
+	// ErrUsernameTaken is returned when a new account would reuse a username
+	ErrUsernameTaken = errors.New("username already exists")
+	// ErrEmailTaken is returned when a new account would reuse an email address
+	ErrEmailTaken = errors.New("email already exists")
+
+	// ErrVoucherInvalid is returned for unknown, revoked, expired and used up vouchers
+	ErrVoucherInvalid = errors.New("voucher is invalid or no longer available")
+	// ErrVoucherRedeemed is returned when the device already redeemed the voucher
+	ErrVoucherRedeemed = errors.New("voucher was already redeemed on this device")
+	// ErrTrialUsed is returned when the device already redeemed a trial voucher
+	ErrTrialUsed = errors.New("a trial was already redeemed on this device")
+	// ErrTrialExistingAccount is returned when a trial voucher would top up an account
+	ErrTrialExistingAccount = errors.New("trial vouchers only create new accounts")
+
+	// ErrQuotaExceeded is returned when a user would take a reseller over their quota; the
+	// error wrapping it tells which limit
+	ErrQuotaExceeded = repoInterfaces.ErrQuotaExceeded
+	// ErrResellerExists is returned when the user already is a reseller
+	ErrResellerExists = errors.New("user already is a reseller")
+	// ErrResellerIneligible is returned for admins and reseller-owned users, who cannot
+	// become resellers
+	ErrResellerIneligible = errors.New("user cannot become a reseller")
+	// ErrResellerHasUsers is returned when a reseller to remove still owns users
+	ErrResellerHasUsers = errors.New("reseller still owns users")
+
+	// ErrAnalyticsDisabled is returned for reports that need the analytics store when it is
+	// not configured
+	ErrAnalyticsDisabled = errors.New("analytics is disabled")
+	// ErrEmailDisabled is returned for mail, such as scheduled reports or password resets,
+	// when SMTP is not configured
+	ErrEmailDisabled = errors.New("email delivery is not configured")
+	// ErrDeliveryFailed is returned when a report could not be mailed or posted; the error
+	// wrapping it tells why
+	ErrDeliveryFailed = errors.New("report delivery failed")
+
+	// ErrSSOStateInvalid is returned for a sign-in callback with an unknown, expired or
+	// already used state
+	ErrSSOStateInvalid = errors.New("sign-in state is invalid or expired")
+	// ErrSSODenied is returned when a provider account may not sign in; the error wrapping
+	// it tells why
+	ErrSSODenied = errors.New("single sign-on denied")
+
+	// ErrNetworkInvalid is returned for an allowlist entry that is no CIDR or address, or has
+	// an unknown scope
+	ErrNetworkInvalid = errors.New("invalid network")
+	// ErrAllowlistLockout is returned when an allowlist change would lock the admin making it
+	// out of the admin API
+	ErrAllowlistLockout = errors.New("change would lock the caller out")
+
+	// ErrErasureInProgress is returned when an erasure of the user is already pending or
+	// running
+	ErrErasureInProgress = errors.New("an erasure of the user is already in progress")
+
+	// ErrJobRunning is returned when a singleton job is already running, on this replica or
+	// another
+	ErrJobRunning = errors.New("job is already running")
+
+	// ErrTelemetryOptOut is returned for telemetry from a user who has not opted in
+	ErrTelemetryOptOut = errors.New("telemetry is not enabled for the user")
+	// ErrPolicyInvalid is returned for an ASN protocol policy without an ASN or with unknown
+	// or repeated protocols
+	ErrPolicyInvalid = errors.New("invalid ASN protocol policy")
+
+	// ErrPortForwardQuota is returned when a user already keeps as many port forwards as their
+	// plan allows
+	ErrPortForwardQuota = errors.New("port forward quota exceeded")
+	// ErrPortTaken is returned when the node already forwards the port
+	ErrPortTaken = errors.New("port is already forwarded on the node")
+	// ErrNodeNotAssigned is returned when a user asks for a port forward on a node they are
+	// not assigned to
+	ErrNodeNotAssigned = errors.New("node is not assigned to the user")
+	// ErrNodeNotFound is returned when a user is assigned a node that does not exist
+	ErrNodeNotFound = errors.New("node not found")
+
+	// ErrIngestBackpressure is returned when too many traffic samples are waiting to be
+	// written; the reporter should retry later
+	ErrIngestBackpressure = errors.New("traffic ingestion is backed up")
+)
@@ -2,7 +2,10 @@ package interfaces
 
 import (
 	"context"
+	"crypto/ecdsa"
 	"hysteria2_microservices/api-service/internal/models"
+	"hysteria2_microservices/api-service/pkg/mailer"
+	"hysteria2_microservices/pkg/events"
 	"time"
 
 	"github.com/google/uuid"
@@ -15,6 +18,31 @@ type AuthService interface {
 	ValidateToken(token string) (*Claims, error)
 	RefreshToken(refreshToken string) (*TokenPair, error)
 	InvalidateUserSessions(ctx context.Context, userID uuid.UUID) error
+	ChangePassword(ctx context.Context, userID uuid.UUID, currentPassword, newPassword string) error
+	// RequestPasswordReset mails a single-use reset link to the active account with the
+	// email; it succeeds without mail for unknown emails. Requests of the IP address count
+	// against its hourly limit, as do resets and verifications.
+	RequestPasswordReset(ctx context.Context, email, ip string) error
+	ResetPassword(ctx context.Context, token, newPassword, ip string) error
+	// RequestVerification mails a new verification link to an account with an unverified
+	// email
+	RequestVerification(ctx context.Context, email, ip string) error
+	VerifyEmail(ctx context.Context, token, ip string) (*models.User, error)
+	// VerificationRequired reports whether accounts with unverified emails are refused
+	// sign-in
+	VerificationRequired() bool
+	SetJWTSecret(secret string)
+}
+
+// JWTKeyService keeps the keyset tokens are signed and validated with
+type JWTKeyService interface {
+	Start(ctx context.Context) error
+	Stop()
+	Rotate(ctx context.Context) (*models.JWTSigningKey, error)
+	ListKeys(ctx context.Context) ([]*models.JWTSigningKey, error)
+	SigningKey() (kid string, key *ecdsa.PrivateKey, err error)
+	PublicKey(kid string) (*ecdsa.PublicKey, error)
+	JWKS() *models.JWKS
 }
 
 type UserService interface {
@@ -24,6 +52,8 @@ type UserService interface {
 	DeleteUser(ctx context.Context, id uuid.UUID) error
 	ListUsers(ctx context.Context, page, limit int, search, status, role string) ([]*models.User, int64, error)
 	GetUserDevices(ctx context.Context, userID uuid.UUID) ([]*models.Device, error)
+	RenameDevice(ctx context.Context, userID, deviceID uuid.UUID, name string) (*models.Device, error)
+	RemoveDevice(ctx context.Context, userID, deviceID uuid.UUID) error
 	UpdateUserDataUsage(ctx context.Context, userID uuid.UUID, dataUsed int64) error
 }
 
@@ -38,16 +68,103 @@ type NodeService interface {
 	GetNodeLogs(ctx context.Context, nodeID uuid.UUID, lines int) ([]string, error)
 	UpdateNodeStatus(ctx context.Context, nodeID uuid.UUID, status string) error
 	GetOnlineNodes(ctx context.Context) ([]*models.VPSNode, error)
+	GetUserNodes(ctx context.Context, userID uuid.UUID) ([]*models.VPSNode, error)
+	// SetUserNodes replaces the nodes assigned to the user and returns them
+	SetUserNodes(ctx context.Context, userID uuid.UUID, nodeIDs []uuid.UUID) ([]*models.VPSNode, error)
+}
+
+type RecommendationService interface {
+	Locate(loc models.ClientLocation) models.ClientLocation
+	Recommend(ctx context.Context, loc models.ClientLocation, limit int) ([]*models.NodeRecommendation, error)
+	RankNodes(ctx context.Context, nodes []*models.VPSNode, loc models.ClientLocation) ([]*models.NodeRecommendation, error)
 }
 
 type TrafficService interface {
+	Start(ctx context.Context)
+	Stop()
 	RecordTraffic(ctx context.Context, stats *models.TrafficStats) error
+	IngestSamples(ctx context.Context, samples []models.TrafficSample) error
+	// ConsumeEvents ingests the traffic samples nodes publish on the event bus
+	ConsumeEvents(ctx context.Context, bus *events.Bus)
 	GetUserTraffic(ctx context.Context, userID uuid.UUID, from, to time.Time) ([]*models.TrafficStats, error)
 	GetTrafficSummary(ctx context.Context, from, to time.Time) (*models.TrafficSummary, error)
 	UpdateUserTraffic(ctx context.Context, userID uuid.UUID, upload, download int64) error
 	UpdateDeviceTraffic(ctx context.Context, deviceID uuid.UUID, upload, download int64) error
 }
 
+type RetentionService interface {
+	Start(ctx context.Context)
+	Stop()
+	GetPolicy() models.RetentionPolicy
+	RunOnce(ctx context.Context) (*models.RetentionReport, error)
+	GetLastReport(ctx context.Context) *models.RetentionReport
+}
+
+type AnalyticsService interface {
+	Enabled() bool
+	EnsureSchema(ctx context.Context) error
+	RecordConnection(ctx context.Context, record *models.ConnectionRecord) error
+	EraseUser(ctx context.Context, userID uuid.UUID, anonymize bool) error
+	GetTopTalkers(ctx context.Context, from, to time.Time, limit int) ([]models.TopTalker, error)
+	GetCountryUsage(ctx context.Context, from, to time.Time) ([]models.CountryUsage, error)
+	GetProtocolBreakdown(ctx context.Context, from, to time.Time) ([]models.ProtocolUsage, error)
+	GetUserUsage(ctx context.Context, from, to time.Time, filter models.ConnectionFilter) ([]models.TopTalker, error)
+	GetTopDestinations(ctx context.Context, from, to time.Time, filter models.ConnectionFilter, limit int) ([]models.DestinationUsage, error)
+	Close() error
+}
+
+// LiveSessionService tracks the clients online on every node from agent reports
+type LiveSessionService interface {
+	Report(ctx context.Context, nodeID uuid.UUID, report *models.SessionReport) (disconnect []string, err error)
+	ListByUser(ctx context.Context, userID uuid.UUID) ([]*models.LiveSession, error)
+	ListByNode(ctx context.Context, nodeID uuid.UUID) ([]*models.LiveSession, error)
+	Disconnect(ctx context.Context, nodeID uuid.UUID, clientID string) (*models.LiveSession, error)
+	DisconnectUser(ctx context.Context, userID uuid.UUID) ([]*models.LiveSession, error)
+}
+
+// ConnectionLogService keeps a log of client sessions from agent reports, as much of it as
+// the connection log mode allows
+type ConnectionLogService interface {
+	Policy() models.ConnectionLogPolicy
+	Record(ctx context.Context, nodeID uuid.UUID, report *models.SessionReport) error
+	ListByUser(ctx context.Context, userID uuid.UUID, page, limit int) ([]*models.ConnectionLog, int64, error)
+	ListByNode(ctx context.Context, nodeID uuid.UUID, page, limit int) ([]*models.ConnectionLog, int64, error)
+}
+
+// TelemetryService stores the connection outcomes client apps of opted-in users report,
+// for reliability analytics, node recommendations and obfuscation experiments
+type TelemetryService interface {
+	SetOptIn(ctx context.Context, userID uuid.UUID, enabled bool) error
+	Ingest(ctx context.Context, userID uuid.UUID, loc models.ClientLocation, report *models.TelemetryReport) (int, error)
+}
+
+// ReachabilityService reports how well each protocol gets through from client ASNs and
+// keeps the protocols subscriptions recommend per ASN
+type ReachabilityService interface {
+	GetReachability(ctx context.Context, since time.Time) ([]*models.ASNReachability, error)
+	ListPolicies(ctx context.Context) ([]*models.ASNProtocolPolicy, error)
+	SetPolicy(ctx context.Context, policy *models.ASNProtocolPolicy) error
+	DeletePolicy(ctx context.Context, asn uint32) error
+}
+
+// PrivacyService exports what is stored about a user and erases it on request. Erasures
+// run in the background and leave a record certifying what was removed.
+type PrivacyService interface {
+	ExportUser(ctx context.Context, userID uuid.UUID) (*models.UserDataExport, error)
+	RequestErasure(ctx context.Context, userID uuid.UUID, mode string, requestedBy *uuid.UUID) (*models.DataErasure, error)
+	GetErasure(ctx context.Context, id uuid.UUID) (*models.DataErasure, error)
+	ListErasures(ctx context.Context, page, limit int) ([]*models.DataErasure, int64, error)
+
+	Start(ctx context.Context)
+	Stop()
+}
+
+type SubscriptionService interface {
+	GenerateSubscription(ctx context.Context, userID uuid.UUID, format string, client models.ClientLocation) (*models.ClientSubscription, error)
+	GetFingerprint(userID uuid.UUID, at time.Time) (string, time.Time)
+	GetShareLink(ctx context.Context, userID uuid.UUID, protocol string, nodeID uuid.UUID) (*models.ShareLink, error)
+}
+
 type HysteriaService interface {
 	GenerateUserConfig(ctx context.Context, userID, deviceID string) (*models.HysteriaConfig, error)
 	UpdateUserConfig(ctx context.Context, userID, deviceID string, config *models.HysteriaConfig) error
@@ -67,14 +184,208 @@ type XrayService interface {
 	GetServiceStatus(ctx context.Context) (*models.ServiceStatus, error)
 }
 
+// WARPService manages the Cloudflare WARP client of nodes through the orchestrator
+type WARPService interface {
+	GetStatus(ctx context.Context, nodeID uuid.UUID) (*models.NodeWARPStatus, error)
+	Configure(ctx context.Context, nodeID uuid.UUID, settings *models.NodeWARPSettings) (string, error)
+	Connect(ctx context.Context, nodeID uuid.UUID) (string, error)
+	Disconnect(ctx context.Context, nodeID uuid.UUID) (string, error)
+	EnableProxy(ctx context.Context, nodeID uuid.UUID, port int) (string, error)
+	DisableProxy(ctx context.Context, nodeID uuid.UUID) (string, error)
+	EnableRouting(ctx context.Context, nodeID uuid.UUID, interfaceName string) (string, error)
+	DisableRouting(ctx context.Context, nodeID uuid.UUID) (string, error)
+	TestConnectivity(ctx context.Context, nodeID uuid.UUID) (*models.WARPConnectivity, error)
+	GetLogs(ctx context.Context, nodeID uuid.UUID, lines int) (*models.WARPLogs, error)
+}
+
+// ObfuscationService manages the obfuscation of nodes through the orchestrator
+type ObfuscationService interface {
+	Get(ctx context.Context, nodeID uuid.UUID) (*models.NodeObfuscation, error)
+	ApplyPreset(ctx context.Context, nodeID uuid.UUID, preset string) (*models.NodeObfuscation, error)
+	ApplySettings(ctx context.Context, nodeID uuid.UUID, settings *models.ObfuscationSettings) (*models.NodeObfuscation, error)
+	Update(ctx context.Context, nodeID uuid.UUID, change *models.ObfuscationChange) (*models.NodeObfuscation, error)
+}
+
+// SNIService manages the SNI domains and certificates of nodes through the orchestrator
+type SNIService interface {
+	AddDomain(ctx context.Context, nodeID uuid.UUID, onboarding *models.SNIDomainOnboarding) (*models.SNIDomainResult, error)
+	RemoveDomain(ctx context.Context, nodeID uuid.UUID, domain string) (*models.NodeSNIDomains, error)
+	GetCertificates(ctx context.Context, nodeID uuid.UUID) (*models.NodeCertificateStatus, error)
+	RenewCertificates(ctx context.Context, nodeID uuid.UUID) (string, error)
+	ListInventory(ctx context.Context, filter models.CertificateFilter) ([]models.InventoryCertificate, error)
+	BulkRenew(ctx context.Context, nodeIDs []uuid.UUID, filter models.CertificateFilter) (*models.CertificateRenewal, error)
+	Upload(ctx context.Context, upload *models.CertificateUpload) (*models.CertificateDistribution, error)
+	ListUploads(ctx context.Context) ([]models.UploadedCertificate, error)
+	DeleteUpload(ctx context.Context, domain string) (string, error)
+	CheckTLS(ctx context.Context, nodeID uuid.UUID) (*models.TLSReport, error)
+	ListTLSReports(ctx context.Context, nodeID *uuid.UUID) ([]models.TLSReport, error)
+}
+
+// DriftService reports and heals the drift of nodes from their desired state through the
+// orchestrator
+type DriftService interface {
+	Check(ctx context.Context, nodeID uuid.UUID, heal bool) (*models.NodeDrift, error)
+	List(ctx context.Context, driftedOnly bool) ([]models.NodeDrift, error)
+	SetPolicy(ctx context.Context, nodeID uuid.UUID, policy string) (string, error)
+}
+
+// PortForwardService keeps the public ports nodes forward to users' servers, within the
+// quota of each user's plan
+type PortForwardService interface {
+	Quota(ctx context.Context, userID uuid.UUID) (int, error)
+	ListUserForwards(ctx context.Context, userID uuid.UUID) ([]*models.PortForward, error)
+	ListForwards(ctx context.Context, nodeID *uuid.UUID) ([]*models.PortForward, error)
+	AddForward(ctx context.Context, forward *models.PortForward) error
+	RemoveForward(ctx context.Context, id uuid.UUID, owner *uuid.UUID) error
+}
+
 type WebSocketService interface {
 	BroadcastTrafficUpdate(userID uuid.UUID, stats *models.TrafficStats)
 	BroadcastUserStatus(userID uuid.UUID, status string)
 	BroadcastDeviceStatus(deviceID uuid.UUID, userID uuid.UUID, online bool)
+	BroadcastNodeEvent(nodeID uuid.UUID, event string, data interface{})
+	BroadcastAlert(severity, code, message string)
 	GetConnectedClientsCount() int
 	IsUserConnected(userID uuid.UUID) bool
 }
 
+// VoucherService issues redeem codes and redeems them into accounts
+type VoucherService interface {
+	CreateVouchers(ctx context.Context, template *models.Voucher, count int) ([]*models.Voucher, error)
+	ListVouchers(ctx context.Context, page, limit int) ([]*models.Voucher, int64, error)
+	RevokeVoucher(ctx context.Context, id uuid.UUID) error
+	Redeem(ctx context.Context, req *RedeemRequest) (*RedeemResult, error)
+}
+
+// RedeemRequest redeems a voucher into the account with Email once Password is verified,
+// or into a new account named Username when there is none
+type RedeemRequest struct {
+	Code              string
+	DeviceFingerprint string
+	IPAddress         string
+	Username          string
+	Email             string
+	Password          string
+}
+
+type RedeemResult struct {
+	User    *models.User
+	Voucher *models.Voucher
+	Created bool
+}
+
+// ResellerService manages reseller quotas for platform admins and the users resellers own.
+// The reseller-scoped methods report users of other resellers as ErrNotFound.
+type ResellerService interface {
+	CreateReseller(ctx context.Context, reseller *models.Reseller) error
+	GetReseller(ctx context.Context, userID uuid.UUID) (*models.Reseller, error)
+	ListResellers(ctx context.Context, page, limit int) ([]*models.Reseller, int64, error)
+	UpdateReseller(ctx context.Context, reseller *models.Reseller) error
+	DeleteReseller(ctx context.Context, userID uuid.UUID) error
+
+	ListUsers(ctx context.Context, resellerID uuid.UUID, page, limit int, search, status string) ([]*models.User, int64, error)
+	GetUser(ctx context.Context, resellerID, userID uuid.UUID) (*models.User, error)
+	CreateUser(ctx context.Context, resellerID uuid.UUID, user *models.User) error
+	UpdateUser(ctx context.Context, resellerID uuid.UUID, user *models.User) error
+	DeleteUser(ctx context.Context, resellerID, userID uuid.UUID) error
+	GetTraffic(ctx context.Context, resellerID uuid.UUID, from, to time.Time) (*ResellerTraffic, error)
+	GetNodes(ctx context.Context, resellerID uuid.UUID) ([]*models.VPSNode, error)
+}
+
+// ResellerTraffic is the traffic of a reseller's users in a period
+type ResellerTraffic struct {
+	From     time.Time                `json:"from"`
+	To       time.Time                `json:"to"`
+	Upload   int64                    `json:"upload"`
+	Download int64                    `json:"download"`
+	Total    int64                    `json:"total"`
+	Users    []models.UserTrafficRank `json:"users"`
+}
+
+// ReportService builds usage reports of a user, a node or a reseller's users (the "tenant"
+// scope) and delivers them on schedules. Node reports need the analytics store.
+type ReportService interface {
+	Generate(ctx context.Context, scope string, subjectID uuid.UUID, from, to time.Time) (*models.UsageReport, error)
+	Render(report *models.UsageReport, format string) (data []byte, contentType string, err error)
+
+	CreateSchedule(ctx context.Context, schedule *models.ReportSchedule) error
+	GetSchedule(ctx context.Context, id uuid.UUID) (*models.ReportSchedule, error)
+	ListSchedules(ctx context.Context, page, limit int) ([]*models.ReportSchedule, int64, error)
+	UpdateSchedule(ctx context.Context, schedule *models.ReportSchedule) error
+	DeleteSchedule(ctx context.Context, id uuid.UUID) error
+	// RunSchedule delivers the report of the schedule's last complete period right away
+	RunSchedule(ctx context.Context, id uuid.UUID) (*models.ReportSchedule, error)
+
+	Start(ctx context.Context)
+	Stop()
+}
+
+// EmailService mails users their account messages from the mail templates: welcome,
+// password reset and email verification messages, invoices, and warnings when they near
+// their data limit or expiry. Welcome, reset and verification messages go out in the
+// background and failures are logged.
+type EmailService interface {
+	Enabled() bool
+	SendWelcome(user *models.User)
+	SendPasswordReset(user *models.User, token string, expiresIn time.Duration)
+	SendVerification(user *models.User, token string, expiresIn time.Duration)
+	SendInvoice(ctx context.Context, user *models.User, invoice mailer.Invoice, pdf []byte) error
+	// RunNotices sends the quota warnings and expiry reminders that are due, each once. It
+	// returns ErrJobRunning while a run is in progress on any replica.
+	RunNotices(ctx context.Context) error
+
+	Start(ctx context.Context)
+	Stop()
+}
+
+// SSOService signs users in through an OpenID provider with the authorization code flow,
+// mapping the provider's groups to roles and creating accounts on first sign-in
+type SSOService interface {
+	// Begin starts a sign-in and returns the provider URL to send the browser to
+	Begin(ctx context.Context) (string, error)
+	// Complete finishes the sign-in the provider redirected back with and returns the user
+	Complete(ctx context.Context, state, code string) (*models.User, error)
+}
+
+// PasswordAuthenticator checks passwords kept outside the user table
+type PasswordAuthenticator interface {
+	// Authenticate returns the user whose login and password the authenticator accepts,
+	// or ErrInvalidCredentials
+	Authenticate(ctx context.Context, login, password string) (*models.User, error)
+}
+
+// DirectoryService keeps the users of an LDAP or Active Directory server in sync: their
+// accounts, roles, plans and status follow the directory
+type DirectoryService interface {
+	PasswordAuthenticator
+	Start(ctx context.Context)
+	Stop()
+	Sync(ctx context.Context) (*models.DirectorySyncReport, error)
+	GetLastReport(ctx context.Context) *models.DirectorySyncReport
+}
+
+// AllowlistService keeps the networks admins and node agents may connect from: those of the
+// environment, which cannot be changed at runtime, and those stored in the database. Allows
+// answers from memory; changes made through other instances are picked up every refresh.
+type AllowlistService interface {
+	Start(ctx context.Context)
+	Stop()
+	Allows(scope, ip string) bool
+	StaticNetworks(scope string) []string
+	ListNetworks(ctx context.Context) ([]*models.AllowedNetwork, error)
+	AddNetwork(ctx context.Context, network *models.AllowedNetwork, callerIP string) error
+	RemoveNetwork(ctx context.Context, id uuid.UUID, callerIP string) error
+}
+
+// AuditService keeps the audit trail of all services. Events are published on the event
+// bus and stored by a consumer, so the trail covers the agents and the orchestrator too;
+// without a bus the API's own events are stored directly.
+type AuditService interface {
+	Start(ctx context.Context)
+	Record(ctx context.Context, event *events.AuditEvent) error
+	List(ctx context.Context, filter models.AuditFilter, page, limit int) ([]*models.AuditEvent, int64, error)
+}
+
 type TokenPair struct {
 	AccessToken  string `json:"access_token"`
 	RefreshToken string `json:"refresh_token"`
@@ -0,0 +1,371 @@
+package services
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/models"
+	repoInterfaces "hysteria2_microservices/api-service/internal/repositories/interfaces"
+	serviceInterfaces "hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/lease"
+	"hysteria2_microservices/api-service/pkg/logger"
+)
+
+const (
+	// jwtKeySyncInterval is how often keys rotated by other API instances are picked up
+	jwtKeySyncInterval = time.Minute
+	// jwtKeyReloadBackoff limits reloads triggered by tokens with an unknown kid
+	jwtKeyReloadBackoff = 10 * time.Second
+	// jwtKeyLease lets one API instance at a time create, rotate and prune keys
+	jwtKeyLease = "jwt-keys"
+	// jwtKeyFirstWait is how long an instance waits for another to create the first key
+	jwtKeyFirstWait = 30 * time.Second
+)
+
+type jwtSigningKey struct {
+	model   *models.JWTSigningKey
+	private *ecdsa.PrivateKey
+}
+
+type jwtKeyService struct {
+	keyRepo          repoInterfaces.JWTKeyRepository
+	locker           *lease.Locker
+	rotationInterval time.Duration
+	tokenLifetime    time.Duration
+	logger           *logger.Logger
+
+	mu         sync.RWMutex
+	keys       map[string]*jwtSigningKey
+	current    *jwtSigningKey
+	lastReload time.Time
+	reloadMu   sync.Mutex
+	stopChan   chan struct{}
+	stopOnce   sync.Once
+	wg         sync.WaitGroup
+}
+
+// NewJWTKeyService creates the signing keyset. A new key is created every rotationInterval,
+// 0 rotates only on request; retired keys validate tokens for tokenLifetime, the lifetime
+// of the longest-lived token.
+func NewJWTKeyService(keyRepo repoInterfaces.JWTKeyRepository, locker *lease.Locker, rotationInterval, tokenLifetime time.Duration, logger *logger.Logger) serviceInterfaces.JWTKeyService {
+	return &jwtKeyService{
+		keyRepo:          keyRepo,
+		locker:           locker,
+		rotationInterval: rotationInterval,
+		tokenLifetime:    tokenLifetime,
+		logger:           logger,
+		keys:             make(map[string]*jwtSigningKey),
+		stopChan:         make(chan struct{}),
+	}
+}
+
+// Start loads the keyset, creating the first signing key if there is none, and then keeps
+// it in sync with the database, rotating and pruning keys when they are due
+func (s *jwtKeyService) Start(ctx context.Context) error {
+	if err := s.reload(ctx); err != nil {
+		return err
+	}
+	if _, _, err := s.SigningKey(); err != nil {
+		if err := s.createFirstKey(ctx); err != nil {
+			return fmt.Errorf("failed to create JWT signing key: %w", err)
+		}
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(jwtKeySyncInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			case <-s.stopChan:
+				return
+			}
+
+			if err := s.maintain(ctx); err != nil {
+				s.logger.Error("JWT keyset maintenance failed", "error", err)
+			}
+		}
+	}()
+	return nil
+}
+
+func (s *jwtKeyService) Stop() {
+	s.stopOnce.Do(func() { close(s.stopChan) })
+	s.wg.Wait()
+}
+
+// createFirstKey creates the first signing key. Instances starting together leave it to
+// the one holding the lease and wait for its key.
+func (s *jwtKeyService) createFirstKey(ctx context.Context) error {
+	deadline := time.Now().Add(jwtKeyFirstWait)
+	for {
+		err := s.locker.Run(ctx, jwtKeyLease, func(ctx context.Context) error {
+			if err := s.reload(ctx); err != nil {
+				return err
+			}
+			if _, _, err := s.SigningKey(); err == nil {
+				return nil
+			}
+			_, err := s.Rotate(ctx)
+			return err
+		})
+		if !errors.Is(err, lease.ErrHeld) {
+			return err
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for another instance to create the key")
+		}
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if err := s.reload(ctx); err != nil {
+			return err
+		}
+		if _, _, err := s.SigningKey(); err == nil {
+			return nil
+		}
+	}
+}
+
+// maintain prunes expired keys and rotates the signing key when due. One instance at a
+// time does so; the others only pick up its changes.
+func (s *jwtKeyService) maintain(ctx context.Context) error {
+	err := s.locker.Run(ctx, jwtKeyLease, func(ctx context.Context) error {
+		if deleted, err := s.keyRepo.DeleteExpired(ctx); err != nil {
+			return fmt.Errorf("failed to delete expired keys: %w", err)
+		} else if deleted > 0 {
+			s.logger.Info("Expired JWT signing keys deleted", "count", deleted)
+		}
+		if err := s.reload(ctx); err != nil {
+			return err
+		}
+
+		s.mu.RLock()
+		due := s.rotationInterval > 0 && (s.current == nil || time.Since(s.current.model.CreatedAt) >= s.rotationInterval)
+		s.mu.RUnlock()
+		if due {
+			_, err := s.Rotate(ctx)
+			return err
+		}
+		return nil
+	})
+	if errors.Is(err, lease.ErrHeld) {
+		return s.reload(ctx)
+	}
+	return err
+}
+
+// Rotate creates a new signing key and retires the current one. Tokens signed with the
+// retired key stay valid until they expire.
+func (s *jwtKeyService) Rotate(ctx context.Context) (*models.JWTSigningKey, error) {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(&private.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	jwk := publicJWK("", &private.PublicKey)
+	key := &models.JWTSigningKey{
+		ID:         jwkThumbprint(jwk),
+		Algorithm:  "ES256",
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER})),
+		PublicKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})),
+		CreatedAt:  time.Now(),
+	}
+	if err := s.keyRepo.Rotate(ctx, key, time.Now().Add(s.tokenLifetime)); err != nil {
+		return nil, fmt.Errorf("failed to store signing key: %w", err)
+	}
+	if err := s.reload(ctx); err != nil {
+		return nil, err
+	}
+
+	s.logger.Info("JWT signing key rotated", "kid", key.ID)
+	return key, nil
+}
+
+func (s *jwtKeyService) ListKeys(ctx context.Context) ([]*models.JWTSigningKey, error) {
+	return s.keyRepo.List(ctx)
+}
+
+// SigningKey returns the key new tokens are signed with
+func (s *jwtKeyService) SigningKey() (string, *ecdsa.PrivateKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.current == nil {
+		return "", nil, fmt.Errorf("no active JWT signing key")
+	}
+	return s.current.model.ID, s.current.private, nil
+}
+
+// PublicKey returns the key that validates tokens with the given kid. An unknown kid may
+// come from a key another API instance just created, so the keyset is reloaded once.
+func (s *jwtKeyService) PublicKey(kid string) (*ecdsa.PublicKey, error) {
+	if key := s.lookup(kid); key != nil {
+		return &key.private.PublicKey, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.reloadOlderThan(ctx, jwtKeyReloadBackoff); err != nil {
+		s.logger.Error("Failed to reload JWT signing keys", "error", err)
+	}
+	if key := s.lookup(kid); key != nil {
+		return &key.private.PublicKey, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// JWKS returns the public keys of every key that still validates tokens
+func (s *jwtKeyService) JWKS() *models.JWKS {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	valid := make([]*jwtSigningKey, 0, len(s.keys))
+	now := time.Now()
+	for _, key := range s.keys {
+		if key.model.ExpiresAt == nil || key.model.ExpiresAt.After(now) {
+			valid = append(valid, key)
+		}
+	}
+	sort.Slice(valid, func(i, j int) bool {
+		return valid[i].model.CreatedAt.After(valid[j].model.CreatedAt)
+	})
+
+	jwks := &models.JWKS{Keys: make([]models.JWK, 0, len(valid))}
+	for _, key := range valid {
+		jwks.Keys = append(jwks.Keys, publicJWK(key.model.ID, &key.private.PublicKey))
+	}
+	return jwks
+}
+
+func (s *jwtKeyService) lookup(kid string) *jwtSigningKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key := s.keys[kid]
+	if key == nil || (key.model.ExpiresAt != nil && key.model.ExpiresAt.Before(time.Now())) {
+		return nil
+	}
+	return key
+}
+
+// reload replaces the cached keyset with the keys in the database
+func (s *jwtKeyService) reload(ctx context.Context) error {
+	return s.reloadOlderThan(ctx, 0)
+}
+
+// reloadOlderThan reloads the keyset unless it was loaded within maxAge, so a burst of
+// tokens with an unknown kid causes a single query
+func (s *jwtKeyService) reloadOlderThan(ctx context.Context, maxAge time.Duration) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	s.mu.RLock()
+	fresh := maxAge > 0 && time.Since(s.lastReload) < maxAge
+	s.mu.RUnlock()
+	if fresh {
+		return nil
+	}
+
+	stored, err := s.keyRepo.List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load JWT signing keys: %w", err)
+	}
+
+	keys := make(map[string]*jwtSigningKey, len(stored))
+	var current *jwtSigningKey
+	for _, model := range stored {
+		private, err := parseSigningKey(model.PrivateKey)
+		if err != nil {
+			s.logger.Error("Skipping invalid JWT signing key", "kid", model.ID, "error", err)
+			continue
+		}
+		key := &jwtSigningKey{model: model, private: private}
+		keys[model.ID] = key
+		// Keys are listed newest first
+		if current == nil && model.RetiredAt == nil {
+			current = key
+		}
+	}
+
+	s.mu.Lock()
+	s.keys = keys
+	s.current = current
+	s.lastReload = time.Now()
+	s.mu.Unlock()
+	return nil
+}
+
+func parseSigningKey(data string) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, fmt.Errorf("invalid PEM")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	private, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok || private.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("not a P-256 key")
+	}
+	return private, nil
+}
+
+func publicJWK(kid string, public *ecdsa.PublicKey) models.JWK {
+	// The uncompressed point is 0x04 followed by the 32-byte X and Y coordinates
+	key, err := public.ECDH()
+	if err != nil {
+		return models.JWK{}
+	}
+	point := key.Bytes()
+	return models.JWK{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(point[1:33]),
+		Y:   base64.RawURLEncoding.EncodeToString(point[33:]),
+		Kid: kid,
+		Alg: "ES256",
+		Use: "sig",
+	}
+}
+
+// jwkThumbprint is the RFC 7638 thumbprint of a key, used as its kid
+func jwkThumbprint(jwk models.JWK) string {
+	// The required members in lexicographic order, without whitespace
+	data, _ := json.Marshal(struct {
+		Crv string `json:"crv"`
+		Kty string `json:"kty"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}{jwk.Crv, jwk.Kty, jwk.X, jwk.Y})
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
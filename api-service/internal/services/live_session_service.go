@@ -0,0 +1,241 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+
+	"hysteria2_microservices/api-service/internal/models"
+	"hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/cache"
+	"hysteria2_microservices/api-service/pkg/logger"
+)
+
+const (
+	// liveSessionTTL is how long a session outlives the last report of its node
+	liveSessionTTL = 90 * time.Second
+	// liveSessionKickTTL drops disconnect requests for nodes that stopped reporting
+	liveSessionKickTTL = 10 * time.Minute
+)
+
+// liveSessionService keeps every live session under its own key, expiring unless the node
+// reports again, and indexes the keys in a set per node and per user. Index members left
+// behind by expired sessions are pruned when the index is read.
+type liveSessionService struct {
+	redis  *cache.RedisClient
+	logger *logger.Logger
+}
+
+func NewLiveSessionService(redis *cache.RedisClient, logger *logger.Logger) interfaces.LiveSessionService {
+	return &liveSessionService{
+		redis:  redis,
+		logger: logger,
+	}
+}
+
+func liveSessionKey(nodeID, clientID string) string {
+	return fmt.Sprintf("live_session:%s:%s", nodeID, clientID)
+}
+
+func liveNodeSessionsKey(nodeID string) string {
+	return fmt.Sprintf("live_sessions:node:%s", nodeID)
+}
+
+func liveUserSessionsKey(userID string) string {
+	return fmt.Sprintf("live_sessions:user:%s", userID)
+}
+
+func liveSessionKicksKey(nodeID string) string {
+	return fmt.Sprintf("live_sessions:kick:%s", nodeID)
+}
+
+// Report applies the events of a node, keeps its sessions alive and returns the clients
+// the node should disconnect
+func (s *liveSessionService) Report(ctx context.Context, nodeID uuid.UUID, report *models.SessionReport) ([]string, error) {
+	node := nodeID.String()
+	now := time.Now()
+
+	connected := make(map[string]bool)
+	for i := range report.Events {
+		event := &report.Events[i]
+		if event.ClientID == "" {
+			continue
+		}
+		key := liveSessionKey(node, event.ClientID)
+		switch event.Type {
+		case "connect":
+			connected[key] = true
+			if err := s.connect(ctx, node, event, now); err != nil {
+				return nil, err
+			}
+		case "disconnect":
+			if err := s.remove(ctx, node, key); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	keys, err := s.redis.SMembers(ctx, liveNodeSessionsKey(node))
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if report.Resync && !connected[key] {
+			if err := s.remove(ctx, node, key); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := s.redis.Expire(ctx, key, liveSessionTTL); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.redis.Expire(ctx, liveNodeSessionsKey(node), liveSessionTTL); err != nil {
+		return nil, err
+	}
+
+	disconnect, err := s.redis.SMembers(ctx, liveSessionKicksKey(node))
+	if err != nil {
+		return nil, err
+	}
+	if len(disconnect) > 0 {
+		members := make([]interface{}, len(disconnect))
+		for i, clientID := range disconnect {
+			members[i] = clientID
+		}
+		if err := s.redis.SRem(ctx, liveSessionKicksKey(node), members...); err != nil {
+			return nil, err
+		}
+	}
+	return disconnect, nil
+}
+
+func (s *liveSessionService) connect(ctx context.Context, node string, event *models.SessionEvent, now time.Time) error {
+	key := liveSessionKey(node, event.ClientID)
+
+	session := &models.LiveSession{
+		ClientID:    event.ClientID,
+		UserID:      event.UserID,
+		DeviceID:    event.DeviceID,
+		NodeID:      node,
+		Protocol:    event.Protocol,
+		Connections: event.Connections,
+		ConnectedAt: event.Time,
+		UpdatedAt:   now,
+	}
+	var existing models.LiveSession
+	if err := s.redis.Get(ctx, key, &existing); err == nil {
+		session.ConnectedAt = existing.ConnectedAt
+	} else if !errors.Is(err, redis.Nil) {
+		return err
+	}
+	if session.ConnectedAt.IsZero() {
+		session.ConnectedAt = now
+	}
+
+	if err := s.redis.Set(ctx, key, session, liveSessionTTL); err != nil {
+		return err
+	}
+	if err := s.redis.SAdd(ctx, liveNodeSessionsKey(node), key); err != nil {
+		return err
+	}
+	if session.UserID != "" {
+		return s.redis.SAdd(ctx, liveUserSessionsKey(session.UserID), key)
+	}
+	return nil
+}
+
+func (s *liveSessionService) remove(ctx context.Context, node, key string) error {
+	var session models.LiveSession
+	if err := s.redis.Get(ctx, key, &session); err == nil && session.UserID != "" {
+		if err := s.redis.SRem(ctx, liveUserSessionsKey(session.UserID), key); err != nil {
+			return err
+		}
+	} else if err != nil && !errors.Is(err, redis.Nil) {
+		return err
+	}
+	if err := s.redis.Del(ctx, key); err != nil {
+		return err
+	}
+	return s.redis.SRem(ctx, liveNodeSessionsKey(node), key)
+}
+
+func (s *liveSessionService) ListByUser(ctx context.Context, userID uuid.UUID) ([]*models.LiveSession, error) {
+	return s.list(ctx, liveUserSessionsKey(userID.String()))
+}
+
+func (s *liveSessionService) ListByNode(ctx context.Context, nodeID uuid.UUID) ([]*models.LiveSession, error) {
+	return s.list(ctx, liveNodeSessionsKey(nodeID.String()))
+}
+
+// list returns the sessions indexed in a set, newest first
+func (s *liveSessionService) list(ctx context.Context, index string) ([]*models.LiveSession, error) {
+	keys, err := s.redis.SMembers(ctx, index)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]*models.LiveSession, 0, len(keys))
+	for _, key := range keys {
+		var session models.LiveSession
+		if err := s.redis.Get(ctx, key, &session); err != nil {
+			if !errors.Is(err, redis.Nil) {
+				return nil, err
+			}
+			// The node stopped reporting the session
+			if err := s.redis.SRem(ctx, index, key); err != nil {
+				s.logger.Error("Failed to prune expired live session", "key", key, "error", err)
+			}
+			continue
+		}
+		sessions = append(sessions, &session)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ConnectedAt.After(sessions[j].ConnectedAt)
+	})
+	return sessions, nil
+}
+
+// Disconnect asks the node to disconnect a client on its next report. It returns nil when
+// the client is not online.
+func (s *liveSessionService) Disconnect(ctx context.Context, nodeID uuid.UUID, clientID string) (*models.LiveSession, error) {
+	var session models.LiveSession
+	if err := s.redis.Get(ctx, liveSessionKey(nodeID.String(), clientID), &session); err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if err := s.kick(ctx, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// DisconnectUser asks every node to disconnect the user's clients and returns their sessions
+func (s *liveSessionService) DisconnectUser(ctx context.Context, userID uuid.UUID) ([]*models.LiveSession, error) {
+	sessions, err := s.ListByUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, session := range sessions {
+		if err := s.kick(ctx, session); err != nil {
+			return nil, err
+		}
+	}
+	return sessions, nil
+}
+
+func (s *liveSessionService) kick(ctx context.Context, session *models.LiveSession) error {
+	key := liveSessionKicksKey(session.NodeID)
+	if err := s.redis.SAdd(ctx, key, session.ClientID); err != nil {
+		return err
+	}
+	s.logger.Info("Live session disconnect requested", "node_id", session.NodeID, "client_id", session.ClientID)
+	return s.redis.Expire(ctx, key, liveSessionKickTTL)
+}
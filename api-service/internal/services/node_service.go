@@ -2,22 +2,27 @@ package services
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"hysteria2_microservices/api-service/internal/models"
 	repoInterfaces "hysteria2_microservices/api-service/internal/repositories/interfaces"
 	serviceInterfaces "hysteria2_microservices/api-service/internal/services/interfaces"
 	"hysteria2_microservices/api-service/pkg/logger"
 
 	"github.com/google/uuid"
+	"gorm.io/gorm"
 )
 
 type nodeService struct {
 	nodeRepo repoInterfaces.NodeRepository
+	userRepo repoInterfaces.UserRepository
 	logger   *logger.Logger
 }
 
-func NewNodeService(nodeRepo repoInterfaces.NodeRepository, logger *logger.Logger) serviceInterfaces.NodeService {
+func NewNodeService(nodeRepo repoInterfaces.NodeRepository, userRepo repoInterfaces.UserRepository, logger *logger.Logger) serviceInterfaces.NodeService {
 	return &nodeService{
 		nodeRepo: nodeRepo,
+		userRepo: userRepo,
 		logger:   logger,
 	}
 }
@@ -49,8 +54,7 @@ func (s *nodeService) ListNodes(ctx context.Context, page, limit int, statusFilt
 
 func (s *nodeService) GetNodeMetrics(ctx context.Context, nodeID uuid.UUID, limit int) ([]*models.NodeMetric, error) {
 	s.logger.Debug("Getting node metrics", "node_id", nodeID, "limit", limit)
-	// This would need a metrics repository - for now return empty
-	return []*models.NodeMetric{}, nil
+	return s.nodeRepo.GetMetricsByNodeIDs(ctx, []uuid.UUID{nodeID}, limit)
 }
 
 func (s *nodeService) RestartNode(ctx context.Context, nodeID uuid.UUID) error {
@@ -76,3 +80,47 @@ func (s *nodeService) GetOnlineNodes(ctx context.Context) ([]*models.VPSNode, er
 	s.logger.Debug("Getting online nodes")
 	return s.nodeRepo.GetOnlineNodes(ctx)
 }
+
+// GetUserNodes returns the nodes the user is assigned to
+func (s *nodeService) GetUserNodes(ctx context.Context, userID uuid.UUID) ([]*models.VPSNode, error) {
+	if _, err := s.userRepo.GetByID(ctx, userID); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, serviceInterfaces.ErrNotFound
+		}
+		return nil, err
+	}
+	return s.nodeRepo.GetAssignedNodes(ctx, userID)
+}
+
+// SetUserNodes replaces the user's assignments with nodeIDs; an empty list removes them all,
+// which offers the user every online node again
+func (s *nodeService) SetUserNodes(ctx context.Context, userID uuid.UUID, nodeIDs []uuid.UUID) ([]*models.VPSNode, error) {
+	if _, err := s.userRepo.GetByID(ctx, userID); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, serviceInterfaces.ErrNotFound
+		}
+		return nil, err
+	}
+
+	seen := make(map[uuid.UUID]bool, len(nodeIDs))
+	unique := make([]uuid.UUID, 0, len(nodeIDs))
+	for _, nodeID := range nodeIDs {
+		if seen[nodeID] {
+			continue
+		}
+		seen[nodeID] = true
+		if _, err := s.nodeRepo.GetByID(ctx, nodeID); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, fmt.Errorf("%w: %s", serviceInterfaces.ErrNodeNotFound, nodeID)
+			}
+			return nil, err
+		}
+		unique = append(unique, nodeID)
+	}
+
+	s.logger.Info("Assigning nodes", "user_id", userID, "nodes", len(unique))
+	if err := s.nodeRepo.SetAssignedNodes(ctx, userID, unique); err != nil {
+		return nil, fmt.Errorf("failed to assign nodes: %w", err)
+	}
+	return s.nodeRepo.GetAssignedNodes(ctx, userID)
+}
@@ -0,0 +1,173 @@
+package services
+
+import (
+	"context"
+	"fmt"
+
+	"hysteria2_microservices/api-service/internal/models"
+	serviceInterfaces "hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/logger"
+	"hysteria2_microservices/api-service/pkg/orchestrator"
+
+	"github.com/google/uuid"
+)
+
+// obfuscationService passes the obfuscation of nodes through to the orchestrator, which
+// keeps the applied settings and pushes them to the node's agent
+type obfuscationService struct {
+	orchestrator *orchestrator.Client // nil when no orchestrator gateway is configured
+	logger       *logger.Logger
+}
+
+func NewObfuscationService(orchestrator *orchestrator.Client, logger *logger.Logger) serviceInterfaces.ObfuscationService {
+	return &obfuscationService{
+		orchestrator: orchestrator,
+		logger:       logger,
+	}
+}
+
+func (s *obfuscationService) Get(ctx context.Context, nodeID uuid.UUID) (*models.NodeObfuscation, error) {
+	if err := s.available(); err != nil {
+		return nil, err
+	}
+	result, err := s.orchestrator.GetNodeObfuscation(ctx, nodeID.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get obfuscation: %w", err)
+	}
+	return nodeObfuscation(result), nil
+}
+
+// ApplyPreset applies a built-in or custom preset; an empty preset turns obfuscation off
+func (s *obfuscationService) ApplyPreset(ctx context.Context, nodeID uuid.UUID, preset string) (*models.NodeObfuscation, error) {
+	return s.apply(ctx, nodeID, preset, nil)
+}
+
+// ApplySettings replaces the node's obfuscation with settings of its own, outside any
+// preset
+func (s *obfuscationService) ApplySettings(ctx context.Context, nodeID uuid.UUID, settings *models.ObfuscationSettings) (*models.NodeObfuscation, error) {
+	return s.apply(ctx, nodeID, "", settings)
+}
+
+// Update switches single knobs on top of the settings applied to the node. The node leaves
+// its preset, if it had one.
+func (s *obfuscationService) Update(ctx context.Context, nodeID uuid.UUID, change *models.ObfuscationChange) (*models.NodeObfuscation, error) {
+	current, err := s.Get(ctx, nodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	settings := models.ObfuscationSettings{}
+	if current.Settings != nil {
+		settings = *current.Settings
+	}
+	applyObfuscationChange(&settings, change)
+	return s.apply(ctx, nodeID, "", &settings)
+}
+
+func (s *obfuscationService) apply(ctx context.Context, nodeID uuid.UUID, preset string, settings *models.ObfuscationSettings) (*models.NodeObfuscation, error) {
+	if err := s.available(); err != nil {
+		return nil, err
+	}
+
+	var custom *orchestrator.ObfuscationSettings
+	if settings != nil {
+		custom = &orchestrator.ObfuscationSettings{
+			Salamander:         settings.Salamander,
+			SalamanderPassword: settings.SalamanderPassword,
+			PortHopping:        settings.PortHopping,
+			HopStartPort:       settings.HopStartPort,
+			HopEndPort:         settings.HopEndPort,
+			HopInterval:        settings.HopInterval,
+			QUICObfuscation:    settings.QUICObfuscation,
+			PacketPadding:      settings.PacketPadding,
+			TimingJitterMs:     settings.TimingJitterMs,
+			Fingerprints:       settings.Fingerprints,
+			RealityTargets:     settings.RealityTargets,
+			TrafficShaping:     settings.TrafficShaping,
+		}
+	}
+
+	result, err := s.orchestrator.SetNodeObfuscation(ctx, nodeID.String(), preset, custom)
+	if err != nil {
+		return nil, fmt.Errorf("failed to apply obfuscation: %w", err)
+	}
+	applied := nodeObfuscation(result)
+	if applied.Settings != nil {
+		s.logger.Info("Obfuscation applied", "node_id", nodeID, "preset", preset,
+			"salamander", applied.Settings.Salamander, "port_hopping", applied.Settings.PortHopping,
+			"quic_obfuscation", applied.Settings.QUICObfuscation)
+	}
+	return applied, nil
+}
+
+func (s *obfuscationService) available() error {
+	if s.orchestrator == nil {
+		return fmt.Errorf("orchestrator gateway is not configured")
+	}
+	return nil
+}
+
+func nodeObfuscation(result *orchestrator.NodeObfuscation) *models.NodeObfuscation {
+	obfuscation := &models.NodeObfuscation{Preset: result.Preset}
+	if settings := result.Settings; settings != nil {
+		obfuscation.Settings = &models.ObfuscationSettings{
+			Salamander:         settings.Salamander,
+			SalamanderPassword: settings.SalamanderPassword,
+			PortHopping:        settings.PortHopping,
+			HopStartPort:       settings.HopStartPort,
+			HopEndPort:         settings.HopEndPort,
+			HopInterval:        settings.HopInterval,
+			QUICObfuscation:    settings.QUICObfuscation,
+			PacketPadding:      settings.PacketPadding,
+			TimingJitterMs:     settings.TimingJitterMs,
+			Fingerprints:       settings.Fingerprints,
+			RealityTargets:     settings.RealityTargets,
+			TrafficShaping:     settings.TrafficShaping,
+		}
+	}
+	return obfuscation
+}
+
+func applyObfuscationChange(settings *models.ObfuscationSettings, change *models.ObfuscationChange) {
+	if change.Salamander != nil {
+		settings.Salamander = *change.Salamander
+	}
+	if change.SalamanderPassword != nil {
+		settings.SalamanderPassword = *change.SalamanderPassword
+	}
+	if change.PortHopping != nil {
+		settings.PortHopping = *change.PortHopping
+	}
+	if change.HopStartPort != nil {
+		settings.HopStartPort = *change.HopStartPort
+	}
+	if change.HopEndPort != nil {
+		settings.HopEndPort = *change.HopEndPort
+	}
+	if change.HopInterval != nil {
+		settings.HopInterval = *change.HopInterval
+	}
+	if change.QUICObfuscation != nil {
+		settings.QUICObfuscation = *change.QUICObfuscation
+		// Padding and jitter are only valid on top of QUIC obfuscation
+		if !settings.QUICObfuscation {
+			settings.PacketPadding = 0
+			settings.TimingJitterMs = 0
+		}
+	}
+	if change.PacketPadding != nil {
+		settings.PacketPadding = *change.PacketPadding
+	}
+	if change.TimingJitterMs != nil {
+		settings.TimingJitterMs = *change.TimingJitterMs
+	}
+	if change.Fingerprints != nil {
+		settings.Fingerprints = change.Fingerprints
+	}
+	if change.RealityTargets != nil {
+		settings.RealityTargets = change.RealityTargets
+	}
+	if change.TrafficShaping != nil {
+		settings.TrafficShaping = *change.TrafficShaping
+	}
+}
@@ -0,0 +1,178 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"hysteria2_microservices/api-service/internal/models"
+	repoInterfaces "hysteria2_microservices/api-service/internal/repositories/interfaces"
+	serviceInterfaces "hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/logger"
+	"hysteria2_microservices/api-service/pkg/orchestrator"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// portForwardService keeps the port forwards users asked for. Quotas and ownership are
+// checked here; the node's agent checks the port against its range and the ports its
+// servers listen on, and installs the forward.
+type portForwardService struct {
+	repo         repoInterfaces.PortForwardRepository
+	userRepo     repoInterfaces.UserRepository
+	nodeRepo     repoInterfaces.NodeRepository
+	orchestrator *orchestrator.Client // nil when no orchestrator gateway is configured
+	quotas       map[string]int
+	defaultQuota int
+	logger       *logger.Logger
+}
+
+// NewPortForwardService takes the forwards a user may keep by plan, and the quota of users
+// of other plans
+func NewPortForwardService(repo repoInterfaces.PortForwardRepository, userRepo repoInterfaces.UserRepository, nodeRepo repoInterfaces.NodeRepository,
+	orchestrator *orchestrator.Client, quotas map[string]int, defaultQuota int, logger *logger.Logger) serviceInterfaces.PortForwardService {
+	return &portForwardService{
+		repo:         repo,
+		userRepo:     userRepo,
+		nodeRepo:     nodeRepo,
+		orchestrator: orchestrator,
+		quotas:       quotas,
+		defaultQuota: defaultQuota,
+		logger:       logger,
+	}
+}
+
+// Quota returns how many forwards the user's plan allows
+func (s *portForwardService) Quota(ctx context.Context, userID uuid.UUID) (int, error) {
+	user, err := s.userRepo.GetByID(ctx, userID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, serviceInterfaces.ErrNotFound
+		}
+		return 0, fmt.Errorf("failed to get user: %w", err)
+	}
+	if quota, ok := s.quotas[user.UserGroup]; ok {
+		return quota, nil
+	}
+	return s.defaultQuota, nil
+}
+
+func (s *portForwardService) ListUserForwards(ctx context.Context, userID uuid.UUID) ([]*models.PortForward, error) {
+	return s.repo.ListByUserID(ctx, userID)
+}
+
+func (s *portForwardService) ListForwards(ctx context.Context, nodeID *uuid.UUID) ([]*models.PortForward, error) {
+	return s.repo.List(ctx, nodeID)
+}
+
+// AddForward installs a forward for its user on a node they are assigned to, within the
+// quota of their plan. The forward is stored once the node has installed it.
+func (s *portForwardService) AddForward(ctx context.Context, forward *models.PortForward) error {
+	if err := s.available(); err != nil {
+		return err
+	}
+
+	quota, err := s.Quota(ctx, forward.UserID)
+	if err != nil {
+		return err
+	}
+	count, err := s.repo.CountByUserID(ctx, forward.UserID)
+	if err != nil {
+		return fmt.Errorf("failed to count port forwards: %w", err)
+	}
+	if count >= int64(quota) {
+		return fmt.Errorf("%w: %d of %d in use", serviceInterfaces.ErrPortForwardQuota, count, quota)
+	}
+
+	nodes, err := s.nodeRepo.GetAssignedNodes(ctx, forward.UserID)
+	if err != nil {
+		return fmt.Errorf("failed to get assigned nodes: %w", err)
+	}
+	assigned := false
+	for _, node := range nodes {
+		if node.ID == forward.NodeID {
+			assigned = true
+			break
+		}
+	}
+	if !assigned {
+		return serviceInterfaces.ErrNodeNotAssigned
+	}
+
+	taken, err := s.repo.PortTaken(ctx, forward.NodeID, forward.Protocol, forward.ListenPort)
+	if err != nil {
+		return fmt.Errorf("failed to check port: %w", err)
+	}
+	if taken {
+		return fmt.Errorf("%w: %s %d", serviceInterfaces.ErrPortTaken, forward.Protocol, forward.ListenPort)
+	}
+
+	forward.ID = uuid.New()
+	installed, err := s.orchestrator.AddPortForward(ctx, forward.NodeID.String(), orchestrator.PortForward{
+		ID:         forward.ID.String(),
+		Owner:      forward.UserID.String(),
+		Protocol:   forward.Protocol,
+		ListenPort: forward.ListenPort,
+		TargetHost: forward.TargetHost,
+		TargetPort: forward.TargetPort,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add port forward: %w", err)
+	}
+	// The agent normalises the target address
+	forward.TargetHost = installed.TargetHost
+
+	if err := s.repo.Create(ctx, forward); err != nil {
+		if removeErr := s.orchestrator.RemovePortForward(ctx, forward.NodeID.String(), forward.ID.String()); removeErr != nil {
+			s.logger.Error("Failed to remove unsaved port forward from node", "error", removeErr, "node_id", forward.NodeID, "id", forward.ID)
+		}
+		return fmt.Errorf("failed to create port forward: %w", err)
+	}
+	s.logger.Info("Port forward added", "id", forward.ID, "user_id", forward.UserID, "node_id", forward.NodeID,
+		"protocol", forward.Protocol, "listen_port", forward.ListenPort)
+	return nil
+}
+
+// RemoveForward removes a forward from its node and forgets it; with owner set, only a
+// forward of that user. A forward the node no longer has is forgotten all the same.
+func (s *portForwardService) RemoveForward(ctx context.Context, id uuid.UUID, owner *uuid.UUID) error {
+	if err := s.available(); err != nil {
+		return err
+	}
+
+	forward, err := s.repo.GetByID(ctx, id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return serviceInterfaces.ErrNotFound
+		}
+		return fmt.Errorf("failed to get port forward: %w", err)
+	}
+	if owner != nil && forward.UserID != *owner {
+		return serviceInterfaces.ErrNotFound
+	}
+
+	if err := s.orchestrator.RemovePortForward(ctx, forward.NodeID.String(), id.String()); err != nil {
+		var orchestratorErr *orchestrator.Error
+		if !errors.As(err, &orchestratorErr) || orchestratorErr.StatusCode != http.StatusNotFound {
+			return fmt.Errorf("failed to remove port forward: %w", err)
+		}
+	}
+
+	if err := s.repo.Delete(ctx, id); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return serviceInterfaces.ErrNotFound
+		}
+		return fmt.Errorf("failed to delete port forward: %w", err)
+	}
+	s.logger.Info("Port forward removed", "id", id, "user_id", forward.UserID, "node_id", forward.NodeID)
+	return nil
+}
+
+func (s *portForwardService) available() error {
+	if s.orchestrator == nil {
+		return fmt.Errorf("orchestrator gateway is not configured")
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/models"
+	repoInterfaces "hysteria2_microservices/api-service/internal/repositories/interfaces"
+	serviceInterfaces "hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/cache"
+	"hysteria2_microservices/api-service/pkg/logger"
+
+	"github.com/google/uuid"
+)
+
+const (
+	erasurePollInterval = 30 * time.Second
+	erasureBatch        = 10
+	// An erasure running this long was left behind by an instance that stopped, and one
+	// that failed is retried after as long; erasing twice is harmless
+	erasureStaleAfter = 30 * time.Minute
+)
+
+type privacyService struct {
+	privacyRepo        repoInterfaces.PrivacyRepository
+	userRepo           repoInterfaces.UserRepository
+	liveSessionService serviceInterfaces.LiveSessionService
+	analyticsService   serviceInterfaces.AnalyticsService
+	redis              *cache.RedisClient
+	logger             *logger.Logger
+
+	wake     chan struct{}
+	stopChan chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+func NewPrivacyService(privacyRepo repoInterfaces.PrivacyRepository, userRepo repoInterfaces.UserRepository,
+	liveSessionService serviceInterfaces.LiveSessionService, analyticsService serviceInterfaces.AnalyticsService,
+	redis *cache.RedisClient, logger *logger.Logger) serviceInterfaces.PrivacyService {
+	return &privacyService{
+		privacyRepo:        privacyRepo,
+		userRepo:           userRepo,
+		liveSessionService: liveSessionService,
+		analyticsService:   analyticsService,
+		redis:              redis,
+		logger:             logger,
+		wake:               make(chan struct{}, 1),
+		stopChan:           make(chan struct{}),
+	}
+}
+
+func (s *privacyService) ExportUser(ctx context.Context, userID uuid.UUID) (*models.UserDataExport, error) {
+	export, err := s.privacyRepo.ExportUser(ctx, userID)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return export, nil
+}
+
+// RequestErasure queues an erasure of the user and returns it pending. A user has one
+// erasure in progress at a time; a failed one is retried until it completes.
+func (s *privacyService) RequestErasure(ctx context.Context, userID uuid.UUID, mode string, requestedBy *uuid.UUID) (*models.DataErasure, error) {
+	if _, err := s.userRepo.GetByID(ctx, userID); err != nil {
+		return nil, notFound(err)
+	}
+	open, err := s.privacyRepo.HasOpenErasure(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if open {
+		return nil, serviceInterfaces.ErrErasureInProgress
+	}
+
+	erasure := &models.DataErasure{
+		UserID:      userID,
+		Mode:        mode,
+		Status:      models.ErasurePending,
+		RequestedBy: requestedBy,
+	}
+	if err := s.privacyRepo.CreateErasure(ctx, erasure); err != nil {
+		return nil, err
+	}
+
+	s.logger.Info("Data erasure requested", "erasure_id", erasure.ID, "user_id", userID, "mode", mode)
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return erasure, nil
+}
+
+func (s *privacyService) GetErasure(ctx context.Context, id uuid.UUID) (*models.DataErasure, error) {
+	erasure, err := s.privacyRepo.GetErasure(ctx, id)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return erasure, nil
+}
+
+func (s *privacyService) ListErasures(ctx context.Context, page, limit int) ([]*models.DataErasure, int64, error) {
+	return s.privacyRepo.ListErasures(ctx, (page-1)*limit, limit)
+}
+
+func (s *privacyService) Start(ctx context.Context) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(erasurePollInterval)
+		defer ticker.Stop()
+
+		for {
+			s.runPending(ctx)
+
+			select {
+			case <-ticker.C:
+			case <-s.wake:
+			case <-ctx.Done():
+				return
+			case <-s.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+func (s *privacyService) Stop() {
+	s.stopOnce.Do(func() { close(s.stopChan) })
+	s.wg.Wait()
+}
+
+// runPending runs the erasures waiting to run. Every instance of the service polls; the
+// claim lets one of them run each erasure.
+func (s *privacyService) runPending(ctx context.Context) {
+	erasures, err := s.privacyRepo.ListRunnable(ctx, time.Now().Add(-erasureStaleAfter), erasureBatch)
+	if err != nil {
+		s.logger.Error("Failed to list pending data erasures", "error", err)
+		return
+	}
+
+	for _, erasure := range erasures {
+		claimed, err := s.privacyRepo.ClaimErasure(ctx, erasure, time.Now())
+		if err != nil {
+			s.logger.Error("Failed to claim data erasure", "erasure_id", erasure.ID, "error", err)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+
+		s.run(ctx, erasure)
+		if err := s.privacyRepo.FinishErasure(ctx, erasure); err != nil {
+			s.logger.Error("Failed to record data erasure", "erasure_id", erasure.ID, "error", err)
+		}
+	}
+}
+
+// run erases the user's data and fills in the outcome: the certificate on success, the
+// error otherwise
+func (s *privacyService) run(ctx context.Context, erasure *models.DataErasure) {
+	err := s.erase(ctx, erasure)
+	// Whole seconds, so the time read back from the database gives the same certificate
+	completedAt := time.Now().UTC().Truncate(time.Second)
+	erasure.CompletedAt = &completedAt
+	if err != nil {
+		erasure.Status = models.ErasureFailed
+		erasure.Error = err.Error()
+		s.logger.Error("Data erasure failed", "erasure_id", erasure.ID, "user_id", erasure.UserID, "error", err)
+		return
+	}
+
+	erasure.Status = models.ErasureCompleted
+	erasure.Error = ""
+	erasure.Certificate = erasureCertificate(erasure)
+	s.logger.Info("Data erasure completed", "erasure_id", erasure.ID, "user_id", erasure.UserID, "mode", erasure.Mode)
+}
+
+func (s *privacyService) erase(ctx context.Context, erasure *models.DataErasure) error {
+	// Disconnect the user first; once their configs are gone they cannot connect again
+	if _, err := s.liveSessionService.DisconnectUser(ctx, erasure.UserID); err != nil {
+		s.logger.Warn("Failed to disconnect user being erased", "user_id", erasure.UserID, "error", err)
+	}
+
+	var err error
+	anonymize := erasure.Mode == models.ErasureAnonymize
+	if anonymize {
+		erasure.Records, err = s.privacyRepo.AnonymizeUser(ctx, erasure.UserID)
+	} else {
+		erasure.Records, err = s.privacyRepo.DeleteUser(ctx, erasure.UserID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to erase stored data: %w", err)
+	}
+
+	s.redis.Del(ctx, fmt.Sprintf("user:%s", erasure.UserID.String()), fmt.Sprintf("user_devices:%s", erasure.UserID.String()))
+
+	if s.analyticsService.Enabled() {
+		if err := s.analyticsService.EraseUser(ctx, erasure.UserID, anonymize); err != nil {
+			return fmt.Errorf("failed to erase analytics: %w", err)
+		}
+		erasure.AnalyticsErased = true
+	}
+	return nil
+}
+
+// erasureCertificate is the SHA-256 digest of what an erasure did, so a certificate kept
+// elsewhere can be checked against the record
+func erasureCertificate(erasure *models.DataErasure) string {
+	data, _ := json.Marshal(struct {
+		ID              uuid.UUID        `json:"id"`
+		UserID          uuid.UUID        `json:"user_id"`
+		Mode            string           `json:"mode"`
+		Records         map[string]int64 `json:"records"`
+		AnalyticsErased bool             `json:"analytics_erased"`
+		CompletedAt     time.Time        `json:"completed_at"`
+	}{erasure.ID, erasure.UserID, erasure.Mode, erasure.Records, erasure.AnalyticsErased, erasure.CompletedAt.UTC()})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
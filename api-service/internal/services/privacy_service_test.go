@@ -0,0 +1,224 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/models"
+	repoInterfaces "hysteria2_microservices/api-service/internal/repositories/interfaces"
+	serviceInterfaces "hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/cache"
+	"hysteria2_microservices/api-service/pkg/logger"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// fakePrivacyRepo keeps erasures in memory; claimedBy holds those another instance has
+// claimed already
+type fakePrivacyRepo struct {
+	repoInterfaces.PrivacyRepository
+	erasures  []*models.DataErasure
+	claimedBy map[uuid.UUID]bool
+	finished  []*models.DataErasure
+	deleted   []uuid.UUID
+}
+
+func (f *fakePrivacyRepo) HasOpenErasure(ctx context.Context, userID uuid.UUID) (bool, error) {
+	for _, erasure := range f.erasures {
+		if erasure.UserID == userID && erasure.Status != models.ErasureCompleted {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (f *fakePrivacyRepo) CreateErasure(ctx context.Context, erasure *models.DataErasure) error {
+	erasure.ID = uuid.New()
+	f.erasures = append(f.erasures, erasure)
+	return nil
+}
+
+func (f *fakePrivacyRepo) ListRunnable(ctx context.Context, staleBefore time.Time, limit int) ([]*models.DataErasure, error) {
+	var runnable []*models.DataErasure
+	for _, erasure := range f.erasures {
+		if erasure.Status == models.ErasurePending {
+			runnable = append(runnable, erasure)
+		}
+	}
+	return runnable, nil
+}
+
+func (f *fakePrivacyRepo) ClaimErasure(ctx context.Context, erasure *models.DataErasure, startedAt time.Time) (bool, error) {
+	if f.claimedBy[erasure.ID] {
+		return false, nil
+	}
+	erasure.Status = models.ErasureRunning
+	erasure.StartedAt = &startedAt
+	return true, nil
+}
+
+func (f *fakePrivacyRepo) FinishErasure(ctx context.Context, erasure *models.DataErasure) error {
+	f.finished = append(f.finished, erasure)
+	return nil
+}
+
+func (f *fakePrivacyRepo) DeleteUser(ctx context.Context, userID uuid.UUID) (map[string]int64, error) {
+	f.deleted = append(f.deleted, userID)
+	return map[string]int64{"users": 1, "devices": 2}, nil
+}
+
+// erasureUsers knows a single user
+type erasureUsers struct {
+	repoInterfaces.UserRepository
+	id uuid.UUID
+}
+
+func (u erasureUsers) GetByID(ctx context.Context, id uuid.UUID) (*models.User, error) {
+	if id != u.id {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &models.User{ID: id}, nil
+}
+
+type erasureSessions struct {
+	serviceInterfaces.LiveSessionService
+	disconnected []uuid.UUID
+}
+
+func (s *erasureSessions) DisconnectUser(ctx context.Context, userID uuid.UUID) ([]*models.LiveSession, error) {
+	s.disconnected = append(s.disconnected, userID)
+	return nil, nil
+}
+
+type erasureAnalytics struct {
+	serviceInterfaces.AnalyticsService
+	err error
+}
+
+func (a erasureAnalytics) Enabled() bool { return true }
+
+func (a erasureAnalytics) EraseUser(ctx context.Context, userID uuid.UUID, anonymize bool) error {
+	return a.err
+}
+
+// unreachableRedis fails every command at once; erasures only clear caches through it
+func unreachableRedis(t *testing.T) *cache.RedisClient {
+	redis := cache.NewRedisClient("redis://127.0.0.1:1/0?max_retries=-1")
+	t.Cleanup(func() { redis.Close() })
+	return redis
+}
+
+func newTestPrivacyService(t *testing.T, repo *fakePrivacyRepo, userID uuid.UUID, analytics erasureAnalytics) (*privacyService, *erasureSessions) {
+	sessions := &erasureSessions{}
+	s := NewPrivacyService(repo, erasureUsers{id: userID}, sessions, analytics, unreachableRedis(t), logger.NewLogger("error"))
+	return s.(*privacyService), sessions
+}
+
+func TestRequestErasure(t *testing.T) {
+	userID := uuid.New()
+	repo := &fakePrivacyRepo{}
+	s, _ := newTestPrivacyService(t, repo, userID, erasureAnalytics{})
+	ctx := context.Background()
+
+	if _, err := s.RequestErasure(ctx, uuid.New(), models.ErasureDelete, nil); !errors.Is(err, serviceInterfaces.ErrNotFound) {
+		t.Errorf("erasure of an unknown user = %v, want ErrNotFound", err)
+	}
+	erasure, err := s.RequestErasure(ctx, userID, models.ErasureDelete, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if erasure.Status != models.ErasurePending || erasure.UserID != userID {
+		t.Errorf("erasure = %+v, want pending", erasure)
+	}
+	// The worker is woken up to run it
+	select {
+	case <-s.wake:
+	default:
+		t.Error("worker not woken")
+	}
+	if _, err := s.RequestErasure(ctx, userID, models.ErasureAnonymize, nil); !errors.Is(err, serviceInterfaces.ErrErasureInProgress) {
+		t.Errorf("second erasure = %v, want ErrErasureInProgress", err)
+	}
+}
+
+func TestRunPendingErasures(t *testing.T) {
+	userID := uuid.New()
+	ctx := context.Background()
+
+	t.Run("completed", func(t *testing.T) {
+		repo := &fakePrivacyRepo{}
+		s, sessions := newTestPrivacyService(t, repo, userID, erasureAnalytics{})
+		erasure, err := s.RequestErasure(ctx, userID, models.ErasureDelete, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.runPending(ctx)
+
+		if len(repo.finished) != 1 || erasure.Status != models.ErasureCompleted || erasure.Error != "" {
+			t.Fatalf("erasure = %+v, want it completed", erasure)
+		}
+		if len(sessions.disconnected) != 1 || len(repo.deleted) != 1 || !erasure.AnalyticsErased || erasure.Records["devices"] != 2 {
+			t.Errorf("erasure = %+v, disconnected %v, deleted %v", erasure, sessions.disconnected, repo.deleted)
+		}
+		if erasure.Certificate == "" || erasure.Certificate != erasureCertificate(erasure) {
+			t.Errorf("certificate = %q, want the digest of the erasure", erasure.Certificate)
+		}
+	})
+
+	t.Run("analytics failed", func(t *testing.T) {
+		repo := &fakePrivacyRepo{}
+		s, _ := newTestPrivacyService(t, repo, userID, erasureAnalytics{err: errors.New("clickhouse unavailable")})
+		erasure, err := s.RequestErasure(ctx, userID, models.ErasureDelete, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.runPending(ctx)
+		if erasure.Status != models.ErasureFailed || erasure.Error == "" || erasure.Certificate != "" {
+			t.Errorf("erasure = %+v, want it failed without a certificate", erasure)
+		}
+	})
+
+	t.Run("claimed elsewhere", func(t *testing.T) {
+		repo := &fakePrivacyRepo{claimedBy: map[uuid.UUID]bool{}}
+		s, _ := newTestPrivacyService(t, repo, userID, erasureAnalytics{})
+		erasure, err := s.RequestErasure(ctx, userID, models.ErasureDelete, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		repo.claimedBy[erasure.ID] = true
+		s.runPending(ctx)
+		if len(repo.finished) != 0 || len(repo.deleted) != 0 {
+			t.Errorf("ran an erasure another instance claimed: finished %v, deleted %v", repo.finished, repo.deleted)
+		}
+	})
+}
+
+func TestErasureCertificate(t *testing.T) {
+	completedAt := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	erasure := &models.DataErasure{
+		ID:          uuid.New(),
+		UserID:      uuid.New(),
+		Mode:        models.ErasureDelete,
+		Records:     map[string]int64{"users": 1, "devices": 2},
+		CompletedAt: &completedAt,
+	}
+	certificate := erasureCertificate(erasure)
+	if len(certificate) != 64 {
+		t.Fatalf("certificate = %q, want a hex SHA-256", certificate)
+	}
+
+	// The time read back in another zone gives the same certificate
+	local := completedAt.In(time.FixedZone("UTC+3", 3*60*60))
+	copied := *erasure
+	copied.CompletedAt = &local
+	if erasureCertificate(&copied) != certificate {
+		t.Error("certificate depends on the time zone")
+	}
+	copied.Records = map[string]int64{"users": 1, "devices": 3}
+	if erasureCertificate(&copied) == certificate {
+		t.Error("certificate does not cover the records")
+	}
+}
@@ -0,0 +1,27 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	serviceInterfaces "hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/cache"
+)
+
+// countAttempt counts an attempt under key and returns ErrRateLimited once more than limit
+// attempts were counted within window; a limit of 0 disables it
+func countAttempt(ctx context.Context, redis *cache.RedisClient, key string, limit int, window time.Duration) error {
+	if limit <= 0 {
+		return nil
+	}
+	attempts, err := redis.IncrWindow(ctx, key, window)
+	if err != nil {
+		// Fail closed: without the counter the limit cannot be enforced
+		return fmt.Errorf("failed to count attempt: %w", err)
+	}
+	if attempts > int64(limit) {
+		return serviceInterfaces.ErrRateLimited
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	serviceInterfaces "hysteria2_microservices/api-service/internal/services/interfaces"
+)
+
+func TestCountAttempt(t *testing.T) {
+	redis := testRedis(t)
+	ctx := context.Background()
+	key := "test_attempts:" + t.Name()
+	redis.Del(ctx, key)
+	t.Cleanup(func() { redis.Del(ctx, key) })
+
+	for i := 0; i < 3; i++ {
+		if err := countAttempt(ctx, redis, key, 3, time.Minute); err != nil {
+			t.Fatalf("attempt %d: %v", i+1, err)
+		}
+	}
+	if err := countAttempt(ctx, redis, key, 3, time.Minute); !errors.Is(err, serviceInterfaces.ErrRateLimited) {
+		t.Errorf("attempt over the limit = %v, want ErrRateLimited", err)
+	}
+	// The counter expires with its first attempt's window
+	if ttl, err := redis.TTL(ctx, key); err != nil || ttl <= 0 || ttl > time.Minute {
+		t.Errorf("counter TTL = %v, %v; want within the window", ttl, err)
+	}
+
+	// A limit of 0 counts nothing
+	if err := countAttempt(ctx, nil, key, 0, time.Minute); err != nil {
+		t.Errorf("disabled limit = %v", err)
+	}
+}
@@ -0,0 +1,170 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/models"
+	repoInterfaces "hysteria2_microservices/api-service/internal/repositories/interfaces"
+	serviceInterfaces "hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/logger"
+
+	"gorm.io/gorm"
+)
+
+// reachabilityService combines client telemetry and node probes by the client's ASN, so
+// operators can tell which protocols get through which ISPs, and keeps the per-ASN protocol
+// policies subscriptions apply
+type reachabilityService struct {
+	telemetryRepo repoInterfaces.TelemetryRepository
+	policyRepo    repoInterfaces.ASNPolicyRepository
+	logger        *logger.Logger
+}
+
+func NewReachabilityService(
+	telemetryRepo repoInterfaces.TelemetryRepository,
+	policyRepo repoInterfaces.ASNPolicyRepository,
+	logger *logger.Logger,
+) serviceInterfaces.ReachabilityService {
+	return &reachabilityService{
+		telemetryRepo: telemetryRepo,
+		policyRepo:    policyRepo,
+		logger:        logger,
+	}
+}
+
+// GetReachability returns every ASN with telemetry, probers or a policy, those with the
+// most attempts first
+func (s *reachabilityService) GetReachability(ctx context.Context, since time.Time) ([]*models.ASNReachability, error) {
+	protocols, err := s.telemetryRepo.GetReachability(ctx, since)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get telemetry: %w", err)
+	}
+	probes, err := s.telemetryRepo.GetProbeSummaries(ctx, since)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get probe reports: %w", err)
+	}
+	policies, err := s.policyRepo.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ASN protocol policies: %w", err)
+	}
+
+	byASN := make(map[uint32]*models.ASNReachability)
+	entry := func(asn uint32) *models.ASNReachability {
+		if r, ok := byASN[asn]; ok {
+			return r
+		}
+		r := &models.ASNReachability{
+			ASN:                  asn,
+			Protocols:            []*models.ProtocolReachability{},
+			RecommendedProtocols: []string{},
+			SuggestedProtocols:   []string{},
+		}
+		byASN[asn] = r
+		return r
+	}
+
+	successes := make(map[uint32]int)
+	ispAttempts := make(map[uint32]int)
+	for _, row := range protocols {
+		r := entry(row.ASN)
+		r.Protocols = append(r.Protocols, row)
+		r.Attempts += row.Attempts
+		successes[row.ASN] += row.Successes
+		// Named as reported with the protocol most attempts were made with
+		if row.ISP != "" && row.Attempts > ispAttempts[row.ASN] {
+			r.ISP = row.ISP
+			ispAttempts[row.ASN] = row.Attempts
+		}
+	}
+	for _, probe := range probes {
+		entry(probe.ASN).Probes = probe
+	}
+	for _, policy := range policies {
+		r := entry(policy.ASN)
+		r.RecommendedProtocols = policy.Protocols
+		if r.ISP == "" {
+			r.ISP = policy.Name
+		}
+	}
+
+	result := make([]*models.ASNReachability, 0, len(byASN))
+	for asn, r := range byASN {
+		if r.Attempts > 0 {
+			r.SuccessRate = float64(successes[asn]) / float64(r.Attempts)
+		}
+		r.SuggestedProtocols = suggestProtocols(r.Protocols)
+		result = append(result, r)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Attempts != result[j].Attempts {
+			return result[i].Attempts > result[j].Attempts
+		}
+		return result[i].ASN < result[j].ASN
+	})
+	return result, nil
+}
+
+// suggestProtocols orders the subscription protocols with enough attempts by success rate
+func suggestProtocols(rows []*models.ProtocolReachability) []string {
+	var candidates []*models.ProtocolReachability
+	for _, row := range rows {
+		if row.Attempts >= recommendMinTelemetry && slices.Contains(subscriptionProtocols, row.Protocol) {
+			candidates = append(candidates, row)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].SuccessRate > candidates[j].SuccessRate
+	})
+
+	suggested := make([]string, 0, len(candidates))
+	for _, row := range candidates {
+		suggested = append(suggested, row.Protocol)
+	}
+	return suggested
+}
+
+func (s *reachabilityService) ListPolicies(ctx context.Context) ([]*models.ASNProtocolPolicy, error) {
+	return s.policyRepo.List(ctx)
+}
+
+// SetPolicy creates or replaces the protocol policy of policy.ASN
+func (s *reachabilityService) SetPolicy(ctx context.Context, policy *models.ASNProtocolPolicy) error {
+	if policy.ASN == 0 {
+		return fmt.Errorf("%w: ASN is required", serviceInterfaces.ErrPolicyInvalid)
+	}
+	if len(policy.Protocols) == 0 {
+		return fmt.Errorf("%w: at least one protocol is required", serviceInterfaces.ErrPolicyInvalid)
+	}
+	seen := make(map[string]bool, len(policy.Protocols))
+	for _, protocol := range policy.Protocols {
+		if !slices.Contains(subscriptionProtocols, protocol) {
+			return fmt.Errorf("%w: unknown protocol %q", serviceInterfaces.ErrPolicyInvalid, protocol)
+		}
+		if seen[protocol] {
+			return fmt.Errorf("%w: protocol %q is listed twice", serviceInterfaces.ErrPolicyInvalid, protocol)
+		}
+		seen[protocol] = true
+	}
+
+	if err := s.policyRepo.Save(ctx, policy); err != nil {
+		return fmt.Errorf("failed to save ASN protocol policy: %w", err)
+	}
+	s.logger.Info("ASN protocol policy set", "asn", policy.ASN, "protocols", policy.Protocols)
+	return nil
+}
+
+func (s *reachabilityService) DeletePolicy(ctx context.Context, asn uint32) error {
+	if err := s.policyRepo.Delete(ctx, asn); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return serviceInterfaces.ErrNotFound
+		}
+		return fmt.Errorf("failed to delete ASN protocol policy: %w", err)
+	}
+	s.logger.Info("ASN protocol policy removed", "asn", asn)
+	return nil
+}
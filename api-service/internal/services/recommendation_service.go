@@ -0,0 +1,290 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/models"
+	repoInterfaces "hysteria2_microservices/api-service/internal/repositories/interfaces"
+	serviceInterfaces "hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/geoip"
+	"hysteria2_microservices/api-service/pkg/logger"
+
+	"github.com/google/uuid"
+)
+
+// Score weights; latency dominates and load and headroom break ties between close nodes
+const (
+	recommendLatencyWeight  = 0.6
+	recommendLoadWeight     = 0.2
+	recommendHeadroomWeight = 0.2
+
+	// recommendLatencyScale is the latency in ms that halves the latency score
+	recommendLatencyScale = 50.0
+	// Nodes without speedtests for the region score like a 150 ms node, so measured
+	// nearby nodes win but an unmeasured node still beats a distant one
+	recommendUnknownLatencyScore = 0.25
+	// Nodes without metrics are assumed half loaded
+	recommendUnknownLoad = 0.5
+	// Client telemetry scales the score by the node's success rate once it holds this many
+	// connection attempts from the client's country
+	recommendMinTelemetry = 20
+
+	// Node metadata keys holding the capacity set by operators
+	nodeMaxUsersKey       = "max_users"
+	nodeMaxConnectionsKey = "max_connections"
+	nodeMaxMbpsKey        = "max_mbps"
+
+	defaultRecommendLimit = 5
+	maxRecommendLimit     = 50
+)
+
+type recommendationService struct {
+	nodeRepo       repoInterfaces.NodeRepository
+	telemetryRepo  repoInterfaces.TelemetryRepository
+	geoDB          *geoip.DB
+	countryRegions map[string]string
+	latencyWindow  time.Duration
+	logger         *logger.Logger
+}
+
+// NewRecommendationService creates a node recommender. geoDB may be nil, in which case
+// clients are located only by the country they or their CDN pass in. regionCountries maps
+// speedtest regions to the ISO country codes whose clients they stand in for.
+func NewRecommendationService(
+	nodeRepo repoInterfaces.NodeRepository,
+	telemetryRepo repoInterfaces.TelemetryRepository,
+	geoDB *geoip.DB,
+	regionCountries map[string][]string,
+	latencyWindow time.Duration,
+	logger *logger.Logger,
+) serviceInterfaces.RecommendationService {
+	if latencyWindow <= 0 {
+		latencyWindow = 24 * time.Hour
+	}
+
+	// Sorted so a country listed under several regions always resolves to the same one
+	regions := make([]string, 0, len(regionCountries))
+	for region := range regionCountries {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+
+	countryRegions := make(map[string]string)
+	for _, region := range regions {
+		for _, country := range regionCountries[region] {
+			country = strings.ToUpper(country)
+			if _, ok := countryRegions[country]; !ok {
+				countryRegions[country] = region
+			}
+		}
+	}
+
+	return &recommendationService{
+		nodeRepo:       nodeRepo,
+		telemetryRepo:  telemetryRepo,
+		geoDB:          geoDB,
+		countryRegions: countryRegions,
+		latencyWindow:  latencyWindow,
+		logger:         logger,
+	}
+}
+
+// Locate fills in the country from the IP and the region from the country, keeping any
+// field the caller already set
+func (s *recommendationService) Locate(loc models.ClientLocation) models.ClientLocation {
+	loc.Country = strings.ToUpper(strings.TrimSpace(loc.Country))
+	if loc.Country == "" && loc.IP != "" {
+		loc.Country = s.geoDB.Country(loc.IP)
+	}
+	if loc.Region == "" && loc.Country != "" {
+		loc.Region = s.countryRegions[loc.Country]
+	}
+	return loc
+}
+
+// Recommend ranks the online nodes for the client location, best first. Nodes at capacity
+// are left out.
+func (s *recommendationService) Recommend(ctx context.Context, loc models.ClientLocation, limit int) ([]*models.NodeRecommendation, error) {
+	if limit <= 0 {
+		limit = defaultRecommendLimit
+	}
+	if limit > maxRecommendLimit {
+		limit = maxRecommendLimit
+	}
+
+	nodes, err := s.nodeRepo.GetOnlineNodes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get online nodes: %w", err)
+	}
+
+	ranked, err := s.RankNodes(ctx, nodes, loc)
+	if err != nil {
+		return nil, err
+	}
+	available := ranked[:0]
+	for _, rec := range ranked {
+		if !rec.Full {
+			available = append(available, rec)
+		}
+	}
+	ranked = available
+	if len(ranked) > limit {
+		ranked = ranked[:limit]
+	}
+	return ranked, nil
+}
+
+// RankNodes scores the given nodes for the client location and returns them best first.
+// The score blends the region's average speedtest latency with the node's latest load
+// and its headroom under the capacity set in its metadata, scaled by the share of client
+// connections from the client's country that succeeded. Nodes at capacity rank last.
+func (s *recommendationService) RankNodes(ctx context.Context, nodes []*models.VPSNode, loc models.ClientLocation) ([]*models.NodeRecommendation, error) {
+	if len(nodes) == 0 {
+		return []*models.NodeRecommendation{}, nil
+	}
+	loc = s.Locate(loc)
+
+	latencies := make(map[uuid.UUID]*models.RegionLatency)
+	if loc.Region != "" {
+		rows, err := s.nodeRepo.GetRegionLatencies(ctx, loc.Region, time.Now().Add(-s.latencyWindow))
+		if err != nil {
+			return nil, fmt.Errorf("failed to get region latencies: %w", err)
+		}
+		for _, row := range rows {
+			latencies[row.NodeID] = row
+		}
+	}
+
+	nodeIDs := make([]uuid.UUID, 0, len(nodes))
+	for _, node := range nodes {
+		nodeIDs = append(nodeIDs, node.ID)
+	}
+	metrics, err := s.nodeRepo.GetMetricsByNodeIDs(ctx, nodeIDs, 1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get node metrics: %w", err)
+	}
+	latestMetrics := make(map[uuid.UUID]*models.NodeMetric, len(metrics))
+	for _, metric := range metrics {
+		latestMetrics[metric.NodeID] = metric
+	}
+	users, err := s.nodeRepo.CountActiveUsersByNodeIDs(ctx, nodeIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count node users: %w", err)
+	}
+	reliability, err := s.telemetryRepo.GetNodeReliability(ctx, models.TelemetryFilter{ASN: loc.ASN, Country: loc.Country}, time.Now().Add(-s.latencyWindow))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get node reliability: %w", err)
+	}
+	successRates := make(map[uuid.UUID]float64, len(reliability))
+	for _, row := range reliability {
+		if row.Attempts >= recommendMinTelemetry {
+			successRates[row.NodeID] = row.SuccessRate
+		}
+	}
+
+	ranked := make([]*models.NodeRecommendation, 0, len(nodes))
+	for _, node := range nodes {
+		rec := &models.NodeRecommendation{
+			Node:     node,
+			Load:     recommendUnknownLoad,
+			Headroom: 1 - recommendUnknownLoad,
+			Users:    users[node.ID],
+		}
+
+		latencyScore := recommendUnknownLatencyScore
+		if latency, ok := latencies[node.ID]; ok {
+			avgLatency, avgDownload := latency.AvgLatencyMs, latency.AvgDownloadMbps
+			rec.LatencyMs = &avgLatency
+			rec.DownloadMbps = &avgDownload
+			latencyScore = recommendLatencyScale / (recommendLatencyScale + avgLatency)
+		}
+
+		// Headroom is what is left under the tightest cap; without caps it follows the load
+		capacity := nodeCapacity(node)
+		var headrooms []float64
+		if capacity.maxUsers > 0 {
+			headrooms = append(headrooms, 1-float64(rec.Users)/float64(capacity.maxUsers))
+		}
+		if metric, ok := latestMetrics[node.ID]; ok {
+			rec.Load = clampUnit(max(metric.CPUUsage, metric.MemoryUsage) / 100)
+			rec.Headroom = 1 - rec.Load
+			if capacity.maxConnections > 0 {
+				headrooms = append(headrooms, 1-float64(metric.ActiveConnections)/float64(capacity.maxConnections))
+			}
+			if capacity.maxMbps > 0 {
+				// Bandwidth is recorded in bytes per second
+				mbps := float64(max(metric.BandwidthUp, metric.BandwidthDown)) * 8 / 1e6
+				headrooms = append(headrooms, 1-mbps/float64(capacity.maxMbps))
+			}
+		}
+		if len(headrooms) > 0 {
+			rec.Headroom = clampUnit(slices.Min(headrooms))
+			rec.Full = rec.Headroom == 0
+		}
+
+		rec.Score = recommendLatencyWeight*latencyScore +
+			recommendLoadWeight*(1-rec.Load) +
+			recommendHeadroomWeight*rec.Headroom
+		if rate, ok := successRates[node.ID]; ok {
+			rec.Reliability = &rate
+			rec.Score *= rate
+		}
+		ranked = append(ranked, rec)
+	}
+
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].Full != ranked[j].Full {
+			return !ranked[i].Full
+		}
+		return ranked[i].Score > ranked[j].Score
+	})
+
+	s.logger.Debug("Ranked nodes", "region", loc.Region, "country", loc.Country, "nodes", len(ranked), "measured", len(latencies))
+	return ranked, nil
+}
+
+// capacityLimits is the operator-set capacity of a node, 0 leaves a cap unset
+type capacityLimits struct {
+	maxUsers       int
+	maxConnections int
+	maxMbps        int
+}
+
+func nodeCapacity(node *models.VPSNode) capacityLimits {
+	return capacityLimits{
+		maxUsers:       nodeMetadataInt(node, nodeMaxUsersKey),
+		maxConnections: nodeMetadataInt(node, nodeMaxConnectionsKey),
+		maxMbps:        nodeMetadataInt(node, nodeMaxMbpsKey),
+	}
+}
+
+// nodeMetadataInt reads a number from node metadata, which holds strings when set through
+// the API and numbers when set by the orchestrator
+func nodeMetadataInt(node *models.VPSNode, key string) int {
+	switch value := node.Metadata[key].(type) {
+	case float64:
+		return int(value)
+	case int:
+		return value
+	case string:
+		n, _ := strconv.Atoi(value)
+		return n
+	}
+	return 0
+}
+
+func clampUnit(v float64) float64 {
+	if v < 0 {
+		return 0
+	}
+	if v > 1 {
+		return 1
+	}
+	return v
+}
@@ -0,0 +1,140 @@
+package services
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"strconv"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/models"
+	"hysteria2_microservices/api-service/pkg/pdf"
+)
+
+// rowLabels name the rows of each report scope
+var rowLabels = map[string]string{
+	"user":   "device",
+	"node":   "user",
+	"tenant": "user",
+}
+
+// renderReportCSV writes a report as CSV sections separated by blank lines: the subject and
+// totals, the rows, and the top destinations when analytics is enabled. Byte counts are
+// plain integers; session counts are empty when unknown.
+func renderReportCSV(report *models.UsageReport) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+
+	w.Write([]string{"scope", "subject_id", "subject_name", "from", "to", "upload", "download", "total", "sessions"})
+	w.Write([]string{report.Scope, report.SubjectID.String(), report.SubjectName,
+		report.From.Format(time.RFC3339), report.To.Format(time.RFC3339),
+		itoa(report.Upload), itoa(report.Download), itoa(report.Total), optionalCount(report.Sessions)})
+
+	w.Write(nil)
+	w.Write([]string{rowLabels[report.Scope] + "_id", "name", "upload", "download", "total", "sessions"})
+	for _, row := range report.Rows {
+		w.Write([]string{row.ID.String(), row.Name, itoa(row.Upload), itoa(row.Download), itoa(row.Total), optionalCount(row.Sessions)})
+	}
+
+	if report.TopDestinations != nil {
+		w.Write(nil)
+		w.Write([]string{"destination", "total", "connections"})
+		for _, destination := range report.TopDestinations {
+			w.Write([]string{destination.Destination, itoa(destination.Total), itoa(destination.Connections)})
+		}
+	}
+
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// renderReportPDF lays a report out as text tables with human readable byte counts
+func renderReportPDF(report *models.UsageReport) []byte {
+	doc := pdf.New(reportTitle(report))
+	doc.Line("%s", reportTitle(report))
+	doc.Line("Subject ID: %s", report.SubjectID)
+	doc.Line("Period:     %s", reportPeriod(report))
+	doc.Line("Generated:  %s", report.GeneratedAt.Format("2006-01-02 15:04 UTC"))
+	doc.Blank()
+	doc.Line("Upload: %s   Download: %s   Total: %s   Sessions: %s",
+		formatBytes(report.Upload), formatBytes(report.Download), formatBytes(report.Total), countOrNA(report.Sessions))
+	doc.Blank()
+
+	const table = "%-38s %12s %12s %12s %9s"
+	label := rowLabels[report.Scope]
+	doc.Line(table, label, "upload", "download", "total", "sessions")
+	if len(report.Rows) == 0 {
+		doc.Line("No traffic in this period")
+	}
+	for _, row := range report.Rows {
+		name := row.Name
+		if name == "" {
+			name = row.ID.String()
+		}
+		doc.Line(table, truncate(name, 38), formatBytes(row.Upload), formatBytes(row.Download), formatBytes(row.Total), countOrNA(row.Sessions))
+	}
+
+	if report.TopDestinations != nil {
+		doc.Blank()
+		doc.Line("Top destinations")
+		doc.Line("%-60s %12s %12s", "destination", "total", "connections")
+		for _, destination := range report.TopDestinations {
+			doc.Line("%-60s %12s %12d", truncate(destination.Destination, 60), formatBytes(destination.Total), destination.Connections)
+		}
+	}
+
+	return doc.Bytes()
+}
+
+func reportTitle(report *models.UsageReport) string {
+	name := report.SubjectName
+	if name == "" {
+		name = report.SubjectID.String()
+	}
+	return fmt.Sprintf("Usage report for %s %s", report.Scope, name)
+}
+
+func reportPeriod(report *models.UsageReport) string {
+	const layout = "2006-01-02 15:04"
+	return fmt.Sprintf("%s - %s UTC", report.From.Format(layout), report.To.Format(layout))
+}
+
+// formatBytes prints a byte count in binary units, e.g. "1.5 GiB"
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 5; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func optionalCount(count *int64) string {
+	if count == nil {
+		return ""
+	}
+	return itoa(*count)
+}
+
+// countOrNA prints a count that needs analytics, "n/a" when it is disabled
+func countOrNA(count *int64) string {
+	if count == nil {
+		return "n/a"
+	}
+	return itoa(*count)
+}
+
+func itoa(n int64) string {
+	return strconv.FormatInt(n, 10)
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-3] + "..."
+}
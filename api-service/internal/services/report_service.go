@@ -0,0 +1,504 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/models"
+	repoInterfaces "hysteria2_microservices/api-service/internal/repositories/interfaces"
+	serviceInterfaces "hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/logger"
+	"hysteria2_microservices/api-service/pkg/mailer"
+	"hysteria2_microservices/api-service/pkg/validation"
+
+	"github.com/google/uuid"
+)
+
+const (
+	reportScheduleInterval = time.Minute
+	reportScheduleBatch    = 50
+	reportTopDestinations  = 10
+	reportWebhookTimeout   = 30 * time.Second
+)
+
+type reportService struct {
+	scheduleRepo     repoInterfaces.ReportScheduleRepository
+	trafficRepo      repoInterfaces.TrafficRepository
+	userRepo         repoInterfaces.UserRepository
+	nodeRepo         repoInterfaces.NodeRepository
+	resellerRepo     repoInterfaces.ResellerRepository
+	analyticsService serviceInterfaces.AnalyticsService
+	mailer           *mailer.Mailer
+	httpClient       *http.Client
+	logger           *logger.Logger
+
+	stopChan chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// NewReportService creates the report builder and scheduler. A nil mailer disables email
+// delivery.
+func NewReportService(scheduleRepo repoInterfaces.ReportScheduleRepository, trafficRepo repoInterfaces.TrafficRepository,
+	userRepo repoInterfaces.UserRepository, nodeRepo repoInterfaces.NodeRepository, resellerRepo repoInterfaces.ResellerRepository,
+	analyticsService serviceInterfaces.AnalyticsService, mailer *mailer.Mailer, logger *logger.Logger) serviceInterfaces.ReportService {
+	return &reportService{
+		scheduleRepo:     scheduleRepo,
+		trafficRepo:      trafficRepo,
+		userRepo:         userRepo,
+		nodeRepo:         nodeRepo,
+		resellerRepo:     resellerRepo,
+		analyticsService: analyticsService,
+		mailer:           mailer,
+		httpClient:       &http.Client{Timeout: reportWebhookTimeout},
+		logger:           logger,
+		stopChan:         make(chan struct{}),
+	}
+}
+
+// Generate builds the usage report of a subject for [from, to)
+func (s *reportService) Generate(ctx context.Context, scope string, subjectID uuid.UUID, from, to time.Time) (*models.UsageReport, error) {
+	report := &models.UsageReport{
+		Scope:       scope,
+		SubjectID:   subjectID,
+		From:        from.UTC(),
+		To:          to.UTC(),
+		GeneratedAt: time.Now().UTC(),
+		Rows:        []models.UsageReportRow{},
+	}
+
+	var err error
+	switch scope {
+	case "user":
+		err = s.userReport(ctx, report)
+	case "node":
+		err = s.nodeReport(ctx, report)
+	case "tenant":
+		err = s.tenantReport(ctx, report)
+	default:
+		err = fmt.Errorf("unknown report scope %q", scope)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range report.Rows {
+		report.Upload += row.Upload
+		report.Download += row.Download
+	}
+	report.Total = report.Upload + report.Download
+	return report, nil
+}
+
+// userReport breaks a user's traffic down by device
+func (s *reportService) userReport(ctx context.Context, report *models.UsageReport) error {
+	user, err := s.userRepo.GetByID(ctx, report.SubjectID)
+	if err != nil {
+		return notFound(err)
+	}
+	report.SubjectName = user.Username
+
+	// Traffic queries take inclusive ranges
+	devices, err := s.trafficRepo.GetUserDeviceTraffic(ctx, user.ID, report.From, report.To.Add(-time.Microsecond))
+	if err != nil {
+		return fmt.Errorf("failed to get device traffic: %w", err)
+	}
+	for _, device := range devices {
+		name := device.DeviceName
+		if device.DeviceID == uuid.Nil {
+			name = "(no device)"
+		}
+		report.Rows = append(report.Rows, models.UsageReportRow{
+			ID:       device.DeviceID,
+			Name:     name,
+			Upload:   device.Upload,
+			Download: device.Download,
+			Total:    device.Total,
+		})
+	}
+
+	return s.addAnalytics(ctx, report, models.ConnectionFilter{UserIDs: []uuid.UUID{user.ID}}, false)
+}
+
+// tenantReport breaks the traffic of a reseller's users down by user
+func (s *reportService) tenantReport(ctx context.Context, report *models.UsageReport) error {
+	reseller, err := s.resellerRepo.GetByUserID(ctx, report.SubjectID)
+	if err != nil {
+		return notFound(err)
+	}
+	if reseller.User != nil {
+		report.SubjectName = reseller.User.Username
+	}
+
+	users, err := s.resellerRepo.GetUserTraffic(ctx, reseller.UserID, report.From, report.To.Add(-time.Microsecond))
+	if err != nil {
+		return fmt.Errorf("failed to get user traffic: %w", err)
+	}
+	if len(users) == 0 {
+		// An empty filter would match every connection
+		return nil
+	}
+
+	filter := models.ConnectionFilter{UserIDs: make([]uuid.UUID, 0, len(users))}
+	for _, user := range users {
+		report.Rows = append(report.Rows, models.UsageReportRow{
+			ID:       user.UserID,
+			Name:     user.Username,
+			Upload:   user.Upload,
+			Download: user.Download,
+			Total:    user.Total,
+		})
+		filter.UserIDs = append(filter.UserIDs, user.UserID)
+	}
+	return s.addAnalytics(ctx, report, filter, true)
+}
+
+// nodeReport breaks a node's traffic down by user. Traffic stats do not record the node,
+// so node reports come from the analytics store alone.
+func (s *reportService) nodeReport(ctx context.Context, report *models.UsageReport) error {
+	if !s.analyticsService.Enabled() {
+		return serviceInterfaces.ErrAnalyticsDisabled
+	}
+
+	node, err := s.nodeRepo.GetByID(ctx, report.SubjectID)
+	if err != nil {
+		return notFound(err)
+	}
+	report.SubjectName = node.Name
+
+	filter := models.ConnectionFilter{NodeID: &node.ID}
+	usage, err := s.analyticsService.GetUserUsage(ctx, report.From, report.To.Add(-time.Second), filter)
+	if err != nil {
+		return fmt.Errorf("failed to get node usage: %w", err)
+	}
+
+	ids := make([]uuid.UUID, 0, len(usage))
+	for _, talker := range usage {
+		if id, err := uuid.Parse(talker.UserID); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	users, err := s.userRepo.GetByIDs(ctx, ids)
+	if err != nil {
+		return fmt.Errorf("failed to get users: %w", err)
+	}
+	usernames := make(map[uuid.UUID]string, len(users))
+	for _, user := range users {
+		usernames[user.ID] = user.Username
+	}
+
+	var sessions int64
+	for _, talker := range usage {
+		id, _ := uuid.Parse(talker.UserID)
+		connections := talker.Connections
+		report.Rows = append(report.Rows, models.UsageReportRow{
+			ID:       id,
+			Name:     usernames[id],
+			Upload:   talker.Upload,
+			Download: talker.Download,
+			Total:    talker.Total,
+			Sessions: &connections,
+		})
+		sessions += connections
+	}
+	report.Sessions = &sessions
+
+	report.TopDestinations, err = s.analyticsService.GetTopDestinations(ctx, report.From, report.To.Add(-time.Second), filter, reportTopDestinations)
+	if err != nil {
+		return fmt.Errorf("failed to get top destinations: %w", err)
+	}
+	return nil
+}
+
+// addAnalytics adds session counts and top destinations when analytics is enabled. With
+// byUser the rows are users and get their own session counts.
+func (s *reportService) addAnalytics(ctx context.Context, report *models.UsageReport, filter models.ConnectionFilter, byUser bool) error {
+	if !s.analyticsService.Enabled() {
+		return nil
+	}
+
+	// Analytics timestamps have second precision
+	to := report.To.Add(-time.Second)
+	usage, err := s.analyticsService.GetUserUsage(ctx, report.From, to, filter)
+	if err != nil {
+		return fmt.Errorf("failed to get session counts: %w", err)
+	}
+
+	connections := make(map[string]int64, len(usage))
+	var sessions int64
+	for _, talker := range usage {
+		connections[talker.UserID] = talker.Connections
+		sessions += talker.Connections
+	}
+	report.Sessions = &sessions
+	if byUser {
+		for i := range report.Rows {
+			count := connections[report.Rows[i].ID.String()]
+			report.Rows[i].Sessions = &count
+		}
+	}
+
+	report.TopDestinations, err = s.analyticsService.GetTopDestinations(ctx, report.From, to, filter, reportTopDestinations)
+	if err != nil {
+		return fmt.Errorf("failed to get top destinations: %w", err)
+	}
+	return nil
+}
+
+func (s *reportService) Render(report *models.UsageReport, format string) ([]byte, string, error) {
+	switch format {
+	case "csv":
+		data, err := renderReportCSV(report)
+		return data, "text/csv", err
+	case "pdf":
+		return renderReportPDF(report), "application/pdf", nil
+	}
+	return nil, "", fmt.Errorf("unsupported report format: %s", format)
+}
+
+// CreateSchedule validates a schedule and sets its first run to the end of the current
+// period
+func (s *reportService) CreateSchedule(ctx context.Context, schedule *models.ReportSchedule) error {
+	if err := s.validateSchedule(ctx, schedule); err != nil {
+		return err
+	}
+	schedule.NextRunAt = s.nextRun(schedule.Period)
+	return s.scheduleRepo.Create(ctx, schedule)
+}
+
+func (s *reportService) GetSchedule(ctx context.Context, id uuid.UUID) (*models.ReportSchedule, error) {
+	schedule, err := s.scheduleRepo.GetByID(ctx, id)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return schedule, nil
+}
+
+func (s *reportService) ListSchedules(ctx context.Context, page, limit int) ([]*models.ReportSchedule, int64, error) {
+	offset := (page - 1) * limit
+	return s.scheduleRepo.List(ctx, offset, limit)
+}
+
+// UpdateSchedule validates a changed schedule. Its next run moves to the end of the current
+// period, which a new period length may change.
+func (s *reportService) UpdateSchedule(ctx context.Context, schedule *models.ReportSchedule) error {
+	if err := s.validateSchedule(ctx, schedule); err != nil {
+		return err
+	}
+	schedule.NextRunAt = s.nextRun(schedule.Period)
+	return s.scheduleRepo.Update(ctx, schedule)
+}
+
+func (s *reportService) DeleteSchedule(ctx context.Context, id uuid.UUID) error {
+	return notFound(s.scheduleRepo.Delete(ctx, id))
+}
+
+func (s *reportService) RunSchedule(ctx context.Context, id uuid.UUID) (*models.ReportSchedule, error) {
+	schedule, err := s.scheduleRepo.GetByID(ctx, id)
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	runErr := s.runSchedule(ctx, schedule)
+
+	if updated, err := s.scheduleRepo.GetByID(ctx, id); err == nil {
+		schedule = updated
+	}
+	return schedule, runErr
+}
+
+// validateSchedule checks what the request validation cannot: that the subject exists and
+// the schedule has a way to deliver its reports
+func (s *reportService) validateSchedule(ctx context.Context, schedule *models.ReportSchedule) error {
+	if len(schedule.Emails) == 0 && schedule.WebhookURL == "" {
+		return &validation.Error{Fields: []validation.FieldError{{
+			Field:   "emails",
+			Tag:     "required_without",
+			Message: "or webhook_url is required",
+		}}}
+	}
+	if len(schedule.Emails) > 0 && s.mailer == nil {
+		return serviceInterfaces.ErrEmailDisabled
+	}
+	if schedule.Scope == "node" && !s.analyticsService.Enabled() {
+		return serviceInterfaces.ErrAnalyticsDisabled
+	}
+
+	var err error
+	switch schedule.Scope {
+	case "user":
+		_, err = s.userRepo.GetByID(ctx, schedule.SubjectID)
+	case "node":
+		_, err = s.nodeRepo.GetByID(ctx, schedule.SubjectID)
+	case "tenant":
+		_, err = s.resellerRepo.GetByUserID(ctx, schedule.SubjectID)
+	}
+	if err = notFound(err); errors.Is(err, serviceInterfaces.ErrNotFound) {
+		return &validation.Error{Fields: []validation.FieldError{{
+			Field:   "subject_id",
+			Tag:     "exists",
+			Message: fmt.Sprintf("does not match a %s", schedule.Scope),
+		}}}
+	}
+	return err
+}
+
+func (s *reportService) nextRun(period string) time.Time {
+	return models.AddReportPeriods(period, models.ReportPeriodStart(period, time.Now()), 1)
+}
+
+// Start delivers due scheduled reports every minute
+func (s *reportService) Start(ctx context.Context) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(reportScheduleInterval)
+		defer ticker.Stop()
+
+		for {
+			s.runDue(ctx)
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			case <-s.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+func (s *reportService) Stop() {
+	s.stopOnce.Do(func() { close(s.stopChan) })
+	s.wg.Wait()
+}
+
+// runDue runs the schedules that are due. Every instance of the service polls; the claim
+// lets one of them run each schedule. Periods missed while no instance was running are
+// skipped: a late run reports the last complete period.
+func (s *reportService) runDue(ctx context.Context) {
+	schedules, err := s.scheduleRepo.ListDue(ctx, time.Now(), reportScheduleBatch)
+	if err != nil {
+		s.logger.Error("Failed to list due report schedules", "error", err)
+		return
+	}
+
+	for _, schedule := range schedules {
+		claimed, err := s.scheduleRepo.Claim(ctx, schedule, s.nextRun(schedule.Period))
+		if err != nil {
+			s.logger.Error("Failed to claim report schedule", "schedule_id", schedule.ID, "error", err)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+
+		if err := s.runSchedule(ctx, schedule); err != nil {
+			s.logger.Error("Scheduled report failed", "schedule_id", schedule.ID, "error", err)
+		}
+	}
+}
+
+// runSchedule delivers the report of the schedule's last complete period and records the
+// outcome on the schedule
+func (s *reportService) runSchedule(ctx context.Context, schedule *models.ReportSchedule) error {
+	to := models.ReportPeriodStart(schedule.Period, time.Now())
+	from := models.AddReportPeriods(schedule.Period, to, -1)
+
+	err := s.deliverReport(ctx, schedule, from, to)
+
+	var runErr string
+	if err != nil {
+		runErr = err.Error()
+	}
+	if recordErr := s.scheduleRepo.RecordRun(ctx, schedule.ID, time.Now(), runErr); recordErr != nil {
+		s.logger.Error("Failed to record report run", "schedule_id", schedule.ID, "error", recordErr)
+	}
+	if err == nil {
+		s.logger.Info("Scheduled report delivered", "schedule_id", schedule.ID, "scope", schedule.Scope,
+			"subject_id", schedule.SubjectID, "from", from, "to", to)
+	}
+	return err
+}
+
+func (s *reportService) deliverReport(ctx context.Context, schedule *models.ReportSchedule, from, to time.Time) error {
+	report, err := s.Generate(ctx, schedule.Scope, schedule.SubjectID, from, to)
+	if err != nil {
+		return err
+	}
+	data, contentType, err := s.Render(report, schedule.Format)
+	if err != nil {
+		return err
+	}
+	filename := report.Filename(schedule.Format)
+
+	var deliveryErrs []error
+	if len(schedule.Emails) > 0 {
+		if err := s.mailReport(schedule, report, filename, contentType, data); err != nil {
+			deliveryErrs = append(deliveryErrs, err)
+		}
+	}
+	if schedule.WebhookURL != "" {
+		if err := s.postReport(ctx, schedule, report, filename, contentType, data); err != nil {
+			deliveryErrs = append(deliveryErrs, err)
+		}
+	}
+	if len(deliveryErrs) > 0 {
+		return fmt.Errorf("%w: %v", serviceInterfaces.ErrDeliveryFailed, errors.Join(deliveryErrs...))
+	}
+	return nil
+}
+
+func (s *reportService) mailReport(schedule *models.ReportSchedule, report *models.UsageReport, filename, contentType string, data []byte) error {
+	if s.mailer == nil {
+		return serviceInterfaces.ErrEmailDisabled
+	}
+
+	subject := fmt.Sprintf("%s: %s", schedule.Name, reportTitle(report))
+	body := fmt.Sprintf("%s\nPeriod: %s\n\nUpload: %s\nDownload: %s\nTotal: %s\n\nThe full report is attached.\n",
+		reportTitle(report), reportPeriod(report),
+		formatBytes(report.Upload), formatBytes(report.Download), formatBytes(report.Total))
+
+	return s.mailer.Send(schedule.Emails, subject, body, mailer.Attachment{
+		Filename:    filename,
+		ContentType: contentType,
+		Data:        data,
+	})
+}
+
+// postReport posts the rendered report to the schedule's webhook, described by X-Report
+// headers
+func (s *reportService) postReport(ctx context.Context, schedule *models.ReportSchedule, report *models.UsageReport, filename, contentType string, data []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, schedule.WebhookURL, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("invalid webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	req.Header.Set("X-Report-Schedule", schedule.ID.String())
+	req.Header.Set("X-Report-Scope", report.Scope)
+	req.Header.Set("X-Report-Subject", report.SubjectID.String())
+	req.Header.Set("X-Report-From", report.From.Format(time.RFC3339))
+	req.Header.Set("X-Report-To", report.To.Format(time.RFC3339))
+	if schedule.WebhookToken != "" {
+		req.Header.Set("Authorization", "Bearer "+schedule.WebhookToken)
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/models"
+	repoInterfaces "hysteria2_microservices/api-service/internal/repositories/interfaces"
+	serviceInterfaces "hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/cache"
+	"hysteria2_microservices/api-service/pkg/logger"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type resellerService struct {
+	resellerRepo repoInterfaces.ResellerRepository
+	userRepo     repoInterfaces.UserRepository
+	nodeRepo     repoInterfaces.NodeRepository
+	redis        *cache.RedisClient
+	logger       *logger.Logger
+}
+
+func NewResellerService(resellerRepo repoInterfaces.ResellerRepository, userRepo repoInterfaces.UserRepository, nodeRepo repoInterfaces.NodeRepository, redis *cache.RedisClient, logger *logger.Logger) serviceInterfaces.ResellerService {
+	return &resellerService{
+		resellerRepo: resellerRepo,
+		userRepo:     userRepo,
+		nodeRepo:     nodeRepo,
+		redis:        redis,
+		logger:       logger,
+	}
+}
+
+// CreateReseller gives a platform user the reseller role with a quota
+func (s *resellerService) CreateReseller(ctx context.Context, reseller *models.Reseller) error {
+	user, err := s.userRepo.GetByID(ctx, reseller.UserID)
+	if err != nil {
+		return notFound(err)
+	}
+	if user.Role == "admin" || user.ResellerID != nil {
+		return serviceInterfaces.ErrResellerIneligible
+	}
+	if user.Role == "reseller" {
+		return serviceInterfaces.ErrResellerExists
+	}
+
+	if err := s.resellerRepo.Create(ctx, reseller); err != nil {
+		return err
+	}
+	s.redis.Del(ctx, fmt.Sprintf("user:%s", reseller.UserID.String()))
+	return nil
+}
+
+func (s *resellerService) GetReseller(ctx context.Context, userID uuid.UUID) (*models.Reseller, error) {
+	reseller, err := s.resellerRepo.GetByUserID(ctx, userID)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	if reseller.Usage, err = s.resellerRepo.GetUsage(ctx, userID); err != nil {
+		return nil, err
+	}
+	return reseller, nil
+}
+
+func (s *resellerService) ListResellers(ctx context.Context, page, limit int) ([]*models.Reseller, int64, error) {
+	offset := (page - 1) * limit
+	resellers, total, err := s.resellerRepo.List(ctx, offset, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for _, reseller := range resellers {
+		if reseller.Usage, err = s.resellerRepo.GetUsage(ctx, reseller.UserID); err != nil {
+			return nil, 0, err
+		}
+	}
+	return resellers, total, nil
+}
+
+// UpdateReseller changes a reseller's quota. A quota lowered below the current usage stops
+// new allocations without touching the existing users.
+func (s *resellerService) UpdateReseller(ctx context.Context, reseller *models.Reseller) error {
+	if _, err := s.resellerRepo.GetByUserID(ctx, reseller.UserID); err != nil {
+		return notFound(err)
+	}
+	return s.resellerRepo.Update(ctx, reseller)
+}
+
+// DeleteReseller returns a reseller without users to the user role
+func (s *resellerService) DeleteReseller(ctx context.Context, userID uuid.UUID) error {
+	usage, err := s.resellerRepo.GetUsage(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if usage.Users > 0 {
+		return serviceInterfaces.ErrResellerHasUsers
+	}
+
+	if err := s.resellerRepo.Delete(ctx, userID); err != nil {
+		return notFound(err)
+	}
+	s.redis.Del(ctx, fmt.Sprintf("user:%s", userID.String()))
+	return nil
+}
+
+func (s *resellerService) ListUsers(ctx context.Context, resellerID uuid.UUID, page, limit int, search, status string) ([]*models.User, int64, error) {
+	offset := (page - 1) * limit
+	return s.resellerRepo.ListUsers(ctx, resellerID, offset, limit, search, status)
+}
+
+func (s *resellerService) GetUser(ctx context.Context, resellerID, userID uuid.UUID) (*models.User, error) {
+	user, err := s.resellerRepo.GetUser(ctx, resellerID, userID)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return user, nil
+}
+
+// CreateUser creates a user owned by the reseller. The password is hashed here; the user
+// always gets the user role.
+func (s *resellerService) CreateUser(ctx context.Context, resellerID uuid.UUID, user *models.User) error {
+	if _, err := s.userRepo.GetByUsername(ctx, user.Username); err == nil {
+		return serviceInterfaces.ErrUsernameTaken
+	}
+	if _, err := s.userRepo.GetByEmail(ctx, user.Email); err == nil {
+		return serviceInterfaces.ErrEmailTaken
+	}
+
+	hashedPassword, err := hashPassword(user.Password)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+	user.Password = hashedPassword
+	user.Role = "user"
+
+	if err := s.resellerRepo.CreateUser(ctx, resellerID, user); err != nil {
+		return notFound(err)
+	}
+
+	s.logger.Info("Reseller user created", "reseller_id", resellerID, "user_id", user.ID)
+	return nil
+}
+
+func (s *resellerService) UpdateUser(ctx context.Context, resellerID uuid.UUID, user *models.User) error {
+	if err := s.resellerRepo.UpdateUser(ctx, resellerID, user); err != nil {
+		return notFound(err)
+	}
+	s.redis.Del(ctx, fmt.Sprintf("user:%s", user.ID.String()))
+	return nil
+}
+
+func (s *resellerService) DeleteUser(ctx context.Context, resellerID, userID uuid.UUID) error {
+	if err := s.resellerRepo.DeleteUser(ctx, resellerID, userID); err != nil {
+		return notFound(err)
+	}
+	s.redis.Del(ctx, fmt.Sprintf("user:%s", userID.String()))
+
+	s.logger.Info("Reseller user deleted", "reseller_id", resellerID, "user_id", userID)
+	return nil
+}
+
+func (s *resellerService) GetTraffic(ctx context.Context, resellerID uuid.UUID, from, to time.Time) (*serviceInterfaces.ResellerTraffic, error) {
+	users, err := s.resellerRepo.GetUserTraffic(ctx, resellerID, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	traffic := &serviceInterfaces.ResellerTraffic{From: from, To: to, Users: users}
+	for _, user := range users {
+		traffic.Upload += user.Upload
+		traffic.Download += user.Download
+	}
+	traffic.Total = traffic.Upload + traffic.Download
+	return traffic, nil
+}
+
+// GetNodes returns the nodes assigned to the reseller. Resellers without assignments see
+// every online node, the nodes offered to users without assignments.
+func (s *resellerService) GetNodes(ctx context.Context, resellerID uuid.UUID) ([]*models.VPSNode, error) {
+	nodes, err := s.nodeRepo.GetAssignedNodes(ctx, resellerID)
+	if err != nil {
+		return nil, err
+	}
+	if len(nodes) == 0 {
+		return s.nodeRepo.GetOnlineNodes(ctx)
+	}
+	return nodes, nil
+}
+
+// notFound reports missing records as ErrNotFound
+func notFound(err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return serviceInterfaces.ErrNotFound
+	}
+	return err
+}
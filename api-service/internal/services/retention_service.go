@@ -0,0 +1,223 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/models"
+	repoInterfaces "hysteria2_microservices/api-service/internal/repositories/interfaces"
+	serviceInterfaces "hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/cache"
+	"hysteria2_microservices/api-service/pkg/lease"
+	"hysteria2_microservices/api-service/pkg/logger"
+)
+
+var partitionedTables = []string{"traffic_stats", "node_metrics"}
+
+// Runs are leased so one replica at a time prunes, and their report is kept in Redis so
+// every replica shows the last one
+const (
+	retentionLease       = "retention"
+	retentionReportKey   = "retention:last_report"
+	retentionRolledUpKey = "retention:rolled_up_to"
+)
+
+type retentionService struct {
+	retentionRepo repoInterfaces.RetentionRepository
+	redis         *cache.RedisClient
+	locker        *lease.Locker
+	policy        models.RetentionPolicy
+	logger        *logger.Logger
+	now           func() time.Time
+
+	stopChan chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+func NewRetentionService(retentionRepo repoInterfaces.RetentionRepository, redis *cache.RedisClient, locker *lease.Locker, policy models.RetentionPolicy, logger *logger.Logger) serviceInterfaces.RetentionService {
+	if policy.Interval <= 0 {
+		policy.Interval = time.Hour
+	}
+	return &retentionService{
+		retentionRepo: retentionRepo,
+		redis:         redis,
+		locker:        locker,
+		policy:        policy,
+		logger:        logger,
+		now:           time.Now,
+		stopChan:      make(chan struct{}),
+	}
+}
+
+// Start runs the pruner immediately and then on every policy interval
+func (s *retentionService) Start(ctx context.Context) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(s.policy.Interval)
+		defer ticker.Stop()
+
+		for {
+			if _, err := s.RunOnce(ctx); errors.Is(err, serviceInterfaces.ErrJobRunning) {
+				s.logger.Debug("Retention run skipped, running elsewhere")
+			} else if err != nil {
+				s.logger.Error("Retention run failed", "error", err)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			case <-s.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+func (s *retentionService) Stop() {
+	s.stopOnce.Do(func() { close(s.stopChan) })
+	s.wg.Wait()
+}
+
+func (s *retentionService) GetPolicy() models.RetentionPolicy {
+	return s.policy
+}
+
+// GetLastReport returns the report of the last run on any replica, nil before the first
+func (s *retentionService) GetLastReport(ctx context.Context) *models.RetentionReport {
+	var report models.RetentionReport
+	if err := s.redis.Get(ctx, retentionReportKey, &report); err != nil {
+		return nil
+	}
+	return &report
+}
+
+// RunOnce creates upcoming partitions, rolls raw traffic up into hourly buckets
+// and prunes everything that is older than the configured retention windows. It returns
+// ErrJobRunning while a run is in progress on any replica.
+func (s *retentionService) RunOnce(ctx context.Context) (*models.RetentionReport, error) {
+	var report *models.RetentionReport
+	err := s.locker.Run(ctx, retentionLease, func(ctx context.Context) error {
+		report = &models.RetentionReport{StartedAt: time.Now()}
+		err := s.run(ctx, report)
+		report.FinishedAt = time.Now()
+		if err != nil {
+			report.Error = err.Error()
+		}
+		if err := s.redis.Set(ctx, retentionReportKey, report, 0); err != nil {
+			s.logger.Error("Failed to store retention report", "error", err)
+		}
+		return err
+	})
+	if errors.Is(err, lease.ErrHeld) {
+		return nil, serviceInterfaces.ErrJobRunning
+	}
+	if report == nil {
+		return nil, err
+	}
+
+	s.logger.Info("Retention run finished",
+		"partitions_created", report.PartitionsCreated,
+		"partitions_dropped", report.PartitionsDropped,
+		"hourly_rows_upserted", report.HourlyRowsUpserted,
+		"raw_rows_deleted", report.RawRowsDeleted,
+		"hourly_rows_deleted", report.HourlyRowsDeleted,
+		"metric_rows_deleted", report.MetricRowsDeleted,
+		"connection_logs_deleted", report.ConnectionLogsDeleted,
+		"telemetry_rows_deleted", report.TelemetryRowsDeleted)
+
+	return report, err
+}
+
+func (s *retentionService) run(ctx context.Context, report *models.RetentionReport) error {
+	now := s.now().UTC()
+
+	for _, table := range partitionedTables {
+		created, err := s.retentionRepo.EnsurePartitions(ctx, table, s.policy.PartitionsAhead)
+		if err != nil {
+			return fmt.Errorf("failed to create partitions for %s: %w", table, err)
+		}
+		report.PartitionsCreated += created
+	}
+
+	// Roll up every completed hour since the last run on any replica; on the first run
+	// the whole raw window is aggregated so no data is lost before pruning.
+	rawCutoff := now.AddDate(0, 0, -s.policy.RawTrafficDays).Truncate(time.Hour)
+	rollupFrom := rawCutoff
+	var rolledUpTo time.Time
+	if err := s.redis.Get(ctx, retentionRolledUpKey, &rolledUpTo); err == nil && rolledUpTo.After(rawCutoff) {
+		rollupFrom = rolledUpTo.Add(-time.Hour)
+	}
+	rollupTo := now.Truncate(time.Hour)
+
+	upserted, err := s.retentionRepo.RollupHourlyTraffic(ctx, rollupFrom, rollupTo)
+	if err != nil {
+		return fmt.Errorf("failed to roll up hourly traffic: %w", err)
+	}
+	report.HourlyRowsUpserted = upserted
+	if err := s.redis.Set(ctx, retentionRolledUpKey, rollupTo, 0); err != nil {
+		s.logger.Error("Failed to store retention rollup progress", "error", err)
+	}
+
+	if s.policy.RawTrafficDays > 0 {
+		dropped, err := s.retentionRepo.DropPartitionsBefore(ctx, "traffic_stats", rawCutoff)
+		if err != nil {
+			return fmt.Errorf("failed to drop traffic partitions: %w", err)
+		}
+		report.PartitionsDropped += dropped
+
+		deleted, err := s.retentionRepo.DeleteRawTrafficBefore(ctx, rawCutoff)
+		if err != nil {
+			return fmt.Errorf("failed to prune raw traffic: %w", err)
+		}
+		report.RawRowsDeleted = deleted
+	}
+
+	if s.policy.HourlyTrafficDays > 0 {
+		deleted, err := s.retentionRepo.DeleteHourlyTrafficBefore(ctx, now.AddDate(0, 0, -s.policy.HourlyTrafficDays))
+		if err != nil {
+			return fmt.Errorf("failed to prune hourly traffic: %w", err)
+		}
+		report.HourlyRowsDeleted = deleted
+	}
+
+	if s.policy.NodeMetricsDays > 0 {
+		metricsCutoff := now.AddDate(0, 0, -s.policy.NodeMetricsDays)
+
+		dropped, err := s.retentionRepo.DropPartitionsBefore(ctx, "node_metrics", metricsCutoff)
+		if err != nil {
+			return fmt.Errorf("failed to drop node metric partitions: %w", err)
+		}
+		report.PartitionsDropped += dropped
+
+		deleted, err := s.retentionRepo.DeleteNodeMetricsBefore(ctx, metricsCutoff)
+		if err != nil {
+			return fmt.Errorf("failed to prune node metrics: %w", err)
+		}
+		report.MetricRowsDeleted = deleted
+	}
+
+	if s.policy.ConnectionLogDays > 0 {
+		deleted, err := s.retentionRepo.DeleteConnectionLogsBefore(ctx, now.AddDate(0, 0, -s.policy.ConnectionLogDays))
+		if err != nil {
+			return fmt.Errorf("failed to prune connection logs: %w", err)
+		}
+		report.ConnectionLogsDeleted = deleted
+	}
+
+	if s.policy.TelemetryDays > 0 {
+		deleted, err := s.retentionRepo.DeleteClientTelemetryBefore(ctx, now.AddDate(0, 0, -s.policy.TelemetryDays))
+		if err != nil {
+			return fmt.Errorf("failed to prune client telemetry: %w", err)
+		}
+		report.TelemetryRowsDeleted = deleted
+	}
+
+	return nil
+}
@@ -0,0 +1,204 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/models"
+	"hysteria2_microservices/api-service/pkg/cache"
+	"hysteria2_microservices/api-service/pkg/lease"
+	"hysteria2_microservices/api-service/pkg/logger"
+)
+
+// The tests that keep state in Redis need a server in TEST_REDIS_URL
+func testRedis(t *testing.T) *cache.RedisClient {
+	url := os.Getenv("TEST_REDIS_URL")
+	if url == "" {
+		t.Skip("TEST_REDIS_URL is not set")
+	}
+	redis := cache.NewRedisClient(url)
+	t.Cleanup(func() { redis.Close() })
+	return redis
+}
+
+type partitionDrop struct {
+	table  string
+	cutoff time.Time
+}
+
+// fakeRetentionRepo records the windows the pruner asks for
+type fakeRetentionRepo struct {
+	rollups      [][2]time.Time
+	drops        []partitionDrop
+	rawDeletes   []time.Time
+	metricDelete []time.Time
+	rollupErr    error
+}
+
+func (r *fakeRetentionRepo) EnsurePartitions(ctx context.Context, table string, monthsAhead int) (int, error) {
+	return 0, nil
+}
+
+func (r *fakeRetentionRepo) DropPartitionsBefore(ctx context.Context, table string, cutoff time.Time) (int, error) {
+	r.drops = append(r.drops, partitionDrop{table: table, cutoff: cutoff})
+	return 1, nil
+}
+
+func (r *fakeRetentionRepo) RollupHourlyTraffic(ctx context.Context, from, to time.Time) (int64, error) {
+	if r.rollupErr != nil {
+		return 0, r.rollupErr
+	}
+	r.rollups = append(r.rollups, [2]time.Time{from, to})
+	return 1, nil
+}
+
+func (r *fakeRetentionRepo) DeleteRawTrafficBefore(ctx context.Context, cutoff time.Time) (int64, error) {
+	r.rawDeletes = append(r.rawDeletes, cutoff)
+	return 0, nil
+}
+
+func (r *fakeRetentionRepo) DeleteHourlyTrafficBefore(ctx context.Context, cutoff time.Time) (int64, error) {
+	return 0, nil
+}
+
+func (r *fakeRetentionRepo) DeleteNodeMetricsBefore(ctx context.Context, cutoff time.Time) (int64, error) {
+	r.metricDelete = append(r.metricDelete, cutoff)
+	return 0, nil
+}
+
+func (r *fakeRetentionRepo) DeleteConnectionLogsBefore(ctx context.Context, cutoff time.Time) (int64, error) {
+	return 0, nil
+}
+
+func (r *fakeRetentionRepo) DeleteClientTelemetryBefore(ctx context.Context, cutoff time.Time) (int64, error) {
+	return 0, nil
+}
+
+var retentionNow = time.Date(2026, 3, 10, 14, 37, 12, 0, time.UTC)
+
+func newTestRetention(t *testing.T, repo *fakeRetentionRepo, policy models.RetentionPolicy) (*retentionService, *cache.RedisClient) {
+	redis := testRedis(t)
+	ctx := context.Background()
+	clear := func() { redis.Del(ctx, retentionRolledUpKey, retentionReportKey) }
+	clear()
+	t.Cleanup(clear)
+
+	s := NewRetentionService(repo, redis, lease.NewLocker(redis, time.Second), policy, logger.NewLogger("error")).(*retentionService)
+	s.now = func() time.Time { return retentionNow }
+	return s, redis
+}
+
+func TestRetentionFirstRunRollsUpWholeRawWindow(t *testing.T) {
+	repo := &fakeRetentionRepo{}
+	s, redis := newTestRetention(t, repo, models.RetentionPolicy{RawTrafficDays: 7})
+
+	if _, err := s.RunOnce(context.Background()); err != nil {
+		t.Fatalf("RunOnce: %v", err)
+	}
+
+	// The cutoff is on an hour boundary so no partially rolled up hour is pruned
+	rawCutoff := time.Date(2026, 3, 3, 14, 0, 0, 0, time.UTC)
+	rollupTo := time.Date(2026, 3, 10, 14, 0, 0, 0, time.UTC)
+	if len(repo.rollups) != 1 || !repo.rollups[0][0].Equal(rawCutoff) || !repo.rollups[0][1].Equal(rollupTo) {
+		t.Fatalf("rollups = %v, want [%v, %v)", repo.rollups, rawCutoff, rollupTo)
+	}
+	if len(repo.drops) != 1 || repo.drops[0].table != "traffic_stats" || !repo.drops[0].cutoff.Equal(rawCutoff) {
+		t.Errorf("partition drops = %v, want traffic_stats before %v", repo.drops, rawCutoff)
+	}
+	if len(repo.rawDeletes) != 1 || !repo.rawDeletes[0].Equal(rawCutoff) {
+		t.Errorf("raw deletes = %v, want before %v", repo.rawDeletes, rawCutoff)
+	}
+
+	var watermark time.Time
+	if err := redis.Get(context.Background(), retentionRolledUpKey, &watermark); err != nil || !watermark.Equal(rollupTo) {
+		t.Errorf("watermark = %v (%v), want %v", watermark, err, rollupTo)
+	}
+}
+
+func TestRetentionResumesFromWatermark(t *testing.T) {
+	tests := []struct {
+		name      string
+		watermark time.Time
+		wantFrom  time.Time
+	}{
+		{
+			// The last rolled up hour is rolled up again for samples that arrived late
+			name:      "within raw window",
+			watermark: time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC),
+			wantFrom:  time.Date(2026, 3, 10, 11, 0, 0, 0, time.UTC),
+		},
+		{
+			// Hours before the cutoff were pruned, so there is nothing older to roll up
+			name:      "before raw window",
+			watermark: time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC),
+			wantFrom:  time.Date(2026, 3, 3, 14, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "at raw cutoff",
+			watermark: time.Date(2026, 3, 3, 14, 0, 0, 0, time.UTC),
+			wantFrom:  time.Date(2026, 3, 3, 14, 0, 0, 0, time.UTC),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := &fakeRetentionRepo{}
+			s, redis := newTestRetention(t, repo, models.RetentionPolicy{RawTrafficDays: 7})
+			if err := redis.Set(context.Background(), retentionRolledUpKey, tt.watermark, 0); err != nil {
+				t.Fatalf("set watermark: %v", err)
+			}
+
+			if _, err := s.RunOnce(context.Background()); err != nil {
+				t.Fatalf("RunOnce: %v", err)
+			}
+			if len(repo.rollups) != 1 || !repo.rollups[0][0].Equal(tt.wantFrom) {
+				t.Errorf("rollups = %v, want from %v", repo.rollups, tt.wantFrom)
+			}
+		})
+	}
+}
+
+func TestRetentionFailedRollupPrunesNothing(t *testing.T) {
+	repo := &fakeRetentionRepo{rollupErr: errors.New("database is down")}
+	s, redis := newTestRetention(t, repo, models.RetentionPolicy{RawTrafficDays: 7, NodeMetricsDays: 30})
+	watermark := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	redis.Set(context.Background(), retentionRolledUpKey, watermark, 0)
+
+	report, err := s.RunOnce(context.Background())
+	if err == nil || report == nil || report.Error == "" {
+		t.Fatalf("RunOnce = %+v, %v; want the rollup error reported", report, err)
+	}
+	// Raw rows that were not rolled up must survive until a later run rolls them up
+	if len(repo.drops) != 0 || len(repo.rawDeletes) != 0 || len(repo.metricDelete) != 0 {
+		t.Errorf("pruned after a failed rollup: drops %v, raw deletes %v, metric deletes %v", repo.drops, repo.rawDeletes, repo.metricDelete)
+	}
+
+	var got time.Time
+	if err := redis.Get(context.Background(), retentionRolledUpKey, &got); err != nil || !got.Equal(watermark) {
+		t.Errorf("watermark = %v (%v), want %v kept", got, err, watermark)
+	}
+}
+
+func TestRetentionCutoffs(t *testing.T) {
+	repo := &fakeRetentionRepo{}
+	s, _ := newTestRetention(t, repo, models.RetentionPolicy{NodeMetricsDays: 30})
+
+	if _, err := s.RunOnce(context.Background()); err != nil {
+		t.Fatalf("RunOnce: %v", err)
+	}
+
+	// Keeping raw traffic forever drops none of it
+	if len(repo.rawDeletes) != 0 {
+		t.Errorf("raw traffic deleted with RawTrafficDays 0: %v", repo.rawDeletes)
+	}
+	metricsCutoff := time.Date(2026, 2, 8, 14, 37, 12, 0, time.UTC)
+	if len(repo.drops) != 1 || repo.drops[0].table != "node_metrics" || !repo.drops[0].cutoff.Equal(metricsCutoff) {
+		t.Errorf("partition drops = %v, want node_metrics before %v", repo.drops, metricsCutoff)
+	}
+	if len(repo.metricDelete) != 1 || !repo.metricDelete[0].Equal(metricsCutoff) {
+		t.Errorf("metric deletes = %v, want before %v", repo.metricDelete, metricsCutoff)
+	}
+}
@@ -0,0 +1,192 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/models"
+	"hysteria2_microservices/api-service/pkg/sharelink"
+
+	"github.com/google/uuid"
+)
+
+const (
+	ShareProtocolHysteria2 = "hysteria2"
+	ShareProtocolVLESS     = "vless"
+	ShareProtocolTrojan    = "trojan"
+)
+
+// hysteriaClientConfig is the subset of a stored Hysteria2 client config needed for a share link
+type hysteriaClientConfig struct {
+	Server string `json:"server"`
+	Auth   string `json:"auth"`
+	Obfs   struct {
+		Type       string `json:"type"`
+		Salamander struct {
+			Password string `json:"password"`
+		} `json:"salamander"`
+	} `json:"obfs"`
+	TLS struct {
+		SNI      string `json:"sni"`
+		Insecure bool   `json:"insecure"`
+	} `json:"tls"`
+}
+
+// GetShareLink returns the connection URI for one of the user's protocols on a node.
+// A nil nodeID selects the first node the user's subscription would offer.
+func (s *subscriptionService) GetShareLink(ctx context.Context, userID uuid.UUID, protocol string, nodeID uuid.UUID) (*models.ShareLink, error) {
+	if protocol != ShareProtocolHysteria2 && protocol != ShareProtocolVLESS && protocol != ShareProtocolTrojan {
+		return nil, fmt.Errorf("unsupported protocol: %s", protocol)
+	}
+
+	user, err := s.userRepo.GetByID(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+	if user.Status != "active" {
+		return nil, fmt.Errorf("user is not active")
+	}
+
+	nodes, err := s.subscriptionNodes(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get nodes: %w", err)
+	}
+
+	var uri string
+	for _, node := range nodes {
+		if nodeID != uuid.Nil && node.ID != nodeID {
+			continue
+		}
+
+		if protocol == ShareProtocolHysteria2 {
+			uri, err = s.hysteriaShareLink(ctx, userID, node)
+		} else {
+			uri, err = s.xrayShareLink(ctx, userID, protocol, node)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if uri != "" {
+			return &models.ShareLink{
+				Protocol: protocol,
+				NodeID:   node.ID,
+				NodeName: node.Name,
+				URI:      uri,
+			}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no %s config available for user", protocol)
+}
+
+func (s *subscriptionService) hysteriaShareLink(ctx context.Context, userID uuid.UUID, node *models.VPSNode) (string, error) {
+	if !node.IsProtocolEnabled(ShareProtocolHysteria2) {
+		return "", nil
+	}
+
+	configs, err := s.hysteriaRepo.GetActiveByUserID(ctx, userID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get user configs: %w", err)
+	}
+
+	for _, cfg := range configs {
+		var client hysteriaClientConfig
+		data, err := json.Marshal(cfg.ConfigData)
+		if err == nil {
+			err = json.Unmarshal(data, &client)
+		}
+		if err != nil {
+			s.logger.Warn("Skipping unreadable Hysteria config", "config_id", cfg.ID, "error", err)
+			continue
+		}
+
+		_, ports := sharelink.SplitServer(client.Server)
+		host := nodeAddress(node)
+		sni := client.TLS.SNI
+		if sni == "" && net.ParseIP(host) == nil {
+			sni = host
+		}
+
+		link := sharelink.Hysteria2{
+			Name:     node.Name,
+			Auth:     client.Auth,
+			Host:     host,
+			Ports:    ports,
+			SNI:      sni,
+			Insecure: client.TLS.Insecure,
+		}
+		if client.Obfs.Type == sharelink.ObfsSalamander {
+			link.ObfsType = sharelink.ObfsSalamander
+			link.ObfsPassword = client.Obfs.Salamander.Password
+		}
+		return link.String(), nil
+	}
+	return "", nil
+}
+
+func (s *subscriptionService) xrayShareLink(ctx context.Context, userID uuid.UUID, protocol string, node *models.VPSNode) (string, error) {
+	configs, err := s.xrayRepo.GetActiveByUserID(ctx, userID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get user configs: %w", err)
+	}
+
+	fingerprint, _ := s.GetFingerprint(userID, time.Now())
+
+	for _, cfg := range configs {
+		for _, endpoint := range s.buildEndpoints(node, cfg) {
+			if endpoint.protocol != protocol {
+				continue
+			}
+			if protocol == ShareProtocolVLESS {
+				return endpointVLESS(endpoint, fingerprint, node.Name).String(), nil
+			}
+			return endpointTrojan(endpoint, fingerprint, node.Name).String(), nil
+		}
+	}
+	return "", nil
+}
+
+func nodeAddress(node *models.VPSNode) string {
+	if node.Hostname != "" {
+		return node.Hostname
+	}
+	return node.IPAddress
+}
+
+func endpointVLESS(e clientEndpoint, fingerprint, name string) sharelink.VLESS {
+	link := sharelink.VLESS{
+		Name:     name,
+		ID:       e.id,
+		Host:     e.server,
+		Port:     e.port,
+		Flow:     e.flow,
+		Security: e.security,
+	}
+	if e.security == sharelink.SecurityTLS || e.security == sharelink.SecurityReality {
+		link.SNI = e.serverName
+		link.Fingerprint = fingerprint
+	}
+	if e.security == sharelink.SecurityTLS {
+		link.ALPN = browserALPN
+	}
+	if e.security == sharelink.SecurityReality {
+		link.PublicKey = e.publicKey
+		link.ShortID = e.shortID
+	}
+	return link
+}
+
+func endpointTrojan(e clientEndpoint, fingerprint, name string) sharelink.Trojan {
+	return sharelink.Trojan{
+		Name:        name,
+		Password:    e.password,
+		Host:        e.server,
+		Port:        e.port,
+		SNI:         e.serverName,
+		ALPN:        browserALPN,
+		Fingerprint: fingerprint,
+	}
+}
@@ -0,0 +1,84 @@
+package services
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"hysteria2_microservices/api-service/internal/models"
+
+	"github.com/google/uuid"
+)
+
+func TestGetShareLinkHysteria2(t *testing.T) {
+	s := newTestSubscriptionService([]string{"safari"}, 0)
+	node := s.nodeRepo.(*fakeSubscriptionNodes).nodes[0]
+	s.hysteriaRepo.(*fakeHysteriaConfigs).configs = []*models.HysteriaConfig{{
+		ID: uuid.New(),
+		ConfigData: map[string]interface{}{
+			"server": "203.0.113.10:443,20000-50000",
+			"auth":   "user-secret",
+			"obfs": map[string]interface{}{
+				"type":       "salamander",
+				"salamander": map[string]interface{}{"password": "obfs-pw"},
+			},
+		},
+	}}
+
+	link, err := s.GetShareLink(context.Background(), uuid.New(), ShareProtocolHysteria2, uuid.Nil)
+	if err != nil {
+		t.Fatalf("GetShareLink: %v", err)
+	}
+	if link.NodeID != node.ID || link.NodeName != "fra-1" {
+		t.Errorf("link for %s (%s), want fra-1", link.NodeName, link.NodeID)
+	}
+
+	// The link points at the node's hostname, keeping the hopping range, with the
+	// hostname as SNI and the Salamander password. net/url cannot parse port ranges, so
+	// the URI is compared whole.
+	want := "hysteria2://user-secret@fra-1.example.com:443,20000-50000/?obfs=salamander&obfs-password=obfs-pw&sni=fra-1.example.com#fra-1"
+	if link.URI != want {
+		t.Errorf("URI %s, want %s", link.URI, want)
+	}
+
+	node.Protocols = map[string]interface{}{"hysteria2": false}
+	if _, err := s.GetShareLink(context.Background(), uuid.New(), ShareProtocolHysteria2, uuid.Nil); err == nil {
+		t.Error("returned a link for a protocol disabled on the node")
+	}
+}
+
+func TestGetShareLinkXray(t *testing.T) {
+	s := newTestSubscriptionService([]string{"safari"}, 0)
+	node := s.nodeRepo.(*fakeSubscriptionNodes).nodes[0]
+	user := uuid.New()
+
+	link, err := s.GetShareLink(context.Background(), user, ShareProtocolVLESS, node.ID)
+	if err != nil {
+		t.Fatalf("GetShareLink vless: %v", err)
+	}
+	u, _ := url.Parse(link.URI)
+	q := u.Query()
+	if u.Scheme != "vless" || u.User.Username() != "c0ffee00-0000-4000-8000-000000000001" || u.Host != "fra-1.example.com:443" {
+		t.Errorf("URI %s, want the client ID at the node hostname", link.URI)
+	}
+	if q.Get("security") != "reality" || q.Get("sni") != "www.microsoft.com" || q.Get("pbk") != "reality-public-key" || q.Get("fp") != "safari" {
+		t.Errorf("URI %s, want REALITY with the user's fingerprint", link.URI)
+	}
+
+	link, err = s.GetShareLink(context.Background(), user, ShareProtocolTrojan, node.ID)
+	if err != nil {
+		t.Fatalf("GetShareLink trojan: %v", err)
+	}
+	u, _ = url.Parse(link.URI)
+	q = u.Query()
+	if u.Scheme != "trojan" || u.User.Username() != "trojan-secret" || u.Port() != "8443" || q.Get("alpn") != "h2,http/1.1" || q.Get("fp") != "safari" {
+		t.Errorf("URI %s, want trojan on 8443 with browser ALPN and fingerprint", link.URI)
+	}
+
+	if _, err := s.GetShareLink(context.Background(), user, ShareProtocolVLESS, uuid.New()); err == nil {
+		t.Error("returned a link for a node the user is not offered")
+	}
+	if _, err := s.GetShareLink(context.Background(), user, "vmess", uuid.Nil); err == nil {
+		t.Error("returned a link for an unsupported protocol")
+	}
+}
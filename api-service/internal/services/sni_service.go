@@ -0,0 +1,370 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/models"
+	serviceInterfaces "hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/logger"
+	"hysteria2_microservices/api-service/pkg/orchestrator"
+
+	"github.com/google/uuid"
+)
+
+// sniService passes the SNI domains and certificates of nodes through to the orchestrator
+type sniService struct {
+	orchestrator *orchestrator.Client // nil when no orchestrator gateway is configured
+	logger       *logger.Logger
+}
+
+func NewSNIService(orchestrator *orchestrator.Client, logger *logger.Logger) serviceInterfaces.SNIService {
+	return &sniService{
+		orchestrator: orchestrator,
+		logger:       logger,
+	}
+}
+
+// AddDomain adds a domain to the node. A domain that does not resolve to the node yet is
+// still added, DNS may follow.
+func (s *sniService) AddDomain(ctx context.Context, nodeID uuid.UUID, onboarding *models.SNIDomainOnboarding) (*models.SNIDomainResult, error) {
+	if err := s.available(); err != nil {
+		return nil, err
+	}
+	resp, err := s.orchestrator.OnboardSNIDomain(ctx, nodeID.String(), orchestrator.SNIOnboarding{
+		Domain:           onboarding.Domain,
+		ManageDNS:        onboarding.ManageDNS,
+		Overwrite:        onboarding.Overwrite,
+		IssueCertificate: onboarding.IssueCertificate,
+		Email:            onboarding.Email,
+		WaitSeconds:      onboarding.WaitSeconds,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to add SNI domain: %w", err)
+	}
+
+	result := &models.SNIDomainResult{
+		Domain:            onboarding.Domain,
+		CertificateIssued: resp.CertificateIssued,
+		CertificateIssuer: resp.CertificateIssuer,
+		Message:           resp.Message,
+	}
+	if check := resp.DNSCheck; check != nil {
+		result.Domain = check.Domain
+		result.ResolvesToNode = check.ResolvesToNode
+		result.DNSMessage = check.Message
+	}
+	if resp.CertificateNotAfter > 0 {
+		notAfter := time.Unix(resp.CertificateNotAfter, 0).UTC()
+		result.CertificateNotAfter = &notAfter
+	}
+	if onboarding.IssueCertificate && !resp.Success {
+		result.CertificateError = resp.Message
+	}
+	s.logger.Info("SNI domain added", "node_id", nodeID, "domain", result.Domain,
+		"manage_dns", onboarding.ManageDNS, "certificate_issued", resp.CertificateIssued)
+	return result, nil
+}
+
+func (s *sniService) RemoveDomain(ctx context.Context, nodeID uuid.UUID, domain string) (*models.NodeSNIDomains, error) {
+	if err := s.available(); err != nil {
+		return nil, err
+	}
+	resp, err := s.orchestrator.RemoveSNIDomain(ctx, nodeID.String(), domain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to remove SNI domain: %w", err)
+	}
+	s.logger.Info("SNI domain removed", "node_id", nodeID, "domain", domain)
+
+	domains := resp.Domains
+	if domains == nil {
+		domains = []string{}
+	}
+	return &models.NodeSNIDomains{
+		Domains:       domains,
+		PrimaryDomain: resp.PrimaryDomain,
+	}, nil
+}
+
+func (s *sniService) GetCertificates(ctx context.Context, nodeID uuid.UUID) (*models.NodeCertificateStatus, error) {
+	if err := s.available(); err != nil {
+		return nil, err
+	}
+	resp, err := s.orchestrator.GetCertificateStatus(ctx, nodeID.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get certificate status: %w", err)
+	}
+
+	status := &models.NodeCertificateStatus{
+		Mode:         "files",
+		Message:      resp.Message,
+		Certificates: make([]models.NodeCertificate, 0, len(resp.Certificates)),
+		Pending:      resp.Pending,
+		ExpiringSoon: resp.ExpiringSoon,
+	}
+	if mode := resp.Mode; mode != nil && mode.Mode != "" {
+		status.Mode = mode.Mode
+		status.CA = mode.CA
+		status.Challenge = mode.Challenge
+		status.Email = mode.Email
+	}
+	for _, cert := range resp.Certificates {
+		status.Certificates = append(status.Certificates, models.NodeCertificate{
+			Domain:    cert.Domain,
+			Issuer:    cert.Issuer,
+			CA:        cert.CA,
+			NotBefore: time.Unix(cert.NotBefore, 0).UTC(),
+			NotAfter:  time.Unix(cert.NotAfter, 0).UTC(),
+			DaysLeft:  cert.DaysLeft,
+		})
+	}
+	if status.Pending == nil {
+		status.Pending = []string{}
+	}
+	if status.ExpiringSoon == nil {
+		status.ExpiringSoon = []string{}
+	}
+	return status, nil
+}
+
+// RenewCertificates has the node renew its certificates now instead of waiting for the
+// renewal window
+func (s *sniService) RenewCertificates(ctx context.Context, nodeID uuid.UUID) (string, error) {
+	if err := s.available(); err != nil {
+		return "", err
+	}
+	message, err := s.orchestrator.RenewCertificates(ctx, nodeID.String())
+	if err != nil {
+		return "", fmt.Errorf("failed to renew certificates: %w", err)
+	}
+	s.logger.Info("Certificate renewal forced", "node_id", nodeID)
+	return message, nil
+}
+
+// ListInventory returns the certificates of every node as last synced by the orchestrator,
+// the ones expiring first
+func (s *sniService) ListInventory(ctx context.Context, filter models.CertificateFilter) ([]models.InventoryCertificate, error) {
+	if err := s.available(); err != nil {
+		return nil, err
+	}
+	certificates, err := s.orchestrator.ListCertificates(ctx, orchestratorCertificateFilter(filter))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list certificates: %w", err)
+	}
+
+	result := make([]models.InventoryCertificate, 0, len(certificates))
+	for _, cert := range certificates {
+		result = append(result, models.InventoryCertificate{
+			Domain:     cert.Domain,
+			Issuer:     cert.Issuer,
+			Source:     cert.Source,
+			SelfSigned: cert.SelfSigned,
+			NotBefore:  time.Unix(cert.NotBefore, 0).UTC(),
+			NotAfter:   time.Unix(cert.NotAfter, 0).UTC(),
+			DaysLeft:   cert.DaysLeft,
+			NodeID:     cert.NodeID,
+			NodeName:   cert.NodeName,
+			SyncedAt:   time.Unix(cert.SyncedAt, 0).UTC(),
+		})
+	}
+	return result, nil
+}
+
+// BulkRenew renews certificates on the given nodes, or on every node holding a certificate
+// matching the filter when no node is given
+func (s *sniService) BulkRenew(ctx context.Context, nodeIDs []uuid.UUID, filter models.CertificateFilter) (*models.CertificateRenewal, error) {
+	if err := s.available(); err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(nodeIDs))
+	for _, nodeID := range nodeIDs {
+		ids = append(ids, nodeID.String())
+	}
+
+	result, err := s.orchestrator.BulkRenewCertificates(ctx, ids, orchestratorCertificateFilter(filter))
+	if err != nil {
+		return nil, fmt.Errorf("failed to renew certificates: %w", err)
+	}
+	s.logger.Info("Bulk certificate renewal finished", "nodes", len(ids), "expiring_within_days", filter.ExpiringWithinDays,
+		"self_signed", filter.SelfSigned, "renewed", len(result.Renewed), "failed", len(result.Failures))
+
+	renewal := &models.CertificateRenewal{
+		Message:  result.Message,
+		Renewed:  result.Renewed,
+		Failures: result.Failures,
+	}
+	if renewal.Renewed == nil {
+		renewal.Renewed = []string{}
+	}
+	if renewal.Failures == nil {
+		renewal.Failures = map[string]string{}
+	}
+	return renewal, nil
+}
+
+// Upload validates and stores an uploaded certificate, then installs it on every node
+// serving a domain it covers
+func (s *sniService) Upload(ctx context.Context, upload *models.CertificateUpload) (*models.CertificateDistribution, error) {
+	if err := s.available(); err != nil {
+		return nil, err
+	}
+	result, err := s.orchestrator.UploadCertificate(ctx, orchestrator.CertificateUpload{
+		Domain:         upload.Domain,
+		CertificatePEM: upload.CertificatePEM,
+		PrivateKeyPEM:  upload.PrivateKeyPEM,
+		CABundlePEM:    upload.CABundlePEM,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload certificate: %w", err)
+	}
+	s.logger.Info("Certificate uploaded", "domain", upload.Domain, "custom_ca", upload.CABundlePEM != "",
+		"installed", len(result.Installed), "failed", len(result.Failures))
+
+	distribution := &models.CertificateDistribution{
+		Message:   result.Message,
+		Installed: result.Installed,
+		Failures:  result.Failures,
+	}
+	if result.Certificate != nil {
+		cert := uploadedCertificate(*result.Certificate)
+		distribution.Certificate = &cert
+	}
+	if distribution.Installed == nil {
+		distribution.Installed = []string{}
+	}
+	if distribution.Failures == nil {
+		distribution.Failures = map[string]string{}
+	}
+	return distribution, nil
+}
+
+// ListUploads returns the uploaded certificates, the ones expiring first
+func (s *sniService) ListUploads(ctx context.Context) ([]models.UploadedCertificate, error) {
+	if err := s.available(); err != nil {
+		return nil, err
+	}
+	certificates, err := s.orchestrator.ListUploadedCertificates(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list uploaded certificates: %w", err)
+	}
+
+	result := make([]models.UploadedCertificate, 0, len(certificates))
+	for _, cert := range certificates {
+		result = append(result, uploadedCertificate(cert))
+	}
+	return result, nil
+}
+
+// DeleteUpload deletes the upload of a domain; nodes keep serving the certificate until it
+// is replaced
+func (s *sniService) DeleteUpload(ctx context.Context, domain string) (string, error) {
+	if err := s.available(); err != nil {
+		return "", err
+	}
+	message, err := s.orchestrator.DeleteUploadedCertificate(ctx, domain)
+	if err != nil {
+		return "", fmt.Errorf("failed to delete uploaded certificate: %w", err)
+	}
+	s.logger.Info("Uploaded certificate deleted", "domain", domain)
+	return message, nil
+}
+
+func uploadedCertificate(cert orchestrator.UploadedCertificate) models.UploadedCertificate {
+	nodeIDs := cert.NodeIDs
+	if nodeIDs == nil {
+		nodeIDs = []string{}
+	}
+	return models.UploadedCertificate{
+		Domain:      cert.Domain,
+		Issuer:      cert.Issuer,
+		Fingerprint: cert.Fingerprint,
+		NotBefore:   time.Unix(cert.NotBefore, 0).UTC(),
+		NotAfter:    time.Unix(cert.NotAfter, 0).UTC(),
+		CustomCA:    cert.CustomCA,
+		NodeIDs:     nodeIDs,
+		UploadedAt:  time.Unix(cert.UploadedAt, 0).UTC(),
+	}
+}
+
+// CheckTLS has another node grade the TLS the node serves: certificate chains, OCSP
+// stapling, protocol versions and cipher suites
+func (s *sniService) CheckTLS(ctx context.Context, nodeID uuid.UUID) (*models.TLSReport, error) {
+	if err := s.available(); err != nil {
+		return nil, err
+	}
+	report, err := s.orchestrator.RunTLSCheck(ctx, nodeID.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to run TLS check: %w", err)
+	}
+	s.logger.Info("TLS check finished", "node_id", nodeID, "grade", report.Grade, "prober_node_id", report.ProberNodeID)
+
+	result := tlsReport(*report)
+	return &result, nil
+}
+
+// ListTLSReports returns the latest TLS reports of a node, or the latest report of every
+// node, worst grade first, when nodeID is nil
+func (s *sniService) ListTLSReports(ctx context.Context, nodeID *uuid.UUID) ([]models.TLSReport, error) {
+	if err := s.available(); err != nil {
+		return nil, err
+	}
+	id := ""
+	if nodeID != nil {
+		id = nodeID.String()
+	}
+	reports, err := s.orchestrator.ListTLSReports(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list TLS reports: %w", err)
+	}
+
+	result := make([]models.TLSReport, 0, len(reports))
+	for _, report := range reports {
+		result = append(result, tlsReport(report))
+	}
+	return result, nil
+}
+
+func tlsReport(report orchestrator.TLSReport) models.TLSReport {
+	result := models.TLSReport{
+		ID:           report.ID,
+		NodeID:       report.NodeID,
+		ProberNodeID: report.ProberNodeID,
+		Target:       report.Target,
+		Grade:        report.Grade,
+		Score:        report.Score,
+		StartedAt:    time.Unix(report.StartedAt, 0).UTC(),
+		FinishedAt:   time.Unix(report.FinishedAt, 0).UTC(),
+		Checks:       make([]models.TLSCheck, 0, len(report.Checks)),
+	}
+	for _, check := range report.Checks {
+		result.Checks = append(result.Checks, models.TLSCheck{
+			Name:       check.Name,
+			Target:     check.Target,
+			Status:     check.Status,
+			Detail:     check.Detail,
+			Hint:       check.Hint,
+			DurationMs: check.DurationMs,
+		})
+	}
+	return result
+}
+
+func orchestratorCertificateFilter(filter models.CertificateFilter) orchestrator.CertificateFilter {
+	result := orchestrator.CertificateFilter{
+		Domain:             filter.Domain,
+		ExpiringWithinDays: filter.ExpiringWithinDays,
+		SelfSigned:         filter.SelfSigned,
+	}
+	if filter.NodeID != nil {
+		result.NodeID = filter.NodeID.String()
+	}
+	return result
+}
+
+func (s *sniService) available() error {
+	if s.orchestrator == nil {
+		return fmt.Errorf("orchestrator gateway is not configured")
+	}
+	return nil
+}
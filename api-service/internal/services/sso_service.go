@@ -0,0 +1,298 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/models"
+	repoInterfaces "hysteria2_microservices/api-service/internal/repositories/interfaces"
+	serviceInterfaces "hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/cache"
+	"hysteria2_microservices/api-service/pkg/logger"
+	"hysteria2_microservices/api-service/pkg/oidc"
+
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+// ssoLoginTTL is how long a browser has to complete a sign-in at the provider
+const ssoLoginTTL = 10 * time.Minute
+
+// externalRoleRank orders the roles single sign-on and the directory sync grant; a user in
+// several mapped groups gets the highest. Reseller accounts need a quota and are only made
+// through the reseller API.
+var externalRoleRank = map[string]int{
+	"user":  1,
+	"admin": 2,
+}
+
+// SSOOptions control who may sign in through the provider and with which role
+type SSOOptions struct {
+	// GroupsClaim is the ID token claim listing the user's groups, e.g. "groups" or
+	// "realm_access.roles"
+	GroupsClaim string
+	// RoleMapping maps provider groups to roles
+	RoleMapping map[string]string
+	// DefaultRole is given to users in no mapped group; empty refuses them
+	DefaultRole string
+	// AutoProvision creates accounts for provider users without one
+	AutoProvision bool
+}
+
+type ssoService struct {
+	provider     *oidc.Provider
+	identityRepo repoInterfaces.UserIdentityRepository
+	userRepo     repoInterfaces.UserRepository
+	redis        *cache.RedisClient
+	options      SSOOptions
+	logger       *logger.Logger
+}
+
+// ssoLogin is what a sign-in in progress keeps between Begin and Complete
+type ssoLogin struct {
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+}
+
+func NewSSOService(provider *oidc.Provider, identityRepo repoInterfaces.UserIdentityRepository, userRepo repoInterfaces.UserRepository, redis *cache.RedisClient, options SSOOptions, logger *logger.Logger) (serviceInterfaces.SSOService, error) {
+	for group, role := range options.RoleMapping {
+		if _, ok := externalRoleRank[role]; !ok {
+			return nil, fmt.Errorf("group %q maps to role %q; single sign-on grants admin or user", group, role)
+		}
+	}
+	if _, ok := externalRoleRank[options.DefaultRole]; options.DefaultRole != "" && !ok {
+		return nil, fmt.Errorf("default role %q; single sign-on grants admin or user", options.DefaultRole)
+	}
+
+	return &ssoService{
+		provider:     provider,
+		identityRepo: identityRepo,
+		userRepo:     userRepo,
+		redis:        redis,
+		options:      options,
+		logger:       logger,
+	}, nil
+}
+
+func (s *ssoService) Begin(ctx context.Context) (string, error) {
+	state, err := oidc.RandomValue()
+	if err != nil {
+		return "", err
+	}
+	login := ssoLogin{}
+	if login.Nonce, err = oidc.RandomValue(); err != nil {
+		return "", err
+	}
+	if login.Verifier, err = oidc.RandomValue(); err != nil {
+		return "", err
+	}
+
+	if err := s.redis.Set(ctx, ssoLoginKey(state), login, ssoLoginTTL); err != nil {
+		return "", fmt.Errorf("failed to store sign-in state: %w", err)
+	}
+	return s.provider.AuthCodeURL(ctx, state, login.Nonce, login.Verifier)
+}
+
+func (s *ssoService) Complete(ctx context.Context, state, code string) (*models.User, error) {
+	// The state is consumed whatever the outcome, so a callback cannot be replayed
+	var login ssoLogin
+	if err := s.redis.GetDel(ctx, ssoLoginKey(state), &login); err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, serviceInterfaces.ErrSSOStateInvalid
+		}
+		return nil, fmt.Errorf("failed to read sign-in state: %w", err)
+	}
+
+	tokens, err := s.provider.Exchange(ctx, code, login.Verifier)
+	if err != nil {
+		return nil, err
+	}
+	id, err := s.provider.VerifyIDToken(ctx, tokens.IDToken, login.Nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	role := s.role(id.Strings(s.options.GroupsClaim))
+	if role == "" {
+		return nil, fmt.Errorf("%w: no group of the account grants a role", serviceInterfaces.ErrSSODenied)
+	}
+
+	user, identity, err := s.resolve(ctx, id, role)
+	if err != nil {
+		return nil, err
+	}
+	if user.Status != "active" {
+		return nil, fmt.Errorf("%w: account is not active", serviceInterfaces.ErrSSODenied)
+	}
+
+	// Groups are the source of truth for roles, so a user removed from the admin group at
+	// the provider loses the role at the next sign-in. Resellers and their users are left
+	// to the reseller API.
+	if user.Role != role && user.Role != "reseller" && user.ResellerID == nil {
+		s.logger.Info("Role changed by single sign-on", "user_id", user.ID, "from", user.Role, "to", role)
+		user.Role = role
+		if err := s.userRepo.Update(ctx, user); err != nil {
+			return nil, fmt.Errorf("failed to update role: %w", err)
+		}
+	}
+
+	now := time.Now()
+	if err := s.identityRepo.RecordLogin(ctx, identity.ID, id.Email, now); err != nil {
+		s.logger.Warn("Failed to record sign-in", "user_id", user.ID, "error", err)
+	}
+	if err := s.userRepo.UpdateLastLogin(ctx, user.ID); err != nil {
+		s.logger.Warn("Failed to update last login", "user_id", user.ID, "error", err)
+	}
+	s.redis.Del(ctx, fmt.Sprintf("user:%s", user.ID.String()))
+
+	return user, nil
+}
+
+// resolve finds the user of a provider account: by an identity linked before, then by a
+// verified email address, which links the identity, and creates one when allowed
+func (s *ssoService) resolve(ctx context.Context, id *oidc.IDToken, role string) (*models.User, *models.UserIdentity, error) {
+	identity, err := s.identityRepo.GetBySubject(ctx, s.provider.Issuer(), id.Subject)
+	if err == nil {
+		user, err := s.userRepo.GetByID(ctx, identity.UserID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get user: %w", err)
+		}
+		return user, identity, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, fmt.Errorf("failed to get identity: %w", err)
+	}
+
+	if id.Email == "" {
+		return nil, nil, fmt.Errorf("%w: the provider sent no email address", serviceInterfaces.ErrSSODenied)
+	}
+	identity = &models.UserIdentity{
+		Issuer:  s.provider.Issuer(),
+		Subject: id.Subject,
+		Email:   id.Email,
+	}
+
+	user, err := s.userRepo.GetByEmail(ctx, id.Email)
+	switch {
+	case err == nil:
+		// Only the provider vouching for the address may take over a local account
+		if !id.EmailVerified {
+			return nil, nil, fmt.Errorf("%w: the provider has not verified the email address", serviceInterfaces.ErrSSODenied)
+		}
+		if err := s.identityRepo.Link(ctx, user, identity); err != nil {
+			return nil, nil, fmt.Errorf("failed to link identity: %w", err)
+		}
+		s.logger.Info("Identity linked", "user_id", user.ID, "issuer", identity.Issuer)
+		return user, identity, nil
+	case !errors.Is(err, gorm.ErrRecordNotFound):
+		return nil, nil, fmt.Errorf("failed to get user: %w", err)
+	case !s.options.AutoProvision:
+		return nil, nil, fmt.Errorf("%w: no account exists for %s", serviceInterfaces.ErrSSODenied, id.Email)
+	}
+
+	base := id.PreferredUsername
+	if base == "" {
+		base, _, _ = strings.Cut(id.Email, "@")
+	}
+	username, err := freeUsername(ctx, s.userRepo, base, s.provider.Issuer()+"\x00"+id.Subject)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The account signs in through the provider only
+	hashedPassword, err := unusablePassword()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user = &models.User{
+		Username: username,
+		Email:    id.Email,
+		Password: hashedPassword,
+		Status:   "active",
+		Role:     role,
+	}
+	if id.Name != "" {
+		user.FullName = &id.Name
+	}
+	if err := s.identityRepo.Link(ctx, user, identity); err != nil {
+		return nil, nil, fmt.Errorf("failed to create user: %w", err)
+	}
+	s.logger.Info("User provisioned by single sign-on", "user_id", user.ID, "username", username, "role", role)
+	return user, identity, nil
+}
+
+// role returns the highest role the groups map to, or the default role
+func (s *ssoService) role(groups []string) string {
+	role := ""
+	for _, group := range groups {
+		if mapped, ok := s.options.RoleMapping[group]; ok && externalRoleRank[mapped] > externalRoleRank[role] {
+			role = mapped
+		}
+	}
+	if role == "" {
+		return s.options.DefaultRole
+	}
+	return role
+}
+
+// freeUsername derives a free username from a name, suffixed with a hash of salt, which
+// identifies the external account, when the plain one is taken
+func freeUsername(ctx context.Context, userRepo repoInterfaces.UserRepository, name, salt string) (string, error) {
+	base := sanitizeUsername(name)
+	sum := sha256.Sum256([]byte(salt))
+	candidates := []string{base, base + "-" + hex.EncodeToString(sum[:3])}
+	if len(base) < 3 {
+		candidates = candidates[1:]
+	}
+	for _, candidate := range candidates {
+		_, err := userRepo.GetByUsername(ctx, candidate)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return candidate, nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to check username: %w", err)
+		}
+	}
+	return "", serviceInterfaces.ErrUsernameTaken
+}
+
+// unusablePassword hashes a random password nobody knows, for accounts that sign in
+// through an external provider only
+func unusablePassword() (string, error) {
+	random, err := oidc.RandomValue()
+	if err != nil {
+		return "", err
+	}
+	hashedPassword, err := hashPassword(random)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash password: %w", err)
+	}
+	return hashedPassword, nil
+}
+
+// sanitizeUsername keeps the lower-case letters, digits, dots, dashes and underscores of a
+// name, at most 40 of them
+func sanitizeUsername(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '.' || r == '-' || r == '_' {
+			b.WriteRune(r)
+		}
+		if b.Len() == 40 {
+			break
+		}
+	}
+	if b.Len() == 0 {
+		return "sso"
+	}
+	return b.String()
+}
+
+func ssoLoginKey(state string) string {
+	return "oidc_login:" + state
+}
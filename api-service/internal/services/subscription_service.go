@@ -0,0 +1,706 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/models"
+	repoInterfaces "hysteria2_microservices/api-service/internal/repositories/interfaces"
+	serviceInterfaces "hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/logger"
+	"hysteria2_microservices/api-service/pkg/sharelink"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	SubscriptionFormatSingBox = "sing-box"
+	SubscriptionFormatXray    = "xray"
+)
+
+// Clients probe every endpoint through this URL and fail over to the next healthy one
+// without waiting for the subscription to be re-fetched
+const (
+	subscriptionProbeURL      = "https://www.gstatic.com/generate_204"
+	subscriptionProbeInterval = "3m"
+	// hysteriaHopInterval is how often clients switch ports of a port-hopping range
+	hysteriaHopInterval = "30s"
+)
+
+// Kinds of node addresses, in the order clients try them
+const (
+	nodeAddressDomain  = "domain"
+	nodeAddressPrimary = "primary"
+	nodeAddressIPv6    = "ipv6"
+	nodeAddressBackup  = "backup"
+)
+
+// subscriptionProtocols are the protocols subscriptions offer, keyed as in the node protocol
+// matrix, in their default order
+var subscriptionProtocols = []string{"vless-reality", "vless", "trojan", "hysteria2"}
+
+// browserALPN is advertised by both the generated clients and the TLS inbounds so the
+// negotiated protocol matches what the impersonated browser would use
+var browserALPN = []string{"h2", "http/1.1"}
+
+// browserCipherSuites restricts TLS 1.2 suites on TLS inbounds to the AEAD suites offered by
+// current Chrome, Firefox and Safari; TLS 1.3 suites are not configurable in Xray
+const browserCipherSuites = "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256:TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:" +
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384:TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:" +
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256:TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256"
+
+// xrayServerConfig is the subset of a stored server-side Xray config needed to build client outbounds
+type xrayServerConfig struct {
+	Inbounds []struct {
+		Port     int    `json:"port"`
+		Protocol string `json:"protocol"`
+		Settings struct {
+			Clients []struct {
+				ID       string `json:"id"`
+				Flow     string `json:"flow"`
+				Password string `json:"password"`
+			} `json:"clients"`
+		} `json:"settings"`
+		StreamSettings struct {
+			Network         string `json:"network"`
+			Security        string `json:"security"`
+			RealitySettings struct {
+				ServerNames []string `json:"serverNames"`
+				PublicKey   string   `json:"publicKey"`
+				ShortIDs    []string `json:"shortIds"`
+			} `json:"realitySettings"`
+		} `json:"streamSettings"`
+	} `json:"inbounds"`
+}
+
+// clientEndpoint is a protocol-agnostic description of one client outbound
+type clientEndpoint struct {
+	tag          string
+	protocol     string
+	server       string
+	port         int
+	portRanges   []string // Hysteria2 port hopping, "20000:50000"
+	id           string
+	flow         string
+	password     string
+	security     string
+	serverName   string
+	publicKey    string
+	shortID      string
+	insecure     bool
+	obfsPassword string
+}
+
+// nodeAddressEntry is one address clients can reach a node at
+type nodeAddressEntry struct {
+	kind    string
+	address string
+}
+
+type subscriptionService struct {
+	userRepo         repoInterfaces.UserRepository
+	nodeRepo         repoInterfaces.NodeRepository
+	xrayRepo         repoInterfaces.XrayConfigRepository
+	hysteriaRepo     repoInterfaces.HysteriaConfigRepository
+	recommender      serviceInterfaces.RecommendationService
+	asnPolicyRepo    repoInterfaces.ASNPolicyRepository
+	fingerprints     []string
+	rotationInterval time.Duration
+	logger           *logger.Logger
+}
+
+func NewSubscriptionService(
+	userRepo repoInterfaces.UserRepository,
+	nodeRepo repoInterfaces.NodeRepository,
+	xrayRepo repoInterfaces.XrayConfigRepository,
+	hysteriaRepo repoInterfaces.HysteriaConfigRepository,
+	recommender serviceInterfaces.RecommendationService,
+	asnPolicyRepo repoInterfaces.ASNPolicyRepository,
+	fingerprints []string,
+	rotationInterval time.Duration,
+	logger *logger.Logger,
+) serviceInterfaces.SubscriptionService {
+	if len(fingerprints) == 0 {
+		fingerprints = []string{"chrome"}
+	}
+	if rotationInterval <= 0 {
+		rotationInterval = 24 * time.Hour
+	}
+	return &subscriptionService{
+		userRepo:         userRepo,
+		nodeRepo:         nodeRepo,
+		xrayRepo:         xrayRepo,
+		hysteriaRepo:     hysteriaRepo,
+		recommender:      recommender,
+		asnPolicyRepo:    asnPolicyRepo,
+		fingerprints:     fingerprints,
+		rotationInterval: rotationInterval,
+		logger:           logger,
+	}
+}
+
+// GetFingerprint returns the uTLS fingerprint a user should present at the given time
+// and when it next rotates. Users are offset by a hash of their ID so the fleet does
+// not switch fingerprints in lockstep.
+func (s *subscriptionService) GetFingerprint(userID uuid.UUID, at time.Time) (string, time.Time) {
+	h := fnv.New32a()
+	h.Write(userID[:])
+
+	period := at.Unix() / int64(s.rotationInterval.Seconds())
+	index := (uint64(h.Sum32()) + uint64(period)) % uint64(len(s.fingerprints))
+	rotatesAt := time.Unix((period+1)*int64(s.rotationInterval.Seconds()), 0).UTC()
+
+	return s.fingerprints[index], rotatesAt
+}
+
+// GenerateSubscription builds the user's client config with the nodes ordered best first
+// for the client's location, so the first outbound is the default selection. Every node is
+// offered at each of its addresses, and clients probe the endpoints to fail over in order.
+func (s *subscriptionService) GenerateSubscription(ctx context.Context, userID uuid.UUID, format string, client models.ClientLocation) (*models.ClientSubscription, error) {
+	if format != SubscriptionFormatSingBox && format != SubscriptionFormatXray {
+		return nil, fmt.Errorf("unsupported subscription format: %s", format)
+	}
+
+	user, err := s.userRepo.GetByID(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+	if user.Status != "active" {
+		return nil, fmt.Errorf("user is not active")
+	}
+
+	configs, err := s.xrayRepo.GetActiveByUserID(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user configs: %w", err)
+	}
+
+	nodes, err := s.subscriptionNodes(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get nodes: %w", err)
+	}
+	nodes = s.rankNodes(ctx, nodes, client)
+
+	// Xray clients have no Hysteria2 outbound
+	var hysteriaConfigs []*models.HysteriaConfig
+	if format == SubscriptionFormatSingBox {
+		if hysteriaConfigs, err = s.hysteriaRepo.GetActiveByUserID(ctx, userID); err != nil {
+			return nil, fmt.Errorf("failed to get user configs: %w", err)
+		}
+	}
+
+	var endpoints []clientEndpoint
+	for _, node := range nodes {
+		for _, cfg := range configs {
+			endpoints = append(endpoints, s.buildEndpoints(node, cfg)...)
+		}
+		endpoints = append(endpoints, s.buildHysteriaEndpoints(node, hysteriaConfigs)...)
+	}
+	s.applyASNPolicy(ctx, endpoints, client.ASN)
+
+	fingerprint, rotatesAt := s.GetFingerprint(userID, time.Now())
+
+	var config map[string]interface{}
+	if format == SubscriptionFormatSingBox {
+		config = buildSingBoxConfig(endpoints, fingerprint)
+	} else {
+		config = buildXrayClientConfig(endpoints, fingerprint)
+	}
+
+	s.logger.Debug("Generated subscription", "user_id", userID, "format", format, "endpoints", len(endpoints), "fingerprint", fingerprint)
+
+	return &models.ClientSubscription{
+		Format:              format,
+		Fingerprint:         fingerprint,
+		RotatesAt:           rotatesAt,
+		UpdateIntervalHours: int(s.rotationInterval.Hours()),
+		Download:            user.DataUsed,
+		Total:               user.DataLimit,
+		ExpiresAt:           user.ExpiryDate,
+		Config:              config,
+	}, nil
+}
+
+// subscriptionNodes returns the online nodes assigned to the user. Users without any
+// assignment predate node assignment and are offered every online node.
+func (s *subscriptionService) subscriptionNodes(ctx context.Context, userID uuid.UUID) ([]*models.VPSNode, error) {
+	assigned, err := s.nodeRepo.GetAssignedNodes(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(assigned) == 0 {
+		return s.nodeRepo.GetOnlineNodes(ctx)
+	}
+
+	var nodes []*models.VPSNode
+	for _, node := range assigned {
+		if node.Status == "online" {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes, nil
+}
+
+// rankNodes orders nodes by recommendation for the client. Ranking is best effort: on
+// failure the nodes keep their original order rather than failing the subscription.
+func (s *subscriptionService) rankNodes(ctx context.Context, nodes []*models.VPSNode, client models.ClientLocation) []*models.VPSNode {
+	if s.recommender == nil || len(nodes) < 2 {
+		return nodes
+	}
+	ranked, err := s.recommender.RankNodes(ctx, nodes, client)
+	if err != nil {
+		s.logger.Warn("Failed to rank subscription nodes", "error", err)
+		return nodes
+	}
+
+	ordered := make([]*models.VPSNode, 0, len(ranked))
+	for _, rec := range ranked {
+		ordered = append(ordered, rec.Node)
+	}
+	return ordered
+}
+
+// applyASNPolicy moves the endpoints of the protocols an operator recommends for the client's
+// ASN to the front, in the policy's order, keeping the node ranking within each protocol.
+// Protocols the policy leaves out stay behind them, so clients can still fall back to them.
+func (s *subscriptionService) applyASNPolicy(ctx context.Context, endpoints []clientEndpoint, asn uint32) {
+	if s.asnPolicyRepo == nil || asn == 0 || len(endpoints) < 2 {
+		return
+	}
+	policy, err := s.asnPolicyRepo.GetByASN(ctx, asn)
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			s.logger.Warn("Failed to get ASN protocol policy", "asn", asn, "error", err)
+		}
+		return
+	}
+
+	rank := make(map[string]int, len(policy.Protocols))
+	for i, protocol := range policy.Protocols {
+		rank[protocol] = i
+	}
+	rankOf := func(e clientEndpoint) int {
+		if r, ok := rank[matrixProtocol(e.protocol, e.security)]; ok {
+			return r
+		}
+		return len(rank)
+	}
+	sort.SliceStable(endpoints, func(i, j int) bool {
+		return rankOf(endpoints[i]) < rankOf(endpoints[j])
+	})
+}
+
+func (s *subscriptionService) buildEndpoints(node *models.VPSNode, cfg *models.XrayConfig) []clientEndpoint {
+	var server xrayServerConfig
+	data, err := json.Marshal(cfg.ConfigData)
+	if err == nil {
+		err = json.Unmarshal(data, &server)
+	}
+	if err != nil {
+		s.logger.Warn("Skipping unreadable Xray config", "config_id", cfg.ID, "error", err)
+		return nil
+	}
+
+	addresses := nodeAddresses(node)
+
+	var endpoints []clientEndpoint
+	for _, inbound := range server.Inbounds {
+		// uTLS only applies to TCP transports; skip protocols without a client identity
+		if inbound.Protocol != "vless" && inbound.Protocol != "trojan" {
+			continue
+		}
+		if len(inbound.Settings.Clients) == 0 {
+			continue
+		}
+		if !node.IsProtocolEnabled(matrixProtocol(inbound.Protocol, inbound.StreamSettings.Security)) {
+			continue
+		}
+
+		client := inbound.Settings.Clients[0]
+		endpoint := clientEndpoint{
+			protocol:   inbound.Protocol,
+			port:       inbound.Port,
+			id:         client.ID,
+			flow:       client.Flow,
+			password:   client.Password,
+			security:   inbound.StreamSettings.Security,
+			serverName: node.Hostname,
+		}
+
+		if endpoint.security == "reality" {
+			reality := inbound.StreamSettings.RealitySettings
+			endpoint.publicKey = reality.PublicKey
+			if len(reality.ServerNames) > 0 {
+				endpoint.serverName = reality.ServerNames[0]
+			}
+			if len(reality.ShortIDs) > 0 {
+				endpoint.shortID = reality.ShortIDs[0]
+			}
+		}
+
+		for i, address := range addresses {
+			endpoint.tag = endpointTag(node.Name, cfg.Protocol, i, address.kind)
+			endpoint.server = address.address
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints
+}
+
+// buildHysteriaEndpoints returns the Hysteria2 outbounds of the first readable client config
+// at each of the node's addresses, hopping over the config's port ranges
+func (s *subscriptionService) buildHysteriaEndpoints(node *models.VPSNode, configs []*models.HysteriaConfig) []clientEndpoint {
+	if !node.IsProtocolEnabled(ShareProtocolHysteria2) {
+		return nil
+	}
+
+	for _, cfg := range configs {
+		var client hysteriaClientConfig
+		data, err := json.Marshal(cfg.ConfigData)
+		if err == nil {
+			err = json.Unmarshal(data, &client)
+		}
+		if err != nil {
+			s.logger.Warn("Skipping unreadable Hysteria config", "config_id", cfg.ID, "error", err)
+			continue
+		}
+
+		_, ports := sharelink.SplitServer(client.Server)
+		port, ranges, err := hysteriaPorts(ports)
+		if err != nil {
+			s.logger.Warn("Skipping Hysteria config with invalid ports", "config_id", cfg.ID, "ports", ports, "error", err)
+			continue
+		}
+
+		endpoint := clientEndpoint{
+			protocol:   ShareProtocolHysteria2,
+			port:       port,
+			portRanges: ranges,
+			password:   client.Auth,
+			serverName: client.TLS.SNI,
+			insecure:   client.TLS.Insecure,
+		}
+		if client.Obfs.Type == sharelink.ObfsSalamander {
+			endpoint.obfsPassword = client.Obfs.Salamander.Password
+		}
+		if endpoint.serverName == "" && net.ParseIP(nodeAddress(node)) == nil {
+			endpoint.serverName = nodeAddress(node)
+		}
+
+		var endpoints []clientEndpoint
+		for i, address := range nodeAddresses(node) {
+			endpoint.tag = endpointTag(node.Name, ShareProtocolHysteria2, i, address.kind)
+			endpoint.server = address.address
+			endpoints = append(endpoints, endpoint)
+		}
+		return endpoints
+	}
+	return nil
+}
+
+// hysteriaPorts converts the port part of a Hysteria2 server address, e.g. "443" or
+// "443,20000-50000", into a single port or sing-box port ranges
+func hysteriaPorts(ports string) (int, []string, error) {
+	if port, err := strconv.Atoi(ports); err == nil {
+		return port, nil, nil
+	}
+
+	var ranges []string
+	for _, part := range strings.Split(ports, ",") {
+		first, last, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		if !isRange {
+			last = first
+		}
+		start, err := strconv.Atoi(first)
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid port %q", part)
+		}
+		end, err := strconv.Atoi(last)
+		if err != nil || end < start {
+			return 0, nil, fmt.Errorf("invalid port range %q", part)
+		}
+		ranges = append(ranges, fmt.Sprintf("%d:%d", start, end))
+	}
+	return 0, ranges, nil
+}
+
+// nodeAddresses returns the addresses clients can reach a node at, in failover order: the
+// address share links use, usually a domain that follows the node when its IP changes,
+// then its primary and IPv6 addresses and the backup addresses listed in metadata
+// "backup_ips"
+func nodeAddresses(node *models.VPSNode) []nodeAddressEntry {
+	var addresses []nodeAddressEntry
+	add := func(kind, address string) {
+		address = strings.TrimSpace(address)
+		if address == "" {
+			return
+		}
+		for _, existing := range addresses {
+			if existing.address == address {
+				return
+			}
+		}
+		addresses = append(addresses, nodeAddressEntry{kind: kind, address: address})
+	}
+
+	if first := nodeAddress(node); net.ParseIP(first) == nil {
+		add(nodeAddressDomain, first)
+	}
+	add(nodeAddressPrimary, node.IPAddress)
+	if ipv6, ok := node.Capabilities["ipv6_address"].(string); ok {
+		add(nodeAddressIPv6, ipv6)
+	}
+	for _, backup := range nodeBackupAddresses(node) {
+		add(nodeAddressBackup, backup)
+	}
+	return addresses
+}
+
+// nodeBackupAddresses reads the operator-set backup addresses from node metadata, which
+// holds a comma-separated string when set through the API and a list when set by the
+// orchestrator
+func nodeBackupAddresses(node *models.VPSNode) []string {
+	switch value := node.Metadata["backup_ips"].(type) {
+	case string:
+		return strings.Split(value, ",")
+	case []interface{}:
+		addresses := make([]string, 0, len(value))
+		for _, v := range value {
+			if address, ok := v.(string); ok {
+				addresses = append(addresses, address)
+			}
+		}
+		return addresses
+	case []string:
+		return value
+	}
+	return nil
+}
+
+// endpointTag names the outbound of a node address; the first address keeps the plain
+// node-protocol tag so existing client selections survive
+func endpointTag(nodeName, protocol string, index int, kind string) string {
+	if index == 0 {
+		return fmt.Sprintf("%s-%s", nodeName, protocol)
+	}
+	return fmt.Sprintf("%s-%s-%s%d", nodeName, protocol, kind, index)
+}
+
+// matrixProtocol maps an Xray inbound to its key in the node protocol matrix
+func matrixProtocol(protocol, security string) string {
+	if protocol == "vless" && security == "reality" {
+		return "vless-reality"
+	}
+	return protocol
+}
+
+func buildSingBoxConfig(endpoints []clientEndpoint, fingerprint string) map[string]interface{} {
+	outbounds := []map[string]interface{}{}
+	tags := []string{}
+
+	for _, e := range endpoints {
+		outbound := map[string]interface{}{
+			"type":        e.protocol,
+			"tag":         e.tag,
+			"server":      e.server,
+			"server_port": e.port,
+		}
+		if e.protocol == ShareProtocolHysteria2 {
+			outbounds = append(outbounds, singBoxHysteriaOutbound(e))
+			tags = append(tags, e.tag)
+			continue
+		}
+		if e.protocol == "vless" {
+			outbound["uuid"] = e.id
+			if e.flow != "" {
+				outbound["flow"] = e.flow
+			}
+		} else {
+			outbound["password"] = e.password
+		}
+
+		if e.security == "tls" || e.security == "reality" {
+			tls := map[string]interface{}{
+				"enabled":     true,
+				"server_name": e.serverName,
+				"utls": map[string]interface{}{
+					"enabled":     true,
+					"fingerprint": fingerprint,
+				},
+			}
+			if e.security == "reality" {
+				tls["reality"] = map[string]interface{}{
+					"enabled":    true,
+					"public_key": e.publicKey,
+					"short_id":   e.shortID,
+				}
+			} else {
+				tls["alpn"] = browserALPN
+			}
+			outbound["tls"] = tls
+		}
+
+		outbounds = append(outbounds, outbound)
+		tags = append(tags, e.tag)
+	}
+
+	selector := map[string]interface{}{
+		"type":      "selector",
+		"tag":       "proxy",
+		"outbounds": append(tags, "direct"),
+	}
+	groups := []map[string]interface{}{selector}
+	if len(tags) > 1 {
+		// The auto group probes every endpoint and moves off failed ones on its own
+		groups = append(groups, map[string]interface{}{
+			"type":      "urltest",
+			"tag":       "auto",
+			"outbounds": tags,
+			"url":       subscriptionProbeURL,
+			"interval":  subscriptionProbeInterval,
+		})
+		selector["outbounds"] = append([]string{"auto"}, selector["outbounds"].([]string)...)
+		selector["default"] = "auto"
+	} else if len(tags) > 0 {
+		selector["default"] = tags[0]
+	}
+
+	outbounds = append(groups, outbounds...)
+	outbounds = append(outbounds, map[string]interface{}{"type": "direct", "tag": "direct"})
+
+	return map[string]interface{}{
+		"log":       map[string]interface{}{"level": "warn"},
+		"outbounds": outbounds,
+		"route":     map[string]interface{}{"final": "proxy"},
+	}
+}
+
+func singBoxHysteriaOutbound(e clientEndpoint) map[string]interface{} {
+	outbound := map[string]interface{}{
+		"type":     "hysteria2",
+		"tag":      e.tag,
+		"server":   e.server,
+		"password": e.password,
+		"tls": map[string]interface{}{
+			"enabled":     true,
+			"server_name": e.serverName,
+			"insecure":    e.insecure,
+			"alpn":        []string{"h3"},
+		},
+	}
+	if len(e.portRanges) > 0 {
+		outbound["server_ports"] = e.portRanges
+		outbound["hop_interval"] = hysteriaHopInterval
+	} else {
+		outbound["server_port"] = e.port
+	}
+	if e.obfsPassword != "" {
+		outbound["obfs"] = map[string]interface{}{
+			"type":     sharelink.ObfsSalamander,
+			"password": e.obfsPassword,
+		}
+	}
+	return outbound
+}
+
+func buildXrayClientConfig(endpoints []clientEndpoint, fingerprint string) map[string]interface{} {
+	outbounds := []map[string]interface{}{}
+	tags := []string{}
+
+	for _, e := range endpoints {
+		if e.protocol == ShareProtocolHysteria2 {
+			continue
+		}
+		outbound := map[string]interface{}{
+			"tag":      e.tag,
+			"protocol": e.protocol,
+		}
+		if e.protocol == "vless" {
+			outbound["settings"] = map[string]interface{}{
+				"vnext": []map[string]interface{}{{
+					"address": e.server,
+					"port":    e.port,
+					"users": []map[string]interface{}{{
+						"id":         e.id,
+						"flow":       e.flow,
+						"encryption": "none",
+					}},
+				}},
+			}
+		} else {
+			outbound["settings"] = map[string]interface{}{
+				"servers": []map[string]interface{}{{
+					"address":  e.server,
+					"port":     e.port,
+					"password": e.password,
+				}},
+			}
+		}
+
+		stream := map[string]interface{}{
+			"network":  "tcp",
+			"security": e.security,
+		}
+		switch e.security {
+		case "reality":
+			stream["realitySettings"] = map[string]interface{}{
+				"serverName":  e.serverName,
+				"fingerprint": fingerprint,
+				"publicKey":   e.publicKey,
+				"shortId":     e.shortID,
+			}
+		case "tls":
+			stream["tlsSettings"] = map[string]interface{}{
+				"serverName":  e.serverName,
+				"fingerprint": fingerprint,
+				"alpn":        browserALPN,
+			}
+		}
+		outbound["streamSettings"] = stream
+
+		outbounds = append(outbounds, outbound)
+		tags = append(tags, e.tag)
+	}
+
+	outbounds = append(outbounds, map[string]interface{}{
+		"tag":      "direct",
+		"protocol": "freedom",
+	})
+
+	config := map[string]interface{}{
+		"log":       map[string]interface{}{"loglevel": "warning"},
+		"outbounds": outbounds,
+	}
+	if len(tags) > 1 {
+		// The observatory probes every endpoint; traffic goes to the fastest healthy one and
+		// to the best ranked endpoint until the first probes finish
+		config["observatory"] = map[string]interface{}{
+			"subjectSelector":   tags,
+			"probeUrl":          subscriptionProbeURL,
+			"probeInterval":     subscriptionProbeInterval,
+			"enableConcurrency": true,
+		}
+		config["routing"] = map[string]interface{}{
+			"balancers": []map[string]interface{}{{
+				"tag":         "auto",
+				"selector":    tags,
+				"strategy":    map[string]interface{}{"type": "leastPing"},
+				"fallbackTag": tags[0],
+			}},
+			"rules": []map[string]interface{}{{
+				"type":        "field",
+				"network":     "tcp,udp",
+				"balancerTag": "auto",
+			}},
+		}
+	}
+	return config
+}
@@ -0,0 +1,243 @@
+package services
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/models"
+	repoInterfaces "hysteria2_microservices/api-service/internal/repositories/interfaces"
+	"hysteria2_microservices/api-service/pkg/logger"
+
+	"github.com/google/uuid"
+)
+
+type fakeSubscriptionUsers struct {
+	repoInterfaces.UserRepository
+	user *models.User
+}
+
+func (f *fakeSubscriptionUsers) GetByID(ctx context.Context, id uuid.UUID) (*models.User, error) {
+	return f.user, nil
+}
+
+type fakeSubscriptionNodes struct {
+	repoInterfaces.NodeRepository
+	nodes []*models.VPSNode
+}
+
+func (f *fakeSubscriptionNodes) GetAssignedNodes(ctx context.Context, userID uuid.UUID) ([]*models.VPSNode, error) {
+	return nil, nil
+}
+
+func (f *fakeSubscriptionNodes) GetOnlineNodes(ctx context.Context) ([]*models.VPSNode, error) {
+	return f.nodes, nil
+}
+
+type fakeXrayConfigs struct {
+	repoInterfaces.XrayConfigRepository
+	configs []*models.XrayConfig
+}
+
+func (f *fakeXrayConfigs) GetActiveByUserID(ctx context.Context, userID uuid.UUID) ([]*models.XrayConfig, error) {
+	return f.configs, nil
+}
+
+type fakeHysteriaConfigs struct {
+	repoInterfaces.HysteriaConfigRepository
+	configs []*models.HysteriaConfig
+}
+
+func (f *fakeHysteriaConfigs) GetActiveByUserID(ctx context.Context, userID uuid.UUID) ([]*models.HysteriaConfig, error) {
+	return f.configs, nil
+}
+
+// testXrayServerConfig is a stored server config with a REALITY and a TLS inbound
+func testXrayServerConfig() *models.XrayConfig {
+	return &models.XrayConfig{
+		ID:       uuid.New(),
+		Protocol: "vless-reality",
+		ConfigData: map[string]interface{}{
+			"inbounds": []interface{}{
+				map[string]interface{}{
+					"port":     443,
+					"protocol": "vless",
+					"settings": map[string]interface{}{
+						"clients": []interface{}{map[string]interface{}{"id": "c0ffee00-0000-4000-8000-000000000001", "flow": "xtls-rprx-vision"}},
+					},
+					"streamSettings": map[string]interface{}{
+						"network":  "tcp",
+						"security": "reality",
+						"realitySettings": map[string]interface{}{
+							"serverNames": []interface{}{"www.microsoft.com"},
+							"publicKey":   "reality-public-key",
+							"shortIds":    []interface{}{"6ba85179e30d4fc2"},
+						},
+					},
+				},
+				map[string]interface{}{
+					"port":     8443,
+					"protocol": "trojan",
+					"settings": map[string]interface{}{
+						"clients": []interface{}{map[string]interface{}{"password": "trojan-secret"}},
+					},
+					"streamSettings": map[string]interface{}{"network": "tcp", "security": "tls"},
+				},
+			},
+		},
+	}
+}
+
+func newTestSubscriptionService(fingerprints []string, interval time.Duration) *subscriptionService {
+	node := &models.VPSNode{ID: uuid.New(), Name: "fra-1", Hostname: "fra-1.example.com", IPAddress: "203.0.113.10", Status: "online"}
+	return NewSubscriptionService(
+		&fakeSubscriptionUsers{user: &models.User{Status: "active"}},
+		&fakeSubscriptionNodes{nodes: []*models.VPSNode{node}},
+		&fakeXrayConfigs{configs: []*models.XrayConfig{testXrayServerConfig()}},
+		&fakeHysteriaConfigs{},
+		nil, nil, fingerprints, interval, logger.NewLogger("error"),
+	).(*subscriptionService)
+}
+
+func TestGetFingerprintRotates(t *testing.T) {
+	fingerprints := []string{"chrome", "firefox", "safari", "ios"}
+	s := newTestSubscriptionService(fingerprints, 6*time.Hour)
+	user := uuid.New()
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	first, rotatesAt := s.GetFingerprint(user, start.Add(time.Hour))
+	if !rotatesAt.Equal(start.Add(6 * time.Hour)) {
+		t.Errorf("rotates at %s, want the end of the 6h period", rotatesAt)
+	}
+	// The fingerprint holds for the whole period
+	if again, _ := s.GetFingerprint(user, start.Add(6*time.Hour-time.Second)); again != first {
+		t.Errorf("fingerprint changed within a period: %s, then %s", first, again)
+	}
+
+	// Every configured fingerprint comes up once per cycle
+	seen := map[string]bool{}
+	for period := 0; period < len(fingerprints); period++ {
+		fp, _ := s.GetFingerprint(user, start.Add(time.Duration(period)*6*time.Hour))
+		seen[fp] = true
+	}
+	if len(seen) != len(fingerprints) {
+		t.Errorf("one cycle used %v, want all of %v", seen, fingerprints)
+	}
+
+	// Users are spread over the list instead of rotating in lockstep
+	used := map[string]bool{}
+	for i := 0; i < 32; i++ {
+		fp, _ := s.GetFingerprint(uuid.New(), start)
+		used[fp] = true
+	}
+	if len(used) < 2 {
+		t.Errorf("32 users all got %v in the same period", used)
+	}
+}
+
+func TestGetFingerprintDefaults(t *testing.T) {
+	s := newTestSubscriptionService(nil, 0)
+	at := time.Date(2024, 3, 1, 15, 0, 0, 0, time.UTC)
+
+	fp, rotatesAt := s.GetFingerprint(uuid.New(), at)
+	if fp != "chrome" || !rotatesAt.Equal(time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("got %s rotating at %s, want chrome rotating daily", fp, rotatesAt)
+	}
+}
+
+func TestGenerateSubscriptionAppliesFingerprint(t *testing.T) {
+	s := newTestSubscriptionService([]string{"firefox"}, 12*time.Hour)
+	user := uuid.New()
+
+	t.Run("sing-box", func(t *testing.T) {
+		sub, err := s.GenerateSubscription(context.Background(), user, SubscriptionFormatSingBox, models.ClientLocation{})
+		if err != nil {
+			t.Fatalf("GenerateSubscription: %v", err)
+		}
+		if sub.Fingerprint != "firefox" || sub.UpdateIntervalHours != 12 || !sub.RotatesAt.After(time.Now()) {
+			t.Errorf("subscription = %s every %dh rotating at %s, want firefox every 12h", sub.Fingerprint, sub.UpdateIntervalHours, sub.RotatesAt)
+		}
+
+		tlsOf := map[string]map[string]interface{}{}
+		for _, outbound := range sub.Config["outbounds"].([]map[string]interface{}) {
+			if tls, ok := outbound["tls"].(map[string]interface{}); ok {
+				tlsOf[outbound["type"].(string)] = tls
+			}
+		}
+		for _, protocol := range []string{"vless", "trojan"} {
+			tls := tlsOf[protocol]
+			utls, _ := tls["utls"].(map[string]interface{})
+			if utls["enabled"] != true || utls["fingerprint"] != "firefox" {
+				t.Errorf("%s utls = %v, want firefox", protocol, utls)
+			}
+		}
+		// ALPN matches the browser on TLS; REALITY borrows the target's handshake
+		if alpn, _ := tlsOf["trojan"]["alpn"].([]string); len(alpn) != 2 || alpn[0] != "h2" {
+			t.Errorf("trojan alpn = %v, want the browser ALPN", tlsOf["trojan"]["alpn"])
+		}
+		if _, ok := tlsOf["vless"]["alpn"]; ok {
+			t.Error("REALITY outbound sets ALPN")
+		}
+	})
+
+	t.Run("xray", func(t *testing.T) {
+		sub, err := s.GenerateSubscription(context.Background(), user, SubscriptionFormatXray, models.ClientLocation{})
+		if err != nil {
+			t.Fatalf("GenerateSubscription: %v", err)
+		}
+
+		stream := map[string]map[string]interface{}{}
+		for _, outbound := range sub.Config["outbounds"].([]map[string]interface{}) {
+			if settings, ok := outbound["streamSettings"].(map[string]interface{}); ok {
+				stream[outbound["protocol"].(string)] = settings
+			}
+		}
+		reality, _ := stream["vless"]["realitySettings"].(map[string]interface{})
+		if reality["fingerprint"] != "firefox" || reality["serverName"] != "www.microsoft.com" {
+			t.Errorf("vless realitySettings = %v, want firefox for www.microsoft.com", reality)
+		}
+		tls, _ := stream["trojan"]["tlsSettings"].(map[string]interface{})
+		if tls["fingerprint"] != "firefox" || tls["serverName"] != "fra-1.example.com" {
+			t.Errorf("trojan tlsSettings = %v, want firefox for the node hostname", tls)
+		}
+	})
+
+	if _, err := s.GenerateSubscription(context.Background(), user, "clash", models.ClientLocation{}); err == nil {
+		t.Error("generated an unsupported format")
+	}
+}
+
+func TestGenerateSubscriptionFollowsProtocolMatrix(t *testing.T) {
+	s := newTestSubscriptionService(nil, 0)
+	node := s.nodeRepo.(*fakeSubscriptionNodes).nodes[0]
+
+	// protocolsOf returns the protocols offered, once each whatever the node addresses
+	protocolsOf := func() map[string]bool {
+		sub, err := s.GenerateSubscription(context.Background(), uuid.New(), SubscriptionFormatXray, models.ClientLocation{})
+		if err != nil {
+			t.Fatalf("GenerateSubscription: %v", err)
+		}
+		protocols := map[string]bool{}
+		for _, outbound := range sub.Config["outbounds"].([]map[string]interface{}) {
+			if outbound["tag"] != "direct" {
+				protocols[outbound["protocol"].(string)] = true
+			}
+		}
+		return protocols
+	}
+
+	// An empty matrix predates the matrix and enables everything
+	if got := protocolsOf(); !reflect.DeepEqual(got, map[string]bool{"vless": true, "trojan": true}) {
+		t.Errorf("outbounds %v, want vless and trojan", got)
+	}
+	node.Protocols = map[string]interface{}{"vless-reality": false, "trojan": true}
+	if got := protocolsOf(); !reflect.DeepEqual(got, map[string]bool{"trojan": true}) {
+		t.Errorf("outbounds %v, want trojan only", got)
+	}
+	// Protocols missing from a set matrix are off
+	node.Protocols = map[string]interface{}{"hysteria2": true}
+	if got := protocolsOf(); len(got) != 0 {
+		t.Errorf("outbounds %v, want none", got)
+	}
+}
@@ -0,0 +1,162 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"hysteria2_microservices/api-service/internal/models"
+	repoInterfaces "hysteria2_microservices/api-service/internal/repositories/interfaces"
+	"hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/geoip"
+	"hysteria2_microservices/api-service/pkg/logger"
+	"hysteria2_microservices/api-service/pkg/orchestrator"
+)
+
+const (
+	// Events older than this are stale app caches and dropped
+	maxTelemetryEventAge = 7 * 24 * time.Hour
+	// Forwarding to the obfuscation experiments must not hold up the app
+	experimentForwardTimeout = 10 * time.Second
+)
+
+// telemetryService stores the connection outcomes client apps report once their user opted
+// in. Events are stored without the user, device or address they came from.
+type telemetryService struct {
+	repo         repoInterfaces.TelemetryRepository
+	userRepo     repoInterfaces.UserRepository
+	geoDB        *geoip.DB
+	orchestrator *orchestrator.Client // nil when no orchestrator gateway is configured
+	logger       *logger.Logger
+}
+
+// NewTelemetryService creates the client telemetry store. geoDB and orchestrator may be
+// nil; without the orchestrator, events are not handed to obfuscation experiments.
+func NewTelemetryService(
+	repo repoInterfaces.TelemetryRepository,
+	userRepo repoInterfaces.UserRepository,
+	geoDB *geoip.DB,
+	orchestrator *orchestrator.Client,
+	logger *logger.Logger,
+) interfaces.TelemetryService {
+	return &telemetryService{
+		repo:         repo,
+		userRepo:     userRepo,
+		geoDB:        geoDB,
+		orchestrator: orchestrator,
+		logger:       logger,
+	}
+}
+
+func (s *telemetryService) SetOptIn(ctx context.Context, userID uuid.UUID, enabled bool) error {
+	user, err := s.userRepo.GetByID(ctx, userID)
+	if err != nil {
+		return interfaces.ErrNotFound
+	}
+	user.TelemetryOptIn = enabled
+	if err := s.userRepo.Update(ctx, user); err != nil {
+		return fmt.Errorf("failed to update user: %w", err)
+	}
+	return nil
+}
+
+// Ingest stores the events of a report from a user who opted in and returns how many were
+// kept. The client's country is resolved from loc, which is not stored.
+func (s *telemetryService) Ingest(ctx context.Context, userID uuid.UUID, loc models.ClientLocation, report *models.TelemetryReport) (int, error) {
+	user, err := s.userRepo.GetByID(ctx, userID)
+	if err != nil {
+		return 0, interfaces.ErrNotFound
+	}
+	if !user.TelemetryOptIn {
+		return 0, interfaces.ErrTelemetryOptOut
+	}
+
+	country := strings.ToUpper(loc.Country)
+	if country == "" && loc.IP != "" {
+		country = s.geoDB.Country(loc.IP)
+	}
+	isp := strings.TrimSpace(report.ISP)
+	if len(isp) > 100 {
+		isp = isp[:100]
+	}
+
+	now := time.Now()
+	events := make([]*models.ClientTelemetry, 0, len(report.Events))
+	for _, event := range report.Events {
+		at := event.OccurredAt
+		if at.IsZero() || at.After(now) {
+			at = now
+		}
+		if now.Sub(at) > maxTelemetryEventAge {
+			continue
+		}
+
+		row := &models.ClientTelemetry{
+			NodeID:         event.NodeID,
+			Protocol:       strings.ToLower(event.Protocol),
+			Success:        event.Success,
+			HandshakeMs:    event.HandshakeMs,
+			ThroughputKbps: event.ThroughputKbps,
+			ASN:            report.ASN,
+			ISP:            isp,
+			Country:        country,
+			ReportedAt:     at,
+		}
+		if !event.Success {
+			row.FailureReason = telemetryFailureReason(event.FailureReason)
+		}
+		events = append(events, row)
+	}
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	if err := s.repo.CreateBatch(ctx, events); err != nil {
+		return 0, fmt.Errorf("failed to store telemetry: %w", err)
+	}
+	s.forwardToExperiments(events)
+	return len(events), nil
+}
+
+// forwardToExperiments hands the events to the orchestrator, which keeps those for nodes
+// in a running obfuscation experiment
+func (s *telemetryService) forwardToExperiments(events []*models.ClientTelemetry) {
+	if s.orchestrator == nil {
+		return
+	}
+
+	samples := make([]orchestrator.ExperimentSample, 0, len(events))
+	for _, event := range events {
+		samples = append(samples, orchestrator.ExperimentSample{
+			NodeID:         event.NodeID.String(),
+			Success:        event.Success,
+			HandshakeMs:    event.HandshakeMs,
+			ThroughputKbps: event.ThroughputKbps,
+			FailureReason:  event.FailureReason,
+			Timestamp:      event.ReportedAt.Unix(),
+		})
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), experimentForwardTimeout)
+		defer cancel()
+		if _, err := s.orchestrator.ReportExperimentSamples(ctx, samples); err != nil {
+			s.logger.Warn("Failed to forward telemetry to obfuscation experiments", "events", len(samples), "error", err)
+		}
+	}()
+}
+
+// telemetryFailureReason normalizes an app-reported failure reason into a short label
+func telemetryFailureReason(reason string) string {
+	reason = strings.ToLower(strings.TrimSpace(reason))
+	if reason == "" {
+		return "unknown"
+	}
+	if len(reason) > 50 {
+		reason = reason[:50]
+	}
+	return reason
+}
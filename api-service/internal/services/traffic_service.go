@@ -2,32 +2,67 @@ package services
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"hysteria2_microservices/api-service/internal/models"
 	repoInterfaces "hysteria2_microservices/api-service/internal/repositories/interfaces"
 	serviceInterfaces "hysteria2_microservices/api-service/internal/services/interfaces"
 	"hysteria2_microservices/api-service/pkg/cache"
+	"hysteria2_microservices/api-service/pkg/logger"
+	"hysteria2_microservices/pkg/events"
 
 	"github.com/google/uuid"
 )
 
+// trafficEventKeyPrefix marks the traffic events already ingested, so a batch delivered
+// again after a lost acknowledgement is not counted twice
+const (
+	trafficEventKeyPrefix = "traffic:event:"
+	trafficEventKeyTTL    = 24 * time.Hour
+)
+
+// trafficIngestKey is the Redis list of JSON samples waiting to be written. Every replica
+// pops whole batches from it, so any number of them can flush side by side.
+const trafficIngestKey = "traffic:ingest"
+
 type trafficService struct {
 	trafficRepo      repoInterfaces.TrafficRepository
 	redis            *cache.RedisClient
 	webSocketService serviceInterfaces.WebSocketService
+	policy           models.TrafficIngestPolicy
+	logger           *logger.Logger
 
 	// Worker pool for broadcasts
 	workerPoolSize int
 	jobChan        chan func()
 	stopChan       chan struct{}
+	stopOnce       sync.Once
+	wg             sync.WaitGroup
+
+	// Unix time of the last backpressure alert, so a backlog raises one alert a minute
+	lastBackpressureAlert atomic.Int64
 }
 
-func NewTrafficService(trafficRepo repoInterfaces.TrafficRepository, redis *cache.RedisClient, wsService serviceInterfaces.WebSocketService) serviceInterfaces.TrafficService {
+func NewTrafficService(trafficRepo repoInterfaces.TrafficRepository, redis *cache.RedisClient, wsService serviceInterfaces.WebSocketService, policy models.TrafficIngestPolicy, logger *logger.Logger) serviceInterfaces.TrafficService {
+	if policy.BatchSize <= 0 {
+		policy.BatchSize = 5000
+	}
+	if policy.FlushInterval <= 0 {
+		policy.FlushInterval = time.Second
+	}
+	if policy.MaxPending <= 0 {
+		policy.MaxPending = 1000000
+	}
 	ts := &trafficService{
 		trafficRepo:      trafficRepo,
 		redis:            redis,
 		webSocketService: wsService,
+		policy:           policy,
+		logger:           logger,
 		workerPoolSize:   10,
 		jobChan:          make(chan func(), 100),
 		stopChan:         make(chan struct{}),
@@ -47,16 +82,195 @@ func (s *trafficService) RecordTraffic(ctx context.Context, stats *models.Traffi
 		return err
 	}
 
-	// Send real-time update via WebSocket
-	if s.webSocketService != nil && s.webSocketService.IsUserConnected(stats.UserID) {
-		select {
-		case s.jobChan <- func() { s.webSocketService.BroadcastTrafficUpdate(stats.UserID, stats) }:
-		default:
-			// Drop if pool full
+	s.notify(stats)
+	return nil
+}
+
+// IngestSamples queues reported samples for the flush worker. While more than the pending
+// limit are queued the report is refused with ErrIngestBackpressure, so a slow database
+// holds the agents back instead of filling Redis.
+func (s *trafficService) IngestSamples(ctx context.Context, samples []models.TrafficSample) error {
+	if len(samples) == 0 {
+		return nil
+	}
+
+	pending, err := s.redis.LLen(ctx, trafficIngestKey)
+	if err != nil {
+		return err
+	}
+	if pending+int64(len(samples)) > s.policy.MaxPending {
+		s.alertBackpressure(pending)
+		return serviceInterfaces.ErrIngestBackpressure
+	}
+
+	now := time.Now()
+	values := make([]interface{}, len(samples))
+	for i, sample := range samples {
+		if sample.RecordedAt.IsZero() {
+			sample.RecordedAt = now
+		}
+		data, err := json.Marshal(sample)
+		if err != nil {
+			return err
 		}
+		values[i] = data
 	}
+	return s.redis.RPush(ctx, trafficIngestKey, values...)
+}
 
-	return nil
+// ConsumeEvents queues the samples of traffic events for the flush worker. A batch refused
+// by backpressure is delivered again later, so it waits in the stream rather than in Redis.
+func (s *trafficService) ConsumeEvents(ctx context.Context, bus *events.Bus) {
+	bus.Consume(ctx, events.ConsumerOptions{
+		Durable:       "api-traffic",
+		FilterSubject: events.TrafficSubjects,
+	}, func(ctx context.Context, event *events.Event) error {
+		var batch events.TrafficBatch
+		if err := json.Unmarshal(event.Data, &batch); err != nil {
+			return events.Permanent(fmt.Errorf("malformed traffic event %s: %w", event.ID, err))
+		}
+
+		key := trafficEventKeyPrefix + event.ID
+		seen, err := s.redis.Exists(ctx, key)
+		if err != nil {
+			return err
+		}
+		if seen > 0 {
+			return nil
+		}
+
+		samples := make([]models.TrafficSample, 0, len(batch.Samples))
+		for _, sample := range batch.Samples {
+			userID, err := uuid.Parse(sample.UserID)
+			if err != nil || sample.Upload < 0 || sample.Download < 0 {
+				s.logger.Warn("Dropping invalid traffic sample", "node_id", batch.NodeID, "user_id", sample.UserID)
+				continue
+			}
+			converted := models.TrafficSample{
+				UserID:     userID,
+				Upload:     sample.Upload,
+				Download:   sample.Download,
+				RecordedAt: sample.RecordedAt,
+			}
+			if deviceID, err := uuid.Parse(sample.DeviceID); err == nil {
+				converted.DeviceID = &deviceID
+			}
+			samples = append(samples, converted)
+		}
+
+		if err := s.IngestSamples(ctx, samples); err != nil {
+			return err
+		}
+		return s.redis.Set(ctx, key, 1, trafficEventKeyTTL)
+	})
+}
+
+// Start runs the flush worker, which writes queued samples in batches every flush interval
+// and straight away again while full batches are waiting
+func (s *trafficService) Start(ctx context.Context) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(s.policy.FlushInterval)
+		defer ticker.Stop()
+
+		for {
+			for {
+				n, err := s.flush(ctx)
+				if err != nil {
+					s.logger.Error("Traffic flush failed", "error", err)
+				}
+				if err != nil || n < s.policy.BatchSize || ctx.Err() != nil {
+					break
+				}
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			case <-s.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the flush worker and the broadcast workers. Samples still queued stay in Redis
+// for the next start.
+func (s *trafficService) Stop() {
+	s.stopOnce.Do(func() { close(s.stopChan) })
+	s.wg.Wait()
+}
+
+// flush writes one batch of queued samples and returns how many it took from the queue. A
+// batch that fails to write is put back at the head of the queue to be retried first.
+func (s *trafficService) flush(ctx context.Context) (int, error) {
+	values, err := s.redis.LPopCount(ctx, trafficIngestKey, s.policy.BatchSize)
+	if err != nil || len(values) == 0 {
+		return 0, err
+	}
+
+	samples := make([]models.TrafficSample, 0, len(values))
+	for _, value := range values {
+		var sample models.TrafficSample
+		if err := json.Unmarshal([]byte(value), &sample); err != nil {
+			s.logger.Warn("Dropping malformed traffic sample", "error", err)
+			continue
+		}
+		samples = append(samples, sample)
+	}
+
+	if err := s.trafficRepo.CopySamples(ctx, samples); err != nil {
+		// LPUSH prepends one value at a time, so push the batch reversed to keep its order
+		requeue := make([]interface{}, len(values))
+		for i, value := range values {
+			requeue[len(values)-1-i] = value
+		}
+		if pushErr := s.redis.LPush(context.Background(), trafficIngestKey, requeue...); pushErr != nil {
+			return 0, fmt.Errorf("%w; %d samples lost: %v", err, len(values), pushErr)
+		}
+		return 0, err
+	}
+
+	for i := range samples {
+		s.notify(&models.TrafficStats{
+			UserID:     samples[i].UserID,
+			DeviceID:   samples[i].DeviceID,
+			Upload:     samples[i].Upload,
+			Download:   samples[i].Download,
+			Total:      samples[i].Upload + samples[i].Download,
+			RecordedAt: samples[i].RecordedAt,
+		})
+	}
+	return len(values), nil
+}
+
+// alertBackpressure tells the admins that reports are being refused, at most once a minute
+func (s *trafficService) alertBackpressure(pending int64) {
+	if s.webSocketService == nil {
+		return
+	}
+	now := time.Now().Unix()
+	last := s.lastBackpressureAlert.Load()
+	if now-last < 60 || !s.lastBackpressureAlert.CompareAndSwap(last, now) {
+		return
+	}
+	s.webSocketService.BroadcastAlert("warning", "INGEST_BACKPRESSURE",
+		fmt.Sprintf("Traffic reports are refused, %d samples are waiting to be written", pending))
+}
+
+// notify sends a real-time update to the user over WebSocket when they are connected
+func (s *trafficService) notify(stats *models.TrafficStats) {
+	if s.webSocketService == nil || !s.webSocketService.IsUserConnected(stats.UserID) {
+		return
+	}
+	select {
+	case s.jobChan <- func() { s.webSocketService.BroadcastTrafficUpdate(stats.UserID, stats) }:
+	default:
+		// Drop if pool full
+	}
 }
 
 func (s *trafficService) GetUserTraffic(ctx context.Context, userID uuid.UUID, from, to time.Time) ([]*models.TrafficStats, error) {
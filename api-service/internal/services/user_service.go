@@ -2,6 +2,7 @@ package services
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
 	"hysteria2_microservices/api-service/internal/models"
@@ -10,24 +11,32 @@ import (
 	"hysteria2_microservices/api-service/pkg/cache"
 
 	"github.com/google/uuid"
+	"gorm.io/gorm"
 )
 
 type userService struct {
 	userRepo   repoInterfaces.UserRepository
 	deviceRepo repoInterfaces.DeviceRepository
 	redis      *cache.RedisClient
+	email      serviceInterfaces.EmailService
 }
 
-func NewUserService(userRepo repoInterfaces.UserRepository, deviceRepo repoInterfaces.DeviceRepository, redis *cache.RedisClient) serviceInterfaces.UserService {
+func NewUserService(userRepo repoInterfaces.UserRepository, deviceRepo repoInterfaces.DeviceRepository, redis *cache.RedisClient, email serviceInterfaces.EmailService) serviceInterfaces.UserService {
 	return &userService{
 		userRepo:   userRepo,
 		deviceRepo: deviceRepo,
 		redis:      redis,
+		email:      email,
 	}
 }
 
+// CreateUser stores a new account and mails its owner a welcome message
 func (s *userService) CreateUser(ctx context.Context, user *models.User) error {
-	return s.userRepo.Create(ctx, user)
+	if err := s.userRepo.Create(ctx, user); err != nil {
+		return err
+	}
+	s.email.SendWelcome(user)
+	return nil
 }
 
 func (s *userService) GetUserByID(ctx context.Context, id uuid.UUID) (*models.User, error) {
@@ -101,6 +110,53 @@ func (s *userService) GetUserDevices(ctx context.Context, userID uuid.UUID) ([]*
 	return devices, nil
 }
 
+// RenameDevice renames one of a user's devices. Devices of other users are reported as
+// ErrNotFound so their IDs cannot be probed.
+func (s *userService) RenameDevice(ctx context.Context, userID, deviceID uuid.UUID, name string) (*models.Device, error) {
+	device, err := s.getUserDevice(ctx, userID, deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	device.Name = name
+	if err := s.deviceRepo.Update(ctx, device); err != nil {
+		return nil, err
+	}
+
+	s.redis.Del(ctx, fmt.Sprintf("user_devices:%s", userID.String()))
+
+	return device, nil
+}
+
+// RemoveDevice deletes one of a user's devices
+func (s *userService) RemoveDevice(ctx context.Context, userID, deviceID uuid.UUID) error {
+	if _, err := s.getUserDevice(ctx, userID, deviceID); err != nil {
+		return err
+	}
+
+	if err := s.deviceRepo.Delete(ctx, deviceID); err != nil {
+		return err
+	}
+
+	s.redis.Del(ctx, fmt.Sprintf("user_devices:%s", userID.String()))
+
+	return nil
+}
+
+func (s *userService) getUserDevice(ctx context.Context, userID, deviceID uuid.UUID) (*models.Device, error) {
+	device, err := s.deviceRepo.GetByID(ctx, deviceID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, serviceInterfaces.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if device.UserID != userID {
+		return nil, serviceInterfaces.ErrNotFound
+	}
+	return device, nil
+}
+
 func (s *userService) UpdateUserDataUsage(ctx context.Context, userID uuid.UUID, dataUsed int64) error {
 	return s.userRepo.UpdateDataUsage(ctx, userID, dataUsed)
 }
@@ -0,0 +1,251 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/models"
+	repoInterfaces "hysteria2_microservices/api-service/internal/repositories/interfaces"
+	serviceInterfaces "hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/cache"
+	"hysteria2_microservices/api-service/pkg/logger"
+	"hysteria2_microservices/api-service/pkg/validation"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	// voucherCodeAlphabet leaves out characters read alike, such as 0/O and 1/I. Its 32
+	// characters divide 256, so a random byte maps onto it without bias.
+	voucherCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	voucherCodeGroups   = 3
+	voucherCodeGroupLen = 4
+
+	// voucherRedeemWindow is the period redeem attempts are counted per IP address in
+	voucherRedeemWindow = time.Hour
+)
+
+type voucherService struct {
+	voucherRepo repoInterfaces.VoucherRepository
+	userRepo    repoInterfaces.UserRepository
+	redis       *cache.RedisClient
+	ipLimit     int
+	logger      *logger.Logger
+}
+
+// NewVoucherService creates the voucher service. ipLimit is the number of redeem attempts
+// an IP address may make per hour, 0 disables the limit.
+func NewVoucherService(voucherRepo repoInterfaces.VoucherRepository, userRepo repoInterfaces.UserRepository, redis *cache.RedisClient, ipLimit int, logger *logger.Logger) serviceInterfaces.VoucherService {
+	return &voucherService{
+		voucherRepo: voucherRepo,
+		userRepo:    userRepo,
+		redis:       redis,
+		ipLimit:     ipLimit,
+		logger:      logger,
+	}
+}
+
+// CreateVouchers issues count vouchers with the terms of template, each with a new code
+func (s *voucherService) CreateVouchers(ctx context.Context, template *models.Voucher, count int) ([]*models.Voucher, error) {
+	vouchers := make([]*models.Voucher, 0, count)
+	for i := 0; i < count; i++ {
+		code, err := generateVoucherCode()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate voucher code: %w", err)
+		}
+		voucher := *template
+		voucher.Code = code
+		vouchers = append(vouchers, &voucher)
+	}
+
+	if err := s.voucherRepo.CreateBatch(ctx, vouchers); err != nil {
+		return nil, fmt.Errorf("failed to create vouchers: %w", err)
+	}
+	return vouchers, nil
+}
+
+func (s *voucherService) ListVouchers(ctx context.Context, page, limit int) ([]*models.Voucher, int64, error) {
+	offset := (page - 1) * limit
+	return s.voucherRepo.List(ctx, offset, limit)
+}
+
+func (s *voucherService) RevokeVoucher(ctx context.Context, id uuid.UUID) error {
+	err := s.voucherRepo.Revoke(ctx, id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return serviceInterfaces.ErrNotFound
+	}
+	return err
+}
+
+// Redeem applies a voucher to the account with the request's email, or to a new account.
+// Attempts are counted per IP address before the code is looked up, so codes cannot be
+// guessed faster than the limit allows.
+func (s *voucherService) Redeem(ctx context.Context, req *serviceInterfaces.RedeemRequest) (*serviceInterfaces.RedeemResult, error) {
+	if err := s.countAttempt(ctx, req.IPAddress); err != nil {
+		return nil, err
+	}
+
+	voucher, err := s.voucherRepo.GetByCode(ctx, normalizeVoucherCode(req.Code))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, serviceInterfaces.ErrVoucherInvalid
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get voucher: %w", err)
+	}
+	now := time.Now()
+	if !voucher.IsRedeemable(now) {
+		return nil, serviceInterfaces.ErrVoucherInvalid
+	}
+
+	if redeemed, err := s.voucherRepo.HasRedemption(ctx, voucher.ID, req.DeviceFingerprint); err != nil {
+		return nil, fmt.Errorf("failed to check redemptions: %w", err)
+	} else if redeemed {
+		return nil, serviceInterfaces.ErrVoucherRedeemed
+	}
+	if voucher.Trial {
+		if redeemed, err := s.voucherRepo.HasTrialRedemption(ctx, req.DeviceFingerprint); err != nil {
+			return nil, fmt.Errorf("failed to check trial redemptions: %w", err)
+		} else if redeemed {
+			return nil, serviceInterfaces.ErrTrialUsed
+		}
+	}
+
+	user, created, err := s.redeemingUser(ctx, voucher, req)
+	if err != nil {
+		return nil, err
+	}
+	applyVoucher(user, voucher, now)
+
+	redemption := &models.VoucherRedemption{
+		DeviceFingerprint: req.DeviceFingerprint,
+		IPAddress:         req.IPAddress,
+		Trial:             voucher.Trial,
+	}
+	err = s.voucherRepo.Redeem(ctx, voucher.ID, user, redemption)
+	if errors.Is(err, repoInterfaces.ErrVoucherUnavailable) {
+		return nil, serviceInterfaces.ErrVoucherInvalid
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to redeem voucher: %w", err)
+	}
+	voucher.Uses++
+
+	if !created {
+		s.redis.Del(ctx, fmt.Sprintf("user:%s", user.ID.String()))
+	}
+	s.logger.Info("Voucher redeemed", "voucher_id", voucher.ID, "user_id", user.ID, "created", created, "ip", req.IPAddress)
+
+	return &serviceInterfaces.RedeemResult{
+		User:    user,
+		Voucher: voucher,
+		Created: created,
+	}, nil
+}
+
+// redeemingUser returns the account a voucher tops up after checking its password, or a new
+// account, not yet stored, when no account has the email
+func (s *voucherService) redeemingUser(ctx context.Context, voucher *models.Voucher, req *serviceInterfaces.RedeemRequest) (*models.User, bool, error) {
+	user, err := s.userRepo.GetByEmail(ctx, req.Email)
+	if err == nil {
+		if !verifyPassword(req.Password, user.Password) || user.Status == "deleted" {
+			return nil, false, serviceInterfaces.ErrInvalidCredentials
+		}
+		if voucher.Trial {
+			return nil, false, serviceInterfaces.ErrTrialExistingAccount
+		}
+		return user, false, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, false, fmt.Errorf("failed to get user: %w", err)
+	}
+
+	if req.Username == "" {
+		return nil, false, &validation.Error{Fields: []validation.FieldError{{
+			Field:   "username",
+			Tag:     "required",
+			Message: "is required to create an account",
+		}}}
+	}
+	if _, err := s.userRepo.GetByUsername(ctx, req.Username); err == nil {
+		return nil, false, serviceInterfaces.ErrUsernameTaken
+	}
+
+	hashedPassword, err := hashPassword(req.Password)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to hash password: %w", err)
+	}
+	return &models.User{
+		Username: req.Username,
+		Email:    req.Email,
+		Password: hashedPassword,
+		Status:   "active",
+		Role:     "user",
+	}, true, nil
+}
+
+// countAttempt counts a redeem attempt of an IP address and returns ErrRateLimited once the
+// address exceeds its hourly limit
+func (s *voucherService) countAttempt(ctx context.Context, ip string) error {
+	return countAttempt(ctx, s.redis, fmt.Sprintf("voucher_redeem:%s", ip), s.ipLimit, voucherRedeemWindow)
+}
+
+// applyVoucher applies a voucher's terms to an account. An unlimited data limit (0) stays
+// unlimited, and an expiry date in the future is extended rather than replaced.
+func applyVoucher(user *models.User, voucher *models.Voucher, now time.Time) {
+	if voucher.Plan != "" {
+		user.UserGroup = voucher.Plan
+	}
+	if voucher.DataLimit > 0 && (user.DataLimit > 0 || user.ID == uuid.Nil) {
+		user.DataLimit += voucher.DataLimit
+	}
+	if voucher.DurationDays > 0 {
+		start := now
+		if user.ExpiryDate != nil && user.ExpiryDate.After(now) {
+			start = *user.ExpiryDate
+		}
+		expiry := start.AddDate(0, 0, voucher.DurationDays)
+		user.ExpiryDate = &expiry
+	}
+}
+
+func generateVoucherCode() (string, error) {
+	random := make([]byte, voucherCodeGroups*voucherCodeGroupLen)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	for i, b := range random {
+		random[i] = voucherCodeAlphabet[int(b)%len(voucherCodeAlphabet)]
+	}
+	return formatVoucherCode(random), nil
+}
+
+// normalizeVoucherCode accepts codes typed in lower case, without dashes or with spaces
+func normalizeVoucherCode(code string) string {
+	var chars []byte
+	for _, r := range strings.ToUpper(code) {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			chars = append(chars, byte(r))
+		}
+	}
+	if len(chars) != voucherCodeGroups*voucherCodeGroupLen {
+		return string(chars)
+	}
+	return formatVoucherCode(chars)
+}
+
+// formatVoucherCode groups code characters as XXXX-XXXX-XXXX
+func formatVoucherCode(chars []byte) string {
+	var code strings.Builder
+	for i, c := range chars {
+		if i > 0 && i%voucherCodeGroupLen == 0 {
+			code.WriteByte('-')
+		}
+		code.WriteByte(c)
+	}
+	return code.String()
+}
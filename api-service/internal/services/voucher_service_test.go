@@ -0,0 +1,189 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/models"
+	repoInterfaces "hysteria2_microservices/api-service/internal/repositories/interfaces"
+	serviceInterfaces "hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/logger"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// fakeVouchers keeps vouchers by code and redemptions by voucher and device, and refuses
+// redemptions past a voucher's uses as the repository's conditional update does
+type fakeVouchers struct {
+	repoInterfaces.VoucherRepository
+	vouchers    map[string]*models.Voucher
+	redemptions map[uuid.UUID]map[string]bool
+}
+
+func newFakeVouchers(vouchers ...*models.Voucher) *fakeVouchers {
+	f := &fakeVouchers{vouchers: map[string]*models.Voucher{}, redemptions: map[uuid.UUID]map[string]bool{}}
+	for _, v := range vouchers {
+		v.ID = uuid.New()
+		f.vouchers[v.Code] = v
+	}
+	return f
+}
+
+func (f *fakeVouchers) GetByCode(ctx context.Context, code string) (*models.Voucher, error) {
+	v, ok := f.vouchers[code]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	copied := *v
+	return &copied, nil
+}
+
+func (f *fakeVouchers) HasRedemption(ctx context.Context, voucherID uuid.UUID, deviceFingerprint string) (bool, error) {
+	return f.redemptions[voucherID][deviceFingerprint], nil
+}
+
+func (f *fakeVouchers) HasTrialRedemption(ctx context.Context, deviceFingerprint string) (bool, error) {
+	return false, nil
+}
+
+func (f *fakeVouchers) Redeem(ctx context.Context, voucherID uuid.UUID, user *models.User, redemption *models.VoucherRedemption) error {
+	for _, v := range f.vouchers {
+		if v.ID != voucherID {
+			continue
+		}
+		if v.Uses >= v.MaxUses {
+			return repoInterfaces.ErrVoucherUnavailable
+		}
+		v.Uses++
+		if f.redemptions[voucherID] == nil {
+			f.redemptions[voucherID] = map[string]bool{}
+		}
+		f.redemptions[voucherID][redemption.DeviceFingerprint] = true
+		return nil
+	}
+	return gorm.ErrRecordNotFound
+}
+
+// noVoucherUsers has no accounts, so every redemption creates one
+type noVoucherUsers struct {
+	repoInterfaces.UserRepository
+}
+
+func (noVoucherUsers) GetByEmail(ctx context.Context, email string) (*models.User, error) {
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (noVoucherUsers) GetByUsername(ctx context.Context, username string) (*models.User, error) {
+	return nil, gorm.ErrRecordNotFound
+}
+
+func redeemRequest(code, device string) *serviceInterfaces.RedeemRequest {
+	return &serviceInterfaces.RedeemRequest{
+		Code:              code,
+		Email:             device + "@example.com",
+		Username:          device,
+		Password:          "correct horse battery staple",
+		DeviceFingerprint: device,
+		IPAddress:         "203.0.113.7",
+	}
+}
+
+func TestVoucherRedeem(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	vouchers := newFakeVouchers(
+		&models.Voucher{Code: "AAAA-BBBB-CCCC", MaxUses: 2, DurationDays: 30},
+		&models.Voucher{Code: "EXPD-EXPD-EXPD", MaxUses: 1, ExpiresAt: &past},
+		&models.Voucher{Code: "USED-USED-USED", MaxUses: 1, Uses: 1},
+		&models.Voucher{Code: "REVK-REVK-REVK", MaxUses: 1, RevokedAt: &past},
+	)
+	s := NewVoucherService(vouchers, noVoucherUsers{}, nil, 0, logger.NewLogger("error"))
+	ctx := context.Background()
+
+	// Codes are accepted as typed
+	result, err := s.Redeem(ctx, redeemRequest("aaaa bbbb cccc", "phone"))
+	if err != nil {
+		t.Fatalf("first redemption: %v", err)
+	}
+	if !result.Created || result.Voucher.Uses != 1 || result.User.ExpiryDate == nil {
+		t.Errorf("first redemption = %+v", result)
+	}
+
+	tests := []struct {
+		name    string
+		req     *serviceInterfaces.RedeemRequest
+		wantErr error
+	}{
+		{"same device again", redeemRequest("AAAA-BBBB-CCCC", "phone"), serviceInterfaces.ErrVoucherRedeemed},
+		{"unknown code", redeemRequest("ZZZZ-ZZZZ-ZZZZ", "laptop"), serviceInterfaces.ErrVoucherInvalid},
+		{"expired", redeemRequest("EXPD-EXPD-EXPD", "laptop"), serviceInterfaces.ErrVoucherInvalid},
+		{"uses exhausted", redeemRequest("USED-USED-USED", "laptop"), serviceInterfaces.ErrVoucherInvalid},
+		{"revoked", redeemRequest("REVK-REVK-REVK", "laptop"), serviceInterfaces.ErrVoucherInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := s.Redeem(ctx, tt.req); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Redeem = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// The last use goes to another device, then the voucher is exhausted
+	if _, err := s.Redeem(ctx, redeemRequest("AAAA-BBBB-CCCC", "laptop")); err != nil {
+		t.Fatalf("second redemption: %v", err)
+	}
+	if _, err := s.Redeem(ctx, redeemRequest("AAAA-BBBB-CCCC", "tablet")); !errors.Is(err, serviceInterfaces.ErrVoucherInvalid) {
+		t.Errorf("redemption past the uses = %v, want ErrVoucherInvalid", err)
+	}
+}
+
+// A redemption racing another one for the last use loses in the repository's update
+func TestVoucherRedeemLosesRace(t *testing.T) {
+	vouchers := newFakeVouchers(&models.Voucher{Code: "AAAA-BBBB-CCCC", MaxUses: 1})
+	s := NewVoucherService(&racingVouchers{vouchers}, noVoucherUsers{}, nil, 0, logger.NewLogger("error"))
+	if _, err := s.Redeem(context.Background(), redeemRequest("AAAA-BBBB-CCCC", "phone")); !errors.Is(err, serviceInterfaces.ErrVoucherInvalid) {
+		t.Errorf("Redeem = %v, want ErrVoucherInvalid", err)
+	}
+}
+
+// racingVouchers spends the last use of a voucher between its lookup and the redemption
+type racingVouchers struct {
+	*fakeVouchers
+}
+
+func (r *racingVouchers) Redeem(ctx context.Context, voucherID uuid.UUID, user *models.User, redemption *models.VoucherRedemption) error {
+	for _, v := range r.vouchers {
+		if v.ID == voucherID {
+			v.Uses = v.MaxUses
+		}
+	}
+	return r.fakeVouchers.Redeem(ctx, voucherID, user, redemption)
+}
+
+func TestVoucherRedeemRateLimit(t *testing.T) {
+	redis := testRedis(t)
+	ctx := context.Background()
+	for _, ip := range []string{"203.0.113.7", "203.0.113.8"} {
+		redis.Del(ctx, "voucher_redeem:"+ip)
+		t.Cleanup(func() { redis.Del(ctx, "voucher_redeem:"+ip) })
+	}
+	s := NewVoucherService(newFakeVouchers(), noVoucherUsers{}, redis, 2, logger.NewLogger("error"))
+
+	// Guesses count against the address whether or not the code exists
+	for i := 0; i < 2; i++ {
+		if _, err := s.Redeem(ctx, redeemRequest("ZZZZ-ZZZZ-ZZZZ", "phone")); !errors.Is(err, serviceInterfaces.ErrVoucherInvalid) {
+			t.Fatalf("attempt %d = %v, want ErrVoucherInvalid", i+1, err)
+		}
+	}
+	if _, err := s.Redeem(ctx, redeemRequest("ZZZZ-ZZZZ-ZZZZ", "phone")); !errors.Is(err, serviceInterfaces.ErrRateLimited) {
+		t.Errorf("attempt over the limit = %v, want ErrRateLimited", err)
+	}
+
+	other := redeemRequest("ZZZZ-ZZZZ-ZZZZ", "phone")
+	other.IPAddress = "203.0.113.8"
+	if _, err := s.Redeem(ctx, other); !errors.Is(err, serviceInterfaces.ErrVoucherInvalid) {
+		t.Errorf("attempt from another address = %v, want ErrVoucherInvalid", err)
+	}
+}
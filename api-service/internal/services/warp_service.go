@@ -0,0 +1,199 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"hysteria2_microservices/api-service/internal/models"
+	serviceInterfaces "hysteria2_microservices/api-service/internal/services/interfaces"
+	"hysteria2_microservices/api-service/pkg/logger"
+	"hysteria2_microservices/api-service/pkg/orchestrator"
+
+	"github.com/google/uuid"
+)
+
+// warpService passes WARP management of nodes through to the orchestrator, which calls the
+// node's agent. Orchestrator errors are returned wrapped so handlers can report their code.
+type warpService struct {
+	orchestrator *orchestrator.Client // nil when no orchestrator gateway is configured
+	logger       *logger.Logger
+}
+
+func NewWARPService(orchestrator *orchestrator.Client, logger *logger.Logger) serviceInterfaces.WARPService {
+	return &warpService{
+		orchestrator: orchestrator,
+		logger:       logger,
+	}
+}
+
+func (s *warpService) GetStatus(ctx context.Context, nodeID uuid.UUID) (*models.NodeWARPStatus, error) {
+	if err := s.available(); err != nil {
+		return nil, err
+	}
+	status, err := s.orchestrator.GetWARPStatus(ctx, nodeID.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get WARP status: %w", err)
+	}
+
+	result := &models.NodeWARPStatus{
+		Installed:      status.Installed,
+		Connected:      status.Connected,
+		Mode:           status.Mode,
+		ProxyPort:      status.ProxyPort,
+		AccountType:    status.AccountType,
+		Organization:   status.Organization,
+		IPAddress:      status.IPAddress,
+		Location:       status.Location,
+		ServerLocation: status.ServerLocation,
+		UptimeSeconds:  status.Uptime,
+		BytesSent:      status.BytesSent,
+		BytesReceived:  status.BytesReceived,
+		Health:         status.Health,
+		Error:          status.Error,
+		ClientType:     status.ClientType,
+		DeviceID:       status.DeviceID,
+		DevicePosture:  status.DevicePosture,
+	}
+	// Agents report the zero time as a negative Unix time
+	if status.LastConnected > 0 {
+		at := time.Unix(status.LastConnected, 0).UTC()
+		result.LastConnectedAt = &at
+	}
+	return result, nil
+}
+
+func (s *warpService) Configure(ctx context.Context, nodeID uuid.UUID, settings *models.NodeWARPSettings) (string, error) {
+	if err := s.available(); err != nil {
+		return "", err
+	}
+	message, err := s.orchestrator.ConfigureWARP(ctx, nodeID.String(), orchestrator.WARPSettings{
+		Enabled:           settings.Enabled,
+		ProxyPort:         settings.ProxyPort,
+		AutoConnect:       settings.AutoConnect,
+		NotifyOnFail:      settings.NotifyOnFail,
+		ClientType:        settings.ClientType,
+		LicenseKey:        settings.LicenseKey,
+		Organization:      settings.Organization,
+		Mode:              settings.Mode,
+		TeamsClientID:     settings.TeamsClientID,
+		TeamsClientSecret: settings.TeamsClientSecret,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to configure WARP: %w", err)
+	}
+	s.logger.Info("WARP configured", "node_id", nodeID, "enabled", settings.Enabled, "client_type", settings.ClientType, "mode", settings.Mode)
+	return message, nil
+}
+
+func (s *warpService) Connect(ctx context.Context, nodeID uuid.UUID) (string, error) {
+	if err := s.available(); err != nil {
+		return "", err
+	}
+	message, err := s.orchestrator.ConnectWARP(ctx, nodeID.String())
+	if err != nil {
+		return "", fmt.Errorf("failed to connect WARP: %w", err)
+	}
+	s.logger.Info("WARP connected", "node_id", nodeID)
+	return message, nil
+}
+
+func (s *warpService) Disconnect(ctx context.Context, nodeID uuid.UUID) (string, error) {
+	if err := s.available(); err != nil {
+		return "", err
+	}
+	message, err := s.orchestrator.DisconnectWARP(ctx, nodeID.String())
+	if err != nil {
+		return "", fmt.Errorf("failed to disconnect WARP: %w", err)
+	}
+	s.logger.Info("WARP disconnected", "node_id", nodeID)
+	return message, nil
+}
+
+func (s *warpService) EnableProxy(ctx context.Context, nodeID uuid.UUID, port int) (string, error) {
+	if err := s.available(); err != nil {
+		return "", err
+	}
+	message, err := s.orchestrator.EnableWARPProxy(ctx, nodeID.String(), port)
+	if err != nil {
+		return "", fmt.Errorf("failed to enable WARP proxy: %w", err)
+	}
+	s.logger.Info("WARP proxy enabled", "node_id", nodeID, "port", port)
+	return message, nil
+}
+
+func (s *warpService) DisableProxy(ctx context.Context, nodeID uuid.UUID) (string, error) {
+	if err := s.available(); err != nil {
+		return "", err
+	}
+	message, err := s.orchestrator.DisableWARPProxy(ctx, nodeID.String())
+	if err != nil {
+		return "", fmt.Errorf("failed to disable WARP proxy: %w", err)
+	}
+	s.logger.Info("WARP proxy disabled", "node_id", nodeID)
+	return message, nil
+}
+
+func (s *warpService) EnableRouting(ctx context.Context, nodeID uuid.UUID, interfaceName string) (string, error) {
+	if err := s.available(); err != nil {
+		return "", err
+	}
+	message, err := s.orchestrator.EnableWARPRouting(ctx, nodeID.String(), interfaceName)
+	if err != nil {
+		return "", fmt.Errorf("failed to enable WARP traffic routing: %w", err)
+	}
+	s.logger.Info("WARP traffic routing enabled", "node_id", nodeID, "interface", interfaceName)
+	return message, nil
+}
+
+func (s *warpService) DisableRouting(ctx context.Context, nodeID uuid.UUID) (string, error) {
+	if err := s.available(); err != nil {
+		return "", err
+	}
+	message, err := s.orchestrator.DisableWARPRouting(ctx, nodeID.String())
+	if err != nil {
+		return "", fmt.Errorf("failed to disable WARP traffic routing: %w", err)
+	}
+	s.logger.Info("WARP traffic routing disabled", "node_id", nodeID)
+	return message, nil
+}
+
+func (s *warpService) TestConnectivity(ctx context.Context, nodeID uuid.UUID) (*models.WARPConnectivity, error) {
+	if err := s.available(); err != nil {
+		return nil, err
+	}
+	result, err := s.orchestrator.TestWARPConnectivity(ctx, nodeID.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to test WARP connectivity: %w", err)
+	}
+	return &models.WARPConnectivity{
+		Success: result.Success,
+		Message: result.Message,
+		Results: result.Results,
+	}, nil
+}
+
+func (s *warpService) GetLogs(ctx context.Context, nodeID uuid.UUID, lines int) (*models.WARPLogs, error) {
+	if err := s.available(); err != nil {
+		return nil, err
+	}
+	result, err := s.orchestrator.GetWARPLogs(ctx, nodeID.String(), lines)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get WARP logs: %w", err)
+	}
+	logs := &models.WARPLogs{
+		Logs:       result.Logs,
+		ClientType: result.ClientType,
+	}
+	if !result.Success {
+		logs.Error = result.Message
+	}
+	return logs, nil
+}
+
+func (s *warpService) available() error {
+	if s.orchestrator == nil {
+		return fmt.Errorf("orchestrator gateway is not configured")
+	}
+	return nil
+}
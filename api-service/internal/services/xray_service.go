@@ -3,33 +3,38 @@ package services
 import (
 	"context"
 	"fmt"
+	"strings"
 
 	"hysteria2_microservices/api-service/internal/models"
 	repoInterfaces "hysteria2_microservices/api-service/internal/repositories/interfaces"
 	serviceInterfaces "hysteria2_microservices/api-service/internal/services/interfaces"
 	"hysteria2_microservices/api-service/pkg/logger"
+	"hysteria2_microservices/api-service/pkg/orchestrator"
 
 	"github.com/google/uuid"
 )
 
 type XrayServiceImpl struct {
-	xrayRepo   repoInterfaces.XrayConfigRepository
-	userRepo   repoInterfaces.UserRepository
-	deviceRepo repoInterfaces.DeviceRepository
-	logger     *logger.Logger
+	xrayRepo     repoInterfaces.XrayConfigRepository
+	userRepo     repoInterfaces.UserRepository
+	deviceRepo   repoInterfaces.DeviceRepository
+	orchestrator *orchestrator.Client // nil when no orchestrator gateway is configured
+	logger       *logger.Logger
 }
 
 func NewXrayService(
 	xrayRepo repoInterfaces.XrayConfigRepository,
 	userRepo repoInterfaces.UserRepository,
 	deviceRepo repoInterfaces.DeviceRepository,
+	orchestrator *orchestrator.Client,
 	logger *logger.Logger,
 ) serviceInterfaces.XrayService {
 	return &XrayServiceImpl{
-		xrayRepo:   xrayRepo,
-		userRepo:   userRepo,
-		deviceRepo: deviceRepo,
-		logger:     logger,
+		xrayRepo:     xrayRepo,
+		userRepo:     userRepo,
+		deviceRepo:   deviceRepo,
+		orchestrator: orchestrator,
+		logger:       logger,
 	}
 }
 
@@ -126,16 +131,65 @@ func (s *XrayServiceImpl) ReloadConfiguration(ctx context.Context) error {
 	return fmt.Errorf("not implemented")
 }
 
+// GetActiveConnections lists the clients online on Xray across every online node. Nodes
+// the orchestrator could not reach are logged and left out.
 func (s *XrayServiceImpl) GetActiveConnections(ctx context.Context) ([]models.Connection, error) {
 	s.logger.Info("Getting active Xray connections")
-	// Implementation would query nodes for active connections
-	return nil, fmt.Errorf("not implemented")
+	if s.orchestrator == nil {
+		return nil, fmt.Errorf("orchestrator gateway is not configured")
+	}
+
+	result, err := s.orchestrator.GetXrayConnections(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get connections from orchestrator: %w", err)
+	}
+	if len(result.FailedNodes) > 0 {
+		s.logger.Warnf("Nodes %s did not report Xray connections", strings.Join(result.FailedNodes, ", "))
+	}
+
+	connections := make([]models.Connection, 0, len(result.Connections))
+	for _, connection := range result.Connections {
+		connections = append(connections, models.Connection{
+			ID:       connection.NodeID + "/" + connection.Email,
+			UserID:   connection.UserID,
+			DeviceID: connection.DeviceID,
+			NodeID:   connection.NodeID,
+			Address:  strings.Join(connection.IPs, ","),
+			Upload:   connection.Uplink,
+			Download: connection.Downlink,
+			LastSeen: connection.LastSeen,
+		})
+	}
+	return connections, nil
 }
 
+// DisconnectUser drops the Xray connections of a user, or of one of their devices, on every
+// online node. The user's configs are untouched, so clients may connect again unless they
+// are revoked as well.
 func (s *XrayServiceImpl) DisconnectUser(ctx context.Context, userID, deviceID string) error {
 	s.logger.Infof("Disconnecting Xray user %s, device %s", userID, deviceID)
-	// Implementation would send disconnect command to nodes
-	return fmt.Errorf("not implemented")
+	if s.orchestrator == nil {
+		return fmt.Errorf("orchestrator gateway is not configured")
+	}
+	if _, err := uuid.Parse(userID); err != nil {
+		return fmt.Errorf("invalid user ID: %w", err)
+	}
+	if deviceID != "" {
+		if _, err := uuid.Parse(deviceID); err != nil {
+			return fmt.Errorf("invalid device ID: %w", err)
+		}
+	}
+
+	result, err := s.orchestrator.DisconnectXrayUser(ctx, "", userID, deviceID)
+	if err != nil {
+		return fmt.Errorf("failed to disconnect user through orchestrator: %w", err)
+	}
+	if len(result.FailedNodes) > 0 {
+		return fmt.Errorf("failed to disconnect user on nodes %s", strings.Join(result.FailedNodes, ", "))
+	}
+
+	s.logger.Infof("Xray user %s disconnected, %d client(s) dropped", userID, len(result.Connections))
+	return nil
 }
 
 func (s *XrayServiceImpl) GetServiceStatus(ctx context.Context) (*models.ServiceStatus, error) {
@@ -300,7 +354,11 @@ func (s *XrayServiceImpl) generateTrojanConfig() (map[string]interface{}, error)
 				"streamSettings": map[string]interface{}{
 					"network":  "tcp",
 					"security": "tls",
+					// Match browser TLS behaviour so uTLS client fingerprints are consistent with the server
 					"tlsSettings": map[string]interface{}{
+						"alpn":         browserALPN,
+						"minVersion":   "1.2",
+						"cipherSuites": browserCipherSuites,
 						"certificates": []map[string]interface{}{
 							{
 								"certificateFile": "/etc/xray/cert.pem",
@@ -1,7 +1,9 @@
 package utils
 
 import (
+	"crypto/ecdsa"
 	"fmt"
+	"slices"
 	"time"
 
 	"hysteria2_microservices/api-service/internal/services/interfaces"
@@ -10,15 +12,24 @@ import (
 	"github.com/google/uuid"
 )
 
-func GenerateJWT(userID uuid.UUID, secret string, expiry time.Duration) (string, error) {
+// ServiceAudience is the audience of the tokens the api-service presents to the other
+// services. They are never accepted as user tokens.
+const ServiceAudience = "hysteria2-services"
+
+// KeyLookup returns the public key of the signing key with the given key ID
+type KeyLookup func(kid string) (*ecdsa.PublicKey, error)
+
+// GenerateJWT signs a token with an ES256 signing key, naming the key in the kid header.
+// The role claim is what role-restricted routes authorize against.
+func GenerateJWT(userID uuid.UUID, username, role, kid string, key *ecdsa.PrivateKey, expiry time.Duration) (string, error) {
 	now := time.Now()
 	claims := &interfaces.Claims{
 		UserID:   userID.String(),
-		Username: "", // Will be filled by service
-		Role:     "", // Will be filled by service
+		Username: username,
+		Role:     role,
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
 		"user_id":  claims.UserID,
 		"username": claims.Username,
 		"role":     claims.Role,
@@ -27,17 +38,64 @@ func GenerateJWT(userID uuid.UUID, secret string, expiry time.Duration) (string,
 		"iss":      "hysteria2-api",
 		"sub":      userID.String(),
 	})
+	token.Header["kid"] = kid
+
+	return token.SignedString(key)
+}
+
+// GenerateServiceJWT signs a short-lived token the api-service presents to the other
+// services, which verify it against the published JWKS. The ServiceAudience keeps it from
+// passing as a user token.
+func GenerateServiceJWT(service, role, kid string, key *ecdsa.PrivateKey, expiry time.Duration) (string, error) {
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"user_id":  service,
+		"username": service,
+		"role":     role,
+		"iat":      now.Unix(),
+		"exp":      now.Add(expiry).Unix(),
+		"iss":      "hysteria2-api",
+		"sub":      service,
+		"aud":      ServiceAudience,
+	})
+	token.Header["kid"] = kid
 
-	return token.SignedString([]byte(secret))
+	return token.SignedString(key)
 }
 
-func ValidateJWT(tokenString, secret string) (*interfaces.Claims, error) {
+// ValidateJWT validates an ES256 token against the signing key its kid names. Tokens
+// without a kid were issued before signing keys existed and are checked against the
+// HS256 secrets instead; with no secrets HS256 is not accepted at all. Every token must
+// carry an expiry, and service tokens are refused.
+func ValidateJWT(tokenString string, keys KeyLookup, secrets ...string) (*interfaces.Claims, error) {
+	keySet := jwt.VerificationKeySet{}
+	for _, secret := range secrets {
+		if secret != "" {
+			keySet.Keys = append(keySet.Keys, []byte(secret))
+		}
+	}
+	methods := []string{jwt.SigningMethodES256.Alg()}
+	if len(keySet.Keys) > 0 {
+		methods = append(methods, jwt.SigningMethodHS256.Alg())
+	}
+
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		kid, _ := token.Header["kid"].(string)
+		switch token.Method.(type) {
+		case *jwt.SigningMethodECDSA:
+			if kid == "" {
+				return nil, fmt.Errorf("token has no key id")
+			}
+			return keys(kid)
+		case *jwt.SigningMethodHMAC:
+			if kid != "" || len(keySet.Keys) == 0 {
+				return nil, fmt.Errorf("unexpected HMAC signed token")
+			}
+			return keySet, nil
+		default:
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
-		return []byte(secret), nil
-	})
+	}, jwt.WithValidMethods(methods), jwt.WithExpirationRequired())
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse token: %w", err)
@@ -51,6 +109,9 @@ func ValidateJWT(tokenString, secret string) (*interfaces.Claims, error) {
 	if !ok {
 		return nil, fmt.Errorf("invalid token claims")
 	}
+	if audience, err := claims.GetAudience(); err != nil || slices.Contains(audience, ServiceAudience) {
+		return nil, fmt.Errorf("not a user token")
+	}
 
 	userID, ok := claims["user_id"].(string)
 	if !ok {
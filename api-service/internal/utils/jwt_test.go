@@ -0,0 +1,135 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testKeySet(t *testing.T, kids ...string) (map[string]*ecdsa.PrivateKey, KeyLookup) {
+	t.Helper()
+	keys := make(map[string]*ecdsa.PrivateKey)
+	for _, kid := range kids {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		keys[kid] = key
+	}
+	return keys, func(kid string) (*ecdsa.PublicKey, error) {
+		if key, ok := keys[kid]; ok {
+			return &key.PublicKey, nil
+		}
+		return nil, fmt.Errorf("unknown key %s", kid)
+	}
+}
+
+func TestValidateJWTWithKeySet(t *testing.T) {
+	keys, lookup := testKeySet(t, "old", "new")
+	userID := uuid.New()
+
+	// Tokens signed by a retired key stay valid while it is in the keyset
+	for _, kid := range []string{"old", "new"} {
+		token, err := GenerateJWT(userID, "john_doe", "reseller", kid, keys[kid], time.Hour)
+		require.NoError(t, err)
+
+		claims, err := ValidateJWT(token, lookup)
+		require.NoError(t, err)
+		assert.Equal(t, userID.String(), claims.UserID)
+		assert.Equal(t, "john_doe", claims.Username)
+		assert.Equal(t, "reseller", claims.Role)
+	}
+
+	// A key dropped from the keyset no longer validates its tokens
+	token, err := GenerateJWT(userID, "john_doe", "user", "old", keys["old"], time.Hour)
+	require.NoError(t, err)
+	delete(keys, "old")
+	_, err = ValidateJWT(token, lookup)
+	assert.Error(t, err)
+
+	// The kid must match the signing key
+	token, err = GenerateJWT(userID, "john_doe", "user", "new", keys["new"], time.Hour)
+	require.NoError(t, err)
+	_, otherLookup := testKeySet(t, "new")
+	_, err = ValidateJWT(token, otherLookup)
+	assert.Error(t, err)
+}
+
+func TestValidateJWTLegacySecret(t *testing.T) {
+	_, lookup := testKeySet(t, "current")
+	userID := uuid.New()
+
+	legacy, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"user_id": userID.String(),
+		"exp":     time.Now().Add(time.Hour).Unix(),
+	}).SignedString([]byte("old-secret"))
+	require.NoError(t, err)
+
+	claims, err := ValidateJWT(legacy, lookup, "new-secret", "old-secret")
+	require.NoError(t, err)
+	assert.Equal(t, userID.String(), claims.UserID)
+
+	_, err = ValidateJWT(legacy, lookup, "new-secret")
+	assert.Error(t, err)
+
+	// Without secrets, as when JWT_LEGACY_HS256 is off, HS256 is not accepted at all
+	_, err = ValidateJWT(legacy, lookup)
+	assert.Error(t, err)
+	_, err = ValidateJWT(legacy, lookup, "")
+	assert.Error(t, err)
+
+	// A legacy token without an expiry would stay valid forever
+	unexpiring, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"user_id": userID.String(),
+	}).SignedString([]byte("old-secret"))
+	require.NoError(t, err)
+	_, err = ValidateJWT(unexpiring, lookup, "old-secret")
+	assert.Error(t, err)
+
+	// HS256 tokens naming a kid are not accepted, so a published public key can never be
+	// used as an HMAC secret
+	withKid := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"user_id": userID.String()})
+	withKid.Header["kid"] = "current"
+	forged, err := withKid.SignedString([]byte("old-secret"))
+	require.NoError(t, err)
+	_, err = ValidateJWT(forged, lookup, "old-secret")
+	assert.Error(t, err)
+}
+
+func TestGenerateServiceJWT(t *testing.T) {
+	keys, lookup := testKeySet(t, "current")
+
+	token, err := GenerateServiceJWT("api-service", "admin", "current", keys["current"], time.Minute)
+	require.NoError(t, err)
+
+	// Other services verify it against the keyset
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
+		return lookup("current")
+	}, jwt.WithAudience(ServiceAudience), jwt.WithExpirationRequired())
+	require.NoError(t, err)
+	assert.Equal(t, "api-service", claims["user_id"])
+	assert.Equal(t, "admin", claims["role"])
+
+	// It is never an admin user here
+	_, err = ValidateJWT(token, lookup)
+	assert.Error(t, err)
+}
+
+func TestValidateJWTRequiresExpiry(t *testing.T) {
+	keys, lookup := testKeySet(t, "current")
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{"user_id": uuid.New().String()})
+	token.Header["kid"] = "current"
+	signed, err := token.SignedString(keys["current"])
+	require.NoError(t, err)
+
+	_, err = ValidateJWT(signed, lookup)
+	assert.Error(t, err)
+}
@@ -0,0 +1,589 @@
+// Package apiclient is a Go client for the admin side of the API service's REST API: signing
+// in, users, node assignments, node config pushes, logs, metrics and sessions, subscription
+// exports, and the live event stream.
+package apiclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fasthttp/websocket"
+)
+
+// Tokens are the credentials of a signed-in client
+type Tokens struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"` // seconds the access token is valid for
+}
+
+// Client talks to the API service, e.g. "https://vpn.example.com". An expired access token
+// is refreshed once per request with the refresh token.
+type Client struct {
+	serverURL  string
+	baseURL    string
+	httpClient *http.Client
+
+	mu        sync.Mutex
+	tokens    Tokens
+	onRefresh func(Tokens)
+}
+
+func NewClient(serverURL string) *Client {
+	serverURL = strings.TrimRight(serverURL, "/")
+	return &Client{
+		serverURL: serverURL,
+		baseURL:   serverURL + "/api/v1",
+		httpClient: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+	}
+}
+
+// SetTokens signs the client in with tokens from an earlier Login
+func (c *Client) SetTokens(tokens Tokens) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tokens = tokens
+}
+
+// Tokens returns the current tokens
+func (c *Client) Tokens() Tokens {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tokens
+}
+
+// OnRefresh sets a function called with the new tokens after a refresh, e.g. to save them
+func (c *Client) OnRefresh(fn func(Tokens)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onRefresh = fn
+}
+
+// Error is a non-2xx response of the API. Code is the error code, e.g. "VALIDATION_ERROR",
+// when the API set one.
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	Details    []FieldError // the invalid fields of a VALIDATION_ERROR
+}
+
+// FieldError is a field of a request that failed validation
+type FieldError struct {
+	Field   string `json:"field"`
+	Tag     string `json:"tag"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	message := e.Message
+	if len(e.Details) > 0 {
+		fields := make([]string, 0, len(e.Details))
+		for _, field := range e.Details {
+			fields = append(fields, field.Message)
+		}
+		message += ": " + strings.Join(fields, "; ")
+	}
+	if e.Code == "" {
+		return fmt.Sprintf("API returned status %d: %s", e.StatusCode, message)
+	}
+	return fmt.Sprintf("API returned status %d: %s (%s)", e.StatusCode, message, e.Code)
+}
+
+// IsUnauthorized tells whether err is the API rejecting the client's credentials
+func IsUnauthorized(err error) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusUnauthorized
+}
+
+// User is an account on the service
+type User struct {
+	ID         string     `json:"id"`
+	Username   string     `json:"username"`
+	Email      string     `json:"email"`
+	FullName   *string    `json:"full_name,omitempty"`
+	Status     string     `json:"status"`
+	Role       string     `json:"role"`
+	UserGroup  string     `json:"user_group,omitempty"`
+	DataLimit  int64      `json:"data_limit"` // bytes, 0 for unlimited
+	DataUsed   int64      `json:"data_used"`
+	ExpiryDate *time.Time `json:"expiry_date,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastLogin  *time.Time `json:"last_login,omitempty"`
+	Notes      *string    `json:"notes,omitempty"`
+}
+
+// Login signs in with an email and password and keeps the tokens for the next requests
+func (c *Client) Login(ctx context.Context, email, password string) (*User, error) {
+	var resp struct {
+		User  User   `json:"user"`
+		Token Tokens `json:"token"`
+	}
+	body := map[string]string{"email": email, "password": password}
+	if _, err := c.roundTrip(ctx, http.MethodPost, "/auth/login", body, false, &resp); err != nil {
+		return nil, err
+	}
+	c.SetTokens(resp.Token)
+	return &resp.User, nil
+}
+
+// Refresh replaces the tokens with new ones issued for the refresh token
+func (c *Client) Refresh(ctx context.Context) error {
+	refreshToken := c.Tokens().RefreshToken
+	if refreshToken == "" {
+		return fmt.Errorf("not signed in")
+	}
+
+	var resp struct {
+		Token Tokens `json:"token"`
+	}
+	body := map[string]string{"refresh_token": refreshToken}
+	if _, err := c.roundTrip(ctx, http.MethodPost, "/auth/refresh", body, false, &resp); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.tokens = resp.Token
+	onRefresh := c.onRefresh
+	c.mu.Unlock()
+	if onRefresh != nil {
+		onRefresh(resp.Token)
+	}
+	return nil
+}
+
+// UserFilter selects the users ListUsers returns; zero fields match everything
+type UserFilter struct {
+	Search string // username or email
+	Status string
+	Role   string
+	Page   int // from 1
+	Limit  int // up to 100
+}
+
+// UserList is a page of users
+type UserList struct {
+	Users []User `json:"users"`
+	Total int64  `json:"total"`
+	Page  int    `json:"page"`
+	Limit int    `json:"limit"`
+}
+
+// ListUsers returns a page of the users filter matches
+func (c *Client) ListUsers(ctx context.Context, filter UserFilter) (*UserList, error) {
+	query := url.Values{}
+	setQuery(query, "search", filter.Search)
+	setQuery(query, "status", filter.Status)
+	setQuery(query, "role", filter.Role)
+	if filter.Page > 0 {
+		query.Set("page", strconv.Itoa(filter.Page))
+	}
+	if filter.Limit > 0 {
+		query.Set("limit", strconv.Itoa(filter.Limit))
+	}
+
+	var resp UserList
+	if err := c.do(ctx, http.MethodGet, withQuery("/users", query), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// GetUser returns a user
+func (c *Client) GetUser(ctx context.Context, userID string) (*User, error) {
+	var resp User
+	if err := c.do(ctx, http.MethodGet, "/users/"+url.PathEscape(userID), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// NewUser is a user to create
+type NewUser struct {
+	Username  string  `json:"username"`
+	Email     string  `json:"email"`
+	Password  string  `json:"password"`
+	FullName  *string `json:"full_name,omitempty"`
+	Role      string  `json:"role,omitempty"` // admin or user, user when empty
+	UserGroup string  `json:"user_group,omitempty"`
+	DataLimit int64   `json:"data_limit,omitempty"` // bytes, 0 for unlimited
+	Notes     *string `json:"notes,omitempty"`
+}
+
+// CreateUser creates an active user
+func (c *Client) CreateUser(ctx context.Context, user NewUser) (*User, error) {
+	var resp User
+	if err := c.do(ctx, http.MethodPost, "/users", user, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Node is a VPS node running the agent
+type Node struct {
+	ID            string     `json:"id"`
+	Name          string     `json:"name"`
+	Hostname      string     `json:"hostname"`
+	IPAddress     string     `json:"ip_address"`
+	Location      string     `json:"location"`
+	Country       string     `json:"country"`
+	Status        string     `json:"status"`
+	Version       string     `json:"version"`
+	LastHeartbeat *time.Time `json:"last_heartbeat,omitempty"`
+}
+
+// NodeFilter selects the nodes ListNodes returns; zero fields match everything
+type NodeFilter struct {
+	Status   string
+	Location string
+	Page     int // from 1
+	Limit    int // up to 100
+}
+
+// NodeList is a page of nodes
+type NodeList struct {
+	Nodes []Node `json:"nodes"`
+	Total int64  `json:"total"`
+	Page  int    `json:"page"`
+	Limit int    `json:"limit"`
+}
+
+// ListNodes returns a page of the nodes filter matches
+func (c *Client) ListNodes(ctx context.Context, filter NodeFilter) (*NodeList, error) {
+	query := url.Values{}
+	setQuery(query, "status", filter.Status)
+	setQuery(query, "location", filter.Location)
+	if filter.Page > 0 {
+		query.Set("page", strconv.Itoa(filter.Page))
+	}
+	if filter.Limit > 0 {
+		query.Set("limit", strconv.Itoa(filter.Limit))
+	}
+
+	var resp NodeList
+	if err := c.do(ctx, http.MethodGet, withQuery("/nodes", query), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// GetUserNodes returns the nodes assigned to a user; a user without any is offered every
+// online node
+func (c *Client) GetUserNodes(ctx context.Context, userID string) ([]Node, error) {
+	var resp struct {
+		Nodes []Node `json:"nodes"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/users/"+url.PathEscape(userID)+"/nodes", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Nodes, nil
+}
+
+// SetUserNodes replaces the nodes assigned to a user and returns them
+func (c *Client) SetUserNodes(ctx context.Context, userID string, nodeIDs []string) ([]Node, error) {
+	if nodeIDs == nil {
+		nodeIDs = []string{}
+	}
+	var resp struct {
+		Nodes []Node `json:"nodes"`
+	}
+	body := map[string][]string{"node_ids": nodeIDs}
+	if err := c.do(ctx, http.MethodPut, "/users/"+url.PathEscape(userID)+"/nodes", body, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Nodes, nil
+}
+
+// DriftItem is one difference between a node and its desired state
+type DriftItem struct {
+	Kind     string `json:"kind"` // config, protocol, service, firewall, routing
+	Target   string `json:"target"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+}
+
+// NodeDrift is what a drift check of a node found; after a heal the items are the drift left
+type NodeDrift struct {
+	NodeID     string      `json:"node_id"`
+	NodeName   string      `json:"node_name"`
+	Policy     string      `json:"policy"`
+	Items      []DriftItem `json:"items"`
+	Healed     []string    `json:"healed,omitempty"`
+	HealFailed []string    `json:"heal_failed,omitempty"`
+	CheckedAt  time.Time   `json:"checked_at"`
+	HealedAt   *time.Time  `json:"healed_at,omitempty"`
+}
+
+// CheckDrift compares a node with its desired state; with heal the orchestrator pushes the
+// desired configs and state to the node wherever it drifted
+func (c *Client) CheckDrift(ctx context.Context, nodeID string, heal bool) (*NodeDrift, error) {
+	var resp struct {
+		Data NodeDrift `json:"data"`
+	}
+	body := map[string]bool{"heal": heal}
+	if err := c.do(ctx, http.MethodPost, "/nodes/"+url.PathEscape(nodeID)+"/drift-check", body, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Data, nil
+}
+
+// GetNodeLogs returns the last lines of a node's log, up to 1000
+func (c *Client) GetNodeLogs(ctx context.Context, nodeID string, lines int) ([]string, error) {
+	path := "/nodes/" + url.PathEscape(nodeID) + "/logs"
+	if lines > 0 {
+		path += "?lines=" + strconv.Itoa(lines)
+	}
+
+	var resp struct {
+		Logs []string `json:"logs"`
+	}
+	if err := c.do(ctx, http.MethodGet, path, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Logs, nil
+}
+
+// NodeMetric is a node's load at one heartbeat
+type NodeMetric struct {
+	CPUUsage          float64   `json:"cpu_usage"`    // percent
+	MemoryUsage       float64   `json:"memory_usage"` // percent
+	BandwidthUp       int64     `json:"bandwidth_up"` // bytes per second sent by the node
+	BandwidthDown     int64     `json:"bandwidth_down"`
+	ActiveConnections int       `json:"active_connections"`
+	RecordedAt        time.Time `json:"recorded_at"`
+
+	DiskUsedPercent    float64 `json:"disk_used_percent"`
+	ConfigDriftFiles   int     `json:"config_drift_files"`
+	WARPFailoverActive bool    `json:"warp_failover_active"`
+}
+
+// GetNodeMetrics returns up to limit of a node's latest metrics, newest first
+func (c *Client) GetNodeMetrics(ctx context.Context, nodeID string, limit int) ([]NodeMetric, error) {
+	path := "/nodes/" + url.PathEscape(nodeID) + "/metrics"
+	if limit > 0 {
+		path += "?limit=" + strconv.Itoa(limit)
+	}
+
+	var resp struct {
+		Metrics []NodeMetric `json:"metrics"`
+	}
+	if err := c.do(ctx, http.MethodGet, path, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Metrics, nil
+}
+
+// Session is a client connected to a node
+type Session struct {
+	ClientID    string    `json:"client_id"`
+	UserID      string    `json:"user_id"`
+	DeviceID    string    `json:"device_id,omitempty"`
+	NodeID      string    `json:"node_id"`
+	Protocol    string    `json:"protocol"`
+	Connections int       `json:"connections"`
+	ConnectedAt time.Time `json:"connected_at"`
+}
+
+// GetNodeSessions returns the clients connected to a node
+func (c *Client) GetNodeSessions(ctx context.Context, nodeID string) ([]Session, error) {
+	var resp struct {
+		Data []Session `json:"data"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/nodes/"+url.PathEscape(nodeID)+"/sessions", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
+// Subscription is a user's client config as their client fetches it
+type Subscription struct {
+	Config   json.RawMessage
+	Userinfo string // upload, download, total and expire, as in the Subscription-Userinfo header
+}
+
+// GetUserSubscription exports a user's subscription in format, e.g. "sing-box" or "clash";
+// the service's default when empty
+func (c *Client) GetUserSubscription(ctx context.Context, userID, format string) (*Subscription, error) {
+	path := "/users/" + url.PathEscape(userID) + "/subscription"
+	if format != "" {
+		path += "?format=" + url.QueryEscape(format)
+	}
+
+	var config json.RawMessage
+	header, err := c.request(ctx, http.MethodGet, path, nil, &config)
+	if err != nil {
+		return nil, err
+	}
+	return &Subscription{Config: config, Userinfo: header.Get("Subscription-Userinfo")}, nil
+}
+
+// do sends an authenticated request, refreshing the tokens once when the access token was
+// rejected
+// StreamMessage is a live event pushed over the WebSocket
+type StreamMessage struct {
+	Type      string          `json:"type"`
+	Room      string          `json:"room,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	Timestamp time.Time       `json:"timestamp"`
+}
+
+// Alert is the data of an "alert" message from the alerts room
+type Alert struct {
+	Severity string `json:"severity"`
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+}
+
+// Stream subscribes to rooms over the WebSocket and hands every message to handle until
+// ctx is done or the connection drops. Rooms are e.g. "alerts" or "node:<id>".
+func (c *Client) Stream(ctx context.Context, rooms []string, handle func(StreamMessage)) error {
+	conn, err := c.dialStream(ctx)
+	if IsUnauthorized(err) && c.Tokens().RefreshToken != "" {
+		if refreshErr := c.Refresh(ctx); refreshErr != nil {
+			return err
+		}
+		conn, err = c.dialStream(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	for _, room := range rooms {
+		if err := conn.WriteJSON(map[string]string{"type": "subscribe", "room": room}); err != nil {
+			return err
+		}
+	}
+
+	for {
+		var msg StreamMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		handle(msg)
+	}
+}
+
+func (c *Client) dialStream(ctx context.Context) (*websocket.Conn, error) {
+	streamURL := "ws" + strings.TrimPrefix(c.serverURL, "http") + "/ws"
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+c.Tokens().AccessToken)
+
+	conn, resp, err := websocket.DefaultDialer.DialContext(ctx, streamURL, header)
+	if err == nil {
+		return conn, nil
+	}
+	if resp == nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return nil, parseError(resp.StatusCode, data)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body, dest interface{}) error {
+	_, err := c.request(ctx, method, path, body, dest)
+	return err
+}
+
+func (c *Client) request(ctx context.Context, method, path string, body, dest interface{}) (http.Header, error) {
+	header, err := c.roundTrip(ctx, method, path, body, true, dest)
+	if !IsUnauthorized(err) || c.Tokens().RefreshToken == "" {
+		return header, err
+	}
+	if refreshErr := c.Refresh(ctx); refreshErr != nil {
+		return nil, err
+	}
+	return c.roundTrip(ctx, method, path, body, true, dest)
+}
+
+func (c *Client) roundTrip(ctx context.Context, method, path string, body interface{}, authenticated bool, dest interface{}) (http.Header, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if authenticated {
+		token := c.Tokens().AccessToken
+		if token == "" {
+			return nil, fmt.Errorf("not signed in")
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("API request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read API response: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, parseError(resp.StatusCode, data)
+	}
+	if err := json.Unmarshal(data, dest); err != nil {
+		return nil, fmt.Errorf("failed to decode API response: %w", err)
+	}
+	return resp.Header, nil
+}
+
+// parseError reads the API's {"error", "code", "details"} body; other bodies, e.g. from a
+// proxy in front of it, become the message. Details are kept when they are field errors.
+func parseError(statusCode int, data []byte) *Error {
+	var body struct {
+		Error   string          `json:"error"`
+		Code    string          `json:"code"`
+		Details json.RawMessage `json:"details"`
+	}
+	if err := json.Unmarshal(data, &body); err != nil || body.Error == "" {
+		return &Error{StatusCode: statusCode, Message: string(bytes.TrimSpace(data))}
+	}
+	apiErr := &Error{StatusCode: statusCode, Code: body.Code, Message: body.Error}
+	json.Unmarshal(body.Details, &apiErr.Details)
+	return apiErr
+}
+
+func setQuery(query url.Values, key, value string) {
+	if value != "" {
+		query.Set(key, value)
+	}
+}
+
+func withQuery(path string, query url.Values) string {
+	if len(query) == 0 {
+		return path
+	}
+	return path + "?" + query.Encode()
+}
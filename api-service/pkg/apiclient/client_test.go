@@ -0,0 +1,239 @@
+package apiclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fasthttp/websocket"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoginKeepsTokens(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/auth/login":
+			assert.Empty(t, r.Header.Get("Authorization"))
+			var body map[string]string
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			assert.Equal(t, "admin@example.com", body["email"])
+			w.Write([]byte(`{
+				"user": {"id": "user-1", "username": "admin", "email": "admin@example.com", "role": "admin", "status": "active"},
+				"token": {"access_token": "access-1", "refresh_token": "refresh-1", "expires_in": 900}
+			}`))
+		case "/api/v1/users/user-2":
+			assert.Equal(t, "Bearer access-1", r.Header.Get("Authorization"))
+			w.Write([]byte(`{"id": "user-2", "username": "alice", "email": "alice@example.com", "role": "user", "status": "active"}`))
+		default:
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL + "/")
+	user, err := client.Login(context.Background(), "admin@example.com", "secret")
+	require.NoError(t, err)
+	assert.Equal(t, "admin", user.Role)
+	assert.Equal(t, Tokens{AccessToken: "access-1", RefreshToken: "refresh-1", ExpiresIn: 900}, client.Tokens())
+
+	other, err := client.GetUser(context.Background(), "user-2")
+	require.NoError(t, err)
+	assert.Equal(t, "alice", other.Username)
+}
+
+func TestRefreshesRejectedAccessToken(t *testing.T) {
+	refreshes := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/auth/refresh":
+			refreshes++
+			var body map[string]string
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			assert.Equal(t, "refresh-1", body["refresh_token"])
+			w.Write([]byte(`{"token": {"access_token": "access-2", "refresh_token": "refresh-2", "expires_in": 900}}`))
+		case "/api/v1/nodes/node-1/logs":
+			if r.Header.Get("Authorization") != "Bearer access-2" {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"error": "Invalid or expired token", "code": "INVALID_TOKEN"}`))
+				return
+			}
+			assert.Equal(t, "50", r.URL.Query().Get("lines"))
+			w.Write([]byte(`{"logs": ["Node started"], "lines": 50}`))
+		default:
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL)
+	client.SetTokens(Tokens{AccessToken: "access-1", RefreshToken: "refresh-1"})
+	var saved Tokens
+	client.OnRefresh(func(tokens Tokens) { saved = tokens })
+
+	logs, err := client.GetNodeLogs(context.Background(), "node-1", 50)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Node started"}, logs)
+	assert.Equal(t, 1, refreshes)
+	assert.Equal(t, "refresh-2", saved.RefreshToken)
+	assert.Equal(t, "access-2", client.Tokens().AccessToken)
+}
+
+func TestRejectedRefreshReturnsOriginalError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error": "Invalid or expired token", "code": "INVALID_TOKEN"}`))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL)
+	client.SetTokens(Tokens{AccessToken: "access-1", RefreshToken: "refresh-1"})
+
+	_, err := client.ListNodes(context.Background(), NodeFilter{})
+	require.Error(t, err)
+	assert.True(t, IsUnauthorized(err))
+}
+
+func TestErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/users":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{
+				"error": "Invalid request",
+				"code": "VALIDATION_ERROR",
+				"details": [{"field": "password", "tag": "min", "message": "password must be at least 8 characters"}]
+			}`))
+		default:
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte("bad gateway\n"))
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL)
+	client.SetTokens(Tokens{AccessToken: "access-1"})
+
+	_, err := client.CreateUser(context.Background(), NewUser{Username: "alice", Email: "alice@example.com", Password: "short"})
+	var apiErr *Error
+	require.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, "VALIDATION_ERROR", apiErr.Code)
+	require.Len(t, apiErr.Details, 1)
+	assert.Equal(t, "password", apiErr.Details[0].Field)
+	assert.Contains(t, err.Error(), "password must be at least 8 characters")
+
+	_, err = client.GetUserNodes(context.Background(), "user-1")
+	require.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, http.StatusBadGateway, apiErr.StatusCode)
+	assert.Equal(t, "bad gateway", apiErr.Message)
+}
+
+func TestSetUserNodesAndSubscription(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/users/user-1/nodes":
+			assert.Equal(t, http.MethodPut, r.Method)
+			var body map[string][]string
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			assert.Equal(t, []string{}, body["node_ids"])
+			w.Write([]byte(`{"nodes": []}`))
+		case "/api/v1/users/user-1/subscription":
+			assert.Equal(t, "clash", r.URL.Query().Get("format"))
+			w.Header().Set("Subscription-Userinfo", "upload=1; download=2; total=0; expire=0")
+			w.Write([]byte(`{"proxies": []}`))
+		default:
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL)
+	client.SetTokens(Tokens{AccessToken: "access-1"})
+
+	nodes, err := client.SetUserNodes(context.Background(), "user-1", nil)
+	require.NoError(t, err)
+	assert.Empty(t, nodes)
+
+	sub, err := client.GetUserSubscription(context.Background(), "user-1", "clash")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"proxies": []}`, string(sub.Config))
+	assert.Equal(t, "upload=1; download=2; total=0; expire=0", sub.Userinfo)
+}
+
+func TestNodeMetricsAndSessions(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/nodes/node-1/metrics":
+			assert.Equal(t, "60", r.URL.Query().Get("limit"))
+			w.Write([]byte(`{"metrics": [{"cpu_usage": 12.5, "bandwidth_up": 1000, "bandwidth_down": 2000, "active_connections": 3}], "limit": 60}`))
+		case "/api/v1/nodes/node-1/sessions":
+			w.Write([]byte(`{"data": [{"client_id": "c-1", "user_id": "user-1", "node_id": "node-1", "protocol": "hysteria2", "connections": 2}]}`))
+		default:
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL)
+	client.SetTokens(Tokens{AccessToken: "access-1"})
+
+	metrics, err := client.GetNodeMetrics(context.Background(), "node-1", 60)
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, int64(1000), metrics[0].BandwidthUp)
+	assert.Equal(t, 3, metrics[0].ActiveConnections)
+
+	sessions, err := client.GetNodeSessions(context.Background(), "node-1")
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	assert.Equal(t, "user-1", sessions[0].UserID)
+}
+
+func TestStreamRefreshesAndSubscribes(t *testing.T) {
+	var upgrader websocket.Upgrader
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/auth/refresh":
+			w.Write([]byte(`{"token": {"access_token": "access-2", "refresh_token": "refresh-2"}}`))
+		case "/ws":
+			if r.Header.Get("Authorization") != "Bearer access-2" {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"error": "Invalid or expired token", "code": "INVALID_TOKEN"}`))
+				return
+			}
+			conn, err := upgrader.Upgrade(w, r, nil)
+			require.NoError(t, err)
+			defer conn.Close()
+
+			var msg map[string]string
+			require.NoError(t, conn.ReadJSON(&msg))
+			assert.Equal(t, map[string]string{"type": "subscribe", "room": "alerts"}, msg)
+			conn.WriteJSON(map[string]interface{}{
+				"type": "alert",
+				"room": "alerts",
+				"data": map[string]string{"severity": "critical", "code": "NODE_OFFLINE", "message": "node-1 is offline"},
+			})
+		default:
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL)
+	client.SetTokens(Tokens{AccessToken: "access-1", RefreshToken: "refresh-1"})
+
+	var alerts []Alert
+	err := client.Stream(context.Background(), []string{"alerts"}, func(msg StreamMessage) {
+		var alert Alert
+		require.NoError(t, json.Unmarshal(msg.Data, &alert))
+		alerts = append(alerts, alert)
+	})
+	require.Error(t, err)
+	assert.False(t, IsUnauthorized(err))
+	require.Len(t, alerts, 1)
+	assert.Equal(t, "NODE_OFFLINE", alerts[0].Code)
+}
@@ -46,6 +46,15 @@ func (r *RedisClient) Get(ctx context.Context, key string, dest interface{}) err
 	return json.Unmarshal([]byte(data), dest)
 }
 
+// GetDel reads and removes a key in one step, so a value is consumed at most once
+func (r *RedisClient) GetDel(ctx context.Context, key string, dest interface{}) error {
+	data, err := r.client.GetDel(ctx, key).Result()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(data), dest)
+}
+
 func (r *RedisClient) Del(ctx context.Context, keys ...string) error {
 	return r.client.Del(ctx, keys...).Err()
 }
@@ -54,6 +63,25 @@ func (r *RedisClient) Exists(ctx context.Context, keys ...string) (int64, error)
 	return r.client.Exists(ctx, keys...).Result()
 }
 
+func (r *RedisClient) Incr(ctx context.Context, key string) (int64, error) {
+	return r.client.Incr(ctx, key).Result()
+}
+
+// IncrWindow increments a counter that expires window after it is created. The counter is
+// created with its expiry in one transaction, so it never outlives the window.
+func (r *RedisClient) IncrWindow(ctx context.Context, key string, window time.Duration) (int64, error) {
+	var incr *redis.IntCmd
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SetNX(ctx, key, 0, window)
+		incr = pipe.Incr(ctx, key)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return incr.Val(), nil
+}
+
 func (r *RedisClient) Expire(ctx context.Context, key string, expiration time.Duration) error {
 	return r.client.Expire(ctx, key, expiration).Err()
 }
@@ -98,6 +126,43 @@ func (r *RedisClient) SIsMember(ctx context.Context, key string, member interfac
 	return r.client.SIsMember(ctx, key, member).Result()
 }
 
+func (r *RedisClient) RPush(ctx context.Context, key string, values ...interface{}) error {
+	return r.client.RPush(ctx, key, values...).Err()
+}
+
+func (r *RedisClient) LPush(ctx context.Context, key string, values ...interface{}) error {
+	return r.client.LPush(ctx, key, values...).Err()
+}
+
+// LPopCount removes and returns up to count elements from the head of a list; an empty or
+// missing list gives none
+func (r *RedisClient) LPopCount(ctx context.Context, key string, count int) ([]string, error) {
+	values, err := r.client.LPopCount(ctx, key, count).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return values, err
+}
+
+func (r *RedisClient) LLen(ctx context.Context, key string) (int64, error) {
+	return r.client.LLen(ctx, key).Result()
+}
+
+// SetNX sets a key that does not exist yet and reports whether it did. The value is stored
+// as is, not JSON encoded.
+func (r *RedisClient) SetNX(ctx context.Context, key, value string, expiration time.Duration) (bool, error) {
+	return r.client.SetNX(ctx, key, value, expiration).Result()
+}
+
+// Eval runs a Lua script; a nil reply gives a nil result
+func (r *RedisClient) Eval(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error) {
+	result, err := r.client.Eval(ctx, script, keys, args...).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return result, err
+}
+
 func (r *RedisClient) Publish(ctx context.Context, channel string, message interface{}) error {
 	return r.client.Publish(ctx, channel, message).Err()
 }
@@ -0,0 +1,126 @@
+package clickhouse
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Client talks to ClickHouse over its HTTP interface
+type Client struct {
+	baseURL    string
+	database   string
+	username   string
+	password   string
+	httpClient *http.Client
+}
+
+func NewClient(baseURL, database, username, password string) *Client {
+	return &Client{
+		baseURL:  baseURL,
+		database: database,
+		username: username,
+		password: password,
+		httpClient: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+	}
+}
+
+func (c *Client) Ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/ping", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("clickhouse ping failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("clickhouse ping returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Exec runs a statement that does not return rows
+func (c *Client) Exec(ctx context.Context, query string) error {
+	_, err := c.do(ctx, query, nil)
+	return err
+}
+
+// InsertJSON inserts rows into table using the JSONEachRow format
+func (c *Client) InsertJSON(ctx context.Context, table string, rows []interface{}) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, row := range rows {
+		if err := encoder.Encode(row); err != nil {
+			return fmt.Errorf("failed to encode row: %w", err)
+		}
+	}
+
+	_, err := c.do(ctx, fmt.Sprintf("INSERT INTO %s FORMAT JSONEachRow", table), &body)
+	return err
+}
+
+// Query runs a SELECT and decodes the "data" section of the JSON output into dest
+func (c *Client) Query(ctx context.Context, query string, dest interface{}) error {
+	data, err := c.do(ctx, query+" FORMAT JSON", nil)
+	if err != nil {
+		return err
+	}
+
+	var result struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return fmt.Errorf("failed to decode clickhouse response: %w", err)
+	}
+	return json.Unmarshal(result.Data, dest)
+}
+
+func (c *Client) do(ctx context.Context, query string, body io.Reader) ([]byte, error) {
+	params := url.Values{}
+	params.Set("database", c.database)
+	// Return 64-bit integers as numbers rather than quoted strings
+	params.Set("output_format_json_quote_64bit_integers", "0")
+
+	if body == nil {
+		body = bytes.NewBufferString(query)
+	} else {
+		params.Set("query", query)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/?"+params.Encode(), body)
+	if err != nil {
+		return nil, err
+	}
+	if c.username != "" {
+		req.Header.Set("X-ClickHouse-User", c.username)
+		req.Header.Set("X-ClickHouse-Key", c.password)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("clickhouse request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read clickhouse response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("clickhouse returned status %d: %s", resp.StatusCode, bytes.TrimSpace(data))
+	}
+	return data, nil
+}
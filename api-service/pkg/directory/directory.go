@@ -0,0 +1,254 @@
+package directory
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	searchPageSize = 500
+	// accountDisable is the userAccountControl flag of a disabled Active Directory account
+	accountDisable = 0x2
+)
+
+// ErrInvalidCredentials is returned when no single directory user matches a login or the
+// password does not bind
+var ErrInvalidCredentials = errors.New("invalid directory credentials")
+
+// Config is the connection to an LDAP or Active Directory server and where its users are.
+// Attribute names default to OpenLDAP's; Active Directory uses objectGUID, sAMAccountName
+// and displayName.
+type Config struct {
+	URL                string // ldap://host:389 or ldaps://host:636
+	StartTLS           bool
+	InsecureSkipVerify bool
+	BindDN             string
+	BindPassword       string
+	BaseDN             string
+	UserFilter         string
+	IDAttr             string
+	UsernameAttr       string
+	EmailAttr          string
+	NameAttr           string
+	GroupAttr          string
+	Timeout            time.Duration
+}
+
+// GroupMapping maps the directory group named Group to a role or plan
+type GroupMapping struct {
+	Group string
+	Value string
+}
+
+// Client searches and authenticates directory users. Every call opens its own connection,
+// as syncs and logins are rare enough not to need a pool.
+type Client struct {
+	config Config
+}
+
+// Entry is a directory user. ID is the directory's stable identifier of the entry, which
+// survives renames and moves; Groups are the values of the group attribute, usually DNs.
+type Entry struct {
+	DN       string
+	ID       string
+	Username string
+	Email    string
+	Name     string
+	Groups   []string
+	Disabled bool
+}
+
+func NewClient(config Config) *Client {
+	if config.UserFilter == "" {
+		config.UserFilter = "(objectClass=person)"
+	}
+	if config.IDAttr == "" {
+		config.IDAttr = "entryUUID"
+	}
+	if config.UsernameAttr == "" {
+		config.UsernameAttr = "uid"
+	}
+	if config.EmailAttr == "" {
+		config.EmailAttr = "mail"
+	}
+	if config.NameAttr == "" {
+		config.NameAttr = "cn"
+	}
+	if config.GroupAttr == "" {
+		config.GroupAttr = "memberOf"
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 10 * time.Second
+	}
+	return &Client{config: config}
+}
+
+// Server returns the directory URL, which tells the accounts of different directories apart
+func (c *Client) Server() string {
+	return c.config.URL
+}
+
+// Users returns every user matching the user filter under the base DN
+func (c *Client) Users(ctx context.Context) ([]Entry, error) {
+	conn, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	result, err := conn.SearchWithPaging(c.searchRequest(c.config.UserFilter, 0), searchPageSize)
+	if err != nil {
+		return nil, fmt.Errorf("directory search failed: %w", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, 0, len(result.Entries))
+	for _, entry := range result.Entries {
+		entries = append(entries, c.entry(entry))
+	}
+	return entries, nil
+}
+
+// Authenticate finds the user whose username or email is login and binds as them with the
+// password
+func (c *Client) Authenticate(ctx context.Context, login, password string) (*Entry, error) {
+	// An empty password would make an unauthenticated bind, which servers accept
+	if login == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	conn, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	filter := UserFilter(c.config.UserFilter, c.config.UsernameAttr, c.config.EmailAttr, login)
+	result, err := conn.Search(c.searchRequest(filter, 2))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, fmt.Errorf("directory search failed: %w", err)
+	}
+	if result == nil || len(result.Entries) != 1 {
+		return nil, ErrInvalidCredentials
+	}
+
+	if err := conn.Bind(result.Entries[0].DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, fmt.Errorf("directory bind failed: %w", err)
+	}
+
+	entry := c.entry(result.Entries[0])
+	if entry.Disabled {
+		return nil, ErrInvalidCredentials
+	}
+	return &entry, nil
+}
+
+// connect dials the server and binds with the service account
+func (c *Client) connect(ctx context.Context) (*ldap.Conn, error) {
+	timeout := c.config.Timeout
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.config.InsecureSkipVerify}
+	conn, err := ldap.DialURL(c.config.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: timeout}),
+		ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to directory: %w", err)
+	}
+	conn.SetTimeout(timeout)
+
+	if c.config.StartTLS {
+		if u, err := url.Parse(c.config.URL); err == nil {
+			tlsConfig.ServerName = u.Hostname()
+		}
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("directory StartTLS failed: %w", err)
+		}
+	}
+
+	if c.config.BindDN != "" {
+		if err := conn.Bind(c.config.BindDN, c.config.BindPassword); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("directory service bind failed: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+func (c *Client) searchRequest(filter string, sizeLimit int) *ldap.SearchRequest {
+	return ldap.NewSearchRequest(c.config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		sizeLimit, int(c.config.Timeout.Seconds()), false, filter,
+		[]string{c.config.IDAttr, c.config.UsernameAttr, c.config.EmailAttr, c.config.NameAttr, c.config.GroupAttr, "userAccountControl"},
+		nil)
+}
+
+func (c *Client) entry(e *ldap.Entry) Entry {
+	entry := Entry{
+		DN:       e.DN,
+		ID:       entryID(e.GetEqualFoldRawAttributeValue(c.config.IDAttr)),
+		Username: e.GetEqualFoldAttributeValue(c.config.UsernameAttr),
+		Email:    e.GetEqualFoldAttributeValue(c.config.EmailAttr),
+		Name:     e.GetEqualFoldAttributeValue(c.config.NameAttr),
+		Groups:   e.GetEqualFoldAttributeValues(c.config.GroupAttr),
+	}
+	if entry.ID == "" {
+		entry.ID = strings.ToLower(e.DN)
+	}
+	if control, err := strconv.ParseInt(e.GetEqualFoldAttributeValue("userAccountControl"), 10, 64); err == nil {
+		entry.Disabled = control&accountDisable != 0
+	}
+	return entry
+}
+
+// entryID renders an identifier attribute: text such as entryUUID as is, binary such as
+// Active Directory's objectGUID in hex
+func entryID(raw []byte) string {
+	if utf8.Valid(raw) && !strings.ContainsFunc(string(raw), func(r rune) bool { return r < 0x20 }) {
+		return string(raw)
+	}
+	return hex.EncodeToString(raw)
+}
+
+// UserFilter narrows a user filter to the entries whose username or email is login
+func UserFilter(base, usernameAttr, emailAttr, login string) string {
+	value := ldap.EscapeFilter(login)
+	if !strings.HasPrefix(base, "(") {
+		base = "(" + base + ")"
+	}
+	return fmt.Sprintf("(&%s(|(%s=%s)(%s=%s)))", base, usernameAttr, value, emailAttr, value)
+}
+
+// Matches reports whether a directory group, a DN or a plain name, is the mapped group.
+// Group names compare case-insensitively, as directories do.
+func (m GroupMapping) Matches(group string) bool {
+	return strings.EqualFold(m.Group, group) || strings.EqualFold(m.Group, GroupName(group))
+}
+
+// GroupName returns the name of a group: the value of the first RDN of a DN such as
+// "CN=VPN Admins,OU=Groups,DC=corp,DC=example", or the value itself when it is no DN
+func GroupName(group string) string {
+	dn, err := ldap.ParseDN(group)
+	if err != nil || len(dn.RDNs) == 0 || len(dn.RDNs[0].Attributes) == 0 {
+		return group
+	}
+	return dn.RDNs[0].Attributes[0].Value
+}
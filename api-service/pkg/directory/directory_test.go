@@ -0,0 +1,34 @@
+package directory
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserFilter(t *testing.T) {
+	assert.Equal(t, "(&(objectClass=person)(|(uid=alice)(mail=alice)))",
+		UserFilter("(objectClass=person)", "uid", "mail", "alice"))
+	assert.Equal(t, "(&(objectClass=user)(|(sAMAccountName=\\2a\\29\\28uid=\\2a)(mail=\\2a\\29\\28uid=\\2a)))",
+		UserFilter("objectClass=user", "sAMAccountName", "mail", "*)(uid=*"))
+}
+
+func TestEntryID(t *testing.T) {
+	assert.Equal(t, "6ba7b810-9dad-11d1-80b4-00c04fd430c8", entryID([]byte("6ba7b810-9dad-11d1-80b4-00c04fd430c8")))
+	// objectGUID is binary
+	guid := []byte{0x10, 0xb8, 0xa7, 0x6b, 0xad, 0x9d, 0xd1, 0x11, 0x80, 0xb4, 0x00, 0xc0, 0x4f, 0xd4, 0x30, 0xc8}
+	assert.Equal(t, "10b8a76bad9dd11180b400c04fd430c8", entryID(guid))
+}
+
+func TestGroupMatches(t *testing.T) {
+	mapping := GroupMapping{Group: "VPN Admins", Value: "admin"}
+	assert.True(t, mapping.Matches("CN=VPN Admins,OU=Groups,DC=corp,DC=example"))
+	assert.True(t, mapping.Matches("cn=vpn admins,ou=groups,dc=corp,dc=example"))
+	assert.True(t, mapping.Matches("vpn admins"))
+	assert.False(t, mapping.Matches("CN=VPN Users,OU=Groups,DC=corp,DC=example"))
+	// Only the group's own name counts, not the containers it is in
+	assert.False(t, mapping.Matches("CN=Staff,OU=VPN Admins,DC=corp,DC=example"))
+
+	dn := GroupMapping{Group: "CN=VPN Admins,OU=Groups,DC=corp,DC=example"}
+	assert.True(t, dn.Matches("cn=VPN Admins,ou=Groups,dc=corp,dc=example"))
+}
@@ -0,0 +1,158 @@
+// Package geoip maps IP addresses to ISO country codes using a CSV range database in
+// the start_ip,end_ip,country_code layout of the free db-ip.com "IP to Country Lite", and to
+// autonomous systems using the start_ip,end_ip,as_number,as_organization layout of its
+// "IP to ASN Lite".
+package geoip
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type ipRange struct {
+	start   netip.Addr
+	end     netip.Addr
+	country string
+	asn     uint32
+	org     string
+}
+
+// DB is an in-memory country or ASN database; the zero value knows no addresses
+type DB struct {
+	ranges []ipRange
+}
+
+// Load reads a CSV country database from path
+func Load(path string) (*DB, error) {
+	return load(path, Parse)
+}
+
+// LoadASN reads a CSV ASN database from path
+func LoadASN(path string) (*DB, error) {
+	return load(path, ParseASN)
+}
+
+func load(path string, parse func(io.Reader) (*DB, error)) (*DB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parse(f)
+}
+
+// Parse reads a CSV country database. Rows that do not hold two addresses of the same
+// family, such as a header, are skipped.
+func Parse(r io.Reader) (*DB, error) {
+	return parse(r, func(record []string, rng *ipRange) bool {
+		rng.country = strings.ToUpper(strings.TrimSpace(record[2]))
+		return true
+	})
+}
+
+// ParseASN reads a CSV ASN database. Rows without two addresses of the same family and an
+// AS number, such as a header, are skipped.
+func ParseASN(r io.Reader) (*DB, error) {
+	return parse(r, func(record []string, rng *ipRange) bool {
+		asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(record[2])), "AS"), 10, 32)
+		if err != nil {
+			return false
+		}
+		rng.asn = uint32(asn)
+		if len(record) > 3 {
+			rng.org = strings.TrimSpace(record[3])
+		}
+		return true
+	})
+}
+
+// parse reads the address range of every row, and the rest of it with fill
+func parse(r io.Reader, fill func(record []string, rng *ipRange) bool) (*DB, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	db := &DB{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read geoip database: %w", err)
+		}
+		if len(record) < 3 {
+			continue
+		}
+		start, err1 := netip.ParseAddr(strings.TrimSpace(record[0]))
+		end, err2 := netip.ParseAddr(strings.TrimSpace(record[1]))
+		if err1 != nil || err2 != nil || start.Is4() != end.Is4() || end.Less(start) {
+			continue
+		}
+		rng := ipRange{start: start, end: end}
+		if !fill(record, &rng) {
+			continue
+		}
+		db.ranges = append(db.ranges, rng)
+	}
+
+	sort.Slice(db.ranges, func(i, j int) bool {
+		return db.ranges[i].start.Less(db.ranges[j].start)
+	})
+	return db, nil
+}
+
+// Country returns the country code of ip, or "" when it is invalid or not covered
+func (db *DB) Country(ip string) string {
+	if rng := db.find(ip); rng != nil {
+		return rng.country
+	}
+	return ""
+}
+
+// ASN returns the autonomous system number and organization of ip, or 0 when it is invalid
+// or not covered
+func (db *DB) ASN(ip string) (uint32, string) {
+	if rng := db.find(ip); rng != nil {
+		return rng.asn, rng.org
+	}
+	return 0, ""
+}
+
+func (db *DB) find(ip string) *ipRange {
+	if db == nil {
+		return nil
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil
+	}
+	addr = addr.Unmap()
+
+	// The last range starting at or before addr is the only one that can contain it
+	i := sort.Search(len(db.ranges), func(i int) bool {
+		return addr.Less(db.ranges[i].start)
+	})
+	if i == 0 {
+		return nil
+	}
+	candidate := &db.ranges[i-1]
+	if candidate.start.Is4() != addr.Is4() || candidate.end.Less(addr) {
+		return nil
+	}
+	return candidate
+}
+
+// Len returns the number of ranges loaded
+func (db *DB) Len() int {
+	if db == nil {
+		return 0
+	}
+	return len(db.ranges)
+}
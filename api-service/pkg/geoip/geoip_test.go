@@ -0,0 +1,97 @@
+package geoip
+
+import (
+	"strings"
+	"testing"
+)
+
+const testDatabase = `start_ip,end_ip,country
+1.0.0.0,1.0.0.255,AU
+5.8.0.0,5.8.255.255,ru
+"77.88.0.0","77.88.63.255","RU"
+2a02:6b8::,2a02:6b8:ffff:ffff:ffff:ffff:ffff:ffff,RU
+10.0.0.0,9.0.0.0,ZZ
+`
+
+func TestCountry(t *testing.T) {
+	db, err := Parse(strings.NewReader(testDatabase))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if db.Len() != 4 {
+		t.Fatalf("Len() = %d, want 4 (header and inverted range skipped)", db.Len())
+	}
+
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"1.0.0.1", "AU"},
+		{"1.0.0.255", "AU"},
+		{"1.0.1.0", ""},
+		{"5.8.17.4", "RU"},
+		{"77.88.55.60", "RU"},
+		{"::ffff:77.88.55.60", "RU"},
+		{"2a02:6b8::2:242", "RU"},
+		{"2a03::1", ""},
+		{"0.0.0.1", ""},
+		{"not-an-ip", ""},
+	}
+	for _, tt := range tests {
+		if got := db.Country(tt.ip); got != tt.want {
+			t.Errorf("Country(%q) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestNilDB(t *testing.T) {
+	var db *DB
+	if got := db.Country("1.1.1.1"); got != "" {
+		t.Errorf("Country on nil DB = %q, want empty", got)
+	}
+	if asn, org := db.ASN("1.1.1.1"); asn != 0 || org != "" {
+		t.Errorf("ASN on nil DB = %d %q, want none", asn, org)
+	}
+}
+
+const testASNDatabase = `start_ip,end_ip,as_number,as_organization
+1.1.1.0,1.1.1.255,13335,"Cloudflare, Inc."
+5.8.0.0,5.8.255.255,AS12389,Rostelecom
+2a02:6b8::,2a02:6b8:ffff:ffff:ffff:ffff:ffff:ffff,13238,YANDEX LLC
+8.8.8.0,8.8.8.255,unknown,Google
+`
+
+func TestASN(t *testing.T) {
+	db, err := ParseASN(strings.NewReader(testASNDatabase))
+	if err != nil {
+		t.Fatalf("ParseASN: %v", err)
+	}
+	if db.Len() != 3 {
+		t.Fatalf("Len() = %d, want 3 (header and row without a number skipped)", db.Len())
+	}
+
+	tests := []struct {
+		ip      string
+		wantASN uint32
+		wantOrg string
+	}{
+		{"1.1.1.1", 13335, "Cloudflare, Inc."},
+		{"5.8.1.1", 12389, "Rostelecom"},
+		{"::ffff:5.8.1.1", 12389, "Rostelecom"},
+		{"2a02:6b8::1", 13238, "YANDEX LLC"},
+		{"8.8.8.8", 0, ""},
+		{"not-an-ip", 0, ""},
+	}
+	for _, tt := range tests {
+		asn, org := db.ASN(tt.ip)
+		if asn != tt.wantASN || org != tt.wantOrg {
+			t.Errorf("ASN(%q) = %d %q, want %d %q", tt.ip, asn, org, tt.wantASN, tt.wantOrg)
+		}
+	}
+
+	// A country database knows no AS numbers
+	countries, _ := Parse(strings.NewReader(testDatabase))
+	if asn, _ := countries.ASN("5.8.17.4"); asn != 0 {
+		t.Errorf("ASN on a country database = %d, want 0", asn)
+	}
+}
@@ -0,0 +1,135 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Report statuses
+const (
+	StatusOK       = "ok"
+	StatusDegraded = "degraded" // a non-critical dependency failed, the service keeps serving
+	StatusDown     = "down"     // a critical dependency failed, the service is not ready
+
+	CheckOK     = "ok"
+	CheckFailed = "failed"
+)
+
+// Check probes one dependency
+type Check struct {
+	Name     string
+	Critical bool // failing takes the service down rather than degrading it
+	Probe    func(ctx context.Context) error
+}
+
+// Result is the outcome of one check
+type Result struct {
+	Name      string  `json:"name"`
+	Status    string  `json:"status"`
+	Critical  bool    `json:"critical"`
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// Report is the state of every dependency
+type Report struct {
+	Status    string    `json:"status"`
+	Degraded  bool      `json:"degraded"`
+	Checks    []Result  `json:"checks"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// Checker runs the dependency checks concurrently, each bounded by the timeout
+type Checker struct {
+	checks  []Check
+	timeout time.Duration
+}
+
+func NewChecker(timeout time.Duration, checks ...Check) *Checker {
+	return &Checker{checks: checks, timeout: timeout}
+}
+
+// Run probes every dependency. The report is down when a critical check fails and
+// degraded when only others do.
+func (c *Checker) Run(ctx context.Context) Report {
+	results := make([]Result, len(c.checks))
+	var wg sync.WaitGroup
+	for i, check := range c.checks {
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+			results[i] = c.probe(ctx, check)
+		}(i, check)
+	}
+	wg.Wait()
+
+	report := Report{Status: StatusOK, Checks: results, CheckedAt: time.Now().UTC()}
+	for _, result := range results {
+		if result.Status == CheckOK {
+			continue
+		}
+		if result.Critical {
+			report.Status = StatusDown
+		} else if report.Status == StatusOK {
+			report.Status = StatusDegraded
+		}
+	}
+	report.Degraded = report.Status == StatusDegraded
+	return report
+}
+
+func (c *Checker) probe(ctx context.Context, check Check) Result {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := check.Probe(ctx)
+	result := Result{
+		Name:      check.Name,
+		Status:    CheckOK,
+		Critical:  check.Critical,
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		result.Status = CheckFailed
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// GRPCClient asks a gRPC server for its grpc_health_v1 status
+type GRPCClient struct {
+	conn    *grpc.ClientConn
+	service string
+}
+
+// NewGRPCClient creates a client for addr; the connection is made on the first probe
+func NewGRPCClient(addr, service string) (*GRPCClient, error) {
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	return &GRPCClient{conn: conn, service: service}, nil
+}
+
+// Probe fails unless the server reports SERVING
+func (g *GRPCClient) Probe(ctx context.Context) error {
+	resp, err := grpc_health_v1.NewHealthClient(g.conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: g.service})
+	if err != nil {
+		return err
+	}
+	if resp.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
+
+func (g *GRPCClient) Close() error {
+	return g.conn.Close()
+}
@@ -0,0 +1,87 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	grpchealth "google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func probeOK(ctx context.Context) error { return nil }
+
+func probeFail(ctx context.Context) error { return errors.New("connection refused") }
+
+func probeSlow(ctx context.Context) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name   string
+		checks []Check
+		want   string
+	}{
+		{"all ok", []Check{{"postgres", true, probeOK}, {"redis", false, probeOK}}, StatusOK},
+		{"optional failed", []Check{{"postgres", true, probeOK}, {"redis", false, probeFail}}, StatusDegraded},
+		{"critical failed", []Check{{"postgres", true, probeFail}, {"redis", false, probeFail}}, StatusDown},
+		{"critical timed out", []Check{{"postgres", true, probeSlow}, {"redis", false, probeOK}}, StatusDown},
+		{"no checks", nil, StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := NewChecker(50*time.Millisecond, tt.checks...).Run(context.Background())
+			if report.Status != tt.want {
+				t.Fatalf("Status = %q, want %q", report.Status, tt.want)
+			}
+			if report.Degraded != (tt.want == StatusDegraded) {
+				t.Errorf("Degraded = %v for status %q", report.Degraded, report.Status)
+			}
+			if len(report.Checks) != len(tt.checks) {
+				t.Fatalf("got %d results, want %d", len(report.Checks), len(tt.checks))
+			}
+			for i, result := range report.Checks {
+				if result.Name != tt.checks[i].Name {
+					t.Errorf("result %d is %q, want %q", i, result.Name, tt.checks[i].Name)
+				}
+				if (result.Status == CheckFailed) != (result.Error != "") {
+					t.Errorf("%s: status %q with error %q", result.Name, result.Status, result.Error)
+				}
+			}
+		})
+	}
+}
+
+func TestGRPCClientProbe(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	server := grpc.NewServer()
+	status := grpchealth.NewServer()
+	grpc_health_v1.RegisterHealthServer(server, status)
+	go server.Serve(lis)
+	defer server.Stop()
+
+	client, err := NewGRPCClient(lis.Addr().String(), "")
+	if err != nil {
+		t.Fatalf("NewGRPCClient: %v", err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Probe(ctx); err != nil {
+		t.Fatalf("Probe of a serving server: %v", err)
+	}
+
+	status.SetServingStatus("", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	if err := client.Probe(ctx); err == nil {
+		t.Fatal("Probe of a server that is not serving succeeded")
+	}
+}
@@ -0,0 +1,114 @@
+// Package lease hands out named, expiring locks in Redis so that a singleton job runs on
+// one replica at a time. A lease is renewed while its holder works and lapses on its own
+// when the holder dies, so a crashed replica holds a job back for one TTL at most.
+package lease
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"hysteria2_microservices/api-service/pkg/cache"
+
+	"github.com/google/uuid"
+)
+
+// ErrHeld is returned when another replica holds the lease
+var ErrHeld = errors.New("lease is held by another replica")
+
+// The scripts only touch a lease still owned by the caller, so a holder that lost its
+// lease to expiry never renews or releases the new holder's
+const (
+	renewScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`
+	releaseScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`
+)
+
+// Locker takes leases on behalf of this replica
+type Locker struct {
+	redis  *cache.RedisClient
+	ttl    time.Duration
+	holder string
+}
+
+// NewLocker creates a locker whose leases last ttl unless renewed. The holder recorded in
+// Redis names the host, to tell which replica runs a job.
+func NewLocker(redis *cache.RedisClient, ttl time.Duration) *Locker {
+	if ttl <= 0 {
+		ttl = 30 * time.Second
+	}
+	host, _ := os.Hostname()
+	return &Locker{
+		redis:  redis,
+		ttl:    ttl,
+		holder: fmt.Sprintf("%s/%s", host, uuid.NewString()),
+	}
+}
+
+func leaseKey(name string) string {
+	return "lease:" + name
+}
+
+// Run runs fn while holding the named lease, renewing it every third of the TTL, and
+// releases it when fn returns. Without running fn it returns ErrHeld when another replica
+// holds the lease. A renewal that finds the lease lost cancels fn's context.
+func (l *Locker) Run(ctx context.Context, name string, fn func(ctx context.Context) error) error {
+	key := leaseKey(name)
+	acquired, err := l.redis.SetNX(ctx, key, l.holder, l.ttl)
+	if err != nil {
+		return fmt.Errorf("failed to acquire lease %s: %w", name, err)
+	}
+	if !acquired {
+		return ErrHeld
+	}
+
+	runCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+
+		ticker := time.NewTicker(l.ttl / 3)
+		defer ticker.Stop()
+		lastRenewed := time.Now()
+		for {
+			select {
+			case <-ticker.C:
+			case <-runCtx.Done():
+				return
+			}
+			held, err := l.redis.Eval(runCtx, renewScript, []string{key}, l.holder, l.ttl.Milliseconds())
+			if err != nil {
+				// Keep trying until the lease may have lapsed
+				if time.Since(lastRenewed) < l.ttl {
+					continue
+				}
+				cancel(fmt.Errorf("lease %s not renewed: %w", name, err))
+				return
+			}
+			if n, _ := held.(int64); n == 0 {
+				cancel(fmt.Errorf("lease %s lost", name))
+				return
+			}
+			lastRenewed = time.Now()
+		}
+	}()
+
+	err = fn(runCtx)
+	cancel(nil)
+	<-renewed
+
+	// Release even when ctx is done, so the next run need not wait out the TTL
+	releaseCtx, releaseCancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer releaseCancel()
+	l.redis.Eval(releaseCtx, releaseScript, []string{key}, l.holder)
+	return err
+}
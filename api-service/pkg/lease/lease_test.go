@@ -0,0 +1,70 @@
+package lease
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"hysteria2_microservices/api-service/pkg/cache"
+
+	"github.com/google/uuid"
+)
+
+// The lease tests need a Redis server in TEST_REDIS_URL
+func testRedis(t *testing.T) *cache.RedisClient {
+	url := os.Getenv("TEST_REDIS_URL")
+	if url == "" {
+		t.Skip("TEST_REDIS_URL is not set")
+	}
+	redis := cache.NewRedisClient(url)
+	t.Cleanup(func() { redis.Close() })
+	return redis
+}
+
+func TestRunExcludesOtherHolders(t *testing.T) {
+	redis := testRedis(t)
+	ctx := context.Background()
+	name := "test-" + uuid.NewString()
+	first, second := NewLocker(redis, time.Second), NewLocker(redis, time.Second)
+
+	err := first.Run(ctx, name, func(ctx context.Context) error {
+		// Outlive the TTL so the lease is only held through renewals
+		time.Sleep(1500 * time.Millisecond)
+		if err := second.Run(ctx, name, func(context.Context) error { return nil }); !errors.Is(err, ErrHeld) {
+			t.Errorf("second holder: got %v, want ErrHeld", err)
+		}
+		return ctx.Err()
+	})
+	if err != nil {
+		t.Fatalf("first holder: %v", err)
+	}
+
+	ran := false
+	if err := second.Run(ctx, name, func(context.Context) error { ran = true; return nil }); err != nil || !ran {
+		t.Errorf("lease not released: ran %v, err %v", ran, err)
+	}
+}
+
+func TestRunCancelsOnLostLease(t *testing.T) {
+	redis := testRedis(t)
+	name := "test-" + uuid.NewString()
+	locker := NewLocker(redis, 300*time.Millisecond)
+
+	err := locker.Run(context.Background(), name, func(ctx context.Context) error {
+		// Another holder takes over once the lease is gone
+		redis.Del(ctx, leaseKey(name))
+		redis.SetNX(ctx, leaseKey(name), "someone else", time.Minute)
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case <-time.After(2 * time.Second):
+			return errors.New("still running without the lease")
+		}
+	})
+	if err == nil || errors.Is(err, ErrHeld) {
+		t.Fatalf("got %v, want the lease lost", err)
+	}
+	redis.Del(context.Background(), leaseKey(name))
+}
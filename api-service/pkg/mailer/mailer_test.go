@@ -0,0 +1,64 @@
+package mailer
+
+import (
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRequiresAddressAndSender(t *testing.T) {
+	_, err := New("smtp.example.com", "", "", "reports@example.com")
+	assert.Error(t, err)
+
+	_, err = New("smtp.example.com:587", "", "", "")
+	assert.Error(t, err)
+}
+
+func TestMessageCarriesBodyAndAttachments(t *testing.T) {
+	m, err := New("smtp.example.com:587", "", "", "reports@example.com")
+	require.NoError(t, err)
+
+	data := []byte(strings.Repeat("user,upload,download\n", 20))
+	raw, err := m.message([]string{"a@example.com", "b@example.com"}, "Отчёт за день", "See attached.",
+		[]Attachment{{Filename: "report.csv", ContentType: "text/csv", Data: data}})
+	require.NoError(t, err)
+
+	msg, err := mail.ReadMessage(strings.NewReader(string(raw)))
+	require.NoError(t, err)
+	assert.Equal(t, "a@example.com, b@example.com", msg.Header.Get("To"))
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	require.NoError(t, err)
+	assert.Equal(t, "Отчёт за день", subject)
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	require.Equal(t, "multipart/mixed", mediaType)
+
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	parts := map[string][]byte{}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		encoded, err := io.ReadAll(part)
+		require.NoError(t, err)
+		for _, line := range strings.Split(strings.TrimSpace(string(encoded)), "\r\n") {
+			assert.LessOrEqual(t, len(line), 76)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(string(encoded), "\r\n", ""))
+		require.NoError(t, err)
+		parts[part.FileName()] = decoded
+	}
+
+	assert.Equal(t, "See attached.", string(parts[""]))
+	assert.Equal(t, data, parts["report.csv"])
+}
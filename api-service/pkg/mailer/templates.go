@@ -0,0 +1,217 @@
+package mailer
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Names of the messages in a template set
+const (
+	TemplateWelcome        = "welcome"
+	TemplatePasswordReset  = "password_reset"
+	TemplateVerifyEmail    = "verify_email"
+	TemplateQuotaWarning   = "quota_warning"
+	TemplateExpiryReminder = "expiry_reminder"
+	TemplateInvoice        = "invoice"
+)
+
+//go:embed templates/*.tmpl
+var builtinTemplates embed.FS
+
+// WelcomeData fills the welcome message of a new account
+type WelcomeData struct {
+	Username string
+	Email    string
+	LoginURL string
+}
+
+// PasswordResetData fills the message carrying a password reset link
+type PasswordResetData struct {
+	Username  string
+	ResetURL  string
+	ExpiresIn time.Duration
+}
+
+// VerifyEmailData fills the message carrying an email verification link
+type VerifyEmailData struct {
+	Username  string
+	VerifyURL string
+	ExpiresIn time.Duration
+}
+
+// QuotaWarningData fills the warning of a user nearing or past their data limit
+type QuotaWarningData struct {
+	Username  string
+	Used      int64 // bytes
+	Limit     int64
+	Percent   int
+	PortalURL string
+}
+
+// ExpiryReminderData fills the reminder of an expiring subscription
+type ExpiryReminderData struct {
+	Username  string
+	ExpiresAt time.Time
+	DaysLeft  int
+	PortalURL string
+}
+
+// Invoice is a paid invoice. Amounts are in minor units of the currency, e.g. cents.
+type Invoice struct {
+	Number   string
+	IssuedAt time.Time
+	Currency string
+	Items    []InvoiceItem
+	Total    int64
+}
+
+// InvoiceItem is a line of an invoice
+type InvoiceItem struct {
+	Description string
+	Amount      int64
+}
+
+// InvoiceData fills the message delivering an invoice; Attached is set when the invoice
+// document goes along
+type InvoiceData struct {
+	Username string
+	Invoice
+	Attached bool
+}
+
+// samples render every template once when it is loaded, so a template referring to a field
+// its message does not have is refused at startup rather than when mailing
+var samples = map[string]interface{}{
+	TemplateWelcome:        WelcomeData{},
+	TemplatePasswordReset:  PasswordResetData{},
+	TemplateVerifyEmail:    VerifyEmailData{},
+	TemplateQuotaWarning:   QuotaWarningData{},
+	TemplateExpiryReminder: ExpiryReminderData{},
+	TemplateInvoice:        InvoiceData{Invoice: Invoice{Items: []InvoiceItem{{}}}},
+}
+
+var templateFuncs = template.FuncMap{
+	"bytes":    formatBytes,
+	"date":     func(t time.Time) string { return t.UTC().Format("January 2, 2006") },
+	"duration": formatDuration,
+	"money":    formatMoney,
+}
+
+// Templates are the plain text messages sent to users. Each template defines a "subject"
+// and a "body".
+type Templates struct {
+	set map[string]*template.Template
+}
+
+// LoadTemplates loads the built-in templates, replacing those that dir has a <name>.tmpl
+// for. An empty dir keeps the built-in ones.
+func LoadTemplates(dir string) (*Templates, error) {
+	t := &Templates{set: make(map[string]*template.Template, len(samples))}
+	for name, sample := range samples {
+		data, err := readTemplate(dir, name)
+		if err != nil {
+			return nil, err
+		}
+		tmpl, err := template.New(name).Funcs(templateFuncs).Parse(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s template: %w", name, err)
+		}
+		t.set[name] = tmpl
+		if _, _, err := t.Render(name, sample); err != nil {
+			return nil, fmt.Errorf("invalid %s template: %w", name, err)
+		}
+	}
+	return t, nil
+}
+
+func readTemplate(dir, name string) ([]byte, error) {
+	if dir != "" {
+		data, err := os.ReadFile(filepath.Join(dir, name+".tmpl"))
+		if err == nil {
+			return data, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("failed to read %s template: %w", name, err)
+		}
+	}
+	return builtinTemplates.ReadFile("templates/" + name + ".tmpl")
+}
+
+// Render fills a template's subject and body with data
+func (t *Templates) Render(name string, data interface{}) (subject, body string, err error) {
+	tmpl, ok := t.set[name]
+	if !ok {
+		return "", "", fmt.Errorf("unknown mail template %q", name)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, "subject", data); err != nil {
+		return "", "", err
+	}
+	// Subjects are one line whatever the template's layout
+	subject = strings.Join(strings.Fields(buf.String()), " ")
+
+	buf.Reset()
+	if err := tmpl.ExecuteTemplate(&buf, "body", data); err != nil {
+		return "", "", err
+	}
+	return subject, strings.TrimSpace(buf.String()) + "\n", nil
+}
+
+// Deliver renders a template and mails it to a single recipient
+func (m *Mailer) Deliver(to string, t *Templates, name string, data interface{}, attachments ...Attachment) error {
+	subject, body, err := t.Render(name, data)
+	if err != nil {
+		return fmt.Errorf("failed to render %s mail: %w", name, err)
+	}
+	return m.Send([]string{to}, subject, body, attachments...)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// formatDuration writes whole days, hours or minutes: "2 days", "1 hour", "30 minutes"
+func formatDuration(d time.Duration) string {
+	plural := func(n int64, unit string) string {
+		if n == 1 {
+			return "1 " + unit
+		}
+		return fmt.Sprintf("%d %ss", n, unit)
+	}
+	switch {
+	case d >= 24*time.Hour && d%(24*time.Hour) == 0:
+		return plural(int64(d/(24*time.Hour)), "day")
+	case d >= time.Hour && d%time.Hour == 0:
+		return plural(int64(d/time.Hour), "hour")
+	default:
+		return plural(int64(d.Round(time.Minute)/time.Minute), "minute")
+	}
+}
+
+// formatMoney writes an amount in minor units with two decimals, the precision of most
+// currencies
+func formatMoney(amount int64, currency string) string {
+	sign := ""
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	return fmt.Sprintf("%s%d.%02d %s", sign, amount/100, amount%100, currency)
+}
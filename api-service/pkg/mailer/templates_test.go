@@ -0,0 +1,87 @@
+package mailer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuiltinTemplates(t *testing.T) {
+	templates, err := LoadTemplates("")
+	require.NoError(t, err)
+
+	subject, body, err := templates.Render(TemplatePasswordReset, PasswordResetData{
+		Username:  "alice",
+		ResetURL:  "https://vpn.example.com/reset-password?token=abc",
+		ExpiresIn: time.Hour,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "Reset your password", subject)
+	assert.Contains(t, body, "https://vpn.example.com/reset-password?token=abc")
+	assert.Contains(t, body, "within 1 hour")
+
+	subject, body, err = templates.Render(TemplateQuotaWarning, QuotaWarningData{
+		Username: "alice",
+		Used:     80 << 30,
+		Limit:    100 << 30,
+		Percent:  80,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "You have used 80% of your data", subject)
+	assert.Contains(t, body, "80.0 GiB of your 100.0 GiB")
+
+	subject, body, err = templates.Render(TemplateInvoice, InvoiceData{
+		Username: "alice",
+		Invoice: Invoice{
+			Number:   "INV-7",
+			IssuedAt: time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC),
+			Currency: "USD",
+			Items:    []InvoiceItem{{Description: "Monthly plan", Amount: 999}},
+			Total:    999,
+		},
+		Attached: true,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "Invoice INV-7", subject)
+	assert.Contains(t, body, "Monthly plan: 9.99 USD")
+	assert.Contains(t, body, "The invoice is attached.")
+}
+
+func TestTemplatesFromDirReplaceBuiltins(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "welcome.tmpl"),
+		[]byte(`{{define "subject"}}Добро пожаловать{{end}}{{define "body"}}Привет, {{.Username}}!{{end}}`), 0600))
+
+	templates, err := LoadTemplates(dir)
+	require.NoError(t, err)
+
+	subject, body, err := templates.Render(TemplateWelcome, WelcomeData{Username: "alice"})
+	require.NoError(t, err)
+	assert.Equal(t, "Добро пожаловать", subject)
+	assert.Equal(t, "Привет, alice!\n", body)
+
+	// Templates the directory lacks stay built in
+	subject, _, err = templates.Render(TemplateExpiryReminder, ExpiryReminderData{DaysLeft: 7})
+	require.NoError(t, err)
+	assert.Equal(t, "Your subscription expires in 7 days", subject)
+}
+
+func TestTemplatesWithUnknownFieldsAreRefused(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "password_reset.tmpl"),
+		[]byte(`{{define "subject"}}Reset{{end}}{{define "body"}}{{.Token}}{{end}}`), 0600))
+
+	_, err := LoadTemplates(dir)
+	assert.ErrorContains(t, err, "password_reset")
+}
+
+func TestFormatDuration(t *testing.T) {
+	assert.Equal(t, "30 minutes", formatDuration(30*time.Minute))
+	assert.Equal(t, "2 hours", formatDuration(2*time.Hour))
+	assert.Equal(t, "1 day", formatDuration(24*time.Hour))
+	assert.Equal(t, "90 minutes", formatDuration(90*time.Minute))
+}
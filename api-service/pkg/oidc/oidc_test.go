@@ -0,0 +1,225 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeProvider struct {
+	server   *httptest.Server
+	key      *rsa.PrivateKey
+	kid      string
+	idToken  string
+	verifier string
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	fake := &fakeProvider{key: key, kid: "key-1"}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 fake.server.URL,
+			"authorization_endpoint": fake.server.URL + "/authorize",
+			"token_endpoint":         fake.server.URL + "/token",
+			"jwks_uri":               fake.server.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": fake.kid,
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(fake.key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(fake.key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "client", user)
+		assert.Equal(t, "secret", pass)
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "authorization_code", r.PostForm.Get("grant_type"))
+		assert.Equal(t, "the-code", r.PostForm.Get("code"))
+		fake.verifier = r.PostForm.Get("code_verifier")
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"id_token":     fake.idToken,
+		})
+	})
+	fake.server = httptest.NewServer(mux)
+	t.Cleanup(fake.server.Close)
+	return fake
+}
+
+func (f *fakeProvider) provider() *Provider {
+	return NewProvider(Config{
+		IssuerURL:    f.server.URL + "/",
+		ClientID:     "client",
+		ClientSecret: "secret",
+		RedirectURL:  "https://vpn.example.com/callback",
+	})
+}
+
+func (f *fakeProvider) sign(t *testing.T, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = f.kid
+	raw, err := token.SignedString(f.key)
+	require.NoError(t, err)
+	return raw
+}
+
+func (f *fakeProvider) claims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":            f.server.URL,
+		"aud":            "client",
+		"sub":            "user-1",
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          "the-nonce",
+		"email":          "alice@example.com",
+		"email_verified": true,
+		"groups":         []string{"vpn-admins", "staff"},
+		"realm_access":   map[string]interface{}{"roles": []string{"admin"}},
+	}
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	fake := newFakeProvider(t)
+
+	authURL, err := fake.provider().AuthCodeURL(context.Background(), "the-state", "the-nonce", "the-verifier")
+	require.NoError(t, err)
+
+	parsed, err := url.Parse(authURL)
+	require.NoError(t, err)
+	assert.Equal(t, "/authorize", parsed.Path)
+	query := parsed.Query()
+	assert.Equal(t, "code", query.Get("response_type"))
+	assert.Equal(t, "client", query.Get("client_id"))
+	assert.Equal(t, "openid email profile", query.Get("scope"))
+	assert.Equal(t, "the-state", query.Get("state"))
+	assert.Equal(t, "the-nonce", query.Get("nonce"))
+	assert.Equal(t, Challenge("the-verifier"), query.Get("code_challenge"))
+	assert.Equal(t, "S256", query.Get("code_challenge_method"))
+}
+
+func TestChallenge(t *testing.T) {
+	// RFC 7636 appendix B
+	assert.Equal(t, "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM", Challenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"))
+}
+
+func TestExchangeAndVerify(t *testing.T) {
+	fake := newFakeProvider(t)
+	fake.idToken = fake.sign(t, fake.claims())
+	provider := fake.provider()
+
+	tokens, err := provider.Exchange(context.Background(), "the-code", "the-verifier")
+	require.NoError(t, err)
+	assert.Equal(t, "the-verifier", fake.verifier)
+
+	id, err := provider.VerifyIDToken(context.Background(), tokens.IDToken, "the-nonce")
+	require.NoError(t, err)
+	assert.Equal(t, "user-1", id.Subject)
+	assert.Equal(t, "alice@example.com", id.Email)
+	assert.True(t, id.EmailVerified)
+	assert.Equal(t, []string{"vpn-admins", "staff"}, id.Strings("groups"))
+	assert.Equal(t, []string{"admin"}, id.Strings("realm_access.roles"))
+	assert.Nil(t, id.Strings("realm_access.missing"))
+}
+
+func TestVerifyIDTokenRejects(t *testing.T) {
+	fake := newFakeProvider(t)
+	provider := fake.provider()
+
+	tests := []struct {
+		name   string
+		modify func(claims jwt.MapClaims)
+	}{
+		{"wrong nonce", func(claims jwt.MapClaims) { claims["nonce"] = "other" }},
+		{"wrong issuer", func(claims jwt.MapClaims) { claims["iss"] = "https://evil.example.com" }},
+		{"wrong audience", func(claims jwt.MapClaims) { claims["aud"] = "other-client" }},
+		{"expired", func(claims jwt.MapClaims) { claims["exp"] = time.Now().Add(-time.Hour).Unix() }},
+		{"no expiry", func(claims jwt.MapClaims) { delete(claims, "exp") }},
+		{"no subject", func(claims jwt.MapClaims) { delete(claims, "sub") }},
+		{"foreign authorized party", func(claims jwt.MapClaims) {
+			claims["aud"] = []string{"client", "other-client"}
+			claims["azp"] = "other-client"
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := fake.claims()
+			tt.modify(claims)
+			_, err := provider.VerifyIDToken(context.Background(), fake.sign(t, claims), "the-nonce")
+			assert.Error(t, err)
+		})
+	}
+
+	t.Run("foreign key", func(t *testing.T) {
+		other, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, fake.claims())
+		token.Header["kid"] = fake.kid
+		raw, err := token.SignedString(other)
+		require.NoError(t, err)
+		_, err = provider.VerifyIDToken(context.Background(), raw, "the-nonce")
+		assert.Error(t, err)
+	})
+
+	t.Run("HMAC with public key", func(t *testing.T) {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, fake.claims())
+		token.Header["kid"] = fake.kid
+		raw, err := token.SignedString([]byte("client"))
+		require.NoError(t, err)
+		_, err = provider.VerifyIDToken(context.Background(), raw, "the-nonce")
+		assert.Error(t, err)
+	})
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	fake := newFakeProvider(t)
+	provider := NewProvider(Config{IssuerURL: fake.server.URL + "/realms/other", ClientID: "client"})
+
+	_, err := provider.AuthCodeURL(context.Background(), "state", "nonce", "verifier")
+	assert.Error(t, err)
+}
+
+func TestParseJWKEC(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	raw, err := json.Marshal(map[string]string{
+		"kty": "EC",
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(key.X.Bytes()),
+		"y":   base64.RawURLEncoding.EncodeToString(key.Y.Bytes()),
+	})
+	require.NoError(t, err)
+
+	parsed, err := parseJWK(raw)
+	require.NoError(t, err)
+	assert.True(t, key.PublicKey.Equal(parsed))
+
+	_, err = parseJWK([]byte(`{"kty":"oct","k":"c2VjcmV0"}`))
+	assert.Error(t, err)
+}
@@ -0,0 +1,829 @@
+package orchestrator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TokenFunc returns the bearer token for the next request
+type TokenFunc func() (string, error)
+
+// Client talks to the orchestrator's REST gateway, e.g. "http://orchestrator-service:8081/api/v1/gateway"
+type Client struct {
+	baseURL    string
+	token      TokenFunc
+	httpClient *http.Client
+}
+
+func NewClient(baseURL string, token TokenFunc) *Client {
+	return &Client{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		token:   token,
+		httpClient: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+	}
+}
+
+// Error is a non-200 response of the gateway. Code is the ErrorCode of the failure, e.g.
+// "NODE_UNREACHABLE", or the upper-cased gRPC code when the orchestrator did not set one.
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	Details    map[string]string
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("orchestrator returned status %d: %s", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("orchestrator returned status %d: %s (%s)", e.StatusCode, e.Message, e.Code)
+}
+
+// XrayConnection is a client online on a node's Xray
+type XrayConnection struct {
+	NodeID      string    `json:"nodeId"`
+	Email       string    `json:"email"`
+	UserID      string    `json:"userId"`
+	DeviceID    string    `json:"deviceId"`
+	InboundTags []string  `json:"inboundTags"`
+	IPs         []string  `json:"ips"`
+	LastSeen    time.Time `json:"-"`
+	Uplink      int64     `json:"uplink,string"`
+	Downlink    int64     `json:"downlink,string"`
+}
+
+func (x *XrayConnection) UnmarshalJSON(data []byte) error {
+	type alias XrayConnection
+	aux := struct {
+		*alias
+		LastSeen int64 `json:"lastSeen,string"`
+	}{alias: (*alias)(x)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	if aux.LastSeen > 0 {
+		x.LastSeen = time.Unix(aux.LastSeen, 0)
+	}
+	return nil
+}
+
+// XrayConnections is the result of a query or disconnect spanning several nodes
+type XrayConnections struct {
+	Connections []XrayConnection
+	FailedNodes []string
+}
+
+// GetXrayConnections lists the clients online on Xray, on one node or on every online node
+// when nodeID is empty
+func (c *Client) GetXrayConnections(ctx context.Context, nodeID string) (*XrayConnections, error) {
+	path := "/xray/connections"
+	if nodeID != "" {
+		path = "/nodes/" + url.PathEscape(nodeID) + "/xray/connections"
+	}
+
+	var resp struct {
+		Connections []XrayConnection `json:"connections"`
+		FailedNodes []string         `json:"failedNodes"`
+	}
+	if err := c.do(ctx, http.MethodGet, path, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &XrayConnections{Connections: resp.Connections, FailedNodes: resp.FailedNodes}, nil
+}
+
+// DisconnectXrayUser drops the Xray connections of a user, or of one of their devices, on
+// one node or on every online node when nodeID is empty
+func (c *Client) DisconnectXrayUser(ctx context.Context, nodeID, userID, deviceID string) (*XrayConnections, error) {
+	path := "/xray/disconnect"
+	if nodeID != "" {
+		path = "/nodes/" + url.PathEscape(nodeID) + "/xray/disconnect"
+	}
+	body := map[string]string{"userId": userID, "deviceId": deviceID}
+
+	var resp struct {
+		Disconnected []XrayConnection `json:"disconnected"`
+		FailedNodes  []string         `json:"failedNodes"`
+	}
+	if err := c.do(ctx, http.MethodPost, path, body, &resp); err != nil {
+		return nil, err
+	}
+	return &XrayConnections{Connections: resp.Disconnected, FailedNodes: resp.FailedNodes}, nil
+}
+
+// ExperimentSample is a client connection attempt to a node, for the obfuscation
+// experiment the node takes part in
+type ExperimentSample struct {
+	NodeID         string `json:"nodeId"`
+	Success        bool   `json:"success"`
+	HandshakeMs    int    `json:"handshakeMs"`
+	ThroughputKbps int    `json:"throughputKbps"`
+	FailureReason  string `json:"failureReason,omitempty"`
+	Timestamp      int64  `json:"timestamp,string"`
+}
+
+// ReportExperimentSamples hands client connection attempts to the obfuscation experiments
+// and returns how many of them were recorded; attempts on nodes outside running
+// experiments are dropped
+func (c *Client) ReportExperimentSamples(ctx context.Context, samples []ExperimentSample) (int, error) {
+	body := map[string][]ExperimentSample{"samples": samples}
+
+	var resp struct {
+		Accepted int `json:"accepted"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/obfuscation-experiments/samples", body, &resp); err != nil {
+		return 0, err
+	}
+	return resp.Accepted, nil
+}
+
+// WARPStatus is the state of the WARP client on a node
+type WARPStatus struct {
+	Installed      bool              `json:"installed"`
+	Connected      bool              `json:"connected"`
+	Mode           string            `json:"mode"`
+	ProxyPort      int               `json:"proxyPort"`
+	AccountType    string            `json:"accountType"`
+	Organization   string            `json:"organization"`
+	IPAddress      string            `json:"ipAddress"`
+	Location       string            `json:"location"`
+	ServerLocation string            `json:"serverLocation"`
+	LastConnected  int64             `json:"lastConnected,string"` // Unix seconds, 0 when never
+	Uptime         int64             `json:"uptime,string"`        // seconds
+	BytesSent      int64             `json:"bytesSent,string"`
+	BytesReceived  int64             `json:"bytesReceived,string"`
+	Health         string            `json:"health"`
+	Error          string            `json:"error"`
+	ClientType     string            `json:"clientType"`
+	DeviceID       string            `json:"deviceId"`
+	DevicePosture  map[string]string `json:"devicePosture"`
+}
+
+// WARPSettings replaces the WARP configuration of a node. LicenseKey and the Zero Trust
+// service token are passed to the agent and never returned.
+type WARPSettings struct {
+	Enabled           bool   `json:"enabled"`
+	ProxyPort         int    `json:"proxyPort"`
+	AutoConnect       bool   `json:"autoConnect"`
+	NotifyOnFail      bool   `json:"notifyOnFail"`
+	ClientType        string `json:"clientType,omitempty"`
+	LicenseKey        string `json:"licenseKey,omitempty"`
+	Organization      string `json:"organization,omitempty"`
+	Mode              string `json:"mode,omitempty"`
+	TeamsClientID     string `json:"teamsClientId,omitempty"`
+	TeamsClientSecret string `json:"teamsClientSecret,omitempty"`
+}
+
+// WARPConnectivity is the outcome of a node checking its WARP proxy, by check
+type WARPConnectivity struct {
+	Success bool            `json:"success"`
+	Message string          `json:"message"`
+	Results map[string]bool `json:"results"`
+}
+
+// WARPLogs is the recent log of a node's WARP service
+type WARPLogs struct {
+	Success    bool   `json:"success"`
+	Message    string `json:"message"`
+	Logs       string `json:"logs"`
+	ClientType string `json:"clientType"`
+}
+
+// actionResult is the reply of the calls that only report whether they worked
+type actionResult struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+}
+
+func warpPath(nodeID, action string) string {
+	return "/nodes/" + url.PathEscape(nodeID) + "/warp" + action
+}
+
+// GetWARPStatus returns the state of the WARP client on a node
+func (c *Client) GetWARPStatus(ctx context.Context, nodeID string) (*WARPStatus, error) {
+	var resp struct {
+		Status *WARPStatus `json:"status"`
+	}
+	if err := c.do(ctx, http.MethodGet, warpPath(nodeID, ""), nil, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Status == nil {
+		return &WARPStatus{}, nil
+	}
+	return resp.Status, nil
+}
+
+// ConfigureWARP replaces the WARP configuration of a node and returns the node's message
+func (c *Client) ConfigureWARP(ctx context.Context, nodeID string, settings WARPSettings) (string, error) {
+	return c.warpAction(ctx, http.MethodPut, warpPath(nodeID, ""), settings)
+}
+
+func (c *Client) ConnectWARP(ctx context.Context, nodeID string) (string, error) {
+	return c.warpAction(ctx, http.MethodPost, warpPath(nodeID, "/connect"), nil)
+}
+
+func (c *Client) DisconnectWARP(ctx context.Context, nodeID string) (string, error) {
+	return c.warpAction(ctx, http.MethodPost, warpPath(nodeID, "/disconnect"), nil)
+}
+
+// EnableWARPProxy switches a node's WARP client to proxy mode on the given local port
+func (c *Client) EnableWARPProxy(ctx context.Context, nodeID string, port int) (string, error) {
+	return c.warpAction(ctx, http.MethodPost, warpPath(nodeID, "/proxy"), map[string]int{"port": port})
+}
+
+func (c *Client) DisableWARPProxy(ctx context.Context, nodeID string) (string, error) {
+	return c.warpAction(ctx, http.MethodDelete, warpPath(nodeID, "/proxy"), nil)
+}
+
+// EnableWARPRouting routes the traffic of a node interface through WARP
+func (c *Client) EnableWARPRouting(ctx context.Context, nodeID, interfaceName string) (string, error) {
+	return c.warpAction(ctx, http.MethodPost, warpPath(nodeID, "/routing"), map[string]string{"interfaceName": interfaceName})
+}
+
+func (c *Client) DisableWARPRouting(ctx context.Context, nodeID string) (string, error) {
+	return c.warpAction(ctx, http.MethodDelete, warpPath(nodeID, "/routing"), nil)
+}
+
+// TestWARPConnectivity has a node check its WARP proxy end to end
+func (c *Client) TestWARPConnectivity(ctx context.Context, nodeID string) (*WARPConnectivity, error) {
+	var resp WARPConnectivity
+	if err := c.do(ctx, http.MethodPost, warpPath(nodeID, "/test"), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// GetWARPLogs returns the last lines of a node's WARP service log, 200 when lines is 0
+func (c *Client) GetWARPLogs(ctx context.Context, nodeID string, lines int) (*WARPLogs, error) {
+	path := warpPath(nodeID, "/logs")
+	if lines > 0 {
+		path += "?lines=" + strconv.Itoa(lines)
+	}
+
+	var resp WARPLogs
+	if err := c.do(ctx, http.MethodGet, path, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// warpAction runs a WARP call and returns the node's message, failing when the node
+// reports it did not work
+func (c *Client) warpAction(ctx context.Context, method, path string, body interface{}) (string, error) {
+	var resp actionResult
+	if err := c.do(ctx, method, path, body, &resp); err != nil {
+		return "", err
+	}
+	if !resp.Success {
+		return "", fmt.Errorf("node did not apply the WARP change: %s", resp.Message)
+	}
+	return resp.Message, nil
+}
+
+// ObfuscationSettings is every obfuscation knob of a node at once; knobs left off are
+// turned off
+type ObfuscationSettings struct {
+	Salamander         bool     `json:"salamander"`
+	SalamanderPassword string   `json:"salamanderPassword,omitempty"` // generated per node when empty
+	PortHopping        bool     `json:"portHopping"`
+	HopStartPort       int      `json:"hopStartPort"`
+	HopEndPort         int      `json:"hopEndPort"`
+	HopInterval        int      `json:"hopInterval"` // seconds
+	QUICObfuscation    bool     `json:"quicObfuscation"`
+	PacketPadding      int      `json:"packetPadding"`
+	TimingJitterMs     int      `json:"timingJitterMs"`
+	Fingerprints       []string `json:"fingerprints"`
+	RealityTargets     []string `json:"realityTargets"`
+	TrafficShaping     bool     `json:"trafficShaping"`
+}
+
+// NodeObfuscation is the preset of a node, empty for custom settings, and its settings as
+// applied. Settings is nil when the node keeps the obfuscation configured on its agent.
+type NodeObfuscation struct {
+	Preset   string               `json:"preset"`
+	Settings *ObfuscationSettings `json:"settings"`
+	Message  string               `json:"message"`
+}
+
+// GetNodeObfuscation returns a node's obfuscation preset and settings
+func (c *Client) GetNodeObfuscation(ctx context.Context, nodeID string) (*NodeObfuscation, error) {
+	var resp NodeObfuscation
+	if err := c.do(ctx, http.MethodGet, "/nodes/"+url.PathEscape(nodeID)+"/obfuscation", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// SetNodeObfuscation applies a preset to a node, or settings when preset is empty. Giving
+// neither turns obfuscation off.
+func (c *Client) SetNodeObfuscation(ctx context.Context, nodeID, preset string, settings *ObfuscationSettings) (*NodeObfuscation, error) {
+	body := struct {
+		Preset   string               `json:"preset,omitempty"`
+		Settings *ObfuscationSettings `json:"settings,omitempty"`
+	}{Preset: preset}
+	if preset == "" {
+		body.Settings = settings
+	}
+
+	var resp NodeObfuscation
+	if err := c.do(ctx, http.MethodPut, "/nodes/"+url.PathEscape(nodeID)+"/obfuscation", body, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// SNIDomainCheck is the pre-flight DNS check of an SNI domain
+type SNIDomainCheck struct {
+	Domain         string `json:"domain"`
+	ResolvesToNode bool   `json:"resolvesToNode"`
+	Message        string `json:"message"`
+}
+
+// SNIOnboarding asks for a domain to be added to a node
+type SNIOnboarding struct {
+	Domain           string `json:"domain"`
+	ManageDNS        bool   `json:"manageDns"`
+	Overwrite        bool   `json:"overwrite"`
+	IssueCertificate bool   `json:"issueCertificate"`
+	Email            string `json:"email,omitempty"`
+	WaitSeconds      int    `json:"waitSeconds,omitempty"`
+}
+
+// SNIOnboardingResult is the outcome of adding a domain to a node. Success is false when
+// the domain was added but its certificate could not be issued.
+type SNIOnboardingResult struct {
+	Success             bool            `json:"success"`
+	Message             string          `json:"message"`
+	DNSCheck            *SNIDomainCheck `json:"dnsCheck"`
+	CertificateIssued   bool            `json:"certificateIssued"`
+	CertificateIssuer   string          `json:"certificateIssuer"`
+	CertificateNotAfter int64           `json:"certificateNotAfter,string"` // Unix seconds
+}
+
+// OnboardSNIDomain adds a domain to a node, optionally pointing its DNS at the node and
+// issuing its certificate
+func (c *Client) OnboardSNIDomain(ctx context.Context, nodeID string, onboarding SNIOnboarding) (*SNIOnboardingResult, error) {
+	var resp SNIOnboardingResult
+	if err := c.do(ctx, http.MethodPost, "/nodes/"+url.PathEscape(nodeID)+"/sni/domains", onboarding, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// SNIDomains is what is left of a node's SNI configuration after a domain was removed
+type SNIDomains struct {
+	Domains       []string `json:"domains"`
+	PrimaryDomain string   `json:"primaryDomain"`
+}
+
+// RemoveSNIDomain takes a domain off a node; its DNS records are kept
+func (c *Client) RemoveSNIDomain(ctx context.Context, nodeID, domain string) (*SNIDomains, error) {
+	path := "/nodes/" + url.PathEscape(nodeID) + "/sni/domains/" + url.PathEscape(domain)
+
+	var resp SNIDomains
+	if err := c.do(ctx, http.MethodDelete, path, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// CertificateMode is how a node's Hysteria2 server gets its certificates. DNS provider
+// credentials are never returned.
+type CertificateMode struct {
+	Mode        string   `json:"mode"`
+	Domains     []string `json:"domains"`
+	Email       string   `json:"email"`
+	CA          string   `json:"ca"`
+	Challenge   string   `json:"challenge"`
+	DNSProvider string   `json:"dnsProvider"`
+}
+
+// ACMECertificate is a certificate a node obtained through ACME
+type ACMECertificate struct {
+	Domain    string `json:"domain"`
+	Issuer    string `json:"issuer"`
+	CA        string `json:"ca"`
+	NotBefore int64  `json:"notBefore,string"` // Unix seconds
+	NotAfter  int64  `json:"notAfter,string"`  // Unix seconds
+	DaysLeft  int    `json:"daysLeft"`
+}
+
+// CertificateStatus is the certificate mode of a node and the certificates it holds.
+// Certificates are only listed when the node can report them, Message says why not.
+type CertificateStatus struct {
+	Message      string            `json:"message"`
+	Mode         *CertificateMode  `json:"mode"`
+	Certificates []ACMECertificate `json:"certificates"`
+	Pending      []string          `json:"pending"`
+	ExpiringSoon []string          `json:"expiringSoon"`
+}
+
+// GetCertificateStatus returns the certificate mode of a node and its ACME certificates
+func (c *Client) GetCertificateStatus(ctx context.Context, nodeID string) (*CertificateStatus, error) {
+	var resp CertificateStatus
+	if err := c.do(ctx, http.MethodGet, "/nodes/"+url.PathEscape(nodeID)+"/acme", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// RenewCertificates has a node renew its certificates now and returns the node's message
+func (c *Client) RenewCertificates(ctx context.Context, nodeID string) (string, error) {
+	var resp actionResult
+	if err := c.do(ctx, http.MethodPost, "/nodes/"+url.PathEscape(nodeID)+"/certificates/renew", nil, &resp); err != nil {
+		return "", err
+	}
+	if !resp.Success {
+		return "", fmt.Errorf("node did not renew its certificates: %s", resp.Message)
+	}
+	return resp.Message, nil
+}
+
+// InventoryCertificate is a certificate in the orchestrator's inventory, as its node served
+// it at the last sync
+type InventoryCertificate struct {
+	Domain     string `json:"domain"`
+	Issuer     string `json:"issuer"`
+	NotBefore  int64  `json:"notBefore,string"` // Unix seconds
+	NotAfter   int64  `json:"notAfter,string"`  // Unix seconds
+	SelfSigned bool   `json:"selfSigned"`
+	Source     string `json:"source"`
+	NodeID     string `json:"nodeId"`
+	NodeName   string `json:"nodeName"`
+	DaysLeft   int    `json:"daysLeft"`
+	SyncedAt   int64  `json:"syncedAt,string"` // Unix seconds
+}
+
+// CertificateFilter narrows the certificate inventory; zero fields match everything
+type CertificateFilter struct {
+	NodeID             string
+	Domain             string
+	ExpiringWithinDays int
+	SelfSigned         bool
+}
+
+// ListCertificates returns the certificate inventory, the certificates expiring first
+func (c *Client) ListCertificates(ctx context.Context, filter CertificateFilter) ([]InventoryCertificate, error) {
+	query := url.Values{}
+	if filter.NodeID != "" {
+		query.Set("nodeId", filter.NodeID)
+	}
+	if filter.Domain != "" {
+		query.Set("domain", filter.Domain)
+	}
+	if filter.ExpiringWithinDays > 0 {
+		query.Set("expiringWithinDays", strconv.Itoa(filter.ExpiringWithinDays))
+	}
+	if filter.SelfSigned {
+		query.Set("selfSigned", "true")
+	}
+	path := "/certificates"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	var resp struct {
+		Certificates []InventoryCertificate `json:"certificates"`
+	}
+	if err := c.do(ctx, http.MethodGet, path, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Certificates, nil
+}
+
+// BulkRenewal is the outcome of renewing certificates on several nodes
+type BulkRenewal struct {
+	Message  string            `json:"message"`
+	Renewed  []string          `json:"renewed"`
+	Failures map[string]string `json:"failures"` // node ID -> error
+}
+
+// BulkRenewCertificates renews the certificates of the given nodes, or of every node
+// holding a certificate that matches filter when nodeIDs is empty. NodeID and Domain of
+// filter are not used.
+func (c *Client) BulkRenewCertificates(ctx context.Context, nodeIDs []string, filter CertificateFilter) (*BulkRenewal, error) {
+	body := struct {
+		NodeIDs            []string `json:"nodeIds,omitempty"`
+		ExpiringWithinDays int      `json:"expiringWithinDays,omitempty"`
+		SelfSigned         bool     `json:"selfSigned,omitempty"`
+	}{NodeIDs: nodeIDs, ExpiringWithinDays: filter.ExpiringWithinDays, SelfSigned: filter.SelfSigned}
+
+	var resp BulkRenewal
+	if err := c.do(ctx, http.MethodPost, "/certificates/renew", body, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// UploadedCertificate is a certificate an operator uploaded for a domain ACME cannot serve.
+// Its private key is never returned.
+type UploadedCertificate struct {
+	Domain      string   `json:"domain"`
+	Issuer      string   `json:"issuer"`
+	Fingerprint string   `json:"fingerprint"`
+	NotBefore   int64    `json:"notBefore,string"` // Unix seconds
+	NotAfter    int64    `json:"notAfter,string"`  // Unix seconds
+	CustomCA    bool     `json:"customCa"`
+	NodeIDs     []string `json:"nodeIds"`
+	UploadedAt  int64    `json:"uploadedAt,string"` // Unix seconds
+}
+
+// CertificateUpload is a certificate chain and key for a domain, with the roots of an
+// internal CA when the chain does not lead to a public root
+type CertificateUpload struct {
+	Domain         string `json:"domain"`
+	CertificatePEM string `json:"certificatePem"`
+	PrivateKeyPEM  string `json:"privateKeyPem"`
+	CABundlePEM    string `json:"caBundlePem,omitempty"`
+}
+
+// CertificateDistribution is the outcome of an upload on the nodes serving its domain
+type CertificateDistribution struct {
+	Message     string               `json:"message"`
+	Certificate *UploadedCertificate `json:"certificate"`
+	Installed   []string             `json:"installed"`
+	Failures    map[string]string    `json:"failures"` // node ID -> error
+}
+
+// UploadCertificate validates and stores an uploaded certificate and installs it on every
+// node serving a domain it covers. An invalid certificate is rejected with 400.
+func (c *Client) UploadCertificate(ctx context.Context, upload CertificateUpload) (*CertificateDistribution, error) {
+	var resp CertificateDistribution
+	if err := c.do(ctx, http.MethodPost, "/certificates/uploads", upload, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ListUploadedCertificates returns the uploaded certificates, the ones expiring first
+func (c *Client) ListUploadedCertificates(ctx context.Context) ([]UploadedCertificate, error) {
+	var resp struct {
+		Certificates []UploadedCertificate `json:"certificates"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/certificates/uploads", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Certificates, nil
+}
+
+// DeleteUploadedCertificate deletes the upload of a domain; nodes keep serving it until it
+// is replaced
+func (c *Client) DeleteUploadedCertificate(ctx context.Context, domain string) (string, error) {
+	var resp actionResult
+	if err := c.do(ctx, http.MethodDelete, "/certificates/uploads/"+url.PathEscape(domain), nil, &resp); err != nil {
+		return "", err
+	}
+	return resp.Message, nil
+}
+
+// TLSCheck is the outcome of one TLS check of a TLS report
+type TLSCheck struct {
+	Name       string `json:"name"`
+	Target     string `json:"target"`
+	Status     string `json:"status"` // pass, warn, fail, skip
+	Detail     string `json:"detail"`
+	Hint       string `json:"hint"`
+	DurationMs int64  `json:"durationMs,string"`
+}
+
+// TLSReport grades the TLS a node serves on its TCP ports, as another node saw it
+type TLSReport struct {
+	ID           string     `json:"id"`
+	NodeID       string     `json:"nodeId"`
+	ProberNodeID string     `json:"proberNodeId"`
+	Target       string     `json:"target"`
+	Grade        string     `json:"grade"`
+	Score        int        `json:"score"`
+	StartedAt    int64      `json:"startedAt,string"`  // Unix seconds
+	FinishedAt   int64      `json:"finishedAt,string"` // Unix seconds
+	Checks       []TLSCheck `json:"checks"`
+}
+
+// RunTLSCheck has another node grade the TLS the node serves and returns the stored report
+func (c *Client) RunTLSCheck(ctx context.Context, nodeID string) (*TLSReport, error) {
+	var resp struct {
+		Success bool       `json:"success"`
+		Message string     `json:"message"`
+		Report  *TLSReport `json:"report"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/nodes/"+url.PathEscape(nodeID)+"/tls-check", nil, &resp); err != nil {
+		return nil, err
+	}
+	if !resp.Success || resp.Report == nil {
+		return nil, fmt.Errorf("TLS check failed: %s", resp.Message)
+	}
+	return resp.Report, nil
+}
+
+// ListTLSReports returns the latest TLS reports of a node, or the latest report of every
+// node, worst grade first, when nodeID is empty
+func (c *Client) ListTLSReports(ctx context.Context, nodeID string) ([]TLSReport, error) {
+	path := "/tls-reports"
+	if nodeID != "" {
+		path = "/nodes/" + url.PathEscape(nodeID) + "/tls-reports"
+	}
+
+	var resp struct {
+		Reports []TLSReport `json:"reports"`
+	}
+	if err := c.do(ctx, http.MethodGet, path, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Reports, nil
+}
+
+// DriftItem is one difference between a node and its desired state
+type DriftItem struct {
+	Kind     string `json:"kind"` // config, protocol, service, firewall, routing
+	Target   string `json:"target"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+}
+
+// DriftReport is what the last drift check of a node found; after a heal the items are the
+// drift left
+type DriftReport struct {
+	NodeID     string      `json:"nodeId"`
+	NodeName   string      `json:"nodeName"`
+	Policy     string      `json:"policy"` // report, heal
+	Items      []DriftItem `json:"items"`
+	Healed     []string    `json:"healed"`
+	HealFailed []string    `json:"healFailed"`
+	CheckedAt  int64       `json:"checkedAt,string"` // Unix seconds
+	HealedAt   int64       `json:"healedAt,string"`  // Unix seconds, 0 before the first heal
+}
+
+// CheckDrift compares a node with its desired state now, healing the drift found with heal
+func (c *Client) CheckDrift(ctx context.Context, nodeID string, heal bool) (*DriftReport, error) {
+	var resp struct {
+		Success bool         `json:"success"`
+		Message string       `json:"message"`
+		Report  *DriftReport `json:"report"`
+	}
+	body := map[string]bool{"heal": heal}
+	if err := c.do(ctx, http.MethodPost, "/nodes/"+url.PathEscape(nodeID)+"/drift-check", body, &resp); err != nil {
+		return nil, err
+	}
+	if !resp.Success || resp.Report == nil {
+		return nil, fmt.Errorf("drift check failed: %s", resp.Message)
+	}
+	return resp.Report, nil
+}
+
+// ListDrift returns the last drift check of every node, the most drifted first
+func (c *Client) ListDrift(ctx context.Context, driftedOnly bool) ([]DriftReport, error) {
+	path := "/drift"
+	if driftedOnly {
+		path += "?driftedOnly=true"
+	}
+
+	var resp struct {
+		Reports []DriftReport `json:"reports"`
+	}
+	if err := c.do(ctx, http.MethodGet, path, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Reports, nil
+}
+
+// SetDriftPolicy selects whether scheduled drift checks only record a node's drift ("report")
+// or heal it ("heal")
+func (c *Client) SetDriftPolicy(ctx context.Context, nodeID, policy string) (string, error) {
+	var resp struct {
+		Success bool   `json:"success"`
+		Message string `json:"message"`
+	}
+	body := map[string]string{"policy": policy}
+	if err := c.do(ctx, http.MethodPut, "/nodes/"+url.PathEscape(nodeID)+"/drift-policy", body, &resp); err != nil {
+		return "", err
+	}
+	if !resp.Success {
+		return "", fmt.Errorf("failed to set drift policy: %s", resp.Message)
+	}
+	return resp.Message, nil
+}
+
+// PortForward is a public port of a node its agent forwards to a user's server
+type PortForward struct {
+	ID         string `json:"id"`
+	Owner      string `json:"owner"` // user the forward was set up for
+	Protocol   string `json:"protocol"`
+	ListenPort int    `json:"listenPort"`
+	TargetHost string `json:"targetHost"`
+	TargetPort int    `json:"targetPort"`
+	CreatedAt  int64  `json:"createdAt,string"` // Unix seconds
+}
+
+// PortForwards are the forwards of a node and the range of ports they may listen on
+type PortForwards struct {
+	Forwards []PortForward `json:"forwards"`
+	MinPort  int           `json:"minPort"`
+	MaxPort  int           `json:"maxPort"`
+}
+
+// AddPortForward has a node forward a public port. The agent rejects ports outside its range,
+// ports its servers listen on and targets that are no public addresses.
+func (c *Client) AddPortForward(ctx context.Context, nodeID string, forward PortForward) (*PortForward, error) {
+	var resp struct {
+		Success bool         `json:"success"`
+		Message string       `json:"message"`
+		Forward *PortForward `json:"forward"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/nodes/"+url.PathEscape(nodeID)+"/port-forwards", forward, &resp); err != nil {
+		return nil, err
+	}
+	if !resp.Success || resp.Forward == nil {
+		return nil, fmt.Errorf("failed to add port forward: %s", resp.Message)
+	}
+	return resp.Forward, nil
+}
+
+// RemovePortForward closes a forwarded port of a node
+func (c *Client) RemovePortForward(ctx context.Context, nodeID, forwardID string) error {
+	var resp struct {
+		Success bool   `json:"success"`
+		Message string `json:"message"`
+	}
+	path := "/nodes/" + url.PathEscape(nodeID) + "/port-forwards/" + url.PathEscape(forwardID)
+	if err := c.do(ctx, http.MethodDelete, path, nil, &resp); err != nil {
+		return err
+	}
+	if !resp.Success {
+		return fmt.Errorf("failed to remove port forward: %s", resp.Message)
+	}
+	return nil
+}
+
+// ListPortForwards returns the forwards a node's agent has installed
+func (c *Client) ListPortForwards(ctx context.Context, nodeID string) (*PortForwards, error) {
+	var resp PortForwards
+	if err := c.do(ctx, http.MethodGet, "/nodes/"+url.PathEscape(nodeID)+"/port-forwards", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body, dest interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	token, err := c.token()
+	if err != nil {
+		return fmt.Errorf("failed to issue orchestrator token: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("orchestrator request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read orchestrator response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return parseError(resp.StatusCode, data)
+	}
+	if err := json.Unmarshal(data, dest); err != nil {
+		return fmt.Errorf("failed to decode orchestrator response: %w", err)
+	}
+	return nil
+}
+
+// parseError reads the gateway's {"error", "code", "details"} body; other bodies, e.g. from a
+// proxy in front of it, become the message
+func parseError(statusCode int, data []byte) *Error {
+	var body struct {
+		Error   string            `json:"error"`
+		Code    string            `json:"code"`
+		Details map[string]string `json:"details"`
+	}
+	if err := json.Unmarshal(data, &body); err != nil || body.Error == "" {
+		return &Error{StatusCode: statusCode, Message: string(bytes.TrimSpace(data))}
+	}
+	return &Error{StatusCode: statusCode, Code: body.Code, Message: body.Error, Details: body.Details}
+}
@@ -0,0 +1,568 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetXrayConnections(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer service-token", r.Header.Get("Authorization"))
+		switch r.URL.Path {
+		case "/api/v1/gateway/xray/connections", "/api/v1/gateway/nodes/node-1/xray/connections":
+		default:
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		// grpc-gateway output: lowerCamelCase names, int64 as strings, unpopulated fields emitted
+		w.Write([]byte(`{
+			"success": true,
+			"message": "1 client(s) online on 1 node(s)",
+			"connections": [{
+				"nodeId": "node-1",
+				"email": "user-1@device-1",
+				"userId": "user-1",
+				"deviceId": "device-1",
+				"inboundTags": ["vless-in"],
+				"ips": ["203.0.113.7"],
+				"lastSeen": "1700000000",
+				"uplink": "1024",
+				"downlink": "0"
+			}],
+			"failedNodes": ["node-2"]
+		}`))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL+"/api/v1/gateway/", func() (string, error) { return "service-token", nil })
+
+	for _, nodeID := range []string{"", "node-1"} {
+		result, err := client.GetXrayConnections(context.Background(), nodeID)
+		require.NoError(t, err)
+		require.Len(t, result.Connections, 1)
+		connection := result.Connections[0]
+		assert.Equal(t, "node-1", connection.NodeID)
+		assert.Equal(t, "user-1", connection.UserID)
+		assert.Equal(t, "device-1", connection.DeviceID)
+		assert.Equal(t, []string{"203.0.113.7"}, connection.IPs)
+		assert.Equal(t, time.Unix(1700000000, 0), connection.LastSeen)
+		assert.Equal(t, int64(1024), connection.Uplink)
+		assert.Equal(t, int64(0), connection.Downlink)
+		assert.Equal(t, []string{"node-2"}, result.FailedNodes)
+	}
+}
+
+func TestDisconnectXrayUser(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/xray/disconnect", r.URL.Path)
+		var body map[string]string
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.Equal(t, map[string]string{"userId": "user-1", "deviceId": ""}, body)
+
+		w.Write([]byte(`{"success": true, "disconnected": [{"nodeId": "node-1", "userId": "user-1", "lastSeen": "0", "uplink": "0", "downlink": "0"}], "failedNodes": []}`))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, func() (string, error) { return "service-token", nil })
+	result, err := client.DisconnectXrayUser(context.Background(), "", "user-1", "")
+	require.NoError(t, err)
+	require.Len(t, result.Connections, 1)
+	assert.Equal(t, "node-1", result.Connections[0].NodeID)
+	assert.True(t, result.Connections[0].LastSeen.IsZero())
+	assert.Empty(t, result.FailedNodes)
+}
+
+func TestReportExperimentSamples(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/obfuscation-experiments/samples", r.URL.Path)
+		var body struct {
+			Samples []map[string]interface{} `json:"samples"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		require.Len(t, body.Samples, 2)
+		assert.Equal(t, "node-1", body.Samples[0]["nodeId"])
+		assert.Equal(t, "1700000000", body.Samples[0]["timestamp"])
+		assert.Equal(t, "timeout", body.Samples[1]["failureReason"])
+
+		w.Write([]byte(`{"success": true, "message": "1 of 2 sample(s) accepted", "accepted": 1}`))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, func() (string, error) { return "service-token", nil })
+	accepted, err := client.ReportExperimentSamples(context.Background(), []ExperimentSample{
+		{NodeID: "node-1", Success: true, HandshakeMs: 180, Timestamp: 1700000000},
+		{NodeID: "node-2", FailureReason: "timeout", Timestamp: 1700000000},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, accepted)
+}
+
+func TestGetWARPStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodGet, r.Method)
+		assert.Equal(t, "/nodes/node-1/warp", r.URL.Path)
+		w.Write([]byte(`{"status": {
+			"installed": true,
+			"connected": true,
+			"mode": "proxy",
+			"proxyPort": 40000,
+			"ipAddress": "104.28.212.7",
+			"lastConnected": "1700000000",
+			"uptime": "3600",
+			"bytesSent": "1024",
+			"bytesReceived": "2048",
+			"health": "healthy",
+			"clientType": "docker",
+			"devicePosture": {}
+		}}`))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, func() (string, error) { return "service-token", nil })
+	status, err := client.GetWARPStatus(context.Background(), "node-1")
+	require.NoError(t, err)
+	assert.True(t, status.Connected)
+	assert.Equal(t, 40000, status.ProxyPort)
+	assert.Equal(t, "104.28.212.7", status.IPAddress)
+	assert.Equal(t, int64(1700000000), status.LastConnected)
+	assert.Equal(t, int64(3600), status.Uptime)
+	assert.Equal(t, int64(2048), status.BytesReceived)
+	assert.Equal(t, "docker", status.ClientType)
+}
+
+func TestWARPActions(t *testing.T) {
+	var calls []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, r.Method+" "+r.URL.Path)
+		switch r.URL.Path {
+		case "/nodes/node-1/warp/proxy":
+			if r.Method == http.MethodPost {
+				var body map[string]int
+				require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+				assert.Equal(t, map[string]int{"port": 40000}, body)
+			}
+		case "/nodes/node-1/warp/connect":
+			w.Write([]byte(`{"success": false, "message": "WARP is not installed"}`))
+			return
+		}
+		w.Write([]byte(`{"success": true, "message": "done"}`))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, func() (string, error) { return "service-token", nil })
+	message, err := client.EnableWARPProxy(context.Background(), "node-1", 40000)
+	require.NoError(t, err)
+	assert.Equal(t, "done", message)
+	_, err = client.DisableWARPProxy(context.Background(), "node-1")
+	require.NoError(t, err)
+
+	_, err = client.ConnectWARP(context.Background(), "node-1")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "WARP is not installed")
+
+	assert.Equal(t, []string{
+		"POST /nodes/node-1/warp/proxy",
+		"DELETE /nodes/node-1/warp/proxy",
+		"POST /nodes/node-1/warp/connect",
+	}, calls)
+}
+
+func TestSetNodeObfuscation(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPut, r.Method)
+		assert.Equal(t, "/nodes/node-1/obfuscation", r.URL.Path)
+
+		var body map[string]interface{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.NotContains(t, body, "preset")
+		settings := body["settings"].(map[string]interface{})
+		assert.Equal(t, true, settings["salamander"])
+		assert.Equal(t, "secret", settings["salamanderPassword"])
+
+		w.Write([]byte(`{
+			"success": true,
+			"message": "Custom obfuscation settings applied",
+			"settings": {"salamander": true, "salamanderPassword": "secret", "hopInterval": 30}
+		}`))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, func() (string, error) { return "service-token", nil })
+	result, err := client.SetNodeObfuscation(context.Background(), "node-1", "", &ObfuscationSettings{
+		Salamander:         true,
+		SalamanderPassword: "secret",
+	})
+	require.NoError(t, err)
+	assert.Empty(t, result.Preset)
+	require.NotNil(t, result.Settings)
+	assert.True(t, result.Settings.Salamander)
+	assert.Equal(t, 30, result.Settings.HopInterval)
+}
+
+func TestSNIDomainsAndCertificates(t *testing.T) {
+	var calls []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, r.Method+" "+r.URL.Path)
+		switch r.URL.Path {
+		case "/nodes/node-1/sni/domains/old.example.com":
+			w.Write([]byte(`{"success": true, "domains": ["cdn.example.com"], "primaryDomain": "cdn.example.com"}`))
+		case "/nodes/node-1/acme":
+			w.Write([]byte(`{
+				"success": true,
+				"mode": {"mode": "acme", "ca": "letsencrypt"},
+				"certificates": [{"domain": "cdn.example.com", "notAfter": "1767225600", "daysLeft": 40}],
+				"pending": ["new.example.com"]
+			}`))
+		case "/nodes/node-1/certificates/renew":
+			w.Write([]byte(`{"success": false, "message": "no certificates to renew"}`))
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, func() (string, error) { return "service-token", nil })
+	domains, err := client.RemoveSNIDomain(context.Background(), "node-1", "old.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"cdn.example.com"}, domains.Domains)
+	assert.Equal(t, "cdn.example.com", domains.PrimaryDomain)
+
+	status, err := client.GetCertificateStatus(context.Background(), "node-1")
+	require.NoError(t, err)
+	require.NotNil(t, status.Mode)
+	assert.Equal(t, "acme", status.Mode.Mode)
+	require.Len(t, status.Certificates, 1)
+	assert.Equal(t, int64(1767225600), status.Certificates[0].NotAfter)
+	assert.Equal(t, []string{"new.example.com"}, status.Pending)
+
+	_, err = client.RenewCertificates(context.Background(), "node-1")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no certificates to renew")
+
+	assert.Equal(t, []string{
+		"DELETE /nodes/node-1/sni/domains/old.example.com",
+		"GET /nodes/node-1/acme",
+		"POST /nodes/node-1/certificates/renew",
+	}, calls)
+}
+
+func TestListCertificates(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/certificates", r.URL.Path)
+		assert.Equal(t, "30", r.URL.Query().Get("expiringWithinDays"))
+		assert.Equal(t, "true", r.URL.Query().Get("selfSigned"))
+		assert.Empty(t, r.URL.Query().Get("nodeId"))
+
+		w.Write([]byte(`{
+			"success": true,
+			"certificates": [{
+				"domain": "cdn.example.com",
+				"issuer": "cdn.example.com",
+				"notAfter": "1767225600",
+				"selfSigned": true,
+				"source": "files",
+				"nodeId": "node-1",
+				"nodeName": "de-fra-1",
+				"daysLeft": 12,
+				"syncedAt": "1766000000"
+			}]
+		}`))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, func() (string, error) { return "service-token", nil })
+	certificates, err := client.ListCertificates(context.Background(), CertificateFilter{ExpiringWithinDays: 30, SelfSigned: true})
+	require.NoError(t, err)
+	require.Len(t, certificates, 1)
+	assert.Equal(t, "de-fra-1", certificates[0].NodeName)
+	assert.True(t, certificates[0].SelfSigned)
+	assert.Equal(t, int64(1767225600), certificates[0].NotAfter)
+	assert.Equal(t, 12, certificates[0].DaysLeft)
+}
+
+func TestBulkRenewCertificates(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/certificates/renew", r.URL.Path)
+
+		var body map[string]interface{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.Equal(t, map[string]interface{}{"expiringWithinDays": float64(30)}, body)
+
+		w.Write([]byte(`{
+			"success": false,
+			"message": "Certificates renewed on 1 node(s), 1 node(s) could not be updated",
+			"renewed": ["node-1"],
+			"failures": {"node-2": "node is offline"}
+		}`))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, func() (string, error) { return "service-token", nil })
+	result, err := client.BulkRenewCertificates(context.Background(), nil, CertificateFilter{ExpiringWithinDays: 30})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"node-1"}, result.Renewed)
+	assert.Equal(t, map[string]string{"node-2": "node is offline"}, result.Failures)
+}
+
+func TestUploadCertificate(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/certificates/uploads", r.URL.Path)
+
+		var body map[string]interface{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.Equal(t, map[string]interface{}{
+			"domain":         "*.corp.example",
+			"certificatePem": "chain",
+			"privateKeyPem":  "key",
+			"caBundlePem":    "roots",
+		}, body)
+
+		w.Write([]byte(`{
+			"success": false,
+			"message": "Certificate for *.corp.example installed on 1 node(s), 1 node(s) could not be updated",
+			"certificate": {
+				"domain": "*.corp.example",
+				"issuer": "Corp Issuing CA",
+				"fingerprint": "ab12",
+				"notBefore": "1767225600",
+				"notAfter": "1798761600",
+				"customCa": true,
+				"nodeIds": ["node-1", "node-2"],
+				"uploadedAt": "1790000000"
+			},
+			"installed": ["node-1"],
+			"failures": {"node-2": "node is offline"}
+		}`))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, func() (string, error) { return "service-token", nil })
+	result, err := client.UploadCertificate(context.Background(), CertificateUpload{
+		Domain:         "*.corp.example",
+		CertificatePEM: "chain",
+		PrivateKeyPEM:  "key",
+		CABundlePEM:    "roots",
+	})
+	require.NoError(t, err)
+	require.NotNil(t, result.Certificate)
+	assert.Equal(t, int64(1798761600), result.Certificate.NotAfter)
+	assert.True(t, result.Certificate.CustomCA)
+	assert.Equal(t, []string{"node-1", "node-2"}, result.Certificate.NodeIDs)
+	assert.Equal(t, []string{"node-1"}, result.Installed)
+	assert.Equal(t, map[string]string{"node-2": "node is offline"}, result.Failures)
+}
+
+func TestDeleteUploadedCertificate(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodDelete, r.Method)
+		assert.Equal(t, "/certificates/uploads/%2A.corp.example", r.URL.EscapedPath())
+		w.Write([]byte(`{"success": true, "message": "Uploaded certificate for *.corp.example deleted"}`))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, func() (string, error) { return "service-token", nil })
+	message, err := client.DeleteUploadedCertificate(context.Background(), "*.corp.example")
+	require.NoError(t, err)
+	assert.Equal(t, "Uploaded certificate for *.corp.example deleted", message)
+}
+
+func TestRunTLSCheck(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/nodes/node-1/tls-check", r.URL.Path)
+
+		w.Write([]byte(`{
+			"success": true,
+			"message": "TLS checks finished with grade F",
+			"report": {
+				"id": "report-1",
+				"nodeId": "node-1",
+				"proberNodeId": "node-2",
+				"target": "203.0.113.10",
+				"grade": "F",
+				"score": 50,
+				"startedAt": "1767225600",
+				"finishedAt": "1767225602",
+				"checks": [
+					{"name": "tls_chain", "target": "203.0.113.10:443 cdn.example.com", "status": "fail",
+					 "detail": "self-signed certificate", "hint": "Issue a Let's Encrypt certificate", "durationMs": "41"},
+					{"name": "tls_versions", "target": "203.0.113.10:443", "status": "pass", "durationMs": "120"}
+				]
+			}
+		}`))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, func() (string, error) { return "service-token", nil })
+	report, err := client.RunTLSCheck(context.Background(), "node-1")
+	require.NoError(t, err)
+	assert.Equal(t, "F", report.Grade)
+	assert.Equal(t, int64(1767225602), report.FinishedAt)
+	require.Len(t, report.Checks, 2)
+	assert.Equal(t, "Issue a Let's Encrypt certificate", report.Checks[0].Hint)
+	assert.Equal(t, int64(120), report.Checks[1].DurationMs)
+}
+
+func TestListTLSReportsOfEveryNode(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodGet, r.Method)
+		assert.Equal(t, "/tls-reports", r.URL.Path)
+		w.Write([]byte(`{"success": true, "reports": [{"nodeId": "node-1", "grade": "C"}, {"nodeId": "node-2", "grade": "A"}]}`))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, func() (string, error) { return "service-token", nil })
+	reports, err := client.ListTLSReports(context.Background(), "")
+	require.NoError(t, err)
+	require.Len(t, reports, 2)
+	assert.Equal(t, "C", reports[0].Grade)
+}
+
+func TestCheckDriftWithHeal(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/nodes/node-1/drift-check", r.URL.Path)
+		var body map[string]bool
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.True(t, body["heal"])
+
+		w.Write([]byte(`{
+			"success": true,
+			"message": "Node edge-1 drifted from its desired state: 1 item(s)",
+			"report": {
+				"nodeId": "node-1",
+				"nodeName": "edge-1",
+				"policy": "report",
+				"items": [{"kind": "routing", "target": "masquerade eth0", "expected": "installed", "actual": "missing"}],
+				"healed": ["restore /etc/hysteria/config.yaml", "restart hysteria2"],
+				"healFailed": ["reinstall routing: iptables: No chain/target/match by that name"],
+				"checkedAt": "1767225600",
+				"healedAt": "1767225600"
+			}
+		}`))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, func() (string, error) { return "service-token", nil })
+	report, err := client.CheckDrift(context.Background(), "node-1", true)
+	require.NoError(t, err)
+	require.Len(t, report.Items, 1)
+	assert.Equal(t, "routing", report.Items[0].Kind)
+	assert.Len(t, report.Healed, 2)
+	assert.Equal(t, int64(1767225600), report.HealedAt)
+}
+
+func TestListDriftedNodes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/drift", r.URL.Path)
+		assert.Equal(t, "true", r.URL.Query().Get("driftedOnly"))
+		w.Write([]byte(`{"success": true, "reports": [{"nodeId": "node-1", "policy": "heal", "items": [{"kind": "service", "target": "xray"}], "checkedAt": "1767225600"}]}`))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, func() (string, error) { return "service-token", nil })
+	reports, err := client.ListDrift(context.Background(), true)
+	require.NoError(t, err)
+	require.Len(t, reports, 1)
+	assert.Equal(t, "heal", reports[0].Policy)
+	assert.Zero(t, reports[0].HealedAt)
+}
+
+func TestAddPortForward(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/nodes/node-1/port-forwards", r.URL.Path)
+		var body PortForward
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.Equal(t, "udp", body.Protocol)
+		assert.Equal(t, 41000, body.ListenPort)
+
+		w.Write([]byte(`{
+			"success": true,
+			"message": "Port forward added successfully",
+			"forward": {"id": "fwd-1", "owner": "user-1", "protocol": "udp", "listenPort": 41000, "targetHost": "203.0.113.7", "targetPort": 27015, "createdAt": "1767225600"}
+		}`))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, func() (string, error) { return "service-token", nil })
+	forward, err := client.AddPortForward(context.Background(), "node-1", PortForward{
+		ID: "fwd-1", Owner: "user-1", Protocol: "udp", ListenPort: 41000, TargetHost: "203.0.113.7", TargetPort: 27015,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "fwd-1", forward.ID)
+	assert.Equal(t, 27015, forward.TargetPort)
+	assert.Equal(t, int64(1767225600), forward.CreatedAt)
+}
+
+func TestAddPortForwardConflict(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"error":"failed to add port forward: port is in use: udp port 41000 is used by hysteria2","code":"PORT_IN_USE"}`))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, func() (string, error) { return "service-token", nil })
+	_, err := client.AddPortForward(context.Background(), "node-1", PortForward{Protocol: "udp", ListenPort: 41000})
+
+	var orchestratorErr *Error
+	require.True(t, errors.As(err, &orchestratorErr))
+	assert.Equal(t, "PORT_IN_USE", orchestratorErr.Code)
+}
+
+func TestClientErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"error":"Insufficient permissions","code":"INSUFFICIENT_PERMISSIONS"}`))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, func() (string, error) { return "service-token", nil })
+	_, err := client.GetXrayConnections(context.Background(), "")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "403")
+}
+
+func TestClientErrorCode(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"error":"failed to connect to node","code":"NODE_UNREACHABLE","details":{"node_id":"node-1"}}`))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, func() (string, error) { return "service-token", nil })
+	_, err := client.DisconnectXrayUser(context.Background(), "node-1", "user-1", "")
+	require.Error(t, err)
+
+	var orchestratorErr *Error
+	require.True(t, errors.As(err, &orchestratorErr))
+	assert.Equal(t, http.StatusServiceUnavailable, orchestratorErr.StatusCode)
+	assert.Equal(t, "NODE_UNREACHABLE", orchestratorErr.Code)
+	assert.Equal(t, "failed to connect to node", orchestratorErr.Message)
+	assert.Equal(t, map[string]string{"node_id": "node-1"}, orchestratorErr.Details)
+}
+
+func TestClientErrorPlainBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("Bad Gateway\n"))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, func() (string, error) { return "service-token", nil })
+	_, err := client.GetXrayConnections(context.Background(), "")
+
+	var orchestratorErr *Error
+	require.True(t, errors.As(err, &orchestratorErr))
+	assert.Empty(t, orchestratorErr.Code)
+	assert.Equal(t, "Bad Gateway", orchestratorErr.Message)
+}
@@ -0,0 +1,53 @@
+package pdf
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBytesXrefPointsAtObjects(t *testing.T) {
+	doc := New("Report")
+	for i := 0; i < linesPerPage*2+1; i++ {
+		doc.Line("line %d", i)
+	}
+	data := doc.Bytes()
+
+	require.True(t, bytes.HasPrefix(data, []byte("%PDF-1.4\n")))
+	require.True(t, bytes.HasSuffix(data, []byte("%%EOF\n")))
+	assert.Contains(t, string(data), "/Count 3")
+
+	startxref := regexp.MustCompile(`startxref\n(\d+)\n`).FindSubmatch(data)
+	require.NotNil(t, startxref)
+	xref, err := strconv.Atoi(string(startxref[1]))
+	require.NoError(t, err)
+	require.True(t, bytes.HasPrefix(data[xref:], []byte("xref\n")))
+
+	// 4 shared objects and 2 per page
+	entries := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllSubmatch(data[xref:], -1)
+	require.Len(t, entries, 4+2*3)
+	for i, entry := range entries {
+		offset, err := strconv.Atoi(string(entry[1]))
+		require.NoError(t, err)
+		assert.True(t, bytes.HasPrefix(data[offset:], []byte(strconv.Itoa(i+1)+" 0 obj\n")), "object %d", i+1)
+	}
+}
+
+func TestBytesEmptyDocumentHasAPage(t *testing.T) {
+	assert.Contains(t, string(New("Empty").Bytes()), "/Count 1")
+}
+
+func TestEscape(t *testing.T) {
+	assert.Equal(t, `a\(b\)\\c`, escape(`a(b)\c`))
+	assert.Equal(t, "caf? ??", escape("café ✓\t"))
+}
+
+func TestContentCutsLongLines(t *testing.T) {
+	long := string(bytes.Repeat([]byte("x"), LineWidth+10))
+	assert.Contains(t, content([]string{long}), "("+long[:LineWidth]+") '")
+	assert.NotContains(t, content([]string{long}), long[:LineWidth+1])
+}
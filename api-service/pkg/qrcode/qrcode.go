@@ -0,0 +1,67 @@
+package qrcode
+
+import (
+	"fmt"
+	"strings"
+
+	goqrcode "github.com/skip2/go-qrcode"
+)
+
+const (
+	FormatPNG = "png"
+	FormatSVG = "svg"
+
+	MinSize = 128
+	MaxSize = 1024
+)
+
+// Encode renders content as a QR code image of roughly size pixels and returns it
+// with its content type. Medium error correction keeps long share links scannable.
+func Encode(content, format string, size int) ([]byte, string, error) {
+	if size < MinSize || size > MaxSize {
+		return nil, "", fmt.Errorf("size must be between %d and %d", MinSize, MaxSize)
+	}
+
+	switch format {
+	case FormatPNG:
+		png, err := goqrcode.Encode(content, goqrcode.Medium, size)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to encode QR code: %w", err)
+		}
+		return png, "image/png", nil
+	case FormatSVG:
+		svg, err := encodeSVG(content, size)
+		if err != nil {
+			return nil, "", err
+		}
+		return svg, "image/svg+xml", nil
+	default:
+		return nil, "", fmt.Errorf("unsupported format: %s", format)
+	}
+}
+
+// encodeSVG draws each dark module as a unit square in a single path, scaled by the viewBox
+func encodeSVG(content string, size int) ([]byte, error) {
+	code, err := goqrcode.New(content, goqrcode.Medium)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode QR code: %w", err)
+	}
+	bitmap := code.Bitmap()
+
+	var path strings.Builder
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&path, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		size, size, len(bitmap), len(bitmap))
+	b.WriteString(`<rect width="100%" height="100%" fill="#fff"/>`)
+	fmt.Fprintf(&b, `<path fill="#000" d="%s"/>`, path.String())
+	b.WriteString(`</svg>`)
+	return []byte(b.String()), nil
+}
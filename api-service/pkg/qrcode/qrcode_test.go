@@ -0,0 +1,79 @@
+package qrcode
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+
+	goqrcode "github.com/skip2/go-qrcode"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testLink = "hysteria2://secret@node.example.com:443,20000-50000/?obfs=salamander&obfs-password=pw&sni=node.example.com#fra-1"
+
+func TestEncodePNG(t *testing.T) {
+	data, contentType, err := Encode(testLink, FormatPNG, 256)
+	require.NoError(t, err)
+	assert.Equal(t, "image/png", contentType)
+
+	img, err := png.Decode(bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Equal(t, 256, img.Bounds().Dx())
+	assert.Equal(t, 256, img.Bounds().Dy())
+
+	// The quiet zone is white so scanners find the code
+	assert.Equal(t, color.White, color.Gray16Model.Convert(img.At(0, 0)))
+}
+
+func TestEncodeSVG(t *testing.T) {
+	data, contentType, err := Encode(testLink, FormatSVG, 512)
+	require.NoError(t, err)
+	assert.Equal(t, "image/svg+xml", contentType)
+
+	var svg struct {
+		XMLName xml.Name `xml:"svg"`
+		Width   string   `xml:"width,attr"`
+		ViewBox string   `xml:"viewBox,attr"`
+		Path    struct {
+			D string `xml:"d,attr"`
+		} `xml:"path"`
+	}
+	require.NoError(t, xml.Unmarshal(data, &svg))
+	assert.Equal(t, "512", svg.Width)
+
+	// The path draws exactly the dark modules of the code for the link
+	code, err := goqrcode.New(testLink, goqrcode.Medium)
+	require.NoError(t, err)
+	bitmap := code.Bitmap()
+	assert.Equal(t, fmt.Sprintf("0 0 %d %d", len(bitmap), len(bitmap)), svg.ViewBox)
+
+	drawn := map[[2]int]bool{}
+	for _, square := range strings.Split(strings.TrimSuffix(svg.Path.D, "z"), "z") {
+		var x, y int
+		_, err := fmt.Sscanf(square, "M%d %dh1v1h-1", &x, &y)
+		require.NoError(t, err, "path segment %q", square)
+		drawn[[2]int{x, y}] = true
+	}
+	for y, row := range bitmap {
+		for x, dark := range row {
+			assert.Equal(t, dark, drawn[[2]int{x, y}], "module %d,%d", x, y)
+		}
+	}
+}
+
+func TestEncodeRejectsInvalidRequests(t *testing.T) {
+	_, _, err := Encode(testLink, FormatPNG, MinSize-1)
+	assert.Error(t, err)
+	_, _, err = Encode(testLink, FormatSVG, MaxSize+1)
+	assert.Error(t, err)
+	_, _, err = Encode(testLink, "gif", 256)
+	assert.Error(t, err)
+	// Beyond the capacity of the largest QR version
+	_, _, err = Encode(strings.Repeat("x", 3000), FormatPNG, 256)
+	assert.Error(t, err)
+}
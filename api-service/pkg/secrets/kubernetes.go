@@ -0,0 +1,137 @@
+package secrets
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ServiceAccountDir is where the kubelet mounts the pod's service account
+const ServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// KubernetesProvider reads keys of Kubernetes Secrets and ConfigMaps through the API server
+// with the pod's service account, which needs get on them. A name is
+// "[<namespace>/]secret/<name>#<key>" or "[<namespace>/]configmap/<name>#<key>"; the
+// namespace defaults to the pod's.
+type KubernetesProvider struct {
+	baseURL   string
+	tokenFile string
+	namespace string
+	client    *http.Client
+}
+
+// NewKubernetesProvider creates a provider for the API server at baseURL
+func NewKubernetesProvider(baseURL, tokenFile, namespace string, client *http.Client) *KubernetesProvider {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &KubernetesProvider{
+		baseURL:   strings.TrimRight(baseURL, "/"),
+		tokenFile: tokenFile,
+		namespace: namespace,
+		client:    client,
+	}
+}
+
+// NewInClusterProvider creates a provider from the environment and service account of the pod
+func NewInClusterProvider(host, port string) (*KubernetesProvider, error) {
+	ca, err := os.ReadFile(filepath.Join(ServiceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("invalid service account CA")
+	}
+	namespace := "default"
+	if data, err := os.ReadFile(filepath.Join(ServiceAccountDir, "namespace")); err == nil && len(data) > 0 {
+		namespace = strings.TrimSpace(string(data))
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	return NewKubernetesProvider("https://"+net.JoinHostPort(host, port), filepath.Join(ServiceAccountDir, "token"), namespace,
+		&http.Client{Timeout: 10 * time.Second, Transport: transport}), nil
+}
+
+// Get reads one key of a Secret or ConfigMap
+func (p *KubernetesProvider) Get(ctx context.Context, name string) (string, error) {
+	ref, key, _ := strings.Cut(name, "#")
+	parts := strings.Split(strings.Trim(ref, "/"), "/")
+	namespace := p.namespace
+	if len(parts) == 3 {
+		namespace, parts = parts[0], parts[1:]
+	}
+	if len(parts) != 2 || key == "" {
+		return "", fmt.Errorf("invalid kubernetes secret reference %q: want [namespace/]secret/name#key", name)
+	}
+	kind, object := parts[0], parts[1]
+	var resource string
+	switch kind {
+	case "secret":
+		resource = "secrets"
+	case "configmap":
+		resource = "configmaps"
+	default:
+		return "", fmt.Errorf("invalid kubernetes secret reference %q: kind must be secret or configmap", name)
+	}
+
+	endpoint := fmt.Sprintf("%s/api/v1/namespaces/%s/%s/%s", p.baseURL, url.PathEscape(namespace), resource, url.PathEscape(object))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/json")
+	// The kubelet rotates the token, so read it for every request
+	if p.tokenFile != "" {
+		token, err := os.ReadFile(p.tokenFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read service account token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("kubernetes request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("kubernetes returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var data struct {
+		Data map[string]string `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return "", fmt.Errorf("invalid kubernetes response: %w", err)
+	}
+	value, ok := data.Data[key]
+	if !ok {
+		return "", fmt.Errorf("kubernetes %s %s/%s has no key %s", kind, namespace, object, key)
+	}
+	// Secret data is base64 encoded, ConfigMap data is not
+	if kind == "secret" {
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return "", fmt.Errorf("invalid kubernetes secret %s/%s: %w", namespace, object, err)
+		}
+		value = string(decoded)
+	}
+	if value = strings.TrimRight(value, "\r\n"); value == "" {
+		return "", fmt.Errorf("kubernetes %s %s/%s key %s is empty", kind, namespace, object, key)
+	}
+	return value, nil
+}
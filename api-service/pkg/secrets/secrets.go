@@ -0,0 +1,224 @@
+// Package secrets resolves configuration values that reference a secret store instead of
+// holding the secret itself. A reference is "<provider>:<name>":
+//
+//	env:JWT_SECRET_V2                 another environment variable
+//	file:/run/secrets/db_password     a file, e.g. a Docker or Kubernetes secret
+//	vault:hysteryvpn/api#jwt_secret   a field of a HashiCorp Vault KV v2 secret
+//	kms:AQICAHh...                    an AWS KMS ciphertext blob, decrypted on load
+//	k8s:secret/hysteryvpn#jwt_secret  a key of a Kubernetes Secret or ConfigMap, read via the API
+//
+// Values with any other prefix are used as they are. Resolved secrets can be refreshed
+// periodically; rotation hooks run when a refreshed value differs from the previous one.
+package secrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"hysteria2_microservices/pkg/secretstore"
+)
+
+// Provider reads secrets from one store
+type Provider interface {
+	Get(ctx context.Context, name string) (string, error)
+}
+
+// Manager resolves references through its providers
+type Manager struct {
+	providers map[string]Provider
+}
+
+// NewManager creates a manager over providers keyed by reference prefix
+func NewManager(providers map[string]Provider) *Manager {
+	return &Manager{providers: providers}
+}
+
+// NewManagerFromEnv configures the env and file providers, Vault when VAULT_ADDR is set,
+// AWS KMS when AWS_REGION is set and Kubernetes when running in a cluster
+func NewManagerFromEnv() *Manager {
+	providers := map[string]Provider{
+		"env":  EnvProvider{},
+		"file": FileProvider{},
+	}
+	if addr := os.Getenv("VAULT_ADDR"); addr != "" {
+		providers["vault"] = secretstore.NewVaultProvider(addr, os.Getenv("VAULT_TOKEN"), os.Getenv("VAULT_NAMESPACE"), os.Getenv("VAULT_KV_MOUNT"))
+	}
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		providers["kms"] = secretstore.NewKMSProvider(region, os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN"))
+	}
+	if host := os.Getenv("KUBERNETES_SERVICE_HOST"); host != "" {
+		// Without a mounted service account only mounted secrets, through file:, are readable
+		if provider, err := NewInClusterProvider(host, os.Getenv("KUBERNETES_SERVICE_PORT")); err == nil {
+			providers["k8s"] = provider
+		}
+	}
+	return NewManager(providers)
+}
+
+// IsReference reports whether value names a secret in one of the configured stores
+func (m *Manager) IsReference(value string) bool {
+	_, _, ok := m.provider(value)
+	return ok
+}
+
+// Resolve returns the secret value refers to, or value itself when it is not a reference
+func (m *Manager) Resolve(ctx context.Context, value string) (string, error) {
+	provider, name, ok := m.provider(value)
+	if !ok {
+		return value, nil
+	}
+	secret, err := provider.Get(ctx, name)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve secret %s: %w", redact(value), err)
+	}
+	return secret, nil
+}
+
+// Load resolves value into a Secret that Refresh keeps current
+func (m *Manager) Load(ctx context.Context, value string) (*Secret, error) {
+	resolved, err := m.Resolve(ctx, value)
+	if err != nil {
+		return nil, err
+	}
+	secret := &Secret{ref: value}
+	secret.value = resolved
+	return secret, nil
+}
+
+// Refresh resolves the referenced secrets again and runs the rotation hooks of those that
+// changed. Literal values never change.
+func (m *Manager) Refresh(ctx context.Context, secrets ...*Secret) error {
+	var errs []error
+	for _, secret := range secrets {
+		if secret == nil || !m.IsReference(secret.ref) {
+			continue
+		}
+		value, err := m.Resolve(ctx, secret.ref)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		secret.set(value)
+	}
+	return errors.Join(errs...)
+}
+
+// StartRotation refreshes secrets every interval until ctx is done. Refresh errors are
+// passed to onError and the previous values stay in use.
+func (m *Manager) StartRotation(ctx context.Context, interval time.Duration, onError func(error), secrets ...*Secret) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := m.Refresh(ctx, secrets...); err != nil && onError != nil {
+					onError(err)
+				}
+			}
+		}
+	}()
+}
+
+func (m *Manager) provider(value string) (Provider, string, bool) {
+	prefix, name, ok := strings.Cut(value, ":")
+	if !ok || name == "" {
+		return nil, "", false
+	}
+	provider, ok := m.providers[prefix]
+	return provider, name, ok
+}
+
+// Secret is a resolved value that rotation may replace
+type Secret struct {
+	ref string
+
+	mu    sync.RWMutex
+	value string
+	hooks []func(string)
+}
+
+// Value returns the current secret
+func (s *Secret) Value() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.value
+}
+
+// Ref returns the configured value, with the secret redacted when it is not a reference
+func (s *Secret) Ref() string {
+	return redact(s.ref)
+}
+
+// OnRotate registers a hook called with the new value after each rotation
+func (s *Secret) OnRotate(hook func(value string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hooks = append(s.hooks, hook)
+}
+
+func (s *Secret) set(value string) {
+	s.mu.Lock()
+	if value == s.value {
+		s.mu.Unlock()
+		return
+	}
+	s.value = value
+	hooks := append([]func(string){}, s.hooks...)
+	s.mu.Unlock()
+
+	for _, hook := range hooks {
+		hook(value)
+	}
+}
+
+// redact keeps the provider and name of a reference for error messages; KMS ciphertexts
+// are shortened since they can be kilobytes long
+func redact(value string) string {
+	prefix, name, ok := strings.Cut(value, ":")
+	if !ok {
+		return "(literal)"
+	}
+	if prefix == "kms" && len(name) > 16 {
+		name = name[:16] + "..."
+	}
+	return prefix + ":" + name
+}
+
+// EnvProvider reads environment variables
+type EnvProvider struct{}
+
+// Get returns the variable name, failing when it is unset or empty
+func (EnvProvider) Get(ctx context.Context, name string) (string, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return value, nil
+}
+
+// FileProvider reads secrets from files such as Docker and Kubernetes secret mounts
+type FileProvider struct{}
+
+// Get returns the file contents without the trailing newline
+func (FileProvider) Get(ctx context.Context, name string) (string, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	value := strings.TrimRight(string(data), "\r\n")
+	if value == "" {
+		return "", fmt.Errorf("%s is empty", name)
+	}
+	return value, nil
+}
@@ -0,0 +1,228 @@
+// Package sharelink encodes node and user settings as the share links understood by
+// mobile and desktop clients (Hysteria2, v2rayN/v2rayNG, NekoBox, Shadowrocket, sing-box).
+package sharelink
+
+import (
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	SchemeHysteria2 = "hysteria2"
+	SchemeVLESS     = "vless"
+	SchemeTrojan    = "trojan"
+
+	ObfsSalamander = "salamander"
+
+	SecurityNone    = "none"
+	SecurityTLS     = "tls"
+	SecurityReality = "reality"
+)
+
+// Hysteria2 describes a hysteria2:// link
+type Hysteria2 struct {
+	Name string
+	Auth string
+	Host string
+	// Ports is the port part of the server address: a single port, or a comma-separated
+	// list of ports and ranges for port hopping, e.g. "443,20000-50000"
+	Ports        string
+	SNI          string
+	Insecure     bool
+	PinSHA256    string
+	ObfsType     string
+	ObfsPassword string
+}
+
+// String encodes h as hysteria2://auth@host:ports/?params#name
+func (h Hysteria2) String() string {
+	ports := h.Ports
+	if ports == "" {
+		ports = "443"
+	}
+
+	query := url.Values{}
+	if h.SNI != "" {
+		query.Set("sni", h.SNI)
+	}
+	if h.Insecure {
+		query.Set("insecure", "1")
+	}
+	if h.PinSHA256 != "" {
+		query.Set("pinSHA256", h.PinSHA256)
+	}
+	if h.ObfsType != "" {
+		query.Set("obfs", h.ObfsType)
+		if h.ObfsType == ObfsSalamander {
+			query.Set("obfs-password", h.ObfsPassword)
+		}
+	}
+
+	u := url.URL{
+		Scheme:   SchemeHysteria2,
+		Host:     joinHostPorts(h.Host, ports),
+		Path:     "/",
+		RawQuery: query.Encode(),
+		Fragment: h.Name,
+	}
+	if h.Auth != "" {
+		u.User = url.User(h.Auth)
+	}
+	return u.String()
+}
+
+// VLESS describes a vless:// link in the format shared by Xray-based clients
+type VLESS struct {
+	Name        string
+	ID          string
+	Host        string
+	Port        int
+	Flow        string
+	Network     string
+	Security    string
+	SNI         string
+	ALPN        []string
+	Fingerprint string
+	PublicKey   string
+	ShortID     string
+	SpiderX     string
+	// Path and HostHeader apply to ws and httpupgrade, ServiceName to grpc
+	Path        string
+	HostHeader  string
+	ServiceName string
+}
+
+// String encodes v as vless://uuid@host:port?params#name
+func (v VLESS) String() string {
+	query := url.Values{}
+	query.Set("encryption", "none")
+	query.Set("type", orDefault(v.Network, "tcp"))
+	query.Set("security", orDefault(v.Security, SecurityNone))
+	if v.Flow != "" {
+		query.Set("flow", v.Flow)
+	}
+	setTransport(query, v.Path, v.HostHeader, v.ServiceName)
+
+	switch v.Security {
+	case SecurityTLS:
+		setTLS(query, v.SNI, v.ALPN, v.Fingerprint)
+	case SecurityReality:
+		setTLS(query, v.SNI, nil, v.Fingerprint)
+		query.Set("pbk", v.PublicKey)
+		if v.ShortID != "" {
+			query.Set("sid", v.ShortID)
+		}
+		if v.SpiderX != "" {
+			query.Set("spx", v.SpiderX)
+		}
+	}
+
+	u := url.URL{
+		Scheme:   SchemeVLESS,
+		User:     url.User(v.ID),
+		Host:     net.JoinHostPort(v.Host, strconv.Itoa(v.Port)),
+		RawQuery: query.Encode(),
+		Fragment: v.Name,
+	}
+	return u.String()
+}
+
+// Trojan describes a trojan:// link; trojan always runs over TLS
+type Trojan struct {
+	Name        string
+	Password    string
+	Host        string
+	Port        int
+	Network     string
+	SNI         string
+	ALPN        []string
+	Fingerprint string
+	Insecure    bool
+	Path        string
+	HostHeader  string
+	ServiceName string
+}
+
+// String encodes t as trojan://password@host:port?params#name
+func (t Trojan) String() string {
+	query := url.Values{}
+	query.Set("type", orDefault(t.Network, "tcp"))
+	query.Set("security", SecurityTLS)
+	setTransport(query, t.Path, t.HostHeader, t.ServiceName)
+	setTLS(query, t.SNI, t.ALPN, t.Fingerprint)
+	if t.Insecure {
+		query.Set("allowInsecure", "1")
+	}
+
+	u := url.URL{
+		Scheme:   SchemeTrojan,
+		User:     url.User(t.Password),
+		Host:     net.JoinHostPort(t.Host, strconv.Itoa(t.Port)),
+		RawQuery: query.Encode(),
+		Fragment: t.Name,
+	}
+	return u.String()
+}
+
+// SplitServer splits a Hysteria2 server address such as "example.com:443,20000-50000"
+// into its host and port part. A missing port part returns "443".
+func SplitServer(server string) (string, string) {
+	if strings.HasPrefix(server, "[") {
+		if end := strings.Index(server, "]"); end > 0 {
+			if rest := server[end+1:]; strings.HasPrefix(rest, ":") && len(rest) > 1 {
+				return server[1:end], rest[1:]
+			}
+			return server[1:end], "443"
+		}
+	}
+	// More than one colon without brackets is a bare IPv6 address
+	if strings.Count(server, ":") == 1 {
+		i := strings.Index(server, ":")
+		if i < len(server)-1 {
+			return server[:i], server[i+1:]
+		}
+		return server[:i], "443"
+	}
+	return server, "443"
+}
+
+func setTLS(query url.Values, sni string, alpn []string, fingerprint string) {
+	if sni != "" {
+		query.Set("sni", sni)
+	}
+	if len(alpn) > 0 {
+		query.Set("alpn", strings.Join(alpn, ","))
+	}
+	if fingerprint != "" {
+		query.Set("fp", fingerprint)
+	}
+}
+
+func setTransport(query url.Values, path, host, serviceName string) {
+	if path != "" {
+		query.Set("path", path)
+	}
+	if host != "" {
+		query.Set("host", host)
+	}
+	if serviceName != "" {
+		query.Set("serviceName", serviceName)
+	}
+}
+
+// joinHostPorts is net.JoinHostPort for a port part that may contain hopping ranges
+func joinHostPorts(host, ports string) string {
+	if strings.Contains(host, ":") {
+		return "[" + host + "]:" + ports
+	}
+	return host + ":" + ports
+}
+
+func orDefault(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
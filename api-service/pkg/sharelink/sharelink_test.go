@@ -0,0 +1,270 @@
+package sharelink
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// hysteria2ClientConfig mirrors the fields the Hysteria2 client fills from a share link
+type hysteria2ClientConfig struct {
+	Server       string
+	Auth         string
+	ObfsType     string
+	ObfsPassword string
+	SNI          string
+	Insecure     bool
+	PinSHA256    string
+}
+
+// parseHysteria2Reference follows the Hysteria2 client's parseURI. The client parses
+// with a copy of net/url that accepts port-hopping ranges, emulated here by swapping
+// the authority out before parsing.
+func parseHysteria2Reference(t *testing.T, uri string) hysteria2ClientConfig {
+	t.Helper()
+
+	scheme, rest, ok := strings.Cut(uri, "://")
+	require.True(t, ok)
+	require.Contains(t, []string{"hysteria2", "hy2"}, scheme)
+
+	end := strings.IndexAny(rest, "/?#")
+	if end < 0 {
+		end = len(rest)
+	}
+	authority := rest[:end]
+
+	var cfg hysteria2ClientConfig
+	if at := strings.LastIndex(authority, "@"); at >= 0 {
+		user, err := url.Parse("x://" + authority[:at] + "@h")
+		require.NoError(t, err)
+		cfg.Auth = user.User.Username()
+		if password, ok := user.User.Password(); ok {
+			cfg.Auth += ":" + password
+		}
+		authority = authority[at+1:]
+	}
+	cfg.Server = authority
+
+	u, err := url.Parse(scheme + "://h" + rest[end:])
+	require.NoError(t, err)
+
+	q := u.Query()
+	if obfsType := q.Get("obfs"); obfsType != "" {
+		cfg.ObfsType = obfsType
+		if strings.ToLower(obfsType) == "salamander" {
+			cfg.ObfsPassword = q.Get("obfs-password")
+		}
+	}
+	cfg.SNI = q.Get("sni")
+	if insecure, err := strconv.ParseBool(q.Get("insecure")); err == nil {
+		cfg.Insecure = insecure
+	}
+	cfg.PinSHA256 = q.Get("pinSHA256")
+	return cfg
+}
+
+// xrayLink is what v2rayN-style clients read from a vless:// or trojan:// link
+type xrayLink struct {
+	Scheme string
+	User   string
+	Host   string
+	Port   int
+	Name   string
+	Query  url.Values
+}
+
+func parseXrayReference(t *testing.T, uri string) xrayLink {
+	t.Helper()
+
+	u, err := url.Parse(uri)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.NoError(t, err)
+
+	return xrayLink{
+		Scheme: u.Scheme,
+		User:   u.User.Username(),
+		Host:   u.Hostname(),
+		Port:   port,
+		Name:   u.Fragment,
+		Query:  u.Query(),
+	}
+}
+
+func TestHysteria2(t *testing.T) {
+	tests := []struct {
+		name   string
+		link   Hysteria2
+		expect hysteria2ClientConfig
+	}{
+		{
+			name: "minimal",
+			link: Hysteria2{Auth: "secret", Host: "vpn.example.com"},
+			expect: hysteria2ClientConfig{
+				Server: "vpn.example.com:443",
+				Auth:   "secret",
+			},
+		},
+		{
+			name: "salamander with port hopping",
+			link: Hysteria2{
+				Name:         "DE 1",
+				Auth:         "user:p@ss/word",
+				Host:         "vpn.example.com",
+				Ports:        "443,20000-50000",
+				SNI:          "cdn.example.com",
+				ObfsType:     ObfsSalamander,
+				ObfsPassword: "obfs&pass=1",
+			},
+			expect: hysteria2ClientConfig{
+				Server:       "vpn.example.com:443,20000-50000",
+				Auth:         "user:p@ss/word",
+				ObfsType:     "salamander",
+				ObfsPassword: "obfs&pass=1",
+				SNI:          "cdn.example.com",
+			},
+		},
+		{
+			name: "insecure IPv6 with pin",
+			link: Hysteria2{
+				Auth:      "secret",
+				Host:      "2001:db8::1",
+				Ports:     "8443",
+				Insecure:  true,
+				PinSHA256: "ba:88:45",
+			},
+			expect: hysteria2ClientConfig{
+				Server:    "[2001:db8::1]:8443",
+				Auth:      "secret",
+				Insecure:  true,
+				PinSHA256: "ba:88:45",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uri := tt.link.String()
+			assert.True(t, strings.HasPrefix(uri, "hysteria2://"))
+			assert.Equal(t, tt.expect, parseHysteria2Reference(t, uri))
+
+			if tt.link.Name != "" {
+				_, fragment, _ := strings.Cut(uri, "#")
+				name, err := url.PathUnescape(fragment)
+				require.NoError(t, err)
+				assert.Equal(t, tt.link.Name, name)
+			}
+		})
+	}
+}
+
+func TestVLESSReality(t *testing.T) {
+	link := VLESS{
+		Name:        "NL Reality",
+		ID:          "5783a3e7-e373-51cd-8642-c83782b807c5",
+		Host:        "203.0.113.10",
+		Port:        443,
+		Flow:        "xtls-rprx-vision",
+		Security:    SecurityReality,
+		SNI:         "www.microsoft.com",
+		Fingerprint: "chrome",
+		PublicKey:   "Z84J2IelR9ch3k8VtlVhhs5ycBUlXA7wHBWcBrjqnAw",
+		ShortID:     "6ba85179e30d4fc2",
+		SpiderX:     "/",
+	}
+
+	parsed := parseXrayReference(t, link.String())
+	assert.Equal(t, "vless", parsed.Scheme)
+	assert.Equal(t, link.ID, parsed.User)
+	assert.Equal(t, "203.0.113.10", parsed.Host)
+	assert.Equal(t, 443, parsed.Port)
+	assert.Equal(t, "NL Reality", parsed.Name)
+
+	q := parsed.Query
+	assert.Equal(t, "none", q.Get("encryption"))
+	assert.Equal(t, "tcp", q.Get("type"))
+	assert.Equal(t, "reality", q.Get("security"))
+	assert.Equal(t, "xtls-rprx-vision", q.Get("flow"))
+	assert.Equal(t, "www.microsoft.com", q.Get("sni"))
+	assert.Equal(t, "chrome", q.Get("fp"))
+	assert.Equal(t, link.PublicKey, q.Get("pbk"))
+	assert.Equal(t, link.ShortID, q.Get("sid"))
+	assert.Equal(t, "/", q.Get("spx"))
+	assert.False(t, q.Has("alpn"))
+}
+
+func TestVLESSTransports(t *testing.T) {
+	ws := parseXrayReference(t, VLESS{
+		ID:          "id",
+		Host:        "vpn.example.com",
+		Port:        443,
+		Network:     "ws",
+		Security:    SecurityTLS,
+		SNI:         "vpn.example.com",
+		ALPN:        []string{"h2", "http/1.1"},
+		Fingerprint: "firefox",
+		Path:        "/ws?ed=2048",
+		HostHeader:  "cdn.example.com",
+	}.String())
+	assert.Equal(t, "ws", ws.Query.Get("type"))
+	assert.Equal(t, "tls", ws.Query.Get("security"))
+	assert.Equal(t, "h2,http/1.1", ws.Query.Get("alpn"))
+	assert.Equal(t, "/ws?ed=2048", ws.Query.Get("path"))
+	assert.Equal(t, "cdn.example.com", ws.Query.Get("host"))
+	assert.False(t, ws.Query.Has("pbk"))
+
+	plain := parseXrayReference(t, VLESS{ID: "id", Host: "2001:db8::2", Port: 80}.String())
+	assert.Equal(t, "2001:db8::2", plain.Host)
+	assert.Equal(t, "none", plain.Query.Get("security"))
+	assert.False(t, plain.Query.Has("sni"))
+	assert.False(t, plain.Query.Has("fp"))
+}
+
+func TestTrojan(t *testing.T) {
+	link := Trojan{
+		Name:        "trojan-1",
+		Password:    "p@ss:word",
+		Host:        "vpn.example.com",
+		Port:        8443,
+		SNI:         "vpn.example.com",
+		ALPN:        []string{"h2", "http/1.1"},
+		Fingerprint: "safari",
+		Insecure:    true,
+		Network:     "grpc",
+		ServiceName: "tunnel",
+	}
+
+	parsed := parseXrayReference(t, link.String())
+	assert.Equal(t, "trojan", parsed.Scheme)
+	assert.Equal(t, "p@ss:word", parsed.User)
+	assert.Equal(t, 8443, parsed.Port)
+	assert.Equal(t, "grpc", parsed.Query.Get("type"))
+	assert.Equal(t, "tunnel", parsed.Query.Get("serviceName"))
+	assert.Equal(t, "tls", parsed.Query.Get("security"))
+	assert.Equal(t, "h2,http/1.1", parsed.Query.Get("alpn"))
+	assert.Equal(t, "safari", parsed.Query.Get("fp"))
+	assert.Equal(t, "1", parsed.Query.Get("allowInsecure"))
+}
+
+func TestSplitServer(t *testing.T) {
+	tests := []struct {
+		server, host, ports string
+	}{
+		{"vpn.example.com", "vpn.example.com", "443"},
+		{"vpn.example.com:8443", "vpn.example.com", "8443"},
+		{"vpn.example.com:443,20000-50000", "vpn.example.com", "443,20000-50000"},
+		{"[2001:db8::1]:443,5000-6000", "2001:db8::1", "443,5000-6000"},
+		{"[2001:db8::1]", "2001:db8::1", "443"},
+		{"2001:db8::1", "2001:db8::1", "443"},
+	}
+
+	for _, tt := range tests {
+		host, ports := SplitServer(tt.server)
+		assert.Equal(t, tt.host, host, tt.server)
+		assert.Equal(t, tt.ports, ports, tt.server)
+	}
+}
@@ -0,0 +1,51 @@
+package validation
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type nodeRequest struct {
+	Hostname string  `json:"hostname" validate:"required,hostname_rfc1123,max=255"`
+	Port     int     `json:"grpc_port" validate:"omitempty,min=1,max=65535"`
+	Password string  `json:"password" validate:"required,notblank,min=8"`
+	Country  *string `json:"country" validate:"omitempty,len=2,alpha"`
+	Internal string  `json:"-" validate:"omitempty,oneof=a b"`
+}
+
+func TestStructValid(t *testing.T) {
+	country := "DE"
+	err := Struct(&nodeRequest{Hostname: "node-1.example.com", Port: 443, Password: "secret-password", Country: &country})
+	assert.NoError(t, err)
+}
+
+func TestStructFieldErrors(t *testing.T) {
+	country := "D1"
+	err := Struct(&nodeRequest{Hostname: "bad_host!", Port: 70000, Password: "         ", Country: &country, Internal: "c"})
+	require.Error(t, err)
+
+	var validationErr *Error
+	require.True(t, errors.As(err, &validationErr))
+	assert.Equal(t, []FieldError{
+		{Field: "hostname", Tag: "hostname_rfc1123", Message: "must be a valid hostname"},
+		{Field: "grpc_port", Tag: "max", Message: "must be at most 65535"},
+		{Field: "password", Tag: "notblank", Message: "is required"},
+		{Field: "country", Tag: "alpha", Message: "must contain only letters"},
+		{Field: "Internal", Tag: "oneof", Message: "must be one of: a, b"},
+	}, validationErr.Fields)
+	assert.Contains(t, err.Error(), "grpc_port must be at most 65535")
+}
+
+func TestStructMissingFields(t *testing.T) {
+	err := Struct(&nodeRequest{Password: "short"})
+
+	var validationErr *Error
+	require.True(t, errors.As(err, &validationErr))
+	assert.Equal(t, []FieldError{
+		{Field: "hostname", Tag: "required", Message: "is required"},
+		{Field: "password", Tag: "min", Message: "must be at least 8 characters long"},
+	}, validationErr.Fields)
+}
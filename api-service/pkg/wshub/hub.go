@@ -0,0 +1,368 @@
+// Package wshub fans messages out to WebSocket clients by room. Every client has a bounded
+// send queue drained by its own writer, so a slow client never holds up a broadcast; when
+// its queue is full the drop policy decides what gives. With Redis, a message published on
+// one replica reaches the clients of every replica.
+package wshub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"hysteria2_microservices/api-service/pkg/cache"
+	"hysteria2_microservices/api-service/pkg/logger"
+
+	ws "github.com/gofiber/websocket/v2"
+	"github.com/google/uuid"
+)
+
+// DropPolicy is what happens to a message for a client whose send queue is full
+type DropPolicy string
+
+const (
+	// DropOldest discards the oldest queued message, keeping the client current
+	DropOldest DropPolicy = "oldest"
+	// DropNewest discards the message being sent
+	DropNewest DropPolicy = "newest"
+	// DropClient disconnects the client; it reconnects and starts over
+	DropClient DropPolicy = "disconnect"
+)
+
+// ParseDropPolicy parses a policy name; the empty name is DropOldest
+func ParseDropPolicy(name string) (DropPolicy, error) {
+	switch policy := DropPolicy(name); policy {
+	case "":
+		return DropOldest, nil
+	case DropOldest, DropNewest, DropClient:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown drop policy %q: want oldest, newest or disconnect", name)
+	}
+}
+
+// Options tune the hub; zero values take the defaults
+type Options struct {
+	SendBuffer   int           // messages queued per client, default 64
+	DropPolicy   DropPolicy    // default DropOldest
+	PingInterval time.Duration // default 30s
+	PongTimeout  time.Duration // time a client may stay silent, default twice PingInterval
+	WriteTimeout time.Duration // default 10s
+	Channel      string        // Redis channel shared by the replicas; empty serves local clients only
+}
+
+// Conn is the side of a WebSocket connection the hub writes to
+type Conn interface {
+	WriteMessage(messageType int, data []byte) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	SetWriteDeadline(t time.Time) error
+	Close() error
+}
+
+// envelope carries a message between replicas
+type envelope struct {
+	Origin string          `json:"origin"`
+	Room   string          `json:"room"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// Hub tracks the clients of this replica and the rooms they joined
+type Hub struct {
+	redis  *cache.RedisClient
+	opts   Options
+	logger *logger.Logger
+	origin string // tells this replica's messages apart on the shared channel
+
+	mu      sync.RWMutex
+	clients map[*Client]struct{}
+	rooms   map[string]map[*Client]struct{}
+	dropped atomic.Int64
+
+	stopChan chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// New creates a hub. Without redis, or without a channel, messages only reach the clients
+// of this replica.
+func New(redis *cache.RedisClient, opts Options, logger *logger.Logger) *Hub {
+	if opts.SendBuffer <= 0 {
+		opts.SendBuffer = 64
+	}
+	if opts.DropPolicy == "" {
+		opts.DropPolicy = DropOldest
+	}
+	if opts.PingInterval <= 0 {
+		opts.PingInterval = 30 * time.Second
+	}
+	if opts.PongTimeout <= 0 {
+		opts.PongTimeout = 2 * opts.PingInterval
+	}
+	if opts.WriteTimeout <= 0 {
+		opts.WriteTimeout = 10 * time.Second
+	}
+	if redis == nil {
+		opts.Channel = ""
+	}
+	return &Hub{
+		redis:    redis,
+		opts:     opts,
+		logger:   logger,
+		origin:   uuid.NewString(),
+		clients:  make(map[*Client]struct{}),
+		rooms:    make(map[string]map[*Client]struct{}),
+		stopChan: make(chan struct{}),
+	}
+}
+
+// PongTimeout is how long a client may stay silent, pongs included, before it is considered
+// gone; readers extend their read deadline by it on every message and pong
+func (h *Hub) PongTimeout() time.Duration {
+	return h.opts.PongTimeout
+}
+
+// Start relays messages published by the other replicas to the clients of this one
+func (h *Hub) Start(ctx context.Context) {
+	if h.opts.Channel == "" {
+		return
+	}
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+
+		pubsub := h.redis.Subscribe(ctx, h.opts.Channel)
+		defer pubsub.Close()
+		messages := pubsub.Channel()
+
+		for {
+			select {
+			case msg, ok := <-messages:
+				if !ok {
+					return
+				}
+				var env envelope
+				if err := json.Unmarshal([]byte(msg.Payload), &env); err != nil {
+					h.logger.Warn("Dropping malformed hub message", "error", err)
+					continue
+				}
+				if env.Origin != h.origin {
+					h.deliver(env.Room, env.Data)
+				}
+			case <-ctx.Done():
+				return
+			case <-h.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// Stop disconnects every client and stops relaying
+func (h *Hub) Stop() {
+	h.stopOnce.Do(func() { close(h.stopChan) })
+
+	h.mu.RLock()
+	clients := make([]*Client, 0, len(h.clients))
+	for c := range h.clients {
+		clients = append(clients, c)
+	}
+	h.mu.RUnlock()
+	for _, c := range clients {
+		c.Close()
+	}
+
+	h.wg.Wait()
+}
+
+// Register adds a connection and starts its writer, which also pings it every ping
+// interval. From then on only the hub may write to conn; send through the client.
+func (h *Hub) Register(conn Conn) *Client {
+	c := &Client{
+		hub:   h,
+		conn:  conn,
+		send:  make(chan []byte, h.opts.SendBuffer),
+		rooms: make(map[string]struct{}),
+		done:  make(chan struct{}),
+	}
+
+	h.mu.Lock()
+	h.clients[c] = struct{}{}
+	h.mu.Unlock()
+
+	h.wg.Add(1)
+	go c.writeLoop()
+	return c
+}
+
+// Publish sends a JSON message to the members of a room on every replica
+func (h *Hub) Publish(ctx context.Context, room string, data []byte) {
+	h.deliver(room, data)
+
+	if h.opts.Channel == "" {
+		return
+	}
+	payload, err := json.Marshal(envelope{Origin: h.origin, Room: room, Data: data})
+	if err != nil {
+		h.logger.Error("Failed to encode hub message", "error", err, "room", room)
+		return
+	}
+	if err := h.redis.Publish(ctx, h.opts.Channel, payload); err != nil {
+		h.logger.Error("Failed to relay hub message", "error", err, "room", room)
+	}
+}
+
+func (h *Hub) deliver(room string, data []byte) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for c := range h.rooms[room] {
+		c.enqueue(data)
+	}
+}
+
+// HasMembers reports whether a message for the room may reach anyone. Members on other
+// replicas are not tracked, so with a shared channel the answer is always yes.
+func (h *Hub) HasMembers(room string) bool {
+	if h.opts.Channel != "" {
+		return true
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.rooms[room]) > 0
+}
+
+// Clients is the number of clients connected to this replica
+func (h *Hub) Clients() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.clients)
+}
+
+// Dropped is the number of messages discarded for full send queues
+func (h *Hub) Dropped() int64 {
+	return h.dropped.Load()
+}
+
+// Client is one connection registered with the hub
+type Client struct {
+	hub   *Hub
+	conn  Conn
+	send  chan []byte
+	rooms map[string]struct{} // guarded by hub.mu
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Join adds the client to a room
+func (c *Client) Join(room string) {
+	c.hub.mu.Lock()
+	defer c.hub.mu.Unlock()
+	if _, ok := c.hub.clients[c]; !ok {
+		return
+	}
+	members, ok := c.hub.rooms[room]
+	if !ok {
+		members = make(map[*Client]struct{})
+		c.hub.rooms[room] = members
+	}
+	members[c] = struct{}{}
+	c.rooms[room] = struct{}{}
+}
+
+// Leave removes the client from a room
+func (c *Client) Leave(room string) {
+	c.hub.mu.Lock()
+	defer c.hub.mu.Unlock()
+	c.leave(room)
+}
+
+// leave needs hub.mu held
+func (c *Client) leave(room string) {
+	delete(c.rooms, room)
+	if members, ok := c.hub.rooms[room]; ok {
+		delete(members, c)
+		if len(members) == 0 {
+			delete(c.hub.rooms, room)
+		}
+	}
+}
+
+// Send queues a JSON message for this client alone, subject to the drop policy
+func (c *Client) Send(data []byte) bool {
+	return c.enqueue(data)
+}
+
+func (c *Client) enqueue(data []byte) bool {
+	select {
+	case c.send <- data:
+		return true
+	default:
+	}
+
+	c.hub.dropped.Add(1)
+	switch c.hub.opts.DropPolicy {
+	case DropOldest:
+		// Another sender may refill the freed slot first; then this message is dropped too
+		select {
+		case <-c.send:
+		default:
+		}
+		select {
+		case c.send <- data:
+			return true
+		default:
+			c.hub.dropped.Add(1)
+		}
+	case DropClient:
+		// The caller may hold hub.mu, which Close takes
+		go c.Close()
+	}
+	return false
+}
+
+// Done is closed when the client is disconnected
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Close removes the client from the hub and closes its connection
+func (c *Client) Close() {
+	c.closeOnce.Do(func() {
+		c.hub.mu.Lock()
+		for room := range c.rooms {
+			c.leave(room)
+		}
+		delete(c.hub.clients, c)
+		c.hub.mu.Unlock()
+
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+func (c *Client) writeLoop() {
+	defer c.hub.wg.Done()
+
+	ticker := time.NewTicker(c.hub.opts.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case data := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(c.hub.opts.WriteTimeout))
+			if err := c.conn.WriteMessage(ws.TextMessage, data); err != nil {
+				c.Close()
+				return
+			}
+		case <-ticker.C:
+			if err := c.conn.WriteControl(ws.PingMessage, nil, time.Now().Add(c.hub.opts.WriteTimeout)); err != nil {
+				c.Close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
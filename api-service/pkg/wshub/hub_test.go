@@ -0,0 +1,154 @@
+package wshub
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"hysteria2_microservices/api-service/pkg/logger"
+)
+
+// fakeConn records the messages written to it; writes block while it is held
+type fakeConn struct {
+	mu       sync.Mutex
+	messages []string
+	closed   bool
+	hold     chan struct{}
+}
+
+func (f *fakeConn) WriteMessage(_ int, data []byte) error {
+	if f.hold != nil {
+		<-f.hold
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return errors.New("closed")
+	}
+	f.messages = append(f.messages, string(data))
+	return nil
+}
+
+func (f *fakeConn) WriteControl(int, []byte, time.Time) error { return nil }
+func (f *fakeConn) SetWriteDeadline(time.Time) error          { return nil }
+
+func (f *fakeConn) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+func (f *fakeConn) received() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.messages...)
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPublishReachesRoomMembers(t *testing.T) {
+	hub := New(nil, Options{}, logger.NewLogger("error"))
+	defer hub.Stop()
+	ctx := context.Background()
+
+	alice, bob := &fakeConn{}, &fakeConn{}
+	a := hub.Register(alice)
+	b := hub.Register(bob)
+	a.Join("traffic:user:a")
+	b.Join("alerts")
+
+	hub.Publish(ctx, "traffic:user:a", []byte(`"for a"`))
+	hub.Publish(ctx, "alerts", []byte(`"for admins"`))
+	hub.Publish(ctx, "node:1", []byte(`"for nobody"`))
+
+	waitFor(t, func() bool { return len(alice.received()) == 1 && len(bob.received()) == 1 })
+	if got := alice.received()[0]; got != `"for a"` {
+		t.Errorf("alice got %s", got)
+	}
+	if got := bob.received()[0]; got != `"for admins"` {
+		t.Errorf("bob got %s", got)
+	}
+
+	if !hub.HasMembers("alerts") || hub.HasMembers("node:1") {
+		t.Error("HasMembers does not follow the joined rooms")
+	}
+	b.Leave("alerts")
+	if hub.HasMembers("alerts") {
+		t.Error("room still has members after Leave")
+	}
+}
+
+func TestDropOldestKeepsNewest(t *testing.T) {
+	hub := New(nil, Options{SendBuffer: 2, DropPolicy: DropOldest}, logger.NewLogger("error"))
+	defer hub.Stop()
+	ctx := context.Background()
+
+	conn := &fakeConn{hold: make(chan struct{})}
+	c := hub.Register(conn)
+	c.Join("room")
+
+	// The writer takes the first message and blocks writing it; the queue then holds two
+	hub.Publish(ctx, "room", []byte("1"))
+	waitFor(t, func() bool { return len(c.send) == 0 })
+	for _, msg := range []string{"2", "3", "4", "5"} {
+		hub.Publish(ctx, "room", []byte(msg))
+	}
+	close(conn.hold)
+
+	waitFor(t, func() bool { return len(conn.received()) == 3 })
+	got := conn.received()
+	if got[0] != "1" || got[1] != "4" || got[2] != "5" {
+		t.Errorf("received %v, want [1 4 5]", got)
+	}
+	if hub.Dropped() != 2 {
+		t.Errorf("Dropped() = %d, want 2", hub.Dropped())
+	}
+}
+
+func TestDropClientDisconnects(t *testing.T) {
+	hub := New(nil, Options{SendBuffer: 1, DropPolicy: DropClient}, logger.NewLogger("error"))
+	defer hub.Stop()
+	ctx := context.Background()
+
+	conn := &fakeConn{hold: make(chan struct{})}
+	defer close(conn.hold)
+	c := hub.Register(conn)
+	c.Join("room")
+
+	hub.Publish(ctx, "room", []byte("1"))
+	waitFor(t, func() bool { return len(c.send) == 0 })
+	hub.Publish(ctx, "room", []byte("2"))
+	hub.Publish(ctx, "room", []byte("3"))
+
+	select {
+	case <-c.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("slow client was not disconnected")
+	}
+	if hub.Clients() != 0 || hub.HasMembers("room") {
+		t.Error("disconnected client is still registered")
+	}
+}
+
+func TestParseDropPolicy(t *testing.T) {
+	for name, want := range map[string]DropPolicy{"": DropOldest, "newest": DropNewest, "disconnect": DropClient} {
+		if got, err := ParseDropPolicy(name); err != nil || got != want {
+			t.Errorf("ParseDropPolicy(%q) = %q, %v; want %q", name, got, err, want)
+		}
+	}
+	if _, err := ParseDropPolicy("random"); err == nil {
+		t.Error("ParseDropPolicy accepted an unknown policy")
+	}
+}
@@ -85,14 +85,14 @@ if [[ ! $CONFIRM =~ ^[Yy]$ ]]; then
 fi
 
 # Check if agent-service directory exists
-if [ ! -d "../agent-service" ]; then
+if [ ! -d "../../agent-service" ]; then
     echo "❌ agent-service directory not found. Run this script from deployments/docker/"
     exit 1
 fi
 
 # Build the agent image
 echo "🏗️ Building agent image..."
-docker build -t hysteria-agent ../agent-service
+docker build -t hysteria-agent -f ../../agent-service/Dockerfile ../..
 
 # Create container name
 CONTAINER_NAME="hysteria-agent-${NODE_ID}"
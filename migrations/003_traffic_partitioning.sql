@@ -0,0 +1,139 @@
+-- Migration: Time-based partitioning and retention for traffic data
+-- Description: Convert traffic_stats and node_metrics to monthly range partitions
+--              and add an hourly rollup table for long-term traffic history
+-- Version: 003
+
+-- Helper that creates monthly partitions for a range-partitioned parent table
+CREATE OR REPLACE FUNCTION ensure_monthly_partitions(parent_table text, months_ahead integer)
+RETURNS integer AS $$
+DECLARE
+    month_start date := date_trunc('month', NOW())::date;
+    partition_start date;
+    partition_end date;
+    partition_name text;
+    created integer := 0;
+BEGIN
+    FOR i IN 0..months_ahead LOOP
+        partition_start := (month_start + (i || ' month')::interval)::date;
+        partition_end := (partition_start + interval '1 month')::date;
+        partition_name := parent_table || '_' || to_char(partition_start, 'YYYY_MM');
+
+        IF to_regclass(partition_name) IS NULL THEN
+            EXECUTE format(
+                'CREATE TABLE %I PARTITION OF %I FOR VALUES FROM (%L) TO (%L)',
+                partition_name, parent_table, partition_start, partition_end
+            );
+            created := created + 1;
+        END IF;
+    END LOOP;
+
+    RETURN created;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Drops monthly partitions whose upper bound is at or before the cutoff
+CREATE OR REPLACE FUNCTION drop_partitions_before(parent_table text, cutoff timestamptz)
+RETURNS integer AS $$
+DECLARE
+    part record;
+    upper_bound timestamptz;
+    dropped integer := 0;
+BEGIN
+    FOR part IN
+        SELECT c.relname AS name
+        FROM pg_inherits i
+        JOIN pg_class c ON c.oid = i.inhrelid
+        JOIN pg_class p ON p.oid = i.inhparent
+        WHERE p.relname = parent_table
+          AND c.relname ~ '_[0-9]{4}_[0-9]{2}$'
+    LOOP
+        upper_bound := to_date(right(part.name, 7), 'YYYY_MM') + interval '1 month';
+        IF upper_bound <= cutoff THEN
+            EXECUTE format('DROP TABLE IF EXISTS %I', part.name);
+            dropped := dropped + 1;
+        END IF;
+    END LOOP;
+
+    RETURN dropped;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Partition traffic_stats by recorded_at
+ALTER TABLE IF EXISTS traffic_stats RENAME TO traffic_stats_legacy;
+
+CREATE TABLE IF NOT EXISTS traffic_stats (
+    id UUID NOT NULL DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL,
+    device_id UUID,
+    upload BIGINT DEFAULT 0,
+    download BIGINT DEFAULT 0,
+    total BIGINT DEFAULT 0,
+    recorded_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    PRIMARY KEY (id, recorded_at)
+) PARTITION BY RANGE (recorded_at);
+
+CREATE TABLE IF NOT EXISTS traffic_stats_default PARTITION OF traffic_stats DEFAULT;
+SELECT ensure_monthly_partitions('traffic_stats', 3);
+
+DO $$
+BEGIN
+    IF to_regclass('traffic_stats_legacy') IS NOT NULL THEN
+        INSERT INTO traffic_stats (id, user_id, device_id, upload, download, total, recorded_at, created_at)
+        SELECT id, user_id, device_id, upload, download, total, recorded_at, created_at
+        FROM traffic_stats_legacy;
+        DROP TABLE traffic_stats_legacy;
+    END IF;
+END $$;
+
+CREATE INDEX IF NOT EXISTS idx_traffic_stats_user_recorded ON traffic_stats(user_id, recorded_at);
+CREATE INDEX IF NOT EXISTS idx_traffic_stats_device_recorded ON traffic_stats(device_id, recorded_at);
+
+-- Partition node_metrics by recorded_at
+ALTER TABLE IF EXISTS node_metrics RENAME TO node_metrics_legacy;
+
+CREATE TABLE IF NOT EXISTS node_metrics (
+    id UUID NOT NULL DEFAULT gen_random_uuid(),
+    node_id UUID NOT NULL REFERENCES vps_nodes(id) ON DELETE CASCADE,
+    cpu_usage DECIMAL(5,2),
+    memory_usage DECIMAL(5,2),
+    bandwidth_up BIGINT,
+    bandwidth_down BIGINT,
+    active_connections INTEGER,
+    recorded_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (id, recorded_at)
+) PARTITION BY RANGE (recorded_at);
+
+CREATE TABLE IF NOT EXISTS node_metrics_default PARTITION OF node_metrics DEFAULT;
+SELECT ensure_monthly_partitions('node_metrics', 3);
+
+DO $$
+BEGIN
+    IF to_regclass('node_metrics_legacy') IS NOT NULL THEN
+        INSERT INTO node_metrics (id, node_id, cpu_usage, memory_usage, bandwidth_up, bandwidth_down, active_connections, recorded_at)
+        SELECT id, node_id, cpu_usage, memory_usage, bandwidth_up, bandwidth_down, active_connections, recorded_at
+        FROM node_metrics_legacy;
+        DROP TABLE node_metrics_legacy;
+    END IF;
+END $$;
+
+CREATE INDEX IF NOT EXISTS idx_node_metrics_node_recorded ON node_metrics(node_id, recorded_at);
+
+-- Hourly rollups kept after raw traffic has been pruned
+CREATE TABLE IF NOT EXISTS traffic_stats_hourly (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL,
+    device_id UUID,
+    bucket TIMESTAMP WITH TIME ZONE NOT NULL,
+    upload BIGINT DEFAULT 0,
+    download BIGINT DEFAULT 0,
+    total BIGINT DEFAULT 0,
+    samples INTEGER DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_traffic_stats_hourly_bucket
+    ON traffic_stats_hourly(user_id, COALESCE(device_id, '00000000-0000-0000-0000-000000000000'::uuid), bucket);
+CREATE INDEX IF NOT EXISTS idx_traffic_stats_hourly_bucket_time ON traffic_stats_hourly(bucket);
+
+COMMENT ON TABLE traffic_stats_hourly IS 'Hourly traffic aggregates retained after raw traffic_stats partitions are dropped';
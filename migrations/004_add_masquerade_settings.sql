@@ -0,0 +1,23 @@
+-- Migration: Add per-node Hysteria2 masquerade settings
+-- Description: Store masquerade mode (string, file, proxy) for each node
+-- Version: 004
+
+ALTER TABLE vps_nodes
+ADD COLUMN IF NOT EXISTS masquerade JSONB;
+
+-- Preserve the previous hardcoded behaviour for existing nodes
+UPDATE vps_nodes
+SET masquerade = '{"type": "proxy", "proxy_url": "https://www.google.com", "rewrite_host": true}'::jsonb
+WHERE masquerade IS NULL;
+
+ALTER TABLE vps_nodes
+ADD CONSTRAINT chk_vps_nodes_masquerade_type
+CHECK (masquerade IS NULL OR masquerade->>'type' IN ('string', 'file', 'proxy'));
+
+COMMENT ON COLUMN vps_nodes.masquerade IS 'Hysteria2 masquerade settings served to unauthenticated clients';
+
+-- Log migration completion
+DO $$
+BEGIN
+    RAISE NOTICE 'Migration 004: Masquerade settings completed successfully';
+END $$;
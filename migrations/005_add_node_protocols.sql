@@ -0,0 +1,17 @@
+-- Migration: Add per-node protocol matrix
+-- Description: Store which protocols (hysteria2, vless, vless-reality, trojan, shadowsocks-2022) each node serves
+-- Version: 005
+
+ALTER TABLE vps_nodes
+ADD COLUMN IF NOT EXISTS protocols JSONB;
+
+-- NULL keeps the previous behaviour where every protocol is offered on every node
+COMMENT ON COLUMN vps_nodes.protocols IS 'Protocol enable/disable matrix, e.g. {"hysteria2": true, "trojan": false}; NULL enables all';
+
+CREATE INDEX IF NOT EXISTS idx_vps_nodes_protocols ON vps_nodes USING GIN (protocols);
+
+-- Log migration completion
+DO $$
+BEGIN
+    RAISE NOTICE 'Migration 005: Node protocol matrix completed successfully';
+END $$;
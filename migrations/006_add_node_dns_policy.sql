@@ -0,0 +1,18 @@
+-- Migration: Add per-node DNS resolver policy
+-- Description: Store the DoH/DoT upstreams and per-domain routing rules pushed to each node's embedded resolver
+-- Version: 006
+
+ALTER TABLE vps_nodes
+ADD COLUMN IF NOT EXISTS dns_policy JSONB;
+
+-- NULL keeps the upstreams configured on the agent
+COMMENT ON COLUMN vps_nodes.dns_policy IS 'Resolver policy, e.g. {"upstreams": ["tls://1.1.1.1"], "via_warp": false, "rules": [{"domains": ["example.com"], "route": "warp"}]}; NULL uses agent defaults';
+
+-- Policies can be applied to every node in a country at once
+CREATE INDEX IF NOT EXISTS idx_vps_nodes_country ON vps_nodes (country);
+
+-- Log migration completion
+DO $$
+BEGIN
+    RAISE NOTICE 'Migration 006: Node DNS policy completed successfully';
+END $$;
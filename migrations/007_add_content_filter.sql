@@ -0,0 +1,45 @@
+-- Migration: Add content filter lists
+-- Description: Store domain blocklists/allowlists and their assignment to nodes and user groups
+-- Version: 007
+
+CREATE TABLE IF NOT EXISTS filter_lists (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    name VARCHAR(63) NOT NULL UNIQUE,
+    category VARCHAR(50),
+    action VARCHAR(10) NOT NULL DEFAULT 'block',
+    url VARCHAR(1000),
+    format VARCHAR(20),
+    domains JSONB,
+    refresh_interval INTEGER DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+COMMENT ON COLUMN filter_lists.domains IS 'Inline entries, e.g. {"domains": ["ads.example.com"]}; merged with the entries fetched from url';
+
+-- NULL node_id applies the list to every node, empty user_group to every user
+CREATE TABLE IF NOT EXISTS filter_assignments (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    list_id UUID NOT NULL REFERENCES filter_lists(id) ON DELETE CASCADE,
+    node_id UUID REFERENCES vps_nodes(id) ON DELETE CASCADE,
+    user_group VARCHAR(50) NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_filter_assignments_list_id ON filter_assignments (list_id);
+CREATE INDEX IF NOT EXISTS idx_filter_assignments_node_id ON filter_assignments (node_id);
+
+-- Users are owned by the API service and may not exist yet on a fresh database
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'users') THEN
+        ALTER TABLE users ADD COLUMN IF NOT EXISTS user_group VARCHAR(50) DEFAULT '';
+        CREATE INDEX IF NOT EXISTS idx_users_user_group ON users (user_group);
+    END IF;
+END $$;
+
+-- Log migration completion
+DO $$
+BEGIN
+    RAISE NOTICE 'Migration 007: Content filter completed successfully';
+END $$;
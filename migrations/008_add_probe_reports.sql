@@ -0,0 +1,25 @@
+-- Migration: Add censorship resilience reports
+-- Description: Store the results of active-probing tests run by one node against another
+-- Version: 008
+
+CREATE TABLE IF NOT EXISTS probe_reports (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    node_id UUID NOT NULL REFERENCES vps_nodes(id) ON DELETE CASCADE,
+    prober_node_id UUID NOT NULL,
+    target VARCHAR(255),
+    score INTEGER NOT NULL,
+    checks JSONB,
+    started_at TIMESTAMP WITH TIME ZONE,
+    finished_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+COMMENT ON COLUMN probe_reports.checks IS 'Probe outcomes, e.g. {"checks": [{"name": "tls_sni", "target": "203.0.113.10:443 example.com", "status": "pass", "duration_ms": 42}]}';
+
+CREATE INDEX IF NOT EXISTS idx_probe_reports_node_created ON probe_reports (node_id, created_at DESC);
+
+-- Log migration completion
+DO $$
+BEGIN
+    RAISE NOTICE 'Migration 008: Probe reports completed successfully';
+END $$;
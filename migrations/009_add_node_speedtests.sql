@@ -0,0 +1,25 @@
+-- Migration: Add node speedtest history
+-- Description: Store latency and throughput measured from each node to the reflectors of client regions
+-- Version: 009
+
+CREATE TABLE IF NOT EXISTS node_speedtests (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    node_id UUID NOT NULL REFERENCES vps_nodes(id) ON DELETE CASCADE,
+    region VARCHAR(50) NOT NULL,
+    reflector VARCHAR(255),
+    latency_ms DOUBLE PRECISION,
+    download_mbps DOUBLE PRECISION,
+    upload_mbps DOUBLE PRECISION,
+    error TEXT NOT NULL DEFAULT '',
+    measured_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+-- "Best node for region" aggregates a region over a recent window
+CREATE INDEX IF NOT EXISTS idx_node_speedtests_region_measured ON node_speedtests (region, measured_at);
+CREATE INDEX IF NOT EXISTS idx_node_speedtests_node_measured ON node_speedtests (node_id, measured_at DESC);
+
+-- Log migration completion
+DO $$
+BEGIN
+    RAISE NOTICE 'Migration 009: Node speedtests completed successfully';
+END $$;
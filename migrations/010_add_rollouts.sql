@@ -0,0 +1,26 @@
+-- Migration: Add staged component rollouts
+-- Description: Track upgrades of node components that go to canary nodes first and then to the rest in batches
+-- Version: 010
+
+CREATE TABLE IF NOT EXISTS rollouts (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    component VARCHAR(20) NOT NULL,
+    version VARCHAR(50) NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    batch_size INTEGER NOT NULL,
+    soak_seconds INTEGER NOT NULL,
+    max_failures INTEGER NOT NULL DEFAULT 0,
+    nodes JSONB,
+    error TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    finished_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_rollouts_status ON rollouts (status);
+CREATE INDEX IF NOT EXISTS idx_rollouts_created_at ON rollouts (created_at DESC);
+
+-- Log migration completion
+DO $$
+BEGIN
+    RAISE NOTICE 'Migration 010: Rollouts completed successfully';
+END $$;
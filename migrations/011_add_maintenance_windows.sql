@@ -0,0 +1,32 @@
+-- Migration: Add maintenance windows
+-- Description: Schedule node restarts, certificate renewals, config pushes and drains for a time window
+-- Version: 011
+
+CREATE TABLE IF NOT EXISTS maintenance_windows (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    operation VARCHAR(20) NOT NULL,
+    service VARCHAR(20),
+    nodes JSONB,
+    starts_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    ends_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    drain BOOLEAN DEFAULT FALSE,
+    status VARCHAR(20) NOT NULL,
+    reason TEXT,
+    error TEXT,
+    affected_users INTEGER DEFAULT 0,
+    notified_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    started_at TIMESTAMP WITH TIME ZONE,
+    finished_at TIMESTAMP WITH TIME ZONE,
+    CHECK (ends_at > starts_at)
+);
+
+CREATE INDEX IF NOT EXISTS idx_maintenance_windows_status ON maintenance_windows (status);
+CREATE INDEX IF NOT EXISTS idx_maintenance_windows_starts_at ON maintenance_windows (starts_at);
+CREATE INDEX IF NOT EXISTS idx_maintenance_windows_ends_at ON maintenance_windows (ends_at);
+
+-- Log migration completion
+DO $$
+BEGIN
+    RAISE NOTICE 'Migration 011: Maintenance windows completed successfully';
+END $$;
@@ -0,0 +1,41 @@
+-- Migration: Add config template library
+-- Description: Store Hysteria2/Xray config templates with variables and assign them to node groups
+-- Version: 012
+
+ALTER TABLE vps_nodes
+ADD COLUMN IF NOT EXISTS node_group VARCHAR(50) DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS idx_vps_nodes_node_group ON vps_nodes (node_group);
+
+CREATE TABLE IF NOT EXISTS config_templates (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    name VARCHAR(40) NOT NULL UNIQUE,
+    kind VARCHAR(20) NOT NULL,
+    protocol VARCHAR(30),
+    body TEXT NOT NULL,
+    variables JSONB,
+    version INTEGER NOT NULL DEFAULT 1,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+COMMENT ON COLUMN config_templates.body IS 'JSON config with {{variable}} placeholders, e.g. {"listen": ":{{port}}"}';
+COMMENT ON COLUMN config_templates.variables IS 'Default variable values, e.g. {"port": "443", "up_mbps": "100"}';
+
+-- Empty node_group applies the template to nodes no group-specific template of its kind covers
+CREATE TABLE IF NOT EXISTS config_template_assignments (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    template_id UUID NOT NULL REFERENCES config_templates(id) ON DELETE CASCADE,
+    node_group VARCHAR(50) NOT NULL DEFAULT '',
+    variables JSONB,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_config_template_assignments_template_id ON config_template_assignments (template_id);
+CREATE INDEX IF NOT EXISTS idx_config_template_assignments_node_group ON config_template_assignments (node_group);
+
+-- Log migration completion
+DO $$
+BEGIN
+    RAISE NOTICE 'Migration 012: Config templates completed successfully';
+END $$;
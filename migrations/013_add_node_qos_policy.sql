@@ -0,0 +1,15 @@
+-- Migration: Add per-node QoS policy
+-- Description: Store the egress qdisc and DSCP traffic classes pushed to each node
+-- Version: 013
+
+ALTER TABLE vps_nodes
+ADD COLUMN IF NOT EXISTS qos_policy JSONB;
+
+-- NULL keeps the QoS settings configured on the agent
+COMMENT ON COLUMN vps_nodes.qos_policy IS 'QoS policy, e.g. {"enabled": true, "qdisc": "cake", "bandwidth_mbps": 900, "classes": [{"name": "dns", "ports": "53", "dscp": "EF"}]}; NULL uses agent defaults';
+
+-- Log migration completion
+DO $$
+BEGIN
+    RAISE NOTICE 'Migration 013: Node QoS policy completed successfully';
+END $$;
@@ -0,0 +1,60 @@
+-- Migration: Add cloud provisioning
+-- Description: Store the autoscaling policies of node groups and the cloud servers created for nodes
+-- Version: 014
+
+CREATE TABLE IF NOT EXISTS scaling_policies (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    node_group VARCHAR(50) NOT NULL UNIQUE,
+    provider VARCHAR(20) NOT NULL,
+    region VARCHAR(50) NOT NULL,
+    size VARCHAR(50) NOT NULL,
+    image VARCHAR(100) NOT NULL,
+    location VARCHAR(100),
+    country VARCHAR(2),
+    min_nodes INTEGER DEFAULT 0,
+    max_nodes INTEGER DEFAULT 0,
+    node_mbps INTEGER DEFAULT 0,
+    scale_up_percent INTEGER DEFAULT 80,
+    scale_down_percent INTEGER DEFAULT 30,
+    idle_minutes INTEGER DEFAULT 30,
+    cooldown INTEGER DEFAULT 600,
+    enabled BOOLEAN DEFAULT FALSE,
+    last_scaled_at TIMESTAMP WITH TIME ZONE,
+    last_error TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+COMMENT ON COLUMN scaling_policies.size IS 'Provider server size, e.g. cx22 (Hetzner), s-1vcpu-1gb (DigitalOcean), vc2-1c-1gb (Vultr)';
+COMMENT ON COLUMN scaling_policies.node_mbps IS 'Bandwidth of a node without a max_mbps capacity; set as the capacity of the servers created';
+
+-- The ID is the provision_id the agent registers with in its node metadata
+CREATE TABLE IF NOT EXISTS provisioned_servers (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    policy_id UUID REFERENCES scaling_policies(id) ON DELETE SET NULL,
+    node_group VARCHAR(50),
+    provider VARCHAR(20) NOT NULL,
+    server_id VARCHAR(100),
+    name VARCHAR(100) NOT NULL,
+    region VARCHAR(50),
+    size VARCHAR(50),
+    ip_address VARCHAR(45),
+    ipv6_address VARCHAR(45),
+    node_id UUID REFERENCES vps_nodes(id) ON DELETE SET NULL,
+    status VARCHAR(20) NOT NULL,
+    error TEXT,
+    idle_since TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    registered_at TIMESTAMP WITH TIME ZONE,
+    destroyed_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_provisioned_servers_policy_id ON provisioned_servers (policy_id);
+CREATE INDEX IF NOT EXISTS idx_provisioned_servers_node_id ON provisioned_servers (node_id);
+CREATE INDEX IF NOT EXISTS idx_provisioned_servers_status ON provisioned_servers (status);
+
+-- Log migration completion
+DO $$
+BEGIN
+    RAISE NOTICE 'Migration 014: Cloud provisioning completed successfully';
+END $$;
@@ -0,0 +1,15 @@
+-- Migration: Add per-node Hysteria2 certificate mode
+-- Description: Store whether each node serves agent-managed certificates or has Hysteria2 obtain its own through ACME
+-- Version: 015
+
+ALTER TABLE vps_nodes
+ADD COLUMN IF NOT EXISTS certificate_mode JSONB;
+
+-- NULL serves the certificates the agent issues with certbot or self-signs
+COMMENT ON COLUMN vps_nodes.certificate_mode IS 'Certificate mode, e.g. {"mode": "acme", "domains": ["vpn.example.com"], "email": "admin@example.com", "challenge": "http"}; NULL uses agent-managed certificates';
+
+-- Log migration completion
+DO $$
+BEGIN
+    RAISE NOTICE 'Migration 015: Node certificate mode completed successfully';
+END $$;
@@ -0,0 +1,30 @@
+-- Migration: Add obfuscation presets
+-- Description: Store custom obfuscation presets and the preset each node uses with its settings as applied
+-- Version: 016
+
+CREATE TABLE IF NOT EXISTS obfuscation_presets (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    name VARCHAR(63) NOT NULL UNIQUE,
+    description VARCHAR(255),
+    settings JSONB,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+COMMENT ON COLUMN obfuscation_presets.settings IS 'Obfuscation settings, e.g. {"salamander": true, "port_hopping": true, "hop_start_port": 20000, "hop_end_port": 50000, "fingerprints": ["chrome"]}; never holds a Salamander password';
+
+ALTER TABLE vps_nodes
+ADD COLUMN IF NOT EXISTS obfuscation_preset VARCHAR(63) DEFAULT '',
+ADD COLUMN IF NOT EXISTS obfuscation JSONB;
+
+CREATE INDEX IF NOT EXISTS idx_vps_nodes_obfuscation_preset ON vps_nodes (obfuscation_preset);
+
+-- Built-in presets (russia, iran, china) live in the orchestrator, not in this table
+COMMENT ON COLUMN vps_nodes.obfuscation_preset IS 'Built-in or custom obfuscation preset applied to the node, empty for none';
+COMMENT ON COLUMN vps_nodes.obfuscation IS 'Obfuscation settings as applied, including the node''s Salamander password; NULL keeps the agent''s configured obfuscation';
+
+-- Log migration completion
+DO $$
+BEGIN
+    RAISE NOTICE 'Migration 016: Obfuscation presets completed successfully';
+END $$;
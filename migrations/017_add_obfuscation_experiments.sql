@@ -0,0 +1,43 @@
+-- Migration: Add obfuscation experiments
+-- Description: Store A/B experiments comparing two obfuscation presets and the client connection samples they collect
+-- Version: 017
+
+CREATE TABLE IF NOT EXISTS obfuscation_experiments (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    name VARCHAR(100) NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    arms JSONB,
+    started_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    ends_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    finished_at TIMESTAMP WITH TIME ZONE,
+    applied_preset VARCHAR(63),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_obfuscation_experiments_status ON obfuscation_experiments (status);
+CREATE INDEX IF NOT EXISTS idx_obfuscation_experiments_created_at ON obfuscation_experiments (created_at);
+
+COMMENT ON COLUMN obfuscation_experiments.arms IS 'Arms a and b, e.g. {"arms": [{"name": "a", "preset": "russia", "nodes": [{"node_id": "...", "previous_preset": "", "status": "applied"}]}]}';
+COMMENT ON COLUMN obfuscation_experiments.applied_preset IS 'Preset the nodes were moved to when the experiment stopped, empty when their previous presets were restored';
+
+CREATE TABLE IF NOT EXISTS experiment_samples (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    experiment_id UUID NOT NULL REFERENCES obfuscation_experiments(id) ON DELETE CASCADE,
+    arm VARCHAR(1) NOT NULL,
+    node_id UUID NOT NULL,
+    success BOOLEAN NOT NULL,
+    handshake_ms INTEGER DEFAULT 0,
+    throughput_kbps INTEGER DEFAULT 0,
+    failure_reason VARCHAR(50),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_experiment_samples_experiment_id ON experiment_samples (experiment_id);
+
+COMMENT ON COLUMN experiment_samples.throughput_kbps IS '0 when the client did not measure throughput';
+
+-- Log migration completion
+DO $$
+BEGIN
+    RAISE NOTICE 'Migration 017: Obfuscation experiments completed successfully';
+END $$;
@@ -0,0 +1,27 @@
+-- Migration: Add node certificate inventory
+-- Description: Store the certificates every node serves, synced periodically from the agents
+-- Version: 018
+
+CREATE TABLE IF NOT EXISTS node_certificates (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    node_id UUID NOT NULL REFERENCES vps_nodes(id) ON DELETE CASCADE,
+    domain VARCHAR(253) NOT NULL,
+    issuer VARCHAR(255),
+    source VARCHAR(10) NOT NULL,
+    self_signed BOOLEAN NOT NULL DEFAULT FALSE,
+    not_before TIMESTAMP WITH TIME ZONE,
+    not_after TIMESTAMP WITH TIME ZONE NOT NULL,
+    synced_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_node_certificates_node_id ON node_certificates (node_id);
+CREATE INDEX IF NOT EXISTS idx_node_certificates_domain ON node_certificates (domain);
+CREATE INDEX IF NOT EXISTS idx_node_certificates_not_after ON node_certificates (not_after);
+
+COMMENT ON COLUMN node_certificates.source IS 'files for certificates the agent manages, acme for those Hysteria2 obtained itself';
+
+-- Log migration completion
+DO $$
+BEGIN
+    RAISE NOTICE 'Migration 018: Node certificate inventory completed successfully';
+END $$;
@@ -0,0 +1,29 @@
+-- Migration: Add uploaded certificates
+-- Description: Store operator-provided certificates for domains ACME cannot serve, installed on every node serving the domain
+-- Version: 019
+
+CREATE TABLE IF NOT EXISTS uploaded_certificates (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    domain VARCHAR(253) NOT NULL,
+    certificate_pem TEXT NOT NULL,
+    private_key_pem TEXT NOT NULL,
+    ca_bundle_pem TEXT,
+    issuer VARCHAR(255),
+    fingerprint VARCHAR(64) NOT NULL,
+    not_before TIMESTAMP WITH TIME ZONE,
+    not_after TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_uploaded_certificates_domain ON uploaded_certificates (domain);
+
+COMMENT ON COLUMN uploaded_certificates.certificate_pem IS 'Leaf followed by the intermediates of its verified chain';
+COMMENT ON COLUMN uploaded_certificates.private_key_pem IS 'Never returned by the API; backups hold it encrypted';
+COMMENT ON COLUMN uploaded_certificates.ca_bundle_pem IS 'Internal CA roots the chain was verified against, empty for public roots';
+
+-- Log migration completion
+DO $$
+BEGIN
+    RAISE NOTICE 'Migration 019: Uploaded certificates completed successfully';
+END $$;
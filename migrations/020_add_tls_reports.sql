@@ -0,0 +1,27 @@
+-- Migration: Add TLS reports
+-- Description: Store the TLS hygiene grades of nodes, checked by one node against another
+-- Version: 020
+
+CREATE TABLE IF NOT EXISTS tls_reports (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    node_id UUID NOT NULL REFERENCES vps_nodes(id) ON DELETE CASCADE,
+    prober_node_id UUID NOT NULL,
+    target VARCHAR(255),
+    grade CHAR(1) NOT NULL,
+    score INTEGER NOT NULL,
+    checks JSONB,
+    started_at TIMESTAMP WITH TIME ZONE,
+    finished_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+COMMENT ON COLUMN tls_reports.grade IS 'A, B with warnings, C for legacy protocols or broken cipher suites, F for a certificate clients reject';
+COMMENT ON COLUMN tls_reports.checks IS 'Check outcomes, e.g. {"checks": [{"name": "tls_chain", "target": "203.0.113.10:443 example.com", "status": "fail", "detail": "self-signed certificate", "hint": "...", "duration_ms": 42}]}';
+
+CREATE INDEX IF NOT EXISTS idx_tls_reports_node_created ON tls_reports (node_id, created_at DESC);
+
+-- Log migration completion
+DO $$
+BEGIN
+    RAISE NOTICE 'Migration 020: TLS reports completed successfully';
+END $$;
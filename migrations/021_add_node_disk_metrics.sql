@@ -0,0 +1,20 @@
+-- Migration: Add disk and config integrity metrics
+-- Description: Record the fullest partition and the configs edited outside the agent with each heartbeat
+-- Version: 021
+
+ALTER TABLE node_metrics
+ADD COLUMN IF NOT EXISTS disk_used_percent DECIMAL(5,2),
+ADD COLUMN IF NOT EXISTS disk_inodes_used_percent DECIMAL(5,2),
+ADD COLUMN IF NOT EXISTS disk_low_partitions INTEGER DEFAULT 0,
+ADD COLUMN IF NOT EXISTS config_drift_files INTEGER DEFAULT 0;
+
+COMMENT ON COLUMN node_metrics.disk_used_percent IS 'Space in use on the fullest partition holding server configs, certificates or logs';
+COMMENT ON COLUMN node_metrics.disk_inodes_used_percent IS 'Inodes in use on the partition with the fewest left';
+COMMENT ON COLUMN node_metrics.disk_low_partitions IS 'Partitions above the agent integrity.disk_warn_percent';
+COMMENT ON COLUMN node_metrics.config_drift_files IS 'Deployed configs whose content no longer matches what the agent wrote';
+
+-- Log migration completion
+DO $$
+BEGIN
+    RAISE NOTICE 'Migration 021: Node disk and integrity metrics completed successfully';
+END $$;
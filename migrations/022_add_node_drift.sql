@@ -0,0 +1,28 @@
+-- Migration: Add node drift
+-- Description: Store the drift policy of each node and what its last drift check found
+-- Version: 022
+
+ALTER TABLE vps_nodes
+ADD COLUMN IF NOT EXISTS drift_policy VARCHAR(20) DEFAULT 'report';
+
+COMMENT ON COLUMN vps_nodes.drift_policy IS 'What scheduled drift checks do with the drift found: report records it, heal re-applies the desired state';
+
+CREATE TABLE IF NOT EXISTS node_drift (
+    node_id UUID PRIMARY KEY REFERENCES vps_nodes(id) ON DELETE CASCADE,
+    items JSONB,
+    drifted INTEGER NOT NULL DEFAULT 0,
+    heal JSONB,
+    checked_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    healed_at TIMESTAMP WITH TIME ZONE
+);
+
+COMMENT ON COLUMN node_drift.items IS 'Differences from the desired state, the ones left after a heal, e.g. {"items": [{"kind": "firewall", "target": "udp 443 (hysteria2)", "expected": "installed", "actual": "missing"}]}';
+COMMENT ON COLUMN node_drift.heal IS 'Outcome of the last heal, e.g. {"actions": ["reinstall firewall"], "failed": []}';
+
+CREATE INDEX IF NOT EXISTS idx_node_drift_drifted ON node_drift (drifted);
+
+-- Log migration completion
+DO $$
+BEGIN
+    RAISE NOTICE 'Migration 022: Node drift completed successfully';
+END $$;
@@ -0,0 +1,15 @@
+-- Migration: Add per-node outbound policy
+-- Description: Store the named outbounds each node's Hysteria2 sends traffic to and the ACL rules choosing between them
+-- Version: 023
+
+ALTER TABLE vps_nodes
+ADD COLUMN IF NOT EXISTS outbound_policy JSONB;
+
+-- NULL sends traffic out the way the agent is configured to
+COMMENT ON COLUMN vps_nodes.outbound_policy IS 'Outbound policy, e.g. {"outbounds": [{"name": "warp", "type": "warp"}, {"name": "direct", "type": "direct"}], "rules": [{"outbound": "direct", "match": "geoip", "value": "ru"}], "default": "warp"}; NULL uses agent defaults';
+
+-- Log migration completion
+DO $$
+BEGIN
+    RAISE NOTICE 'Migration 023: Node outbound policy completed successfully';
+END $$;
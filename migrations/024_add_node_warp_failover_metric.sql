@@ -0,0 +1,14 @@
+-- Migration: Add WARP failover metric
+-- Description: Record with each heartbeat whether the node moved WARP's traffic to its backup egress
+-- Version: 024
+
+ALTER TABLE node_metrics
+ADD COLUMN IF NOT EXISTS warp_failover_active BOOLEAN DEFAULT false;
+
+COMMENT ON COLUMN node_metrics.warp_failover_active IS 'Traffic meant for WARP leaves through the agent warp_failover.backup while WARP is unhealthy';
+
+-- Log migration completion
+DO $$
+BEGIN
+    RAISE NOTICE 'Migration 024: WARP failover metric completed successfully';
+END $$;
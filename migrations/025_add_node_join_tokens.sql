@@ -0,0 +1,26 @@
+-- Migration: Add node join tokens
+-- Description: Store the single-use tokens new servers exchange for the node auth token
+-- Version: 025
+
+-- Only the SHA-256 of each token is kept; the token itself is in the server's user data
+CREATE TABLE IF NOT EXISTS node_join_tokens (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    token_hash VARCHAR(64) NOT NULL UNIQUE,
+    node_id UUID,
+    provision_id UUID,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE,
+    used_from VARCHAR(45),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+COMMENT ON COLUMN node_join_tokens.node_id IS 'Node the server runs as, for bootstrap of an existing node; the token is refused once the node is deleted';
+COMMENT ON COLUMN node_join_tokens.provision_id IS 'Provisioned server the token was minted for by the autoscaler';
+
+CREATE INDEX IF NOT EXISTS idx_node_join_tokens_expires_at ON node_join_tokens (expires_at);
+
+-- Log migration completion
+DO $$
+BEGIN
+    RAISE NOTICE 'Migration 025: Node join tokens completed successfully';
+END $$;
@@ -0,0 +1,114 @@
+// orchestrator-backup manages the disaster-recovery backups of the orchestrator, using the
+// backup and database settings of orchestrator.yaml and the environment.
+//
+//	orchestrator-backup keygen                      print a new BACKUP_ENCRYPTION_KEY or BACKUP_SIGNING_KEY
+//	orchestrator-backup list                        list the stored backups, newest first
+//	orchestrator-backup create                      back up the database now, without node files
+//	orchestrator-backup restore -name backup -yes   replace the control-plane tables with a backup
+//
+// Restore rebuilds the database of a new orchestrator. Once it runs, RestoreNodes
+// (POST /api/v1/gateway/backups/restore) writes the node files back and pushes the stored
+// configuration to the nodes.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"hysteria2_microservices/orchestrator-service/internal/backup"
+	"hysteria2_microservices/orchestrator-service/internal/config"
+	"hysteria2_microservices/orchestrator-service/internal/database"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	name := flags.String("name", "", "backup to restore, as printed by list")
+	yes := flags.Bool("yes", false, "confirm replacing the current tables")
+	flags.Parse(os.Args[2:])
+
+	if os.Args[1] == "keygen" {
+		key := make([]byte, 32)
+		_, err := rand.Read(key)
+		exitOnError(err)
+		fmt.Println(base64.StdEncoding.EncodeToString(key))
+		return
+	}
+
+	cfg, err := config.LoadConfig()
+	exitOnError(err)
+	store, err := backup.NewStore(cfg.Backup)
+	exitOnError(err)
+	key, err := backup.ParseKey(cfg.Backup.EncryptionKey)
+	exitOnError(err)
+	ctx := context.Background()
+
+	switch os.Args[1] {
+	case "list":
+		objects, err := store.List(ctx, cfg.Backup.Prefix+"backup-")
+		exitOnError(err)
+		for i := len(objects) - 1; i >= 0; i-- {
+			fmt.Printf("%s\t%d\t%s\n", strings.TrimPrefix(objects[i].Key, cfg.Backup.Prefix), objects[i].Size,
+				objects[i].LastModified.Format("2006-01-02 15:04:05"))
+		}
+	case "create":
+		db, err := database.NewDatabase(&cfg.Database)
+		exitOnError(err)
+		defer database.Close(db)
+
+		archive, err := backup.Dump(db.DB)
+		exitOnError(err)
+		data, err := backup.Seal(archive, key)
+		exitOnError(err)
+		objectName := backup.ObjectName(archive.CreatedAt)
+		exitOnError(store.Put(ctx, cfg.Backup.Prefix+objectName, data))
+		fmt.Println(objectName)
+	case "restore":
+		if *name == "" {
+			usage()
+		}
+		data, err := store.Get(ctx, cfg.Backup.Prefix+*name)
+		exitOnError(err)
+		archive, err := backup.Open(data, key)
+		exitOnError(err)
+
+		for _, table := range archive.Tables {
+			fmt.Printf("%s\t%d rows\n", table.Name, len(table.Rows))
+		}
+		fmt.Printf("node files\t%d nodes\n", len(archive.Nodes))
+		if !*yes {
+			fmt.Fprintf(os.Stderr, "Backup of %s; run again with -yes to replace the tables of %s\n",
+				archive.CreatedAt.Format("2006-01-02 15:04:05"), cfg.Database.DBName)
+			os.Exit(1)
+		}
+
+		db, err := database.NewDatabase(&cfg.Database)
+		exitOnError(err)
+		defer database.Close(db)
+
+		exitOnError(backup.Restore(db.DB, archive))
+		fmt.Printf("Database restored; start the orchestrator and restore the nodes with RestoreNodes {\"backup_name\": %q}\n", *name)
+	default:
+		usage()
+	}
+}
+
+func exitOnError(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: orchestrator-backup keygen|list|create|restore [-name backup] [-yes]")
+	os.Exit(2)
+}
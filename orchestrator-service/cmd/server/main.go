@@ -11,17 +11,27 @@ import (
 	"syscall"
 	"time"
 
+	"hysteria2_microservices/orchestrator-service/internal/artifacts"
 	"hysteria2_microservices/orchestrator-service/internal/config"
 	"hysteria2_microservices/orchestrator-service/internal/database"
+	"hysteria2_microservices/orchestrator-service/internal/gateway"
+	"hysteria2_microservices/orchestrator-service/internal/handlers"
+	"hysteria2_microservices/orchestrator-service/internal/leader"
+	"hysteria2_microservices/orchestrator-service/internal/middleware"
 	"hysteria2_microservices/orchestrator-service/internal/models"
+	"hysteria2_microservices/orchestrator-service/internal/provisioning"
 	"hysteria2_microservices/orchestrator-service/internal/repositories"
 	"hysteria2_microservices/orchestrator-service/internal/services"
+	"hysteria2_microservices/pkg/events"
 
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/reflection"
 	"hysteria2_microservices/orchestrator-service/pkg/proto"
 )
@@ -60,12 +70,51 @@ func main() {
 	// Initialize services
 	services := setupServices(repos, logger)
 
+	// Networks agents may reach the gRPC port from
+	allowlist, err := middleware.NewAllowlist(cfg.Security.AgentAllowedCIDRs, repos.NetworkRepo, cfg.Security.BreakGlassToken,
+		cfg.Security.AllowlistLoopback, logger)
+	if err != nil {
+		logger.Fatalf("Failed to configure agent allowlist: %v", err)
+	}
+	if cfg.Gateway.Enabled && !cfg.Security.AllowlistLoopback {
+		logger.Info("The REST gateway calls the gRPC port from loopback; once agent networks are allowlisted, set ALLOWLIST_ALLOW_LOOPBACK or allow 127.0.0.1")
+	}
+
 	// Setup GRPC server
-	grpcServer := setupGRPCServer(services, cfg, logger)
+	healthServer := health.NewServer()
+	grpcServer := setupGRPCServer(services, repos, healthServer, allowlist, cfg, logger)
 	go startGRPCServer(grpcServer, cfg, logger)
 
+	healthCtx, stopHealth := context.WithCancel(context.Background())
+	defer stopHealth()
+	go watchHealth(healthCtx, db, healthServer, logger)
+	go allowlist.Run(healthCtx, time.Duration(cfg.Security.AllowlistRefresh)*time.Second)
+
+	// Only the elected replica runs the schedulers; they are handed the elector through SetElector
+	elector := setupElector(db, cfg.Leader, logger)
+	if elector != nil {
+		go elector.Run(healthCtx)
+	}
+
+	// Heartbeats arrive over the event bus when it is configured; the gRPC heartbeat stays
+	// for agents that do not publish to it
+	bus := setupEventBus(cfg.Events, logger)
+	if bus != nil {
+		bus.Start(healthCtx)
+		defer bus.Stop()
+		handlers.NewHeartbeatConsumer(repos.NodeRepo, repos.MetricRepo, logger).Start(healthCtx, bus)
+	}
+
 	// Setup REST server
 	restServer := setupRESTServer(services, cfg, logger)
+	setupProbes(restServer, healthServer)
+	if cfg.Gateway.Enabled {
+		setupGateway(restServer, cfg, bus, logger)
+	}
+	if cfg.Artifacts.Enabled {
+		setupArtifacts(restServer, cfg, logger)
+	}
+	setupJoin(restServer, db, cfg, logger)
 	go startRESTServer(restServer, cfg, logger)
 
 	// Wait for interrupt signal
@@ -76,6 +125,10 @@ func main() {
 
 	logger.Info("Shutting down servers...")
 
+	// Report NOT_SERVING so load balancers stop routing before the listeners close
+	stopHealth()
+	healthServer.Shutdown()
+
 	// Graceful shutdown with timeout
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
@@ -120,6 +173,7 @@ func setupRepositories(db *database.Database) *repositories.Repositories {
 		MetricRepo:     repositories.NewNodeMetricRepository(db.DB),
 		DeploymentRepo: repositories.NewDeploymentRepository(db.DB),
 		UserRepo:       repositories.NewUserRepository(db.DB),
+		NetworkRepo:    repositories.NewAllowedNetworkRepository(db.DB),
 	}
 }
 
@@ -133,7 +187,7 @@ func setupServices(repos *repositories.Repositories, logger *logrus.Logger) *ser
 	}
 }
 
-func setupGRPCServer(services *services.Services, cfg *config.Config, logger *logrus.Logger) *grpc.Server {
+func setupGRPCServer(services *services.Services, repos *repositories.Repositories, healthServer *health.Server, allowlist *middleware.Allowlist, cfg *config.Config, logger *logrus.Logger) *grpc.Server {
 	// Setup TLS if configured
 	var opts []grpc.ServerOption
 
@@ -145,11 +199,34 @@ func setupGRPCServer(services *services.Services, cfg *config.Config, logger *lo
 		opts = append(opts, grpc.Creds(creds))
 	}
 
+	// Refuse peers outside the agent allowlist, then report handler errors as statuses with
+	// an ErrorCode detail
+	opts = append(opts,
+		grpc.ChainUnaryInterceptor(allowlist.UnaryInterceptor, handlers.ErrorCodeInterceptor),
+		grpc.StreamInterceptor(allowlist.StreamInterceptor),
+	)
+
+	// Node tunnels stay open without RPCs in flight; ping them so connections dropped by NAT
+	// are noticed, and let agents ping as often as every 20 seconds
+	opts = append(opts,
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:    time.Minute,
+			Timeout: 20 * time.Second,
+		}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             20 * time.Second,
+			PermitWithoutStream: true,
+		}),
+	)
+
 	s := grpc.NewServer(opts...)
 
 	// Register services
 	node_management.RegisterMasterServiceServer(s, handlers.NewMasterServiceHandler(services.NodeService, logger))
 	node_management.RegisterAdminServiceServer(s, handlers.NewAdminServiceHandler(services.NodeService, services.MetricsService, logger))
+	node_management.RegisterTunnelServiceServer(s, handlers.NewTunnelHandler(repos.NodeRepo, cfg.Security.NodeAuthToken, logger))
+
+	grpc_health_v1.RegisterHealthServer(s, healthServer)
 
 	// Enable reflection for development
 	reflection.Register(s)
@@ -157,6 +234,85 @@ func setupGRPCServer(services *services.Services, cfg *config.Config, logger *lo
 	return s
 }
 
+// watchHealth keeps the grpc_health_v1 status in step with the database, which every RPC
+// of the orchestrator depends on
+func watchHealth(ctx context.Context, db *database.Database, healthServer *health.Server, logger *logrus.Logger) {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	serving := true
+	for {
+		status := grpc_health_v1.HealthCheckResponse_SERVING
+		if err := pingDatabase(ctx, db); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			status = grpc_health_v1.HealthCheckResponse_NOT_SERVING
+			if serving {
+				logger.Errorf("Database health check failed: %v", err)
+			}
+		} else if !serving {
+			logger.Info("Database health check recovered")
+		}
+		serving = status == grpc_health_v1.HealthCheckResponse_SERVING
+		healthServer.SetServingStatus("", status)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// setupEventBus returns nil when no NATS server is configured
+func setupEventBus(cfg config.EventsConfig, logger *logrus.Logger) *events.Bus {
+	if cfg.URL == "" {
+		return nil
+	}
+	bus, err := events.New(events.Config{
+		Options: events.Options{
+			URL:      cfg.URL,
+			Name:     "orchestrator-service",
+			Token:    cfg.Token,
+			User:     cfg.User,
+			Password: cfg.Password,
+		},
+		Source: "orchestrator-service",
+		MaxAge: time.Duration(cfg.Retention) * time.Hour,
+		Outbox: cfg.Outbox,
+		OnError: func(err error) {
+			logger.Errorf("Event bus error: %v", err)
+		},
+	})
+	if err != nil {
+		logger.Fatalf("Failed to set up the event bus: %v", err)
+	}
+	return bus
+}
+
+// setupElector returns nil, which always leads, when leader election is disabled
+func setupElector(db *database.Database, cfg config.LeaderConfig, logger *logrus.Logger) *leader.Elector {
+	if !cfg.Enabled {
+		return nil
+	}
+	sqlDB, err := db.DB.DB()
+	if err != nil {
+		logger.Fatalf("Failed to set up leader election: %v", err)
+	}
+	return leader.New(sqlDB, "orchestrator-scheduler", time.Duration(cfg.Interval)*time.Second, logger)
+}
+
+func pingDatabase(ctx context.Context, db *database.Database) error {
+	sqlDB, err := db.DB.DB()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	return sqlDB.PingContext(ctx)
+}
+
 func startGRPCServer(s *grpc.Server, cfg *config.Config, logger *logrus.Logger) {
 	addr := fmt.Sprintf("%s:%d", cfg.GRPC.Host, cfg.GRPC.Port)
 	lis, err := net.Listen("tcp", addr)
@@ -188,6 +344,87 @@ func setupRESTServer(services *services.Services, cfg *config.Config, logger *lo
 	return r
 }
 
+// setupProbes serves the liveness and readiness probes of Kubernetes. Readiness follows the
+// gRPC health status, which tracks the database and turns NOT_SERVING on shutdown.
+func setupProbes(r *gin.Engine, healthServer *health.Server) {
+	r.GET("/healthz", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+	r.GET("/readyz", func(c *gin.Context) {
+		resp, err := healthServer.Check(c.Request.Context(), &grpc_health_v1.HealthCheckRequest{})
+		if err != nil || resp.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "not serving"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "serving"})
+	})
+}
+
+// setupGateway exposes the gRPC services over REST behind the same JWT auth as api-service
+// Changes made through it are published as audit events when the event bus is configured.
+func setupGateway(r *gin.Engine, cfg *config.Config, bus *events.Bus, logger *logrus.Logger) {
+	// Dial the local gRPC listener rather than the bind address
+	endpoint := fmt.Sprintf("127.0.0.1:%d", cfg.GRPC.Port)
+
+	var creds credentials.TransportCredentials
+	if cfg.GRPC.HostKey != "" && cfg.GRPC.CertKey != "" {
+		tlsCreds, err := credentials.NewClientTLSFromFile(cfg.GRPC.CertKey, "")
+		if err != nil {
+			logger.Fatalf("Failed to load gateway TLS credentials: %v", err)
+		}
+		creds = tlsCreds
+	}
+
+	gw, err := gateway.New(context.Background(), endpoint, creds, logger,
+		node_management.RegisterMasterServiceHandlerFromEndpoint,
+		node_management.RegisterAdminServiceHandlerFromEndpoint,
+	)
+	if err != nil {
+		logger.Fatalf("Failed to setup REST gateway: %v", err)
+	}
+
+	var jwks *middleware.JWKS
+	switch {
+	case cfg.Security.JWKSURL != "":
+		jwks = middleware.NewJWKS(cfg.Security.JWKSURL)
+	case cfg.Security.JWTSecret != "":
+		logger.Warn("JWKS_URL is not set, only tokens signed with JWT_SECRET are accepted")
+	default:
+		logger.Fatal("REST gateway needs JWKS_URL or JWT_SECRET to verify tokens; set one or GATEWAY_ENABLED=false")
+	}
+	group := r.Group(cfg.Gateway.PathPrefix, middleware.JWTAuth(cfg.Security.JWTSecret, jwks), middleware.RequireRole("admin"))
+	if bus != nil {
+		group.Use(middleware.Audit(bus, logger))
+	}
+	group.Any("/*path", gw.Handler())
+
+	logger.Infof("REST gateway enabled on %s", cfg.Gateway.PathPrefix)
+}
+
+// setupArtifacts serves the mirrored release files to agents in offline mode, behind the
+// node auth token rather than user JWTs
+func setupArtifacts(r *gin.Engine, cfg *config.Config, logger *logrus.Logger) {
+	store, err := artifacts.New(cfg.Artifacts.Dir, logger)
+	if err != nil {
+		logger.Fatalf("Failed to setup artifact store: %v", err)
+	}
+	if cfg.Security.NodeAuthToken == "" {
+		logger.Warn("Artifact store enabled without NODE_AUTH_TOKEN; all downloads will be rejected")
+	}
+
+	group := r.Group("/artifacts", middleware.NodeAuth(cfg.Security.NodeAuthToken))
+	group.GET("/*path", store.Handler())
+
+	logger.Infof("Artifact store serving %s on /artifacts", cfg.Artifacts.Dir)
+}
+
+// setupJoin lets new servers exchange the join token in their user data for the node auth
+// token; the join token is the only credential the request carries
+func setupJoin(r *gin.Engine, db *database.Database, cfg *config.Config, logger *logrus.Logger) {
+	joinTokens := provisioning.NewJoinTokens(db.DB, cfg.Security.NodeAuthToken, logger)
+	r.POST("/join", joinTokens.Handler())
+}
+
 func startRESTServer(r *gin.Engine, cfg *config.Config, logger *logrus.Logger) {
 	addr := fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.Port)
 	logger.Infof("Starting REST server on %s", addr)
@@ -0,0 +1,175 @@
+package artifacts
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// ChecksumsFile is generated from the store contents; agents verify every download against it
+const ChecksumsFile = "SHA256SUMS"
+
+// Store serves release files that operators mirror into a directory, so agents in
+// networks that block GitHub and the Cloudflare package repository can install from the
+// orchestrator instead. The layout is <component>/<version>/<asset> plus a
+// <component>/latest file naming the default version, e.g.
+//
+//	hysteria2/latest
+//	hysteria2/v2.6.1/hysteria-linux-amd64
+//	xray/v25.1.30/Xray-linux-64.zip
+//	warp/cloudflare-warp-amd64.deb
+//	decoy/site.tar.gz
+type Store struct {
+	dir    string
+	logger *logrus.Logger
+
+	// mu guards the checksum cache, keyed by path and invalidated by size and mtime
+	mu     sync.Mutex
+	hashes map[string]fileHash
+}
+
+type fileHash struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+// New creates a store over dir, which must exist
+func New(dir string, logger *logrus.Logger) (*Store, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("artifact directory: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("artifact directory %s is not a directory", dir)
+	}
+	return &Store{
+		dir:    dir,
+		logger: logger,
+		hashes: make(map[string]fileHash),
+	}, nil
+}
+
+// Handler serves GET /*path from gin; it must run after middleware.NodeAuth
+func (s *Store) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := strings.TrimPrefix(c.Param("path"), "/")
+
+		if name == ChecksumsFile {
+			listing, err := s.Checksums()
+			if err != nil {
+				s.logger.Errorf("Failed to compute artifact checksums: %v", err)
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute checksums"})
+				return
+			}
+			c.Data(http.StatusOK, "text/plain; charset=utf-8", listing)
+			return
+		}
+
+		// ValidPath rejects "..", absolute and empty paths before anything touches the disk
+		if !fs.ValidPath(name) || name == "." {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Artifact not found"})
+			return
+		}
+		f, err := os.Open(filepath.Join(s.dir, filepath.FromSlash(name)))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Artifact not found"})
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Artifact not found"})
+			return
+		}
+
+		s.logger.Debugf("Serving artifact %s to %s", name, c.ClientIP())
+		c.Header("Content-Type", "application/octet-stream")
+		http.ServeContent(c.Writer, c.Request, info.Name(), info.ModTime(), f)
+	}
+}
+
+// Checksums lists every regular file in the store as "<sha256>  <path>" lines, sorted by
+// path, in the format of sha256sum
+func (s *Store) Checksums() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seen := make(map[string]bool)
+	var names []string
+	err := filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if name == ChecksumsFile {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		cached, ok := s.hashes[name]
+		if !ok || cached.size != info.Size() || !cached.modTime.Equal(info.ModTime()) {
+			sum, err := hashFile(path)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			s.hashes[name] = fileHash{size: info.Size(), modTime: info.ModTime(), sum: sum}
+		}
+		seen[name] = true
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for name := range s.hashes {
+		if !seen[name] {
+			delete(s.hashes, name)
+		}
+	}
+
+	sort.Strings(names)
+	var listing bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&listing, "%s  %s\n", s.hashes[name].sum, name)
+	}
+	return listing.Bytes(), nil
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
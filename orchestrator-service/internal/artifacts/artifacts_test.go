@@ -0,0 +1,122 @@
+package artifacts
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func sum(data string) string {
+	hash := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(hash[:])
+}
+
+// newTestStore mirrors files into a store directory and serves it the way the orchestrator does
+func newTestStore(t *testing.T, files map[string]string) (*Store, *httptest.Server) {
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	store, err := New(dir, logger)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	r := gin.New()
+	r.GET("/artifacts/*path", store.Handler())
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	return store, server
+}
+
+func get(t *testing.T, url string) (int, string) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestNewRequiresDirectory(t *testing.T) {
+	if _, err := New(filepath.Join(t.TempDir(), "missing"), logrus.New()); err == nil {
+		t.Error("created a store over a missing directory")
+	}
+	file := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(file, nil, 0644)
+	if _, err := New(file, logrus.New()); err == nil {
+		t.Error("created a store over a file")
+	}
+}
+
+func TestChecksums(t *testing.T) {
+	store, _ := newTestStore(t, map[string]string{
+		"xray/latest":                           "v25.1.30\n",
+		"hysteria2/v2.6.1/hysteria-linux-amd64": "binary",
+		ChecksumsFile:                           "stale listing",
+	})
+
+	listing, err := store.Checksums()
+	if err != nil {
+		t.Fatalf("Checksums: %v", err)
+	}
+	want := sum("binary") + "  hysteria2/v2.6.1/hysteria-linux-amd64\n" + sum("v25.1.30\n") + "  xray/latest\n"
+	if string(listing) != want {
+		t.Errorf("listing:\n%s\nwant, sorted and without a mirrored SHA256SUMS:\n%s", listing, want)
+	}
+
+	// A replaced file is hashed again even though the cache holds its old sum
+	path := filepath.Join(store.dir, "xray", "latest")
+	os.WriteFile(path, []byte("v25.2.1\n"), 0644)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path, later, later)
+	os.Remove(filepath.Join(store.dir, "hysteria2", "v2.6.1", "hysteria-linux-amd64"))
+
+	listing, _ = store.Checksums()
+	if want := sum("v25.2.1\n") + "  xray/latest\n"; string(listing) != want {
+		t.Errorf("listing after changes:\n%s\nwant:\n%s", listing, want)
+	}
+	if len(store.hashes) != 1 {
+		t.Errorf("cache holds %d entries, want removed files dropped", len(store.hashes))
+	}
+}
+
+func TestHandler(t *testing.T) {
+	_, server := newTestStore(t, map[string]string{
+		"decoy/site.tar.gz": "archive",
+	})
+	if status, body := get(t, server.URL+"/artifacts/decoy/site.tar.gz"); status != http.StatusOK || body != "archive" {
+		t.Errorf("GET site.tar.gz = %d %q", status, body)
+	}
+	if status, body := get(t, server.URL+"/artifacts/SHA256SUMS"); status != http.StatusOK || body != sum("archive")+"  decoy/site.tar.gz\n" {
+		t.Errorf("GET SHA256SUMS = %d %q", status, body)
+	}
+
+	for _, path := range []string{"/artifacts/", "/artifacts/decoy", "/artifacts/decoy/missing", "/artifacts/decoy/..%2F..%2Fetc%2Fpasswd"} {
+		if status, _ := get(t, server.URL+path); status != http.StatusNotFound {
+			t.Errorf("GET %s = %d, want 404", path, status)
+		}
+	}
+}
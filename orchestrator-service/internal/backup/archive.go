@@ -0,0 +1,345 @@
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ArchiveVersion is written to every archive; Open refuses archives of a later version
+const ArchiveVersion = 1
+
+// archiveMagic starts every sealed archive, followed by the GCM nonce and ciphertext
+const archiveMagic = "HVB1"
+
+// Tables are the control-plane tables a backup holds, parents before the tables
+// referencing them. Telemetry (metrics, traffic, probe and speedtest history) and live
+// sessions are left out; they are rebuilt by running nodes. Tables another service has not
+// created in this database are skipped.
+var Tables = []string{
+	"users",
+	"devices",
+	"resellers",
+	"user_identities",
+	"jwt_signing_keys",
+	"hysteria_configs",
+	"xray_configs",
+	"vouchers",
+	"voucher_redemptions",
+	"report_schedules",
+	"allowed_networks",
+	"asn_protocol_policies",
+	"data_erasures",
+	"vps_nodes",
+	"node_assignments",
+	"deployments",
+	"port_forwards",
+	"filter_lists",
+	"filter_assignments",
+	"rollouts",
+	"maintenance_windows",
+	"config_templates",
+	"config_template_assignments",
+	"obfuscation_presets",
+	"obfuscation_experiments",
+	"uploaded_certificates",
+	"scaling_policies",
+	"provisioned_servers",
+}
+
+// Rebuilt are the tables referencing backed up ones that a restore may empty: telemetry,
+// sessions and node reports that running nodes and clients fill again. TRUNCATE ... CASCADE
+// reaching any other table fails the restore rather than losing its rows.
+var Rebuilt = []string{
+	"sessions",
+	"traffic_stats",
+	"traffic_stats_hourly",
+	"connection_logs",
+	"client_telemetry",
+	"node_metrics",
+	"node_certificates",
+	"node_drift",
+	"node_speedtests",
+	"probe_reports",
+	"tls_reports",
+	"experiment_samples",
+}
+
+// Archive is the content of one backup
+type Archive struct {
+	Version     int         `json:"version"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Tables      []TableDump `json:"tables"`
+	Nodes       []NodeFiles `json:"nodes,omitempty"`
+	FailedNodes []string    `json:"failed_nodes,omitempty"` // nodes whose files could not be collected
+}
+
+// TableDump holds the rows of a table as row_to_json objects
+type TableDump struct {
+	Name string            `json:"name"`
+	Rows []json.RawMessage `json:"rows"`
+}
+
+// NodeFiles are the critical files collected from one node
+type NodeFiles struct {
+	NodeID   string     `json:"node_id"`
+	NodeName string     `json:"node_name"`
+	Files    []NodeFile `json:"files"`
+}
+
+// NodeFile is a file as the agent returned it
+type NodeFile struct {
+	Path    string `json:"path"`
+	Mode    uint32 `json:"mode"`
+	Content []byte `json:"content"`
+}
+
+// ObjectName is the key, relative to the configured prefix, of a backup taken at t. Names
+// sort by time.
+func ObjectName(t time.Time) string {
+	return "backup-" + t.UTC().Format("20060102T150405Z") + ".hvb"
+}
+
+// Node returns the files backed up for a node
+func (a *Archive) Node(nodeID string) (*NodeFiles, bool) {
+	for i := range a.Nodes {
+		if strings.EqualFold(a.Nodes[i].NodeID, nodeID) {
+			return &a.Nodes[i], true
+		}
+	}
+	return nil, false
+}
+
+// Dump reads the backed up tables in one repeatable-read transaction, so rows referencing
+// each other are consistent
+func Dump(db *gorm.DB) (*Archive, error) {
+	archive := &Archive{Version: ArchiveVersion, CreatedAt: time.Now().UTC()}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for _, table := range Tables {
+			exists, err := tableExists(tx, table)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				continue
+			}
+
+			dump, err := dumpTable(tx, table)
+			if err != nil {
+				return err
+			}
+			archive.Tables = append(archive.Tables, *dump)
+		}
+		return nil
+	}, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	return archive, nil
+}
+
+// Restore replaces the content of the backed up tables with the archive's rows in one
+// transaction. The schema must already be migrated to the version the backup was taken
+// on; columns missing from the backup are left NULL. Tables referencing the restored ones
+// are emptied with them, which is refused unless they are in the archive or Rebuilt.
+func Restore(db *gorm.DB, archive *Archive) error {
+	if archive.Version > ArchiveVersion {
+		return fmt.Errorf("archive version %d is newer than supported version %d", archive.Version, ArchiveVersion)
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		var tables []string
+		for _, dump := range archive.Tables {
+			exists, err := tableExists(tx, dump.Name)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				return fmt.Errorf("table %s does not exist; run the migrations first", dump.Name)
+			}
+			tables = append(tables, fmt.Sprintf("%q", dump.Name))
+		}
+		if len(tables) == 0 {
+			return nil
+		}
+		referencing, err := referencingTables(tx, archive.tableNames())
+		if err != nil {
+			return err
+		}
+		if err := checkCascade(archive, referencing); err != nil {
+			return err
+		}
+		if err := tx.Exec("TRUNCATE TABLE " + strings.Join(tables, ", ") + " CASCADE").Error; err != nil {
+			return fmt.Errorf("failed to clear tables: %w", err)
+		}
+
+		for _, dump := range archive.Tables {
+			insert := fmt.Sprintf(`INSERT INTO %[1]q SELECT * FROM json_populate_record(NULL::%[1]q, ?::json)`, dump.Name)
+			for _, row := range dump.Rows {
+				if err := tx.Exec(insert, string(row)).Error; err != nil {
+					return fmt.Errorf("failed to restore %s: %w", dump.Name, err)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (a *Archive) tableNames() []string {
+	names := make([]string, 0, len(a.Tables))
+	for _, dump := range a.Tables {
+		names = append(names, dump.Name)
+	}
+	return names
+}
+
+// referencingTables lists the tables TRUNCATE ... CASCADE on tables would reach, through
+// foreign keys, directly or through other referencing tables. Partitions are named by their
+// partitioned table.
+func referencingTables(tx *gorm.DB, tables []string) ([]string, error) {
+	var names []string
+	err := tx.Raw(`
+		WITH RECURSIVE refs(rel) AS (
+			SELECT conrelid FROM pg_constraint
+			WHERE contype = 'f' AND confrelid = ANY(?::text[]::regclass[])
+			UNION
+			SELECT c.conrelid FROM pg_constraint c JOIN refs ON c.confrelid = refs.rel
+			WHERE c.contype = 'f'
+		)
+		SELECT DISTINCT (SELECT relname FROM pg_class WHERE oid = coalesce(pg_partition_root(rel), rel))
+		FROM refs`, "{"+strings.Join(tables, ",")+"}").Scan(&names).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up referencing tables: %w", err)
+	}
+	return names, nil
+}
+
+// checkCascade refuses a restore that would empty a table the archive does not hold and
+// that is not Rebuilt
+func checkCascade(archive *Archive, referencing []string) error {
+	covered := make(map[string]bool)
+	for _, name := range append(archive.tableNames(), Rebuilt...) {
+		covered[name] = true
+	}
+	var lost []string
+	for _, name := range referencing {
+		if !covered[name] {
+			lost = append(lost, name)
+		}
+	}
+	if len(lost) > 0 {
+		sort.Strings(lost)
+		return fmt.Errorf("restoring would empty %s, which the archive does not hold", strings.Join(lost, ", "))
+	}
+	return nil
+}
+
+func dumpTable(tx *gorm.DB, table string) (*TableDump, error) {
+	rows, err := tx.Raw(fmt.Sprintf(`SELECT row_to_json(t)::text FROM %q t`, table)).Rows()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	dump := &TableDump{Name: table, Rows: []json.RawMessage{}}
+	for rows.Next() {
+		var row string
+		if err := rows.Scan(&row); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", table, err)
+		}
+		dump.Rows = append(dump.Rows, json.RawMessage(row))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", table, err)
+	}
+	return dump, nil
+}
+
+func tableExists(tx *gorm.DB, table string) (bool, error) {
+	var exists bool
+	if err := tx.Raw(`SELECT to_regclass(?) IS NOT NULL`, table).Scan(&exists).Error; err != nil {
+		return false, fmt.Errorf("failed to look up table %s: %w", table, err)
+	}
+	return exists, nil
+}
+
+// ParseKey decodes a base64 AES-256 backup encryption key
+func ParseKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("backup encryption key is not valid base64: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("backup encryption key must be 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
+// Seal compresses and encrypts an archive with AES-256-GCM
+func Seal(archive *Archive, key []byte) ([]byte, error) {
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if err := json.NewEncoder(zw).Encode(archive); err != nil {
+		return nil, fmt.Errorf("failed to encode archive: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress archive: %w", err)
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := append([]byte(archiveMagic), nonce...)
+	return gcm.Seal(sealed, nonce, compressed.Bytes(), []byte(archiveMagic)), nil
+}
+
+// Open decrypts and decodes an archive written by Seal
+func Open(data, key []byte) (*Archive, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(data, []byte(archiveMagic)) || len(data) < len(archiveMagic)+gcm.NonceSize() {
+		return nil, fmt.Errorf("not a backup archive")
+	}
+	data = data[len(archiveMagic):]
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], []byte(archiveMagic))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt archive: wrong encryption key or corrupted data")
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(plain))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress archive: %w", err)
+	}
+	defer zr.Close()
+	var archive Archive
+	if err := json.NewDecoder(zr).Decode(&archive); err != nil {
+		return nil, fmt.Errorf("failed to decode archive: %w", err)
+	}
+	return &archive, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,67 @@
+package backup
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckCascade(t *testing.T) {
+	archive := &Archive{Version: ArchiveVersion, Tables: []TableDump{{Name: "users"}, {Name: "devices"}, {Name: "resellers"}}}
+
+	tests := []struct {
+		name        string
+		referencing []string
+		wantLost    string // empty when the restore may go ahead
+	}{
+		{"only archived tables", []string{"devices", "resellers"}, ""},
+		{"rebuilt telemetry", []string{"devices", "sessions", "traffic_stats"}, ""},
+		{"table missing from the archive", []string{"devices", "user_identities", "sessions"}, "user_identities"},
+		{"several missing tables", []string{"voucher_redemptions", "port_forwards"}, "port_forwards, voucher_redemptions"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkCascade(archive, tt.referencing)
+			if tt.wantLost == "" {
+				if err != nil {
+					t.Fatalf("refused: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), "empty "+tt.wantLost+",") {
+				t.Errorf("error = %v, want %s named", err, tt.wantLost)
+			}
+		})
+	}
+}
+
+// Every table is restored after the tables it references
+func TestTablesParentFirst(t *testing.T) {
+	parents := map[string][]string{
+		"devices":                     {"users"},
+		"resellers":                   {"users"},
+		"user_identities":             {"users"},
+		"hysteria_configs":            {"users", "devices"},
+		"xray_configs":                {"users", "devices"},
+		"voucher_redemptions":         {"vouchers", "users"},
+		"node_assignments":            {"users", "vps_nodes"},
+		"deployments":                 {"vps_nodes"},
+		"port_forwards":               {"users", "vps_nodes"},
+		"filter_assignments":          {"filter_lists", "vps_nodes"},
+		"config_template_assignments": {"config_templates"},
+		"provisioned_servers":         {"scaling_policies", "vps_nodes"},
+	}
+	position := make(map[string]int)
+	for i, table := range Tables {
+		if _, ok := position[table]; ok {
+			t.Errorf("%s listed twice", table)
+		}
+		position[table] = i
+	}
+	for table, refs := range parents {
+		for _, parent := range refs {
+			if position[parent] >= position[table] {
+				t.Errorf("%s is restored before its parent %s", table, parent)
+			}
+		}
+	}
+}
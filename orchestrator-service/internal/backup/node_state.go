@@ -0,0 +1,190 @@
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"hysteria2_microservices/orchestrator-service/internal/models"
+)
+
+// NodeStateVersion is written to every node state archive
+const NodeStateVersion = 1
+
+// nodeStateMagic starts every node state archive, followed by the HMAC-SHA256 of the magic
+// and the compressed state
+const nodeStateMagic = "HNS1"
+
+// MaxNodeState bounds both a node state archive and the state it decompresses to, so an
+// archive cannot exhaust memory before or after its signature is checked
+const MaxNodeState = 32 << 20
+
+// NodeState is everything that makes up a node: its identity (node key, certificates,
+// Reality keys), server configs, ACLs, firewall rules and the settings stored for it. It
+// is imported to rebuild the node or to clone it onto a new VPS.
+type NodeState struct {
+	Version   int            `json:"version"`
+	CreatedAt time.Time      `json:"created_at"`
+	NodeID    string         `json:"node_id"`
+	NodeName  string         `json:"node_name"`
+	Settings  NodeSettings   `json:"settings"`
+	Files     []NodeFile     `json:"files"`
+	Firewall  *FirewallState `json:"firewall,omitempty"`
+}
+
+// NodeSettings are the stored node settings the agent's configuration is pushed from
+type NodeSettings struct {
+	PrimaryDomain     string       `json:"primary_domain"`
+	SNIEnabled        bool         `json:"sni_enabled"`
+	SNIDomains        models.JSONB `json:"sni_domains"`
+	CertificatePath   string       `json:"certificate_path"`
+	KeyPath           string       `json:"key_path"`
+	SNIAutoRenew      bool         `json:"sni_auto_renew"`
+	SNIEmail          string       `json:"sni_email"`
+	Masquerade        models.JSONB `json:"masquerade"`
+	CertificateMode   models.JSONB `json:"certificate_mode,omitempty"`
+	ObfuscationPreset string       `json:"obfuscation_preset,omitempty"`
+	Obfuscation       models.JSONB `json:"obfuscation,omitempty"`
+	Protocols         models.JSONB `json:"protocols"`
+	DNSPolicy         models.JSONB `json:"dns_policy"`
+	QoSPolicy         models.JSONB `json:"qos_policy"`
+	OutboundPolicy    models.JSONB `json:"outbound_policy,omitempty"`
+	NodeGroup         string       `json:"node_group"`
+}
+
+// FirewallState is the operator ruleset applied on the node, without the agent's baseline
+type FirewallState struct {
+	Backend string         `json:"backend"`
+	Rules   []FirewallRule `json:"rules"`
+}
+
+// FirewallRule is one allowed port range
+type FirewallRule struct {
+	Protocol string   `json:"protocol"`
+	Ports    string   `json:"ports"`
+	Sources  []string `json:"sources,omitempty"`
+	Comment  string   `json:"comment,omitempty"`
+}
+
+// NodeSettingsOf returns the settings stored for a node
+func NodeSettingsOf(node *models.VPSNode) NodeSettings {
+	return NodeSettings{
+		PrimaryDomain:     node.PrimaryDomain,
+		SNIEnabled:        node.SNIEnabled,
+		SNIDomains:        node.SNIDomains,
+		CertificatePath:   node.CertificatePath,
+		KeyPath:           node.KeyPath,
+		SNIAutoRenew:      node.SNIAutoRenew,
+		SNIEmail:          node.SNIEmail,
+		Masquerade:        node.Masquerade,
+		CertificateMode:   node.CertificateMode,
+		ObfuscationPreset: node.ObfuscationPreset,
+		Obfuscation:       node.Obfuscation,
+		Protocols:         node.Protocols,
+		DNSPolicy:         node.DNSPolicy,
+		QoSPolicy:         node.QoSPolicy,
+		OutboundPolicy:    node.OutboundPolicy,
+		NodeGroup:         node.NodeGroup,
+	}
+}
+
+// Updates returns the settings as column updates for the node taking them over
+func (s NodeSettings) Updates() map[string]interface{} {
+	return map[string]interface{}{
+		"primary_domain":     s.PrimaryDomain,
+		"sni_enabled":        s.SNIEnabled,
+		"sni_domains":        s.SNIDomains,
+		"certificate_path":   s.CertificatePath,
+		"key_path":           s.KeyPath,
+		"sni_auto_renew":     s.SNIAutoRenew,
+		"sni_email":          s.SNIEmail,
+		"masquerade":         s.Masquerade,
+		"certificate_mode":   s.CertificateMode,
+		"obfuscation_preset": s.ObfuscationPreset,
+		"obfuscation":        s.Obfuscation,
+		"protocols":          s.Protocols,
+		"dns_policy":         s.DNSPolicy,
+		"qos_policy":         s.QoSPolicy,
+		"outbound_policy":    s.OutboundPolicy,
+		"node_group":         s.NodeGroup,
+	}
+}
+
+// ParseSigningKey decodes a base64 node state signing key
+func ParseSigningKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("node state signing key is not valid base64: %w", err)
+	}
+	if len(key) < 32 {
+		return nil, fmt.Errorf("node state signing key must be at least 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
+// SignNodeState compresses a node state and signs it with key. The archive is signed, not
+// encrypted: it holds the node's private keys and must be stored like one.
+func SignNodeState(state *NodeState, key []byte) ([]byte, error) {
+	var payload bytes.Buffer
+	zw := gzip.NewWriter(&payload)
+	if err := json.NewEncoder(zw).Encode(state); err != nil {
+		return nil, fmt.Errorf("failed to encode node state: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress node state: %w", err)
+	}
+
+	archive := append([]byte(nodeStateMagic), nodeStateSignature(payload.Bytes(), key)...)
+	return append(archive, payload.Bytes()...), nil
+}
+
+// OpenNodeState verifies the signature of an archive written by SignNodeState and decodes it
+func OpenNodeState(archive, key []byte) (*NodeState, error) {
+	if !bytes.HasPrefix(archive, []byte(nodeStateMagic)) || len(archive) < len(nodeStateMagic)+sha256.Size {
+		return nil, fmt.Errorf("not a node state archive")
+	}
+	if len(archive) > MaxNodeState {
+		return nil, fmt.Errorf("node state archive exceeds %d bytes", MaxNodeState)
+	}
+	signature := archive[len(nodeStateMagic) : len(nodeStateMagic)+sha256.Size]
+	payload := archive[len(nodeStateMagic)+sha256.Size:]
+
+	if !hmac.Equal(signature, nodeStateSignature(payload, key)) {
+		return nil, fmt.Errorf("node state signature does not match, the archive was modified or signed with another key")
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress node state: %w", err)
+	}
+	defer zr.Close()
+	data, err := io.ReadAll(io.LimitReader(zr, MaxNodeState+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress node state: %w", err)
+	}
+	if len(data) > MaxNodeState {
+		return nil, fmt.Errorf("node state exceeds %d bytes", MaxNodeState)
+	}
+	var state NodeState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to decode node state: %w", err)
+	}
+	if state.Version > NodeStateVersion {
+		return nil, fmt.Errorf("node state version %d is newer than supported version %d", state.Version, NodeStateVersion)
+	}
+	return &state, nil
+}
+
+func nodeStateSignature(payload, key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(nodeStateMagic))
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
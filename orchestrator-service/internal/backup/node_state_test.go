@@ -0,0 +1,106 @@
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"hysteria2_microservices/orchestrator-service/internal/models"
+)
+
+var testSigningKey = bytes.Repeat([]byte("k"), 32)
+
+func testNodeState() *NodeState {
+	return &NodeState{
+		Version:   NodeStateVersion,
+		CreatedAt: time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC),
+		NodeID:    "0b6f3e2a-5c4d-4e3f-8a9b-1c2d3e4f5a6b",
+		NodeName:  "eu-frankfurt-1",
+		Settings: NodeSettings{
+			PrimaryDomain: "vpn.example.com",
+			SNIEnabled:    true,
+			SNIDomains:    models.JSONB{"domains": []interface{}{"a.example.com", "b.example.com"}},
+			NodeGroup:     "eu",
+		},
+		Files: []NodeFile{{Path: "/etc/hysteria/server.yaml", Mode: 0600, Content: []byte("listen: :443\n")}},
+		Firewall: &FirewallState{
+			Backend: "nftables",
+			Rules:   []FirewallRule{{Protocol: "udp", Ports: "443", Comment: "hysteria2"}},
+		},
+	}
+}
+
+// signedArchive signs payload as SignNodeState would, for payloads it cannot produce
+func signedArchive(payload []byte) []byte {
+	archive := append([]byte(nodeStateMagic), nodeStateSignature(payload, testSigningKey)...)
+	return append(archive, payload...)
+}
+
+func TestNodeStateRoundTrip(t *testing.T) {
+	state := testNodeState()
+	archive, err := SignNodeState(state, testSigningKey)
+	if err != nil {
+		t.Fatalf("SignNodeState: %v", err)
+	}
+	got, err := OpenNodeState(archive, testSigningKey)
+	if err != nil {
+		t.Fatalf("OpenNodeState: %v", err)
+	}
+	if !reflect.DeepEqual(got, state) {
+		t.Errorf("OpenNodeState = %+v, want %+v", got, state)
+	}
+}
+
+func TestOpenNodeStateRejects(t *testing.T) {
+	archive, err := SignNodeState(testNodeState(), testSigningKey)
+	if err != nil {
+		t.Fatalf("SignNodeState: %v", err)
+	}
+	tamper := func(offset int) []byte {
+		modified := append([]byte{}, archive...)
+		modified[offset] ^= 0xff
+		return modified
+	}
+
+	var bomb bytes.Buffer
+	zw := gzip.NewWriter(&bomb)
+	zw.Write(make([]byte, MaxNodeState+1))
+	zw.Close()
+	newer, err := SignNodeState(&NodeState{Version: NodeStateVersion + 1}, testSigningKey)
+	if err != nil {
+		t.Fatalf("SignNodeState: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		archive []byte
+		key     []byte
+		wantErr string
+	}{
+		{"tampered signature", tamper(len(nodeStateMagic)), testSigningKey, "signature does not match"},
+		{"tampered payload", tamper(len(archive) - 1), testSigningKey, "signature does not match"},
+		{"wrong key", archive, bytes.Repeat([]byte("x"), 32), "signature does not match"},
+		{"truncated archive", archive[:len(archive)-8], testSigningKey, "signature does not match"},
+		{"truncated signature", archive[:len(nodeStateMagic)+sha256.Size/2], testSigningKey, "not a node state archive"},
+		{"no magic", archive[len(nodeStateMagic):], testSigningKey, "not a node state archive"},
+		{"signed truncated payload", signedArchive(archive[len(nodeStateMagic)+sha256.Size : len(archive)-8]), testSigningKey, "failed to decompress"},
+		{"oversize archive", append(append([]byte{}, archive...), make([]byte, MaxNodeState)...), testSigningKey, "archive exceeds"},
+		{"oversize state", signedArchive(bomb.Bytes()), testSigningKey, "node state exceeds"},
+		{"newer version", newer, testSigningKey, "is newer than supported"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, err := OpenNodeState(tt.archive, tt.key)
+			if err == nil {
+				t.Fatalf("OpenNodeState = %+v, want error", state)
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package cloudflare
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"hysteria2_microservices/orchestrator-service/internal/config"
+)
+
+const requestTimeout = 30 * time.Second
+
+// Record is a DNS record of the zone
+type Record struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl"` // seconds, 1 lets Cloudflare choose
+	Proxied bool   `json:"proxied"`
+	Comment string `json:"comment,omitempty"`
+}
+
+// Client manages the DNS records of one zone through the Cloudflare v4 API
+type Client struct {
+	baseURL  string
+	apiToken string
+	zoneID   string
+	client   *http.Client
+}
+
+type apiResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result     json.RawMessage `json:"result"`
+	ResultInfo struct {
+		Page       int `json:"page"`
+		TotalPages int `json:"total_pages"`
+	} `json:"result_info"`
+}
+
+// NewClient creates a client for the zone configured in cfg
+func NewClient(cfg config.CloudflareConfig) (*Client, error) {
+	if cfg.APIToken == "" || cfg.ZoneID == "" {
+		return nil, fmt.Errorf("cloudflare API token and zone ID must be set")
+	}
+	return newClient(cfg.APIURL, cfg.ZoneID, cfg.APIToken), nil
+}
+
+// NewClientForDomain creates a client for the zone of cfg.Zones with the longest name
+// the domain belongs to
+func NewClientForDomain(cfg config.CloudflareConfig, domain string) (*Client, error) {
+	domain = strings.TrimSuffix(strings.ToLower(strings.TrimPrefix(domain, "*.")), ".")
+
+	var zone *config.CloudflareZone
+	longest := 0
+	for i := range cfg.Zones {
+		name := strings.TrimSuffix(strings.ToLower(cfg.Zones[i].Name), ".")
+		if name == "" || (domain != name && !strings.HasSuffix(domain, "."+name)) {
+			continue
+		}
+		if len(name) > longest {
+			zone, longest = &cfg.Zones[i], len(name)
+		}
+	}
+	if zone == nil {
+		return nil, fmt.Errorf("no cloudflare zone configured for %s", domain)
+	}
+
+	token := zone.APIToken
+	if token == "" {
+		token = cfg.APIToken
+	}
+	if token == "" || zone.ZoneID == "" {
+		return nil, fmt.Errorf("cloudflare API token and zone ID of zone %s must be set", zone.Name)
+	}
+	return newClient(cfg.APIURL, zone.ZoneID, token), nil
+}
+
+func newClient(apiURL, zoneID, apiToken string) *Client {
+	baseURL := strings.TrimRight(apiURL, "/")
+	if baseURL == "" {
+		baseURL = "https://api.cloudflare.com/client/v4"
+	}
+	return &Client{
+		baseURL:  baseURL,
+		apiToken: apiToken,
+		zoneID:   zoneID,
+		client:   &http.Client{Timeout: requestTimeout},
+	}
+}
+
+// ListRecords returns the records of the given type called name; an empty type returns all
+func (c *Client) ListRecords(ctx context.Context, name, recordType string) ([]Record, error) {
+	var records []Record
+	for page := 1; ; page++ {
+		query := url.Values{}
+		query.Set("name", name)
+		if recordType != "" {
+			query.Set("type", recordType)
+		}
+		query.Set("per_page", "100")
+		query.Set("page", fmt.Sprint(page))
+
+		resp, err := c.do(ctx, http.MethodGet, "/dns_records?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		var batch []Record
+		if err := json.Unmarshal(resp.Result, &batch); err != nil {
+			return nil, fmt.Errorf("invalid cloudflare response: %w", err)
+		}
+		records = append(records, batch...)
+		if page >= resp.ResultInfo.TotalPages {
+			return records, nil
+		}
+	}
+}
+
+// CreateRecord adds a record and returns it with its ID
+func (c *Client) CreateRecord(ctx context.Context, record Record) (*Record, error) {
+	resp, err := c.do(ctx, http.MethodPost, "/dns_records", record)
+	if err != nil {
+		return nil, err
+	}
+	var created Record
+	if err := json.Unmarshal(resp.Result, &created); err != nil {
+		return nil, fmt.Errorf("invalid cloudflare response: %w", err)
+	}
+	return &created, nil
+}
+
+// UpdateRecord replaces the record with the given ID
+func (c *Client) UpdateRecord(ctx context.Context, id string, record Record) (*Record, error) {
+	resp, err := c.do(ctx, http.MethodPut, "/dns_records/"+url.PathEscape(id), record)
+	if err != nil {
+		return nil, err
+	}
+	var updated Record
+	if err := json.Unmarshal(resp.Result, &updated); err != nil {
+		return nil, fmt.Errorf("invalid cloudflare response: %w", err)
+	}
+	return &updated, nil
+}
+
+// DeleteRecord removes the record with the given ID
+func (c *Client) DeleteRecord(ctx context.Context, id string) error {
+	_, err := c.do(ctx, http.MethodDelete, "/dns_records/"+url.PathEscape(id), nil)
+	return err
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body interface{}) (*apiResponse, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+"/zones/"+url.PathEscape(c.zoneID)+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.apiToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("cloudflare request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var result apiResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 16<<20)).Decode(&result); err != nil {
+		return nil, fmt.Errorf("cloudflare %s %s returned %s", method, path, resp.Status)
+	}
+	if !result.Success || resp.StatusCode >= 300 {
+		messages := make([]string, 0, len(result.Errors))
+		for _, e := range result.Errors {
+			messages = append(messages, fmt.Sprintf("%d: %s", e.Code, e.Message))
+		}
+		if len(messages) == 0 {
+			messages = append(messages, resp.Status)
+		}
+		return nil, fmt.Errorf("cloudflare %s failed: %s", method, strings.Join(messages, "; "))
+	}
+	return &result, nil
+}
@@ -0,0 +1,357 @@
+package cloudflare
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"hysteria2_microservices/orchestrator-service/internal/config"
+)
+
+// fakeZone serves the DNS records endpoints of one zone from memory, paging lists by
+// per_page the way Cloudflare does
+type fakeZone struct {
+	t      *testing.T
+	zoneID string
+	token  string
+
+	mu      sync.Mutex
+	records map[string]Record
+	nextID  int
+	pages   int // list pages served
+}
+
+func newFakeZone(t *testing.T, records ...Record) (*fakeZone, *Client) {
+	t.Helper()
+	zone := &fakeZone{t: t, zoneID: "zone-1", token: "cf-token", records: map[string]Record{}}
+	for _, record := range records {
+		zone.add(record)
+	}
+	server := httptest.NewServer(zone)
+	t.Cleanup(server.Close)
+	return zone, newClient(server.URL+"/client/v4/", zone.zoneID, zone.token)
+}
+
+func (z *fakeZone) add(record Record) Record {
+	z.nextID++
+	record.ID = fmt.Sprintf("rec-%03d", z.nextID)
+	z.records[record.ID] = record
+	return record
+}
+
+func (z *fakeZone) reply(w http.ResponseWriter, status int, result interface{}, info map[string]int) {
+	body := map[string]interface{}{"success": status < 300, "errors": []interface{}{}, "result": result}
+	if info != nil {
+		body["result_info"] = info
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func (z *fakeZone) fail(w http.ResponseWriter, status, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"success":false,"errors":[{"code":%d,"message":%q}],"messages":[],"result":null}`, code, message)
+}
+
+func (z *fakeZone) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer "+z.token {
+		z.fail(w, http.StatusForbidden, 10000, "Authentication error")
+		return
+	}
+	prefix := "/client/v4/zones/" + z.zoneID + "/dns_records"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		z.fail(w, http.StatusNotFound, 7003, "Could not route to "+r.URL.Path)
+		return
+	}
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, prefix), "/")
+
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		z.list(w, r)
+	case r.Method == http.MethodPost && id == "":
+		var record Record
+		if err := json.NewDecoder(r.Body).Decode(&record); err != nil || r.Header.Get("Content-Type") != "application/json" {
+			z.fail(w, http.StatusBadRequest, 9207, "Request body is invalid")
+			return
+		}
+		for _, existing := range z.records {
+			if existing.Name == record.Name && existing.Type == record.Type && existing.Content == record.Content {
+				z.fail(w, http.StatusBadRequest, 81057, "Record already exists.")
+				return
+			}
+		}
+		z.reply(w, http.StatusOK, z.add(record), nil)
+	case r.Method == http.MethodPut && id != "":
+		if _, ok := z.records[id]; !ok {
+			z.fail(w, http.StatusNotFound, 81044, "Record does not exist.")
+			return
+		}
+		var record Record
+		if err := json.NewDecoder(r.Body).Decode(&record); err != nil {
+			z.fail(w, http.StatusBadRequest, 9207, "Request body is invalid")
+			return
+		}
+		record.ID = id
+		z.records[id] = record
+		z.reply(w, http.StatusOK, record, nil)
+	case r.Method == http.MethodDelete && id != "":
+		if _, ok := z.records[id]; !ok {
+			z.fail(w, http.StatusNotFound, 81044, "Record does not exist.")
+			return
+		}
+		delete(z.records, id)
+		z.reply(w, http.StatusOK, map[string]string{"id": id}, nil)
+	default:
+		z.fail(w, http.StatusMethodNotAllowed, 10000, "Method not allowed")
+	}
+}
+
+func (z *fakeZone) list(w http.ResponseWriter, r *http.Request) {
+	z.pages++
+	query := r.URL.Query()
+	var matched []Record
+	for _, record := range z.records {
+		if (query.Get("name") == "" || record.Name == query.Get("name")) && (query.Get("type") == "" || record.Type == query.Get("type")) {
+			matched = append(matched, record)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].ID < matched[j].ID })
+
+	perPage, _ := strconv.Atoi(query.Get("per_page"))
+	page, _ := strconv.Atoi(query.Get("page"))
+	if perPage <= 0 || page <= 0 {
+		z.t.Errorf("list without paging: %s", r.URL.RawQuery)
+		perPage, page = 100, 1
+	}
+	totalPages := (len(matched) + perPage - 1) / perPage
+	start, end := (page-1)*perPage, page*perPage
+	if start > len(matched) {
+		start = len(matched)
+	}
+	if end > len(matched) {
+		end = len(matched)
+	}
+	z.reply(w, http.StatusOK, matched[start:end], map[string]int{
+		"page": page, "per_page": perPage, "count": end - start, "total_count": len(matched), "total_pages": totalPages,
+	})
+}
+
+func (z *fakeZone) snapshot() []Record {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	records := make([]Record, 0, len(z.records))
+	for _, record := range z.records {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].ID < records[j].ID })
+	return records
+}
+
+func TestListRecordsPaginates(t *testing.T) {
+	var records []Record
+	for i := 0; i < 250; i++ {
+		records = append(records, Record{Type: "A", Name: "vpn.example.com", Content: fmt.Sprintf("192.0.2.%d", i), TTL: 60})
+	}
+	records = append(records,
+		Record{Type: "AAAA", Name: "vpn.example.com", Content: "2001:db8::1", TTL: 60},
+		Record{Type: "A", Name: "other.example.com", Content: "198.51.100.1", TTL: 60},
+	)
+	zone, client := newFakeZone(t, records...)
+
+	got, err := client.ListRecords(context.Background(), "vpn.example.com", "A")
+	if err != nil {
+		t.Fatalf("ListRecords: %v", err)
+	}
+	if len(got) != 250 || zone.pages != 3 {
+		t.Errorf("got %d records in %d pages, want 250 in 3", len(got), zone.pages)
+	}
+	seen := map[string]bool{}
+	for _, record := range got {
+		if record.Type != "A" || record.Name != "vpn.example.com" || seen[record.ID] {
+			t.Fatalf("unexpected or repeated record %+v", record)
+		}
+		seen[record.ID] = true
+	}
+
+	all, err := client.ListRecords(context.Background(), "vpn.example.com", "")
+	if err != nil {
+		t.Fatalf("ListRecords: %v", err)
+	}
+	if len(all) != 251 {
+		t.Errorf("got %d records of every type, want 251", len(all))
+	}
+}
+
+func TestListRecordsEmpty(t *testing.T) {
+	_, client := newFakeZone(t)
+	got, err := client.ListRecords(context.Background(), "vpn.example.com", "")
+	if err != nil || len(got) != 0 {
+		t.Errorf("ListRecords = %v, %v, want no records", got, err)
+	}
+}
+
+// TestUpsertAndDelete runs the sequence the DNS balancer and SNI onboarding use: list the
+// records of a name, update the one to keep, create the missing one and delete the stale one
+func TestUpsertAndDelete(t *testing.T) {
+	zone, client := newFakeZone(t,
+		Record{Type: "A", Name: "vpn.example.com", Content: "192.0.2.1", TTL: 300},
+		Record{Type: "A", Name: "vpn.example.com", Content: "192.0.2.2", TTL: 300},
+	)
+	ctx := context.Background()
+
+	existing, err := client.ListRecords(ctx, "vpn.example.com", "A")
+	if err != nil || len(existing) != 2 {
+		t.Fatalf("ListRecords = %v, %v", existing, err)
+	}
+	keep, stale := existing[0], existing[1]
+
+	keep.TTL = 60
+	keep.Comment = "hysteryvpn"
+	updated, err := client.UpdateRecord(ctx, keep.ID, keep)
+	if err != nil {
+		t.Fatalf("UpdateRecord: %v", err)
+	}
+	if updated.ID != keep.ID || updated.TTL != 60 {
+		t.Errorf("UpdateRecord = %+v", updated)
+	}
+	created, err := client.CreateRecord(ctx, Record{Type: "A", Name: "vpn.example.com", Content: "192.0.2.3", TTL: 60})
+	if err != nil {
+		t.Fatalf("CreateRecord: %v", err)
+	}
+	if created.ID == "" || created.Content != "192.0.2.3" {
+		t.Errorf("CreateRecord = %+v, want the record with its ID", created)
+	}
+	if err := client.DeleteRecord(ctx, stale.ID); err != nil {
+		t.Fatalf("DeleteRecord: %v", err)
+	}
+
+	want := []Record{
+		{ID: keep.ID, Type: "A", Name: "vpn.example.com", Content: "192.0.2.1", TTL: 60, Comment: "hysteryvpn"},
+		{ID: created.ID, Type: "A", Name: "vpn.example.com", Content: "192.0.2.3", TTL: 60},
+	}
+	if got := zone.snapshot(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("zone = %+v, want %+v", got, want)
+	}
+
+	// Records deleted concurrently surface the API error
+	err = client.DeleteRecord(ctx, stale.ID)
+	if err == nil || !strings.Contains(err.Error(), "81044: Record does not exist.") {
+		t.Errorf("second DeleteRecord error = %v", err)
+	}
+}
+
+func TestAPIErrorEnvelope(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		wantErr string
+	}{
+		{
+			name: "errors listed",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"success":false,"errors":[{"code":1004,"message":"DNS Validation Error"},{"code":9005,"message":"Content for A record is invalid."}],"result":null}`)
+			},
+			wantErr: "cloudflare POST failed: 1004: DNS Validation Error; 9005: Content for A record is invalid.",
+		},
+		{
+			name: "unsuccessful without errors",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, `{"success":false,"errors":[],"result":null}`)
+			},
+			wantErr: "cloudflare POST failed: 200 OK",
+		},
+		{
+			name: "error status with success",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusTooManyRequests)
+				fmt.Fprint(w, `{"success":true,"errors":[],"result":{}}`)
+			},
+			wantErr: "cloudflare POST failed: 429 Too Many Requests",
+		},
+		{
+			name: "not JSON",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusBadGateway)
+				fmt.Fprint(w, "<html>502 Bad Gateway</html>")
+			},
+			wantErr: "cloudflare POST /dns_records returned 502 Bad Gateway",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(tt.handler)
+			defer server.Close()
+			client := newClient(server.URL, "zone-1", "cf-token")
+
+			_, err := client.CreateRecord(context.Background(), Record{Type: "A", Name: "vpn.example.com", Content: "bad"})
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("error = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAuthenticationError(t *testing.T) {
+	zone, _ := newFakeZone(t)
+	server := httptest.NewServer(zone)
+	defer server.Close()
+	client := newClient(server.URL+"/client/v4", zone.zoneID, "wrong-token")
+
+	_, err := client.ListRecords(context.Background(), "vpn.example.com", "")
+	if err == nil || !strings.Contains(err.Error(), "10000: Authentication error") {
+		t.Errorf("error = %v, want the authentication error", err)
+	}
+}
+
+func TestNewClientForDomain(t *testing.T) {
+	cfg := config.CloudflareConfig{
+		APIToken: "default-token",
+		Zones: []config.CloudflareZone{
+			{Name: "example.com", ZoneID: "zone-example"},
+			{Name: "eu.example.com.", ZoneID: "zone-eu", APIToken: "eu-token"},
+			{Name: "example.org", ZoneID: ""},
+		},
+	}
+	tests := []struct {
+		domain    string
+		wantZone  string
+		wantToken string
+		wantErr   bool
+	}{
+		{"vpn.example.com", "zone-example", "default-token", false},
+		{"*.example.com", "zone-example", "default-token", false},
+		{"de.eu.example.com.", "zone-eu", "eu-token", false},
+		{"EU.Example.com", "zone-eu", "eu-token", false},
+		{"notexample.com", "", "", true},
+		{"vpn.example.org", "", "", true},
+	}
+	for _, tt := range tests {
+		client, err := NewClientForDomain(cfg, tt.domain)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: got zone %s, want error", tt.domain, client.zoneID)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.domain, err)
+			continue
+		}
+		if client.zoneID != tt.wantZone || client.apiToken != tt.wantToken {
+			t.Errorf("%s: zone %s with %s, want %s with %s", tt.domain, client.zoneID, client.apiToken, tt.wantZone, tt.wantToken)
+		}
+	}
+}
@@ -4,17 +4,32 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/joho/godotenv"
 	"github.com/spf13/viper"
 )
 
 type Config struct {
-	Server   ServerConfig   `mapstructure:"server"`
-	Database DatabaseConfig `mapstructure:"database"`
-	GRPC     GRPCConfig     `mapstructure:"grpc"`
-	Security SecurityConfig `mapstructure:"security"`
-	Logging  LoggingConfig  `mapstructure:"logging"`
+	Server       ServerConfig       `mapstructure:"server"`
+	Database     DatabaseConfig     `mapstructure:"database"`
+	GRPC         GRPCConfig         `mapstructure:"grpc"`
+	Security     SecurityConfig     `mapstructure:"security"`
+	Logging      LoggingConfig      `mapstructure:"logging"`
+	Gateway      GatewayConfig      `mapstructure:"gateway"`
+	Speedtest    SpeedtestConfig    `mapstructure:"speedtest"`
+	Egress       EgressConfig       `mapstructure:"egress"`
+	Drift        DriftConfig        `mapstructure:"drift"`
+	Certificates CertificatesConfig `mapstructure:"certificates"`
+	Artifacts    ArtifactsConfig    `mapstructure:"artifacts"`
+	Maintenance  MaintenanceConfig  `mapstructure:"maintenance"`
+	Backup       BackupConfig       `mapstructure:"backup"`
+	Cloudflare   CloudflareConfig   `mapstructure:"cloudflare"`
+	DNS          DNSConfig          `mapstructure:"dns"`
+	Leader       LeaderConfig       `mapstructure:"leader"`
+	Events       EventsConfig       `mapstructure:"events"`
+	Provision    ProvisionConfig    `mapstructure:"provisioning"`
+	Kubernetes   KubernetesConfig   `mapstructure:"kubernetes"`
 }
 
 type ServerConfig struct {
@@ -41,7 +56,168 @@ type GRPCConfig struct {
 
 type SecurityConfig struct {
 	JWTSecret     string `mapstructure:"jwt_secret"`
+	JWKSURL       string `mapstructure:"jwks_url"` // api-service signing keys, e.g. "http://api-service:8080/.well-known/jwks.json"
 	NodeAuthToken string `mapstructure:"node_auth_token"`
+
+	// Networks the gRPC port accepts agents from, joined by the agent networks stored
+	// through api-service; none leaves the port open
+	AgentAllowedCIDRs []string `mapstructure:"agent_allowed_cidrs"`
+	AllowlistRefresh  int      `mapstructure:"allowlist_refresh"`  // seconds between reads of the stored networks
+	BreakGlassToken   string   `mapstructure:"break_glass_token"`  // x-break-glass-token metadata passing the allowlist, empty disables it
+	AllowlistLoopback bool     `mapstructure:"allowlist_loopback"` // let loopback peers, such as the REST gateway, past the allowlist
+}
+
+// GatewayConfig controls the REST proxy in front of the gRPC services
+type GatewayConfig struct {
+	Enabled    bool   `mapstructure:"enabled"`
+	PathPrefix string `mapstructure:"path_prefix"` // must match the routes in proto/node_management_gateway.yaml
+}
+
+// SpeedtestConfig schedules throughput and latency measurements from every node to
+// reflectors that stand in for the client regions
+type SpeedtestConfig struct {
+	Enabled    bool                 `mapstructure:"enabled"`
+	Interval   int                  `mapstructure:"interval"` // seconds between rounds
+	Duration   int                  `mapstructure:"duration"` // seconds per direction
+	Reflectors []SpeedtestReflector `mapstructure:"reflectors"`
+}
+
+// SpeedtestReflector is an iperf3 server, or a Speedtest.net server for type "speedtest"
+type SpeedtestReflector struct {
+	Region   string `mapstructure:"region"`
+	Host     string `mapstructure:"host"`
+	Port     int    `mapstructure:"port"`
+	Type     string `mapstructure:"type"`
+	ServerID string `mapstructure:"server_id"`
+}
+
+// EgressConfig collects the egress reputation checks the agents run on their own schedule
+type EgressConfig struct {
+	Enabled  bool `mapstructure:"enabled"`
+	Interval int  `mapstructure:"interval"` // seconds between collections
+}
+
+// DriftConfig schedules the checks comparing every node with its desired state; nodes with
+// the heal drift policy are healed when drift is found
+type DriftConfig struct {
+	Enabled  bool `mapstructure:"enabled"`
+	Interval int  `mapstructure:"interval"` // seconds between checks
+}
+
+// CertificatesConfig syncs the certificates every node serves into the orchestrator's
+// inventory
+type CertificatesConfig struct {
+	Enabled  bool `mapstructure:"enabled"`
+	Interval int  `mapstructure:"interval"` // seconds between syncs
+}
+
+// ArtifactsConfig serves mirrored release files to agents installing in offline mode
+type ArtifactsConfig struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Dir     string `mapstructure:"dir"`
+}
+
+// MaintenanceConfig runs scheduled node operations and tells the users assigned to the
+// affected nodes ahead of time
+type MaintenanceConfig struct {
+	Interval     int    `mapstructure:"interval"`      // seconds between scheduler checks
+	NotifyBefore int    `mapstructure:"notify_before"` // minutes before a window opens
+	NotifyURL    string `mapstructure:"notify_url"`    // webhook receiving notifications, empty only logs them
+	NotifyToken  string `mapstructure:"notify_token"`  // bearer token sent to the webhook
+}
+
+// BackupConfig writes encrypted disaster-recovery backups of the control-plane tables and
+// of the files every node cannot rebuild to S3-compatible storage
+type BackupConfig struct {
+	Enabled       bool   `mapstructure:"enabled"`
+	Interval      int    `mapstructure:"interval"`       // seconds between scheduled backups
+	Retention     int    `mapstructure:"retention"`      // backups kept, older ones are deleted
+	NodeFiles     bool   `mapstructure:"node_files"`     // also collect node keys, configs and certificates
+	Endpoint      string `mapstructure:"endpoint"`       // e.g. "https://s3.eu-central-1.amazonaws.com" or a MinIO URL
+	Region        string `mapstructure:"region"`         // signing region, "us-east-1" for MinIO
+	Bucket        string `mapstructure:"bucket"`         // addressed path-style, so it works with any provider
+	Prefix        string `mapstructure:"prefix"`         // object key prefix, e.g. "orchestrator/"
+	AccessKey     string `mapstructure:"access_key"`     // needs s3:PutObject, GetObject, ListBucket and DeleteObject
+	SecretKey     string `mapstructure:"secret_key"`     // secret of the access key
+	EncryptionKey string `mapstructure:"encryption_key"` // base64 32-byte AES key; keep a copy off-site, backups cannot be read without it
+	SigningKey    string `mapstructure:"signing_key"`    // base64 key of at least 32 bytes signing exported node state
+}
+
+// CloudflareConfig gives access to the Cloudflare zone holding the service hostnames and
+// to the zones SNI domains are onboarded in
+type CloudflareConfig struct {
+	APIToken string           `mapstructure:"api_token"` // needs Zone:DNS:Edit on the zone
+	ZoneID   string           `mapstructure:"zone_id"`
+	APIURL   string           `mapstructure:"api_url"`
+	Zones    []CloudflareZone `mapstructure:"zones"`
+}
+
+// CloudflareZone is a zone SNI domain records are created in; a domain uses the zone with
+// the longest matching name
+type CloudflareZone struct {
+	Name     string `mapstructure:"name"` // e.g. "example.com"
+	ZoneID   string `mapstructure:"zone_id"`
+	APIToken string `mapstructure:"api_token"` // token scoped to the zone, defaults to cloudflare.api_token
+}
+
+// DNSConfig publishes the healthy nodes under the service hostnames as A/AAAA records,
+// rotated by weight, and withdraws drained and unhealthy ones
+type DNSConfig struct {
+	Enabled          bool `mapstructure:"enabled"`
+	Interval         int  `mapstructure:"interval"`          // seconds between syncs
+	HeartbeatTimeout int  `mapstructure:"heartbeat_timeout"` // seconds without a heartbeat before a node is withdrawn
+	SNIWait          int  `mapstructure:"sni_wait"`          // seconds an onboarded SNI domain may take to resolve
+}
+
+// LeaderConfig elects one replica, through a Postgres advisory lock, to run the scheduled
+// jobs; disable it only when a single orchestrator runs
+type LeaderConfig struct {
+	Enabled  bool `mapstructure:"enabled"`
+	Interval int  `mapstructure:"interval"` // seconds between checks of the lock
+}
+
+// EventsConfig connects to the NATS JetStream event bus, consumed for agent heartbeats and
+// published to with the gateway's audit events; empty URL disables it
+type EventsConfig struct {
+	URL       string `mapstructure:"url"`
+	Token     string `mapstructure:"token"`
+	User      string `mapstructure:"user"`
+	Password  string `mapstructure:"password"`
+	Retention int    `mapstructure:"retention"` // hours the stream keeps events when the orchestrator creates it
+	Outbox    int    `mapstructure:"outbox"`    // events held while NATS is unreachable
+}
+
+// ProvisionConfig creates cloud servers that install the agent on first boot and register
+// with the master, and destroys them again, following the scaling policies of each node
+// group. Only providers with an API token are available.
+type ProvisionConfig struct {
+	Enabled         bool           `mapstructure:"enabled"`
+	Interval        int            `mapstructure:"interval"`         // seconds between autoscaler checks
+	RegisterTimeout int            `mapstructure:"register_timeout"` // seconds a new server may take to register before it is destroyed
+	MasterServer    string         `mapstructure:"master_server"`    // gRPC address new agents register with, e.g. "orchestrator.example.com:50051"
+	JoinURL         string         `mapstructure:"join_url"`         // REST URL new servers exchange their join token at, e.g. "https://orchestrator.example.com:8081/join"
+	JoinTokenTTL    int            `mapstructure:"join_token_ttl"`   // seconds the join token of a bootstrap stays valid; the autoscaler's expire with register_timeout
+	AgentURL        string         `mapstructure:"agent_url"`        // agent binary download, {version} is replaced by AgentVersion
+	HelperURL       string         `mapstructure:"helper_url"`       // agent-helper download, {version} is replaced by AgentVersion; defaults to agent-helper next to the agent
+	AgentVersion    string         `mapstructure:"agent_version"`
+	SSHKeys         []string       `mapstructure:"ssh_keys"` // authorized keys added to every server
+	Hetzner         ProviderConfig `mapstructure:"hetzner"`
+	DigitalOcean    ProviderConfig `mapstructure:"digitalocean"`
+	Vultr           ProviderConfig `mapstructure:"vultr"`
+}
+
+// ProviderConfig gives access to the API of a cloud provider
+type ProviderConfig struct {
+	APIToken string `mapstructure:"api_token"`
+	APIURL   string `mapstructure:"api_url"`
+}
+
+// KubernetesConfig mirrors VPNNode custom resources into the node table when the
+// orchestrator runs in a cluster
+type KubernetesConfig struct {
+	Operator  bool   `mapstructure:"operator"`
+	Namespace string `mapstructure:"namespace"` // namespace watched for VPNNodes, empty for the pod's own, "*" for all
+	Resync    int    `mapstructure:"resync"`    // seconds between full reconciliations, which also refresh the status
 }
 
 type LoggingConfig struct {
@@ -66,6 +242,10 @@ func LoadConfig() (*Config, error) {
 	viper.AddConfigPath("./configs")
 	viper.AddConfigPath("../configs")
 	viper.AddConfigPath("../../configs")
+	viper.AddConfigPath("/etc/hysteryvpn") // e.g. a mounted ConfigMap
+	if file := os.Getenv("ORCHESTRATOR_CONFIG"); file != "" {
+		viper.SetConfigFile(file)
+	}
 
 	// Enable environment variable binding
 	viper.AutomaticEnv()
@@ -86,10 +266,44 @@ func LoadConfig() (*Config, error) {
 	if err := viper.Unmarshal(&config); err != nil {
 		return nil, fmt.Errorf("error unmarshaling config: %w", err)
 	}
+	if err := config.resolveSecretFiles(); err != nil {
+		return nil, err
+	}
 
 	return &config, nil
 }
 
+// resolveSecretFiles replaces secrets given as "file:<path>", such as a mounted Kubernetes or
+// Docker secret, with the contents of the file
+func (c *Config) resolveSecretFiles() error {
+	for _, value := range []*string{
+		&c.Database.Password,
+		&c.Security.JWTSecret,
+		&c.Security.NodeAuthToken,
+		&c.Security.BreakGlassToken,
+		&c.Events.Token,
+		&c.Events.Password,
+		&c.Cloudflare.APIToken,
+		&c.Backup.SecretKey,
+		&c.Backup.EncryptionKey,
+		&c.Backup.SigningKey,
+		&c.Provision.Hetzner.APIToken,
+		&c.Provision.DigitalOcean.APIToken,
+		&c.Provision.Vultr.APIToken,
+	} {
+		file, ok := strings.CutPrefix(*value, "file:")
+		if !ok {
+			continue
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("error reading secret file: %w", err)
+		}
+		*value = strings.TrimRight(string(data), "\r\n")
+	}
+	return nil
+}
+
 func setDefaults() {
 	viper.SetDefault("server.host", "0.0.0.0")
 	viper.SetDefault("server.port", 8081)
@@ -105,6 +319,62 @@ func setDefaults() {
 	viper.SetDefault("grpc.host", "0.0.0.0")
 	viper.SetDefault("grpc.port", 50052)
 
+	viper.SetDefault("security.allowlist_refresh", 30)
+
+	viper.SetDefault("gateway.enabled", true)
+	viper.SetDefault("gateway.path_prefix", "/api/v1/gateway")
+
+	viper.SetDefault("speedtest.enabled", false)
+	viper.SetDefault("speedtest.interval", 21600)
+	viper.SetDefault("speedtest.duration", 5)
+
+	viper.SetDefault("egress.enabled", true)
+	viper.SetDefault("egress.interval", 3600)
+
+	viper.SetDefault("drift.enabled", true)
+	viper.SetDefault("drift.interval", 900)
+
+	viper.SetDefault("certificates.enabled", true)
+	viper.SetDefault("certificates.interval", 21600)
+
+	viper.SetDefault("artifacts.enabled", false)
+	viper.SetDefault("artifacts.dir", "/var/lib/hysteryvpn/artifacts")
+
+	viper.SetDefault("maintenance.interval", 30)
+	viper.SetDefault("maintenance.notify_before", 1440)
+
+	viper.SetDefault("backup.enabled", false)
+	viper.SetDefault("backup.interval", 86400)
+	viper.SetDefault("backup.retention", 14)
+	viper.SetDefault("backup.node_files", true)
+	viper.SetDefault("backup.region", "us-east-1")
+	viper.SetDefault("backup.prefix", "orchestrator/")
+
+	viper.SetDefault("cloudflare.api_url", "https://api.cloudflare.com/client/v4")
+
+	viper.SetDefault("dns.enabled", false)
+	viper.SetDefault("dns.interval", 60)
+	viper.SetDefault("dns.heartbeat_timeout", 120)
+	viper.SetDefault("dns.sni_wait", 180)
+
+	viper.SetDefault("leader.enabled", true)
+	viper.SetDefault("leader.interval", 10)
+
+	viper.SetDefault("events.retention", 72)
+	viper.SetDefault("events.outbox", 10000)
+
+	viper.SetDefault("provisioning.enabled", false)
+	viper.SetDefault("provisioning.interval", 60)
+	viper.SetDefault("provisioning.register_timeout", 900)
+	viper.SetDefault("provisioning.join_token_ttl", 86400)
+	viper.SetDefault("provisioning.agent_version", "latest")
+	viper.SetDefault("provisioning.hetzner.api_url", "https://api.hetzner.cloud/v1")
+	viper.SetDefault("provisioning.digitalocean.api_url", "https://api.digitalocean.com/v2")
+	viper.SetDefault("provisioning.vultr.api_url", "https://api.vultr.com/v2")
+
+	viper.SetDefault("kubernetes.operator", false)
+	viper.SetDefault("kubernetes.resync", 300)
+
 	viper.SetDefault("logging.level", "info")
 	viper.SetDefault("logging.format", "json")
 	viper.SetDefault("logging.output", "stdout")
@@ -128,7 +398,75 @@ func bindEnvVars() {
 	viper.BindEnv("grpc.cert_key", "GRPC_CERT_KEY")
 
 	viper.BindEnv("security.jwt_secret", "JWT_SECRET")
+	viper.BindEnv("security.jwks_url", "JWKS_URL")
 	viper.BindEnv("security.node_auth_token", "NODE_AUTH_TOKEN")
+	viper.BindEnv("security.agent_allowed_cidrs", "AGENT_ALLOWED_CIDRS")
+	viper.BindEnv("security.allowlist_refresh", "ALLOWLIST_REFRESH_SECONDS")
+	viper.BindEnv("security.break_glass_token", "BREAK_GLASS_TOKEN")
+	viper.BindEnv("security.allowlist_loopback", "ALLOWLIST_ALLOW_LOOPBACK")
+
+	viper.BindEnv("gateway.enabled", "GATEWAY_ENABLED")
+	viper.BindEnv("gateway.path_prefix", "GATEWAY_PATH_PREFIX")
+
+	viper.BindEnv("speedtest.enabled", "SPEEDTEST_ENABLED")
+	viper.BindEnv("speedtest.interval", "SPEEDTEST_INTERVAL")
+
+	viper.BindEnv("egress.enabled", "EGRESS_CHECK_ENABLED")
+	viper.BindEnv("egress.interval", "EGRESS_CHECK_INTERVAL")
+
+	viper.BindEnv("drift.enabled", "DRIFT_CHECK_ENABLED")
+	viper.BindEnv("drift.interval", "DRIFT_CHECK_INTERVAL")
+
+	viper.BindEnv("certificates.enabled", "CERT_INVENTORY_ENABLED")
+	viper.BindEnv("certificates.interval", "CERT_INVENTORY_INTERVAL")
+
+	viper.BindEnv("artifacts.enabled", "ARTIFACTS_ENABLED")
+	viper.BindEnv("artifacts.dir", "ARTIFACTS_DIR")
+
+	viper.BindEnv("maintenance.notify_before", "MAINTENANCE_NOTIFY_BEFORE")
+	viper.BindEnv("maintenance.notify_url", "MAINTENANCE_NOTIFY_URL")
+	viper.BindEnv("maintenance.notify_token", "MAINTENANCE_NOTIFY_TOKEN")
+
+	viper.BindEnv("backup.enabled", "BACKUP_ENABLED")
+	viper.BindEnv("backup.interval", "BACKUP_INTERVAL")
+	viper.BindEnv("backup.retention", "BACKUP_RETENTION")
+	viper.BindEnv("backup.endpoint", "BACKUP_S3_ENDPOINT")
+	viper.BindEnv("backup.region", "BACKUP_S3_REGION")
+	viper.BindEnv("backup.bucket", "BACKUP_S3_BUCKET")
+	viper.BindEnv("backup.prefix", "BACKUP_S3_PREFIX")
+	viper.BindEnv("backup.access_key", "BACKUP_S3_ACCESS_KEY")
+	viper.BindEnv("backup.secret_key", "BACKUP_S3_SECRET_KEY")
+	viper.BindEnv("backup.encryption_key", "BACKUP_ENCRYPTION_KEY")
+	viper.BindEnv("backup.signing_key", "BACKUP_SIGNING_KEY")
+
+	viper.BindEnv("cloudflare.api_token", "CLOUDFLARE_API_TOKEN")
+	viper.BindEnv("cloudflare.zone_id", "CLOUDFLARE_ZONE_ID")
+
+	viper.BindEnv("dns.enabled", "DNS_LB_ENABLED")
+	viper.BindEnv("dns.interval", "DNS_LB_INTERVAL")
+
+	viper.BindEnv("leader.enabled", "LEADER_ELECTION_ENABLED")
+	viper.BindEnv("leader.interval", "LEADER_ELECTION_INTERVAL")
+
+	viper.BindEnv("events.url", "EVENTS_NATS_URL")
+	viper.BindEnv("events.token", "EVENTS_NATS_TOKEN")
+	viper.BindEnv("events.user", "EVENTS_NATS_USER")
+	viper.BindEnv("events.password", "EVENTS_NATS_PASSWORD")
+	viper.BindEnv("events.retention", "EVENTS_RETENTION_HOURS")
+	viper.BindEnv("events.outbox", "EVENTS_OUTBOX_SIZE")
+
+	viper.BindEnv("provisioning.enabled", "PROVISIONING_ENABLED")
+	viper.BindEnv("provisioning.master_server", "PROVISIONING_MASTER_SERVER")
+	viper.BindEnv("provisioning.join_url", "PROVISIONING_JOIN_URL")
+	viper.BindEnv("provisioning.agent_url", "PROVISIONING_AGENT_URL")
+	viper.BindEnv("provisioning.helper_url", "PROVISIONING_HELPER_URL")
+	viper.BindEnv("provisioning.agent_version", "PROVISIONING_AGENT_VERSION")
+	viper.BindEnv("provisioning.hetzner.api_token", "HETZNER_API_TOKEN")
+	viper.BindEnv("provisioning.digitalocean.api_token", "DIGITALOCEAN_API_TOKEN")
+	viper.BindEnv("provisioning.vultr.api_token", "VULTR_API_KEY")
+
+	viper.BindEnv("kubernetes.operator", "KUBERNETES_OPERATOR_ENABLED")
+	viper.BindEnv("kubernetes.namespace", "KUBERNETES_WATCH_NAMESPACE")
 
 	viper.BindEnv("logging.level", "LOG_LEVEL")
 	viper.BindEnv("logging.format", "LOG_FORMAT")
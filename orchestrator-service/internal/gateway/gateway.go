@@ -0,0 +1,105 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// Headers set by the gateway from the verified JWT; never trusted from the client
+const (
+	userIDHeader = "X-Auth-User-Id"
+	roleHeader   = "X-Auth-Role"
+)
+
+// RegisterFunc matches the generated pb.Register<Service>HandlerFromEndpoint functions
+type RegisterFunc func(ctx context.Context, mux *runtime.ServeMux, endpoint string, opts []grpc.DialOption) error
+
+// Gateway proxies REST calls to the orchestrator's own gRPC server
+type Gateway struct {
+	mux    *runtime.ServeMux
+	logger *logrus.Logger
+}
+
+// New registers the given services against the gRPC endpoint. creds may be nil for plaintext.
+func New(ctx context.Context, endpoint string, creds credentials.TransportCredentials, logger *logrus.Logger, registrars ...RegisterFunc) (*Gateway, error) {
+	mux := runtime.NewServeMux(
+		runtime.WithIncomingHeaderMatcher(headerMatcher),
+		runtime.WithErrorHandler(errorHandler),
+	)
+
+	if creds == nil {
+		creds = insecure.NewCredentials()
+	}
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+
+	for _, register := range registrars {
+		if err := register(ctx, mux, endpoint, opts); err != nil {
+			return nil, fmt.Errorf("failed to register gateway handler: %w", err)
+		}
+	}
+
+	return &Gateway{mux: mux, logger: logger}, nil
+}
+
+// Handler serves the gateway from gin; it must run after middleware.JWTAuth
+func (g *Gateway) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request.Header.Del(userIDHeader)
+		c.Request.Header.Del(roleHeader)
+		c.Request.Header.Set(userIDHeader, c.GetString("user_id"))
+		c.Request.Header.Set(roleHeader, c.GetString("role"))
+
+		g.logger.Debugf("Gateway request %s %s by user %s", c.Request.Method, c.Request.URL.Path, c.GetString("user_id"))
+		g.mux.ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+// headerMatcher forwards the verified identity headers as gRPC metadata alongside the defaults
+func headerMatcher(key string) (string, bool) {
+	switch strings.ToLower(key) {
+	case strings.ToLower(userIDHeader), strings.ToLower(roleHeader):
+		return strings.ToLower(key), true
+	}
+	return runtime.DefaultHeaderMatcher(key)
+}
+
+// errorHandler renders gRPC errors in the same {"error", "code"} shape as the REST API. The
+// code is the ErrorCode of the status' ErrorInfo, whose metadata is returned as "details";
+// statuses without one fall back to the gRPC code.
+func errorHandler(ctx context.Context, mux *runtime.ServeMux, marshaler runtime.Marshaler, w http.ResponseWriter, r *http.Request, err error) {
+	st := status.Convert(err)
+
+	w.Header().Set("Content-Type", marshaler.ContentType(nil))
+	w.WriteHeader(runtime.HTTPStatusFromCode(st.Code()))
+
+	resp := map[string]interface{}{
+		"error": st.Message(),
+		"code":  strings.ToUpper(st.Code().String()),
+	}
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			resp["code"] = info.Reason
+			if len(info.Metadata) > 0 {
+				resp["details"] = info.Metadata
+			}
+			break
+		}
+	}
+
+	body, marshalErr := marshaler.Marshal(resp)
+	if marshalErr != nil {
+		return
+	}
+	w.Write(body)
+}
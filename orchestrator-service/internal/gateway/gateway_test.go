@@ -0,0 +1,133 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// echoMetadata stands in for a generated handler: it answers with the gRPC metadata the
+// gateway would send upstream, or with err
+func echoMetadata(err error) RegisterFunc {
+	return func(ctx context.Context, mux *runtime.ServeMux, endpoint string, opts []grpc.DialOption) error {
+		return mux.HandlePath(http.MethodGet, "/v1/nodes", func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+			ctx, annotateErr := runtime.AnnotateContext(r.Context(), mux, r, "/hysteria2.NodeManager/ListNodes")
+			if annotateErr != nil {
+				err = annotateErr
+			}
+			if err != nil {
+				_, marshaler := runtime.MarshalerForRequest(mux, r)
+				runtime.HTTPError(ctx, mux, marshaler, w, r, err)
+				return
+			}
+			md, _ := metadata.FromOutgoingContext(ctx)
+			json.NewEncoder(w).Encode(md)
+		})
+	}
+}
+
+func newTestGateway(t *testing.T, register RegisterFunc) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	gw, err := New(context.Background(), "127.0.0.1:0", nil, logger, register)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	router := gin.New()
+	// Stands in for middleware.JWTAuth
+	verified := func(c *gin.Context) {
+		c.Set("user_id", "550e8400-e29b-41d4-a716-446655440000")
+		c.Set("role", "operator")
+	}
+	router.Any("/v1/*path", verified, gw.Handler())
+	return router
+}
+
+func TestGatewayForwardsVerifiedIdentity(t *testing.T) {
+	router := newTestGateway(t, echoMetadata(nil))
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/nodes", nil)
+	// Identity headers sent by the client are replaced by the verified ones
+	req.Header.Set("X-Auth-User-Id", "7c9e6679-7425-40de-944b-e07fc1f90ae7")
+	req.Header.Set("X-Auth-Role", "admin")
+	req.Header.Set("X-Unrelated", "dropped")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	var md map[string][]string
+	if err := json.Unmarshal(w.Body.Bytes(), &md); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got := md["x-auth-user-id"]; len(got) != 1 || got[0] != "550e8400-e29b-41d4-a716-446655440000" {
+		t.Errorf("x-auth-user-id = %v, want the verified user only", got)
+	}
+	if got := md["x-auth-role"]; len(got) != 1 || got[0] != "operator" {
+		t.Errorf("x-auth-role = %v, want the verified role only", got)
+	}
+	if _, ok := md["x-unrelated"]; ok {
+		t.Error("forwarded a header outside the identity headers and defaults")
+	}
+}
+
+func TestGatewayErrorShape(t *testing.T) {
+	withInfo, _ := status.New(codes.FailedPrecondition, "node is offline").WithDetails(&errdetails.ErrorInfo{
+		Reason:   "NODE_OFFLINE",
+		Metadata: map[string]string{"node_id": "node-1"},
+	})
+
+	tests := []struct {
+		name        string
+		err         error
+		wantStatus  int
+		wantCode    string
+		wantDetails map[string]string
+	}{
+		{"error info", withInfo.Err(), http.StatusBadRequest, "NODE_OFFLINE", map[string]string{"node_id": "node-1"}},
+		{"plain status", status.Error(codes.NotFound, "node not found"), http.StatusNotFound, "NOTFOUND", nil},
+		{"permission", status.Error(codes.PermissionDenied, "admins only"), http.StatusForbidden, "PERMISSIONDENIED", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := newTestGateway(t, echoMetadata(tt.err))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/nodes", nil))
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status %d, want %d", w.Code, tt.wantStatus)
+			}
+			var body struct {
+				Error   string            `json:"error"`
+				Code    string            `json:"code"`
+				Details map[string]string `json:"details"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("decode %q: %v", w.Body.String(), err)
+			}
+			if body.Error != status.Convert(tt.err).Message() || body.Code != tt.wantCode {
+				t.Errorf("body = %+v, want %q with code %s", body, status.Convert(tt.err).Message(), tt.wantCode)
+			}
+			if len(body.Details) != len(tt.wantDetails) || body.Details["node_id"] != tt.wantDetails["node_id"] {
+				t.Errorf("details = %v, want %v", body.Details, tt.wantDetails)
+			}
+		})
+	}
+}
@@ -0,0 +1,750 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+
+	"hysteria2_microservices/orchestrator-service/internal/config"
+	"hysteria2_microservices/orchestrator-service/internal/models"
+	"hysteria2_microservices/orchestrator-service/internal/provisioning"
+	pb "hysteria2_microservices/proto"
+)
+
+const (
+	defaultAutoscaleInterval = time.Minute
+	defaultRegisterTimeout   = 15 * time.Minute
+	autoscaleNodeTimeout     = 10 * time.Second
+)
+
+// Autoscaler keeps the bandwidth of node groups within their scaling policies. It creates a
+// server when fewer nodes than the minimum are online or the group's utilization reaches
+// the scale-up percent, and destroys a server it created once that node has stayed under
+// the scale-down percent without users for the idle period. Nodes it did not create are
+// never destroyed.
+type Autoscaler struct {
+	leadership
+	nodeHandler *NodeHandler
+	drivers     map[string]provisioning.Driver
+	config      config.ProvisionConfig
+	joinTokens  *provisioning.JoinTokens
+	logger      *logrus.Logger
+
+	// mu serialises scaling actions and guards the last measurement of each policy
+	mu    sync.Mutex
+	loads map[uuid.UUID]groupLoad
+}
+
+// groupLoad is the bandwidth the online nodes of a group use and have
+type groupLoad struct {
+	online   int
+	nodes    map[uuid.UUID]nodeLoad // nodes whose bandwidth was measured
+	mbps     float64
+	capacity float64
+}
+
+type nodeLoad struct {
+	mbps     float64
+	capacity float64
+}
+
+func (l groupLoad) utilization() float64 {
+	if l.capacity <= 0 {
+		return 0
+	}
+	return 100 * l.mbps / l.capacity
+}
+
+// NewAutoscaler creates a new Autoscaler using the providers cfg has API tokens for. New
+// servers get a join token from joinTokens, which they exchange for the node auth token.
+func NewAutoscaler(nodeHandler *NodeHandler, cfg config.ProvisionConfig, joinTokens *provisioning.JoinTokens, logger *logrus.Logger) *Autoscaler {
+	return &Autoscaler{
+		nodeHandler: nodeHandler,
+		drivers:     provisioning.Drivers(cfg),
+		config:      cfg,
+		joinTokens:  joinTokens,
+		logger:      logger,
+		loads:       make(map[uuid.UUID]groupLoad),
+	}
+}
+
+// Start applies the enabled policies once per interval until ctx is cancelled, while this
+// replica leads
+func (a *Autoscaler) Start(ctx context.Context) {
+	if !a.config.Enabled {
+		a.logger.Info("Autoscaling disabled")
+		return
+	}
+	if len(a.drivers) == 0 {
+		a.logger.Warn("Autoscaling enabled without the API token of any cloud provider")
+		return
+	}
+
+	interval := time.Duration(a.config.Interval) * time.Second
+	if interval <= 0 {
+		interval = defaultAutoscaleInterval
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if a.leading() {
+				a.tick(ctx, time.Now())
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	a.logger.Infof("Autoscaling node groups every %s with %s", interval, strings.Join(a.providers(), ", "))
+}
+
+func (a *Autoscaler) tick(ctx context.Context, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.trackServers(ctx)
+
+	var policies []models.ScalingPolicy
+	if err := a.nodeHandler.db.Where("enabled = ?", true).Order("node_group").Find(&policies).Error; err != nil {
+		a.logger.Errorf("Failed to get scaling policies: %v", err)
+		return
+	}
+	for i := range policies {
+		if ctx.Err() != nil {
+			return
+		}
+		a.scale(ctx, &policies[i], now)
+	}
+}
+
+// trackServers ties newly registered nodes to their servers, destroys servers whose agent
+// never registered and retries destroying servers the provider refused to delete
+func (a *Autoscaler) trackServers(ctx context.Context) {
+	var servers []models.ProvisionedServer
+	err := a.nodeHandler.db.
+		Where("status IN ?", []string{models.ProvisionStatusPending, models.ProvisionStatusDestroying}).
+		Find(&servers).Error
+	if err != nil {
+		a.logger.Errorf("Failed to get provisioned servers: %v", err)
+		return
+	}
+
+	for i := range servers {
+		server := &servers[i]
+		if server.Status == models.ProvisionStatusDestroying {
+			err = a.destroy(ctx, server, models.ProvisionStatusDestroyed, server.Error)
+		} else {
+			err = a.checkRegistered(ctx, server)
+		}
+		if err != nil {
+			a.logger.Warnf("Provisioned server %s: %v", server.Name, err)
+		}
+	}
+}
+
+// checkRegistered adopts the node the server's agent registered, if it did
+func (a *Autoscaler) checkRegistered(ctx context.Context, server *models.ProvisionedServer) error {
+	db := a.nodeHandler.db
+
+	var node models.VPSNode
+	err := db.Where("metadata->>'"+provisioning.MetadataProvisionID+"' = ?", server.ID.String()).First(&node).Error
+	if err == nil {
+		return a.adopt(server, &node)
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	timeout := a.registerTimeout()
+	if time.Since(server.CreatedAt) > timeout {
+		return a.destroy(ctx, server, models.ProvisionStatusFailed, fmt.Sprintf("agent did not register within %s", timeout))
+	}
+
+	// Providers assign the addresses while the server boots
+	driver, ok := a.drivers[server.Provider]
+	if server.IPAddress == "" && server.ServerID != "" && ok {
+		remote, err := driver.Get(ctx, server.ServerID)
+		if err != nil {
+			return fmt.Errorf("failed to get server: %w", err)
+		}
+		server.IPAddress = remote.IPv4
+		server.IPv6Address = remote.IPv6
+		return db.Model(server).Select("ip_address", "ipv6_address").Updates(server).Error
+	}
+	return nil
+}
+
+// adopt records the node registered from server and puts it in the server's group with the
+// capacity of its policy
+func (a *Autoscaler) adopt(server *models.ProvisionedServer, node *models.VPSNode) error {
+	db := a.nodeHandler.db
+
+	updates := map[string]interface{}{}
+	if server.NodeGroup != "" {
+		updates["node_group"] = server.NodeGroup
+	}
+	if node.IPAddress == "" && server.IPAddress != "" {
+		updates["ip_address"] = server.IPAddress
+	}
+	if server.PolicyID != nil {
+		var policy models.ScalingPolicy
+		if err := db.First(&policy, "id = ?", *server.PolicyID).Error; err == nil && node.Capacity().MaxMbps == 0 {
+			capacity := node.Capacity()
+			capacity.MaxMbps = policy.NodeMbps
+			node.SetCapacity(capacity)
+			updates["metadata"] = node.Metadata
+		}
+	}
+	if len(updates) > 0 {
+		if err := db.Model(node).Updates(updates).Error; err != nil {
+			return fmt.Errorf("failed to update node %s: %w", node.Name, err)
+		}
+	}
+
+	now := time.Now()
+	server.NodeID = &node.ID
+	server.RegisteredAt = &now
+	server.Status = models.ProvisionStatusActive
+	if server.IPAddress == "" {
+		server.IPAddress = node.IPAddress
+	}
+	if err := db.Save(server).Error; err != nil {
+		return fmt.Errorf("failed to save server: %w", err)
+	}
+	a.logger.Infof("Provisioned server %s registered as node %s", server.Name, node.ID)
+	return nil
+}
+
+// scale measures the policy's group and takes at most one scaling action
+func (a *Autoscaler) scale(ctx context.Context, policy *models.ScalingPolicy, now time.Time) {
+	db := a.nodeHandler.db
+
+	load, err := a.measure(ctx, policy)
+	if err != nil {
+		a.logger.Errorf("Failed to measure node group %s: %v", policy.NodeGroup, err)
+		return
+	}
+	a.loads[policy.ID] = load
+
+	var servers []models.ProvisionedServer
+	err = db.Where("policy_id = ? AND status IN ?", policy.ID, []string{models.ProvisionStatusPending, models.ProvisionStatusActive}).
+		Order("created_at").Find(&servers).Error
+	if err != nil {
+		a.logger.Errorf("Failed to get servers of node group %s: %v", policy.NodeGroup, err)
+		return
+	}
+	idle := a.trackIdle(policy, load, servers, now)
+
+	if policy.LastScaledAt != nil && now.Sub(*policy.LastScaledAt) < time.Duration(policy.Cooldown)*time.Second {
+		return
+	}
+	// Decide again once the server being created has registered
+	for _, server := range servers {
+		if server.Status == models.ProvisionStatusPending {
+			return
+		}
+	}
+
+	var action error
+	switch utilization := load.utilization(); {
+	case load.online < policy.MinNodes:
+		_, action = a.provision(ctx, policy, fmt.Sprintf("%d of at least %d nodes online", load.online, policy.MinNodes))
+	case utilization >= float64(policy.ScaleUpPercent) && load.online < policy.MaxNodes:
+		_, action = a.provision(ctx, policy, fmt.Sprintf("bandwidth utilization at %.0f%%", utilization))
+	case idle != nil && load.online > policy.MinNodes:
+		action = a.destroy(ctx, idle, models.ProvisionStatusDestroyed,
+			fmt.Sprintf("idle for %d minutes", int(now.Sub(*idle.IdleSince).Minutes())))
+	default:
+		return
+	}
+
+	policy.LastScaledAt = &now
+	policy.LastError = ""
+	if action != nil {
+		policy.LastError = action.Error()
+		a.logger.Errorf("Failed to scale node group %s: %v", policy.NodeGroup, action)
+	}
+	if err := db.Model(policy).Select("last_scaled_at", "last_error").Updates(policy).Error; err != nil {
+		a.logger.Errorf("Failed to save scaling state of node group %s: %v", policy.NodeGroup, err)
+	}
+}
+
+// measure asks every online node of the group for its bandwidth. Nodes that cannot measure
+// it count as online but not towards the utilization.
+func (a *Autoscaler) measure(ctx context.Context, policy *models.ScalingPolicy) (groupLoad, error) {
+	var nodes []models.VPSNode
+	err := a.nodeHandler.db.Where("node_group = ? AND status = ?", policy.NodeGroup, models.NodeStatusOnline).Find(&nodes).Error
+	if err != nil {
+		return groupLoad{}, err
+	}
+
+	load := groupLoad{online: len(nodes), nodes: make(map[uuid.UUID]nodeLoad, len(nodes))}
+	for i := range nodes {
+		node := &nodes[i]
+		mbps, err := a.nodeMbps(ctx, node)
+		if err != nil {
+			a.logger.Warnf("Failed to measure bandwidth of node %s: %v", node.Name, err)
+			continue
+		}
+		capacity := float64(node.Capacity().MaxMbps)
+		if capacity == 0 {
+			capacity = float64(policy.NodeMbps)
+		}
+		load.nodes[node.ID] = nodeLoad{mbps: mbps, capacity: capacity}
+		load.mbps += mbps
+		load.capacity += capacity
+	}
+	return load, nil
+}
+
+func (a *Autoscaler) nodeMbps(ctx context.Context, node *models.VPSNode) (float64, error) {
+	if nodeCapability(node, "admission_control") != "true" {
+		return 0, fmt.Errorf("its agent does not measure bandwidth")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, autoscaleNodeTimeout)
+	defer cancel()
+
+	conn, err := a.nodeHandler.connect(node.ID.String())
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	resp, err := pb.NewNodeManagerClient(conn).GetNodeCapacity(ctx, &pb.GetNodeCapacityRequest{NodeId: node.ID.String()})
+	if err != nil {
+		return 0, err
+	}
+	if resp.Utilization == nil {
+		return 0, nil
+	}
+	return resp.Utilization.Mbps, nil
+}
+
+// trackIdle marks the policy's servers idle while their node is under the scale-down
+// percent without users and returns the one idle longest once it is past the idle period,
+// provided the group stays under the scale-up percent without it
+func (a *Autoscaler) trackIdle(policy *models.ScalingPolicy, load groupLoad, servers []models.ProvisionedServer, now time.Time) *models.ProvisionedServer {
+	var candidate *models.ProvisionedServer
+	for i := range servers {
+		server := &servers[i]
+		if server.Status != models.ProvisionStatusActive || server.NodeID == nil {
+			continue
+		}
+
+		measured, ok := load.nodes[*server.NodeID]
+		idle := ok && measured.capacity > 0 && 100*measured.mbps/measured.capacity < float64(policy.ScaleDownPercent)
+		if idle {
+			users, err := a.nodeHandler.activeUsers(server.NodeID.String())
+			idle = err == nil && users == 0
+		}
+
+		switch {
+		case idle && server.IdleSince == nil:
+			server.IdleSince = &now
+		case !idle && server.IdleSince != nil:
+			server.IdleSince = nil
+		default:
+			if idle && now.Sub(*server.IdleSince) >= time.Duration(policy.IdleMinutes)*time.Minute {
+				remaining := groupLoad{mbps: load.mbps - measured.mbps, capacity: load.capacity - measured.capacity}
+				if remaining.utilization() < float64(policy.ScaleUpPercent) &&
+					(candidate == nil || server.IdleSince.Before(*candidate.IdleSince)) {
+					candidate = server
+				}
+			}
+			continue
+		}
+		if err := a.nodeHandler.db.Model(server).Update("idle_since", server.IdleSince).Error; err != nil {
+			a.logger.Errorf("Failed to save idle state of server %s: %v", server.Name, err)
+		}
+	}
+	return candidate
+}
+
+// registerTimeout is how long a new server may take to register before it is destroyed
+func (a *Autoscaler) registerTimeout() time.Duration {
+	if a.config.RegisterTimeout <= 0 {
+		return defaultRegisterTimeout
+	}
+	return time.Duration(a.config.RegisterTimeout) * time.Second
+}
+
+// provision creates a server with the settings of policy. The server is recorded before the
+// provider is asked, so a server created by a call that failed midway is still destroyed
+// when its agent does not register.
+func (a *Autoscaler) provision(ctx context.Context, policy *models.ScalingPolicy, reason string) (*models.ProvisionedServer, error) {
+	driver, ok := a.drivers[policy.Provider]
+	if !ok {
+		return nil, fmt.Errorf("provider %s has no API token configured", policy.Provider)
+	}
+
+	id := uuid.New()
+	server := &models.ProvisionedServer{
+		ID:        id,
+		PolicyID:  &policy.ID,
+		NodeGroup: policy.NodeGroup,
+		Provider:  policy.Provider,
+		// Server names are hostnames, which cannot hold the underscores of group names
+		Name:   strings.ReplaceAll(policy.NodeGroup, "_", "-") + "-" + id.String()[:8],
+		Region: policy.Region,
+		Size:   policy.Size,
+		Status: models.ProvisionStatusPending,
+	}
+	// The token expires with the registration deadline, after which the server is destroyed
+	joinToken, err := a.joinTokens.Mint(nil, &id, a.registerTimeout())
+	if err != nil {
+		return nil, err
+	}
+	userData, err := provisioning.UserData(provisioning.AgentBootstrap{
+		ProvisionID:  id.String(),
+		NodeName:     server.Name,
+		Location:     policy.Location,
+		Country:      policy.Country,
+		MasterServer: a.config.MasterServer,
+		JoinURL:      a.config.JoinURL,
+		JoinToken:    joinToken,
+		AgentURL:     provisioning.AgentURL(a.config, ""),
+		HelperURL:    provisioning.HelperURL(a.config, ""),
+		SSHKeys:      a.config.SSHKeys,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to render user data: %w", err)
+	}
+
+	db := a.nodeHandler.db
+	if err := db.Create(server).Error; err != nil {
+		return nil, fmt.Errorf("failed to save server: %w", err)
+	}
+
+	created, err := driver.Create(ctx, provisioning.ServerSpec{
+		Name:     server.Name,
+		Region:   policy.Region,
+		Size:     policy.Size,
+		Image:    policy.Image,
+		UserData: userData,
+		Tags:     []string{"hysteryvpn", "hysteryvpn-" + strings.ReplaceAll(policy.NodeGroup, "_", "-")},
+	})
+	if err != nil {
+		now := time.Now()
+		server.Status = models.ProvisionStatusFailed
+		server.Error = err.Error()
+		server.DestroyedAt = &now
+		if saveErr := db.Save(server).Error; saveErr != nil {
+			a.logger.Errorf("Failed to save server %s: %v", server.Name, saveErr)
+		}
+		return server, fmt.Errorf("failed to create %s server: %w", policy.Provider, err)
+	}
+
+	server.ServerID = created.ID
+	server.IPAddress = created.IPv4
+	server.IPv6Address = created.IPv6
+	if err := db.Save(server).Error; err != nil {
+		return server, fmt.Errorf("server %s created but not saved: %w", created.ID, err)
+	}
+	a.logger.Infof("Provisioned %s server %s for node group %s: %s", policy.Provider, server.Name, policy.NodeGroup, reason)
+	return server, nil
+}
+
+// destroy deletes the server with its provider and removes its node, leaving the server in
+// status with reason as its error. A server the provider fails to delete stays destroying
+// and is retried.
+func (a *Autoscaler) destroy(ctx context.Context, server *models.ProvisionedServer, status, reason string) error {
+	db := a.nodeHandler.db
+
+	server.Status = models.ProvisionStatusDestroying
+	server.Error = reason
+	if err := db.Save(server).Error; err != nil {
+		return fmt.Errorf("failed to save server: %w", err)
+	}
+
+	if server.ServerID != "" {
+		driver, ok := a.drivers[server.Provider]
+		if !ok {
+			return fmt.Errorf("provider %s has no API token configured", server.Provider)
+		}
+		if err := driver.Delete(ctx, server.ServerID); err != nil && !errors.Is(err, provisioning.ErrNotFound) {
+			return fmt.Errorf("failed to delete %s server %s: %w", server.Provider, server.ServerID, err)
+		}
+	}
+
+	if server.NodeID != nil {
+		if err := db.Delete(&models.VPSNode{}, "id = ?", *server.NodeID).Error; err != nil {
+			a.logger.Errorf("Failed to remove node %s of destroyed server %s: %v", *server.NodeID, server.Name, err)
+		}
+		server.NodeID = nil
+	}
+
+	now := time.Now()
+	server.Status = status
+	server.DestroyedAt = &now
+	if err := db.Save(server).Error; err != nil {
+		return fmt.Errorf("server destroyed but not saved: %w", err)
+	}
+	a.logger.Infof("Destroyed %s server %s: %s", server.Provider, server.Name, reason)
+	return nil
+}
+
+func (a *Autoscaler) providers() []string {
+	names := make([]string, 0, len(a.drivers))
+	for name := range a.drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ListScalingPolicies returns every policy with the last utilization measured for its group
+func (a *Autoscaler) ListScalingPolicies(ctx context.Context, req *pb.ListScalingPoliciesRequest) (*pb.ListScalingPoliciesResponse, error) {
+	var policies []models.ScalingPolicy
+	if err := a.nodeHandler.db.Order("node_group").Find(&policies).Error; err != nil {
+		return nil, fmt.Errorf("failed to get scaling policies: %w", err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	resp := &pb.ListScalingPoliciesResponse{
+		Success:   true,
+		Message:   "Scaling policies retrieved successfully",
+		Policies:  make([]*pb.ScalingPolicy, 0, len(policies)),
+		Providers: a.providers(),
+	}
+	for i := range policies {
+		resp.Policies = append(resp.Policies, a.scalingPolicyToProto(&policies[i]))
+	}
+	return resp, nil
+}
+
+// SaveScalingPolicy creates a policy, or updates it when an ID is given
+func (a *Autoscaler) SaveScalingPolicy(ctx context.Context, req *pb.SaveScalingPolicyRequest) (*pb.SaveScalingPolicyResponse, error) {
+	if req.Policy == nil {
+		return nil, fmt.Errorf("policy is required")
+	}
+
+	db := a.nodeHandler.db
+	policy := models.ScalingPolicy{ScaleUpPercent: 80, ScaleDownPercent: 30, IdleMinutes: 30, Cooldown: 600}
+	if req.Policy.Id != "" {
+		if err := db.First(&policy, "id = ?", req.Policy.Id).Error; err != nil {
+			return nil, fmt.Errorf("scaling policy not found: %w", err)
+		}
+	}
+	switch req.Policy.Provider {
+	case "hetzner", "digitalocean", "vultr":
+	default:
+		return nil, fmt.Errorf("unsupported provider %q", req.Policy.Provider)
+	}
+
+	policy.NodeGroup = req.Policy.NodeGroup
+	policy.Provider = req.Policy.Provider
+	policy.Region = req.Policy.Region
+	policy.Size = req.Policy.Size
+	policy.Image = req.Policy.Image
+	policy.Location = req.Policy.Location
+	policy.Country = strings.ToUpper(req.Policy.Country)
+	policy.MinNodes = int(req.Policy.MinNodes)
+	policy.MaxNodes = int(req.Policy.MaxNodes)
+	policy.NodeMbps = int(req.Policy.NodeMbps)
+	if req.Policy.ScaleUpPercent != 0 {
+		policy.ScaleUpPercent = int(req.Policy.ScaleUpPercent)
+	}
+	if req.Policy.ScaleDownPercent != 0 {
+		policy.ScaleDownPercent = int(req.Policy.ScaleDownPercent)
+	}
+	if req.Policy.IdleMinutes != 0 {
+		policy.IdleMinutes = int(req.Policy.IdleMinutes)
+	}
+	if req.Policy.Cooldown != 0 {
+		policy.Cooldown = int(req.Policy.Cooldown)
+	}
+	policy.Enabled = req.Policy.Enabled
+	if err := policy.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid scaling policy: %w", err)
+	}
+
+	if err := db.Save(&policy).Error; err != nil {
+		return nil, fmt.Errorf("failed to save scaling policy: %w", err)
+	}
+
+	message := "Scaling policy saved successfully"
+	if _, ok := a.drivers[policy.Provider]; !ok {
+		message = fmt.Sprintf("Scaling policy saved; provider %s has no API token configured", policy.Provider)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return &pb.SaveScalingPolicyResponse{
+		Success: true,
+		Message: message,
+		Policy:  a.scalingPolicyToProto(&policy),
+	}, nil
+}
+
+// DeleteScalingPolicy removes a policy; the servers it created stay until destroyed
+func (a *Autoscaler) DeleteScalingPolicy(ctx context.Context, req *pb.DeleteScalingPolicyRequest) (*pb.DeleteScalingPolicyResponse, error) {
+	var policy models.ScalingPolicy
+	if err := a.nodeHandler.db.First(&policy, "id = ?", req.PolicyId).Error; err != nil {
+		return nil, fmt.Errorf("scaling policy not found: %w", err)
+	}
+	if err := a.nodeHandler.db.Delete(&policy).Error; err != nil {
+		return nil, fmt.Errorf("failed to delete scaling policy: %w", err)
+	}
+
+	a.mu.Lock()
+	delete(a.loads, policy.ID)
+	a.mu.Unlock()
+
+	return &pb.DeleteScalingPolicyResponse{
+		Success: true,
+		Message: "Scaling policy deleted successfully",
+	}, nil
+}
+
+// ListProvisionedServers returns the servers created for nodes, newest first
+func (a *Autoscaler) ListProvisionedServers(ctx context.Context, req *pb.ListProvisionedServersRequest) (*pb.ListProvisionedServersResponse, error) {
+	query := a.nodeHandler.db.Order("created_at DESC")
+	if req.NodeGroup != "" {
+		query = query.Where("node_group = ?", req.NodeGroup)
+	}
+	if !req.IncludeDestroyed {
+		query = query.Where("status NOT IN ?", []string{models.ProvisionStatusDestroyed, models.ProvisionStatusFailed})
+	}
+
+	var servers []models.ProvisionedServer
+	if err := query.Find(&servers).Error; err != nil {
+		return nil, fmt.Errorf("failed to get provisioned servers: %w", err)
+	}
+
+	resp := &pb.ListProvisionedServersResponse{
+		Success: true,
+		Message: "Provisioned servers retrieved successfully",
+		Servers: make([]*pb.ProvisionedServer, 0, len(servers)),
+	}
+	for i := range servers {
+		resp.Servers = append(resp.Servers, provisionedServerToProto(&servers[i]))
+	}
+	return resp, nil
+}
+
+// ProvisionServer creates a server for a node group right away, with the settings of its
+// policy whether or not the policy is enabled. The group's cooldown starts over.
+func (a *Autoscaler) ProvisionServer(ctx context.Context, req *pb.ProvisionServerRequest) (*pb.ProvisionServerResponse, error) {
+	var policy models.ScalingPolicy
+	if err := a.nodeHandler.db.First(&policy, "node_group = ?", req.NodeGroup).Error; err != nil {
+		return nil, fmt.Errorf("node group %q has no scaling policy: %w", req.NodeGroup, err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	server, err := a.provision(ctx, &policy, "requested by an admin")
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	policy.LastScaledAt = &now
+	if err := a.nodeHandler.db.Model(&policy).Update("last_scaled_at", policy.LastScaledAt).Error; err != nil {
+		a.logger.Errorf("Failed to save scaling state of node group %s: %v", policy.NodeGroup, err)
+	}
+
+	return &pb.ProvisionServerResponse{
+		Success: true,
+		Message: fmt.Sprintf("Server %s created; its node registers once the agent is installed", server.Name),
+		Server:  provisionedServerToProto(server),
+	}, nil
+}
+
+// DestroyServer destroys a provisioned server and removes its node, whatever its users
+func (a *Autoscaler) DestroyServer(ctx context.Context, req *pb.DestroyServerRequest) (*pb.DestroyServerResponse, error) {
+	var server models.ProvisionedServer
+	if err := a.nodeHandler.db.First(&server, "id = ?", req.ServerId).Error; err != nil {
+		return nil, fmt.Errorf("provisioned server not found: %w", err)
+	}
+	if server.Status == models.ProvisionStatusDestroyed || server.Status == models.ProvisionStatusFailed {
+		return nil, fmt.Errorf("server %s is already destroyed", server.Name)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.destroy(ctx, &server, models.ProvisionStatusDestroyed, "destroyed by an admin"); err != nil {
+		return nil, err
+	}
+	return &pb.DestroyServerResponse{
+		Success: true,
+		Message: fmt.Sprintf("Server %s destroyed", server.Name),
+		Server:  provisionedServerToProto(&server),
+	}, nil
+}
+
+// scalingPolicyToProto converts a policy with its last measurement; a.mu must be held
+func (a *Autoscaler) scalingPolicyToProto(policy *models.ScalingPolicy) *pb.ScalingPolicy {
+	result := &pb.ScalingPolicy{
+		Id:               policy.ID.String(),
+		NodeGroup:        policy.NodeGroup,
+		Provider:         policy.Provider,
+		Region:           policy.Region,
+		Size:             policy.Size,
+		Image:            policy.Image,
+		Location:         policy.Location,
+		Country:          policy.Country,
+		MinNodes:         int32(policy.MinNodes),
+		MaxNodes:         int32(policy.MaxNodes),
+		NodeMbps:         int32(policy.NodeMbps),
+		ScaleUpPercent:   int32(policy.ScaleUpPercent),
+		ScaleDownPercent: int32(policy.ScaleDownPercent),
+		IdleMinutes:      int32(policy.IdleMinutes),
+		Cooldown:         int32(policy.Cooldown),
+		Enabled:          policy.Enabled,
+		LastError:        policy.LastError,
+	}
+	if policy.LastScaledAt != nil {
+		result.LastScaledAt = policy.LastScaledAt.Unix()
+	}
+	if load, ok := a.loads[policy.ID]; ok {
+		result.UtilizationPercent = load.utilization()
+		result.OnlineNodes = int32(load.online)
+	}
+	return result
+}
+
+func provisionedServerToProto(server *models.ProvisionedServer) *pb.ProvisionedServer {
+	result := &pb.ProvisionedServer{
+		Id:          server.ID.String(),
+		NodeGroup:   server.NodeGroup,
+		Provider:    server.Provider,
+		ServerId:    server.ServerID,
+		Name:        server.Name,
+		Region:      server.Region,
+		Size:        server.Size,
+		IpAddress:   server.IPAddress,
+		Ipv6Address: server.IPv6Address,
+		Status:      server.Status,
+		Error:       server.Error,
+		CreatedAt:   server.CreatedAt.Unix(),
+	}
+	if server.PolicyID != nil {
+		result.PolicyId = server.PolicyID.String()
+	}
+	if server.NodeID != nil {
+		result.NodeId = server.NodeID.String()
+	}
+	if server.RegisteredAt != nil {
+		result.RegisteredAt = server.RegisteredAt.Unix()
+	}
+	if server.DestroyedAt != nil {
+		result.DestroyedAt = server.DestroyedAt.Unix()
+	}
+	return result
+}
@@ -0,0 +1,398 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"hysteria2_microservices/orchestrator-service/internal/backup"
+	"hysteria2_microservices/orchestrator-service/internal/config"
+	"hysteria2_microservices/orchestrator-service/internal/models"
+	pb "hysteria2_microservices/proto"
+)
+
+const (
+	defaultBackupInterval = 24 * time.Hour
+	backupRetryInterval   = 15 * time.Minute
+	backupTimeout         = 30 * time.Minute
+	backupNodeTimeout     = 30 * time.Second
+	restoreNodeTimeout    = 5 * time.Minute
+)
+
+// BackupHandler writes disaster-recovery backups of the control-plane tables and of the
+// files each node cannot rebuild (node key, server configs with the Reality keys,
+// certificates) to S3-compatible storage, encrypted with the configured key. The
+// database is restored with the orchestrator-backup command; RestoreNodes then writes the
+// node files back and pushes the stored configuration to the nodes again.
+type BackupHandler struct {
+	leadership
+	nodeHandler *NodeHandler
+	config      config.BackupConfig
+	logger      *logrus.Logger
+
+	// mu lets one backup run at a time
+	mu sync.Mutex
+}
+
+// NewBackupHandler creates a new BackupHandler
+func NewBackupHandler(nodeHandler *NodeHandler, cfg config.BackupConfig, logger *logrus.Logger) *BackupHandler {
+	return &BackupHandler{
+		nodeHandler: nodeHandler,
+		config:      cfg,
+		logger:      logger,
+	}
+}
+
+// Start takes a backup whenever the latest one is older than the interval, until ctx is
+// cancelled. Waiting for the latest backup to age keeps a restarting orchestrator from
+// replacing good backups through the retention limit.
+func (h *BackupHandler) Start(ctx context.Context) {
+	if !h.config.Enabled {
+		h.logger.Info("Scheduled backups disabled")
+		return
+	}
+	if _, _, err := h.target(); err != nil {
+		h.logger.Errorf("Scheduled backups disabled: %v", err)
+		return
+	}
+
+	interval := time.Duration(h.config.Interval) * time.Second
+	if interval <= 0 {
+		interval = defaultBackupInterval
+	}
+
+	go func() {
+		wait := h.untilNext(ctx, interval)
+		for {
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return
+			}
+
+			if !h.leading() {
+				// Check again when the leader's next backup is due
+				wait = h.untilNext(ctx, interval)
+				if wait == 0 {
+					wait = backupRetryInterval
+				}
+				continue
+			}
+
+			wait = interval
+			info, failed, err := h.run(ctx)
+			if err != nil {
+				h.logger.Errorf("Scheduled backup failed: %v", err)
+				wait = backupRetryInterval
+				continue
+			}
+			if len(failed) > 0 {
+				h.logger.Warnf("Backup %s is missing the files of node(s) %s", info.Name, strings.Join(failed, ", "))
+			}
+		}
+	}()
+	h.logger.Infof("Scheduled backups every %s", interval)
+}
+
+// RunBackup takes a backup now
+func (h *BackupHandler) RunBackup(ctx context.Context, req *pb.RunBackupRequest) (*pb.RunBackupResponse, error) {
+	info, failed, err := h.run(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &pb.RunBackupResponse{
+		Success:     len(failed) == 0,
+		Message:     fmt.Sprintf("Backup %s written", info.Name),
+		Backup:      info,
+		FailedNodes: failed,
+	}
+	if len(failed) > 0 {
+		resp.Message = fmt.Sprintf("Backup %s written without the files of %d node(s)", info.Name, len(failed))
+	}
+	return resp, nil
+}
+
+// ListBackups lists the stored backups, newest first
+func (h *BackupHandler) ListBackups(ctx context.Context, req *pb.ListBackupsRequest) (*pb.ListBackupsResponse, error) {
+	store, _, err := h.target()
+	if err != nil {
+		return nil, err
+	}
+	objects, err := store.List(ctx, h.config.Prefix+"backup-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+
+	resp := &pb.ListBackupsResponse{}
+	for i := len(objects) - 1; i >= 0; i-- {
+		resp.Backups = append(resp.Backups, h.backupInfo(objects[i]))
+	}
+	return resp, nil
+}
+
+// RestoreNodes writes the files of the given nodes, or of every node in the backup, back
+// to the nodes and pushes their stored protocol matrix, masquerade and DNS policy. Nodes
+// are restored one at a time and a failed node does not stop the others.
+func (h *BackupHandler) RestoreNodes(ctx context.Context, req *pb.RestoreNodesRequest) (*pb.RestoreNodesResponse, error) {
+	if req.BackupName == "" || path.Base(req.BackupName) != req.BackupName {
+		return nil, fmt.Errorf("invalid backup name %q", req.BackupName)
+	}
+	store, key, err := h.target()
+	if err != nil {
+		return nil, err
+	}
+	data, err := store.Get(ctx, h.config.Prefix+req.BackupName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download backup: %w", err)
+	}
+	archive, err := backup.Open(data, key)
+	if err != nil {
+		return nil, err
+	}
+
+	nodeIDs := req.NodeIds
+	if len(nodeIDs) == 0 {
+		for _, node := range archive.Nodes {
+			nodeIDs = append(nodeIDs, node.NodeID)
+		}
+	}
+	if len(nodeIDs) == 0 {
+		return nil, fmt.Errorf("backup %s holds no node files", req.BackupName)
+	}
+
+	resp := &pb.RestoreNodesResponse{}
+	failed := 0
+	for _, nodeID := range nodeIDs {
+		result := h.restoreNode(ctx, archive, nodeID)
+		if result.Status == models.DeploymentStatusFailed {
+			failed++
+			h.logger.Warnf("Restore of node %s from %s failed: %s", nodeID, req.BackupName, result.Error)
+		}
+		resp.Nodes = append(resp.Nodes, result)
+	}
+
+	resp.Success = failed == 0
+	resp.Message = fmt.Sprintf("Restored %d of %d node(s) from %s", len(nodeIDs)-failed, len(nodeIDs), req.BackupName)
+	return resp, nil
+}
+
+// run dumps the tables, collects the node files and uploads the sealed archive, then
+// deletes the backups beyond the retention limit. It returns the nodes whose files are
+// missing from the backup.
+func (h *BackupHandler) run(ctx context.Context) (*pb.BackupInfo, []string, error) {
+	store, key, err := h.target()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !h.mu.TryLock() {
+		return nil, nil, fmt.Errorf("a backup is already running")
+	}
+	defer h.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, backupTimeout)
+	defer cancel()
+
+	archive, err := backup.Dump(h.nodeHandler.db)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to dump database: %w", err)
+	}
+	if h.config.NodeFiles {
+		h.collectNodeFiles(ctx, archive)
+	}
+
+	data, err := backup.Seal(archive, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	name := backup.ObjectName(archive.CreatedAt)
+	if err := store.Put(ctx, h.config.Prefix+name, data); err != nil {
+		return nil, nil, fmt.Errorf("failed to upload backup: %w", err)
+	}
+	h.logger.Infof("Backup %s written: %d table(s), %d node(s), %d bytes", name, len(archive.Tables), len(archive.Nodes), len(data))
+
+	h.prune(ctx, store)
+	return &pb.BackupInfo{Name: name, Size: int64(len(data)), CreatedAt: archive.CreatedAt.Unix()}, archive.FailedNodes, nil
+}
+
+// collectNodeFiles adds the critical files of every node to the archive. Offline nodes
+// and nodes that fail to answer are recorded as failed.
+func (h *BackupHandler) collectNodeFiles(ctx context.Context, archive *backup.Archive) {
+	var nodes []models.VPSNode
+	if err := h.nodeHandler.db.Order("name").Find(&nodes).Error; err != nil {
+		h.logger.Errorf("Failed to get nodes for backup: %v", err)
+		return
+	}
+
+	for i := range nodes {
+		node := &nodes[i]
+		if node.Status == models.NodeStatusOffline {
+			archive.FailedNodes = append(archive.FailedNodes, node.Name)
+			continue
+		}
+		files, err := h.backupNode(ctx, node.ID.String())
+		if err != nil {
+			h.logger.Warnf("Failed to back up files of node %s: %v", node.Name, err)
+			archive.FailedNodes = append(archive.FailedNodes, node.Name)
+			continue
+		}
+		archive.Nodes = append(archive.Nodes, backup.NodeFiles{
+			NodeID:   node.ID.String(),
+			NodeName: node.Name,
+			Files:    files,
+		})
+	}
+}
+
+func (h *BackupHandler) backupNode(ctx context.Context, nodeID string) ([]backup.NodeFile, error) {
+	ctx, cancel := context.WithTimeout(ctx, backupNodeTimeout)
+	defer cancel()
+
+	conn, err := h.nodeHandler.connect(nodeID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to node: %w", err)
+	}
+	defer conn.Close()
+
+	return nodeFiles(ctx, pb.NewNodeManagerClient(conn), nodeID)
+}
+
+// nodeFiles collects the critical files of a node through its agent
+func nodeFiles(ctx context.Context, client pb.NodeManagerClient, nodeID string) ([]backup.NodeFile, error) {
+	resp, err := client.BackupNodeFiles(ctx, &pb.BackupNodeFilesRequest{NodeId: nodeID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to collect files on node: %w", err)
+	}
+	if !resp.Success {
+		return nil, fmt.Errorf("%s", resp.Message)
+	}
+
+	files := make([]backup.NodeFile, 0, len(resp.Files))
+	for _, file := range resp.Files {
+		files = append(files, backup.NodeFile{Path: file.Path, Mode: file.Mode, Content: file.Content})
+	}
+	return files, nil
+}
+
+func (h *BackupHandler) restoreNode(ctx context.Context, archive *backup.Archive, nodeID string) *pb.NodeRestore {
+	result := &pb.NodeRestore{NodeId: nodeID, Status: models.DeploymentStatusFailed}
+
+	entry, ok := archive.Node(nodeID)
+	if !ok {
+		result.Error = "node has no files in the backup"
+		return result
+	}
+	result.NodeName = entry.NodeName
+
+	var node models.VPSNode
+	if err := h.nodeHandler.db.First(&node, "id = ?", entry.NodeID).Error; err != nil {
+		result.Error = fmt.Sprintf("node not found: %v", err)
+		return result
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, restoreNodeTimeout)
+	defer cancel()
+
+	conn, err := h.nodeHandler.connect(entry.NodeID)
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to connect to node: %v", err)
+		return result
+	}
+	defer conn.Close()
+
+	client := pb.NewNodeManagerClient(conn)
+
+	resp, err := client.RestoreNodeFiles(ctx, &pb.RestoreNodeFilesRequest{NodeId: entry.NodeID, Files: nodeFilesToProto(entry.Files)})
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to restore files on node: %v", err)
+		return result
+	}
+	result.RestoredFiles = resp.RestoredFiles
+	if !resp.Success {
+		result.Error = resp.Message
+		return result
+	}
+
+	pushed, err := pushStoredConfig(ctx, client, &node)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Config = pushed
+	result.Status = models.DeploymentStatusSuccess
+	return result
+}
+
+// prune deletes the oldest backups beyond the retention limit
+func (h *BackupHandler) prune(ctx context.Context, store *backup.Store) {
+	if h.config.Retention <= 0 {
+		return
+	}
+	objects, err := store.List(ctx, h.config.Prefix+"backup-")
+	if err != nil {
+		h.logger.Warnf("Failed to list backups for pruning: %v", err)
+		return
+	}
+	for i := 0; i < len(objects)-h.config.Retention; i++ {
+		if err := store.Delete(ctx, objects[i].Key); err != nil {
+			h.logger.Warnf("Failed to delete old backup %s: %v", objects[i].Key, err)
+			continue
+		}
+		h.logger.Infof("Deleted old backup %s", objects[i].Key)
+	}
+}
+
+// untilNext returns how long to wait for the next scheduled backup
+func (h *BackupHandler) untilNext(ctx context.Context, interval time.Duration) time.Duration {
+	store, _, err := h.target()
+	if err != nil {
+		return backupRetryInterval
+	}
+	objects, err := store.List(ctx, h.config.Prefix+"backup-")
+	if err != nil {
+		h.logger.Warnf("Failed to list backups: %v", err)
+		return backupRetryInterval
+	}
+	if len(objects) == 0 {
+		return 0
+	}
+	wait := time.Until(objects[len(objects)-1].LastModified.Add(interval))
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// target returns the bucket and encryption key backups use
+func (h *BackupHandler) target() (*backup.Store, []byte, error) {
+	key, err := backup.ParseKey(h.config.EncryptionKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	store, err := backup.NewStore(h.config)
+	if err != nil {
+		return nil, nil, err
+	}
+	return store, key, nil
+}
+
+func nodeFilesToProto(files []backup.NodeFile) []*pb.NodeFile {
+	result := make([]*pb.NodeFile, 0, len(files))
+	for _, file := range files {
+		result = append(result, &pb.NodeFile{Path: file.Path, Mode: file.Mode, Content: file.Content})
+	}
+	return result
+}
+
+func (h *BackupHandler) backupInfo(object backup.Object) *pb.BackupInfo {
+	return &pb.BackupInfo{
+		Name:      strings.TrimPrefix(object.Key, h.config.Prefix),
+		Size:      object.Size,
+		CreatedAt: object.LastModified.Unix(),
+	}
+}
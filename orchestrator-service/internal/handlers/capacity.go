@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"hysteria2_microservices/orchestrator-service/internal/models"
+	pb "hysteria2_microservices/proto"
+)
+
+// CapacityHandler keeps each node's capacity. The user cap is kept in the node metadata
+// for the api-service, which stops placing users on a full node; the connection and
+// bandwidth caps are pushed to the agent, which rejects new connections over them.
+type CapacityHandler struct {
+	nodeHandler *NodeHandler
+	logger      *logrus.Logger
+}
+
+// NewCapacityHandler creates a new CapacityHandler
+func NewCapacityHandler(nodeHandler *NodeHandler, logger *logrus.Logger) *CapacityHandler {
+	return &CapacityHandler{
+		nodeHandler: nodeHandler,
+		logger:      logger,
+	}
+}
+
+// SetNodeCapacity saves the node's capacity and applies the connection and bandwidth caps
+// on the node. The caps are saved even when the node cannot be reached and are applied by
+// calling again once it is back.
+func (h *CapacityHandler) SetNodeCapacity(ctx context.Context, req *pb.SetNodeCapacityRequest) (*pb.SetNodeCapacityResponse, error) {
+	if req.Capacity == nil {
+		return nil, status.Error(codes.InvalidArgument, "capacity is required")
+	}
+	if req.Capacity.MaxUsers < 0 || req.Capacity.MaxConnections < 0 || req.Capacity.MaxMbps < 0 {
+		return nil, status.Error(codes.InvalidArgument, "capacity limits must not be negative")
+	}
+
+	db := h.nodeHandler.db
+	var node models.VPSNode
+	if err := db.First(&node, "id = ?", req.NodeId).Error; err != nil {
+		return nil, fmt.Errorf("node not found: %w", err)
+	}
+
+	node.SetCapacity(models.NodeCapacity{
+		MaxUsers:       int(req.Capacity.MaxUsers),
+		MaxConnections: int(req.Capacity.MaxConnections),
+		MaxMbps:        int(req.Capacity.MaxMbps),
+	})
+	if err := db.Model(&node).Update("metadata", node.Metadata).Error; err != nil {
+		return nil, fmt.Errorf("failed to save node capacity: %w", err)
+	}
+
+	resp := &pb.SetNodeCapacityResponse{
+		Capacity: nodeCapacityProto(node.Capacity()),
+	}
+	if nodeCapability(&node, "admission_control") != "true" {
+		resp.Message = fmt.Sprintf("Capacity of node %s saved; its agent cannot enforce connection and bandwidth caps", node.Name)
+		return resp, nil
+	}
+
+	conn, err := h.nodeHandler.connect(req.NodeId)
+	if err != nil {
+		return nil, fmt.Errorf("capacity saved but node is unreachable: %w", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewNodeManagerClient(conn)
+
+	agentResp, err := client.SetNodeCapacity(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("capacity saved but the node rejected it: %w", err)
+	}
+
+	resp.Success = true
+	resp.Message = fmt.Sprintf("Capacity of node %s applied", node.Name)
+	resp.Utilization = agentResp.Utilization
+	if resp.Utilization == nil {
+		resp.Utilization = &pb.CapacityUtilization{}
+	}
+	if resp.Utilization.Users, err = h.nodeHandler.activeUsers(req.NodeId); err != nil {
+		return nil, err
+	}
+	h.logger.Infof("Node %s capacity set: %d users, %d connections, %d Mbps",
+		node.Name, req.Capacity.MaxUsers, req.Capacity.MaxConnections, req.Capacity.MaxMbps)
+	return resp, nil
+}
+
+// GetNodeCapacity returns the node's capacity and what it uses of it: the users assigned to
+// it and the connections and traffic its agent last measured
+func (h *CapacityHandler) GetNodeCapacity(ctx context.Context, req *pb.GetNodeCapacityRequest) (*pb.GetNodeCapacityResponse, error) {
+	var node models.VPSNode
+	if err := h.nodeHandler.db.First(&node, "id = ?", req.NodeId).Error; err != nil {
+		return nil, fmt.Errorf("node not found: %w", err)
+	}
+
+	users, err := h.nodeHandler.activeUsers(req.NodeId)
+	if err != nil {
+		return nil, err
+	}
+	resp := &pb.GetNodeCapacityResponse{
+		Success:     true,
+		Capacity:    nodeCapacityProto(node.Capacity()),
+		Utilization: &pb.CapacityUtilization{Users: users},
+	}
+	if !node.IsOnline() || nodeCapability(&node, "admission_control") != "true" {
+		resp.Message = fmt.Sprintf("Connections and traffic of node %s are not measured", node.Name)
+		return resp, nil
+	}
+
+	conn, err := h.nodeHandler.connect(req.NodeId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to node: %w", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewNodeManagerClient(conn)
+
+	agentResp, err := client.GetNodeCapacity(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get node capacity: %w", err)
+	}
+	if agentResp.Utilization != nil {
+		resp.Utilization = agentResp.Utilization
+		resp.Utilization.Users = users
+	}
+	return resp, nil
+}
+
+// activeUsers counts the active users with an active assignment on the node
+func (h *NodeHandler) activeUsers(nodeID string) (int32, error) {
+	var count int64
+	err := h.db.Model(&models.NodeAssignment{}).
+		Joins("JOIN users ON users.id = node_assignments.user_id").
+		Where("node_assignments.node_id = ? AND node_assignments.is_active = ? AND users.status = ?",
+			nodeID, true, models.UserStatusActive).
+		Count(&count).Error
+	if err != nil {
+		return 0, fmt.Errorf("failed to count node users: %w", err)
+	}
+	return int32(count), nil
+}
+
+func nodeCapacityProto(capacity models.NodeCapacity) *pb.NodeCapacity {
+	return &pb.NodeCapacity{
+		MaxUsers:       int32(capacity.MaxUsers),
+		MaxConnections: int32(capacity.MaxConnections),
+		MaxMbps:        int32(capacity.MaxMbps),
+	}
+}
@@ -0,0 +1,367 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm/clause"
+
+	"hysteria2_microservices/orchestrator-service/internal/models"
+	pb "hysteria2_microservices/proto"
+)
+
+// UploadCertificate validates an operator-provided certificate, stores it in place of the
+// domain's previous upload and installs it on every node serving a domain it covers. Nodes
+// that cannot be reached now get it at a later inventory sync.
+func (h *CertificateInventoryHandler) UploadCertificate(ctx context.Context, req *pb.UploadCertificateRequest) (*pb.UploadCertificateResponse, error) {
+	domain, err := models.NormalizeSNIDomain(req.Domain)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	upload, err := parseUploadedCertificate(domain, req.CertificatePem, req.PrivateKeyPem, req.CaBundlePem)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	err = h.nodeHandler.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "domain"}},
+		DoUpdates: clause.AssignmentColumns([]string{
+			"certificate_pem", "private_key_pem", "ca_bundle_pem", "issuer", "fingerprint", "not_before", "not_after", "updated_at",
+		}),
+	}).Create(upload).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to save certificate: %w", err)
+	}
+	var saved models.UploadedCertificate
+	if err := h.nodeHandler.db.First(&saved, "domain = ?", domain).Error; err != nil {
+		return nil, fmt.Errorf("failed to get certificate: %w", err)
+	}
+	upload = &saved
+	h.logger.Infof("Certificate for %s uploaded, issued by %s, valid until %s", domain, upload.Issuer, upload.NotAfter.Format("2006-01-02"))
+
+	var nodes []models.VPSNode
+	if err := h.nodeHandler.db.Find(&nodes).Error; err != nil {
+		return nil, fmt.Errorf("failed to get nodes: %w", err)
+	}
+
+	resp := &pb.UploadCertificateResponse{Failures: make(map[string]string)}
+	for i := range nodes {
+		node := &nodes[i]
+		domains := coveredDomains(upload, node)
+		if len(domains) == 0 {
+			continue
+		}
+		if err := h.installOnNode(ctx, node, upload, domains); err != nil {
+			resp.Failures[node.ID.String()] = err.Error()
+			continue
+		}
+		resp.Installed = append(resp.Installed, node.ID.String())
+	}
+
+	resp.Certificate = uploadedCertificateToProto(upload, nodes)
+	resp.Success = len(resp.Failures) == 0
+	resp.Message = filterSyncMessage(fmt.Sprintf("Certificate for %s installed on %d node(s)", domain, len(resp.Installed)), resp.Failures)
+	return resp, nil
+}
+
+// ListUploadedCertificates returns the uploaded certificates, without their keys, the ones
+// expiring first
+func (h *CertificateInventoryHandler) ListUploadedCertificates(ctx context.Context, req *pb.ListUploadedCertificatesRequest) (*pb.ListUploadedCertificatesResponse, error) {
+	var uploads []models.UploadedCertificate
+	if err := h.nodeHandler.db.Order("not_after, domain").Find(&uploads).Error; err != nil {
+		return nil, fmt.Errorf("failed to get uploaded certificates: %w", err)
+	}
+
+	var nodes []models.VPSNode
+	if err := h.nodeHandler.db.Select("id", "sni_domains").Find(&nodes).Error; err != nil {
+		return nil, fmt.Errorf("failed to get nodes: %w", err)
+	}
+
+	resp := &pb.ListUploadedCertificatesResponse{
+		Success:      true,
+		Message:      "Uploaded certificates retrieved successfully",
+		Certificates: make([]*pb.UploadedCertificate, 0, len(uploads)),
+	}
+	for i := range uploads {
+		resp.Certificates = append(resp.Certificates, uploadedCertificateToProto(&uploads[i], nodes))
+	}
+	return resp, nil
+}
+
+// DeleteUploadedCertificate deletes the upload of a domain. Nodes keep serving the
+// certificate until another one replaces it.
+func (h *CertificateInventoryHandler) DeleteUploadedCertificate(ctx context.Context, req *pb.DeleteUploadedCertificateRequest) (*pb.DeleteUploadedCertificateResponse, error) {
+	domain, err := models.NormalizeSNIDomain(req.Domain)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	result := h.nodeHandler.db.Where("domain = ?", domain).Delete(&models.UploadedCertificate{})
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to delete uploaded certificate: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return nil, status.Errorf(codes.NotFound, "no certificate uploaded for %s", domain)
+	}
+
+	h.logger.Infof("Uploaded certificate for %s deleted", domain)
+	return &pb.DeleteUploadedCertificateResponse{
+		Success: true,
+		Message: fmt.Sprintf("Uploaded certificate for %s deleted, nodes keep serving it until it is replaced", domain),
+	}, nil
+}
+
+// installOnNode installs an uploaded certificate under each of the given node domains and
+// syncs the node's inventory afterwards
+func (h *CertificateInventoryHandler) installOnNode(ctx context.Context, node *models.VPSNode, upload *models.UploadedCertificate, domains []string) error {
+	if !node.IsOnline() {
+		return fmt.Errorf("node is offline")
+	}
+	if nodeCapability(node, "cert_upload") != "true" {
+		return fmt.Errorf("agent does not support uploaded certificates")
+	}
+
+	conn, err := h.nodeHandler.connect(node.ID.String())
+	if err != nil {
+		return fmt.Errorf("failed to connect to node: %w", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewNodeManagerClient(conn)
+	for _, domain := range domains {
+		if err := installUploadedCertificate(ctx, client, node, upload, domain); err != nil {
+			return err
+		}
+	}
+
+	if nodeCapability(node, "cert_inventory") == "true" {
+		if err := h.syncNode(ctx, node); err != nil {
+			h.logger.Warnf("Certificate inventory of node %s failed after upload: %v", node.Name, err)
+		}
+	}
+	return nil
+}
+
+// installMissingUploads installs the uploaded certificates the node should serve but does
+// not, e.g. because it was offline at upload or got a covered domain since. It reports
+// whether anything was installed.
+func (h *CertificateInventoryHandler) installMissingUploads(ctx context.Context, client pb.NodeManagerClient, node *models.VPSNode, served []*pb.NodeCertificate) (bool, error) {
+	if nodeCapability(node, "cert_upload") != "true" {
+		return false, nil
+	}
+
+	var uploads []models.UploadedCertificate
+	if err := h.nodeHandler.db.Find(&uploads).Error; err != nil {
+		return false, fmt.Errorf("failed to get uploaded certificates: %w", err)
+	}
+
+	installed := false
+	for i := range uploads {
+		upload := &uploads[i]
+		for _, domain := range coveredDomains(upload, node) {
+			if servesUpload(served, upload, domain) {
+				continue
+			}
+			if err := installUploadedCertificate(ctx, client, node, upload, domain); err != nil {
+				return installed, err
+			}
+			installed = true
+		}
+	}
+	return installed, nil
+}
+
+func installUploadedCertificate(ctx context.Context, client pb.NodeManagerClient, node *models.VPSNode, upload *models.UploadedCertificate, domain string) error {
+	resp, err := client.InstallCertificate(ctx, &pb.InstallCertificateRequest{
+		NodeId:         node.ID.String(),
+		Domain:         domain,
+		CertificatePem: upload.CertificatePEM,
+		PrivateKeyPem:  upload.PrivateKeyPEM,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to install certificate for %s on node: %w", domain, err)
+	}
+	if !resp.Success {
+		return fmt.Errorf("%s", resp.Message)
+	}
+	return nil
+}
+
+// servesUpload reports whether the node lists the uploaded certificate for domain. The
+// expiry tells uploads apart: an upload replacing another one is valid longer.
+func servesUpload(served []*pb.NodeCertificate, upload *models.UploadedCertificate, domain string) bool {
+	for _, cert := range served {
+		if cert.Domain == domain && cert.Source == "files" && cert.NotAfter == upload.NotAfter.Unix() {
+			return true
+		}
+	}
+	return false
+}
+
+// coveredDomains returns the node's SNI domains the uploaded certificate serves
+func coveredDomains(upload *models.UploadedCertificate, node *models.VPSNode) []string {
+	var domains []string
+	for _, domain := range node.GetSNIDomains() {
+		if upload.Covers(domain) {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+func uploadedCertificateToProto(upload *models.UploadedCertificate, nodes []models.VPSNode) *pb.UploadedCertificate {
+	cert := &pb.UploadedCertificate{
+		Domain:      upload.Domain,
+		Issuer:      upload.Issuer,
+		Fingerprint: upload.Fingerprint,
+		NotBefore:   upload.NotBefore.Unix(),
+		NotAfter:    upload.NotAfter.Unix(),
+		CustomCa:    upload.CABundlePEM != "",
+		NodeIds:     []string{},
+		UploadedAt:  upload.UpdatedAt.Unix(),
+	}
+	for i := range nodes {
+		if len(coveredDomains(upload, &nodes[i])) > 0 {
+			cert.NodeIds = append(cert.NodeIds, nodes[i].ID.String())
+		}
+	}
+	return cert
+}
+
+// parseUploadedCertificate validates an uploaded certificate for a normalized domain: the
+// key must match the leaf, the leaf must cover the domain and be valid now, and the chain
+// must verify against the roots of the CA bundle, or the system roots when none is given.
+// The stored chain is the verified one without its root, so nodes also serve intermediates
+// that came in the bundle.
+func parseUploadedCertificate(domain, certPEM, keyPEM, caBundlePEM string) (*models.UploadedCertificate, error) {
+	pair, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		return nil, fmt.Errorf("certificate and private key do not match: %w", err)
+	}
+
+	chain := make([]*x509.Certificate, 0, len(pair.Certificate))
+	for _, der := range pair.Certificate {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate: %w", err)
+		}
+		chain = append(chain, cert)
+	}
+	leaf := chain[0]
+
+	now := time.Now()
+	if now.After(leaf.NotAfter) {
+		return nil, fmt.Errorf("certificate expired on %s", leaf.NotAfter.Format("2006-01-02"))
+	}
+	if now.Before(leaf.NotBefore) {
+		return nil, fmt.Errorf("certificate is not valid before %s", leaf.NotBefore.Format("2006-01-02"))
+	}
+	if !leafCovers(leaf, domain) {
+		return nil, fmt.Errorf("certificate is not valid for %s, it covers %s", domain, strings.Join(leaf.DNSNames, ", "))
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	var roots *x509.CertPool
+	if strings.TrimSpace(caBundlePEM) != "" {
+		if roots, err = parseCABundle(caBundlePEM, intermediates); err != nil {
+			return nil, err
+		}
+	} else if roots, err = x509.SystemCertPool(); err != nil {
+		return nil, fmt.Errorf("failed to load system roots: %w", err)
+	}
+	verified, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("certificate chain is incomplete or untrusted: %w", err)
+	}
+
+	served := verified[0]
+	if len(served) > 1 {
+		served = served[:len(served)-1]
+	}
+	var chainPEM strings.Builder
+	for _, cert := range served {
+		pem.Encode(&chainPEM, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+
+	issuer := leaf.Issuer.CommonName
+	if issuer == "" {
+		issuer = leaf.Issuer.String()
+	}
+	fingerprint := sha256.Sum256(leaf.Raw)
+	return &models.UploadedCertificate{
+		Domain:         domain,
+		CertificatePEM: chainPEM.String(),
+		PrivateKeyPEM:  strings.TrimSpace(keyPEM) + "\n",
+		CABundlePEM:    strings.TrimSpace(caBundlePEM),
+		Issuer:         issuer,
+		Fingerprint:    hex.EncodeToString(fingerprint[:]),
+		NotBefore:      leaf.NotBefore,
+		NotAfter:       leaf.NotAfter,
+	}, nil
+}
+
+// parseCABundle returns the self-signed roots of a CA bundle and adds its other
+// certificates to intermediates. Verification would take an intermediate in the roots for
+// an anchor and leave it out of the chain nodes serve.
+func parseCABundle(bundlePEM string, intermediates *x509.CertPool) (*x509.CertPool, error) {
+	roots := x509.NewCertPool()
+	found := false
+	rest := []byte(bundlePEM)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CA bundle: %w", err)
+		}
+		if bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil {
+			roots.AddCert(cert)
+			found = true
+			continue
+		}
+		intermediates.AddCert(cert)
+	}
+	if !found {
+		return nil, errors.New("CA bundle holds no root certificate")
+	}
+	return roots, nil
+}
+
+// leafCovers reports whether the leaf serves a normalized domain. A wildcard domain must be
+// a name of the certificate itself.
+func leafCovers(leaf *x509.Certificate, domain string) bool {
+	if !strings.HasPrefix(domain, "*.") {
+		return leaf.VerifyHostname(domain) == nil
+	}
+	for _, name := range leaf.DNSNames {
+		if strings.EqualFold(name, domain) {
+			return true
+		}
+	}
+	return false
+}
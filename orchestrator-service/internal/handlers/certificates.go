@@ -0,0 +1,329 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm"
+
+	"hysteria2_microservices/orchestrator-service/internal/config"
+	"hysteria2_microservices/orchestrator-service/internal/models"
+	pb "hysteria2_microservices/proto"
+)
+
+// certificateRenewTimeout bounds one node's renewal in a bulk renewal; certbot may run for
+// every certificate of the node
+const certificateRenewTimeout = 10 * time.Minute
+
+// CertificateInventoryHandler keeps a central inventory of the certificates every node
+// serves, so expiring and self-signed certificates can be found without asking each node,
+// and renews them in bulk
+type CertificateInventoryHandler struct {
+	leadership
+	nodeHandler *NodeHandler
+	config      config.CertificatesConfig
+	logger      *logrus.Logger
+}
+
+// NewCertificateInventoryHandler creates a new CertificateInventoryHandler
+func NewCertificateInventoryHandler(nodeHandler *NodeHandler, cfg config.CertificatesConfig, logger *logrus.Logger) *CertificateInventoryHandler {
+	return &CertificateInventoryHandler{
+		nodeHandler: nodeHandler,
+		config:      cfg,
+		logger:      logger,
+	}
+}
+
+// Start syncs the certificates of every online node once per interval until ctx is
+// cancelled, while this replica leads
+func (h *CertificateInventoryHandler) Start(ctx context.Context) {
+	if !h.config.Enabled {
+		h.logger.Info("Certificate inventory sync disabled")
+		return
+	}
+
+	interval := time.Duration(h.config.Interval) * time.Second
+	if interval <= 0 {
+		interval = 6 * time.Hour
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if h.leading() {
+				h.sync(ctx)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	h.logger.Infof("Syncing certificate inventory every %s", interval)
+}
+
+func (h *CertificateInventoryHandler) sync(ctx context.Context) {
+	var nodes []models.VPSNode
+	if err := h.nodeHandler.db.Where("status = ?", models.NodeStatusOnline).Find(&nodes).Error; err != nil {
+		h.logger.Errorf("Failed to get nodes for certificate inventory: %v", err)
+		return
+	}
+
+	synced := 0
+	for i := range nodes {
+		if ctx.Err() != nil {
+			return
+		}
+		if nodeCapability(&nodes[i], "cert_inventory") != "true" {
+			continue
+		}
+		if err := h.syncNode(ctx, &nodes[i]); err != nil {
+			h.logger.Warnf("Certificate inventory of node %s failed: %v", nodes[i].Name, err)
+			continue
+		}
+		synced++
+	}
+	h.logger.Infof("Certificate inventory synced: %d of %d node(s)", synced, len(nodes))
+}
+
+// syncNode replaces the stored certificates of node with the ones its agent lists, after
+// installing the uploaded certificates the node misses
+func (h *CertificateInventoryHandler) syncNode(ctx context.Context, node *models.VPSNode) error {
+	conn, err := h.nodeHandler.connect(node.ID.String())
+	if err != nil {
+		return fmt.Errorf("failed to connect to node: %w", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewNodeManagerClient(conn)
+
+	resp, err := listNodeCertificates(ctx, client, node)
+	if err != nil {
+		return err
+	}
+	installed, err := h.installMissingUploads(ctx, client, node, resp.Certificates)
+	if err != nil {
+		h.logger.Warnf("Uploaded certificates not installed on node %s: %v", node.Name, err)
+	}
+	if installed {
+		if resp, err = listNodeCertificates(ctx, client, node); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	rows := make([]models.NodeCertificate, 0, len(resp.Certificates))
+	for _, cert := range resp.Certificates {
+		rows = append(rows, models.NodeCertificate{
+			NodeID:     node.ID,
+			Domain:     cert.Domain,
+			Issuer:     cert.Issuer,
+			Source:     cert.Source,
+			SelfSigned: cert.SelfSigned,
+			NotBefore:  time.Unix(cert.NotBefore, 0),
+			NotAfter:   time.Unix(cert.NotAfter, 0),
+			SyncedAt:   now,
+		})
+	}
+
+	return h.nodeHandler.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("node_id = ?", node.ID).Delete(&models.NodeCertificate{}).Error; err != nil {
+			return fmt.Errorf("failed to clear certificates: %w", err)
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+		if err := tx.Create(&rows).Error; err != nil {
+			return fmt.Errorf("failed to save certificates: %w", err)
+		}
+		return nil
+	})
+}
+
+func listNodeCertificates(ctx context.Context, client pb.NodeManagerClient, node *models.VPSNode) (*pb.ListCertificatesResponse, error) {
+	resp, err := client.ListCertificates(ctx, &pb.ListCertificatesRequest{NodeId: node.ID.String()})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list certificates on node: %w", err)
+	}
+	if !resp.Success {
+		return nil, fmt.Errorf("%s", resp.Message)
+	}
+	return resp, nil
+}
+
+// ListCertificates returns the inventory, the certificates expiring first
+func (h *CertificateInventoryHandler) ListCertificates(ctx context.Context, req *pb.ListCertificatesRequest) (*pb.ListCertificatesResponse, error) {
+	if req.ExpiringWithinDays < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "expiring_within_days must not be negative")
+	}
+
+	query, err := h.certificateQuery(req.NodeId, req.ExpiringWithinDays, req.SelfSigned)
+	if err != nil {
+		return nil, err
+	}
+	if req.Domain != "" {
+		query = query.Where("domain = ?", strings.ToLower(req.Domain))
+	}
+
+	var certificates []models.NodeCertificate
+	if err := query.Order("not_after, domain").Find(&certificates).Error; err != nil {
+		return nil, fmt.Errorf("failed to get certificates: %w", err)
+	}
+
+	names, err := h.nodeNames()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &pb.ListCertificatesResponse{
+		Success:      true,
+		Message:      "Certificates retrieved successfully",
+		Certificates: make([]*pb.NodeCertificate, 0, len(certificates)),
+	}
+	for i := range certificates {
+		cert := &certificates[i]
+		resp.Certificates = append(resp.Certificates, &pb.NodeCertificate{
+			Domain:     cert.Domain,
+			Issuer:     cert.Issuer,
+			NotBefore:  cert.NotBefore.Unix(),
+			NotAfter:   cert.NotAfter.Unix(),
+			SelfSigned: cert.SelfSigned,
+			Source:     cert.Source,
+			NodeId:     cert.NodeID.String(),
+			NodeName:   names[cert.NodeID],
+			DaysLeft:   int32(time.Until(cert.NotAfter).Hours() / 24),
+			SyncedAt:   cert.SyncedAt.Unix(),
+		})
+	}
+	return resp, nil
+}
+
+// BulkRenewCertificates has the given nodes, or every node holding a certificate matching
+// the filters, renew their certificates. Nodes are renewed one after another and their
+// inventory is synced again afterwards.
+func (h *CertificateInventoryHandler) BulkRenewCertificates(ctx context.Context, req *pb.BulkRenewCertificatesRequest) (*pb.BulkRenewCertificatesResponse, error) {
+	if req.ExpiringWithinDays < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "expiring_within_days must not be negative")
+	}
+
+	nodeIDs := req.NodeIds
+	for _, nodeID := range nodeIDs {
+		if _, err := uuid.Parse(nodeID); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid node ID %q", nodeID)
+		}
+	}
+	if len(nodeIDs) == 0 {
+		query, err := h.certificateQuery("", req.ExpiringWithinDays, req.SelfSigned)
+		if err != nil {
+			return nil, err
+		}
+		if err := query.Distinct("node_id").Pluck("node_id", &nodeIDs).Error; err != nil {
+			return nil, fmt.Errorf("failed to get certificates: %w", err)
+		}
+	}
+	if len(nodeIDs) == 0 {
+		return &pb.BulkRenewCertificatesResponse{
+			Success: true,
+			Message: "No certificates match",
+		}, nil
+	}
+
+	var nodes []models.VPSNode
+	if err := h.nodeHandler.db.Where("id IN ?", nodeIDs).Find(&nodes).Error; err != nil {
+		return nil, fmt.Errorf("failed to get nodes: %w", err)
+	}
+
+	resp := &pb.BulkRenewCertificatesResponse{Failures: make(map[string]string)}
+	found := make(map[string]bool, len(nodes))
+	for i := range nodes {
+		node := &nodes[i]
+		found[node.ID.String()] = true
+		if err := h.renewNode(ctx, node); err != nil {
+			resp.Failures[node.ID.String()] = err.Error()
+			continue
+		}
+		resp.Renewed = append(resp.Renewed, node.ID.String())
+	}
+	for _, nodeID := range nodeIDs {
+		if !found[nodeID] {
+			resp.Failures[nodeID] = "node not found"
+		}
+	}
+
+	resp.Success = len(resp.Failures) == 0
+	resp.Message = filterSyncMessage(fmt.Sprintf("Certificates renewed on %d node(s)", len(resp.Renewed)), resp.Failures)
+	return resp, nil
+}
+
+func (h *CertificateInventoryHandler) renewNode(ctx context.Context, node *models.VPSNode) error {
+	if !node.IsOnline() {
+		return fmt.Errorf("node is offline")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, certificateRenewTimeout)
+	defer cancel()
+
+	conn, err := h.nodeHandler.connect(node.ID.String())
+	if err != nil {
+		return fmt.Errorf("failed to connect to node: %w", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewNodeManagerClient(conn)
+
+	resp, err := client.RenewCertificates(ctx, &pb.RenewCertificatesRequest{NodeId: node.ID.String()})
+	if err != nil {
+		return fmt.Errorf("failed to renew certificates on node: %w", err)
+	}
+	if !resp.Success {
+		return fmt.Errorf("%s", resp.Message)
+	}
+
+	if nodeCapability(node, "cert_inventory") == "true" {
+		if err := h.syncNode(ctx, node); err != nil {
+			h.logger.Warnf("Certificate inventory of node %s failed after renewal: %v", node.Name, err)
+		}
+	}
+	return nil
+}
+
+// certificateQuery selects the stored certificates matching the filters shared by listing
+// and bulk renewal
+func (h *CertificateInventoryHandler) certificateQuery(nodeID string, expiringWithinDays int32, selfSigned bool) (*gorm.DB, error) {
+	query := h.nodeHandler.db.Model(&models.NodeCertificate{})
+	if nodeID != "" {
+		if _, err := uuid.Parse(nodeID); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid node ID %q", nodeID)
+		}
+		query = query.Where("node_id = ?", nodeID)
+	}
+	if expiringWithinDays > 0 {
+		query = query.Where("not_after < ?", time.Now().Add(time.Duration(expiringWithinDays)*24*time.Hour))
+	}
+	if selfSigned {
+		query = query.Where("self_signed = ?", true)
+	}
+	return query, nil
+}
+
+func (h *CertificateInventoryHandler) nodeNames() (map[uuid.UUID]string, error) {
+	var nodes []models.VPSNode
+	if err := h.nodeHandler.db.Select("id", "name").Find(&nodes).Error; err != nil {
+		return nil, fmt.Errorf("failed to get nodes: %w", err)
+	}
+	names := make(map[uuid.UUID]string, len(nodes))
+	for _, node := range nodes {
+		names[node.ID] = node.Name
+	}
+	return names, nil
+}
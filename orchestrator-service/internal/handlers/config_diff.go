@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	pb "hysteria2_microservices/proto"
+)
+
+const (
+	configChangeAdded   = "added"
+	configChangeRemoved = "removed"
+	configChangeChanged = "changed"
+
+	redactedValue = `"[redacted]"`
+)
+
+// redactedConfigKeys hold credentials; their values are never returned, only whether they changed
+var redactedConfigKeys = map[string]bool{
+	"password":   true,
+	"privateKey": true,
+	"secret":     true,
+	"token":      true,
+	"psk":        true,
+}
+
+// clientImpactConfigKeys are the settings clients have in their own config, so changing
+// them disconnects clients until they fetch a new one
+var clientImpactConfigKeys = map[string]bool{
+	"listen":          true,
+	"port":            true,
+	"obfs":            true,
+	"auth":            true,
+	"password":        true,
+	"sni":             true,
+	"serverName":      true,
+	"serverNames":     true,
+	"security":        true,
+	"network":         true,
+	"realitySettings": true,
+	"shortIds":        true,
+	"privateKey":      true,
+	"flow":            true,
+	"method":          true,
+	"clients":         true,
+}
+
+// diffConfigs compares two server configs, JSON like Xray's or YAML like Hysteria2's, and
+// returns their differences ordered by path. An empty current config counts as an empty
+// object. Arrays of objects that all carry a tag, like Xray inbounds, are matched by tag
+// rather than by position.
+func diffConfigs(current, next string) ([]*pb.ConfigChange, error) {
+	var from, to interface{}
+	if strings.TrimSpace(current) == "" {
+		from = map[string]interface{}{}
+	} else if err := decodeConfig(current, &from); err != nil {
+		return nil, fmt.Errorf("current config is not valid JSON or YAML: %w", err)
+	}
+	if err := decodeConfig(next, &to); err != nil {
+		return nil, fmt.Errorf("new config is not valid JSON or YAML: %w", err)
+	}
+
+	var changes []*pb.ConfigChange
+	diffValues("", from, to, false, &changes)
+	return changes, nil
+}
+
+func diffValues(path string, from, to interface{}, impact bool, changes *[]*pb.ConfigChange) {
+	switch {
+	case from == nil && to == nil:
+		return
+	case from == nil:
+		*changes = append(*changes, configChange(path, configChangeAdded, nil, to, impact))
+		return
+	case to == nil:
+		*changes = append(*changes, configChange(path, configChangeRemoved, from, nil, impact))
+		return
+	}
+
+	switch fromValue := from.(type) {
+	case map[string]interface{}:
+		if toValue, ok := to.(map[string]interface{}); ok {
+			for _, key := range unionKeys(fromValue, toValue) {
+				diffValues(joinConfigPath(path, key), fromValue[key], toValue[key], impact || clientImpactConfigKeys[key], changes)
+			}
+			return
+		}
+	case []interface{}:
+		if toValue, ok := to.([]interface{}); ok {
+			fromTags, fromTagged := tagIndex(fromValue)
+			toTags, toTagged := tagIndex(toValue)
+			if fromTagged && toTagged {
+				for _, tag := range unionKeys(fromTags, toTags) {
+					diffValues(fmt.Sprintf("%s[tag=%s]", path, tag), fromTags[tag], toTags[tag], impact, changes)
+				}
+				return
+			}
+			for i := 0; i < len(fromValue) || i < len(toValue); i++ {
+				var a, b interface{}
+				if i < len(fromValue) {
+					a = fromValue[i]
+				}
+				if i < len(toValue) {
+					b = toValue[i]
+				}
+				diffValues(fmt.Sprintf("%s[%d]", path, i), a, b, impact, changes)
+			}
+			return
+		}
+	}
+
+	if !reflect.DeepEqual(from, to) {
+		*changes = append(*changes, configChange(path, configChangeChanged, from, to, impact))
+	}
+}
+
+func configChange(path, op string, from, to interface{}, impact bool) *pb.ConfigChange {
+	redact := redactedConfigKeys[lastConfigKey(path)]
+	return &pb.ConfigChange{
+		Path:         path,
+		Op:           op,
+		OldValue:     configValue(from, redact),
+		NewValue:     configValue(to, redact),
+		ClientImpact: impact,
+	}
+}
+
+func configValue(value interface{}, redact bool) string {
+	if value == nil {
+		return ""
+	}
+	if redact {
+		return redactedValue
+	}
+	data, err := json.Marshal(redactConfig(value))
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// redactConfigJSON returns a JSON or YAML config as JSON with its credentials replaced
+func redactConfigJSON(config string) (string, error) {
+	var value interface{}
+	if err := decodeConfig(config, &value); err != nil {
+		return "", fmt.Errorf("generated config is not valid JSON or YAML: %w", err)
+	}
+	data, err := json.MarshalIndent(redactConfig(value), "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// redactConfig returns a copy of a config value with the credentials replaced
+func redactConfig(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			if redactedConfigKeys[key] {
+				result[key] = "[redacted]"
+			} else {
+				result[key] = redactConfig(item)
+			}
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			result[i] = redactConfig(item)
+		}
+		return result
+	}
+	return value
+}
+
+// tagIndex maps the elements of an array by their "tag" when every element is an object
+// with a distinct tag
+func tagIndex(items []interface{}) (map[string]interface{}, bool) {
+	if len(items) == 0 {
+		return map[string]interface{}{}, true
+	}
+	index := make(map[string]interface{}, len(items))
+	for _, item := range items {
+		object, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		tag, ok := object["tag"].(string)
+		if !ok || tag == "" {
+			return nil, false
+		}
+		if _, duplicate := index[tag]; duplicate {
+			return nil, false
+		}
+		index[tag] = item
+	}
+	return index, true
+}
+
+func unionKeys(a, b map[string]interface{}) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func joinConfigPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func lastConfigKey(path string) string {
+	if i := strings.LastIndex(path, "."); i >= 0 {
+		path = path[i+1:]
+	}
+	if i := strings.Index(path, "["); i >= 0 {
+		path = path[:i]
+	}
+	return path
+}
+
+// decodeConfig decodes a JSON or YAML config into JSON values, so a YAML config compares
+// equal to the same config in JSON
+func decodeConfig(config string, value *interface{}) error {
+	if json.Unmarshal([]byte(config), value) == nil {
+		return nil
+	}
+	var document interface{}
+	if err := yaml.Unmarshal([]byte(config), &document); err != nil {
+		return err
+	}
+	data, err := json.Marshal(document)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
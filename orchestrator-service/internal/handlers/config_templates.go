@@ -0,0 +1,565 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+
+	"hysteria2_microservices/orchestrator-service/internal/models"
+	pb "hysteria2_microservices/proto"
+)
+
+// The agent writes the config and restarts the server before answering
+const configDeployTimeout = 2 * time.Minute
+
+// ConfigTemplateHandler manages the config template library and deploys the templates
+// assigned to a node's group, rendered and validated for that node, through its agent
+type ConfigTemplateHandler struct {
+	nodeHandler *NodeHandler
+	logger      *logrus.Logger
+}
+
+// NewConfigTemplateHandler creates a new ConfigTemplateHandler
+func NewConfigTemplateHandler(nodeHandler *NodeHandler, logger *logrus.Logger) *ConfigTemplateHandler {
+	return &ConfigTemplateHandler{
+		nodeHandler: nodeHandler,
+		logger:      logger,
+	}
+}
+
+// ListConfigTemplates returns every template with its assignments
+func (h *ConfigTemplateHandler) ListConfigTemplates(ctx context.Context, req *pb.ListConfigTemplatesRequest) (*pb.ListConfigTemplatesResponse, error) {
+	var templates []models.ConfigTemplate
+	if err := h.nodeHandler.db.Preload("Assignments").Order("kind, name").Find(&templates).Error; err != nil {
+		return nil, fmt.Errorf("failed to get config templates: %w", err)
+	}
+
+	resp := &pb.ListConfigTemplatesResponse{
+		Success:   true,
+		Message:   "Config templates retrieved successfully",
+		Templates: make([]*pb.ConfigTemplate, 0, len(templates)),
+	}
+	for i := range templates {
+		resp.Templates = append(resp.Templates, configTemplateToProto(&templates[i]))
+	}
+	return resp, nil
+}
+
+// SaveConfigTemplate creates a template, or updates it when an ID is given. Nodes keep
+// their config until the template is deployed again.
+func (h *ConfigTemplateHandler) SaveConfigTemplate(ctx context.Context, req *pb.SaveConfigTemplateRequest) (*pb.SaveConfigTemplateResponse, error) {
+	if req.Template == nil {
+		return nil, fmt.Errorf("config template is required")
+	}
+
+	template := models.ConfigTemplate{Version: 1}
+	if req.Template.Id != "" {
+		if err := h.nodeHandler.db.Preload("Assignments").First(&template, "id = ?", req.Template.Id).Error; err != nil {
+			return nil, fmt.Errorf("config template not found: %w", err)
+		}
+		if req.Template.Kind != template.Kind {
+			return nil, fmt.Errorf("the kind of a template cannot be changed")
+		}
+		if req.Template.Body != template.Body || req.Template.Protocol != template.Protocol ||
+			!sameVariables(req.Template.Variables, template.GetVariables()) {
+			template.Version++
+		}
+	}
+	template.Name = req.Template.Name
+	template.Kind = req.Template.Kind
+	template.Protocol = req.Template.Protocol
+	template.Body = req.Template.Body
+	template.SetVariables(req.Template.Variables)
+	template.UpdatedAt = time.Now()
+	if err := template.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config template: %w", err)
+	}
+
+	if err := h.nodeHandler.db.Omit("Assignments").Save(&template).Error; err != nil {
+		return nil, fmt.Errorf("failed to save config template: %w", err)
+	}
+
+	h.logger.Infof("Config template %s saved", template.ConfigVersion())
+	return &pb.SaveConfigTemplateResponse{
+		Success:  true,
+		Message:  "Config template saved successfully",
+		Template: configTemplateToProto(&template),
+	}, nil
+}
+
+// DeleteConfigTemplate removes a template and its assignments
+func (h *ConfigTemplateHandler) DeleteConfigTemplate(ctx context.Context, req *pb.DeleteConfigTemplateRequest) (*pb.DeleteConfigTemplateResponse, error) {
+	var template models.ConfigTemplate
+	if err := h.nodeHandler.db.First(&template, "id = ?", req.TemplateId).Error; err != nil {
+		return nil, fmt.Errorf("config template not found: %w", err)
+	}
+
+	err := h.nodeHandler.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("template_id = ?", template.ID).Delete(&models.ConfigTemplateAssignment{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&template).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete config template: %w", err)
+	}
+
+	return &pb.DeleteConfigTemplateResponse{
+		Success: true,
+		Message: "Config template deleted successfully",
+	}, nil
+}
+
+// SetConfigTemplateAssignments replaces the node groups a template applies to. A group can
+// only be covered by one template of each kind.
+func (h *ConfigTemplateHandler) SetConfigTemplateAssignments(ctx context.Context, req *pb.SetConfigTemplateAssignmentsRequest) (*pb.SetConfigTemplateAssignmentsResponse, error) {
+	var template models.ConfigTemplate
+	if err := h.nodeHandler.db.First(&template, "id = ?", req.TemplateId).Error; err != nil {
+		return nil, fmt.Errorf("config template not found: %w", err)
+	}
+
+	assignments := make([]models.ConfigTemplateAssignment, 0, len(req.Assignments))
+	groups := make(map[string]bool, len(req.Assignments))
+	for i, assignment := range req.Assignments {
+		ca := models.ConfigTemplateAssignment{TemplateID: template.ID, NodeGroup: assignment.NodeGroup}
+		ca.SetVariables(assignment.Variables)
+		if err := ca.Validate(); err != nil {
+			return nil, fmt.Errorf("assignment %d: %w", i+1, err)
+		}
+		if groups[ca.NodeGroup] {
+			return nil, fmt.Errorf("assignment %d: node group %q is assigned twice", i+1, ca.NodeGroup)
+		}
+		groups[ca.NodeGroup] = true
+		assignments = append(assignments, ca)
+	}
+
+	err := h.nodeHandler.db.Transaction(func(tx *gorm.DB) error {
+		for _, assignment := range assignments {
+			var other models.ConfigTemplate
+			err := tx.Joins("JOIN config_template_assignments ON config_template_assignments.template_id = config_templates.id").
+				Where("config_templates.kind = ? AND config_templates.id <> ? AND config_template_assignments.node_group = ?",
+					template.Kind, template.ID, assignment.NodeGroup).
+				First(&other).Error
+			if err == nil {
+				return fmt.Errorf("node group %q already uses %s template %s", assignment.NodeGroup, other.Kind, other.Name)
+			}
+			if err != gorm.ErrRecordNotFound {
+				return err
+			}
+		}
+
+		if err := tx.Where("template_id = ?", template.ID).Delete(&models.ConfigTemplateAssignment{}).Error; err != nil {
+			return err
+		}
+		if len(assignments) == 0 {
+			return nil
+		}
+		return tx.Create(&assignments).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to save config template assignments: %w", err)
+	}
+	template.Assignments = assignments
+
+	return &pb.SetConfigTemplateAssignmentsResponse{
+		Success:  true,
+		Message:  "Config template assignments saved successfully",
+		Template: configTemplateToProto(&template),
+	}, nil
+}
+
+// SetNodeGroup moves a node into a group, which selects the templates deployed to it
+func (h *ConfigTemplateHandler) SetNodeGroup(ctx context.Context, req *pb.SetNodeGroupRequest) (*pb.SetNodeGroupResponse, error) {
+	if req.NodeGroup != "" && !models.NodeGroupPattern.MatchString(req.NodeGroup) {
+		return nil, fmt.Errorf("node group must be 1-50 lowercase letters, digits, '-' or '_'")
+	}
+
+	result := h.nodeHandler.db.Model(&models.VPSNode{}).Where("id = ?", req.NodeId).Update("node_group", req.NodeGroup)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to update node: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return nil, fmt.Errorf("node not found: %s", req.NodeId)
+	}
+
+	return &pb.SetNodeGroupResponse{
+		Success: true,
+		Message: "Node group updated successfully",
+	}, nil
+}
+
+// RenderConfigTemplate renders the template of a kind assigned to a node, to preview what
+// a deploy would send
+func (h *ConfigTemplateHandler) RenderConfigTemplate(ctx context.Context, req *pb.RenderConfigTemplateRequest) (*pb.RenderConfigTemplateResponse, error) {
+	var node models.VPSNode
+	if err := h.nodeHandler.db.First(&node, "id = ?", req.NodeId).Error; err != nil {
+		return nil, fmt.Errorf("node not found: %w", err)
+	}
+
+	template, config, err := h.render(&node, req.Kind)
+	if err != nil {
+		return nil, err
+	}
+	if template == nil {
+		return nil, fmt.Errorf("no %s template is assigned to node %s", req.Kind, node.Name)
+	}
+
+	return &pb.RenderConfigTemplateResponse{
+		Success:       true,
+		Message:       "Config template rendered successfully",
+		TemplateId:    template.ID.String(),
+		ConfigVersion: template.ConfigVersion(),
+		Config:        config,
+	}, nil
+}
+
+// PreviewConfigChange shows what a node would receive for a pending change, a draft
+// template or the template assigned to it, as the config its agent would generate and
+// the differences to the config the node runs now. Nothing is saved or deployed.
+func (h *ConfigTemplateHandler) PreviewConfigChange(ctx context.Context, req *pb.PreviewConfigChangeRequest) (*pb.PreviewConfigChangeResponse, error) {
+	var node models.VPSNode
+	if err := h.nodeHandler.db.First(&node, "id = ?", req.NodeId).Error; err != nil {
+		return nil, fmt.Errorf("node not found: %w", err)
+	}
+
+	var template *models.ConfigTemplate
+	var assignment *models.ConfigTemplateAssignment
+	var err error
+	if req.Template != nil {
+		draft := models.ConfigTemplate{
+			Name:     req.Template.Name,
+			Kind:     req.Kind,
+			Protocol: req.Template.Protocol,
+			Body:     req.Template.Body,
+		}
+		draft.SetVariables(req.Template.Variables)
+		if err := draft.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid config template: %w", err)
+		}
+		if req.Template.Id != "" {
+			templateID, err := uuid.Parse(req.Template.Id)
+			if err != nil {
+				return nil, fmt.Errorf("invalid template ID: %s", req.Template.Id)
+			}
+			if assignment, err = h.assignment(&node, req.Kind, &templateID); err != nil {
+				return nil, err
+			}
+		}
+		template = &draft
+	} else {
+		if assignment, err = h.assignment(&node, req.Kind, nil); err != nil {
+			return nil, err
+		}
+		if assignment == nil {
+			return nil, fmt.Errorf("no %s template is assigned to node %s", req.Kind, node.Name)
+		}
+		template = &models.ConfigTemplate{}
+		if err := h.nodeHandler.db.First(template, "id = ?", assignment.TemplateID).Error; err != nil {
+			return nil, fmt.Errorf("config template not found: %w", err)
+		}
+	}
+
+	config, err := renderForNode(template, &node, assignment, req.Variables)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := h.nodeHandler.connect(node.ID.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to node: %w", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewNodeManagerClient(conn)
+
+	preview, err := client.PreviewServerConfig(ctx, &pb.PreviewServerConfigRequest{
+		NodeId:         node.ID.String(),
+		Kind:           template.Kind,
+		Protocol:       template.Protocol,
+		ConfigTemplate: config,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to preview config on node: %w", err)
+	}
+	if !preview.Success {
+		return nil, fmt.Errorf("node failed to generate config: %s", preview.Message)
+	}
+
+	changes, err := diffConfigs(preview.CurrentConfig, preview.GeneratedConfig)
+	if err != nil {
+		return nil, err
+	}
+	generated, err := redactConfigJSON(preview.GeneratedConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &pb.PreviewConfigChangeResponse{
+		Success: true,
+		Config:  generated,
+		Changes: changes,
+	}
+	if req.Template == nil {
+		resp.ConfigVersion = template.ConfigVersion()
+	}
+	for _, change := range changes {
+		if change.ClientImpact {
+			resp.ClientImpact = true
+		}
+	}
+	switch {
+	case len(changes) == 0:
+		resp.Message = "No changes"
+	case resp.ClientImpact:
+		resp.Message = fmt.Sprintf("%d change(s), clients need a new config", len(changes))
+	default:
+		resp.Message = fmt.Sprintf("%d change(s)", len(changes))
+	}
+	return resp, nil
+}
+
+// DeployConfigTemplates renders the templates assigned to each node and applies them
+// through its agent. Every attempt is recorded as a deployment of the template version.
+func (h *ConfigTemplateHandler) DeployConfigTemplates(ctx context.Context, req *pb.DeployConfigTemplatesRequest) (*pb.DeployConfigTemplatesResponse, error) {
+	if (len(req.NodeIds) == 0) == (req.NodeGroup == "") {
+		return nil, fmt.Errorf("exactly one of node_ids or node_group must be specified")
+	}
+	kinds := []string{models.ComponentHysteria2, models.ComponentXray}
+	switch req.Kind {
+	case "":
+	case models.ComponentHysteria2, models.ComponentXray:
+		kinds = []string{req.Kind}
+	default:
+		return nil, fmt.Errorf("unsupported kind %q", req.Kind)
+	}
+
+	var nodes []models.VPSNode
+	query := h.nodeHandler.db.Order("name")
+	if req.NodeGroup != "" {
+		query = query.Where("node_group = ?", req.NodeGroup)
+	} else {
+		query = query.Where("id IN ?", req.NodeIds)
+	}
+	if err := query.Find(&nodes).Error; err != nil {
+		return nil, fmt.Errorf("failed to get nodes: %w", err)
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no nodes found")
+	}
+
+	resp := &pb.DeployConfigTemplatesResponse{}
+	failed := 0
+	for i := range nodes {
+		node := &nodes[i]
+		for _, kind := range kinds {
+			result := &pb.ConfigDeployment{
+				NodeId:   node.ID.String(),
+				NodeName: node.Name,
+				Kind:     kind,
+				Status:   models.DeploymentStatusFailed,
+			}
+
+			template, config, err := h.render(node, kind)
+			switch {
+			case err != nil:
+				result.Error = err.Error()
+			case template == nil && req.Kind == "":
+				// Deploying both kinds only covers the ones the node has a template for
+				continue
+			case template == nil:
+				result.Error = fmt.Sprintf("no %s template is assigned", kind)
+			default:
+				result.ConfigVersion = template.ConfigVersion()
+				if err := h.deploy(ctx, node, template, config); err != nil {
+					result.Error = err.Error()
+				} else {
+					result.Status = models.DeploymentStatusSuccess
+				}
+			}
+
+			if result.Status == models.DeploymentStatusFailed {
+				failed++
+				h.logger.Warnf("Config deploy of %s to node %s failed: %s", kind, node.Name, result.Error)
+			}
+			resp.Deployments = append(resp.Deployments, result)
+		}
+	}
+
+	resp.Success = failed == 0
+	if resp.Success {
+		resp.Message = fmt.Sprintf("Deployed %d config(s)", len(resp.Deployments))
+	} else {
+		resp.Message = fmt.Sprintf("Deployed %d of %d config(s)", len(resp.Deployments)-failed, len(resp.Deployments))
+	}
+	return resp, nil
+}
+
+// render returns the template of a kind assigned to the node, rendered for it. A nil
+// template means none is assigned.
+func (h *ConfigTemplateHandler) render(node *models.VPSNode, kind string) (*models.ConfigTemplate, string, error) {
+	assignment, err := h.assignment(node, kind, nil)
+	if err != nil || assignment == nil {
+		return nil, "", err
+	}
+
+	var template models.ConfigTemplate
+	if err := h.nodeHandler.db.First(&template, "id = ?", assignment.TemplateID).Error; err != nil {
+		return nil, "", fmt.Errorf("config template not found: %w", err)
+	}
+
+	config, err := renderForNode(&template, node, assignment, nil)
+	if err != nil {
+		return &template, "", err
+	}
+	return &template, config, nil
+}
+
+// assignment returns the assignment of a template of the kind covering the node's group,
+// preferring the group's own over the default one, or nil when there is none. With a
+// template ID only that template's assignments are considered.
+func (h *ConfigTemplateHandler) assignment(node *models.VPSNode, kind string, templateID *uuid.UUID) (*models.ConfigTemplateAssignment, error) {
+	query := h.nodeHandler.db.
+		Joins("JOIN config_templates ON config_templates.id = config_template_assignments.template_id").
+		Where("config_templates.kind = ? AND config_template_assignments.node_group IN ?", kind, []string{node.NodeGroup, ""})
+	if templateID != nil {
+		query = query.Where("config_template_assignments.template_id = ?", *templateID)
+	}
+	var assignments []models.ConfigTemplateAssignment
+	if err := query.Find(&assignments).Error; err != nil {
+		return nil, fmt.Errorf("failed to get config template assignments: %w", err)
+	}
+
+	var assignment *models.ConfigTemplateAssignment
+	for i := range assignments {
+		if assignment == nil || assignments[i].NodeGroup == node.NodeGroup {
+			assignment = &assignments[i]
+		}
+	}
+	return assignment, nil
+}
+
+// renderForNode renders a template with its defaults, the node's variables, the
+// assignment's variables and the overrides, later ones taking precedence
+func renderForNode(template *models.ConfigTemplate, node *models.VPSNode, assignment *models.ConfigTemplateAssignment, overrides map[string]string) (string, error) {
+	variables := template.GetVariables()
+	for name, value := range node.TemplateVariables() {
+		variables[name] = value
+	}
+	if assignment != nil {
+		for name, value := range assignment.GetVariables() {
+			variables[name] = value
+		}
+	}
+	for name, value := range overrides {
+		variables[name] = value
+	}
+
+	config, err := template.Render(variables)
+	if err != nil {
+		return "", fmt.Errorf("failed to render template %s: %w", template.ConfigVersion(), err)
+	}
+	return config, nil
+}
+
+// deploy sends a rendered config to the node's agent, restarts the server and records the deployment
+func (h *ConfigTemplateHandler) deploy(ctx context.Context, node *models.VPSNode, template *models.ConfigTemplate, config string) error {
+	deployment := models.Deployment{
+		NodeID:        node.ID,
+		ConfigVersion: template.ConfigVersion(),
+		Status:        models.DeploymentStatusDeploying,
+	}
+	if err := h.nodeHandler.db.Create(&deployment).Error; err != nil {
+		return fmt.Errorf("failed to record deployment: %w", err)
+	}
+
+	err := h.apply(ctx, node.ID.String(), template, config)
+
+	updates := map[string]interface{}{"status": models.DeploymentStatusSuccess}
+	if err != nil {
+		updates = map[string]interface{}{"status": models.DeploymentStatusFailed, "error_message": err.Error()}
+	} else {
+		updates["deployed_at"] = time.Now()
+	}
+	if dbErr := h.nodeHandler.db.Model(&deployment).Updates(updates).Error; dbErr != nil {
+		h.logger.Errorf("Failed to update deployment %s: %v", deployment.ID, dbErr)
+	}
+	return err
+}
+
+func (h *ConfigTemplateHandler) apply(ctx context.Context, nodeID string, template *models.ConfigTemplate, config string) error {
+	ctx, cancel := context.WithTimeout(ctx, configDeployTimeout)
+	defer cancel()
+
+	conn, err := h.nodeHandler.connect(nodeID)
+	if err != nil {
+		return fmt.Errorf("failed to connect to node: %w", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewNodeManagerClient(conn)
+
+	switch template.Kind {
+	case models.ComponentHysteria2:
+		resp, err := client.ConfigureHysteria2(ctx, &pb.ConfigureHysteria2Request{NodeId: nodeID, ConfigTemplate: config})
+		if err != nil {
+			return fmt.Errorf("failed to configure Hysteria2 on node: %w", err)
+		}
+		if !resp.Success {
+			return fmt.Errorf("node rejected Hysteria2 config: %s", resp.Message)
+		}
+	case models.ComponentXray:
+		resp, err := client.ConfigureXray(ctx, &pb.ConfigureXrayRequest{NodeId: nodeID, Protocol: template.Protocol, ConfigTemplate: config})
+		if err != nil {
+			return fmt.Errorf("failed to configure Xray on node: %w", err)
+		}
+		if !resp.Success {
+			return fmt.Errorf("node rejected Xray config: %s", resp.Message)
+		}
+	}
+
+	resp, err := client.RestartServer(ctx, &pb.RestartRequest{NodeId: nodeID, ServiceName: template.Kind})
+	if err != nil {
+		return fmt.Errorf("failed to restart %s on node: %w", template.Kind, err)
+	}
+	if !resp.Success {
+		return fmt.Errorf("node failed to restart %s: %s", template.Kind, resp.Message)
+	}
+	return nil
+}
+
+func sameVariables(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, value := range a {
+		if other, ok := b[name]; !ok || other != value {
+			return false
+		}
+	}
+	return true
+}
+
+func configTemplateToProto(template *models.ConfigTemplate) *pb.ConfigTemplate {
+	result := &pb.ConfigTemplate{
+		Id:           template.ID.String(),
+		Name:         template.Name,
+		Kind:         template.Kind,
+		Protocol:     template.Protocol,
+		Body:         template.Body,
+		Variables:    template.GetVariables(),
+		Version:      int32(template.Version),
+		Placeholders: template.Placeholders(),
+		UpdatedAt:    template.UpdatedAt.Unix(),
+	}
+	for _, assignment := range template.Assignments {
+		result.Assignments = append(result.Assignments, &pb.ConfigTemplateAssignment{
+			NodeGroup: assignment.NodeGroup,
+			Variables: assignment.GetVariables(),
+		})
+	}
+	return result
+}
@@ -0,0 +1,328 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"hysteria2_microservices/orchestrator-service/internal/models"
+	pb "hysteria2_microservices/proto"
+)
+
+// ListFilterLists returns every content filter list with its assignments
+func (h *NodeConfigHandler) ListFilterLists(ctx context.Context, req *pb.ListFilterListsRequest) (*pb.ListFilterListsResponse, error) {
+	var lists []models.FilterList
+	if err := h.nodeHandler.db.Preload("Assignments").Order("name").Find(&lists).Error; err != nil {
+		return nil, fmt.Errorf("failed to get filter lists: %w", err)
+	}
+
+	resp := &pb.ListFilterListsResponse{
+		Success: true,
+		Message: "Filter lists retrieved successfully",
+		Lists:   make([]*pb.FilterList, 0, len(lists)),
+	}
+	for i := range lists {
+		resp.Lists = append(resp.Lists, filterListToProto(&lists[i]))
+	}
+	return resp, nil
+}
+
+// SaveFilterList creates a list, or updates it when an ID is given, and pushes the change
+// to the nodes it is assigned to
+func (h *NodeConfigHandler) SaveFilterList(ctx context.Context, req *pb.SaveFilterListRequest) (*pb.SaveFilterListResponse, error) {
+	if req.List == nil {
+		return nil, fmt.Errorf("filter list is required")
+	}
+
+	list := models.FilterList{}
+	if req.List.Id != "" {
+		if err := h.nodeHandler.db.Preload("Assignments").First(&list, "id = ?", req.List.Id).Error; err != nil {
+			return nil, fmt.Errorf("filter list not found: %w", err)
+		}
+	}
+	list.Name = req.List.Name
+	list.Category = req.List.Category
+	list.Action = req.List.Action
+	list.URL = req.List.Url
+	list.Format = req.List.Format
+	list.RefreshInterval = int(req.List.RefreshInterval)
+	list.SetDomains(req.List.Domains)
+	if err := list.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid filter list: %w", err)
+	}
+
+	if err := h.nodeHandler.db.Omit("Assignments").Save(&list).Error; err != nil {
+		return nil, fmt.Errorf("failed to save filter list: %w", err)
+	}
+
+	failures, err := h.syncContentFilter(ctx, list.Assignments)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.SaveFilterListResponse{
+		Success:  len(failures) == 0,
+		Message:  filterSyncMessage("Filter list saved", failures),
+		List:     filterListToProto(&list),
+		Failures: failures,
+	}, nil
+}
+
+// DeleteFilterList removes a list and its assignments and pushes the change to the affected nodes
+func (h *NodeConfigHandler) DeleteFilterList(ctx context.Context, req *pb.DeleteFilterListRequest) (*pb.DeleteFilterListResponse, error) {
+	var list models.FilterList
+	if err := h.nodeHandler.db.Preload("Assignments").First(&list, "id = ?", req.ListId).Error; err != nil {
+		return nil, fmt.Errorf("filter list not found: %w", err)
+	}
+
+	err := h.nodeHandler.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("list_id = ?", list.ID).Delete(&models.FilterAssignment{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&list).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete filter list: %w", err)
+	}
+
+	failures, err := h.syncContentFilter(ctx, list.Assignments)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.DeleteFilterListResponse{
+		Success:  len(failures) == 0,
+		Message:  filterSyncMessage("Filter list deleted", failures),
+		Failures: failures,
+	}, nil
+}
+
+// SetFilterAssignments replaces the nodes and user groups a list applies to
+func (h *NodeConfigHandler) SetFilterAssignments(ctx context.Context, req *pb.SetFilterAssignmentsRequest) (*pb.SetFilterAssignmentsResponse, error) {
+	var list models.FilterList
+	if err := h.nodeHandler.db.Preload("Assignments").First(&list, "id = ?", req.ListId).Error; err != nil {
+		return nil, fmt.Errorf("filter list not found: %w", err)
+	}
+
+	assignments := make([]models.FilterAssignment, 0, len(req.Assignments))
+	for i, assignment := range req.Assignments {
+		fa := models.FilterAssignment{ListID: list.ID, UserGroup: assignment.UserGroup}
+		if assignment.NodeId != "" {
+			nodeID, err := uuid.Parse(assignment.NodeId)
+			if err != nil {
+				return nil, fmt.Errorf("assignment %d: invalid node ID: %s", i+1, assignment.NodeId)
+			}
+			var node models.VPSNode
+			if err := h.nodeHandler.db.First(&node, "id = ?", nodeID).Error; err != nil {
+				return nil, fmt.Errorf("assignment %d: node not found: %w", i+1, err)
+			}
+			fa.NodeID = &nodeID
+		}
+		assignments = append(assignments, fa)
+	}
+
+	err := h.nodeHandler.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("list_id = ?", list.ID).Delete(&models.FilterAssignment{}).Error; err != nil {
+			return err
+		}
+		if len(assignments) == 0 {
+			return nil
+		}
+		return tx.Create(&assignments).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to save filter assignments: %w", err)
+	}
+
+	// Nodes that lose the list need the update as much as the ones that gain it
+	failures, err := h.syncContentFilter(ctx, append(list.Assignments, assignments...))
+	if err != nil {
+		return nil, err
+	}
+	return &pb.SetFilterAssignmentsResponse{
+		Success:  len(failures) == 0,
+		Message:  filterSyncMessage("Filter assignments saved", failures),
+		Failures: failures,
+	}, nil
+}
+
+// GetContentFilter retrieves the lists in force on a node with their domain counts and download state
+func (h *NodeConfigHandler) GetContentFilter(ctx context.Context, req *pb.GetContentFilterRequest) (*pb.GetContentFilterResponse, error) {
+	conn, err := h.nodeHandler.connect(req.NodeId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to node: %w", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewNodeManagerClient(conn)
+
+	resp, err := client.GetContentFilter(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get content filter from node: %w", err)
+	}
+	return resp, nil
+}
+
+// syncContentFilter pushes the current lists to every node touched by assignments and
+// returns the nodes that could not be updated. An assignment without a node touches all nodes.
+func (h *NodeConfigHandler) syncContentFilter(ctx context.Context, assignments []models.FilterAssignment) (map[string]string, error) {
+	failures := make(map[string]string)
+	if len(assignments) == 0 {
+		return failures, nil
+	}
+
+	query := h.nodeHandler.db
+	allNodes := false
+	var nodeIDs []uuid.UUID
+	for _, assignment := range assignments {
+		if assignment.NodeID == nil {
+			allNodes = true
+			break
+		}
+		nodeIDs = append(nodeIDs, *assignment.NodeID)
+	}
+	if !allNodes {
+		query = query.Where("id IN ?", nodeIDs)
+	}
+
+	var nodes []models.VPSNode
+	if err := query.Find(&nodes).Error; err != nil {
+		return nil, fmt.Errorf("failed to get nodes: %w", err)
+	}
+
+	for _, node := range nodes {
+		nodeID := node.ID.String()
+		if err := h.pushContentFilter(ctx, node.ID); err != nil {
+			failures[nodeID] = err.Error()
+		}
+	}
+	return failures, nil
+}
+
+func (h *NodeConfigHandler) pushContentFilter(ctx context.Context, nodeID uuid.UUID) error {
+	lists, err := h.nodeFilterLists(nodeID)
+	if err != nil {
+		return err
+	}
+
+	conn, err := h.nodeHandler.connect(nodeID.String())
+	if err != nil {
+		return fmt.Errorf("failed to connect to node: %w", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewNodeManagerClient(conn)
+
+	resp, err := client.SetContentFilter(ctx, &pb.SetContentFilterRequest{
+		NodeId: nodeID.String(),
+		Lists:  lists,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to push content filter: %w", err)
+	}
+	if !resp.Success {
+		return fmt.Errorf("node rejected content filter: %s", resp.Message)
+	}
+	return nil
+}
+
+// nodeFilterLists resolves the lists assigned to a node. A list assigned to user groups
+// applies only to the Xray users of those groups assigned to the node, and is left out
+// when none of them are.
+func (h *NodeConfigHandler) nodeFilterLists(nodeID uuid.UUID) ([]*pb.FilterList, error) {
+	db := h.nodeHandler.db
+
+	var assignments []models.FilterAssignment
+	if err := db.Where("node_id = ? OR node_id IS NULL", nodeID).Find(&assignments).Error; err != nil {
+		return nil, fmt.Errorf("failed to get filter assignments: %w", err)
+	}
+
+	everyone := make(map[uuid.UUID]bool)
+	groups := make(map[uuid.UUID][]string)
+	for _, assignment := range assignments {
+		if assignment.UserGroup == "" {
+			everyone[assignment.ListID] = true
+		} else {
+			groups[assignment.ListID] = append(groups[assignment.ListID], assignment.UserGroup)
+		}
+	}
+	listIDs := make([]uuid.UUID, 0, len(everyone)+len(groups))
+	for id := range everyone {
+		listIDs = append(listIDs, id)
+	}
+	for id := range groups {
+		if !everyone[id] {
+			listIDs = append(listIDs, id)
+		}
+	}
+	if len(listIDs) == 0 {
+		return []*pb.FilterList{}, nil
+	}
+
+	var lists []models.FilterList
+	if err := db.Where("id IN ?", listIDs).Order("name").Find(&lists).Error; err != nil {
+		return nil, fmt.Errorf("failed to get filter lists: %w", err)
+	}
+
+	result := make([]*pb.FilterList, 0, len(lists))
+	for i := range lists {
+		list := filterListToProto(&lists[i])
+		list.Assignments = nil
+
+		if !everyone[lists[i].ID] {
+			emails, err := h.groupUserEmails(nodeID, groups[lists[i].ID])
+			if err != nil {
+				return nil, fmt.Errorf("failed to get users of list %s: %w", lists[i].Name, err)
+			}
+			if len(emails) == 0 {
+				continue
+			}
+			list.Users = emails
+		}
+		result = append(result, list)
+	}
+	return result, nil
+}
+
+// groupUserEmails returns the Xray user emails of the active users of groups assigned to the node
+func (h *NodeConfigHandler) groupUserEmails(nodeID uuid.UUID, groups []string) ([]string, error) {
+	var emails []string
+	err := h.nodeHandler.db.Model(&models.User{}).
+		Joins("JOIN node_assignments ON node_assignments.user_id = users.id AND node_assignments.node_id = ? AND node_assignments.is_active", nodeID).
+		Where("users.user_group IN ? AND users.status = ?", groups, models.UserStatusActive).
+		Pluck("users.email", &emails).Error
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(emails)
+	return emails, nil
+}
+
+func filterListToProto(list *models.FilterList) *pb.FilterList {
+	result := &pb.FilterList{
+		Id:              list.ID.String(),
+		Name:            list.Name,
+		Category:        list.Category,
+		Action:          list.Action,
+		Url:             list.URL,
+		Format:          list.Format,
+		Domains:         list.GetDomains(),
+		RefreshInterval: int32(list.RefreshInterval),
+	}
+	for _, assignment := range list.Assignments {
+		fa := &pb.FilterAssignment{UserGroup: assignment.UserGroup}
+		if assignment.NodeID != nil {
+			fa.NodeId = assignment.NodeID.String()
+		}
+		result.Assignments = append(result.Assignments, fa)
+	}
+	return result
+}
+
+func filterSyncMessage(action string, failures map[string]string) string {
+	if len(failures) == 0 {
+		return action + " successfully"
+	}
+	return fmt.Sprintf("%s, %d node(s) could not be updated", action, len(failures))
+}
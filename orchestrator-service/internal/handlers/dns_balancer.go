@@ -0,0 +1,476 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"hysteria2_microservices/orchestrator-service/internal/cloudflare"
+	"hysteria2_microservices/orchestrator-service/internal/config"
+	"hysteria2_microservices/orchestrator-service/internal/models"
+	pb "hysteria2_microservices/proto"
+)
+
+// dnsRecordComment marks the records the balancer owns; other records of a hostname are
+// never touched
+const dnsRecordComment = "managed by hysteryvpn orchestrator"
+
+// DNSBalancer publishes the healthy nodes under each service hostname as A/AAAA records
+// in Cloudflare. Nodes in maintenance, offline or without a recent heartbeat are withdrawn
+// on the next sync; when no node is healthy the current records are kept rather than
+// leaving the hostname without any.
+type DNSBalancer struct {
+	leadership
+	nodeHandler *NodeHandler
+	client      *cloudflare.Client
+	config      config.DNSConfig
+	logger      *logrus.Logger
+
+	mu sync.Mutex
+	// Smooth weighted round-robin state of the hostnames publishing some of their nodes
+	rotation map[uuid.UUID]map[string]int
+}
+
+// NewDNSBalancer creates a new DNSBalancer; without a client records are never synced
+func NewDNSBalancer(nodeHandler *NodeHandler, client *cloudflare.Client, cfg config.DNSConfig, logger *logrus.Logger) *DNSBalancer {
+	return &DNSBalancer{
+		nodeHandler: nodeHandler,
+		client:      client,
+		config:      cfg,
+		logger:      logger,
+		rotation:    make(map[uuid.UUID]map[string]int),
+	}
+}
+
+// Start syncs every enabled hostname once per interval until ctx is cancelled, while this
+// replica leads
+func (b *DNSBalancer) Start(ctx context.Context) {
+	if !b.config.Enabled {
+		b.logger.Info("DNS load balancing disabled")
+		return
+	}
+	if b.client == nil {
+		b.logger.Warn("DNS load balancing enabled without Cloudflare credentials")
+		return
+	}
+
+	interval := time.Duration(b.config.Interval) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if b.leading() {
+				b.syncAll(ctx)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	b.logger.Infof("Syncing DNS records every %s", interval)
+}
+
+func (b *DNSBalancer) syncAll(ctx context.Context) []models.DNSHostname {
+	var hostnames []models.DNSHostname
+	if err := b.nodeHandler.db.Where("enabled = ?", true).Order("name").Find(&hostnames).Error; err != nil {
+		b.logger.Errorf("Failed to get DNS hostnames: %v", err)
+		return nil
+	}
+	for i := range hostnames {
+		if ctx.Err() != nil {
+			break
+		}
+		if err := b.syncHostname(ctx, &hostnames[i]); err != nil {
+			b.logger.Warnf("Failed to sync DNS records of %s: %v", hostnames[i].Name, err)
+		}
+	}
+	return hostnames
+}
+
+// syncHostname publishes the nodes picked for hostname and removes the records of the
+// others, creating new records before deleting old ones so the name never goes empty
+func (b *DNSBalancer) syncHostname(ctx context.Context, hostname *models.DNSHostname) error {
+	err := b.publish(ctx, hostname)
+	now := time.Now()
+	hostname.LastSyncedAt = &now
+	hostname.LastError = ""
+	if err != nil {
+		hostname.LastError = err.Error()
+	}
+	if saveErr := b.nodeHandler.db.Model(hostname).Select("published", "last_synced_at", "last_error").Updates(hostname).Error; saveErr != nil {
+		b.logger.Errorf("Failed to save DNS sync state of %s: %v", hostname.Name, saveErr)
+	}
+	return err
+}
+
+func (b *DNSBalancer) publish(ctx context.Context, hostname *models.DNSHostname) error {
+	nodes, err := b.healthyNodes(hostname)
+	if err != nil {
+		return err
+	}
+	desired := dnsRecordsFor(b.pick(hostname, nodes))
+	if len(desired) == 0 {
+		return fmt.Errorf("no healthy node to publish, keeping the current records")
+	}
+
+	existing, err := b.client.ListRecords(ctx, hostname.Name, "")
+	if err != nil {
+		return err
+	}
+	current := make(map[string]cloudflare.Record)
+	for _, record := range existing {
+		if (record.Type == "A" || record.Type == "AAAA") && record.Comment == dnsRecordComment {
+			current[record.Type+" "+record.Content] = record
+		}
+	}
+
+	var errs []string
+	wanted := make(map[string]bool, len(desired))
+	for _, record := range desired {
+		key := record.Type + " " + record.Content
+		wanted[key] = true
+		spec := cloudflare.Record{
+			Type:    record.Type,
+			Name:    hostname.Name,
+			Content: record.Content,
+			TTL:     hostname.TTL,
+			Proxied: hostname.Proxied,
+			Comment: dnsRecordComment,
+		}
+		if spec.Proxied {
+			spec.TTL = 1 // proxied records always use the automatic TTL
+		}
+
+		if found, ok := current[key]; ok {
+			if found.TTL == spec.TTL && found.Proxied == spec.Proxied {
+				continue
+			}
+			if _, err := b.client.UpdateRecord(ctx, found.ID, spec); err != nil {
+				errs = append(errs, fmt.Sprintf("update %s: %v", key, err))
+			}
+			continue
+		}
+		if _, err := b.client.CreateRecord(ctx, spec); err != nil {
+			errs = append(errs, fmt.Sprintf("create %s: %v", key, err))
+			continue
+		}
+		b.logger.Infof("Published %s %s for node %s", hostname.Name, key, record.NodeID)
+	}
+
+	// Stale records go only once every wanted record is in place
+	if len(errs) == 0 {
+		for key, record := range current {
+			if wanted[key] {
+				continue
+			}
+			if err := b.client.DeleteRecord(ctx, record.ID); err != nil {
+				errs = append(errs, fmt.Sprintf("delete %s: %v", key, err))
+				continue
+			}
+			b.logger.Infof("Withdrew %s %s", hostname.Name, key)
+		}
+	}
+
+	if err := hostname.SetPublished(desired); err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// healthyNodes returns the online nodes of the hostname's group with a recent heartbeat
+// and a weight above zero
+func (b *DNSBalancer) healthyNodes(hostname *models.DNSHostname) ([]models.VPSNode, error) {
+	timeout := time.Duration(b.config.HeartbeatTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = 2 * time.Minute
+	}
+
+	query := b.nodeHandler.db.Where("status = ? AND last_heartbeat >= ?", models.NodeStatusOnline, time.Now().Add(-timeout))
+	if hostname.NodeGroup != "" {
+		query = query.Where("node_group = ?", hostname.NodeGroup)
+	}
+	var nodes []models.VPSNode
+	if err := query.Order("name").Find(&nodes).Error; err != nil {
+		return nil, fmt.Errorf("failed to get nodes: %w", err)
+	}
+
+	healthy := nodes[:0]
+	for _, node := range nodes {
+		if hostname.Weight(node.ID.String()) > 0 {
+			healthy = append(healthy, node)
+		}
+	}
+	return healthy, nil
+}
+
+// pick returns the nodes to publish. When the hostname publishes fewer records than it has
+// nodes, each sync runs that many rounds of smooth weighted round-robin over the nodes not
+// yet picked, so over time every node is published in proportion to its weight.
+func (b *DNSBalancer) pick(hostname *models.DNSHostname, nodes []models.VPSNode) []models.VPSNode {
+	if hostname.Records <= 0 || hostname.Records >= len(nodes) {
+		return nodes
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	previous := b.rotation[hostname.ID]
+	state := make(map[string]int, len(nodes))
+	total := 0
+	for _, node := range nodes {
+		id := node.ID.String()
+		state[id] = previous[id]
+		total += hostname.Weight(id)
+	}
+
+	picked := make(map[string]bool, hostname.Records)
+	var chosen []models.VPSNode
+	for round := 0; round < hostname.Records; round++ {
+		best := -1
+		for i, node := range nodes {
+			id := node.ID.String()
+			state[id] += hostname.Weight(id)
+			if picked[id] {
+				continue
+			}
+			if best < 0 || state[id] > state[nodes[best].ID.String()] {
+				best = i
+			}
+		}
+		id := nodes[best].ID.String()
+		state[id] -= total
+		picked[id] = true
+		chosen = append(chosen, nodes[best])
+	}
+
+	// Nodes that left the pool drop their state
+	b.rotation[hostname.ID] = state
+	return chosen
+}
+
+// dnsRecordsFor returns the A record of every node's address and the AAAA records of
+// their IPv6 addresses
+func dnsRecordsFor(nodes []models.VPSNode) []models.DNSRecord {
+	var records []models.DNSRecord
+	seen := make(map[string]bool)
+	for i := range nodes {
+		addresses := []string{nodes[i].IPAddress}
+		if ipv6 := nodeCapability(&nodes[i], "ipv6_address"); ipv6 != "" {
+			addresses = append(addresses, ipv6)
+		}
+		for _, address := range addresses {
+			addr, err := netip.ParseAddr(strings.TrimSpace(address))
+			if err != nil || !addr.IsGlobalUnicast() || addr.IsPrivate() {
+				continue
+			}
+			addr = addr.Unmap()
+			record := models.DNSRecord{Type: "A", Content: addr.String(), NodeID: nodes[i].ID.String()}
+			if addr.Is6() {
+				record.Type = "AAAA"
+			}
+			if key := record.Type + " " + record.Content; !seen[key] {
+				seen[key] = true
+				records = append(records, record)
+			}
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Type != records[j].Type {
+			return records[i].Type < records[j].Type
+		}
+		return records[i].Content < records[j].Content
+	})
+	return records
+}
+
+// ListDNSHostnames returns every service hostname with the records last published for it
+func (b *DNSBalancer) ListDNSHostnames(ctx context.Context, req *pb.ListDNSHostnamesRequest) (*pb.ListDNSHostnamesResponse, error) {
+	var hostnames []models.DNSHostname
+	if err := b.nodeHandler.db.Order("name").Find(&hostnames).Error; err != nil {
+		return nil, fmt.Errorf("failed to get DNS hostnames: %w", err)
+	}
+
+	resp := &pb.ListDNSHostnamesResponse{
+		Success:   true,
+		Message:   "DNS hostnames retrieved successfully",
+		Hostnames: make([]*pb.DNSHostname, 0, len(hostnames)),
+	}
+	for i := range hostnames {
+		resp.Hostnames = append(resp.Hostnames, dnsHostnameToProto(&hostnames[i]))
+	}
+	return resp, nil
+}
+
+// SaveDNSHostname creates a hostname, or updates it when an ID is given, and syncs its records
+func (b *DNSBalancer) SaveDNSHostname(ctx context.Context, req *pb.SaveDNSHostnameRequest) (*pb.SaveDNSHostnameResponse, error) {
+	if req.Hostname == nil {
+		return nil, fmt.Errorf("hostname is required")
+	}
+
+	hostname := models.DNSHostname{}
+	if req.Hostname.Id != "" {
+		if err := b.nodeHandler.db.First(&hostname, "id = ?", req.Hostname.Id).Error; err != nil {
+			return nil, fmt.Errorf("DNS hostname not found: %w", err)
+		}
+	}
+	name, err := models.NormalizeSNIDomain(req.Hostname.Name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNS hostname: %w", err)
+	}
+	// Records published under the old name would be left behind
+	if hostname.ID != uuid.Nil && hostname.Name != name {
+		return nil, fmt.Errorf("the name of a hostname cannot change; delete it and create a new one")
+	}
+	hostname.Name = name
+	hostname.NodeGroup = req.Hostname.NodeGroup
+	hostname.Records = int(req.Hostname.Records)
+	hostname.TTL = int(req.Hostname.Ttl)
+	if hostname.TTL == 0 {
+		hostname.TTL = 60
+	}
+	hostname.Proxied = req.Hostname.Proxied
+	hostname.Enabled = req.Hostname.Enabled
+	weights := make(map[string]int, len(req.Hostname.Weights))
+	for nodeID, weight := range req.Hostname.Weights {
+		weights[nodeID] = int(weight)
+	}
+	hostname.SetWeights(weights)
+	if err := hostname.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid DNS hostname: %w", err)
+	}
+
+	if err := b.nodeHandler.db.Save(&hostname).Error; err != nil {
+		return nil, fmt.Errorf("failed to save DNS hostname: %w", err)
+	}
+
+	message := "DNS hostname saved successfully"
+	success := true
+	if hostname.Enabled && b.client != nil {
+		if err := b.syncHostname(ctx, &hostname); err != nil {
+			success = false
+			message = fmt.Sprintf("DNS hostname saved, records not synced: %v", err)
+		}
+	}
+	return &pb.SaveDNSHostnameResponse{
+		Success:  success,
+		Message:  message,
+		Hostname: dnsHostnameToProto(&hostname),
+	}, nil
+}
+
+// DeleteDNSHostname withdraws the records the balancer published for a hostname and
+// removes it
+func (b *DNSBalancer) DeleteDNSHostname(ctx context.Context, req *pb.DeleteDNSHostnameRequest) (*pb.DeleteDNSHostnameResponse, error) {
+	var hostname models.DNSHostname
+	if err := b.nodeHandler.db.First(&hostname, "id = ?", req.HostnameId).Error; err != nil {
+		return nil, fmt.Errorf("DNS hostname not found: %w", err)
+	}
+
+	if b.client != nil {
+		records, err := b.client.ListRecords(ctx, hostname.Name, "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to list DNS records: %w", err)
+		}
+		for _, record := range records {
+			if record.Comment != dnsRecordComment {
+				continue
+			}
+			if err := b.client.DeleteRecord(ctx, record.ID); err != nil {
+				return nil, fmt.Errorf("failed to delete DNS record %s %s: %w", record.Type, record.Content, err)
+			}
+		}
+	}
+
+	if err := b.nodeHandler.db.Delete(&hostname).Error; err != nil {
+		return nil, fmt.Errorf("failed to delete DNS hostname: %w", err)
+	}
+
+	b.mu.Lock()
+	delete(b.rotation, hostname.ID)
+	b.mu.Unlock()
+
+	return &pb.DeleteDNSHostnameResponse{
+		Success: true,
+		Message: "DNS hostname deleted successfully",
+	}, nil
+}
+
+// SyncDNS syncs one hostname, or every enabled hostname without an ID, right away
+func (b *DNSBalancer) SyncDNS(ctx context.Context, req *pb.SyncDNSRequest) (*pb.SyncDNSResponse, error) {
+	if b.client == nil {
+		return nil, fmt.Errorf("cloudflare credentials are not configured")
+	}
+
+	var hostnames []models.DNSHostname
+	if req.HostnameId != "" {
+		var hostname models.DNSHostname
+		if err := b.nodeHandler.db.First(&hostname, "id = ?", req.HostnameId).Error; err != nil {
+			return nil, fmt.Errorf("DNS hostname not found: %w", err)
+		}
+		b.syncHostname(ctx, &hostname)
+		hostnames = append(hostnames, hostname)
+	} else {
+		hostnames = b.syncAll(ctx)
+	}
+
+	resp := &pb.SyncDNSResponse{
+		Success:   true,
+		Hostnames: make([]*pb.DNSHostname, 0, len(hostnames)),
+	}
+	failed := 0
+	for i := range hostnames {
+		if hostnames[i].LastError != "" {
+			failed++
+		}
+		resp.Hostnames = append(resp.Hostnames, dnsHostnameToProto(&hostnames[i]))
+	}
+	resp.Success = failed == 0
+	resp.Message = fmt.Sprintf("%d hostname(s) synced, %d failed", len(hostnames)-failed, failed)
+	return resp, nil
+}
+
+func dnsHostnameToProto(hostname *models.DNSHostname) *pb.DNSHostname {
+	result := &pb.DNSHostname{
+		Id:        hostname.ID.String(),
+		Name:      hostname.Name,
+		NodeGroup: hostname.NodeGroup,
+		Weights:   make(map[string]int32, len(hostname.Weights)),
+		Records:   int32(hostname.Records),
+		Ttl:       int32(hostname.TTL),
+		Proxied:   hostname.Proxied,
+		Enabled:   hostname.Enabled,
+		LastError: hostname.LastError,
+	}
+	for nodeID, weight := range hostname.GetWeights() {
+		result.Weights[nodeID] = int32(weight)
+	}
+	if hostname.LastSyncedAt != nil {
+		result.LastSyncedAt = hostname.LastSyncedAt.Unix()
+	}
+	for _, record := range hostname.GetPublished() {
+		result.Published = append(result.Published, &pb.DNSRecord{
+			Type:    record.Type,
+			Content: record.Content,
+			NodeId:  record.NodeID,
+		})
+	}
+	return result
+}
@@ -0,0 +1,321 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm/clause"
+
+	"hysteria2_microservices/orchestrator-service/internal/config"
+	"hysteria2_microservices/orchestrator-service/internal/models"
+	pb "hysteria2_microservices/proto"
+)
+
+// DriftHandler compares every node with its desired state on a schedule: the protocol
+// matrix and settings stored here, and the configs, firewall and routing rules its agent
+// applied. Drift is recorded per node and healed on nodes whose policy asks for it.
+type DriftHandler struct {
+	leadership
+	nodeHandler *NodeHandler
+	config      config.DriftConfig
+	logger      *logrus.Logger
+}
+
+// NewDriftHandler creates a new DriftHandler
+func NewDriftHandler(nodeHandler *NodeHandler, cfg config.DriftConfig, logger *logrus.Logger) *DriftHandler {
+	return &DriftHandler{
+		nodeHandler: nodeHandler,
+		config:      cfg,
+		logger:      logger,
+	}
+}
+
+// Start checks every online node once per interval until ctx is cancelled, while this
+// replica leads
+func (h *DriftHandler) Start(ctx context.Context) {
+	if !h.config.Enabled {
+		h.logger.Info("Drift checks disabled")
+		return
+	}
+
+	interval := time.Duration(h.config.Interval) * time.Second
+	if interval <= 0 {
+		interval = 15 * time.Minute
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if h.leading() {
+				h.checkAll(ctx)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	h.logger.Infof("Checking nodes for drift every %s", interval)
+}
+
+func (h *DriftHandler) checkAll(ctx context.Context) {
+	var nodes []models.VPSNode
+	if err := h.nodeHandler.db.Where("status = ?", models.NodeStatusOnline).Find(&nodes).Error; err != nil {
+		h.logger.Errorf("Failed to get nodes for drift checks: %v", err)
+		return
+	}
+
+	drifted := 0
+	for i := range nodes {
+		if ctx.Err() != nil {
+			return
+		}
+		node := &nodes[i]
+		if nodeCapability(node, "drift_check") != "true" {
+			continue
+		}
+		report, err := h.checkNode(ctx, node, node.DriftPolicy == models.DriftPolicyHeal)
+		if err != nil {
+			h.logger.Warnf("Drift check on node %s failed: %v", node.Name, err)
+			continue
+		}
+		if len(report.Items) > 0 {
+			h.logger.Warnf("Node %s drifted from its desired state: %d item(s)", node.Name, len(report.Items))
+			drifted++
+		}
+	}
+	h.logger.Infof("Drift checks done: %d node(s) drifted", drifted)
+}
+
+// checkNode has the agent compare the node with its desired state and stores the outcome.
+// With heal, drift found is healed by the agent, then the stored settings are pushed again
+// if some is left.
+func (h *DriftHandler) checkNode(ctx context.Context, node *models.VPSNode, heal bool) (*pb.DriftReport, error) {
+	conn, err := h.nodeHandler.connect(node.ID.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to node: %w", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewNodeManagerClient(conn)
+
+	req := &pb.CheckDriftRequest{NodeId: node.ID.String()}
+	if len(node.Protocols) > 0 {
+		req.Protocols = node.GetProtocols()
+	}
+	report, err := h.agentDrift(ctx, client, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if heal && len(report.Items) > 0 {
+		req.Heal = true
+		if report, err = h.agentDrift(ctx, client, req); err != nil {
+			return nil, err
+		}
+		if len(report.Items) > 0 {
+			pushed, err := pushStoredConfig(ctx, client, node)
+			if err != nil {
+				report.HealFailed = append(report.HealFailed, err.Error())
+			} else if pushed != "" {
+				report.Healed = append(report.Healed, "push "+pushed)
+				req.Heal = false
+				remaining, err := h.agentDrift(ctx, client, req)
+				if err != nil {
+					return nil, err
+				}
+				report.Items = remaining.Items
+				report.CheckedAt = remaining.CheckedAt
+			}
+		}
+		h.logger.Infof("Healed drift on node %s: %v, %d item(s) left", node.Name, report.Healed, len(report.Items))
+	}
+
+	if err := h.saveDrift(node, report); err != nil {
+		return nil, err
+	}
+	report.NodeId = node.ID.String()
+	report.NodeName = node.Name
+	report.Policy = driftPolicy(node)
+	return report, nil
+}
+
+func (h *DriftHandler) agentDrift(ctx context.Context, client pb.NodeManagerClient, req *pb.CheckDriftRequest) (*pb.DriftReport, error) {
+	resp, err := client.CheckDrift(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check drift on node: %w", err)
+	}
+	if !resp.Success || resp.Report == nil {
+		return nil, fmt.Errorf("%s", resp.Message)
+	}
+	return resp.Report, nil
+}
+
+// saveDrift replaces the node's stored drift; the last heal is kept until the next one
+func (h *DriftHandler) saveDrift(node *models.VPSNode, report *pb.DriftReport) error {
+	drift := models.NodeDrift{
+		NodeID:    node.ID,
+		CheckedAt: time.Unix(report.CheckedAt, 0),
+	}
+	items := make([]models.DriftItem, 0, len(report.Items))
+	for _, item := range report.Items {
+		items = append(items, models.DriftItem{
+			Kind:     item.Kind,
+			Target:   item.Target,
+			Expected: item.Expected,
+			Actual:   item.Actual,
+		})
+	}
+	if err := drift.SetItems(items); err != nil {
+		return fmt.Errorf("failed to encode drift items: %w", err)
+	}
+
+	columns := []string{"items", "drifted", "checked_at"}
+	if report.HealedAt > 0 {
+		healedAt := time.Unix(report.HealedAt, 0)
+		drift.HealedAt = &healedAt
+		if err := drift.SetHeal(models.DriftHeal{Actions: report.Healed, Failed: report.HealFailed}); err != nil {
+			return fmt.Errorf("failed to encode drift heal: %w", err)
+		}
+		columns = append(columns, "heal", "healed_at")
+	}
+
+	err := h.nodeHandler.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "node_id"}},
+		DoUpdates: clause.AssignmentColumns(columns),
+	}).Create(&drift).Error
+	if err != nil {
+		return fmt.Errorf("failed to save drift: %w", err)
+	}
+	return nil
+}
+
+// CheckDrift compares a node with its desired state now, healing the drift found with heal
+func (h *DriftHandler) CheckDrift(ctx context.Context, req *pb.CheckDriftRequest) (*pb.CheckDriftResponse, error) {
+	var node models.VPSNode
+	if err := h.nodeHandler.db.First(&node, "id = ?", req.NodeId).Error; err != nil {
+		return nil, fmt.Errorf("node not found: %w", err)
+	}
+	if nodeCapability(&node, "drift_check") != "true" {
+		return nil, status.Errorf(codes.FailedPrecondition, "node %s does not run drift checks", node.Name)
+	}
+
+	report, err := h.checkNode(ctx, &node, req.Heal)
+	if err != nil {
+		return nil, err
+	}
+	message := fmt.Sprintf("Node %s matches its desired state", node.Name)
+	if len(report.Items) > 0 {
+		message = fmt.Sprintf("Node %s drifted from its desired state: %d item(s)", node.Name, len(report.Items))
+	}
+	return &pb.CheckDriftResponse{
+		Success: true,
+		Message: message,
+		Report:  report,
+	}, nil
+}
+
+// ListDrift returns the last drift check of every node, the most drifted first
+func (h *DriftHandler) ListDrift(ctx context.Context, req *pb.ListDriftRequest) (*pb.ListDriftResponse, error) {
+	query := h.nodeHandler.db.Model(&models.NodeDrift{})
+	if req.DriftedOnly {
+		query = query.Where("drifted > 0")
+	}
+	var drifts []models.NodeDrift
+	if err := query.Find(&drifts).Error; err != nil {
+		return nil, fmt.Errorf("failed to get drift: %w", err)
+	}
+
+	var nodes []models.VPSNode
+	if err := h.nodeHandler.db.Select("id", "name", "drift_policy").Find(&nodes).Error; err != nil {
+		return nil, fmt.Errorf("failed to get nodes: %w", err)
+	}
+	byID := make(map[string]*models.VPSNode, len(nodes))
+	for i := range nodes {
+		byID[nodes[i].ID.String()] = &nodes[i]
+	}
+
+	resp := &pb.ListDriftResponse{
+		Success: true,
+		Reports: make([]*pb.DriftReport, 0, len(drifts)),
+	}
+	for i := range drifts {
+		node, ok := byID[drifts[i].NodeID.String()]
+		if !ok {
+			continue
+		}
+		resp.Reports = append(resp.Reports, nodeDriftToProto(&drifts[i], node))
+	}
+	sort.SliceStable(resp.Reports, func(i, j int) bool {
+		a, b := resp.Reports[i], resp.Reports[j]
+		if len(a.Items) != len(b.Items) {
+			return len(a.Items) > len(b.Items)
+		}
+		return a.NodeName < b.NodeName
+	})
+	resp.Message = fmt.Sprintf("%d node(s) checked", len(resp.Reports))
+	return resp, nil
+}
+
+// SetDriftPolicy selects whether scheduled checks only record a node's drift or heal it
+func (h *DriftHandler) SetDriftPolicy(ctx context.Context, req *pb.SetDriftPolicyRequest) (*pb.SetDriftPolicyResponse, error) {
+	if req.Policy != models.DriftPolicyReport && req.Policy != models.DriftPolicyHeal {
+		return nil, status.Errorf(codes.InvalidArgument, "policy must be %s or %s", models.DriftPolicyReport, models.DriftPolicyHeal)
+	}
+
+	var node models.VPSNode
+	if err := h.nodeHandler.db.First(&node, "id = ?", req.NodeId).Error; err != nil {
+		return nil, fmt.Errorf("node not found: %w", err)
+	}
+	if err := h.nodeHandler.db.Model(&node).Update("drift_policy", req.Policy).Error; err != nil {
+		return nil, fmt.Errorf("failed to save drift policy: %w", err)
+	}
+
+	h.logger.Infof("Drift policy of node %s set to %s", node.Name, req.Policy)
+	return &pb.SetDriftPolicyResponse{
+		Success: true,
+		Message: fmt.Sprintf("Drift policy of node %s set to %s", node.Name, req.Policy),
+		Policy:  req.Policy,
+	}, nil
+}
+
+// driftPolicy returns the node's policy, report for nodes saved before policies existed
+func driftPolicy(node *models.VPSNode) string {
+	if node.DriftPolicy == "" {
+		return models.DriftPolicyReport
+	}
+	return node.DriftPolicy
+}
+
+func nodeDriftToProto(drift *models.NodeDrift, node *models.VPSNode) *pb.DriftReport {
+	report := &pb.DriftReport{
+		NodeId:    node.ID.String(),
+		NodeName:  node.Name,
+		Policy:    driftPolicy(node),
+		CheckedAt: drift.CheckedAt.Unix(),
+	}
+	for _, item := range drift.GetItems() {
+		report.Items = append(report.Items, &pb.DriftItem{
+			Kind:     item.Kind,
+			Target:   item.Target,
+			Expected: item.Expected,
+			Actual:   item.Actual,
+		})
+	}
+	if drift.HealedAt != nil {
+		heal := drift.GetHeal()
+		report.Healed = heal.Actions
+		report.HealFailed = heal.Failed
+		report.HealedAt = drift.HealedAt.Unix()
+	}
+	return report
+}
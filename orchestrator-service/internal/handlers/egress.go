@@ -0,0 +1,281 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"hysteria2_microservices/orchestrator-service/internal/config"
+	"hysteria2_microservices/orchestrator-service/internal/models"
+	pb "hysteria2_microservices/proto"
+)
+
+const egressHistoryRetention = 30 * 24 * time.Hour
+
+// egressHealthOrder lists the worst nodes first
+var egressHealthOrder = map[string]int{"dirty": 0, "degraded": 1, "unknown": 2, "clean": 3}
+
+// EgressHandler collects the egress reputation checks agents run on their own schedule,
+// runs them on demand and lists the health of every node's egress addresses
+type EgressHandler struct {
+	leadership
+	nodeHandler *NodeHandler
+	config      config.EgressConfig
+	logger      *logrus.Logger
+}
+
+// NewEgressHandler creates a new EgressHandler
+func NewEgressHandler(nodeHandler *NodeHandler, cfg config.EgressConfig, logger *logrus.Logger) *EgressHandler {
+	return &EgressHandler{
+		nodeHandler: nodeHandler,
+		config:      cfg,
+		logger:      logger,
+	}
+}
+
+// Start collects the last check of every online node once per interval until ctx is
+// cancelled, while this replica leads
+func (h *EgressHandler) Start(ctx context.Context) {
+	if !h.config.Enabled {
+		h.logger.Info("Egress check collection disabled")
+		return
+	}
+
+	interval := time.Duration(h.config.Interval) * time.Second
+	if interval <= 0 {
+		interval = time.Hour
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if h.leading() {
+				h.collect(ctx)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	h.logger.Infof("Collecting egress checks every %s", interval)
+}
+
+func (h *EgressHandler) collect(ctx context.Context) {
+	var nodes []models.VPSNode
+	if err := h.nodeHandler.db.Where("status = ?", models.NodeStatusOnline).Find(&nodes).Error; err != nil {
+		h.logger.Errorf("Failed to get nodes for egress checks: %v", err)
+		return
+	}
+
+	flagged := 0
+	for i := range nodes {
+		if ctx.Err() != nil {
+			return
+		}
+		if nodeCapability(&nodes[i], "egress_check") != "true" {
+			continue
+		}
+		report, err := h.checkNode(ctx, &nodes[i], false)
+		if err != nil {
+			h.logger.Warnf("Egress check on node %s failed: %v", nodes[i].Name, err)
+			continue
+		}
+		if report.Health == "dirty" || report.Health == "degraded" {
+			h.logger.Warnf("Egress addresses of node %s are %s", nodes[i].Name, report.Health)
+			flagged++
+		}
+	}
+
+	cutoff := time.Now().Add(-egressHistoryRetention)
+	if err := h.nodeHandler.db.Where("checked_at < ?", cutoff).Delete(&models.NodeEgressCheck{}).Error; err != nil {
+		h.logger.Warnf("Failed to prune egress check history: %v", err)
+	}
+	h.logger.Infof("Egress checks collected: %d node(s) flagged", flagged)
+}
+
+// checkNode gets the node's egress report from its agent and stores it, unless the same
+// check was stored before
+func (h *EgressHandler) checkNode(ctx context.Context, node *models.VPSNode, refresh bool) (*pb.EgressReport, error) {
+	conn, err := h.nodeHandler.connect(node.ID.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to node: %w", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewNodeManagerClient(conn)
+
+	resp, err := client.CheckEgress(ctx, &pb.CheckEgressRequest{NodeId: node.ID.String(), Refresh: refresh})
+	if err != nil {
+		return nil, fmt.Errorf("failed to check egress on node: %w", err)
+	}
+	if !resp.Success || resp.Report == nil {
+		return nil, fmt.Errorf("%s", resp.Message)
+	}
+
+	report := resp.Report
+	report.NodeId = node.ID.String()
+	report.NodeName = node.Name
+
+	check := models.NodeEgressCheck{
+		NodeID:    node.ID,
+		Health:    report.Health,
+		CheckedAt: time.Unix(report.CheckedAt, 0),
+	}
+	var stored int64
+	if err := h.nodeHandler.db.Model(&models.NodeEgressCheck{}).Where("node_id = ? AND checked_at = ?", check.NodeID, check.CheckedAt).Count(&stored).Error; err != nil {
+		return nil, fmt.Errorf("failed to look up egress checks: %w", err)
+	}
+	if stored > 0 {
+		return report, nil
+	}
+
+	paths := make([]models.EgressPath, 0, len(report.Paths))
+	for _, path := range report.Paths {
+		switch path.Path {
+		case "direct":
+			check.DirectIP = path.Ip
+		case "warp":
+			check.WARPIP = path.Ip
+		}
+		paths = append(paths, egressPathFromProto(path))
+	}
+	if err := check.SetPaths(paths); err != nil {
+		return nil, fmt.Errorf("failed to encode egress paths: %w", err)
+	}
+	if err := h.nodeHandler.db.Create(&check).Error; err != nil {
+		return nil, fmt.Errorf("failed to save egress check: %w", err)
+	}
+	return report, nil
+}
+
+// CheckEgress returns the reputation of a node's egress addresses, checked now with refresh
+func (h *EgressHandler) CheckEgress(ctx context.Context, req *pb.CheckEgressRequest) (*pb.CheckEgressResponse, error) {
+	var node models.VPSNode
+	if err := h.nodeHandler.db.First(&node, "id = ?", req.NodeId).Error; err != nil {
+		return nil, fmt.Errorf("node not found: %w", err)
+	}
+
+	report, err := h.checkNode(ctx, &node, req.Refresh)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.CheckEgressResponse{
+		Success: true,
+		Message: fmt.Sprintf("Egress health of node %s is %s", node.Name, report.Health),
+		Report:  report,
+	}, nil
+}
+
+// ListEgressHealth returns the last stored check of every node, the worst first, so
+// operators see which addresses to rotate
+func (h *EgressHandler) ListEgressHealth(ctx context.Context, req *pb.ListEgressHealthRequest) (*pb.ListEgressHealthResponse, error) {
+	var checks []models.NodeEgressCheck
+	err := h.nodeHandler.db.Raw(`SELECT DISTINCT ON (node_id) * FROM node_egress_checks ORDER BY node_id, checked_at DESC`).
+		Scan(&checks).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to get egress checks: %w", err)
+	}
+
+	var nodes []models.VPSNode
+	if err := h.nodeHandler.db.Select("id", "name").Find(&nodes).Error; err != nil {
+		return nil, fmt.Errorf("failed to get nodes: %w", err)
+	}
+	names := make(map[string]string, len(nodes))
+	for _, node := range nodes {
+		names[node.ID.String()] = node.Name
+	}
+
+	resp := &pb.ListEgressHealthResponse{
+		Success: true,
+		Reports: make([]*pb.EgressReport, 0, len(checks)),
+	}
+	for i := range checks {
+		name, ok := names[checks[i].NodeID.String()]
+		if !ok || (req.Health != "" && checks[i].Health != req.Health) {
+			continue
+		}
+		resp.Reports = append(resp.Reports, egressCheckToProto(&checks[i], name))
+	}
+	sort.SliceStable(resp.Reports, func(i, j int) bool {
+		a, b := resp.Reports[i], resp.Reports[j]
+		if egressHealthOrder[a.Health] != egressHealthOrder[b.Health] {
+			return egressHealthOrder[a.Health] < egressHealthOrder[b.Health]
+		}
+		return a.NodeName < b.NodeName
+	})
+	resp.Message = fmt.Sprintf("%d node(s) checked", len(resp.Reports))
+	return resp, nil
+}
+
+func egressCheckToProto(check *models.NodeEgressCheck, nodeName string) *pb.EgressReport {
+	report := &pb.EgressReport{
+		NodeId:    check.NodeID.String(),
+		NodeName:  nodeName,
+		Health:    check.Health,
+		CheckedAt: check.CheckedAt.Unix(),
+	}
+	for _, path := range check.GetPaths() {
+		p := &pb.EgressPath{
+			Path:    path.Path,
+			Ip:      path.IP,
+			Country: path.Country,
+			Org:     path.Org,
+			Health:  path.Health,
+			Issues:  path.Issues,
+			Error:   path.Error,
+		}
+		for _, listing := range path.Listings {
+			p.Listings = append(p.Listings, &pb.EgressListing{
+				Zone:   listing.Zone,
+				Listed: listing.Listed,
+				Codes:  listing.Codes,
+				Error:  listing.Error,
+			})
+		}
+		for _, service := range path.Services {
+			p.Services = append(p.Services, &pb.EgressServiceCheck{
+				Service: service.Service,
+				Status:  service.Status,
+				Detail:  service.Detail,
+			})
+		}
+		report.Paths = append(report.Paths, p)
+	}
+	return report
+}
+
+func egressPathFromProto(path *pb.EgressPath) models.EgressPath {
+	result := models.EgressPath{
+		Path:    path.Path,
+		IP:      path.Ip,
+		Country: path.Country,
+		Org:     path.Org,
+		Health:  path.Health,
+		Issues:  path.Issues,
+		Error:   path.Error,
+	}
+	for _, listing := range path.Listings {
+		result.Listings = append(result.Listings, models.EgressListing{
+			Zone:   listing.Zone,
+			Listed: listing.Listed,
+			Codes:  listing.Codes,
+			Error:  listing.Error,
+		})
+	}
+	for _, service := range path.Services {
+		result.Services = append(result.Services, models.EgressServiceCheck{
+			Service: service.Service,
+			Status:  service.Status,
+			Detail:  service.Detail,
+		})
+	}
+	return result
+}
@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm"
+
+	pb "hysteria2_microservices/proto"
+)
+
+// errorDomain is the ErrorInfo domain of every ErrorCode
+const errorDomain = "hysteria2.vpn"
+
+// errorCodesByStatus are the ErrorCodes of statuses returned without an ErrorInfo, e.g. by
+// gRPC itself when a node cannot be dialed
+var errorCodesByStatus = map[codes.Code]pb.ErrorCode{
+	codes.InvalidArgument:  pb.ErrorCode_ERROR_CODE_INVALID_ARGUMENT,
+	codes.NotFound:         pb.ErrorCode_ERROR_CODE_NOT_FOUND,
+	codes.PermissionDenied: pb.ErrorCode_ERROR_CODE_PERMISSION_DENIED,
+	codes.Unauthenticated:  pb.ErrorCode_ERROR_CODE_PERMISSION_DENIED,
+	codes.DeadlineExceeded: pb.ErrorCode_ERROR_CODE_TIMEOUT,
+	codes.Unavailable:      pb.ErrorCode_ERROR_CODE_NODE_UNREACHABLE,
+}
+
+// codedError returns a status with an ErrorInfo for failures the gRPC code alone does not
+// tell apart
+func codedError(grpcCode codes.Code, code pb.ErrorCode, metadata map[string]string, format string, args ...interface{}) error {
+	st := status.Newf(grpcCode, format, args...)
+	detailed, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason:   strings.TrimPrefix(code.String(), "ERROR_CODE_"),
+		Domain:   errorDomain,
+		Metadata: metadata,
+	})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+// errorStatus converts a handler error into a gRPC status carrying an ErrorInfo detail with
+// its ErrorCode. Node errors are wrapped statuses that already carry the node's ErrorInfo
+// and keep it.
+func errorStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	st, ok := status.FromError(err)
+	if ok {
+		for _, detail := range st.Details() {
+			if _, isInfo := detail.(*errdetails.ErrorInfo); isInfo {
+				return st.Err()
+			}
+		}
+	}
+
+	grpcCode, code := classifyError(err, st, ok)
+	plain := status.New(grpcCode, err.Error())
+	detailed, detailErr := plain.WithDetails(&errdetails.ErrorInfo{
+		Reason: strings.TrimPrefix(code.String(), "ERROR_CODE_"),
+		Domain: errorDomain,
+	})
+	if detailErr != nil {
+		return plain.Err()
+	}
+	return detailed.Err()
+}
+
+// classifyError finds the codes of an error from its status or the errors it wraps
+func classifyError(err error, st *status.Status, isStatus bool) (codes.Code, pb.ErrorCode) {
+	if isStatus {
+		if code, found := errorCodesByStatus[st.Code()]; found {
+			return st.Code(), code
+		}
+		return st.Code(), pb.ErrorCode_ERROR_CODE_INTERNAL
+	}
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return codes.NotFound, pb.ErrorCode_ERROR_CODE_NOT_FOUND
+	case errors.Is(err, context.DeadlineExceeded):
+		return codes.DeadlineExceeded, pb.ErrorCode_ERROR_CODE_TIMEOUT
+	case errors.Is(err, context.Canceled):
+		return codes.Canceled, pb.ErrorCode_ERROR_CODE_INTERNAL
+	}
+	return codes.Internal, pb.ErrorCode_ERROR_CODE_INTERNAL
+}
+
+// ErrorCodeInterceptor reports every error a handler returns as a status with its ErrorCode
+func ErrorCodeInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	resp, err := handler(ctx, req)
+	if err != nil {
+		return nil, errorStatus(err)
+	}
+	return resp, nil
+}
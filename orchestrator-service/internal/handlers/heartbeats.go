@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"hysteria2_microservices/orchestrator-service/internal/models"
+	"hysteria2_microservices/orchestrator-service/internal/repositories/interfaces"
+	"hysteria2_microservices/pkg/events"
+)
+
+// HeartbeatConsumer applies the heartbeats agents publish on the event bus: the node's last
+// heartbeat and status, and a metric sample. Every replica may consume; the durable consumer
+// hands each heartbeat to one of them.
+type HeartbeatConsumer struct {
+	nodeRepo   interfaces.NodeRepository
+	metricRepo interfaces.NodeMetricRepository
+	logger     *logrus.Logger
+}
+
+// NewHeartbeatConsumer creates a new HeartbeatConsumer
+func NewHeartbeatConsumer(nodeRepo interfaces.NodeRepository, metricRepo interfaces.NodeMetricRepository, logger *logrus.Logger) *HeartbeatConsumer {
+	return &HeartbeatConsumer{
+		nodeRepo:   nodeRepo,
+		metricRepo: metricRepo,
+		logger:     logger,
+	}
+}
+
+// Start consumes heartbeats until ctx is cancelled, starting with those published while the
+// orchestrator was down
+func (h *HeartbeatConsumer) Start(ctx context.Context, bus *events.Bus) {
+	bus.Consume(ctx, events.ConsumerOptions{
+		Durable:       "orchestrator-heartbeats",
+		FilterSubject: events.HeartbeatSubjects,
+	}, h.handle)
+	h.logger.Info("Consuming node heartbeats from the event bus")
+}
+
+func (h *HeartbeatConsumer) handle(ctx context.Context, event *events.Event) error {
+	var heartbeat events.Heartbeat
+	if err := json.Unmarshal(event.Data, &heartbeat); err != nil {
+		return events.Permanent(fmt.Errorf("malformed heartbeat %s: %w", event.ID, err))
+	}
+	nodeID, err := uuid.Parse(heartbeat.NodeID)
+	if err != nil {
+		return events.Permanent(fmt.Errorf("heartbeat %s of invalid node %q", event.ID, heartbeat.NodeID))
+	}
+
+	node, err := h.nodeRepo.GetByID(heartbeat.NodeID)
+	if err != nil {
+		// Heartbeats of deleted nodes stay in the stream until it expires them
+		return events.Permanent(fmt.Errorf("heartbeat of unknown node %s: %w", heartbeat.NodeID, err))
+	}
+
+	// Replayed heartbeats older than the last one applied only add their metrics
+	if event.Time.After(node.LastHeartbeat) {
+		if err := h.nodeRepo.UpdateLastHeartbeat(heartbeat.NodeID, event.Time); err != nil {
+			return err
+		}
+		if heartbeat.Status != "" && heartbeat.Status != node.Status {
+			if err := h.nodeRepo.UpdateStatus(heartbeat.NodeID, heartbeat.Status); err != nil {
+				return err
+			}
+		}
+	}
+
+	metrics := heartbeat.Metrics
+	return h.metricRepo.Create(&models.NodeMetric{
+		NodeID:            nodeID,
+		CPUUsage:          metrics["cpu_usage"],
+		MemoryUsage:       metrics["memory_usage"],
+		BandwidthUp:       int64(metrics["bandwidth_up"]),
+		BandwidthDown:     int64(metrics["bandwidth_down"]),
+		ActiveConnections: int(metrics["capacity_connections"]),
+		RecordedAt:        event.Time,
+
+		DiskUsedPercent:       metrics["disk_used_percent"],
+		DiskInodesUsedPercent: metrics["disk_inodes_used_percent"],
+		DiskLowPartitions:     int(metrics["disk_low_partitions"]),
+		ConfigDriftFiles:      int(metrics["config_drift_files"]),
+
+		WARPFailoverActive: metrics["warp_failover_active"] > 0,
+	})
+}
@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"hysteria2_microservices/orchestrator-service/internal/models"
+	pb "hysteria2_microservices/proto"
+)
+
+// CheckIntegrity returns the free space of a node's partitions and the deployed configs
+// edited outside its agent, checked now with refresh. Heartbeats carry the same figures
+// summed up, see HeartbeatConsumer.
+func (h *NodeConfigHandler) CheckIntegrity(ctx context.Context, req *pb.CheckIntegrityRequest) (*pb.CheckIntegrityResponse, error) {
+	var node models.VPSNode
+	if err := h.nodeHandler.db.First(&node, "id = ?", req.NodeId).Error; err != nil {
+		return nil, fmt.Errorf("node not found: %w", err)
+	}
+	if nodeCapability(&node, "integrity_check") != "true" {
+		return nil, status.Errorf(codes.FailedPrecondition, "node %s does not run integrity checks", node.Name)
+	}
+
+	conn, err := h.nodeHandler.connect(node.ID.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to node: %w", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewNodeManagerClient(conn)
+
+	resp, err := client.CheckIntegrity(ctx, &pb.CheckIntegrityRequest{NodeId: node.ID.String(), Refresh: req.Refresh})
+	if err != nil {
+		return nil, fmt.Errorf("failed to check integrity on node: %w", err)
+	}
+	if resp.Success && resp.Report != nil {
+		resp.Report.NodeId = node.ID.String()
+		resp.Report.NodeName = node.Name
+	}
+	return resp, nil
+}
@@ -0,0 +1,21 @@
+package handlers
+
+import (
+	"hysteria2_microservices/orchestrator-service/internal/leader"
+)
+
+// leadership keeps a scheduler to the leading orchestrator, so running several replicas
+// does not run every scheduled job several times. Requests are served by every replica.
+type leadership struct {
+	elector *leader.Elector
+}
+
+// SetElector makes the scheduler run only while this replica leads; without an elector it
+// always runs
+func (l *leadership) SetElector(elector *leader.Elector) {
+	l.elector = elector
+}
+
+func (l *leadership) leading() bool {
+	return l.elector.IsLeader()
+}
@@ -0,0 +1,755 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"hysteria2_microservices/orchestrator-service/internal/config"
+	"hysteria2_microservices/orchestrator-service/internal/models"
+	pb "hysteria2_microservices/proto"
+)
+
+const (
+	defaultMaintenanceInterval  = 30 * time.Second
+	maintenanceOperationTimeout = 10 * time.Minute
+	maintenanceNotifyTimeout    = 10 * time.Second
+)
+
+var maintenanceOperations = map[string]bool{
+	models.MaintenanceOperationRestart:     true,
+	models.MaintenanceOperationCertRenewal: true,
+	models.MaintenanceOperationConfigPush:  true,
+	models.MaintenanceOperationDrain:       true,
+}
+
+// maintenanceNotification is posted to the notify webhook for the users assigned to the
+// nodes of a window
+type maintenanceNotification struct {
+	Event  string                 `json:"event"` // maintenance_scheduled or maintenance_cancelled
+	Window maintenanceNotice      `json:"window"`
+	Users  []maintenanceRecipient `json:"users"`
+}
+
+type maintenanceNotice struct {
+	ID        uuid.UUID               `json:"id"`
+	Operation string                  `json:"operation"`
+	StartsAt  time.Time               `json:"starts_at"`
+	EndsAt    time.Time               `json:"ends_at"`
+	Reason    string                  `json:"reason,omitempty"`
+	Nodes     []maintenanceNoticeNode `json:"nodes"`
+}
+
+type maintenanceNoticeNode struct {
+	ID   uuid.UUID `json:"id"`
+	Name string    `json:"name"`
+}
+
+type maintenanceRecipient struct {
+	ID       uuid.UUID `json:"id"`
+	Username string    `json:"username"`
+	Email    string    `json:"email"`
+}
+
+// MaintenanceHandler schedules node operations in maintenance windows. When a window opens
+// its nodes are drained into maintenance status and the operation runs on one node at a
+// time; the users assigned to the nodes are notified ahead of the window.
+type MaintenanceHandler struct {
+	leadership
+	nodeHandler *NodeHandler
+	config      config.MaintenanceConfig
+	client      *http.Client
+	logger      *logrus.Logger
+
+	// mu serialises conflict checks with the creation of windows
+	mu sync.Mutex
+}
+
+// NewMaintenanceHandler creates a new MaintenanceHandler
+func NewMaintenanceHandler(nodeHandler *NodeHandler, cfg config.MaintenanceConfig, logger *logrus.Logger) *MaintenanceHandler {
+	return &MaintenanceHandler{
+		nodeHandler: nodeHandler,
+		config:      cfg,
+		client:      &http.Client{Timeout: maintenanceNotifyTimeout},
+		logger:      logger,
+	}
+}
+
+// Start checks the schedule once per interval until ctx is cancelled, while this replica
+// leads. Windows left running by a previous leader are recovered whenever this replica
+// takes over.
+func (h *MaintenanceHandler) Start(ctx context.Context) {
+	interval := time.Duration(h.config.Interval) * time.Second
+	if interval <= 0 {
+		interval = defaultMaintenanceInterval
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		recovered := false
+		for {
+			if !h.leading() {
+				recovered = false
+			} else {
+				if !recovered {
+					h.recoverInterrupted()
+					recovered = true
+				}
+				h.tick(ctx, time.Now())
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	h.logger.Infof("Maintenance scheduler checking every %s", interval)
+}
+
+// ScheduleMaintenance plans an operation on the given nodes. A window overlapping another
+// scheduled or running window on one of its nodes is refused and the conflicts are listed.
+func (h *MaintenanceHandler) ScheduleMaintenance(ctx context.Context, req *pb.ScheduleMaintenanceRequest) (*pb.ScheduleMaintenanceResponse, error) {
+	if !maintenanceOperations[req.Operation] {
+		return nil, fmt.Errorf("unsupported operation %q", req.Operation)
+	}
+	switch req.Service {
+	case "", models.ComponentHysteria2, models.ComponentXray:
+	default:
+		return nil, fmt.Errorf("unsupported service %q", req.Service)
+	}
+	if req.Service != "" && req.Operation != models.MaintenanceOperationRestart {
+		return nil, fmt.Errorf("service only applies to restarts")
+	}
+	if len(req.NodeIds) == 0 {
+		return nil, fmt.Errorf("at least one node is required")
+	}
+	if req.StartsAt == 0 || req.EndsAt == 0 {
+		return nil, fmt.Errorf("starts_at and ends_at are required")
+	}
+	start, end := time.Unix(req.StartsAt, 0), time.Unix(req.EndsAt, 0)
+	if !end.After(start) {
+		return nil, fmt.Errorf("window must end after it starts")
+	}
+	if !end.After(time.Now()) {
+		return nil, fmt.Errorf("window has already ended")
+	}
+
+	var nodes []models.VPSNode
+	if err := h.nodeHandler.db.Where("id IN ?", req.NodeIds).Order("name").Find(&nodes).Error; err != nil {
+		return nil, fmt.Errorf("failed to get nodes: %w", err)
+	}
+	if len(nodes) != len(req.NodeIds) {
+		return nil, fmt.Errorf("%d of %d requested node(s) not found", len(req.NodeIds)-len(nodes), len(req.NodeIds))
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	conflicts, err := h.conflicts(nodes, start, end)
+	if err != nil {
+		return nil, err
+	}
+	if len(conflicts) > 0 {
+		return &pb.ScheduleMaintenanceResponse{
+			Success:   false,
+			Message:   fmt.Sprintf("Window conflicts with %d other window(s)", len(conflicts)),
+			Conflicts: conflicts,
+		}, nil
+	}
+
+	window := models.MaintenanceWindow{
+		Operation: req.Operation,
+		Service:   req.Service,
+		StartsAt:  start,
+		EndsAt:    end,
+		Drain:     req.Drain || req.Operation == models.MaintenanceOperationDrain,
+		Status:    models.MaintenanceStatusScheduled,
+		Reason:    req.Reason,
+	}
+	plan := make([]models.MaintenanceNode, 0, len(nodes))
+	for _, node := range nodes {
+		plan = append(plan, models.MaintenanceNode{
+			NodeID:   node.ID,
+			NodeName: node.Name,
+			Status:   models.MaintenanceNodePending,
+		})
+	}
+	if err := window.SetNodes(plan); err != nil {
+		return nil, fmt.Errorf("failed to encode maintenance nodes: %w", err)
+	}
+	if err := h.nodeHandler.db.Create(&window).Error; err != nil {
+		return nil, fmt.Errorf("failed to save maintenance window: %w", err)
+	}
+
+	h.logger.Infof("Maintenance window %s scheduled: %s on %d node(s) from %s to %s",
+		window.ID, window.Operation, len(plan), start.Format(time.RFC3339), end.Format(time.RFC3339))
+
+	return &pb.ScheduleMaintenanceResponse{
+		Success: true,
+		Message: "Maintenance window scheduled",
+		Window:  maintenanceWindowToProto(&window),
+	}, nil
+}
+
+// ListMaintenanceWindows returns the windows by start time, only those still scheduled or
+// running unless finished ones are requested
+func (h *MaintenanceHandler) ListMaintenanceWindows(ctx context.Context, req *pb.ListMaintenanceWindowsRequest) (*pb.ListMaintenanceWindowsResponse, error) {
+	query := h.nodeHandler.db.Order("starts_at")
+	if !req.IncludeFinished {
+		query = query.Where("status IN ?", []string{models.MaintenanceStatusScheduled, models.MaintenanceStatusRunning})
+	}
+	var windows []models.MaintenanceWindow
+	if err := query.Find(&windows).Error; err != nil {
+		return nil, fmt.Errorf("failed to get maintenance windows: %w", err)
+	}
+
+	resp := &pb.ListMaintenanceWindowsResponse{Success: true}
+	for i := range windows {
+		if req.NodeId != "" && !windowHasNode(&windows[i], req.NodeId) {
+			continue
+		}
+		resp.Windows = append(resp.Windows, maintenanceWindowToProto(&windows[i]))
+	}
+	resp.Message = fmt.Sprintf("%d maintenance window(s)", len(resp.Windows))
+	return resp, nil
+}
+
+// CancelMaintenance cancels a scheduled window, or stops a running one and returns its
+// nodes to service. Users notified of the window are told it was cancelled.
+func (h *MaintenanceHandler) CancelMaintenance(ctx context.Context, req *pb.CancelMaintenanceRequest) (*pb.CancelMaintenanceResponse, error) {
+	var window models.MaintenanceWindow
+	if err := h.nodeHandler.db.First(&window, "id = ?", req.WindowId).Error; err != nil {
+		return nil, fmt.Errorf("maintenance window not found: %w", err)
+	}
+
+	now := time.Now()
+	result := h.nodeHandler.db.Model(&models.MaintenanceWindow{}).
+		Where("id = ? AND status IN ?", window.ID, []string{models.MaintenanceStatusScheduled, models.MaintenanceStatusRunning}).
+		Updates(map[string]interface{}{"status": models.MaintenanceStatusCancelled, "finished_at": now})
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to cancel maintenance window: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return nil, fmt.Errorf("maintenance window %s is %s", window.ID, window.Status)
+	}
+	wasRunning := window.Status == models.MaintenanceStatusRunning
+	window.Status = models.MaintenanceStatusCancelled
+	window.FinishedAt = &now
+
+	if wasRunning {
+		nodes := window.GetNodes()
+		for i := range nodes {
+			h.leaveMaintenance(&nodes[i])
+		}
+		h.saveNodes(&window, nodes)
+	}
+	h.logger.Warnf("Maintenance window %s cancelled", window.ID)
+
+	if window.NotifiedAt != nil {
+		if err := h.notifyUsers(ctx, "maintenance_cancelled", &window); err != nil {
+			h.logger.Errorf("Failed to notify users of cancelled maintenance window %s: %v", window.ID, err)
+		}
+	}
+
+	return &pb.CancelMaintenanceResponse{
+		Success: true,
+		Message: "Maintenance window cancelled",
+		Window:  maintenanceWindowToProto(&window),
+	}, nil
+}
+
+// conflicts describes the scheduled and running windows overlapping [start, end) on any of nodes
+func (h *MaintenanceHandler) conflicts(nodes []models.VPSNode, start, end time.Time) ([]string, error) {
+	var windows []models.MaintenanceWindow
+	err := h.nodeHandler.db.
+		Where("status IN ?", []string{models.MaintenanceStatusScheduled, models.MaintenanceStatusRunning}).
+		Order("starts_at").Find(&windows).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to check maintenance conflicts: %w", err)
+	}
+
+	requested := make(map[uuid.UUID]bool, len(nodes))
+	for _, node := range nodes {
+		requested[node.ID] = true
+	}
+	var conflicts []string
+	for _, window := range windows {
+		if !window.Overlaps(start, end) {
+			continue
+		}
+		var shared []string
+		for _, node := range window.GetNodes() {
+			if requested[node.NodeID] {
+				shared = append(shared, node.NodeName)
+			}
+		}
+		if len(shared) > 0 {
+			conflicts = append(conflicts, fmt.Sprintf("%s window %s from %s to %s on %s",
+				window.Operation, window.ID, window.StartsAt.Format(time.RFC3339),
+				window.EndsAt.Format(time.RFC3339), strings.Join(shared, ", ")))
+		}
+	}
+	return conflicts, nil
+}
+
+// tick notifies users of upcoming windows, opens the windows that are due and closes the
+// drained windows that have ended
+func (h *MaintenanceHandler) tick(ctx context.Context, now time.Time) {
+	h.notifyUpcoming(ctx, now)
+
+	var due []models.MaintenanceWindow
+	if err := h.nodeHandler.db.Where("status = ? AND starts_at <= ?", models.MaintenanceStatusScheduled, now).
+		Order("starts_at").Find(&due).Error; err != nil {
+		h.logger.Errorf("Failed to get due maintenance windows: %v", err)
+		return
+	}
+	for i := range due {
+		h.open(due[i], now)
+	}
+
+	var ended []models.MaintenanceWindow
+	if err := h.nodeHandler.db.Where("status = ? AND drain = ? AND ends_at <= ?", models.MaintenanceStatusRunning, true, now).
+		Find(&ended).Error; err != nil {
+		h.logger.Errorf("Failed to get ended maintenance windows: %v", err)
+		return
+	}
+	for i := range ended {
+		h.closeEnded(&ended[i])
+	}
+}
+
+// notifyUpcoming notifies the users of windows opening within notify_before minutes. A
+// failed notification is retried on the next tick.
+func (h *MaintenanceHandler) notifyUpcoming(ctx context.Context, now time.Time) {
+	horizon := now.Add(time.Duration(h.config.NotifyBefore) * time.Minute)
+
+	var upcoming []models.MaintenanceWindow
+	if err := h.nodeHandler.db.Where("status = ? AND notified_at IS NULL AND starts_at <= ?", models.MaintenanceStatusScheduled, horizon).
+		Find(&upcoming).Error; err != nil {
+		h.logger.Errorf("Failed to get upcoming maintenance windows: %v", err)
+		return
+	}
+	for i := range upcoming {
+		window := &upcoming[i]
+		if err := h.notifyUsers(ctx, "maintenance_scheduled", window); err != nil {
+			h.logger.Errorf("Failed to notify users of maintenance window %s: %v", window.ID, err)
+			continue
+		}
+		if err := h.nodeHandler.db.Model(&models.MaintenanceWindow{}).Where("id = ?", window.ID).
+			Updates(map[string]interface{}{"notified_at": now, "affected_users": window.AffectedUsers}).Error; err != nil {
+			h.logger.Errorf("Failed to save maintenance window %s notification: %v", window.ID, err)
+		}
+	}
+}
+
+// open marks a due window as running and runs it in the background. Windows that ended
+// before the scheduler saw them are failed instead.
+func (h *MaintenanceHandler) open(window models.MaintenanceWindow, now time.Time) {
+	result := h.nodeHandler.db.Model(&models.MaintenanceWindow{}).
+		Where("id = ? AND status = ?", window.ID, models.MaintenanceStatusScheduled).
+		Updates(map[string]interface{}{"status": models.MaintenanceStatusRunning, "started_at": now})
+	if result.Error != nil {
+		h.logger.Errorf("Failed to open maintenance window %s: %v", window.ID, result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		return
+	}
+	window.Status = models.MaintenanceStatusRunning
+	window.StartedAt = &now
+
+	if !window.EndsAt.After(now) {
+		h.finish(&window, models.MaintenanceStatusFailed, "window ended before it could open")
+		return
+	}
+
+	h.logger.Infof("Maintenance window %s opened: %s on %d node(s)", window.ID, window.Operation, len(window.GetNodes()))
+	go h.run(&window)
+}
+
+// run drains the nodes and runs the operation on one node at a time. Without Drain each
+// node returns to service right after its operation and the window finishes with the last
+// node; drained nodes stay in maintenance until the window closes.
+func (h *MaintenanceHandler) run(window *models.MaintenanceWindow) {
+	ctx := context.Background()
+	nodes := window.GetNodes()
+
+	if window.Drain {
+		for i := range nodes {
+			h.enterMaintenance(&nodes[i])
+		}
+		h.saveNodes(window, nodes)
+	}
+
+	for i := range nodes {
+		if h.cancelled(window.ID) {
+			return
+		}
+		entry := &nodes[i]
+		if !window.Drain {
+			h.enterMaintenance(entry)
+			h.saveNodes(window, nodes)
+		}
+		if entry.Status != models.MaintenanceNodePending {
+			continue
+		}
+
+		message, err := h.runOperation(ctx, window, entry.NodeID.String())
+		if err != nil {
+			entry.Status, entry.Message = models.MaintenanceNodeFailed, err.Error()
+			h.logger.Warnf("Maintenance window %s: %s on %s failed: %v", window.ID, window.Operation, entry.NodeName, err)
+		} else {
+			entry.Status, entry.Message = models.MaintenanceNodeDone, message
+			h.logger.Infof("Maintenance window %s: %s on %s done", window.ID, window.Operation, entry.NodeName)
+		}
+		finished := time.Now()
+		entry.FinishedAt = &finished
+
+		if !window.Drain {
+			h.leaveMaintenance(entry)
+		}
+		h.saveNodes(window, nodes)
+	}
+
+	if !window.Drain {
+		status, message := h.outcome(nodes)
+		h.finish(window, status, message)
+	}
+}
+
+// closeEnded returns the nodes of a drained window to service once the window has ended and
+// every node is through the operation
+func (h *MaintenanceHandler) closeEnded(window *models.MaintenanceWindow) {
+	nodes := window.GetNodes()
+	for _, node := range nodes {
+		if node.Status == models.MaintenanceNodePending {
+			return
+		}
+	}
+	for i := range nodes {
+		h.leaveMaintenance(&nodes[i])
+	}
+	h.saveNodes(window, nodes)
+	status, message := h.outcome(nodes)
+	h.finish(window, status, message)
+}
+
+// recoverInterrupted settles the windows a previous orchestrator left running: nodes that never ran
+// the operation are skipped, and windows that are not drained finish right away
+func (h *MaintenanceHandler) recoverInterrupted() {
+	var running []models.MaintenanceWindow
+	if err := h.nodeHandler.db.Where("status = ?", models.MaintenanceStatusRunning).Find(&running).Error; err != nil {
+		h.logger.Errorf("Failed to get running maintenance windows: %v", err)
+		return
+	}
+	for i := range running {
+		window := &running[i]
+		nodes := window.GetNodes()
+		for j := range nodes {
+			if nodes[j].Status == models.MaintenanceNodePending {
+				nodes[j].Status, nodes[j].Message = models.MaintenanceNodeSkipped, "interrupted by an orchestrator restart"
+			}
+			if !window.Drain {
+				h.leaveMaintenance(&nodes[j])
+			}
+		}
+		h.saveNodes(window, nodes)
+		if !window.Drain {
+			h.finish(window, models.MaintenanceStatusFailed, "interrupted by an orchestrator restart")
+		}
+		h.logger.Warnf("Recovered maintenance window %s interrupted by an orchestrator restart", window.ID)
+	}
+}
+
+// enterMaintenance drains a node by putting it in maintenance status, remembering the status
+// to restore. Nodes that are gone, not online, or being upgraded by a rollout are skipped.
+func (h *MaintenanceHandler) enterMaintenance(entry *models.MaintenanceNode) {
+	if entry.Status != models.MaintenanceNodePending {
+		return
+	}
+
+	var node models.VPSNode
+	if err := h.nodeHandler.db.First(&node, "id = ?", entry.NodeID).Error; err != nil {
+		entry.Status, entry.Message = models.MaintenanceNodeSkipped, "node no longer exists"
+		return
+	}
+	if node.Status != models.NodeStatusOnline && node.Status != models.NodeStatusMaintenance {
+		entry.Status, entry.Message = models.MaintenanceNodeSkipped, fmt.Sprintf("node is %s", node.Status)
+		return
+	}
+	if rolloutID, ok := h.activeRollout(node.ID); ok {
+		entry.Status, entry.Message = models.MaintenanceNodeSkipped, fmt.Sprintf("node is being upgraded by rollout %s", rolloutID)
+		return
+	}
+
+	if node.Status == models.NodeStatusMaintenance {
+		return
+	}
+	result := h.nodeHandler.db.Model(&models.VPSNode{}).
+		Where("id = ? AND status = ?", node.ID, node.Status).
+		Update("status", models.NodeStatusMaintenance)
+	if result.Error != nil || result.RowsAffected == 0 {
+		entry.Status, entry.Message = models.MaintenanceNodeSkipped, "failed to drain node"
+		return
+	}
+	entry.PreviousStatus = node.Status
+}
+
+// leaveMaintenance restores the status a node had before the window drained it, unless the
+// node left maintenance meanwhile
+func (h *MaintenanceHandler) leaveMaintenance(entry *models.MaintenanceNode) {
+	if entry.PreviousStatus == "" {
+		return
+	}
+	if err := h.nodeHandler.db.Model(&models.VPSNode{}).
+		Where("id = ? AND status = ?", entry.NodeID, models.NodeStatusMaintenance).
+		Update("status", entry.PreviousStatus).Error; err != nil {
+		h.logger.Errorf("Failed to return node %s to service: %v", entry.NodeName, err)
+		return
+	}
+	entry.PreviousStatus = ""
+}
+
+// activeRollout returns the rollout still due to upgrade the node, if any
+func (h *MaintenanceHandler) activeRollout(nodeID uuid.UUID) (uuid.UUID, bool) {
+	var rollouts []models.Rollout
+	if err := h.nodeHandler.db.Where("status IN ?",
+		[]string{models.RolloutStatusCanary, models.RolloutStatusSoaking, models.RolloutStatusRolling}).
+		Find(&rollouts).Error; err != nil {
+		h.logger.Errorf("Failed to get active rollouts: %v", err)
+		return uuid.Nil, false
+	}
+	for _, rollout := range rollouts {
+		for _, node := range rollout.GetNodes() {
+			if node.NodeID == nodeID && node.Status == models.RolloutNodePending {
+				return rollout.ID, true
+			}
+		}
+	}
+	return uuid.Nil, false
+}
+
+// runOperation runs the window's operation on a node through its agent
+func (h *MaintenanceHandler) runOperation(ctx context.Context, window *models.MaintenanceWindow, nodeID string) (string, error) {
+	if window.Operation == models.MaintenanceOperationDrain {
+		return "drained", nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, maintenanceOperationTimeout)
+	defer cancel()
+
+	conn, err := h.nodeHandler.connect(nodeID)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to node: %w", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewNodeManagerClient(conn)
+
+	switch window.Operation {
+	case models.MaintenanceOperationRestart:
+		resp, err := client.RestartServer(ctx, &pb.RestartRequest{NodeId: nodeID, ServiceName: window.Service})
+		if err != nil {
+			return "", fmt.Errorf("failed to restart node: %w", err)
+		}
+		if !resp.Success {
+			return "", fmt.Errorf("%s", resp.Message)
+		}
+		return resp.Message, nil
+	case models.MaintenanceOperationCertRenewal:
+		resp, err := client.RenewCertificates(ctx, &pb.RenewCertificatesRequest{NodeId: nodeID})
+		if err != nil {
+			return "", fmt.Errorf("failed to renew certificates on node: %w", err)
+		}
+		if !resp.Success {
+			return "", fmt.Errorf("%s", resp.Message)
+		}
+		return resp.Message, nil
+	case models.MaintenanceOperationConfigPush:
+		var node models.VPSNode
+		if err := h.nodeHandler.db.First(&node, "id = ?", nodeID).Error; err != nil {
+			return "", fmt.Errorf("node not found: %w", err)
+		}
+		return pushStoredConfig(ctx, client, &node)
+	}
+	return "", fmt.Errorf("unsupported operation %q", window.Operation)
+}
+
+// notifyUsers sends an event about the window to the users with an active assignment on
+// its nodes and records how many there were
+func (h *MaintenanceHandler) notifyUsers(ctx context.Context, event string, window *models.MaintenanceWindow) error {
+	entries := window.GetNodes()
+	nodeIDs := make([]uuid.UUID, 0, len(entries))
+	notice := maintenanceNotice{
+		ID:        window.ID,
+		Operation: window.Operation,
+		StartsAt:  window.StartsAt,
+		EndsAt:    window.EndsAt,
+		Reason:    window.Reason,
+	}
+	for _, entry := range entries {
+		nodeIDs = append(nodeIDs, entry.NodeID)
+		notice.Nodes = append(notice.Nodes, maintenanceNoticeNode{ID: entry.NodeID, Name: entry.NodeName})
+	}
+
+	var users []models.User
+	err := h.nodeHandler.db.Model(&models.User{}).
+		Distinct("users.id", "users.username", "users.email").
+		Joins("JOIN node_assignments ON node_assignments.user_id = users.id").
+		Where("node_assignments.node_id IN ? AND node_assignments.is_active = ? AND users.status = ?",
+			nodeIDs, true, models.UserStatusActive).
+		Find(&users).Error
+	if err != nil {
+		return fmt.Errorf("failed to get affected users: %w", err)
+	}
+	window.AffectedUsers = len(users)
+	if len(users) == 0 {
+		return nil
+	}
+
+	if h.config.NotifyURL == "" {
+		h.logger.Infof("Maintenance window %s: %s, %d user(s) affected (no notify_url configured)", window.ID, event, len(users))
+		return nil
+	}
+
+	notification := maintenanceNotification{Event: event, Window: notice}
+	for _, user := range users {
+		notification.Users = append(notification.Users, maintenanceRecipient{ID: user.ID, Username: user.Username, Email: user.Email})
+	}
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.config.NotifyURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.config.NotifyToken != "" {
+		req.Header.Set("Authorization", "Bearer "+h.config.NotifyToken)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("notify webhook failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("notify webhook returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	h.logger.Infof("Maintenance window %s: %s sent to %d user(s)", window.ID, event, len(users))
+	return nil
+}
+
+// outcome returns the final status of a window and its error
+func (h *MaintenanceHandler) outcome(nodes []models.MaintenanceNode) (string, string) {
+	failed := 0
+	for _, node := range nodes {
+		if node.Status == models.MaintenanceNodeFailed {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return models.MaintenanceStatusFailed, fmt.Sprintf("%d of %d node(s) failed", failed, len(nodes))
+	}
+	return models.MaintenanceStatusCompleted, ""
+}
+
+func (h *MaintenanceHandler) saveNodes(window *models.MaintenanceWindow, nodes []models.MaintenanceNode) {
+	if err := window.SetNodes(nodes); err != nil {
+		h.logger.Errorf("Failed to encode maintenance window %s progress: %v", window.ID, err)
+		return
+	}
+	if err := h.nodeHandler.db.Model(&models.MaintenanceWindow{}).Where("id = ?", window.ID).
+		Update("nodes", window.Nodes).Error; err != nil {
+		h.logger.Errorf("Failed to save maintenance window %s progress: %v", window.ID, err)
+	}
+}
+
+func (h *MaintenanceHandler) finish(window *models.MaintenanceWindow, status, message string) {
+	now := time.Now()
+	err := h.nodeHandler.db.Model(&models.MaintenanceWindow{}).
+		Where("id = ? AND status = ?", window.ID, models.MaintenanceStatusRunning).
+		Updates(map[string]interface{}{"status": status, "error": message, "finished_at": now}).Error
+	if err != nil {
+		h.logger.Errorf("Failed to finish maintenance window %s: %v", window.ID, err)
+	}
+
+	if status == models.MaintenanceStatusCompleted {
+		h.logger.Infof("Maintenance window %s (%s) completed", window.ID, window.Operation)
+	} else {
+		h.logger.Errorf("Maintenance window %s (%s) %s: %s", window.ID, window.Operation, status, message)
+	}
+}
+
+func (h *MaintenanceHandler) cancelled(id uuid.UUID) bool {
+	var window models.MaintenanceWindow
+	if err := h.nodeHandler.db.Select("status").First(&window, "id = ?", id).Error; err != nil {
+		h.logger.Errorf("Failed to get maintenance window %s: %v", id, err)
+		return true
+	}
+	return window.Status == models.MaintenanceStatusCancelled
+}
+
+func windowHasNode(window *models.MaintenanceWindow, nodeID string) bool {
+	for _, node := range window.GetNodes() {
+		if node.NodeID.String() == strings.ToLower(nodeID) {
+			return true
+		}
+	}
+	return false
+}
+
+func maintenanceWindowToProto(window *models.MaintenanceWindow) *pb.MaintenanceWindow {
+	result := &pb.MaintenanceWindow{
+		Id:            window.ID.String(),
+		Operation:     window.Operation,
+		Service:       window.Service,
+		StartsAt:      window.StartsAt.Unix(),
+		EndsAt:        window.EndsAt.Unix(),
+		Drain:         window.Drain,
+		Status:        window.Status,
+		Reason:        window.Reason,
+		Error:         window.Error,
+		AffectedUsers: int32(window.AffectedUsers),
+		CreatedAt:     window.CreatedAt.Unix(),
+	}
+	if window.NotifiedAt != nil {
+		result.NotifiedAt = window.NotifiedAt.Unix()
+	}
+	if window.StartedAt != nil {
+		result.StartedAt = window.StartedAt.Unix()
+	}
+	if window.FinishedAt != nil {
+		result.FinishedAt = window.FinishedAt.Unix()
+	}
+
+	for _, node := range window.GetNodes() {
+		entry := &pb.MaintenanceNode{
+			NodeId:   node.NodeID.String(),
+			NodeName: node.NodeName,
+			Status:   node.Status,
+			Message:  node.Message,
+		}
+		if node.FinishedAt != nil {
+			entry.FinishedAt = node.FinishedAt.Unix()
+		}
+		result.Nodes = append(result.Nodes, entry)
+	}
+	return result
+}
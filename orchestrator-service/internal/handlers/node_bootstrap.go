@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"hysteria2_microservices/orchestrator-service/internal/models"
+	"hysteria2_microservices/orchestrator-service/internal/provisioning"
+	pb "hysteria2_microservices/proto"
+)
+
+// defaultJoinTokenTTL is how long the join token of a bootstrap stays valid without
+// provisioning.join_token_ttl
+const defaultJoinTokenTTL = 24 * time.Hour
+
+// GetNodeBootstrap renders the cloud-init user data, and with a provider the Terraform
+// configuration, that install the agent on a new server and run it as the node. Both hold a
+// join token the server exchanges once, within join_token_ttl, for the node auth token.
+func (a *Autoscaler) GetNodeBootstrap(ctx context.Context, req *pb.GetNodeBootstrapRequest) (*pb.GetNodeBootstrapResponse, error) {
+	db := a.nodeHandler.db
+
+	var node models.VPSNode
+	if err := db.First(&node, "id = ?", req.NodeId).Error; err != nil {
+		return nil, fmt.Errorf("node not found: %w", err)
+	}
+
+	ttl := time.Duration(a.config.JoinTokenTTL) * time.Second
+	if ttl <= 0 {
+		ttl = defaultJoinTokenTTL
+	}
+	joinToken, err := a.joinTokens.Mint(&node.ID, nil, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	version := req.AgentVersion
+	if version == "" {
+		version = a.config.AgentVersion
+	}
+	userData, err := provisioning.UserData(provisioning.AgentBootstrap{
+		NodeID:       node.ID.String(),
+		NodeName:     node.Name,
+		Hostname:     node.Hostname,
+		Location:     node.Location,
+		Country:      node.Country,
+		MasterServer: a.config.MasterServer,
+		JoinURL:      a.config.JoinURL,
+		JoinToken:    joinToken,
+		AgentURL:     provisioning.AgentURL(a.config, version),
+		HelperURL:    provisioning.HelperURL(a.config, version),
+		Tunnel:       req.Tunnel,
+		SSHKeys:      a.config.SSHKeys,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to render user data: %w", err)
+	}
+
+	resp := &pb.GetNodeBootstrapResponse{
+		Success:      true,
+		Message:      "Node bootstrap rendered successfully",
+		CloudInit:    userData,
+		AgentVersion: version,
+	}
+
+	spec := provisioning.ServerSpec{
+		Name:     strings.ReplaceAll(node.Name, "_", "-"),
+		Region:   req.Region,
+		Size:     req.Size,
+		Image:    req.Image,
+		UserData: userData,
+		Tags:     []string{"hysteryvpn"},
+	}
+	provider := req.Provider
+	if node.NodeGroup != "" {
+		spec.Tags = append(spec.Tags, "hysteryvpn-"+strings.ReplaceAll(node.NodeGroup, "_", "-"))
+
+		var policy models.ScalingPolicy
+		err := db.First(&policy, "node_group = ?", node.NodeGroup).Error
+		switch {
+		case err == nil && (provider == "" || provider == policy.Provider):
+			provider = policy.Provider
+			spec.Region = firstNonEmpty(spec.Region, policy.Region)
+			spec.Size = firstNonEmpty(spec.Size, policy.Size)
+			spec.Image = firstNonEmpty(spec.Image, policy.Image)
+		case err != nil && !errors.Is(err, gorm.ErrRecordNotFound):
+			return nil, fmt.Errorf("failed to get scaling policy: %w", err)
+		}
+	}
+	if provider == "" {
+		return resp, nil
+	}
+
+	if resp.Terraform, err = provisioning.Terraform(provider, spec); err != nil {
+		return nil, fmt.Errorf("failed to render Terraform configuration: %w", err)
+	}
+	return resp, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -3,8 +3,12 @@ package handlers
 import (
 	"context"
 	"fmt"
+	"net"
+	"strings"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/emptypb"
 
 	"hysteria2_microservices/orchestrator-service/internal/models"
@@ -34,30 +38,68 @@ func (h *NodeConfigHandler) GetSNIConfig(ctx context.Context, nodeID string) (*m
 	return &node, nil
 }
 
-// UpdateSNIConfig updates SNI configuration for a node
+// UpdateSNIConfig updates SNI configuration for a node. Domains are normalized and must not
+// be used by another node; each gets a pre-flight DNS check returned in the response.
 func (h *NodeConfigHandler) UpdateSNIConfig(ctx context.Context, req *pb.UpdateSNIConfigRequest) (*pb.UpdateSNIConfigResponse, error) {
+	domains, err := normalizeSNIDomains(req.Domains)
+	if err != nil {
+		return nil, err
+	}
+	primaryDomain := ""
+	if req.PrimaryDomain != "" {
+		if primaryDomain, err = models.NormalizeSNIDomain(req.PrimaryDomain); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if !containsDomain(domains, primaryDomain) {
+			return nil, status.Errorf(codes.InvalidArgument, "primary domain %s is not one of the domains", primaryDomain)
+		}
+	}
+
 	// Get node from database
 	var node models.VPSNode
 	if err := h.nodeHandler.db.First(&node, "id = ?", req.NodeId).Error; err != nil {
 		return nil, fmt.Errorf("node not found: %w", err)
 	}
+	if err := h.checkSNIConflicts(req.NodeId, domains); err != nil {
+		return nil, err
+	}
+	checks := checkSNIDomainsDNS(ctx, domains, node.IPAddress)
 
 	// Update SNI fields
 	node.SNIEnabled = req.SniEnabled
-	node.PrimaryDomain = req.PrimaryDomain
+	node.PrimaryDomain = primaryDomain
 	node.SNIAutoRenew = req.AutoRenew
 	node.SNIEmail = req.Email
 
 	// Update SNI domains
-	node.SetSNIDomains(req.Domains)
+	node.SetSNIDomains(domains)
 
 	// Save to database
 	if err := h.nodeHandler.db.Save(&node).Error; err != nil {
 		return nil, fmt.Errorf("failed to update node: %w", err)
 	}
 
+	nodeChecks, err := h.pushSNIConfig(ctx, &node)
+	if err != nil {
+		return nil, err
+	}
+	// The node checks against all of its public addresses, IPv6 included
+	if len(nodeChecks) > 0 {
+		checks = nodeChecks
+	}
+
+	return &pb.UpdateSNIConfigResponse{
+		Success:   true,
+		Message:   "SNI configuration updated successfully",
+		DnsChecks: checks,
+	}, nil
+}
+
+// pushSNIConfig sends the node's stored SNI settings to its agent and returns the agent's
+// DNS checks of the domains
+func (h *NodeConfigHandler) pushSNIConfig(ctx context.Context, node *models.VPSNode) ([]*pb.SNIDomainCheck, error) {
 	// Connect to node via gRPC and update configuration
-	conn, err := h.nodeHandler.getNodeConnection(req.NodeId)
+	conn, err := h.nodeHandler.connect(node.ID.String())
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to node: %w", err)
 	}
@@ -67,35 +109,42 @@ func (h *NodeConfigHandler) UpdateSNIConfig(ctx context.Context, req *pb.UpdateS
 
 	// Generate and send new configuration with SNI
 	configUpdate := &pb.SNIConfigUpdateRequest{
-		Enabled:    req.SniEnabled,
-		Domains:    req.Domains,
-		DefaultSni: req.PrimaryDomain,
+		Enabled:    node.SNIEnabled,
+		Domains:    node.GetSNIDomains(),
+		DefaultSni: node.PrimaryDomain,
 		AutoMode:   true, // Always use auto mode for simplicity
 	}
 
-	_, err = client.UpdateSNIConfig(ctx, configUpdate)
+	resp, err := client.UpdateSNIConfig(ctx, configUpdate)
 	if err != nil {
 		return nil, fmt.Errorf("failed to update SNI config on node: %w", err)
 	}
-
-	return &pb.UpdateSNIConfigResponse{
-		Success: true,
-		Message: "SNI configuration updated successfully",
-	}, nil
+	return resp.DnsChecks, nil
 }
 
-// AddSNIDomain adds a new domain to node's SNI configuration
-func (h *NodeConfigHandler) AddSNIDomain(ctx context.Context, nodeID, domain string) error {
+// AddSNIDomain adds a new domain to node's SNI configuration and returns the pre-flight DNS
+// check of the domain
+func (h *NodeConfigHandler) AddSNIDomain(ctx context.Context, nodeID, domain string) (*pb.SNIDomainCheck, error) {
+	domain, err := models.NormalizeSNIDomain(domain)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
 	// Get node from database
 	var node models.VPSNode
 	if err := h.nodeHandler.db.First(&node, "id = ?", nodeID).Error; err != nil {
-		return fmt.Errorf("node not found: %w", err)
+		return nil, fmt.Errorf("node not found: %w", err)
 	}
 
 	// Check if domain already exists
 	if node.HasSNIDomain(domain) {
-		return fmt.Errorf("domain %s already exists", domain)
+		return nil, codedError(codes.AlreadyExists, pb.ErrorCode_ERROR_CODE_DOMAIN_CONFLICT,
+			map[string]string{"domain": domain, "node_id": nodeID}, "domain %s already exists", domain)
 	}
+	if err := h.checkSNIConflicts(nodeID, []string{domain}); err != nil {
+		return nil, err
+	}
+	check := checkSNIDomainDNS(ctx, domain, node.IPAddress)
 
 	// Add domain
 	node.AddSNIDomain(domain)
@@ -108,13 +157,13 @@ func (h *NodeConfigHandler) AddSNIDomain(ctx context.Context, nodeID, domain str
 
 	// Save to database
 	if err := h.nodeHandler.db.Save(&node).Error; err != nil {
-		return fmt.Errorf("failed to update node: %w", err)
+		return nil, fmt.Errorf("failed to update node: %w", err)
 	}
 
 	// Update configuration on node
-	conn, err := h.nodeHandler.getNodeConnection(nodeID)
+	conn, err := h.nodeHandler.connect(nodeID)
 	if err != nil {
-		return fmt.Errorf("failed to connect to node: %w", err)
+		return nil, fmt.Errorf("failed to connect to node: %w", err)
 	}
 	defer conn.Close()
 
@@ -124,23 +173,29 @@ func (h *NodeConfigHandler) AddSNIDomain(ctx context.Context, nodeID, domain str
 		Domain: domain,
 	})
 	if err != nil {
-		return fmt.Errorf("failed to add domain on node: %w", err)
+		return nil, fmt.Errorf("failed to add domain on node: %w", err)
 	}
 
-	return nil
+	return check, nil
 }
 
-// RemoveSNIDomain removes a domain from node's SNI configuration
-func (h *NodeConfigHandler) RemoveSNIDomain(ctx context.Context, nodeID, domain string) error {
+// RemoveSNIDomain removes a domain from node's SNI configuration and pushes the remaining
+// domains to the node
+func (h *NodeConfigHandler) RemoveSNIDomain(ctx context.Context, nodeID, domain string) (*models.VPSNode, error) {
+	domain, err := models.NormalizeSNIDomain(domain)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
 	// Get node from database
 	var node models.VPSNode
 	if err := h.nodeHandler.db.First(&node, "id = ?", nodeID).Error; err != nil {
-		return fmt.Errorf("node not found: %w", err)
+		return nil, fmt.Errorf("node not found: %w", err)
 	}
 
 	// Remove domain
 	if !node.HasSNIDomain(domain) {
-		return fmt.Errorf("domain %s not found", domain)
+		return nil, status.Errorf(codes.NotFound, "domain %s is not configured on node %s", domain, node.Name)
 	}
 
 	node.RemoveSNIDomain(domain)
@@ -158,26 +213,14 @@ func (h *NodeConfigHandler) RemoveSNIDomain(ctx context.Context, nodeID, domain
 
 	// Save to database
 	if err := h.nodeHandler.db.Save(&node).Error; err != nil {
-		return fmt.Errorf("failed to update node: %w", err)
+		return nil, fmt.Errorf("failed to update node: %w", err)
 	}
 
 	// Update configuration on node
-	conn, err := h.nodeHandler.getNodeConnection(nodeID)
-	if err != nil {
-		return fmt.Errorf("failed to connect to node: %w", err)
-	}
-	defer conn.Close()
-
-	client := pb.NewNodeManagerClient(conn)
-
-	_, err = client.RemoveSNIDomain(ctx, &pb.RemoveSNIDomainRequest{
-		Domain: domain,
-	})
-	if err != nil {
-		return fmt.Errorf("failed to remove domain on node: %w", err)
+	if _, err := h.pushSNIConfig(ctx, &node); err != nil {
+		return nil, err
 	}
-
-	return nil
+	return &node, nil
 }
 
 // GetSNIStatus retrieves SNI status for a node
@@ -189,7 +232,7 @@ func (h *NodeConfigHandler) GetSNIStatus(ctx context.Context, nodeID string) (*p
 	}
 
 	// Connect to node to get certificate status
-	conn, err := h.nodeHandler.getNodeConnection(nodeID)
+	conn, err := h.nodeHandler.connect(nodeID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to node: %w", err)
 	}
@@ -212,3 +255,788 @@ func (h *NodeConfigHandler) GetSNIStatus(ctx context.Context, nodeID string) (*p
 		ExpiringSoon:  statusResp.ExpiringSoon,
 	}, nil
 }
+
+// GetMasqueradeConfig retrieves Hysteria2 masquerade settings for a node
+func (h *NodeConfigHandler) GetMasqueradeConfig(ctx context.Context, nodeID string) (*models.MasqueradeSettings, error) {
+	// Get node from database
+	var node models.VPSNode
+	if err := h.nodeHandler.db.First(&node, "id = ?", nodeID).Error; err != nil {
+		return nil, fmt.Errorf("node not found: %w", err)
+	}
+
+	settings := node.GetMasquerade()
+	return &settings, nil
+}
+
+// UpdateMasqueradeConfig stores masquerade settings for a node and pushes them to the agent
+func (h *NodeConfigHandler) UpdateMasqueradeConfig(ctx context.Context, req *pb.ConfigureMasqueradeRequest) (*pb.ConfigureMasqueradeResponse, error) {
+	if req.Masquerade == nil {
+		return nil, fmt.Errorf("masquerade configuration is required")
+	}
+
+	settings := models.MasqueradeSettings{
+		Type:          req.Masquerade.Type,
+		ProxyURL:      req.Masquerade.ProxyUrl,
+		RewriteHost:   req.Masquerade.RewriteHost,
+		FileDir:       req.Masquerade.FileDir,
+		StringContent: req.Masquerade.StringContent,
+		StringStatus:  int(req.Masquerade.StringStatus),
+		StringHeaders: req.Masquerade.StringHeaders,
+	}
+
+	switch settings.Type {
+	case models.MasqueradeTypeProxy:
+		if settings.ProxyURL == "" {
+			return nil, fmt.Errorf("proxy URL is required for proxy masquerade")
+		}
+	case models.MasqueradeTypeFile:
+		if settings.FileDir == "" {
+			return nil, fmt.Errorf("directory is required for file masquerade")
+		}
+	case models.MasqueradeTypeString:
+	default:
+		return nil, fmt.Errorf("unsupported masquerade type %q", settings.Type)
+	}
+
+	// Get node from database
+	var node models.VPSNode
+	if err := h.nodeHandler.db.First(&node, "id = ?", req.NodeId).Error; err != nil {
+		return nil, fmt.Errorf("node not found: %w", err)
+	}
+
+	if err := node.SetMasquerade(settings); err != nil {
+		return nil, fmt.Errorf("failed to encode masquerade settings: %w", err)
+	}
+
+	// Save to database
+	if err := h.nodeHandler.db.Save(&node).Error; err != nil {
+		return nil, fmt.Errorf("failed to update node: %w", err)
+	}
+
+	// Push configuration to node
+	conn, err := h.nodeHandler.connect(req.NodeId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to node: %w", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewNodeManagerClient(conn)
+
+	resp, err := client.ConfigureMasquerade(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure masquerade on node: %w", err)
+	}
+	if !resp.Success {
+		return nil, fmt.Errorf("node rejected masquerade configuration: %s", resp.Message)
+	}
+
+	return &pb.ConfigureMasqueradeResponse{
+		Success: true,
+		Message: "Masquerade configuration updated successfully",
+	}, nil
+}
+
+// GetCertificateMode retrieves how a node's Hysteria2 server gets its certificate, without
+// the DNS provider credentials
+func (h *NodeConfigHandler) GetCertificateMode(ctx context.Context, nodeID string) (*models.CertificateModeSettings, error) {
+	// Get node from database
+	var node models.VPSNode
+	if err := h.nodeHandler.db.First(&node, "id = ?", nodeID).Error; err != nil {
+		return nil, fmt.Errorf("node not found: %w", err)
+	}
+
+	settings, _ := node.GetCertificateMode()
+	settings = settings.Redacted()
+	return &settings, nil
+}
+
+// UpdateCertificateMode pushes a certificate mode to a node and stores it once the agent
+// has regenerated its config with it
+func (h *NodeConfigHandler) UpdateCertificateMode(ctx context.Context, req *pb.ConfigureCertificateModeRequest) (*pb.ConfigureCertificateModeResponse, error) {
+	if req.Mode == nil {
+		return nil, fmt.Errorf("certificate mode is required")
+	}
+
+	settings := certificateModeFromProto(req.Mode)
+	if err := settings.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid certificate mode: %w", err)
+	}
+
+	// Get node from database
+	var node models.VPSNode
+	if err := h.nodeHandler.db.First(&node, "id = ?", req.NodeId).Error; err != nil {
+		return nil, fmt.Errorf("node not found: %w", err)
+	}
+	if settings.Mode == models.CertificateModeACME && nodeCapability(&node, "hysteria2_acme") != "true" {
+		return nil, fmt.Errorf("agent of node %s cannot configure ACME", node.Name)
+	}
+
+	conn, err := h.nodeHandler.connect(req.NodeId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to node: %w", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewNodeManagerClient(conn)
+
+	resp, err := client.ConfigureCertificateMode(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure certificate mode on node: %w", err)
+	}
+	if !resp.Success {
+		return nil, fmt.Errorf("node rejected certificate mode: %s", resp.Message)
+	}
+
+	if err := node.SetCertificateMode(settings); err != nil {
+		return nil, fmt.Errorf("failed to encode certificate mode: %w", err)
+	}
+
+	// Save to database
+	if err := h.nodeHandler.db.Save(&node).Error; err != nil {
+		return nil, fmt.Errorf("failed to update node: %w", err)
+	}
+	return resp, nil
+}
+
+// GetACMEStatus returns the certificates a node's Hysteria2 server obtained through ACME.
+// When the node cannot report them, only the stored mode is returned.
+func (h *NodeConfigHandler) GetACMEStatus(ctx context.Context, req *pb.GetACMEStatusRequest) (*pb.GetACMEStatusResponse, error) {
+	var node models.VPSNode
+	if err := h.nodeHandler.db.First(&node, "id = ?", req.NodeId).Error; err != nil {
+		return nil, fmt.Errorf("node not found: %w", err)
+	}
+
+	if !node.IsOnline() || nodeCapability(&node, "hysteria2_acme") != "true" {
+		settings, _ := node.GetCertificateMode()
+		return &pb.GetACMEStatusResponse{
+			Success: true,
+			Message: fmt.Sprintf("Node %s cannot report its ACME certificates", node.Name),
+			Mode:    certificateModeToProto(settings.Redacted()),
+		}, nil
+	}
+
+	conn, err := h.nodeHandler.connect(req.NodeId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to node: %w", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewNodeManagerClient(conn)
+
+	resp, err := client.GetACMEStatus(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ACME status: %w", err)
+	}
+	return resp, nil
+}
+
+// RenewCertificates has the node renew its certificates now instead of waiting for the
+// renewal window
+func (h *NodeConfigHandler) RenewCertificates(ctx context.Context, req *pb.RenewCertificatesRequest) (*pb.RenewCertificatesResponse, error) {
+	var node models.VPSNode
+	if err := h.nodeHandler.db.First(&node, "id = ?", req.NodeId).Error; err != nil {
+		return nil, fmt.Errorf("node not found: %w", err)
+	}
+	if !node.IsOnline() {
+		return nil, status.Errorf(codes.Unavailable, "node %s is offline", node.Name)
+	}
+
+	conn, err := h.nodeHandler.connect(req.NodeId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to node: %w", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewNodeManagerClient(conn)
+
+	resp, err := client.RenewCertificates(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to renew certificates on node: %w", err)
+	}
+	return resp, nil
+}
+
+// GetProtocolMatrix retrieves which protocols are enabled on a node
+func (h *NodeConfigHandler) GetProtocolMatrix(ctx context.Context, nodeID string) (map[string]bool, error) {
+	// Get node from database
+	var node models.VPSNode
+	if err := h.nodeHandler.db.First(&node, "id = ?", nodeID).Error; err != nil {
+		return nil, fmt.Errorf("node not found: %w", err)
+	}
+
+	return node.GetProtocols(), nil
+}
+
+// UpdateProtocolMatrix enables or disables protocols on a node. The agent reconciles its
+// running services first; the matrix is only stored once the node has applied it.
+func (h *NodeConfigHandler) UpdateProtocolMatrix(ctx context.Context, req *pb.SetNodeProtocolsRequest) (*pb.SetNodeProtocolsResponse, error) {
+	if len(req.Protocols) == 0 {
+		return nil, fmt.Errorf("at least one protocol must be specified")
+	}
+	for protocol := range req.Protocols {
+		if !models.IsSupportedProtocol(protocol) {
+			return nil, fmt.Errorf("unsupported protocol %q", protocol)
+		}
+	}
+
+	// Get node from database
+	var node models.VPSNode
+	if err := h.nodeHandler.db.First(&node, "id = ?", req.NodeId).Error; err != nil {
+		return nil, fmt.Errorf("node not found: %w", err)
+	}
+
+	protocols := node.GetProtocols()
+	for protocol, enabled := range req.Protocols {
+		protocols[protocol] = enabled
+	}
+
+	// Push the full matrix so the agent converges even if it missed earlier updates
+	conn, err := h.nodeHandler.connect(req.NodeId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to node: %w", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewNodeManagerClient(conn)
+
+	resp, err := client.SetNodeProtocols(ctx, &pb.SetNodeProtocolsRequest{
+		NodeId:    req.NodeId,
+		Protocols: protocols,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to apply protocols on node: %w", err)
+	}
+	if !resp.Success {
+		return nil, fmt.Errorf("node failed to apply protocols: %s", resp.Message)
+	}
+
+	node.SetProtocols(protocols)
+
+	// Save to database
+	if err := h.nodeHandler.db.Save(&node).Error; err != nil {
+		return nil, fmt.Errorf("failed to update node: %w", err)
+	}
+
+	return &pb.SetNodeProtocolsResponse{
+		Success:   true,
+		Message:   "Node protocols updated successfully",
+		Protocols: protocols,
+		Results:   resp.Results,
+	}, nil
+}
+
+// GetDNSPolicy retrieves a node's resolver policy, or nil while the node uses its agent defaults
+func (h *NodeConfigHandler) GetDNSPolicy(ctx context.Context, nodeID string) (*models.DNSPolicy, error) {
+	// Get node from database
+	var node models.VPSNode
+	if err := h.nodeHandler.db.First(&node, "id = ?", nodeID).Error; err != nil {
+		return nil, fmt.Errorf("node not found: %w", err)
+	}
+
+	policy, ok := node.GetDNSPolicy()
+	if !ok {
+		return nil, nil
+	}
+	return &policy, nil
+}
+
+// UpdateDNSPolicy pushes a resolver policy to one node, or to every node in a country.
+// Each node stores the policy only after its agent has applied it; nodes that fail are
+// reported in Failures and keep their previous policy.
+func (h *NodeConfigHandler) UpdateDNSPolicy(ctx context.Context, req *pb.SetDNSPolicyRequest) (*pb.SetDNSPolicyResponse, error) {
+	if req.Policy == nil {
+		return nil, fmt.Errorf("DNS policy is required")
+	}
+	if (req.NodeId == "") == (req.Country == "") {
+		return nil, fmt.Errorf("exactly one of node_id or country must be specified")
+	}
+
+	policy := models.DNSPolicy{
+		Upstreams: req.Policy.Upstreams,
+		ViaWARP:   req.Policy.ViaWarp,
+	}
+	for _, rule := range req.Policy.Rules {
+		policy.Rules = append(policy.Rules, models.DNSRule{
+			Domains:   rule.Domains,
+			Upstreams: rule.Upstreams,
+			Route:     rule.Route,
+		})
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid DNS policy: %w", err)
+	}
+
+	// Get nodes from database
+	var nodes []models.VPSNode
+	query := h.nodeHandler.db
+	if req.NodeId != "" {
+		query = query.Where("id = ?", req.NodeId)
+	} else {
+		query = query.Where("country = ?", strings.ToUpper(req.Country))
+	}
+	if err := query.Find(&nodes).Error; err != nil {
+		return nil, fmt.Errorf("failed to get nodes: %w", err)
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no nodes found")
+	}
+
+	resp := &pb.SetDNSPolicyResponse{Failures: make(map[string]string)}
+	for i := range nodes {
+		node := &nodes[i]
+		nodeID := node.ID.String()
+
+		if err := h.pushDNSPolicy(ctx, nodeID, req.Policy); err != nil {
+			resp.Failures[nodeID] = err.Error()
+			continue
+		}
+
+		if err := node.SetDNSPolicy(policy); err != nil {
+			resp.Failures[nodeID] = fmt.Sprintf("failed to encode DNS policy: %v", err)
+			continue
+		}
+
+		// Save to database
+		if err := h.nodeHandler.db.Save(node).Error; err != nil {
+			resp.Failures[nodeID] = fmt.Sprintf("failed to update node: %v", err)
+			continue
+		}
+		resp.NodeIds = append(resp.NodeIds, nodeID)
+	}
+
+	resp.Success = len(resp.Failures) == 0
+	if resp.Success {
+		resp.Message = fmt.Sprintf("DNS policy applied to %d node(s)", len(resp.NodeIds))
+	} else {
+		resp.Message = fmt.Sprintf("DNS policy applied to %d of %d node(s)", len(resp.NodeIds), len(nodes))
+	}
+	return resp, nil
+}
+
+func (h *NodeConfigHandler) pushDNSPolicy(ctx context.Context, nodeID string, policy *pb.DNSPolicy) error {
+	conn, err := h.nodeHandler.connect(nodeID)
+	if err != nil {
+		return fmt.Errorf("failed to connect to node: %w", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewNodeManagerClient(conn)
+
+	resp, err := client.SetDNSPolicy(ctx, &pb.SetDNSPolicyRequest{
+		NodeId: nodeID,
+		Policy: policy,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to apply DNS policy on node: %w", err)
+	}
+	if !resp.Success {
+		return fmt.Errorf("node rejected DNS policy: %s", resp.Message)
+	}
+	return nil
+}
+
+// UpdateQoSPolicy pushes a queueing policy to a node and stores it once the agent has
+// applied it. The response carries the latency the agent measured before and after.
+func (h *NodeConfigHandler) UpdateQoSPolicy(ctx context.Context, req *pb.SetQoSPolicyRequest) (*pb.SetQoSPolicyResponse, error) {
+	if req.Policy == nil {
+		return nil, fmt.Errorf("QoS policy is required")
+	}
+
+	policy := qosPolicyFromProto(req.Policy)
+	if err := policy.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid QoS policy: %w", err)
+	}
+
+	// Get node from database
+	var node models.VPSNode
+	if err := h.nodeHandler.db.First(&node, "id = ?", req.NodeId).Error; err != nil {
+		return nil, fmt.Errorf("node not found: %w", err)
+	}
+	if nodeCapability(&node, "qos") != "true" {
+		return nil, fmt.Errorf("agent of node %s cannot apply QoS policies", node.Name)
+	}
+
+	conn, err := h.nodeHandler.connect(req.NodeId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to node: %w", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewNodeManagerClient(conn)
+
+	resp, err := client.SetQoSPolicy(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to apply QoS policy on node: %w", err)
+	}
+	if !resp.Success {
+		return nil, fmt.Errorf("node rejected QoS policy: %s", resp.Message)
+	}
+
+	if err := node.SetQoSPolicy(policy); err != nil {
+		return nil, fmt.Errorf("failed to encode QoS policy: %w", err)
+	}
+
+	// Save to database
+	if err := h.nodeHandler.db.Save(&node).Error; err != nil {
+		return nil, fmt.Errorf("failed to update node: %w", err)
+	}
+	return resp, nil
+}
+
+// GetQoSStatus returns the queueing policy in force on a node and its latency measurements,
+// or only the stored policy while the node cannot be asked
+func (h *NodeConfigHandler) GetQoSStatus(ctx context.Context, req *pb.GetQoSStatusRequest) (*pb.GetQoSStatusResponse, error) {
+	var node models.VPSNode
+	if err := h.nodeHandler.db.First(&node, "id = ?", req.NodeId).Error; err != nil {
+		return nil, fmt.Errorf("node not found: %w", err)
+	}
+
+	if !node.IsOnline() || nodeCapability(&node, "qos") != "true" {
+		resp := &pb.GetQoSStatusResponse{
+			Success: true,
+			Message: fmt.Sprintf("Node %s cannot report its QoS status", node.Name),
+		}
+		if policy, ok := node.GetQoSPolicy(); ok {
+			resp.Policy = qosPolicyToProto(policy)
+		}
+		return resp, nil
+	}
+
+	conn, err := h.nodeHandler.connect(req.NodeId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to node: %w", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewNodeManagerClient(conn)
+
+	resp, err := client.GetQoSStatus(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get QoS status: %w", err)
+	}
+	return resp, nil
+}
+
+// GetFirewallRules retrieves the firewall ruleset in force on a node
+func (h *NodeConfigHandler) GetFirewallRules(ctx context.Context, req *pb.GetFirewallRulesRequest) (*pb.GetFirewallRulesResponse, error) {
+	conn, err := h.nodeHandler.connect(req.NodeId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to node: %w", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewNodeManagerClient(conn)
+
+	resp, err := client.GetFirewallRules(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get firewall rules from node: %w", err)
+	}
+	return resp, nil
+}
+
+// ApplyFirewallRules installs the default-deny baseline plus the given rules on a node
+func (h *NodeConfigHandler) ApplyFirewallRules(ctx context.Context, req *pb.ApplyFirewallRulesRequest) (*pb.ApplyFirewallRulesResponse, error) {
+	for i, rule := range req.Rules {
+		if rule.Protocol != "tcp" && rule.Protocol != "udp" {
+			return nil, fmt.Errorf("rule %d: protocol must be tcp or udp", i+1)
+		}
+		if rule.Ports == "" {
+			return nil, fmt.Errorf("rule %d: ports are required", i+1)
+		}
+	}
+
+	conn, err := h.nodeHandler.connect(req.NodeId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to node: %w", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewNodeManagerClient(conn)
+
+	resp, err := client.ApplyFirewallRules(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to apply firewall rules on node: %w", err)
+	}
+	if !resp.Success {
+		return nil, fmt.Errorf("node rejected firewall rules: %s", resp.Message)
+	}
+	return resp, nil
+}
+
+// RestoreFirewallRules rolls a node's firewall back to the ruleset in force before the last apply
+func (h *NodeConfigHandler) RestoreFirewallRules(ctx context.Context, req *pb.RestoreFirewallRulesRequest) (*pb.RestoreFirewallRulesResponse, error) {
+	conn, err := h.nodeHandler.connect(req.NodeId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to node: %w", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewNodeManagerClient(conn)
+
+	resp, err := client.RestoreFirewallRules(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore firewall rules on node: %w", err)
+	}
+	if !resp.Success {
+		return nil, fmt.Errorf("node failed to restore firewall rules: %s", resp.Message)
+	}
+	return resp, nil
+}
+
+// ListBans retrieves the addresses a node's brute-force guard has banned
+func (h *NodeConfigHandler) ListBans(ctx context.Context, req *pb.ListBansRequest) (*pb.ListBansResponse, error) {
+	conn, err := h.nodeHandler.connect(req.NodeId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to node: %w", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewNodeManagerClient(conn)
+
+	resp, err := client.ListBans(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list bans on node: %w", err)
+	}
+	return resp, nil
+}
+
+// UnbanIP lifts a brute-force ban on a node
+func (h *NodeConfigHandler) UnbanIP(ctx context.Context, req *pb.UnbanIPRequest) (*pb.UnbanIPResponse, error) {
+	if net.ParseIP(req.Ip) == nil {
+		return nil, fmt.Errorf("invalid IP address: %s", req.Ip)
+	}
+
+	conn, err := h.nodeHandler.connect(req.NodeId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to node: %w", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewNodeManagerClient(conn)
+
+	resp, err := client.UnbanIP(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unban IP on node: %w", err)
+	}
+	if !resp.Success {
+		return nil, fmt.Errorf("node failed to unban IP: %s", resp.Message)
+	}
+	return resp, nil
+}
+
+// pushStoredConfig applies the protocol matrix, masquerade, certificate mode, obfuscation,
+// DNS, QoS and outbound policy stored for a node again, so the agent converges on them after
+// drifting or losing its state
+func pushStoredConfig(ctx context.Context, client pb.NodeManagerClient, node *models.VPSNode) (string, error) {
+	nodeID := node.ID.String()
+
+	var pushed []string
+	if len(node.Protocols) > 0 {
+		resp, err := client.SetNodeProtocols(ctx, &pb.SetNodeProtocolsRequest{NodeId: nodeID, Protocols: node.GetProtocols()})
+		if err != nil {
+			return "", fmt.Errorf("failed to apply protocols on node: %w", err)
+		}
+		if !resp.Success {
+			return "", fmt.Errorf("node failed to apply protocols: %s", resp.Message)
+		}
+		pushed = append(pushed, "protocols")
+	}
+	if len(node.Masquerade) > 0 {
+		resp, err := client.ConfigureMasquerade(ctx, &pb.ConfigureMasqueradeRequest{
+			NodeId:     nodeID,
+			Masquerade: masqueradeToProto(node.GetMasquerade()),
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to configure masquerade on node: %w", err)
+		}
+		if !resp.Success {
+			return "", fmt.Errorf("node rejected masquerade configuration: %s", resp.Message)
+		}
+		pushed = append(pushed, "masquerade")
+	}
+	if settings, ok := node.GetCertificateMode(); ok {
+		resp, err := client.ConfigureCertificateMode(ctx, &pb.ConfigureCertificateModeRequest{
+			NodeId: nodeID,
+			Mode:   certificateModeToProto(settings),
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to configure certificate mode on node: %w", err)
+		}
+		if !resp.Success {
+			return "", fmt.Errorf("node rejected certificate mode: %s", resp.Message)
+		}
+		pushed = append(pushed, "certificate mode")
+	}
+	if settings, ok := node.GetObfuscation(); ok && nodeCapability(node, "obfuscation") == "true" {
+		resp, err := client.ApplyObfuscation(ctx, &pb.ApplyObfuscationRequest{
+			NodeId:   nodeID,
+			Preset:   node.ObfuscationPreset,
+			Settings: obfuscationSettingsToProto(settings),
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to apply obfuscation on node: %w", err)
+		}
+		if !resp.Success {
+			return "", fmt.Errorf("node rejected obfuscation settings: %s", resp.Message)
+		}
+		pushed = append(pushed, "obfuscation")
+	}
+	if policy, ok := node.GetDNSPolicy(); ok {
+		resp, err := client.SetDNSPolicy(ctx, &pb.SetDNSPolicyRequest{NodeId: nodeID, Policy: dnsPolicyToProto(policy)})
+		if err != nil {
+			return "", fmt.Errorf("failed to apply DNS policy on node: %w", err)
+		}
+		if !resp.Success {
+			return "", fmt.Errorf("node rejected DNS policy: %s", resp.Message)
+		}
+		pushed = append(pushed, "DNS policy")
+	}
+	if policy, ok := node.GetQoSPolicy(); ok && nodeCapability(node, "qos") == "true" {
+		resp, err := client.SetQoSPolicy(ctx, &pb.SetQoSPolicyRequest{NodeId: nodeID, Policy: qosPolicyToProto(policy)})
+		if err != nil {
+			return "", fmt.Errorf("failed to apply QoS policy on node: %w", err)
+		}
+		if !resp.Success {
+			return "", fmt.Errorf("node rejected QoS policy: %s", resp.Message)
+		}
+		pushed = append(pushed, "QoS policy")
+	}
+	if policy, ok := node.GetOutboundPolicy(); ok && nodeCapability(node, "outbound_policy") == "true" {
+		resp, err := client.SetOutboundPolicy(ctx, &pb.SetOutboundPolicyRequest{NodeId: nodeID, Policy: outboundPolicyToProto(policy)})
+		if err != nil {
+			return "", fmt.Errorf("failed to apply outbound policy on node: %w", err)
+		}
+		if !resp.Success {
+			return "", fmt.Errorf("node rejected outbound policy: %s", resp.Message)
+		}
+		pushed = append(pushed, "outbound policy")
+	}
+
+	if len(pushed) == 0 {
+		return "no stored configuration to push", nil
+	}
+	return fmt.Sprintf("pushed %s", strings.Join(pushed, ", ")), nil
+}
+
+func masqueradeToProto(settings models.MasqueradeSettings) *pb.MasqueradeConfig {
+	return &pb.MasqueradeConfig{
+		Type:          settings.Type,
+		ProxyUrl:      settings.ProxyURL,
+		RewriteHost:   settings.RewriteHost,
+		FileDir:       settings.FileDir,
+		StringContent: settings.StringContent,
+		StringStatus:  int32(settings.StringStatus),
+		StringHeaders: settings.StringHeaders,
+	}
+}
+
+func certificateModeToProto(settings models.CertificateModeSettings) *pb.CertificateMode {
+	return &pb.CertificateMode{
+		Mode:        settings.Mode,
+		Domains:     settings.Domains,
+		Email:       settings.Email,
+		Ca:          settings.CA,
+		Challenge:   settings.Challenge,
+		ListenHost:  settings.ListenHost,
+		AltPort:     int32(settings.AltPort),
+		DnsProvider: settings.DNSProvider,
+		DnsConfig:   settings.DNSConfig,
+	}
+}
+
+func certificateModeFromProto(mode *pb.CertificateMode) models.CertificateModeSettings {
+	return models.CertificateModeSettings{
+		Mode:        mode.Mode,
+		Domains:     mode.Domains,
+		Email:       mode.Email,
+		CA:          mode.Ca,
+		Challenge:   mode.Challenge,
+		ListenHost:  mode.ListenHost,
+		AltPort:     int(mode.AltPort),
+		DNSProvider: mode.DnsProvider,
+		DNSConfig:   mode.DnsConfig,
+	}
+}
+
+func obfuscationSettingsToProto(settings models.ObfuscationSettings) *pb.ObfuscationSettings {
+	return &pb.ObfuscationSettings{
+		Salamander:         settings.Salamander,
+		SalamanderPassword: settings.SalamanderPassword,
+		PortHopping:        settings.PortHopping,
+		HopStartPort:       int32(settings.HopStartPort),
+		HopEndPort:         int32(settings.HopEndPort),
+		HopInterval:        int32(settings.HopInterval),
+		QuicObfuscation:    settings.QUICObfuscation,
+		PacketPadding:      int32(settings.PacketPadding),
+		TimingJitterMs:     int32(settings.TimingJitterMs),
+		Fingerprints:       settings.Fingerprints,
+		RealityTargets:     settings.RealityTargets,
+		TrafficShaping:     settings.TrafficShaping,
+	}
+}
+
+func obfuscationSettingsFromProto(settings *pb.ObfuscationSettings) models.ObfuscationSettings {
+	return models.ObfuscationSettings{
+		Salamander:         settings.Salamander,
+		SalamanderPassword: settings.SalamanderPassword,
+		PortHopping:        settings.PortHopping,
+		HopStartPort:       int(settings.HopStartPort),
+		HopEndPort:         int(settings.HopEndPort),
+		HopInterval:        int(settings.HopInterval),
+		QUICObfuscation:    settings.QuicObfuscation,
+		PacketPadding:      int(settings.PacketPadding),
+		TimingJitterMs:     int(settings.TimingJitterMs),
+		Fingerprints:       settings.Fingerprints,
+		RealityTargets:     settings.RealityTargets,
+		TrafficShaping:     settings.TrafficShaping,
+	}
+}
+
+func dnsPolicyToProto(policy models.DNSPolicy) *pb.DNSPolicy {
+	result := &pb.DNSPolicy{
+		Upstreams: policy.Upstreams,
+		ViaWarp:   policy.ViaWARP,
+	}
+	for _, rule := range policy.Rules {
+		result.Rules = append(result.Rules, &pb.DNSRule{
+			Domains:   rule.Domains,
+			Upstreams: rule.Upstreams,
+			Route:     rule.Route,
+		})
+	}
+	return result
+}
+
+func qosPolicyToProto(policy models.QoSPolicy) *pb.QoSPolicy {
+	result := &pb.QoSPolicy{
+		Enabled:       policy.Enabled,
+		Qdisc:         policy.Qdisc,
+		BandwidthMbps: int32(policy.BandwidthMbps),
+	}
+	for _, class := range policy.Classes {
+		result.Classes = append(result.Classes, &pb.QoSClass{
+			Name:     class.Name,
+			Protocol: class.Protocol,
+			Ports:    class.Ports,
+			Dscp:     class.DSCP,
+		})
+	}
+	return result
+}
+
+func qosPolicyFromProto(policy *pb.QoSPolicy) models.QoSPolicy {
+	result := models.QoSPolicy{
+		Enabled:       policy.Enabled,
+		Qdisc:         strings.ToLower(policy.Qdisc),
+		BandwidthMbps: int(policy.BandwidthMbps),
+	}
+	for _, class := range policy.Classes {
+		result.Classes = append(result.Classes, models.QoSClass{
+			Name:     class.Name,
+			Protocol: strings.ToLower(class.Protocol),
+			Ports:    class.Ports,
+			DSCP:     strings.ToUpper(class.Dscp),
+		})
+	}
+	return result
+}
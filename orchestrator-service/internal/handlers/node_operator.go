@@ -0,0 +1,289 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+
+	"hysteria2_microservices/orchestrator-service/internal/config"
+	"hysteria2_microservices/orchestrator-service/internal/kubernetes"
+	"hysteria2_microservices/orchestrator-service/internal/models"
+)
+
+const (
+	defaultOperatorResync = 5 * time.Minute
+	operatorRetryDelay    = 10 * time.Second
+
+	// metadataVPNNode is the node metadata key holding the namespace/name of the VPNNode a
+	// node is mirrored from
+	metadataVPNNode = "vpnnode"
+)
+
+// VPNNodeResource is the vpnnodes.hysteryvpn.io custom resource
+var VPNNodeResource = kubernetes.Resource{Group: "hysteryvpn.io", Version: "v1alpha1", Plural: "vpnnodes"}
+
+// vpnNodeSpec is the desired state of a node
+type vpnNodeSpec struct {
+	Name      string `json:"name"` // defaults to the resource name
+	Hostname  string `json:"hostname"`
+	IPAddress string `json:"ipAddress"`
+	Location  string `json:"location"`
+	Country   string `json:"country"`
+	GRPCPort  int    `json:"grpcPort"`
+	NodeGroup string `json:"nodeGroup"`
+	Capacity  *struct {
+		MaxUsers       int `json:"maxUsers"`
+		MaxConnections int `json:"maxConnections"`
+		MaxMbps        int `json:"maxMbps"`
+	} `json:"capacity"`
+}
+
+// vpnNodeStatus reports the mirrored node back on the resource
+type vpnNodeStatus struct {
+	NodeID             string `json:"nodeId"`
+	Phase              string `json:"phase"` // the node's status: offline, online, maintenance or error
+	LastHeartbeat      string `json:"lastHeartbeat"`
+	ObservedGeneration int64  `json:"observedGeneration"`
+	Message            string `json:"message"` // why the spec could not be applied
+}
+
+// NodeOperator mirrors VPNNode resources into the node table: creating a resource adds the
+// node, changing its spec updates the node and deleting it removes the node. Nodes not
+// created from a resource are left alone. The resource's status follows the node, refreshed
+// on every change and full resync.
+type NodeOperator struct {
+	leadership
+	nodeHandler *NodeHandler
+	client      *kubernetes.Client
+	namespace   string
+	resync      time.Duration
+	logger      *logrus.Logger
+}
+
+// NewNodeOperator creates a new NodeOperator watching the namespace of cfg
+func NewNodeOperator(nodeHandler *NodeHandler, client *kubernetes.Client, cfg config.KubernetesConfig, logger *logrus.Logger) *NodeOperator {
+	namespace := cfg.Namespace
+	switch namespace {
+	case "":
+		namespace = kubernetes.Namespace()
+	case "*":
+		namespace = ""
+	}
+	resync := time.Duration(cfg.Resync) * time.Second
+	if resync <= 0 {
+		resync = defaultOperatorResync
+	}
+	return &NodeOperator{
+		nodeHandler: nodeHandler,
+		client:      client,
+		namespace:   namespace,
+		resync:      resync,
+		logger:      logger,
+	}
+}
+
+// Start reconciles the resources until ctx is cancelled, while this replica leads
+func (o *NodeOperator) Start(ctx context.Context) {
+	go func() {
+		for ctx.Err() == nil {
+			delay := operatorRetryDelay
+			if o.leading() {
+				if err := o.run(ctx); err != nil && ctx.Err() == nil {
+					o.logger.Errorf("VPNNode operator: %v", err)
+				} else {
+					delay = 0
+				}
+			}
+
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	scope := o.namespace
+	if scope == "" {
+		scope = "all namespaces"
+	}
+	o.logger.Infof("Mirroring VPNNode resources of %s into nodes", scope)
+}
+
+// run reconciles every resource, then applies changes as they are watched until the next
+// resync
+func (o *NodeOperator) run(ctx context.Context) error {
+	list, err := o.client.List(ctx, VPNNodeResource, o.namespace)
+	if err != nil {
+		return fmt.Errorf("failed to list VPNNodes: %w", err)
+	}
+
+	keys := make(map[string]bool, len(list.Items))
+	for i := range list.Items {
+		keys[list.Items[i].Key()] = true
+		o.reconcile(ctx, &list.Items[i])
+	}
+	if err := o.prune(keys); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, o.resync)
+	defer cancel()
+
+	err = o.client.Watch(ctx, VPNNodeResource, o.namespace, list.Metadata.ResourceVersion, func(event kubernetes.Event) error {
+		if !o.leading() {
+			return errLostLeadership
+		}
+		switch event.Type {
+		case kubernetes.EventAdded, kubernetes.EventModified:
+			o.reconcile(ctx, &event.Object)
+		case kubernetes.EventDeleted:
+			if err := o.remove(event.Object.Key()); err != nil {
+				o.logger.Errorf("Failed to remove node of VPNNode %s: %v", event.Object.Key(), err)
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, kubernetes.ErrExpired) || errors.Is(err, errLostLeadership) {
+		return nil
+	}
+	return err
+}
+
+var errLostLeadership = errors.New("lost leadership")
+
+// reconcile applies the resource's spec to its node and reports the node in its status
+func (o *NodeOperator) reconcile(ctx context.Context, obj *kubernetes.Object) {
+	if obj.Metadata.DeletionTimestamp != nil {
+		return
+	}
+
+	status := vpnNodeStatus{ObservedGeneration: obj.Metadata.Generation}
+	node, err := o.apply(obj)
+	if err != nil {
+		status.Message = err.Error()
+		o.logger.Warnf("Failed to reconcile VPNNode %s: %v", obj.Key(), err)
+	}
+	if node != nil {
+		status.NodeID = node.ID.String()
+		status.Phase = node.Status
+		if !node.LastHeartbeat.IsZero() {
+			status.LastHeartbeat = node.LastHeartbeat.UTC().Format(time.RFC3339)
+		}
+	}
+
+	// Every status update is watched back as a change; skip the ones that change nothing
+	var current vpnNodeStatus
+	if json.Unmarshal(obj.Status, &current) == nil && current == status {
+		return
+	}
+	if err := o.client.UpdateStatus(ctx, VPNNodeResource, obj, status); err != nil {
+		o.logger.Errorf("Failed to update status of VPNNode %s: %v", obj.Key(), err)
+	}
+}
+
+// apply creates or updates the node of the resource
+func (o *NodeOperator) apply(obj *kubernetes.Object) (*models.VPSNode, error) {
+	db := o.nodeHandler.db
+
+	var spec vpnNodeSpec
+	if err := json.Unmarshal(obj.Spec, &spec); err != nil {
+		return nil, fmt.Errorf("invalid spec: %w", err)
+	}
+	if spec.Name == "" {
+		spec.Name = obj.Metadata.Name
+	}
+	if spec.Hostname == "" {
+		return nil, fmt.Errorf("spec.hostname is required")
+	}
+	if spec.NodeGroup != "" && !models.NodeGroupPattern.MatchString(spec.NodeGroup) {
+		return nil, fmt.Errorf("invalid node group %q", spec.NodeGroup)
+	}
+
+	var node models.VPSNode
+	err := db.Where("metadata->>'"+metadataVPNNode+"' = ?", obj.Key()).First(&node).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	created := err != nil
+	if created {
+		node = models.VPSNode{
+			Status:   models.NodeStatusOffline,
+			Metadata: models.JSONB{metadataVPNNode: obj.Key()},
+		}
+	}
+
+	node.Name = spec.Name
+	node.Hostname = spec.Hostname
+	node.Location = spec.Location
+	node.Country = spec.Country
+	node.NodeGroup = spec.NodeGroup
+	node.GRPCPort = 50051
+	if spec.GRPCPort > 0 {
+		node.GRPCPort = spec.GRPCPort
+	}
+	// Agents report their address when they register; the spec only overrides it
+	if spec.IPAddress != "" {
+		node.IPAddress = spec.IPAddress
+	}
+	if spec.Capacity != nil {
+		node.SetCapacity(models.NodeCapacity{
+			MaxUsers:       spec.Capacity.MaxUsers,
+			MaxConnections: spec.Capacity.MaxConnections,
+			MaxMbps:        spec.Capacity.MaxMbps,
+		})
+	}
+
+	if created {
+		err = db.Create(&node).Error
+	} else {
+		// Only the mirrored columns, so heartbeats landing meanwhile are kept
+		err = db.Model(&node).
+			Select("name", "hostname", "location", "country", "node_group", "grpc_port", "ip_address", "metadata").
+			Updates(&node).Error
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to save node: %w", err)
+	}
+	return &node, nil
+}
+
+// prune removes the nodes whose resource is gone; keys holds every resource that exists
+func (o *NodeOperator) prune(keys map[string]bool) error {
+	var nodes []models.VPSNode
+	if err := o.nodeHandler.db.Where("metadata->>'" + metadataVPNNode + "' IS NOT NULL").Find(&nodes).Error; err != nil {
+		return fmt.Errorf("failed to get mirrored nodes: %w", err)
+	}
+	for _, node := range nodes {
+		key, _ := node.Metadata[metadataVPNNode].(string)
+		if keys[key] || !o.watches(key) {
+			continue
+		}
+		if err := o.remove(key); err != nil {
+			o.logger.Errorf("Failed to remove node of VPNNode %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// watches reports whether key is in the watched namespace
+func (o *NodeOperator) watches(key string) bool {
+	return o.namespace == "" || strings.HasPrefix(key, o.namespace+"/")
+}
+
+func (o *NodeOperator) remove(key string) error {
+	result := o.nodeHandler.db.Where("metadata->>'"+metadataVPNNode+"' = ?", key).Delete(&models.VPSNode{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		o.logger.Infof("Removed node of deleted VPNNode %s", key)
+	}
+	return nil
+}
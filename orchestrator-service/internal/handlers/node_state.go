@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"hysteria2_microservices/orchestrator-service/internal/backup"
+	"hysteria2_microservices/orchestrator-service/internal/models"
+	pb "hysteria2_microservices/proto"
+)
+
+// ExportNodeState bundles a node's files, firewall rules and stored settings into an
+// archive signed with the backup signing key
+func (h *BackupHandler) ExportNodeState(ctx context.Context, req *pb.ExportNodeStateRequest) (*pb.ExportNodeStateResponse, error) {
+	key, err := backup.ParseSigningKey(h.config.SigningKey)
+	if err != nil {
+		return nil, err
+	}
+	var node models.VPSNode
+	if err := h.nodeHandler.db.First(&node, "id = ?", req.NodeId).Error; err != nil {
+		return nil, fmt.Errorf("node not found: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, backupNodeTimeout)
+	defer cancel()
+
+	conn, err := h.nodeHandler.connect(req.NodeId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to node: %w", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewNodeManagerClient(conn)
+
+	files, err := nodeFiles(ctx, client, req.NodeId)
+	if err != nil {
+		return nil, err
+	}
+	state := &backup.NodeState{
+		Version:   backup.NodeStateVersion,
+		CreatedAt: time.Now().UTC(),
+		NodeID:    node.ID.String(),
+		NodeName:  node.Name,
+		Settings:  backup.NodeSettingsOf(&node),
+		Files:     files,
+	}
+
+	firewall, err := client.GetFirewallRules(ctx, &pb.GetFirewallRulesRequest{NodeId: req.NodeId})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get firewall rules from node: %w", err)
+	}
+	if !firewall.Success {
+		return nil, fmt.Errorf("node failed to report firewall rules: %s", firewall.Message)
+	}
+	if firewall.Enabled {
+		state.Firewall = &backup.FirewallState{Backend: firewall.Backend}
+		for _, rule := range firewall.Rules {
+			state.Firewall.Rules = append(state.Firewall.Rules, backup.FirewallRule{
+				Protocol: rule.Protocol,
+				Ports:    rule.Ports,
+				Sources:  rule.Sources,
+				Comment:  rule.Comment,
+			})
+		}
+	}
+
+	archive, err := backup.SignNodeState(state, key)
+	if err != nil {
+		return nil, err
+	}
+	h.logger.Infof("Exported state of node %s: %d file(s)", node.Name, len(files))
+
+	resp := &pb.ExportNodeStateResponse{
+		Success: true,
+		Message: fmt.Sprintf("Exported %d file(s) of node %s", len(files), node.Name),
+		Archive: archive,
+		Files:   int32(len(files)),
+	}
+	if state.Firewall != nil {
+		resp.FirewallRules = int32(len(state.Firewall.Rules))
+	}
+	return resp, nil
+}
+
+// ImportNodeState verifies an exported archive and applies it to a node: the files are
+// written and the servers restarted, the firewall rules applied, and the stored settings
+// copied to the node and pushed. Importing onto another node makes it take over the
+// identity of the exported one, e.g. when rebuilding a node on a new VPS.
+func (h *BackupHandler) ImportNodeState(ctx context.Context, req *pb.ImportNodeStateRequest) (*pb.ImportNodeStateResponse, error) {
+	key, err := backup.ParseSigningKey(h.config.SigningKey)
+	if err != nil {
+		return nil, err
+	}
+	state, err := backup.OpenNodeState(req.Archive, key)
+	if err != nil {
+		return nil, err
+	}
+	var node models.VPSNode
+	if err := h.nodeHandler.db.First(&node, "id = ?", req.NodeId).Error; err != nil {
+		return nil, fmt.Errorf("node not found: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, restoreNodeTimeout)
+	defer cancel()
+
+	conn, err := h.nodeHandler.connect(req.NodeId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to node: %w", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewNodeManagerClient(conn)
+
+	resp := &pb.ImportNodeStateResponse{
+		SourceNodeId:   state.NodeID,
+		SourceNodeName: state.NodeName,
+	}
+
+	restored, err := client.RestoreNodeFiles(ctx, &pb.RestoreNodeFilesRequest{NodeId: req.NodeId, Files: nodeFilesToProto(state.Files)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore files on node: %w", err)
+	}
+	resp.RestoredFiles = restored.RestoredFiles
+	if !restored.Success {
+		resp.Message = restored.Message
+		return resp, nil
+	}
+
+	if state.Firewall != nil && len(state.Firewall.Rules) > 0 {
+		rules := make([]*pb.FirewallRule, 0, len(state.Firewall.Rules))
+		for _, rule := range state.Firewall.Rules {
+			rules = append(rules, &pb.FirewallRule{
+				Protocol: rule.Protocol,
+				Ports:    rule.Ports,
+				Sources:  rule.Sources,
+				Comment:  rule.Comment,
+			})
+		}
+		applied, err := client.ApplyFirewallRules(ctx, &pb.ApplyFirewallRulesRequest{
+			NodeId:  req.NodeId,
+			Backend: state.Firewall.Backend,
+			Rules:   rules,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to apply firewall rules on node: %w", err)
+		}
+		if !applied.Success {
+			resp.Message = fmt.Sprintf("Restored %d file(s) but the node rejected the firewall rules: %s", restored.RestoredFiles, applied.Message)
+			return resp, nil
+		}
+		resp.FirewallRules = int32(len(rules))
+	}
+
+	if err := h.nodeHandler.db.Model(&node).Updates(state.Settings.Updates()).Error; err != nil {
+		return nil, fmt.Errorf("failed to update node settings: %w", err)
+	}
+	if err := h.nodeHandler.db.First(&node, "id = ?", req.NodeId).Error; err != nil {
+		return nil, fmt.Errorf("failed to reload node: %w", err)
+	}
+	pushed, err := pushStoredConfig(ctx, client, &node)
+	if err != nil {
+		resp.Message = fmt.Sprintf("Restored %d file(s) but failed to push the stored config: %v", restored.RestoredFiles, err)
+		return resp, nil
+	}
+
+	h.logger.Infof("Imported state of node %s onto node %s", state.NodeName, node.Name)
+	resp.Success = true
+	resp.Config = pushed
+	resp.Message = fmt.Sprintf("Imported state of node %s: %d file(s), %d firewall rule(s)", state.NodeName, restored.RestoredFiles, resp.FirewallRules)
+	return resp, nil
+}
@@ -0,0 +1,486 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"hysteria2_microservices/orchestrator-service/internal/models"
+	pb "hysteria2_microservices/proto"
+)
+
+const (
+	defaultExperimentHours = 72
+	maxExperimentHours     = 30 * 24
+
+	// Both arms need this many attempts before a winner is declared
+	minExperimentSamples = 30
+	// Success rates must differ at this two-sided significance level
+	experimentSignificance = 0.05
+)
+
+var experimentArmNames = []string{"a", "b"}
+
+// experimentArmStats are the aggregated samples of one experiment arm
+type experimentArmStats struct {
+	Arm                string
+	Attempts           int
+	Successes          int
+	MedianHandshakeMs  float64
+	MeanThroughputKbps float64
+}
+
+// StartObfuscationExperiment applies the preset of each arm to the arm's nodes and starts
+// collecting client samples for them
+func (h *NodeConfigHandler) StartObfuscationExperiment(ctx context.Context, req *pb.StartObfuscationExperimentRequest) (*pb.StartObfuscationExperimentResponse, error) {
+	if strings.TrimSpace(req.Name) == "" {
+		return nil, fmt.Errorf("experiment name is required")
+	}
+	if len(req.Arms) != len(experimentArmNames) {
+		return nil, fmt.Errorf("an experiment needs exactly %d arms, got %d", len(experimentArmNames), len(req.Arms))
+	}
+	if req.Arms[0].Preset == req.Arms[1].Preset {
+		return nil, fmt.Errorf("both arms use preset %q", req.Arms[0].Preset)
+	}
+	hours := int(req.DurationHours)
+	if hours <= 0 {
+		hours = defaultExperimentHours
+	}
+	if hours > maxExperimentHours {
+		return nil, fmt.Errorf("duration must be at most %d hours", maxExperimentHours)
+	}
+
+	busy, err := h.experimentNodes()
+	if err != nil {
+		return nil, err
+	}
+
+	settings := make([]models.ObfuscationSettings, len(req.Arms))
+	nodes := make([][]models.VPSNode, len(req.Arms))
+	seen := make(map[string]bool)
+	for i, arm := range req.Arms {
+		if arm.Preset == "" {
+			return nil, fmt.Errorf("arm %s needs a preset", experimentArmNames[i])
+		}
+		if settings[i], err = h.findObfuscationPreset(arm.Preset); err != nil {
+			return nil, err
+		}
+		if len(arm.NodeIds) == 0 {
+			return nil, fmt.Errorf("arm %s needs at least one node", experimentArmNames[i])
+		}
+		for _, nodeID := range arm.NodeIds {
+			if seen[nodeID] {
+				return nil, fmt.Errorf("node %s is listed more than once", nodeID)
+			}
+			seen[nodeID] = true
+
+			var node models.VPSNode
+			if err := h.nodeHandler.db.First(&node, "id = ?", nodeID).Error; err != nil {
+				return nil, fmt.Errorf("node %s not found: %w", nodeID, err)
+			}
+			if nodeCapability(&node, "obfuscation") != "true" {
+				return nil, fmt.Errorf("agent of node %s cannot apply obfuscation presets", node.Name)
+			}
+			if busy[node.ID] {
+				return nil, fmt.Errorf("node %s is already part of a running experiment", node.Name)
+			}
+			nodes[i] = append(nodes[i], node)
+		}
+	}
+
+	arms := make([]models.ExperimentArm, len(req.Arms))
+	for i, arm := range req.Arms {
+		arms[i] = models.ExperimentArm{Name: experimentArmNames[i], Preset: arm.Preset}
+		for j := range nodes[i] {
+			node := &nodes[i][j]
+			entry := models.ExperimentNode{
+				NodeID:         node.ID,
+				NodeName:       node.Name,
+				PreviousPreset: node.ObfuscationPreset,
+				Status:         models.ExperimentNodeApplied,
+			}
+			if _, err := h.applyObfuscation(ctx, node, arm.Preset, settings[i]); err != nil {
+				entry.Status = models.ExperimentNodeFailed
+				entry.Message = err.Error()
+			}
+			arms[i].Nodes = append(arms[i].Nodes, entry)
+		}
+	}
+
+	// An arm without nodes measures nothing; put the other arm's nodes back
+	for _, arm := range arms {
+		if experimentArmApplied(arm) == 0 {
+			h.restoreExperimentNodes(ctx, arms, "")
+			return nil, fmt.Errorf("preset %s could not be applied to any node of arm %s", arm.Preset, arm.Name)
+		}
+	}
+
+	now := time.Now()
+	experiment := models.ObfuscationExperiment{
+		Name:      req.Name,
+		Status:    models.ExperimentStatusRunning,
+		StartedAt: now,
+		EndsAt:    now.Add(time.Duration(hours) * time.Hour),
+	}
+	if err := experiment.SetArms(arms); err != nil {
+		return nil, fmt.Errorf("failed to encode experiment arms: %w", err)
+	}
+	if err := h.nodeHandler.db.Create(&experiment).Error; err != nil {
+		return nil, fmt.Errorf("failed to save experiment: %w", err)
+	}
+
+	applied := experimentArmApplied(arms[0]) + experimentArmApplied(arms[1])
+	return &pb.StartObfuscationExperimentResponse{
+		Success:    applied == len(seen),
+		Message:    fmt.Sprintf("Experiment started on %d of %d node(s)", applied, len(seen)),
+		Experiment: obfuscationExperimentToProto(&experiment),
+	}, nil
+}
+
+// ListObfuscationExperiments returns every experiment, newest first
+func (h *NodeConfigHandler) ListObfuscationExperiments(ctx context.Context, req *pb.ListObfuscationExperimentsRequest) (*pb.ListObfuscationExperimentsResponse, error) {
+	var experiments []models.ObfuscationExperiment
+	if err := h.nodeHandler.db.Order("created_at DESC").Find(&experiments).Error; err != nil {
+		return nil, fmt.Errorf("failed to get experiments: %w", err)
+	}
+
+	resp := &pb.ListObfuscationExperimentsResponse{
+		Success:     true,
+		Message:     "Experiments retrieved successfully",
+		Experiments: make([]*pb.ObfuscationExperiment, 0, len(experiments)),
+	}
+	for i := range experiments {
+		resp.Experiments = append(resp.Experiments, obfuscationExperimentToProto(&experiments[i]))
+	}
+	return resp, nil
+}
+
+// GetObfuscationExperiment returns an experiment with the comparison of its arms so far
+func (h *NodeConfigHandler) GetObfuscationExperiment(ctx context.Context, req *pb.GetObfuscationExperimentRequest) (*pb.GetObfuscationExperimentResponse, error) {
+	var experiment models.ObfuscationExperiment
+	if err := h.nodeHandler.db.First(&experiment, "id = ?", req.ExperimentId).Error; err != nil {
+		return nil, fmt.Errorf("experiment not found: %w", err)
+	}
+
+	report, err := h.experimentReport(&experiment)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.GetObfuscationExperimentResponse{
+		Success:    true,
+		Message:    "Experiment retrieved successfully",
+		Experiment: obfuscationExperimentToProto(&experiment),
+		Report:     report,
+	}, nil
+}
+
+// ReportExperimentSamples records client connection attempts to nodes of running
+// experiments; samples for other nodes are dropped
+func (h *NodeConfigHandler) ReportExperimentSamples(ctx context.Context, req *pb.ReportExperimentSamplesRequest) (*pb.ReportExperimentSamplesResponse, error) {
+	var experiments []models.ObfuscationExperiment
+	err := h.nodeHandler.db.Where("status = ? AND ends_at > ?", models.ExperimentStatusRunning, time.Now()).
+		Find(&experiments).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to get running experiments: %w", err)
+	}
+
+	samples := make([]models.ExperimentSample, 0, len(req.Samples))
+	for _, sample := range req.Samples {
+		nodeID, err := uuid.Parse(sample.NodeId)
+		if err != nil || sample.HandshakeMs < 0 || sample.ThroughputKbps < 0 {
+			continue
+		}
+		at := time.Now()
+		if sample.Timestamp > 0 {
+			at = time.Unix(sample.Timestamp, 0)
+		}
+
+		for i := range experiments {
+			experiment := &experiments[i]
+			arm := experiment.ArmOf(nodeID)
+			if arm == "" || at.Before(experiment.StartedAt) || at.After(experiment.EndsAt) {
+				continue
+			}
+
+			entry := models.ExperimentSample{
+				ExperimentID:   experiment.ID,
+				Arm:            arm,
+				NodeID:         nodeID,
+				Success:        sample.Success,
+				HandshakeMs:    int(sample.HandshakeMs),
+				ThroughputKbps: int(sample.ThroughputKbps),
+				CreatedAt:      at,
+			}
+			if !sample.Success {
+				entry.FailureReason = experimentFailureReason(sample.FailureReason)
+			}
+			samples = append(samples, entry)
+			break
+		}
+	}
+
+	if len(samples) > 0 {
+		if err := h.nodeHandler.db.Create(&samples).Error; err != nil {
+			return nil, fmt.Errorf("failed to save samples: %w", err)
+		}
+	}
+	return &pb.ReportExperimentSamplesResponse{
+		Success:  true,
+		Message:  fmt.Sprintf("%d of %d sample(s) accepted", len(samples), len(req.Samples)),
+		Accepted: int32(len(samples)),
+	}, nil
+}
+
+// StopObfuscationExperiment ends an experiment and puts its nodes back on their previous
+// presets, or moves all of them to apply_preset
+func (h *NodeConfigHandler) StopObfuscationExperiment(ctx context.Context, req *pb.StopObfuscationExperimentRequest) (*pb.StopObfuscationExperimentResponse, error) {
+	var experiment models.ObfuscationExperiment
+	if err := h.nodeHandler.db.First(&experiment, "id = ?", req.ExperimentId).Error; err != nil {
+		return nil, fmt.Errorf("experiment not found: %w", err)
+	}
+	if experiment.Status != models.ExperimentStatusRunning {
+		return nil, fmt.Errorf("experiment %s is not running", experiment.Name)
+	}
+	if req.ApplyPreset != "" {
+		if _, err := h.findObfuscationPreset(req.ApplyPreset); err != nil {
+			return nil, err
+		}
+	}
+
+	arms := experiment.GetArms()
+	failures := h.restoreExperimentNodes(ctx, arms, req.ApplyPreset)
+
+	now := time.Now()
+	experiment.Status = models.ExperimentStatusCompleted
+	if now.Before(experiment.EndsAt) {
+		experiment.Status = models.ExperimentStatusCancelled
+	}
+	experiment.FinishedAt = &now
+	experiment.AppliedPreset = req.ApplyPreset
+	if err := experiment.SetArms(arms); err != nil {
+		return nil, fmt.Errorf("failed to encode experiment arms: %w", err)
+	}
+	if err := h.nodeHandler.db.Save(&experiment).Error; err != nil {
+		return nil, fmt.Errorf("failed to update experiment: %w", err)
+	}
+
+	action := "Experiment stopped, previous presets restored"
+	if req.ApplyPreset != "" {
+		action = fmt.Sprintf("Experiment stopped, preset %s applied", req.ApplyPreset)
+	}
+	return &pb.StopObfuscationExperimentResponse{
+		Success:    len(failures) == 0,
+		Message:    filterSyncMessage(action, failures),
+		Experiment: obfuscationExperimentToProto(&experiment),
+		Failures:   failures,
+	}, nil
+}
+
+// experimentNodes returns the nodes taking part in running experiments
+func (h *NodeConfigHandler) experimentNodes() (map[uuid.UUID]bool, error) {
+	var experiments []models.ObfuscationExperiment
+	if err := h.nodeHandler.db.Where("status = ?", models.ExperimentStatusRunning).Find(&experiments).Error; err != nil {
+		return nil, fmt.Errorf("failed to get running experiments: %w", err)
+	}
+
+	nodes := make(map[uuid.UUID]bool)
+	for i := range experiments {
+		for _, arm := range experiments[i].GetArms() {
+			for _, node := range arm.Nodes {
+				if node.Status == models.ExperimentNodeApplied {
+					nodes[node.NodeID] = true
+				}
+			}
+		}
+	}
+	return nodes, nil
+}
+
+// restoreExperimentNodes moves the nodes an arm preset was applied to onto preset, or back
+// onto their previous preset when preset is empty, and records the outcome in arms
+func (h *NodeConfigHandler) restoreExperimentNodes(ctx context.Context, arms []models.ExperimentArm, preset string) map[string]string {
+	failures := make(map[string]string)
+	for i := range arms {
+		for j := range arms[i].Nodes {
+			entry := &arms[i].Nodes[j]
+			if entry.Status != models.ExperimentNodeApplied {
+				continue
+			}
+
+			target := preset
+			if target == "" {
+				target = entry.PreviousPreset
+			}
+			if err := h.moveNodeToPreset(ctx, entry.NodeID, target); err != nil {
+				entry.Status = models.ExperimentNodeFailed
+				entry.Message = err.Error()
+				failures[entry.NodeID.String()] = err.Error()
+				continue
+			}
+			entry.Status = models.ExperimentNodeRestored
+			entry.Message = ""
+		}
+	}
+	return failures
+}
+
+func (h *NodeConfigHandler) moveNodeToPreset(ctx context.Context, nodeID uuid.UUID, preset string) error {
+	var node models.VPSNode
+	if err := h.nodeHandler.db.First(&node, "id = ?", nodeID).Error; err != nil {
+		return fmt.Errorf("node not found: %w", err)
+	}
+	settings, err := h.findObfuscationPreset(preset)
+	if err != nil {
+		return err
+	}
+	_, err = h.applyObfuscation(ctx, &node, preset, settings)
+	return err
+}
+
+// experimentReport aggregates the samples of each arm and compares their success rates
+func (h *NodeConfigHandler) experimentReport(experiment *models.ObfuscationExperiment) (*pb.ExperimentReport, error) {
+	var stats []experimentArmStats
+	err := h.nodeHandler.db.Raw(`SELECT arm,
+		COUNT(*) AS attempts,
+		COUNT(*) FILTER (WHERE success) AS successes,
+		COALESCE(percentile_cont(0.5) WITHIN GROUP (ORDER BY handshake_ms) FILTER (WHERE success), 0) AS median_handshake_ms,
+		COALESCE(AVG(throughput_kbps) FILTER (WHERE success AND throughput_kbps > 0), 0) AS mean_throughput_kbps
+		FROM experiment_samples WHERE experiment_id = ? GROUP BY arm`, experiment.ID).
+		Scan(&stats).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to aggregate samples: %w", err)
+	}
+
+	var failures []struct {
+		Arm           string
+		FailureReason string
+		Attempts      int
+	}
+	err = h.nodeHandler.db.Raw(`SELECT arm, failure_reason, COUNT(*) AS attempts
+		FROM experiment_samples WHERE experiment_id = ? AND NOT success GROUP BY arm, failure_reason`, experiment.ID).
+		Scan(&failures).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to aggregate failures: %w", err)
+	}
+
+	byArm := make(map[string]experimentArmStats, len(stats))
+	for _, s := range stats {
+		byArm[s.Arm] = s
+	}
+
+	report := &pb.ExperimentReport{}
+	for _, arm := range experiment.GetArms() {
+		s := byArm[arm.Name]
+		entry := &pb.ExperimentArmReport{
+			Arm:                arm.Name,
+			Preset:             arm.Preset,
+			Attempts:           int32(s.Attempts),
+			Successes:          int32(s.Successes),
+			MedianHandshakeMs:  int32(math.Round(s.MedianHandshakeMs)),
+			MeanThroughputKbps: int32(math.Round(s.MeanThroughputKbps)),
+			Failures:           make(map[string]int32),
+		}
+		if s.Attempts > 0 {
+			entry.SuccessRate = float64(s.Successes) / float64(s.Attempts)
+		}
+		for _, f := range failures {
+			if f.Arm == arm.Name {
+				entry.Failures[f.FailureReason] = int32(f.Attempts)
+			}
+		}
+		report.Arms = append(report.Arms, entry)
+	}
+
+	a, b := byArm[experimentArmNames[0]], byArm[experimentArmNames[1]]
+	report.PValue = successRatePValue(a, b)
+	switch {
+	case a.Attempts < minExperimentSamples || b.Attempts < minExperimentSamples:
+		report.Conclusion = fmt.Sprintf("Not enough samples yet, each arm needs %d attempts", minExperimentSamples)
+	case report.PValue >= experimentSignificance:
+		report.Conclusion = "No significant difference between the arms' success rates"
+	default:
+		winner, loser := a, b
+		if b.Successes*a.Attempts > a.Successes*b.Attempts {
+			winner, loser = b, a
+		}
+		report.Winner = winner.Arm
+		report.Conclusion = fmt.Sprintf("Arm %s connects significantly more often: %.1f%% against %.1f%%",
+			winner.Arm, 100*float64(winner.Successes)/float64(winner.Attempts),
+			100*float64(loser.Successes)/float64(loser.Attempts))
+	}
+	return report, nil
+}
+
+// successRatePValue is the two-sided p-value of a two-proportion z-test on the success
+// rates of a and b, 1 when there is nothing to compare
+func successRatePValue(a, b experimentArmStats) float64 {
+	if a.Attempts == 0 || b.Attempts == 0 {
+		return 1
+	}
+	pooled := float64(a.Successes+b.Successes) / float64(a.Attempts+b.Attempts)
+	se := math.Sqrt(pooled * (1 - pooled) * (1/float64(a.Attempts) + 1/float64(b.Attempts)))
+	if se == 0 {
+		return 1
+	}
+	z := (float64(a.Successes)/float64(a.Attempts) - float64(b.Successes)/float64(b.Attempts)) / se
+	return math.Erfc(math.Abs(z) / math.Sqrt2)
+}
+
+func experimentArmApplied(arm models.ExperimentArm) int {
+	applied := 0
+	for _, node := range arm.Nodes {
+		if node.Status == models.ExperimentNodeApplied {
+			applied++
+		}
+	}
+	return applied
+}
+
+// experimentFailureReason normalizes a client-reported failure reason into a short label
+func experimentFailureReason(reason string) string {
+	reason = strings.ToLower(strings.TrimSpace(reason))
+	if reason == "" {
+		return "unknown"
+	}
+	if len(reason) > 50 {
+		reason = reason[:50]
+	}
+	return reason
+}
+
+func obfuscationExperimentToProto(experiment *models.ObfuscationExperiment) *pb.ObfuscationExperiment {
+	result := &pb.ObfuscationExperiment{
+		Id:            experiment.ID.String(),
+		Name:          experiment.Name,
+		Status:        experiment.Status,
+		StartedAt:     experiment.StartedAt.Unix(),
+		EndsAt:        experiment.EndsAt.Unix(),
+		AppliedPreset: experiment.AppliedPreset,
+	}
+	if experiment.FinishedAt != nil {
+		result.FinishedAt = experiment.FinishedAt.Unix()
+	}
+
+	for _, arm := range experiment.GetArms() {
+		entry := &pb.ExperimentArm{
+			Name:   arm.Name,
+			Preset: arm.Preset,
+		}
+		for _, node := range arm.Nodes {
+			entry.NodeIds = append(entry.NodeIds, node.NodeID.String())
+			entry.Nodes = append(entry.Nodes, &pb.ExperimentNode{
+				NodeId:         node.NodeID.String(),
+				NodeName:       node.NodeName,
+				PreviousPreset: node.PreviousPreset,
+				Status:         node.Status,
+				Message:        node.Message,
+			})
+		}
+		result.Arms = append(result.Arms, entry)
+	}
+	return result
+}
@@ -0,0 +1,262 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm"
+
+	"hysteria2_microservices/orchestrator-service/internal/models"
+	pb "hysteria2_microservices/proto"
+)
+
+// ListObfuscationPresets returns the built-in presets followed by the custom ones
+func (h *NodeConfigHandler) ListObfuscationPresets(ctx context.Context, req *pb.ListObfuscationPresetsRequest) (*pb.ListObfuscationPresetsResponse, error) {
+	var presets []models.ObfuscationPreset
+	if err := h.nodeHandler.db.Order("name").Find(&presets).Error; err != nil {
+		return nil, fmt.Errorf("failed to get obfuscation presets: %w", err)
+	}
+
+	resp := &pb.ListObfuscationPresetsResponse{
+		Success: true,
+		Message: "Obfuscation presets retrieved successfully",
+		Presets: make([]*pb.ObfuscationPreset, 0, len(models.ObfuscationPresets)+len(presets)),
+	}
+	for _, preset := range models.ObfuscationPresets {
+		resp.Presets = append(resp.Presets, &pb.ObfuscationPreset{
+			Name:        preset.Name,
+			Description: preset.Description,
+			Settings:    obfuscationSettingsToProto(preset.Settings),
+			Builtin:     true,
+		})
+	}
+	for i := range presets {
+		resp.Presets = append(resp.Presets, obfuscationPresetToProto(&presets[i]))
+	}
+	return resp, nil
+}
+
+// SaveObfuscationPreset creates a custom preset, or updates it when an ID is given, and
+// applies the change to the nodes using it
+func (h *NodeConfigHandler) SaveObfuscationPreset(ctx context.Context, req *pb.SaveObfuscationPresetRequest) (*pb.SaveObfuscationPresetResponse, error) {
+	if req.Preset == nil {
+		return nil, fmt.Errorf("obfuscation preset is required")
+	}
+
+	preset := models.ObfuscationPreset{}
+	if req.Preset.Id != "" {
+		if err := h.nodeHandler.db.First(&preset, "id = ?", req.Preset.Id).Error; err != nil {
+			return nil, fmt.Errorf("obfuscation preset not found: %w", err)
+		}
+	}
+	previousName := preset.Name
+	preset.Name = req.Preset.Name
+	preset.Description = req.Preset.Description
+
+	var settings models.ObfuscationSettings
+	if req.Preset.Settings != nil {
+		settings = obfuscationSettingsFromProto(req.Preset.Settings)
+	}
+	if err := preset.SetSettings(settings); err != nil {
+		return nil, fmt.Errorf("failed to encode settings: %w", err)
+	}
+	if err := preset.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid obfuscation preset: %w", err)
+	}
+
+	err := h.nodeHandler.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&preset).Error; err != nil {
+			return err
+		}
+		if previousName == "" || previousName == preset.Name {
+			return nil
+		}
+		return tx.Model(&models.VPSNode{}).Where("obfuscation_preset = ?", previousName).
+			Update("obfuscation_preset", preset.Name).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to save obfuscation preset: %w", err)
+	}
+
+	var nodes []models.VPSNode
+	if err := h.nodeHandler.db.Where("obfuscation_preset = ?", preset.Name).Find(&nodes).Error; err != nil {
+		return nil, fmt.Errorf("failed to get nodes: %w", err)
+	}
+	failures := make(map[string]string)
+	for i := range nodes {
+		if _, err := h.applyObfuscation(ctx, &nodes[i], preset.Name, preset.GetSettings()); err != nil {
+			failures[nodes[i].ID.String()] = err.Error()
+		}
+	}
+
+	return &pb.SaveObfuscationPresetResponse{
+		Success:  len(failures) == 0,
+		Message:  filterSyncMessage("Obfuscation preset saved", failures),
+		Preset:   obfuscationPresetToProto(&preset),
+		Failures: failures,
+	}, nil
+}
+
+// DeleteObfuscationPreset removes a custom preset no node uses
+func (h *NodeConfigHandler) DeleteObfuscationPreset(ctx context.Context, req *pb.DeleteObfuscationPresetRequest) (*pb.DeleteObfuscationPresetResponse, error) {
+	var preset models.ObfuscationPreset
+	if err := h.nodeHandler.db.First(&preset, "id = ?", req.PresetId).Error; err != nil {
+		return nil, fmt.Errorf("obfuscation preset not found: %w", err)
+	}
+
+	var inUse int64
+	if err := h.nodeHandler.db.Model(&models.VPSNode{}).Where("obfuscation_preset = ?", preset.Name).Count(&inUse).Error; err != nil {
+		return nil, fmt.Errorf("failed to get nodes: %w", err)
+	}
+	if inUse > 0 {
+		return nil, fmt.Errorf("obfuscation preset %s is used by %d nodes", preset.Name, inUse)
+	}
+
+	if err := h.nodeHandler.db.Delete(&preset).Error; err != nil {
+		return nil, fmt.Errorf("failed to delete obfuscation preset: %w", err)
+	}
+	return &pb.DeleteObfuscationPresetResponse{
+		Success: true,
+		Message: "Obfuscation preset deleted",
+	}, nil
+}
+
+// SetNodeObfuscation applies a built-in or custom preset to a node, or the given settings
+// when no preset is named. Giving neither turns every obfuscation knob off.
+func (h *NodeConfigHandler) SetNodeObfuscation(ctx context.Context, req *pb.SetNodeObfuscationRequest) (*pb.SetNodeObfuscationResponse, error) {
+	var node models.VPSNode
+	if err := h.nodeHandler.db.First(&node, "id = ?", req.NodeId).Error; err != nil {
+		return nil, fmt.Errorf("node not found: %w", err)
+	}
+	if nodeCapability(&node, "obfuscation") != "true" {
+		return nil, fmt.Errorf("agent of node %s cannot apply obfuscation presets", node.Name)
+	}
+	busy, err := h.experimentNodes()
+	if err != nil {
+		return nil, err
+	}
+	if busy[node.ID] {
+		return nil, fmt.Errorf("node %s is part of a running obfuscation experiment", node.Name)
+	}
+
+	var settings models.ObfuscationSettings
+	if req.Preset == "" && req.Settings != nil {
+		settings = obfuscationSettingsFromProto(req.Settings)
+		if err := settings.Validate(); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid obfuscation settings: %v", err)
+		}
+	} else if settings, err = h.findObfuscationPreset(req.Preset); err != nil {
+		return nil, err
+	}
+
+	applied, err := h.applyObfuscation(ctx, &node, req.Preset, settings)
+	if err != nil {
+		return nil, err
+	}
+
+	message := "Obfuscation turned off"
+	switch {
+	case req.Preset != "":
+		message = fmt.Sprintf("Obfuscation preset %s applied", req.Preset)
+	case req.Settings != nil:
+		message = "Custom obfuscation settings applied"
+	}
+	return &pb.SetNodeObfuscationResponse{
+		Success:  true,
+		Message:  message,
+		Preset:   req.Preset,
+		Settings: obfuscationSettingsToProto(applied),
+	}, nil
+}
+
+// GetNodeObfuscation returns a node's preset and its settings as applied, including the
+// node's Salamander password client configs need
+func (h *NodeConfigHandler) GetNodeObfuscation(ctx context.Context, req *pb.GetNodeObfuscationRequest) (*pb.GetNodeObfuscationResponse, error) {
+	var node models.VPSNode
+	if err := h.nodeHandler.db.First(&node, "id = ?", req.NodeId).Error; err != nil {
+		return nil, fmt.Errorf("node not found: %w", err)
+	}
+
+	settings, ok := node.GetObfuscation()
+	if !ok {
+		return &pb.GetNodeObfuscationResponse{
+			Success: true,
+			Message: "Node keeps the obfuscation configured on its agent",
+		}, nil
+	}
+	return &pb.GetNodeObfuscationResponse{
+		Success:  true,
+		Message:  "Obfuscation retrieved successfully",
+		Preset:   node.ObfuscationPreset,
+		Settings: obfuscationSettingsToProto(settings),
+	}, nil
+}
+
+// findObfuscationPreset returns the settings of the built-in or custom preset called name,
+// or no obfuscation at all for an empty name
+func (h *NodeConfigHandler) findObfuscationPreset(name string) (models.ObfuscationSettings, error) {
+	if name == "" {
+		return models.ObfuscationSettings{}, nil
+	}
+	if builtin := models.FindObfuscationPreset(name); builtin != nil {
+		return builtin.Settings, nil
+	}
+
+	var preset models.ObfuscationPreset
+	if err := h.nodeHandler.db.First(&preset, "name = ?", name).Error; err != nil {
+		return models.ObfuscationSettings{}, fmt.Errorf("obfuscation preset %q not found: %w", name, err)
+	}
+	return preset.GetSettings(), nil
+}
+
+// applyObfuscation pushes settings to node, keeping the node's Salamander password across
+// presets unless settings bring their own, and stores them as applied
+func (h *NodeConfigHandler) applyObfuscation(ctx context.Context, node *models.VPSNode, preset string, settings models.ObfuscationSettings) (models.ObfuscationSettings, error) {
+	if current, ok := node.GetObfuscation(); ok && settings.Salamander && settings.SalamanderPassword == "" {
+		settings.SalamanderPassword = current.SalamanderPassword
+	}
+
+	conn, err := h.nodeHandler.connect(node.ID.String())
+	if err != nil {
+		return settings, fmt.Errorf("failed to connect to node: %w", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewNodeManagerClient(conn)
+
+	resp, err := client.ApplyObfuscation(ctx, &pb.ApplyObfuscationRequest{
+		NodeId:   node.ID.String(),
+		Preset:   preset,
+		Settings: obfuscationSettingsToProto(settings),
+	})
+	if err != nil {
+		return settings, fmt.Errorf("failed to apply obfuscation on node: %w", err)
+	}
+	if !resp.Success {
+		return settings, fmt.Errorf("node rejected obfuscation settings: %s", resp.Message)
+	}
+
+	applied := settings
+	if resp.Settings != nil {
+		applied = obfuscationSettingsFromProto(resp.Settings)
+	}
+	node.ObfuscationPreset = preset
+	if err := node.SetObfuscation(applied); err != nil {
+		return applied, fmt.Errorf("failed to encode obfuscation settings: %w", err)
+	}
+	if err := h.nodeHandler.db.Save(node).Error; err != nil {
+		return applied, fmt.Errorf("failed to update node: %w", err)
+	}
+	return applied, nil
+}
+
+func obfuscationPresetToProto(preset *models.ObfuscationPreset) *pb.ObfuscationPreset {
+	return &pb.ObfuscationPreset{
+		Id:          preset.ID.String(),
+		Name:        preset.Name,
+		Description: preset.Description,
+		Settings:    obfuscationSettingsToProto(preset.GetSettings()),
+	}
+}
@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+
+	"hysteria2_microservices/orchestrator-service/internal/models"
+	pb "hysteria2_microservices/proto"
+)
+
+// UpdateOutboundPolicy pushes the outbounds a node's Hysteria2 sends traffic to and the rules
+// choosing between them, and stores them so they are pushed again when the node converges.
+// A policy without outbounds removes it.
+func (h *NodeConfigHandler) UpdateOutboundPolicy(ctx context.Context, req *pb.SetOutboundPolicyRequest) (*pb.SetOutboundPolicyResponse, error) {
+	if req.Policy == nil {
+		return nil, fmt.Errorf("outbound policy is required")
+	}
+
+	policy := outboundPolicyFromProto(req.Policy)
+	if policy.Default == "" && len(policy.Outbounds) > 0 {
+		policy.Default = policy.Outbounds[0].Name
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid outbound policy: %w", err)
+	}
+
+	// Get node from database
+	var node models.VPSNode
+	if err := h.nodeHandler.db.First(&node, "id = ?", req.NodeId).Error; err != nil {
+		return nil, fmt.Errorf("node not found: %w", err)
+	}
+	if nodeCapability(&node, "outbound_policy") != "true" {
+		return nil, fmt.Errorf("agent of node %s cannot apply outbound policies", node.Name)
+	}
+
+	// Outbounds through another node go to its address as it is now
+	for i, outbound := range policy.Outbounds {
+		if outbound.NodeID == "" {
+			continue
+		}
+		if outbound.NodeID == node.ID.String() {
+			return nil, fmt.Errorf("outbound %s: a node cannot send its traffic through itself", outbound.Name)
+		}
+		var target models.VPSNode
+		if err := h.nodeHandler.db.Select("id", "ip_address").First(&target, "id = ?", outbound.NodeID).Error; err != nil {
+			return nil, fmt.Errorf("outbound %s: node not found: %w", outbound.Name, err)
+		}
+		if outbound.Address == "" {
+			policy.Outbounds[i].Address = target.IPAddress
+		}
+	}
+
+	conn, err := h.nodeHandler.connect(req.NodeId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to node: %w", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewNodeManagerClient(conn)
+
+	resp, err := client.SetOutboundPolicy(ctx, &pb.SetOutboundPolicyRequest{NodeId: req.NodeId, Policy: outboundPolicyToProto(policy)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to apply outbound policy on node: %w", err)
+	}
+	if !resp.Success {
+		return nil, fmt.Errorf("node rejected outbound policy: %s", resp.Message)
+	}
+
+	if err := node.SetOutboundPolicy(policy); err != nil {
+		return nil, fmt.Errorf("failed to encode outbound policy: %w", err)
+	}
+
+	// Save to database
+	if err := h.nodeHandler.db.Save(&node).Error; err != nil {
+		return nil, fmt.Errorf("failed to update node: %w", err)
+	}
+	if len(policy.Outbounds) > 0 {
+		resp.Policy = outboundPolicyToProto(policy.Redacted())
+	}
+	return resp, nil
+}
+
+// GetOutboundPolicy returns the outbound policy stored for a node, without proxy passwords
+func (h *NodeConfigHandler) GetOutboundPolicy(ctx context.Context, req *pb.GetOutboundPolicyRequest) (*pb.GetOutboundPolicyResponse, error) {
+	var node models.VPSNode
+	if err := h.nodeHandler.db.First(&node, "id = ?", req.NodeId).Error; err != nil {
+		return nil, fmt.Errorf("node not found: %w", err)
+	}
+
+	policy, ok := node.GetOutboundPolicy()
+	if !ok {
+		return &pb.GetOutboundPolicyResponse{
+			Success: true,
+			Message: fmt.Sprintf("Node %s has no outbound policy", node.Name),
+		}, nil
+	}
+	return &pb.GetOutboundPolicyResponse{
+		Success: true,
+		Message: "Outbound policy retrieved successfully",
+		Policy:  outboundPolicyToProto(policy.Redacted()),
+	}, nil
+}
+
+func outboundPolicyFromProto(policy *pb.OutboundPolicy) models.OutboundPolicy {
+	result := models.OutboundPolicy{Default: policy.DefaultOutbound}
+	for _, outbound := range policy.Outbounds {
+		result.Outbounds = append(result.Outbounds, models.PolicyOutbound{
+			Name:       outbound.Name,
+			Type:       outbound.Type,
+			NodeID:     outbound.NodeId,
+			Address:    outbound.Address,
+			Port:       int(outbound.Port),
+			Username:   outbound.Username,
+			Password:   outbound.Password,
+			BindDevice: outbound.BindDevice,
+		})
+	}
+	for _, rule := range policy.Rules {
+		result.Rules = append(result.Rules, models.PolicyRule{
+			Outbound: rule.Outbound,
+			Match:    rule.Match,
+			Value:    rule.Value,
+			Protocol: rule.Protocol,
+			Port:     rule.Port,
+		})
+	}
+	return result
+}
+
+func outboundPolicyToProto(policy models.OutboundPolicy) *pb.OutboundPolicy {
+	result := &pb.OutboundPolicy{DefaultOutbound: policy.Default}
+	for _, outbound := range policy.Outbounds {
+		result.Outbounds = append(result.Outbounds, &pb.PolicyOutbound{
+			Name:       outbound.Name,
+			Type:       outbound.Type,
+			NodeId:     outbound.NodeID,
+			Address:    outbound.Address,
+			Port:       int32(outbound.Port),
+			Username:   outbound.Username,
+			Password:   outbound.Password,
+			BindDevice: outbound.BindDevice,
+		})
+	}
+	for _, rule := range policy.Rules {
+		result.Rules = append(result.Rules, &pb.PolicyRule{
+			Outbound: rule.Outbound,
+			Match:    rule.Match,
+			Value:    rule.Value,
+			Protocol: rule.Protocol,
+			Port:     rule.Port,
+		})
+	}
+	return result
+}
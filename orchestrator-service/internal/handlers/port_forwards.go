@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"hysteria2_microservices/orchestrator-service/internal/models"
+	pb "hysteria2_microservices/proto"
+)
+
+// PortForwardHandler relays port forwards to the agents, which check them against the
+// ports their servers listen on, install them and keep them across restarts. Who may
+// forward which ports is up to the api-service.
+type PortForwardHandler struct {
+	nodeHandler *NodeHandler
+	logger      *logrus.Logger
+}
+
+// NewPortForwardHandler creates a new PortForwardHandler
+func NewPortForwardHandler(nodeHandler *NodeHandler, logger *logrus.Logger) *PortForwardHandler {
+	return &PortForwardHandler{
+		nodeHandler: nodeHandler,
+		logger:      logger,
+	}
+}
+
+// AddPortForward exposes a user's server on a public port of a node
+func (h *PortForwardHandler) AddPortForward(ctx context.Context, req *pb.AddPortForwardRequest) (*pb.AddPortForwardResponse, error) {
+	if req.Forward == nil {
+		return nil, status.Error(codes.InvalidArgument, "port forward is required")
+	}
+
+	client, node, closeConn, err := h.agent(req.NodeId)
+	if err != nil {
+		return nil, err
+	}
+	defer closeConn()
+
+	resp, err := client.AddPortForward(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	h.logger.Infof("Port forward %s added on node %s: %s %d -> %s:%d", resp.Forward.GetId(), node.Name,
+		req.Forward.Protocol, req.Forward.ListenPort, req.Forward.TargetHost, req.Forward.TargetPort)
+	return resp, nil
+}
+
+// RemovePortForward closes a forwarded port of a node
+func (h *PortForwardHandler) RemovePortForward(ctx context.Context, req *pb.RemovePortForwardRequest) (*pb.RemovePortForwardResponse, error) {
+	client, node, closeConn, err := h.agent(req.NodeId)
+	if err != nil {
+		return nil, err
+	}
+	defer closeConn()
+
+	resp, err := client.RemovePortForward(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	h.logger.Infof("Port forward %s removed from node %s", req.ForwardId, node.Name)
+	return resp, nil
+}
+
+// ListPortForwards returns the forwards of a node
+func (h *PortForwardHandler) ListPortForwards(ctx context.Context, req *pb.ListPortForwardsRequest) (*pb.ListPortForwardsResponse, error) {
+	client, _, closeConn, err := h.agent(req.NodeId)
+	if err != nil {
+		return nil, err
+	}
+	defer closeConn()
+
+	return client.ListPortForwards(ctx, req)
+}
+
+// agent connects to the agent of a node that forwards ports. Agent errors are passed on
+// as they are, so a port conflict keeps its status code.
+func (h *PortForwardHandler) agent(nodeID string) (pb.NodeManagerClient, *models.VPSNode, func(), error) {
+	var node models.VPSNode
+	if err := h.nodeHandler.db.First(&node, "id = ?", nodeID).Error; err != nil {
+		return nil, nil, nil, fmt.Errorf("node not found: %w", err)
+	}
+	if nodeCapability(&node, "port_forward") != "true" {
+		return nil, nil, nil, status.Errorf(codes.FailedPrecondition, "node %s does not forward ports", node.Name)
+	}
+
+	conn, err := h.nodeHandler.connect(nodeID)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to connect to node: %w", err)
+	}
+	return pb.NewNodeManagerClient(conn), &node, func() { conn.Close() }, nil
+}
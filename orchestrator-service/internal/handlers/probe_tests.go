@@ -0,0 +1,225 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"hysteria2_microservices/orchestrator-service/internal/models"
+	pb "hysteria2_microservices/proto"
+)
+
+const (
+	defaultProbeReportLimit = 20
+	maxProbeReportLimit     = 100
+)
+
+// RunProbeTests has another node probe the node the way DPI systems probe suspected proxies
+// and stores the resulting censorship resilience report
+func (h *NodeConfigHandler) RunProbeTests(ctx context.Context, req *pb.RunProbeTestsRequest) (*pb.RunProbeTestsResponse, error) {
+	var node models.VPSNode
+	if err := h.nodeHandler.db.First(&node, "id = ?", req.NodeId).Error; err != nil {
+		return nil, fmt.Errorf("node not found: %w", err)
+	}
+
+	prober, err := h.selectProber(&node, req.ProberNodeId, "probe_runner")
+	if err != nil {
+		return nil, err
+	}
+
+	target := probeTargetForNode(&node, req.Target)
+	if len(target.TlsPorts) == 0 && target.QuicPort == 0 {
+		return nil, fmt.Errorf("node %s has not reported its public ports, pass them in target", node.Name)
+	}
+
+	conn, err := h.nodeHandler.connect(prober.ID.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to prober node: %w", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewNodeManagerClient(conn)
+
+	resp, err := client.RunProbeTests(ctx, &pb.RunProbeTestsRequest{
+		NodeId:       node.ID.String(),
+		ProberNodeId: prober.ID.String(),
+		Target:       target,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to run probe tests on prober node: %w", err)
+	}
+	if !resp.Success || resp.Report == nil {
+		return resp, nil
+	}
+
+	report := models.ProbeReport{
+		NodeID:       node.ID,
+		ProberNodeID: prober.ID,
+		Target:       resp.Report.Target,
+		Score:        int(resp.Report.Score),
+		StartedAt:    time.Unix(resp.Report.StartedAt, 0),
+		FinishedAt:   time.Unix(resp.Report.FinishedAt, 0),
+	}
+	checks := make([]models.ProbeCheck, 0, len(resp.Report.Checks))
+	for _, check := range resp.Report.Checks {
+		checks = append(checks, models.ProbeCheck{
+			Name:       check.Name,
+			Target:     check.Target,
+			Status:     check.Status,
+			Detail:     check.Detail,
+			DurationMs: check.DurationMs,
+		})
+	}
+	if err := report.SetChecks(checks); err != nil {
+		return nil, fmt.Errorf("failed to encode probe checks: %w", err)
+	}
+	if err := h.nodeHandler.db.Create(&report).Error; err != nil {
+		return nil, fmt.Errorf("failed to save probe report: %w", err)
+	}
+
+	return &pb.RunProbeTestsResponse{
+		Success: true,
+		Message: resp.Message,
+		Report:  probeReportToProto(&report),
+	}, nil
+}
+
+// ListProbeReports returns the latest censorship resilience reports of a node, newest first
+func (h *NodeConfigHandler) ListProbeReports(ctx context.Context, req *pb.ListProbeReportsRequest) (*pb.ListProbeReportsResponse, error) {
+	limit := int(req.Limit)
+	if limit <= 0 {
+		limit = defaultProbeReportLimit
+	}
+	if limit > maxProbeReportLimit {
+		limit = maxProbeReportLimit
+	}
+
+	var reports []models.ProbeReport
+	err := h.nodeHandler.db.Where("node_id = ?", req.NodeId).
+		Order("created_at DESC").
+		Limit(limit).
+		Find(&reports).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to get probe reports: %w", err)
+	}
+
+	resp := &pb.ListProbeReportsResponse{
+		Success: true,
+		Message: "Probe reports retrieved successfully",
+		Reports: make([]*pb.ProbeReport, 0, len(reports)),
+	}
+	for i := range reports {
+		resp.Reports = append(resp.Reports, probeReportToProto(&reports[i]))
+	}
+	return resp, nil
+}
+
+// selectProber returns the requested prober, or the most recently seen online node
+// other than the target with the capability to run the checks
+func (h *NodeConfigHandler) selectProber(target *models.VPSNode, proberID, capability string) (*models.VPSNode, error) {
+	if proberID != "" {
+		if proberID == target.ID.String() {
+			return nil, fmt.Errorf("a node cannot probe itself")
+		}
+		var prober models.VPSNode
+		if err := h.nodeHandler.db.First(&prober, "id = ?", proberID).Error; err != nil {
+			return nil, fmt.Errorf("prober node not found: %w", err)
+		}
+		if !prober.IsOnline() {
+			return nil, fmt.Errorf("prober node %s is %s", prober.Name, prober.Status)
+		}
+		return &prober, nil
+	}
+
+	var candidates []models.VPSNode
+	err := h.nodeHandler.db.Where("id <> ? AND status = ?", target.ID, models.NodeStatusOnline).
+		Order("last_heartbeat DESC").
+		Find(&candidates).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to get prober candidates: %w", err)
+	}
+	for i := range candidates {
+		if nodeCapability(&candidates[i], capability) == "true" {
+			return &candidates[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no other online node has the %s capability", capability)
+}
+
+// probeTargetForNode builds the probed surface from the ports and server names the node
+// reported at registration, with any non-empty field of override taking precedence
+func probeTargetForNode(node *models.VPSNode, override *pb.ProbeTarget) *pb.ProbeTarget {
+	target := &pb.ProbeTarget{Host: node.IPAddress}
+
+	for _, port := range strings.Split(nodeCapability(node, "tls_ports"), ",") {
+		if p, err := strconv.Atoi(strings.TrimSpace(port)); err == nil && p > 0 {
+			target.TlsPorts = append(target.TlsPorts, int32(p))
+		}
+	}
+	if node.IsProtocolEnabled(models.ProtocolHysteria2) {
+		if p, err := strconv.Atoi(nodeCapability(node, "hysteria2_port")); err == nil && p > 0 {
+			target.QuicPort = int32(p)
+		}
+	}
+
+	seen := make(map[string]bool)
+	domains := append([]string{node.PrimaryDomain}, node.GetSNIDomains()...)
+	domains = append(domains, strings.Split(nodeCapability(node, "reality_server_names"), ",")...)
+	for _, domain := range domains {
+		domain = strings.TrimSpace(domain)
+		if domain != "" && !seen[domain] {
+			seen[domain] = true
+			target.SniDomains = append(target.SniDomains, domain)
+		}
+	}
+
+	if override != nil {
+		if override.Host != "" {
+			target.Host = override.Host
+		}
+		if len(override.TlsPorts) > 0 {
+			target.TlsPorts = override.TlsPorts
+		}
+		if override.QuicPort > 0 {
+			target.QuicPort = override.QuicPort
+		}
+		if len(override.SniDomains) > 0 {
+			target.SniDomains = override.SniDomains
+		}
+		target.FloodPackets = override.FloodPackets
+	}
+	return target
+}
+
+func nodeCapability(node *models.VPSNode, key string) string {
+	value, ok := node.GetCapability(key)
+	if !ok {
+		return ""
+	}
+	str, _ := value.(string)
+	return str
+}
+
+func probeReportToProto(report *models.ProbeReport) *pb.ProbeReport {
+	result := &pb.ProbeReport{
+		Id:           report.ID.String(),
+		NodeId:       report.NodeID.String(),
+		ProberNodeId: report.ProberNodeID.String(),
+		Target:       report.Target,
+		Score:        int32(report.Score),
+		StartedAt:    report.StartedAt.Unix(),
+		FinishedAt:   report.FinishedAt.Unix(),
+	}
+	for _, check := range report.GetChecks() {
+		result.Checks = append(result.Checks, &pb.ProbeCheck{
+			Name:       check.Name,
+			Target:     check.Target,
+			Status:     check.Status,
+			Detail:     check.Detail,
+			DurationMs: check.DurationMs,
+		})
+	}
+	return result
+}
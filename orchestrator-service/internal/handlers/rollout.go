@@ -0,0 +1,589 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"hysteria2_microservices/orchestrator-service/internal/models"
+	pb "hysteria2_microservices/proto"
+)
+
+const (
+	defaultRolloutCanaryCount = 1
+	defaultRolloutBatchSize   = 5
+	defaultRolloutSoakSeconds = 300
+
+	// The agent downloads, dry-runs and health-checks the release before answering
+	nodeUpgradeTimeout = 10 * time.Minute
+	rolloutPollPeriod  = 10 * time.Second
+)
+
+var rolloutVersionPattern = regexp.MustCompile(`^v\d+\.\d+\.\d+(-[0-9A-Za-z.]+)?$`)
+
+// rolloutCapabilities maps each upgradable component to the agent capability advertising it
+var rolloutCapabilities = map[string]string{
+	models.ComponentHysteria2: "hysteria2_upgrade",
+	models.ComponentXray:      "xray_upgrade",
+}
+
+// componentUpgrade is the outcome of an agent upgrade call for any component
+type componentUpgrade struct {
+	success          bool
+	rolledBack       bool
+	message          string
+	previousVersion  string
+	installedVersion string
+}
+
+// RolloutHandler checks node component versions and upgrades them, either one node at a
+// time or as a staged rollout that stops when canaries or too many batch nodes fail
+type RolloutHandler struct {
+	nodeHandler *NodeHandler
+	logger      *logrus.Logger
+
+	// mu guards rollout node progress while a batch upgrades nodes in parallel
+	mu sync.Mutex
+}
+
+// NewRolloutHandler creates a new RolloutHandler
+func NewRolloutHandler(nodeHandler *NodeHandler, logger *logrus.Logger) *RolloutHandler {
+	return &RolloutHandler{
+		nodeHandler: nodeHandler,
+		logger:      logger,
+	}
+}
+
+// CheckUpdates compares the component releases installed on a node with the latest ones
+func (h *RolloutHandler) CheckUpdates(ctx context.Context, req *pb.CheckUpdatesRequest) (*pb.CheckUpdatesResponse, error) {
+	conn, err := h.nodeHandler.connect(req.NodeId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to node: %w", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewNodeManagerClient(conn)
+
+	resp, err := client.CheckUpdates(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check updates on node: %w", err)
+	}
+	return resp, nil
+}
+
+// UpgradeHysteria2 upgrades a single node outside of a rollout
+func (h *RolloutHandler) UpgradeHysteria2(ctx context.Context, req *pb.UpgradeHysteria2Request) (*pb.UpgradeHysteria2Response, error) {
+	if req.Version != "" && !rolloutVersionPattern.MatchString(req.Version) {
+		return nil, fmt.Errorf("invalid version %q, expected e.g. v2.6.1", req.Version)
+	}
+
+	conn, err := h.nodeHandler.connect(req.NodeId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to node: %w", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewNodeManagerClient(conn)
+
+	ctx, cancel := context.WithTimeout(ctx, nodeUpgradeTimeout)
+	defer cancel()
+
+	resp, err := client.UpgradeHysteria2(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upgrade Hysteria2 on node: %w", err)
+	}
+	return resp, nil
+}
+
+// UpgradeXray upgrades Xray-core on a single node outside of a rollout; the agent migrates
+// the server config when the new release changed its schema
+func (h *RolloutHandler) UpgradeXray(ctx context.Context, req *pb.UpgradeXrayRequest) (*pb.UpgradeXrayResponse, error) {
+	if req.Version != "" && !rolloutVersionPattern.MatchString(req.Version) {
+		return nil, fmt.Errorf("invalid version %q, expected e.g. v25.1.30", req.Version)
+	}
+
+	conn, err := h.nodeHandler.connect(req.NodeId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to node: %w", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewNodeManagerClient(conn)
+
+	ctx, cancel := context.WithTimeout(ctx, nodeUpgradeTimeout)
+	defer cancel()
+
+	resp, err := client.UpgradeXray(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upgrade Xray on node: %w", err)
+	}
+	return resp, nil
+}
+
+// StartRollout plans a staged upgrade and runs it in the background; poll GetRollout for progress
+func (h *RolloutHandler) StartRollout(ctx context.Context, req *pb.StartRolloutRequest) (*pb.StartRolloutResponse, error) {
+	if _, ok := rolloutCapabilities[req.Component]; !ok {
+		return nil, fmt.Errorf("unsupported component %q", req.Component)
+	}
+	if !rolloutVersionPattern.MatchString(req.Version) {
+		return nil, fmt.Errorf("invalid version %q, expected e.g. v2.6.1", req.Version)
+	}
+
+	var active int64
+	err := h.nodeHandler.db.Model(&models.Rollout{}).
+		Where("component = ? AND status IN ?", req.Component,
+			[]string{models.RolloutStatusCanary, models.RolloutStatusSoaking, models.RolloutStatusRolling}).
+		Count(&active).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to check active rollouts: %w", err)
+	}
+	if active > 0 {
+		return nil, fmt.Errorf("a %s rollout is already in progress", req.Component)
+	}
+
+	nodes, err := h.rolloutTargets(req.Component, req.NodeIds)
+	if err != nil {
+		return nil, err
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no online node can be upgraded")
+	}
+
+	canaries, err := selectCanaries(nodes, req.CanaryNodeIds, int(req.CanaryCount))
+	if err != nil {
+		return nil, err
+	}
+
+	rollout := models.Rollout{
+		Component:   req.Component,
+		Version:     req.Version,
+		Status:      models.RolloutStatusCanary,
+		BatchSize:   int(req.BatchSize),
+		SoakSeconds: int(req.SoakSeconds),
+		MaxFailures: int(req.MaxFailures),
+	}
+	if rollout.BatchSize <= 0 {
+		rollout.BatchSize = defaultRolloutBatchSize
+	}
+	if rollout.SoakSeconds <= 0 {
+		rollout.SoakSeconds = defaultRolloutSoakSeconds
+	}
+	if rollout.MaxFailures < 0 {
+		rollout.MaxFailures = 0
+	}
+
+	plan := make([]models.RolloutNode, 0, len(nodes))
+	for i := range nodes {
+		if canaries[nodes[i].ID] {
+			plan = append(plan, newRolloutNode(&nodes[i], "canary"))
+		}
+	}
+	batched := 0
+	for i := range nodes {
+		if !canaries[nodes[i].ID] {
+			stage := fmt.Sprintf("batch-%d", batched/rollout.BatchSize+1)
+			plan = append(plan, newRolloutNode(&nodes[i], stage))
+			batched++
+		}
+	}
+	if err := rollout.SetNodes(plan); err != nil {
+		return nil, fmt.Errorf("failed to encode rollout plan: %w", err)
+	}
+	if err := h.nodeHandler.db.Create(&rollout).Error; err != nil {
+		return nil, fmt.Errorf("failed to save rollout: %w", err)
+	}
+
+	h.logger.Infof("Starting %s %s rollout %s: %d canary and %d batch node(s)",
+		rollout.Component, rollout.Version, rollout.ID, len(plan)-batched, batched)
+	go h.run(rollout, plan)
+
+	return &pb.StartRolloutResponse{
+		Success: true,
+		Message: fmt.Sprintf("Rollout started on %d node(s)", len(plan)),
+		Rollout: rolloutToProto(&rollout),
+	}, nil
+}
+
+// GetRollout returns a rollout with the progress of every node
+func (h *RolloutHandler) GetRollout(ctx context.Context, req *pb.GetRolloutRequest) (*pb.GetRolloutResponse, error) {
+	var rollout models.Rollout
+	if err := h.nodeHandler.db.First(&rollout, "id = ?", req.RolloutId).Error; err != nil {
+		return nil, fmt.Errorf("rollout not found: %w", err)
+	}
+	return &pb.GetRolloutResponse{
+		Success: true,
+		Message: "Rollout retrieved successfully",
+		Rollout: rolloutToProto(&rollout),
+	}, nil
+}
+
+// AbortRollout stops a rollout before its next node; an upgrade already running on a node
+// finishes, with its own rollback on failure
+func (h *RolloutHandler) AbortRollout(ctx context.Context, req *pb.AbortRolloutRequest) (*pb.AbortRolloutResponse, error) {
+	now := time.Now()
+	result := h.nodeHandler.db.Model(&models.Rollout{}).
+		Where("id = ? AND status IN ?", req.RolloutId,
+			[]string{models.RolloutStatusCanary, models.RolloutStatusSoaking, models.RolloutStatusRolling}).
+		Updates(map[string]interface{}{"status": models.RolloutStatusAborted, "finished_at": now})
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to abort rollout: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return nil, fmt.Errorf("rollout %s is not in progress", req.RolloutId)
+	}
+	return &pb.AbortRolloutResponse{
+		Success: true,
+		Message: "Rollout aborted",
+	}, nil
+}
+
+// run upgrades the canaries one by one, waits out the soak period, confirms the canaries
+// still run the new version, then upgrades the remaining nodes batch by batch
+func (h *RolloutHandler) run(rollout models.Rollout, nodes []models.RolloutNode) {
+	ctx := context.Background()
+
+	for i := range nodes {
+		if nodes[i].Stage != "canary" {
+			continue
+		}
+		if h.aborted(rollout.ID) {
+			return
+		}
+		h.upgradeNode(ctx, &rollout, nodes, i)
+		if nodes[i].Status != models.RolloutNodeUpgraded {
+			h.finish(&rollout, models.RolloutStatusFailed,
+				fmt.Sprintf("canary %s did not upgrade: %s", nodes[i].NodeName, nodes[i].Message))
+			return
+		}
+	}
+
+	if !h.setStatus(&rollout, models.RolloutStatusSoaking) {
+		return
+	}
+	deadline := time.Now().Add(time.Duration(rollout.SoakSeconds) * time.Second)
+	for time.Now().Before(deadline) {
+		time.Sleep(min(rolloutPollPeriod, time.Until(deadline)))
+		if h.aborted(rollout.ID) {
+			return
+		}
+	}
+	for i := range nodes {
+		if nodes[i].Stage != "canary" {
+			continue
+		}
+		if err := h.verifyNode(ctx, &rollout, &nodes[i]); err != nil {
+			h.finish(&rollout, models.RolloutStatusFailed,
+				fmt.Sprintf("canary %s failed after the soak period: %v", nodes[i].NodeName, err))
+			return
+		}
+	}
+
+	if !h.setStatus(&rollout, models.RolloutStatusRolling) {
+		return
+	}
+	failures := 0
+	for start := 0; start < len(nodes); {
+		stage := nodes[start].Stage
+		end := start
+		for end < len(nodes) && nodes[end].Stage == stage {
+			end++
+		}
+		if stage == "canary" {
+			start = end
+			continue
+		}
+		if h.aborted(rollout.ID) {
+			return
+		}
+
+		var wg sync.WaitGroup
+		for i := start; i < end; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				h.upgradeNode(ctx, &rollout, nodes, i)
+			}(i)
+		}
+		wg.Wait()
+
+		for i := start; i < end; i++ {
+			if nodes[i].Status == models.RolloutNodeFailed || nodes[i].Status == models.RolloutNodeRolledBack {
+				failures++
+			}
+		}
+		if failures > rollout.MaxFailures {
+			h.finish(&rollout, models.RolloutStatusFailed,
+				fmt.Sprintf("%d node(s) failed to upgrade, %d allowed", failures, rollout.MaxFailures))
+			return
+		}
+		start = end
+	}
+
+	h.finish(&rollout, models.RolloutStatusCompleted, "")
+}
+
+// upgradeNode upgrades nodes[i] and records the outcome. Nodes that are no longer online
+// are skipped; the agent restores the previous binary itself when the upgrade fails.
+func (h *RolloutHandler) upgradeNode(ctx context.Context, rollout *models.Rollout, nodes []models.RolloutNode, i int) {
+	h.mu.Lock()
+	entry := nodes[i]
+	h.mu.Unlock()
+
+	var node models.VPSNode
+	err := h.nodeHandler.db.First(&node, "id = ?", entry.NodeID).Error
+	switch {
+	case err != nil:
+		entry.Status, entry.Message = models.RolloutNodeSkipped, "node no longer exists"
+	case !node.IsOnline():
+		entry.Status, entry.Message = models.RolloutNodeSkipped, fmt.Sprintf("node is %s", node.Status)
+	default:
+		result, err := h.upgradeComponent(ctx, rollout.Component, entry.NodeID.String(), rollout.Version)
+		switch {
+		case err != nil:
+			entry.Status, entry.Message = models.RolloutNodeFailed, err.Error()
+		case result.rolledBack:
+			entry.Status, entry.Message = models.RolloutNodeRolledBack, result.message
+		case !result.success:
+			entry.Status, entry.Message = models.RolloutNodeFailed, result.message
+		default:
+			entry.Status, entry.Message = models.RolloutNodeUpgraded, result.message
+		}
+		if result != nil {
+			entry.PreviousVersion = result.previousVersion
+			entry.InstalledVersion = result.installedVersion
+		}
+	}
+	now := time.Now()
+	entry.FinishedAt = &now
+
+	if entry.Status == models.RolloutNodeUpgraded {
+		h.logger.Infof("Rollout %s: %s upgraded to %s", rollout.ID, entry.NodeName, rollout.Version)
+	} else {
+		h.logger.Warnf("Rollout %s: %s %s: %s", rollout.ID, entry.NodeName, entry.Status, entry.Message)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	nodes[i] = entry
+	if err := rollout.SetNodes(nodes); err != nil {
+		h.logger.Errorf("Failed to encode rollout %s progress: %v", rollout.ID, err)
+		return
+	}
+	if err := h.nodeHandler.db.Model(&models.Rollout{}).Where("id = ?", rollout.ID).
+		Update("nodes", rollout.Nodes).Error; err != nil {
+		h.logger.Errorf("Failed to save rollout %s progress: %v", rollout.ID, err)
+	}
+}
+
+func (h *RolloutHandler) upgradeComponent(ctx context.Context, component, nodeID, version string) (*componentUpgrade, error) {
+	if component == models.ComponentXray {
+		resp, err := h.UpgradeXray(ctx, &pb.UpgradeXrayRequest{NodeId: nodeID, Version: version})
+		if err != nil {
+			return nil, err
+		}
+		return &componentUpgrade{
+			success:          resp.Success,
+			rolledBack:       resp.RolledBack,
+			message:          resp.Message,
+			previousVersion:  resp.PreviousVersion,
+			installedVersion: resp.InstalledVersion,
+		}, nil
+	}
+
+	resp, err := h.UpgradeHysteria2(ctx, &pb.UpgradeHysteria2Request{NodeId: nodeID, Version: version})
+	if err != nil {
+		return nil, err
+	}
+	return &componentUpgrade{
+		success:          resp.Success,
+		rolledBack:       resp.RolledBack,
+		message:          resp.Message,
+		previousVersion:  resp.PreviousVersion,
+		installedVersion: resp.InstalledVersion,
+	}, nil
+}
+
+// verifyNode confirms a node is online and still reports the rollout version
+func (h *RolloutHandler) verifyNode(ctx context.Context, rollout *models.Rollout, entry *models.RolloutNode) error {
+	var node models.VPSNode
+	if err := h.nodeHandler.db.First(&node, "id = ?", entry.NodeID).Error; err != nil {
+		return fmt.Errorf("node not found: %w", err)
+	}
+	if !node.IsOnline() {
+		return fmt.Errorf("node is %s", node.Status)
+	}
+
+	resp, err := h.CheckUpdates(ctx, &pb.CheckUpdatesRequest{NodeId: entry.NodeID.String()})
+	if err != nil {
+		return err
+	}
+	if !resp.Success {
+		return fmt.Errorf("%s", resp.Message)
+	}
+	for _, component := range resp.Components {
+		if component.Name == rollout.Component {
+			if component.Installed != rollout.Version {
+				return fmt.Errorf("node reports %s %s", component.Name, component.Installed)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("node does not report %s", rollout.Component)
+}
+
+// setStatus moves the rollout to the next phase unless it was aborted meanwhile
+func (h *RolloutHandler) setStatus(rollout *models.Rollout, status string) bool {
+	result := h.nodeHandler.db.Model(&models.Rollout{}).
+		Where("id = ? AND status <> ?", rollout.ID, models.RolloutStatusAborted).
+		Update("status", status)
+	if result.Error != nil {
+		h.logger.Errorf("Failed to update rollout %s: %v", rollout.ID, result.Error)
+		return false
+	}
+	rollout.Status = status
+	return result.RowsAffected > 0
+}
+
+func (h *RolloutHandler) finish(rollout *models.Rollout, status, message string) {
+	now := time.Now()
+	err := h.nodeHandler.db.Model(&models.Rollout{}).
+		Where("id = ? AND status <> ?", rollout.ID, models.RolloutStatusAborted).
+		Updates(map[string]interface{}{"status": status, "error": message, "finished_at": now}).Error
+	if err != nil {
+		h.logger.Errorf("Failed to finish rollout %s: %v", rollout.ID, err)
+	}
+
+	if status == models.RolloutStatusCompleted {
+		h.logger.Infof("Rollout %s of %s %s completed", rollout.ID, rollout.Component, rollout.Version)
+	} else {
+		h.logger.Errorf("Rollout %s of %s %s %s: %s", rollout.ID, rollout.Component, rollout.Version, status, message)
+	}
+}
+
+func (h *RolloutHandler) aborted(id uuid.UUID) bool {
+	var rollout models.Rollout
+	if err := h.nodeHandler.db.Select("status").First(&rollout, "id = ?", id).Error; err != nil {
+		h.logger.Errorf("Failed to get rollout %s: %v", id, err)
+		return true
+	}
+	if rollout.Status == models.RolloutStatusAborted {
+		h.logger.Warnf("Rollout %s aborted", id)
+		return true
+	}
+	return false
+}
+
+// rolloutTargets returns the requested nodes, or every online node whose agent can upgrade
+// component, ordered by name
+func (h *RolloutHandler) rolloutTargets(component string, nodeIDs []string) ([]models.VPSNode, error) {
+	var nodes []models.VPSNode
+	query := h.nodeHandler.db.Order("name")
+	if len(nodeIDs) > 0 {
+		query = query.Where("id IN ?", nodeIDs)
+	} else {
+		query = query.Where("status = ?", models.NodeStatusOnline)
+	}
+	if err := query.Find(&nodes).Error; err != nil {
+		return nil, fmt.Errorf("failed to get nodes: %w", err)
+	}
+	if len(nodeIDs) > 0 && len(nodes) != len(nodeIDs) {
+		return nil, fmt.Errorf("%d of %d requested node(s) not found", len(nodeIDs)-len(nodes), len(nodeIDs))
+	}
+
+	targets := nodes[:0]
+	for _, node := range nodes {
+		if nodeCapability(&node, rolloutCapabilities[component]) == "true" {
+			targets = append(targets, node)
+		} else if len(nodeIDs) > 0 {
+			return nil, fmt.Errorf("node %s does not support %s upgrades", node.Name, component)
+		}
+	}
+	return targets, nil
+}
+
+// selectCanaries picks the requested canaries, else the nodes marked canary in their
+// metadata, else the first count nodes
+func selectCanaries(nodes []models.VPSNode, canaryIDs []string, count int) (map[uuid.UUID]bool, error) {
+	canaries := make(map[uuid.UUID]bool)
+
+	if len(canaryIDs) > 0 {
+		byID := make(map[string]uuid.UUID, len(nodes))
+		for _, node := range nodes {
+			byID[node.ID.String()] = node.ID
+		}
+		for _, id := range canaryIDs {
+			nodeID, ok := byID[strings.ToLower(id)]
+			if !ok {
+				return nil, fmt.Errorf("canary node %s is not part of the rollout", id)
+			}
+			canaries[nodeID] = true
+		}
+		return canaries, nil
+	}
+
+	for i := range nodes {
+		if value, ok := nodes[i].GetMetadata("canary"); ok && (value == true || value == "true") {
+			canaries[nodes[i].ID] = true
+		}
+	}
+	if len(canaries) > 0 {
+		return canaries, nil
+	}
+
+	if count <= 0 {
+		count = defaultRolloutCanaryCount
+	}
+	for i := 0; i < count && i < len(nodes); i++ {
+		canaries[nodes[i].ID] = true
+	}
+	return canaries, nil
+}
+
+func newRolloutNode(node *models.VPSNode, stage string) models.RolloutNode {
+	return models.RolloutNode{
+		NodeID:   node.ID,
+		NodeName: node.Name,
+		Stage:    stage,
+		Status:   models.RolloutNodePending,
+	}
+}
+
+func rolloutToProto(rollout *models.Rollout) *pb.Rollout {
+	result := &pb.Rollout{
+		Id:          rollout.ID.String(),
+		Component:   rollout.Component,
+		Version:     rollout.Version,
+		Status:      rollout.Status,
+		BatchSize:   int32(rollout.BatchSize),
+		SoakSeconds: int32(rollout.SoakSeconds),
+		MaxFailures: int32(rollout.MaxFailures),
+		Error:       rollout.Error,
+		CreatedAt:   rollout.CreatedAt.Unix(),
+	}
+	if rollout.FinishedAt != nil {
+		result.FinishedAt = rollout.FinishedAt.Unix()
+	}
+
+	for _, node := range rollout.GetNodes() {
+		entry := &pb.RolloutNode{
+			NodeId:           node.NodeID.String(),
+			NodeName:         node.NodeName,
+			Stage:            node.Stage,
+			Status:           node.Status,
+			PreviousVersion:  node.PreviousVersion,
+			InstalledVersion: node.InstalledVersion,
+			Message:          node.Message,
+		}
+		if node.FinishedAt != nil {
+			entry.FinishedAt = node.FinishedAt.Unix()
+		}
+		result.Nodes = append(result.Nodes, entry)
+	}
+	return result
+}
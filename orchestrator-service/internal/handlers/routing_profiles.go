@@ -0,0 +1,427 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"hysteria2_microservices/orchestrator-service/internal/models"
+	pb "hysteria2_microservices/proto"
+)
+
+// ListRoutingProfiles returns every routing profile with its assignments, and the presets
+// rules can use
+func (h *NodeConfigHandler) ListRoutingProfiles(ctx context.Context, req *pb.ListRoutingProfilesRequest) (*pb.ListRoutingProfilesResponse, error) {
+	var profiles []models.RoutingProfile
+	if err := h.nodeHandler.db.Preload("Assignments").Order("name").Find(&profiles).Error; err != nil {
+		return nil, fmt.Errorf("failed to get routing profiles: %w", err)
+	}
+
+	resp := &pb.ListRoutingProfilesResponse{
+		Success:  true,
+		Message:  "Routing profiles retrieved successfully",
+		Profiles: make([]*pb.RoutingProfile, 0, len(profiles)),
+		Presets:  make([]*pb.RoutingPreset, 0, len(models.RoutingPresets)),
+	}
+	for i := range profiles {
+		resp.Profiles = append(resp.Profiles, routingProfileToProto(&profiles[i]))
+	}
+	for _, preset := range models.RoutingPresets {
+		resp.Presets = append(resp.Presets, &pb.RoutingPreset{
+			Name:        preset.Name,
+			Description: preset.Description,
+			Domains:     preset.Domains,
+			Ips:         preset.IPs,
+		})
+	}
+	return resp, nil
+}
+
+// SaveRoutingProfile creates a profile, or updates it when an ID is given, and pushes the
+// change to the nodes it is assigned to
+func (h *NodeConfigHandler) SaveRoutingProfile(ctx context.Context, req *pb.SaveRoutingProfileRequest) (*pb.SaveRoutingProfileResponse, error) {
+	if req.Profile == nil {
+		return nil, fmt.Errorf("routing profile is required")
+	}
+
+	profile := models.RoutingProfile{}
+	if req.Profile.Id != "" {
+		if err := h.nodeHandler.db.Preload("Assignments").First(&profile, "id = ?", req.Profile.Id).Error; err != nil {
+			return nil, fmt.Errorf("routing profile not found: %w", err)
+		}
+	}
+	profile.Name = req.Profile.Name
+	profile.Description = req.Profile.Description
+
+	outbounds := make([]models.RoutingOutbound, 0, len(req.Profile.Outbounds))
+	for _, outbound := range req.Profile.Outbounds {
+		outbounds = append(outbounds, models.RoutingOutbound{
+			Name:     outbound.Name,
+			Type:     outbound.Type,
+			NodeID:   outbound.NodeId,
+			Address:  outbound.Address,
+			Port:     int(outbound.Port),
+			Username: outbound.Username,
+			Password: outbound.Password,
+			Method:   outbound.Method,
+			SNI:      outbound.Sni,
+		})
+	}
+	rules := make([]models.RoutingRule, 0, len(req.Profile.Rules))
+	for _, rule := range req.Profile.Rules {
+		rules = append(rules, models.RoutingRule{
+			Domains:   rule.Domains,
+			IPs:       rule.Ips,
+			Presets:   rule.Presets,
+			Outbounds: rule.Outbounds,
+			Strategy:  rule.Strategy,
+		})
+	}
+	if err := profile.SetOutbounds(outbounds); err != nil {
+		return nil, fmt.Errorf("failed to encode outbounds: %w", err)
+	}
+	if err := profile.SetRules(rules); err != nil {
+		return nil, fmt.Errorf("failed to encode rules: %w", err)
+	}
+	if err := profile.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid routing profile: %w", err)
+	}
+	for _, outbound := range outbounds {
+		if outbound.NodeID == "" {
+			continue
+		}
+		var node models.VPSNode
+		if err := h.nodeHandler.db.Select("id").First(&node, "id = ?", outbound.NodeID).Error; err != nil {
+			return nil, fmt.Errorf("outbound %s: node not found: %w", outbound.Name, err)
+		}
+	}
+
+	if err := h.nodeHandler.db.Omit("Assignments").Save(&profile).Error; err != nil {
+		return nil, fmt.Errorf("failed to save routing profile: %w", err)
+	}
+
+	failures, err := h.syncRoutingProfiles(ctx, profile.Assignments)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.SaveRoutingProfileResponse{
+		Success:  len(failures) == 0,
+		Message:  filterSyncMessage("Routing profile saved", failures),
+		Profile:  routingProfileToProto(&profile),
+		Failures: failures,
+	}, nil
+}
+
+// DeleteRoutingProfile removes a profile and its assignments and pushes the change to the
+// affected nodes
+func (h *NodeConfigHandler) DeleteRoutingProfile(ctx context.Context, req *pb.DeleteRoutingProfileRequest) (*pb.DeleteRoutingProfileResponse, error) {
+	var profile models.RoutingProfile
+	if err := h.nodeHandler.db.Preload("Assignments").First(&profile, "id = ?", req.ProfileId).Error; err != nil {
+		return nil, fmt.Errorf("routing profile not found: %w", err)
+	}
+
+	err := h.nodeHandler.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("profile_id = ?", profile.ID).Delete(&models.RoutingProfileAssignment{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&profile).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete routing profile: %w", err)
+	}
+
+	failures, err := h.syncRoutingProfiles(ctx, profile.Assignments)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.DeleteRoutingProfileResponse{
+		Success:  len(failures) == 0,
+		Message:  filterSyncMessage("Routing profile deleted", failures),
+		Failures: failures,
+	}, nil
+}
+
+// SetRoutingProfileAssignments replaces the nodes and user groups a profile applies to
+func (h *NodeConfigHandler) SetRoutingProfileAssignments(ctx context.Context, req *pb.SetRoutingProfileAssignmentsRequest) (*pb.SetRoutingProfileAssignmentsResponse, error) {
+	var profile models.RoutingProfile
+	if err := h.nodeHandler.db.Preload("Assignments").First(&profile, "id = ?", req.ProfileId).Error; err != nil {
+		return nil, fmt.Errorf("routing profile not found: %w", err)
+	}
+
+	assignments := make([]models.RoutingProfileAssignment, 0, len(req.Assignments))
+	for i, assignment := range req.Assignments {
+		ra := models.RoutingProfileAssignment{ProfileID: profile.ID, UserGroup: assignment.UserGroup}
+		if assignment.NodeId != "" {
+			nodeID, err := uuid.Parse(assignment.NodeId)
+			if err != nil {
+				return nil, fmt.Errorf("assignment %d: invalid node ID: %s", i+1, assignment.NodeId)
+			}
+			var node models.VPSNode
+			if err := h.nodeHandler.db.First(&node, "id = ?", nodeID).Error; err != nil {
+				return nil, fmt.Errorf("assignment %d: node not found: %w", i+1, err)
+			}
+			ra.NodeID = &nodeID
+		}
+		assignments = append(assignments, ra)
+	}
+
+	err := h.nodeHandler.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("profile_id = ?", profile.ID).Delete(&models.RoutingProfileAssignment{}).Error; err != nil {
+			return err
+		}
+		if len(assignments) == 0 {
+			return nil
+		}
+		return tx.Create(&assignments).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to save routing profile assignments: %w", err)
+	}
+
+	// Nodes that lose the profile need the update as much as the ones that gain it
+	failures, err := h.syncRoutingProfiles(ctx, append(profile.Assignments, assignments...))
+	if err != nil {
+		return nil, err
+	}
+	return &pb.SetRoutingProfileAssignmentsResponse{
+		Success:  len(failures) == 0,
+		Message:  filterSyncMessage("Routing profile assignments saved", failures),
+		Failures: failures,
+	}, nil
+}
+
+// syncRoutingProfiles pushes the current profiles to every node touched by assignments and
+// returns the nodes that could not be updated. An assignment without a node touches all nodes.
+func (h *NodeConfigHandler) syncRoutingProfiles(ctx context.Context, assignments []models.RoutingProfileAssignment) (map[string]string, error) {
+	failures := make(map[string]string)
+	if len(assignments) == 0 {
+		return failures, nil
+	}
+
+	query := h.nodeHandler.db
+	allNodes := false
+	var nodeIDs []uuid.UUID
+	for _, assignment := range assignments {
+		if assignment.NodeID == nil {
+			allNodes = true
+			break
+		}
+		nodeIDs = append(nodeIDs, *assignment.NodeID)
+	}
+	if !allNodes {
+		query = query.Where("id IN ?", nodeIDs)
+	}
+
+	var nodes []models.VPSNode
+	if err := query.Find(&nodes).Error; err != nil {
+		return nil, fmt.Errorf("failed to get nodes: %w", err)
+	}
+
+	for i := range nodes {
+		if err := h.pushRoutingProfiles(ctx, &nodes[i]); err != nil {
+			failures[nodes[i].ID.String()] = err.Error()
+		}
+	}
+	return failures, nil
+}
+
+func (h *NodeConfigHandler) pushRoutingProfiles(ctx context.Context, node *models.VPSNode) error {
+	profiles, err := h.nodeRoutingProfiles(node)
+	if err != nil {
+		return err
+	}
+
+	conn, err := h.nodeHandler.connect(node.ID.String())
+	if err != nil {
+		return fmt.Errorf("failed to connect to node: %w", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewNodeManagerClient(conn)
+
+	resp, err := client.SetRoutingProfiles(ctx, &pb.SetRoutingProfilesRequest{
+		NodeId:   node.ID.String(),
+		Profiles: profiles,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to push routing profiles: %w", err)
+	}
+	if !resp.Success {
+		return fmt.Errorf("node rejected routing profiles: %s", resp.Message)
+	}
+	return nil
+}
+
+// nodeRoutingProfiles resolves the profiles assigned to a node the way nodeFilterLists
+// resolves filter lists, then expands presets and points node outbounds at the node's
+// address. Traffic a profile sends through the node itself leaves it directly.
+func (h *NodeConfigHandler) nodeRoutingProfiles(node *models.VPSNode) ([]*pb.RoutingProfile, error) {
+	db := h.nodeHandler.db
+
+	var assignments []models.RoutingProfileAssignment
+	if err := db.Where("node_id = ? OR node_id IS NULL", node.ID).Find(&assignments).Error; err != nil {
+		return nil, fmt.Errorf("failed to get routing profile assignments: %w", err)
+	}
+
+	everyone := make(map[uuid.UUID]bool)
+	groups := make(map[uuid.UUID][]string)
+	for _, assignment := range assignments {
+		if assignment.UserGroup == "" {
+			everyone[assignment.ProfileID] = true
+		} else {
+			groups[assignment.ProfileID] = append(groups[assignment.ProfileID], assignment.UserGroup)
+		}
+	}
+	profileIDs := make([]uuid.UUID, 0, len(everyone)+len(groups))
+	for id := range everyone {
+		profileIDs = append(profileIDs, id)
+	}
+	for id := range groups {
+		if !everyone[id] {
+			profileIDs = append(profileIDs, id)
+		}
+	}
+	if len(profileIDs) == 0 {
+		return []*pb.RoutingProfile{}, nil
+	}
+
+	var profiles []models.RoutingProfile
+	if err := db.Where("id IN ?", profileIDs).Order("name").Find(&profiles).Error; err != nil {
+		return nil, fmt.Errorf("failed to get routing profiles: %w", err)
+	}
+
+	result := make([]*pb.RoutingProfile, 0, len(profiles))
+	for i := range profiles {
+		profile, err := h.resolveRoutingProfile(&profiles[i], node)
+		if err != nil {
+			return nil, fmt.Errorf("routing profile %s: %w", profiles[i].Name, err)
+		}
+
+		if !everyone[profiles[i].ID] {
+			emails, err := h.groupUserEmails(node.ID, groups[profiles[i].ID])
+			if err != nil {
+				return nil, fmt.Errorf("failed to get users of routing profile %s: %w", profiles[i].Name, err)
+			}
+			if len(emails) == 0 {
+				continue
+			}
+			profile.Users = emails
+		}
+		result = append(result, profile)
+	}
+	return result, nil
+}
+
+// resolveRoutingProfile returns the profile as pushed to node
+func (h *NodeConfigHandler) resolveRoutingProfile(profile *models.RoutingProfile, node *models.VPSNode) (*pb.RoutingProfile, error) {
+	result := &pb.RoutingProfile{
+		Name:        profile.Name,
+		Description: profile.Description,
+	}
+
+	// Outbounds through the node itself become direct
+	self := make(map[string]bool)
+	for _, outbound := range profile.GetOutbounds() {
+		address := outbound.Address
+		if outbound.NodeID != "" {
+			if outbound.NodeID == node.ID.String() {
+				self[outbound.Name] = true
+				continue
+			}
+			var target models.VPSNode
+			if err := h.nodeHandler.db.Select("id", "ip_address").First(&target, "id = ?", outbound.NodeID).Error; err != nil {
+				return nil, fmt.Errorf("outbound %s: node not found: %w", outbound.Name, err)
+			}
+			if address == "" {
+				address = target.IPAddress
+			}
+		}
+		result.Outbounds = append(result.Outbounds, &pb.RoutingOutbound{
+			Name:     outbound.Name,
+			Type:     outbound.Type,
+			Address:  address,
+			Port:     int32(outbound.Port),
+			Username: outbound.Username,
+			Password: outbound.Password,
+			Method:   outbound.Method,
+			Sni:      outbound.SNI,
+		})
+	}
+
+	for i, rule := range profile.GetRules() {
+		resolved := &pb.RoutingRule{
+			Domains:  append([]string{}, rule.Domains...),
+			Ips:      append([]string{}, rule.IPs...),
+			Strategy: rule.Strategy,
+		}
+		for _, name := range rule.Presets {
+			preset := models.FindRoutingPreset(name)
+			if preset == nil {
+				return nil, fmt.Errorf("rule %d: unknown preset %q", i+1, name)
+			}
+			if preset.Name == models.RoutingPresetLocal {
+				if node.Country == "" {
+					return nil, fmt.Errorf("rule %d: preset %q needs the node's country", i+1, name)
+				}
+				resolved.Ips = append(resolved.Ips, "geoip:"+strings.ToLower(node.Country))
+				continue
+			}
+			resolved.Domains = append(resolved.Domains, preset.Domains...)
+			resolved.Ips = append(resolved.Ips, preset.IPs...)
+		}
+
+		seen := make(map[string]bool, len(rule.Outbounds))
+		for _, name := range rule.Outbounds {
+			if self[name] {
+				name = models.RoutingOutboundDirect
+			}
+			if !seen[name] {
+				seen[name] = true
+				resolved.Outbounds = append(resolved.Outbounds, name)
+			}
+		}
+		result.Rules = append(result.Rules, resolved)
+	}
+	return result, nil
+}
+
+func routingProfileToProto(profile *models.RoutingProfile) *pb.RoutingProfile {
+	result := &pb.RoutingProfile{
+		Id:          profile.ID.String(),
+		Name:        profile.Name,
+		Description: profile.Description,
+	}
+	for _, outbound := range profile.GetOutbounds() {
+		result.Outbounds = append(result.Outbounds, &pb.RoutingOutbound{
+			Name:     outbound.Name,
+			Type:     outbound.Type,
+			NodeId:   outbound.NodeID,
+			Address:  outbound.Address,
+			Port:     int32(outbound.Port),
+			Username: outbound.Username,
+			Password: outbound.Password,
+			Method:   outbound.Method,
+			Sni:      outbound.SNI,
+		})
+	}
+	for _, rule := range profile.GetRules() {
+		result.Rules = append(result.Rules, &pb.RoutingRule{
+			Domains:   rule.Domains,
+			Ips:       rule.IPs,
+			Presets:   rule.Presets,
+			Outbounds: rule.Outbounds,
+			Strategy:  rule.Strategy,
+		})
+	}
+	for _, assignment := range profile.Assignments {
+		ra := &pb.RoutingProfileAssignment{UserGroup: assignment.UserGroup}
+		if assignment.NodeID != nil {
+			ra.NodeId = assignment.NodeID.String()
+		}
+		result.Assignments = append(result.Assignments, ra)
+	}
+	return result
+}
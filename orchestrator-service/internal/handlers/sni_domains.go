@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"hysteria2_microservices/orchestrator-service/internal/models"
+	pb "hysteria2_microservices/proto"
+)
+
+const (
+	sniDNSCheckTimeout = 5 * time.Second
+
+	// wildcardProbeLabel is resolved in place of the "*" of a wildcard domain: a wildcard
+	// record answers for any label
+	wildcardProbeLabel = "sni-check"
+)
+
+// normalizeSNIDomains normalizes a domain list and rejects names listed twice, including
+// spellings that normalize to the same name
+func normalizeSNIDomains(domains []string) ([]string, error) {
+	normalized := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		name, err := models.NormalizeSNIDomain(domain)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if containsDomain(normalized, name) {
+			return nil, codedError(codes.InvalidArgument, pb.ErrorCode_ERROR_CODE_DOMAIN_CONFLICT,
+				map[string]string{"domain": name}, "domain %s is listed twice", name)
+		}
+		normalized = append(normalized, name)
+	}
+	return normalized, nil
+}
+
+// checkSNIConflicts rejects domains that match a server name of another node's SNI domain,
+// wildcards included: clients would reach whichever node DNS happens to point at
+func (h *NodeConfigHandler) checkSNIConflicts(nodeID string, domains []string) error {
+	if len(domains) == 0 {
+		return nil
+	}
+
+	var nodes []models.VPSNode
+	if err := h.nodeHandler.db.Select("id", "sni_domains").Where("id <> ?", nodeID).Find(&nodes).Error; err != nil {
+		return fmt.Errorf("failed to get nodes: %w", err)
+	}
+	for _, node := range nodes {
+		for _, existing := range node.GetSNIDomains() {
+			for _, domain := range domains {
+				if models.SNIDomainsOverlap(domain, existing) {
+					return codedError(codes.AlreadyExists, pb.ErrorCode_ERROR_CODE_DOMAIN_CONFLICT,
+						map[string]string{"domain": domain, "node_id": node.ID.String()},
+						"domain %s conflicts with %s on node %s", domain, existing, node.ID)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func containsDomain(domains []string, domain string) bool {
+	for _, d := range domains {
+		if d == domain {
+			return true
+		}
+	}
+	return false
+}
+
+func checkSNIDomainsDNS(ctx context.Context, domains []string, nodeIP string) []*pb.SNIDomainCheck {
+	checks := make([]*pb.SNIDomainCheck, 0, len(domains))
+	for _, domain := range domains {
+		checks = append(checks, checkSNIDomainDNS(ctx, domain, nodeIP))
+	}
+	return checks
+}
+
+// checkSNIDomainDNS checks that a normalized domain resolves to the node's registered
+// address. The result is reported, not enforced: DNS may be updated after the node is
+// configured.
+func checkSNIDomainDNS(ctx context.Context, domain, nodeIP string) *pb.SNIDomainCheck {
+	check := &pb.SNIDomainCheck{Domain: domain}
+
+	name := domain
+	if strings.HasPrefix(name, "*.") {
+		name = wildcardProbeLabel + name[1:]
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, sniDNSCheckTimeout)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+	if err != nil {
+		check.Message = fmt.Sprintf("DNS lookup failed: %v", err)
+		return check
+	}
+
+	target := net.ParseIP(nodeIP)
+	records := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if addr.IP.Equal(target) {
+			check.ResolvesToNode = true
+			return check
+		}
+		records = append(records, addr.IP.String())
+	}
+	check.Message = fmt.Sprintf("resolves to %s, not to node address %s", strings.Join(records, ", "), nodeIP)
+	return check
+}
@@ -0,0 +1,276 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"hysteria2_microservices/orchestrator-service/internal/cloudflare"
+	"hysteria2_microservices/orchestrator-service/internal/config"
+	"hysteria2_microservices/orchestrator-service/internal/models"
+	pb "hysteria2_microservices/proto"
+)
+
+const (
+	// sniRecordTTL keeps onboarded records short-lived so a moved domain follows quickly
+	sniRecordTTL = 60
+
+	sniResolvePollInterval = 10 * time.Second
+	maxSNIWait             = 10 * time.Minute
+)
+
+// SNIOnboardingHandler adds SNI domains to nodes in one call: it points the domain at the
+// node through the Cloudflare API, waits for it to resolve, adds it to the node and issues
+// its certificate
+type SNIOnboardingHandler struct {
+	nodeConfig *NodeConfigHandler
+	cloudflare config.CloudflareConfig
+	config     config.DNSConfig
+	logger     *logrus.Logger
+}
+
+// NewSNIOnboardingHandler creates a new SNIOnboardingHandler
+func NewSNIOnboardingHandler(nodeConfig *NodeConfigHandler, cloudflareCfg config.CloudflareConfig, cfg config.DNSConfig, logger *logrus.Logger) *SNIOnboardingHandler {
+	return &SNIOnboardingHandler{
+		nodeConfig: nodeConfig,
+		cloudflare: cloudflareCfg,
+		config:     cfg,
+		logger:     logger,
+	}
+}
+
+// OnboardSNIDomain creates or checks the domain's records, adds the domain to the node once
+// it resolves there and issues its Let's Encrypt certificate. A domain that does not
+// resolve in time is still added, so calling again later only retries the certificate.
+func (h *SNIOnboardingHandler) OnboardSNIDomain(ctx context.Context, req *pb.OnboardSNIDomainRequest) (*pb.OnboardSNIDomainResponse, error) {
+	domain, err := models.NormalizeSNIDomain(req.Domain)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if req.IssueCertificate && strings.HasPrefix(domain, "*.") {
+		return nil, status.Errorf(codes.InvalidArgument, "wildcard certificates of %s cannot be issued with the HTTP-01 challenge", domain)
+	}
+
+	db := h.nodeConfig.nodeHandler.db
+	var node models.VPSNode
+	if err := db.First(&node, "id = ?", req.NodeId).Error; err != nil {
+		return nil, fmt.Errorf("node not found: %w", err)
+	}
+	if err := h.nodeConfig.checkSNIConflicts(req.NodeId, []string{domain}); err != nil {
+		return nil, err
+	}
+
+	records := dnsRecordsFor([]models.VPSNode{node})
+	if len(records) == 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "node %s has no public address", node.Name)
+	}
+	if req.ManageDns {
+		if err := h.ensureRecords(ctx, domain, records, req.Overwrite); err != nil {
+			return nil, err
+		}
+	}
+
+	resp := &pb.OnboardSNIDomainResponse{
+		DnsRecords: make([]*pb.DNSRecord, 0, len(records)),
+	}
+	for _, record := range records {
+		resp.DnsRecords = append(resp.DnsRecords, &pb.DNSRecord{
+			Type:    record.Type,
+			Content: record.Content,
+			NodeId:  record.NodeID,
+		})
+	}
+
+	wait := time.Duration(h.config.SNIWait) * time.Second
+	if req.WaitSeconds > 0 {
+		wait = time.Duration(req.WaitSeconds) * time.Second
+	}
+	if wait > maxSNIWait {
+		wait = maxSNIWait
+	}
+	resp.DnsCheck = waitForSNIDomain(ctx, domain, node.IPAddress, wait)
+
+	if !node.HasSNIDomain(domain) {
+		node.AddSNIDomain(domain)
+		node.SNIEnabled = true
+		if node.PrimaryDomain == "" {
+			node.PrimaryDomain = domain
+		}
+		if err := db.Save(&node).Error; err != nil {
+			return nil, fmt.Errorf("failed to update node: %w", err)
+		}
+	}
+	checks, err := h.nodeConfig.pushSNIConfig(ctx, &node)
+	if err != nil {
+		return nil, err
+	}
+	// The node checks against all of its public addresses, IPv6 included
+	for _, check := range checks {
+		if check.Domain == domain {
+			resp.DnsCheck = check
+		}
+	}
+
+	if !resp.DnsCheck.ResolvesToNode {
+		resp.Message = fmt.Sprintf("Domain %s added to node %s but does not resolve to it yet: %s", domain, node.Name, resp.DnsCheck.Message)
+		return resp, nil
+	}
+	if !req.IssueCertificate {
+		resp.Success = true
+		resp.Message = fmt.Sprintf("Domain %s added to node %s", domain, node.Name)
+		return resp, nil
+	}
+
+	email := req.Email
+	if email == "" {
+		email = node.SNIEmail
+	}
+	conn, err := h.nodeConfig.nodeHandler.connect(req.NodeId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to node: %w", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewNodeManagerClient(conn)
+
+	certResp, err := client.IssueCertificate(ctx, &pb.IssueCertificateRequest{
+		NodeId: req.NodeId,
+		Domain: domain,
+		Email:  email,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue certificate on node: %w", err)
+	}
+	if !certResp.Success {
+		resp.Message = fmt.Sprintf("Domain %s added to node %s, certificate not issued: %s", domain, node.Name, certResp.Message)
+		return resp, nil
+	}
+
+	resp.Success = true
+	resp.Message = fmt.Sprintf("Domain %s added to node %s with a certificate issued by %s", domain, node.Name, certResp.Issuer)
+	resp.CertificateIssued = true
+	resp.CertificateIssuer = certResp.Issuer
+	resp.CertificateNotAfter = certResp.NotAfter
+	return resp, nil
+}
+
+// RemoveNodeSNIDomain takes a domain off a node. Its DNS records are kept, other nodes may
+// still be onboarded with them.
+func (h *SNIOnboardingHandler) RemoveNodeSNIDomain(ctx context.Context, req *pb.RemoveNodeSNIDomainRequest) (*pb.RemoveNodeSNIDomainResponse, error) {
+	node, err := h.nodeConfig.RemoveSNIDomain(ctx, req.NodeId, req.Domain)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.RemoveNodeSNIDomainResponse{
+		Success:       true,
+		Message:       fmt.Sprintf("Domain %s removed from node %s", req.Domain, node.Name),
+		Domains:       node.GetSNIDomains(),
+		PrimaryDomain: node.PrimaryDomain,
+	}, nil
+}
+
+// ensureRecords points the domain's A and AAAA records at the node's addresses. Records
+// pointing elsewhere, or proxied ones Cloudflare would not pass QUIC through, are replaced
+// only with overwrite.
+func (h *SNIOnboardingHandler) ensureRecords(ctx context.Context, domain string, records []models.DNSRecord, overwrite bool) error {
+	client, err := cloudflare.NewClientForDomain(h.cloudflare, domain)
+	if err != nil {
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+
+	existing, err := client.ListRecords(ctx, domain, "")
+	if err != nil {
+		return fmt.Errorf("failed to list records of %s: %w", domain, err)
+	}
+	for _, record := range existing {
+		if record.Type == "CNAME" {
+			return codedError(codes.FailedPrecondition, pb.ErrorCode_ERROR_CODE_DOMAIN_CONFLICT,
+				map[string]string{"domain": domain}, "%s is a CNAME to %s, remove it first", domain, record.Content)
+		}
+	}
+
+	for _, recordType := range []string{"A", "AAAA"} {
+		wanted := make(map[string]bool)
+		for _, record := range records {
+			if record.Type == recordType {
+				wanted[record.Content] = true
+			}
+		}
+
+		found := make(map[string]bool)
+		var proxied, stale []cloudflare.Record
+		for _, record := range existing {
+			switch {
+			case record.Type != recordType:
+			case wanted[record.Content] && !record.Proxied:
+				found[record.Content] = true
+			case wanted[record.Content] && !found[record.Content]:
+				found[record.Content] = true
+				proxied = append(proxied, record)
+			default:
+				stale = append(stale, record)
+			}
+		}
+		if conflicting := append(proxied, stale...); len(conflicting) > 0 && !overwrite {
+			return codedError(codes.FailedPrecondition, pb.ErrorCode_ERROR_CODE_DOMAIN_CONFLICT,
+				map[string]string{"domain": domain}, "%s record %s of %s points elsewhere or is proxied, set overwrite to replace it",
+				recordType, conflicting[0].Content, domain)
+		}
+
+		for content := range wanted {
+			if found[content] {
+				continue
+			}
+			if _, err := client.CreateRecord(ctx, sniRecord(domain, recordType, content)); err != nil {
+				return fmt.Errorf("failed to create %s record of %s: %w", recordType, domain, err)
+			}
+			h.logger.Infof("Created %s %s %s", domain, recordType, content)
+		}
+		for _, record := range proxied {
+			if _, err := client.UpdateRecord(ctx, record.ID, sniRecord(domain, recordType, record.Content)); err != nil {
+				return fmt.Errorf("failed to update %s record %s of %s: %w", recordType, record.Content, domain, err)
+			}
+			h.logger.Infof("Disabled proxying of %s %s %s", domain, recordType, record.Content)
+		}
+		for _, record := range stale {
+			if err := client.DeleteRecord(ctx, record.ID); err != nil {
+				return fmt.Errorf("failed to delete %s record %s of %s: %w", recordType, record.Content, domain, err)
+			}
+			h.logger.Infof("Replaced %s %s %s", domain, recordType, record.Content)
+		}
+	}
+	return nil
+}
+
+func sniRecord(domain, recordType, content string) cloudflare.Record {
+	return cloudflare.Record{
+		Type:    recordType,
+		Name:    domain,
+		Content: content,
+		TTL:     sniRecordTTL,
+		Comment: dnsRecordComment,
+	}
+}
+
+// waitForSNIDomain checks the domain until it resolves to the node or wait runs out
+func waitForSNIDomain(ctx context.Context, domain, nodeIP string, wait time.Duration) *pb.SNIDomainCheck {
+	deadline := time.Now().Add(wait)
+	for {
+		check := checkSNIDomainDNS(ctx, domain, nodeIP)
+		if check.ResolvesToNode || time.Now().Add(sniResolvePollInterval).After(deadline) {
+			return check
+		}
+
+		select {
+		case <-time.After(sniResolvePollInterval):
+		case <-ctx.Done():
+			return check
+		}
+	}
+}
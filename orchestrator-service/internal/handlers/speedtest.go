@@ -0,0 +1,293 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"hysteria2_microservices/orchestrator-service/internal/config"
+	"hysteria2_microservices/orchestrator-service/internal/models"
+	pb "hysteria2_microservices/proto"
+)
+
+const (
+	defaultSpeedtestWindowHours = 24
+	defaultBestNodesLimit       = 5
+	speedtestHistoryRetention   = 30 * 24 * time.Hour
+)
+
+// SpeedtestHandler runs speedtests from nodes to the configured reflectors, on demand and
+// on a schedule, and ranks nodes per client region from the stored measurements
+type SpeedtestHandler struct {
+	leadership
+	nodeHandler *NodeHandler
+	config      config.SpeedtestConfig
+	logger      *logrus.Logger
+}
+
+// NewSpeedtestHandler creates a new SpeedtestHandler
+func NewSpeedtestHandler(nodeHandler *NodeHandler, cfg config.SpeedtestConfig, logger *logrus.Logger) *SpeedtestHandler {
+	return &SpeedtestHandler{
+		nodeHandler: nodeHandler,
+		config:      cfg,
+		logger:      logger,
+	}
+}
+
+// Start measures every online node once per interval until ctx is cancelled, while this
+// replica leads
+func (h *SpeedtestHandler) Start(ctx context.Context) {
+	if !h.config.Enabled || len(h.config.Reflectors) == 0 {
+		h.logger.Info("Scheduled speedtests disabled")
+		return
+	}
+
+	interval := time.Duration(h.config.Interval) * time.Second
+	if interval <= 0 {
+		interval = 6 * time.Hour
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if h.leading() {
+				h.runRound(ctx)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	h.logger.Infof("Scheduled speedtests every %s against %d reflectors", interval, len(h.config.Reflectors))
+}
+
+// runRound measures nodes one after another, since an iperf3 reflector serves a single test at a time
+func (h *SpeedtestHandler) runRound(ctx context.Context) {
+	var nodes []models.VPSNode
+	if err := h.nodeHandler.db.Where("status = ?", models.NodeStatusOnline).Find(&nodes).Error; err != nil {
+		h.logger.Errorf("Failed to get nodes for speedtests: %v", err)
+		return
+	}
+
+	measured := 0
+	for i := range nodes {
+		if ctx.Err() != nil {
+			return
+		}
+		if nodeCapability(&nodes[i], "speedtest") != "true" {
+			continue
+		}
+		if _, err := h.runNode(ctx, &nodes[i], h.reflectorsToProto(), int32(h.config.Duration)); err != nil {
+			h.logger.Warnf("Speedtest on node %s failed: %v", nodes[i].Name, err)
+			continue
+		}
+		measured++
+	}
+
+	cutoff := time.Now().Add(-speedtestHistoryRetention)
+	if err := h.nodeHandler.db.Where("measured_at < ?", cutoff).Delete(&models.NodeSpeedtest{}).Error; err != nil {
+		h.logger.Warnf("Failed to prune speedtest history: %v", err)
+	}
+	h.logger.Infof("Speedtest round finished: %d of %d node(s) measured", measured, len(nodes))
+}
+
+// runNode asks the node's agent to run the speedtest and stores every result
+func (h *SpeedtestHandler) runNode(ctx context.Context, node *models.VPSNode, reflectors []*pb.SpeedtestReflector, duration int32) ([]*pb.SpeedtestResult, error) {
+	conn, err := h.nodeHandler.connect(node.ID.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to node: %w", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewNodeManagerClient(conn)
+
+	resp, err := client.RunSpeedtest(ctx, &pb.RunSpeedtestRequest{
+		NodeId:     node.ID.String(),
+		Reflectors: reflectors,
+		Duration:   duration,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to run speedtest on node: %w", err)
+	}
+	if !resp.Success {
+		return nil, fmt.Errorf("%s", resp.Message)
+	}
+
+	rows := make([]models.NodeSpeedtest, 0, len(resp.Results))
+	for _, result := range resp.Results {
+		result.NodeId = node.ID.String()
+		rows = append(rows, models.NodeSpeedtest{
+			NodeID:       node.ID,
+			Region:       result.Region,
+			Reflector:    result.Host,
+			LatencyMs:    result.LatencyMs,
+			DownloadMbps: result.DownloadMbps,
+			UploadMbps:   result.UploadMbps,
+			Error:        result.Error,
+			MeasuredAt:   time.Unix(result.MeasuredAt, 0),
+		})
+	}
+	if len(rows) > 0 {
+		if err := h.nodeHandler.db.Create(&rows).Error; err != nil {
+			return nil, fmt.Errorf("failed to save speedtest results: %w", err)
+		}
+	}
+	return resp.Results, nil
+}
+
+// RunSpeedtest measures one node now, against the configured reflectors unless others are given
+func (h *SpeedtestHandler) RunSpeedtest(ctx context.Context, req *pb.RunSpeedtestRequest) (*pb.RunSpeedtestResponse, error) {
+	var node models.VPSNode
+	if err := h.nodeHandler.db.First(&node, "id = ?", req.NodeId).Error; err != nil {
+		return nil, fmt.Errorf("node not found: %w", err)
+	}
+
+	reflectors := req.Reflectors
+	if len(reflectors) == 0 {
+		reflectors = h.reflectorsToProto()
+	}
+	if len(reflectors) == 0 {
+		return nil, fmt.Errorf("no reflectors configured or given")
+	}
+	for i, reflector := range reflectors {
+		if reflector.Region == "" {
+			return nil, fmt.Errorf("reflector %d has no region", i+1)
+		}
+	}
+
+	duration := req.Duration
+	if duration == 0 {
+		duration = int32(h.config.Duration)
+	}
+
+	results, err := h.runNode(ctx, &node, reflectors, duration)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.RunSpeedtestResponse{
+		Success: true,
+		Message: fmt.Sprintf("Speedtest completed against %d reflector(s)", len(results)),
+		Results: results,
+	}, nil
+}
+
+// GetSpeedtestHistory returns a node's measurements in the window, newest first
+func (h *SpeedtestHandler) GetSpeedtestHistory(ctx context.Context, req *pb.GetSpeedtestHistoryRequest) (*pb.GetSpeedtestHistoryResponse, error) {
+	nodeID, err := uuid.Parse(req.NodeId)
+	if err != nil {
+		return nil, fmt.Errorf("invalid node ID: %s", req.NodeId)
+	}
+
+	query := h.nodeHandler.db.Where("node_id = ? AND measured_at > ?", nodeID, speedtestWindowStart(req.Hours))
+	if req.Region != "" {
+		query = query.Where("region = ?", req.Region)
+	}
+
+	var rows []models.NodeSpeedtest
+	if err := query.Order("measured_at DESC").Find(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to get speedtest history: %w", err)
+	}
+
+	resp := &pb.GetSpeedtestHistoryResponse{
+		Success: true,
+		Message: "Speedtest history retrieved successfully",
+		Results: make([]*pb.SpeedtestResult, 0, len(rows)),
+	}
+	for _, row := range rows {
+		resp.Results = append(resp.Results, &pb.SpeedtestResult{
+			NodeId:       row.NodeID.String(),
+			Region:       row.Region,
+			Host:         row.Reflector,
+			LatencyMs:    row.LatencyMs,
+			DownloadMbps: row.DownloadMbps,
+			UploadMbps:   row.UploadMbps,
+			Error:        row.Error,
+			MeasuredAt:   row.MeasuredAt.Unix(),
+		})
+	}
+	return resp, nil
+}
+
+// GetBestNodes ranks the online nodes for a region by average latency, then download
+// throughput, over the successful measurements in the window
+func (h *SpeedtestHandler) GetBestNodes(ctx context.Context, req *pb.GetBestNodesRequest) (*pb.GetBestNodesResponse, error) {
+	if req.Region == "" {
+		return nil, fmt.Errorf("region is required")
+	}
+	limit := int(req.Limit)
+	if limit <= 0 {
+		limit = defaultBestNodesLimit
+	}
+
+	var rows []struct {
+		NodeID          uuid.UUID
+		NodeName        string
+		AvgLatencyMs    float64
+		AvgDownloadMbps float64
+		AvgUploadMbps   float64
+		Samples         int
+	}
+	err := h.nodeHandler.db.Table("node_speedtests").
+		Select("node_speedtests.node_id, vps_nodes.name AS node_name, "+
+			"AVG(node_speedtests.latency_ms) AS avg_latency_ms, "+
+			"AVG(node_speedtests.download_mbps) AS avg_download_mbps, "+
+			"AVG(node_speedtests.upload_mbps) AS avg_upload_mbps, "+
+			"COUNT(*) AS samples").
+		Joins("JOIN vps_nodes ON vps_nodes.id = node_speedtests.node_id").
+		Where("node_speedtests.region = ? AND node_speedtests.measured_at > ? AND node_speedtests.error = ''", req.Region, speedtestWindowStart(req.Hours)).
+		Where("vps_nodes.status = ?", models.NodeStatusOnline).
+		Group("node_speedtests.node_id, vps_nodes.name").
+		Order("avg_latency_ms ASC, avg_download_mbps DESC").
+		Limit(limit).
+		Scan(&rows).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to rank nodes: %w", err)
+	}
+
+	resp := &pb.GetBestNodesResponse{
+		Success: true,
+		Message: fmt.Sprintf("%d node(s) ranked for region %s", len(rows), req.Region),
+		Nodes:   make([]*pb.NodeRegionScore, 0, len(rows)),
+	}
+	for _, row := range rows {
+		resp.Nodes = append(resp.Nodes, &pb.NodeRegionScore{
+			NodeId:          row.NodeID.String(),
+			NodeName:        row.NodeName,
+			Region:          req.Region,
+			AvgLatencyMs:    row.AvgLatencyMs,
+			AvgDownloadMbps: row.AvgDownloadMbps,
+			AvgUploadMbps:   row.AvgUploadMbps,
+			Samples:         int32(row.Samples),
+		})
+	}
+	return resp, nil
+}
+
+func (h *SpeedtestHandler) reflectorsToProto() []*pb.SpeedtestReflector {
+	reflectors := make([]*pb.SpeedtestReflector, 0, len(h.config.Reflectors))
+	for _, reflector := range h.config.Reflectors {
+		reflectors = append(reflectors, &pb.SpeedtestReflector{
+			Region:   reflector.Region,
+			Host:     reflector.Host,
+			Port:     int32(reflector.Port),
+			Type:     reflector.Type,
+			ServerId: reflector.ServerID,
+		})
+	}
+	return reflectors
+}
+
+func speedtestWindowStart(hours int32) time.Time {
+	if hours <= 0 {
+		hours = defaultSpeedtestWindowHours
+	}
+	return time.Now().Add(-time.Duration(hours) * time.Hour)
+}
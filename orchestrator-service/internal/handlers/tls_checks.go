@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"hysteria2_microservices/orchestrator-service/internal/models"
+	pb "hysteria2_microservices/proto"
+)
+
+// RunTLSCheck has another node grade the TLS the node serves on its TCP ports, the way
+// clients see it, and stores the report
+func (h *NodeConfigHandler) RunTLSCheck(ctx context.Context, req *pb.RunTLSCheckRequest) (*pb.RunTLSCheckResponse, error) {
+	var node models.VPSNode
+	if err := h.nodeHandler.db.First(&node, "id = ?", req.NodeId).Error; err != nil {
+		return nil, fmt.Errorf("node not found: %w", err)
+	}
+
+	prober, err := h.selectProber(&node, req.ProberNodeId, "tls_check")
+	if err != nil {
+		return nil, err
+	}
+
+	target := probeTargetForNode(&node, req.Target)
+	if len(target.TlsPorts) == 0 {
+		return nil, fmt.Errorf("node %s has not reported its TLS ports, pass them in target", node.Name)
+	}
+
+	conn, err := h.nodeHandler.connect(prober.ID.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to prober node: %w", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewNodeManagerClient(conn)
+
+	resp, err := client.RunTLSCheck(ctx, &pb.RunTLSCheckRequest{
+		NodeId:       node.ID.String(),
+		ProberNodeId: prober.ID.String(),
+		Target:       target,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to run TLS checks on prober node: %w", err)
+	}
+	if !resp.Success || resp.Report == nil {
+		return resp, nil
+	}
+
+	report := models.TLSReport{
+		NodeID:       node.ID,
+		ProberNodeID: prober.ID,
+		Target:       resp.Report.Target,
+		Grade:        resp.Report.Grade,
+		Score:        int(resp.Report.Score),
+		StartedAt:    time.Unix(resp.Report.StartedAt, 0),
+		FinishedAt:   time.Unix(resp.Report.FinishedAt, 0),
+	}
+	checks := make([]models.ProbeCheck, 0, len(resp.Report.Checks))
+	for _, check := range resp.Report.Checks {
+		checks = append(checks, models.ProbeCheck{
+			Name:       check.Name,
+			Target:     check.Target,
+			Status:     check.Status,
+			Detail:     check.Detail,
+			Hint:       check.Hint,
+			DurationMs: check.DurationMs,
+		})
+	}
+	if err := report.SetChecks(checks); err != nil {
+		return nil, fmt.Errorf("failed to encode TLS checks: %w", err)
+	}
+	if err := h.nodeHandler.db.Create(&report).Error; err != nil {
+		return nil, fmt.Errorf("failed to save TLS report: %w", err)
+	}
+
+	return &pb.RunTLSCheckResponse{
+		Success: true,
+		Message: resp.Message,
+		Report:  tlsReportToProto(&report),
+	}, nil
+}
+
+// ListTLSReports returns the latest TLS reports of a node, newest first, or the latest
+// report of every node, worst grade first
+func (h *NodeConfigHandler) ListTLSReports(ctx context.Context, req *pb.ListTLSReportsRequest) (*pb.ListTLSReportsResponse, error) {
+	var reports []models.TLSReport
+	if req.NodeId != "" {
+		if _, err := uuid.Parse(req.NodeId); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid node ID %q", req.NodeId)
+		}
+		limit := int(req.Limit)
+		if limit <= 0 {
+			limit = defaultProbeReportLimit
+		}
+		if limit > maxProbeReportLimit {
+			limit = maxProbeReportLimit
+		}
+
+		err := h.nodeHandler.db.Where("node_id = ?", req.NodeId).
+			Order("created_at DESC").
+			Limit(limit).
+			Find(&reports).Error
+		if err != nil {
+			return nil, fmt.Errorf("failed to get TLS reports: %w", err)
+		}
+	} else {
+		latest := h.nodeHandler.db.Model(&models.TLSReport{}).
+			Select("DISTINCT ON (node_id) id").
+			Order("node_id, created_at DESC")
+		err := h.nodeHandler.db.Where("id IN (?)", latest).
+			Order("grade DESC, score, created_at DESC").
+			Find(&reports).Error
+		if err != nil {
+			return nil, fmt.Errorf("failed to get TLS reports: %w", err)
+		}
+	}
+
+	resp := &pb.ListTLSReportsResponse{
+		Success: true,
+		Message: "TLS reports retrieved successfully",
+		Reports: make([]*pb.TLSReport, 0, len(reports)),
+	}
+	for i := range reports {
+		resp.Reports = append(resp.Reports, tlsReportToProto(&reports[i]))
+	}
+	return resp, nil
+}
+
+func tlsReportToProto(report *models.TLSReport) *pb.TLSReport {
+	result := &pb.TLSReport{
+		Id:           report.ID.String(),
+		NodeId:       report.NodeID.String(),
+		ProberNodeId: report.ProberNodeID.String(),
+		Target:       report.Target,
+		Grade:        report.Grade,
+		Score:        int32(report.Score),
+		StartedAt:    report.StartedAt.Unix(),
+		FinishedAt:   report.FinishedAt.Unix(),
+	}
+	for _, check := range report.GetChecks() {
+		result.Checks = append(result.Checks, &pb.ProbeCheck{
+			Name:       check.Name,
+			Target:     check.Target,
+			Status:     check.Status,
+			Detail:     check.Detail,
+			Hint:       check.Hint,
+			DurationMs: check.DurationMs,
+		})
+	}
+	return result
+}
@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"errors"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"hysteria2_microservices/orchestrator-service/internal/repositories/interfaces"
+	"hysteria2_microservices/orchestrator-service/internal/tunnel"
+	pb "hysteria2_microservices/proto"
+)
+
+// tunnelNodeMetadata names the node opening a data stream
+const tunnelNodeMetadata = "node-id"
+
+// nodeTunnels are the reverse tunnels the agents hold open to this orchestrator
+var nodeTunnels = tunnel.NewRegistry()
+
+// TunnelHandler serves the reverse tunnels of nodes the orchestrator cannot dial, e.g. behind
+// NAT or a firewall closing the agent's gRPC port. Agents authenticate with the node auth
+// token.
+type TunnelHandler struct {
+	nodeRepo interfaces.NodeRepository
+	token    string
+	logger   *logrus.Logger
+}
+
+// NewTunnelHandler creates a new TunnelHandler
+func NewTunnelHandler(nodeRepo interfaces.NodeRepository, token string, logger *logrus.Logger) *TunnelHandler {
+	return &TunnelHandler{
+		nodeRepo: nodeRepo,
+		token:    token,
+		logger:   logger,
+	}
+}
+
+// Control holds the tunnel of the node open, sending it a dial for every connection the
+// orchestrator opens to it, until the agent disconnects or opens a newer tunnel
+func (h *TunnelHandler) Control(req *pb.TunnelOpen, stream pb.TunnelService_ControlServer) error {
+	if err := h.authenticate(stream, req.NodeId); err != nil {
+		return err
+	}
+
+	h.logger.WithField("node_id", req.NodeId).Info("Node tunnel opened")
+	err := nodeTunnels.Serve(stream.Context(), req.NodeId, func(connID string) error {
+		return stream.Send(&pb.TunnelDial{ConnId: connID})
+	})
+	h.logger.WithField("node_id", req.NodeId).Infof("Node tunnel closed: %v", err)
+
+	if errors.Is(err, tunnel.ErrReplaced) {
+		return status.Error(codes.Aborted, err.Error())
+	}
+	if stream.Context().Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// Data carries one connection the node opened in answer to a dial; its first frame names
+// the dial
+func (h *TunnelHandler) Data(stream pb.TunnelService_DataServer) error {
+	var nodeID string
+	if values := metadata.ValueFromIncomingContext(stream.Context(), tunnelNodeMetadata); len(values) > 0 {
+		nodeID = values[0]
+	}
+	if err := h.authenticate(stream, nodeID); err != nil {
+		return err
+	}
+
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	closed, err := nodeTunnels.Accept(nodeID, first.ConnId, dataStream{stream})
+	if err != nil {
+		return status.Errorf(codes.NotFound, "dial %s: %v", first.ConnId, err)
+	}
+
+	select {
+	case <-closed:
+		return nil
+	case <-stream.Context().Done():
+		return stream.Context().Err()
+	}
+}
+
+// authenticate checks the node auth token of a tunnel stream and that its node is registered
+func (h *TunnelHandler) authenticate(stream grpc.ServerStream, nodeID string) error {
+	var provided string
+	if values := metadata.ValueFromIncomingContext(stream.Context(), "authorization"); len(values) > 0 {
+		provided, _ = strings.CutPrefix(values[0], "Bearer ")
+	}
+	if h.token == "" || subtle.ConstantTimeCompare([]byte(provided), []byte(h.token)) != 1 {
+		return status.Error(codes.Unauthenticated, "invalid node token")
+	}
+	if nodeID == "" {
+		return status.Error(codes.InvalidArgument, "node_id is required")
+	}
+	if _, err := h.nodeRepo.GetByID(nodeID); err != nil {
+		return status.Errorf(codes.NotFound, "node %s not found", nodeID)
+	}
+	return nil
+}
+
+// dataStream adapts a data stream to tunnelconn.Stream
+type dataStream struct {
+	stream pb.TunnelService_DataServer
+}
+
+func (s dataStream) Send(data []byte) error {
+	return s.stream.Send(&pb.TunnelFrame{Data: data})
+}
+
+func (s dataStream) Recv() ([]byte, error) {
+	frame, err := s.stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	return frame.Data, nil
+}
+
+// connect returns a connection to the NodeManager of nodeID, over the node's tunnel when it
+// holds one open to this orchestrator and dialing the node otherwise
+func (h *NodeHandler) connect(nodeID string) (*grpc.ClientConn, error) {
+	if nodeTunnels.Connected(nodeID) {
+		return nodeTunnels.ClientConn(nodeID)
+	}
+	return h.getNodeConnection(nodeID)
+}
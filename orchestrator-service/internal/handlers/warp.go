@@ -0,0 +1,185 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"hysteria2_microservices/orchestrator-service/internal/models"
+	pb "hysteria2_microservices/proto"
+)
+
+// GetWARPStatus returns the state of the WARP client on a node
+func (h *NodeConfigHandler) GetWARPStatus(ctx context.Context, req *pb.GetWARPStatusRequest) (*pb.GetWARPStatusResponse, error) {
+	client, conn, err := h.warpNode(req.NodeId)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	resp, err := client.GetWARPStatus(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get WARP status from node: %w", err)
+	}
+	return resp, nil
+}
+
+// ConfigureWARP replaces the WARP settings of a node; the agent validates the client type
+// and mode
+func (h *NodeConfigHandler) ConfigureWARP(ctx context.Context, req *pb.ConfigureWARPRequest) (*pb.ConfigureWARPResponse, error) {
+	if req.ProxyPort < 0 || req.ProxyPort > 65535 {
+		return nil, status.Errorf(codes.InvalidArgument, "proxy port %d is out of range", req.ProxyPort)
+	}
+
+	client, conn, err := h.warpNode(req.NodeId)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	resp, err := client.ConfigureWARP(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure WARP on node: %w", err)
+	}
+	return resp, nil
+}
+
+func (h *NodeConfigHandler) ConnectWARP(ctx context.Context, req *pb.ConnectWARPRequest) (*pb.ConnectWARPResponse, error) {
+	client, conn, err := h.warpNode(req.NodeId)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	resp, err := client.ConnectWARP(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect WARP on node: %w", err)
+	}
+	return resp, nil
+}
+
+func (h *NodeConfigHandler) DisconnectWARP(ctx context.Context, req *pb.DisconnectWARPRequest) (*pb.DisconnectWARPResponse, error) {
+	client, conn, err := h.warpNode(req.NodeId)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	resp, err := client.DisconnectWARP(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to disconnect WARP on node: %w", err)
+	}
+	return resp, nil
+}
+
+// EnableWARPProxy switches the node's WARP client to proxy mode on the given local port
+func (h *NodeConfigHandler) EnableWARPProxy(ctx context.Context, req *pb.EnableWARPProxyRequest) (*pb.EnableWARPProxyResponse, error) {
+	if req.Port <= 0 || req.Port > 65535 {
+		return nil, status.Errorf(codes.InvalidArgument, "proxy port %d is out of range", req.Port)
+	}
+
+	client, conn, err := h.warpNode(req.NodeId)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	resp, err := client.EnableWARPProxy(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to enable WARP proxy on node: %w", err)
+	}
+	return resp, nil
+}
+
+func (h *NodeConfigHandler) DisableWARPProxy(ctx context.Context, req *pb.DisableWARPProxyRequest) (*pb.DisableWARPProxyResponse, error) {
+	client, conn, err := h.warpNode(req.NodeId)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	resp, err := client.DisableWARPProxy(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to disable WARP proxy on node: %w", err)
+	}
+	return resp, nil
+}
+
+// EnableWARPTrafficRouting routes the traffic of a node interface through WARP
+func (h *NodeConfigHandler) EnableWARPTrafficRouting(ctx context.Context, req *pb.EnableWARPTrafficRoutingRequest) (*pb.EnableWARPTrafficRoutingResponse, error) {
+	if req.InterfaceName == "" {
+		return nil, status.Error(codes.InvalidArgument, "interface name is required")
+	}
+
+	client, conn, err := h.warpNode(req.NodeId)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	resp, err := client.EnableWARPTrafficRouting(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to enable WARP traffic routing on node: %w", err)
+	}
+	return resp, nil
+}
+
+func (h *NodeConfigHandler) DisableWARPTrafficRouting(ctx context.Context, req *pb.DisableWARPTrafficRoutingRequest) (*pb.DisableWARPTrafficRoutingResponse, error) {
+	client, conn, err := h.warpNode(req.NodeId)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	resp, err := client.DisableWARPTrafficRouting(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to disable WARP traffic routing on node: %w", err)
+	}
+	return resp, nil
+}
+
+// TestWARPProxyConnectivity has the node check its WARP proxy end to end
+func (h *NodeConfigHandler) TestWARPProxyConnectivity(ctx context.Context, req *pb.TestWARPProxyConnectivityRequest) (*pb.TestWARPProxyConnectivityResponse, error) {
+	client, conn, err := h.warpNode(req.NodeId)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	resp, err := client.TestWARPProxyConnectivity(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to test WARP connectivity on node: %w", err)
+	}
+	return resp, nil
+}
+
+func (h *NodeConfigHandler) GetWARPLogs(ctx context.Context, req *pb.GetWARPLogsRequest) (*pb.GetWARPLogsResponse, error) {
+	client, conn, err := h.warpNode(req.NodeId)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	resp, err := client.GetWARPLogs(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get WARP logs from node: %w", err)
+	}
+	return resp, nil
+}
+
+// warpNode connects to the agent of a known node; the caller closes the connection
+func (h *NodeConfigHandler) warpNode(nodeID string) (pb.NodeManagerClient, *grpc.ClientConn, error) {
+	var node models.VPSNode
+	if err := h.nodeHandler.db.First(&node, "id = ?", nodeID).Error; err != nil {
+		return nil, nil, fmt.Errorf("node not found: %w", err)
+	}
+
+	conn, err := h.nodeHandler.connect(node.ID.String())
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to node: %w", err)
+	}
+	return pb.NewNodeManagerClient(conn), conn, nil
+}
@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	"hysteria2_microservices/orchestrator-service/internal/models"
+	pb "hysteria2_microservices/proto"
+)
+
+// XrayConnectionsHandler lists and disconnects the clients online on Xray, on one node or
+// on every online node at once
+type XrayConnectionsHandler struct {
+	nodeHandler *NodeHandler
+	logger      *logrus.Logger
+}
+
+// NewXrayConnectionsHandler creates a new XrayConnectionsHandler
+func NewXrayConnectionsHandler(nodeHandler *NodeHandler, logger *logrus.Logger) *XrayConnectionsHandler {
+	return &XrayConnectionsHandler{
+		nodeHandler: nodeHandler,
+		logger:      logger,
+	}
+}
+
+// GetXrayConnections collects the online clients of the requested node, or of every online
+// node when none is given. Nodes that cannot be queried are listed in FailedNodes.
+func (h *XrayConnectionsHandler) GetXrayConnections(ctx context.Context, req *pb.GetXrayConnectionsRequest) (*pb.GetXrayConnectionsResponse, error) {
+	nodeIDs, err := h.targetNodes(req.NodeId)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &pb.GetXrayConnectionsResponse{Success: true}
+	var mu sync.Mutex
+	h.forEachNode(nodeIDs, func(nodeID string) error {
+		conn, err := h.nodeHandler.connect(nodeID)
+		if err != nil {
+			mu.Lock()
+			resp.FailedNodes = append(resp.FailedNodes, nodeID)
+			mu.Unlock()
+			return fmt.Errorf("failed to connect to node: %w", err)
+		}
+		defer conn.Close()
+
+		client := pb.NewNodeManagerClient(conn)
+		nodeResp, err := client.GetXrayConnections(ctx, &pb.GetXrayConnectionsRequest{NodeId: nodeID})
+		if err == nil && !nodeResp.Success {
+			err = fmt.Errorf("%s", nodeResp.Message)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			resp.FailedNodes = append(resp.FailedNodes, nodeID)
+			return err
+		}
+		for _, connection := range nodeResp.Connections {
+			connection.NodeId = nodeID
+		}
+		resp.Connections = append(resp.Connections, nodeResp.Connections...)
+		return nil
+	})
+
+	if req.NodeId != "" && len(resp.FailedNodes) > 0 {
+		return nil, fmt.Errorf("failed to get Xray connections from node %s", req.NodeId)
+	}
+	resp.Message = fmt.Sprintf("%d client(s) online on %d node(s)", len(resp.Connections), len(nodeIDs)-len(resp.FailedNodes))
+	return resp, nil
+}
+
+// DisconnectXrayUser drops the user's Xray connections on the requested node, or on every
+// online node when none is given
+func (h *XrayConnectionsHandler) DisconnectXrayUser(ctx context.Context, req *pb.DisconnectXrayUserRequest) (*pb.DisconnectXrayUserResponse, error) {
+	if req.UserId == "" {
+		return nil, fmt.Errorf("user_id is required")
+	}
+	nodeIDs, err := h.targetNodes(req.NodeId)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &pb.DisconnectXrayUserResponse{Success: true}
+	var mu sync.Mutex
+	h.forEachNode(nodeIDs, func(nodeID string) error {
+		conn, err := h.nodeHandler.connect(nodeID)
+		if err != nil {
+			mu.Lock()
+			resp.FailedNodes = append(resp.FailedNodes, nodeID)
+			mu.Unlock()
+			return fmt.Errorf("failed to connect to node: %w", err)
+		}
+		defer conn.Close()
+
+		client := pb.NewNodeManagerClient(conn)
+		nodeResp, err := client.DisconnectXrayUser(ctx, &pb.DisconnectXrayUserRequest{
+			NodeId:   nodeID,
+			UserId:   req.UserId,
+			DeviceId: req.DeviceId,
+		})
+
+		mu.Lock()
+		defer mu.Unlock()
+		if nodeResp != nil {
+			for _, connection := range nodeResp.Disconnected {
+				connection.NodeId = nodeID
+			}
+			resp.Disconnected = append(resp.Disconnected, nodeResp.Disconnected...)
+			if err == nil && !nodeResp.Success {
+				err = fmt.Errorf("%s", nodeResp.Message)
+			}
+		}
+		if err != nil {
+			resp.FailedNodes = append(resp.FailedNodes, nodeID)
+			return err
+		}
+		return nil
+	})
+
+	resp.Success = len(resp.FailedNodes) == 0
+	resp.Message = fmt.Sprintf("%d client(s) disconnected", len(resp.Disconnected))
+	if !resp.Success {
+		resp.Message += fmt.Sprintf(", %d node(s) failed", len(resp.FailedNodes))
+	}
+	return resp, nil
+}
+
+// targetNodes returns nodeID, or every online node when it is empty
+func (h *XrayConnectionsHandler) targetNodes(nodeID string) ([]string, error) {
+	if nodeID != "" {
+		return []string{nodeID}, nil
+	}
+
+	var nodes []models.VPSNode
+	if err := h.nodeHandler.db.Select("id").Where("status = ?", models.NodeStatusOnline).Find(&nodes).Error; err != nil {
+		return nil, fmt.Errorf("failed to get online nodes: %w", err)
+	}
+	nodeIDs := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		nodeIDs = append(nodeIDs, node.ID.String())
+	}
+	return nodeIDs, nil
+}
+
+// forEachNode calls fn for every node in parallel and logs the nodes that failed
+func (h *XrayConnectionsHandler) forEachNode(nodeIDs []string, fn func(nodeID string) error) {
+	var wg sync.WaitGroup
+	for _, nodeID := range nodeIDs {
+		wg.Add(1)
+		go func(nodeID string) {
+			defer wg.Done()
+			if err := fn(nodeID); err != nil {
+				h.logger.Warnf("Xray connections request to node %s failed: %v", nodeID, err)
+			}
+		}(nodeID)
+	}
+	wg.Wait()
+}
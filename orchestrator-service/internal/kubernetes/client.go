@@ -0,0 +1,277 @@
+// Package kubernetes is a minimal client of the Kubernetes API for the orchestrator running
+// inside a cluster. It authenticates with the pod's service account and lists, watches and
+// updates the status of namespaced custom resources.
+package kubernetes
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// ServiceAccountDir is where the kubelet mounts the pod's service account
+const ServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+const requestTimeout = 30 * time.Second
+
+// ErrExpired is returned by Watch when the resource version is too old to resume from; list
+// again and watch from the new version
+var ErrExpired = errors.New("resource version expired")
+
+// Watch event types
+const (
+	EventAdded    = "ADDED"
+	EventModified = "MODIFIED"
+	EventDeleted  = "DELETED"
+	EventBookmark = "BOOKMARK"
+	eventError    = "ERROR"
+)
+
+// Resource identifies a kind of custom resource
+type Resource struct {
+	Group   string
+	Version string
+	Plural  string
+}
+
+// Object is a custom resource with its spec and status left encoded
+type Object struct {
+	APIVersion string          `json:"apiVersion"`
+	Kind       string          `json:"kind"`
+	Metadata   ObjectMeta      `json:"metadata"`
+	Spec       json.RawMessage `json:"spec,omitempty"`
+	Status     json.RawMessage `json:"status,omitempty"`
+}
+
+type ObjectMeta struct {
+	Name              string     `json:"name"`
+	Namespace         string     `json:"namespace,omitempty"`
+	UID               string     `json:"uid,omitempty"`
+	ResourceVersion   string     `json:"resourceVersion,omitempty"`
+	Generation        int64      `json:"generation,omitempty"`
+	DeletionTimestamp *time.Time `json:"deletionTimestamp,omitempty"`
+}
+
+// Key returns the object's namespace/name
+func (o *Object) Key() string {
+	return o.Metadata.Namespace + "/" + o.Metadata.Name
+}
+
+// List is a page of objects with the resource version to watch from
+type List struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []Object `json:"items"`
+}
+
+// Event is a change reported by Watch
+type Event struct {
+	Type   string
+	Object Object
+}
+
+// status is the error body of the API
+type status struct {
+	Code    int    `json:"code"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+// Client calls the API server with a bearer token read from a file, which the kubelet
+// rotates
+type Client struct {
+	baseURL   string
+	tokenFile string
+	http      *http.Client
+}
+
+// NewClient creates a client for the API server at baseURL
+func NewClient(baseURL, tokenFile string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{baseURL: strings.TrimRight(baseURL, "/"), tokenFile: tokenFile, http: httpClient}
+}
+
+// InCluster creates a client from the environment and service account of the pod
+func InCluster() (*Client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes cluster: KUBERNETES_SERVICE_HOST is not set")
+	}
+	ca, err := os.ReadFile(path.Join(ServiceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("invalid service account CA")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+
+	// No client timeout: watches stay open until the server or the context ends them
+	return NewClient("https://"+net.JoinHostPort(host, port), path.Join(ServiceAccountDir, "token"), &http.Client{Transport: transport}), nil
+}
+
+// Namespace returns the namespace of the pod, or "default" outside a cluster
+func Namespace() string {
+	data, err := os.ReadFile(path.Join(ServiceAccountDir, "namespace"))
+	if err != nil || strings.TrimSpace(string(data)) == "" {
+		return "default"
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// List returns the resources of namespace, or of every namespace when it is empty
+func (c *Client) List(ctx context.Context, res Resource, namespace string) (*List, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	var list List
+	if err := c.do(ctx, http.MethodGet, c.path(res, namespace, ""), nil, "", &list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// Watch streams the changes after resourceVersion to fn until ctx is done, the server ends
+// the watch or fn fails. It returns nil when the server ends it; watch again from the last
+// version seen.
+func (c *Client) Watch(ctx context.Context, res Resource, namespace, resourceVersion string, fn func(Event) error) error {
+	query := url.Values{
+		"watch":               {"true"},
+		"resourceVersion":     {resourceVersion},
+		"allowWatchBookmarks": {"true"},
+	}
+	req, err := c.request(ctx, http.MethodGet, c.path(res, namespace, "")+"?"+query.Encode(), nil, "")
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return ErrExpired
+	}
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+
+	decoder := json.NewDecoder(bufio.NewReader(resp.Body))
+	for {
+		var event struct {
+			Type   string          `json:"type"`
+			Object json.RawMessage `json:"object"`
+		}
+		if err := decoder.Decode(&event); err != nil {
+			if errors.Is(err, io.EOF) || ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to read watch: %w", err)
+		}
+
+		if event.Type == eventError {
+			var s status
+			if json.Unmarshal(event.Object, &s) == nil && s.Code == http.StatusGone {
+				return ErrExpired
+			}
+			return fmt.Errorf("watch failed: %s", event.Object)
+		}
+		var object Object
+		if err := json.Unmarshal(event.Object, &object); err != nil {
+			return fmt.Errorf("invalid watch event: %w", err)
+		}
+		if err := fn(Event{Type: event.Type, Object: object}); err != nil {
+			return err
+		}
+	}
+}
+
+// UpdateStatus merges status into the status subresource of obj
+func (c *Client) UpdateStatus(ctx context.Context, res Resource, obj *Object, status interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	body, err := json.Marshal(map[string]interface{}{"status": status})
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, http.MethodPatch, c.path(res, obj.Metadata.Namespace, obj.Metadata.Name)+"/status", body, "application/merge-patch+json", nil)
+}
+
+func (c *Client) path(res Resource, namespace, name string) string {
+	p := "/apis/" + res.Group + "/" + res.Version
+	if namespace != "" {
+		p += "/namespaces/" + url.PathEscape(namespace)
+	}
+	p += "/" + res.Plural
+	if name != "" {
+		p += "/" + url.PathEscape(name)
+	}
+	return p
+}
+
+func (c *Client) request(ctx context.Context, method, p string, body []byte, contentType string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+p, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.tokenFile != "" {
+		token, err := os.ReadFile(c.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read service account token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	return req, nil
+}
+
+func (c *Client) do(ctx context.Context, method, p string, body []byte, contentType string, result interface{}) error {
+	req, err := c.request(ctx, method, p, body, contentType)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return responseError(resp)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func responseError(resp *http.Response) error {
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	var s status
+	if json.Unmarshal(data, &s) == nil && s.Message != "" {
+		return fmt.Errorf("kubernetes API: %s (%d %s)", s.Message, resp.StatusCode, s.Reason)
+	}
+	return fmt.Errorf("kubernetes API: %s", resp.Status)
+}
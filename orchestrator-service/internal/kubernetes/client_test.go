@@ -0,0 +1,220 @@
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var vpnNodes = Resource{Group: "hysteryvpn.io", Version: "v1alpha1", Plural: "vpnnodes"}
+
+// newTestClient serves handler as the API server and authenticates with a token file
+// holding token
+func newTestClient(t *testing.T, token string, handler http.HandlerFunc) *Client {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte(token+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return NewClient(server.URL+"/", tokenFile, server.Client())
+}
+
+func TestList(t *testing.T) {
+	tests := []struct {
+		namespace string
+		wantPath  string
+	}{
+		{"vpn", "/apis/hysteryvpn.io/v1alpha1/namespaces/vpn/vpnnodes"},
+		{"", "/apis/hysteryvpn.io/v1alpha1/vpnnodes"},
+	}
+	for _, tt := range tests {
+		client := newTestClient(t, "sa-token", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet || r.URL.Path != tt.wantPath {
+				t.Errorf("namespace %q: got %s %s, want GET %s", tt.namespace, r.Method, r.URL.Path, tt.wantPath)
+			}
+			if got := r.Header.Get("Authorization"); got != "Bearer sa-token" {
+				t.Errorf("Authorization = %q, want the trimmed token file", got)
+			}
+			fmt.Fprint(w, `{"metadata":{"resourceVersion":"42"},"items":[
+				{"apiVersion":"hysteryvpn.io/v1alpha1","kind":"VPNNode","metadata":{"name":"de-fra-1","namespace":"vpn","generation":3},"spec":{"hostname":"de.example.com"}}]}`)
+		})
+
+		list, err := client.List(context.Background(), vpnNodes, tt.namespace)
+		if err != nil {
+			t.Fatalf("List: %v", err)
+		}
+		if list.Metadata.ResourceVersion != "42" || len(list.Items) != 1 {
+			t.Fatalf("List = %+v, want version 42 and one item", list)
+		}
+		item := list.Items[0]
+		if item.Key() != "vpn/de-fra-1" || item.Metadata.Generation != 3 || string(item.Spec) != `{"hostname":"de.example.com"}` {
+			t.Errorf("item = %+v", item)
+		}
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		wantErr string
+	}{
+		{"status body", http.StatusForbidden,
+			`{"kind":"Status","code":403,"reason":"Forbidden","message":"vpnnodes is forbidden: User cannot list"}`,
+			"kubernetes API: vpnnodes is forbidden: User cannot list (403 Forbidden)"},
+		{"plain body", http.StatusBadGateway, "upstream unavailable", "kubernetes API: 502 Bad Gateway"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newTestClient(t, "sa-token", func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.body)
+			})
+			_, err := client.List(context.Background(), vpnNodes, "vpn")
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("error = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWatch(t *testing.T) {
+	client := newTestClient(t, "sa-token", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("watch") != "true" || query.Get("resourceVersion") != "42" || query.Get("allowWatchBookmarks") != "true" {
+			t.Errorf("query = %s", r.URL.RawQuery)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		for _, line := range []string{
+			`{"type":"ADDED","object":{"metadata":{"name":"a","namespace":"vpn","resourceVersion":"43"}}}`,
+			`{"type":"MODIFIED","object":{"metadata":{"name":"a","namespace":"vpn","resourceVersion":"44"},"status":{"phase":"Ready"}}}`,
+			`{"type":"BOOKMARK","object":{"metadata":{"resourceVersion":"45"}}}`,
+			`{"type":"DELETED","object":{"metadata":{"name":"a","namespace":"vpn","resourceVersion":"46"}}}`,
+		} {
+			fmt.Fprintln(w, line)
+			w.(http.Flusher).Flush()
+		}
+	})
+
+	var got []string
+	err := client.Watch(context.Background(), vpnNodes, "vpn", "42", func(e Event) error {
+		got = append(got, e.Type+" "+e.Object.Metadata.Name+"@"+e.Object.Metadata.ResourceVersion)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+	want := []string{"ADDED a@43", "MODIFIED a@44", "BOOKMARK @45", "DELETED a@46"}
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+}
+
+func TestWatchExpired(t *testing.T) {
+	tests := map[string]http.HandlerFunc{
+		"410 response": func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusGone)
+		},
+		"410 error event": func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintln(w, `{"type":"ERROR","object":{"kind":"Status","code":410,"reason":"Expired","message":"too old resource version: 1 (40)"}}`)
+		},
+	}
+	for name, handler := range tests {
+		t.Run(name, func(t *testing.T) {
+			client := newTestClient(t, "sa-token", handler)
+			err := client.Watch(context.Background(), vpnNodes, "vpn", "1", func(Event) error {
+				t.Error("event delivered")
+				return nil
+			})
+			if !errors.Is(err, ErrExpired) {
+				t.Errorf("error = %v, want ErrExpired", err)
+			}
+		})
+	}
+}
+
+func TestWatchStops(t *testing.T) {
+	t.Run("other error event", func(t *testing.T) {
+		client := newTestClient(t, "sa-token", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintln(w, `{"type":"ERROR","object":{"kind":"Status","code":500,"message":"internal error"}}`)
+		})
+		err := client.Watch(context.Background(), vpnNodes, "vpn", "1", func(Event) error { return nil })
+		if err == nil || errors.Is(err, ErrExpired) || !strings.Contains(err.Error(), "internal error") {
+			t.Errorf("error = %v, want the watch failure", err)
+		}
+	})
+
+	t.Run("handler error", func(t *testing.T) {
+		client := newTestClient(t, "sa-token", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintln(w, `{"type":"ADDED","object":{"metadata":{"name":"a"}}}`)
+			fmt.Fprintln(w, `{"type":"ADDED","object":{"metadata":{"name":"b"}}}`)
+		})
+		stop := errors.New("stop")
+		calls := 0
+		err := client.Watch(context.Background(), vpnNodes, "vpn", "1", func(Event) error {
+			calls++
+			return stop
+		})
+		if !errors.Is(err, stop) || calls != 1 {
+			t.Errorf("error = %v after %d events, want stop after 1", err, calls)
+		}
+	})
+
+	t.Run("cancelled context", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		client := newTestClient(t, "sa-token", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintln(w, `{"type":"ADDED","object":{"metadata":{"name":"a"}}}`)
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		})
+		err := client.Watch(ctx, vpnNodes, "vpn", "1", func(Event) error {
+			cancel()
+			return nil
+		})
+		if err != nil {
+			t.Errorf("error = %v, want nil once the context is done", err)
+		}
+	})
+}
+
+func TestUpdateStatus(t *testing.T) {
+	client := newTestClient(t, "sa-token", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPatch || r.URL.Path != "/apis/hysteryvpn.io/v1alpha1/namespaces/vpn/vpnnodes/de-fra-1/status" {
+			t.Errorf("got %s %s", r.Method, r.URL.Path)
+		}
+		if got := r.Header.Get("Content-Type"); got != "application/merge-patch+json" {
+			t.Errorf("Content-Type = %s", got)
+		}
+		body, _ := io.ReadAll(r.Body)
+		var patch map[string]map[string]string
+		if err := json.Unmarshal(body, &patch); err != nil || patch["status"]["phase"] != "Ready" {
+			t.Errorf("body = %s, want a status merge patch", body)
+		}
+		fmt.Fprint(w, `{}`)
+	})
+
+	obj := &Object{Metadata: ObjectMeta{Name: "de-fra-1", Namespace: "vpn"}}
+	if err := client.UpdateStatus(context.Background(), vpnNodes, obj, map[string]string{"phase": "Ready"}); err != nil {
+		t.Fatalf("UpdateStatus: %v", err)
+	}
+}
+
+func TestMissingTokenFile(t *testing.T) {
+	client := NewClient("http://127.0.0.1:1", filepath.Join(t.TempDir(), "missing"), nil)
+	_, err := client.List(context.Background(), vpnNodes, "vpn")
+	if err == nil || !strings.Contains(err.Error(), "service account token") {
+		t.Errorf("error = %v, want the token file error", err)
+	}
+}
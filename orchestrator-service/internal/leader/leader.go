@@ -0,0 +1,116 @@
+// Package leader elects the orchestrator replica that runs the schedulers. The leader
+// holds a Postgres session advisory lock on a connection of its own; the lock goes with
+// the session, so a replica that dies or loses the database hands leadership over to the
+// next one that asks.
+package leader
+
+import (
+	"context"
+	"database/sql"
+	"hash/fnv"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Elector campaigns for leadership until its context is done. A nil Elector always leads,
+// for a single orchestrator.
+type Elector struct {
+	db       *sql.DB
+	name     string
+	lockID   int64
+	interval time.Duration
+	logger   *logrus.Logger
+
+	leading atomic.Bool
+}
+
+// New creates an elector for the named role; replicas using the same name compete for it.
+// Leadership is checked, and sought by followers, once per interval.
+func New(db *sql.DB, name string, interval time.Duration, logger *logrus.Logger) *Elector {
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return &Elector{
+		db:       db,
+		name:     name,
+		lockID:   int64(h.Sum64()),
+		interval: interval,
+		logger:   logger,
+	}
+}
+
+// IsLeader reports whether this replica leads right now
+func (e *Elector) IsLeader() bool {
+	return e == nil || e.leading.Load()
+}
+
+// Run campaigns until ctx is done, then gives leadership up
+func (e *Elector) Run(ctx context.Context) {
+	var conn *sql.Conn
+	defer func() {
+		if conn != nil {
+			e.release(conn)
+		}
+	}()
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		if conn == nil {
+			conn = e.acquire(ctx)
+		} else if err := conn.PingContext(ctx); err != nil && ctx.Err() == nil {
+			// The session and its lock are gone
+			e.leading.Store(false)
+			e.logger.Warnf("Lost %s leadership: %v", e.name, err)
+			conn.Close()
+			conn = nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// acquire returns the connection holding the lock, or nil when another replica holds it
+func (e *Elector) acquire(ctx context.Context) *sql.Conn {
+	conn, err := e.db.Conn(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			e.logger.Errorf("Failed to open %s election connection: %v", e.name, err)
+		}
+		return nil
+	}
+
+	var acquired bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", e.lockID).Scan(&acquired); err != nil || !acquired {
+		if err != nil && ctx.Err() == nil {
+			e.logger.Errorf("Failed to campaign for %s leadership: %v", e.name, err)
+		}
+		conn.Close()
+		return nil
+	}
+
+	e.leading.Store(true)
+	e.logger.Infof("Became %s leader", e.name)
+	return conn
+}
+
+func (e *Elector) release(conn *sql.Conn) {
+	e.leading.Store(false)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", e.lockID); err != nil {
+		e.logger.Warnf("Failed to give up %s leadership, it lapses with the connection: %v", e.name, err)
+	}
+	conn.Close()
+	e.logger.Infof("Gave up %s leadership", e.name)
+}
@@ -0,0 +1,280 @@
+package leader
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// fakeServer stands in for Postgres: it grants the advisory lock to one session at a time
+// and can drop a session, as a database restart or network failure would
+type fakeServer struct {
+	mu     sync.Mutex
+	holder interface{} // the session holding the lock, nil when it is free
+	dead   map[*fakeConn]bool
+	pings  int
+	unlock int
+}
+
+// other is a session of another replica
+var other = new(int)
+
+func (s *fakeServer) setHolder(holder interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.holder = holder
+}
+
+// dropLeader kills the session holding the lock, which releases it
+func (s *fakeServer) dropLeader() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if conn, ok := s.holder.(*fakeConn); ok {
+		s.dead[conn] = true
+		s.holder = nil
+	}
+}
+
+func (s *fakeServer) counts() (pings, unlock int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pings, s.unlock
+}
+
+var (
+	serversMu sync.Mutex
+	servers   = map[string]*fakeServer{}
+)
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	serversMu.Lock()
+	defer serversMu.Unlock()
+	return &fakeConn{server: servers[name]}, nil
+}
+
+func init() {
+	sql.Register("leadertest", fakeDriver{})
+}
+
+type fakeConn struct {
+	server *fakeServer
+}
+
+func (c *fakeConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c *fakeConn) Close() error                        { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+func (c *fakeConn) alive() bool {
+	return !c.server.dead[c]
+}
+
+// IsValid keeps dropped sessions out of the pool
+func (c *fakeConn) IsValid() bool {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	return c.alive()
+}
+
+func (c *fakeConn) Ping(ctx context.Context) error {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	c.server.pings++
+	if !c.alive() {
+		return errors.New("server closed the connection unexpectedly")
+	}
+	return nil
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if !strings.Contains(query, "pg_try_advisory_lock") {
+		return nil, errors.New("unexpected query " + query)
+	}
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	if !c.alive() {
+		return nil, driver.ErrBadConn
+	}
+	acquired := c.server.holder == nil || c.server.holder == c
+	if acquired {
+		c.server.holder = c
+	}
+	return &boolRows{value: acquired}, nil
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if !strings.Contains(query, "pg_advisory_unlock") {
+		return nil, errors.New("unexpected statement " + query)
+	}
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	if c.server.holder == c {
+		c.server.holder = nil
+	}
+	c.server.unlock++
+	return driver.RowsAffected(0), nil
+}
+
+type boolRows struct {
+	value bool
+	done  bool
+}
+
+func (r *boolRows) Columns() []string { return []string{"acquired"} }
+func (r *boolRows) Close() error      { return nil }
+
+func (r *boolRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	dest[0] = r.value
+	return nil
+}
+
+func newTestElector(t *testing.T) (*Elector, *fakeServer) {
+	t.Helper()
+	server := &fakeServer{dead: map[*fakeConn]bool{}}
+	serversMu.Lock()
+	servers[t.Name()] = server
+	serversMu.Unlock()
+
+	db, err := sql.Open("leadertest", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return New(db, "test", 5*time.Millisecond, logger), server
+}
+
+// run campaigns until the test ends, which must give leadership up
+func run(t *testing.T, e *Elector) context.CancelFunc {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		e.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestNilElectorLeads(t *testing.T) {
+	var e *Elector
+	if !e.IsLeader() {
+		t.Error("nil elector does not lead")
+	}
+}
+
+func TestElectorAcquiresRenewsAndReleases(t *testing.T) {
+	e, server := newTestElector(t)
+	stop := run(t, e)
+
+	waitFor(t, "the elector leads", e.IsLeader)
+
+	// Leading replicas renew by checking their session each interval
+	pings, _ := server.counts()
+	waitFor(t, "the session is checked again", func() bool {
+		renewed, _ := server.counts()
+		return renewed >= pings+3
+	})
+	if !e.IsLeader() {
+		t.Fatal("leadership was not kept while the session lived")
+	}
+
+	stop()
+	if e.IsLeader() {
+		t.Error("still leading after Run returned")
+	}
+	if _, unlock := server.counts(); unlock != 1 {
+		t.Errorf("lock released %d times, want 1", unlock)
+	}
+}
+
+func TestElectorFollowsWhileAnotherLeads(t *testing.T) {
+	e, server := newTestElector(t)
+	server.setHolder(other)
+	run(t, e)
+
+	time.Sleep(50 * time.Millisecond)
+	if e.IsLeader() {
+		t.Fatal("leading while another replica holds the lock")
+	}
+
+	// The other replica goes away and this one takes over
+	server.setHolder(nil)
+	waitFor(t, "the elector takes over", e.IsLeader)
+}
+
+func TestLostLeadershipStopsWork(t *testing.T) {
+	e, server := newTestElector(t)
+	run(t, e)
+	waitFor(t, "the elector leads", e.IsLeader)
+
+	// A scheduler runs its job only while leading, as handlers.leadership does
+	var runs atomic.Int64
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		ticker := time.NewTicker(time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if e.IsLeader() {
+					runs.Add(1)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	waitFor(t, "the job runs", func() bool { return runs.Load() > 0 })
+
+	// The session drops and another replica takes the lock before this one asks again
+	server.dropLeader()
+	server.setHolder(other)
+	waitFor(t, "leadership is lost", func() bool { return !e.IsLeader() })
+
+	// A job that read IsLeader just before the loss may still finish
+	time.Sleep(5 * time.Millisecond)
+	before := runs.Load()
+	time.Sleep(50 * time.Millisecond)
+	if after := runs.Load(); after != before {
+		t.Errorf("job ran %d times after leadership was lost", after-before)
+	}
+	if e.IsLeader() {
+		t.Error("leading again while another replica holds the lock")
+	}
+}
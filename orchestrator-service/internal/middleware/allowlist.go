@@ -0,0 +1,168 @@
+package middleware
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"hysteria2_microservices/orchestrator-service/internal/repositories/interfaces"
+	"hysteria2_microservices/pkg/ipallow"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// breakGlassMetadata carries the emergency token letting a call past the allowlist, like
+// api-service's X-Break-Glass-Token header
+const breakGlassMetadata = "x-break-glass-token"
+
+// healthServicePrefix is left open so load balancers and api-service can probe the port
+const healthServicePrefix = "/grpc.health.v1.Health/"
+
+// Allowlist guards the gRPC port with the networks node agents may connect from: those of
+// the config and the agent networks admins store through api-service, which are re-read
+// every refresh. Without any the port is not restricted. Loopback peers, such as the REST
+// gateway in this process, pass only when allowLoopback is set: agents reaching the port
+// through a reverse tunnel arrive from loopback too.
+type Allowlist struct {
+	static          []netip.Prefix
+	repo            interfaces.AllowedNetworkRepository
+	breakGlassToken string
+	allowLoopback   bool
+	logger          *logrus.Logger
+
+	mu       sync.RWMutex
+	networks []netip.Prefix
+}
+
+// NewAllowlist parses the configured networks, in CIDR notation or single addresses
+func NewAllowlist(cidrs []string, repo interfaces.AllowedNetworkRepository, breakGlassToken string, allowLoopback bool, logger *logrus.Logger) (*Allowlist, error) {
+	static, err := ipallow.Parse(cidrs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Allowlist{
+		static:          static,
+		repo:            repo,
+		breakGlassToken: breakGlassToken,
+		allowLoopback:   allowLoopback,
+		logger:          logger,
+		networks:        static,
+	}, nil
+}
+
+// Run re-reads the stored networks every interval until ctx is done; with no interval they
+// are read once. A failed read keeps the networks read before rather than opening the port.
+func (a *Allowlist) Run(ctx context.Context, interval time.Duration) {
+	a.refresh()
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.refresh()
+		}
+	}
+}
+
+func (a *Allowlist) refresh() {
+	stored, err := a.repo.ListByScope("agent")
+	if err != nil {
+		a.logger.Errorf("Failed to load allowed agent networks: %v", err)
+		return
+	}
+
+	networks := append([]netip.Prefix(nil), a.static...)
+	for _, network := range stored {
+		prefix, err := ipallow.ParsePrefix(network.CIDR)
+		if err != nil {
+			a.logger.Warnf("Skipping invalid allowed network %s: %v", network.ID, err)
+			continue
+		}
+		networks = append(networks, prefix)
+	}
+
+	a.mu.Lock()
+	a.networks = networks
+	a.mu.Unlock()
+}
+
+// Allows reports whether a peer at addr may call
+func (a *Allowlist) Allows(addr netip.Addr) bool {
+	addr = addr.Unmap().WithZone("")
+	if a.allowLoopback && addr.IsLoopback() {
+		return true
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if len(a.networks) == 0 {
+		return true
+	}
+	for _, prefix := range a.networks {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// UnaryInterceptor refuses unary calls from peers outside the allowlist
+func (a *Allowlist) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := a.check(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// StreamInterceptor refuses streams from peers outside the allowlist
+func (a *Allowlist) StreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := a.check(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+func (a *Allowlist) check(ctx context.Context, method string) error {
+	if strings.HasPrefix(method, healthServicePrefix) {
+		return nil
+	}
+
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return status.Error(codes.PermissionDenied, "unknown peer address")
+	}
+	addrPort, err := netip.ParseAddrPort(p.Addr.String())
+	if err != nil {
+		return status.Error(codes.PermissionDenied, "unknown peer address")
+	}
+	addr := addrPort.Addr()
+	if a.Allows(addr) {
+		return nil
+	}
+
+	if values := metadata.ValueFromIncomingContext(ctx, breakGlassMetadata); len(values) > 0 {
+		if a.breakGlassToken != "" && subtle.ConstantTimeCompare([]byte(values[0]), []byte(a.breakGlassToken)) == 1 {
+			a.logger.WithFields(logrus.Fields{"peer": addr.String(), "method": method}).Warn("Break-glass token used")
+			return nil
+		}
+		a.logger.WithFields(logrus.Fields{"peer": addr.String(), "method": method}).Warn("Invalid break-glass token")
+	}
+
+	a.logger.WithFields(logrus.Fields{"peer": addr.String(), "method": method}).Warn("gRPC call from network not allowed")
+	return status.Error(codes.PermissionDenied, "access from this network is not allowed")
+}
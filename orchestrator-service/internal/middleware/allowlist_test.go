@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"io"
+	"net/netip"
+	"testing"
+
+	"hysteria2_microservices/orchestrator-service/internal/models"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+type fakeNetworks []string
+
+func (f fakeNetworks) ListByScope(scope string) ([]*models.AllowedNetwork, error) {
+	var networks []*models.AllowedNetwork
+	for _, cidr := range f {
+		networks = append(networks, &models.AllowedNetwork{ID: uuid.New(), Scope: scope, CIDR: cidr})
+	}
+	return networks, nil
+}
+
+func TestAllowlistAllows(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	tests := []struct {
+		name          string
+		static        []string
+		stored        fakeNetworks
+		allowLoopback bool
+		addr          string
+		want          bool
+	}{
+		{"no networks", nil, nil, false, "198.51.100.1", true},
+		{"configured network", []string{"192.0.2.0/24"}, nil, false, "192.0.2.10", true},
+		{"stored network", []string{"192.0.2.0/24"}, fakeNetworks{"198.51.100.7"}, false, "198.51.100.7", true},
+		{"mapped address", []string{"192.0.2.0/24"}, nil, false, "::ffff:192.0.2.10", true},
+		{"other network", []string{"192.0.2.0/24"}, nil, false, "198.51.100.1", false},
+		{"invalid stored network skipped", []string{"192.0.2.0/24"}, fakeNetworks{"not-a-network"}, false, "198.51.100.1", false},
+		// Agents coming through a reverse tunnel arrive from loopback
+		{"loopback", []string{"192.0.2.0/24"}, nil, false, "127.0.0.1", false},
+		{"loopback allowed", []string{"192.0.2.0/24"}, nil, true, "127.0.0.1", true},
+		{"IPv6 loopback allowed", []string{"192.0.2.0/24"}, nil, true, "::1", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowlist, err := NewAllowlist(tt.static, tt.stored, "", tt.allowLoopback, logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			allowlist.refresh()
+			if got := allowlist.Allows(netip.MustParseAddr(tt.addr)); got != tt.want {
+				t.Errorf("Allows(%s) = %v, want %v", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewAllowlistRejectsInvalidNetwork(t *testing.T) {
+	if _, err := NewAllowlist([]string{"192.0.2.0/33"}, fakeNetworks{}, "", false, logrus.New()); err == nil {
+		t.Error("invalid network accepted")
+	}
+}
@@ -0,0 +1,42 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+
+	"hysteria2_microservices/pkg/events"
+)
+
+// AuditSource is the source of the orchestrator's audit events
+const AuditSource = "orchestrator-service"
+
+// Audit publishes an audit event for every request that changed something, by the caller
+// JWTAuth set. Reads and refused requests are not recorded.
+func Audit(bus *events.Bus, logger *logrus.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			return
+		}
+		if c.Writer.Status() >= http.StatusBadRequest {
+			return
+		}
+
+		event := events.AuditEvent{
+			Actor:    c.GetString("user_id"),
+			Action:   c.Request.Method + " " + c.Request.URL.Path,
+			Severity: "info",
+			Details: map[string]string{
+				"ip":   c.ClientIP(),
+				"role": c.GetString("role"),
+			},
+		}
+		if err := bus.Publish(events.AuditSubject(AuditSource), events.TypeAudit, event); err != nil {
+			logger.Errorf("Failed to publish audit event for %s: %v", event.Action, err)
+		}
+	}
+}
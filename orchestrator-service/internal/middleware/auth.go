@@ -0,0 +1,120 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// JWTAuth validates bearer tokens issued by api-service and stores user_id, username and
+// role in the gin context. Tokens are ES256 signed with the key their kid names in the
+// api-service JWKS; tokens without a kid predate signing keys and use the shared
+// JWT_SECRET (HS256), which is not accepted at all while the secret is empty. Tokens
+// without an expiry are rejected.
+func JWTAuth(secret string, jwks *JWKS) gin.HandlerFunc {
+	methods := []string{jwt.SigningMethodES256.Alg()}
+	if secret != "" {
+		methods = append(methods, jwt.SigningMethodHS256.Alg())
+	}
+
+	return func(c *gin.Context) {
+		authHeader := c.GetHeader("Authorization")
+		if authHeader == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": "Authorization header required",
+				"code":  "AUTH_HEADER_REQUIRED",
+			})
+			return
+		}
+
+		tokenParts := strings.Split(authHeader, " ")
+		if len(tokenParts) != 2 || tokenParts[0] != "Bearer" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": "Invalid authorization header format",
+				"code":  "INVALID_AUTH_FORMAT",
+			})
+			return
+		}
+
+		claims := jwt.MapClaims{}
+		token, err := jwt.ParseWithClaims(tokenParts[1], claims, func(token *jwt.Token) (interface{}, error) {
+			kid, _ := token.Header["kid"].(string)
+			switch token.Method.(type) {
+			case *jwt.SigningMethodECDSA:
+				if kid == "" || jwks == nil {
+					return nil, fmt.Errorf("no key to verify token")
+				}
+				return jwks.PublicKey(kid)
+			case *jwt.SigningMethodHMAC:
+				if kid != "" || secret == "" {
+					return nil, fmt.Errorf("unexpected HMAC signed token")
+				}
+				return []byte(secret), nil
+			default:
+				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+			}
+		}, jwt.WithValidMethods(methods), jwt.WithExpirationRequired())
+		if err != nil || !token.Valid {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": "Invalid or expired token",
+				"code":  "INVALID_TOKEN",
+			})
+			return
+		}
+
+		userID, _ := claims["user_id"].(string)
+		username, _ := claims["username"].(string)
+		role, _ := claims["role"].(string)
+
+		c.Set("user_id", userID)
+		c.Set("username", username)
+		c.Set("role", role)
+
+		c.Next()
+	}
+}
+
+// RequireRole allows admins and users with the required role
+func RequireRole(requiredRole string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		role := c.GetString("role")
+		if role == "" {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error": "User role not found",
+				"code":  "ROLE_NOT_FOUND",
+			})
+			return
+		}
+
+		if role != "admin" && role != requiredRole {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error": "Insufficient permissions",
+				"code":  "INSUFFICIENT_PERMISSIONS",
+			})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// NodeAuth admits agents presenting the shared node auth token as a bearer token. With no
+// token configured every request is rejected.
+func NodeAuth(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		provided, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if token == "" || !ok || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": "Invalid node token",
+				"code":  "INVALID_NODE_TOKEN",
+			})
+			return
+		}
+
+		c.Next()
+	}
+}
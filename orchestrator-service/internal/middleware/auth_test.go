@@ -0,0 +1,216 @@
+package middleware
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testSecret = "test-secret"
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// serveJWKS publishes key as kid the way api-service does
+func serveJWKS(t *testing.T, kid string, key *ecdsa.PublicKey) *JWKS {
+	document := map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "EC",
+			"crv": "P-256",
+			"kid": kid,
+			"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+			"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+		}},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(document)
+	}))
+	t.Cleanup(server.Close)
+	return NewJWKS(server.URL)
+}
+
+func testClaims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"user_id":  "550e8400-e29b-41d4-a716-446655440000",
+		"username": "alice",
+		"role":     "admin",
+		"exp":      time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	return signed
+}
+
+// serve runs handlers for one request and returns the response and the identity they saw
+func serve(authorization string, handlers ...gin.HandlerFunc) (*httptest.ResponseRecorder, gin.H) {
+	var seen gin.H
+	router := gin.New()
+	router.GET("/", append(handlers, func(c *gin.Context) {
+		seen = gin.H{"user_id": c.GetString("user_id"), "username": c.GetString("username"), "role": c.GetString("role")}
+		c.Status(http.StatusOK)
+	})...)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w, seen
+}
+
+func errorCode(t *testing.T, w *httptest.ResponseRecorder) string {
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode %q: %v", w.Body.String(), err)
+	}
+	return body.Code
+}
+
+func TestJWTAuth(t *testing.T) {
+	signingKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwks := serveJWKS(t, "key-1", &signingKey.PublicKey)
+
+	expired := testClaims()
+	expired["exp"] = time.Now().Add(-time.Minute).Unix()
+	unexpiring := testClaims()
+	delete(unexpiring, "exp")
+
+	tests := []struct {
+		name          string
+		authorization string
+		wantCode      string // empty when the request is let through
+	}{
+		{"ES256 with a published key", "Bearer " + sign(t, jwt.SigningMethodES256, "key-1", signingKey, testClaims()), ""},
+		{"HS256 without kid", "Bearer " + sign(t, jwt.SigningMethodHS256, "", []byte(testSecret), testClaims()), ""},
+		{"no header", "", "AUTH_HEADER_REQUIRED"},
+		{"not a bearer token", "Token abc", "INVALID_AUTH_FORMAT"},
+		{"ES256 signed by another key", "Bearer " + sign(t, jwt.SigningMethodES256, "key-1", otherKey, testClaims()), "INVALID_TOKEN"},
+		{"ES256 with an unknown kid", "Bearer " + sign(t, jwt.SigningMethodES256, "key-2", signingKey, testClaims()), "INVALID_TOKEN"},
+		{"ES256 without kid", "Bearer " + sign(t, jwt.SigningMethodES256, "", signingKey, testClaims()), "INVALID_TOKEN"},
+		// A kid means a signing key; HMAC with one could be forged with the public key material
+		{"HS256 with kid", "Bearer " + sign(t, jwt.SigningMethodHS256, "key-1", []byte(testSecret), testClaims()), "INVALID_TOKEN"},
+		{"HS256 with the wrong secret", "Bearer " + sign(t, jwt.SigningMethodHS256, "", []byte("other"), testClaims()), "INVALID_TOKEN"},
+		{"HS384", "Bearer " + sign(t, jwt.SigningMethodHS384, "", []byte(testSecret), testClaims()), "INVALID_TOKEN"},
+		{"expired", "Bearer " + sign(t, jwt.SigningMethodHS256, "", []byte(testSecret), expired), "INVALID_TOKEN"},
+		{"ES256 without exp", "Bearer " + sign(t, jwt.SigningMethodES256, "key-1", signingKey, unexpiring), "INVALID_TOKEN"},
+		{"HS256 without exp", "Bearer " + sign(t, jwt.SigningMethodHS256, "", []byte(testSecret), unexpiring), "INVALID_TOKEN"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, seen := serve(tt.authorization, JWTAuth(testSecret, jwks))
+			if tt.wantCode == "" {
+				if w.Code != http.StatusOK {
+					t.Fatalf("status %d (%s), want 200", w.Code, w.Body.String())
+				}
+				if seen["user_id"] != "550e8400-e29b-41d4-a716-446655440000" || seen["username"] != "alice" || seen["role"] != "admin" {
+					t.Errorf("identity = %v", seen)
+				}
+				return
+			}
+			if w.Code != http.StatusUnauthorized || errorCode(t, w) != tt.wantCode {
+				t.Errorf("got %d %s, want 401 %s", w.Code, w.Body.String(), tt.wantCode)
+			}
+		})
+	}
+}
+
+// Without JWT_SECRET an HS256 token signed with the empty key must not pass as an admin
+func TestJWTAuthWithoutSecret(t *testing.T) {
+	signingKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	jwks := serveJWKS(t, "key-1", &signingKey.PublicKey)
+
+	forged := "Bearer " + sign(t, jwt.SigningMethodHS256, "", []byte(""), testClaims())
+	for _, handlers := range [][]gin.HandlerFunc{
+		{JWTAuth("", jwks), RequireRole("admin")},
+		{JWTAuth("", nil), RequireRole("admin")},
+	} {
+		w, _ := serve(forged, handlers...)
+		if w.Code != http.StatusUnauthorized || errorCode(t, w) != "INVALID_TOKEN" {
+			t.Errorf("got %d %s, want 401 INVALID_TOKEN", w.Code, w.Body.String())
+		}
+	}
+
+	w, _ := serve("Bearer "+sign(t, jwt.SigningMethodES256, "key-1", signingKey, testClaims()), JWTAuth("", jwks))
+	if w.Code != http.StatusOK {
+		t.Errorf("ES256 token: status %d (%s), want 200", w.Code, w.Body.String())
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	tests := []struct {
+		role     string
+		wantCode string
+	}{
+		{"operator", ""},
+		{"admin", ""},
+		{"user", "INSUFFICIENT_PERMISSIONS"},
+		{"", "ROLE_NOT_FOUND"},
+	}
+	for _, tt := range tests {
+		setRole := func(c *gin.Context) { c.Set("role", tt.role) }
+		w, _ := serve("", setRole, RequireRole("operator"))
+		if tt.wantCode == "" {
+			if w.Code != http.StatusOK {
+				t.Errorf("role %q: status %d, want 200", tt.role, w.Code)
+			}
+			continue
+		}
+		if w.Code != http.StatusForbidden || errorCode(t, w) != tt.wantCode {
+			t.Errorf("role %q: got %d %s, want 403 %s", tt.role, w.Code, w.Body.String(), tt.wantCode)
+		}
+	}
+}
+
+func TestNodeAuth(t *testing.T) {
+	tests := []struct {
+		token         string
+		authorization string
+		wantOK        bool
+	}{
+		{"node-token", "Bearer node-token", true},
+		{"node-token", "Bearer other", false},
+		{"node-token", "node-token", false},
+		{"node-token", "", false},
+		// Without a configured token nothing is admitted, not even an empty bearer token
+		{"", "Bearer ", false},
+	}
+	for _, tt := range tests {
+		w, _ := serve(tt.authorization, NodeAuth(tt.token))
+		if ok := w.Code == http.StatusOK; ok != tt.wantOK {
+			t.Errorf("token %q, header %q: status %d, want ok %v", tt.token, tt.authorization, w.Code, tt.wantOK)
+		}
+		if !tt.wantOK && errorCode(t, w) != "INVALID_NODE_TOKEN" {
+			t.Errorf("token %q, header %q: code %s, want INVALID_NODE_TOKEN", tt.token, tt.authorization, errorCode(t, w))
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package middleware
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// jwksRefreshBackoff limits refetches triggered by tokens with an unknown kid
+const jwksRefreshBackoff = 10 * time.Second
+
+// JWKS caches the ES256 public keys api-service publishes at /.well-known/jwks.json.
+// The set is fetched again when a token names a key it does not have, which is how a
+// rotated signing key is picked up.
+type JWKS struct {
+	url    string
+	client *http.Client
+
+	mu        sync.RWMutex
+	keys      map[string]*ecdsa.PublicKey
+	fetchMu   sync.Mutex
+	fetchedAt time.Time
+}
+
+// NewJWKS creates a key cache for the JWKS document at url
+func NewJWKS(url string) *JWKS {
+	return &JWKS{
+		url:    url,
+		client: &http.Client{Timeout: 5 * time.Second},
+		keys:   make(map[string]*ecdsa.PublicKey),
+	}
+}
+
+// PublicKey returns the key named kid
+func (j *JWKS) PublicKey(kid string) (*ecdsa.PublicKey, error) {
+	if key := j.lookup(kid); key != nil {
+		return key, nil
+	}
+	if err := j.refresh(); err != nil {
+		return nil, err
+	}
+	if key := j.lookup(kid); key != nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func (j *JWKS) lookup(kid string) *ecdsa.PublicKey {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return j.keys[kid]
+}
+
+func (j *JWKS) refresh() error {
+	j.fetchMu.Lock()
+	defer j.fetchMu.Unlock()
+	if time.Since(j.fetchedAt) < jwksRefreshBackoff {
+		return nil
+	}
+	j.fetchedAt = time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, j.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := j.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch JWKS: %s", resp.Status)
+	}
+
+	var document struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+			Kid string `json:"kid"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&document); err != nil {
+		return fmt.Errorf("invalid JWKS: %w", err)
+	}
+
+	keys := make(map[string]*ecdsa.PublicKey, len(document.Keys))
+	for _, jwk := range document.Keys {
+		if jwk.Kty != "EC" || jwk.Crv != "P-256" || jwk.Kid == "" {
+			continue
+		}
+		x, errX := base64.RawURLEncoding.DecodeString(jwk.X)
+		y, errY := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if errX != nil || errY != nil || len(x) != 32 || len(y) != 32 {
+			continue
+		}
+		key, err := parseP256Point(append(append([]byte{4}, x...), y...))
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+
+	j.mu.Lock()
+	j.keys = keys
+	j.mu.Unlock()
+	return nil
+}
+
+// parseP256Point converts an uncompressed P-256 point, validating it is on the curve
+func parseP256Point(point []byte) (*ecdsa.PublicKey, error) {
+	key, err := ecdh.P256().NewPublicKey(point)
+	if err != nil {
+		return nil, err
+	}
+	// ecdh and ecdsa keys share the PKIX encoding
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	public, ok := parsed.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("not an ECDSA key")
+	}
+	return public, nil
+}
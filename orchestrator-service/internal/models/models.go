@@ -1,9 +1,17 @@
 package models
 
 import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"golang.org/x/net/idna"
 	"gorm.io/gorm"
 )
 
@@ -32,6 +40,39 @@ type VPSNode struct {
 	SNIAutoRenew    bool   `gorm:"default:true" json:"sni_auto_renew"`
 	SNIEmail        string `gorm:"size:255" json:"sni_email"`
 
+	// Hysteria2 masquerade settings
+	Masquerade JSONB `gorm:"type:jsonb" json:"masquerade"` // MasqueradeSettings
+
+	// Hysteria2 certificate source, NULL serves the certificates the agent manages. Holds DNS
+	// provider credentials, so it is only returned redacted.
+	CertificateMode JSONB `gorm:"type:jsonb" json:"-"` // CertificateModeSettings
+
+	// Protocol enable/disable matrix, NULL means every protocol is enabled
+	Protocols JSONB `gorm:"type:jsonb" json:"protocols"` // map[string]bool
+
+	// Resolver upstreams and per-domain rules, NULL keeps the agent's configured defaults
+	DNSPolicy JSONB `gorm:"type:jsonb" json:"dns_policy"` // DNSPolicy
+
+	// Egress queueing and DSCP marking, NULL keeps the agent's configured defaults
+	QoSPolicy JSONB `gorm:"type:jsonb" json:"qos_policy"` // QoSPolicy
+
+	// Outbounds Hysteria2 sends client traffic to and the rules choosing between them, NULL
+	// sends it out the way the agent is configured to. Holds proxy passwords, so it is only
+	// returned redacted through GetOutboundPolicy.
+	OutboundPolicy JSONB `gorm:"type:jsonb" json:"-"` // OutboundPolicy
+
+	// Obfuscation preset selected for the node and its settings as applied, NULL keeps the
+	// agent's configured obfuscation. The settings hold the node's Salamander password, so
+	// they are only returned through GetNodeObfuscation.
+	ObfuscationPreset string `gorm:"size:63;index" json:"obfuscation_preset"`
+	Obfuscation       JSONB  `gorm:"type:jsonb" json:"-"` // ObfuscationSettings
+
+	// Group selecting the config templates rendered for the node
+	NodeGroup string `gorm:"size:50;index" json:"node_group"`
+
+	// What a scheduled drift check does with the drift it finds: report it or heal it
+	DriftPolicy string `gorm:"size:20;default:'report'" json:"drift_policy"`
+
 	// Relations
 	Assignments []NodeAssignment `gorm:"foreignKey:NodeID" json:"assignments,omitempty"`
 	Metrics     []NodeMetric     `gorm:"foreignKey:NodeID" json:"metrics,omitempty"`
@@ -62,6 +103,16 @@ type NodeMetric struct {
 	ActiveConnections int       `json:"active_connections"`
 	RecordedAt        time.Time `gorm:"default:CURRENT_TIMESTAMP;index" json:"recorded_at"`
 
+	// Fullest partition holding server configs, certificates or logs, and deployed configs
+	// edited outside the agent
+	DiskUsedPercent       float64 `gorm:"type:decimal(5,2)" json:"disk_used_percent"`
+	DiskInodesUsedPercent float64 `gorm:"type:decimal(5,2)" json:"disk_inodes_used_percent"`
+	DiskLowPartitions     int     `gorm:"default:0" json:"disk_low_partitions"`
+	ConfigDriftFiles      int     `gorm:"default:0" json:"config_drift_files"`
+
+	// Traffic meant for WARP leaves through the backup egress while WARP is unhealthy
+	WARPFailoverActive bool `gorm:"default:false" json:"warp_failover_active"`
+
 	// Relations
 	Node *VPSNode `gorm:"foreignKey:NodeID" json:"node,omitempty"`
 }
@@ -95,11 +146,490 @@ type User struct {
 	UpdatedAt  time.Time  `gorm:"default:CURRENT_TIMESTAMP" json:"updated_at"`
 	LastLogin  *time.Time `json:"last_login"`
 	Notes      string     `gorm:"type:text" json:"notes"`
+	UserGroup  string     `gorm:"size:50;index" json:"user_group"` // Content filter lists can be assigned per group
 
 	// Relations
 	Assignments []NodeAssignment `gorm:"foreignKey:UserID" json:"assignments,omitempty"`
 }
 
+// FilterList is a domain blocklist or allowlist compiled into node routing
+type FilterList struct {
+	ID              uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	Name            string    `gorm:"size:63;unique;not null" json:"name"`
+	Category        string    `gorm:"size:50" json:"category"`
+	Action          string    `gorm:"size:10;not null;default:'block'" json:"action"`
+	URL             string    `gorm:"size:1000" json:"url"`
+	Format          string    `gorm:"size:20" json:"format"`
+	Domains         JSONB     `gorm:"type:jsonb" json:"domains"` // []string
+	RefreshInterval int       `gorm:"default:0" json:"refresh_interval"`
+	CreatedAt       time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+	UpdatedAt       time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"updated_at"`
+
+	// Relations
+	Assignments []FilterAssignment `gorm:"foreignKey:ListID" json:"assignments,omitempty"`
+}
+
+// FilterAssignment applies a list to a node, or every node when NodeID is nil, for the
+// users of a group, or every user when UserGroup is empty
+type FilterAssignment struct {
+	ID        uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	ListID    uuid.UUID  `gorm:"type:uuid;not null;index" json:"list_id"`
+	NodeID    *uuid.UUID `gorm:"type:uuid;index" json:"node_id"`
+	UserGroup string     `gorm:"size:50" json:"user_group"`
+	CreatedAt time.Time  `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+}
+
+// RoutingProfile sends the domains and addresses of its rules to other nodes, WARP, the
+// node's default outbound or nowhere, e.g. "Netflix via node X" or "local banking direct"
+type RoutingProfile struct {
+	ID          uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	Name        string    `gorm:"size:63;unique;not null" json:"name"`
+	Description string    `gorm:"size:255" json:"description"`
+	Outbounds   JSONB     `gorm:"type:jsonb" json:"outbounds"` // []RoutingOutbound
+	Rules       JSONB     `gorm:"type:jsonb" json:"rules"`     // []RoutingRule
+	CreatedAt   time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+	UpdatedAt   time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"updated_at"`
+
+	// Relations
+	Assignments []RoutingProfileAssignment `gorm:"foreignKey:ProfileID" json:"assignments,omitempty"`
+}
+
+// RoutingOutbound is a proxy rules of a RoutingProfile can send traffic to. With NodeID set
+// it connects to that node's address, resolved when the profile is pushed.
+type RoutingOutbound struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	NodeID   string `json:"node_id,omitempty"`
+	Address  string `json:"address,omitempty"`
+	Port     int    `json:"port"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Method   string `json:"method,omitempty"`
+	SNI      string `json:"sni,omitempty"`
+}
+
+// RoutingRule sends its domains, addresses and those of its presets to Outbounds
+type RoutingRule struct {
+	Domains   []string `json:"domains,omitempty"`
+	IPs       []string `json:"ips,omitempty"`
+	Presets   []string `json:"presets,omitempty"`
+	Outbounds []string `json:"outbounds"`
+	Strategy  string   `json:"strategy,omitempty"`
+}
+
+// RoutingProfileAssignment applies a profile to a node, or every node when NodeID is nil,
+// for the users of a group, or every user when UserGroup is empty
+type RoutingProfileAssignment struct {
+	ID        uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	ProfileID uuid.UUID  `gorm:"type:uuid;not null;index" json:"profile_id"`
+	NodeID    *uuid.UUID `gorm:"type:uuid;index" json:"node_id"`
+	UserGroup string     `gorm:"size:50" json:"user_group"`
+	CreatedAt time.Time  `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+}
+
+// RoutingPreset is a named set of domains and addresses rules can use instead of listing them
+type RoutingPreset struct {
+	Name        string
+	Description string
+	Domains     []string
+	IPs         []string
+}
+
+// ProbeReport is a censorship resilience report: the result of one node probing another
+// the way DPI systems probe suspected proxies
+type ProbeReport struct {
+	ID           uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	NodeID       uuid.UUID `gorm:"type:uuid;not null;index" json:"node_id"`
+	ProberNodeID uuid.UUID `gorm:"type:uuid;not null" json:"prober_node_id"`
+	Target       string    `gorm:"size:255" json:"target"`
+	Score        int       `gorm:"not null" json:"score"`
+	Checks       JSONB     `gorm:"type:jsonb" json:"checks"` // []ProbeCheck
+	StartedAt    time.Time `json:"started_at"`
+	FinishedAt   time.Time `json:"finished_at"`
+	CreatedAt    time.Time `gorm:"default:CURRENT_TIMESTAMP;index" json:"created_at"`
+}
+
+// ProbeCheck is the outcome of a single probe in a ProbeReport
+type ProbeCheck struct {
+	Name       string `json:"name"`
+	Target     string `json:"target"`
+	Status     string `json:"status"`
+	Detail     string `json:"detail,omitempty"`
+	Hint       string `json:"hint,omitempty"` // remediation, TLS checks only
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// TLSReport grades the TLS a node serves on its TCP ports, as another node saw it
+type TLSReport struct {
+	ID           uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	NodeID       uuid.UUID `gorm:"type:uuid;not null;index" json:"node_id"`
+	ProberNodeID uuid.UUID `gorm:"type:uuid;not null" json:"prober_node_id"`
+	Target       string    `gorm:"size:255" json:"target"`
+	Grade        string    `gorm:"size:1;not null" json:"grade"`
+	Score        int       `gorm:"not null" json:"score"`
+	Checks       JSONB     `gorm:"type:jsonb" json:"checks"` // []ProbeCheck
+	StartedAt    time.Time `json:"started_at"`
+	FinishedAt   time.Time `json:"finished_at"`
+	CreatedAt    time.Time `gorm:"default:CURRENT_TIMESTAMP;index" json:"created_at"`
+}
+
+// NodeSpeedtest is one measurement between a node and the reflector of a client region
+type NodeSpeedtest struct {
+	ID           uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	NodeID       uuid.UUID `gorm:"type:uuid;not null;index" json:"node_id"`
+	Region       string    `gorm:"size:50;not null;index" json:"region"`
+	Reflector    string    `gorm:"size:255" json:"reflector"`
+	LatencyMs    float64   `json:"latency_ms"`
+	DownloadMbps float64   `json:"download_mbps"`
+	UploadMbps   float64   `json:"upload_mbps"`
+	Error        string    `gorm:"type:text" json:"error,omitempty"`
+	MeasuredAt   time.Time `gorm:"not null;index" json:"measured_at"`
+}
+
+// NodeEgressCheck is one reputation check of the addresses a node's traffic leaves from
+type NodeEgressCheck struct {
+	ID        uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	NodeID    uuid.UUID `gorm:"type:uuid;not null;index" json:"node_id"`
+	Health    string    `gorm:"size:20;not null;index" json:"health"`
+	DirectIP  string    `gorm:"size:45" json:"direct_ip"`
+	WARPIP    string    `gorm:"size:45" json:"warp_ip"`
+	Paths     JSONB     `gorm:"type:jsonb" json:"paths"` // []EgressPath
+	CheckedAt time.Time `gorm:"not null;index" json:"checked_at"`
+}
+
+// NodeDrift is what the last drift check of a node found, one row per node
+type NodeDrift struct {
+	NodeID    uuid.UUID  `gorm:"type:uuid;primary_key" json:"node_id"`
+	Items     JSONB      `gorm:"type:jsonb" json:"items"` // []DriftItem, the drift left after a heal
+	Drifted   int        `gorm:"not null;default:0;index" json:"drifted"`
+	Heal      JSONB      `gorm:"type:jsonb" json:"heal"` // DriftHeal of the last heal
+	CheckedAt time.Time  `gorm:"not null" json:"checked_at"`
+	HealedAt  *time.Time `json:"healed_at"`
+}
+
+// DriftItem is one difference between a node and its desired state
+type DriftItem struct {
+	Kind     string `json:"kind"` // config, protocol, service, firewall, routing
+	Target   string `json:"target"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+}
+
+// DriftHeal lists what the last heal of a node did and what failed
+type DriftHeal struct {
+	Actions []string `json:"actions"`
+	Failed  []string `json:"failed,omitempty"`
+}
+
+// EgressPath is the address of one egress path in a NodeEgressCheck and what was found
+type EgressPath struct {
+	Path     string               `json:"path"`
+	IP       string               `json:"ip"`
+	Country  string               `json:"country,omitempty"`
+	Org      string               `json:"org,omitempty"`
+	Health   string               `json:"health"`
+	Issues   []string             `json:"issues,omitempty"`
+	Listings []EgressListing      `json:"listings,omitempty"`
+	Services []EgressServiceCheck `json:"services,omitempty"`
+	Error    string               `json:"error,omitempty"`
+}
+
+// EgressListing is the answer of one DNS blocklist in an EgressPath
+type EgressListing struct {
+	Zone   string   `json:"zone"`
+	Listed bool     `json:"listed"`
+	Codes  []string `json:"codes,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// EgressServiceCheck is how a streaming or search service treats the address of an EgressPath
+type EgressServiceCheck struct {
+	Service string `json:"service"`
+	Status  string `json:"status"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// DNSHostname is a service hostname whose A/AAAA records point at healthy nodes. With
+// Records set, only that many nodes are published at a time and they rotate every sync in
+// proportion to their weight.
+type DNSHostname struct {
+	ID           uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	Name         string     `gorm:"size:253;unique;not null" json:"name"`
+	NodeGroup    string     `gorm:"size:50" json:"node_group"` // empty publishes nodes of every group
+	Weights      JSONB      `gorm:"type:jsonb" json:"weights"` // map[node_id]int, nodes left out weigh 1
+	Records      int        `gorm:"default:0" json:"records"`  // nodes published at a time, 0 publishes all
+	TTL          int        `gorm:"default:60" json:"ttl"`
+	Proxied      bool       `gorm:"default:false" json:"proxied"`
+	Enabled      bool       `gorm:"default:false" json:"enabled"`
+	Published    JSONB      `gorm:"type:jsonb" json:"published"` // []DNSRecord
+	LastSyncedAt *time.Time `json:"last_synced_at"`
+	LastError    string     `gorm:"type:text" json:"last_error"`
+	CreatedAt    time.Time  `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+	UpdatedAt    time.Time  `gorm:"default:CURRENT_TIMESTAMP" json:"updated_at"`
+}
+
+// DNSRecord is a record published for a DNSHostname
+type DNSRecord struct {
+	Type    string `json:"type"`
+	Content string `json:"content"`
+	NodeID  string `json:"node_id"`
+}
+
+// Rollout is a staged upgrade of a component across nodes: canaries first, then the
+// remaining nodes in batches once the canaries have stayed healthy for the soak period
+type Rollout struct {
+	ID          uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	Component   string     `gorm:"size:20;not null" json:"component"`
+	Version     string     `gorm:"size:50;not null" json:"version"`
+	Status      string     `gorm:"size:20;not null;index" json:"status"`
+	BatchSize   int        `gorm:"not null" json:"batch_size"`
+	SoakSeconds int        `gorm:"not null" json:"soak_seconds"`
+	MaxFailures int        `gorm:"not null;default:0" json:"max_failures"`
+	Nodes       JSONB      `gorm:"type:jsonb" json:"nodes"` // []RolloutNode
+	Error       string     `gorm:"type:text" json:"error,omitempty"`
+	CreatedAt   time.Time  `gorm:"default:CURRENT_TIMESTAMP;index" json:"created_at"`
+	FinishedAt  *time.Time `json:"finished_at"`
+}
+
+// RolloutNode is the progress of one node in a Rollout
+type RolloutNode struct {
+	NodeID           uuid.UUID  `json:"node_id"`
+	NodeName         string     `json:"node_name"`
+	Stage            string     `json:"stage"` // "canary" or "batch-N"
+	Status           string     `json:"status"`
+	PreviousVersion  string     `json:"previous_version,omitempty"`
+	InstalledVersion string     `json:"installed_version,omitempty"`
+	Message          string     `json:"message,omitempty"`
+	FinishedAt       *time.Time `json:"finished_at,omitempty"`
+}
+
+// MaintenanceWindow is a node operation scheduled for a time window. Its nodes are drained
+// by putting them in maintenance status, either while the operation runs or, with Drain,
+// until the window closes.
+type MaintenanceWindow struct {
+	ID            uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	Operation     string     `gorm:"size:20;not null" json:"operation"`
+	Service       string     `gorm:"size:20" json:"service,omitempty"` // restarted service, empty for every server
+	Nodes         JSONB      `gorm:"type:jsonb" json:"nodes"`          // []MaintenanceNode
+	StartsAt      time.Time  `gorm:"not null;index" json:"starts_at"`
+	EndsAt        time.Time  `gorm:"not null;index" json:"ends_at"`
+	Drain         bool       `gorm:"default:false" json:"drain"`
+	Status        string     `gorm:"size:20;not null;index" json:"status"`
+	Reason        string     `gorm:"type:text" json:"reason,omitempty"`
+	Error         string     `gorm:"type:text" json:"error,omitempty"`
+	AffectedUsers int        `gorm:"default:0" json:"affected_users"`
+	NotifiedAt    *time.Time `json:"notified_at"`
+	CreatedAt     time.Time  `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+	StartedAt     *time.Time `json:"started_at"`
+	FinishedAt    *time.Time `json:"finished_at"`
+}
+
+// MaintenanceNode is the progress of one node in a MaintenanceWindow. PreviousStatus is
+// restored when the node leaves maintenance.
+type MaintenanceNode struct {
+	NodeID         uuid.UUID  `json:"node_id"`
+	NodeName       string     `json:"node_name"`
+	PreviousStatus string     `json:"previous_status,omitempty"`
+	Status         string     `json:"status"`
+	Message        string     `json:"message,omitempty"`
+	FinishedAt     *time.Time `json:"finished_at,omitempty"`
+}
+
+// ConfigTemplate is a Hysteria2 or Xray config with {{variable}} placeholders. The deploy
+// pipeline renders it per node from the template defaults, the node's own variables and
+// the variables of the assignment covering the node's group.
+type ConfigTemplate struct {
+	ID        uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	Name      string    `gorm:"size:40;unique;not null" json:"name"`
+	Kind      string    `gorm:"size:20;not null" json:"kind"`
+	Protocol  string    `gorm:"size:30" json:"protocol,omitempty"` // Xray protocol
+	Body      string    `gorm:"type:text;not null" json:"body"`
+	Variables JSONB     `gorm:"type:jsonb" json:"variables"` // map[string]string defaults
+	Version   int       `gorm:"not null;default:1" json:"version"`
+	CreatedAt time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+	UpdatedAt time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"updated_at"`
+
+	// Relations
+	Assignments []ConfigTemplateAssignment `gorm:"foreignKey:TemplateID" json:"assignments,omitempty"`
+}
+
+// ConfigTemplateAssignment applies a template to the nodes of a group, or to every node no
+// group-specific template of the same kind covers when NodeGroup is empty
+type ConfigTemplateAssignment struct {
+	ID         uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	TemplateID uuid.UUID `gorm:"type:uuid;not null;index" json:"template_id"`
+	NodeGroup  string    `gorm:"size:50" json:"node_group"`
+	Variables  JSONB     `gorm:"type:jsonb" json:"variables"` // map[string]string overrides
+	CreatedAt  time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+}
+
+// ObfuscationPreset is a custom set of obfuscation settings nodes can select by name, next
+// to the built-in ObfuscationPresets
+type ObfuscationPreset struct {
+	ID          uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	Name        string    `gorm:"size:63;unique;not null" json:"name"`
+	Description string    `gorm:"size:255" json:"description"`
+	Settings    JSONB     `gorm:"type:jsonb" json:"settings"` // ObfuscationSettings
+	CreatedAt   time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+	UpdatedAt   time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"updated_at"`
+}
+
+// BuiltinObfuscationPreset is an obfuscation preset shipped with the orchestrator
+type BuiltinObfuscationPreset struct {
+	Name        string
+	Description string
+	Settings    ObfuscationSettings
+}
+
+// ObfuscationExperiment runs two obfuscation presets side by side, each on its own nodes,
+// and compares how client connections to the two sets of nodes fare
+type ObfuscationExperiment struct {
+	ID            uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	Name          string     `gorm:"size:100;not null" json:"name"`
+	Status        string     `gorm:"size:20;not null;index" json:"status"`
+	Arms          JSONB      `gorm:"type:jsonb" json:"arms"` // []ExperimentArm
+	StartedAt     time.Time  `gorm:"not null" json:"started_at"`
+	EndsAt        time.Time  `gorm:"not null" json:"ends_at"` // samples are accepted until then
+	FinishedAt    *time.Time `json:"finished_at"`
+	AppliedPreset string     `gorm:"size:63" json:"applied_preset,omitempty"` // preset the nodes were left on
+	CreatedAt     time.Time  `gorm:"default:CURRENT_TIMESTAMP;index" json:"created_at"`
+}
+
+// ExperimentArm is one side of an ObfuscationExperiment
+type ExperimentArm struct {
+	Name   string           `json:"name"` // "a" or "b"
+	Preset string           `json:"preset"`
+	Nodes  []ExperimentNode `json:"nodes"`
+}
+
+// ExperimentNode is a node taking part in an experiment arm. PreviousPreset is restored
+// when the experiment stops without a preset to keep.
+type ExperimentNode struct {
+	NodeID         uuid.UUID `json:"node_id"`
+	NodeName       string    `json:"node_name"`
+	PreviousPreset string    `json:"previous_preset,omitempty"`
+	Status         string    `json:"status"`
+	Message        string    `json:"message,omitempty"`
+}
+
+// ExperimentSample is a connection attempt a client reported for a node in an experiment
+type ExperimentSample struct {
+	ID             uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	ExperimentID   uuid.UUID `gorm:"type:uuid;not null;index" json:"experiment_id"`
+	Arm            string    `gorm:"size:1;not null" json:"arm"`
+	NodeID         uuid.UUID `gorm:"type:uuid;not null" json:"node_id"`
+	Success        bool      `gorm:"not null" json:"success"`
+	HandshakeMs    int       `json:"handshake_ms"`
+	ThroughputKbps int       `json:"throughput_kbps"` // 0 when the client did not measure it
+	FailureReason  string    `gorm:"size:50" json:"failure_reason,omitempty"`
+	CreatedAt      time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+}
+
+// AllowedNetwork is a network admins or node agents may connect from. api-service owns the
+// table; the orchestrator reads the agent networks to guard its gRPC port.
+type AllowedNetwork struct {
+	ID          uuid.UUID `gorm:"type:uuid;primary_key" json:"id"`
+	Scope       string    `gorm:"size:20;not null;index" json:"scope"` // admin or agent
+	CIDR        string    `gorm:"column:cidr;size:50;not null" json:"cidr"`
+	Description string    `gorm:"size:255" json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// ScalingPolicy keeps the bandwidth of a node group within bounds by creating servers with
+// a cloud provider when the group runs hot and destroying the servers it created once they
+// sit idle. Nodes without a max_mbps capacity count as NodeMbps.
+type ScalingPolicy struct {
+	ID               uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	NodeGroup        string     `gorm:"size:50;unique;not null" json:"node_group"`
+	Provider         string     `gorm:"size:20;not null" json:"provider"`
+	Region           string     `gorm:"size:50;not null" json:"region"`
+	Size             string     `gorm:"size:50;not null" json:"size"`
+	Image            string     `gorm:"size:100;not null" json:"image"`
+	Location         string     `gorm:"size:100" json:"location"`
+	Country          string     `gorm:"size:2" json:"country"`
+	MinNodes         int        `gorm:"default:0" json:"min_nodes"` // online nodes of the group, provisioned or not
+	MaxNodes         int        `gorm:"default:0" json:"max_nodes"`
+	NodeMbps         int        `gorm:"default:0" json:"node_mbps"`
+	ScaleUpPercent   int        `gorm:"default:80" json:"scale_up_percent"`
+	ScaleDownPercent int        `gorm:"default:30" json:"scale_down_percent"`
+	IdleMinutes      int        `gorm:"default:30" json:"idle_minutes"`
+	Cooldown         int        `gorm:"default:600" json:"cooldown"` // seconds between scaling actions
+	Enabled          bool       `gorm:"default:false" json:"enabled"`
+	LastScaledAt     *time.Time `json:"last_scaled_at"`
+	LastError        string     `gorm:"type:text" json:"last_error"`
+	CreatedAt        time.Time  `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+	UpdatedAt        time.Time  `gorm:"default:CURRENT_TIMESTAMP" json:"updated_at"`
+}
+
+// ProvisionedServer is a cloud server created for a node. Its ID is the provision ID the
+// agent registers with, which ties the server to its node.
+type ProvisionedServer struct {
+	ID           uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	PolicyID     *uuid.UUID `gorm:"type:uuid;index" json:"policy_id"` // nil for servers created by hand
+	NodeGroup    string     `gorm:"size:50" json:"node_group"`
+	Provider     string     `gorm:"size:20;not null" json:"provider"`
+	ServerID     string     `gorm:"size:100" json:"server_id"` // the provider's ID
+	Name         string     `gorm:"size:100;not null" json:"name"`
+	Region       string     `gorm:"size:50" json:"region"`
+	Size         string     `gorm:"size:50" json:"size"`
+	IPAddress    string     `gorm:"size:45" json:"ip_address"`
+	IPv6Address  string     `gorm:"size:45" json:"ipv6_address"`
+	NodeID       *uuid.UUID `gorm:"type:uuid;index" json:"node_id"`
+	Status       string     `gorm:"size:20;not null;index" json:"status"`
+	Error        string     `gorm:"type:text" json:"error,omitempty"`
+	IdleSince    *time.Time `json:"idle_since"`
+	CreatedAt    time.Time  `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+	RegisteredAt *time.Time `json:"registered_at"`
+	DestroyedAt  *time.Time `json:"destroyed_at"`
+}
+
+// NodeJoinToken is a token in the user data of a new server, which the server exchanges once,
+// before it expires, for the node auth token. Only its SHA-256 is stored.
+type NodeJoinToken struct {
+	ID          uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	TokenHash   string     `gorm:"size:64;not null;uniqueIndex" json:"-"`
+	NodeID      *uuid.UUID `gorm:"type:uuid" json:"node_id"`      // set for the bootstrap of an existing node
+	ProvisionID *uuid.UUID `gorm:"type:uuid" json:"provision_id"` // set for servers the autoscaler creates
+	ExpiresAt   time.Time  `gorm:"not null;index" json:"expires_at"`
+	UsedAt      *time.Time `json:"used_at"`
+	UsedFrom    string     `gorm:"size:45" json:"used_from,omitempty"`
+	CreatedAt   time.Time  `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+}
+
+// NodeCertificate is a certificate a node served at its last inventory sync
+type NodeCertificate struct {
+	ID         uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	NodeID     uuid.UUID `gorm:"type:uuid;not null;index" json:"node_id"`
+	Domain     string    `gorm:"size:253;not null;index" json:"domain"`
+	Issuer     string    `gorm:"size:255" json:"issuer"`
+	Source     string    `gorm:"size:10;not null" json:"source"` // "files" or "acme"
+	SelfSigned bool      `gorm:"not null;default:false" json:"self_signed"`
+	NotBefore  time.Time `json:"not_before"`
+	NotAfter   time.Time `gorm:"not null;index" json:"not_after"`
+	SyncedAt   time.Time `gorm:"not null" json:"synced_at"`
+}
+
+// UploadedCertificate is a certificate an operator provided for a domain ACME cannot serve,
+// installed on every node serving a domain it covers
+type UploadedCertificate struct {
+	ID             uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	Domain         string    `gorm:"size:253;not null;uniqueIndex" json:"domain"`
+	CertificatePEM string    `gorm:"type:text;not null" json:"certificate_pem"` // leaf followed by its intermediates
+	PrivateKeyPEM  string    `gorm:"type:text;not null" json:"-"`
+	CABundlePEM    string    `gorm:"type:text" json:"ca_bundle_pem,omitempty"`
+	Issuer         string    `gorm:"size:255" json:"issuer"`
+	Fingerprint    string    `gorm:"size:64;not null" json:"fingerprint"`
+	NotBefore      time.Time `json:"not_before"`
+	NotAfter       time.Time `gorm:"not null" json:"not_after"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// Covers reports whether the certificate serves a normalized SNI domain
+func (c *UploadedCertificate) Covers(domain string) bool {
+	return c.Domain == domain || wildcardCovers(c.Domain, domain)
+}
+
 // JSONB type for PostgreSQL JSONB fields
 type JSONB map[string]interface{}
 
@@ -108,7 +638,7 @@ func (j JSONB) Value() (interface{}, error) {
 	if j == nil {
 		return nil, nil
 	}
-	return j, nil
+	return json.Marshal(j)
 }
 
 // Scan implements sql.Scanner interface
@@ -122,9 +652,17 @@ func (j *JSONB) Scan(value interface{}) error {
 	case map[string]interface{}:
 		*j = v
 	case []byte:
-		// Handle byte array conversion if needed
-		*j = make(map[string]interface{})
-		// Simple JSON parsing could be added here
+		result := make(map[string]interface{})
+		if err := json.Unmarshal(v, &result); err != nil {
+			return fmt.Errorf("failed to unmarshal JSONB: %w", err)
+		}
+		*j = result
+	case string:
+		result := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(v), &result); err != nil {
+			return fmt.Errorf("failed to unmarshal JSONB: %w", err)
+		}
+		*j = result
 	default:
 		*j = make(map[string]interface{})
 	}
@@ -161,6 +699,125 @@ func (d *Deployment) BeforeCreate(tx *gorm.DB) error {
 	return nil
 }
 
+func (f *FilterList) BeforeCreate(tx *gorm.DB) error {
+	if f.ID == uuid.Nil {
+		f.ID = uuid.New()
+	}
+	return nil
+}
+
+func (fa *FilterAssignment) BeforeCreate(tx *gorm.DB) error {
+	if fa.ID == uuid.Nil {
+		fa.ID = uuid.New()
+	}
+	return nil
+}
+
+func (rp *RoutingProfile) BeforeCreate(tx *gorm.DB) error {
+	if rp.ID == uuid.Nil {
+		rp.ID = uuid.New()
+	}
+	return nil
+}
+
+func (ra *RoutingProfileAssignment) BeforeCreate(tx *gorm.DB) error {
+	if ra.ID == uuid.Nil {
+		ra.ID = uuid.New()
+	}
+	return nil
+}
+
+func (dh *DNSHostname) BeforeCreate(tx *gorm.DB) error {
+	if dh.ID == uuid.Nil {
+		dh.ID = uuid.New()
+	}
+	return nil
+}
+
+func (pr *ProbeReport) BeforeCreate(tx *gorm.DB) error {
+	if pr.ID == uuid.Nil {
+		pr.ID = uuid.New()
+	}
+	return nil
+}
+
+func (ns *NodeSpeedtest) BeforeCreate(tx *gorm.DB) error {
+	if ns.ID == uuid.Nil {
+		ns.ID = uuid.New()
+	}
+	return nil
+}
+
+func (ec *NodeEgressCheck) BeforeCreate(tx *gorm.DB) error {
+	if ec.ID == uuid.Nil {
+		ec.ID = uuid.New()
+	}
+	return nil
+}
+
+func (r *Rollout) BeforeCreate(tx *gorm.DB) error {
+	if r.ID == uuid.Nil {
+		r.ID = uuid.New()
+	}
+	return nil
+}
+
+func (m *MaintenanceWindow) BeforeCreate(tx *gorm.DB) error {
+	if m.ID == uuid.Nil {
+		m.ID = uuid.New()
+	}
+	return nil
+}
+
+func (ct *ConfigTemplate) BeforeCreate(tx *gorm.DB) error {
+	if ct.ID == uuid.Nil {
+		ct.ID = uuid.New()
+	}
+	return nil
+}
+
+func (ca *ConfigTemplateAssignment) BeforeCreate(tx *gorm.DB) error {
+	if ca.ID == uuid.Nil {
+		ca.ID = uuid.New()
+	}
+	return nil
+}
+
+func (op *ObfuscationPreset) BeforeCreate(tx *gorm.DB) error {
+	if op.ID == uuid.Nil {
+		op.ID = uuid.New()
+	}
+	return nil
+}
+
+func (oe *ObfuscationExperiment) BeforeCreate(tx *gorm.DB) error {
+	if oe.ID == uuid.Nil {
+		oe.ID = uuid.New()
+	}
+	return nil
+}
+
+func (es *ExperimentSample) BeforeCreate(tx *gorm.DB) error {
+	if es.ID == uuid.Nil {
+		es.ID = uuid.New()
+	}
+	return nil
+}
+
+func (sp *ScalingPolicy) BeforeCreate(tx *gorm.DB) error {
+	if sp.ID == uuid.Nil {
+		sp.ID = uuid.New()
+	}
+	return nil
+}
+
+func (ps *ProvisionedServer) BeforeCreate(tx *gorm.DB) error {
+	if ps.ID == uuid.Nil {
+		ps.ID = uuid.New()
+	}
+	return nil
+}
+
 // TableName methods for custom table names
 func (VPSNode) TableName() string {
 	return "vps_nodes"
@@ -178,6 +835,98 @@ func (Deployment) TableName() string {
 	return "deployments"
 }
 
+func (FilterList) TableName() string {
+	return "filter_lists"
+}
+
+func (FilterAssignment) TableName() string {
+	return "filter_assignments"
+}
+
+func (RoutingProfile) TableName() string {
+	return "routing_profiles"
+}
+
+func (RoutingProfileAssignment) TableName() string {
+	return "routing_profile_assignments"
+}
+
+func (DNSHostname) TableName() string {
+	return "dns_hostnames"
+}
+
+func (ProbeReport) TableName() string {
+	return "probe_reports"
+}
+
+func (TLSReport) TableName() string {
+	return "tls_reports"
+}
+
+func (NodeSpeedtest) TableName() string {
+	return "node_speedtests"
+}
+
+func (NodeEgressCheck) TableName() string {
+	return "node_egress_checks"
+}
+
+func (NodeDrift) TableName() string {
+	return "node_drift"
+}
+
+func (Rollout) TableName() string {
+	return "rollouts"
+}
+
+func (MaintenanceWindow) TableName() string {
+	return "maintenance_windows"
+}
+
+func (ConfigTemplate) TableName() string {
+	return "config_templates"
+}
+
+func (ConfigTemplateAssignment) TableName() string {
+	return "config_template_assignments"
+}
+
+func (ObfuscationPreset) TableName() string {
+	return "obfuscation_presets"
+}
+
+func (ObfuscationExperiment) TableName() string {
+	return "obfuscation_experiments"
+}
+
+func (ExperimentSample) TableName() string {
+	return "experiment_samples"
+}
+
+func (AllowedNetwork) TableName() string {
+	return "allowed_networks"
+}
+
+func (ScalingPolicy) TableName() string {
+	return "scaling_policies"
+}
+
+func (ProvisionedServer) TableName() string {
+	return "provisioned_servers"
+}
+
+func (NodeJoinToken) TableName() string {
+	return "node_join_tokens"
+}
+
+func (NodeCertificate) TableName() string {
+	return "node_certificates"
+}
+
+func (UploadedCertificate) TableName() string {
+	return "uploaded_certificates"
+}
+
 // Helper methods
 func (n *VPSNode) IsOnline() bool {
 	return n.Status == "online"
@@ -199,6 +948,63 @@ func (n *VPSNode) GetMetadata(key string) (interface{}, bool) {
 	return value, exists
 }
 
+// Node metadata keys holding the node's capacity; the api-service reads them when it ranks
+// nodes for users
+const (
+	MetadataMaxUsers       = "max_users"
+	MetadataMaxConnections = "max_connections"
+	MetadataMaxMbps        = "max_mbps"
+)
+
+// NodeCapacity caps what a node takes on, 0 leaves a cap unset
+type NodeCapacity struct {
+	MaxUsers       int
+	MaxConnections int
+	MaxMbps        int
+}
+
+// Capacity reads the node's capacity from its metadata
+func (n *VPSNode) Capacity() NodeCapacity {
+	return NodeCapacity{
+		MaxUsers:       n.metadataInt(MetadataMaxUsers),
+		MaxConnections: n.metadataInt(MetadataMaxConnections),
+		MaxMbps:        n.metadataInt(MetadataMaxMbps),
+	}
+}
+
+// SetCapacity stores the capacity in the node's metadata, leaving out unset caps
+func (n *VPSNode) SetCapacity(capacity NodeCapacity) {
+	if n.Metadata == nil {
+		n.Metadata = JSONB{}
+	}
+	for key, value := range map[string]int{
+		MetadataMaxUsers:       capacity.MaxUsers,
+		MetadataMaxConnections: capacity.MaxConnections,
+		MetadataMaxMbps:        capacity.MaxMbps,
+	} {
+		if value > 0 {
+			n.Metadata[key] = value
+		} else {
+			delete(n.Metadata, key)
+		}
+	}
+}
+
+// metadataInt reads a number from the metadata, which holds strings when set through the
+// api-service and numbers otherwise
+func (n *VPSNode) metadataInt(key string) int {
+	switch value := n.Metadata[key].(type) {
+	case float64:
+		return int(value)
+	case int:
+		return value
+	case string:
+		i, _ := strconv.Atoi(value)
+		return i
+	}
+	return 0
+}
+
 // SNI-related helper methods
 func (n *VPSNode) GetSNIDomains() []string {
 	if n.SNIDomains == nil {
@@ -264,22 +1070,1557 @@ func (n *VPSNode) RemoveSNIDomain(domain string) {
 	n.SetSNIDomains(domains)
 }
 
-// Constants
-const (
-	NodeStatusOffline     = "offline"
-	NodeStatusOnline      = "online"
-	NodeStatusMaintenance = "maintenance"
-	NodeStatusError       = "error"
+// sniDomainProfile maps domains the way TLS clients send them: lower-case, IDNA A-labels
+var sniDomainProfile = idna.New(
+	idna.MapForLookup(),
+	idna.BidiRule(),
+	idna.VerifyDNSLength(true),
+	idna.Transitional(false),
+)
 
-	DeploymentStatusPending   = "pending"
-	DeploymentStatusDeploying = "deploying"
-	DeploymentStatusSuccess   = "success"
-	DeploymentStatusFailed    = "failed"
+// NormalizeSNIDomain validates an SNI domain and returns the form it is stored and compared
+// in: lower-case ASCII without a trailing dot, e.g. "xn--e1afmkfd.xn--p1ai" for
+// "пример.рф". A wildcard must be the whole leftmost label of a name with at least two
+// more labels, e.g. "*.example.com".
+func NormalizeSNIDomain(domain string) (string, error) {
+	name := strings.TrimSuffix(strings.TrimSpace(domain), ".")
+	if name == "" {
+		return "", fmt.Errorf("domain cannot be empty")
+	}
 
-	UserStatusActive    = "active"
-	UserStatusSuspended = "suspended"
-	UserStatusDeleted   = "deleted"
+	wildcard := strings.HasPrefix(name, "*.")
+	if wildcard {
+		name = name[2:]
+	}
+	if strings.Contains(name, "*") {
+		return "", fmt.Errorf("invalid domain %q: a wildcard must be the whole leftmost label", domain)
+	}
+	if net.ParseIP(name) != nil {
+		return "", fmt.Errorf("invalid domain %q: SNI requires a host name, not an IP address", domain)
+	}
 
-	UserRoleAdmin = "admin"
-	UserRoleUser  = "user"
+	ascii, err := sniDomainProfile.ToASCII(name)
+	if err != nil {
+		return "", fmt.Errorf("invalid domain %q: %w", domain, err)
+	}
+	if !strings.Contains(ascii, ".") {
+		return "", fmt.Errorf("invalid domain %q: a fully qualified name is required", domain)
+	}
+
+	if wildcard {
+		return "*." + ascii, nil
+	}
+	return ascii, nil
+}
+
+// SNIDomainsOverlap reports whether two normalized domains match a common server name,
+// e.g. "*.example.com" and "vpn.example.com". A wildcard covers exactly one label.
+func SNIDomainsOverlap(a, b string) bool {
+	return a == b || wildcardCovers(a, b) || wildcardCovers(b, a)
+}
+
+func wildcardCovers(pattern, name string) bool {
+	if !strings.HasPrefix(pattern, "*.") || strings.HasPrefix(name, "*.") {
+		return false
+	}
+	label := strings.TrimSuffix(name, pattern[1:])
+	return label != name && label != "" && !strings.Contains(label, ".")
+}
+
+// MasqueradeSettings describes what a node's Hysteria2 server serves to unauthenticated probes
+type MasqueradeSettings struct {
+	Type          string            `json:"type"` // "string", "file", "proxy"
+	ProxyURL      string            `json:"proxy_url,omitempty"`
+	RewriteHost   bool              `json:"rewrite_host"`
+	FileDir       string            `json:"file_dir,omitempty"`
+	StringContent string            `json:"string_content,omitempty"`
+	StringStatus  int               `json:"string_status,omitempty"`
+	StringHeaders map[string]string `json:"string_headers,omitempty"`
+}
+
+// Masquerade-related helper methods
+func (n *VPSNode) GetMasquerade() MasqueradeSettings {
+	settings := MasqueradeSettings{
+		Type:        MasqueradeTypeProxy,
+		ProxyURL:    DefaultMasqueradeProxyURL,
+		RewriteHost: true,
+	}
+	if len(n.Masquerade) == 0 {
+		return settings
+	}
+
+	data, err := json.Marshal(n.Masquerade)
+	if err != nil {
+		return settings
+	}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return settings
+	}
+	return settings
+}
+
+func (n *VPSNode) SetMasquerade(settings MasqueradeSettings) error {
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+
+	masquerade := JSONB{}
+	if err := json.Unmarshal(data, &masquerade); err != nil {
+		return err
+	}
+	n.Masquerade = masquerade
+	return nil
+}
+
+// CertificateModeSettings selects whether a node's Hysteria2 server serves the certificates
+// the agent manages or obtains its own through ACME
+type CertificateModeSettings struct {
+	Mode        string            `json:"mode"` // "files" or "acme"
+	Domains     []string          `json:"domains,omitempty"`
+	Email       string            `json:"email,omitempty"`
+	CA          string            `json:"ca,omitempty"`        // "letsencrypt" or "zerossl"
+	Challenge   string            `json:"challenge,omitempty"` // "http", "tls" or "dns"
+	ListenHost  string            `json:"listen_host,omitempty"`
+	AltPort     int               `json:"alt_port,omitempty"`
+	DNSProvider string            `json:"dns_provider,omitempty"`
+	DNSConfig   map[string]string `json:"dns_config,omitempty"`
+}
+
+// Validate checks the mode before it is pushed to a node; the agent checks domains and
+// DNS providers
+func (s CertificateModeSettings) Validate() error {
+	switch s.Mode {
+	case CertificateModeFiles:
+		return nil
+	case CertificateModeACME:
+	default:
+		return fmt.Errorf("mode must be %s or %s", CertificateModeFiles, CertificateModeACME)
+	}
+	switch s.CA {
+	case "", ACMECALetsEncrypt, ACMECAZeroSSL:
+	default:
+		return fmt.Errorf("ca must be %s or %s", ACMECALetsEncrypt, ACMECAZeroSSL)
+	}
+	switch s.Challenge {
+	case "", "http", "tls":
+	case "dns":
+		if s.DNSProvider == "" || len(s.DNSConfig) == 0 {
+			return fmt.Errorf("dns challenge needs a DNS provider and its credentials")
+		}
+	default:
+		return fmt.Errorf("challenge must be http, tls or dns")
+	}
+	if s.AltPort < 0 || s.AltPort > 65535 {
+		return fmt.Errorf("invalid challenge port %d", s.AltPort)
+	}
+	return nil
+}
+
+// Redacted returns the settings without the DNS provider credentials
+func (s CertificateModeSettings) Redacted() CertificateModeSettings {
+	s.DNSConfig = nil
+	return s
+}
+
+// Certificate mode helper methods
+func (n *VPSNode) GetCertificateMode() (CertificateModeSettings, bool) {
+	settings := CertificateModeSettings{Mode: CertificateModeFiles}
+	if len(n.CertificateMode) == 0 {
+		return settings, false
+	}
+
+	data, err := json.Marshal(n.CertificateMode)
+	if err != nil {
+		return settings, false
+	}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return settings, false
+	}
+	return settings, true
+}
+
+func (n *VPSNode) SetCertificateMode(settings CertificateModeSettings) error {
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+
+	mode := JSONB{}
+	if err := json.Unmarshal(data, &mode); err != nil {
+		return err
+	}
+	n.CertificateMode = mode
+	return nil
+}
+
+// DNSRule routes queries for a set of domains to its own upstreams or route
+type DNSRule struct {
+	Domains   []string `json:"domains"`
+	Upstreams []string `json:"upstreams,omitempty"`
+	Route     string   `json:"route,omitempty"` // "warp", "direct", or empty to follow ViaWARP
+}
+
+// DNSPolicy describes how a node's embedded resolver forwards queries
+type DNSPolicy struct {
+	Upstreams []string  `json:"upstreams"`
+	ViaWARP   bool      `json:"via_warp"`
+	Rules     []DNSRule `json:"rules,omitempty"`
+}
+
+// Validate checks upstream schemes and rule routes before the policy is pushed to a node
+func (p DNSPolicy) Validate() error {
+	if len(p.Upstreams) == 0 {
+		return fmt.Errorf("at least one upstream is required")
+	}
+	if err := validateDNSUpstreams(p.Upstreams); err != nil {
+		return err
+	}
+	for i, rule := range p.Rules {
+		if len(rule.Domains) == 0 {
+			return fmt.Errorf("rule %d has no domains", i+1)
+		}
+		if err := validateDNSUpstreams(rule.Upstreams); err != nil {
+			return fmt.Errorf("rule %d: %w", i+1, err)
+		}
+		switch rule.Route {
+		case "", DNSRouteWARP, DNSRouteDirect:
+		default:
+			return fmt.Errorf("rule %d: unsupported route %q", i+1, rule.Route)
+		}
+	}
+	return nil
+}
+
+func validateDNSUpstreams(upstreams []string) error {
+	for _, upstream := range upstreams {
+		u, err := url.Parse(upstream)
+		if err != nil || u.Hostname() == "" {
+			return fmt.Errorf("invalid upstream %q", upstream)
+		}
+		if u.Scheme != DNSUpstreamSchemeDoH && u.Scheme != DNSUpstreamSchemeDoT {
+			return fmt.Errorf("upstream %q must use https:// (DoH) or tls:// (DoT)", upstream)
+		}
+	}
+	return nil
+}
+
+// DNS policy helper methods
+func (n *VPSNode) GetDNSPolicy() (DNSPolicy, bool) {
+	var policy DNSPolicy
+	if len(n.DNSPolicy) == 0 {
+		return policy, false
+	}
+
+	data, err := json.Marshal(n.DNSPolicy)
+	if err != nil {
+		return policy, false
+	}
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return policy, false
+	}
+	return policy, true
+}
+
+func (n *VPSNode) SetDNSPolicy(policy DNSPolicy) error {
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+
+	dnsPolicy := JSONB{}
+	if err := json.Unmarshal(data, &dnsPolicy); err != nil {
+		return err
+	}
+	n.DNSPolicy = dnsPolicy
+	return nil
+}
+
+// QoS queueing disciplines
+const (
+	QoSQdiscFQCoDel = "fq_codel"
+	QoSQdiscCake    = "cake"
+)
+
+// QoSClass marks a node's traffic to or from a port range with a DSCP class
+type QoSClass struct {
+	Name     string `json:"name"`
+	Protocol string `json:"protocol,omitempty"` // "tcp" or "udp", empty for both
+	Ports    string `json:"ports"`              // "53" or "20000-50000"
+	DSCP     string `json:"dscp"`               // "EF", "AF41", "CS1"...
+}
+
+// QoSPolicy describes how a node queues its egress traffic
+type QoSPolicy struct {
+	Enabled       bool       `json:"enabled"`
+	Qdisc         string     `json:"qdisc"`
+	BandwidthMbps int        `json:"bandwidth_mbps"` // cake only, 0 leaves it unshaped
+	Classes       []QoSClass `json:"classes,omitempty"`
+}
+
+// Validate checks the qdisc and classes before the policy is pushed to a node; the agent
+// checks DSCP class names and port ranges
+func (p QoSPolicy) Validate() error {
+	if p.Qdisc != "" && p.Qdisc != QoSQdiscFQCoDel && p.Qdisc != QoSQdiscCake {
+		return fmt.Errorf("qdisc must be %s or %s", QoSQdiscFQCoDel, QoSQdiscCake)
+	}
+	if p.BandwidthMbps < 0 {
+		return fmt.Errorf("bandwidth must not be negative")
+	}
+	for i, class := range p.Classes {
+		if class.Name == "" || class.Ports == "" || class.DSCP == "" {
+			return fmt.Errorf("class %d needs a name, ports and a DSCP class", i+1)
+		}
+		switch class.Protocol {
+		case "", "tcp", "udp":
+		default:
+			return fmt.Errorf("class %q: protocol must be tcp or udp", class.Name)
+		}
+	}
+	return nil
+}
+
+// QoS policy helper methods
+func (n *VPSNode) GetQoSPolicy() (QoSPolicy, bool) {
+	var policy QoSPolicy
+	if len(n.QoSPolicy) == 0 {
+		return policy, false
+	}
+
+	data, err := json.Marshal(n.QoSPolicy)
+	if err != nil {
+		return policy, false
+	}
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return policy, false
+	}
+	return policy, true
+}
+
+func (n *VPSNode) SetQoSPolicy(policy QoSPolicy) error {
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+
+	qosPolicy := JSONB{}
+	if err := json.Unmarshal(data, &qosPolicy); err != nil {
+		return err
+	}
+	n.QoSPolicy = qosPolicy
+	return nil
+}
+
+// Outbound policy outbound types
+const (
+	PolicyOutboundDirect = "direct"
+	PolicyOutboundWARP   = "warp"
+	PolicyOutboundSOCKS5 = "socks5"
+	PolicyOutboundHTTP   = "http"
+)
+
+// PolicyOutbound is a named way out of a node. With NodeID set it is the SOCKS5 or HTTP
+// proxy another node serves, at that node's address unless Address is given.
+type PolicyOutbound struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	NodeID     string `json:"node_id,omitempty"`
+	Address    string `json:"address,omitempty"`
+	Port       int    `json:"port,omitempty"`
+	Username   string `json:"username,omitempty"`
+	Password   string `json:"password,omitempty"`
+	BindDevice string `json:"bind_device,omitempty"`
+}
+
+// PolicyRule sends the destinations it matches to an outbound of the policy, or "reject"
+type PolicyRule struct {
+	Outbound string `json:"outbound"`
+	Match    string `json:"match"`
+	Value    string `json:"value,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+	Port     string `json:"port,omitempty"`
+}
+
+// OutboundPolicy chooses where a node's Hysteria2 sends client traffic: rules send
+// destinations to named outbounds and the rest goes to Default
+type OutboundPolicy struct {
+	Outbounds []PolicyOutbound `json:"outbounds"`
+	Rules     []PolicyRule     `json:"rules,omitempty"`
+	Default   string           `json:"default"`
+}
+
+// Validate checks outbound names and types and the outbounds rules refer to before the
+// policy is pushed; the agent checks the rule matches
+func (p OutboundPolicy) Validate() error {
+	names := make(map[string]bool, len(p.Outbounds))
+	for i, outbound := range p.Outbounds {
+		if outbound.Name == "" {
+			return fmt.Errorf("outbound %d needs a name", i+1)
+		}
+		if names[outbound.Name] {
+			return fmt.Errorf("duplicate outbound %q", outbound.Name)
+		}
+		names[outbound.Name] = true
+
+		switch outbound.Type {
+		case PolicyOutboundDirect, PolicyOutboundWARP:
+			if outbound.NodeID != "" {
+				return fmt.Errorf("outbound %q: only socks5 and http outbounds can go through another node", outbound.Name)
+			}
+		case PolicyOutboundSOCKS5, PolicyOutboundHTTP:
+			if outbound.Address == "" && outbound.NodeID == "" {
+				return fmt.Errorf("outbound %q needs an address or a node", outbound.Name)
+			}
+			if outbound.Port < 1 || outbound.Port > 65535 {
+				return fmt.Errorf("outbound %q: invalid port %d", outbound.Name, outbound.Port)
+			}
+		default:
+			return fmt.Errorf("outbound %q: type must be %s, %s, %s or %s", outbound.Name,
+				PolicyOutboundDirect, PolicyOutboundWARP, PolicyOutboundSOCKS5, PolicyOutboundHTTP)
+		}
+	}
+	for i, rule := range p.Rules {
+		if rule.Outbound != "reject" && !names[rule.Outbound] {
+			return fmt.Errorf("rule %d: unknown outbound %q", i+1, rule.Outbound)
+		}
+	}
+	if p.Default != "" && !names[p.Default] {
+		return fmt.Errorf("default outbound %q is not one of the outbounds", p.Default)
+	}
+	return nil
+}
+
+// Redacted returns the policy without proxy passwords
+func (p OutboundPolicy) Redacted() OutboundPolicy {
+	redacted := p
+	redacted.Outbounds = make([]PolicyOutbound, len(p.Outbounds))
+	for i, outbound := range p.Outbounds {
+		outbound.Password = ""
+		redacted.Outbounds[i] = outbound
+	}
+	return redacted
+}
+
+// Outbound policy helper methods
+func (n *VPSNode) GetOutboundPolicy() (OutboundPolicy, bool) {
+	var policy OutboundPolicy
+	if len(n.OutboundPolicy) == 0 {
+		return policy, false
+	}
+
+	data, err := json.Marshal(n.OutboundPolicy)
+	if err != nil {
+		return policy, false
+	}
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return policy, false
+	}
+	return policy, true
+}
+
+// SetOutboundPolicy stores the policy, or clears it when it has no outbounds
+func (n *VPSNode) SetOutboundPolicy(policy OutboundPolicy) error {
+	if len(policy.Outbounds) == 0 {
+		n.OutboundPolicy = nil
+		return nil
+	}
+
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+
+	outboundPolicy := JSONB{}
+	if err := json.Unmarshal(data, &outboundPolicy); err != nil {
+		return err
+	}
+	n.OutboundPolicy = outboundPolicy
+	return nil
+}
+
+// ObfuscationSettings bundles a node's obfuscation knobs: Salamander, port hopping, the QUIC
+// relay, the fingerprints client configs rotate through and the sites Reality borrows
+type ObfuscationSettings struct {
+	Salamander         bool     `json:"salamander"`
+	SalamanderPassword string   `json:"salamander_password,omitempty"` // per node, never part of a preset
+	PortHopping        bool     `json:"port_hopping"`
+	HopStartPort       int      `json:"hop_start_port,omitempty"`
+	HopEndPort         int      `json:"hop_end_port,omitempty"`
+	HopInterval        int      `json:"hop_interval,omitempty"` // seconds
+	QUICObfuscation    bool     `json:"quic_obfuscation"`       // needs clients that speak the relay's scrambling
+	PacketPadding      int      `json:"packet_padding,omitempty"`
+	TimingJitterMs     int      `json:"timing_jitter_ms,omitempty"`
+	Fingerprints       []string `json:"fingerprints,omitempty"`
+	RealityTargets     []string `json:"reality_targets,omitempty"`
+	TrafficShaping     bool     `json:"traffic_shaping"`
+}
+
+// Validate checks the settings before they are saved in a preset; the agent checks
+// fingerprint names and Reality targets
+func (s ObfuscationSettings) Validate() error {
+	if s.PortHopping {
+		if s.HopStartPort < 1 || s.HopEndPort > 65535 || s.HopStartPort >= s.HopEndPort {
+			return fmt.Errorf("invalid port hopping range %d-%d", s.HopStartPort, s.HopEndPort)
+		}
+		if s.HopInterval != 0 && s.HopInterval < 5 {
+			return fmt.Errorf("hop interval must be at least 5 seconds")
+		}
+	}
+	if !s.QUICObfuscation && (s.PacketPadding != 0 || s.TimingJitterMs != 0) {
+		return fmt.Errorf("packet padding and timing jitter need QUIC obfuscation")
+	}
+	if s.PacketPadding != 0 && (s.PacketPadding < 1200 || s.PacketPadding > 1500) {
+		return fmt.Errorf("packet padding must be between 1200 and 1500 bytes")
+	}
+	if s.TimingJitterMs < 0 || s.TimingJitterMs > 1000 {
+		return fmt.Errorf("timing jitter must be between 0 and 1000 ms")
+	}
+	return nil
+}
+
+// Obfuscation helper methods
+func (n *VPSNode) GetObfuscation() (ObfuscationSettings, bool) {
+	var settings ObfuscationSettings
+	if len(n.Obfuscation) == 0 {
+		return settings, false
+	}
+
+	data, err := json.Marshal(n.Obfuscation)
+	if err != nil {
+		return settings, false
+	}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return settings, false
+	}
+	return settings, true
+}
+
+func (n *VPSNode) SetObfuscation(settings ObfuscationSettings) error {
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+
+	obfuscation := JSONB{}
+	if err := json.Unmarshal(data, &obfuscation); err != nil {
+		return err
+	}
+	n.Obfuscation = obfuscation
+	return nil
+}
+
+func (op *ObfuscationPreset) GetSettings() ObfuscationSettings {
+	var settings ObfuscationSettings
+	if op.Settings == nil {
+		return settings
+	}
+
+	data, err := json.Marshal(op.Settings)
+	if err != nil {
+		return settings
+	}
+	json.Unmarshal(data, &settings)
+	return settings
+}
+
+func (op *ObfuscationPreset) SetSettings(settings ObfuscationSettings) error {
+	// Salamander passwords are generated per node
+	settings.SalamanderPassword = ""
+
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+
+	result := JSONB{}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return err
+	}
+	op.Settings = result
+	return nil
+}
+
+// Validate checks the name, which must not shadow a built-in preset, and the settings
+func (op *ObfuscationPreset) Validate() error {
+	if !filterListNamePattern.MatchString(op.Name) {
+		return fmt.Errorf("name must be 1-63 lowercase letters, digits, '-' or '_'")
+	}
+	if FindObfuscationPreset(op.Name) != nil {
+		return fmt.Errorf("name %q is taken by a built-in preset", op.Name)
+	}
+	return op.GetSettings().Validate()
+}
+
+// ObfuscationPresets are the built-in presets, tuned to the DPI of each country. They keep
+// standard Hysteria2 clients working, so they leave the QUIC relay, and with it packet
+// padding, to custom presets.
+var ObfuscationPresets = []BuiltinObfuscationPreset{
+	{
+		Name:        "russia",
+		Description: "TSPU: Salamander hides the QUIC handshake, hopping over a wide range defeats per-port UDP throttling",
+		Settings: ObfuscationSettings{
+			Salamander:     true,
+			PortHopping:    true,
+			HopStartPort:   20000,
+			HopEndPort:     50000,
+			HopInterval:    30,
+			Fingerprints:   []string{"chrome", "firefox", "safari"},
+			RealityTargets: []string{"www.microsoft.com", "dl.google.com"},
+		},
+	},
+	{
+		Name:        "iran",
+		Description: "Whitelisting DPI: fast hopping across a broad range before ports get blocked, Reality over TCP as the fallback",
+		Settings: ObfuscationSettings{
+			Salamander:     true,
+			PortHopping:    true,
+			HopStartPort:   10000,
+			HopEndPort:     60000,
+			HopInterval:    15,
+			Fingerprints:   []string{"chrome", "firefox"},
+			RealityTargets: []string{"www.speedtest.net", "www.microsoft.com"},
+			TrafficShaping: true,
+		},
+	},
+	{
+		Name:        "china",
+		Description: "GFW: hopping against per-port UDP QoS, Reality borrowing sites reachable from the mainland",
+		Settings: ObfuscationSettings{
+			Salamander:     true,
+			PortHopping:    true,
+			HopStartPort:   20000,
+			HopEndPort:     40000,
+			HopInterval:    20,
+			Fingerprints:   []string{"chrome", "safari", "ios"},
+			RealityTargets: []string{"www.apple.com", "gateway.icloud.com"},
+			TrafficShaping: true,
+		},
+	},
+}
+
+// FindObfuscationPreset returns the built-in preset called name, or nil
+func FindObfuscationPreset(name string) *BuiltinObfuscationPreset {
+	for i := range ObfuscationPresets {
+		if ObfuscationPresets[i].Name == name {
+			return &ObfuscationPresets[i]
+		}
+	}
+	return nil
+}
+
+// Obfuscation experiment helper methods
+func (oe *ObfuscationExperiment) GetArms() []ExperimentArm {
+	var arms []ExperimentArm
+	if oe.Arms == nil {
+		return arms
+	}
+
+	data, err := json.Marshal(oe.Arms["arms"])
+	if err != nil {
+		return arms
+	}
+	json.Unmarshal(data, &arms)
+	return arms
+}
+
+func (oe *ObfuscationExperiment) SetArms(arms []ExperimentArm) error {
+	data, err := json.Marshal(map[string][]ExperimentArm{"arms": arms})
+	if err != nil {
+		return err
+	}
+
+	result := JSONB{}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return err
+	}
+	oe.Arms = result
+	return nil
+}
+
+// ArmOf returns the arm node takes part in, or an empty string
+func (oe *ObfuscationExperiment) ArmOf(nodeID uuid.UUID) string {
+	for _, arm := range oe.GetArms() {
+		for _, node := range arm.Nodes {
+			if node.NodeID == nodeID && node.Status == ExperimentNodeApplied {
+				return arm.Name
+			}
+		}
+	}
+	return ""
+}
+
+// Filter list helper methods
+func (f *FilterList) GetDomains() []string {
+	if f.Domains == nil {
+		return []string{}
+	}
+
+	domains, ok := f.Domains["domains"].([]interface{})
+	if !ok {
+		return []string{}
+	}
+	result := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		if str, ok := domain.(string); ok {
+			result = append(result, str)
+		}
+	}
+	return result
+}
+
+func (f *FilterList) SetDomains(domains []string) {
+	if len(domains) == 0 {
+		f.Domains = JSONB{}
+		return
+	}
+
+	interfaceDomains := make([]interface{}, len(domains))
+	for i, domain := range domains {
+		interfaceDomains[i] = domain
+	}
+	f.Domains = JSONB{
+		"domains": interfaceDomains,
+	}
+}
+
+// Validate checks the fields the agent relies on before the list is saved
+func (f *FilterList) Validate() error {
+	if !filterListNamePattern.MatchString(f.Name) {
+		return fmt.Errorf("name must be 1-63 lowercase letters, digits, '-' or '_'")
+	}
+	if f.Action != FilterActionBlock && f.Action != FilterActionAllow {
+		return fmt.Errorf("action must be %q or %q", FilterActionBlock, FilterActionAllow)
+	}
+	switch f.Format {
+	case "", FilterFormatDomains, FilterFormatWildcard, FilterFormatHosts, FilterFormatAdblock:
+	default:
+		return fmt.Errorf("unsupported format %q", f.Format)
+	}
+	if f.URL == "" && len(f.GetDomains()) == 0 {
+		return fmt.Errorf("a URL or inline domains are required")
+	}
+	if f.URL != "" {
+		u, err := url.Parse(f.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid list URL %q", f.URL)
+		}
+	}
+	if f.RefreshInterval < 0 {
+		return fmt.Errorf("refresh interval must not be negative")
+	}
+	return nil
+}
+
+var filterListNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// Routing profile helper methods
+func (rp *RoutingProfile) GetOutbounds() []RoutingOutbound {
+	var outbounds []RoutingOutbound
+	if rp.Outbounds == nil {
+		return outbounds
+	}
+
+	data, err := json.Marshal(rp.Outbounds["outbounds"])
+	if err != nil {
+		return outbounds
+	}
+	json.Unmarshal(data, &outbounds)
+	return outbounds
+}
+
+func (rp *RoutingProfile) SetOutbounds(outbounds []RoutingOutbound) error {
+	data, err := json.Marshal(map[string][]RoutingOutbound{"outbounds": outbounds})
+	if err != nil {
+		return err
+	}
+
+	result := JSONB{}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return err
+	}
+	rp.Outbounds = result
+	return nil
+}
+
+func (rp *RoutingProfile) GetRules() []RoutingRule {
+	var rules []RoutingRule
+	if rp.Rules == nil {
+		return rules
+	}
+
+	data, err := json.Marshal(rp.Rules["rules"])
+	if err != nil {
+		return rules
+	}
+	json.Unmarshal(data, &rules)
+	return rules
+}
+
+func (rp *RoutingProfile) SetRules(rules []RoutingRule) error {
+	data, err := json.Marshal(map[string][]RoutingRule{"rules": rules})
+	if err != nil {
+		return err
+	}
+
+	result := JSONB{}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return err
+	}
+	rp.Rules = result
+	return nil
+}
+
+// Validate checks what the agent cannot: outbound nodes, presets and the references between
+// rules and outbounds. Domains and addresses are checked by the agent.
+func (rp *RoutingProfile) Validate() error {
+	if !filterListNamePattern.MatchString(rp.Name) {
+		return fmt.Errorf("name must be 1-63 lowercase letters, digits, '-' or '_'")
+	}
+
+	outbounds := make(map[string]bool)
+	for _, outbound := range rp.GetOutbounds() {
+		if !filterListNamePattern.MatchString(outbound.Name) {
+			return fmt.Errorf("outbound name %q must be lowercase letters, digits, '-' or '_'", outbound.Name)
+		}
+		switch outbound.Name {
+		case RoutingOutboundDirect, RoutingOutboundWARP, RoutingOutboundBlock:
+			return fmt.Errorf("outbound name %q is reserved", outbound.Name)
+		}
+		if outbounds[outbound.Name] {
+			return fmt.Errorf("duplicate outbound %q", outbound.Name)
+		}
+		outbounds[outbound.Name] = true
+
+		switch outbound.Type {
+		case RoutingOutboundSocks, RoutingOutboundHTTP, RoutingOutboundShadowsocks, RoutingOutboundTrojan:
+		default:
+			return fmt.Errorf("outbound %s: unsupported type %q", outbound.Name, outbound.Type)
+		}
+		if outbound.NodeID == "" && outbound.Address == "" {
+			return fmt.Errorf("outbound %s: a node or an address is required", outbound.Name)
+		}
+		if outbound.NodeID != "" {
+			if _, err := uuid.Parse(outbound.NodeID); err != nil {
+				return fmt.Errorf("outbound %s: invalid node ID %q", outbound.Name, outbound.NodeID)
+			}
+		}
+		if outbound.Port < 1 || outbound.Port > 65535 {
+			return fmt.Errorf("outbound %s: invalid port %d", outbound.Name, outbound.Port)
+		}
+	}
+
+	rules := rp.GetRules()
+	if len(rules) == 0 {
+		return fmt.Errorf("at least one rule is required")
+	}
+	for i, rule := range rules {
+		if len(rule.Domains) == 0 && len(rule.IPs) == 0 && len(rule.Presets) == 0 {
+			return fmt.Errorf("rule %d: domains, addresses or presets are required", i+1)
+		}
+		for _, preset := range rule.Presets {
+			if FindRoutingPreset(preset) == nil {
+				return fmt.Errorf("rule %d: unknown preset %q", i+1, preset)
+			}
+		}
+		if len(rule.Outbounds) == 0 {
+			return fmt.Errorf("rule %d: an outbound is required", i+1)
+		}
+		for _, name := range rule.Outbounds {
+			switch {
+			case name == RoutingOutboundBlock && len(rule.Outbounds) > 1:
+				return fmt.Errorf("rule %d: %q cannot be balanced with other outbounds", i+1, RoutingOutboundBlock)
+			case name == RoutingOutboundDirect || name == RoutingOutboundWARP || name == RoutingOutboundBlock || outbounds[name]:
+			default:
+				return fmt.Errorf("rule %d: unknown outbound %q", i+1, name)
+			}
+		}
+		switch rule.Strategy {
+		case "", RoutingStrategyRandom, RoutingStrategyRoundRobin:
+		default:
+			return fmt.Errorf("rule %d: unsupported strategy %q", i+1, rule.Strategy)
+		}
+	}
+	return nil
+}
+
+// RoutingPresetLocal stands for the country of the node the profile is pushed to
+const RoutingPresetLocal = "local"
+
+// RoutingPresets are the presets rules can use. Geosite and geoip lists are the ones
+// shipped with Xray and downloaded by Hysteria2.
+var RoutingPresets = []RoutingPreset{
+	{Name: "netflix", Description: "Netflix", Domains: []string{"geosite:netflix"}},
+	{Name: "disney", Description: "Disney+", Domains: []string{"geosite:disney"}},
+	{Name: "youtube", Description: "YouTube", Domains: []string{"geosite:youtube"}},
+	{Name: "spotify", Description: "Spotify", Domains: []string{"geosite:spotify"}},
+	{Name: "openai", Description: "ChatGPT and the OpenAI API", Domains: []string{"geosite:openai"}},
+	{Name: "telegram", Description: "Telegram", Domains: []string{"geosite:telegram"}},
+	{Name: RoutingPresetLocal, Description: "Addresses in the node's country, such as local banking"},
+	{Name: "private", Description: "Private and loopback networks", IPs: []string{
+		"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "127.0.0.0/8", "fc00::/7", "::1/128",
+	}},
+}
+
+// FindRoutingPreset returns the preset called name, or nil
+func FindRoutingPreset(name string) *RoutingPreset {
+	for i := range RoutingPresets {
+		if RoutingPresets[i].Name == name {
+			return &RoutingPresets[i]
+		}
+	}
+	return nil
+}
+
+// Protocol matrix helper methods
+func (n *VPSNode) GetProtocols() map[string]bool {
+	protocols := make(map[string]bool, len(SupportedProtocols))
+	for _, protocol := range SupportedProtocols {
+		protocols[protocol] = len(n.Protocols) == 0
+	}
+	for protocol, value := range n.Protocols {
+		if enabled, ok := value.(bool); ok {
+			protocols[protocol] = enabled
+		}
+	}
+	return protocols
+}
+
+func (n *VPSNode) SetProtocols(protocols map[string]bool) {
+	matrix := JSONB{}
+	for protocol, enabled := range protocols {
+		matrix[protocol] = enabled
+	}
+	n.Protocols = matrix
+}
+
+func (n *VPSNode) IsProtocolEnabled(protocol string) bool {
+	return n.GetProtocols()[protocol]
+}
+
+// IsSupportedProtocol reports whether protocol can be toggled in the node protocol matrix
+func IsSupportedProtocol(protocol string) bool {
+	for _, p := range SupportedProtocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// Probe report helper methods
+func (pr *ProbeReport) GetChecks() []ProbeCheck {
+	var checks []ProbeCheck
+	if pr.Checks == nil {
+		return checks
+	}
+
+	data, err := json.Marshal(pr.Checks["checks"])
+	if err != nil {
+		return checks
+	}
+	json.Unmarshal(data, &checks)
+	return checks
+}
+
+func (pr *ProbeReport) SetChecks(checks []ProbeCheck) error {
+	data, err := json.Marshal(map[string][]ProbeCheck{"checks": checks})
+	if err != nil {
+		return err
+	}
+
+	result := JSONB{}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return err
+	}
+	pr.Checks = result
+	return nil
+}
+
+// TLS report helper methods
+func (r *TLSReport) GetChecks() []ProbeCheck {
+	var checks []ProbeCheck
+	if r.Checks == nil {
+		return checks
+	}
+
+	data, err := json.Marshal(r.Checks["checks"])
+	if err != nil {
+		return checks
+	}
+	json.Unmarshal(data, &checks)
+	return checks
+}
+
+func (r *TLSReport) SetChecks(checks []ProbeCheck) error {
+	data, err := json.Marshal(map[string][]ProbeCheck{"checks": checks})
+	if err != nil {
+		return err
+	}
+
+	result := JSONB{}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return err
+	}
+	r.Checks = result
+	return nil
+}
+
+// NodeEgressCheck helper methods
+func (ec *NodeEgressCheck) GetPaths() []EgressPath {
+	var paths []EgressPath
+	if ec.Paths == nil {
+		return paths
+	}
+
+	data, err := json.Marshal(ec.Paths["paths"])
+	if err != nil {
+		return paths
+	}
+	json.Unmarshal(data, &paths)
+	return paths
+}
+
+func (ec *NodeEgressCheck) SetPaths(paths []EgressPath) error {
+	data, err := json.Marshal(map[string][]EgressPath{"paths": paths})
+	if err != nil {
+		return err
+	}
+
+	result := JSONB{}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return err
+	}
+	ec.Paths = result
+	return nil
+}
+
+// NodeDrift helper methods
+func (d *NodeDrift) GetItems() []DriftItem {
+	var items []DriftItem
+	if d.Items == nil {
+		return items
+	}
+
+	data, err := json.Marshal(d.Items["items"])
+	if err != nil {
+		return items
+	}
+	json.Unmarshal(data, &items)
+	return items
+}
+
+func (d *NodeDrift) SetItems(items []DriftItem) error {
+	data, err := json.Marshal(map[string][]DriftItem{"items": items})
+	if err != nil {
+		return err
+	}
+
+	result := JSONB{}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return err
+	}
+	d.Items = result
+	d.Drifted = len(items)
+	return nil
+}
+
+func (d *NodeDrift) GetHeal() DriftHeal {
+	var heal DriftHeal
+	if d.Heal == nil {
+		return heal
+	}
+
+	data, err := json.Marshal(d.Heal)
+	if err != nil {
+		return heal
+	}
+	json.Unmarshal(data, &heal)
+	return heal
+}
+
+func (d *NodeDrift) SetHeal(heal DriftHeal) error {
+	data, err := json.Marshal(heal)
+	if err != nil {
+		return err
+	}
+
+	result := JSONB{}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return err
+	}
+	d.Heal = result
+	return nil
+}
+
+// DNS hostname helper methods
+func (dh *DNSHostname) GetWeights() map[string]int {
+	weights := make(map[string]int, len(dh.Weights))
+	for nodeID := range dh.Weights {
+		weights[nodeID] = dh.Weight(nodeID)
+	}
+	return weights
+}
+
+func (dh *DNSHostname) SetWeights(weights map[string]int) {
+	dh.Weights = JSONB{}
+	for nodeID, weight := range weights {
+		dh.Weights[nodeID] = weight
+	}
+}
+
+// Weight returns the weight of a node, 1 unless set
+func (dh *DNSHostname) Weight(nodeID string) int {
+	if value, ok := dh.Weights[nodeID]; ok {
+		if weight, ok := value.(float64); ok {
+			return int(weight)
+		}
+		if weight, ok := value.(int); ok {
+			return weight
+		}
+	}
+	return 1
+}
+
+func (dh *DNSHostname) GetPublished() []DNSRecord {
+	var records []DNSRecord
+	if dh.Published == nil {
+		return records
+	}
+
+	data, err := json.Marshal(dh.Published["records"])
+	if err != nil {
+		return records
+	}
+	json.Unmarshal(data, &records)
+	return records
+}
+
+func (dh *DNSHostname) SetPublished(records []DNSRecord) error {
+	data, err := json.Marshal(map[string][]DNSRecord{"records": records})
+	if err != nil {
+		return err
+	}
+
+	result := JSONB{}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return err
+	}
+	dh.Published = result
+	return nil
+}
+
+// Validate checks a hostname before it is saved
+func (dh *DNSHostname) Validate() error {
+	name, err := NormalizeSNIDomain(dh.Name)
+	if err != nil {
+		return fmt.Errorf("invalid hostname: %w", err)
+	}
+	dh.Name = name
+	if dh.NodeGroup != "" && !NodeGroupPattern.MatchString(dh.NodeGroup) {
+		return fmt.Errorf("invalid node group %q", dh.NodeGroup)
+	}
+	if dh.Records < 0 {
+		return fmt.Errorf("records must not be negative")
+	}
+	// Cloudflare accepts 1 (automatic) or 30 to 86400 seconds
+	if dh.TTL != 1 && (dh.TTL < 30 || dh.TTL > 86400) {
+		return fmt.Errorf("TTL must be 1 (automatic) or between 30 and 86400 seconds")
+	}
+	for nodeID, weight := range dh.GetWeights() {
+		if _, err := uuid.Parse(nodeID); err != nil {
+			return fmt.Errorf("invalid node ID %q in weights", nodeID)
+		}
+		if weight < 0 {
+			return fmt.Errorf("weight of node %s must not be negative", nodeID)
+		}
+	}
+	return nil
+}
+
+// Validate checks a scaling policy before it is saved
+func (sp *ScalingPolicy) Validate() error {
+	if !NodeGroupPattern.MatchString(sp.NodeGroup) {
+		return fmt.Errorf("invalid node group %q", sp.NodeGroup)
+	}
+	if sp.Provider == "" || sp.Region == "" || sp.Size == "" || sp.Image == "" {
+		return fmt.Errorf("provider, region, size and image are required")
+	}
+	if sp.MinNodes < 0 || sp.MaxNodes < sp.MinNodes {
+		return fmt.Errorf("max nodes must be at least min nodes, which must not be negative")
+	}
+	if sp.NodeMbps <= 0 {
+		return fmt.Errorf("node Mbps must be positive")
+	}
+	if sp.ScaleDownPercent < 0 || sp.ScaleUpPercent > 100 || sp.ScaleDownPercent >= sp.ScaleUpPercent {
+		return fmt.Errorf("scale-down percent must be below scale-up percent, both between 0 and 100")
+	}
+	if sp.IdleMinutes < 0 || sp.Cooldown < 0 {
+		return fmt.Errorf("idle minutes and cooldown must not be negative")
+	}
+	if sp.Country != "" && len(sp.Country) != 2 {
+		return fmt.Errorf("country must be a two-letter code")
+	}
+	return nil
+}
+
+// Rollout helper methods
+func (r *Rollout) GetNodes() []RolloutNode {
+	var nodes []RolloutNode
+	if r.Nodes == nil {
+		return nodes
+	}
+
+	data, err := json.Marshal(r.Nodes["nodes"])
+	if err != nil {
+		return nodes
+	}
+	json.Unmarshal(data, &nodes)
+	return nodes
+}
+
+func (r *Rollout) SetNodes(nodes []RolloutNode) error {
+	data, err := json.Marshal(map[string][]RolloutNode{"nodes": nodes})
+	if err != nil {
+		return err
+	}
+
+	result := JSONB{}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return err
+	}
+	r.Nodes = result
+	return nil
+}
+
+// IsActive reports whether the rollout is still upgrading nodes
+func (r *Rollout) IsActive() bool {
+	switch r.Status {
+	case RolloutStatusCanary, RolloutStatusSoaking, RolloutStatusRolling:
+		return true
+	}
+	return false
+}
+
+// MaintenanceWindow helper methods
+func (m *MaintenanceWindow) GetNodes() []MaintenanceNode {
+	var nodes []MaintenanceNode
+	if m.Nodes == nil {
+		return nodes
+	}
+
+	data, err := json.Marshal(m.Nodes["nodes"])
+	if err != nil {
+		return nodes
+	}
+	json.Unmarshal(data, &nodes)
+	return nodes
+}
+
+func (m *MaintenanceWindow) SetNodes(nodes []MaintenanceNode) error {
+	data, err := json.Marshal(map[string][]MaintenanceNode{"nodes": nodes})
+	if err != nil {
+		return err
+	}
+
+	result := JSONB{}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return err
+	}
+	m.Nodes = result
+	return nil
+}
+
+// Overlaps reports whether the window shares time with [start, end)
+func (m *MaintenanceWindow) Overlaps(start, end time.Time) bool {
+	return m.StartsAt.Before(end) && start.Before(m.EndsAt)
+}
+
+// Config template helper methods
+func (ct *ConfigTemplate) GetVariables() map[string]string {
+	return stringMap(ct.Variables)
+}
+
+func (ct *ConfigTemplate) SetVariables(variables map[string]string) {
+	ct.Variables = stringMapJSONB(variables)
+}
+
+func (ca *ConfigTemplateAssignment) GetVariables() map[string]string {
+	return stringMap(ca.Variables)
+}
+
+func (ca *ConfigTemplateAssignment) SetVariables(variables map[string]string) {
+	ca.Variables = stringMapJSONB(variables)
+}
+
+func stringMap(j JSONB) map[string]string {
+	result := make(map[string]string, len(j))
+	for key, value := range j {
+		if str, ok := value.(string); ok {
+			result[key] = str
+		}
+	}
+	return result
+}
+
+func stringMapJSONB(values map[string]string) JSONB {
+	result := JSONB{}
+	for key, value := range values {
+		result[key] = value
+	}
+	return result
+}
+
+// Placeholders returns the variables the body uses, in order of first use
+func (ct *ConfigTemplate) Placeholders() []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, match := range configTemplatePlaceholder.FindAllStringSubmatch(ct.Body, -1) {
+		if !seen[match[1]] {
+			seen[match[1]] = true
+			names = append(names, match[1])
+		}
+	}
+	return names
+}
+
+// Validate checks the template before it is saved. Placeholders without a default are
+// rendered as 0 so the body can still be checked to be a JSON config of its kind.
+func (ct *ConfigTemplate) Validate() error {
+	if !configTemplateNamePattern.MatchString(ct.Name) {
+		return fmt.Errorf("name must be 1-40 lowercase letters, digits, '-' or '_'")
+	}
+	switch ct.Kind {
+	case ComponentHysteria2:
+		if ct.Protocol != "" {
+			return fmt.Errorf("protocol only applies to Xray templates")
+		}
+	case ComponentXray:
+		switch ct.Protocol {
+		case ProtocolVLESS, ProtocolVLESSReality, ProtocolTrojan, ProtocolShadowsocks2022:
+		default:
+			return fmt.Errorf("unsupported Xray protocol %q", ct.Protocol)
+		}
+	default:
+		return fmt.Errorf("kind must be %q or %q", ComponentHysteria2, ComponentXray)
+	}
+	if strings.TrimSpace(ct.Body) == "" {
+		return fmt.Errorf("body is required")
+	}
+	for name := range ct.GetVariables() {
+		if !configTemplateVariablePattern.MatchString(name) {
+			return fmt.Errorf("invalid variable name %q", name)
+		}
+	}
+
+	// JSON never contains "{{" outside strings, so one left over is a malformed placeholder
+	if strings.Contains(configTemplatePlaceholder.ReplaceAllString(ct.Body, ""), "{{") {
+		return fmt.Errorf("malformed placeholder, use {{name}} with lowercase letters, digits and '_'")
+	}
+
+	sample := ct.GetVariables()
+	for _, name := range ct.Placeholders() {
+		if _, ok := sample[name]; !ok {
+			sample[name] = "0"
+		}
+	}
+	_, err := ct.Render(sample)
+	return err
+}
+
+// Render substitutes the variables into the body and checks the result is a JSON config
+// of the template's kind. Every placeholder must have a value.
+func (ct *ConfigTemplate) Render(variables map[string]string) (string, error) {
+	var missing []string
+	for _, name := range ct.Placeholders() {
+		if _, ok := variables[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("missing variables: %s", strings.Join(missing, ", "))
+	}
+
+	rendered := configTemplatePlaceholder.ReplaceAllStringFunc(ct.Body, func(placeholder string) string {
+		return variables[configTemplatePlaceholder.FindStringSubmatch(placeholder)[1]]
+	})
+
+	var config map[string]interface{}
+	if err := json.Unmarshal([]byte(rendered), &config); err != nil {
+		return "", fmt.Errorf("rendered config is not a JSON object: %w", err)
+	}
+	switch ct.Kind {
+	case ComponentHysteria2:
+		if _, ok := config["listen"].(string); !ok {
+			return "", fmt.Errorf("rendered Hysteria2 config has no listen address")
+		}
+	case ComponentXray:
+		if inbounds, ok := config["inbounds"].([]interface{}); !ok || len(inbounds) == 0 {
+			return "", fmt.Errorf("rendered Xray config has no inbounds")
+		}
+	}
+	return rendered, nil
+}
+
+// Validate checks the group and variable names of the assignment
+func (ca *ConfigTemplateAssignment) Validate() error {
+	if ca.NodeGroup != "" && !NodeGroupPattern.MatchString(ca.NodeGroup) {
+		return fmt.Errorf("node group must be 1-50 lowercase letters, digits, '-' or '_'")
+	}
+	for name := range ca.GetVariables() {
+		if !configTemplateVariablePattern.MatchString(name) {
+			return fmt.Errorf("invalid variable name %q", name)
+		}
+	}
+	return nil
+}
+
+// ConfigVersion names the template revision recorded in deployments
+func (ct *ConfigTemplate) ConfigVersion() string {
+	return fmt.Sprintf("%s@v%d", ct.Name, ct.Version)
+}
+
+// TemplateVariables returns the variables every template can use for the node
+func (n *VPSNode) TemplateVariables() map[string]string {
+	domain := n.PrimaryDomain
+	if domain == "" {
+		domain = n.Hostname
+	}
+	return map[string]string{
+		"node_id":    n.ID.String(),
+		"node_name":  n.Name,
+		"node_group": n.NodeGroup,
+		"hostname":   n.Hostname,
+		"ip_address": n.IPAddress,
+		"country":    n.Country,
+		"domain":     domain,
+	}
+}
+
+// NodeGroupPattern matches the names of node groups
+var NodeGroupPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,49}$`)
+
+var (
+	configTemplateNamePattern     = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,39}$`)
+	configTemplateVariablePattern = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+	configTemplatePlaceholder     = regexp.MustCompile(`\{\{\s*([a-z][a-z0-9_]*)\s*\}\}`)
+)
+
+// SupportedProtocols lists the protocols that can be enabled per node
+var SupportedProtocols = []string{
+	ProtocolHysteria2,
+	ProtocolVLESS,
+	ProtocolVLESSReality,
+	ProtocolTrojan,
+	ProtocolShadowsocks2022,
+}
+
+// Constants
+const (
+	NodeStatusOffline     = "offline"
+	NodeStatusOnline      = "online"
+	NodeStatusMaintenance = "maintenance"
+	NodeStatusError       = "error"
+
+	DeploymentStatusPending   = "pending"
+	DeploymentStatusDeploying = "deploying"
+	DeploymentStatusSuccess   = "success"
+	DeploymentStatusFailed    = "failed"
+
+	UserStatusActive    = "active"
+	UserStatusSuspended = "suspended"
+	UserStatusDeleted   = "deleted"
+
+	UserRoleAdmin = "admin"
+	UserRoleUser  = "user"
+
+	MasqueradeTypeString = "string"
+	MasqueradeTypeFile   = "file"
+	MasqueradeTypeProxy  = "proxy"
+
+	DefaultMasqueradeProxyURL = "https://www.google.com"
+
+	DriftPolicyReport = "report"
+	DriftPolicyHeal   = "heal"
+
+	CertificateModeFiles = "files"
+	CertificateModeACME  = "acme"
+	ACMECALetsEncrypt    = "letsencrypt"
+	ACMECAZeroSSL        = "zerossl"
+
+	ProtocolHysteria2       = "hysteria2"
+	ProtocolVLESS           = "vless"
+	ProtocolVLESSReality    = "vless-reality"
+	ProtocolTrojan          = "trojan"
+	ProtocolShadowsocks2022 = "shadowsocks-2022"
+
+	DNSRouteWARP   = "warp"
+	DNSRouteDirect = "direct"
+
+	DNSUpstreamSchemeDoH = "https"
+	DNSUpstreamSchemeDoT = "tls"
+
+	FilterActionBlock = "block"
+	FilterActionAllow = "allow"
+
+	FilterFormatDomains  = "domains"
+	FilterFormatWildcard = "wildcard"
+	FilterFormatHosts    = "hosts"
+	FilterFormatAdblock  = "adblock"
+
+	RoutingOutboundDirect      = "direct"
+	RoutingOutboundWARP        = "warp"
+	RoutingOutboundBlock       = "block"
+	RoutingOutboundSocks       = "socks"
+	RoutingOutboundHTTP        = "http"
+	RoutingOutboundShadowsocks = "shadowsocks"
+	RoutingOutboundTrojan      = "trojan"
+
+	RoutingStrategyRandom     = "random"
+	RoutingStrategyRoundRobin = "roundRobin"
+
+	ComponentHysteria2 = "hysteria2"
+	ComponentXray      = "xray"
+
+	RolloutStatusCanary    = "canary"
+	RolloutStatusSoaking   = "soaking"
+	RolloutStatusRolling   = "rolling"
+	RolloutStatusCompleted = "completed"
+	RolloutStatusFailed    = "failed"
+	RolloutStatusAborted   = "aborted"
+
+	RolloutNodePending    = "pending"
+	RolloutNodeUpgraded   = "upgraded"
+	RolloutNodeRolledBack = "rolled_back"
+	RolloutNodeFailed     = "failed"
+	RolloutNodeSkipped    = "skipped"
+
+	MaintenanceOperationRestart     = "restart"
+	MaintenanceOperationCertRenewal = "cert_renewal"
+	MaintenanceOperationConfigPush  = "config_push"
+	MaintenanceOperationDrain       = "drain"
+
+	MaintenanceStatusScheduled = "scheduled"
+	MaintenanceStatusRunning   = "running"
+	MaintenanceStatusCompleted = "completed"
+	MaintenanceStatusFailed    = "failed"
+	MaintenanceStatusCancelled = "cancelled"
+
+	MaintenanceNodePending = "pending"
+	MaintenanceNodeDone    = "done"
+	MaintenanceNodeFailed  = "failed"
+	MaintenanceNodeSkipped = "skipped"
+
+	ExperimentStatusRunning   = "running"
+	ExperimentStatusCompleted = "completed"
+	ExperimentStatusCancelled = "cancelled"
+
+	ExperimentNodeApplied  = "applied"
+	ExperimentNodeFailed   = "failed"
+	ExperimentNodeRestored = "restored"
+
+	ProvisionStatusPending    = "pending" // created, waiting for the agent to register
+	ProvisionStatusActive     = "active"
+	ProvisionStatusDestroying = "destroying"
+	ProvisionStatusDestroyed  = "destroyed"
+	ProvisionStatusFailed     = "failed"
 )
@@ -0,0 +1,228 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestMaintenanceWindowOverlaps(t *testing.T) {
+	start := time.Date(2026, 3, 1, 2, 0, 0, 0, time.UTC)
+	window := &MaintenanceWindow{StartsAt: start, EndsAt: start.Add(time.Hour)}
+
+	tests := []struct {
+		name       string
+		start, end time.Time
+		want       bool
+	}{
+		{"same window", start, start.Add(time.Hour), true},
+		{"inside", start.Add(10 * time.Minute), start.Add(20 * time.Minute), true},
+		{"around", start.Add(-time.Hour), start.Add(2 * time.Hour), true},
+		{"overlapping the start", start.Add(-30 * time.Minute), start.Add(30 * time.Minute), true},
+		{"overlapping the end", start.Add(30 * time.Minute), start.Add(90 * time.Minute), true},
+		// Windows are half-open, so back-to-back windows do not conflict
+		{"right before", start.Add(-time.Hour), start, false},
+		{"right after", start.Add(time.Hour), start.Add(2 * time.Hour), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := window.Overlaps(tt.start, tt.end); got != tt.want {
+				t.Errorf("Overlaps(%s, %s) = %v, want %v", tt.start.Format(time.Kitchen), tt.end.Format(time.Kitchen), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaintenanceWindowNodes(t *testing.T) {
+	finished := time.Date(2026, 3, 1, 2, 5, 0, 0, time.UTC)
+	nodes := []MaintenanceNode{
+		{NodeID: uuid.New(), NodeName: "eu-1", Status: MaintenanceNodeDone, PreviousStatus: NodeStatusOnline, FinishedAt: &finished},
+		{NodeID: uuid.New(), NodeName: "eu-2", Status: MaintenanceNodePending},
+	}
+	window := &MaintenanceWindow{}
+	if got := window.GetNodes(); len(got) != 0 {
+		t.Errorf("GetNodes of an empty window = %+v", got)
+	}
+	if err := window.SetNodes(nodes); err != nil {
+		t.Fatal(err)
+	}
+	got := window.GetNodes()
+	if len(got) != 2 || got[0].NodeID != nodes[0].NodeID || got[0].Status != MaintenanceNodeDone ||
+		got[0].PreviousStatus != NodeStatusOnline || !got[0].FinishedAt.Equal(finished) || got[1].NodeName != "eu-2" {
+		t.Errorf("GetNodes = %+v, want %+v", got, nodes)
+	}
+}
+
+func TestConfigTemplateRender(t *testing.T) {
+	template := &ConfigTemplate{
+		Kind: ComponentHysteria2,
+		Body: `{"listen": ":{{port}}", "tls": {"sni": "{{ domain }}"}, "masquerade": "https://{{domain}}"}`,
+	}
+	if got := template.Placeholders(); len(got) != 2 || got[0] != "port" || got[1] != "domain" {
+		t.Errorf("Placeholders = %v, want [port domain]", got)
+	}
+
+	got, err := template.Render(map[string]string{"port": "443", "domain": "vpn.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"listen": ":443", "tls": {"sni": "vpn.example.com"}, "masquerade": "https://vpn.example.com"}`; got != want {
+		t.Errorf("Render = %s, want %s", got, want)
+	}
+	if _, err := template.Render(map[string]string{"port": "443"}); err == nil {
+		t.Error("rendered without the domain")
+	}
+	// A value breaking out of its string leaves no JSON config
+	if _, err := template.Render(map[string]string{"port": "443", "domain": `x"}`}); err == nil {
+		t.Error("rendered a broken config")
+	}
+}
+
+func TestConfigTemplateValidate(t *testing.T) {
+	valid := ConfigTemplate{Name: "eu-default", Kind: ComponentHysteria2, Body: `{"listen": ":{{port}}"}`}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("valid template: %v", err)
+	}
+
+	tests := map[string]func(ct *ConfigTemplate){
+		"bad name":              func(ct *ConfigTemplate) { ct.Name = "EU Default" },
+		"unknown kind":          func(ct *ConfigTemplate) { ct.Kind = "wireguard" },
+		"protocol on Hysteria2": func(ct *ConfigTemplate) { ct.Protocol = ProtocolVLESS },
+		"Xray without protocol": func(ct *ConfigTemplate) { ct.Kind = ComponentXray },
+		"empty body":            func(ct *ConfigTemplate) { ct.Body = " " },
+		"malformed placeholder": func(ct *ConfigTemplate) { ct.Body = `{"listen": ":{{Port}}"}` },
+		"not a Hysteria2 config": func(ct *ConfigTemplate) {
+			ct.Body = `{"server": ":{{port}}"}`
+		},
+		"bad variable name": func(ct *ConfigTemplate) { ct.SetVariables(map[string]string{"Port": "443"}) },
+	}
+	for name, mutate := range tests {
+		t.Run(name, func(t *testing.T) {
+			ct := valid
+			mutate(&ct)
+			if err := ct.Validate(); err == nil {
+				t.Error("Validate succeeded")
+			}
+		})
+	}
+}
+
+func TestConfigTemplateRenderXray(t *testing.T) {
+	template := &ConfigTemplate{Name: "reality", Kind: ComponentXray, Protocol: ProtocolVLESSReality, Body: `{"inbounds": [{"port": {{port}}}]}`}
+	template.SetVariables(map[string]string{"port": "8443"})
+	if err := template.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if _, err := template.Render(template.GetVariables()); err != nil {
+		t.Errorf("Render: %v", err)
+	}
+	template.Body = `{"inbounds": []}`
+	if _, err := template.Render(nil); err == nil {
+		t.Error("rendered an Xray config without inbounds")
+	}
+}
+
+func TestObfuscationSettingsValidate(t *testing.T) {
+	hopping := ObfuscationSettings{PortHopping: true, HopStartPort: 20000, HopEndPort: 40000}
+	tests := []struct {
+		name     string
+		settings ObfuscationSettings
+		wantErr  bool
+	}{
+		{"nothing on", ObfuscationSettings{}, false},
+		{"hopping", hopping, false},
+		{"hopping range reversed", ObfuscationSettings{PortHopping: true, HopStartPort: 40000, HopEndPort: 20000}, true},
+		{"hopping past the last port", ObfuscationSettings{PortHopping: true, HopStartPort: 60000, HopEndPort: 70000}, true},
+		{"hopping too often", ObfuscationSettings{PortHopping: true, HopStartPort: 20000, HopEndPort: 40000, HopInterval: 2}, true},
+		{"padding with the relay", ObfuscationSettings{QUICObfuscation: true, PacketPadding: 1350, TimingJitterMs: 50}, false},
+		{"padding without the relay", ObfuscationSettings{PacketPadding: 1350}, true},
+		{"padding too small", ObfuscationSettings{QUICObfuscation: true, PacketPadding: 600}, true},
+		{"jitter too long", ObfuscationSettings{QUICObfuscation: true, TimingJitterMs: 5000}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.settings.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	for _, preset := range ObfuscationPresets {
+		if err := preset.Settings.Validate(); err != nil {
+			t.Errorf("built-in preset %s: %v", preset.Name, err)
+		}
+	}
+}
+
+func TestObfuscationPresetValidate(t *testing.T) {
+	preset := &ObfuscationPreset{Name: "campus-wifi"}
+	if err := preset.SetSettings(ObfuscationSettings{Salamander: true, SalamanderPassword: "node-secret", QUICObfuscation: true, PacketPadding: 1300}); err != nil {
+		t.Fatal(err)
+	}
+	if err := preset.Validate(); err != nil {
+		t.Errorf("Validate = %v", err)
+	}
+	// Salamander passwords are generated per node, never kept in a preset
+	if settings := preset.GetSettings(); !settings.Salamander || settings.SalamanderPassword != "" || settings.PacketPadding != 1300 {
+		t.Errorf("settings = %+v", settings)
+	}
+
+	for _, name := range []string{"russia", "Campus", "", "campus wifi"} {
+		if err := (&ObfuscationPreset{Name: name}).Validate(); err == nil {
+			t.Errorf("preset named %q accepted", name)
+		}
+	}
+	preset.SetSettings(ObfuscationSettings{PacketPadding: 1300})
+	if err := preset.Validate(); err == nil {
+		t.Error("preset with invalid settings accepted")
+	}
+}
+
+func TestNodeObfuscation(t *testing.T) {
+	node := &VPSNode{}
+	if _, ok := node.GetObfuscation(); ok {
+		t.Error("node without obfuscation settings has some")
+	}
+	settings := FindObfuscationPreset("iran").Settings
+	settings.SalamanderPassword = "node-secret"
+	if err := node.SetObfuscation(settings); err != nil {
+		t.Fatal(err)
+	}
+	got, ok := node.GetObfuscation()
+	if !ok || got.SalamanderPassword != "node-secret" || got.HopInterval != 15 || len(got.RealityTargets) != 2 {
+		t.Errorf("obfuscation = %+v, %v", got, ok)
+	}
+	if FindObfuscationPreset("atlantis") != nil {
+		t.Error("unknown built-in preset found")
+	}
+}
+
+func TestObfuscationExperimentArms(t *testing.T) {
+	applied, failed, restored := uuid.New(), uuid.New(), uuid.New()
+	experiment := &ObfuscationExperiment{}
+	if arms := experiment.GetArms(); len(arms) != 0 {
+		t.Errorf("arms of a new experiment = %+v", arms)
+	}
+	err := experiment.SetArms([]ExperimentArm{
+		{Name: "a", Preset: "russia", Nodes: []ExperimentNode{{NodeID: applied, NodeName: "node-1", PreviousPreset: "iran", Status: ExperimentNodeApplied}}},
+		{Name: "b", Preset: "campus-wifi", Nodes: []ExperimentNode{
+			{NodeID: failed, NodeName: "node-2", Status: ExperimentNodeFailed, Message: "node offline"},
+			{NodeID: restored, NodeName: "node-3", Status: ExperimentNodeRestored},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	arms := experiment.GetArms()
+	if len(arms) != 2 || arms[0].Nodes[0].PreviousPreset != "iran" || arms[1].Preset != "campus-wifi" || arms[1].Nodes[0].Message != "node offline" {
+		t.Errorf("arms = %+v", arms)
+	}
+	// Only nodes running the arm's preset count toward it
+	for node, want := range map[uuid.UUID]string{applied: "a", failed: "", restored: "", uuid.New(): ""} {
+		if got := experiment.ArmOf(node); got != want {
+			t.Errorf("ArmOf(%s) = %q, want %q", node, got, want)
+		}
+	}
+}
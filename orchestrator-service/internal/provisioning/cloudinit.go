@@ -0,0 +1,153 @@
+package provisioning
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"hysteria2_microservices/orchestrator-service/internal/config"
+)
+
+// MetadataProvisionID is the node metadata key a provisioned agent registers its
+// provisioning ID under, which ties the registered node to its server
+const MetadataProvisionID = "provision_id"
+
+// AgentBootstrap is what a new server needs to install the agent and register
+type AgentBootstrap struct {
+	ProvisionID  string // set for servers the autoscaler creates
+	NodeID       string // set to run the agent as an existing node
+	NodeName     string
+	Hostname     string // defaults to NodeName
+	Location     string
+	Country      string
+	MasterServer string
+	JoinURL      string // the orchestrator's POST /join, where JoinToken is exchanged
+	JoinToken    string // single-use token exchanged for the NODE_AUTH_TOKEN on first boot
+	AgentURL     string // agent binary, downloaded with the NODE_AUTH_TOKEN
+	HelperURL    string // setuid agent-helper binary the unprivileged agent runs privileged commands through
+	Tunnel       bool   // reach the master over a reverse tunnel, for servers without open inbound ports
+	SSHKeys      []string
+}
+
+// AgentURL returns the download URL of version of the agent
+func AgentURL(cfg config.ProvisionConfig, version string) string {
+	if version == "" {
+		version = cfg.AgentVersion
+	}
+	return strings.ReplaceAll(cfg.AgentURL, "{version}", version)
+}
+
+// HelperURL returns the download URL of version of the agent-helper, by default the
+// agent-helper next to the agent binary
+func HelperURL(cfg config.ProvisionConfig, version string) string {
+	if version == "" {
+		version = cfg.AgentVersion
+	}
+	if cfg.HelperURL != "" {
+		return strings.ReplaceAll(cfg.HelperURL, "{version}", version)
+	}
+	agentURL := AgentURL(cfg, version)
+	i := strings.LastIndex(agentURL, "/")
+	if i < 0 {
+		return ""
+	}
+	return agentURL[:i+1] + "agent-helper"
+}
+
+var userDataTemplate = template.Must(template.New("user-data").Funcs(template.FuncMap{
+	"quote": quote,
+}).Parse(`#cloud-config
+hostname: {{ quote .Hostname }}
+{{- if .SSHKeys }}
+ssh_authorized_keys:
+{{- range .SSHKeys }}
+  - {{ quote . }}
+{{- end }}
+{{- end }}
+write_files:
+  - path: /opt/hysteria2-agent/configs/agent.yaml
+    permissions: "0600"
+    content: |
+      master_server: {{ quote .MasterServer }}
+      node:
+{{- if .NodeID }}
+        id: {{ quote .NodeID }}
+{{- end }}
+        name: {{ quote .NodeName }}
+        hostname: {{ quote .Hostname }}
+        location: {{ quote .Location }}
+        country: {{ quote .Country }}
+{{- if .ProvisionID }}
+        metadata:
+          provision_id: {{ quote .ProvisionID }}
+{{- end }}
+{{- if .Tunnel }}
+      tunnel:
+        enabled: true
+{{- end }}
+      privilege:
+        helper: /usr/local/libexec/hysteria2-agent/agent-helper
+  - path: /etc/hysteria2-agent/agent.env
+    permissions: "0600"
+    content: ""
+  - path: /etc/systemd/system/hysteria2-agent.service
+    content: |
+      [Unit]
+      Description=HysteryVPN node agent
+      After=network-online.target
+      Wants=network-online.target
+
+      [Service]
+      User=hysteria2-agent
+      WorkingDirectory=/opt/hysteria2-agent
+      EnvironmentFile=/etc/hysteria2-agent/agent.env
+      ExecStart=/usr/local/bin/hysteria2-agent
+      Restart=always
+      RestartSec=5
+
+      [Install]
+      WantedBy=multi-user.target
+runcmd:
+  - [useradd, --system, --home, /var/lib/hysteria2-agent, --shell, /usr/sbin/nologin, hysteria2-agent]
+  - [install, -d, -o, root, -g, root, -m, "0755", /var/lib/hysteria2-agent, /usr/local/libexec/hysteria2-agent]
+  - [install, -d, -o, hysteria2-agent, -m, "0750", /etc/hysteria]
+  - [curl, -fsS, --retry, "10", --retry-connrefused, -X, POST, -H, {{ quote (print "Authorization: Bearer " .JoinToken) }}, -o, /etc/hysteria2-agent/agent.env, {{ quote .JoinURL }}]
+  - [sh, -c, '. /etc/hysteria2-agent/agent.env && exec curl -fsSL --retry 10 --retry-all-errors -H "Authorization: Bearer $NODE_AUTH_TOKEN" -o /usr/local/bin/hysteria2-agent "$1"', sh, {{ quote .AgentURL }}]
+  - [chmod, "0755", /usr/local/bin/hysteria2-agent]
+  - [sh, -c, '. /etc/hysteria2-agent/agent.env && exec curl -fsSL --retry 10 --retry-all-errors -H "Authorization: Bearer $NODE_AUTH_TOKEN" -o /usr/local/libexec/hysteria2-agent/agent-helper "$1"', sh, {{ quote .HelperURL }}]
+  - [chown, "root:hysteria2-agent", /usr/local/libexec/hysteria2-agent/agent-helper]
+  - [chmod, "4750", /usr/local/libexec/hysteria2-agent/agent-helper]
+  - [chown, -R, hysteria2-agent, /opt/hysteria2-agent, /etc/hysteria2-agent]
+  - [systemctl, daemon-reload]
+  - [systemctl, enable, --now, hysteria2-agent]
+`))
+
+// UserData renders the cloud-init user data installing the agent as a systemd service of the
+// unprivileged hysteria2-agent user, next to the setuid agent-helper. On first boot the
+// server exchanges the join token for the node auth token, which agent.env receives, then
+// downloads the agent and the helper with it. The exchange is retried only when the
+// orchestrator cannot be reached.
+func UserData(b AgentBootstrap) (string, error) {
+	if b.MasterServer == "" || b.AgentURL == "" || b.HelperURL == "" || b.JoinURL == "" {
+		return "", fmt.Errorf("master server, join URL, agent URL and helper URL are required")
+	}
+	if b.JoinToken == "" || strings.ContainsAny(b.JoinToken, "\r\n") {
+		return "", fmt.Errorf("invalid join token")
+	}
+	if b.Hostname == "" {
+		b.Hostname = b.NodeName
+	}
+	var buf bytes.Buffer
+	if err := userDataTemplate.Execute(&buf, b); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// quote returns s as a double-quoted YAML scalar
+func quote(s string) string {
+	data, _ := json.Marshal(s)
+	return string(data)
+}
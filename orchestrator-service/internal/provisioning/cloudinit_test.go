@@ -0,0 +1,121 @@
+package provisioning
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"hysteria2_microservices/orchestrator-service/internal/config"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// goldenBootstraps are the user data the orchestrator renders: a server the autoscaler
+// creates and the bootstrap of an existing node behind a tunnel
+func goldenBootstraps() map[string]AgentBootstrap {
+	return map[string]AgentBootstrap{
+		"provisioned": {
+			ProvisionID:  "7f1c2a4e-1d3b-4c5a-9e8f-0a1b2c3d4e5f",
+			NodeName:     "eu-7f1c2a4e",
+			Location:     "Falkenstein",
+			Country:      "DE",
+			MasterServer: "orchestrator.example.com:50051",
+			JoinURL:      "https://orchestrator.example.com:8081/join",
+			JoinToken:    "hjt_c2luZ2xlLXVzZQ",
+			AgentURL:     "https://orchestrator.example.com:8081/artifacts/agent/latest/hysteria2-agent",
+			HelperURL:    "https://orchestrator.example.com:8081/artifacts/agent/latest/agent-helper",
+		},
+		"node_tunnel": {
+			NodeID:       "0b6f3e2a-5c4d-4e3f-8a9b-1c2d3e4f5a6b",
+			NodeName:     "EU Frankfurt 1",
+			Hostname:     "eu-frankfurt-1.vpn.example.com",
+			Location:     "Frankfurt: \"Main\"",
+			Country:      "DE",
+			MasterServer: "orchestrator.example.com:50051",
+			JoinURL:      "https://orchestrator.example.com:8081/join",
+			JoinToken:    "hjt_dHVubmVsZWQ",
+			AgentURL:     "https://releases.example.com/agent/v1.4.0/hysteria2-agent",
+			HelperURL:    "https://releases.example.com/agent/v1.4.0/agent-helper",
+			Tunnel:       true,
+			SSHKeys:      []string{"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIG9wcw ops%{admin}"},
+		},
+	}
+}
+
+// checkGolden compares got with testdata/name, rewriting it with -update
+func checkGolden(t *testing.T, name, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run with -update to create it)", err)
+	}
+	if got != string(want) {
+		t.Errorf("output differs from %s:\n--- got\n%s\n--- want\n%s", path, got, want)
+	}
+}
+
+func TestUserDataGolden(t *testing.T) {
+	for name, b := range goldenBootstraps() {
+		t.Run(name, func(t *testing.T) {
+			got, err := UserData(b)
+			if err != nil {
+				t.Fatalf("UserData: %v", err)
+			}
+			checkGolden(t, name+".user-data", got)
+		})
+	}
+}
+
+func TestUserDataRejects(t *testing.T) {
+	valid := goldenBootstraps()["provisioned"]
+	tests := map[string]func(b *AgentBootstrap){
+		"no join URL":           func(b *AgentBootstrap) { b.JoinURL = "" },
+		"no join token":         func(b *AgentBootstrap) { b.JoinToken = "" },
+		"join token with break": func(b *AgentBootstrap) { b.JoinToken += "\r\nX-Injected: 1" },
+		"no agent URL":          func(b *AgentBootstrap) { b.AgentURL = "" },
+		"no helper URL":         func(b *AgentBootstrap) { b.HelperURL = "" },
+		"no master server":      func(b *AgentBootstrap) { b.MasterServer = "" },
+	}
+	for name, mutate := range tests {
+		b := valid
+		mutate(&b)
+		if _, err := UserData(b); err == nil {
+			t.Errorf("%s: UserData succeeded", name)
+		}
+	}
+}
+
+func TestHelperURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     config.ProvisionConfig
+		version string
+		want    string
+	}{
+		{
+			name:    "next to the agent",
+			cfg:     config.ProvisionConfig{AgentURL: "https://orchestrator.example.com:8081/artifacts/agent/{version}/hysteria2-agent", AgentVersion: "latest"},
+			version: "v1.4.0",
+			want:    "https://orchestrator.example.com:8081/artifacts/agent/v1.4.0/agent-helper",
+		},
+		{
+			name: "configured",
+			cfg:  config.ProvisionConfig{AgentURL: "https://releases.example.com/agent", HelperURL: "https://releases.example.com/helper/{version}", AgentVersion: "v1.4.0"},
+			want: "https://releases.example.com/helper/v1.4.0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := HelperURL(tt.cfg, tt.version); got != tt.want {
+				t.Errorf("HelperURL = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package provisioning
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"hysteria2_microservices/orchestrator-service/internal/config"
+)
+
+// DigitalOcean manages droplets through the DigitalOcean v2 API
+type DigitalOcean struct {
+	api *apiClient
+}
+
+type doAddress struct {
+	IPAddress string `json:"ip_address"`
+	Type      string `json:"type"` // public or private
+}
+
+type doDroplet struct {
+	ID       int64  `json:"id"`
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Networks struct {
+		V4 []doAddress `json:"v4"`
+		V6 []doAddress `json:"v6"`
+	} `json:"networks"`
+	Region struct {
+		Slug string `json:"slug"`
+	} `json:"region"`
+}
+
+// NewDigitalOcean creates a DigitalOcean driver
+func NewDigitalOcean(cfg config.ProviderConfig) *DigitalOcean {
+	return &DigitalOcean{api: newAPIClient("digitalocean", cfg, func(body []byte) string {
+		var resp struct {
+			ID      string `json:"id"`
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(body, &resp) != nil || resp.Message == "" {
+			return ""
+		}
+		return resp.ID + ": " + resp.Message
+	})}
+}
+
+func (d *DigitalOcean) Name() string { return "digitalocean" }
+
+func (d *DigitalOcean) Create(ctx context.Context, spec ServerSpec) (*Server, error) {
+	body := map[string]interface{}{
+		"name":      spec.Name,
+		"region":    spec.Region,
+		"size":      spec.Size,
+		"image":     spec.Image,
+		"user_data": spec.UserData,
+		"ipv6":      true,
+		"tags":      spec.Tags,
+	}
+	var resp struct {
+		Droplet doDroplet `json:"droplet"`
+	}
+	if err := d.api.do(ctx, http.MethodPost, "/droplets", body, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Droplet.toServer(), nil
+}
+
+func (d *DigitalOcean) Get(ctx context.Context, id string) (*Server, error) {
+	var resp struct {
+		Droplet doDroplet `json:"droplet"`
+	}
+	if err := d.api.do(ctx, http.MethodGet, "/droplets/"+url.PathEscape(id), nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Droplet.toServer(), nil
+}
+
+func (d *DigitalOcean) Delete(ctx context.Context, id string) error {
+	return d.api.do(ctx, http.MethodDelete, "/droplets/"+url.PathEscape(id), nil, nil)
+}
+
+func (d *doDroplet) toServer() *Server {
+	status := StatusOff
+	switch d.Status {
+	case "new":
+		status = StatusPending
+	case "active":
+		status = StatusRunning
+	}
+	return &Server{
+		ID:     fmt.Sprint(d.ID),
+		Name:   d.Name,
+		Region: d.Region.Slug,
+		Status: status,
+		IPv4:   publicAddress(d.Networks.V4),
+		IPv6:   publicAddress(d.Networks.V6),
+	}
+}
+
+func publicAddress(addresses []doAddress) string {
+	for _, address := range addresses {
+		if address.Type == "public" {
+			return address.IPAddress
+		}
+	}
+	return ""
+}
@@ -0,0 +1,144 @@
+// Package provisioning creates and destroys cloud servers for new nodes through the APIs of
+// the supported providers. Servers install and start the agent from their cloud-init user
+// data and register with the master like any other node.
+package provisioning
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"hysteria2_microservices/orchestrator-service/internal/config"
+)
+
+const requestTimeout = 30 * time.Second
+
+// Server statuses, normalized across providers
+const (
+	StatusPending = "pending" // being created or booting
+	StatusRunning = "running"
+	StatusOff     = "off"
+)
+
+// ErrNotFound is returned for servers the provider does not know, e.g. already destroyed
+var ErrNotFound = errors.New("server not found")
+
+// ServerSpec describes a server to create. Region, Size and Image are the provider's own
+// identifiers, e.g. "fsn1", "cx22" and "ubuntu-24.04" on Hetzner.
+type ServerSpec struct {
+	Name     string
+	Region   string
+	Size     string
+	Image    string
+	UserData string // cloud-init user data, see UserData
+	Tags     []string
+}
+
+// Server is a server of a provider
+type Server struct {
+	ID     string
+	Name   string
+	Region string
+	Status string
+	IPv4   string
+	IPv6   string
+}
+
+// Driver creates and destroys servers with one provider
+type Driver interface {
+	Name() string
+	Create(ctx context.Context, spec ServerSpec) (*Server, error)
+	Get(ctx context.Context, id string) (*Server, error)
+	Delete(ctx context.Context, id string) error
+}
+
+// Drivers returns the drivers of the providers cfg has API tokens for, by name
+func Drivers(cfg config.ProvisionConfig) map[string]Driver {
+	drivers := make(map[string]Driver)
+	if cfg.Hetzner.APIToken != "" {
+		drivers["hetzner"] = NewHetzner(cfg.Hetzner)
+	}
+	if cfg.DigitalOcean.APIToken != "" {
+		drivers["digitalocean"] = NewDigitalOcean(cfg.DigitalOcean)
+	}
+	if cfg.Vultr.APIToken != "" {
+		drivers["vultr"] = NewVultr(cfg.Vultr)
+	}
+	return drivers
+}
+
+// apiClient makes the JSON requests of a provider API
+type apiClient struct {
+	provider string
+	baseURL  string
+	apiToken string
+	client   *http.Client
+	// errorMessage extracts the error of a failed response body
+	errorMessage func(body []byte) string
+}
+
+func newAPIClient(provider string, cfg config.ProviderConfig, errorMessage func([]byte) string) *apiClient {
+	return &apiClient{
+		provider:     provider,
+		baseURL:      strings.TrimRight(cfg.APIURL, "/"),
+		apiToken:     cfg.APIToken,
+		client:       &http.Client{Timeout: requestTimeout},
+		errorMessage: errorMessage,
+	}
+}
+
+// do sends body as JSON and decodes the response into result, when both are set. A 404 is
+// returned as ErrNotFound.
+func (c *apiClient) do(ctx context.Context, method, path string, body, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.apiToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s request failed: %w", c.provider, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return fmt.Errorf("%s %s %s: %w", c.provider, method, path, err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	if resp.StatusCode >= 300 {
+		message := c.errorMessage(data)
+		if message == "" {
+			message = resp.Status
+		}
+		return fmt.Errorf("%s %s failed: %s", c.provider, method, message)
+	}
+	if result == nil || len(data) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(data, result); err != nil {
+		return fmt.Errorf("invalid %s response: %w", c.provider, err)
+	}
+	return nil
+}
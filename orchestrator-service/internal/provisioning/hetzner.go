@@ -0,0 +1,118 @@
+package provisioning
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"hysteria2_microservices/orchestrator-service/internal/config"
+)
+
+// Hetzner manages servers through the Hetzner Cloud API
+type Hetzner struct {
+	api *apiClient
+}
+
+type hetznerServer struct {
+	ID        int64  `json:"id"`
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+	PublicNet struct {
+		IPv4 struct {
+			IP string `json:"ip"`
+		} `json:"ipv4"`
+		IPv6 struct {
+			IP string `json:"ip"` // the /64 network, e.g. "2001:db8::/64"
+		} `json:"ipv6"`
+	} `json:"public_net"`
+	Datacenter struct {
+		Location struct {
+			Name string `json:"name"`
+		} `json:"location"`
+	} `json:"datacenter"`
+}
+
+// NewHetzner creates a Hetzner driver
+func NewHetzner(cfg config.ProviderConfig) *Hetzner {
+	return &Hetzner{api: newAPIClient("hetzner", cfg, func(body []byte) string {
+		var resp struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if json.Unmarshal(body, &resp) != nil || resp.Error.Message == "" {
+			return ""
+		}
+		return resp.Error.Code + ": " + resp.Error.Message
+	})}
+}
+
+func (h *Hetzner) Name() string { return "hetzner" }
+
+func (h *Hetzner) Create(ctx context.Context, spec ServerSpec) (*Server, error) {
+	// Labels are the only tags Hetzner has; a tag becomes a label with an empty value
+	labels := make(map[string]string, len(spec.Tags))
+	for _, tag := range spec.Tags {
+		labels[tag] = ""
+	}
+	body := map[string]interface{}{
+		"name":        spec.Name,
+		"server_type": spec.Size,
+		"image":       spec.Image,
+		"location":    spec.Region,
+		"user_data":   spec.UserData,
+		"labels":      labels,
+	}
+	var resp struct {
+		Server hetznerServer `json:"server"`
+	}
+	if err := h.api.do(ctx, http.MethodPost, "/servers", body, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Server.toServer(), nil
+}
+
+func (h *Hetzner) Get(ctx context.Context, id string) (*Server, error) {
+	var resp struct {
+		Server hetznerServer `json:"server"`
+	}
+	if err := h.api.do(ctx, http.MethodGet, "/servers/"+url.PathEscape(id), nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Server.toServer(), nil
+}
+
+func (h *Hetzner) Delete(ctx context.Context, id string) error {
+	return h.api.do(ctx, http.MethodDelete, "/servers/"+url.PathEscape(id), nil, nil)
+}
+
+func (s *hetznerServer) toServer() *Server {
+	status := StatusOff
+	switch s.Status {
+	case "initializing", "starting":
+		status = StatusPending
+	case "running":
+		status = StatusRunning
+	}
+	return &Server{
+		ID:     fmt.Sprint(s.ID),
+		Name:   s.Name,
+		Region: s.Datacenter.Location.Name,
+		Status: status,
+		IPv4:   s.PublicNet.IPv4.IP,
+		IPv6:   hetznerIPv6(s.PublicNet.IPv6.IP),
+	}
+}
+
+// hetznerIPv6 returns the first address of the /64 Hetzner assigns, which the server uses
+func hetznerIPv6(network string) string {
+	prefix, _, ok := strings.Cut(network, "/")
+	if !ok || prefix == "" {
+		return ""
+	}
+	return prefix + "1"
+}
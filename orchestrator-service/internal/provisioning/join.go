@@ -0,0 +1,112 @@
+package provisioning
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+
+	"hysteria2_microservices/orchestrator-service/internal/models"
+)
+
+// joinTokenPrefix marks join tokens, so one pasted where the node auth token belongs is
+// recognisable
+const joinTokenPrefix = "hjt_"
+
+// JoinTokens mints the tokens written into the user data of new servers and exchanges each,
+// for one address and before it expires, for the node auth token. User data and Terraform
+// output never hold the node auth token itself.
+type JoinTokens struct {
+	db        *gorm.DB
+	nodeToken string
+	logger    *logrus.Logger
+}
+
+// NewJoinTokens creates JoinTokens handing out nodeToken
+func NewJoinTokens(db *gorm.DB, nodeToken string, logger *logrus.Logger) *JoinTokens {
+	return &JoinTokens{db: db, nodeToken: nodeToken, logger: logger}
+}
+
+// Mint stores a join token for nodeID or provisionID valid for ttl and returns it. Tokens
+// that have expired are removed.
+func (j *JoinTokens) Mint(nodeID, provisionID *uuid.UUID, ttl time.Duration) (string, error) {
+	if ttl <= 0 {
+		return "", fmt.Errorf("join token lifetime must be positive")
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("failed to generate join token: %w", err)
+	}
+	token := joinTokenPrefix + base64.RawURLEncoding.EncodeToString(secret)
+
+	now := time.Now()
+	if err := j.db.Where("expires_at < ?", now).Delete(&models.NodeJoinToken{}).Error; err != nil {
+		j.logger.Warnf("Failed to remove expired join tokens: %v", err)
+	}
+	record := &models.NodeJoinToken{
+		TokenHash:   HashJoinToken(token),
+		NodeID:      nodeID,
+		ProvisionID: provisionID,
+		ExpiresAt:   now.Add(ttl),
+	}
+	if err := j.db.Create(record).Error; err != nil {
+		return "", fmt.Errorf("failed to save join token: %w", err)
+	}
+	return token, nil
+}
+
+// HashJoinToken returns the hex SHA-256 a join token is stored under
+func HashJoinToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Handler serves POST /join from gin: it consumes the bearer join token and answers with the
+// agent's environment file holding the node auth token. A token that is unknown, expired,
+// already used from another address or bound to a deleted node is refused.
+func (j *JoinTokens) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || !strings.HasPrefix(token, joinTokenPrefix) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid join token", "code": "INVALID_JOIN_TOKEN"})
+			return
+		}
+		if j.nodeToken == "" {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "NODE_AUTH_TOKEN is not configured"})
+			return
+		}
+
+		// One conditional update consumes the token, so concurrent exchanges from different
+		// addresses cannot both succeed. The address that consumed it may exchange it again
+		// until it expires, in case the answer to its first request was lost.
+		now := time.Now()
+		clientIP := c.ClientIP()
+		result := j.db.Model(&models.NodeJoinToken{}).
+			Where("token_hash = ? AND expires_at > ?", HashJoinToken(token), now).
+			Where("used_at IS NULL OR used_from = ?", clientIP).
+			Where("node_id IS NULL OR EXISTS (SELECT 1 FROM vps_nodes WHERE vps_nodes.id = node_join_tokens.node_id)").
+			Updates(map[string]interface{}{"used_at": gorm.Expr("COALESCE(used_at, ?)", now), "used_from": clientIP})
+		if result.Error != nil {
+			j.logger.Errorf("Failed to consume join token: %v", result.Error)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to consume join token"})
+			return
+		}
+		if result.RowsAffected != 1 {
+			j.logger.Warnf("Refused join token from %s", clientIP)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid join token", "code": "INVALID_JOIN_TOKEN"})
+			return
+		}
+
+		j.logger.Infof("Exchanged join token from %s for the node auth token", clientIP)
+		c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte("NODE_AUTH_TOKEN="+j.nodeToken+"\n"))
+	}
+}
@@ -0,0 +1,173 @@
+package provisioning
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// terraformTemplates declare one server per provider with the official Terraform providers,
+// which read their API token from HCLOUD_TOKEN, DIGITALOCEAN_TOKEN and VULTR_API_KEY
+var terraformTemplates = map[string]*template.Template{
+	"hetzner": terraformTemplate(`terraform {
+  required_providers {
+    hcloud = {
+      source = "hetznercloud/hcloud"
+    }
+  }
+}
+
+resource "hcloud_server" {{ quote .Resource }} {
+  name        = {{ quote .Name }}
+  server_type = {{ quote .Size }}
+  image       = {{ quote .Image }}
+  location    = {{ quote .Region }}
+  labels = {
+{{- range .Tags }}
+    {{ quote . }} = ""
+{{- end }}
+  }
+  user_data = {{ heredoc .UserData }}
+}
+
+output "ipv4_address" {
+  value = hcloud_server.{{ .Resource }}.ipv4_address
+}
+`),
+	"digitalocean": terraformTemplate(`terraform {
+  required_providers {
+    digitalocean = {
+      source = "digitalocean/digitalocean"
+    }
+  }
+}
+
+resource "digitalocean_droplet" {{ quote .Resource }} {
+  name      = {{ quote .Name }}
+  size      = {{ quote .Size }}
+  image     = {{ quote .Image }}
+  region    = {{ quote .Region }}
+  ipv6      = true
+  tags      = [{{ range $i, $tag := .Tags }}{{ if $i }}, {{ end }}{{ quote $tag }}{{ end }}]
+  user_data = {{ heredoc .UserData }}
+}
+
+output "ipv4_address" {
+  value = digitalocean_droplet.{{ .Resource }}.ipv4_address
+}
+`),
+	"vultr": terraformTemplate(`terraform {
+  required_providers {
+    vultr = {
+      source = "vultr/vultr"
+    }
+  }
+}
+
+resource "vultr_instance" {{ quote .Resource }} {
+  label       = {{ quote .Name }}
+  hostname    = {{ quote .Name }}
+  plan        = {{ quote .Size }}
+  region      = {{ quote .Region }}
+{{- if .OSID }}
+  os_id       = {{ .OSID }}
+{{- else }}
+  image_id    = {{ quote .Image }}
+{{- end }}
+  enable_ipv6 = true
+  tags        = [{{ range $i, $tag := .Tags }}{{ if $i }}, {{ end }}{{ quote $tag }}{{ end }}]
+  user_data   = {{ heredoc .UserData }}
+}
+
+output "ipv4_address" {
+  value = vultr_instance.{{ .Resource }}.main_ip
+}
+`),
+}
+
+var nonIdentifier = regexp.MustCompile(`[^A-Za-z0-9_]+`)
+
+func terraformTemplate(text string) *template.Template {
+	return template.Must(template.New("terraform").Funcs(template.FuncMap{
+		"quote":   hclQuote,
+		"heredoc": heredoc,
+	}).Parse(text))
+}
+
+// Terraform renders a Terraform configuration creating the server of spec with provider
+func Terraform(provider string, spec ServerSpec) (string, error) {
+	tmpl, ok := terraformTemplates[provider]
+	if !ok {
+		return "", fmt.Errorf("unsupported provider %q", provider)
+	}
+	if spec.Name == "" || spec.Region == "" || spec.Size == "" || spec.Image == "" {
+		return "", fmt.Errorf("name, region, size and image are required")
+	}
+
+	data := struct {
+		ServerSpec
+		Resource string
+		OSID     string
+	}{ServerSpec: spec, Resource: strings.Trim(nonIdentifier.ReplaceAllString(spec.Name, "_"), "_")}
+	if data.Resource == "" || (data.Resource[0] >= '0' && data.Resource[0] <= '9') {
+		data.Resource = "node_" + data.Resource
+	}
+	if _, err := strconv.Atoi(spec.Image); err == nil {
+		data.OSID = spec.Image
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// templateEscaper escapes the interpolation and directive sequences Terraform evaluates in
+// quoted strings and heredocs
+var templateEscaper = strings.NewReplacer("${", "$${", "%{", "%%{")
+
+// hclQuote returns s as a quoted Terraform string taken literally
+func hclQuote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range templateEscaper.Replace(s) {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&b, `\u%04x`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// heredoc returns s as an indented Terraform heredoc, escaping template sequences
+func heredoc(s string) string {
+	s = templateEscaper.Replace(s)
+
+	var b strings.Builder
+	b.WriteString("<<-USERDATA\n")
+	for _, line := range strings.Split(strings.TrimRight(s, "\n"), "\n") {
+		if line != "" {
+			b.WriteString("    ")
+			b.WriteString(line)
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString("  USERDATA")
+	return b.String()
+}
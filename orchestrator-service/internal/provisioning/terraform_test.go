@@ -0,0 +1,52 @@
+package provisioning
+
+import "testing"
+
+func TestTerraformGolden(t *testing.T) {
+	userData, err := UserData(goldenBootstraps()["node_tunnel"])
+	if err != nil {
+		t.Fatalf("UserData: %v", err)
+	}
+	specs := map[string]ServerSpec{
+		"hetzner": {
+			Name: "eu-frankfurt-1", Region: "fsn1", Size: "cx22", Image: "ubuntu-24.04",
+			UserData: userData, Tags: []string{"hysteryvpn", "hysteryvpn-eu"},
+		},
+		"digitalocean": {
+			Name: "eu-frankfurt-1", Region: "fra1", Size: "s-1vcpu-1gb", Image: "ubuntu-24-04-x64",
+			UserData: userData, Tags: []string{"hysteryvpn", "${var.extra_tag}"},
+		},
+		"vultr": {
+			Name: "1-eu-frankfurt", Region: "fra", Size: "vc2-1c-1gb", Image: "2284",
+			UserData: userData, Tags: []string{"hysteryvpn", "%{ if true }x%{ endif }"},
+		},
+	}
+	for provider, spec := range specs {
+		t.Run(provider, func(t *testing.T) {
+			got, err := Terraform(provider, spec)
+			if err != nil {
+				t.Fatalf("Terraform: %v", err)
+			}
+			checkGolden(t, provider+".tf", got)
+		})
+	}
+}
+
+func TestHCLQuote(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"plain", `"plain"`},
+		{`say "hi" \ bye`, `"say \"hi\" \\ bye"`},
+		{"${var.secret}", `"$${var.secret}"`},
+		{"%{ if true }x%{ endif }", `"%%{ if true }x%%{ endif }"`},
+		{"$ and % alone", `"$ and % alone"`},
+		{"line\nbreak\ttab\x07", `"line\nbreak\ttab\u0007"`},
+		{"<&>", `"<&>"`},
+	}
+	for _, tt := range tests {
+		if got := hclQuote(tt.in); got != tt.want {
+			t.Errorf("hclQuote(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+terraform {
+  required_providers {
+    hcloud = {
+      source = "hetznercloud/hcloud"
+    }
+  }
+}
+
+resource "hcloud_server" "eu_frankfurt_1" {
+  name        = "eu-frankfurt-1"
+  server_type = "cx22"
+  image       = "ubuntu-24.04"
+  location    = "fsn1"
+  labels = {
+    "hysteryvpn" = ""
+    "hysteryvpn-eu" = ""
+  }
+  user_data = <<-USERDATA
+    #cloud-config
+    hostname: "eu-frankfurt-1.vpn.example.com"
+    ssh_authorized_keys:
+      - "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIG9wcw ops%%{admin}"
+    write_files:
+      - path: /opt/hysteria2-agent/configs/agent.yaml
+        permissions: "0600"
+        content: |
+          master_server: "orchestrator.example.com:50051"
+          node:
+            id: "0b6f3e2a-5c4d-4e3f-8a9b-1c2d3e4f5a6b"
+            name: "EU Frankfurt 1"
+            hostname: "eu-frankfurt-1.vpn.example.com"
+            location: "Frankfurt: \"Main\""
+            country: "DE"
+          tunnel:
+            enabled: true
+          privilege:
+            helper: /usr/local/libexec/hysteria2-agent/agent-helper
+      - path: /etc/hysteria2-agent/agent.env
+        permissions: "0600"
+        content: ""
+      - path: /etc/systemd/system/hysteria2-agent.service
+        content: |
+          [Unit]
+          Description=HysteryVPN node agent
+          After=network-online.target
+          Wants=network-online.target
+
+          [Service]
+          User=hysteria2-agent
+          WorkingDirectory=/opt/hysteria2-agent
+          EnvironmentFile=/etc/hysteria2-agent/agent.env
+          ExecStart=/usr/local/bin/hysteria2-agent
+          Restart=always
+          RestartSec=5
+
+          [Install]
+          WantedBy=multi-user.target
+    runcmd:
+      - [useradd, --system, --home, /var/lib/hysteria2-agent, --shell, /usr/sbin/nologin, hysteria2-agent]
+      - [install, -d, -o, root, -g, root, -m, "0755", /var/lib/hysteria2-agent, /usr/local/libexec/hysteria2-agent]
+      - [install, -d, -o, hysteria2-agent, -m, "0750", /etc/hysteria]
+      - [curl, -fsS, --retry, "10", --retry-connrefused, -X, POST, -H, "Authorization: Bearer hjt_dHVubmVsZWQ", -o, /etc/hysteria2-agent/agent.env, "https://orchestrator.example.com:8081/join"]
+      - [sh, -c, '. /etc/hysteria2-agent/agent.env && exec curl -fsSL --retry 10 --retry-all-errors -H "Authorization: Bearer $NODE_AUTH_TOKEN" -o /usr/local/bin/hysteria2-agent "$1"', sh, "https://releases.example.com/agent/v1.4.0/hysteria2-agent"]
+      - [chmod, "0755", /usr/local/bin/hysteria2-agent]
+      - [sh, -c, '. /etc/hysteria2-agent/agent.env && exec curl -fsSL --retry 10 --retry-all-errors -H "Authorization: Bearer $NODE_AUTH_TOKEN" -o /usr/local/libexec/hysteria2-agent/agent-helper "$1"', sh, "https://releases.example.com/agent/v1.4.0/agent-helper"]
+      - [chown, "root:hysteria2-agent", /usr/local/libexec/hysteria2-agent/agent-helper]
+      - [chmod, "4750", /usr/local/libexec/hysteria2-agent/agent-helper]
+      - [chown, -R, hysteria2-agent, /opt/hysteria2-agent, /etc/hysteria2-agent]
+      - [systemctl, daemon-reload]
+      - [systemctl, enable, --now, hysteria2-agent]
+  USERDATA
+}
+
+output "ipv4_address" {
+  value = hcloud_server.eu_frankfurt_1.ipv4_address
+}
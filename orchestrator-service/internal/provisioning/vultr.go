@@ -0,0 +1,108 @@
+package provisioning
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"hysteria2_microservices/orchestrator-service/internal/config"
+)
+
+// Vultr manages instances through the Vultr v2 API
+type Vultr struct {
+	api *apiClient
+}
+
+type vultrInstance struct {
+	ID          string `json:"id"`
+	Label       string `json:"label"`
+	Region      string `json:"region"`
+	Status      string `json:"status"`       // pending, active, suspended or resizing
+	PowerStatus string `json:"power_status"` // running or stopped
+	MainIP      string `json:"main_ip"`
+	V6MainIP    string `json:"v6_main_ip"`
+}
+
+// NewVultr creates a Vultr driver
+func NewVultr(cfg config.ProviderConfig) *Vultr {
+	return &Vultr{api: newAPIClient("vultr", cfg, func(body []byte) string {
+		var resp struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &resp) != nil {
+			return ""
+		}
+		return resp.Error
+	})}
+}
+
+func (v *Vultr) Name() string { return "vultr" }
+
+// Create takes the numeric ID of an operating system, or the ID of a marketplace app
+// image, as the image
+func (v *Vultr) Create(ctx context.Context, spec ServerSpec) (*Server, error) {
+	body := map[string]interface{}{
+		"label":       spec.Name,
+		"hostname":    spec.Name,
+		"region":      spec.Region,
+		"plan":        spec.Size,
+		"user_data":   base64.StdEncoding.EncodeToString([]byte(spec.UserData)),
+		"enable_ipv6": true,
+		"tags":        spec.Tags,
+	}
+	if osID, err := strconv.Atoi(spec.Image); err == nil {
+		body["os_id"] = osID
+	} else {
+		body["image_id"] = spec.Image
+	}
+	var resp struct {
+		Instance vultrInstance `json:"instance"`
+	}
+	if err := v.api.do(ctx, http.MethodPost, "/instances", body, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Instance.toServer(), nil
+}
+
+func (v *Vultr) Get(ctx context.Context, id string) (*Server, error) {
+	var resp struct {
+		Instance vultrInstance `json:"instance"`
+	}
+	if err := v.api.do(ctx, http.MethodGet, "/instances/"+url.PathEscape(id), nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Instance.toServer(), nil
+}
+
+func (v *Vultr) Delete(ctx context.Context, id string) error {
+	return v.api.do(ctx, http.MethodDelete, "/instances/"+url.PathEscape(id), nil, nil)
+}
+
+func (i *vultrInstance) toServer() *Server {
+	status := StatusOff
+	switch {
+	case i.Status == "pending":
+		status = StatusPending
+	case i.Status == "active" && i.PowerStatus == "running":
+		status = StatusRunning
+	}
+	server := &Server{
+		ID:     i.ID,
+		Name:   i.Label,
+		Region: i.Region,
+		Status: status,
+		IPv4:   i.MainIP,
+		IPv6:   i.V6MainIP,
+	}
+	// Addresses read 0.0.0.0 and :: until they are assigned
+	if server.IPv4 == "0.0.0.0" {
+		server.IPv4 = ""
+	}
+	if server.IPv6 == "::" {
+		server.IPv6 = ""
+	}
+	return server
+}
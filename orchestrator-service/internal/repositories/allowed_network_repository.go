@@ -0,0 +1,21 @@
+package repositories
+
+import (
+	"gorm.io/gorm"
+	"hysteria2_microservices/orchestrator-service/internal/models"
+	"hysteria2_microservices/orchestrator-service/internal/repositories/interfaces"
+)
+
+type AllowedNetworkRepository struct {
+	db *gorm.DB
+}
+
+func NewAllowedNetworkRepository(db *gorm.DB) interfaces.AllowedNetworkRepository {
+	return &AllowedNetworkRepository{db: db}
+}
+
+func (r *AllowedNetworkRepository) ListByScope(scope string) ([]*models.AllowedNetwork, error) {
+	var networks []*models.AllowedNetwork
+	err := r.db.Where("scope = ?", scope).Order("created_at").Find(&networks).Error
+	return networks, err
+}
@@ -62,3 +62,8 @@ type UserRepository interface {
 	List(offset, limit int) ([]*models.User, int64, error)
 	Search(query string, offset, limit int) ([]*models.User, int64, error)
 }
+
+// AllowedNetworkRepository reads the networks admins allow through api-service
+type AllowedNetworkRepository interface {
+	ListByScope(scope string) ([]*models.AllowedNetwork, error)
+}
@@ -10,4 +10,5 @@ type Repositories struct {
 	MetricRepo     interfaces.NodeMetricRepository
 	DeploymentRepo interfaces.DeploymentRepository
 	UserRepo       interfaces.UserRepository
+	NetworkRepo    interfaces.AllowedNetworkRepository
 }
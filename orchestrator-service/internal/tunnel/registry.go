@@ -0,0 +1,183 @@
+// Package tunnel carries connections to nodes over streams the nodes open themselves, for
+// nodes behind NAT or firewalls the orchestrator cannot dial. The agent keeps a control
+// stream open; for every connection the orchestrator needs it asks the agent to open a data
+// stream, and the gRPC client of the NodeManager runs over that stream as if it were TCP.
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"hysteria2_microservices/pkg/tunnelconn"
+)
+
+// DialTimeout is how long Dial waits for the agent to answer a dial with a data stream
+const DialTimeout = 10 * time.Second
+
+var (
+	// ErrNoTunnel is returned by Dial for nodes without an open tunnel
+	ErrNoTunnel = errors.New("node has no tunnel open")
+	// ErrReplaced ends the control stream of a node that opened a newer one
+	ErrReplaced = errors.New("tunnel replaced by a newer one")
+	// ErrUnknownDial is returned by Accept for data streams answering no pending dial
+	ErrUnknownDial = errors.New("no pending dial")
+)
+
+// Registry holds the tunnels the agents connected to this orchestrator keep open. A tunnel
+// lives on the replica the agent connected to; other replicas dial the node directly.
+type Registry struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+	pending  map[string]*pendingDial
+}
+
+type session struct {
+	dials    chan string
+	replaced chan struct{}
+}
+
+type pendingDial struct {
+	nodeID string
+	conns  chan net.Conn
+}
+
+// NewRegistry returns an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{
+		sessions: make(map[string]*session),
+		pending:  make(map[string]*pendingDial),
+	}
+}
+
+// Serve holds the tunnel of nodeID open, calling send for every dial until ctx is cancelled,
+// send fails or the node opens a newer tunnel
+func (r *Registry) Serve(ctx context.Context, nodeID string, send func(connID string) error) error {
+	s := &session{
+		dials:    make(chan string),
+		replaced: make(chan struct{}),
+	}
+	r.mu.Lock()
+	if old, ok := r.sessions[nodeID]; ok {
+		close(old.replaced)
+	}
+	r.sessions[nodeID] = s
+	r.mu.Unlock()
+
+	defer func() {
+		r.mu.Lock()
+		if r.sessions[nodeID] == s {
+			delete(r.sessions, nodeID)
+		}
+		r.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.replaced:
+			return ErrReplaced
+		case connID := <-s.dials:
+			if err := send(connID); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Connected reports whether nodeID has a tunnel open to this orchestrator
+func (r *Registry) Connected(nodeID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.sessions[nodeID]
+	return ok
+}
+
+// Dial asks nodeID for a new connection over its tunnel and waits for it
+func (r *Registry) Dial(ctx context.Context, nodeID string) (net.Conn, error) {
+	r.mu.Lock()
+	s, ok := r.sessions[nodeID]
+	if !ok {
+		r.mu.Unlock()
+		return nil, ErrNoTunnel
+	}
+	connID := uuid.NewString()
+	dial := &pendingDial{nodeID: nodeID, conns: make(chan net.Conn, 1)}
+	r.pending[connID] = dial
+	r.mu.Unlock()
+
+	defer func() {
+		r.mu.Lock()
+		delete(r.pending, connID)
+		r.mu.Unlock()
+		// Close a connection that arrived after Dial gave up
+		select {
+		case conn := <-dial.conns:
+			conn.Close()
+		default:
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, DialTimeout)
+	defer cancel()
+
+	select {
+	case s.dials <- connID:
+	case <-s.replaced:
+		return nil, ErrReplaced
+	case <-ctx.Done():
+		return nil, fmt.Errorf("tunnel of node %s did not take the dial: %w", nodeID, ctx.Err())
+	}
+
+	select {
+	case conn := <-dial.conns:
+		return conn, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("node %s did not answer the dial: %w", nodeID, ctx.Err())
+	}
+}
+
+// Accept hands the data stream answering dial connID of nodeID to the waiting Dial. The
+// returned channel is closed once the connection is closed; the stream must stay open until
+// then.
+func (r *Registry) Accept(nodeID, connID string, stream tunnelconn.Stream) (<-chan struct{}, error) {
+	r.mu.Lock()
+	dial, ok := r.pending[connID]
+	if ok && dial.nodeID == nodeID {
+		delete(r.pending, connID)
+	}
+	r.mu.Unlock()
+	if !ok || dial.nodeID != nodeID {
+		return nil, ErrUnknownDial
+	}
+
+	closed := make(chan struct{})
+	conn := tunnelconn.NewConn(stream, tunnelconn.Addr("orchestrator"), tunnelconn.Addr(nodeID), func() error {
+		close(closed)
+		return nil
+	})
+	// conns is buffered and only this Accept sends on it
+	dial.conns <- conn
+	return closed, nil
+}
+
+// ClientConn returns a gRPC client connection to the NodeManager of nodeID over its tunnel.
+// The tunnel is authenticated by the orchestrator's own listener, so the connection inside
+// it is plaintext.
+func (r *Registry) ClientConn(nodeID string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	opts = append([]grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return r.Dial(ctx, nodeID)
+		}),
+	}, opts...)
+	return grpc.NewClient("passthrough:///"+nodeID, opts...)
+}
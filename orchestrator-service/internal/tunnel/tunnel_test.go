@@ -0,0 +1,194 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+
+	"hysteria2_microservices/pkg/tunnelconn"
+)
+
+// pipeStream is one end of an in-memory data stream
+type pipeStream struct {
+	in   chan []byte
+	out  chan []byte
+	once sync.Once
+}
+
+func newPipe() (*pipeStream, *pipeStream) {
+	a, b := make(chan []byte, 16), make(chan []byte, 16)
+	return &pipeStream{in: a, out: b}, &pipeStream{in: b, out: a}
+}
+
+func (p *pipeStream) Send(data []byte) error {
+	p.out <- data
+	return nil
+}
+
+func (p *pipeStream) Recv() ([]byte, error) {
+	data, ok := <-p.in
+	if !ok {
+		return nil, io.EOF
+	}
+	return data, nil
+}
+
+func (p *pipeStream) close() error {
+	p.once.Do(func() { close(p.out) })
+	return nil
+}
+
+// chanListener is the agent's side: the connections it opened over the tunnel
+type chanListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (l *chanListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *chanListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *chanListener) Addr() net.Addr { return tunnelconn.Addr("agent") }
+
+// serveTunnel opens a tunnel for nodeID whose dials are answered by listener
+func serveTunnel(ctx context.Context, t *testing.T, r *Registry, nodeID string, listener *chanListener) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- r.Serve(ctx, nodeID, func(connID string) error {
+			orchestrator, agent := newPipe()
+			go func() {
+				closed, err := r.Accept(nodeID, connID, orchestrator)
+				if err != nil {
+					t.Errorf("Accept: %v", err)
+					return
+				}
+				<-closed
+				orchestrator.close()
+			}()
+			listener.conns <- tunnelconn.NewConn(agent, tunnelconn.Addr(nodeID), tunnelconn.Addr("orchestrator"), agent.close)
+			return nil
+		})
+	}()
+	waitConnected(t, r, nodeID)
+	return done
+}
+
+func waitConnected(t *testing.T, r *Registry, nodeID string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !r.Connected(nodeID) {
+		if time.Now().After(deadline) {
+			t.Fatal("tunnel not registered")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestDialWithoutTunnel(t *testing.T) {
+	r := NewRegistry()
+	if _, err := r.Dial(context.Background(), "node-1"); !errors.Is(err, ErrNoTunnel) {
+		t.Errorf("Dial = %v, want ErrNoTunnel", err)
+	}
+}
+
+func TestClientConnOverTunnel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listener := &chanListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+	server := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(server, health.NewServer())
+	go server.Serve(listener)
+	defer server.Stop()
+
+	r := NewRegistry()
+	serveTunnel(ctx, t, r, "node-1", listener)
+
+	// Every client connection dials the node afresh, as each RPC handler opens and closes its own
+	for i := 0; i < 2; i++ {
+		conn, err := r.ClientConn("node-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		callCtx, callCancel := context.WithTimeout(ctx, 5*time.Second)
+		resp, err := grpc_health_v1.NewHealthClient(conn).Check(callCtx, &grpc_health_v1.HealthCheckRequest{})
+		callCancel()
+		conn.Close()
+		if err != nil {
+			t.Fatalf("Check over tunnel: %v", err)
+		}
+		if resp.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+			t.Errorf("status %v", resp.Status)
+		}
+	}
+}
+
+func TestNewerTunnelReplacesOlder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := NewRegistry()
+	listener := &chanListener{conns: make(chan net.Conn, 1), closed: make(chan struct{})}
+	first := serveTunnel(ctx, t, r, "node-1", listener)
+	second := make(chan error, 1)
+	go func() {
+		second <- r.Serve(ctx, "node-1", func(string) error { return nil })
+	}()
+
+	select {
+	case err := <-first:
+		if !errors.Is(err, ErrReplaced) {
+			t.Errorf("older tunnel ended with %v, want ErrReplaced", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("older tunnel still served")
+	}
+
+	cancel()
+	<-second
+	if r.Connected("node-1") {
+		t.Error("node still connected after its tunnel ended")
+	}
+}
+
+func TestAcceptRejectsOtherNodes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := NewRegistry()
+	dials := make(chan string, 1)
+	go r.Serve(ctx, "node-1", func(connID string) error {
+		dials <- connID
+		return nil
+	})
+	waitConnected(t, r, "node-1")
+
+	go r.Dial(ctx, "node-1")
+	connID := <-dials
+	stream, _ := newPipe()
+	if _, err := r.Accept("node-2", connID, stream); !errors.Is(err, ErrUnknownDial) {
+		t.Errorf("Accept by another node = %v, want ErrUnknownDial", err)
+	}
+	if _, err := r.Accept("node-1", connID, stream); err != nil {
+		t.Errorf("Accept by the dialed node: %v", err)
+	}
+}
@@ -0,0 +1,547 @@
+// Package events carries events between the services over NATS JetStream. Events are kept
+// in a stream for a retention period and read through durable consumers that remember what
+// they acknowledged, so a service that was down picks up the events it missed once it is
+// back. Publishers hold events in an outbox while NATS is unreachable.
+package events
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// StreamName is the stream every service publishes to
+const StreamName = "HVPN_EVENTS"
+
+// Subjects of the stream; node and source tokens come from the publisher
+const (
+	streamSubjects    = "hvpn.>"
+	HeartbeatSubjects = "hvpn.nodes.*.heartbeat"
+	TrafficSubjects   = "hvpn.nodes.*.traffic"
+	AuditSubjects     = "hvpn.audit.>"
+)
+
+// Event types
+const (
+	TypeHeartbeat = "node.heartbeat"
+	TypeTraffic   = "node.traffic"
+	TypeAudit     = "audit"
+)
+
+const (
+	publishTimeout   = 5 * time.Second
+	outboxRetry      = time.Second
+	fetchWait        = 5 * time.Second
+	consumerRetry    = 5 * time.Second
+	defaultMaxAge    = 72 * time.Hour
+	defaultOutbox    = 10000
+	defaultRedeliver = 10 * time.Second
+	reconnectWait    = 2 * time.Second
+)
+
+// errNotConnected is returned by a publish while the connection to NATS is down
+var errNotConnected = errors.New("not connected to NATS")
+
+// HeartbeatSubject is where a node's heartbeats are published
+func HeartbeatSubject(nodeID string) string {
+	return "hvpn.nodes." + token(nodeID) + ".heartbeat"
+}
+
+// TrafficSubject is where a node's traffic samples are published
+func TrafficSubject(nodeID string) string {
+	return "hvpn.nodes." + token(nodeID) + ".traffic"
+}
+
+// AuditSubject is where a service publishes its audit events
+func AuditSubject(source string) string {
+	return "hvpn.audit." + token(source)
+}
+
+// token makes s a single subject token
+func token(s string) string {
+	if s == "" {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', ' ', '\t', '\r', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// Event is the envelope of everything on the bus
+type Event struct {
+	ID     string          `json:"id"` // unique, publishes and deliveries may repeat
+	Type   string          `json:"type"`
+	Source string          `json:"source"` // service, or "agent/<node id>"
+	Time   time.Time       `json:"time"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// Heartbeat is what a node reports about itself periodically
+type Heartbeat struct {
+	NodeID  string             `json:"node_id"`
+	Status  string             `json:"status"`
+	Metrics map[string]float64 `json:"metrics"`
+}
+
+// TrafficSample is the traffic of a user, or one of their devices, a node counted since its
+// previous sample
+type TrafficSample struct {
+	UserID     string    `json:"user_id"`
+	DeviceID   string    `json:"device_id,omitempty"`
+	Upload     int64     `json:"upload"`
+	Download   int64     `json:"download"`
+	RecordedAt time.Time `json:"recorded_at"`
+}
+
+// TrafficBatch is the samples of one node
+type TrafficBatch struct {
+	NodeID  string          `json:"node_id"`
+	Samples []TrafficSample `json:"samples"`
+}
+
+// AuditEvent is something done on a service worth keeping a record of
+type AuditEvent struct {
+	Actor    string            `json:"actor,omitempty"` // user ID, or empty for the service itself
+	Action   string            `json:"action"`
+	Target   string            `json:"target,omitempty"`
+	Severity string            `json:"severity"` // info, warning, error or critical
+	Message  string            `json:"message,omitempty"`
+	Details  map[string]string `json:"details,omitempty"`
+}
+
+// Options configure the connection to NATS
+type Options struct {
+	URL      string // e.g. "nats://nats:4222"; "tls://" connects over TLS
+	Name     string // client name shown by the server
+	Token    string
+	User     string
+	Password string
+}
+
+// Config configures a bus
+type Config struct {
+	Options
+	Source   string        // recorded on every event published
+	MaxAge   time.Duration // how long the stream keeps events when this service creates it, default 72h
+	Replicas int           // stream replicas in a JetStream cluster, default 1
+	Outbox   int           // events held while NATS is unreachable, default 10000
+	// OnError is told about failures of the background work, such as a handler error
+	OnError func(err error)
+}
+
+// Handler handles a delivered event. An error has the event delivered again later, unless
+// it is marked Permanent.
+type Handler func(ctx context.Context, event *Event) error
+
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent marks a handler error for an event that can never be handled, so it is not
+// delivered again
+func Permanent(err error) error {
+	return permanentError{err: err}
+}
+
+// outboxEntry is an event waiting to be published
+type outboxEntry struct {
+	subject string
+	id      string
+	data    []byte
+}
+
+// Bus publishes and consumes events. Events are published in order; while NATS is
+// unreachable they wait in a bounded outbox, which drops the oldest when full.
+type Bus struct {
+	nc  *nats.Conn
+	js  jetstream.JetStream
+	cfg Config
+
+	mu      sync.Mutex
+	outbox  []outboxEntry
+	dropped atomic.Int64
+	wake    chan struct{}
+
+	stopChan chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// New connects a bus; NATS need not be reachable yet
+func New(cfg Config) (*Bus, error) {
+	if cfg.MaxAge <= 0 {
+		cfg.MaxAge = defaultMaxAge
+	}
+	if cfg.Outbox <= 0 {
+		cfg.Outbox = defaultOutbox
+	}
+	if cfg.Name == "" {
+		cfg.Name = cfg.Source
+	}
+	if cfg.OnError == nil {
+		cfg.OnError = func(error) {}
+	}
+	nc, err := connect(cfg.Options)
+	if err != nil {
+		return nil, err
+	}
+	js, err := jetstream.New(nc)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return &Bus{
+		nc:       nc,
+		js:       js,
+		cfg:      cfg,
+		wake:     make(chan struct{}, 1),
+		stopChan: make(chan struct{}),
+	}, nil
+}
+
+// connect starts connecting to NATS and keeps reconnecting until the connection is closed.
+// It only fails for invalid options.
+func connect(opts Options) (*nats.Conn, error) {
+	u, err := url.Parse(opts.URL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid NATS URL %q", opts.URL)
+	}
+	switch u.Scheme {
+	case "nats", "tls":
+	default:
+		return nil, fmt.Errorf("invalid NATS URL %q: want nats:// or tls://", opts.URL)
+	}
+
+	natsOpts := []nats.Option{
+		nats.Name(opts.Name),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(reconnectWait),
+		// Events wait in the outbox rather than in the client while NATS is unreachable
+		nats.ReconnectBufSize(-1),
+	}
+	if opts.Token != "" {
+		natsOpts = append(natsOpts, nats.Token(opts.Token))
+	}
+	if opts.User != "" {
+		natsOpts = append(natsOpts, nats.UserInfo(opts.User, opts.Password))
+	}
+	return nats.Connect(opts.URL, natsOpts...)
+}
+
+// Start creates the stream when it is missing and publishes the outbox whenever NATS is
+// reachable
+func (b *Bus) Start(ctx context.Context) {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+
+		ensured := false
+		ticker := time.NewTicker(outboxRetry)
+		defer ticker.Stop()
+		for {
+			if !ensured && b.nc.IsConnected() {
+				if err := b.ensureStream(ctx); err != nil {
+					b.cfg.OnError(fmt.Errorf("failed to create stream %s: %w", StreamName, err))
+				} else {
+					ensured = true
+				}
+			}
+			// A stream deleted meanwhile leaves the publishes without responders
+			if ensured && errors.Is(b.flush(ctx), jetstream.ErrNoStreamResponse) {
+				ensured = false
+			}
+
+			select {
+			case <-ticker.C:
+			case <-b.wake:
+			case <-ctx.Done():
+				return
+			case <-b.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// Flush publishes the outbox right away, until it is empty or ctx is done. Call it before
+// Stop to publish the last events of a shutdown.
+func (b *Bus) Flush(ctx context.Context) error {
+	return b.flush(ctx)
+}
+
+// Stop stops the consumers and the outbox and closes the connection. Events still in the
+// outbox are lost.
+func (b *Bus) Stop() {
+	b.stopOnce.Do(func() { close(b.stopChan) })
+	b.wg.Wait()
+	b.nc.Close()
+}
+
+// Connected reports whether NATS is reachable
+func (b *Bus) Connected() bool {
+	return b.nc.IsConnected()
+}
+
+// Pending is the number of events in the outbox
+func (b *Bus) Pending() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.outbox)
+}
+
+// Dropped is the number of events dropped from a full outbox
+func (b *Bus) Dropped() int64 {
+	return b.dropped.Load()
+}
+
+// ensureStream creates the stream unless it exists. An existing stream is left as it is,
+// so services configured with different retention do not keep changing it.
+func (b *Bus) ensureStream(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, publishTimeout)
+	defer cancel()
+	_, err := b.js.Stream(ctx, StreamName)
+	if !errors.Is(err, jetstream.ErrStreamNotFound) {
+		return err
+	}
+
+	replicas := b.cfg.Replicas
+	if replicas <= 0 {
+		replicas = 1
+	}
+	_, err = b.js.CreateStream(ctx, jetstream.StreamConfig{
+		Name:       StreamName,
+		Subjects:   []string{streamSubjects},
+		Retention:  jetstream.LimitsPolicy,
+		Storage:    jetstream.FileStorage,
+		Discard:    jetstream.DiscardOld,
+		MaxAge:     b.cfg.MaxAge,
+		Replicas:   replicas,
+		Duplicates: 2 * time.Minute,
+	})
+	return err
+}
+
+// Publish queues an event with data encoded as JSON for publishing in the background, after
+// the events queued before it. It only fails when data cannot be encoded.
+func (b *Bus) Publish(subject, eventType string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s event: %w", eventType, err)
+	}
+	event := Event{
+		ID:     randomID(),
+		Type:   eventType,
+		Source: b.cfg.Source,
+		Time:   time.Now().UTC(),
+		Data:   payload,
+	}
+	encoded, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	if len(b.outbox) >= b.cfg.Outbox {
+		b.outbox = b.outbox[1:]
+		b.dropped.Add(1)
+	}
+	b.outbox = append(b.outbox, outboxEntry{subject: subject, id: event.ID, data: encoded})
+	b.mu.Unlock()
+
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// flush publishes the outbox in order until it is empty or a publish fails
+func (b *Bus) flush(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		if len(b.outbox) == 0 {
+			b.mu.Unlock()
+			return nil
+		}
+		entry := b.outbox[0]
+		b.mu.Unlock()
+
+		if !b.nc.IsConnected() {
+			return errNotConnected
+		}
+		// The stream drops a second publish of the event ID within its duplicate window, so
+		// a publish retried after a lost acknowledgement is stored once
+		pubCtx, cancel := context.WithTimeout(ctx, publishTimeout)
+		_, err := b.js.Publish(pubCtx, entry.subject, entry.data, jetstream.WithMsgID(entry.id))
+		cancel()
+		if err != nil {
+			if b.nc.IsConnected() {
+				b.cfg.OnError(fmt.Errorf("failed to publish to %s: %w", entry.subject, err))
+			}
+			return err
+		}
+
+		// Publish may have dropped the entry from a full outbox meanwhile
+		b.mu.Lock()
+		if len(b.outbox) > 0 && b.outbox[0].id == entry.id {
+			b.outbox = b.outbox[1:]
+		}
+		b.mu.Unlock()
+	}
+}
+
+// ConsumerOptions tune a consumer; zero values take the defaults
+type ConsumerOptions struct {
+	Durable       string        // consumers sharing the name share the events
+	FilterSubject string        // e.g. TrafficSubjects
+	Batch         int           // events pulled at a time, default 100
+	AckWait       time.Duration // default 30s
+	MaxDeliver    int           // default 10
+	Redeliver     time.Duration // delay before a failed event is delivered again, default 10s
+}
+
+// Consume handles the events on the filter subject until ctx is done or the bus stops. The
+// durable consumer remembers what was acknowledged, so events published while no consumer
+// ran are delivered once one does.
+func (b *Bus) Consume(ctx context.Context, opts ConsumerOptions, handler Handler) {
+	if opts.Batch <= 0 {
+		opts.Batch = 100
+	}
+	if opts.AckWait <= 0 {
+		opts.AckWait = 30 * time.Second
+	}
+	if opts.MaxDeliver <= 0 {
+		opts.MaxDeliver = 10
+	}
+	if opts.Redeliver <= 0 {
+		opts.Redeliver = defaultRedeliver
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	b.wg.Add(2)
+	go func() {
+		defer b.wg.Done()
+		select {
+		case <-b.stopChan:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+	go func() {
+		defer b.wg.Done()
+		defer cancel()
+
+		var consumer jetstream.Consumer
+		for ctx.Err() == nil {
+			if consumer == nil {
+				var err error
+				if consumer, err = b.ensureConsumer(ctx, opts); err != nil {
+					if b.nc.IsConnected() && ctx.Err() == nil {
+						b.cfg.OnError(fmt.Errorf("failed to create consumer %s: %w", opts.Durable, err))
+					}
+					sleep(ctx, consumerRetry)
+					continue
+				}
+			}
+
+			if err := b.fetch(ctx, consumer, opts, handler); err != nil && ctx.Err() == nil {
+				if errors.Is(err, jetstream.ErrConsumerNotFound) || errors.Is(err, jetstream.ErrConsumerDeleted) || !b.nc.IsConnected() {
+					consumer = nil
+				} else {
+					b.cfg.OnError(fmt.Errorf("failed to fetch from %s: %w", opts.Durable, err))
+				}
+				sleep(ctx, time.Second)
+			}
+		}
+	}()
+}
+
+// ensureConsumer creates the durable consumer, or updates it to opts when it exists
+func (b *Bus) ensureConsumer(ctx context.Context, opts ConsumerOptions) (jetstream.Consumer, error) {
+	if err := b.ensureStream(ctx); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, publishTimeout)
+	defer cancel()
+	return b.js.CreateOrUpdateConsumer(ctx, StreamName, jetstream.ConsumerConfig{
+		Durable:       opts.Durable,
+		DeliverPolicy: jetstream.DeliverAllPolicy,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       opts.AckWait,
+		MaxDeliver:    opts.MaxDeliver,
+		FilterSubject: opts.FilterSubject,
+		MaxAckPending: opts.Batch * 10,
+		ReplayPolicy:  jetstream.ReplayInstantPolicy,
+	})
+}
+
+// fetch pulls up to a batch of events, waiting at most fetchWait for the first, and handles
+// them
+func (b *Bus) fetch(ctx context.Context, consumer jetstream.Consumer, opts ConsumerOptions, handler Handler) error {
+	fetchCtx, cancel := context.WithTimeout(ctx, fetchWait)
+	defer cancel()
+	batch, err := consumer.Fetch(opts.Batch, jetstream.FetchContext(fetchCtx))
+	if err != nil {
+		return err
+	}
+	for msg := range batch.Messages() {
+		b.handle(ctx, opts, handler, msg)
+	}
+	// A batch cut short by the wait is not an error
+	if err := batch.Error(); err != nil && !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, nats.ErrTimeout) {
+		return err
+	}
+	return nil
+}
+
+func (b *Bus) handle(ctx context.Context, opts ConsumerOptions, handler Handler, msg jetstream.Msg) {
+	var event Event
+	if err := json.Unmarshal(msg.Data(), &event); err != nil {
+		b.cfg.OnError(fmt.Errorf("dropping malformed event on %s: %w", msg.Subject(), err))
+		msg.Term()
+		return
+	}
+
+	err := handler(ctx, &event)
+	var permanent permanentError
+	switch {
+	case err == nil:
+		msg.Ack()
+	case errors.As(err, &permanent):
+		b.cfg.OnError(fmt.Errorf("dropping %s event %s: %w", event.Type, event.ID, err))
+		msg.Term()
+	default:
+		b.cfg.OnError(fmt.Errorf("failed to handle %s event %s: %w", event.Type, event.ID, err))
+		msg.NakWithDelay(opts.Redeliver)
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-ctx.Done():
+	}
+}
+
+func randomID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
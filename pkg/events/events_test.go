@@ -0,0 +1,222 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// freePort reserves a port for a NATS server started later in the test
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// runServer runs an in-process NATS server with JetStream on port
+func runServer(t *testing.T, port int) {
+	srv, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      port,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Start()
+	if !srv.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server not ready")
+	}
+	t.Cleanup(srv.Shutdown)
+}
+
+func serverURL(port int) string {
+	return fmt.Sprintf("nats://127.0.0.1:%d", port)
+}
+
+// stored reads the events in the stream, in order
+func stored(t *testing.T, port int) []*jetstream.RawStreamMsg {
+	nc, err := nats.Connect(serverURL(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	js, _ := jetstream.New(nc)
+	ctx := context.Background()
+	stream, err := js.Stream(ctx, StreamName)
+	if errors.Is(err, jetstream.ErrStreamNotFound) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := stream.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msgs []*jetstream.RawStreamMsg
+	for seq := info.State.FirstSeq; seq <= info.State.LastSeq && info.State.Msgs > 0; seq++ {
+		msg, err := stream.GetMsg(ctx, seq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNewRejectsInvalidURL(t *testing.T) {
+	for _, url := range []string{"", "nats.example.com:4222", "http://nats:4222"} {
+		if _, err := New(Config{Options: Options{URL: url}}); err == nil {
+			t.Errorf("New accepted URL %q", url)
+		}
+	}
+}
+
+func TestSubjectTokens(t *testing.T) {
+	if got := HeartbeatSubject("node.1*"); got != "hvpn.nodes.node_1_.heartbeat" {
+		t.Errorf("HeartbeatSubject = %s", got)
+	}
+	if got := AuditSubject(""); got != "hvpn.audit._" {
+		t.Errorf("AuditSubject = %s", got)
+	}
+}
+
+func TestOutboxPublishesOnceReachable(t *testing.T) {
+	port := freePort(t)
+
+	bus, err := New(Config{Options: Options{URL: serverURL(port)}, Source: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bus.Stop()
+	bus.Start(context.Background())
+
+	for i := 0; i < 3; i++ {
+		if err := bus.Publish(AuditSubject("test"), TypeAudit, AuditEvent{Action: fmt.Sprint(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(200 * time.Millisecond)
+	if bus.Pending() != 3 || bus.Connected() {
+		t.Fatalf("published while NATS was down: pending %d", bus.Pending())
+	}
+
+	runServer(t, port)
+	waitFor(t, func() bool { return bus.Pending() == 0 })
+	msgs := stored(t, port)
+	if len(msgs) != 3 {
+		t.Fatalf("stream holds %d events, want 3", len(msgs))
+	}
+	for i, msg := range msgs {
+		var event Event
+		var audit AuditEvent
+		if err := json.Unmarshal(msg.Data, &event); err != nil {
+			t.Fatal(err)
+		}
+		json.Unmarshal(event.Data, &audit)
+		if audit.Action != fmt.Sprint(i) || msg.Header.Get(jetstream.MsgIDHeader) != event.ID || event.Source != "test" {
+			t.Errorf("event %d: %+v, msg id %s", i, event, msg.Header.Get(jetstream.MsgIDHeader))
+		}
+	}
+}
+
+func TestOutboxDropsOldest(t *testing.T) {
+	bus, err := New(Config{Options: Options{URL: serverURL(freePort(t))}, Source: "test", Outbox: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bus.Stop()
+
+	for i := 0; i < 5; i++ {
+		bus.Publish(AuditSubject("test"), TypeAudit, AuditEvent{Action: fmt.Sprint(i)})
+	}
+	if bus.Pending() != 2 || bus.Dropped() != 3 {
+		t.Errorf("pending %d, dropped %d; want 2 and 3", bus.Pending(), bus.Dropped())
+	}
+}
+
+func TestConsumeAcknowledges(t *testing.T) {
+	port := freePort(t)
+	runServer(t, port)
+	bus, err := New(Config{Options: Options{URL: serverURL(port)}, Source: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bus.Stop()
+	ctx := context.Background()
+	bus.Start(ctx)
+
+	for _, action := range []string{"ok", "retry", "never"} {
+		bus.Publish(AuditSubject("test"), TypeAudit, AuditEvent{Action: action})
+	}
+	waitFor(t, func() bool { return len(stored(t, port)) == 3 })
+
+	var mu sync.Mutex
+	deliveries := make(map[string]int)
+	count := func(action string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return deliveries[action]
+	}
+	bus.Consume(ctx, ConsumerOptions{Durable: "test", FilterSubject: AuditSubjects, Redeliver: 100 * time.Millisecond}, func(ctx context.Context, event *Event) error {
+		var audit AuditEvent
+		json.Unmarshal(event.Data, &audit)
+		mu.Lock()
+		deliveries[audit.Action]++
+		n := deliveries[audit.Action]
+		mu.Unlock()
+		switch {
+		case audit.Action == "retry" && n == 1:
+			return errors.New("not now")
+		case audit.Action == "never":
+			return Permanent(errors.New("cannot be handled"))
+		}
+		return nil
+	})
+
+	// The failed event is delivered again after the redelivery delay
+	waitFor(t, func() bool { return count("retry") == 2 })
+	time.Sleep(300 * time.Millisecond)
+	if count("ok") != 1 || count("never") != 1 || count("retry") != 2 {
+		t.Errorf("deliveries ok %d, retry %d, never %d; want the handled and the permanently failed event delivered once", count("ok"), count("retry"), count("never"))
+	}
+
+	nc, _ := nats.Connect(serverURL(port))
+	defer nc.Close()
+	js, _ := jetstream.New(nc)
+	consumer, err := js.Consumer(ctx, StreamName, "test")
+	if err != nil {
+		t.Fatalf("durable consumer not created: %v", err)
+	}
+	waitFor(t, func() bool {
+		info, err := consumer.Info(ctx)
+		return err == nil && info.NumAckPending == 0 && info.AckFloor.Stream == 3
+	})
+}
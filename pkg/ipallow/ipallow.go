@@ -0,0 +1,72 @@
+package ipallow
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// List is a set of networks clients may connect from. An empty list restricts nothing.
+type List []netip.Prefix
+
+// ParsePrefix parses a network in CIDR notation, or a single address, which stands for a /32
+// or /128. Host bits are masked off and IPv4-mapped IPv6 networks become IPv4 ones.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid network %q", s)
+		}
+		addr = addr.Unmap().WithZone("")
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid network %q", s)
+	}
+	if addr := prefix.Addr(); addr.Is4In6() {
+		bits := prefix.Bits() - 96
+		if bits < 0 {
+			return netip.Prefix{}, fmt.Errorf("invalid network %q: wider than the IPv4-mapped range", s)
+		}
+		prefix = netip.PrefixFrom(addr.Unmap(), bits)
+	}
+	return prefix.Masked(), nil
+}
+
+// Parse parses networks as ParsePrefix does
+func Parse(networks []string) (List, error) {
+	list := make(List, 0, len(networks))
+	for _, network := range networks {
+		prefix, err := ParsePrefix(network)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, prefix)
+	}
+	return list, nil
+}
+
+// Contains reports whether the address is in one of the networks. Addresses that do not
+// parse are in none.
+func (l List) Contains(ip string) bool {
+	addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap().WithZone("")
+	for _, prefix := range l {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows reports whether a client at ip may connect: always when the list is empty,
+// otherwise when one of the networks contains it
+func (l List) Allows(ip string) bool {
+	return len(l) == 0 || l.Contains(ip)
+}
@@ -0,0 +1,56 @@
+package ipallow
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePrefix(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"10.0.0.0/8", "10.0.0.0/8"},
+		{" 192.168.1.77/24 ", "192.168.1.0/24"},
+		{"203.0.113.5", "203.0.113.5/32"},
+		{"2001:db8::1", "2001:db8::1/128"},
+		{"2001:db8:1::/48", "2001:db8:1::/48"},
+		{"::ffff:10.1.0.0/112", "10.1.0.0/16"},
+		{"::ffff:10.1.2.3", "10.1.2.3/32"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			prefix, err := ParsePrefix(tt.in)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, prefix.String())
+		})
+	}
+
+	for _, in := range []string{"", "10.0.0.0/33", "example.com", "::ffff:0:0/80"} {
+		_, err := ParsePrefix(in)
+		assert.Error(t, err, in)
+	}
+}
+
+func TestListAllows(t *testing.T) {
+	list, err := Parse([]string{"10.0.0.0/8", "2001:db8::/32", "198.51.100.7"})
+	require.NoError(t, err)
+
+	assert.True(t, list.Allows("10.20.30.40"))
+	assert.True(t, list.Allows("::ffff:10.20.30.40"))
+	assert.True(t, list.Allows("2001:db8::42"))
+	assert.True(t, list.Allows("198.51.100.7"))
+	assert.False(t, list.Allows("198.51.100.8"))
+	assert.False(t, list.Allows("2001:db9::1"))
+	assert.False(t, list.Allows("not-an-ip"))
+	assert.False(t, list.Allows(""))
+
+	var empty List
+	assert.True(t, empty.Allows("203.0.113.1"))
+	assert.False(t, empty.Contains("203.0.113.1"))
+
+	_, err = Parse([]string{"10.0.0.0/8", "bogus"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,82 @@
+// Package secretstore reads secrets from the external stores the services share: fields of
+// HashiCorp Vault KV version 2 secrets and AWS KMS ciphertext blobs. Each provider's Get
+// takes the name part of a "<provider>:<name>" reference.
+package secretstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// VaultProvider reads fields of HashiCorp Vault KV version 2 secrets. A name is
+// "<path>#<field>"; the field defaults to "value".
+type VaultProvider struct {
+	addr      string
+	token     string
+	namespace string
+	mount     string
+	client    *http.Client
+}
+
+// NewVaultProvider creates a provider for the Vault server at addr. The KV mount defaults
+// to "secret".
+func NewVaultProvider(addr, token, namespace, mount string) *VaultProvider {
+	if mount == "" {
+		mount = "secret"
+	}
+	return &VaultProvider{
+		addr:      strings.TrimRight(addr, "/"),
+		token:     token,
+		namespace: namespace,
+		mount:     strings.Trim(mount, "/"),
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Get reads one field of the latest version of a secret
+func (p *VaultProvider) Get(ctx context.Context, name string) (string, error) {
+	path, field, _ := strings.Cut(name, "#")
+	if field == "" {
+		field = "value"
+	}
+
+	endpoint := fmt.Sprintf("%s/v1/%s/data/%s", p.addr, p.mount, (&url.URL{Path: strings.Trim(path, "/")}).EscapedPath())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", p.token)
+	if p.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", p.namespace)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("vault request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("vault returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var secret struct {
+		Data struct {
+			Data map[string]interface{} `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return "", fmt.Errorf("invalid vault response: %w", err)
+	}
+	value, ok := secret.Data.Data[field].(string)
+	if !ok || value == "" {
+		return "", fmt.Errorf("vault secret %s has no field %s", path, field)
+	}
+	return value, nil
+}
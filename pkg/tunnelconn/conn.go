@@ -0,0 +1,127 @@
+// Package tunnelconn runs a connection over a data stream of the node tunnel. The
+// orchestrator and the agent each hold one end of the stream and see it as a net.Conn.
+package tunnelconn
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxFrame is the most data a single frame carries
+const maxFrame = 32 * 1024
+
+// Stream is one data stream of the tunnel, carrying the bytes of a single connection
+type Stream interface {
+	Send(data []byte) error
+	Recv() ([]byte, error)
+}
+
+// conn adapts a Stream to net.Conn
+type conn struct {
+	stream Stream
+	local  net.Addr
+	remote net.Addr
+
+	writeMu sync.Mutex
+	readMu  sync.Mutex
+	pending []byte
+
+	closeOnce sync.Once
+	closeFn   func() error
+	closed    chan struct{}
+}
+
+// NewConn returns a connection over stream; closeFn ends the stream and is called once, on
+// the first Close
+func NewConn(stream Stream, local, remote net.Addr, closeFn func() error) net.Conn {
+	return &conn{
+		stream:  stream,
+		local:   local,
+		remote:  remote,
+		closeFn: closeFn,
+		closed:  make(chan struct{}),
+	}
+}
+
+func (c *conn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for len(c.pending) == 0 {
+		data, err := c.stream.Recv()
+		if err != nil {
+			if c.isClosed() {
+				return 0, net.ErrClosed
+			}
+			if errors.Is(err, io.EOF) {
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+		c.pending = data
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *conn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.isClosed() {
+		return 0, net.ErrClosed
+	}
+	written := 0
+	for written < len(p) {
+		end := written + maxFrame
+		if end > len(p) {
+			end = len(p)
+		}
+		// The stream may hold on to the slice until it is sent
+		chunk := append([]byte(nil), p[written:end]...)
+		if err := c.stream.Send(chunk); err != nil {
+			return written, err
+		}
+		written = end
+	}
+	return written, nil
+}
+
+func (c *conn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		if c.closeFn != nil {
+			err = c.closeFn()
+		}
+	})
+	return err
+}
+
+func (c *conn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *conn) LocalAddr() net.Addr  { return c.local }
+func (c *conn) RemoteAddr() net.Addr { return c.remote }
+
+// Deadlines are not supported: gRPC, the only user of these connections, bounds its calls
+// with contexts and detects dead connections with keepalive pings
+func (c *conn) SetDeadline(time.Time) error      { return nil }
+func (c *conn) SetReadDeadline(time.Time) error  { return nil }
+func (c *conn) SetWriteDeadline(time.Time) error { return nil }
+
+// Addr is the address of either end of a tunnel, named after the node
+type Addr string
+
+func (a Addr) Network() string { return "tunnel" }
+func (a Addr) String() string  { return string(a) }
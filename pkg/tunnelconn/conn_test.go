@@ -0,0 +1,69 @@
+package tunnelconn
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// pipeStream is one end of an in-memory data stream
+type pipeStream struct {
+	in   chan []byte
+	out  chan []byte
+	once sync.Once
+}
+
+func newPipe() (*pipeStream, *pipeStream) {
+	a, b := make(chan []byte, 16), make(chan []byte, 16)
+	return &pipeStream{in: a, out: b}, &pipeStream{in: b, out: a}
+}
+
+func (p *pipeStream) Send(data []byte) error {
+	p.out <- data
+	return nil
+}
+
+func (p *pipeStream) Recv() ([]byte, error) {
+	data, ok := <-p.in
+	if !ok {
+		return nil, io.EOF
+	}
+	return data, nil
+}
+
+func (p *pipeStream) close() error {
+	p.once.Do(func() { close(p.out) })
+	return nil
+}
+
+func TestConnCarriesLargeWrites(t *testing.T) {
+	a, b := newPipe()
+	left := NewConn(a, Addr("a"), Addr("b"), a.close)
+	right := NewConn(b, Addr("b"), Addr("a"), b.close)
+
+	payload := make([]byte, 3*maxFrame+17)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	go func() {
+		left.Write(payload)
+		left.Close()
+	}()
+	got, err := io.ReadAll(right)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(payload) {
+		t.Fatalf("read %d bytes, want %d", len(got), len(payload))
+	}
+	for i := range got {
+		if got[i] != payload[i] {
+			t.Fatalf("byte %d differs", i)
+		}
+	}
+	if _, err := left.Write([]byte("x")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("write after close = %v", err)
+	}
+}